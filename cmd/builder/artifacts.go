@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fsusage"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// targetAttrs are the attributes of the NixOS system that builds of targets
+// other than netboot build. The configuration has to import the module
+// that defines the attribute, such as installer/cd-dvd/iso-image.nix.
+var targetAttrs = map[string]string{
+	models.BuildTargetISO:     "config.system.build.isoImage",
+	models.BuildTargetSDImage: "config.system.build.sdImage",
+	models.BuildTargetKexec:   "config.system.build.kexecTree",
+}
+
+// targetFiles finds the files a build of target linked to resultPath. ISO
+// and SD image builds produce one image, in a subdirectory of the result;
+// a kexec tree is a kernel, an initrd, and the kexec-boot script that loads
+// them, all of which are published.
+func targetFiles(target, resultPath string) ([]string, error) {
+	var pattern string
+	switch target {
+	case models.BuildTargetISO:
+		pattern = filepath.Join(resultPath, "iso", "*.iso")
+	case models.BuildTargetSDImage:
+		pattern = filepath.Join(resultPath, "sd-image", "*.img*")
+	case models.BuildTargetKexec:
+		pattern = filepath.Join(resultPath, "*")
+	default:
+		return nil, fmt.Errorf("unknown build target %q", target)
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if target != models.BuildTargetKexec && len(files) != 1 {
+		return nil, fmt.Errorf("Expected one %s image in the build result, found %d", target, len(files))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Build result has no files")
+	}
+	return files, nil
+}
+
+// publishArtifacts copies the files of a build of an installer or bundle to
+// the target's directory under outputPath, replacing the last build's of
+// the same target, and returns the URL they are served under: the image's
+// for single image targets, and the directory's for kexec bundles. The
+// build's ID is written next to them, as models.BuildArtifactMarker.
+func publishArtifacts(build *models.BuildRequest, machine *models.Machine, resultPath, outputPath string) (string, error) {
+	files, err := targetFiles(build.Target, resultPath)
+	if err != nil {
+		return "", err
+	}
+
+	// The files are gathered in a staging directory and swapped in, so a
+	// download never sees half of one build's bundle and half of another's
+	dir := filepath.Join(outputPath, build.Target)
+	staging := dir + ".tmp"
+	os.RemoveAll(staging)
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return "", fmt.Errorf("Failed to create artifact directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+
+	for _, file := range files {
+		if err := copyArtifact(file, filepath.Join(staging, filepath.Base(file))); err != nil {
+			return "", fmt.Errorf("Failed to copy %s: %v", filepath.Base(file), err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(staging, models.BuildArtifactMarker), []byte(build.ID+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("Failed to write build ID: %v", err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("Failed to remove previous artifacts: %v", err)
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		return "", fmt.Errorf("Failed to publish artifacts: %v", err)
+	}
+
+	url := fmt.Sprintf("/images/machines/%s/%s", machine.ServiceTag, build.Target)
+	if build.Target != models.BuildTargetKexec {
+		url += "/" + filepath.Base(files[0])
+	}
+	return url, nil
+}
+
+// copyArtifact copies a file out of the nix store, following the symlinks
+// of link farms such as the kexec tree. Images run to gigabytes, so unlike
+// copyFile it streams them.
+func copyArtifact(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// measureArtifacts returns the size of what a build published to dir: the
+// files under it, or only the files directly in it if recursive is false.
+// A build's size is only recorded, so a failure to measure it is logged
+// rather than failing the build.
+func measureArtifacts(dir string, recursive bool) int64 {
+	if recursive {
+		bytes, err := fsusage.DirBytes(dir)
+		if err != nil {
+			log.Printf("Failed to measure artifacts in %s: %v", dir, err)
+		}
+		return bytes
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to measure artifacts in %s: %v", dir, err)
+		return 0
+	}
+	var bytes int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			bytes += info.Size()
+		}
+	}
+	return bytes
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// writeFiles creates files under dir, relative path to contents
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// assertFile checks that path holds contents
+func assertFile(t *testing.T, path, contents string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("read %s: %v", path, err)
+		return
+	}
+	if string(data) != contents {
+		t.Errorf("%s = %q, want %q", path, data, contents)
+	}
+}
+
+func TestPublishNetboot(t *testing.T) {
+	result, output := t.TempDir(), t.TempDir()
+	writeFiles(t, result, map[string]string{"kernel": "kernel-1", "initrd": "initrd-1"})
+
+	// The last build's files are replaced, even though the store's copies
+	// are read-only
+	writeFiles(t, output, map[string]string{"bzImage": "kernel-0"})
+	os.Chmod(filepath.Join(output, "bzImage"), 0644)
+
+	if err := publishNetboot(result, output); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(output, "bzImage"), "kernel-1")
+	assertFile(t, filepath.Join(output, "initrd"), "initrd-1")
+
+	// Published files are writable, so the next build can replace them
+	info, err := os.Stat(filepath.Join(output, "initrd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("initrd mode = %v, want 0644", info.Mode().Perm())
+	}
+}
+
+func TestPublishNetbootMissingInitrd(t *testing.T) {
+	result, output := t.TempDir(), t.TempDir()
+	writeFiles(t, result, map[string]string{"kernel": "kernel-1"})
+
+	err := publishNetboot(result, output)
+	if err == nil || !strings.Contains(err.Error(), "initrd") {
+		t.Errorf("err = %v, want a failure to copy the initrd", err)
+	}
+}
+
+func TestPublishArtifactsISO(t *testing.T) {
+	result, output := t.TempDir(), t.TempDir()
+	writeFiles(t, result, map[string]string{"iso/nixos-24.05-x86_64-linux.iso": "iso-2"})
+	writeFiles(t, output, map[string]string{"iso/nixos-old.iso": "iso-1", "bzImage": "kernel"})
+
+	build := &models.BuildRequest{ID: "build-2", Target: models.BuildTargetISO}
+	machine := &models.Machine{ServiceTag: "ABC123"}
+
+	url, err := publishArtifacts(build, machine, result, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/images/machines/ABC123/iso/nixos-24.05-x86_64-linux.iso"; url != want {
+		t.Errorf("url = %q, want %q", url, want)
+	}
+
+	assertFile(t, filepath.Join(output, "iso", "nixos-24.05-x86_64-linux.iso"), "iso-2")
+	assertFile(t, filepath.Join(output, "iso", models.BuildArtifactMarker), "build-2\n")
+	if _, err := os.Stat(filepath.Join(output, "iso", "nixos-old.iso")); !os.IsNotExist(err) {
+		t.Errorf("the last build's image is still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "iso.tmp")); !os.IsNotExist(err) {
+		t.Errorf("the staging directory is left behind: %v", err)
+	}
+
+	// The machine's own image is left alone
+	assertFile(t, filepath.Join(output, "bzImage"), "kernel")
+}
+
+func TestPublishArtifactsKexecFollowsLinks(t *testing.T) {
+	store, result, output := t.TempDir(), t.TempDir(), t.TempDir()
+
+	// A kexec tree is a link farm into the store
+	writeFiles(t, store, map[string]string{"bzImage": "kernel", "initrd": "initrd", "kexec-boot": "#!/bin/sh\n"})
+	for _, name := range []string{"bzImage", "initrd", "kexec-boot"} {
+		if err := os.Symlink(filepath.Join(store, name), filepath.Join(result, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := &models.BuildRequest{ID: "build-1", Target: models.BuildTargetKexec}
+	url, err := publishArtifacts(build, &models.Machine{ServiceTag: "ABC123"}, result, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/images/machines/ABC123/kexec"; url != want {
+		t.Errorf("url = %q, want %q", url, want)
+	}
+
+	for name, contents := range map[string]string{"bzImage": "kernel", "initrd": "initrd", "kexec-boot": "#!/bin/sh\n"} {
+		path := filepath.Join(output, "kexec", name)
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("%s is %v, want a copy rather than a link", name, info.Mode())
+		}
+		assertFile(t, path, contents)
+	}
+}
+
+func TestPublishArtifactsWantsOneImage(t *testing.T) {
+	machine := &models.Machine{ServiceTag: "ABC123"}
+
+	for name, files := range map[string]map[string]string{
+		"no image":   {"iso/README": "not an image"},
+		"two images": {"iso/a.iso": "a", "iso/b.iso": "b"},
+	} {
+		result, output := t.TempDir(), t.TempDir()
+		writeFiles(t, result, files)
+		writeFiles(t, output, map[string]string{"iso/previous.iso": "previous"})
+
+		build := &models.BuildRequest{ID: "build-1", Target: models.BuildTargetISO}
+		if _, err := publishArtifacts(build, machine, result, output); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+
+		// A failed build leaves the last build's image in place
+		assertFile(t, filepath.Join(output, "iso", "previous.iso"), "previous")
+	}
+}
+
+func TestMeasureArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bzImage": "12345", "initrd": "123", "iso/image.iso": "1234567890"})
+
+	if got := measureArtifacts(dir, false); got != 8 {
+		t.Errorf("own files = %d bytes, want 8", got)
+	}
+	if got := measureArtifacts(dir, true); got != 18 {
+		t.Errorf("all files = %d bytes, want 18", got)
+	}
+}
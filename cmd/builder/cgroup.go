@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+)
+
+type cgroupMode int
+
+const (
+	cgroupNone cgroupMode = iota
+	cgroupSystemd
+	cgroupDirect
+)
+
+// cpuPeriod is the cgroup CPU accounting period, in microseconds
+const cpuPeriod = 100000
+
+// cgroupLimiter enforces build memory and CPU limits. It runs builds in a
+// transient systemd scope when systemd is usable, and otherwise manages
+// child cgroups of a cgroup v2 directory itself. When neither works, builds
+// still run, with only the timeout and disk quota enforced.
+type cgroupLimiter struct {
+	mode   cgroupMode
+	root   string
+	runner command.Runner
+}
+
+// newCgroupLimiter picks how to enforce limits on this host. root is the
+// cgroup v2 directory used when systemd isn't available.
+func newCgroupLimiter(root string, runner command.Runner) *cgroupLimiter {
+	c := &cgroupLimiter{root: root, runner: runner}
+
+	if _, err := exec.LookPath("systemd-run"); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, _, err := runner.Run(ctx, "systemd-run", "--scope", "--quiet", "--collect", "true"); err == nil {
+			c.mode = cgroupSystemd
+			log.Printf("Build limits enforced with systemd scopes")
+			return c
+		}
+	}
+
+	if root != "" {
+		err := os.MkdirAll(root, 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+		}
+		if err == nil {
+			c.mode = cgroupDirect
+			log.Printf("Build limits enforced with cgroups under %s", root)
+			return c
+		}
+		log.Printf("Cannot manage cgroups under %s: %v", root, err)
+	}
+
+	log.Printf("Memory and CPU build limits are unavailable on this host; only timeouts and disk quotas apply")
+	return c
+}
+
+// wrap returns the command line that runs name under limits, inside group
+// when limits are managed directly
+func (c *cgroupLimiter) wrap(unit string, group *buildCgroup, limits resourceLimits, name string, args []string) (string, []string) {
+	if group != nil {
+		// The shell joins the cgroup before exec, so nothing escapes it
+		return "sh", append([]string{"-c", `echo $$ > "$0/cgroup.procs" && exec "$@"`, group.dir, name}, args...)
+	}
+
+	if c.mode != cgroupSystemd || (limits.MemoryMB <= 0 && limits.CPUPercent <= 0) {
+		return name, args
+	}
+
+	wrapped := []string{"--scope", "--quiet", "--unit=" + unit}
+	if limits.MemoryMB > 0 {
+		wrapped = append(wrapped,
+			"--property=MemoryMax="+strconv.Itoa(limits.MemoryMB)+"M",
+			"--property=MemorySwapMax=0")
+	}
+	if limits.CPUPercent > 0 {
+		wrapped = append(wrapped, "--property=CPUQuota="+strconv.Itoa(limits.CPUPercent)+"%")
+	}
+	wrapped = append(wrapped, "--", name)
+
+	return "systemd-run", append(wrapped, args...)
+}
+
+// prepare creates a cgroup for a build when cgroups are managed directly,
+// with or without limits, so that the build's memory use can be measured.
+// It returns nil otherwise.
+func (c *cgroupLimiter) prepare(unit string, limits resourceLimits) (*buildCgroup, error) {
+	if c.mode != cgroupDirect {
+		return nil, nil
+	}
+
+	group := &buildCgroup{dir: filepath.Join(c.root, unit)}
+	if err := os.Mkdir(group.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if limits.MemoryMB > 0 {
+		if err := group.write("memory.max", strconv.FormatInt(int64(limits.MemoryMB)<<20, 10)); err != nil {
+			group.remove()
+			return nil, err
+		}
+		// Without swap the limit is hard; not every kernel has swap accounting
+		group.write("memory.swap.max", "0")
+	}
+	if limits.CPUPercent > 0 {
+		quota := limits.CPUPercent * cpuPeriod / 100
+		if err := group.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			group.remove()
+			return nil, err
+		}
+	}
+
+	return group, nil
+}
+
+// oomKilled reports whether the kernel killed a process of the build for
+// exceeding its memory limit
+func (c *cgroupLimiter) oomKilled(unit string, group *buildCgroup) bool {
+	switch c.mode {
+	case cgroupDirect:
+		return group.oomKills() > 0
+
+	case cgroupSystemd:
+		scope := unit + ".scope"
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		output, _, err := c.runner.Run(ctx, "systemctl", "show", "--property=Result", "--value", scope)
+		// A failed scope lingers until reset
+		c.runner.Run(ctx, "systemctl", "reset-failed", scope)
+		return err == nil && strings.TrimSpace(output) == "oom-kill"
+	}
+
+	return false
+}
+
+// buildCgroup is a cgroup holding one build's processes. A nil buildCgroup
+// is valid and does nothing.
+type buildCgroup struct {
+	dir string
+}
+
+func (g *buildCgroup) write(file, value string) error {
+	return os.WriteFile(filepath.Join(g.dir, file), []byte(value), 0644)
+}
+
+// oomKills returns how many processes the kernel killed in the cgroup
+func (g *buildCgroup) oomKills() int {
+	if g == nil {
+		return 0
+	}
+
+	f, err := os.Open(filepath.Join(g.dir, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if count, ok := strings.CutPrefix(scanner.Text(), "oom_kill "); ok {
+			n, _ := strconv.Atoi(count)
+			return n
+		}
+	}
+	return 0
+}
+
+// peakMemory returns the most memory the cgroup's processes used at once,
+// or 0 if the kernel doesn't report it; memory.peak needs Linux 5.19
+func (g *buildCgroup) peakMemory() int64 {
+	if g == nil {
+		return 0
+	}
+
+	data, err := os.ReadFile(filepath.Join(g.dir, "memory.peak"))
+	if err != nil {
+		return 0
+	}
+	peak, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return peak
+}
+
+// remove kills anything left in the cgroup and deletes it
+func (g *buildCgroup) remove() {
+	if g == nil {
+		return
+	}
+
+	// cgroup.kill needs Linux 5.14; older kernels rely on the process group kill
+	g.write("cgroup.kill", "1")
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(g.dir); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("Failed to remove cgroup %s", g.dir)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// closureDiffTimeout bounds comparing two system closures
+const closureDiffTimeout = 2 * time.Minute
+
+// recordClosure records on a machine build's result its system closure and
+// the packages that changed since the machine's previous successful build.
+// Netboot builds build the ramdisk, so their system is built separately;
+// nix already has it, as the ramdisk's input. Nothing here fails the
+// build: without a closure, or with the previous one garbage collected,
+// builds can still be compared by configuration.
+func (b *Builder) recordClosure(ctx context.Context, job *models.BuildJob, buildPath string, limits resourceLimits, result *models.BuildResult) {
+	build, machine := job.Build, job.Machine
+
+	systemLink := filepath.Join(buildPath, "result")
+	if !machine.BootsFromDisk() {
+		systemLink = filepath.Join(buildPath, "system")
+		if output, _, err := b.nixBuildTo(ctx, build.ID, buildPath, limits, "config.system.build.toplevel", systemLink); err != nil {
+			log.Printf("Failed to build system closure of build %s: %v: %s", build.ID, err, strings.TrimSpace(output))
+			return
+		}
+	}
+	systemPath, err := filepath.EvalSymlinks(systemLink)
+	if err != nil {
+		log.Printf("Failed to resolve system closure of build %s: %v", build.ID, err)
+		return
+	}
+	result.SystemPath = systemPath
+
+	previous := job.PreviousBuild
+	if previous == nil || previous.SystemPath == "" {
+		return
+	}
+	if _, err := os.Stat(previous.SystemPath); err != nil {
+		log.Printf("System closure of build %s is gone, not diffing build %s: %v", previous.ID, build.ID, err)
+	} else if diff, err := b.diffClosures(previous.SystemPath, systemPath); err != nil {
+		log.Printf("Failed to diff closures of builds %s and %s: %v", previous.ID, build.ID, err)
+	} else {
+		result.ClosureDiffFrom = previous.ID
+		result.ClosureDiff = diff
+	}
+}
+
+// diffClosures lists the packages that changed between two system
+// closures, with nvd if it is installed and nix store diff-closures if not
+func (b *Builder) diffClosures(from, to string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), closureDiffTimeout)
+	defer cancel()
+
+	stdout, stderr, err := b.runner.Run(ctx, "nvd", "diff", from, to)
+	if errors.Is(err, exec.ErrNotFound) {
+		stdout, stderr, err = b.runner.Run(ctx, "nix", "--extra-experimental-features", "nix-command",
+			"store", "diff-closures", from, to)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr))
+	}
+	return stdout, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// deployScript does what `nixos-rebuild switch --target-host` does with a
+// system closure that has already been built
+const deployScript = `#!/bin/sh
+# Deploys build %[1]s
+# Usage: deploy.sh [user@host]
+set -eu
+
+target="${1:-%[2]s}"
+system=%[3]s
+export NIX_SSHOPTS="${NIX_SSHOPTS:-%[4]s}"
+
+nix-copy-closure --to "$target" "$system"
+ssh $NIX_SSHOPTS "$target" nix-env -p /nix/var/nix/profiles/system --set "$system"
+ssh $NIX_SSHOPTS "$target" "$system/bin/switch-to-configuration" switch
+`
+
+// publishNetboot copies the kernel and initrd of a netboot build to where
+// the iPXE server serves them
+func publishNetboot(resultPath, outputPath string) error {
+	kernelSrc := filepath.Join(resultPath, "kernel")
+	initrdSrc := filepath.Join(resultPath, "initrd")
+
+	if err := copyFile(kernelSrc, filepath.Join(outputPath, "bzImage")); err != nil {
+		return fmt.Errorf("Failed to copy kernel: %v", err)
+	}
+
+	if err := copyFile(initrdSrc, filepath.Join(outputPath, "initrd")); err != nil {
+		return fmt.Errorf("Failed to copy initrd: %v", err)
+	}
+
+	return nil
+}
+
+// publishSystem keeps the system closure of a switch-mode build alive with a
+// GC root, since the result link goes away with the build directory, and
+// writes its store path and a deploy script to the output directory
+func (b *Builder) publishSystem(build *models.BuildRequest, machine *models.Machine, resultPath, outputPath string) error {
+	systemPath, err := filepath.EvalSymlinks(resultPath)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve system closure: %v", err)
+	}
+
+	root := filepath.Join(b.gcrootsDir, machine.ServiceTag)
+	if _, stderr, err := b.runner.Run(context.Background(), "nix-store", "--realise", systemPath, "--add-root", root, "--indirect"); err != nil {
+		return fmt.Errorf("Failed to add GC root: %v: %s", err, strings.TrimSpace(stderr))
+	}
+
+	if err := os.WriteFile(filepath.Join(outputPath, "system"), []byte(systemPath+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write system path: %v", err)
+	}
+
+	// The API only accepts host or host:port with a numeric port and plain
+	// user names, so all are safe to put in the script unquoted
+	host, sshOpts := machine.SSHAddress, ""
+	if h, port, err := net.SplitHostPort(machine.SSHAddress); err == nil {
+		host, sshOpts = h, "-p "+port
+	}
+
+	user := machine.SSHUser
+	if user == "" {
+		user = "root"
+	}
+
+	script := fmt.Sprintf(deployScript, build.ID, user+"@"+host, shellQuote(systemPath), sshOpts)
+	if err := os.WriteFile(filepath.Join(outputPath, "deploy.sh"), []byte(script), 0755); err != nil {
+		return fmt.Errorf("Failed to write deploy script: %v", err)
+	}
+
+	return nil
+}
+
+// shellQuote quotes s for use as a single sh word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
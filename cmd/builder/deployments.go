@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const (
+	// systemProfile is the profile NixOS boots and switches generations of
+	systemProfile = "/nix/var/nix/profiles/system"
+
+	// deployStepTimeout bounds copying the closure and each SSH command
+	deployStepTimeout = 30 * time.Minute
+
+	defaultHealthCheckTimeout = 60 * time.Second
+	healthCheckInterval       = 5 * time.Second
+)
+
+// sshKeyName matches the key file names the API accepts
+var sshKeyName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// sshTarget is how the builder reaches a machine for a deployment
+type sshTarget struct {
+	dest string   // user@host
+	opts []string // ssh options, also passed to nix-copy-closure
+}
+
+// sshTargetFor builds the SSH target of a machine. The key, if any, is a
+// file in the builder's SSH keys directory.
+func (b *Builder) sshTargetFor(machine *models.Machine) (*sshTarget, error) {
+	if machine.SSHAddress == "" {
+		return nil, fmt.Errorf("machine has no ssh_address")
+	}
+
+	host, port := machine.SSHAddress, ""
+	if h, p, err := net.SplitHostPort(machine.SSHAddress); err == nil {
+		host, port = h, p
+	}
+
+	user := machine.SSHUser
+	if user == "" {
+		user = "root"
+	}
+
+	target := &sshTarget{
+		dest: user + "@" + host,
+		opts: []string{"-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new", "-o", "ConnectTimeout=10"},
+	}
+	if port != "" {
+		target.opts = append(target.opts, "-p", port)
+	}
+	if machine.SSHKey != "" {
+		if !sshKeyName.MatchString(machine.SSHKey) {
+			return nil, fmt.Errorf("invalid ssh_key %q", machine.SSHKey)
+		}
+		target.opts = append(target.opts, "-i", filepath.Join(b.sshKeysDir, machine.SSHKey))
+	}
+
+	return target, nil
+}
+
+// deployment is a running deployment and the log it builds up
+type deployment struct {
+	*models.Deployment
+	log strings.Builder
+}
+
+func (d *deployment) logf(format string, args ...interface{}) {
+	fmt.Fprintf(&d.log, "==> "+format+"\n", args...)
+}
+
+// ssh runs a command on the machine and logs its output
+func (b *Builder) ssh(d *deployment, target *sshTarget, remoteCommand ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deployStepTimeout)
+	defer cancel()
+
+	args := append(append(append([]string{}, target.opts...), target.dest, "--"), remoteCommand...)
+	stdout, stderr, err := b.runner.Run(ctx, "ssh", args...)
+	d.log.WriteString(stderr + stdout)
+	return stdout, err
+}
+
+// deployWorker starts pending deployments as slots free up. At most
+// deployConcurrency deployments run at once, and at most MaxUnavailable of
+// any one rollout.
+func (b *Builder) deployWorker() {
+	log.Println("Deployment worker started")
+
+	b.failInterruptedDeployments()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := b.startPendingDeployments(); err != nil {
+			log.Printf("Error starting deployments: %v", err)
+		}
+	}
+}
+
+// failInterruptedDeployments fails deployments left running by a previous
+// builder process, since nothing will finish them
+func (b *Builder) failInterruptedDeployments() {
+	running, err := b.db.ListDeploymentsByStatus(models.DeploymentRunning)
+	if err != nil {
+		log.Printf("Failed to list running deployments: %v", err)
+		return
+	}
+
+	for _, d := range running {
+		b.finishDeployment(&deployment{Deployment: d}, models.DeploymentFailed, "builder restarted during deployment")
+	}
+}
+
+func (b *Builder) startPendingDeployments() error {
+	running, err := b.db.ListDeploymentsByStatus(models.DeploymentRunning)
+	if err != nil {
+		return err
+	}
+	pending, err := b.db.ListDeploymentsByStatus(models.DeploymentPending)
+	if err != nil {
+		return err
+	}
+
+	unavailable := map[string]int{}
+	for _, d := range running {
+		if d.RolloutID != "" {
+			unavailable[d.RolloutID]++
+		}
+	}
+
+	for _, d := range pending {
+		if d.RolloutID != "" && unavailable[d.RolloutID] >= d.MaxUnavailable {
+			continue
+		}
+
+		select {
+		case b.deploySlots <- struct{}{}:
+		default:
+			return nil // All slots are busy
+		}
+
+		now := time.Now()
+		d.Status = models.DeploymentRunning
+		d.StartedAt = &now
+		if err := b.db.UpdateDeployment(d); err != nil {
+			<-b.deploySlots
+			return err
+		}
+		if d.RolloutID != "" {
+			unavailable[d.RolloutID]++
+		}
+
+		go func(d *models.Deployment) {
+			defer func() { <-b.deploySlots }()
+			b.runDeployment(&deployment{Deployment: d})
+		}(d)
+	}
+
+	return nil
+}
+
+// runDeployment builds the system of the deployment's build, copies it to
+// the machine, and switches to it. If the switch or the health check fails,
+// the machine is rolled back to the generation it was running.
+func (b *Builder) runDeployment(d *deployment) {
+	log.Printf("Deploying build %s to machine %s: deployment_id=%s", d.BuildID, d.MachineID, d.ID)
+
+	machine, err := b.db.GetMachine(d.MachineID)
+	if err != nil || machine == nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("Failed to get machine: %v", err))
+		return
+	}
+	build, err := b.db.GetBuild(d.BuildID)
+	if err != nil || build == nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("Failed to get build: %v", err))
+		return
+	}
+
+	target, err := b.sshTargetFor(machine)
+	if err != nil {
+		b.finishDeployment(d, models.DeploymentFailed, err.Error())
+		return
+	}
+
+	// The closure is usually still in the store from the build, which makes
+	// this instant; netboot builds never built it
+	d.logf("Building system")
+	systemPath, err := b.buildSystem(d, build)
+	if err != nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("Failed to build system: %v", err))
+		return
+	}
+	d.SystemPath = systemPath
+
+	d.logf("Copying %s to %s", systemPath, target.dest)
+	if err := b.copyClosure(d, target, systemPath); err != nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("Failed to copy closure: %v", err))
+		return
+	}
+
+	previous, err := b.ssh(d, target, "readlink", "-f", systemProfile)
+	if err != nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("Failed to read current system: %v", err))
+		return
+	}
+	d.PreviousSystem = strings.TrimSpace(previous)
+
+	d.logf("Switching to %s", systemPath)
+	if _, err := b.ssh(d, target, "nix-env", "-p", systemProfile, "--set", systemPath); err != nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("Failed to set system profile: %v", err))
+		return
+	}
+	if _, err := b.ssh(d, target, systemPath+"/bin/switch-to-configuration", "switch"); err != nil {
+		b.rollback(d, target, fmt.Sprintf("Activation failed: %v", err))
+		return
+	}
+
+	if d.HealthCheck != nil {
+		d.logf("Running %s health check", d.HealthCheck.Type)
+		if err := b.runHealthCheck(d, target); err != nil {
+			b.rollback(d, target, fmt.Sprintf("Health check failed: %v", err))
+			return
+		}
+	}
+
+	machine.Status = models.StatusProvisioned
+	if err := b.db.UpdateMachine(machine); err != nil {
+		log.Printf("Failed to update machine: %v", err)
+	}
+
+	b.finishDeployment(d, models.DeploymentSucceeded, "")
+}
+
+// buildSystem builds the system closure of a build's configuration and
+// returns its store path
+func (b *Builder) buildSystem(d *deployment, build *models.BuildRequest) (string, error) {
+	buildPath := filepath.Join(b.buildDir, "deploy-"+d.ID)
+	if err := os.MkdirAll(buildPath, 0755); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(buildPath)
+
+	if err := os.WriteFile(filepath.Join(buildPath, "configuration.nix"), []byte(build.Config), 0644); err != nil {
+		return "", err
+	}
+
+	output, _, err := b.nixBuild(context.Background(), d.ID, buildPath, b.limitsFor(d.MachineID), "config.system.build.toplevel")
+	d.log.WriteString(output)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(filepath.Join(buildPath, "result"))
+}
+
+func (b *Builder) copyClosure(d *deployment, target *sshTarget, systemPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deployStepTimeout)
+	defer cancel()
+
+	stdout, stderr, err := b.runner.Run(ctx, "env", "NIX_SSHOPTS="+strings.Join(target.opts, " "),
+		"nix-copy-closure", "--to", target.dest, systemPath)
+	d.log.WriteString(stderr + stdout)
+	return err
+}
+
+// runHealthCheck retries the deployment's health check until it passes or
+// its timeout runs out
+func (b *Builder) runHealthCheck(d *deployment, target *sshTarget) error {
+	timeout := defaultHealthCheckTimeout
+	if d.HealthCheck.Timeout > 0 {
+		timeout = time.Duration(d.HealthCheck.Timeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for {
+		var err error
+		switch d.HealthCheck.Type {
+		case models.HealthCheckHTTP:
+			err = checkHTTP(client, d.HealthCheck.URL)
+		case models.HealthCheckCommand:
+			_, err = b.ssh(d, target, d.HealthCheck.Command)
+		default:
+			return fmt.Errorf("unknown health check type %q", d.HealthCheck.Type)
+		}
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(healthCheckInterval).After(deadline) {
+			return fmt.Errorf("%v (gave up after %s)", err, timeout)
+		}
+		d.logf("Health check failed, retrying: %v", err)
+		time.Sleep(healthCheckInterval)
+	}
+}
+
+func checkHTTP(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// rollback switches the machine back to the generation before the
+// deployment's
+func (b *Builder) rollback(d *deployment, target *sshTarget, reason string) {
+	d.logf("%s; rolling back", reason)
+
+	if _, err := b.ssh(d, target, "nix-env", "-p", systemProfile, "--rollback"); err != nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("%s; rollback failed: %v", reason, err))
+		return
+	}
+	if _, err := b.ssh(d, target, systemProfile+"/bin/switch-to-configuration", "switch"); err != nil {
+		b.finishDeployment(d, models.DeploymentFailed, fmt.Sprintf("%s; rollback failed: %v", reason, err))
+		return
+	}
+
+	b.finishDeployment(d, models.DeploymentRolledBack, reason)
+}
+
+// finishDeployment records a deployment's outcome and emits its event. A
+// failed deployment cancels the rest of its rollout.
+func (b *Builder) finishDeployment(d *deployment, status, errorMsg string) {
+	now := time.Now()
+	d.Status = status
+	d.Error = errorMsg
+	d.CompletedAt = &now
+	if d.log.Len() > 0 {
+		d.LogOutput = d.log.String()
+	}
+
+	if err := b.db.UpdateDeployment(d.Deployment); err != nil {
+		log.Printf("Failed to update deployment %s: %v", d.ID, err)
+	}
+
+	data := events.DeployFinishedData{
+		DeploymentID: d.ID,
+		BuildID:      d.BuildID,
+		Status:       status,
+		RolloutID:    d.RolloutID,
+	}
+
+	eventType := events.MachineDeployed
+	if status == models.DeploymentSucceeded {
+		log.Printf("Deployment %s to machine %s succeeded", d.ID, d.MachineID)
+		data.SystemPath = d.SystemPath
+	} else {
+		log.Printf("Deployment %s to machine %s %s: %s", d.ID, d.MachineID, status, errorMsg)
+		eventType = events.MachineDeployFailed
+		data.Error = errorMsg
+
+		if d.RolloutID != "" {
+			if n, err := b.db.CancelPendingRollout(d.RolloutID); err != nil {
+				log.Printf("Failed to cancel rollout %s: %v", d.RolloutID, err)
+			} else if n > 0 {
+				log.Printf("Cancelled %d pending deployment(s) of rollout %s", n, d.RolloutID)
+			}
+		}
+	}
+
+	b.publish(events.Event{Type: eventType, MachineID: d.MachineID, Data: data})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fsusage"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const (
+	// lowDiskRetryInterval is how long the worker waits to check again
+	// after finding a filesystem below its threshold
+	lowDiskRetryInterval = 30 * time.Second
+
+	// storeMeasureInterval is how often the size of the nix store is
+	// measured, which means walking all of it
+	storeMeasureInterval = 15 * time.Minute
+	storeMeasureTimeout  = 10 * time.Minute
+
+	// autoGCInterval is the least time between garbage collections the
+	// builder starts itself, so one that frees too little to get above
+	// the threshold isn't rerun every heartbeat
+	autoGCInterval = 15 * time.Minute
+
+	gcTimeout = time.Hour
+)
+
+// gcFreedPattern matches the summary nix-collect-garbage ends with, such as
+// "1234 store paths deleted, 567.89 MiB freed"
+var gcFreedPattern = regexp.MustCompile(`([\d.]+) MiB freed`)
+
+// diskMonitor watches the filesystems the builder writes to, measures the
+// nix store, and remembers the last garbage collection
+type diskMonitor struct {
+	// disks are the filesystems checked, with their thresholds
+	disks  []models.BuilderDisk
+	store  string
+	runner command.Runner
+
+	// gcBelow is the free space on the nix store below which the builder
+	// collects garbage by itself, freeing at most gcMaxFreed; 0 turns
+	// that off
+	gcBelow    int64
+	gcMaxFreed int64
+
+	mu         sync.Mutex
+	storeBytes int64
+	lastGC     *models.BuilderGC
+	lastAutoGC time.Time
+	low        bool
+}
+
+// health reports the current usage of the monitored filesystems. One that
+// can't be read, such as a nix store on a builder without nix, is left out.
+func (m *diskMonitor) health() *models.BuilderHealth {
+	health := &models.BuilderHealth{
+		Disks:     []models.BuilderDisk{},
+		CheckedAt: time.Now(),
+	}
+	for _, disk := range m.disks {
+		total, free, err := fsusage.Filesystem(disk.Path)
+		if err != nil {
+			continue
+		}
+		disk.TotalBytes = total
+		disk.FreeBytes = free
+		health.Disks = append(health.Disks, disk)
+	}
+
+	m.mu.Lock()
+	health.NixStoreBytes = m.storeBytes
+	if m.lastGC != nil {
+		gc := *m.lastGC
+		health.LastGC = &gc
+	}
+	m.mu.Unlock()
+
+	return health
+}
+
+// lowDisk returns the first filesystem below its threshold, or nil. It logs
+// when the builder goes low on space and when it recovers.
+func (m *diskMonitor) lowDisk() *models.BuilderDisk {
+	var low *models.BuilderDisk
+	for _, disk := range m.health().Disks {
+		if disk.Low() {
+			low = &disk
+			break
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if low != nil && !m.low {
+		log.Printf("Claiming no builds: %s (%s) has %d MiB free, below its threshold of %d MiB",
+			low.Name, low.Path, low.FreeBytes>>20, low.MinFreeBytes>>20)
+	} else if low == nil && m.low {
+		log.Printf("Disk space recovered, claiming builds again")
+	}
+	m.low = low != nil
+	return low
+}
+
+// storeFree returns the free space on the nix store's filesystem
+func (m *diskMonitor) storeFree() (int64, error) {
+	_, free, err := fsusage.Filesystem(m.store)
+	return free, err
+}
+
+// measureStore measures the size of the nix store now and then until the
+// builder exits
+func (m *diskMonitor) measureStore() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), storeMeasureTimeout)
+		size, err := m.storeSize(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to measure nix store: %v", err)
+		} else {
+			m.mu.Lock()
+			m.storeBytes = size
+			m.mu.Unlock()
+		}
+
+		time.Sleep(storeMeasureInterval)
+	}
+}
+
+// storeSize returns the size of the nix store in bytes
+func (m *diskMonitor) storeSize(ctx context.Context) (int64, error) {
+	stdout, stderr, err := m.runner.Run(ctx, "du", "-sb", m.store)
+	if err != nil {
+		return 0, fmt.Errorf("du failed: %v: %s", err, strings.TrimSpace(stderr))
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected du output %q", stdout)
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
+
+// autoGCDue reports whether the nix store is below the automatic garbage
+// collection threshold and the last automatic collection was long enough
+// ago
+func (m *diskMonitor) autoGCDue() bool {
+	if m.gcBelow <= 0 {
+		return false
+	}
+	free, err := m.storeFree()
+	if err != nil || free >= m.gcBelow {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Since(m.lastAutoGC) >= autoGCInterval
+}
+
+// gcRan reports whether the last garbage collection answered requestID
+func (m *diskMonitor) gcRan(requestID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastGC != nil && m.lastGC.RequestID == requestID
+}
+
+// collectGarbage runs nix-collect-garbage, freeing at most maxFreed bytes
+// if maxFreed is positive, and records the result for the next heartbeat.
+// requestID is the admin request it answers, or empty if the builder
+// started it itself. It returns false without collecting if a build or
+// another collection is running; builds claimed meanwhile wait for it.
+func (b *Builder) collectGarbage(requestID string, maxFreed int64) bool {
+	if !b.storeLock.TryLock() {
+		return false
+	}
+	defer b.storeLock.Unlock()
+
+	gc := &models.BuilderGC{
+		RequestID:     requestID,
+		MaxFreedBytes: maxFreed,
+		StartedAt:     time.Now(),
+	}
+	if requestID == "" {
+		b.disks.mu.Lock()
+		b.disks.lastAutoGC = gc.StartedAt
+		b.disks.mu.Unlock()
+	}
+
+	args := []string{}
+	if maxFreed > 0 {
+		args = append(args, "--max-freed", strconv.FormatInt(maxFreed, 10))
+	}
+	log.Printf("Collecting garbage (max freed: %d bytes)", maxFreed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gcTimeout)
+	defer cancel()
+	stdout, stderr, err := b.runner.Run(ctx, "nix-collect-garbage", args...)
+	gc.CompletedAt = time.Now()
+
+	// The summary is on stdout or stderr depending on the nix version
+	if match := gcFreedPattern.FindStringSubmatch(stdout + stderr); match != nil {
+		if mib, err := strconv.ParseFloat(match[1], 64); err == nil {
+			gc.FreedBytes = int64(mib * (1 << 20))
+		}
+	}
+	if err != nil {
+		gc.Error = fmt.Sprintf("nix-collect-garbage failed: %v: %s", err, strings.TrimSpace(stderr))
+		log.Printf("Garbage collection failed: %s", gc.Error)
+	} else {
+		log.Printf("Garbage collection freed %d MiB in %s", gc.FreedBytes>>20, gc.CompletedAt.Sub(gc.StartedAt).Round(time.Second))
+	}
+
+	b.disks.mu.Lock()
+	b.disks.lastGC = gc
+	b.disks.mu.Unlock()
+
+	if err == nil {
+		// Measure the store again rather than report its old size
+		// until the next measurement
+		ctx, cancel := context.WithTimeout(context.Background(), storeMeasureTimeout)
+		defer cancel()
+		if size, err := b.disks.storeSize(ctx); err == nil {
+			b.disks.mu.Lock()
+			b.disks.storeBytes = size
+			b.disks.mu.Unlock()
+		}
+	}
+	return true
+}
+
+// maybeCollectGarbage starts the garbage collection an admin asked for, if
+// it hasn't run yet, or one of the builder's own if its nix store is low on
+// space. Either waits for a heartbeat with no build running.
+func (b *Builder) maybeCollectGarbage(pending *models.BuilderGCRequest) {
+	switch {
+	case pending != nil && !b.disks.gcRan(pending.ID):
+		go b.collectGarbage(pending.ID, pending.MaxFreedBytes)
+	case b.disks.autoGCDue():
+		go b.collectGarbage("", b.disks.gcMaxFreed)
+	}
+}
+
+// handleHealth reports that the builder is up, with its disk usage
+func (b *Builder) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		*models.BuilderHealth
+	}{
+		Status:        "ok",
+		BuilderHealth: b.disks.health(),
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// dryRunBuild runs a dry-run build of a virtual machine's configuration,
+// written to buildPath: it is parsed, then the attribute a build would
+// build is evaluated to its derivation under limits, without nix-build
+// building it. Nothing is published, so the build has no artifacts and no
+// boot test.
+func (b *Builder) dryRunBuild(ctx context.Context, build *models.BuildRequest, buildPath string, machine *models.Machine, limits resourceLimits, result *models.BuildResult) error {
+	log.Printf("Dry-run building NixOS system for %s", machine.ServiceTag)
+
+	parsed, err := b.validate(ctx, build.Config)
+	if err != nil {
+		return fmt.Errorf("Failed to parse config: %v", err)
+	}
+	if !parsed.Valid {
+		result.Log = parsed.Error
+		return fmt.Errorf("Build failed: %s", parsed.Error)
+	}
+
+	attr := buildAttr(build, machine)
+	args := append([]string{
+		"<nixpkgs/nixos>",
+		"-A", attr,
+		"-I", fmt.Sprintf("nixos-config=%s/configuration.nix", buildPath),
+	}, b.nixOptions...)
+
+	output, peakMemory, err := b.runLimited(ctx, build.ID, buildPath, limits, "nix-instantiate", args...)
+	result.PeakMemoryBytes = peakMemory
+	result.Log = output
+	if err != nil {
+		return fmt.Errorf("Build failed: %v", err)
+	}
+
+	result.Log = strings.TrimRight(output, "\n") + fmt.Sprintf("\nDry run: evaluated %s; nix-build skipped, nothing published\n", attr)
+	return nil
+}
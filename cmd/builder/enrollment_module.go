@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Files of a machine build's directory. configuration.nix, which nix-build
+// is pointed at, is a wrapper importing the machine's configuration and
+// the enrollment module.
+const (
+	machineConfigFile    = "machine-configuration.nix"
+	enrollmentModuleFile = "metal-enrollment.nix"
+)
+
+// Files the enrollment module puts in machine images. api.env is an
+// environment file, for systemd's EnvironmentFile= or a shell's source,
+// setting METAL_API and MACHINE_ID, the names the kernel command line's
+// metal_api and machine_id have in the images' scripts. token holds the
+// machine's hooks token alone, readable only by root. These paths are
+// what machine configurations rely on, so they must not change.
+const (
+	enrollmentEnvPath   = "metal-enrollment/api.env"
+	enrollmentTokenPath = "metal-enrollment/token"
+)
+
+// writeMachineConfig writes a machine build's configuration to buildPath,
+// with the enrollment module, which tells the machine's image the API URL,
+// its machine ID, and its token. It returns warnings for what the image
+// goes without, which don't fail the build.
+func (b *Builder) writeMachineConfig(buildPath, config string, machine *models.Machine, token string) ([]string, error) {
+	var warnings []string
+	if b.machineAPIURL == "" {
+		warnings = append(warnings, "No API URL is configured for machine images; the image has no METAL_API")
+	}
+	if token == "" {
+		warnings = append(warnings, "No machine token was issued with the build; the image has no /etc/"+enrollmentTokenPath)
+	}
+
+	files := map[string]string{
+		machineConfigFile:    config,
+		enrollmentModuleFile: enrollmentModule(b.machineAPIURL, machine.ID, token),
+		"configuration.nix": "# Generated by the metal-enrollment builder\n" +
+			"{\n  imports = [ ./" + machineConfigFile + " ./" + enrollmentModuleFile + " ];\n}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(buildPath, name), []byte(content), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return warnings, nil
+}
+
+// enrollmentModule returns the NixOS module that puts the API URL, machine
+// ID, and token in /etc/metal-enrollment. The token ends up in the nix
+// store like the rest of the image, so it only guards against users of the
+// running system, not anyone who can read the image.
+func enrollmentModule(apiURL, machineID, token string) string {
+	var env strings.Builder
+	if apiURL != "" {
+		fmt.Fprintf(&env, "METAL_API=%s\n", apiURL)
+	}
+	fmt.Fprintf(&env, "MACHINE_ID=%s\n", machineID)
+
+	var module strings.Builder
+	module.WriteString("# Generated by the metal-enrollment builder\n{\n")
+	fmt.Fprintf(&module, "  environment.etc.%s = {\n    text = %s;\n    mode = \"0444\";\n  };\n",
+		nixString(enrollmentEnvPath), nixString(env.String()))
+	if token != "" {
+		fmt.Fprintf(&module, "  environment.etc.%s = {\n    text = %s;\n    mode = \"0400\";\n  };\n",
+			nixString(enrollmentTokenPath), nixString(token+"\n"))
+	}
+	module.WriteString("}\n")
+	return module.String()
+}
+
+// nixString quotes s as a Nix string, escaping what Nix would otherwise
+// interpret, such as ${ starting an interpolation
+func nixString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(s) + `"`
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// environmentTimeout bounds each nix command run to describe the toolchain
+const environmentTimeout = 30 * time.Second
+
+// nixpkgsInfoExpr reads the version and revision of the <nixpkgs> builds
+// use. Channels have a revision; a plain checkout may not.
+const nixpkgsInfoExpr = `let lib = import <nixpkgs/lib>; in {
+  version = lib.version;
+  revision = lib.trivial.revisionWithDefault "";
+}`
+
+// builderVersion is the module version the builder was built from, or its
+// VCS revision when built from a checkout
+var builderVersion = func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}()
+
+// captureEnvironment describes the toolchain builds run with now. Parts
+// that can't be determined are left empty.
+func (b *Builder) captureEnvironment() models.BuildEnvironment {
+	env := models.BuildEnvironment{BuilderVersion: builderVersion}
+
+	ctx, cancel := context.WithTimeout(context.Background(), environmentTimeout)
+	defer cancel()
+
+	if stdout, _, err := b.runner.Run(ctx, "nix", "--version"); err != nil {
+		log.Printf("Failed to get nix version: %v", err)
+	} else {
+		env.NixVersion = strings.TrimSpace(stdout)
+	}
+
+	stdout, _, err := b.runner.Run(ctx, "nix-instantiate", "--eval", "--strict", "--json", "-E", nixpkgsInfoExpr)
+	if err != nil {
+		log.Printf("Failed to get nixpkgs version: %v", err)
+		return env
+	}
+	var nixpkgs struct {
+		Version  string `json:"version"`
+		Revision string `json:"revision"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &nixpkgs); err != nil {
+		log.Printf("Failed to parse nixpkgs version: %v", err)
+		return env
+	}
+	env.NixpkgsVersion = nixpkgs.Version
+	env.NixpkgsRevision = nixpkgs.Revision
+
+	return env
+}
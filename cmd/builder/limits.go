@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// diskCheckInterval is how often a build's directory is measured against
+// its disk quota
+var diskCheckInterval = 5 * time.Second
+
+// Builds stopped for using too much of a resource fail with one of these,
+// so the build record says why rather than showing a bare exit status
+var (
+	errTimeLimit   = errors.New("exceeded time limit")
+	errMemoryLimit = errors.New("exceeded memory limit")
+	errDiskQuota   = errors.New("exceeded disk quota")
+)
+
+// resourceLimits are the limits applied to one build. Zero means unlimited.
+type resourceLimits struct {
+	Timeout    time.Duration
+	MemoryMB   int
+	CPUPercent int
+	DiskMB     int
+}
+
+// limitsFor returns the limits for a machine's build, looking up its
+// groups in the database
+func (b *Builder) limitsFor(machineID string) resourceLimits {
+	groups, err := b.db.GetMachineGroups(machineID)
+	if err != nil {
+		log.Printf("Failed to get groups for machine %s, using default build limits: %v", machineID, err)
+		return b.limits
+	}
+	return b.groupLimits(groups)
+}
+
+// groupLimits returns the limits for a build of a machine in groups: the
+// builder defaults, overridden by the groups. When several groups set a
+// limit, the most generous wins.
+func (b *Builder) groupLimits(groups []*models.MachineGroup) resourceLimits {
+	limits := b.limits
+
+	overridden := map[string]bool{}
+	override := func(name string, current *int, value int) {
+		if value <= 0 {
+			return
+		}
+		if !overridden[name] || value > *current {
+			*current = value
+		}
+		overridden[name] = true
+	}
+
+	timeoutMinutes := int(limits.Timeout / time.Minute)
+	for _, group := range groups {
+		if group.BuildLimits == nil {
+			continue
+		}
+		override("timeout", &timeoutMinutes, group.BuildLimits.TimeoutMinutes)
+		override("memory", &limits.MemoryMB, group.BuildLimits.MemoryMB)
+		override("cpu", &limits.CPUPercent, group.BuildLimits.CPUPercent)
+		override("disk", &limits.DiskMB, group.BuildLimits.DiskMB)
+	}
+	if overridden["timeout"] {
+		limits.Timeout = time.Duration(timeoutMinutes) * time.Minute
+	}
+
+	return limits
+}
+
+// runLimited runs a build command under limits and returns its output, and
+// the most memory it used when that can be measured (0 otherwise). The
+// runner kills the command's whole process group when the build is
+// stopped, by a limit or by ctx, so nix's children go down with it.
+func (b *Builder) runLimited(ctx context.Context, buildID, buildPath string, limits resourceLimits, name string, args ...string) (string, int64, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	if limits.Timeout > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeoutCause(ctx, limits.Timeout, fmt.Errorf("%w (%s)", errTimeLimit, limits.Timeout))
+		defer stop()
+	}
+
+	// Single-user nix builds in TMPDIR, which keeps them under the quota
+	tmpDir := filepath.Join(buildPath, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", 0, err
+	}
+	args = append([]string{"TMPDIR=" + tmpDir, name}, args...)
+
+	unit := "metal-build-" + buildID
+	group, err := b.cgroups.prepare(unit, limits)
+	if err != nil {
+		log.Printf("Build %s runs without memory and CPU limits: %v", buildID, err)
+	}
+	defer group.remove()
+
+	name, args = b.cgroups.wrap(unit, group, limits, "env", args)
+
+	if limits.DiskMB > 0 {
+		go watchDiskQuota(ctx, cancel, buildPath, int64(limits.DiskMB)<<20)
+	}
+
+	// nix logs to stderr and prints the result path on stdout
+	stdout, stderr, err := b.runner.Run(ctx, name, args...)
+	output := stderr + stdout
+	peakMemory := group.peakMemory()
+	if err == nil {
+		return output, peakMemory, nil
+	}
+
+	if ctx.Err() != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errTimeLimit) || errors.Is(cause, errDiskQuota) {
+			return output, peakMemory, cause
+		}
+	}
+	// A SIGKILL the builder didn't send is the OOM killer
+	if limits.MemoryMB > 0 && (b.cgroups.oomKilled(unit, group) || command.KilledBySignal(err)) {
+		return output, peakMemory, fmt.Errorf("%w (%d MB)", errMemoryLimit, limits.MemoryMB)
+	}
+
+	return output, peakMemory, err
+}
+
+// watchDiskQuota cancels the build once dir grows past quota bytes
+func watchDiskQuota(ctx context.Context, cancel context.CancelCauseFunc, dir string, quota int64) {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if size := dirSize(dir); size > quota {
+			cancel(fmt.Errorf("%w (%d MB)", errDiskQuota, quota>>20))
+			return
+		}
+	}
+}
+
+// dirSize totals the regular files under dir without following symlinks,
+// so the result link into the nix store isn't counted
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// runFunc is a Runner that runs a function in place of the command, for
+// builds that have to do something while they run
+type runFunc func(ctx context.Context, name string, args ...string) (string, string, error)
+
+func (f runFunc) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	return f(ctx, name, args...)
+}
+
+// newLimitedBuilder returns a builder running commands with runner under
+// cgroups managed in mode
+func newLimitedBuilder(runner command.Runner, mode cgroupMode, root string) *Builder {
+	return &Builder{
+		runner:     runner,
+		cgroups:    &cgroupLimiter{mode: mode, root: root, runner: runner},
+		nixOptions: []string{"--option", "sandbox", "true", "--option", "restrict-eval", "true"},
+	}
+}
+
+func TestNixBuildInSystemdScope(t *testing.T) {
+	runner := &command.Fake{}
+	runner.Script(command.FakeResult{Stdout: "/nix/store/abc-ramdisk\n", Stderr: "building\n"})
+	b := newLimitedBuilder(runner, cgroupSystemd, "")
+	buildPath := t.TempDir()
+
+	limits := resourceLimits{MemoryMB: 512, CPUPercent: 50}
+	output, _, err := b.nixBuild(context.Background(), "b-1", buildPath, limits, "config.system.build.netbootRamdisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "building\n/nix/store/abc-ramdisk\n" {
+		t.Errorf("output = %q, want stderr then stdout", output)
+	}
+
+	want := []string{
+		"systemd-run", "--scope", "--quiet", "--unit=metal-build-b-1",
+		"--property=MemoryMax=512M", "--property=MemorySwapMax=0", "--property=CPUQuota=50%", "--",
+		"env", "TMPDIR=" + filepath.Join(buildPath, "tmp"), "nix-build", "<nixpkgs/nixos>",
+		"-A", "config.system.build.netbootRamdisk",
+		"-I", "nixos-config=" + buildPath + "/configuration.nix",
+		"-o", filepath.Join(buildPath, "result"),
+		"--option", "sandbox", "true", "--option", "restrict-eval", "true",
+	}
+	if calls := runner.Calls(); len(calls) != 1 || !reflect.DeepEqual(calls[0], want) {
+		t.Errorf("ran %q, want %q", calls, want)
+	}
+}
+
+func TestNixBuildWithoutLimitsIsNotWrapped(t *testing.T) {
+	runner := &command.Fake{}
+	runner.Script(command.FakeResult{})
+	b := newLimitedBuilder(runner, cgroupSystemd, "")
+
+	if _, _, err := b.nixBuild(context.Background(), "b-1", t.TempDir(), resourceLimits{}, "config.system.build.toplevel"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := runner.Calls(); calls[0][0] != "env" {
+		t.Errorf("ran %q, want nix-build under env alone", calls[0])
+	}
+}
+
+func TestRunLimitedMemoryLimitInSystemdScope(t *testing.T) {
+	limits := resourceLimits{MemoryMB: 512}
+	failed := errors.New("exit status 137")
+
+	tests := []struct {
+		name   string
+		result string // the scope's result, as systemctl reports it
+		want   error
+	}{
+		{"killed by the OOM killer", "oom-kill", errMemoryLimit},
+		{"failed on its own", "exit-code", failed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &command.Fake{}
+			runner.Script(
+				command.FakeResult{Stderr: "error: builder failed\n", Err: failed},
+				command.FakeResult{Stdout: tt.result + "\n"},
+				command.FakeResult{},
+			)
+			b := newLimitedBuilder(runner, cgroupSystemd, "")
+
+			output, _, err := b.runLimited(context.Background(), "b-2", t.TempDir(), limits, "nix-build")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if tt.want == errMemoryLimit && err.Error() != "exceeded memory limit (512 MB)" {
+				t.Errorf("err = %q, want the limit in the message", err)
+			}
+			if output != "error: builder failed\n" {
+				t.Errorf("output = %q, want the build's output", output)
+			}
+
+			// The failed scope is inspected, then reset
+			calls := runner.Calls()
+			if len(calls) != 3 || calls[1][0] != "systemctl" || calls[1][len(calls[1])-1] != "metal-build-b-2.scope" ||
+				!reflect.DeepEqual(calls[2][:2], []string{"systemctl", "reset-failed"}) {
+				t.Errorf("ran %q, want systemctl show and reset-failed on the scope", calls)
+			}
+		})
+	}
+}
+
+func TestRunLimitedDirectCgroup(t *testing.T) {
+	root := t.TempDir()
+	limits := resourceLimits{MemoryMB: 256, CPUPercent: 150}
+
+	var ran []string
+	runner := runFunc(func(ctx context.Context, name string, args ...string) (string, string, error) {
+		ran = append([]string{name}, args...)
+
+		// The build joins its cgroup, which has the limits written, and
+		// the kernel kills it there
+		dir := args[2]
+		for file, want := range map[string]string{"memory.max": "268435456", "memory.swap.max": "0", "cpu.max": "150000 100000"} {
+			if data, err := os.ReadFile(filepath.Join(dir, file)); err != nil || string(data) != want {
+				t.Errorf("%s = %q, %v, want %q", file, data, err, want)
+			}
+		}
+		os.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 12\noom 1\noom_kill 1\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "memory.peak"), []byte("268435456\n"), 0644)
+		return "", "", errors.New("signal: killed")
+	})
+	b := newLimitedBuilder(runner, cgroupDirect, root)
+
+	_, peak, err := b.runLimited(context.Background(), "b-3", t.TempDir(), limits, "nix-build")
+	if !errors.Is(err, errMemoryLimit) {
+		t.Errorf("err = %v, want %v", err, errMemoryLimit)
+	}
+	if peak != 256<<20 {
+		t.Errorf("peak memory = %d, want %d", peak, 256<<20)
+	}
+	if len(ran) < 5 || ran[0] != "sh" || ran[3] != filepath.Join(root, "metal-build-b-3") || ran[4] != "env" {
+		t.Errorf("ran %q, want env run by a shell that joins the build's cgroup", ran)
+	}
+}
+
+func TestRunLimitedTimeout(t *testing.T) {
+	runner := runFunc(func(ctx context.Context, name string, args ...string) (string, string, error) {
+		<-ctx.Done()
+		return "", "still building\n", ctx.Err()
+	})
+	b := newLimitedBuilder(runner, cgroupNone, "")
+
+	start := time.Now()
+	output, _, err := b.runLimited(context.Background(), "b-4", t.TempDir(), resourceLimits{Timeout: 50 * time.Millisecond}, "nix-build")
+	if !errors.Is(err, errTimeLimit) {
+		t.Errorf("err = %v, want %v", err, errTimeLimit)
+	}
+	if output != "still building\n" {
+		t.Errorf("output = %q, want what the build wrote before it was stopped", output)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stopped after %s", elapsed)
+	}
+
+	// A build stopped for another reason isn't a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := b.runLimited(ctx, "b-4", t.TempDir(), resourceLimits{Timeout: time.Hour}, "nix-build"); errors.Is(err, errTimeLimit) {
+		t.Errorf("cancelled build failed with %v", err)
+	}
+}
+
+func TestRunLimitedDiskQuota(t *testing.T) {
+	interval := diskCheckInterval
+	diskCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { diskCheckInterval = interval })
+
+	// The build fills its directory past the quota and keeps going
+	runner := runFunc(func(ctx context.Context, name string, args ...string) (string, string, error) {
+		tmpDir := strings.TrimPrefix(args[0], "TMPDIR=")
+		if err := os.WriteFile(filepath.Join(tmpDir, "fill"), make([]byte, 2<<20), 0644); err != nil {
+			return "", "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-time.After(5 * time.Second):
+			return "", "", nil
+		}
+	})
+	b := newLimitedBuilder(runner, cgroupNone, "")
+
+	_, _, err := b.runLimited(context.Background(), "b-5", t.TempDir(), resourceLimits{DiskMB: 1}, "nix-build")
+	if !errors.Is(err, errDiskQuota) || err.Error() != "exceeded disk quota (1 MB)" {
+		t.Errorf("err = %v, want %v (1 MB)", err, errDiskQuota)
+	}
+}
+
+func TestGroupLimits(t *testing.T) {
+	b := &Builder{limits: resourceLimits{Timeout: time.Hour, MemoryMB: 4096, CPUPercent: 200, DiskMB: 10240}}
+
+	heavy := &models.MachineGroup{BuildLimits: &models.BuildLimits{TimeoutMinutes: 180, MemoryMB: 16384}}
+	heavier := &models.MachineGroup{BuildLimits: &models.BuildLimits{TimeoutMinutes: 240, MemoryMB: 8192}}
+	small := &models.MachineGroup{BuildLimits: &models.BuildLimits{CPUPercent: 50}}
+	plain := &models.MachineGroup{}
+
+	tests := []struct {
+		name   string
+		groups []*models.MachineGroup
+		want   resourceLimits
+	}{
+		{"no groups", nil, b.limits},
+		{"group without limits", []*models.MachineGroup{plain}, b.limits},
+		{"group override", []*models.MachineGroup{heavy}, resourceLimits{Timeout: 3 * time.Hour, MemoryMB: 16384, CPUPercent: 200, DiskMB: 10240}},
+		{"lower override still applies", []*models.MachineGroup{small}, resourceLimits{Timeout: time.Hour, MemoryMB: 4096, CPUPercent: 50, DiskMB: 10240}},
+		{"most generous group wins", []*models.MachineGroup{heavy, heavier, plain}, resourceLimits{Timeout: 4 * time.Hour, MemoryMB: 16384, CPUPercent: 200, DiskMB: 10240}},
+	}
+
+	for _, tt := range tests {
+		if got := b.groupLimits(tt.groups); got != tt.want {
+			t.Errorf("%s: limits = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
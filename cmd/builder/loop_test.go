@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// fakeNix stands in for nix on the builder's runner. nix-build links its
+// out link to a directory under store holding a netboot image, after
+// calling during, if set, with the build's context.
+type fakeNix struct {
+	store  string
+	during func(ctx context.Context, attr string) error
+}
+
+func (f *fakeNix) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	// Builds run under env, with TMPDIR set
+	if name == "env" && len(args) > 1 {
+		name, args = args[1], args[2:]
+	}
+
+	switch name {
+	case "nix":
+		return "nix (Nix) 2.18.1\n", "", nil
+	case "nix-instantiate":
+		return `{"version":"24.05","revision":"0123456789abcdef"}`, "", nil
+	case "nix-build":
+		return f.build(ctx, args)
+	}
+	return "", "", exec.ErrNotFound
+}
+
+func (f *fakeNix) build(ctx context.Context, args []string) (string, string, error) {
+	var attr, outLink string
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-A":
+			attr = args[i+1]
+		case "-o":
+			outLink = args[i+1]
+		}
+	}
+
+	if f.during != nil {
+		if err := f.during(ctx, attr); err != nil {
+			return "", err.Error(), err
+		}
+	}
+
+	path := filepath.Join(f.store, fmt.Sprintf("%d-%s", time.Now().UnixNano(), attr))
+	files := map[string]string{"kernel": "kernel", "initrd": "initrd"}
+	for name, contents := range files {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return "", "", err
+		}
+		if err := os.WriteFile(filepath.Join(path, name), []byte(contents), 0444); err != nil {
+			return "", "", err
+		}
+	}
+	if err := os.Symlink(path, outLink); err != nil {
+		return "", "", err
+	}
+	return path + "\n", "building '" + attr + "'\n", nil
+}
+
+// renewalCounter counts the lease renewals the server accepted, which are
+// the progress reports without a stage
+type renewalCounter struct {
+	buildQueue
+	renewals atomic.Int32
+}
+
+func (q *renewalCounter) Progress(ctx context.Context, id string, progress models.BuildProgress) error {
+	err := q.buildQueue.Progress(ctx, id, progress)
+	if err == nil && progress.Stage == "" {
+		q.renewals.Add(1)
+	}
+	return err
+}
+
+// newLoopBuilder returns a builder registered with env's API with an
+// operator's token, claiming from it and running nix as runner
+func newLoopBuilder(t *testing.T, env *testutil.Env, runner *fakeNix) (*Builder, *renewalCounter) {
+	t.Helper()
+
+	interval := leaseRenewInterval
+	leaseRenewInterval = 20 * time.Millisecond
+	t.Cleanup(func() { leaseRenewInterval = interval })
+
+	apiURL, token := env.URL("/api/v1"), env.Tokens[models.RoleOperator]
+	queue := &renewalCounter{buildQueue: &apiQueue{
+		name:   "builder-loop",
+		url:    apiURL,
+		token:  token,
+		client: env.Server.Client(),
+	}}
+	b := &Builder{
+		buildDir:      t.TempDir(),
+		outputDir:     t.TempDir(),
+		gcrootsDir:    t.TempDir(),
+		runner:        runner,
+		cgroups:       &cgroupLimiter{mode: cgroupNone, runner: runner},
+		name:          "builder-loop",
+		startedAt:     time.Now(),
+		architectures: []string{models.NormalizeArchitecture("amd64")},
+		maxBuilds:     1,
+		apiURL:        apiURL,
+		apiToken:      token,
+		client:        env.Server.Client(),
+		machineAPIURL: apiURL,
+		queue:         queue,
+		spool:         &resultSpool{dir: t.TempDir(), queue: queue},
+	}
+
+	// The API only hands builds to registered builders
+	_, err := b.register(models.RegisterBuilderRequest{
+		Name:                b.name,
+		Environment:         b.captureEnvironment(),
+		StartedAt:           b.startedAt,
+		Architectures:       b.architectures,
+		MaxConcurrentBuilds: b.maxBuilds,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, queue
+}
+
+// queueBuild triggers a build of a newly configured machine
+func queueBuild(t *testing.T, env *testutil.Env, serviceTag string) *models.BuildRequest {
+	t.Helper()
+
+	machine := env.EnrollMachine(serviceTag)
+	env.ConfigureMachine(machine.ID, testutil.FixtureConfig)
+
+	var build models.BuildRequest
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+machine.ID+"/build", nil, http.StatusCreated, &build)
+	return &build
+}
+
+// claim claims the next build as the worker does
+func claim(t *testing.T, b *Builder) *models.BuildJob {
+	t.Helper()
+
+	job, err := b.queue.Claim(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil {
+		t.Fatal("no build claimed")
+	}
+	return job
+}
+
+// assertSpoolEmpty checks that every result was acknowledged or dropped
+func assertSpoolEmpty(t *testing.T, b *Builder) {
+	t.Helper()
+
+	entries, err := os.ReadDir(b.spool.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d results left in the spool", len(entries))
+	}
+}
+
+func TestBuilderLoop(t *testing.T) {
+	env := testutil.New(t)
+	runner := &fakeNix{store: t.TempDir()}
+	b, queue := newLoopBuilder(t, env, runner)
+	build := queueBuild(t, env, "LOOP01")
+
+	job := claim(t, b)
+	if job.Build.ID != build.ID || job.Build.LeaseExpiresAt == nil {
+		t.Fatalf("claimed %+v, want build %s with a lease", job.Build, build.ID)
+	}
+	claimedUntil := *job.Build.LeaseExpiresAt
+
+	// The ramdisk build runs until the lease has been renewed a few times
+	runner.during = func(ctx context.Context, attr string) error {
+		if attr != "config.system.build.netbootRamdisk" {
+			return nil
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for queue.renewals.Load() < 3 {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("lease renewed %d times", queue.renewals.Load())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		var running models.BuildRequest
+		env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/builds/"+build.ID, nil, http.StatusOK, &running)
+		if running.Status != "building" || running.Builder != b.name {
+			return fmt.Errorf("build %s on %q while running, want building on %s", running.Status, running.Builder, b.name)
+		}
+		if running.LeaseExpiresAt == nil || !running.LeaseExpiresAt.After(claimedUntil) {
+			return fmt.Errorf("lease expires %v, want later than %v", running.LeaseExpiresAt, claimedUntil)
+		}
+		return nil
+	}
+
+	b.runJob(job)
+
+	var done models.BuildRequest
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/builds/"+build.ID, nil, http.StatusOK, &done)
+	if done.Status != "success" {
+		t.Fatalf("build %s: %s", done.Status, done.Error)
+	}
+	if done.Builder != b.name || done.ArtifactURL != "/images/machines/LOOP01" || done.SystemPath == "" {
+		t.Errorf("build = %+v, want one built by %s with its artifacts and system closure", done, b.name)
+	}
+	resp := env.Do(models.RoleViewer, http.MethodGet, "/api/v1/builds/"+build.ID+"/logs", nil)
+	logs, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(logs), "netbootRamdisk") {
+		t.Errorf("log = %q, want nix-build's output", logs)
+	}
+	assertFile(t, filepath.Join(b.outputDir, "machines", "LOOP01", "bzImage"), "kernel")
+	assertSpoolEmpty(t, b)
+
+	// Nothing else is queued
+	if job, err := b.queue.Claim(context.Background(), 0); err != nil || job != nil {
+		t.Errorf("second claim = %v, %v, want nothing", job, err)
+	}
+}
+
+func TestBuilderLoopDropsLostBuild(t *testing.T) {
+	env := testutil.New(t)
+	runner := &fakeNix{store: t.TempDir()}
+	b, _ := newLoopBuilder(t, env, runner)
+	build := queueBuild(t, env, "LOOP02")
+	job := claim(t, b)
+
+	// The lease goes to another builder mid-build, which the next renewal
+	// finds, stopping the build
+	runner.during = func(ctx context.Context, attr string) error {
+		if _, err := env.DB.Exec("UPDATE builds SET builder = ? WHERE id = ?", "builder-other", build.ID); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("build not stopped")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	b.runJob(job)
+
+	// Its result is dropped rather than reported
+	var got models.BuildRequest
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/builds/"+build.ID, nil, http.StatusOK, &got)
+	if got.Status != "building" || got.Builder != "builder-other" {
+		t.Errorf("build %s on %s, want still building on builder-other", got.Status, got.Builder)
+	}
+	assertSpoolEmpty(t, b)
+}
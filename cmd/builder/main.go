@@ -1,28 +1,102 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/notify"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/webhook"
 	"github.com/gorilla/mux"
 )
 
 type Builder struct {
-	db          *database.DB
-	buildDir    string
-	outputDir   string
-	nixosDir    string
+	db         *database.DB
+	buildDir   string
+	outputDir  string
+	nixosDir   string
+	gcrootsDir string
+	sshKeysDir string
+
+	runner     command.Runner
+	cgroups    *cgroupLimiter
+	limits     resourceLimits
+	nixOptions []string
+
+	events      *events.Publisher
+	deploySlots chan struct{}
+
+	// autoTest creates a pending boot test for every successful build.
+	// Builds that require a test get one regardless.
+	autoTest bool
+
+	// maxLogBytes caps stored build logs; longer logs lose their middle
+	maxLogBytes int
+
+	// name identifies the builder in build records and the builder list
+	name      string
+	startedAt time.Time
+
+	// architectures and labels decide which builds the builder claims, and
+	// maxBuilds how many it runs at once
+	architectures []string
+	labels        []string
+	maxBuilds     int
+
+	// apiURL and apiToken register the builder through the API; without
+	// them it registers in the database directly
+	apiURL   string
+	apiToken string
+	client   *http.Client
+
+	// machineAPIURL is the API base URL put in machine images, for
+	// machines that reach the API at a different address than the builder
+	machineAPIURL string
+
+	// signer signs the kernel and initrd of netboot images; nil if boot
+	// artifacts aren't signed
+	signer *artifactSigner
+
+	// queue is where builds are claimed and reported, through the API
+	// when there is an API URL, and spool holds results until it
+	// acknowledges them
+	queue buildQueue
+	spool *resultSpool
+
+	// service records registrations when there is no API URL
+	service *service.Service
+
+	// disks watches free space, which the builder checks before claiming
+	// a build. Builds hold storeLock for reading while they run, and
+	// garbage collection holds it for writing, so the two never overlap.
+	disks     *diskMonitor
+	storeLock sync.RWMutex
 }
 
+// claimRetryInterval is how long the worker waits to claim again after a
+// claim fails
+const claimRetryInterval = 10 * time.Second
+
+// leaseRenewInterval is how often a running build's lease is renewed,
+// well within the lease so a failed renewal or two is ridden out
+var leaseRenewInterval = models.BuildLease / 4
+
 type BuildJobRequest struct {
 	BuildID   string `json:"build_id"`
 	MachineID string `json:"machine_id"`
@@ -36,8 +110,44 @@ func main() {
 	buildDir := flag.String("build-dir", getEnv("BUILD_DIR", "/tmp/metal-builds"), "Build working directory")
 	outputDir := flag.String("output-dir", getEnv("OUTPUT_DIR", "/var/lib/metal-enrollment/images"), "Output directory for built images")
 	nixosDir := flag.String("nixos-dir", getEnv("NIXOS_DIR", "/etc/metal-enrollment/nixos"), "NixOS configurations directory")
+	gcrootsDir := flag.String("gcroots-dir", getEnv("GCROOTS_DIR", "/var/lib/metal-enrollment/gcroots"), "Directory for GC roots keeping switch-mode system closures alive")
+	buildTimeout := flag.Duration("build-timeout", parseDurationEnv("BUILD_TIMEOUT", 60*time.Minute), "Maximum duration of a build (0 for no limit)")
+	buildMemoryLimit := flag.Int("build-memory-limit", parseIntEnv("BUILD_MEMORY_LIMIT", 0), "Memory limit per build in MB (0 for no limit)")
+	buildCPULimit := flag.Int("build-cpu-limit", parseIntEnv("BUILD_CPU_LIMIT", 0), "CPU limit per build in percent of one core (0 for no limit)")
+	buildDiskQuota := flag.Int("build-disk-quota", parseIntEnv("BUILD_DISK_QUOTA", 0), "Size limit of a build's working directory in MB (0 for no limit)")
+	buildCgroup := flag.String("build-cgroup", getEnv("BUILD_CGROUP", "/sys/fs/cgroup/metal-builds"), "cgroup v2 directory for build limits when systemd is unavailable")
+	nixRestrictEval := flag.Bool("nix-restrict-eval", getEnv("NIX_RESTRICT_EVAL", "true") == "true", "Evaluate machine configurations in nix restricted mode")
+	sshKeysDir := flag.String("ssh-keys-dir", getEnv("SSH_KEYS_DIR", "/etc/metal-enrollment/ssh-keys"), "Directory of private keys that machines' ssh_key refers to")
+	deployConcurrency := flag.Int("deploy-concurrency", parseIntEnv("DEPLOY_CONCURRENCY", 4), "Maximum number of deployments running at once")
+	autoTest := flag.Bool("auto-test", getEnv("AUTO_TEST", "false") == "true", "Create a pending boot test for each successful build")
+	maxBuildLogKB := flag.Int("max-build-log-kb", parseIntEnv("MAX_BUILD_LOG_KB", 10240), "Maximum size of a stored build log in KiB; longer logs keep their start and end (0 for no limit)")
+	nixAllowedURIs := flag.String("nix-allowed-uris", getEnv("NIX_ALLOWED_URIS", ""), "Space-separated URI prefixes restricted evaluation may fetch from")
+	builderName := flag.String("builder-name", getEnv("BUILDER_NAME", ""), "Name of this builder in build records and the builder list (default: hostname)")
+	architectures := flag.String("architectures", getEnv("BUILDER_ARCHITECTURES", models.NormalizeArchitecture(runtime.GOARCH)), "Comma-separated CPU architectures this builder builds for")
+	labels := flag.String("labels", getEnv("BUILDER_LABELS", ""), "Comma-separated labels builds can require of this builder, e.g. gpu")
+	maxBuilds := flag.Int("max-concurrent-builds", parseIntEnv("MAX_CONCURRENT_BUILDS", 1), "Maximum number of builds running at once")
+	apiURL := flag.String("api-url", getEnv("API_URL", ""), "API base URL to register with and claim builds from, e.g. http://enrollment.local:8080/api/v1 (default: use the database)")
+	apiToken := flag.String("api-token", getEnv("API_TOKEN", ""), "Bearer token of an operator for registering with the API and claiming builds")
+	machineAPIURL := flag.String("machine-api-url", getEnv("MACHINE_API_URL", ""), "API base URL machine images reach the API at (default: -api-url)")
+	spoolDir := flag.String("spool-dir", getEnv("SPOOL_DIR", "/var/lib/metal-enrollment/builder-spool"), "Directory keeping build results until the server acknowledges them")
+	signingCert := flag.String("signing-cert", getEnv("SIGNING_CERT", ""), "PEM code signing certificate, and any CA certificates it chains to, for signing kernels and initrds")
+	signingKey := flag.String("signing-key", getEnv("SIGNING_KEY", ""), "PEM private key of the signing certificate")
+	nixStoreDir := flag.String("nix-store-dir", getEnv("NIX_STORE_DIR", "/nix/store"), "Nix store, whose filesystem is checked for free space and garbage collected")
+	minFreeBuildDir := flag.Int("min-free-build-dir-mb", parseIntEnv("MIN_FREE_BUILD_DIR_MB", 1024), "Free space in MB the build directory needs for the builder to claim builds (0 for no check)")
+	minFreeOutputDir := flag.Int("min-free-output-dir-mb", parseIntEnv("MIN_FREE_OUTPUT_DIR_MB", 1024), "Free space in MB the output directory needs for the builder to claim builds (0 for no check)")
+	minFreeNixStore := flag.Int("min-free-nix-store-mb", parseIntEnv("MIN_FREE_NIX_STORE_MB", 4096), "Free space in MB the nix store needs for the builder to claim builds (0 for no check)")
+	gcBelow := flag.Int("gc-below-mb", parseIntEnv("GC_BELOW_MB", 0), "Collect garbage when the nix store has less than this many MB free, between builds (0 to only collect when asked)")
+	gcMaxFreed := flag.Int("gc-max-freed-mb", parseIntEnv("GC_MAX_FREED_MB", 0), "Most MB a garbage collection the builder starts itself frees (0 for no limit)")
 	flag.Parse()
 
+	if *builderName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Failed to get hostname; set -builder-name: %v", err)
+		}
+		*builderName = hostname
+	}
+
 	// Initialize database
 	db, err := database.New(database.Config{
 		Driver: *dbDriver,
@@ -48,27 +158,110 @@ func main() {
 	}
 	defer db.Close()
 
+	nixOptions := []string{"--option", "sandbox", "true"}
+	if *nixRestrictEval {
+		nixOptions = append(nixOptions, "--option", "restrict-eval", "true")
+		if *nixAllowedURIs != "" {
+			nixOptions = append(nixOptions, "--option", "allowed-uris", *nixAllowedURIs)
+		}
+	}
+
 	builder := &Builder{
-		db:          db,
-		buildDir:    *buildDir,
-		outputDir:   *outputDir,
-		nixosDir:    *nixosDir,
+		db:         db,
+		buildDir:   *buildDir,
+		outputDir:  *outputDir,
+		nixosDir:   *nixosDir,
+		gcrootsDir: *gcrootsDir,
+		sshKeysDir: *sshKeysDir,
+		runner:     command.Exec{},
+		limits: resourceLimits{
+			Timeout:    *buildTimeout,
+			MemoryMB:   *buildMemoryLimit,
+			CPUPercent: *buildCPULimit,
+			DiskMB:     *buildDiskQuota,
+		},
+		nixOptions:  nixOptions,
+		events:      events.NewPublisher(db),
+		deploySlots: make(chan struct{}, max(*deployConcurrency, 1)),
+		autoTest:    *autoTest,
+		maxLogBytes: *maxBuildLogKB << 10,
+		name:        *builderName,
+		startedAt:   time.Now(),
+
+		architectures: splitList(*architectures, models.NormalizeArchitecture),
+		labels:        splitList(*labels, nil),
+		maxBuilds:     max(*maxBuilds, 1),
+		apiURL:        strings.TrimSuffix(*apiURL, "/"),
+		apiToken:      *apiToken,
+		client:        &http.Client{Timeout: registerTimeout},
+		machineAPIURL: strings.TrimSuffix(*machineAPIURL, "/"),
+	}
+	if builder.machineAPIURL == "" {
+		builder.machineAPIURL = builder.apiURL
+	}
+	webhooks := webhook.NewService(db)
+	webhooks.SetPublisher(builder.events)
+	builder.events.Subscribe(webhooks.HandleEvent)
+	builder.events.Subscribe(notify.NewService(db).HandleEvent)
+	builder.cgroups = newCgroupLimiter(*buildCgroup, builder.runner)
+	builder.disks = &diskMonitor{
+		disks: []models.BuilderDisk{
+			{Name: models.BuilderDiskBuildDir, Path: *buildDir, MinFreeBytes: int64(*minFreeBuildDir) << 20},
+			{Name: models.BuilderDiskOutputDir, Path: *outputDir, MinFreeBytes: int64(*minFreeOutputDir) << 20},
+			{Name: models.BuilderDiskNixStore, Path: *nixStoreDir, MinFreeBytes: int64(*minFreeNixStore) << 20},
+		},
+		store:      *nixStoreDir,
+		runner:     builder.runner,
+		gcBelow:    int64(*gcBelow) << 20,
+		gcMaxFreed: int64(*gcMaxFreed) << 20,
+	}
+
+	if builder.apiURL == "" {
+		builder.service = service.New(db, builder.events, nil, service.Config{ImagesDir: *outputDir})
+		builder.queue = &localQueue{
+			name:    builder.name,
+			service: builder.service,
+		}
+	} else {
+		builder.queue = &apiQueue{
+			name:   builder.name,
+			url:    builder.apiURL,
+			token:  builder.apiToken,
+			client: &http.Client{},
+		}
+	}
+	builder.spool = &resultSpool{dir: *spoolDir, queue: builder.queue}
+
+	if *signingCert != "" || *signingKey != "" {
+		if *signingCert == "" || *signingKey == "" {
+			log.Fatalf("Signing boot artifacts needs both -signing-cert and -signing-key")
+		}
+		builder.signer, err = newArtifactSigner(*signingCert, *signingKey)
+		if err != nil {
+			log.Fatalf("Failed to load signing certificate: %v", err)
+		}
+		log.Printf("Signing boot artifacts with %s (%s)", builder.signer.key.Subject, builder.signer.key.Fingerprint)
 	}
 
 	// Ensure directories exist
-	for _, dir := range []string{*buildDir, *outputDir} {
+	for _, dir := range []string{*buildDir, *outputDir, *gcrootsDir, *spoolDir} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			log.Fatalf("Failed to create directory %s: %v", dir, err)
 		}
 	}
 
 	// Start build worker
+	go builder.disks.measureStore()
+	go builder.heartbeat()
+	go builder.spool.retry()
 	go builder.worker()
+	go builder.deployWorker()
 
 	// Start HTTP server
 	router := mux.NewRouter()
-	router.HandleFunc("/health", handleHealth).Methods("GET")
+	router.HandleFunc("/health", builder.handleHealth).Methods("GET")
 	router.HandleFunc("/build", builder.handleBuild).Methods("POST")
+	router.HandleFunc("/validate", builder.handleValidate).Methods("POST")
 
 	log.Printf("Starting builder service on %s", *listenAddr)
 	if err := http.ListenAndServe(*listenAddr, router); err != nil {
@@ -86,7 +279,7 @@ func (b *Builder) handleBuild(w http.ResponseWriter, r *http.Request) {
 	// Build will be picked up by worker
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{
-		"status": "accepted",
+		"status":   "accepted",
 		"build_id": req.BuildID,
 	})
 }
@@ -94,173 +287,243 @@ func (b *Builder) handleBuild(w http.ResponseWriter, r *http.Request) {
 func (b *Builder) worker() {
 	log.Println("Build worker started")
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	// Only this loop takes slots, so it can't overfill them
+	slots := make(chan struct{}, b.maxBuilds)
 
-	for range ticker.C {
-		// Get pending builds
-		builds, err := b.getPendingBuilds()
-		if err != nil {
-			log.Printf("Error getting pending builds: %v", err)
+	for {
+		slots <- struct{}{}
+
+		// A build that runs out of space fails halfway through, so one
+		// that wouldn't fit is left queued for another builder
+		if b.disks.lowDisk() != nil {
+			<-slots
+			time.Sleep(lowDiskRetryInterval)
 			continue
 		}
 
-		for _, build := range builds {
-			log.Printf("Processing build %s for machine %s", build.ID, build.MachineID)
-			b.processBuild(build)
+		// Claiming is atomic, so several builders can share the queue
+		job, err := b.queue.Claim(context.Background(), models.MaxBuildClaimWait)
+		if err != nil || job == nil {
+			<-slots
+			if err != nil {
+				log.Printf("Error claiming pending build: %v", err)
+				time.Sleep(claimRetryInterval)
+			}
+			continue
 		}
+
+		go func() {
+			defer func() { <-slots }()
+
+			log.Printf("Processing build %s for machine %s", job.Build.ID, job.Build.MachineID)
+			b.runJob(job)
+		}()
 	}
 }
 
-func (b *Builder) getPendingBuilds() ([]*models.BuildRequest, error) {
-	// Query database for pending builds
-	// This is a simplified version - in production you'd want proper querying
-	query := `SELECT id, machine_id, status, config, created_at FROM builds WHERE status = 'pending' ORDER BY created_at ASC LIMIT 1`
+// runJob runs a claimed build, renewing its lease while it runs, and
+// reports the result. A build that stops being this builder's, because it
+// was cancelled or its lease ran out, is stopped and its result dropped.
+func (b *Builder) runJob(job *models.BuildJob) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go b.keepLease(ctx, cancel, job.Build.ID)
+
+	// A build claimed while garbage is being collected waits for it
+	b.storeLock.RLock()
+	result := b.processBuild(ctx, job)
+	b.storeLock.RUnlock()
+	if cause := context.Cause(ctx); errors.Is(cause, errBuildGone) {
+		log.Printf("Stopped build %s: %v", job.Build.ID, cause)
+		return
+	}
+	cancel(nil)
 
-	rows, err := b.db.Query(query)
-	if err != nil {
-		return nil, err
+	if result.Success {
+		log.Printf("Build %s completed successfully", job.Build.ID)
+	} else {
+		log.Printf("Build %s failed: %s", job.Build.ID, result.Error)
 	}
-	defer rows.Close()
+	b.spool.complete(job.Build.ID, result)
+}
 
-	var builds []*models.BuildRequest
-	for rows.Next() {
-		build := &models.BuildRequest{}
-		err := rows.Scan(&build.ID, &build.MachineID, &build.Status, &build.Config, &build.CreatedAt)
-		if err != nil {
-			return nil, err
+// keepLease renews the lease on a build until ctx is done, and stops the
+// build once the server says it is no longer this builder's
+func (b *Builder) keepLease(ctx context.Context, stop context.CancelCauseFunc, id string) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		builds = append(builds, build)
-	}
 
-	return builds, nil
+		err := b.queue.Progress(ctx, id, models.BuildProgress{Builder: b.name})
+		if errors.Is(err, errBuildGone) {
+			stop(err)
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to renew lease on build %s: %v", id, err)
+		}
+	}
 }
 
-func (b *Builder) processBuild(build *models.BuildRequest) {
-	// Update status to building
-	build.Status = "building"
-	if err := b.db.UpdateBuild(build); err != nil {
-		log.Printf("Failed to update build status: %v", err)
-		return
+// processBuild runs a build that has been claimed, and so is already
+// building, and returns how it ended
+func (b *Builder) processBuild(ctx context.Context, job *models.BuildJob) models.BuildResult {
+	started := time.Now()
+
+	// Record what the build runs with before it can fail
+	env := b.captureEnvironment()
+	if err := b.queue.Progress(ctx, job.Build.ID, models.BuildProgress{Builder: b.name, Stage: "started", Environment: &env}); err != nil {
+		log.Printf("Failed to record environment of build %s: %v", job.Build.ID, err)
+	}
+
+	result := models.BuildResult{
+		Builder:     b.name,
+		Environment: &env,
+		MaxLogBytes: b.maxLogBytes,
 	}
 
-	// Get machine details
-	machine, err := b.db.GetMachine(build.MachineID)
+	var err error
+	if job.Build.Type == models.BuildTypeRegistration {
+		err = b.runRegistrationBuild(ctx, job, &result)
+	} else {
+		err = b.runMachineBuild(ctx, job, &result)
+	}
+
+	result.Success = err == nil
 	if err != nil {
-		log.Printf("Failed to get machine: %v", err)
-		b.failBuild(build, fmt.Sprintf("Failed to get machine: %v", err))
-		return
+		result.Error = err.Error()
 	}
+	result.CompletedAt = time.Now()
+	result.DurationMS = result.CompletedAt.Sub(started).Milliseconds()
+	return result
+}
+
+// runMachineBuild builds a machine's image and publishes it under
+// images/machines
+func (b *Builder) runMachineBuild(ctx context.Context, job *models.BuildJob, result *models.BuildResult) error {
+	build, machine := job.Build, job.Machine
 
 	// Create build directory
 	buildPath := filepath.Join(b.buildDir, build.ID)
 	if err := os.MkdirAll(buildPath, 0755); err != nil {
-		b.failBuild(build, fmt.Sprintf("Failed to create build directory: %v", err))
-		return
+		return fmt.Errorf("Failed to create build directory: %v", err)
 	}
 	defer os.RemoveAll(buildPath)
 
-	// Write configuration file
-	configPath := filepath.Join(buildPath, "configuration.nix")
-	if err := os.WriteFile(configPath, []byte(build.Config), 0644); err != nil {
-		b.failBuild(build, fmt.Sprintf("Failed to write config: %v", err))
-		return
+	// Write the machine's configuration, and the enrollment module
+	// beside it
+	warnings, err := b.writeMachineConfig(buildPath, build.Config, machine, job.MachineToken)
+	if err != nil {
+		return fmt.Errorf("Failed to write config: %v", err)
+	}
+	result.Warnings = warnings
+
+	limits := b.groupLimits(job.Groups)
+	if build.DryRun {
+		return b.dryRunBuild(ctx, build, buildPath, machine, limits, result)
 	}
 
 	// Build NixOS system
 	log.Printf("Building NixOS system for %s", machine.ServiceTag)
-	output, err := b.buildNixOS(buildPath, machine)
-	build.LogOutput = output
-
+	output, peakMemory, err := b.buildNixOS(ctx, build, buildPath, machine, limits)
+	result.PeakMemoryBytes = peakMemory
+	result.Log = output
 	if err != nil {
-		b.failBuild(build, fmt.Sprintf("Build failed: %v", err))
-		return
+		return fmt.Errorf("Build failed: %v", err)
 	}
 
 	// Copy artifacts to output directory
 	outputPath := filepath.Join(b.outputDir, "machines", machine.ServiceTag)
 	if err := os.MkdirAll(outputPath, 0755); err != nil {
-		b.failBuild(build, fmt.Sprintf("Failed to create output directory: %v", err))
-		return
+		return fmt.Errorf("Failed to create output directory: %v", err)
 	}
 
-	// Extract kernel and initrd from result
+	// Installers and bundles are published next to the machine's own
+	// image, in a directory per target, so the iPXE server never serves
+	// them. They aren't boot tested, signed, or diffed.
 	resultPath := filepath.Join(buildPath, "result")
-	kernelSrc := filepath.Join(resultPath, "kernel")
-	initrdSrc := filepath.Join(resultPath, "initrd")
-
-	if err := copyFile(kernelSrc, filepath.Join(outputPath, "bzImage")); err != nil {
-		b.failBuild(build, fmt.Sprintf("Failed to copy kernel: %v", err))
-		return
+	if !build.BootsMachine() {
+		result.ArtifactURL, err = publishArtifacts(build, machine, resultPath, outputPath)
+		if err == nil {
+			result.ArtifactBytes = measureArtifacts(filepath.Join(outputPath, build.Target), true)
+		}
+		return err
 	}
 
-	if err := copyFile(initrdSrc, filepath.Join(outputPath, "initrd")); err != nil {
-		b.failBuild(build, fmt.Sprintf("Failed to copy initrd: %v", err))
-		return
+	if machine.BootsFromDisk() {
+		err = b.publishSystem(build, machine, resultPath, outputPath)
+	} else {
+		err = publishNetboot(resultPath, outputPath)
+		if err == nil {
+			result.SigningKey, err = b.signArtifacts(outputPath)
+		}
 	}
-
-	// Mark build as success
-	build.Status = "success"
-	build.ArtifactURL = fmt.Sprintf("/images/machines/%s", machine.ServiceTag)
-	now := time.Now()
-	build.CompletedAt = &now
-
-	if err := b.db.UpdateBuild(build); err != nil {
-		log.Printf("Failed to update build: %v", err)
-		return
+	if err != nil {
+		return err
 	}
 
-	// Update machine status
-	machine.Status = models.StatusReady
-	machine.LastBuildID = &build.ID
-	machine.LastBuildTime = &now
-	if err := b.db.UpdateMachine(machine); err != nil {
-		log.Printf("Failed to update machine: %v", err)
-	}
+	b.recordClosure(ctx, job, buildPath, limits, result)
 
-	log.Printf("Build %s completed successfully", build.ID)
+	// The machine's own image is the files of its directory; the
+	// directories beside them are other targets'
+	result.ArtifactBytes = measureArtifacts(outputPath, false)
+	result.ArtifactURL = fmt.Sprintf("/images/machines/%s", machine.ServiceTag)
+	result.CreateBootTest = b.autoTest
+	return nil
 }
 
-func (b *Builder) buildNixOS(buildPath string, machine *models.Machine) (string, error) {
+func (b *Builder) buildNixOS(ctx context.Context, build *models.BuildRequest, buildPath string, machine *models.Machine, limits resourceLimits) (string, int64, error) {
 	// Build the netboot system
 	// nix-build '<nixpkgs/nixos>' -A config.system.build.netbootRamdisk -I nixos-config=./configuration.nix
-
-	cmd := exec.Command("nix-build",
-		"<nixpkgs/nixos>",
-		"-A", "config.system.build.netbootRamdisk",
-		"-I", fmt.Sprintf("nixos-config=%s/configuration.nix", buildPath),
-		"-o", filepath.Join(buildPath, "result"),
-	)
-
-	cmd.Dir = buildPath
-	output, err := cmd.CombinedOutput()
-
-	return string(output), err
+	return b.nixBuild(ctx, build.ID, buildPath, limits, buildAttr(build, machine))
 }
 
-func (b *Builder) failBuild(build *models.BuildRequest, errorMsg string) {
-	log.Printf("Build %s failed: %s", build.ID, errorMsg)
+// buildAttr returns the attribute of the NixOS system a build builds: the
+// netboot ramdisk, or the system closure for machines that boot from disk,
+// which is what nixos-rebuild builds, or the attribute of the build's
+// target
+func buildAttr(build *models.BuildRequest, machine *models.Machine) string {
+	attr := "config.system.build.netbootRamdisk"
+	if machine.BootsFromDisk() {
+		attr = "config.system.build.toplevel"
+	}
+	if targetAttr, ok := targetAttrs[build.Target]; ok {
+		attr = targetAttr
+	}
+	return attr
+}
 
-	build.Status = "failed"
-	build.Error = errorMsg
-	now := time.Now()
-	build.CompletedAt = &now
+// nixBuild builds an attribute of the NixOS system in buildPath's
+// configuration.nix under limits, linking the result to buildPath/result.
+// It returns nix's output and the build's peak memory use, if measured.
+func (b *Builder) nixBuild(ctx context.Context, buildID, buildPath string, limits resourceLimits, attr string) (string, int64, error) {
+	return b.nixBuildTo(ctx, buildID, buildPath, limits, attr, filepath.Join(buildPath, "result"))
+}
 
-	if err := b.db.UpdateBuild(build); err != nil {
-		log.Printf("Failed to update build status: %v", err)
-	}
+// nixBuildTo is nixBuild linking the result to outLink
+func (b *Builder) nixBuildTo(ctx context.Context, buildID, buildPath string, limits resourceLimits, attr, outLink string) (string, int64, error) {
+	args := append([]string{
+		"<nixpkgs/nixos>",
+		"-A", attr,
+		"-I", fmt.Sprintf("nixos-config=%s/configuration.nix", buildPath),
+		"-o", outLink,
+	}, b.nixOptions...)
 
-	// Update machine status
-	machine, err := b.db.GetMachine(build.MachineID)
-	if err == nil {
-		machine.Status = models.StatusFailed
-		b.db.UpdateMachine(machine)
-	}
+	return b.runLimited(ctx, buildID, buildPath, limits, "nix-build", args...)
 }
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "OK")
+// publish publishes an event, logging rather than failing when it cannot be
+// recorded
+func (b *Builder) publish(event events.Event) {
+	if err := b.events.Publish(context.Background(), event); err != nil {
+		log.Printf("Failed to publish %s event for machine %s: %v", event.Type, event.MachineID, err)
+	}
 }
 
 func copyFile(src, dst string) error {
@@ -277,3 +540,21 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func parseDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+func parseIntEnv(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+)
+
+// errBuildGone is returned when the server no longer has a build building
+// on this builder, because it was cancelled or its lease ran out and it
+// went to another builder. The builder stops working on it and drops its
+// result.
+var errBuildGone = errors.New("build is no longer building on this builder")
+
+// buildQueue is where the builder claims builds and reports on them: the
+// API, or the database directly when there is no API URL
+type buildQueue interface {
+	// Claim claims the next build the builder can run, waiting up to
+	// wait for one. It returns nil if none was queued in time.
+	Claim(ctx context.Context, wait time.Duration) (*models.BuildJob, error)
+
+	// Progress renews the builder's lease on a build
+	Progress(ctx context.Context, id string, progress models.BuildProgress) error
+
+	// Complete reports how a build ended
+	Complete(ctx context.Context, id string, result models.BuildResult) error
+}
+
+// localQueue goes through the service layer against the database, as the
+// API would
+type localQueue struct {
+	name    string
+	service *service.Service
+}
+
+func (q *localQueue) Claim(ctx context.Context, wait time.Duration) (*models.BuildJob, error) {
+	return q.service.ClaimBuild(ctx, q.name, wait)
+}
+
+func (q *localQueue) Progress(ctx context.Context, id string, progress models.BuildProgress) error {
+	return localErr(q.service.RecordBuildProgress(ctx, id, progress))
+}
+
+func (q *localQueue) Complete(ctx context.Context, id string, result models.BuildResult) error {
+	_, err := q.service.CompleteBuild(ctx, id, result)
+	return localErr(err)
+}
+
+// localErr turns the service's errors for a build that isn't this
+// builder's into errBuildGone
+func localErr(err error) error {
+	var conflict *service.ConflictError
+	if errors.As(err, &conflict) || errors.Is(err, service.ErrBuildNotFound) {
+		return fmt.Errorf("%w: %v", errBuildGone, err)
+	}
+	return err
+}
+
+// apiQueue goes through the API's internal build endpoints with an
+// operator's token
+type apiQueue struct {
+	name   string
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (q *apiQueue) Claim(ctx context.Context, wait time.Duration) (*models.BuildJob, error) {
+	query := url.Values{
+		"builder": {q.name},
+		"wait":    {strconv.Itoa(int(wait / time.Second))},
+	}
+
+	// The server holds the request open for up to wait
+	ctx, cancel := context.WithTimeout(ctx, wait+registerTimeout)
+	defer cancel()
+
+	var job models.BuildJob
+	status, err := q.do(ctx, "GET", "/internal/builds/next?"+query.Encode(), nil, &job)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNoContent {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+func (q *apiQueue) Progress(ctx context.Context, id string, progress models.BuildProgress) error {
+	ctx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+
+	_, err := q.do(ctx, "POST", "/internal/builds/"+url.PathEscape(id)+"/progress", progress, nil)
+	return err
+}
+
+func (q *apiQueue) Complete(ctx context.Context, id string, result models.BuildResult) error {
+	ctx, cancel := context.WithTimeout(ctx, registerTimeout)
+	defer cancel()
+
+	_, err := q.do(ctx, "POST", "/internal/builds/"+url.PathEscape(id)+"/complete", result, nil)
+	return err
+}
+
+// do sends a request to the API, decoding a successful response into out
+// if it has a body. A 404 or 409 means the build isn't this builder's.
+func (q *apiQueue) do(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, q.url+path, body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if q.token != "" {
+		req.Header.Set("Authorization", "Bearer "+q.token)
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return resp.StatusCode, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, fmt.Errorf("%w: API returned %s: %s", errBuildGone, resp.Status, apiErrorMessage(resp.Body))
+	case resp.StatusCode != http.StatusOK:
+		return resp.StatusCode, fmt.Errorf("API returned %s: %s", resp.Status, apiErrorMessage(resp.Body))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// apiErrorMessage reads the message of an API error response
+func apiErrorMessage(body io.Reader) string {
+	var apiErr models.ErrorResponse
+	data, _ := io.ReadAll(io.LimitReader(body, 4096))
+	if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+		return apiErr.Error.Message
+	}
+	return string(bytes.TrimSpace(data))
+}
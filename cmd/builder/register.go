@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// registerTimeout bounds a registration request to the API
+const registerTimeout = 10 * time.Second
+
+// heartbeat registers the builder and its capabilities, and keeps the
+// registration current, including the toolchain, which can change under a
+// running builder when the channel is updated, and its disk usage. It also
+// starts the garbage collections the registration asks for.
+func (b *Builder) heartbeat() {
+	ticker := time.NewTicker(models.BuilderHeartbeatInterval)
+	defer ticker.Stop()
+
+	cordoned := false
+	for {
+		builder, err := b.register(models.RegisterBuilderRequest{
+			Name:                b.name,
+			Environment:         b.captureEnvironment(),
+			StartedAt:           b.startedAt,
+			Architectures:       b.architectures,
+			Labels:              b.labels,
+			MaxConcurrentBuilds: b.maxBuilds,
+			Health:              b.disks.health(),
+		})
+		if err != nil {
+			log.Printf("Failed to send builder heartbeat: %v", err)
+		} else if builder != nil && builder.Cordoned != cordoned {
+			cordoned = builder.Cordoned
+			log.Printf("Builder cordoned: %t", cordoned)
+		}
+
+		var pending *models.BuilderGCRequest
+		if builder != nil {
+			pending = builder.PendingGC
+		}
+		b.maybeCollectGarbage(pending)
+
+		<-ticker.C
+	}
+}
+
+// register sends a registration to the API, or records it in the database
+// when there is no API URL, and returns the builder as recorded
+func (b *Builder) register(req models.RegisterBuilderRequest) (*models.Builder, error) {
+	if b.apiURL == "" {
+		return b.service.RegisterBuilder(context.Background(), req)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", b.apiURL+"/internal/builders/register", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if b.apiToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+b.apiToken)
+	}
+
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API returned %s", resp.Status)
+	}
+
+	var builder models.Builder
+	if err := json.NewDecoder(resp.Body).Decode(&builder); err != nil {
+		return nil, fmt.Errorf("failed to decode registration: %w", err)
+	}
+	return &builder, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+// normalize, if set, is applied to each entry first.
+func splitList(value string, normalize func(string) string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if normalize != nil {
+			v = normalize(v)
+		}
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
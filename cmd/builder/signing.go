@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// signingTimeout bounds signing or verifying one artifact
+const signingTimeout = 2 * time.Minute
+
+// signedArtifacts are the files of a netboot image that get a detached
+// signature, named after the file with .sig added
+var signedArtifacts = []string{"bzImage", "initrd"}
+
+// artifactSigner signs boot artifacts with openssl cms, which makes the
+// detached DER signatures iPXE's imgverify checks
+type artifactSigner struct {
+	certFile string
+	keyFile  string
+
+	// chain is whether certFile has CA certificates after the signing
+	// certificate, which go in the signatures
+	chain bool
+	key   models.BootSigningKey
+}
+
+// newArtifactSigner loads the signing certificate, which must be for code
+// signing, since iPXE trusts no other
+func newArtifactSigner(certFile, keyFile string) (*artifactSigner, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not start with a PEM certificate", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", certFile, err)
+	}
+	if !slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageCodeSigning) {
+		return nil, fmt.Errorf("%s is not a code signing certificate", certFile)
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(block.Bytes)
+	next, _ := pem.Decode(rest)
+	return &artifactSigner{
+		certFile: certFile,
+		keyFile:  keyFile,
+		chain:    next != nil,
+		key: models.BootSigningKey{
+			Fingerprint: hex.EncodeToString(sum[:]),
+			Subject:     cert.Subject.String(),
+			NotAfter:    cert.NotAfter,
+			Certificate: string(data),
+		},
+	}, nil
+}
+
+// signArtifacts signs the kernel and initrd of a netboot image and checks
+// the signatures the way iPXE will, returning the key that signed them. A
+// signature that doesn't verify fails the build rather than leaving an
+// image machines would refuse to boot. Without a signing key, signatures
+// left by earlier builds are removed, since they no longer match.
+func (b *Builder) signArtifacts(outputPath string) (*models.BootSigningKey, error) {
+	if b.signer == nil {
+		for _, name := range signedArtifacts {
+			if err := os.Remove(filepath.Join(outputPath, name+".sig")); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("Failed to remove stale signature of %s: %v", name, err)
+			}
+		}
+		return nil, nil
+	}
+
+	for _, name := range signedArtifacts {
+		file := filepath.Join(outputPath, name)
+		if err := b.signer.sign(b, file); err != nil {
+			return nil, fmt.Errorf("Failed to sign %s: %v", name, err)
+		}
+		if err := b.signer.verify(b, file); err != nil {
+			return nil, fmt.Errorf("Signature of %s does not verify: %v", name, err)
+		}
+	}
+
+	key := b.signer.key
+	return &key, nil
+}
+
+// sign writes a detached signature of file to file.sig
+func (s *artifactSigner) sign(b *Builder, file string) error {
+	args := []string{"cms", "-sign", "-binary", "-noattr",
+		"-in", file, "-signer", s.certFile, "-inkey", s.keyFile,
+		"-outform", "DER", "-out", file + ".sig"}
+	if s.chain {
+		args = append(args, "-certfile", s.certFile)
+	}
+	return s.openssl(b, args...)
+}
+
+// verify checks file.sig against file, trusting the signing certificate
+// and its chain
+func (s *artifactSigner) verify(b *Builder, file string) error {
+	return s.openssl(b, "cms", "-verify", "-binary", "-inform", "DER",
+		"-in", file+".sig", "-content", file,
+		"-CAfile", s.certFile, "-purpose", "any", "-out", os.DevNull)
+}
+
+func (s *artifactSigner) openssl(b *Builder, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), signingTimeout)
+	defer cancel()
+
+	if _, stderr, err := b.runner.Run(ctx, "openssl", args...); err != nil {
+		if stderr = strings.TrimSpace(stderr); stderr != "" {
+			return fmt.Errorf("%v: %s", err, stderr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// spoolRetryInterval is how often results the server hasn't acknowledged
+// are sent again
+const spoolRetryInterval = 30 * time.Second
+
+// spooledResult is a build result waiting for the server to acknowledge it
+type spooledResult struct {
+	BuildID string             `json:"build_id"`
+	Result  models.BuildResult `json:"result"`
+}
+
+// resultSpool keeps build results on disk until the server acknowledges
+// them, so a result outlives the server being unreachable or the builder
+// restarting. The server acknowledges a result it already has the same
+// way, so sending one twice is harmless.
+type resultSpool struct {
+	dir   string
+	queue buildQueue
+
+	// mu keeps the retry loop and a build's first send from sending the
+	// same result at once
+	mu sync.Mutex
+}
+
+// complete spools a build's result and sends it. A result that can't be
+// sent stays spooled for the retry loop.
+func (s *resultSpool) complete(id string, result models.BuildResult) {
+	if err := s.write(id, result); err != nil {
+		log.Printf("Failed to spool result of build %s, sending it unspooled: %v", id, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.send(id, result)
+}
+
+// send reports a result and removes it from the spool once the server
+// acknowledges it, or says the build is no longer this builder's
+func (s *resultSpool) send(id string, result models.BuildResult) {
+	err := s.queue.Complete(context.Background(), id, result)
+	if err != nil && !errors.Is(err, errBuildGone) {
+		log.Printf("Failed to report result of build %s, will retry: %v", id, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Dropping result of build %s: %v", id, err)
+	}
+
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove spooled result of build %s: %v", id, err)
+	}
+}
+
+// write saves a result to the spool, replacing the file atomically so a
+// crash never leaves half a result
+func (s *resultSpool) write(id string, result models.BuildResult) error {
+	data, err := json.Marshal(spooledResult{BuildID: id, Result: result})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".result-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(id))
+}
+
+func (s *resultSpool) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// retry sends spooled results until the server acknowledges them, starting
+// with any left from before the builder restarted
+func (s *resultSpool) retry() {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.drain()
+		<-ticker.C
+	}
+}
+
+// drain sends every spooled result once
+func (s *resultSpool) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Failed to read result spool: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			log.Printf("Failed to read spooled result %s: %v", entry.Name(), err)
+			continue
+		}
+		var spooled spooledResult
+		if err := json.Unmarshal(data, &spooled); err != nil || spooled.BuildID == "" {
+			log.Printf("Removing unreadable spooled result %s: %v", entry.Name(), err)
+			os.Remove(filepath.Join(s.dir, entry.Name()))
+			continue
+		}
+
+		s.send(spooled.BuildID, spooled.Result)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// runRegistrationBuild builds a version of the registration image. The
+// configuration comes from the build, and the files it refers to, such as
+// enroll.sh, from the registration directory of the NixOS configurations.
+// The version is published beside the others under images/registration;
+// the server then holds it for a boot test before it can be promoted to
+// current.
+func (b *Builder) runRegistrationBuild(ctx context.Context, job *models.BuildJob, result *models.BuildResult) error {
+	build, image := job.Build, job.SystemImage
+
+	buildPath := filepath.Join(b.buildDir, build.ID)
+	if err := os.MkdirAll(buildPath, 0755); err != nil {
+		return fmt.Errorf("Failed to create build directory: %v", err)
+	}
+	defer os.RemoveAll(buildPath)
+
+	if err := copyConfigFiles(filepath.Join(b.nixosDir, image.Name), buildPath); err != nil {
+		return fmt.Errorf("Failed to copy %s files: %v", image.Name, err)
+	}
+	configPath := filepath.Join(buildPath, "configuration.nix")
+	if err := os.WriteFile(configPath, []byte(build.Config), 0644); err != nil {
+		return fmt.Errorf("Failed to write config: %v", err)
+	}
+
+	log.Printf("Building %s image version %d", image.Name, image.Version)
+	output, peakMemory, err := b.nixBuild(ctx, build.ID, buildPath, b.limits, "config.system.build.netbootRamdisk")
+	result.PeakMemoryBytes = peakMemory
+	result.Log = output
+	if err != nil {
+		return fmt.Errorf("Build failed: %v", err)
+	}
+
+	version := strconv.Itoa(image.Version)
+	outputPath := filepath.Join(b.outputDir, image.Name, version)
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return fmt.Errorf("Failed to create output directory: %v", err)
+	}
+	if err := publishNetboot(filepath.Join(buildPath, "result"), outputPath); err != nil {
+		return err
+	}
+	if result.SigningKey, err = b.signArtifacts(outputPath); err != nil {
+		return err
+	}
+
+	result.ArtifactBytes = measureArtifacts(outputPath, true)
+	result.ArtifactURL = fmt.Sprintf("/images/%s/%s", image.Name, version)
+	return nil
+}
+
+// copyConfigFiles copies the regular files of a NixOS configuration
+// directory, leaving out links such as a result from a manual build
+func copyConfigFiles(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
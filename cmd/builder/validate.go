@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/builder"
+)
+
+// Validation only parses, so it gets far less time and input than a build
+const (
+	validateTimeout  = 20 * time.Second
+	maxValidateBytes = 16 << 20
+)
+
+// handleValidate checks that a NixOS configuration parses, without
+// evaluating or building it, so the server can reject a broken assembled
+// configuration before queueing a build
+func (b *Builder) handleValidate(w http.ResponseWriter, r *http.Request) {
+	var req builder.ValidateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxValidateBytes)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	result, err := b.validate(r.Context(), req.Config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// validate parses config with nix-instantiate --parse
+func (b *Builder) validate(ctx context.Context, config string) (*builder.ValidateResponse, error) {
+	dir, err := os.MkdirTemp(b.buildDir, "validate-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "configuration.nix")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+
+	_, stderr, err := b.runner.Run(ctx, "nix-instantiate", "--parse", path)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		// Parse errors name the temporary file, which means nothing to
+		// the caller
+		message := strings.ReplaceAll(strings.TrimSpace(stderr), path, "configuration.nix")
+		if message == "" {
+			message = err.Error()
+		}
+		return &builder.ValidateResponse{Error: message}, nil
+	}
+
+	return &builder.ValidateResponse{Valid: true}, nil
+}
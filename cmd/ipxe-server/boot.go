@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Boot script flavors
+const (
+	flavorAuto = "auto"
+	flavorIPXE = "ipxe"
+	flavorGRUB = "grub"
+	flavorEFI  = "efi"
+)
+
+// Supported architectures, named the way iPXE's ${buildarch} reports them
+const (
+	archX86_64 = "x86_64"
+	archARM64  = "arm64"
+)
+
+var kernelNames = map[string]string{
+	archX86_64: "bzImage",
+	archARM64:  "Image",
+}
+
+// efiArchNames are the suffixes shim and GRUB use in their EFI binary names
+var efiArchNames = map[string]string{
+	archX86_64: "x64",
+	archARM64:  "aa64",
+}
+
+// bootClient describes the firmware or bootloader requesting a boot script
+type bootClient struct {
+	Flavor     string
+	Arch       string
+	BootMode   string
+	SecureBoot bool
+}
+
+// detectClient works out what is asking for a boot script. The User-Agent
+// identifies iPXE, GRUB, and UEFI HTTP boot firmware; ?arch=, ?uefi=, and
+// ?secureboot= fill in what the agent does not say, and the boot mode the
+// machine reported at enrollment is used when the request gives no hint.
+func detectClient(r *http.Request, flavor string, machine *models.Machine) bootClient {
+	query := r.URL.Query()
+	agent := strings.ToLower(r.UserAgent())
+
+	client := bootClient{
+		Flavor:     flavor,
+		SecureBoot: isTrue(query.Get("secureboot")),
+	}
+
+	if client.Flavor == flavorAuto {
+		switch {
+		case strings.Contains(agent, "ipxe"):
+			client.Flavor = flavorIPXE
+		case strings.Contains(agent, "grub"):
+			client.Flavor = flavorGRUB
+		case strings.Contains(agent, "httpboot"):
+			client.Flavor = flavorEFI
+		case machine != nil && machine.BootMode == models.BootModeUEFIHTTP:
+			client.Flavor = flavorEFI
+		default:
+			client.Flavor = flavorIPXE
+		}
+	}
+
+	client.Arch = normalizeArch(query.Get("arch"))
+	if client.Arch == "" && machine != nil {
+		client.Arch = normalizeArch(machine.Hardware.CPU.Architecture)
+	}
+	if client.Arch == "" {
+		client.Arch = archX86_64
+	}
+
+	switch {
+	case client.Flavor == flavorEFI:
+		client.BootMode = models.BootModeUEFIHTTP
+	case query.Get("uefi") != "":
+		client.BootMode = models.BootModeBIOS
+		if isTrue(query.Get("uefi")) {
+			client.BootMode = models.BootModeUEFI
+		}
+	case machine != nil && machine.BootMode != "":
+		client.BootMode = machine.BootMode
+	case client.Flavor == flavorGRUB:
+		client.BootMode = models.BootModeUEFI
+	default:
+		client.BootMode = models.BootModeBIOS
+	}
+
+	return client
+}
+
+// normalizeArch maps the architecture spellings used by iPXE, UEFI, and
+// uname onto the names used for image directories. It returns an empty
+// string for architectures we have no images for.
+func normalizeArch(arch string) string {
+	switch strings.ToLower(arch) {
+	case "x86_64", "amd64", "x64":
+		return archX86_64
+	case "arm64", "aarch64", "aa64":
+		return archARM64
+	}
+	return ""
+}
+
+// isTrue accepts the values iPXE and firmware scripts tend to pass for flags,
+// including iPXE's ${platform} ("efi" vs "pcbios")
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "efi":
+		return true
+	}
+	return false
+}
+
+// bootTemplates holds the boot script templates for each flavor
+type bootTemplates struct {
+	ipxeRegistration *template.Template
+	ipxeMachine      *template.Template
+	grubRegistration *template.Template
+	grubMachine      *template.Template
+	secureboot       *template.Template
+
+	ipxeDecommissioned *template.Template
+	grubDecommissioned *template.Template
+	ipxeWipe           *template.Template
+	grubWipe           *template.Template
+	ipxeLocalBoot      *template.Template
+	grubLocalBoot      *template.Template
+	ipxeOverride       *template.Template
+}
+
+// lookup returns the template for a flavor and image type
+func (t *bootTemplates) lookup(flavor string, custom bool) *template.Template {
+	if flavor == flavorGRUB {
+		if custom {
+			return t.grubMachine
+		}
+		return t.grubRegistration
+	}
+
+	if custom {
+		return t.ipxeMachine
+	}
+	return t.ipxeRegistration
+}
+
+// decommissioned returns the script served to decommissioned machines in
+// place of any image
+func (t *bootTemplates) decommissioned(flavor string) *template.Template {
+	if flavor == flavorGRUB {
+		return t.grubDecommissioned
+	}
+	return t.ipxeDecommissioned
+}
+
+// wipe returns the script that boots the disk wipe image
+func (t *bootTemplates) wipe(flavor string) *template.Template {
+	if flavor == flavorGRUB {
+		return t.grubWipe
+	}
+	return t.ipxeWipe
+}
+
+// localBoot returns the script that hands machines that boot from disk back
+// to the firmware
+func (t *bootTemplates) localBoot(flavor string) *template.Template {
+	if flavor == flavorGRUB {
+		return t.grubLocalBoot
+	}
+	return t.ipxeLocalBoot
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// newBootServer starts an iPXE server with the built-in templates and an
+// empty images directory, backed by a fake API that knows machines
+func newBootServer(t *testing.T, machines ...*models.Machine) *httptest.Server {
+	t.Helper()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v1/machines":
+			found := []*models.Machine{}
+			for _, m := range machines {
+				if strings.EqualFold(m.ServiceTag, r.URL.Query().Get("service_tag")) {
+					found = append(found, m)
+				}
+			}
+			json.NewEncoder(w).Encode(found)
+		case r.URL.Path == "/api/v1/boot-profiles":
+			json.NewEncoder(w).Encode([]*models.BootProfile{})
+		case strings.HasSuffix(r.URL.Path, "/boot-history"):
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	templates, err := newTemplateStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagesDir := t.TempDir()
+	s := &Server{
+		baseURL:       "http://boot.example.com",
+		enrollmentURL: "http://api.example.com/api/v1/enroll",
+		apiURL:        api.URL + "/api/v1",
+		imagesDir:     imagesDir,
+		kernelParams:  defaultKernelParams,
+		templates:     templates,
+		files:         &imageFiles{imagesDir: imagesDir, baseURL: "http://boot.example.com"},
+		client:        api.Client(),
+		profiles:      &profileCache{ttl: time.Minute},
+		metrics:       newServerMetrics(),
+		mirrors:       parseMirrors("", 0),
+	}
+
+	server := httptest.NewServer(s.router())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBootClientSignatures(t *testing.T) {
+	// An enrolled machine that boots over UEFI HTTP boot, as it said at
+	// enrollment, and has no image yet
+	httpBoot := &models.Machine{ID: "m-1", ServiceTag: "HTTPBOOT01", Status: models.StatusEnrolled, BootMode: models.BootModeUEFIHTTP}
+	httpBoot.Hardware.CPU.Architecture = "aarch64"
+	server := newBootServer(t, httpBoot)
+
+	tests := []struct {
+		name      string
+		path      string
+		userAgent string
+		query     string
+
+		// status and, for scripts, what the script starts with and
+		// contains, or, for redirects, where to
+		status   int
+		prefix   string
+		contains []string
+		location string
+	}{
+		// Clients that identify themselves are served their flavor
+		{
+			name:      "iPXE",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "iPXE/1.21.1+ (g9e96)",
+			status:    http.StatusOK,
+			prefix:    "#!ipxe",
+			contains:  []string{"kernel http://boot.example.com/images/registration/bzImage", "boot_mode=bios"},
+		},
+		{
+			name:      "iPXE on UEFI, by its platform",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "iPXE/1.21.1+ (g9e96)",
+			query:     "uefi=efi&arch=x86_64",
+			status:    http.StatusOK,
+			prefix:    "#!ipxe",
+			contains:  []string{"boot_mode=uefi"},
+		},
+		{
+			name:      "GRUB",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "GRUB 2.06",
+			status:    http.StatusOK,
+			prefix:    "# Registration image",
+			contains:  []string{"linux (http,boot.example.com)/images/registration/bzImage", "boot_mode=uefi"},
+		},
+		{
+			name:      "UEFI HTTP boot without a unified kernel image",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "UefiHttpBoot/1.0",
+			status:    http.StatusNotFound,
+		},
+		{
+			name:      "UEFI HTTP boot with SecureBoot",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "UefiHttpBoot/1.0",
+			query:     "secureboot=1&arch=aa64",
+			status:    http.StatusFound,
+			location:  "http://boot.example.com/secureboot/arm64/shim.efi",
+		},
+
+		// Without a signature, the request's hints and then what the
+		// machine reported at enrollment decide
+		{
+			name:     "no signature, unknown machine",
+			path:     "/nixos/machines/UNKNOWN01.ipxe",
+			status:   http.StatusOK,
+			prefix:   "#!ipxe",
+			contains: []string{"/images/registration/bzImage", "boot_mode=bios"},
+		},
+		{
+			name:     "no signature, arch hint",
+			path:     "/nixos/machines/UNKNOWN01.ipxe",
+			query:    "arch=aarch64",
+			status:   http.StatusOK,
+			prefix:   "#!ipxe",
+			contains: []string{"/images/registration/arm64/Image"},
+		},
+		{
+			name:   "no signature, machine enrolled for UEFI HTTP boot",
+			path:   "/nixos/machines/HTTPBOOT01.ipxe",
+			status: http.StatusNotFound,
+		},
+
+		// Signatures and hints that don't make sense fall back to the
+		// defaults rather than failing the boot
+		{
+			name:      "unrecognized user agent",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "curl/8.5.0",
+			status:    http.StatusOK,
+			prefix:    "#!ipxe",
+			contains:  []string{"boot_mode=bios"},
+		},
+		{
+			name:      "unsupported arch",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "iPXE/1.21.1+ (g9e96)",
+			query:     "arch=sparc64",
+			status:    http.StatusOK,
+			prefix:    "#!ipxe",
+			contains:  []string{"/images/registration/bzImage"},
+		},
+		{
+			name:      "garbled UEFI flag",
+			path:      "/nixos/machines/UNKNOWN01.ipxe",
+			userAgent: "iPXE/1.21.1+ (g9e96)",
+			query:     "uefi=%24%7Bplatform%7D",
+			status:    http.StatusOK,
+			prefix:    "#!ipxe",
+			contains:  []string{"boot_mode=bios"},
+		},
+		{
+			name:      "forced GRUB route ignores the agent",
+			path:      "/nixos/machines/UNKNOWN01.cfg",
+			userAgent: "iPXE/1.21.1+ (g9e96)",
+			status:    http.StatusOK,
+			prefix:    "# Registration image",
+			contains:  []string{"menuentry"},
+		},
+		{
+			name:      "machine's boot mode doesn't override the agent",
+			path:      "/nixos/machines/HTTPBOOT01.ipxe",
+			userAgent: "iPXE/1.21.1+ (g9e96)",
+			status:    http.StatusOK,
+			prefix:    "#!ipxe",
+			contains:  []string{"/images/registration/arm64/Image", "boot_mode=uefi-http"},
+		},
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := server.URL + tt.path
+			if tt.query != "" {
+				url += "?" + tt.query
+			}
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Go sends its own User-Agent unless told not to
+			req.Header.Set("User-Agent", tt.userAgent)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if got := resp.Header.Get("Location"); got != tt.location {
+				t.Errorf("redirected to %q, want %q", got, tt.location)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			script := string(body)
+			if !strings.HasPrefix(script, tt.prefix) {
+				t.Errorf("script starts %q, want %q", strings.SplitN(script, "\n", 2)[0], tt.prefix)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(script, want) {
+					t.Errorf("script doesn't contain %q:\n%s", want, script)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache-Control for image files. Files under a system image's numbered
+// version directory never change once written; anything else, such as a
+// machine's image, is replaced by the next build and is revalidated
+// against its ETag.
+const (
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	mutableCacheControl   = "no-cache"
+)
+
+// serverMetrics holds the iPXE server's counters, served at /metrics
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	artifactResponses *prometheus.CounterVec
+	artifactRedirects *prometheus.CounterVec
+	artifactBytes     prometheus.Counter
+	syncedFiles       *prometheus.CounterVec
+	syncedBytes       prometheus.Counter
+	lastSync          prometheus.Gauge
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		artifactResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metal_ipxe_artifact_responses_total",
+			Help: "Image file requests by result (served, not_modified for cache hits, redirected to a mirror, not_found)",
+		}, []string{"result"}),
+		artifactRedirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metal_ipxe_artifact_redirects_total",
+			Help: "Image file requests redirected to each mirror",
+		}, []string{"mirror"}),
+		artifactBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "metal_ipxe_artifact_bytes_served_total",
+			Help: "Bytes of image files served",
+		}),
+		syncedFiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metal_ipxe_sync_files_total",
+			Help: "Image files pulled from the sync source by result (synced, checksum_mismatch, failed)",
+		}, []string{"result"}),
+		syncedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "metal_ipxe_sync_bytes_total",
+			Help: "Bytes of image files pulled from the sync source",
+		}),
+		lastSync: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "metal_ipxe_sync_last_success_timestamp_seconds",
+			Help: "Unix time of the last sync that pulled every file of the source's manifest",
+		}),
+	}
+	m.registry.MustRegister(m.artifactResponses, m.artifactRedirects, m.artifactBytes,
+		m.syncedFiles, m.syncedBytes, m.lastSync)
+	return m
+}
+
+// mirrorSet is the secondary iPXE servers a fraction of image requests
+// are redirected to, to spread a mass boot across their uplinks
+type mirrorSet struct {
+	urls     []string
+	fraction float64
+}
+
+// parseMirrors reads a comma-separated list of mirror base URLs
+func parseMirrors(list string, fraction float64) *mirrorSet {
+	m := &mirrorSet{fraction: fraction}
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u != "" {
+			m.urls = append(m.urls, u)
+		}
+	}
+	return m
+}
+
+// pick returns the mirror to redirect a client to, or "" to serve it here.
+// Clients are picked by a hash of their address, so each one is always
+// sent to the same place: its kernel and initrd come from one server, and
+// interrupted downloads resume where they started.
+func (m *mirrorSet) pick(clientIP string) string {
+	if m == nil || len(m.urls) == 0 || m.fraction <= 0 {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write([]byte(clientIP))
+	sum := h.Sum64()
+	if float64(sum%10000)/10000 >= m.fraction {
+		return ""
+	}
+	return m.urls[(sum/10000)%uint64(len(m.urls))]
+}
+
+// handleImage serves a file from the images directory with a strong ETag,
+// its SHA-256, and cache headers, answering conditional and range requests.
+// Clients the mirror set picks are redirected to their mirror instead.
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(r.URL.Path, "/images/")
+	file := s.files.file(rel)
+
+	// Directories and missing files are the file server's to answer
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		if err != nil {
+			s.metrics.artifactResponses.WithLabelValues("not_found").Inc()
+		}
+		s.images.ServeHTTP(w, r)
+		return
+	}
+
+	if mirror := s.mirrors.pick(remoteIP(r)); mirror != "" {
+		target := mirror + "/images/" + strings.TrimPrefix(r.URL.EscapedPath(), "/images/")
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		s.metrics.artifactResponses.WithLabelValues("redirected").Inc()
+		s.metrics.artifactRedirects.WithLabelValues(mirror).Inc()
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		return
+	}
+
+	if sum := s.files.sumFile(file); sum != "" {
+		w.Header().Set("ETag", strconv.Quote(sum))
+	}
+	w.Header().Set("Cache-Control", cacheControl(rel))
+
+	counter := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+	s.images.ServeHTTP(counter, r)
+
+	result := "served"
+	switch {
+	case counter.status == http.StatusNotModified:
+		result = "not_modified"
+	case counter.status == http.StatusNotFound:
+		result = "not_found"
+	}
+	s.metrics.artifactResponses.WithLabelValues(result).Inc()
+	s.metrics.artifactBytes.Add(float64(counter.written))
+}
+
+// cacheControl returns the Cache-Control of the image file at rel. System
+// images are written to <name>/<version>/ and never changed; machines'
+// directories are named after service tags, which may be all digits, so
+// they never count as versions.
+func cacheControl(rel string) string {
+	parts := strings.Split(rel, "/")
+	if len(parts) >= 3 && parts[0] != "machines" && isVersion(parts[1]) {
+		return immutableCacheControl
+	}
+	return mutableCacheControl
+}
+
+// isVersion reports whether a directory name is a system image version
+func isVersion(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// countingWriter records the status and body size of a response
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
@@ -1,59 +1,160 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipxe"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/wol"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const defaultIPXEScript = `#!ipxe
-# Registration image for {{.ServiceTag}}
-# Unknown machine - serving registration image
+// defaultKernelParams are the kernel arguments every image boots with,
+// unless KERNEL_PARAMS says otherwise
+const defaultKernelParams = "console=ttyS0,115200 console=tty0"
 
-echo Metal Enrollment - Registration Mode
-echo Service Tag: {{.ServiceTag}}
-echo ========================================
-
-kernel {{.BaseURL}}/images/registration/bzImage init=/nix/store/HASH-nixos-system-registration/init console=ttyS0,115200 console=tty0 enrollment_url={{.EnrollmentURL}}
-initrd {{.BaseURL}}/images/registration/initrd
-boot
-`
-
-const machineIPXEScript = `#!ipxe
-# Custom image for {{.ServiceTag}}
-
-echo Metal Enrollment - Custom Image
-echo Service Tag: {{.ServiceTag}}
-echo Hostname: {{.Hostname}}
-echo ========================================
-
-kernel {{.BaseURL}}/images/machines/{{.ServiceTag}}/bzImage init=/nix/store/HASH-nixos-system-{{.Hostname}}/init console=ttyS0,115200 console=tty0
-initrd {{.BaseURL}}/images/machines/{{.ServiceTag}}/initrd
-boot
-`
-
-type iPXEConfig struct {
+// bootConfig is the data boot script templates are rendered with. See
+// sampleBootConfig for an example of each field.
+type bootConfig struct {
 	ServiceTag    string
 	Hostname      string
 	BaseURL       string
 	EnrollmentURL string
+	APIURL        string
+	MachineID     string
+
+	// Client platform: x86_64 or arm64, bios, uefi, or uefi-http, and the
+	// kernel's file name for the architecture
+	Arch     string
+	BootMode string
+	Kernel   string
+
+	// KernelParams are the kernel arguments every image boots with, and
+	// InitPath the NixOS system's init, from an init file next to the
+	// kernel. InitPath is empty if there is no such file.
+	KernelParams string
+	InitPath     string
+
+	// Image location as an HTTP URL (iPXE) and a GRUB device path
+	ImageURL      string
+	GrubRoot      string
+	GrubImagePath string
+
+	// Kernel and initrd of the registration image, which a boot profile
+	// can replace, and kernel arguments the profile adds
+	KernelURL      string
+	InitrdURL      string
+	GrubKernelPath string
+	GrubInitrdPath string
+	ExtraCmdline   string
+
+	// ISO a boot override sanboots
+	ISOURL string
+
+	// VerifySignatures has iPXE check the image's kernel and initrd
+	// against the detached signatures the builder writes beside them
+	VerifySignatures bool
+
+	// StaleBuild warns in the script of a custom image that the
+	// machine's configuration has changed since the image was built
+	StaleBuild bool
+
+	// HooksToken lets the custom image's agent fetch and report the
+	// machine's provisioning hooks. It is only set for the boots machines
+	// are served, never for previews.
+	HooksToken string
+
+	// WipeJobID is the wipe job the wipe image runs, and WipeToken lets
+	// it report the job's progress. Like HooksToken, they are only set
+	// for the boots machines are served.
+	WipeJobID string
+	WipeToken string
+
+	// ClientIP is the address the machine asked for its script from, and
+	// IPv6 whether it is an IPv6 address, for templates that set up the
+	// network of IPv6-only machines differently. Previews use ?client_ip=
+	// or the machine's current IP.
+	ClientIP string
+	IPv6     bool
+
+	files *imageFiles
+}
+
+// setClientIP records the address a boot script is for, normalized.
+// Addresses that don't parse are left out.
+func (c *bootConfig) setClientIP(ip string) {
+	normalized, err := models.NormalizeIP(ip)
+	if err != nil {
+		return
+	}
+	c.ClientIP = normalized
+	c.IPv6 = strings.Contains(normalized, ":")
+}
+
+// KernelSHA256 is the SHA-256 of the kernel at KernelURL, or empty if this
+// server doesn't serve it from its images directory
+func (c bootConfig) KernelSHA256() string {
+	return c.files.sha256(c.KernelURL)
 }
 
+// InitrdSHA256 is the SHA-256 of the initrd at InitrdURL, or empty if this
+// server doesn't serve it from its images directory
+func (c bootConfig) InitrdSHA256() string {
+	return c.files.sha256(c.InitrdURL)
+}
+
+// apiTimeout bounds requests to the API, which boot requests wait on
+const apiTimeout = 10 * time.Second
+
 type Server struct {
 	baseURL       string
 	enrollmentURL string
 	apiURL        string
+	apiToken      string
 	imagesDir     string
-	templates     struct {
-		registration *template.Template
-		machine      *template.Template
-	}
+	bootAssetsDir string
+	kernelParams  string
+	verifySigs    bool
+	templates     *templateStore
+	files         *imageFiles
+	client        *http.Client
+	profiles      *profileCache
+	metrics       *serverMetrics
+
+	// images serves the images directory. A fraction of requests for its
+	// files may be redirected to mirrors, which pull the files with the
+	// sync token.
+	images    http.Handler
+	mirrors   *mirrorSet
+	syncToken string
+
+	// Wake-on-LAN relay for the API, which may not be on the provisioning
+	// network. Off unless wolRelay is set.
+	wolRelay         bool
+	wolBroadcastAddr string
+	wolRelayToken    string
+
+	// manifest, if set, is what machines are served from in place of the
+	// API, for networks with no route to it
+	manifest *manifestStore
 }
 
 func main() {
@@ -61,26 +162,67 @@ func main() {
 	enrollmentURL := flag.String("enrollment-url", getEnv("ENROLLMENT_URL", "http://enrollment.local:8080/api/v1/enroll"), "Enrollment API URL")
 	apiURL := flag.String("api-url", getEnv("API_URL", "http://enrollment.local:8080/api/v1"), "API base URL")
 	imagesDir := flag.String("images-dir", getEnv("IMAGES_DIR", "/var/lib/metal-enrollment/images"), "Directory for serving images")
+	bootAssetsDir := flag.String("boot-assets-dir", getEnv("BOOT_ASSETS_DIR", "/var/lib/metal-enrollment/boot-assets"), "Directory of boot override assets uploaded to the API")
+	templatesDir := flag.String("templates-dir", getEnv("TEMPLATES_DIR", ""), "Directory with boot script templates overriding the built-in ones, reloaded when they change")
+	kernelParams := flag.String("kernel-params", getEnv("KERNEL_PARAMS", defaultKernelParams), "Kernel arguments every image boots with")
+	verifySigs := flag.Bool("verify-signatures", getEnv("VERIFY_SIGNATURES", "false") == "true", "Have iPXE verify the signatures of machine images' kernels and initrds")
+	apiToken := flag.String("api-token", getEnv("API_TOKEN", ""), "Bearer token for machine lookups, boot profiles, and boot reports when the API requires authentication")
+	profileTTL := flag.Duration("boot-profile-ttl", getDurationEnv("BOOT_PROFILE_TTL", time.Minute), "How long boot profiles fetched from the API are cached")
 	listenAddr := flag.String("listen", getEnv("LISTEN_ADDR", ":8080"), "HTTP listen address")
+	wolRelay := flag.Bool("wol-relay", getEnv("WOL_RELAY", "false") == "true", "Send Wake-on-LAN packets on the API's behalf")
+	wolBroadcastAddr := flag.String("wol-broadcast-addr", getEnv("WOL_BROADCAST_ADDR", wol.DefaultBroadcastAddr), "Address Wake-on-LAN packets are broadcast to, as host:port")
+	wolRelayToken := flag.String("wol-relay-token", getEnv("WOL_RELAY_TOKEN", ""), "Bearer token the API must send with Wake-on-LAN requests")
+	mirrorURLs := flag.String("mirror-urls", getEnv("MIRROR_URLS", ""), "Comma-separated base URLs of iPXE servers a fraction of image requests are redirected to")
+	mirrorFraction := flag.Float64("mirror-fraction", getFloatEnv("MIRROR_FRACTION", 0.5), "Fraction of clients whose image requests are redirected to a mirror")
+	syncToken := flag.String("sync-token", getEnv("SYNC_TOKEN", ""), "Bearer token for the sync manifest and file endpoints, and for pulling from SYNC_FROM")
+	syncFrom := flag.String("sync-from", getEnv("SYNC_FROM", ""), "Base URL of an iPXE server to mirror the images directory of")
+	syncInterval := flag.Duration("sync-interval", getDurationEnv("SYNC_INTERVAL", time.Minute), "How often the images directory is synced from SYNC_FROM")
+	manifestFile := flag.String("manifest", getEnv("MANIFEST", ""), "Signed boot manifest exported by the API to serve machines from instead of the API, reloaded when it changes")
+	manifestKey := flag.String("manifest-public-key", getEnv("MANIFEST_PUBLIC_KEY", ""), "Base64 Ed25519 public key the boot manifest must be signed with")
+	manifestMaxAge := flag.Duration("manifest-max-age", getDurationEnv("MANIFEST_MAX_AGE", 24*time.Hour), "Age after which the boot manifest is reported stale, or 0 never to")
 	flag.Parse()
 
 	server := &Server{
-		baseURL:       *baseURL,
+		baseURL:       strings.TrimSuffix(*baseURL, "/"),
 		enrollmentURL: *enrollmentURL,
 		apiURL:        *apiURL,
+		apiToken:      *apiToken,
 		imagesDir:     *imagesDir,
+		bootAssetsDir: *bootAssetsDir,
+		kernelParams:  *kernelParams,
+		verifySigs:    *verifySigs,
+		files:         &imageFiles{imagesDir: *imagesDir, baseURL: strings.TrimSuffix(*baseURL, "/")},
+		client:        &http.Client{Timeout: apiTimeout},
+		profiles:      &profileCache{ttl: *profileTTL},
+		metrics:       newServerMetrics(),
+		images:        http.StripPrefix("/images/", http.FileServer(http.Dir(*imagesDir))),
+		mirrors:       parseMirrors(*mirrorURLs, *mirrorFraction),
+		syncToken:     *syncToken,
+
+		wolRelay:         *wolRelay,
+		wolBroadcastAddr: *wolBroadcastAddr,
+		wolRelayToken:    *wolRelayToken,
 	}
 
-	// Parse templates
+	// Parse templates, and reload them when they change
 	var err error
-	server.templates.registration, err = template.New("registration").Parse(defaultIPXEScript)
+	server.templates, err = newTemplateStore(*templatesDir)
 	if err != nil {
-		log.Fatalf("Failed to parse registration template: %v", err)
+		log.Fatalf("Failed to load boot templates: %v", err)
 	}
+	server.templates.watch()
 
-	server.templates.machine, err = template.New("machine").Parse(machineIPXEScript)
-	if err != nil {
-		log.Fatalf("Failed to parse machine template: %v", err)
+	// Serve machines from the boot manifest, and reload it when it changes
+	if *manifestFile != "" {
+		publicKey, err := models.ParseBootManifestKey(*manifestKey)
+		if err != nil {
+			log.Fatalf("Failed to load boot manifest: %v", err)
+		}
+		server.manifest, err = newManifestStore(*manifestFile, publicKey, *manifestMaxAge)
+		if err != nil {
+			log.Fatalf("Failed to load boot manifest: %v", err)
+		}
+		server.manifest.watch()
 	}
 
 	// Ensure images directory exists
@@ -88,90 +230,736 @@ func main() {
 		log.Fatalf("Failed to create images directory: %v", err)
 	}
 
+	if *syncFrom != "" {
+		y := &syncer{
+			source:    strings.TrimSuffix(*syncFrom, "/"),
+			token:     *syncToken,
+			interval:  *syncInterval,
+			imagesDir: *imagesDir,
+			files:     server.files,
+			metrics:   server.metrics,
+			client:    &http.Client{},
+		}
+		go y.run()
+	}
+
+	log.Printf("Starting iPXE server on %s", *listenAddr)
+	log.Printf("Base URL: %s", *baseURL)
+	log.Printf("Enrollment URL: %s", *enrollmentURL)
+	if *manifestFile != "" {
+		log.Printf("Serving machines from boot manifest %s; the API is not consulted", *manifestFile)
+	}
+	log.Printf("Images directory: %s", *imagesDir)
+	if *templatesDir != "" {
+		log.Printf("Templates directory: %s", *templatesDir)
+	}
+	if *verifySigs {
+		log.Printf("Verifying signatures of machine images")
+	}
+	if len(server.mirrors.urls) > 0 {
+		log.Printf("Redirecting %.0f%% of clients' image requests to %s", *mirrorFraction*100, strings.Join(server.mirrors.urls, ", "))
+	}
+	if *syncFrom != "" {
+		log.Printf("Syncing images from %s every %s", *syncFrom, *syncInterval)
+	}
+	if *wolRelay {
+		log.Printf("Wake-on-LAN relay: broadcasting to %s", *wolBroadcastAddr)
+		if *wolRelayToken == "" {
+			log.Printf("Warning: the Wake-on-LAN relay has no token; anyone who can reach this server can wake machines")
+		}
+	}
+
+	if err := http.ListenAndServe(*listenAddr, server.router()); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+func (s *Server) router() *mux.Router {
 	router := mux.NewRouter()
 
-	// iPXE script routes
-	router.HandleFunc("/nixos/machines/{servicetag}.ipxe", server.handleMachineIPXE).Methods("GET")
+	// Boot script routes. The .ipxe route picks the script flavor from the
+	// client; .cfg and .efi force GRUB and UEFI HTTP boot respectively.
+	router.HandleFunc("/nixos/machines/{servicetag}.ipxe", s.handleMachineBoot(flavorAuto)).Methods("GET")
+	router.HandleFunc("/nixos/machines/{servicetag}.cfg", s.handleMachineBoot(flavorGRUB)).Methods("GET")
+	router.HandleFunc("/nixos/machines/{servicetag}.efi", s.handleMachineBoot(flavorEFI)).Methods("GET")
+
+	// What a machine would be served, for the API's script preview
+	router.HandleFunc("/preview/{servicetag}", s.handlePreview).Methods("GET")
+
+	// Whether the templates on disk load, for template authors
+	router.HandleFunc("/admin/templates/validate", s.handleValidateTemplates).Methods("GET")
+
+	// Wake-on-LAN packets sent for the API
+	if s.wolRelay {
+		router.HandleFunc("/wol", s.handleWake).Methods("POST")
+	}
 
-	// Serve kernel and initrd images
-	router.PathPrefix("/images/").Handler(http.StripPrefix("/images/",
-		http.FileServer(http.Dir(*imagesDir))))
+	// Signed shim and GRUB for SecureBoot clients
+	router.HandleFunc("/secureboot/{arch}/{file}", s.handleSecureBoot).Methods("GET")
 
-	// Health check
+	// Boot override assets uploaded to the API
+	router.HandleFunc("/assets/{sha256}/{name}", s.handleBootAsset).Methods("GET")
+
+	// Serve kernel and initrd images, and the installers and bundles
+	// built from machines' configurations, with their content types. The
+	// file server answers range and conditional requests, so downloads
+	// can be resumed and caches revalidate against the ETag.
+	for ext, contentType := range models.ArtifactContentTypes {
+		mime.AddExtensionType(ext, contentType)
+	}
+	router.PathPrefix("/images/").HandlerFunc(s.handleImage)
+
+	// The images directory's manifest and files, for mirrors to sync
+	router.HandleFunc("/internal/manifest", s.handleManifest).Methods("GET")
+	router.PathPrefix("/internal/sync/").HandlerFunc(s.handleSyncFile).Methods("GET", "HEAD")
+
+	router.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})).Methods("GET")
+
+	// Health check. A stale boot manifest is reported, but machines are
+	// still served from it.
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "OK")
+		if s.manifest != nil {
+			fmt.Fprintf(w, "\n%s", s.manifest.status())
+		}
 	}).Methods("GET")
 
-	log.Printf("Starting iPXE server on %s", *listenAddr)
-	log.Printf("Base URL: %s", *baseURL)
-	log.Printf("Enrollment URL: %s", *enrollmentURL)
-	log.Printf("Images directory: %s", *imagesDir)
+	return router
+}
 
-	if err := http.ListenAndServe(*listenAddr, router); err != nil {
-		log.Fatalf("Server failed: %v", err)
+func (s *Server) handleMachineBoot(flavor string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		serviceTag := vars["servicetag"]
+
+		// Check if machine exists and has a custom image
+		machine, lookupErr := s.checkMachine(serviceTag)
+		if lookupErr != nil {
+			log.Printf("Error checking machine: %v", lookupErr)
+		}
+		client := detectClient(r, flavor, machine)
+
+		log.Printf("Boot request for service tag: %s (flavor: %s, arch: %s, mode: %s, agent: %q)",
+			serviceTag, client.Flavor, client.Arch, client.BootMode, r.UserAgent())
+
+		query := profileQuery{name: r.URL.Query().Get("profile"), clientIP: remoteIP(r)}
+		plan := s.planBoot(serviceTag, client, machine, lookupErr, query)
+		plan.config.setClientIP(query.clientIP)
+		if plan.decision == models.BootDecisionCustom && plan.tmpl != nil && s.manifest == nil {
+			plan.config.HooksToken = s.hooksToken(machine.ID)
+		}
+		if plan.decision == models.BootDecisionWipe && plan.tmpl != nil && s.manifest == nil {
+			plan.config.WipeJobID, plan.config.WipeToken = s.wipeToken(machine.ID)
+		}
+		var diagnosticsToken string
+		if plan.diagnosticRunID != "" && plan.tmpl != nil && s.manifest == nil {
+			if diagnosticsToken = s.diagnosticsToken(machine.ID, plan.diagnosticRunID); diagnosticsToken != "" {
+				plan.config.ExtraCmdline += " metal_diagnostics_token=" + diagnosticsToken
+			}
+		}
+		boot, err := plan.render(client)
+		if err != nil {
+			log.Printf("Error executing template: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Serving %s boot to %s: %s", boot.Decision, serviceTag, boot.Reason)
+		switch {
+		case boot.Redirect != "":
+			http.Redirect(w, r, boot.Redirect, http.StatusFound)
+		case boot.Status != http.StatusOK:
+			http.Error(w, boot.Reason, boot.Status)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, boot.Script)
+		}
+
+		// Only enrolled machines have a boot history, which viewers can
+		// read, so it doesn't get the hooks, wipe, or diagnostics token. Without the API
+		// there is nowhere to report boots.
+		if machine != nil && s.manifest == nil {
+			for _, token := range []string{plan.config.HooksToken, plan.config.WipeToken, diagnosticsToken} {
+				if token != "" {
+					boot.Script = strings.ReplaceAll(boot.Script, token, redactedToken)
+				}
+			}
+			boot.MachineID = machine.ID
+			boot.ClientIP = remoteIP(r)
+			go s.reportBoot(boot)
+		}
 	}
 }
 
-func (s *Server) handleMachineIPXE(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	serviceTag := vars["servicetag"]
+// handlePreview returns, as JSON, the boot script a machine would be served
+// right now and why, without recording a boot. ?flavor= picks the script
+// flavor, and ?arch=, ?uefi=, ?secureboot=, and ?profile= work as for boot
+// requests. Boot profiles are selected by subnet for ?client_ip=, or else
+// the machine's current IP, since the request comes from the API.
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	serviceTag := mux.Vars(r)["servicetag"]
+
+	flavor := r.URL.Query().Get("flavor")
+	switch flavor {
+	case "":
+		flavor = flavorAuto
+	case flavorIPXE, flavorGRUB, flavorEFI:
+	default:
+		http.Error(w, "flavor must be ipxe, grub, or efi", http.StatusBadRequest)
+		return
+	}
 
-	log.Printf("iPXE request for service tag: %s", serviceTag)
+	machine, lookupErr := s.checkMachine(serviceTag)
+	client := detectClient(r, flavor, machine)
 
-	// Check if machine exists and has a custom image
-	machineExists, hostname := s.checkMachine(serviceTag)
+	query := profileQuery{name: r.URL.Query().Get("profile"), clientIP: r.URL.Query().Get("client_ip")}
+	if query.clientIP == "" && machine != nil {
+		query.clientIP = machine.CurrentIP
+	}
 
-	w.Header().Set("Content-Type", "text/plain")
+	plan := s.planBoot(serviceTag, client, machine, lookupErr, query)
+	plan.config.setClientIP(query.clientIP)
+	boot, err := plan.render(client)
+	if err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if machine != nil {
+		boot.MachineID = machine.ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(boot)
+}
+
+// handleWake broadcasts a Wake-on-LAN magic packet for the MAC address in
+// the request, on the API's behalf
+func (s *Server) handleWake(w http.ResponseWriter, r *http.Request) {
+	if s.wolRelayToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.wolRelayToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ipxe.WakeRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
 
-	config := iPXEConfig{
-		ServiceTag:    serviceTag,
-		Hostname:      hostname,
-		BaseURL:       s.baseURL,
-		EnrollmentURL: s.enrollmentURL,
+	if _, err := wol.MagicPacket(req.MACAddress); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := wol.Send(req.MACAddress, s.wolBroadcastAddr); err != nil {
+		log.Printf("Failed to wake %s: %v", req.MACAddress, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	log.Printf("Sent Wake-on-LAN packet to %s from %s", req.MACAddress, remoteIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bootPlan is what to serve a boot request, and why
+type bootPlan struct {
+	decision string
+	reason   string
+	config   bootConfig
+	tmpl     *template.Template
+
+	// script is served as it is, in place of a template
+	script string
+
+	// UEFI HTTP boot clients are redirected, or refused with status
+	redirect string
+	status   int
+
+	artifactsVersion string
+
+	// diagnosticRunID is the diagnostic run an override boots the
+	// diagnostics image of
+	diagnosticRunID string
+}
+
+// planBoot decides what to serve a machine. machine is nil if the machine
+// is unknown or lookupErr says why it could not be looked up. query selects
+// the boot profile of a registration boot.
+func (s *Server) planBoot(serviceTag string, client bootClient, machine *models.Machine, lookupErr error, query profileQuery) bootPlan {
+	plan := s.planDecision(serviceTag, client, machine, lookupErr, query)
+
+	// Boot overrides are only kept by the API
+	if machine == nil || s.manifest != nil {
+		return plan
+	}
+
+	// A boot override replaces whatever the machine would get. Overrides
+	// are iPXE scripts, so other clients are served as usual.
+	override, err := s.bootOverride(machine.ID)
+	switch {
+	case err != nil:
+		log.Printf("Error looking up boot override of %s: %v", serviceTag, err)
+		plan.reason += fmt.Sprintf("; boot override lookup failed: %v", err)
+	case override == nil:
+	case client.Flavor != flavorIPXE:
+		plan.reason += fmt.Sprintf("; boot override not served to %s clients", client.Flavor)
+	default:
+		overridePlan, err := s.planOverride(override, s.bootConfig(serviceTag, client, s.registrationDir(client)))
+		if err != nil {
+			plan.reason += fmt.Sprintf("; boot override not served: %v", err)
+			break
+		}
+		return overridePlan
+	}
+	return plan
+}
+
+// planDecision decides what to serve a machine by its status, as planBoot
+// does without a boot override
+func (s *Server) planDecision(serviceTag string, client bootClient, machine *models.Machine, lookupErr error, query profileQuery) bootPlan {
+	config := s.bootConfig(serviceTag, client, s.registrationDir(client))
+
+	// Decommissioned machines get neither their old image nor the
+	// registration image
+	if machine != nil && machine.Status == models.StatusDecommissioned {
+		plan := bootPlan{
+			decision: models.BootDecisionDecommissioned,
+			reason:   "machine is decommissioned",
+			config:   config,
+			tmpl:     s.templates.get().decommissioned(client.Flavor),
+		}
+		if client.Flavor == flavorEFI {
+			plan.tmpl = nil
+			plan.status = http.StatusForbidden
+		}
+		return plan
+	}
+
+	// A requested wipe replaces the machine's own image until it
+	// completes
+	if machine != nil && machine.Status == models.StatusWiping {
+		wipeConfig := s.bootConfig(serviceTag, client, "wipe")
+		wipeConfig.MachineID = machine.ID
+		return s.planEFI(bootPlan{
+			decision: models.BootDecisionWipe,
+			reason:   "a disk wipe is pending",
+			config:   wipeConfig,
+			tmpl:     s.templates.get().wipe(client.Flavor),
+		}, client)
+	}
+
+	// Adopted machines run NixOS from disk; exiting hands them back to
+	// the firmware to boot the next device. A hardware refresh sends them
+	// to the registration image instead.
+	if machine != nil && machine.BootsFromDisk() && machine.HardwareRefreshRequestedAt == nil {
+		plan := bootPlan{
+			decision: models.BootDecisionLocalDisk,
+			reason:   "machine boots NixOS from its own disk",
+			config:   config,
+			tmpl:     s.templates.get().localBoot(client.Flavor),
+		}
+		if client.Flavor == flavorEFI {
+			plan.tmpl = nil
+			plan.status = http.StatusNotFound
+		}
+		return plan
 	}
 
-	if machineExists && hostname != "" {
-		// Check if custom image exists
-		imagePath := filepath.Join(s.imagesDir, "machines", serviceTag, "bzImage")
-		if _, err := os.Stat(imagePath); err == nil {
-			log.Printf("Serving custom image for %s (hostname: %s)", serviceTag, hostname)
-			if err := s.templates.machine.Execute(w, config); err != nil {
-				log.Printf("Error executing template: %v", err)
+	plan := bootPlan{decision: models.BootDecisionRegistration, config: config}
+
+	// Only machines with a successful build have an image to serve; a
+	// wipe clears the last build so the old image is never booted again
+	switch {
+	case lookupErr != nil:
+		plan.reason = fmt.Sprintf("machine lookup failed: %v", lookupErr)
+	case machine == nil:
+		plan.reason = "machine is not enrolled"
+	case machine.Status == models.StatusConflict:
+		plan.reason = "machine's enrollment is held: its MAC address or serial number belongs to another machine"
+	case machine.HardwareRefreshRequestedAt != nil:
+		plan.reason = "a hardware refresh is pending: the registration image collects the machine's inventory again"
+	case machine.Hostname == "":
+		plan.reason = "machine has no hostname"
+	case machine.LastBuildID == nil:
+		plan.reason = fmt.Sprintf("machine has no successful build (status: %s)", machine.Status)
+	default:
+		// Check if custom image exists. Only the netboot image counts:
+		// installers and bundles are built into subdirectories, and
+		// their builds don't become the machine's last build.
+		machineConfig := s.bootConfig(serviceTag, client, filepath.Join("machines", serviceTag))
+		machineConfig.Hostname = machine.Hostname
+		machineConfig.MachineID = machine.ID
+		machineConfig.StaleBuild = machine.StaleBuild
+		machineConfig.VerifySignatures = s.verifySigs
+		if path := s.imagePath(machineConfig, client); !fileExists(path) {
+			plan.reason = fmt.Sprintf("image artifacts missing: %s", path)
+		} else {
+			plan = bootPlan{
+				decision:         models.BootDecisionCustom,
+				reason:           fmt.Sprintf("serving the image of build %s", *machine.LastBuildID),
+				config:           machineConfig,
+				artifactsVersion: *machine.LastBuildID,
+			}
+			if machine.StaleBuild {
+				plan.reason += "; the configuration has changed since the build"
+			}
+			if s.verifySigs && client.Flavor == flavorIPXE && !fileExists(path+".sig") {
+				plan.reason += "; the image is not signed and will fail verification"
+			}
+		}
+
+		// Without the API, only images the manifest vouches for are
+		// served
+		if s.manifest != nil && plan.decision == models.BootDecisionCustom {
+			if why := s.checkManifestImage(s.manifest.get().image(serviceTag), machineConfig, client); why != "" {
+				plan = bootPlan{
+					decision: models.BootDecisionRegistration,
+					reason:   "image artifacts not served: " + why,
+					config:   config,
+				}
 			}
-			return
 		}
 	}
 
-	// Serve registration image
-	log.Printf("Serving registration image for %s", serviceTag)
-	if err := s.templates.registration.Execute(w, config); err != nil {
-		log.Printf("Error executing template: %v", err)
+	// There is nothing but the registration image to serve without the
+	// API, so one that doesn't match the manifest is served with a warning
+	if s.manifest != nil && plan.decision == models.BootDecisionRegistration {
+		registration := s.manifest.get().Registration
+		if why := s.checkManifestImage(&registration, plan.config, client); why != "" {
+			log.Printf("WARNING: registration image served to %s: %s", serviceTag, why)
+			plan.reason += "; registration image: " + why
+		}
+	}
+
+	// UEFI HTTP boot firmware is sent to the unified kernel image, which
+	// a profile doesn't replace
+	if plan.decision == models.BootDecisionRegistration && client.Flavor != flavorEFI {
+		if profile, why := s.selectProfile(machine, query); profile != nil {
+			s.applyProfile(&plan.config, profile)
+			plan.reason += fmt.Sprintf("; boot profile %s (%s)", profile.Name, why)
+		}
+	}
+
+	plan.tmpl = s.templates.get().lookup(client.Flavor, plan.decision == models.BootDecisionCustom)
+	return s.planEFI(plan, client)
+}
+
+// planEFI points UEFI HTTP boot firmware at a bootable EFI binary. Firmware
+// can only load EFI executables, so clients are redirected to the image's
+// unified kernel image, or to the signed shim when SecureBoot is enforced.
+func (s *Server) planEFI(plan bootPlan, client bootClient) bootPlan {
+	if client.Flavor != flavorEFI {
+		return plan
+	}
+
+	plan.tmpl = nil
+	if client.SecureBoot {
+		plan.redirect = fmt.Sprintf("%s/secureboot/%s/shim.efi", s.baseURL, client.Arch)
+	} else if path := s.imagePath(plan.config, client); !fileExists(path) {
+		plan.status = http.StatusNotFound
+		plan.reason += fmt.Sprintf("; no unified kernel image at %s", path)
+	} else {
+		plan.redirect = plan.config.ImageURL + "/uki.efi"
+	}
+	return plan
+}
+
+// render runs the plan's template and describes the result
+func (p bootPlan) render(client bootClient) (*models.BootRequest, error) {
+	boot := &models.BootRequest{
+		ServiceTag:       p.config.ServiceTag,
+		Flavor:           client.Flavor,
+		Arch:             client.Arch,
+		BootMode:         client.BootMode,
+		Decision:         p.decision,
+		Reason:           p.reason,
+		Redirect:         p.redirect,
+		Status:           http.StatusOK,
+		ArtifactsVersion: p.artifactsVersion,
+		RequestedAt:      time.Now(),
+	}
+
+	switch {
+	case p.redirect != "":
+		boot.Status = http.StatusFound
+	case p.status != 0:
+		boot.Status = p.status
+	case p.script != "":
+		boot.Script = p.script
+	case p.tmpl != nil:
+		var script strings.Builder
+		if err := p.tmpl.Execute(&script, p.config); err != nil {
+			return nil, err
+		}
+		boot.Script = script.String()
+	}
+
+	return boot, nil
+}
+
+// handleSecureBoot serves the distribution-signed shim and GRUB binaries and
+// the GRUB config they load. Binaries are read from
+// <images-dir>/secureboot/<arch>/ using the names shim installs them under.
+func (s *Server) handleSecureBoot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	arch := normalizeArch(vars["arch"])
+	if arch == "" {
+		http.Error(w, "Unsupported architecture", http.StatusNotFound)
+		return
+	}
+
+	efiArch := efiArchNames[arch]
+
+	switch vars["file"] {
+	case "shim.efi":
+		http.ServeFile(w, r, filepath.Join(s.imagesDir, "secureboot", arch, "shim"+efiArch+".efi"))
+	case "grub.efi", "grub" + efiArch + ".efi":
+		// shim chainloads grub<arch>.efi from its own directory
+		http.ServeFile(w, r, filepath.Join(s.imagesDir, "secureboot", arch, "grub"+efiArch+".efi"))
+	case "grub.cfg":
+		w.Header().Set("Content-Type", "text/plain")
+		client := bootClient{Arch: arch, BootMode: models.BootModeUEFIHTTP}
+		config := s.bootConfig("", client, s.registrationDir(client))
+		if err := s.templates.get().secureboot.Execute(w, config); err != nil {
+			log.Printf("Error executing template: %v", err)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// bootConfig builds the template data for an image directory under /images
+func (s *Server) bootConfig(serviceTag string, client bootClient, imageDir string) bootConfig {
+	// x86_64 images live at the top of the image directory for
+	// compatibility with existing deployments; other architectures get a
+	// subdirectory
+	if client.Arch != archX86_64 {
+		imageDir = filepath.Join(imageDir, client.Arch)
+	}
+	imageDir = filepath.ToSlash(imageDir)
+
+	grubRoot := s.grubRoot()
+	imageURL := s.baseURL + "/images/" + imageDir
+	grubImagePath := grubRoot + "/images/" + imageDir
+	kernel := kernelNames[client.Arch]
+
+	return bootConfig{
+		ServiceTag:     serviceTag,
+		BaseURL:        s.baseURL,
+		EnrollmentURL:  s.enrollmentURL,
+		APIURL:         s.apiURL,
+		Arch:           client.Arch,
+		BootMode:       client.BootMode,
+		Kernel:         kernel,
+		KernelParams:   s.kernelParams,
+		InitPath:       s.files.initPath(imageURL + "/" + kernel),
+		ImageURL:       imageURL,
+		GrubRoot:       grubRoot,
+		GrubImagePath:  grubImagePath,
+		KernelURL:      imageURL + "/" + kernel,
+		InitrdURL:      imageURL + "/initrd",
+		GrubKernelPath: grubImagePath + "/" + kernel,
+		GrubInitrdPath: grubImagePath + "/initrd",
+		files:          s.files,
+	}
+}
+
+// registrationDir returns the image directory of the registration image.
+// Promoting a version built by the server links it as current; before the
+// first promotion, and for architectures other than x86_64, which are only
+// built by hand, the image is served from where build.sh puts it. A boot
+// manifest says which it is for x86_64.
+func (s *Server) registrationDir(client bootClient) string {
+	if client.Arch == archX86_64 {
+		if s.manifest != nil {
+			return s.manifest.get().Registration.Dir
+		}
+		if _, err := os.Stat(filepath.Join(s.imagesDir, "registration", "current")); err == nil {
+			return "registration/current"
+		}
 	}
+	return "registration"
 }
 
-func (s *Server) checkMachine(serviceTag string) (bool, string) {
+// grubRoot returns the base URL as a GRUB device path
+func (s *Server) grubRoot() string {
+	if u, err := url.Parse(s.baseURL); err == nil {
+		return fmt.Sprintf("(http,%s)%s", u.Host, u.Path)
+	}
+	return s.baseURL
+}
+
+// imagePath returns the on-disk file the client will boot from the config's
+// image directory
+func (s *Server) imagePath(config bootConfig, client bootClient) string {
+	file := config.Kernel
+	if client.Flavor == flavorEFI {
+		file = "uki.efi"
+	}
+	rel := strings.TrimPrefix(config.ImageURL, s.baseURL+"/images/")
+	return filepath.Join(s.imagesDir, filepath.FromSlash(rel), file)
+}
+
+// checkMachine looks up an enrolled machine by service tag, in the boot
+// manifest if there is one. It returns nil if the machine is unknown, and
+// an error if the API cannot be reached.
+func (s *Server) checkMachine(serviceTag string) (*models.Machine, error) {
+	if s.manifest != nil {
+		return s.manifest.get().machine(serviceTag), nil
+	}
+
 	// Make API call to check if machine exists
-	url := fmt.Sprintf("%s/machines/by-servicetag/%s", s.apiURL, serviceTag)
+	reqURL := fmt.Sprintf("%s/machines?service_tag=%s", s.apiURL, url.QueryEscape(serviceTag))
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
 	if err != nil {
-		log.Printf("Error checking machine: %v", err)
-		return false, ""
+		return nil, err
 	}
-	defer resp.Body.Close()
+	s.authorize(req)
 
-	if resp.StatusCode == http.StatusNotFound {
-		return false, ""
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return false, ""
+		return nil, fmt.Errorf("API returned %s", resp.Status)
+	}
+
+	var machines []*models.Machine
+	if err := json.NewDecoder(resp.Body).Decode(&machines); err != nil {
+		return nil, fmt.Errorf("failed to decode machine lookup: %w", err)
 	}
 
-	// Parse response to get hostname
-	// For now, just return true - we'll implement full parsing later
-	return true, ""
+	// The service_tag filter is a substring match
+	for _, machine := range machines {
+		if strings.EqualFold(machine.ServiceTag, serviceTag) {
+			return machine, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// reportBoot adds a boot to the machine's boot history
+func (s *Server) reportBoot(boot *models.BootRequest) {
+	body, err := json.Marshal(boot)
+	if err != nil {
+		log.Printf("Error encoding boot report: %v", err)
+		return
+	}
+
+	reqURL := fmt.Sprintf("%s/machines/%s/boot-history", s.apiURL, url.PathEscape(boot.MachineID))
+	req, err := http.NewRequest(http.MethodPost, reqURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error reporting boot of %s: %v", boot.ServiceTag, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.authorize(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("Error reporting boot of %s: %v", boot.ServiceTag, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		log.Printf("Error reporting boot of %s: API returned %s", boot.ServiceTag, resp.Status)
+	}
+}
+
+// redactedToken stands in for a machine's hooks, wipe, and diagnostics
+// tokens in the scripts reported to its boot history
+const redactedToken = "REDACTED"
+
+// tokenPattern matches the tokens and IDs the API makes, so that one can't
+// add arguments to the kernel command line
+var tokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// hooksToken fetches the token a machine's agent runs its provisioning
+// hooks with. Without one the image boots as it would without hooks, so
+// errors are only logged.
+func (s *Server) hooksToken(machineID string) string {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	reqURL := fmt.Sprintf("%s/machines/%s/hooks/token", s.apiURL, url.PathEscape(machineID))
+	if err := s.getAPI(reqURL, &resp); err != nil {
+		log.Printf("Error fetching hooks token of %s: %v", machineID, err)
+		return ""
+	}
+	if !tokenPattern.MatchString(resp.Token) {
+		log.Printf("Error fetching hooks token of %s: API returned a malformed token", machineID)
+		return ""
+	}
+	return resp.Token
+}
+
+// wipeToken fetches the machine's active wipe job and the token the wipe
+// image reports its progress with. Without them the wipe image can't
+// report, so errors are only logged.
+func (s *Server) wipeToken(machineID string) (string, string) {
+	var resp struct {
+		JobID string `json:"job_id"`
+		Token string `json:"token"`
+	}
+	reqURL := fmt.Sprintf("%s/machines/%s/wipe/active/token", s.apiURL, url.PathEscape(machineID))
+	if err := s.getAPI(reqURL, &resp); err != nil {
+		log.Printf("Error fetching wipe token of %s: %v", machineID, err)
+		return "", ""
+	}
+	if !tokenPattern.MatchString(resp.JobID) || !tokenPattern.MatchString(resp.Token) {
+		log.Printf("Error fetching wipe token of %s: API returned a malformed token", machineID)
+		return "", ""
+	}
+	return resp.JobID, resp.Token
+}
+
+// diagnosticsToken fetches the token the diagnostics image of a running
+// diagnostic run posts its results with. Without it the image can't post
+// them and the run ends when it runs out, so errors are only logged.
+func (s *Server) diagnosticsToken(machineID, runID string) string {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	reqURL := fmt.Sprintf("%s/machines/%s/diagnostics/%s/token", s.apiURL, url.PathEscape(machineID), url.PathEscape(runID))
+	if err := s.getAPI(reqURL, &resp); err != nil {
+		log.Printf("Error fetching diagnostics token of %s: %v", machineID, err)
+		return ""
+	}
+	if !tokenPattern.MatchString(resp.Token) {
+		log.Printf("Error fetching diagnostics token of %s: API returned a malformed token", machineID)
+		return ""
+	}
+	return resp.Token
+}
+
+// authorize adds the API token to a request to the API, if there is one
+func (s *Server) authorize(req *http.Request) {
+	if s.apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.apiToken)
+	}
+}
+
+// remoteIP returns the address a request came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	// The zone of a link-local client only names the server's interface
+	host, _, _ = strings.Cut(host, "%")
+	return host
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
 
 func getEnv(key, defaultValue string) string {
@@ -180,3 +968,23 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getFloatEnv(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+		log.Printf("Invalid %s %q, using %g", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Invalid %s %q, using %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/fsnotify/fsnotify"
+)
+
+// manifestCheckInterval is how often the manifest's age is checked, to
+// warn once it goes stale
+const manifestCheckInterval = time.Minute
+
+// manifestStore holds the boot manifest machines are served from when the
+// iPXE server runs without the API. Reloads replace it only if the new
+// file verifies, so a half-copied or tampered manifest never stops boots
+// from being served.
+type manifestStore struct {
+	file      string
+	publicKey ed25519.PublicKey
+	maxAge    time.Duration
+
+	current atomic.Pointer[bootManifest]
+
+	mu         sync.Mutex
+	loadedAt   time.Time
+	lastError  string
+	staleNoted bool
+}
+
+// bootManifest is a verified manifest, with its machines by service tag
+type bootManifest struct {
+	*models.BootManifest
+	machines map[string]*models.BootManifestMachine
+}
+
+// newManifestStore loads the manifest in file, which must verify with
+// publicKey, since there is nothing else to serve machines from
+func newManifestStore(file string, publicKey ed25519.PublicKey, maxAge time.Duration) (*manifestStore, error) {
+	store := &manifestStore{file: file, publicKey: publicKey, maxAge: maxAge}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// get returns the manifest being served
+func (m *manifestStore) get() *bootManifest {
+	return m.current.Load()
+}
+
+// load reads and verifies the manifest file
+func (m *manifestStore) load() (*bootManifest, error) {
+	data, err := os.ReadFile(m.file)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed models.SignedBootManifest
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", m.file, err)
+	}
+	manifest, err := signed.Verify(m.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := &bootManifest{BootManifest: manifest, machines: make(map[string]*models.BootManifestMachine, len(manifest.Machines))}
+	for i := range manifest.Machines {
+		loaded.machines[strings.ToUpper(manifest.Machines[i].ServiceTag)] = &manifest.Machines[i]
+	}
+	return loaded, nil
+}
+
+// reload loads the manifest again, keeping the one being served if the
+// file doesn't verify
+func (m *manifestStore) reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	manifest, err := m.load()
+	if err != nil {
+		m.lastError = err.Error()
+		if m.current.Load() != nil {
+			log.Printf("ERROR: boot manifest %s failed to load; still serving the last good manifest: %v", m.file, err)
+		} else {
+			log.Printf("ERROR: boot manifest %s failed to load: %v", m.file, err)
+		}
+		return err
+	}
+
+	m.current.Store(manifest)
+	m.loadedAt = time.Now()
+	m.lastError = ""
+	m.staleNoted = false
+	log.Printf("Loaded boot manifest %s: %d machines, generated %s", m.file, len(manifest.Machines), manifest.GeneratedAt.Format(time.RFC3339))
+	m.checkStale()
+	return nil
+}
+
+// stale returns how old the manifest being served is, and whether that is
+// older than it should be
+func (m *manifestStore) stale() (time.Duration, bool) {
+	age := time.Since(m.get().GeneratedAt)
+	return age, m.maxAge > 0 && age > m.maxAge
+}
+
+// checkStale warns once that the manifest has gone stale. The caller holds
+// mu.
+func (m *manifestStore) checkStale() {
+	age, stale := m.stale()
+	if stale && !m.staleNoted {
+		log.Printf("WARNING: boot manifest %s was generated %s ago, more than %s; machines are served decisions that may be out of date", m.file, age.Round(time.Minute), m.maxAge)
+	}
+	m.staleNoted = stale
+}
+
+// status describes the manifest being served for /health
+func (m *manifestStore) status() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	manifest := m.get()
+	age, stale := m.stale()
+	status := fmt.Sprintf("boot manifest: %d machines, generated %s (%s ago)", len(manifest.Machines), manifest.GeneratedAt.Format(time.RFC3339), age.Round(time.Second))
+	if stale {
+		status += fmt.Sprintf("\nWARNING: boot manifest is stale, older than %s", m.maxAge)
+	}
+	if m.lastError != "" {
+		status += "\nWARNING: the last reload failed: " + m.lastError
+	}
+	return status
+}
+
+// watch reloads the manifest when its file changes, and on SIGHUP. The
+// directory is watched rather than the file, since rsync and most copies
+// replace the file by renaming a new one over it.
+func (m *manifestStore) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	dir := filepath.Dir(m.file)
+	if fsw, err := fsnotify.NewWatcher(); err != nil {
+		log.Printf("Failed to watch boot manifest, reload with SIGHUP: %v", err)
+	} else if err := fsw.Add(dir); err != nil {
+		fsw.Close()
+		log.Printf("Failed to watch boot manifest directory %s, reload with SIGHUP: %v", dir, err)
+	} else {
+		events, errs = fsw.Events, fsw.Errors
+	}
+
+	check := time.NewTicker(manifestCheckInterval)
+
+	go func() {
+		var pending <-chan time.Time
+
+		for {
+			select {
+			case <-hup:
+				log.Printf("Reloading boot manifest on SIGHUP")
+				m.reload()
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				if filepath.Clean(event.Name) == filepath.Clean(m.file) {
+					pending = time.After(templateReloadDelay)
+				}
+			case <-pending:
+				pending = nil
+				m.reload()
+			case <-check.C:
+				m.mu.Lock()
+				m.checkStale()
+				m.mu.Unlock()
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				log.Printf("Boot manifest watcher error: %v", err)
+			}
+		}
+	}()
+}
+
+// machine returns the machine with a service tag as the manifest describes
+// it, with the fields boot decisions are made from, or nil if the manifest
+// doesn't list it
+func (m *bootManifest) machine(serviceTag string) *models.Machine {
+	entry, ok := m.machines[strings.ToUpper(serviceTag)]
+	if !ok {
+		return nil
+	}
+
+	machine := &models.Machine{
+		ID:         entry.ID,
+		ServiceTag: entry.ServiceTag,
+		Hostname:   entry.Hostname,
+		Status:     models.MachineStatus(entry.Status),
+		BootMode:   entry.BootMode,
+		DeployMode: entry.DeployMode,
+		StaleBuild: entry.StaleBuild,
+	}
+	machine.Hardware.CPU.Architecture = entry.Arch
+	if entry.HardwareRefresh {
+		requested := m.GeneratedAt
+		machine.HardwareRefreshRequestedAt = &requested
+	}
+	if entry.LastBuildID != "" {
+		buildID := entry.LastBuildID
+		machine.LastBuildID = &buildID
+	}
+	return machine
+}
+
+// image returns the manifest's image of a machine, or nil if it has none
+func (m *bootManifest) image(serviceTag string) *models.BootManifestImage {
+	if entry, ok := m.machines[strings.ToUpper(serviceTag)]; ok {
+		return entry.Image
+	}
+	return nil
+}
+
+// checkManifestImage returns why the files a client would boot from an
+// image don't match the manifest's checksums, or "" if they do. The kernel
+// or unified kernel image, the initrd, and the init file the command line
+// is built from are checked.
+func (s *Server) checkManifestImage(image *models.BootManifestImage, config bootConfig, client bootClient) string {
+	if image == nil {
+		return "image is not in the boot manifest"
+	}
+
+	kernel := s.imagePath(config, client)
+	files := []string{kernel}
+	if client.Flavor != flavorEFI {
+		files = append(files, filepath.Join(filepath.Dir(kernel), "initrd"), filepath.Join(filepath.Dir(kernel), "init"))
+	}
+
+	root := filepath.Join(s.imagesDir, filepath.FromSlash(image.Dir))
+	for _, file := range files {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return fmt.Sprintf("%s is not in the boot manifest", file)
+		}
+		name := filepath.ToSlash(rel)
+		artifact := image.Artifact(name)
+		if artifact == nil {
+			if filepath.Base(file) == "init" && !fileExists(file) {
+				continue
+			}
+			return fmt.Sprintf("%s is not in the boot manifest", name)
+		}
+		if sum := s.files.sumFile(file); sum != artifact.SHA256 {
+			return fmt.Sprintf("%s does not match the boot manifest", name)
+		}
+	}
+	return ""
+}
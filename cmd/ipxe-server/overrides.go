@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// sha256Pattern is a SHA-256 in hex, which boot assets are stored under
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// bootOverride returns a machine's boot override, or nil if it has none
+func (s *Server) bootOverride(machineID string) (*models.BootOverride, error) {
+	var override models.BootOverride
+	err := s.getAPI(fmt.Sprintf("%s/machines/%s/boot-override", s.apiURL, url.PathEscape(machineID)), &override)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+// planOverride builds the plan that serves a boot override. Raw scripts
+// are served as they are, never run as templates; asset boots are built
+// from the override template, with the assets' names and the command line
+// checked again so nothing in them can change the script.
+func (s *Server) planOverride(override *models.BootOverride, config bootConfig) (bootPlan, error) {
+	plan := bootPlan{
+		decision: models.BootDecisionOverride,
+		reason:   fmt.Sprintf("boot override set by %q", override.CreatedBy),
+		config:   config,
+	}
+	if override.MaxBoots > 0 {
+		plan.reason += fmt.Sprintf(" (boot %d of %d)", override.BootsServed+1, override.MaxBoots)
+	}
+	if override.ExpiresAt != nil {
+		plan.reason += fmt.Sprintf(" until %s", override.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"))
+	}
+
+	if override.Script != "" {
+		plan.script = override.Script
+		return plan, nil
+	}
+
+	if !models.ValidBootCmdline(override.Cmdline) {
+		return plan, fmt.Errorf("invalid command line")
+	}
+
+	var err error
+	switch {
+	case override.ISO != nil:
+		if plan.config.ISOURL, err = s.assetURL(override.ISO); err != nil {
+			return plan, err
+		}
+	case override.Kernel != nil:
+		if plan.config.KernelURL, err = s.assetURL(override.Kernel); err != nil {
+			return plan, err
+		}
+		plan.config.InitrdURL = ""
+		if override.Initrd != nil {
+			if plan.config.InitrdURL, err = s.assetURL(override.Initrd); err != nil {
+				return plan, err
+			}
+		} else if override.InitrdAssetID != "" {
+			return plan, fmt.Errorf("initrd asset %s no longer exists", override.InitrdAssetID)
+		}
+		plan.config.ExtraCmdline = override.Cmdline
+
+		// Diagnostics images post their results back, as the wipe image
+		// does its progress
+		if override.DiagnosticRunID != "" {
+			plan.config.ExtraCmdline = strings.TrimSpace(fmt.Sprintf("%s metal_api=%s machine_id=%s diagnostics_run=%s",
+				override.Cmdline, plan.config.APIURL, override.MachineID, override.DiagnosticRunID))
+			plan.diagnosticRunID = override.DiagnosticRunID
+		}
+	default:
+		return plan, fmt.Errorf("its asset no longer exists")
+	}
+
+	plan.config.InitPath = ""
+	plan.tmpl = s.templates.get().ipxeOverride
+	return plan, nil
+}
+
+// assetURL returns where the iPXE server serves a boot asset
+func (s *Server) assetURL(asset *models.BootAsset) (string, error) {
+	if !sha256Pattern.MatchString(asset.SHA256) {
+		return "", fmt.Errorf("asset %s has an invalid checksum", asset.ID)
+	}
+	if err := models.ValidateBootAsset(asset.Name, asset.Kind); err != nil {
+		return "", fmt.Errorf("asset %s: %w", asset.ID, err)
+	}
+	return fmt.Sprintf("%s/assets/%s/%s", s.baseURL, asset.SHA256, asset.Name), nil
+}
+
+// handleBootAsset serves a boot asset by its SHA-256. The file name in the
+// URL is only for the client's benefit.
+func (s *Server) handleBootAsset(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["sha256"]
+	if !sha256Pattern.MatchString(hash) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(s.bootAssetsDir, hash[:2], hash))
+}
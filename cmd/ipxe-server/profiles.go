@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// profileCache holds the boot profiles fetched from the API. A failed fetch
+// is cached too, as no profiles, so an unreachable API costs one timeout
+// per TTL rather than one per boot.
+type profileCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	profiles  []*models.BootProfile
+	fetchedAt time.Time
+}
+
+// profileQuery is what a registration boot's profile is selected by,
+// besides the machine's groups
+type profileQuery struct {
+	name     string // Profile named by the DHCP configuration, from ?profile=
+	clientIP string
+}
+
+// bootProfiles returns the boot profiles, fetching them from the API when
+// the cache has expired. There are none without the API.
+func (s *Server) bootProfiles() []*models.BootProfile {
+	if s.manifest != nil {
+		return nil
+	}
+
+	s.profiles.mu.Lock()
+	defer s.profiles.mu.Unlock()
+
+	if !s.profiles.fetchedAt.IsZero() && time.Since(s.profiles.fetchedAt) < s.profiles.ttl {
+		return s.profiles.profiles
+	}
+
+	profiles, err := s.fetchBootProfiles()
+	if err != nil {
+		log.Printf("Error fetching boot profiles, serving the default registration image: %v", err)
+	}
+	s.profiles.profiles = profiles
+	s.profiles.fetchedAt = time.Now()
+
+	return profiles
+}
+
+func (s *Server) fetchBootProfiles() ([]*models.BootProfile, error) {
+	var profiles []*models.BootProfile
+	if err := s.getAPI(s.apiURL+"/boot-profiles", &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// machineGroups returns the IDs of the groups a machine belongs to
+func (s *Server) machineGroups(machineID string) ([]string, error) {
+	var groups []*models.MachineGroup
+	if err := s.getAPI(fmt.Sprintf("%s/machines/%s/groups", s.apiURL, url.PathEscape(machineID)), &groups); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(groups))
+	for i, group := range groups {
+		ids[i] = group.ID
+	}
+	return ids, nil
+}
+
+// errNotFound is wrapped by getAPI's error when the API responds 404
+var errNotFound = errors.New("not found")
+
+// getAPI decodes the JSON response to a GET request to the API
+func (s *Server) getAPI(reqURL string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return err
+	}
+	s.authorize(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("API returned %s: %w", resp.Status, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API returned %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// selectProfile picks the boot profile for a registration boot: the
+// profile of one of the machine's groups, then the profile the DHCP
+// configuration names, then the profile with the most specific subnet
+// containing the client. It returns nil if none applies, and says why one
+// was picked.
+func (s *Server) selectProfile(machine *models.Machine, query profileQuery) (*models.BootProfile, string) {
+	profiles := s.bootProfiles()
+	if len(profiles) == 0 {
+		return nil, ""
+	}
+
+	if machine != nil {
+		groups, err := s.machineGroups(machine.ID)
+		if err != nil {
+			log.Printf("Error looking up groups of %s for its boot profile: %v", machine.ServiceTag, err)
+		}
+		for _, groupID := range groups {
+			for _, profile := range profiles {
+				for _, id := range profile.GroupIDs {
+					if id == groupID {
+						return profile, "assigned to the machine's group"
+					}
+				}
+			}
+		}
+	}
+
+	if query.name != "" {
+		for _, profile := range profiles {
+			if profile.Name == query.name {
+				return profile, "requested by the boot URL"
+			}
+		}
+		log.Printf("Boot URL requested unknown boot profile %q", query.name)
+	}
+
+	ip := net.ParseIP(query.clientIP)
+	if ip == nil {
+		return nil, ""
+	}
+
+	var best *models.BootProfile
+	var bestPrefix int
+	var bestSubnet string
+	for _, profile := range profiles {
+		for _, subnet := range profile.Subnets {
+			_, network, err := net.ParseCIDR(subnet)
+			if err != nil || !network.Contains(ip) {
+				continue
+			}
+			if prefix, _ := network.Mask.Size(); best == nil || prefix > bestPrefix {
+				best, bestPrefix, bestSubnet = profile, prefix, subnet
+			}
+		}
+	}
+	if best == nil {
+		return nil, ""
+	}
+	return best, fmt.Sprintf("client is in %s", bestSubnet)
+}
+
+// applyProfile points a registration config at a boot profile's kernel,
+// initrd, and enrollment URL. "{arch}" in the profile's paths is replaced
+// with the client's architecture.
+func (s *Server) applyProfile(config *bootConfig, profile *models.BootProfile) {
+	config.KernelURL, config.GrubKernelPath = s.profileImage(profile.KernelPath, config.Arch)
+	config.InitrdURL, config.GrubInitrdPath = s.profileImage(profile.InitrdPath, config.Arch)
+	config.InitPath = s.files.initPath(config.KernelURL)
+	config.ExtraCmdline = profile.ExtraCmdline
+	if profile.EnrollmentURL != "" {
+		config.EnrollmentURL = profile.EnrollmentURL
+	}
+}
+
+// profileImage returns the HTTP URL and GRUB path of a boot profile's
+// kernel or initrd, which is relative to /images or an absolute URL
+func (s *Server) profileImage(path, arch string) (string, string) {
+	path = strings.ReplaceAll(path, "{arch}", arch)
+
+	if strings.Contains(path, "://") {
+		grubPath := path
+		if u, err := url.Parse(path); err == nil {
+			grubPath = fmt.Sprintf("(%s,%s)%s", u.Scheme, u.Host, u.Path)
+		}
+		return path, grubPath
+	}
+
+	path = strings.TrimPrefix(path, "/")
+	return s.baseURL + "/images/" + path, s.grubRoot() + "/images/" + path
+}
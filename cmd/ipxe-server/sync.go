@@ -0,0 +1,414 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// syncTempPrefix starts the names of files being pulled, which are left
+// out of manifests and removed by the next sync if a pull was interrupted
+const syncTempPrefix = ".sync-"
+
+// artifactManifest lists the files of an images directory, for mirrors
+// to pull
+type artifactManifest struct {
+	GeneratedAt time.Time          `json:"generated_at"`
+	Artifacts   []manifestArtifact `json:"artifacts"`
+}
+
+// manifestArtifact is a file, or a symlink such as a system image's
+// current version, in an images directory
+type manifestArtifact struct {
+	Path    string    `json:"path"` // Slash-separated, relative to the images directory
+	Size    int64     `json:"size,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+	Link    string    `json:"link,omitempty"` // Target of a symlink
+}
+
+// checkSyncToken answers 401 and returns false unless the request has the
+// sync token, if there is one
+func (s *Server) checkSyncToken(w http.ResponseWriter, r *http.Request) bool {
+	if s.syncToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.syncToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleManifest lists the images directory's files with their sizes and
+// checksums. Checksums are cached, so only new and changed files are read.
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
+	if !s.checkSyncToken(w, r) {
+		return
+	}
+
+	manifest, err := s.buildManifest()
+	if err != nil {
+		log.Printf("Error listing images for the sync manifest: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// buildManifest walks the images directory. Symlinks are listed rather
+// than followed, so each file is listed once, at its real path.
+func (s *Server) buildManifest() (*artifactManifest, error) {
+	manifest := &artifactManifest{GeneratedAt: time.Now(), Artifacts: []manifestArtifact{}}
+
+	err := filepath.WalkDir(s.imagesDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == s.imagesDir || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), syncTempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.imagesDir, file)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		artifact := manifestArtifact{Path: filepath.ToSlash(rel), ModTime: info.ModTime()}
+
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			artifact.Link = filepath.ToSlash(target)
+		case d.Type().IsRegular():
+			artifact.Size = info.Size()
+			artifact.SHA256 = s.files.sumFile(file)
+			if artifact.SHA256 == "" {
+				// Removed since the walk reached it
+				return nil
+			}
+		default:
+			return nil
+		}
+
+		manifest.Artifacts = append(manifest.Artifacts, artifact)
+		return nil
+	})
+	return manifest, err
+}
+
+// handleSyncFile serves a file of the images directory to a mirror, with
+// its SHA-256 in X-Checksum-Sha256 for the mirror to verify
+func (s *Server) handleSyncFile(w http.ResponseWriter, r *http.Request) {
+	if !s.checkSyncToken(w, r) {
+		return
+	}
+
+	rel, ok := cleanArtifactPath(strings.TrimPrefix(r.URL.Path, "/internal/sync/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	file := s.files.file(rel)
+
+	in, err := os.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if sum := s.files.sumFile(file); sum != "" {
+		w.Header().Set("X-Checksum-Sha256", sum)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), in)
+}
+
+// cleanArtifactPath checks that a manifest path stays inside the images
+// directory and isn't a pull in progress
+func cleanArtifactPath(p string) (string, bool) {
+	if p == "" || strings.HasPrefix(p, "/") || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return "", false
+	}
+	if strings.HasPrefix(path.Base(p), syncTempPrefix) {
+		return "", false
+	}
+	return p, true
+}
+
+// syncer keeps a mirror's images directory the same as the sync source's,
+// pulling new and changed files and removing those the source no longer
+// has
+type syncer struct {
+	source    string
+	token     string
+	interval  time.Duration
+	imagesDir string
+	files     *imageFiles
+	metrics   *serverMetrics
+
+	// Artifacts can be large, so only the manifest has a deadline
+	client *http.Client
+}
+
+// run syncs every interval, forever
+func (y *syncer) run() {
+	for {
+		if err := y.sync(); err != nil {
+			log.Printf("Error syncing images from %s: %v", y.source, err)
+		}
+		time.Sleep(y.interval)
+	}
+}
+
+// sync pulls what changed in the source's manifest. Files are pulled
+// before symlinks are pointed at them, and a file only replaces the local
+// one once its checksum matches the manifest.
+func (y *syncer) sync() error {
+	manifest, err := y.fetchManifest()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	var links []manifestArtifact
+	var failed int
+	for _, artifact := range manifest.Artifacts {
+		rel, ok := cleanArtifactPath(artifact.Path)
+		if !ok {
+			log.Printf("Skipping unsafe path %q in the manifest of %s", artifact.Path, y.source)
+			continue
+		}
+		wanted[rel] = true
+
+		if artifact.Link != "" {
+			links = append(links, artifact)
+			continue
+		}
+		if y.upToDate(artifact) {
+			continue
+		}
+		if err := y.pull(artifact); err != nil {
+			log.Printf("Error pulling %s from %s: %v", rel, y.source, err)
+			failed++
+		}
+	}
+
+	for _, artifact := range links {
+		if err := y.link(artifact); err != nil {
+			log.Printf("Error linking %s: %v", artifact.Path, err)
+			failed++
+		}
+	}
+
+	if err := y.prune(wanted); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d artifacts failed to sync", failed, len(manifest.Artifacts))
+	}
+	y.metrics.lastSync.SetToCurrentTime()
+	return nil
+}
+
+func (y *syncer) fetchManifest() (*artifactManifest, error) {
+	req, err := http.NewRequest(http.MethodGet, y.source+"/internal/manifest", nil)
+	if err != nil {
+		return nil, err
+	}
+	y.authorize(req)
+
+	client := *y.client
+	client.Timeout = apiTimeout * 6
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("manifest request returned %s", resp.Status)
+	}
+	var manifest artifactManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// upToDate reports whether the local copy of a file matches the manifest.
+// A different size is enough to tell without reading the file.
+func (y *syncer) upToDate(artifact manifestArtifact) bool {
+	file := y.files.file(artifact.Path)
+	info, err := os.Lstat(file)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != artifact.Size {
+		return false
+	}
+	return y.files.sumFile(file) == artifact.SHA256
+}
+
+// pull downloads a file next to where it goes and renames it into place
+// once its size and checksum match the manifest
+func (y *syncer) pull(artifact manifestArtifact) error {
+	dest := y.files.file(artifact.Path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), syncTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var escaped []string
+	for _, part := range strings.Split(artifact.Path, "/") {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	req, err := http.NewRequest(http.MethodGet, y.source+"/internal/sync/"+strings.Join(escaped, "/"), nil)
+	if err != nil {
+		return err
+	}
+	y.authorize(req)
+
+	resp, err := y.client.Do(req)
+	if err != nil {
+		y.metrics.syncedFiles.WithLabelValues("failed").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		y.metrics.syncedFiles.WithLabelValues("failed").Inc()
+		return fmt.Errorf("source returned %s", resp.Status)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	y.metrics.syncedBytes.Add(float64(n))
+	if err != nil {
+		y.metrics.syncedFiles.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if n != artifact.Size || sum != artifact.SHA256 {
+		y.metrics.syncedFiles.WithLabelValues("checksum_mismatch").Inc()
+		return fmt.Errorf("got %d bytes with SHA-256 %s, want %d bytes with %s; it may have changed since the manifest", n, sum, artifact.Size, artifact.SHA256)
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Keeping the source's modification time keeps Last-Modified the same
+	// on every server
+	if err := os.Chtimes(tmp.Name(), artifact.ModTime, artifact.ModTime); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+
+	y.metrics.syncedFiles.WithLabelValues("synced").Inc()
+	log.Printf("Synced %s (%d bytes) from %s", artifact.Path, n, y.source)
+	return nil
+}
+
+// link points a symlink where the source's points, replacing it in one
+// rename as the API does when it promotes a system image. Targets must
+// stay inside the images directory.
+func (y *syncer) link(artifact manifestArtifact) error {
+	dest := y.files.file(artifact.Path)
+	target := filepath.FromSlash(artifact.Link)
+
+	resolved := filepath.Clean(filepath.Join(filepath.Dir(dest), target))
+	if filepath.IsAbs(target) || !strings.HasPrefix(resolved, filepath.Clean(y.imagesDir)+string(filepath.Separator)) {
+		return fmt.Errorf("link target %q is outside the images directory", artifact.Link)
+	}
+
+	if current, err := os.Readlink(dest); err == nil && current == target {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(dest), syncTempPrefix+filepath.Base(dest))
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// prune removes files and symlinks the source's manifest doesn't list,
+// and pulls left behind by interrupted syncs
+func (y *syncer) prune(wanted map[string]bool) error {
+	return filepath.WalkDir(y.imagesDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(y.imagesDir, file)
+		if err != nil {
+			return err
+		}
+		if wanted[filepath.ToSlash(rel)] {
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			log.Printf("Error removing %s, which %s no longer has: %v", rel, y.source, err)
+			return nil
+		}
+		log.Printf("Removed %s, which %s no longer has", rel, y.source)
+		return nil
+	})
+}
+
+// authorize adds the sync token to a request to the source
+func (y *syncer) authorize(req *http.Request) {
+	if y.token != "" {
+		req.Header.Set("Authorization", "Bearer "+y.token)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/fsnotify/fsnotify"
+)
+
+//go:embed templates/*
+var defaultTemplates embed.FS
+
+// templateFiles are the names of the boot script templates
+var templateFiles = []string{
+	"registration.ipxe",
+	"machine.ipxe",
+	"registration.grub",
+	"machine.grub",
+	"secureboot.grub",
+	"decommissioned.ipxe",
+	"decommissioned.grub",
+	"wipe.ipxe",
+	"wipe.grub",
+	"localboot.ipxe",
+	"localboot.grub",
+	"override.ipxe",
+}
+
+// templateReloadDelay collapses the events an editor or a config
+// management run produces while writing templates into a single reload
+const templateReloadDelay = 500 * time.Millisecond
+
+// templateResult is how a template loaded
+type templateResult struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // The file it was read from, or "built-in"
+	Error  string `json:"error,omitempty"`
+}
+
+// loadTemplates parses the built-in templates, replacing any that have a
+// file of the same name in dir, and renders each with sample data to catch
+// the errors parsing doesn't, such as fields that don't exist. It returns
+// the templates only if all of them load.
+func loadTemplates(dir string) (*bootTemplates, []templateResult, error) {
+	parsed := make(map[string]*template.Template, len(templateFiles))
+	results := make([]templateResult, 0, len(templateFiles))
+	var errs []error
+
+	for _, name := range templateFiles {
+		tmpl, source, err := loadTemplate(dir, name)
+		result := templateResult{Name: name, Source: source}
+		if err != nil {
+			result.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+		results = append(results, result)
+		parsed[name] = tmpl
+	}
+	if len(errs) > 0 {
+		return nil, results, errors.Join(errs...)
+	}
+
+	return &bootTemplates{
+		ipxeRegistration:   parsed["registration.ipxe"],
+		ipxeMachine:        parsed["machine.ipxe"],
+		grubRegistration:   parsed["registration.grub"],
+		grubMachine:        parsed["machine.grub"],
+		secureboot:         parsed["secureboot.grub"],
+		ipxeDecommissioned: parsed["decommissioned.ipxe"],
+		grubDecommissioned: parsed["decommissioned.grub"],
+		ipxeWipe:           parsed["wipe.ipxe"],
+		grubWipe:           parsed["wipe.grub"],
+		ipxeLocalBoot:      parsed["localboot.ipxe"],
+		grubLocalBoot:      parsed["localboot.grub"],
+		ipxeOverride:       parsed["override.ipxe"],
+	}, results, nil
+}
+
+// loadTemplate parses and test-renders one template, returning where it
+// was read from
+func loadTemplate(dir, name string) (*template.Template, string, error) {
+	source := "built-in"
+	var data []byte
+	var err error
+
+	if dir != "" {
+		file := filepath.Join(dir, name)
+		data, err = os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, file, err
+		}
+		if err == nil {
+			source = file
+		}
+	}
+	if data == nil {
+		data, err = defaultTemplates.ReadFile("templates/" + name)
+		if err != nil {
+			return nil, source, err
+		}
+	}
+
+	tmpl, err := template.New(name).Parse(string(data))
+	if err != nil {
+		return nil, source, fmt.Errorf("failed to parse: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, sampleBootConfig()); err != nil {
+		return nil, source, fmt.Errorf("failed to render: %w", err)
+	}
+	return tmpl, source, nil
+}
+
+// sampleBootConfig is the data templates are test-rendered with. Every
+// field is set; the checksums, which are read from the image files, are
+// empty.
+func sampleBootConfig() bootConfig {
+	return bootConfig{
+		ServiceTag:       "ABC1234",
+		Hostname:         "node01",
+		BaseURL:          "http://boot.example.com",
+		EnrollmentURL:    "http://enrollment.example.com/api/v1/enroll",
+		APIURL:           "http://enrollment.example.com/api/v1",
+		MachineID:        "00000000-0000-0000-0000-000000000000",
+		Arch:             archX86_64,
+		BootMode:         models.BootModeUEFI,
+		Kernel:           kernelNames[archX86_64],
+		KernelParams:     defaultKernelParams,
+		InitPath:         "/nix/store/00000000000000000000000000000000-nixos-system-node01/init",
+		ImageURL:         "http://boot.example.com/images/machines/ABC1234",
+		GrubRoot:         "(http,boot.example.com)",
+		GrubImagePath:    "(http,boot.example.com)/images/machines/ABC1234",
+		KernelURL:        "http://boot.example.com/images/machines/ABC1234/bzImage",
+		InitrdURL:        "http://boot.example.com/images/machines/ABC1234/initrd",
+		GrubKernelPath:   "(http,boot.example.com)/images/machines/ABC1234/bzImage",
+		GrubInitrdPath:   "(http,boot.example.com)/images/machines/ABC1234/initrd",
+		ExtraCmdline:     "systemd.log_level=debug",
+		ISOURL:           "http://boot.example.com/assets/0000/firmware.iso",
+		VerifySignatures: true,
+		StaleBuild:       true,
+		HooksToken:       "c2FtcGxlLWhvb2tzLXRva2Vu",
+		WipeJobID:        "00000000-0000-0000-0000-000000000001",
+		WipeToken:        "c2FtcGxlLXdpcGUtdG9rZW4",
+		ClientIP:         "2001:db8::10",
+		IPv6:             true,
+	}
+}
+
+// templateStore holds the boot templates being served. Reloads replace
+// them all at once, and only if every template loads, so a broken file
+// never stops boots from being served.
+type templateStore struct {
+	dir     string
+	current atomic.Pointer[bootTemplates]
+
+	mu         sync.Mutex
+	loadedAt   time.Time
+	lastError  string
+	lastFailed time.Time
+}
+
+// newTemplateStore loads the templates in dir. If they don't load, the
+// built-in templates are served until a reload succeeds.
+func newTemplateStore(dir string) (*templateStore, error) {
+	store := &templateStore{dir: dir}
+	if err := store.reload(); err == nil {
+		return store, nil
+	}
+
+	templates, _, err := loadTemplates("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load built-in templates: %w", err)
+	}
+	store.current.Store(templates)
+	log.Printf("WARNING: serving the built-in boot templates until the templates in %s are fixed", dir)
+	return store, nil
+}
+
+// get returns the templates being served
+func (t *templateStore) get() *bootTemplates {
+	return t.current.Load()
+}
+
+// reload loads the templates again, keeping the ones being served if any
+// fails to load
+func (t *templateStore) reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	templates, _, err := loadTemplates(t.dir)
+	if err != nil {
+		t.lastError = err.Error()
+		t.lastFailed = time.Now()
+		if t.current.Load() != nil {
+			log.Printf("ERROR: boot templates in %s failed to load; still serving the last good templates: %v", t.dir, err)
+		} else {
+			log.Printf("ERROR: boot templates in %s failed to load: %v", t.dir, err)
+		}
+		return err
+	}
+
+	t.current.Store(templates)
+	t.loadedAt = time.Now()
+	t.lastError = ""
+	if t.dir != "" {
+		log.Printf("Loaded boot templates from %s", t.dir)
+	}
+	return nil
+}
+
+// watch reloads the templates when a file in the templates directory
+// changes, and on SIGHUP
+func (t *templateStore) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if t.dir != "" {
+		if fsw, err := fsnotify.NewWatcher(); err != nil {
+			log.Printf("Failed to watch templates directory, reload with SIGHUP: %v", err)
+		} else if err := fsw.Add(t.dir); err != nil {
+			fsw.Close()
+			log.Printf("Failed to watch templates directory %s, reload with SIGHUP: %v", t.dir, err)
+		} else {
+			events, errs = fsw.Events, fsw.Errors
+		}
+	}
+
+	go func() {
+		var pending <-chan time.Time
+
+		for {
+			select {
+			case <-hup:
+				log.Printf("Reloading boot templates on SIGHUP")
+				t.reload()
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				if isTemplateFile(filepath.Base(event.Name)) {
+					pending = time.After(templateReloadDelay)
+				}
+			case <-pending:
+				pending = nil
+				t.reload()
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				log.Printf("Templates directory watcher error: %v", err)
+			}
+		}
+	}()
+}
+
+func isTemplateFile(name string) bool {
+	for _, file := range templateFiles {
+		if name == file {
+			return true
+		}
+	}
+	return false
+}
+
+// handleValidateTemplates loads the templates on disk without serving
+// them, and reports whether each parses and renders with sample data. The
+// response also says when the templates being served were loaded and why
+// the last reload failed, if it did.
+func (s *Server) handleValidateTemplates(w http.ResponseWriter, r *http.Request) {
+	_, results, err := loadTemplates(s.templates.dir)
+
+	s.templates.mu.Lock()
+	report := struct {
+		Dir        string           `json:"dir,omitempty"`
+		Valid      bool             `json:"valid"`
+		Templates  []templateResult `json:"templates"`
+		LoadedAt   *time.Time       `json:"loaded_at,omitempty"`
+		LastError  string           `json:"last_reload_error,omitempty"`
+		LastFailed *time.Time       `json:"last_reload_failed_at,omitempty"`
+	}{
+		Dir:       s.templates.dir,
+		Valid:     err == nil,
+		Templates: results,
+		LastError: s.templates.lastError,
+	}
+	if !s.templates.loadedAt.IsZero() {
+		loadedAt := s.templates.loadedAt
+		report.LoadedAt = &loadedAt
+	}
+	if report.LastError != "" {
+		lastFailed := s.templates.lastFailed
+		report.LastFailed = &lastFailed
+	}
+	s.templates.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// imageFiles finds the files behind image URLs this server serves, for the
+// template data that describes them, and keeps their checksums
+type imageFiles struct {
+	imagesDir string
+	baseURL   string
+
+	mu   sync.Mutex
+	sums map[string]fileSum
+
+	// hashing holds a channel for each file being hashed, closed when it
+	// is done, so concurrent requests for a large file hash it once
+	hashing map[string]chan struct{}
+}
+
+// fileSum is a file's SHA-256, valid while its size and modification time
+// stay the same
+type fileSum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// localPath returns the file served at an /images URL, or "" for URLs
+// this server doesn't serve from its images directory
+func (f *imageFiles) localPath(imageURL string) string {
+	if f == nil {
+		return ""
+	}
+	rel, ok := strings.CutPrefix(imageURL, f.baseURL+"/images/")
+	if !ok {
+		return ""
+	}
+	return f.file(rel)
+}
+
+// file returns the file at a slash-separated path in the images directory
+func (f *imageFiles) file(rel string) string {
+	rel = path.Clean("/" + rel)
+	return filepath.Join(f.imagesDir, filepath.FromSlash(rel))
+}
+
+// sha256 returns the SHA-256 of the file served at an /images URL, or ""
+// if there is no such file
+func (f *imageFiles) sha256(imageURL string) string {
+	file := f.localPath(imageURL)
+	if file == "" {
+		return ""
+	}
+	return f.sumFile(file)
+}
+
+// sumFile returns the SHA-256 of a file, or "" if it can't be read. Sums
+// are cached until the file changes.
+func (f *imageFiles) sumFile(file string) string {
+	for {
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			return ""
+		}
+
+		f.mu.Lock()
+		if cached, ok := f.sums[file]; ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+			f.mu.Unlock()
+			return cached.sum
+		}
+		if done, ok := f.hashing[file]; ok {
+			f.mu.Unlock()
+			<-done
+			continue
+		}
+		if f.hashing == nil {
+			f.hashing = make(map[string]chan struct{})
+		}
+		done := make(chan struct{})
+		f.hashing[file] = done
+		f.mu.Unlock()
+
+		sum, err := hashFile(file)
+
+		f.mu.Lock()
+		delete(f.hashing, file)
+		close(done)
+		if err != nil {
+			f.mu.Unlock()
+			log.Printf("Error reading %s for its checksum: %v", file, err)
+			return ""
+		}
+		if f.sums == nil {
+			f.sums = make(map[string]fileSum)
+		}
+		f.sums[file] = fileSum{size: info.Size(), modTime: info.ModTime(), sum: sum}
+		f.mu.Unlock()
+		return sum
+	}
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(file string) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// initPath returns the NixOS init path in the init file next to the
+// kernel served at an /images URL, or "" if there is none
+func (f *imageFiles) initPath(kernelURL string) string {
+	file := f.localPath(kernelURL)
+	if file == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(file), "init"))
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	line = strings.TrimSpace(line)
+
+	// The path goes on the kernel command line
+	if strings.ContainsAny(line, " \t\"'${}") {
+		log.Printf("Ignoring init path with unsafe characters next to %s", file)
+		return ""
+	}
+	return line
+}
@@ -2,16 +2,28 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/backup"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/dcim"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/lint"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ratelimit"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/web"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/webhook"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/wol"
 	"github.com/gorilla/mux"
 )
 
@@ -21,28 +33,190 @@ func main() {
 	dbDSN := flag.String("db-dsn", getEnv("DB_DSN", "metal-enrollment.db"), "Database connection string")
 	listenAddr := flag.String("listen", getEnv("LISTEN_ADDR", ":8080"), "HTTP listen address")
 	builderURL := flag.String("builder-url", getEnv("BUILDER_URL", "http://builder:8081"), "Image builder service URL")
+	ipxeURL := flag.String("ipxe-url", getEnv("IPXE_URL", ""), "iPXE server URL, for boot script previews and the Wake-on-LAN relay")
+	wolMode := flag.String("wol-mode", getEnv("WOL_MODE", ""), "How Wake-on-LAN packets are sent to machines without a BMC: relay (through the iPXE server), broadcast (from this server), or empty to disable")
+	wolBroadcastAddr := flag.String("wol-broadcast-addr", getEnv("WOL_BROADCAST_ADDR", wol.DefaultBroadcastAddr), "Address Wake-on-LAN packets are broadcast to in broadcast mode, as host:port")
+	wolRelayToken := flag.String("wol-relay-token", getEnv("WOL_RELAY_TOKEN", ""), "Bearer token sent to the iPXE server's Wake-on-LAN relay")
+	netboxURL := flag.String("netbox-url", getEnv("NETBOX_URL", ""), "NetBox URL to sync preregistered machines from, or empty to disable the sync")
+	netboxToken := flag.String("netbox-token", getEnv("NETBOX_TOKEN", ""), "NetBox API token")
+	netboxFilter := flag.String("netbox-filter", getEnv("NETBOX_FILTER", ""), "NetBox device filters selecting the devices to sync, as a query string, e.g. site=ams1&role=server")
+	netboxSyncInterval := flag.Duration("netbox-sync-interval", parseDurationEnv("NETBOX_SYNC_INTERVAL", time.Hour), "Interval between scheduled NetBox syncs (0 disables them; syncs can still be started through the API)")
 	enableAuth := flag.Bool("enable-auth", getEnv("ENABLE_AUTH", "true") == "true", "Enable authentication")
 	jwtSecret := flag.String("jwt-secret", getEnv("JWT_SECRET", "change-me-in-production"), "JWT signing secret")
+	bmcPollInterval := flag.Duration("bmc-poll-interval", parseDurationEnv("BMC_POLL_INTERVAL", 0), "Interval between scheduled BMC health checks (0 disables)")
+	powerPollInterval := flag.Duration("power-poll-interval", parseDurationEnv("POWER_POLL_INTERVAL", 0), "Interval between scheduled BMC power state reads (0 disables)")
+	bmcPollConcurrency := flag.Int("bmc-poll-concurrency", parseIntEnv("BMC_POLL_CONCURRENCY", 4), "Maximum concurrent BMC connections for health checks")
+	enrollConcurrency := flag.Int("enroll-concurrency", parseIntEnv("ENROLL_CONCURRENCY", 8), "Maximum enrollments processed at once")
+	enrollQueueDepth := flag.Int("enroll-queue-depth", parseIntEnv("ENROLL_QUEUE_DEPTH", 64), "Maximum enrollments waiting for a turn; more are answered with 503 and Retry-After")
+	enrollQueueTimeout := flag.Duration("enroll-queue-timeout", parseDurationEnv("ENROLL_QUEUE_TIMEOUT", 10*time.Second), "How long an enrollment waits for a turn before it is answered with 503 and Retry-After")
+	leaseFile := flag.String("lease-file", getEnv("LEASE_FILE", ""), "ISC dhcpd or dnsmasq lease file to read machine IPs from")
+	decommissionRetention := flag.Duration("decommission-retention", parseDurationEnv("DECOMMISSION_RETENTION", 30*24*time.Hour), "How long decommissioned machines are kept before deletion (0 keeps them forever)")
+	unschedulableTimeout := flag.Duration("unschedulable-timeout", parseDurationEnv("UNSCHEDULABLE_TIMEOUT", 15*time.Minute), "How long a build waits with no online builder able to run it before it is marked unschedulable (0 disables the check)")
+	trashRetention := flag.Duration("trash-retention", parseDurationEnv("TRASH_RETENTION", 30*24*time.Hour), "How long deleted machines are kept in the trash before permanent deletion (0 keeps them forever)")
+	claimCodeTTL := flag.Duration("claim-code-ttl", parseDurationEnv("CLAIM_CODE_TTL", 0), "How long the claim code an unclaimed machine gets at enrollment stays valid (0 disables claim codes; requires auth)")
+	trashedEnrollment := flag.String("trashed-enrollment", getEnv("TRASHED_ENROLLMENT", api.TrashedEnrollmentBlock), "What happens when a machine in the trash enrolls: block (reject the enrollment) or restore (restore the machine)")
+	metricsRefreshInterval := flag.Duration("metrics-refresh-interval", parseDurationEnv("METRICS_REFRESH_INTERVAL", 15*time.Second), "Interval between refreshes of the machine gauges and build metrics served to Prometheus (0 disables them)")
+	metricsIncludeVirtual := flag.Bool("metrics-include-virtual", getEnv("METRICS_INCLUDE_VIRTUAL", "false") == "true", "Export virtual machines, and their builds, in the Prometheus metrics")
+	bulkRequireConfirmation := flag.Bool("bulk-require-confirmation", getEnv("BULK_REQUIRE_CONFIRMATION", "false") == "true", "Require bulk updates to carry the confirmation token of a dry run of the same update")
+	eventDedupeWindow := flag.Duration("event-dedupe-window", parseDurationEnv("EVENT_DEDUPE_WINDOW", events.DefaultDedupeWindow), "How long after a machine's event an identical one is dropped (0 disables deduplication)")
+	eventRetention := flag.Duration("event-retention", parseDurationEnv("EVENT_RETENTION", 0), "How long machine events are kept before pruning (0 keeps them forever)")
+	metricsRetention := flag.Duration("metrics-retention", parseDurationEnv("METRICS_RETENTION", 0), "How long machine metrics are kept before pruning (0 keeps them forever)")
+	buildLogRetention := flag.Duration("build-log-retention", parseDurationEnv("BUILD_LOG_RETENTION", 0), "How long build logs are kept before pruning; the builds themselves are kept (0 keeps them forever)")
+	maxBuildLogKB := flag.Int("max-build-log-kb", parseIntEnv("MAX_BUILD_LOG_KB", 10240), "Maximum size of a build log moved out of the builds table in KiB; longer logs keep their start and end (0 for no limit)")
+	auditRetention := flag.Duration("audit-retention", parseDurationEnv("AUDIT_RETENTION", 0), "How long audit log entries are kept before pruning (0 keeps them forever)")
+	webhookDeliveryRetention := flag.Duration("webhook-delivery-retention", parseDurationEnv("WEBHOOK_DELIVERY_RETENTION", 0), "How long webhook deliveries are kept before pruning; each webhook's last failure is kept (0 keeps them forever)")
+	auditFields := flag.String("audit-fields", getEnv("AUDIT_FIELDS", strings.Join(api.DefaultAuditFields, ",")), "Comma-separated request body fields kept in the audit log; nothing else from request bodies is kept")
+	eventArchiveDir := flag.String("event-archive-dir", getEnv("EVENT_ARCHIVE_DIR", ""), "Directory to write pruned events to as gzipped NDJSON before deletion")
+	wipeTimeout := flag.Duration("wipe-timeout", parseDurationEnv("WIPE_TIMEOUT", 30*time.Minute), "How long a running disk wipe may go without reporting progress before it fails")
+	bmcEncryptionKey := flag.String("bmc-encryption-key", getEnv("BMC_ENCRYPTION_KEY", ""), "Key for encrypting stored BMC passwords (kept out of backups; restores need the same key)")
+	imagesDir := flag.String("images-dir", getEnv("IMAGES_DIR", "/var/lib/metal-enrollment/images"), "Directory of built images, listed in backup manifests and measured for storage usage")
+	storageReconcileInterval := flag.Duration("storage-reconcile-interval", parseDurationEnv("STORAGE_RECONCILE_INTERVAL", time.Hour), "Interval between walks of the images directory correcting its recorded usage (0 disables them)")
+	storageAlertPercent := flag.Int("storage-alert-percent", parseIntEnv("STORAGE_ALERT_PERCENT", 90), "How full in percent the images directory's filesystem gets before storage.usage_high is published (0 disables the alert)")
+	nixosDir := flag.String("nixos-dir", getEnv("NIXOS_DIR", "/etc/metal-enrollment/nixos"), "NixOS configurations directory, where system image configurations are edited")
+	attachmentsDir := flag.String("attachments-dir", getEnv("ATTACHMENTS_DIR", "/var/lib/metal-enrollment/attachments"), "Directory for files attached to machines, such as rack photos and invoices")
+	maxAttachmentKB := flag.Int("max-attachment-kb", parseIntEnv("MAX_ATTACHMENT_KB", 10240), "Maximum size of a file attached to a machine in KiB")
+	maxBMCScreenshots := flag.Int("max-bmc-screenshots", parseIntEnv("MAX_BMC_SCREENSHOTS", 10), "Number of BMC console screenshots each machine keeps as attachments")
+	bootAssetsDir := flag.String("boot-assets-dir", getEnv("BOOT_ASSETS_DIR", "/var/lib/metal-enrollment/boot-assets"), "Directory for boot override assets, shared with the iPXE server")
+	maxBootAssetMB := flag.Int("max-boot-asset-mb", parseIntEnv("MAX_BOOT_ASSET_MB", 4096), "Maximum size of a boot asset in MiB")
+	backupDir := flag.String("backup-dir", getEnv("BACKUP_DIR", ""), "Directory for stored and scheduled backups")
+	backupInterval := flag.Duration("backup-interval", parseDurationEnv("BACKUP_INTERVAL", 0), "Interval between scheduled backups to the backup directory (0 disables)")
+	backupKeep := flag.Int("backup-keep", parseIntEnv("BACKUP_KEEP", 7), "Number of backups kept in the backup directory")
+	maxBodyKB := flag.Int("max-body-kb", parseIntEnv("MAX_BODY_KB", 1024), "Maximum request body size in KiB")
+	smallBodyKB := flag.Int("small-body-kb", parseIntEnv("SMALL_BODY_KB", 256), "Maximum request body size in KiB for login and enrollment")
+	largeBodyKB := flag.Int("large-body-kb", parseIntEnv("LARGE_BODY_KB", 16384), "Maximum request body size in KiB for NixOS configurations, templates, bulk operations, and lease imports")
+	idempotencyTTL := flag.Duration("idempotency-ttl", parseDurationEnv("IDEMPOTENCY_TTL", 24*time.Hour), "How long responses to requests with an Idempotency-Key are kept for retries")
+	publicURL := flag.String("public-url", getEnv("PUBLIC_URL", ""), "The server's URL as clients reach it, sent as the source of CloudEvents webhook deliveries and used in unsubscribe links")
+	subscriptionChannel := flag.String("subscription-channel", getEnv("SUBSCRIPTION_CHANNEL", ""), "Name or ID of the email notification channel users' own subscriptions are emailed through (default: the oldest active email channel)")
+	maxSubscriptions := flag.Int("max-subscriptions", parseIntEnv("MAX_SUBSCRIPTIONS", models.DefaultMaxSubscriptions), "Maximum subscriptions each user may have")
+	subscriptionDigestInterval := flag.Duration("subscription-digest-interval", parseDurationEnv("SUBSCRIPTION_DIGEST_INTERVAL", api.DefaultSubscriptionDigestInterval), "Interval between emails of the events held for digest subscriptions")
+	webhookAllowHTTP := flag.Bool("webhook-allow-http", getEnv("WEBHOOK_ALLOW_HTTP", "false") == "true", "Allow webhook URLs that use plain http")
+	webhookDisableAfterFailures := flag.Int("webhook-disable-after-failures", parseIntEnv("WEBHOOK_DISABLE_AFTER_FAILURES", webhook.DefaultDisableAfterFailures), "Failure streak at which webhooks that don't set their own are deactivated (0 never deactivates them)")
+	webhookDisableAfter := flag.Duration("webhook-disable-after", parseDurationEnv("WEBHOOK_DISABLE_AFTER", webhook.DefaultDisableAfter), "How long a webhook's failure streak must have lasted before it is deactivated, for webhooks that don't set their own")
+	requireImageTest := flag.Bool("require-image-test", getEnv("REQUIRE_IMAGE_TEST", "false") == "true", "Keep machines in testing after a build until the build's boot test passes")
+	requireBuildApproval := flag.Bool("require-build-approval", getEnv("REQUIRE_BUILD_APPROVAL", "false") == "true", "Hold builds not queued by an admin, and bulk builds, for an admin's approval")
+	rateLimit := flag.Bool("rate-limit", getEnv("RATE_LIMIT", "true") == "true", "Limit how fast each client can make API requests")
+	rateLimitEnroll := flag.String("rate-limit-enroll", getEnv("RATE_LIMIT_ENROLL", "30/1m"), "Enrollment rate limit per source address, as <requests>/<period>")
+	rateLimitClaim := flag.String("rate-limit-claim", getEnv("RATE_LIMIT_CLAIM", "10/1m"), "Machine claim rate limit per user, as <requests>/<period>")
+	rateLimitMetrics := flag.String("rate-limit-metrics", getEnv("RATE_LIMIT_METRICS", "12/1m"), "Metrics submission rate limit per machine, as <requests>/<period>")
+	rateLimitPower := flag.String("rate-limit-power", getEnv("RATE_LIMIT_POWER", "30/1m"), "Rate limit of power and BMC requests per user, as <requests>/<period>")
+	rateLimitDefault := flag.String("rate-limit-default", getEnv("RATE_LIMIT_DEFAULT", "600/1m"), "Rate limit of all other requests per user, or per source address without credentials, as <requests>/<period>")
+	rateLimitExempt := flag.String("rate-limit-exempt-users", getEnv("RATE_LIMIT_EXEMPT_USERS", ""), "Comma-separated usernames that are never rate limited, e.g. a Prometheus scraper's account")
+	lintRulesFile := flag.String("lint-rules", getEnv("LINT_RULES", "/etc/metal-enrollment/lint-rules.json"), "JSON file of the rules configurations are linted with before builds, managed through the lint rules API (empty runs only the built-in checks)")
+	quotaBuilds := flag.String("quota-builds", getEnv("QUOTA_BUILDS", ""), "Builds users of each role may queue per 24 hours, as comma-separated role=limit pairs, e.g. operator=100 (roles not listed are unlimited)")
+	quotaPowerOperations := flag.String("quota-power-operations", getEnv("QUOTA_POWER_OPERATIONS", ""), "Power operations users of each role may start per 24 hours, as comma-separated role=limit pairs (roles not listed are unlimited)")
+	trustedProxies := flag.String("trusted-proxies", getEnv("TRUSTED_PROXIES", ""), "Comma-separated addresses and CIDR ranges of proxies whose X-Forwarded-For headers are believed")
+	restore := flag.String("restore", "", "Restore the database from a backup archive and exit")
+	migrateBuildLogs := flag.Bool("migrate-build-logs", false, "Move build logs stored in the builds table to compressed log storage and exit")
 	createAdmin := flag.Bool("create-admin", false, "Create default admin user")
 	flag.Parse()
 
-	// Initialize database
-	db, err := database.New(database.Config{
+	rateLimits := api.RateLimitConfig{Disabled: !*rateLimit}
+	for _, l := range []struct {
+		flag  string
+		value string
+		limit *ratelimit.Limit
+	}{
+		{"rate-limit-enroll", *rateLimitEnroll, &rateLimits.Enroll},
+		{"rate-limit-claim", *rateLimitClaim, &rateLimits.Claim},
+		{"rate-limit-metrics", *rateLimitMetrics, &rateLimits.Metrics},
+		{"rate-limit-power", *rateLimitPower, &rateLimits.Power},
+		{"rate-limit-default", *rateLimitDefault, &rateLimits.Default},
+	} {
+		limit, err := ratelimit.ParseLimit(l.value)
+		if err != nil {
+			log.Fatalf("Invalid -%s: %v", l.flag, err)
+		}
+		*l.limit = limit
+	}
+	for _, user := range strings.Split(*rateLimitExempt, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			rateLimits.ExemptUsers = append(rateLimits.ExemptUsers, user)
+		}
+	}
+
+	quotas := map[models.UserRole]*models.QuotaLimits{}
+	for _, q := range []struct {
+		flag  string
+		value string
+		kind  string
+	}{
+		{"quota-builds", *quotaBuilds, models.QuotaBuilds},
+		{"quota-power-operations", *quotaPowerOperations, models.QuotaPowerOperations},
+	} {
+		limits, err := models.ParseRoleQuotas(q.value)
+		if err != nil {
+			log.Fatalf("Invalid -%s: %v", q.flag, err)
+		}
+		for role, limit := range limits {
+			if quotas[role] == nil {
+				quotas[role] = &models.QuotaLimits{}
+			}
+			quotas[role].Set(q.kind, limit)
+		}
+	}
+
+	var auditFieldList []string
+	for _, field := range strings.Split(*auditFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			auditFieldList = append(auditFieldList, field)
+		}
+	}
+
+	trustedProxyList, err := api.ParseTrustedProxies(strings.Split(*trustedProxies, ","))
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+
+	switch *wolMode {
+	case "", api.WOLModeBroadcast:
+	case api.WOLModeRelay:
+		if *ipxeURL == "" {
+			log.Fatalf("Wake-on-LAN relay mode needs the iPXE server URL")
+		}
+	default:
+		log.Fatalf("Invalid -wol-mode %q: must be relay or broadcast", *wolMode)
+	}
+
+	switch *trashedEnrollment {
+	case api.TrashedEnrollmentBlock, api.TrashedEnrollmentRestore:
+	default:
+		log.Fatalf("Invalid -trashed-enrollment %q: must be block or restore", *trashedEnrollment)
+	}
+
+	dbConfig := database.Config{
 		Driver: *dbDriver,
 		DSN:    *dbDSN,
-	})
+	}
+
+	if *restore != "" {
+		os.Exit(runRestore(*restore, dbConfig, *bmcEncryptionKey, *imagesDir))
+	}
+
+	// Initialize database
+	db, err := openDatabase(dbConfig)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		log.Fatalf("%v", err)
 	}
 	defer db.Close()
 
-	// Run migrations
-	if err := db.Migrate(); err != nil {
-		log.Fatalf("Failed to run migrations: %v", err)
+	if err := db.SetSecretKey(*bmcEncryptionKey); err != nil {
+		log.Fatalf("Invalid BMC encryption key: %v", err)
+	}
+	if err := db.VerifySecretKey(); err != nil {
+		log.Fatalf("%v", err)
 	}
 
 	log.Printf("Database initialized successfully (%s)", *dbDriver)
 
+	if *migrateBuildLogs {
+		moved, err := db.MigrateBuildLogs(*maxBuildLogKB << 10)
+		if err != nil {
+			log.Fatalf("Failed to migrate build logs after moving %d: %v", moved, err)
+		}
+		log.Printf("Moved %d build logs to log storage", moved)
+		return
+	}
+
 	// Create default admin user if requested
 	if *createAdmin {
 		if err := createDefaultAdmin(db); err != nil {
@@ -50,6 +224,20 @@ func main() {
 		}
 	}
 
+	var dcimSource dcim.Source
+	if *netboxURL != "" {
+		netbox, err := dcim.NewNetBox(*netboxURL, *netboxToken, *netboxFilter)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		dcimSource = netbox
+	}
+
+	lintRules, err := lint.Open(*lintRulesFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	// Create API server
 	apiServer := api.New(db, api.Config{
 		ListenAddr: *listenAddr,
@@ -57,16 +245,158 @@ func main() {
 		JWTSecret:  *jwtSecret,
 		JWTExpiry:  24 * time.Hour,
 		EnableAuth: *enableAuth,
+
+		BMCPollConcurrency: *bmcPollConcurrency,
+
+		EnrollConcurrency:  *enrollConcurrency,
+		EnrollQueueDepth:   *enrollQueueDepth,
+		EnrollQueueTimeout: *enrollQueueTimeout,
+
+		ImagesDir:  *imagesDir,
+		NixOSDir:   *nixosDir,
+		BackupDir:  *backupDir,
+		BackupKeep: *backupKeep,
+
+		StorageAlertPercent: *storageAlertPercent,
+
+		MaxBodyBytes:   int64(*maxBodyKB) << 10,
+		SmallBodyBytes: int64(*smallBodyKB) << 10,
+		LargeBodyBytes: int64(*largeBodyKB) << 10,
+
+		IdempotencyTTL:    *idempotencyTTL,
+		EventDedupeWindow: *eventDedupeWindow,
+
+		WebhookDisableAfterFailures: *webhookDisableAfterFailures,
+		WebhookDisableAfter:         *webhookDisableAfter,
+
+		WebhookAllowHTTP:     *webhookAllowHTTP,
+		PublicURL:            *publicURL,
+		SubscriptionChannel:  *subscriptionChannel,
+		MaxSubscriptions:     *maxSubscriptions,
+		RequireImageTest:     *requireImageTest,
+		RequireBuildApproval: *requireBuildApproval,
+		MaxBuildLogBytes:     *maxBuildLogKB << 10,
+		RateLimits:           rateLimits,
+		IPXEURL:              *ipxeURL,
+		WOLMode:              *wolMode,
+		WOLBroadcastAddr:     *wolBroadcastAddr,
+		WOLRelayToken:        *wolRelayToken,
+
+		TrashedEnrollment: *trashedEnrollment,
+		ClaimCodeTTL:      *claimCodeTTL,
+
+		AttachmentsDir:     *attachmentsDir,
+		MaxAttachmentBytes: int64(*maxAttachmentKB) << 10,
+		MaxBMCScreenshots:  *maxBMCScreenshots,
+
+		BootAssetsDir:     *bootAssetsDir,
+		MaxBootAssetBytes: int64(*maxBootAssetMB) << 20,
+
+		AuditFields: auditFieldList,
+
+		DCIM: dcimSource,
+
+		TrustedProxies: trustedProxyList,
+
+		MetricsIncludeVirtual:   *metricsIncludeVirtual,
+		BulkRequireConfirmation: *bulkRequireConfirmation,
+
+		LintRules: lintRules,
+		Quotas:    quotas,
 	})
 
+	apiServer.StartIdempotencyCleanup()
+	apiServer.StartBuildRolloutOrchestrator()
+
+	if *bmcPollInterval > 0 {
+		apiServer.StartBMCPoller(*bmcPollInterval)
+	}
+	if *powerPollInterval > 0 {
+		apiServer.StartPowerPoller(*powerPollInterval)
+	}
+
+	if *metricsRefreshInterval > 0 {
+		apiServer.StartMetricsRefresher(*metricsRefreshInterval)
+	}
+
+	if *storageReconcileInterval > 0 || *storageAlertPercent > 0 {
+		apiServer.StartStorageAccounting(*storageReconcileInterval)
+	}
+
+	if *unschedulableTimeout > 0 {
+		apiServer.StartUnschedulableCheck(*unschedulableTimeout)
+	}
+
+	if *netboxSyncInterval > 0 {
+		apiServer.StartDCIMSync(*netboxSyncInterval)
+	}
+
+	if *decommissionRetention > 0 {
+		apiServer.StartDecommissionPurger(*decommissionRetention)
+	}
+
+	if *trashRetention > 0 {
+		apiServer.StartTrashPurger(*trashRetention)
+	}
+
+	if *eventRetention > 0 || *metricsRetention > 0 || *buildLogRetention > 0 || *auditRetention > 0 || *webhookDeliveryRetention > 0 {
+		apiServer.StartRetention(api.RetentionConfig{
+			Events:            *eventRetention,
+			Metrics:           *metricsRetention,
+			BuildLogs:         *buildLogRetention,
+			Audit:             *auditRetention,
+			WebhookDeliveries: *webhookDeliveryRetention,
+			ArchiveDir:        *eventArchiveDir,
+		})
+	}
+
+	if *wipeTimeout > 0 {
+		apiServer.StartWipeWatchdog(*wipeTimeout)
+	}
+	apiServer.StartDiagnosticsWatchdog()
+	apiServer.StartProvisioningWatchdog()
+	apiServer.StartBuildLeaseWatchdog()
+	apiServer.StartBuildScheduler()
+
+	if *enableAuth && *subscriptionDigestInterval > 0 {
+		apiServer.StartSubscriptionDigests(*subscriptionDigestInterval)
+	}
+
+	if *backupInterval > 0 {
+		if *backupDir == "" {
+			log.Fatalf("Scheduled backups need a backup directory")
+		}
+		apiServer.StartBackups(*backupInterval)
+	}
+
+	if *leaseFile != "" {
+		if err := apiServer.StartLeaseWatcher(*leaseFile); err != nil {
+			log.Fatalf("Failed to watch lease file: %v", err)
+		}
+	}
+
 	// Create web server
-	webServer := web.NewServer(db)
+	webServer := web.NewServer(db, apiServer.Service(), *ipxeURL)
 
 	// Combine routers
 	router := mux.NewRouter()
 	router.PathPrefix("/api/").Handler(apiServer.Router)
 	router.PathPrefix("/").Handler(webServer.Router())
 
+	// Hand periodic jobs to another replica right away on shutdown, and
+	// leave SQLite databases without a write-ahead log to lose
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		apiServer.ReleaseJobLocks()
+		if err := db.Checkpoint(); err != nil {
+			log.Printf("%v", err)
+		}
+		db.Close()
+		os.Exit(0)
+	}()
+
 	// Start server
 	log.Printf("Starting Metal Enrollment server on %s (auth: %v)", *listenAddr, *enableAuth)
 	if err := http.ListenAndServe(*listenAddr, router); err != nil {
@@ -74,6 +404,59 @@ func main() {
 	}
 }
 
+// openDatabase connects to the database and migrates it. A database that
+// fails its integrity check is neither migrated nor served.
+func openDatabase(config database.Config) (*database.DB, error) {
+	db, err := database.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	check, err := db.CheckIntegrity(false)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	if !check.OK {
+		db.Close()
+		return nil, fmt.Errorf("database failed its integrity check, restore it from a backup: %s", strings.Join(check.IntegrityCheck, "; "))
+	}
+
+	if err := db.Migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+	return db, nil
+}
+
+// runRestore restores a backup over the configured database and returns the
+// process exit code
+func runRestore(archive string, dbConfig database.Config, secretKey, imagesDir string) int {
+	report, err := backup.Restore(archive, dbConfig, secretKey, imagesDir)
+	if err != nil {
+		log.Printf("Restore failed: %v", err)
+		return 1
+	}
+
+	log.Printf("Restored %s database from backup taken %s", report.Manifest.Driver, report.Manifest.CreatedAt.Format(time.RFC3339))
+	if report.PreviousDatabase != "" {
+		log.Printf("Previous database moved to %s", report.PreviousDatabase)
+	}
+
+	for _, path := range report.Missing {
+		log.Printf("Missing artifact: %s", path)
+	}
+	for _, path := range report.Changed {
+		log.Printf("Changed artifact: %s", path)
+	}
+	if len(report.Missing) > 0 || len(report.Changed) > 0 {
+		log.Printf("%d of %d artifacts are missing or changed in %s; rebuild the affected machines",
+			len(report.Missing)+len(report.Changed), len(report.Manifest.Artifacts), imagesDir)
+	}
+
+	return 0
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -81,6 +464,26 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func parseDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Ignoring invalid %s=%q", key, value)
+	}
+	return defaultValue
+}
+
+func parseIntEnv(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		log.Printf("Ignoring invalid %s=%q", key, value)
+	}
+	return defaultValue
+}
+
 func createDefaultAdmin(db *database.DB) error {
 	// Check if admin already exists
 	admin, err := db.GetUserByUsername("admin")
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+)
+
+// copyFixture copies a database from testdata into a directory of its own,
+// so opening it can't change the fixture
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestOpenCorruptDatabase starts on testdata/corrupt.db, a database that
+// SQLite still reads without complaint: a table of 100 machines whose
+// service tag index had the entry TAG00050 overwritten with TAG99950
+func TestOpenCorruptDatabase(t *testing.T) {
+	path := copyFixture(t, "corrupt.db")
+
+	db, err := openDatabase(database.Config{Driver: "sqlite3", DSN: path})
+	if err == nil {
+		db.Close()
+		t.Fatal("opened a corrupt database")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "failed its integrity check") || !strings.Contains(msg, "row 50 missing from index idx_tag") {
+		t.Errorf("err = %q, want the integrity check's findings", msg)
+	}
+
+	// The database was neither migrated nor backed up for a migration
+	backups, _ := filepath.Glob(path + ".pre-migrate.*")
+	if len(backups) != 0 {
+		t.Errorf("backed up to %v", backups)
+	}
+	raw, err := database.New(database.Config{Driver: "sqlite3", DSN: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var tables int
+	if err := raw.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 1 {
+		t.Errorf("database has %d tables, want the fixture's one", tables)
+	}
+}
+
+func TestOpenDatabase(t *testing.T) {
+	db, err := openDatabase(database.Config{Driver: "sqlite3", DSN: filepath.Join(t.TempDir(), "metal.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if check := db.LastCheck(); check == nil || !check.OK {
+		t.Errorf("last check = %+v, want the startup check, passed", check)
+	}
+	if _, err := db.ListMachines(); err != nil {
+		t.Errorf("database isn't migrated: %v", err)
+	}
+}
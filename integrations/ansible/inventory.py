@@ -57,8 +57,8 @@ class MetalInventory:
             sys.exit(1)
 
     def get_machines(self):
-        """Get all machines from the API"""
-        return self._make_request('machines')
+        """Get all machines from the API, with hardware and BMC details"""
+        return self._make_request('machines?view=full')
 
     def get_groups(self):
         """Get all groups from the API"""
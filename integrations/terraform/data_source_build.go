@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// buildPollInterval is how often a build data source with wait_timeout
+// checks for a successful build
+const buildPollInterval = 15 * time.Second
+
+// buildSchema is the schema of a build's attributes, shared by the build
+// data source and the machine data source's latest_successful_build
+func buildSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"id": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "Build ID",
+		},
+		"status": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "Build status",
+		},
+		"artifact_url": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "URL of the built image",
+		},
+		"created_at": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "When the build was requested",
+		},
+		"completed_at": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "When the build finished",
+		},
+	}
+}
+
+func dataSourceBuild() *schema.Resource {
+	s := buildSchema()
+	s["id"] = &schema.Schema{
+		Type:         schema.TypeString,
+		Optional:     true,
+		Computed:     true,
+		ExactlyOneOf: []string{"id", "machine_id"},
+		Description:  "Build ID",
+	}
+	s["machine_id"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		Computed:    true,
+		Description: "Machine whose latest successful build to read",
+	}
+	s["wait_timeout"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+		ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+			if _, err := time.ParseDuration(v.(string)); err != nil {
+				return nil, []error{fmt.Errorf("%s must be a duration such as 30m: %v", k, err)}
+			}
+			return nil, nil
+		},
+		Description: "How long to wait for the build to succeed, such as 30m. Without it, a build that hasn't succeeded is an error.",
+	}
+
+	return &schema.Resource{
+		ReadContext: dataSourceBuildRead,
+		Schema:      s,
+	}
+}
+
+func dataSourceBuildRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	var timeout time.Duration
+	if v, ok := d.GetOk("wait_timeout"); ok {
+		timeout, _ = time.ParseDuration(v.(string))
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		build, err := readSuccessfulBuild(ctx, client, d.Get("id").(string), d.Get("machine_id").(string))
+		if err != nil {
+			return diag.FromErr(err)
+		}
+		if build != nil {
+			d.SetId(fmt.Sprint(build["id"]))
+			d.Set("machine_id", build["machine_id"])
+			for key, value := range flattenBuild(build) {
+				if key != "id" {
+					d.Set(key, value)
+				}
+			}
+			return nil
+		}
+
+		if !time.Now().Add(buildPollInterval).Before(deadline) {
+			if id := d.Get("id").(string); id != "" {
+				return diag.Errorf("build %s has not succeeded", id)
+			}
+			return diag.Errorf("machine %s has no successful build", d.Get("machine_id").(string))
+		}
+
+		select {
+		case <-ctx.Done():
+			return diag.FromErr(ctx.Err())
+		case <-time.After(buildPollInterval):
+		}
+	}
+}
+
+// readSuccessfulBuild reads build id, or machineID's latest successful build
+// if id is empty. It returns nil if the build hasn't succeeded yet, and an
+// error if it never will.
+func readSuccessfulBuild(ctx context.Context, client *apiClient, id, machineID string) (map[string]interface{}, error) {
+	if id == "" {
+		return latestSuccessfulBuild(ctx, client, machineID)
+	}
+
+	var build map[string]interface{}
+	if err := getJSON(ctx, client, "/api/v1/builds/"+url.PathEscape(id), &build); err != nil {
+		return nil, err
+	}
+
+	switch build["status"] {
+	case "success":
+		return build, nil
+	case "pending", "building":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("build %s finished with status %v", id, build["status"])
+	}
+}
+
+// latestSuccessfulBuild reads a machine's latest successful build. It
+// returns nil if the machine has none.
+func latestSuccessfulBuild(ctx context.Context, client *apiClient, machineID string) (map[string]interface{}, error) {
+	var builds []map[string]interface{}
+	path := fmt.Sprintf("/api/v1/machines/%s/builds?status=success&limit=1", url.PathEscape(machineID))
+	if err := getJSON(ctx, client, path, &builds); err != nil {
+		return nil, err
+	}
+
+	if len(builds) == 0 {
+		return nil, nil
+	}
+	return builds[0], nil
+}
+
+// flattenBuild returns the attributes in buildSchema from a build
+func flattenBuild(build map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	for key := range buildSchema() {
+		if value, ok := build[key]; ok && value != nil {
+			flat[key] = fmt.Sprint(value)
+		} else {
+			flat[key] = ""
+		}
+	}
+	return flat
+}
+
+// getJSON reads an API path into out
+func getJSON(ctx context.Context, client *apiClient, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", client.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	if client.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", client.Token))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return responseError(resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode API response: %w", err)
+	}
+	return nil
+}
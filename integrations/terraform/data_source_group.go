@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sort"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func dataSourceGroup() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataSourceGroupRead,
+
+		Schema: map[string]*schema.Schema{
+			"id": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ExactlyOneOf: []string{"id", "name"},
+				Description:  "Group ID",
+			},
+			"name": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Group name",
+			},
+			"description": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Group description",
+			},
+			"tags": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Group tags",
+			},
+			"machine_ids": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "IDs of the group's machines, sorted",
+			},
+		},
+	}
+}
+
+func dataSourceGroupRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	var group groupSummary
+	if id := d.Get("id").(string); id != "" {
+		if err := getJSON(ctx, client, "/api/v1/groups/"+url.PathEscape(id), &group); err != nil {
+			return diag.FromErr(err)
+		}
+	} else {
+		name := d.Get("name").(string)
+
+		var groups []groupSummary
+		if err := getJSON(ctx, client, "/api/v1/groups", &groups); err != nil {
+			return diag.FromErr(err)
+		}
+		for _, g := range groups {
+			if g.Name == name {
+				group = g
+				break
+			}
+		}
+		if group.ID == "" {
+			return diag.Errorf("no group named %s", name)
+		}
+	}
+
+	var members []struct {
+		ID string `json:"id"`
+	}
+	if err := getJSON(ctx, client, "/api/v1/groups/"+url.PathEscape(group.ID)+"/machines", &members); err != nil {
+		return diag.FromErr(err)
+	}
+	machineIDs := make([]string, 0, len(members))
+	for _, m := range members {
+		machineIDs = append(machineIDs, m.ID)
+	}
+	sort.Strings(machineIDs)
+
+	tags := group.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	d.SetId(group.ID)
+	d.Set("name", group.Name)
+	d.Set("description", group.Description)
+	d.Set("tags", tags)
+	d.Set("machine_ids", machineIDs)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// groupSummary is a group as the API lists it, with the attributes the
+// groups data source exposes
+type groupSummary struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+func dataSourceGroups() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataSourceGroupsRead,
+
+		Schema: map[string]*schema.Schema{
+			"tags": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only groups with all of these tags",
+			},
+			"groups": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The matching groups, ordered by name",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"id":          {Type: schema.TypeString, Computed: true, Description: "Group ID"},
+						"name":        {Type: schema.TypeString, Computed: true, Description: "Group name"},
+						"description": {Type: schema.TypeString, Computed: true, Description: "Group description"},
+						"tags": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Elem:        &schema.Schema{Type: schema.TypeString},
+							Description: "Group tags",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func dataSourceGroupsRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	var groups []groupSummary
+	if err := getJSON(ctx, client, "/api/v1/groups", &groups); err != nil {
+		return diag.FromErr(err)
+	}
+
+	// The API lists every group, so tags are matched here
+	tags := expandStringSet(d.Get("tags").(*schema.Set))
+	flat := []map[string]interface{}{}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Name != groups[j].Name {
+			return groups[i].Name < groups[j].Name
+		}
+		return groups[i].ID < groups[j].ID
+	})
+	for _, g := range groups {
+		if !hasAllTags(g.Tags, tags) {
+			continue
+		}
+		groupTags := g.Tags
+		if groupTags == nil {
+			groupTags = []string{}
+		}
+		flat = append(flat, map[string]interface{}{
+			"id":          g.ID,
+			"name":        g.Name,
+			"description": g.Description,
+			"tags":        groupTags,
+		})
+	}
+	if err := d.Set("groups", flat); err != nil {
+		return diag.FromErr(err)
+	}
+
+	filters := url.Values{}
+	for _, tag := range tags {
+		filters.Add("tag", tag)
+	}
+	d.SetId(filterID("groups", filters))
+	return nil
+}
+
+// hasAllTags reports whether have includes every tag in want. Tags are
+// matched ignoring case, as the API stores them lowercased.
+func hasAllTags(have, want []string) bool {
+	set := make(map[string]bool, len(have))
+	for _, tag := range have {
+		set[strings.ToLower(tag)] = true
+	}
+	for _, tag := range want {
+		if !set[strings.ToLower(strings.TrimSpace(tag))] {
+			return false
+		}
+	}
+	return true
+}
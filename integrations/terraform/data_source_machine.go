@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func dataSourceMachine() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataSourceMachineRead,
+
+		Schema: map[string]*schema.Schema{
+			"id": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ExactlyOneOf: []string{"id", "service_tag"},
+				Description:  "Machine ID",
+			},
+			"service_tag": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Machine service tag",
+			},
+			"hostname": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Machine hostname",
+			},
+			"description": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Machine description",
+			},
+			"status": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Machine status",
+			},
+			"mac_address": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Machine MAC address",
+			},
+			"enrolled_at": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Enrollment timestamp",
+			},
+			"latest_successful_build": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The machine's latest successful build, if it has one",
+				Elem: &schema.Resource{
+					Schema: buildSchema(),
+				},
+			},
+		},
+	}
+}
+
+func dataSourceMachineRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	id := d.Get("id").(string)
+	if id == "" {
+		serviceTag := d.Get("service_tag").(string)
+
+		// The service_tag filter matches substrings
+		var machines []map[string]interface{}
+		if err := getJSON(ctx, client, "/api/v1/machines?service_tag="+url.QueryEscape(serviceTag), &machines); err != nil {
+			return diag.FromErr(err)
+		}
+		for _, m := range machines {
+			if m["service_tag"] == serviceTag {
+				id = fmt.Sprint(m["id"])
+				break
+			}
+		}
+		if id == "" {
+			return diag.Errorf("no machine with service tag %s", serviceTag)
+		}
+	}
+
+	var machine map[string]interface{}
+	if err := getJSON(ctx, client, "/api/v1/machines/"+url.PathEscape(id), &machine); err != nil {
+		return diag.FromErr(err)
+	}
+
+	build, err := latestSuccessfulBuild(ctx, client, id)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(id)
+	d.Set("service_tag", machine["service_tag"])
+	d.Set("hostname", machine["hostname"])
+	d.Set("description", machine["description"])
+	d.Set("status", machine["status"])
+	d.Set("mac_address", machine["mac_address"])
+	d.Set("enrolled_at", machine["enrolled_at"])
+
+	builds := []map[string]interface{}{}
+	if build != nil {
+		builds = append(builds, flattenBuild(build))
+	}
+	d.Set("latest_successful_build", builds)
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// machinesPageSize is how many machines the machines data source reads per
+// request. Tests lower it to read several pages of a few machines.
+var machinesPageSize = 500
+
+// machineSummary is a machine as the API lists it, with the attributes the
+// machines data source exposes
+type machineSummary struct {
+	ID           string   `json:"id"`
+	ServiceTag   string   `json:"service_tag"`
+	Hostname     string   `json:"hostname"`
+	Description  string   `json:"description"`
+	Status       string   `json:"status"`
+	MACAddress   string   `json:"mac_address"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	Tags         []string `json:"tags"`
+	CurrentIP    string   `json:"current_ip"`
+	CPUCores     int      `json:"cpu_cores"`
+	MemoryGB     float64  `json:"memory_gb"`
+	GPUCount     int      `json:"gpu_count"`
+	Virtual      bool     `json:"virtual"`
+	StaleBuild   bool     `json:"stale_build"`
+	EnrolledAt   string   `json:"enrolled_at"`
+}
+
+func dataSourceMachines() *schema.Resource {
+	return &schema.Resource{
+		ReadContext: dataSourceMachinesRead,
+
+		Schema: map[string]*schema.Schema{
+			"status": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Only machines with this status",
+			},
+			"group_id": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Only machines in this group",
+			},
+			"manufacturer": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Only machines whose manufacturer contains this",
+			},
+			"model": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Only machines whose model contains this",
+			},
+			"search": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Only machines whose service tag, hostname, MAC address, or description contains this",
+			},
+			"tags": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Only machines with all of these tags",
+			},
+			"machines": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "The matching machines, ordered by service tag",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"id":           {Type: schema.TypeString, Computed: true, Description: "Machine ID"},
+						"service_tag":  {Type: schema.TypeString, Computed: true, Description: "Machine service tag"},
+						"hostname":     {Type: schema.TypeString, Computed: true, Description: "Machine hostname"},
+						"description":  {Type: schema.TypeString, Computed: true, Description: "Machine description"},
+						"status":       {Type: schema.TypeString, Computed: true, Description: "Machine status"},
+						"mac_address":  {Type: schema.TypeString, Computed: true, Description: "Machine MAC address"},
+						"manufacturer": {Type: schema.TypeString, Computed: true, Description: "Hardware manufacturer"},
+						"model":        {Type: schema.TypeString, Computed: true, Description: "Hardware model"},
+						"current_ip":   {Type: schema.TypeString, Computed: true, Description: "The machine's current IP address, if known"},
+						"cpu_cores":    {Type: schema.TypeInt, Computed: true, Description: "CPU cores"},
+						"memory_gb":    {Type: schema.TypeFloat, Computed: true, Description: "Memory in GB"},
+						"gpu_count":    {Type: schema.TypeInt, Computed: true, Description: "Number of GPUs"},
+						"virtual":      {Type: schema.TypeBool, Computed: true, Description: "Whether the machine is virtual, with no hardware"},
+						"stale_build":  {Type: schema.TypeBool, Computed: true, Description: "Whether the configuration changed since the last successful build"},
+						"enrolled_at":  {Type: schema.TypeString, Computed: true, Description: "Enrollment timestamp"},
+						"tags": {
+							Type:        schema.TypeList,
+							Computed:    true,
+							Elem:        &schema.Schema{Type: schema.TypeString},
+							Description: "Machine tags",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func dataSourceMachinesRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	// Filters are passed through to the API, which matches them the same
+	// way as the machine list
+	query := url.Values{}
+	for _, key := range []string{"status", "manufacturer", "model", "search"} {
+		if v := d.Get(key).(string); v != "" {
+			query.Set(key, v)
+		}
+	}
+	tags := expandStringSet(d.Get("tags").(*schema.Set))
+	for _, tag := range tags {
+		query.Add("tag", tag)
+	}
+
+	machines, err := listMachines(ctx, client, query)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	// The machine list has no group filter, so group members are read
+	// separately and the rest dropped
+	groupID := d.Get("group_id").(string)
+	if groupID != "" {
+		var members []struct {
+			ID string `json:"id"`
+		}
+		if err := getJSON(ctx, client, "/api/v1/groups/"+url.PathEscape(groupID)+"/machines", &members); err != nil {
+			return diag.FromErr(err)
+		}
+		inGroup := make(map[string]bool, len(members))
+		for _, m := range members {
+			inGroup[m.ID] = true
+		}
+		filtered := machines[:0]
+		for _, m := range machines {
+			if inGroup[m.ID] {
+				filtered = append(filtered, m)
+			}
+		}
+		machines = filtered
+	}
+
+	// The API lists machines newest first, which changes as machines
+	// enroll; ordering by service tag keeps plans stable
+	sort.Slice(machines, func(i, j int) bool {
+		if machines[i].ServiceTag != machines[j].ServiceTag {
+			return machines[i].ServiceTag < machines[j].ServiceTag
+		}
+		return machines[i].ID < machines[j].ID
+	})
+
+	flat := make([]map[string]interface{}, 0, len(machines))
+	for _, m := range machines {
+		flat = append(flat, flattenMachineSummary(m))
+	}
+	if err := d.Set("machines", flat); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if groupID != "" {
+		query.Set("group_id", groupID)
+	}
+	d.SetId(filterID("machines", query))
+	return nil
+}
+
+// listMachines reads every machine matching query, a page at a time
+func listMachines(ctx context.Context, client *apiClient, query url.Values) ([]machineSummary, error) {
+	var machines []machineSummary
+	for offset := 0; ; offset += machinesPageSize {
+		page := url.Values{}
+		for key, values := range query {
+			page[key] = values
+		}
+		page.Set("limit", strconv.Itoa(machinesPageSize))
+		page.Set("offset", strconv.Itoa(offset))
+
+		var batch []machineSummary
+		if err := getJSON(ctx, client, "/api/v1/machines?"+page.Encode(), &batch); err != nil {
+			return nil, err
+		}
+		machines = append(machines, batch...)
+		if len(batch) < machinesPageSize {
+			break
+		}
+	}
+
+	// A machine enrolled while paging shifts the pages after it, which can
+	// list a machine twice
+	seen := make(map[string]bool, len(machines))
+	unique := machines[:0]
+	for _, m := range machines {
+		if !seen[m.ID] {
+			seen[m.ID] = true
+			unique = append(unique, m)
+		}
+	}
+	return unique, nil
+}
+
+// flattenMachineSummary returns the attributes of a machine in the machines
+// data source's machines list
+func flattenMachineSummary(m machineSummary) map[string]interface{} {
+	tags := m.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return map[string]interface{}{
+		"id":           m.ID,
+		"service_tag":  m.ServiceTag,
+		"hostname":     m.Hostname,
+		"description":  m.Description,
+		"status":       m.Status,
+		"mac_address":  m.MACAddress,
+		"manufacturer": m.Manufacturer,
+		"model":        m.Model,
+		"current_ip":   m.CurrentIP,
+		"cpu_cores":    m.CPUCores,
+		"memory_gb":    m.MemoryGB,
+		"gpu_count":    m.GPUCount,
+		"virtual":      m.Virtual,
+		"stale_build":  m.StaleBuild,
+		"enrolled_at":  m.EnrolledAt,
+		"tags":         tags,
+	}
+}
+
+// expandStringSet returns the strings of a set attribute, sorted
+func expandStringSet(set *schema.Set) []string {
+	values := make([]string, 0, set.Len())
+	for _, v := range set.List() {
+		values = append(values, v.(string))
+	}
+	sort.Strings(values)
+	return values
+}
+
+// filterID returns the ID of a list data source read with filters, the same
+// for the same filters
+func filterID(kind string, filters url.Values) string {
+	sum := sha256.Sum256([]byte(kind + "?" + filters.Encode()))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// testAPI is the API server running in-process, with a client for it as
+// an operator. It records the queries the machine list is asked for.
+type testAPI struct {
+	*testutil.Env
+	client *apiClient
+
+	mu      sync.Mutex
+	queries []url.Values
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	api := &testAPI{Env: testutil.New(t)}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/machines" && r.Method == "GET" {
+			api.mu.Lock()
+			api.queries = append(api.queries, r.URL.Query())
+			api.mu.Unlock()
+		}
+		api.API.Router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	api.client = &apiClient{BaseURL: srv.URL, Token: api.Tokens[models.RoleOperator]}
+	return api
+}
+
+// enrollMachines enrolls n machines, TAG0000 and on. The even ones are
+// configured, and each is tagged with its rack, rack-0 to rack-2.
+func (api *testAPI) enrollMachines(n int) map[string]string {
+	ids := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		serviceTag := fmt.Sprintf("TAG%04d", i)
+		machine := api.EnrollMachine(serviceTag)
+		if i%2 == 0 {
+			api.ConfigureMachine(machine.ID, testutil.FixtureConfig)
+		}
+		api.MustJSON(models.RoleOperator, "PUT", "/api/v1/machines/"+machine.ID,
+			map[string]interface{}{"tags": []string{"rack-" + strconv.Itoa(i%3)}}, http.StatusOK, nil)
+		ids[serviceTag] = machine.ID
+	}
+	return ids
+}
+
+// readDataSource reads a data source with config and returns its state
+func readDataSource(t *testing.T, resource *schema.Resource, client *apiClient, config map[string]interface{}) *schema.ResourceData {
+	t.Helper()
+
+	d := schema.TestResourceDataRaw(t, resource.Schema, config)
+	if diags := resource.ReadContext(context.Background(), d, client); diags.HasError() {
+		t.Fatalf("read: %v", diags)
+	}
+	return d
+}
+
+// machineTags returns the service tags of the machines in a machines data
+// source's state, in order
+func machineTags(d *schema.ResourceData) []string {
+	var tags []string
+	for _, m := range d.Get("machines").([]interface{}) {
+		tags = append(tags, m.(map[string]interface{})["service_tag"].(string))
+	}
+	return tags
+}
+
+// setPageSize sets machinesPageSize until the test ends
+func setPageSize(t *testing.T, size int) {
+	old := machinesPageSize
+	machinesPageSize = size
+	t.Cleanup(func() { machinesPageSize = old })
+}
+
+func TestMachinesDataSourceReadsEveryPage(t *testing.T) {
+	setPageSize(t, 4)
+	api := newTestAPI(t)
+	api.enrollMachines(2*machinesPageSize + 3)
+
+	d := readDataSource(t, dataSourceMachines(), api.client, map[string]interface{}{})
+
+	tags := machineTags(d)
+	if len(tags) != 2*machinesPageSize+3 {
+		t.Fatalf("read %d machines, want %d", len(tags), 2*machinesPageSize+3)
+	}
+	for i := 1; i < len(tags); i++ {
+		if tags[i-1] >= tags[i] {
+			t.Fatalf("machines not ordered by service tag: %s before %s", tags[i-1], tags[i])
+		}
+	}
+
+	if len(api.queries) != 3 {
+		t.Errorf("read %d pages, want 3", len(api.queries))
+	}
+	for i, query := range api.queries {
+		if query.Get("limit") != strconv.Itoa(machinesPageSize) || query.Get("offset") != strconv.Itoa(i*machinesPageSize) {
+			t.Errorf("page %d: limit=%s offset=%s", i, query.Get("limit"), query.Get("offset"))
+		}
+	}
+}
+
+func TestMachinesDataSourcePassesFiltersThrough(t *testing.T) {
+	api := newTestAPI(t)
+	ids := api.enrollMachines(12)
+
+	d := readDataSource(t, dataSourceMachines(), api.client, map[string]interface{}{
+		"status":       "configured",
+		"manufacturer": "Dell",
+		"model":        "R650",
+		"search":       "TAG",
+		"tags":         []interface{}{"rack-1"},
+	})
+
+	query := api.queries[0]
+	for key, want := range map[string]string{"status": "configured", "manufacturer": "Dell", "model": "R650", "search": "TAG", "tag": "rack-1"} {
+		if got := query.Get(key); got != want {
+			t.Errorf("query %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// Configured machines are the even ones; rack-1 of those are 4 and 10
+	if got := strings.Join(machineTags(d), ","); got != "TAG0004,TAG0010" {
+		t.Errorf("machines = %s, want TAG0004,TAG0010", got)
+	}
+
+	machine := d.Get("machines").([]interface{})[0].(map[string]interface{})
+	if machine["id"] != ids["TAG0004"] || machine["status"] != "configured" || machine["manufacturer"] != "Dell Inc." {
+		t.Errorf("machine = %v", machine)
+	}
+}
+
+func TestMachinesDataSourceFiltersByGroup(t *testing.T) {
+	api := newTestAPI(t)
+	ids := api.enrollMachines(6)
+	group := api.CreateGroup("rack-a")
+	for _, tag := range []string{"TAG0005", "TAG0001"} {
+		api.MustJSON(models.RoleOperator, "PUT", "/api/v1/groups/"+group.ID+"/machines/"+ids[tag], nil, http.StatusNoContent, nil)
+	}
+
+	d := readDataSource(t, dataSourceMachines(), api.client, map[string]interface{}{"group_id": group.ID})
+
+	if got := strings.Join(machineTags(d), ","); got != "TAG0001,TAG0005" {
+		t.Errorf("machines = %s, want TAG0001,TAG0005", got)
+	}
+}
+
+func TestMachinesDataSourceEmptyResults(t *testing.T) {
+	api := newTestAPI(t)
+	api.enrollMachines(4)
+
+	d := readDataSource(t, dataSourceMachines(), api.client, map[string]interface{}{"status": "decommissioned"})
+
+	// An empty list rather than none, so references to it still work
+	machines, ok := d.Get("machines").([]interface{})
+	if !ok || len(machines) != 0 {
+		t.Errorf("machines = %#v, want an empty list", d.Get("machines"))
+	}
+	if d.Id() == "" {
+		t.Error("no ID set")
+	}
+}
+
+func TestMachinesDataSourceIDFollowsFilters(t *testing.T) {
+	api := newTestAPI(t)
+	api.enrollMachines(4)
+
+	configured := readDataSource(t, dataSourceMachines(), api.client, map[string]interface{}{"status": "configured"})
+	again := readDataSource(t, dataSourceMachines(), api.client, map[string]interface{}{"status": "configured"})
+	enrolled := readDataSource(t, dataSourceMachines(), api.client, map[string]interface{}{"status": "enrolled"})
+
+	if configured.Id() != again.Id() {
+		t.Errorf("same filters, different IDs: %s, %s", configured.Id(), again.Id())
+	}
+	if configured.Id() == enrolled.Id() {
+		t.Errorf("different filters, same ID %s", configured.Id())
+	}
+}
+
+func TestMachinesDataSourceReportsAPIErrors(t *testing.T) {
+	api := newTestAPI(t)
+	client := &apiClient{BaseURL: api.client.BaseURL}
+
+	d := schema.TestResourceDataRaw(t, dataSourceMachines().Schema, map[string]interface{}{})
+	diags := dataSourceMachinesRead(context.Background(), d, client)
+	if !diags.HasError() || !strings.Contains(diags[0].Summary, "401") || !strings.Contains(diags[0].Summary, "unauthorized") {
+		t.Errorf("diags = %v, want the API's error", diags)
+	}
+}
+
+// createGroup creates a group with tags as an operator and returns its ID
+func (api *testAPI) createGroup(name string, tags ...string) string {
+	var group models.MachineGroup
+	api.MustJSON(models.RoleOperator, "POST", "/api/v1/groups",
+		models.CreateGroupRequest{Name: name, Description: name + " servers", Tags: tags}, http.StatusCreated, &group)
+	return group.ID
+}
+
+func TestGroupsDataSourceFiltersByTag(t *testing.T) {
+	api := newTestAPI(t)
+	api.createGroup("web", "prod", "frontend")
+	api.createGroup("db", "prod")
+	api.createGroup("staging", "staging")
+	api.createGroup("cache")
+
+	names := func(d *schema.ResourceData) string {
+		var names []string
+		for _, g := range d.Get("groups").([]interface{}) {
+			names = append(names, g.(map[string]interface{})["name"].(string))
+		}
+		return strings.Join(names, ",")
+	}
+
+	if got := names(readDataSource(t, dataSourceGroups(), api.client, map[string]interface{}{})); got != "cache,db,staging,web" {
+		t.Errorf("all groups = %s, want them ordered by name", got)
+	}
+	if got := names(readDataSource(t, dataSourceGroups(), api.client, map[string]interface{}{"tags": []interface{}{"PROD"}})); got != "db,web" {
+		t.Errorf("prod groups = %s, want db,web", got)
+	}
+	if got := names(readDataSource(t, dataSourceGroups(), api.client, map[string]interface{}{"tags": []interface{}{"prod", "frontend"}})); got != "web" {
+		t.Errorf("prod frontend groups = %s, want web", got)
+	}
+
+	empty := readDataSource(t, dataSourceGroups(), api.client, map[string]interface{}{"tags": []interface{}{"nothing"}})
+	if groups := empty.Get("groups").([]interface{}); len(groups) != 0 {
+		t.Errorf("groups = %v, want none", groups)
+	}
+}
+
+func TestGroupDataSourceByIDAndName(t *testing.T) {
+	api := newTestAPI(t)
+	ids := api.enrollMachines(3)
+	groupID := api.createGroup("web", "prod")
+	for _, tag := range []string{"TAG0002", "TAG0000"} {
+		api.MustJSON(models.RoleOperator, "PUT", "/api/v1/groups/"+groupID+"/machines/"+ids[tag], nil, http.StatusNoContent, nil)
+	}
+
+	for _, config := range []map[string]interface{}{{"id": groupID}, {"name": "web"}} {
+		d := readDataSource(t, dataSourceGroup(), api.client, config)
+		if d.Id() != groupID || d.Get("name") != "web" || d.Get("description") != "web servers" {
+			t.Errorf("%v: read group %s %q %q", config, d.Id(), d.Get("name"), d.Get("description"))
+		}
+
+		members := []string{ids["TAG0000"], ids["TAG0002"]}
+		if members[0] > members[1] {
+			members[0], members[1] = members[1], members[0]
+		}
+		if got := fmt.Sprint(d.Get("machine_ids")); got != fmt.Sprint(members) {
+			t.Errorf("%v: machine_ids = %s, want %v", config, got, members)
+		}
+	}
+
+	d := schema.TestResourceDataRaw(t, dataSourceGroup().Schema, map[string]interface{}{"name": "missing"})
+	if diags := dataSourceGroupRead(context.Background(), d, api.client); !diags.HasError() {
+		t.Error("read a group that doesn't exist")
+	}
+}
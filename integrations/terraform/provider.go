@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/plugin"
 )
 
 // Provider returns the Metal Enrollment terraform provider
@@ -32,25 +40,108 @@ func Provider() *schema.Provider {
 			},
 		},
 		ResourcesMap: map[string]*schema.Resource{
-			"metal-enrollment_machine":           resourceMachine(),
-			"metal-enrollment_group":             resourceGroup(),
-			"metal-enrollment_group_membership":  resourceGroupMembership(),
-			"metal-enrollment_power_operation":   resourcePowerOperation(),
+			"metal-enrollment_machine":          resourceMachine(),
+			"metal-enrollment_group":            resourceGroup(),
+			"metal-enrollment_group_membership": resourceGroupMembership(),
+			"metal-enrollment_power_operation":  resourcePowerOperation(),
 		},
 		DataSourcesMap: map[string]*schema.Resource{
 			"metal-enrollment_machine":  dataSourceMachine(),
 			"metal-enrollment_machines": dataSourceMachines(),
 			"metal-enrollment_group":    dataSourceGroup(),
 			"metal-enrollment_groups":   dataSourceGroups(),
+			"metal-enrollment_build":    dataSourceBuild(),
 		},
 		ConfigureContextFunc: providerConfigure,
 	}
 }
 
 type apiClient struct {
-	BaseURL   string
-	Token     string
-	Insecure  bool
+	BaseURL  string
+	Token    string
+	Insecure bool
+}
+
+// apiError is an error response from the Metal Enrollment API
+type apiError struct {
+	Status    int
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("API returned status %d: %s (%s)", e.Status, e.Message, e.Code)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(", request ID %s", e.RequestID)
+	}
+	return msg
+}
+
+// responseError reads the error from a failed API response. Bodies that
+// aren't in the API's error format, such as a proxy's, are quoted as is.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var parsed struct {
+		Error *apiError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil && parsed.Error != nil && parsed.Error.Code != "" {
+		parsed.Error.Status = resp.StatusCode
+		return parsed.Error
+	}
+
+	return fmt.Errorf("API returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// isNotFound reports whether err is the API's error for a missing resource
+// with code, such as group_not_found. A 404 from a wrong api_url has no
+// code, so it isn't taken for a deleted resource.
+func isNotFound(err error, code string) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound && apiErr.Code == code
+}
+
+// sendJSON makes a request with body, unless nil, encoded as JSON, and
+// decodes the response into out, unless nil. Any 2xx status is a success.
+func sendJSON(ctx context.Context, client *apiClient, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, client.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", client.Token))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode API response: %w", err)
+		}
+	}
+	return nil
 }
 
 func providerConfigure(ctx context.Context, d *schema.ResourceData) (interface{}, diag.Diagnostics) {
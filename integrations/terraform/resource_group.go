@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/customdiff"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func resourceGroup() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: resourceGroupCreate,
+		ReadContext:   resourceGroupRead,
+		UpdateContext: resourceGroupUpdate,
+		DeleteContext: resourceGroupDelete,
+
+		Importer: &schema.ResourceImporter{
+			StateContext: schema.ImportStatePassthroughContext,
+		},
+
+		// The API leaves a group's description and tags as they are when
+		// sent empty ones, so removing them replaces the group
+		CustomizeDiff: customdiff.All(
+			customdiff.ForceNewIfChange("description", func(ctx context.Context, old, new, meta interface{}) bool {
+				return old.(string) != "" && new.(string) == ""
+			}),
+			customdiff.ForceNewIfChange("tags", func(ctx context.Context, old, new, meta interface{}) bool {
+				return old.(*schema.Set).Len() > 0 && new.(*schema.Set).Len() == 0
+			}),
+		),
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Group name",
+			},
+			"description": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Group description",
+			},
+			"tags": {
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Group tags",
+			},
+		},
+	}
+}
+
+func resourceGroupCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	create := map[string]interface{}{
+		"name":        d.Get("name"),
+		"description": d.Get("description"),
+		"tags":        expandStringSet(d.Get("tags").(*schema.Set)),
+	}
+
+	var group groupSummary
+	if err := sendJSON(ctx, client, "POST", "/api/v1/groups", create, &group); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(group.ID)
+	return resourceGroupRead(ctx, d, meta)
+}
+
+func resourceGroupRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	var group groupSummary
+	if err := getJSON(ctx, client, "/api/v1/groups/"+url.PathEscape(d.Id()), &group); err != nil {
+		if isNotFound(err, "group_not_found") {
+			d.SetId("")
+			return nil
+		}
+		return diag.FromErr(err)
+	}
+
+	d.Set("name", group.Name)
+	d.Set("description", group.Description)
+	d.Set("tags", group.Tags)
+	return nil
+}
+
+func resourceGroupUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	update := map[string]interface{}{}
+	if d.HasChange("name") {
+		update["name"] = d.Get("name")
+	}
+	if d.HasChange("description") {
+		update["description"] = d.Get("description")
+	}
+	if d.HasChange("tags") {
+		update["tags"] = expandStringSet(d.Get("tags").(*schema.Set))
+	}
+
+	if err := sendJSON(ctx, client, "PUT", "/api/v1/groups/"+url.PathEscape(d.Id()), update, nil); err != nil {
+		return diag.FromErr(err)
+	}
+
+	return resourceGroupRead(ctx, d, meta)
+}
+
+func resourceGroupDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	if err := sendJSON(ctx, client, "DELETE", "/api/v1/groups/"+url.PathEscape(d.Id()), nil, nil); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId("")
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func resourceGroupMembership() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: resourceGroupMembershipCreate,
+		ReadContext:   resourceGroupMembershipRead,
+		DeleteContext: resourceGroupMembershipDelete,
+
+		Schema: map[string]*schema.Schema{
+			"group_id": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Group ID",
+			},
+			"machine_id": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Machine ID",
+			},
+		},
+	}
+}
+
+// membershipPath returns the API path of a machine's membership of a group
+func membershipPath(groupID, machineID string) string {
+	return fmt.Sprintf("/api/v1/groups/%s/machines/%s", url.PathEscape(groupID), url.PathEscape(machineID))
+}
+
+func resourceGroupMembershipCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	groupID := d.Get("group_id").(string)
+	machineID := d.Get("machine_id").(string)
+	if err := sendJSON(ctx, client, "PUT", membershipPath(groupID, machineID), nil, nil); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(groupID + "/" + machineID)
+	return resourceGroupMembershipRead(ctx, d, meta)
+}
+
+func resourceGroupMembershipRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	groupID, machineID, ok := strings.Cut(d.Id(), "/")
+	if !ok {
+		return diag.Errorf("invalid group membership ID %q, want <group_id>/<machine_id>", d.Id())
+	}
+
+	// A deleted group lists no machines, so its memberships are gone too
+	var members []struct {
+		ID string `json:"id"`
+	}
+	if err := getJSON(ctx, client, "/api/v1/groups/"+url.PathEscape(groupID)+"/machines", &members); err != nil {
+		return diag.FromErr(err)
+	}
+
+	for _, m := range members {
+		if m.ID == machineID {
+			d.Set("group_id", groupID)
+			d.Set("machine_id", machineID)
+			return nil
+		}
+	}
+
+	d.SetId("")
+	return nil
+}
+
+func resourceGroupMembershipDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	groupID := d.Get("group_id").(string)
+	machineID := d.Get("machine_id").(string)
+	if err := sendJSON(ctx, client, "DELETE", membershipPath(groupID, machineID), nil, nil); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId("")
+	return nil
+}
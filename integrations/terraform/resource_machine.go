@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
@@ -56,6 +56,42 @@ func resourceMachine() *schema.Resource {
 				Computed:    true,
 				Description: "Enrollment timestamp",
 			},
+			"metadata": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Top-level machine metadata fields, as strings",
+			},
+			"ownership": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    1,
+				Description: "Who owns the machine; fields left unset are inherited from its groups",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"team": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Owner team",
+						},
+						"contact_email": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Contact email address",
+						},
+						"slack_channel": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Slack channel to escalate to, e.g. #infra-oncall",
+						},
+						"environment": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Environment (prod, staging, or dev)",
+						},
+					},
+				},
+			},
 			"bmc": {
 				Type:        schema.TypeList,
 				Optional:    true,
@@ -97,6 +133,26 @@ func resourceMachine() *schema.Resource {
 							Default:     true,
 							Description: "Enable BMC access",
 						},
+						"interface": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "ipmitool interface (lan or lanplus; default lanplus)",
+						},
+						"cipher_suite": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "lanplus cipher suite ID, e.g. 17",
+						},
+						"privilege_level": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "IPMI session privilege level (CALLBACK, USER, OPERATOR, or ADMINISTRATOR)",
+						},
+						"retries": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "IPMI session retries",
+						},
 					},
 				},
 			},
@@ -127,12 +183,18 @@ func resourceMachineRead(ctx context.Context, d *schema.ResourceData, meta inter
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 404 {
-		d.SetId("")
-		return diags
+		// A 404 from a wrong api_url must not drop the machine from state
+		err := responseError(resp)
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.Code == "machine_not_found" {
+			d.SetId("")
+			return diags
+		}
+		return diag.FromErr(err)
 	}
 
 	if resp.StatusCode != 200 {
-		return diag.Errorf("API returned status %d", resp.StatusCode)
+		return diag.FromErr(responseError(resp))
 	}
 
 	var machine map[string]interface{}
@@ -148,6 +210,33 @@ func resourceMachineRead(ctx context.Context, d *schema.ResourceData, meta inter
 	d.Set("mac_address", machine["mac_address"])
 	d.Set("enrolled_at", machine["enrolled_at"])
 
+	// Nested objects and arrays can't be represented in a string map
+	metadata := map[string]string{}
+	if fields, ok := machine["metadata"].(map[string]interface{}); ok {
+		for key, value := range fields {
+			switch v := value.(type) {
+			case string:
+				metadata[key] = v
+			case float64, bool:
+				metadata[key] = fmt.Sprint(v)
+			}
+		}
+	}
+	d.Set("metadata", metadata)
+
+	// The machine's own ownership; what it inherits from groups is left
+	// out so it doesn't show up as drift
+	var ownership []map[string]interface{}
+	if owner, ok := machine["ownership"].(map[string]interface{}); ok {
+		ownership = append(ownership, map[string]interface{}{
+			"team":          owner["team"],
+			"contact_email": owner["contact_email"],
+			"slack_channel": owner["slack_channel"],
+			"environment":   owner["environment"],
+		})
+	}
+	d.Set("ownership", ownership)
+
 	// Set BMC info if present
 	if bmcInfo, ok := machine["bmc_info"].(map[string]interface{}); ok && bmcInfo != nil {
 		bmcList := []map[string]interface{}{
@@ -157,6 +246,11 @@ func resourceMachineRead(ctx context.Context, d *schema.ResourceData, meta inter
 				"type":       bmcInfo["type"],
 				"port":       bmcInfo["port"],
 				"enabled":    bmcInfo["enabled"],
+
+				"interface":       bmcInfo["interface"],
+				"cipher_suite":    bmcInfo["cipher_suite"],
+				"privilege_level": bmcInfo["privilege_level"],
+				"retries":         bmcInfo["retries"],
 				// Password is not returned from API for security
 			},
 		}
@@ -188,6 +282,10 @@ func resourceMachineUpdate(ctx context.Context, d *schema.ResourceData, meta int
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != 200 {
+		return diag.FromErr(responseError(resp))
+	}
+
 	var machines []map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&machines); err != nil {
 		return diag.FromErr(err)
@@ -214,6 +312,20 @@ func resourceMachineUpdate(ctx context.Context, d *schema.ResourceData, meta int
 		"nixos_config": d.Get("nixos_config"),
 	}
 
+	// An empty ownership removes the machine's own, so it inherits all of
+	// its groups' again
+	if d.HasChange("ownership") {
+		ownership := map[string]interface{}{}
+		if list, ok := d.GetOk("ownership"); ok && len(list.([]interface{})) > 0 && list.([]interface{})[0] != nil {
+			for key, value := range list.([]interface{})[0].(map[string]interface{}) {
+				if value != "" {
+					ownership[key] = value
+				}
+			}
+		}
+		update["ownership"] = ownership
+	}
+
 	// Add BMC info if configured
 	if bmcList, ok := d.GetOk("bmc"); ok && len(bmcList.([]interface{})) > 0 {
 		bmcData := bmcList.([]interface{})[0].(map[string]interface{})
@@ -224,6 +336,11 @@ func resourceMachineUpdate(ctx context.Context, d *schema.ResourceData, meta int
 			"type":       bmcData["type"],
 			"port":       bmcData["port"],
 			"enabled":    bmcData["enabled"],
+
+			"interface":       bmcData["interface"],
+			"cipher_suite":    bmcData["cipher_suite"],
+			"privilege_level": bmcData["privilege_level"],
+			"retries":         bmcData["retries"],
 		}
 	}
 
@@ -250,13 +367,64 @@ func resourceMachineUpdate(ctx context.Context, d *schema.ResourceData, meta int
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return diag.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+		return diag.FromErr(responseError(resp))
+	}
+
+	if d.HasChange("metadata") {
+		if err := updateMachineMetadata(ctx, client, machineID, d); err != nil {
+			return diag.FromErr(err)
+		}
 	}
 
 	return resourceMachineRead(ctx, d, meta)
 }
 
+// updateMachineMetadata sends the metadata changes as a merge patch, so
+// fields set outside Terraform that were never in the configuration are
+// left alone, and fields removed from the configuration are deleted
+func updateMachineMetadata(ctx context.Context, client *apiClient, machineID string, d *schema.ResourceData) error {
+	oldValue, newValue := d.GetChange("metadata")
+	oldMetadata, _ := oldValue.(map[string]interface{})
+	newMetadata, _ := newValue.(map[string]interface{})
+
+	patch := map[string]interface{}{}
+	for key := range oldMetadata {
+		if _, ok := newMetadata[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	for key, value := range newMetadata {
+		patch[key] = value
+	}
+
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/api/v1/machines/%s/metadata", client.BaseURL, machineID)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if client.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", client.Token))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return responseError(resp)
+	}
+	return nil
+}
+
 func resourceMachineDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
 	client := meta.(*apiClient)
 	var diags diag.Diagnostics
@@ -280,7 +448,7 @@ func resourceMachineDelete(ctx context.Context, d *schema.ResourceData, meta int
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		return diag.Errorf("API returned status %d", resp.StatusCode)
+		return diag.FromErr(responseError(resp))
 	}
 
 	d.SetId("")
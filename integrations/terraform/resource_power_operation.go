@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+// powerOperation is a power operation as the API returns it
+type powerOperation struct {
+	ID        string `json:"id"`
+	MachineID string `json:"machine_id"`
+	Operation string `json:"operation"`
+	Method    string `json:"method"`
+	Status    string `json:"status"`
+	Result    string `json:"result"`
+	Error     string `json:"error"`
+	CreatedAt string `json:"created_at"`
+}
+
+// resourcePowerOperation runs a power operation when created. Changing it
+// runs another; destroying it only drops it from state, as an operation
+// that ran can't be undone.
+func resourcePowerOperation() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: resourcePowerOperationCreate,
+		ReadContext:   resourcePowerOperationRead,
+		DeleteContext: resourcePowerOperationDelete,
+
+		Schema: map[string]*schema.Schema{
+			"machine_id": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Machine ID",
+			},
+			"operation": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringInSlice([]string{"on", "off", "reset", "cycle"}, false),
+				Description:  "Power operation (on, off, reset, or cycle)",
+			},
+			"method": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "How the operation reached the machine (bmc, wol, or simulated)",
+			},
+			"status": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Operation status (pending, success, or failed)",
+			},
+			"result": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Operation output",
+			},
+			"error": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Why the operation failed",
+			},
+			"created_at": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "When the operation was started",
+			},
+		},
+	}
+}
+
+func resourcePowerOperationCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	machineID := d.Get("machine_id").(string)
+	request := map[string]interface{}{
+		"operation": d.Get("operation"),
+	}
+
+	var op powerOperation
+	if err := sendJSON(ctx, client, "POST", "/api/v1/machines/"+url.PathEscape(machineID)+"/power", request, &op); err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(op.ID)
+	setPowerOperation(d, op)
+	return nil
+}
+
+func resourcePowerOperationRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	var ops []powerOperation
+	if err := getJSON(ctx, client, "/api/v1/machines/"+url.PathEscape(d.Get("machine_id").(string))+"/power/operations", &ops); err != nil {
+		if isNotFound(err, "machine_not_found") {
+			d.SetId("")
+			return nil
+		}
+		return diag.FromErr(err)
+	}
+
+	// Only a machine's latest operations are listed; an older one keeps
+	// the outcome last read
+	for _, op := range ops {
+		if op.ID == d.Id() {
+			setPowerOperation(d, op)
+			break
+		}
+	}
+	return nil
+}
+
+func resourcePowerOperationDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	d.SetId("")
+	return nil
+}
+
+// setPowerOperation sets the computed attributes of a power operation
+func setPowerOperation(d *schema.ResourceData, op powerOperation) {
+	d.Set("method", op.Method)
+	d.Set("status", op.Status)
+	d.Set("result", op.Result)
+	d.Set("error", op.Error)
+	d.Set("created_at", op.CreatedAt)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func TestGroupResourceLifecycle(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	resource := resourceGroup()
+
+	// Only admins can delete groups
+	client := &apiClient{BaseURL: api.client.BaseURL, Token: api.Tokens[models.RoleAdmin]}
+
+	d := schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{
+		"name":        "web",
+		"description": "Web servers",
+		"tags":        []interface{}{"prod"},
+	})
+	if diags := resource.CreateContext(ctx, d, client); diags.HasError() {
+		t.Fatalf("create: %v", diags)
+	}
+
+	var group models.MachineGroup
+	api.MustJSON(models.RoleViewer, "GET", "/api/v1/groups/"+d.Id(), nil, http.StatusOK, &group)
+	if group.Name != "web" || group.Description != "Web servers" || strings.Join(group.Tags, ",") != "prod" {
+		t.Errorf("created group = %+v", group)
+	}
+
+	state := d.State()
+	d = schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{
+		"name":        "web-servers",
+		"description": "Web servers",
+		"tags":        []interface{}{"prod", "frontend"},
+	})
+	d.SetId(state.ID)
+	if diags := resource.UpdateContext(ctx, d, client); diags.HasError() {
+		t.Fatalf("update: %v", diags)
+	}
+	api.MustJSON(models.RoleViewer, "GET", "/api/v1/groups/"+d.Id(), nil, http.StatusOK, &group)
+	if group.Name != "web-servers" || len(group.Tags) != 2 {
+		t.Errorf("updated group = %+v", group)
+	}
+
+	if diags := resource.DeleteContext(ctx, d, client); diags.HasError() {
+		t.Fatalf("delete: %v", diags)
+	}
+	if status := api.JSON(models.RoleViewer, "GET", "/api/v1/groups/"+state.ID, nil, nil); status != http.StatusNotFound {
+		t.Errorf("deleted group: status %d, want 404", status)
+	}
+
+	// A group deleted outside Terraform is dropped from state
+	d = schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{"name": "web-servers"})
+	d.SetId(state.ID)
+	if diags := resource.ReadContext(ctx, d, client); diags.HasError() {
+		t.Fatalf("read: %v", diags)
+	}
+	if d.Id() != "" {
+		t.Error("deleted group left in state")
+	}
+}
+
+func TestGroupMembershipResource(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	resource := resourceGroupMembership()
+	machine := api.EnrollMachine("MEMBER1")
+	group := api.CreateGroup("web")
+
+	d := schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{
+		"group_id":   group.ID,
+		"machine_id": machine.ID,
+	})
+	if diags := resource.CreateContext(ctx, d, api.client); diags.HasError() {
+		t.Fatalf("create: %v", diags)
+	}
+	if d.Id() != group.ID+"/"+machine.ID {
+		t.Errorf("ID = %s, want %s/%s", d.Id(), group.ID, machine.ID)
+	}
+
+	var groups []models.MachineGroup
+	api.MustJSON(models.RoleViewer, "GET", "/api/v1/machines/"+machine.ID+"/groups", nil, http.StatusOK, &groups)
+	if len(groups) != 1 || groups[0].ID != group.ID {
+		t.Fatalf("machine's groups = %+v, want web", groups)
+	}
+
+	if diags := resource.DeleteContext(ctx, d, api.client); diags.HasError() {
+		t.Fatalf("delete: %v", diags)
+	}
+	api.MustJSON(models.RoleViewer, "GET", "/api/v1/machines/"+machine.ID+"/groups", nil, http.StatusOK, &groups)
+	if len(groups) != 0 {
+		t.Errorf("machine's groups after delete = %+v, want none", groups)
+	}
+
+	// A membership removed outside Terraform is dropped from state
+	d.SetId(group.ID + "/" + machine.ID)
+	if diags := resource.ReadContext(ctx, d, api.client); diags.HasError() {
+		t.Fatalf("read: %v", diags)
+	}
+	if d.Id() != "" {
+		t.Error("removed membership left in state")
+	}
+}
+
+func TestPowerOperationResource(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	resource := resourcePowerOperation()
+	machine := api.EnrollMachine("POWER1")
+	api.SetBMC(machine.ID, "10.0.0.5")
+
+	d := schema.TestResourceDataRaw(t, resource.Schema, map[string]interface{}{
+		"machine_id": machine.ID,
+		"operation":  "on",
+	})
+	if diags := resource.CreateContext(ctx, d, api.client); diags.HasError() {
+		t.Fatalf("create: %v", diags)
+	}
+	if d.Id() == "" || d.Get("method") != "bmc" {
+		t.Fatalf("operation %q method %q, want a BMC operation", d.Id(), d.Get("method"))
+	}
+
+	// The operation runs in the background; reads pick up its outcome
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Get("status") == "pending" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if diags := resource.ReadContext(ctx, d, api.client); diags.HasError() {
+			t.Fatalf("read: %v", diags)
+		}
+	}
+	if d.Get("status") != "success" {
+		t.Errorf("status = %q, error %q, want success", d.Get("status"), d.Get("error"))
+	}
+	if power := api.BMC.Power("10.0.0.5"); power != "on" {
+		t.Errorf("BMC power = %s, want on", power)
+	}
+
+	if diags := resource.DeleteContext(ctx, d, api.client); diags.HasError() || d.Id() != "" {
+		t.Errorf("delete: %v, ID %q", diags, d.Id())
+	}
+}
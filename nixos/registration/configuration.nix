@@ -9,6 +9,9 @@
   boot.kernelPackages = pkgs.linuxPackages_latest;
   boot.kernelParams = [ "console=ttyS0,115200" "console=tty0" ];
 
+  # In-band BMC access (/dev/ipmi0) for reading the BMC's LAN settings
+  boot.kernelModules = [ "ipmi_si" "ipmi_devintf" ];
+
   # Enable serial console
   boot.loader.grub.extraConfig = ''
     serial --unit=0 --speed=115200
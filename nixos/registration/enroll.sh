@@ -58,6 +58,19 @@ fi
 
 log "MAC address: $MAC_ADDRESS"
 
+# Detect boot mode. The boot server passes boot_mode= on the kernel command
+# line when it knows better (UEFI HTTP boot looks like plain UEFI from here).
+BOOT_MODE=$(tr ' ' '\n' < /proc/cmdline | sed -n 's/^boot_mode=//p' | head -n1)
+if [ -z "$BOOT_MODE" ]; then
+    if [ -d /sys/firmware/efi ]; then
+        BOOT_MODE="uefi"
+    else
+        BOOT_MODE="bios"
+    fi
+fi
+
+log "Boot mode: $BOOT_MODE"
+
 # Gather hardware information
 
 # System information
@@ -164,27 +177,64 @@ for nic in /sys/class/net/*; do
 done
 NICS_JSON+="]"
 
-# GPU information (if any)
+# GPU information (if any). nvidia-smi, when the NVIDIA driver is loaded,
+# gives UUIDs, VBIOS versions, and memory; other GPUs come from lspci, which
+# lists datacenter cards as "3D controller" rather than "VGA".
 log "Gathering GPU information..."
-GPUS_JSON="[]"
+NVIDIA_PCI=""
+GPU_ENTRIES=""
+if command -v nvidia-smi &> /dev/null; then
+    NVIDIA_GPUS=$(nvidia-smi --query-gpu=pci.bus_id,name,uuid,vbios_version,memory.total \
+        --format=csv,noheader,nounits 2>/dev/null || true)
+    while IFS=, read -r bus name uuid vbios memory; do
+        [ -z "$bus" ] && continue
+        # 00000000:3B:00.0 -> 3b:00.0, the form lspci prints
+        pci=$(echo "$bus" | xargs | sed 's/^[0-9A-Fa-f]*://' | tr 'A-F' 'a-f')
+        NVIDIA_PCI+=" $pci"
+        memory=$(echo "$memory" | xargs)
+        memory_bytes=0
+        [[ "$memory" =~ ^[0-9]+$ ]] && memory_bytes=$(( memory * 1024 * 1024 ))
+        [ -n "$GPU_ENTRIES" ] && GPU_ENTRIES+=","
+        GPU_ENTRIES+="{\"model\":\"$(echo "$name" | xargs)\",\"vendor\":\"NVIDIA\",\"memory_bytes\":$memory_bytes,\"pci_address\":\"$pci\",\"uuid\":\"$(echo "$uuid" | xargs)\",\"vbios_version\":\"$(echo "$vbios" | xargs)\"}"
+    done <<< "$NVIDIA_GPUS"
+fi
 if command -v lspci &> /dev/null; then
-    GPUS_JSON=$(lspci | grep -i vga | awk -F: '{
-        pci=$1
-        gsub(/^[ \t]+/, "", pci)
-        desc=$3
-        gsub(/^[ \t]+/, "", desc)
-        vendor=""
-        model=desc
-
-        if (desc ~ /NVIDIA/) vendor="NVIDIA"
-        else if (desc ~ /AMD|ATI/) vendor="AMD"
-        else if (desc ~ /Intel/) vendor="Intel"
-        else vendor="Unknown"
-
-        if (first) printf ","
-        printf "{\"model\":\"%s\",\"vendor\":\"%s\",\"pci_address\":\"%s\"}", model, vendor, pci
-        first=1
-    } BEGIN { printf "["; first=0 } END { printf "]" }')
+    while read -r line; do
+        pci=$(echo "$line" | awk '{print $1}')
+        case " $NVIDIA_PCI " in *" $pci "*) continue ;; esac
+        desc=$(echo "$line" | cut -d: -f3- | sed 's/^[ \t]*//')
+        case "$desc" in
+            *NVIDIA*) vendor="NVIDIA" ;;
+            *AMD*|*ATI*) vendor="AMD" ;;
+            *Intel*) vendor="Intel" ;;
+            *) vendor="Unknown" ;;
+        esac
+        [ -n "$GPU_ENTRIES" ] && GPU_ENTRIES+=","
+        GPU_ENTRIES+="{\"model\":\"$desc\",\"vendor\":\"$vendor\",\"pci_address\":\"$pci\"}"
+    done < <(lspci | grep -E "VGA compatible controller|3D controller|Display controller" || true)
+fi
+GPUS_JSON="[$GPU_ENTRIES]"
+
+# BMC LAN configuration, read in-band through /dev/ipmi0. Vendors put the
+# LAN interface on different channels, so take the first one with an address.
+log "Gathering BMC information..."
+BMC_JSON=""
+if command -v ipmitool &> /dev/null && [ -e /dev/ipmi0 ]; then
+    for channel in 1 2 3 8; do
+        LAN=$(ipmitool lan print "$channel" 2>/dev/null || true)
+        BMC_IP=$(echo "$LAN" | awk -F: '/^IP Address[ \t]*:/ { gsub(/[ \t]/, "", $2); print $2; exit }')
+        if [ -n "$BMC_IP" ] && [ "$BMC_IP" != "0.0.0.0" ]; then
+            BMC_MAC=$(echo "$LAN" | sed -n 's/^MAC Address[ \t]*: *//p' | head -n1 | tr -d '[:space:]')
+            BMC_JSON=",
+  \"bmc\": {
+    \"ip_address\": \"$BMC_IP\",
+    \"mac_address\": \"$BMC_MAC\",
+    \"channel\": $channel
+  }"
+            log "BMC: $BMC_IP (channel $channel)"
+            break
+        fi
+    done
 fi
 
 # Build JSON payload
@@ -193,6 +243,7 @@ PAYLOAD=$(cat <<EOF
 {
   "service_tag": "$SERVICE_TAG",
   "mac_address": "$MAC_ADDRESS",
+  "boot_mode": "$BOOT_MODE",
   "hardware": {
     "manufacturer": "$MANUFACTURER",
     "model": "$MODEL",
@@ -214,20 +265,44 @@ PAYLOAD=$(cat <<EOF
     "disks": $DISKS_JSON,
     "nics": $NICS_JSON,
     "gpus": $GPUS_JSON
-  }
+  }$BMC_JSON
 }
 EOF
 )
 
-# Send enrollment request
-log "Sending enrollment request to $ENROLLMENT_URL..."
-RESPONSE=$(curl -s -w "\n%{http_code}" -X POST \
-    -H "Content-Type: application/json" \
-    -d "$PAYLOAD" \
-    "$ENROLLMENT_URL" || echo -e "\n000")
+# Send enrollment request. A busy server answers 503, and a rate limited
+# client gets 429, both with Retry-After; wait that out, plus a few seconds
+# at random so machines booted together don't retry together.
+ENROLL_ATTEMPTS="${ENROLL_ATTEMPTS:-20}"
+HEADERS_FILE=$(mktemp)
+trap 'rm -f "$HEADERS_FILE"' EXIT
+
+for attempt in $(seq 1 "$ENROLL_ATTEMPTS"); do
+    log "Sending enrollment request to $ENROLLMENT_URL (attempt $attempt)..."
+    RESPONSE=$(curl -s -D "$HEADERS_FILE" -w "\n%{http_code}" -X POST \
+        -H "Content-Type: application/json" \
+        -d "$PAYLOAD" \
+        "$ENROLLMENT_URL" || echo -e "\n000")
+
+    HTTP_CODE=$(echo "$RESPONSE" | tail -n1)
+    RESPONSE_BODY=$(echo "$RESPONSE" | head -n-1)
+
+    if [ "$HTTP_CODE" != "503" ] && [ "$HTTP_CODE" != "429" ] && [ "$HTTP_CODE" != "000" ]; then
+        break
+    fi
+    if [ "$attempt" -eq "$ENROLL_ATTEMPTS" ]; then
+        break
+    fi
 
-HTTP_CODE=$(echo "$RESPONSE" | tail -n1)
-RESPONSE_BODY=$(echo "$RESPONSE" | head -n-1)
+    # Retry-After in seconds; an HTTP date or no header waits the default
+    RETRY_AFTER=$(grep -i '^retry-after:' "$HEADERS_FILE" 2>/dev/null | tail -n1 | cut -d: -f2 | tr -d ' \r' || echo "")
+    if ! [[ "$RETRY_AFTER" =~ ^[0-9]+$ ]]; then
+        RETRY_AFTER=10
+    fi
+    WAIT=$((RETRY_AFTER + RANDOM % 5))
+    log "Enrollment server unavailable (HTTP $HTTP_CODE), retrying in ${WAIT}s..."
+    sleep "$WAIT"
+done
 
 if [ "$HTTP_CODE" = "200" ] || [ "$HTTP_CODE" = "201" ]; then
     log "Enrollment successful!"
@@ -250,8 +325,40 @@ if [ "$HTTP_CODE" = "200" ] || [ "$HTTP_CODE" = "201" ]; then
     echo "=========================================="
     echo ""
 
+    # An unclaimed machine gets a claim code when claims are enabled
+    CLAIM_CODE=$(echo "$RESPONSE_BODY" | jq -r '.claim_code // empty' 2>/dev/null || echo "")
+    if [ -n "$CLAIM_CODE" ]; then
+        CLAIM_EXPIRES=$(echo "$RESPONSE_BODY" | jq -r '.claim_code_expires_at // empty' 2>/dev/null || echo "")
+        echo "=========================================="
+        echo "  CLAIM CODE: $CLAIM_CODE"
+        echo "=========================================="
+        echo "Enter this code on the Claim Machine page"
+        echo "to add this machine to your account."
+        echo "Valid until: $CLAIM_EXPIRES"
+        echo "=========================================="
+        echo ""
+
+        # Leave time to write the code down
+        sleep 60
+    fi
+
     # Wait a bit before exiting
     sleep 10
+elif [ "$HTTP_CODE" = "409" ]; then
+    # Held for an operator: a decommissioned machine, or a MAC address or
+    # serial number that belongs to another machine
+    log "Enrollment held: $RESPONSE_BODY"
+
+    echo ""
+    echo "=========================================="
+    echo "  ENROLLMENT HELD"
+    echo "=========================================="
+    echo "Service Tag: $SERVICE_TAG"
+    echo ""
+    echo "An administrator has to approve this"
+    echo "machine before it can be provisioned."
+    echo "=========================================="
+    echo ""
 else
     error "Enrollment failed with HTTP code $HTTP_CODE: $RESPONSE_BODY"
 fi
@@ -0,0 +1,55 @@
+{ config, pkgs, lib, modulesPath, ... }:
+
+{
+  imports = [
+    "${modulesPath}/installer/netboot/netboot-minimal.nix"
+  ];
+
+  # Kernel and boot configuration
+  boot.kernelPackages = pkgs.linuxPackages_latest;
+  boot.kernelParams = [ "console=ttyS0,115200" "console=tty0" ];
+
+  # Network configuration
+  networking.hostName = "metal-enrollment-wipe";
+  networking.useDHCP = true;
+  networking.firewall.enable = false;
+
+  # Disk erase tools
+  environment.systemPackages = with pkgs; [
+    nvme-cli
+    util-linux
+    coreutils
+    gawk
+    curl
+    jq
+    bash
+  ];
+
+  # Disk wipe service. The API URL and machine ID come from the kernel
+  # command line written by the iPXE server.
+  systemd.services.metal-wipe = {
+    description = "Metal Enrollment Disk Wipe Service";
+    wantedBy = [ "multi-user.target" ];
+    after = [ "network-online.target" ];
+    wants = [ "network-online.target" ];
+    path = with pkgs; [ nvme-cli util-linux coreutils gawk gnugrep gnused curl jq systemd ];
+
+    serviceConfig = {
+      Type = "oneshot";
+      RemainAfterExit = false;
+      ExecStart = "${pkgs.bash}/bin/bash /etc/metal-enrollment/wipe.sh";
+    };
+  };
+
+  # Wipe script
+  environment.etc."metal-enrollment/wipe.sh" = {
+    text = builtins.readFile ./wipe.sh;
+    mode = "0755";
+  };
+
+  # Auto-login on console for debugging failed wipes
+  services.getty.autologinUser = "root";
+
+  # Minimal system state version
+  system.stateVersion = "24.05";
+}
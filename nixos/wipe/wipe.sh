@@ -0,0 +1,163 @@
+#!/usr/bin/env bash
+set -uo pipefail
+
+# Metal Enrollment Wipe Script
+# This script runs on the wipe image to erase every disk in the machine's
+# active wipe job and report per-disk progress back to the API
+
+LOG_FILE="/var/log/metal-wipe.log"
+PROGRESS_INTERVAL="${PROGRESS_INTERVAL:-30}"
+
+log() {
+    echo "[$(date -Iseconds)] $*" | tee -a "$LOG_FILE"
+}
+
+error() {
+    log "ERROR: $*"
+    exit 1
+}
+
+# Read a key=value argument from the kernel command line
+cmdline_arg() {
+    tr ' ' '\n' < /proc/cmdline | sed -n "s/^$1=//p" | head -n1
+}
+
+API_URL="${METAL_API:-$(cmdline_arg metal_api)}"
+MACHINE_ID="${MACHINE_ID:-$(cmdline_arg machine_id)}"
+JOB_ID="${WIPE_JOB:-$(cmdline_arg wipe_job)}"
+WIPE_TOKEN="${METAL_WIPE_TOKEN:-$(cmdline_arg metal_wipe_token)}"
+
+if [ -z "$API_URL" ] || [ -z "$MACHINE_ID" ] || [ -z "$JOB_ID" ] || [ -z "$WIPE_TOKEN" ]; then
+    error "metal_api, machine_id, wipe_job, and metal_wipe_token must be set on the kernel command line"
+fi
+
+# The wipe token is the job's own; it reports this job's progress and
+# nothing else
+CURL_ARGS=(-sf -H "Content-Type: application/json" -H "Authorization: Bearer $WIPE_TOKEN")
+STATUS_URL="$API_URL/machines/$MACHINE_ID/wipe/$JOB_ID/status"
+
+log "Starting disk wipe for machine $MACHINE_ID (job $JOB_ID)..."
+
+# post_status STATUS ERROR DISKS_JSON
+post_status() {
+    jq -n --arg status "$1" --arg error "$2" --argjson disks "$3" \
+        '{status: $status, error: $error, disks: $disks}' |
+        curl "${CURL_ARGS[@]}" -X POST -d @- "$STATUS_URL" > /dev/null ||
+        log "WARNING: failed to report status"
+}
+
+# The first report starts the job and returns it with its disk plan. Wait
+# for the API to be reachable.
+JOB=""
+for i in {1..30}; do
+    if JOB=$(jq -n '{status: "running", disks: []}' |
+        curl "${CURL_ARGS[@]}" -X POST -d @- "$STATUS_URL"); then
+        break
+    fi
+    if [ $i -eq 30 ]; then
+        error "Could not start wipe job $JOB_ID"
+    fi
+    sleep 2
+done
+
+# disk_update SERIAL DEVICE STATUS PROGRESS [ERROR]
+disk_update() {
+    jq -n --arg serial "$1" --arg device "$2" --arg status "$3" \
+        --argjson progress "$4" --arg error "${5:-}" \
+        '[{serial: $serial, device: $device, status: $status, progress: $progress, error: $error}]'
+}
+
+# find_device SERIAL DEVICE resolves a planned disk to its current device
+# node. Device names can change between boots, so disks with a serial are
+# looked up by serial.
+find_device() {
+    local serial="$1" device="$2"
+    if [ -n "$serial" ] && [ "$serial" != "Unknown" ]; then
+        lsblk -dno NAME,SERIAL | awk -v s="$serial" '$2 == s { print "/dev/" $1; exit }'
+    elif [ -b "$device" ]; then
+        echo "$device"
+    fi
+}
+
+# wipe_disk DEVICE METHOD
+wipe_disk() {
+    local device="$1" method="$2"
+    case "$method" in
+        nvme-format)
+            nvme format "$device" --ses=1 --force
+            ;;
+        blkdiscard)
+            blkdiscard --secure "$device" || blkdiscard "$device"
+            ;;
+        shred)
+            shred -v -n 1 -z "$device" 2>&1 | while read -r line; do
+                # shred reports "pass 1/2 (random)...1.2GiB/10GiB 12%"
+                pct=$(echo "$line" | grep -o '[0-9]*%$' | tr -d '%')
+                pass=$(echo "$line" | grep -o 'pass [0-9]' | awk '{print $2}')
+                if [ -n "$pct" ] && [ -n "$pass" ]; then
+                    echo $(( (pass - 1) * 50 + pct / 2 )) > "$PROGRESS_FILE"
+                fi
+            done
+            return "${PIPESTATUS[0]}"
+            ;;
+        *)
+            log "Unknown wipe method: $method"
+            return 1
+            ;;
+    esac
+}
+
+DISK_COUNT=$(echo "$JOB" | jq '.disks | length')
+PROGRESS_FILE=$(mktemp)
+
+for i in $(seq 0 $((DISK_COUNT - 1))); do
+    SERIAL=$(echo "$JOB" | jq -r ".disks[$i].serial")
+    PLANNED=$(echo "$JOB" | jq -r ".disks[$i].device")
+    METHOD=$(echo "$JOB" | jq -r ".disks[$i].method")
+
+    DEVICE=$(find_device "$SERIAL" "$PLANNED")
+    if [ -z "$DEVICE" ]; then
+        log "Disk $SERIAL ($PLANNED) not found"
+        post_status running "" "$(disk_update "$SERIAL" "$PLANNED" missing 0 "disk not found")"
+        exit 1
+    fi
+
+    log "Wiping $DEVICE (serial: $SERIAL) using $METHOD..."
+    echo 0 > "$PROGRESS_FILE"
+    post_status running "" "$(disk_update "$SERIAL" "$DEVICE" running 0)"
+
+    wipe_disk "$DEVICE" "$METHOD" > >(tee -a "$LOG_FILE") 2>&1 &
+    WIPE_PID=$!
+
+    # Report progress until the wipe finishes. A disk that disappears
+    # mid-wipe fails the job instead of leaving it hanging.
+    while kill -0 "$WIPE_PID" 2>/dev/null; do
+        sleep "$PROGRESS_INTERVAL" &
+        wait $! 2>/dev/null
+        if ! kill -0 "$WIPE_PID" 2>/dev/null; then
+            break
+        fi
+        if [ ! -b "$DEVICE" ]; then
+            kill "$WIPE_PID" 2>/dev/null
+            log "Disk $SERIAL ($DEVICE) disappeared during the wipe"
+            post_status running "" "$(disk_update "$SERIAL" "$DEVICE" missing 0 "disk disappeared during the wipe")"
+            exit 1
+        fi
+        post_status running "" "$(disk_update "$SERIAL" "$DEVICE" running "$(cat "$PROGRESS_FILE")")"
+    done
+
+    if ! wait "$WIPE_PID"; then
+        log "Wiping $DEVICE failed"
+        post_status running "" "$(disk_update "$SERIAL" "$DEVICE" failed 0 "$METHOD failed, see $LOG_FILE")"
+        exit 1
+    fi
+
+    log "Wiped $DEVICE"
+    post_status running "" "$(disk_update "$SERIAL" "$DEVICE" completed 100)"
+done
+
+log "All disks wiped"
+post_status completed "" "[]"
+
+log "Powering off"
+systemctl poweroff
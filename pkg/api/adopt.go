@@ -0,0 +1,153 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/gorilla/mux"
+)
+
+// handleAdoptMachine brings a machine that is already running NixOS under
+// management. Adopted machines boot from disk: the iPXE server won't serve
+// them an image, and their builds are deployed by switching over SSH until
+// an operator converts them to netboot.
+func (s *Server) handleAdoptMachine(w http.ResponseWriter, r *http.Request) {
+	var req models.AdoptRequest
+	if !decodeStrictJSON(w, r, &req) {
+		return
+	}
+
+	if req.ServiceTag == "" || req.MACAddress == "" || req.Hostname == "" || req.SSHAddress == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "service_tag, mac_address, hostname, and ssh_address are required")
+		return
+	}
+
+	if err := service.ValidateSSHTarget(req.SSHAddress, req.SSHUser, req.SSHKey); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	mac, err := models.NormalizeMAC(req.MACAddress)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	req.MACAddress = mac
+
+	existing, err := s.db.GetMachineByServiceTag(req.ServiceTag)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if existing != nil {
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "a machine with this service tag already exists")
+		return
+	}
+
+	trashed, err := s.db.GetTrashedMachineByServiceTag(req.ServiceTag)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if trashed != nil {
+		respondServiceError(w, &service.TrashedError{Machine: trashed}, "database error")
+		return
+	}
+
+	owner, _, err := s.db.FindIdentityOwner(req.MACAddress, "")
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if owner != nil {
+		respondError(w, http.StatusConflict, CodeAlreadyExists,
+			fmt.Sprintf("mac_address %s already belongs to machine %s (service_tag: %s)", req.MACAddress, owner.ID, owner.ServiceTag))
+		return
+	}
+
+	machine, err := s.db.AdoptMachine(req)
+	if err != nil {
+		respondServiceError(w, err, "failed to adopt machine")
+		return
+	}
+
+	log.Printf("Adopted machine: %s (service_tag: %s, ssh: %s)", machine.ID, machine.ServiceTag, machine.SSHAddress)
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineAdopted,
+		MachineID: machine.ID,
+		Data: events.AdoptedData{
+			ServiceTag: machine.ServiceTag,
+			MACAddress: machine.MACAddress,
+			Hostname:   machine.Hostname,
+			Status:     machine.Status,
+			SSHAddress: machine.SSHAddress,
+			HasConfig:  machine.NixOSConfig != "",
+		},
+	})
+
+	respondJSON(w, http.StatusCreated, machine)
+}
+
+// handleConvertMachine switches a machine that boots from disk over to
+// netboot. Its last build was a system closure rather than a netboot image,
+// so it is cleared and the machine has to be built again before the iPXE
+// server serves it anything but the registration image.
+func (s *Server) handleConvertMachine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if !machine.BootsFromDisk() {
+		respondError(w, http.StatusConflict, CodeConflict, "machine already netboots")
+		return
+	}
+
+	if !machine.CanProvision() {
+		respondError(w, http.StatusConflict, CodeConflict, "machine is "+string(machine.Status))
+		return
+	}
+
+	oldStatus := machine.Status
+	machine.DeployMode = models.DeployModeNetboot
+	machine.LastBuildID = nil
+	machine.LastBuildTime = nil
+	if machine.NixOSConfig != "" {
+		machine.Status = models.StatusConfigured
+	} else {
+		machine.Status = models.StatusEnrolled
+	}
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		respondInternalError(w, err, "failed to update machine")
+		return
+	}
+
+	log.Printf("Converted machine %s (service_tag: %s) to netboot", machine.ID, machine.ServiceTag)
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineConverted,
+		MachineID: machine.ID,
+		Data: events.ConvertedData{
+			OldStatus:  oldStatus,
+			DeployMode: machine.DeployMode,
+		},
+	})
+	s.publishStatusChange(r.Context(), machine, oldStatus, "")
+
+	respondJSON(w, http.StatusOK, machine)
+}
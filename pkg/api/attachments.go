@@ -0,0 +1,344 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// attachmentTypes are the content types attachments may have, as sniffed
+// from their contents: photos and PDFs
+var attachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// staleUploadAge is how old an unfinished upload's temporary file has to be
+// before it is removed with the unused attachment files
+const staleUploadAge = time.Hour
+
+// handleListMachineAttachments lists a machine's attachments, newest first
+func (s *Server) handleListMachineAttachments(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	attachments, err := s.db.ListMachineAttachments(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to list attachments")
+		return
+	}
+
+	if attachments == nil {
+		attachments = []*models.MachineAttachment{}
+	}
+
+	respondJSON(w, http.StatusOK, attachments)
+}
+
+// handleUploadMachineAttachment attaches the file in the multipart form
+// field "file" to a machine. The file is stored under its SHA-256, so the
+// same photo attached twice is stored once.
+func (s *Server) handleUploadMachineAttachment(w http.ResponseWriter, r *http.Request) {
+	if s.config.AttachmentsDir == "" {
+		respondError(w, http.StatusServiceUnavailable, CodeAttachmentsNotConfigured, "no attachments directory is configured")
+		return
+	}
+
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "body must be a multipart form with a file field")
+		return
+	}
+
+	var attachment *models.MachineAttachment
+	var tmpPath string
+	for attachment == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "the form has no file field")
+			return
+		}
+		if err != nil {
+			if !respondBodyError(w, err) {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid multipart form: "+err.Error())
+			}
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		attachment, tmpPath, err = s.receiveAttachment(part)
+		part.Close()
+		if err != nil {
+			if !respondBodyError(w, err) {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			}
+			return
+		}
+	}
+	defer os.Remove(tmpPath)
+
+	attachment.MachineID = machine.ID
+	if claims, ok := auth.GetClaims(r); ok {
+		attachment.UploadedBy = claims.Username
+	}
+
+	if err := s.storeAttachment(attachment, tmpPath); err != nil {
+		respondInternalError(w, err, "failed to store attachment")
+		return
+	}
+
+	log.Printf("Attached %s (%s, %d bytes) to machine %s", attachment.Filename, attachment.ContentType, attachment.Size, machine.ID)
+
+	respondJSON(w, http.StatusCreated, attachment)
+}
+
+// receiveAttachment writes an uploaded file to a temporary file in the
+// attachments directory, checking its size and type, and returns its record
+// and the temporary file's path
+func (s *Server) receiveAttachment(part *multipart.Part) (*models.MachineAttachment, string, error) {
+	filename := filepath.Base(strings.ReplaceAll(part.FileName(), `\`, "/"))
+	if filename == "" || filename == "." || filename == "/" {
+		return nil, "", errors.New("the file field has no filename")
+	}
+
+	tmpPath, size, hash, err := receiveFile(s.config.AttachmentsDir, part, s.config.MaxAttachmentBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType, err := sniffFile(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, "", err
+	}
+	if !attachmentTypes[contentType] {
+		os.Remove(tmpPath)
+		return nil, "", fmt.Errorf("attachments must be PNG, JPEG, GIF, or WebP images or PDFs; got %s", contentType)
+	}
+
+	return &models.MachineAttachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      hash,
+	}, tmpPath, nil
+}
+
+// receiveFile writes an uploaded file of at most limit bytes to a temporary
+// file in dir, and returns its path, size, and SHA-256
+func receiveFile(dir string, r io.Reader, limit int64) (string, int64, string, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", 0, "", err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer tmp.Close()
+
+	fail := func(err error) (string, int64, string, error) {
+		os.Remove(tmp.Name())
+		return "", 0, "", err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, limit+1))
+	if err != nil {
+		return fail(err)
+	}
+	if size > limit {
+		return fail(&http.MaxBytesError{Limit: limit})
+	}
+	if size == 0 {
+		return fail(errors.New("the file is empty"))
+	}
+	if err := tmp.Close(); err != nil {
+		return fail(err)
+	}
+
+	return tmp.Name(), size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sniffFile detects a file's content type from its first bytes
+func sniffFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := file.Read(head)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// storeAttachment moves an uploaded file to its content-addressed path,
+// unless the same file is already stored, and records the attachment
+func (s *Server) storeAttachment(attachment *models.MachineAttachment, tmpPath string) error {
+	path := s.attachmentPath(attachment.SHA256)
+
+	s.attachmentsMu.Lock()
+	defer s.attachmentsMu.Unlock()
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return s.db.CreateMachineAttachment(attachment)
+}
+
+// handleDownloadMachineAttachment serves an attached file
+func (s *Server) handleDownloadMachineAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment := s.machineAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+
+	file, err := os.Open(s.attachmentPath(attachment.SHA256))
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(w, http.StatusNotFound, CodeAttachmentNotFound, "attachment file is missing from the attachments directory")
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to open attachment")
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+attachment.SHA256+`"`)
+	http.ServeContent(w, r, "", attachment.CreatedAt, file)
+}
+
+// handleDeleteMachineAttachment deletes an attachment, and its file if
+// nothing else is attached with the same contents
+func (s *Server) handleDeleteMachineAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment := s.machineAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+
+	if _, err := s.db.DeleteMachineAttachment(attachment.MachineID, attachment.ID); err != nil {
+		respondInternalError(w, err, "failed to delete attachment")
+		return
+	}
+
+	s.removeUnusedAttachments()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// machineAttachment looks up the attachment of a request. It responds with
+// an error and returns nil if there is no such attachment.
+func (s *Server) machineAttachment(w http.ResponseWriter, r *http.Request) *models.MachineAttachment {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return nil
+	}
+
+	attachment, err := s.db.GetMachineAttachment(machine.ID, mux.Vars(r)["attachment_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if attachment == nil {
+		respondError(w, http.StatusNotFound, CodeAttachmentNotFound, "attachment not found")
+		return nil
+	}
+	return attachment
+}
+
+// attachmentPath is where the file with a SHA-256 is stored
+func (s *Server) attachmentPath(hash string) string {
+	return filepath.Join(s.config.AttachmentsDir, hash[:2], hash)
+}
+
+// removeUnusedAttachments removes stored files that no attachment refers
+// to, such as those of permanently deleted machines, along with temporary
+// files of uploads that never finished
+func (s *Server) removeUnusedAttachments() {
+	if s.config.AttachmentsDir == "" {
+		return
+	}
+
+	s.attachmentsMu.Lock()
+	defer s.attachmentsMu.Unlock()
+
+	hashes, err := s.db.AttachmentHashes()
+	if err != nil {
+		log.Printf("Failed to list attachments: %v", err)
+		return
+	}
+
+	removeUnusedFiles(s.config.AttachmentsDir, hashes)
+}
+
+// removeUnusedFiles removes files stored under their SHA-256 in dir that
+// aren't in hashes, along with temporary files of uploads that never
+// finished
+func removeUnusedFiles(dir string, hashes map[string]bool) {
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		name := entry.Name()
+		if strings.HasPrefix(name, ".upload-") {
+			// Uploads still being received are left alone
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < staleUploadAge {
+				return nil
+			}
+		} else if len(name) != sha256.Size*2 || hashes[name] {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove unused file %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove unused files from %s: %v", dir, err)
+	}
+}
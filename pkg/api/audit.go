@@ -0,0 +1,250 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 1000
+)
+
+// DefaultAuditFields are the request body fields kept in the audit log
+// unless configured otherwise
+var DefaultAuditFields = []string{"role", "active", "status", "operation", "priority"}
+
+// auditedMethods are the methods of requests that change something
+var auditedMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// unauditedRoutes are mutating routes that machines and services report
+// through, rather than users acting, and POSTs that change nothing
+var unauditedRoutes = map[string]bool{
+	"/api/v1/enroll":                             true,
+	"/api/v1/auth/refresh":                       true,
+	"/api/v1/machines/{id}/metrics":              true,
+	"/api/v1/machines/{id}/boot-history":         true,
+	"/api/v1/machines/{id}/wipe/{job_id}/status": true,
+	"/api/v1/machines/{id}/assemble":             true,
+}
+
+// auditedReads are GET routes audited like mutating requests, since they
+// reach into a machine
+var auditedReads = map[string]bool{
+	"/api/v1/machines/{id}/bmc/screenshot": true,
+}
+
+// secretFieldWords mark body fields that are never kept, even if allowed
+var secretFieldWords = []string{"password", "secret", "token", "key"}
+
+type auditEntryKey struct{}
+
+// auditMiddleware records mutating requests, and auditedReads, in the
+// audit log once they are handled. It runs after routing, so the route template and its variables
+// are known. Login attempts are recorded with the username tried, which
+// handleLogin adds with setAuditActor. Requests made while an admin
+// impersonates a user are recorded under the user, and the admin as the
+// impersonator.
+func (s *Server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		audited := auditedMethods[r.Method] || (r.Method == http.MethodGet && auditedReads[route])
+		if !audited || unauditedRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := &models.AuditEntry{
+			Method:    r.Method,
+			Route:     route,
+			SourceIP:  clientIP(r),
+			RequestID: requestID(r),
+		}
+		if vars := mux.Vars(r); len(vars) > 0 {
+			entry.Targets = vars
+		}
+		if claims := s.requestClaims(r); claims != nil {
+			entry.Actor = claims.Username
+			entry.ActorID = claims.UserID
+			entry.Impersonator = claims.Impersonator
+			entry.ImpersonatorID = claims.ImpersonatorID
+		}
+
+		// The body is copied as the handler reads it, so handlers see the
+		// same body and errors they would without the audit log
+		var body *bytes.Buffer
+		if len(s.config.AuditFields) > 0 && r.Body != nil && !rawBodyRoutes[route] {
+			body = &bytes.Buffer{}
+			r.Body = teeReadCloser{Reader: io.TeeReader(r.Body, body), Closer: r.Body}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditEntryKey{}, entry)))
+
+		entry.Status = rec.status
+		if body != nil {
+			entry.Fields = auditFields(body.Bytes(), s.config.AuditFields)
+		}
+
+		if err := s.db.CreateAuditEntry(entry); err != nil {
+			log.Printf("[%s] Failed to record audit entry for %s %s: %v", entry.RequestID, entry.Method, entry.Route, err)
+		}
+	})
+}
+
+// setAuditActor sets who a request's audit entry is attributed to, for
+// requests that identify a user without a token
+func setAuditActor(r *http.Request, username, userID string) {
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*models.AuditEntry); ok {
+		entry.Actor = username
+		entry.ActorID = userID
+	}
+}
+
+// auditFields returns the allowed top-level fields of a JSON body. Only
+// scalar values are kept; objects may hold credentials, such as bmc_info.
+func auditFields(body []byte, allowed []string) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+
+	kept := make(map[string]json.RawMessage)
+	for _, name := range allowed {
+		value, ok := fields[name]
+		if !ok || isSecretField(name) {
+			continue
+		}
+		if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			continue
+		}
+		kept[name] = value
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range secretFieldWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// teeReadCloser reads through a TeeReader and closes the original body
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// requestClaims returns the claims of a request's bearer token, or nil if
+// auth is disabled or the token is missing or invalid. It is for
+// middleware that runs before authMiddleware has checked the token.
+func (s *Server) requestClaims(r *http.Request) *auth.Claims {
+	if !s.config.EnableAuth {
+		return nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	claims, err := s.jwtManager.ValidateToken(token)
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// handleListAudit lists audit entries newest first, filtered by the actor,
+// impersonator, route, since, and until query parameters. since and until take an RFC
+// 3339 time or a duration before now. When the page is full, the
+// X-Next-Cursor header carries the cursor for the following page.
+func (s *Server) handleListAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := database.AuditFilter{
+		Actor:        query.Get("actor"),
+		Impersonator: query.Get("impersonator"),
+		Route:        query.Get("route"),
+		Limit:        defaultAuditLimit,
+	}
+
+	var err error
+	if filter.Since, err = parseEventTime(query.Get("since")); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid since: %v", err))
+		return
+	}
+	if filter.Until, err = parseEventTime(query.Get("until")); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid until: %v", err))
+		return
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeEventCursor(cursor)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		filter.After = &after
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxAuditLimit {
+			limit = maxAuditLimit
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := s.db.ListAuditEntries(filter)
+	if err != nil {
+		respondInternalError(w, err, "failed to list audit entries")
+		return
+	}
+
+	if entries == nil {
+		entries = []*models.AuditEntry{}
+	}
+
+	if len(entries) == filter.Limit {
+		last := entries[len(entries)-1]
+		w.Header().Set("X-Next-Cursor", encodeEventCursor(database.EventCursor{CreatedAt: last.CreatedAt, ID: last.ID}))
+	}
+
+	respondJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,88 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+func TestAuditLog(t *testing.T) {
+	env := testutil.New(t, func(config *api.Config) {
+		config.AuditFields = api.DefaultAuditFields
+	})
+	admin, viewer := env.Users[models.RoleAdmin], env.Users[models.RoleViewer]
+	machine := env.EnrollMachine("AUDIT01")
+
+	// The audited requests, and reads, which aren't
+	update := models.UpdateUserRequest{Role: models.RoleOperator, Active: true, Password: "new-password"}
+	env.MustJSON(models.RoleAdmin, http.MethodPut, "/api/v1/users/"+viewer.ID, update, http.StatusOK, nil)
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/"+machine.ID, nil, http.StatusOK, nil)
+	resp := env.Do(models.RoleAdmin, http.MethodDelete, "/api/v1/machines/"+machine.ID, nil)
+	resp.Body.Close()
+	deleted := resp.StatusCode
+	if deleted >= 300 {
+		t.Fatalf("delete machine: status %d", deleted)
+	}
+	login := models.LoginRequest{Username: "operator", Password: "wrong"}
+	env.MustJSON(testutil.Anonymous, http.MethodPost, "/api/v1/login", login, http.StatusUnauthorized, nil)
+	login.Password = "password"
+	env.MustJSON(testutil.Anonymous, http.MethodPost, "/api/v1/login", login, http.StatusOK, nil)
+
+	entries := func(route string) []*models.AuditEntry {
+		t.Helper()
+		var entries []*models.AuditEntry
+		env.MustJSON(models.RoleAdmin, http.MethodGet, "/api/v1/audit?route="+url.QueryEscape(route), nil, http.StatusOK, &entries)
+		return entries
+	}
+
+	users := entries("/api/v1/users/{id}")
+	if len(users) != 1 {
+		t.Fatalf("found %d user entries, want 1", len(users))
+	}
+	entry := users[0]
+	if entry.Actor != "admin" || entry.ActorID != admin.ID || entry.Method != http.MethodPut ||
+		entry.Targets["id"] != viewer.ID || entry.Status != http.StatusOK || entry.SourceIP != "127.0.0.1" {
+		t.Errorf("user update entry = %+v", entry)
+	}
+	// Only the allowed fields of the body are kept, and never the password
+	var fields map[string]interface{}
+	if err := json.Unmarshal(entry.Fields, &fields); err != nil {
+		t.Fatalf("fields %q: %v", entry.Fields, err)
+	}
+	if len(fields) != 2 || fields["role"] != "operator" || fields["active"] != true {
+		t.Errorf("user update fields = %s, want the role and active", entry.Fields)
+	}
+
+	machines := entries("/api/v1/machines/{id}")
+	if len(machines) != 1 {
+		t.Fatalf("found %d machine entries, want the delete alone", len(machines))
+	}
+	if entry := machines[0]; entry.Actor != "admin" || entry.Method != http.MethodDelete ||
+		entry.Targets["id"] != machine.ID || entry.Status != deleted || entry.Fields != nil {
+		t.Errorf("machine delete entry = %+v", entry)
+	}
+
+	// Logins are recorded under the username tried, newest first
+	logins := entries("/api/v1/login")
+	if len(logins) != 2 {
+		t.Fatalf("found %d login entries, want 2", len(logins))
+	}
+	if entry := logins[1]; entry.Actor != "operator" || entry.ActorID != "" || entry.Status != http.StatusUnauthorized || entry.Fields != nil {
+		t.Errorf("failed login entry = %+v", entry)
+	}
+	if entry := logins[0]; entry.Actor != "operator" || entry.ActorID != env.Users[models.RoleOperator].ID || entry.Status != http.StatusOK {
+		t.Errorf("login entry = %+v", entry)
+	}
+
+	// Only admins read the log
+	resp = env.Do(models.RoleOperator, http.MethodGet, "/api/v1/audit", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("operator read the audit log: status %d", resp.StatusCode)
+	}
+}
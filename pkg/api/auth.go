@@ -1,7 +1,7 @@
 package api
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -16,19 +16,18 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	// Only admins can register new users
 	claims, ok := auth.GetClaims(r)
 	if !ok || claims.Role != models.RoleAdmin {
-		respondError(w, http.StatusForbidden, "only admins can register new users")
+		respondError(w, http.StatusForbidden, CodeForbidden, "only admins can register new users")
 		return
 	}
 
 	var req models.RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate required fields
 	if req.Username == "" || req.Email == "" || req.Password == "" {
-		respondError(w, http.StatusBadRequest, "username, email, and password are required")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "username, email, and password are required")
 		return
 	}
 
@@ -37,37 +36,45 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		req.Role = models.RoleViewer
 	}
 	if req.Role != models.RoleAdmin && req.Role != models.RoleOperator && req.Role != models.RoleViewer {
-		respondError(w, http.StatusBadRequest, "invalid role")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid role")
 		return
 	}
 
 	// Check if username already exists
 	existing, err := s.db.GetUserByUsername(req.Username)
 	if err != nil {
-		log.Printf("Failed to check existing user: %v", err)
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 	if existing != nil {
-		respondError(w, http.StatusConflict, "username already exists")
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "username already exists")
+		return
+	}
+
+	if req.DefaultGroupID != "" && !s.checkDefaultGroup(w, req.DefaultGroupID) {
 		return
 	}
 
 	// Hash password
 	passwordHash, err := auth.HashPassword(req.Password)
 	if err != nil {
-		log.Printf("Failed to hash password: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to create user")
+		respondInternalError(w, err, "failed to create user")
 		return
 	}
 
 	// Create user
 	user, err := s.db.CreateUser(req.Username, req.Email, passwordHash, req.Role)
 	if err != nil {
-		log.Printf("Failed to create user: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to create user")
+		respondInternalError(w, err, "failed to create user")
 		return
 	}
+	if req.DefaultGroupID != "" {
+		user.DefaultGroupID = req.DefaultGroupID
+		if err := s.db.UpdateUser(user); err != nil {
+			respondInternalError(w, err, "failed to set default group")
+			return
+		}
+	}
 
 	log.Printf("Created user: %s (role: %s)", user.Username, user.Role)
 	respondJSON(w, http.StatusCreated, user)
@@ -76,47 +83,49 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 // handleLogin handles user login
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var req models.LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeStrictJSON(w, r, &req) {
 		return
 	}
 
+	// Login attempts are audited under the username tried
+	setAuditActor(r, req.Username, "")
+
 	// Validate required fields
 	if req.Username == "" || req.Password == "" {
-		respondError(w, http.StatusBadRequest, "username and password are required")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "username and password are required")
 		return
 	}
 
 	// Get user
 	user, err := s.db.GetUserByUsername(req.Username)
 	if err != nil {
-		log.Printf("Failed to get user: %v", err)
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if user == nil {
-		respondError(w, http.StatusUnauthorized, "invalid credentials")
+		respondError(w, http.StatusUnauthorized, CodeInvalidCredentials, "invalid credentials")
 		return
 	}
 
 	// Check if user is active
 	if !user.Active {
-		respondError(w, http.StatusUnauthorized, "account is disabled")
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "account is disabled")
 		return
 	}
 
 	// Verify password
 	if err := auth.VerifyPassword(req.Password, user.PasswordHash); err != nil {
-		respondError(w, http.StatusUnauthorized, "invalid credentials")
+		respondError(w, http.StatusUnauthorized, CodeInvalidCredentials, "invalid credentials")
 		return
 	}
 
+	setAuditActor(r, user.Username, user.ID)
+
 	// Generate token
 	token, expiresAt, err := s.jwtManager.GenerateToken(user)
 	if err != nil {
-		log.Printf("Failed to generate token: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to generate token")
+		respondInternalError(w, err, "failed to generate token")
 		return
 	}
 
@@ -140,21 +149,25 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
 	// Get current token from header
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		respondError(w, http.StatusUnauthorized, "missing authorization header")
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "missing authorization header")
 		return
 	}
 
 	// Extract token
 	var token string
 	if _, err := fmt.Sscanf(authHeader, "Bearer %s", &token); err != nil {
-		respondError(w, http.StatusUnauthorized, "invalid authorization header")
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid authorization header")
 		return
 	}
 
 	// Refresh token
 	newToken, expiresAt, err := s.jwtManager.RefreshToken(token)
+	if errors.Is(err, auth.ErrImpersonationNotRefreshable) {
+		respondError(w, http.StatusForbidden, CodeImpersonating, "impersonation tokens cannot be refreshed; start another session")
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusUnauthorized, "invalid token")
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid token")
 		return
 	}
 
@@ -170,31 +183,39 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	claims, ok := auth.GetClaims(r)
 	if !ok {
-		respondError(w, http.StatusUnauthorized, "unauthorized")
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
 		return
 	}
 
 	user, err := s.db.GetUser(claims.UserID)
 	if err != nil {
-		log.Printf("Failed to get user: %v", err)
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if user == nil {
-		respondError(w, http.StatusNotFound, "user not found")
+		respondError(w, http.StatusNotFound, CodeUserNotFound, "user not found")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, user)
+	current := models.CurrentUser{User: *user}
+	if claims.Impersonating() {
+		session, err := s.db.GetImpersonationSession(claims.ID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		current.Impersonation = session
+	}
+
+	respondJSON(w, http.StatusOK, current)
 }
 
 // handleListUsers lists all users (admin only)
 func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
 	users, err := s.db.ListUsers()
 	if err != nil {
-		log.Printf("Failed to list users: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to list users")
+		respondInternalError(w, err, "failed to list users")
 		return
 	}
 
@@ -208,13 +229,12 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := s.db.GetUser(id)
 	if err != nil {
-		log.Printf("Failed to get user: %v", err)
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if user == nil {
-		respondError(w, http.StatusNotFound, "user not found")
+		respondError(w, http.StatusNotFound, CodeUserNotFound, "user not found")
 		return
 	}
 
@@ -228,18 +248,17 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := s.db.GetUser(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if user == nil {
-		respondError(w, http.StatusNotFound, "user not found")
+		respondError(w, http.StatusNotFound, CodeUserNotFound, "user not found")
 		return
 	}
 
 	var req models.UpdateUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
@@ -250,24 +269,28 @@ func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	if req.Password != "" {
 		passwordHash, err := auth.HashPassword(req.Password)
 		if err != nil {
-			log.Printf("Failed to hash password: %v", err)
-			respondError(w, http.StatusInternalServerError, "failed to update user")
+			respondInternalError(w, err, "failed to update user")
 			return
 		}
 		user.PasswordHash = passwordHash
 	}
 	if req.Role != "" {
 		if req.Role != models.RoleAdmin && req.Role != models.RoleOperator && req.Role != models.RoleViewer {
-			respondError(w, http.StatusBadRequest, "invalid role")
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid role")
 			return
 		}
 		user.Role = req.Role
 	}
+	if req.DefaultGroupID != nil {
+		if *req.DefaultGroupID != "" && !s.checkDefaultGroup(w, *req.DefaultGroupID) {
+			return
+		}
+		user.DefaultGroupID = *req.DefaultGroupID
+	}
 	user.Active = req.Active
 
 	if err := s.db.UpdateUser(user); err != nil {
-		log.Printf("Failed to update user: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to update user")
+		respondInternalError(w, err, "failed to update user")
 		return
 	}
 
@@ -282,15 +305,29 @@ func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	// Prevent deleting self
 	claims, ok := auth.GetClaims(r)
 	if ok && claims.UserID == id {
-		respondError(w, http.StatusBadRequest, "cannot delete yourself")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "cannot delete yourself")
 		return
 	}
 
 	if err := s.db.DeleteUser(id); err != nil {
-		log.Printf("Failed to delete user: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to delete user")
+		respondInternalError(w, err, "failed to delete user")
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// checkDefaultGroup checks that the group given as a user's default group
+// exists. It responds with an error and returns false if not.
+func (s *Server) checkDefaultGroup(w http.ResponseWriter, groupID string) bool {
+	group, err := s.db.GetGroup(groupID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return false
+	}
+	if group == nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "default_group_id: group not found")
+		return false
+	}
+	return true
+}
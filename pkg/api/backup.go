@@ -0,0 +1,114 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/backup"
+)
+
+// handleBackup creates a backup. By default the archive is streamed back;
+// with ?store=true it is written to the backup directory instead.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	store, _ := strconv.ParseBool(r.URL.Query().Get("store"))
+
+	if store {
+		if s.config.BackupDir == "" {
+			respondError(w, http.StatusConflict, CodeConflict, "no backup directory is configured")
+			return
+		}
+
+		path, manifest, err := s.storeBackup()
+		if err != nil {
+			respondInternalError(w, err, "failed to create backup")
+			return
+		}
+
+		respondJSON(w, http.StatusCreated, map[string]interface{}{
+			"path":     path,
+			"manifest": manifest,
+		})
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "metal-backup-out-")
+	if err != nil {
+		respondInternalError(w, err, "failed to create backup")
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path, _, err := backup.Create(dir, s.db, s.config.ImagesDir)
+	if err != nil {
+		respondInternalError(w, err, "failed to create backup")
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		respondInternalError(w, err, "failed to read backup")
+		return
+	}
+	defer f.Close()
+
+	s.metrics.lastBackup.SetToCurrentTime()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Backup download interrupted: %v", err)
+	}
+}
+
+// StartBackups writes a backup to the backup directory every interval,
+// keeping the newest BackupKeep
+func (s *Server) StartBackups(interval time.Duration) {
+	go func() {
+		log.Printf("Scheduled backups started (interval: %s, keep: %d, dir: %s)", interval, s.config.BackupKeep, s.config.BackupDir)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !s.leadJob("backup", interval) {
+				continue
+			}
+
+			path, _, err := s.storeBackup()
+			if err != nil {
+				log.Printf("Scheduled backup failed: %v", err)
+				continue
+			}
+			log.Printf("Wrote backup %s", path)
+		}
+	}()
+}
+
+// storeBackup writes a backup to the backup directory and rotates old ones
+func (s *Server) storeBackup() (string, *backup.Manifest, error) {
+	path, manifest, err := backup.Create(s.config.BackupDir, s.db, s.config.ImagesDir)
+	if err != nil {
+		return "", nil, err
+	}
+	s.metrics.lastBackup.SetToCurrentTime()
+
+	if s.config.BackupKeep > 0 {
+		removed, err := backup.Rotate(s.config.BackupDir, s.config.BackupKeep)
+		if err != nil {
+			// The new backup is good; a failed rotation only leaves extras
+			log.Printf("Backup rotation failed: %v", err)
+		}
+		for _, old := range removed {
+			log.Printf("Rotated out backup %s", old)
+		}
+	}
+
+	return path, manifest, nil
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// defaultBMCPollConcurrency bounds concurrent BMC connections when the
+// server is not configured with an explicit limit
+const defaultBMCPollConcurrency = 4
+
+// BMCHealthResponse is the result of a live BMC health check
+type BMCHealthResponse struct {
+	MachineID   string             `json:"machine_id"`
+	State       string             `json:"state"`
+	Firmware    string             `json:"firmware,omitempty"`
+	Unreachable bool               `json:"unreachable"`
+	Error       string             `json:"error,omitempty"`
+	CheckedAt   time.Time          `json:"checked_at"`
+	Report      *ipmi.HealthReport `json:"report,omitempty"`
+}
+
+// handleGetBMCHealth polls the machine's BMC and returns its health roll-up
+func (s *Server) handleGetBMCHealth(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	machineID := vars["id"]
+
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if machine.BMCInfo == nil || !machine.BMCInfo.Enabled {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.checkBMC(machine))
+}
+
+// checkBMC reads firmware and sensor health from a machine's BMC and records
+// the result. A BMC that cannot be reached is flagged as unreachable; the
+// machine's own status is left untouched.
+func (s *Server) checkBMC(machine *models.Machine) *BMCHealthResponse {
+	s.bmcSlots <- struct{}{}
+	defer func() { <-s.bmcSlots }()
+
+	result := &BMCHealthResponse{
+		MachineID: machine.ID,
+		State:     ipmi.HealthUnknown,
+		CheckedAt: time.Now(),
+	}
+
+	controller := s.powerController()
+
+	info, err := controller.GetBMCInfo(machine.BMCInfo)
+	var readings []ipmi.SensorReading
+	if err == nil {
+		readings, err = controller.GetSensorReadings(machine.BMCInfo)
+	}
+
+	if err != nil {
+		log.Printf("BMC health check failed for machine %s: %v", machine.ID, err)
+		result.Unreachable = true
+		result.Error = err.Error()
+		result.Firmware = machine.BMCFirmware
+	} else {
+		report := ipmi.SummarizeHealth(readings)
+		result.State = report.State
+		result.Firmware = ipmi.FirmwareVersion(info)
+		result.Report = &report
+	}
+
+	// Unknown is not persisted so a BMC that stops reporting sensors keeps
+	// its last known state alongside the unreachable flag
+	health := result.State
+	if health == ipmi.HealthUnknown {
+		health = ""
+	}
+	if err := s.db.UpdateMachineBMCStatus(machine.ID, result.Firmware, health, result.Unreachable, result.CheckedAt); err != nil {
+		log.Printf("Failed to record BMC status for machine %s: %v", machine.ID, err)
+	}
+
+	return result
+}
+
+// StartBMCPoller periodically checks every machine with an enabled BMC. The
+// number of concurrent BMC connections is shared with on-demand checks and
+// limited by Config.BMCPollConcurrency.
+func (s *Server) StartBMCPoller(interval time.Duration) {
+	go func() {
+		log.Printf("BMC poller started (interval: %s)", interval)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if s.leadJob("bmc-poller", interval) {
+				s.pollBMCs()
+			}
+		}
+	}()
+}
+
+// pollBMCs runs one scheduled health check pass over all enabled BMCs
+func (s *Server) pollBMCs() {
+	machines, err := s.db.ListMachines()
+	if err != nil {
+		log.Printf("BMC poller failed to list machines: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, machine := range machines {
+		if machine.BMCInfo == nil || !machine.BMCInfo.Enabled || machine.Status == models.StatusDecommissioned {
+			continue
+		}
+
+		wg.Add(1)
+		go func(m *models.Machine) {
+			defer wg.Done()
+			s.checkBMC(m)
+		}(machine)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,358 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/redfish"
+	"github.com/gorilla/mux"
+)
+
+// Verifying a new BMC password is retried, since some BMCs take a moment to
+// apply it
+const (
+	bmcVerifyAttempts = 3
+	bmcVerifyDelay    = 2 * time.Second
+)
+
+// maxBulkRotationConcurrency bounds the concurrency a bulk rotation can ask
+// for
+const maxBulkRotationConcurrency = 32
+
+// bmcPasswordAlphabet leaves out characters that ipmitool exec or BMC web
+// interfaces might treat specially, and ones that are easy to misread
+const bmcPasswordAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+
+// handleRotateBMCPassword sets a new random password on the machine's BMC.
+// Rotation runs asynchronously and is tracked as a BMC operation that can be
+// polled via GET /machines/{id}/bmc/operations/{op_id}.
+func (s *Server) handleRotateBMCPassword(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	machineID := vars["id"]
+
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if machine.BMCInfo == nil || !machine.BMCInfo.Enabled {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
+		return
+	}
+	if machine.BMCInfo.Username == "" || machine.BMCInfo.Password == "" {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC credentials are not set for this machine")
+		return
+	}
+
+	userID := "system"
+	if claims, ok := auth.GetClaims(r); ok {
+		userID = claims.UserID
+	}
+
+	if _, busy := s.bmcRotations.LoadOrStore(machineID, struct{}{}); busy {
+		respondError(w, http.StatusConflict, CodeConflict, "a BMC password rotation is already running for this machine")
+		return
+	}
+
+	op := &models.PowerOperation{
+		MachineID:   machineID,
+		Operation:   "bmc_rotate",
+		Status:      "pending",
+		InitiatedBy: userID,
+	}
+
+	if err := s.db.CreatePowerOperation(op); err != nil {
+		s.bmcRotations.Delete(machineID)
+		respondInternalError(w, err, "failed to create BMC operation")
+		return
+	}
+
+	go func() {
+		defer s.bmcRotations.Delete(machineID)
+		s.rotateBMCPassword(machineID, op)
+	}()
+
+	respondJSON(w, http.StatusAccepted, op)
+}
+
+// bulkRotateBMC rotates the BMC passwords of machines, at most concurrency
+// at a time, and waits for every rotation to finish
+func (s *Server) bulkRotateBMC(machineIDs []string, concurrency int, userID string) models.BulkOperationResult {
+	result := models.BulkOperationResult{
+		TotalCount: len(machineIDs),
+	}
+
+	var mu sync.Mutex
+	fail := func(id string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.Fail(id, err)
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for _, id := range machineIDs {
+		machine, err := s.db.GetMachine(id)
+		if err != nil {
+			fail(id, err)
+			continue
+		}
+		if machine == nil {
+			fail(id, fmt.Errorf("not found"))
+			continue
+		}
+		if machine.BMCInfo == nil || !machine.BMCInfo.Enabled {
+			fail(id, fmt.Errorf("BMC is not configured"))
+			continue
+		}
+		if machine.BMCInfo.Username == "" || machine.BMCInfo.Password == "" {
+			fail(id, fmt.Errorf("BMC credentials are not set"))
+			continue
+		}
+		if _, busy := s.bmcRotations.LoadOrStore(id, struct{}{}); busy {
+			fail(id, fmt.Errorf("rotation already running"))
+			continue
+		}
+
+		op := &models.PowerOperation{
+			MachineID:   id,
+			Operation:   "bmc_rotate",
+			Status:      "pending",
+			InitiatedBy: userID,
+		}
+		if err := s.db.CreatePowerOperation(op); err != nil {
+			s.bmcRotations.Delete(id)
+			fail(id, err)
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer s.bmcRotations.Delete(id)
+
+			if err := s.rotateBMCPassword(id, op); err != nil {
+				fail(id, err)
+				return
+			}
+			mu.Lock()
+			result.Succeed(id, nil)
+			mu.Unlock()
+		}(id)
+	}
+
+	wg.Wait()
+	return result
+}
+
+// rotateBMCPassword sets a new password on a machine's BMC, verifies that it
+// logs in, and only then stores it. A password that fails verification, or
+// that cannot be stored, is rolled back on the BMC. The operation is
+// finished and the outcome recorded as a machine event.
+func (s *Server) rotateBMCPassword(machineID string, op *models.PowerOperation) error {
+	machine, err := s.db.GetMachine(machineID)
+	if err == nil && machine == nil {
+		err = fmt.Errorf("machine no longer exists")
+	}
+	if err == nil && machine.BMCInfo == nil {
+		err = fmt.Errorf("BMC is not configured for this machine")
+	}
+	if err != nil {
+		return s.failBMCRotation(machineID, op, err, false)
+	}
+
+	current := *machine.BMCInfo
+	password, err := generateBMCPassword(ipmi.PasswordLength(&current))
+	if err != nil {
+		return s.failBMCRotation(machineID, op, err, false)
+	}
+
+	// A failed set leaves the old password in place
+	if err := s.setBMCPassword(&current, password); err != nil {
+		return s.failBMCRotation(machineID, op, redactBMCError(err, password), false)
+	}
+
+	rotated := current
+	rotated.Password = password
+
+	if err := s.verifyBMCLogin(&rotated); err != nil {
+		err = fmt.Errorf("new password did not verify: %w", redactBMCError(err, password))
+		return s.failBMCRotation(machineID, op, err, s.restoreBMCPassword(machineID, &current, password))
+	}
+
+	// Store the password in whatever the machine looks like now
+	machine, err = s.db.GetMachine(machineID)
+	if err == nil && (machine == nil || machine.BMCInfo == nil) {
+		err = fmt.Errorf("machine or its BMC was removed during rotation")
+	}
+	if err == nil && (machine.BMCInfo.IPAddress != current.IPAddress || machine.BMCInfo.Username != current.Username) {
+		err = fmt.Errorf("BMC address or username changed during rotation")
+	}
+	if err == nil {
+		machine.BMCInfo.Password = password
+		err = s.db.UpdateMachine(machine)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to store new password: %w", err)
+		return s.failBMCRotation(machineID, op, err, s.restoreBMCPassword(machineID, &current, password))
+	}
+
+	now := time.Now()
+	op.CompletedAt = &now
+	op.Status = "success"
+	op.Result = fmt.Sprintf("rotated password for BMC user %s", current.Username)
+	s.finishPowerOperation(op)
+
+	log.Printf("Rotated BMC password for machine %s", machineID)
+	s.publish(context.Background(), events.Event{
+		Type:      events.MachineBMCPasswordRotated,
+		MachineID: machineID,
+		Actor:     operationActor(op),
+		Data: events.BMCPasswordRotatedData{
+			OperationID: op.ID,
+			Username:    current.Username,
+			Source:      bmcSource(&current),
+		},
+	})
+
+	return nil
+}
+
+// restoreBMCPassword puts the old password back after a rotation that could
+// not be completed. The BMC is asked with the new password first and then
+// with the old one, in case the change never took effect. It reports whether
+// the old password was restored.
+func (s *Server) restoreBMCPassword(machineID string, old *models.BMCInfo, password string) bool {
+	rotated := *old
+	rotated.Password = password
+
+	for _, login := range []*models.BMCInfo{&rotated, old} {
+		if err := s.setBMCPassword(login, old.Password); err != nil {
+			continue
+		}
+		if s.verifyBMCLogin(old) == nil {
+			return true
+		}
+	}
+
+	log.Printf("Failed to restore the BMC password of machine %s after a failed rotation", machineID)
+	return false
+}
+
+// failBMCRotation finishes a rotation's operation as failed and records the
+// failure
+func (s *Server) failBMCRotation(machineID string, op *models.PowerOperation, err error, rolledBack bool) error {
+	now := time.Now()
+	op.CompletedAt = &now
+	op.Status = "failed"
+	op.Error = err.Error()
+	if rolledBack {
+		op.Error += " (old password restored)"
+	}
+	s.finishPowerOperation(op)
+
+	log.Printf("BMC password rotation failed for machine %s: %v", machineID, err)
+	s.publish(context.Background(), events.Event{
+		Type:      events.MachineBMCPasswordRotationFailed,
+		MachineID: machineID,
+		Actor:     operationActor(op),
+		Data: events.BMCPasswordRotationFailedData{
+			OperationID: op.ID,
+			Error:       err.Error(),
+			RolledBack:  rolledBack,
+		},
+	})
+
+	return err
+}
+
+// setBMCPassword changes the password of the BMC user bmc logs in as, using
+// the protocol the BMC speaks
+func (s *Server) setBMCPassword(bmc *models.BMCInfo, password string) error {
+	if bmcSource(bmc) == "redfish" {
+		client, err := redfish.NewClient(bmc)
+		if err != nil {
+			return err
+		}
+		return client.SetPassword(password)
+	}
+
+	return s.powerController().SetPassword(bmc, password)
+}
+
+// verifyBMCLogin checks that bmc's credentials log in, retrying while the
+// BMC applies a new password
+func (s *Server) verifyBMCLogin(bmc *models.BMCInfo) error {
+	var err error
+	for attempt := 0; attempt < bmcVerifyAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(bmcVerifyDelay)
+		}
+
+		if bmcSource(bmc) == "redfish" {
+			var client *redfish.Client
+			client, err = redfish.NewClient(bmc)
+			if err == nil {
+				err = client.CheckLogin()
+			}
+		} else {
+			err = s.powerController().TestConnection(bmc)
+		}
+
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// redactBMCError hides a new password in an error from a BMC client
+func redactBMCError(err error, password string) error {
+	if !strings.Contains(err.Error(), password) {
+		return err
+	}
+	return fmt.Errorf("%s", ipmi.Redact(err.Error(), password))
+}
+
+// generateBMCPassword returns a random password of the given length with at
+// least one uppercase letter, lowercase letter, and digit, which BMC
+// password policies commonly require
+func generateBMCPassword(length int) (string, error) {
+	max := big.NewInt(int64(len(bmcPasswordAlphabet)))
+	for {
+		password := make([]byte, length)
+		for i := range password {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", fmt.Errorf("failed to generate BMC password: %w", err)
+			}
+			password[i] = bmcPasswordAlphabet[n.Int64()]
+		}
+
+		p := string(password)
+		if strings.ContainsAny(p, "ABCDEFGHJKLMNPQRSTUVWXYZ") &&
+			strings.ContainsAny(p, "abcdefghijkmnopqrstuvwxyz") &&
+			strings.ContainsAny(p, "23456789") {
+			return p, nil
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Default request body limits
+const (
+	defaultMaxBodyBytes   = 1 << 20
+	defaultSmallBodyBytes = 256 << 10
+	defaultLargeBodyBytes = 16 << 20
+
+	defaultMaxAttachmentBytes = 10 << 20
+
+	// multipartOverhead is room for the multipart framing around an
+	// uploaded attachment
+	multipartOverhead = 64 << 10
+)
+
+// smallBodyRoutes are reachable without credentials, so they get the small
+// limit
+var smallBodyRoutes = map[string]bool{
+	"/api/v1/login":  true,
+	"/api/v1/enroll": true,
+
+	"/api/v1/subscriptions/{id}/unsubscribe": true,
+}
+
+// largeBodyRoutes carry NixOS configurations, bulk operations, or lease
+// files, which outgrow the default limit
+var largeBodyRoutes = map[string]bool{
+	"/api/v1/machines/{id}":          true,
+	"/api/v1/machines/adopt":         true,
+	"/api/v1/machines/apply":         true,
+	"/api/v1/machines/{id}/assemble": true,
+	"/api/v1/bulk":                   true,
+	"/api/v1/templates":              true,
+	"/api/v1/templates/{id}":         true,
+	"/api/v1/fragments":              true,
+	"/api/v1/fragments/{id}":         true,
+	"/api/v1/dhcp/leases":            true,
+
+	"/api/v1/system-images/{name}/config": true,
+}
+
+// attachmentRoutes take file uploads, limited by the attachment size
+var attachmentRoutes = map[string]bool{
+	"/api/v1/machines/{id}/attachments": true,
+}
+
+// bootAssetRoutes take boot asset uploads, limited by the boot asset size
+var bootAssetRoutes = map[string]bool{
+	"/api/v1/boot-assets": true,
+}
+
+// rawBodyRoutes take a body that isn't JSON, such as the form mail
+// clients post to unsubscribe
+var rawBodyRoutes = map[string]bool{
+	"/api/v1/machines/apply":                 true,
+	"/api/v1/dhcp/leases":                    true,
+	"/api/v1/machines/{id}/attachments":      true,
+	"/api/v1/boot-assets":                    true,
+	"/api/v1/subscriptions/{id}/unsubscribe": true,
+}
+
+// bodyLimitMiddleware caps the size of request bodies by route, and requires
+// the bodies of mutating requests to be JSON
+func (s *Server) bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		limit := s.config.MaxBodyBytes
+		if smallBodyRoutes[route] {
+			limit = s.config.SmallBodyBytes
+		} else if largeBodyRoutes[route] {
+			limit = s.config.LargeBodyBytes
+		} else if attachmentRoutes[route] {
+			limit = s.config.MaxAttachmentBytes + multipartOverhead
+		} else if bootAssetRoutes[route] {
+			limit = s.config.MaxBootAssetBytes + multipartOverhead
+		}
+
+		if r.ContentLength > limit {
+			respondBodyTooLarge(w, limit)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			// Requests without a body, like most actions, need no content type
+			if r.ContentLength != 0 && !rawBodyRoutes[route] && !isJSON(r) {
+				respondError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Content-Type must be application/json")
+				return
+			}
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isJSON reports whether a request declares a JSON body
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// decodeJSON decodes a request body into v. On failure it responds with 413
+// when the body was too large and 400 otherwise, and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	return decode(w, r, json.NewDecoder(r.Body), v)
+}
+
+// decodeStrictJSON is decodeJSON, but rejects fields v doesn't have
+func decodeStrictJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return decode(w, r, dec, v)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, dec *json.Decoder, v interface{}) bool {
+	err := dec.Decode(v)
+	if err == nil {
+		return true
+	}
+
+	if !respondBodyError(w, err) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body: "+err.Error())
+	}
+	return false
+}
+
+// respondBodyError responds with 413 and returns true if err came from
+// reading past the body limit
+func respondBodyError(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	respondBodyTooLarge(w, tooLarge.Limit)
+	return true
+}
+
+func respondBodyTooLarge(w http.ResponseWriter, limit int64) {
+	respondError(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("request body is larger than %d bytes", limit))
+}
@@ -0,0 +1,172 @@
+package api_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// Body limits of newBodyLimitEnv's server, small enough to exceed cheaply
+const (
+	testSmallBodyBytes  = 4 << 10
+	testMaxBodyBytes    = 8 << 10
+	testLargeBodyBytes  = 32 << 10
+	testAttachmentBytes = 32 << 10
+
+	// The attachment limit leaves this much room for multipart framing
+	multipartOverhead = 64 << 10
+)
+
+func newBodyLimitEnv(t *testing.T) *testutil.Env {
+	return testutil.New(t, func(config *api.Config) {
+		config.SmallBodyBytes = testSmallBodyBytes
+		config.MaxBodyBytes = testMaxBodyBytes
+		config.LargeBodyBytes = testLargeBodyBytes
+		config.MaxAttachmentBytes = testAttachmentBytes
+	})
+}
+
+// paddedJSON returns a JSON object of exactly n bytes
+func paddedJSON(n int) []byte {
+	const frame = `{"pad":""}`
+	return []byte(`{"pad":"` + strings.Repeat("x", n-len(frame)) + `"}`)
+}
+
+// sendBody makes a request as the user with role with body, of the given
+// content type unless empty. A chunked body is sent without its length,
+// so only reading it can find it too large.
+func sendBody(t *testing.T, env *testutil.Env, role models.UserRole, method, path, contentType string, body []byte, chunked bool) *http.Response {
+	t.Helper()
+
+	var reader io.Reader = bytes.NewReader(body)
+	if chunked {
+		reader = io.MultiReader(reader)
+	}
+	req, err := http.NewRequest(method, env.URL(path), reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if role != testutil.Anonymous {
+		req.Header.Set("Authorization", "Bearer "+env.Tokens[role])
+	}
+
+	resp, err := env.Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// expectError checks that resp is a JSON error with status and code
+func expectError(t *testing.T, resp *http.Response, status int, code string) {
+	t.Helper()
+
+	if resp.StatusCode != status {
+		body, _ := io.ReadAll(resp.Body)
+		t.Errorf("%s %s: status %d, want %d: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status, body)
+		return
+	}
+	if apiErr, ok := decodeError(t, resp); ok && apiErr.Code != code {
+		t.Errorf("%s %s: code %s, want %s", resp.Request.Method, resp.Request.URL.Path, apiErr.Code, code)
+	}
+}
+
+func TestBodyLimitsByRouteClass(t *testing.T) {
+	env := newBodyLimitEnv(t)
+	machine := env.EnrollMachine("LIMIT01")
+
+	tests := []struct {
+		class  string
+		role   models.UserRole
+		method string
+		path   string
+		limit  int
+
+		// json is set for routes that decode their body as JSON, which
+		// also find a chunked body too large
+		json bool
+	}{
+		{"small", testutil.Anonymous, "POST", "/api/v1/login", testSmallBodyBytes, true},
+		{"small", testutil.Anonymous, "POST", "/api/v1/enroll", testSmallBodyBytes, true},
+		{"default", models.RoleOperator, "POST", "/api/v1/groups", testMaxBodyBytes, true},
+		{"default", models.RoleOperator, "PUT", "/api/v1/machines/" + machine.ID + "/metadata", testMaxBodyBytes, true},
+		{"large", models.RoleOperator, "PUT", "/api/v1/machines/" + machine.ID, testLargeBodyBytes, true},
+		{"large", models.RoleOperator, "POST", "/api/v1/bulk", testLargeBodyBytes, true},
+		{"attachment", models.RoleOperator, "POST", "/api/v1/machines/" + machine.ID + "/attachments", testAttachmentBytes + multipartOverhead, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.class+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			// At the limit the body gets through to the handler, whatever
+			// it makes of it
+			resp := sendBody(t, env, tt.role, tt.method, tt.path, "application/json", paddedJSON(tt.limit), false)
+			if resp.StatusCode == http.StatusRequestEntityTooLarge {
+				t.Errorf("body of %d bytes rejected as too large", tt.limit)
+			}
+
+			resp = sendBody(t, env, tt.role, tt.method, tt.path, "application/json", paddedJSON(tt.limit+1), false)
+			expectError(t, resp, http.StatusRequestEntityTooLarge, "body_too_large")
+
+			if tt.json {
+				resp = sendBody(t, env, tt.role, tt.method, tt.path, "application/json", paddedJSON(tt.limit+1), true)
+				expectError(t, resp, http.StatusRequestEntityTooLarge, "body_too_large")
+			}
+		})
+	}
+}
+
+func TestMutatingRequestsRequireJSON(t *testing.T) {
+	env := newBodyLimitEnv(t)
+	machine := env.EnrollMachine("LIMIT02")
+	body := []byte(`{"name":"json-group"}`)
+
+	tests := []struct {
+		name        string
+		role        models.UserRole
+		method      string
+		path        string
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{"plain text", models.RoleOperator, "POST", "/api/v1/groups", "text/plain", body, http.StatusUnsupportedMediaType},
+		{"no content type", models.RoleOperator, "POST", "/api/v1/groups", "", body, http.StatusUnsupportedMediaType},
+		{"form", models.RoleOperator, "PUT", "/api/v1/machines/" + machine.ID, "application/x-www-form-urlencoded", []byte("hostname=x"), http.StatusUnsupportedMediaType},
+		{"anonymous", testutil.Anonymous, "POST", "/api/v1/login", "text/plain", []byte(`{"username":"admin"}`), http.StatusUnsupportedMediaType},
+		{"json with charset", models.RoleOperator, "POST", "/api/v1/groups", "application/json; charset=utf-8", body, http.StatusCreated},
+
+		// Requests without a body need no content type, and raw body
+		// routes take theirs as is
+		{"empty body", models.RoleOperator, "POST", "/api/v1/groups", "", nil, http.StatusBadRequest},
+		{"raw body route", models.RoleOperator, "POST", "/api/v1/dhcp/leases", "text/plain", []byte("lease 10.0.0.5 {\n}\n"), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := sendBody(t, env, tt.role, tt.method, tt.path, tt.contentType, tt.body, false)
+			switch tt.want {
+			case http.StatusUnsupportedMediaType:
+				expectError(t, resp, tt.want, "unsupported_media_type")
+			case 0:
+				if resp.StatusCode == http.StatusUnsupportedMediaType {
+					t.Errorf("raw body rejected with 415")
+				}
+			default:
+				if resp.StatusCode != tt.want {
+					data, _ := io.ReadAll(resp.Body)
+					t.Errorf("status %d, want %d: %s", resp.StatusCode, tt.want, data)
+				}
+			}
+		})
+	}
+}
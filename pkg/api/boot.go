@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// defaultBootHistoryLimit is how many boot requests are listed without
+// ?limit=
+const defaultBootHistoryLimit = 20
+
+// handleGetBootScript returns the boot script the iPXE server would serve a
+// machine right now, and which decision it made: the machine's own image or
+// the registration image and why, or a wipe, local boot, or refusal.
+// ?flavor=ipxe|grub|efi, ?arch=, ?uefi=, ?secureboot=, and ?profile=
+// describe the client the way a booting machine's request would, and
+// ?client_ip= the address a boot profile is selected by.
+func (s *Server) handleGetBootScript(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	machine, err := s.db.GetMachine(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if s.ipxe == nil {
+		respondError(w, http.StatusServiceUnavailable, CodeBootServerNotConfigured, "no iPXE server is configured; set IPXE_URL")
+		return
+	}
+
+	query := r.URL.Query()
+	switch query.Get("flavor") {
+	case "", "ipxe", "grub", "efi":
+	default:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "flavor must be ipxe, grub, or efi")
+		return
+	}
+
+	params := url.Values{}
+	for _, key := range []string{"flavor", "arch", "uefi", "secureboot", "profile", "client_ip"} {
+		if value := query.Get(key); value != "" {
+			params.Set(key, value)
+		}
+	}
+
+	preview, err := s.ipxe.Preview(r.Context(), machine.ServiceTag, params)
+	if err != nil {
+		respondError(w, http.StatusBadGateway, CodeBootServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, preview)
+}
+
+// handleListBootHistory lists a machine's network boot requests, newest
+// first
+func (s *Server) handleListBootHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	limit := defaultBootHistoryLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(l, database.BootHistoryKeep)
+	}
+
+	history, err := s.db.ListBootRequests(vars["id"], limit)
+	if err != nil {
+		respondInternalError(w, err, "failed to list boot history")
+		return
+	}
+
+	if history == nil {
+		history = []*models.BootRequest{}
+	}
+
+	respondJSON(w, http.StatusOK, history)
+}
+
+// handleRecordBootRequest adds a boot script the iPXE server served to the
+// machine's boot history. Every boot is published as machine.boot_requested,
+// so that a provisioned machine unexpectedly network booting can be alerted
+// on.
+func (s *Server) handleRecordBootRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	machine, err := s.db.GetMachine(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	var boot models.BootRequest
+	if !decodeJSON(w, r, &boot) {
+		return
+	}
+
+	if boot.Decision == "" || boot.Flavor == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "decision and flavor are required")
+		return
+	}
+
+	boot.MachineID = machine.ID
+	boot.ServiceTag = machine.ServiceTag
+
+	if err := s.db.RecordBootRequest(&boot); err != nil {
+		respondInternalError(w, err, "failed to record boot request")
+		return
+	}
+
+	if boot.Decision == models.BootDecisionOverride {
+		s.countBootOverrideServe(r.Context(), machine.ID)
+	}
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineBootRequested,
+		MachineID: machine.ID,
+		Data: events.BootRequestedData{
+			Decision:         boot.Decision,
+			Reason:           boot.Reason,
+			ClientIP:         boot.ClientIP,
+			Flavor:           boot.Flavor,
+			ArtifactsVersion: boot.ArtifactsVersion,
+			MachineStatus:    machine.Status,
+		},
+	})
+
+	// The image the machine booted doesn't have its latest configuration
+	if boot.Decision == models.BootDecisionCustom && machine.StaleBuild {
+		s.publish(r.Context(), events.Event{
+			Type:      events.MachineBootWithStaleConfig,
+			MachineID: machine.ID,
+			Data: events.BootWithStaleConfigData{
+				ArtifactsVersion: boot.ArtifactsVersion,
+				ConfigUpdatedAt:  machine.ConfigUpdatedAt,
+				ClientIP:         boot.ClientIP,
+			},
+		})
+	}
+
+	s.startProvisioning(r.Context(), machine, &boot)
+
+	respondJSON(w, http.StatusCreated, boot)
+}
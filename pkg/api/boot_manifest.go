@@ -0,0 +1,192 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// handleExportBootManifest exports what the iPXE server needs to serve
+// every machine without the API, signed with the boot manifest key, for
+// iPXE servers on networks the API can't be reached from. Virtual machines
+// never boot, so they are left out.
+func (s *Server) handleExportBootManifest(w http.ResponseWriter, r *http.Request) {
+	machines, err := s.db.ListMachines()
+	if err != nil {
+		respondInternalError(w, err, "failed to list machines")
+		return
+	}
+
+	manifest := &models.BootManifest{
+		GeneratedAt: time.Now().UTC(),
+		Machines:    []models.BootManifestMachine{},
+	}
+
+	registration, err := s.registrationManifestImage()
+	if err != nil {
+		respondInternalError(w, err, "failed to read the registration image")
+		return
+	}
+	manifest.Registration = *registration
+
+	for _, machine := range machines {
+		if machine.Virtual {
+			continue
+		}
+		entry := models.BootManifestMachine{
+			ID:              machine.ID,
+			ServiceTag:      machine.ServiceTag,
+			Hostname:        machine.Hostname,
+			Status:          string(machine.Status),
+			BootMode:        machine.BootMode,
+			Arch:            machine.Hardware.CPU.Architecture,
+			DeployMode:      machine.DeployMode,
+			HardwareRefresh: machine.HardwareRefreshRequestedAt != nil,
+			StaleBuild:      machine.StaleBuild,
+		}
+		if machine.LastBuildID != nil {
+			entry.LastBuildID = *machine.LastBuildID
+			image, err := s.manifestImage(path.Join("machines", machine.ServiceTag))
+			if err != nil {
+				respondInternalError(w, err, "failed to read the image of "+machine.ServiceTag)
+				return
+			}
+			if len(image.Artifacts) > 0 {
+				entry.Image = image
+			}
+		}
+		manifest.Machines = append(manifest.Machines, entry)
+	}
+
+	signed, err := models.SignBootManifest(manifest, s.jwtManager.BootManifestKey())
+	if err != nil {
+		respondInternalError(w, err, "failed to sign boot manifest")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="boot-manifest.json"`)
+	respondJSON(w, http.StatusOK, signed)
+}
+
+// registrationManifestImage describes the registration image the iPXE
+// server serves: the promoted version, or the image build.sh put in place
+// before the first promotion
+func (s *Server) registrationManifestImage() (*models.BootManifestImage, error) {
+	current, err := s.db.GetCurrentSystemImage(models.SystemImageRegistration)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := models.SystemImageRegistration
+	if _, err := os.Stat(filepath.Join(s.config.ImagesDir, dir, "current")); err == nil {
+		dir += "/current"
+	}
+	image, err := s.manifestImage(dir)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && strings.HasSuffix(dir, "/current") {
+		image.Version = current.Version
+	}
+	return image, nil
+}
+
+// netbootKernels are the kernels of netboot images, by which the
+// subdirectories of an image directory holding other architectures' images
+// are told apart from those holding installers and bundles
+var netbootKernels = []string{"bzImage", "Image"}
+
+// manifestImage lists the files of an image directory with their
+// checksums: those at its top, and those in subdirectories with the
+// netboot image of another architecture. Installers and bundles, which
+// are built into other subdirectories, aren't netbooted and are left out.
+func (s *Server) manifestImage(dir string) (*models.BootManifestImage, error) {
+	image := &models.BootManifestImage{Dir: dir, Artifacts: []models.BootManifestArtifact{}}
+
+	root := filepath.Join(s.config.ImagesDir, filepath.FromSlash(dir))
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return image, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if !hasNetbootKernel(filepath.Join(root, entry.Name())) {
+				continue
+			}
+			sub, err := s.manifestImage(path.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, artifact := range sub.Artifacts {
+				artifact.Name = entry.Name() + "/" + artifact.Name
+				image.Artifacts = append(image.Artifacts, artifact)
+			}
+			continue
+		}
+
+		name := entry.Name()
+		if name == models.BuildArtifactMarker || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		file := filepath.Join(root, name)
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return nil, err
+		}
+		image.Artifacts = append(image.Artifacts, models.BootManifestArtifact{Name: name, Size: info.Size(), SHA256: sum})
+
+		if name == "init" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			line, _, _ := strings.Cut(string(data), "\n")
+			image.Init = strings.TrimSpace(line)
+		}
+	}
+	return image, nil
+}
+
+// hasNetbootKernel reports whether a directory holds a netboot image
+func hasNetbootKernel(dir string) bool {
+	for _, kernel := range netbootKernels {
+		if info, err := os.Stat(filepath.Join(dir, kernel)); err == nil && info.Mode().IsRegular() {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's contents
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,436 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// defaultMaxBootAssetBytes is large enough for installer and firmware ISOs
+const defaultMaxBootAssetBytes = 4 << 30
+
+// sha256Pattern is a SHA-256 in hex, as uploads are checked against
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Reasons a boot override is cleared, in machine.boot_override_cleared
+const (
+	overrideCleared   = "cleared"
+	overrideExpired   = "expired"
+	overrideBootsUsed = "boots_used"
+
+	overrideDiagnosticsEnded = "diagnostics_ended"
+)
+
+// handleListBootAssets lists boot assets, newest first
+func (s *Server) handleListBootAssets(w http.ResponseWriter, r *http.Request) {
+	assets, err := s.db.ListBootAssets()
+	if err != nil {
+		respondInternalError(w, err, "failed to list boot assets")
+		return
+	}
+	if assets == nil {
+		assets = []*models.BootAsset{}
+	}
+
+	respondJSON(w, http.StatusOK, assets)
+}
+
+// handleUploadBootAsset stores the file in the multipart form field "file"
+// as a boot asset of ?kind=. If ?sha256= is given, the upload is rejected
+// unless the file has that checksum.
+func (s *Server) handleUploadBootAsset(w http.ResponseWriter, r *http.Request) {
+	if s.config.BootAssetsDir == "" {
+		respondError(w, http.StatusServiceUnavailable, CodeBootAssetsNotConfigured, "no boot assets directory is configured")
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+	expected := strings.ToLower(r.URL.Query().Get("sha256"))
+	if expected != "" && !sha256Pattern.MatchString(expected) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "sha256 must be 64 hex digits")
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "body must be a multipart form with a file field")
+		return
+	}
+
+	var asset *models.BootAsset
+	var tmpPath string
+	for asset == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "the form has no file field")
+			return
+		}
+		if err != nil {
+			if !respondBodyError(w, err) {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid multipart form: "+err.Error())
+			}
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		name := filepath.Base(strings.ReplaceAll(part.FileName(), `\`, "/"))
+		if err := models.ValidateBootAsset(name, kind); err != nil {
+			part.Close()
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		path, size, hash, err := receiveFile(s.config.BootAssetsDir, part, s.config.MaxBootAssetBytes)
+		part.Close()
+		if err != nil {
+			if !respondBodyError(w, err) {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			}
+			return
+		}
+		asset = &models.BootAsset{Name: name, Kind: kind, Size: size, SHA256: hash}
+		tmpPath = path
+	}
+	defer os.Remove(tmpPath)
+
+	if expected != "" && expected != asset.SHA256 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "checksum mismatch: the uploaded file's SHA-256 is "+asset.SHA256)
+		return
+	}
+
+	if claims, ok := auth.GetClaims(r); ok {
+		asset.UploadedBy = claims.Username
+	}
+
+	if err := s.storeBootAsset(asset, tmpPath); err != nil {
+		respondInternalError(w, err, "failed to store boot asset")
+		return
+	}
+
+	log.Printf("Stored boot asset %s (%s, %s, %d bytes)", asset.Name, asset.Kind, asset.SHA256, asset.Size)
+
+	respondJSON(w, http.StatusCreated, asset)
+}
+
+// storeBootAsset moves an uploaded file to its content-addressed path,
+// unless the same file is already stored, and records the asset
+func (s *Server) storeBootAsset(asset *models.BootAsset, tmpPath string) error {
+	path := filepath.Join(s.config.BootAssetsDir, asset.SHA256[:2], asset.SHA256)
+
+	s.bootAssetsMu.Lock()
+	defer s.bootAssetsMu.Unlock()
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		// The iPXE server serves the file, possibly as another user
+		if err := os.Chmod(tmpPath, 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return s.db.CreateBootAsset(asset)
+}
+
+// handleGetBootAsset returns a boot asset's record
+func (s *Server) handleGetBootAsset(w http.ResponseWriter, r *http.Request) {
+	asset, err := s.db.GetBootAsset(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if asset == nil {
+		respondError(w, http.StatusNotFound, CodeBootAssetNotFound, "boot asset not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, asset)
+}
+
+// handleDeleteBootAsset deletes a boot asset, and its file if no other asset
+// has the same contents. Assets that boot overrides or diagnostic profiles
+// use can't be deleted.
+func (s *Server) handleDeleteBootAsset(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	machineIDs, err := s.db.BootAssetOverrides(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	for _, machineID := range machineIDs {
+		override, err := s.activeBootOverride(r.Context(), machineID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if override != nil {
+			respondError(w, http.StatusConflict, CodeConflict, "the boot override of machine "+machineID+" uses this asset")
+			return
+		}
+	}
+
+	profiles, err := s.db.BootAssetDiagnosticProfiles(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if len(profiles) > 0 {
+		respondError(w, http.StatusConflict, CodeConflict, "diagnostic profile "+profiles[0]+" uses this asset")
+		return
+	}
+
+	deleted, err := s.db.DeleteBootAsset(id)
+	if err != nil {
+		respondInternalError(w, err, "failed to delete boot asset")
+		return
+	}
+	if !deleted {
+		respondError(w, http.StatusNotFound, CodeBootAssetNotFound, "boot asset not found")
+		return
+	}
+
+	s.removeUnusedBootAssets()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeUnusedBootAssets removes stored files no boot asset refers to
+func (s *Server) removeUnusedBootAssets() {
+	if s.config.BootAssetsDir == "" {
+		return
+	}
+
+	s.bootAssetsMu.Lock()
+	defer s.bootAssetsMu.Unlock()
+
+	hashes, err := s.db.BootAssetHashes()
+	if err != nil {
+		log.Printf("Failed to list boot assets: %v", err)
+		return
+	}
+
+	removeUnusedFiles(s.config.BootAssetsDir, hashes)
+}
+
+// handleGetBootOverride returns a machine's boot override with its assets.
+// The iPXE server reads it on every boot of the machine.
+func (s *Server) handleGetBootOverride(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	override, err := s.activeBootOverride(r.Context(), machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if override == nil {
+		respondError(w, http.StatusNotFound, CodeBootOverrideNotFound, "machine has no boot override")
+		return
+	}
+	if err := s.fillBootOverrideAssets(override); err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, override)
+}
+
+// handleSetBootOverride sets a machine's boot override, replacing any it
+// has. The machine's status is left alone: the override only changes what
+// the iPXE server serves it.
+func (s *Server) handleSetBootOverride(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	var req models.SetBootOverrideRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := req.Validate(time.Now()); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	override := &models.BootOverride{
+		MachineID:     machine.ID,
+		Script:        req.Script,
+		KernelAssetID: req.KernelAssetID,
+		InitrdAssetID: req.InitrdAssetID,
+		ISOAssetID:    req.ISOAssetID,
+		Cmdline:       req.Cmdline,
+		MaxBoots:      req.MaxBoots,
+		ExpiresAt:     req.ExpiresAt,
+	}
+	if err := s.fillBootOverrideAssets(override); err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	for _, ref := range []struct {
+		field, id, kind string
+		asset           *models.BootAsset
+	}{
+		{"kernel_asset_id", override.KernelAssetID, models.BootAssetKernel, override.Kernel},
+		{"initrd_asset_id", override.InitrdAssetID, models.BootAssetInitrd, override.Initrd},
+		{"iso_asset_id", override.ISOAssetID, models.BootAssetISO, override.ISO},
+	} {
+		if ref.id == "" {
+			continue
+		}
+		if ref.asset == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, ref.field+" is not a boot asset")
+			return
+		}
+		if ref.asset.Kind != ref.kind {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, ref.field+" must be an asset of kind "+ref.kind)
+			return
+		}
+	}
+
+	if claims, ok := auth.GetClaims(r); ok {
+		override.CreatedBy = claims.Username
+	}
+
+	if err := s.db.SetBootOverride(override); err != nil {
+		respondInternalError(w, err, "failed to set boot override")
+		return
+	}
+
+	log.Printf("Boot override set on machine %s by %q", machine.ID, override.CreatedBy)
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineBootOverrideSet,
+		MachineID: machine.ID,
+		Data: events.BootOverrideSetData{
+			KernelAssetID: override.KernelAssetID,
+			ISOAssetID:    override.ISOAssetID,
+			Script:        override.Script != "",
+			MaxBoots:      override.MaxBoots,
+			ExpiresAt:     override.ExpiresAt,
+			CreatedBy:     override.CreatedBy,
+		},
+	})
+
+	respondJSON(w, http.StatusCreated, override)
+}
+
+// handleClearBootOverride clears a machine's boot override, so the iPXE
+// server serves it what its status calls for again
+func (s *Server) handleClearBootOverride(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	cleared, err := s.db.ClearBootOverride(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to clear boot override")
+		return
+	}
+	if !cleared {
+		respondError(w, http.StatusNotFound, CodeBootOverrideNotFound, "machine has no boot override")
+		return
+	}
+
+	s.publishBootOverrideCleared(r.Context(), machine.ID, overrideCleared)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// activeBootOverride returns a machine's boot override, or nil if it has
+// none. An expired override is cleared.
+func (s *Server) activeBootOverride(ctx context.Context, machineID string) (*models.BootOverride, error) {
+	override, err := s.db.GetBootOverride(machineID)
+	if err != nil || override == nil {
+		return nil, err
+	}
+	if !override.Expired(time.Now()) {
+		return override, nil
+	}
+
+	cleared, err := s.db.ClearBootOverride(machineID)
+	if err != nil {
+		return nil, err
+	}
+	if cleared {
+		reason := overrideExpired
+		if override.MaxBoots > 0 && override.BootsServed >= override.MaxBoots {
+			reason = overrideBootsUsed
+		}
+		s.publishBootOverrideCleared(ctx, machineID, reason)
+	}
+	return nil, nil
+}
+
+// countBootOverrideServe counts a boot the iPXE server served a machine's
+// override, and clears the override once it has been served its maximum
+// number of times
+func (s *Server) countBootOverrideServe(ctx context.Context, machineID string) {
+	override, err := s.db.CountBootOverrideServe(machineID)
+	if err != nil {
+		log.Printf("Failed to count boot override serve of machine %s: %v", machineID, err)
+		return
+	}
+	if override != nil {
+		if _, err := s.activeBootOverride(ctx, machineID); err != nil {
+			log.Printf("Failed to clear boot override of machine %s: %v", machineID, err)
+		}
+	}
+}
+
+// fillBootOverrideAssets looks up the assets an override refers to. An
+// asset that doesn't exist is left nil.
+func (s *Server) fillBootOverrideAssets(override *models.BootOverride) error {
+	for _, ref := range []struct {
+		id    string
+		asset **models.BootAsset
+	}{
+		{override.KernelAssetID, &override.Kernel},
+		{override.InitrdAssetID, &override.Initrd},
+		{override.ISOAssetID, &override.ISO},
+	} {
+		if ref.id == "" {
+			continue
+		}
+		asset, err := s.db.GetBootAsset(ref.id)
+		if err != nil {
+			return err
+		}
+		*ref.asset = asset
+	}
+	return nil
+}
+
+func (s *Server) publishBootOverrideCleared(ctx context.Context, machineID, reason string) {
+	log.Printf("Boot override of machine %s cleared (%s)", machineID, reason)
+	s.publish(ctx, events.Event{
+		Type:      events.MachineBootOverrideCleared,
+		MachineID: machineID,
+		Data:      events.BootOverrideClearedData{Reason: reason},
+	})
+}
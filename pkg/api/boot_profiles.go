@@ -0,0 +1,200 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleCreateBootProfile creates a boot profile
+func (s *Server) handleCreateBootProfile(w http.ResponseWriter, r *http.Request) {
+	var profile models.BootProfile
+	if !decodeJSON(w, r, &profile) {
+		return
+	}
+
+	if err := profile.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	existing, err := s.db.GetBootProfileByName(profile.Name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if existing != nil {
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "boot profile with this name already exists")
+		return
+	}
+
+	if !s.checkBootProfileGroups(w, "", profile.GroupIDs) {
+		return
+	}
+
+	if err := s.db.CreateBootProfile(&profile); err != nil {
+		respondInternalError(w, err, "failed to create boot profile")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, profile)
+}
+
+// handleListBootProfiles lists all boot profiles by name
+func (s *Server) handleListBootProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := s.db.ListBootProfiles()
+	if err != nil {
+		respondInternalError(w, err, "failed to list boot profiles")
+		return
+	}
+
+	if profiles == nil {
+		profiles = []*models.BootProfile{}
+	}
+
+	respondJSON(w, http.StatusOK, profiles)
+}
+
+// handleGetBootProfile retrieves a single boot profile
+func (s *Server) handleGetBootProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.bootProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, profile)
+}
+
+// handleUpdateBootProfile updates a boot profile. The iPXE server picks up
+// the change when its profile cache expires.
+func (s *Server) handleUpdateBootProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.bootProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	var updates models.UpdateBootProfileRequest
+	if !decodeJSON(w, r, &updates) {
+		return
+	}
+
+	if updates.Name != "" && updates.Name != profile.Name {
+		existing, err := s.db.GetBootProfileByName(updates.Name)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if existing != nil {
+			respondError(w, http.StatusConflict, CodeAlreadyExists, "boot profile with this name already exists")
+			return
+		}
+		profile.Name = updates.Name
+	}
+	if updates.Description != nil {
+		profile.Description = *updates.Description
+	}
+	if updates.KernelPath != "" {
+		profile.KernelPath = updates.KernelPath
+	}
+	if updates.InitrdPath != "" {
+		profile.InitrdPath = updates.InitrdPath
+	}
+	if updates.ExtraCmdline != nil {
+		profile.ExtraCmdline = *updates.ExtraCmdline
+	}
+	if updates.EnrollmentURL != nil {
+		profile.EnrollmentURL = *updates.EnrollmentURL
+	}
+	if updates.Subnets != nil {
+		profile.Subnets = *updates.Subnets
+	}
+	if updates.GroupIDs != nil {
+		profile.GroupIDs = *updates.GroupIDs
+	}
+
+	if err := profile.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if updates.GroupIDs != nil && !s.checkBootProfileGroups(w, profile.ID, profile.GroupIDs) {
+		return
+	}
+
+	if err := s.db.UpdateBootProfile(profile); err != nil {
+		respondInternalError(w, err, "failed to update boot profile")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, profile)
+}
+
+// handleDeleteBootProfile deletes a boot profile
+func (s *Server) handleDeleteBootProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.bootProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	if err := s.db.DeleteBootProfile(profile.ID); err != nil {
+		respondInternalError(w, err, "failed to delete boot profile")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bootProfile looks up the boot profile of a request. It responds with an
+// error and returns nil if there is no such profile.
+func (s *Server) bootProfile(w http.ResponseWriter, r *http.Request) *models.BootProfile {
+	profile, err := s.db.GetBootProfile(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if profile == nil {
+		respondError(w, http.StatusNotFound, CodeBootProfileNotFound, "boot profile not found")
+		return nil
+	}
+	return profile
+}
+
+// checkBootProfileGroups checks that the groups given to a profile exist
+// and have no other profile. It responds with an error and returns false
+// if not.
+func (s *Server) checkBootProfileGroups(w http.ResponseWriter, profileID string, groupIDs []string) bool {
+	seen := make(map[string]bool, len(groupIDs))
+	for _, id := range groupIDs {
+		if seen[id] {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("group %q is listed twice", id))
+			return false
+		}
+		seen[id] = true
+
+		group, err := s.db.GetGroup(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return false
+		}
+		if group == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("group %q not found", id))
+			return false
+		}
+	}
+
+	assigned, err := s.db.GroupBootProfiles(groupIDs)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return false
+	}
+	for _, id := range groupIDs {
+		if other, ok := assigned[id]; ok && other != profileID {
+			respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("group %q already has another boot profile", id))
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// handleListBootSigningKeys lists the keys the builder has signed boot
+// artifacts with, oldest first
+func (s *Server) handleListBootSigningKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.db.ListBootSigningKeys()
+	if err != nil {
+		respondInternalError(w, err, "failed to list boot signing keys")
+		return
+	}
+
+	if keys == nil {
+		keys = []*models.BootSigningKey{}
+	}
+
+	respondJSON(w, http.StatusOK, keys)
+}
+
+// handleBootSigningCertificates serves the certificates of every key the
+// builder has signed boot artifacts with as one PEM file, for embedding in
+// an iPXE build. Keys that have been rotated out stay in it, so artifacts
+// they signed keep booting.
+func (s *Server) handleBootSigningCertificates(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.db.ListBootSigningKeys()
+	if err != nil {
+		respondInternalError(w, err, "failed to list boot signing keys")
+		return
+	}
+	if len(keys) == 0 {
+		respondError(w, http.StatusNotFound, CodeNotFound, "no boot artifacts have been signed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	for _, key := range keys {
+		io.WriteString(w, key.Certificate)
+		if !strings.HasSuffix(key.Certificate, "\n") {
+			io.WriteString(w, "\n")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleApproveBuild queues a build awaiting approval
+func (s *Server) handleApproveBuild(w http.ResponseWriter, r *http.Request) {
+	build, err := s.service.ApproveBuild(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		respondServiceError(w, err, "failed to approve build")
+		return
+	}
+
+	s.setQueuePosition(build)
+	respondJSON(w, http.StatusOK, build)
+}
+
+// handleRejectBuild rejects a build awaiting approval. The optional body
+// gives the reason.
+func (s *Server) handleRejectBuild(w http.ResponseWriter, r *http.Request) {
+	var req models.BuildReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+
+	build, err := s.service.RejectBuild(r.Context(), mux.Vars(r)["id"], req.Reason)
+	if err != nil {
+		respondServiceError(w, err, "failed to reject build")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, build)
+}
+
+// isAdmin reports whether the request's user is an admin. Without
+// authentication everyone is.
+func (s *Server) isAdmin(r *http.Request) bool {
+	if !s.config.EnableAuth {
+		return true
+	}
+	claims, ok := auth.GetClaims(r)
+	return ok && claims.Role == models.RoleAdmin
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleListBuildArtifacts lists the files a build of an installer or
+// bundle produced, for download
+func (s *Server) handleListBuildArtifacts(w http.ResponseWriter, r *http.Request) {
+	build, dir := s.buildArtifactDir(w, r)
+	if build == nil {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		respondInternalError(w, err, "failed to list artifacts")
+		return
+	}
+
+	artifacts := []models.BuildArtifact{}
+	for _, entry := range entries {
+		if entry.Name() == models.BuildArtifactMarker || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			respondInternalError(w, err, "failed to list artifacts")
+			return
+		}
+		artifacts = append(artifacts, models.BuildArtifact{
+			Name:        entry.Name(),
+			Size:        info.Size(),
+			ContentType: models.ArtifactContentType(entry.Name()),
+			URL:         "/api/v1/builds/" + build.ID + "/artifacts/" + entry.Name(),
+		})
+	}
+
+	respondJSON(w, http.StatusOK, artifacts)
+}
+
+// handleDownloadBuildArtifact serves a file a build of an installer or
+// bundle produced. Range requests resume interrupted downloads of images.
+func (s *Server) handleDownloadBuildArtifact(w http.ResponseWriter, r *http.Request) {
+	build, dir := s.buildArtifactDir(w, r)
+	if build == nil {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if name == models.BuildArtifactMarker || name != filepath.Base(name) {
+		respondError(w, http.StatusNotFound, CodeArtifactNotFound, "artifact not found")
+		return
+	}
+
+	file, err := os.Open(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(w, http.StatusNotFound, CodeArtifactNotFound, "artifact not found")
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to open artifact")
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		respondInternalError(w, err, "failed to open artifact")
+		return
+	}
+
+	w.Header().Set("Content-Type", models.ArtifactContentType(name))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+build.ID+"/"+name+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// buildArtifactDir returns the build in the request and the directory of
+// its artifacts under the images directory, or responds with an error and
+// returns nil. Only builds of installers and bundles have artifacts to
+// download; the iPXE server serves netboot images. A later build of the
+// same target replaces a build's artifacts, which are then gone.
+func (s *Server) buildArtifactDir(w http.ResponseWriter, r *http.Request) (*models.BuildRequest, string) {
+	build, err := s.db.GetBuild(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil, ""
+	}
+	if build == nil {
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
+		return nil, ""
+	}
+	if build.BootsMachine() {
+		respondError(w, http.StatusNotFound, CodeArtifactNotFound, "netboot builds have no artifacts to download; the iPXE server serves their images")
+		return nil, ""
+	}
+	if build.Status != "success" || build.ArtifactURL == "" {
+		respondError(w, http.StatusNotFound, CodeArtifactNotFound, "build is "+build.Status+" and has no artifacts")
+		return nil, ""
+	}
+
+	// Single image targets' artifact URLs are the image's, and kexec
+	// bundles' the directory's
+	rel, ok := strings.CutPrefix(path.Clean(build.ArtifactURL), "/images/")
+	if !ok || strings.HasPrefix(rel, "../") {
+		respondError(w, http.StatusNotFound, CodeArtifactNotFound, "build has no artifacts")
+		return nil, ""
+	}
+	if build.Target != models.BuildTargetKexec {
+		rel = path.Dir(rel)
+	}
+	dir := filepath.Join(s.config.ImagesDir, filepath.FromSlash(rel))
+
+	marker, err := os.ReadFile(filepath.Join(dir, models.BuildArtifactMarker))
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(w, http.StatusNotFound, CodeArtifactNotFound, "build's artifacts are missing from the images directory")
+		return nil, ""
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to read artifacts")
+		return nil, ""
+	}
+	if strings.TrimSpace(string(marker)) != build.ID {
+		respondError(w, http.StatusGone, CodeArtifactNotFound, "a later "+build.Target+" build replaced the build's artifacts")
+		return nil, ""
+	}
+
+	return build, dir
+}
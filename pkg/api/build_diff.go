@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/drift"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleDiffBuilds shows what changes between two of a machine's builds.
+// to defaults to pending-config, the configuration the machine's next build
+// would use, and from to the successful build before to. The diff of the
+// closures is included when the builder recorded one between the two
+// builds.
+func (s *Server) handleDiffBuilds(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.db.GetMachine(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	query := r.URL.Query()
+	diff := &models.BuildDiff{From: query.Get("from"), To: query.Get("to")}
+	if diff.To == "" {
+		diff.To = models.BuildDiffPendingConfig
+	}
+
+	var to *models.BuildRequest
+	if diff.To != models.BuildDiffPendingConfig {
+		if to, err = s.db.GetBuild(diff.To); err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if to == nil || to.MachineID != machine.ID {
+			respondError(w, http.StatusNotFound, CodeBuildNotFound, "build to diff to not found")
+			return
+		}
+	}
+
+	// A build is diffed against the build before it by default, and the
+	// pending configuration against the latest successful build
+	if diff.From == "" {
+		diff.From, err = s.previousBuildID(machine, to)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+	}
+	from, err := s.db.GetBuild(diff.From)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if from == nil || from.MachineID != machine.ID {
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, "build to diff from not found")
+		return
+	}
+
+	toName, toConfig := diff.To, ""
+	if to == nil {
+		// Diffing doesn't need the builder to validate the configuration
+		toConfig, err = fragments.BuildConfig(r.Context(), s.db, nil, machine)
+		if err != nil {
+			respondServiceError(w, err, "failed to assemble configuration")
+			return
+		}
+	} else {
+		toName, toConfig = "build "+to.ID, to.Config
+		if to.ClosureDiffFrom == from.ID {
+			summary := models.SummarizeClosureDiff(to.ClosureDiff)
+			diff.ClosureDiff = to.ClosureDiff
+			diff.ClosureSummary = &summary
+		}
+	}
+
+	diff.ConfigDiff = drift.UnifiedDiff("build "+from.ID, toName, from.Config, toConfig)
+	respondJSON(w, http.StatusOK, diff)
+}
+
+// previousBuildID returns the ID of the machine's successful build before
+// build: the one the builder diffed its closure against, or else the latest
+// one that finished before it. With no build, it is the latest successful
+// build. It returns "" if there is none.
+func (s *Server) previousBuildID(machine *models.Machine, build *models.BuildRequest) (string, error) {
+	if build != nil && build.ClosureDiffFrom != "" {
+		return build.ClosureDiffFrom, nil
+	}
+
+	builds, err := s.db.ListBuilds(database.BuildFilter{MachineID: machine.ID, Status: "success"})
+	if err != nil {
+		return "", err
+	}
+	for _, b := range builds {
+		if build == nil {
+			return b.ID, nil
+		}
+		if b.ID != build.ID && b.CompletedAt != nil && build.CompletedAt != nil && b.CompletedAt.Before(*build.CompletedAt) {
+			return b.ID, nil
+		}
+	}
+	return "", nil
+}
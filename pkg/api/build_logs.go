@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// handleGetBuildLog streams a build's log as plain text. ?tail=N returns
+// only the last N lines. A log still stored inline in the build, as logs
+// were by older builders, is moved to log storage first.
+func (s *Server) handleGetBuildLog(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	build, err := s.db.GetBuild(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if build == nil {
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
+		return
+	}
+
+	s.respondBuildLog(w, r, id)
+}
+
+// respondBuildLog streams the log of the build with the given ID, which
+// exists, honoring ?tail=N
+func (s *Server) respondBuildLog(w http.ResponseWriter, r *http.Request, id string) {
+	tail := 0
+	if v := r.URL.Query().Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "tail must be a positive number of lines")
+			return
+		}
+		tail = n
+	}
+
+	if _, err := s.db.MigrateBuildLog(id, s.config.MaxBuildLogBytes); err != nil {
+		respondInternalError(w, err, "failed to migrate build log")
+		return
+	}
+
+	logReader, err := s.db.OpenBuildLog(id)
+	if err != nil {
+		respondInternalError(w, err, "failed to open build log")
+		return
+	}
+	if logReader == nil {
+		respondError(w, http.StatusNotFound, CodeBuildLogNotFound, "build has no log")
+		return
+	}
+	defer logReader.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if tail > 0 {
+		err = writeTail(w, logReader, tail)
+	} else {
+		_, err = io.Copy(w, logReader)
+	}
+	if err != nil {
+		// The status is already sent, so all that's left is to log it
+		log.Printf("Failed to stream log of build %s: %v", id, err)
+	}
+}
+
+// writeTail writes the last n lines read from r to w
+func writeTail(w io.Writer, r io.Reader, n int) error {
+	lines := make([]string, 0, min(n, 1024))
+	next := 0
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if len(lines) < n {
+				lines = append(lines, line)
+			} else {
+				lines[next] = line
+				next = (next + 1) % n
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range lines {
+		if _, err := io.WriteString(w, lines[(next+i)%len(lines)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
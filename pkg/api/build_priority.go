@@ -0,0 +1,95 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleSetBuildPriority moves a pending build up or down the queue
+func (s *Server) handleSetBuildPriority(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var req models.BuildPriorityRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !s.checkBuildPriority(w, r, req.Priority) {
+		return
+	}
+
+	build, err := s.db.GetBuild(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if build == nil {
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
+		return
+	}
+
+	updated, err := s.db.SetBuildPriority(build.ID, req.Priority)
+	if err != nil {
+		respondInternalError(w, err, "failed to set build priority")
+		return
+	}
+	if !updated {
+		respondError(w, http.StatusConflict, CodeConflict, "only queued builds can be reprioritized; build is "+build.Status)
+		return
+	}
+
+	oldPriority := build.Priority
+	build.Priority = req.Priority
+
+	log.Printf("Build %s priority changed from %s to %s", build.ID, oldPriority, build.Priority)
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineBuildPriorityChanged,
+		MachineID: build.MachineID,
+		Data: events.BuildPriorityChangedData{
+			BuildID:     build.ID,
+			Priority:    build.Priority,
+			OldPriority: oldPriority,
+		},
+	})
+
+	s.setQueuePosition(build)
+	respondJSON(w, http.StatusOK, build)
+}
+
+// checkBuildPriority responds with an error and returns false if priority
+// is not a build priority, or is urgent and the user is not an admin
+func (s *Server) checkBuildPriority(w http.ResponseWriter, r *http.Request, priority string) bool {
+	if !models.IsValidBuildPriority(priority) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "priority must be urgent, high, normal, or low")
+		return false
+	}
+
+	if priority == models.BuildPriorityUrgent && s.config.EnableAuth {
+		claims, ok := auth.GetClaims(r)
+		if !ok || claims.Role != models.RoleAdmin {
+			respondError(w, http.StatusForbidden, CodeForbidden, "only admins can queue urgent builds")
+			return false
+		}
+	}
+
+	return true
+}
+
+// setQueuePosition fills in where a pending build is in the queue
+func (s *Server) setQueuePosition(build *models.BuildRequest) {
+	if build.Status != "pending" {
+		return
+	}
+
+	position, err := s.db.BuildQueuePosition(build)
+	if err != nil {
+		log.Printf("Failed to get queue position of build %s: %v", build.ID, err)
+		return
+	}
+	build.QueuePosition = position
+}
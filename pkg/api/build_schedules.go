@@ -0,0 +1,565 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/maintenance"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/gorilla/mux"
+)
+
+// buildSchedulerTick is how often build schedules are checked for a run
+// that is due. A run that is due starts up to a tick late, so it doesn't
+// count toward its grace period.
+const buildSchedulerTick = time.Minute
+
+// defaultScheduleRunsShown is how many runs the run history lists without
+// a limit
+const defaultScheduleRunsShown = 50
+
+func (s *Server) handleGetMachineSchedule(w http.ResponseWriter, r *http.Request) {
+	s.getBuildSchedule(w, r, models.BuildScheduleScopeMachine)
+}
+
+func (s *Server) handleSetMachineSchedule(w http.ResponseWriter, r *http.Request) {
+	s.setBuildSchedule(w, r, models.BuildScheduleScopeMachine)
+}
+
+func (s *Server) handleDeleteMachineSchedule(w http.ResponseWriter, r *http.Request) {
+	s.deleteBuildSchedule(w, r, models.BuildScheduleScopeMachine)
+}
+
+func (s *Server) handleListMachineScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	s.listBuildScheduleRuns(w, r, models.BuildScheduleScopeMachine)
+}
+
+func (s *Server) handleGetGroupSchedule(w http.ResponseWriter, r *http.Request) {
+	s.getBuildSchedule(w, r, models.BuildScheduleScopeGroup)
+}
+
+func (s *Server) handleSetGroupSchedule(w http.ResponseWriter, r *http.Request) {
+	s.setBuildSchedule(w, r, models.BuildScheduleScopeGroup)
+}
+
+func (s *Server) handleDeleteGroupSchedule(w http.ResponseWriter, r *http.Request) {
+	s.deleteBuildSchedule(w, r, models.BuildScheduleScopeGroup)
+}
+
+func (s *Server) handleListGroupScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	s.listBuildScheduleRuns(w, r, models.BuildScheduleScopeGroup)
+}
+
+// handleListBuildSchedules lists every machine's and group's build
+// schedule, soonest next run first
+func (s *Server) handleListBuildSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules, err := s.db.ListBuildSchedules()
+	if err != nil {
+		respondInternalError(w, err, "failed to list build schedules")
+		return
+	}
+
+	if schedules == nil {
+		schedules = []*models.BuildSchedule{}
+	}
+
+	respondJSON(w, http.StatusOK, schedules)
+}
+
+// setBuildSchedule creates a machine's or group's build schedule, or
+// replaces the one it has. The cron expression is checked here so that a
+// schedule that can never run isn't saved.
+func (s *Server) setBuildSchedule(w http.ResponseWriter, r *http.Request, scope string) {
+	id := mux.Vars(r)["id"]
+
+	var req models.BuildScheduleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	schedule := &models.BuildSchedule{
+		Scope:         scope,
+		ScopeID:       id,
+		Cron:          req.Cron,
+		Timezone:      req.Timezone,
+		Mode:          req.Mode,
+		SkipUnchanged: req.SkipUnchanged,
+		GraceMinutes:  models.DefaultScheduleGraceMinutes,
+		Enabled:       true,
+	}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	if schedule.Mode == "" {
+		schedule.Mode = models.BuildScheduleRebuild
+	}
+	if req.GraceMinutes != nil {
+		schedule.GraceMinutes = *req.GraceMinutes
+	}
+	if req.Enabled != nil {
+		schedule.Enabled = *req.Enabled
+	}
+
+	switch {
+	case schedule.Cron == "":
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "cron is required")
+		return
+	case schedule.Mode != models.BuildScheduleRebuild && schedule.Mode != models.BuildScheduleRebuildReboot:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "mode must be rebuild or rebuild_reboot")
+		return
+	case schedule.GraceMinutes < 0:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "grace_minutes must not be negative")
+		return
+	}
+	if _, err := maintenance.ParseSchedule(schedule.Cron); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid cron: %v", err))
+		return
+	}
+	if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid timezone: %v", err))
+		return
+	}
+
+	switch scope {
+	case models.BuildScheduleScopeMachine:
+		machine, err := s.db.GetMachine(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if machine == nil {
+			respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+			return
+		}
+		if schedule.Mode == models.BuildScheduleRebuildReboot && (machine.BMCInfo == nil || !machine.BMCInfo.Enabled) {
+			respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "rebuild_reboot needs the machine's BMC")
+			return
+		}
+	case models.BuildScheduleScopeGroup:
+		group, err := s.db.GetGroup(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if group == nil {
+			respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+			return
+		}
+	}
+
+	if schedule.Enabled {
+		schedule.NextRunAt = nextScheduledRun(schedule, time.Now())
+	}
+
+	existing, err := s.db.GetBuildScheduleFor(scope, id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	status := http.StatusCreated
+	if existing != nil {
+		schedule.ID = existing.ID
+		schedule.LastRunAt = existing.LastRunAt
+		schedule.CreatedBy = existing.CreatedBy
+		schedule.CreatedAt = existing.CreatedAt
+		err = s.db.UpdateBuildSchedule(schedule)
+		status = http.StatusOK
+	} else {
+		if claims, ok := auth.GetClaims(r); ok {
+			schedule.CreatedBy = claims.Username
+		}
+		err = s.db.CreateBuildSchedule(schedule)
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to save build schedule")
+		return
+	}
+
+	log.Printf("Build schedule %s of %s %s set to %q (%s, %s)", schedule.ID, scope, id, schedule.Cron, schedule.Timezone, schedule.Mode)
+	respondJSON(w, status, schedule)
+}
+
+func (s *Server) getBuildSchedule(w http.ResponseWriter, r *http.Request, scope string) {
+	schedule := s.scopeBuildSchedule(w, r, scope)
+	if schedule == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, schedule)
+}
+
+func (s *Server) deleteBuildSchedule(w http.ResponseWriter, r *http.Request, scope string) {
+	schedule := s.scopeBuildSchedule(w, r, scope)
+	if schedule == nil {
+		return
+	}
+
+	if err := s.db.DeleteBuildSchedule(schedule.ID); err != nil {
+		respondInternalError(w, err, "failed to delete build schedule")
+		return
+	}
+
+	log.Printf("Build schedule %s of %s %s deleted", schedule.ID, scope, schedule.ScopeID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listBuildScheduleRuns lists what a schedule's runs did, newest first
+func (s *Server) listBuildScheduleRuns(w http.ResponseWriter, r *http.Request, scope string) {
+	limit := defaultScheduleRunsShown
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	schedule := s.scopeBuildSchedule(w, r, scope)
+	if schedule == nil {
+		return
+	}
+
+	runs, err := s.db.ListBuildScheduleRuns(schedule.ID, limit)
+	if err != nil {
+		respondInternalError(w, err, "failed to list build schedule runs")
+		return
+	}
+
+	if runs == nil {
+		runs = []*models.BuildScheduleRun{}
+	}
+
+	respondJSON(w, http.StatusOK, runs)
+}
+
+// scopeBuildSchedule looks up the schedule of the machine or group in the
+// request, responding with an error and returning nil if it has none
+func (s *Server) scopeBuildSchedule(w http.ResponseWriter, r *http.Request, scope string) *models.BuildSchedule {
+	schedule, err := s.db.GetBuildScheduleFor(scope, mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if schedule == nil {
+		respondError(w, http.StatusNotFound, CodeBuildScheduleNotFound, fmt.Sprintf("%s has no build schedule", scope))
+		return nil
+	}
+	return schedule
+}
+
+// nextScheduledRun returns when a schedule is next due after after, in
+// UTC, or nil if its cron expression never matches again. The expression
+// is evaluated in the schedule's time zone so that it follows local wall
+// clock time across DST changes.
+func nextScheduledRun(schedule *models.BuildSchedule, after time.Time) *time.Time {
+	cron, err := maintenance.ParseSchedule(schedule.Cron)
+	if err != nil {
+		return nil
+	}
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	next := cron.Next(after.In(location))
+	if next.IsZero() {
+		return nil
+	}
+	next = next.UTC()
+	return &next
+}
+
+// StartBuildScheduler runs build schedules when they are due and power
+// cycles machines rebuilt by rebuild_reboot schedules once a maintenance
+// window allows it. The first pass runs at startup, so a run missed while
+// the server was down happens then if it is still within its grace period.
+func (s *Server) StartBuildScheduler() {
+	go func() {
+		log.Printf("Build scheduler started")
+
+		ticker := time.NewTicker(buildSchedulerTick)
+		defer ticker.Stop()
+
+		for {
+			if s.leadJob("build-scheduler", buildSchedulerTick) {
+				s.runBuildSchedules(time.Now())
+				s.followScheduledRuns()
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// runBuildSchedules runs every schedule that is due
+func (s *Server) runBuildSchedules(now time.Time) {
+	schedules, err := s.db.ListDueBuildSchedules(now)
+	if err != nil {
+		log.Printf("Build scheduler failed to list due schedules: %v", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		s.runBuildSchedule(schedule, now)
+	}
+}
+
+// runBuildSchedule runs a schedule once for the time it was due. The
+// schedule moves on to its next run first, so however many runs were
+// missed while the server was down, at most one happens.
+func (s *Server) runBuildSchedule(schedule *models.BuildSchedule, now time.Time) {
+	dueAt := *schedule.NextRunAt
+
+	advanced, err := s.db.AdvanceBuildSchedule(schedule.ID, dueAt, nextScheduledRun(schedule, now), now)
+	if err != nil {
+		log.Printf("Build scheduler failed to advance schedule %s: %v", schedule.ID, err)
+		return
+	}
+	if !advanced {
+		return
+	}
+
+	grace := time.Duration(schedule.GraceMinutes)*time.Minute + buildSchedulerTick
+	if late := now.Sub(dueAt); late > grace {
+		log.Printf("Build schedule %s missed its run at %s by %s, skipping it", schedule.ID, dueAt.Format(time.RFC3339), late.Round(time.Minute))
+		s.recordScheduleRun(&models.BuildScheduleRun{
+			ScheduleID:   schedule.ID,
+			ScheduledFor: dueAt,
+			Status:       models.ScheduleRunSkipped,
+			Reason:       fmt.Sprintf("missed by %s, more than the %d minute grace period", late.Round(time.Minute), schedule.GraceMinutes),
+		})
+		return
+	}
+
+	machines, err := s.scheduleMachines(schedule)
+	if err != nil {
+		log.Printf("Build schedule %s failed to run: %v", schedule.ID, err)
+		s.recordScheduleRun(&models.BuildScheduleRun{
+			ScheduleID:   schedule.ID,
+			ScheduledFor: dueAt,
+			Status:       models.ScheduleRunFailed,
+			Reason:       err.Error(),
+		})
+		return
+	}
+
+	log.Printf("Build schedule %s of %s %s running for %d machine(s)", schedule.ID, schedule.Scope, schedule.ScopeID, len(machines))
+	for _, machine := range machines {
+		s.runScheduledBuild(schedule, dueAt, machine)
+	}
+}
+
+// scheduleMachines returns the machines a schedule rebuilds
+func (s *Server) scheduleMachines(schedule *models.BuildSchedule) ([]*models.Machine, error) {
+	if schedule.Scope == models.BuildScheduleScopeMachine {
+		machine, err := s.db.GetMachine(schedule.ScopeID)
+		if err != nil {
+			return nil, err
+		}
+		if machine == nil {
+			return nil, fmt.Errorf("machine no longer exists")
+		}
+		return []*models.Machine{machine}, nil
+	}
+
+	group, err := s.db.GetGroup(schedule.ScopeID)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, fmt.Errorf("group no longer exists")
+	}
+
+	members, err := s.db.GetGroupMachines(group.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Members are loaded again in full, as the build needs all of them
+	machines := make([]*models.Machine, 0, len(members))
+	for _, member := range members {
+		machine, err := s.db.GetMachine(member.ID)
+		if err != nil {
+			return nil, err
+		}
+		if machine != nil {
+			machines = append(machines, machine)
+		}
+	}
+	return machines, nil
+}
+
+// runScheduledBuild queues a scheduled build of one machine, recording a
+// run whether or not it did
+func (s *Server) runScheduledBuild(schedule *models.BuildSchedule, dueAt time.Time, machine *models.Machine) {
+	ctx := context.Background()
+	run := &models.BuildScheduleRun{
+		ScheduleID:   schedule.ID,
+		MachineID:    machine.ID,
+		ScheduledFor: dueAt,
+	}
+	reboot := schedule.Mode == models.BuildScheduleRebuildReboot
+
+	switch {
+	case machine.Status == models.StatusBuilding:
+		run.Status = models.ScheduleRunSkipped
+		run.Reason = "machine is already building"
+	case !machine.CanProvision():
+		run.Status = models.ScheduleRunSkipped
+		run.Reason = fmt.Sprintf("machine is %s", machine.Status)
+	case reboot && (machine.BMCInfo == nil || !machine.BMCInfo.Enabled):
+		run.Status = models.ScheduleRunFailed
+		run.Reason = "rebuild_reboot needs the machine's BMC"
+	case schedule.SkipUnchanged:
+		changed, err := s.service.ConfigChanged(ctx, machine)
+		if err != nil {
+			run.Status = models.ScheduleRunFailed
+			run.Reason = fmt.Sprintf("failed to compare configuration: %v", err)
+		} else if !changed {
+			run.Status = models.ScheduleRunSkipped
+			run.Reason = "configuration unchanged since the last successful build"
+		}
+	}
+
+	if run.Status == "" {
+		actor := schedule.CreatedBy
+		if actor == "" {
+			actor = "schedule"
+		}
+
+		build, err := s.service.TriggerBuild(ctx, machine.ID, service.BuildOptions{Actor: actor, Bulk: true})
+		var blocked *service.MaintenanceError
+		switch {
+		case errors.As(err, &blocked):
+			run.Status = models.ScheduleRunSkipped
+			run.Reason = err.Error()
+		case err != nil:
+			run.Status = models.ScheduleRunFailed
+			run.Reason = err.Error()
+		case reboot:
+			run.Status = models.ScheduleRunBuilding
+			run.BuildID = build.ID
+		default:
+			run.Status = models.ScheduleRunQueued
+			run.BuildID = build.ID
+		}
+	}
+
+	if !s.recordScheduleRun(run) {
+		return
+	}
+	if run.BuildID == "" {
+		log.Printf("Build schedule %s %s machine %s: %s", schedule.ID, run.Status, machine.ID, run.Reason)
+		return
+	}
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineScheduledBuildStarted,
+		MachineID: machine.ID,
+		Data: events.ScheduledBuildStartedData{
+			ScheduleID:   schedule.ID,
+			BuildID:      run.BuildID,
+			ScheduledFor: dueAt,
+			Mode:         schedule.Mode,
+		},
+	})
+}
+
+// recordScheduleRun stores a new run, completing it if nothing more will
+// happen for it
+func (s *Server) recordScheduleRun(run *models.BuildScheduleRun) bool {
+	if run.IsDone() {
+		now := time.Now()
+		run.CompletedAt = &now
+	}
+
+	if err := s.db.CreateBuildScheduleRun(run); err != nil {
+		log.Printf("Failed to record run of build schedule %s: %v", run.ScheduleID, err)
+		return false
+	}
+	return true
+}
+
+// followScheduledRuns moves rebuild_reboot runs along: a run whose build
+// succeeded waits for a maintenance window that allows power operations,
+// then power cycles its machine into the new build
+func (s *Server) followScheduledRuns() {
+	runs, err := s.db.ListActiveBuildScheduleRuns()
+	if err != nil {
+		log.Printf("Build scheduler failed to list active runs: %v", err)
+		return
+	}
+
+	for _, run := range runs {
+		if s.advanceScheduledRun(run) {
+			if run.IsDone() {
+				now := time.Now()
+				run.CompletedAt = &now
+			}
+			if err := s.db.UpdateBuildScheduleRun(run); err != nil {
+				log.Printf("Failed to update build schedule run %s: %v", run.ID, err)
+			}
+		}
+	}
+}
+
+// advanceScheduledRun moves a run on if it can, reporting whether it changed
+func (s *Server) advanceScheduledRun(run *models.BuildScheduleRun) bool {
+	changed := false
+
+	if run.Status == models.ScheduleRunBuilding {
+		build, err := s.db.GetBuild(run.BuildID)
+		if err != nil {
+			log.Printf("Build scheduler failed to get build %s: %v", run.BuildID, err)
+			return false
+		}
+		if build == nil {
+			run.Status = models.ScheduleRunFailed
+			run.Reason = "build no longer exists"
+			return true
+		}
+
+		switch build.Status {
+		case models.BuildStatusAwaitingApproval, "pending", "unschedulable", "building":
+			return false
+		case "success":
+			run.Status = models.ScheduleRunWaiting
+			changed = true
+		default:
+			run.Status = models.ScheduleRunFailed
+			run.Reason = fmt.Sprintf("build %s", build.Status)
+			if build.Error != "" {
+				run.Reason += ": " + build.Error
+			}
+			return true
+		}
+	}
+
+	err := s.service.CheckMaintenance(context.Background(), []string{run.MachineID}, models.MaintenanceOpPower, false)
+	if err != nil {
+		var blocked *service.MaintenanceError
+		if !errors.As(err, &blocked) {
+			log.Printf("Build scheduler failed to check maintenance windows of machine %s: %v", run.MachineID, err)
+		}
+		return changed
+	}
+
+	if err := s.powerCycleBuiltMachine(run.MachineID, "schedule"); err != nil {
+		run.Status = models.ScheduleRunFailed
+		run.Reason = fmt.Sprintf("power cycle failed: %v", err)
+		return true
+	}
+
+	log.Printf("Build schedule %s power cycled machine %s into build %s", run.ScheduleID, run.MachineID, run.BuildID)
+	run.Status = models.ScheduleRunRebooted
+	return true
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// buildLeaseWatchdogTick is how often builds are checked for a lease
+// that has run out
+const buildLeaseWatchdogTick = 30 * time.Second
+
+// handleClaimBuild claims the next queued build for a builder, waiting up
+// to wait seconds for one to be queued. The response is the build with
+// what the builder needs to run it, or 204 No Content if nothing was
+// queued in time. Machine builds come with the machine's hooks token, for
+// the builder to put in the image.
+func (s *Server) handleClaimBuild(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	builder := query.Get("builder")
+	if builder == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "builder is required")
+		return
+	}
+
+	var wait time.Duration
+	if raw := query.Get("wait"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "wait must be a number of seconds")
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	job, err := s.service.ClaimBuild(r.Context(), builder, wait)
+	if err != nil {
+		respondServiceError(w, err, "failed to claim build")
+		return
+	}
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if job.Machine != nil {
+		job.MachineToken = s.jwtManager.GenerateHooksToken(job.Machine.ID)
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// handleBuildProgress renews a builder's lease on a build it is running,
+// recording what it reports. A 409 tells the builder the build is no
+// longer its own.
+func (s *Server) handleBuildProgress(w http.ResponseWriter, r *http.Request) {
+	var progress models.BuildProgress
+	if !decodeJSON(w, r, &progress) {
+		return
+	}
+	if progress.Builder == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "builder is required")
+		return
+	}
+
+	if err := s.service.RecordBuildProgress(r.Context(), mux.Vars(r)["id"], progress); err != nil {
+		respondServiceError(w, err, "failed to record build progress")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCompleteBuild records how a build ended. Reporting the same result
+// again is acknowledged the same way, so a builder can retry until it
+// hears back.
+func (s *Server) handleCompleteBuild(w http.ResponseWriter, r *http.Request) {
+	var result models.BuildResult
+	if !decodeJSON(w, r, &result) {
+		return
+	}
+	if result.Builder == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "builder is required")
+		return
+	}
+
+	build, err := s.service.CompleteBuild(r.Context(), mux.Vars(r)["id"], result)
+	if err != nil {
+		respondServiceError(w, err, "failed to complete build")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, build)
+}
+
+// StartBuildLeaseWatchdog puts builds back in the queue when the builder
+// running them stops renewing their lease
+func (s *Server) StartBuildLeaseWatchdog() {
+	go func() {
+		log.Printf("Build lease watchdog started")
+
+		ticker := time.NewTicker(buildLeaseWatchdogTick)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !s.leadJob("build-lease-watchdog", buildLeaseWatchdogTick) {
+				continue
+			}
+
+			if err := s.service.ExpireBuildLeases(context.Background()); err != nil {
+				log.Printf("Build lease watchdog failed: %v", err)
+			}
+		}
+	}()
+}
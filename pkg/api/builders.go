@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// unschedulableCheckTick is how often pending builds are checked for a
+// builder that can run them
+const unschedulableCheckTick = time.Minute
+
+// handleListBuilders lists the builders that have registered, with the
+// toolchain and capabilities each last reported, whether it is still
+// sending heartbeats, and how many queued builds it could claim
+func (s *Server) handleListBuilders(w http.ResponseWriter, r *http.Request) {
+	builders, err := s.db.ListBuilders()
+	if err != nil {
+		respondInternalError(w, err, "failed to list builders")
+		return
+	}
+	if builders == nil {
+		builders = []*models.Builder{}
+	}
+
+	queued, err := s.db.ListQueuedBuilds()
+	if err != nil {
+		respondInternalError(w, err, "failed to list queued builds")
+		return
+	}
+	for _, builder := range builders {
+		for _, build := range queued {
+			if builder.CanBuild(build.BuildRequirements) {
+				builder.QueueDepth++
+			}
+		}
+	}
+
+	respondJSON(w, http.StatusOK, builders)
+}
+
+// handleRegisterBuilder registers a builder with its capabilities and
+// health. Builders register again every heartbeat interval to stay online;
+// a registration never changes whether the builder is cordoned. The
+// response is the builder as recorded, with any garbage collection an
+// admin asked of it.
+func (s *Server) handleRegisterBuilder(w http.ResponseWriter, r *http.Request) {
+	var req models.RegisterBuilderRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	builder, err := s.service.RegisterBuilder(r.Context(), req)
+	if err != nil {
+		respondServiceError(w, err, "failed to register builder")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, builder)
+}
+
+// handleBuilderGC asks a builder to run nix-collect-garbage, optionally
+// freeing at most max_freed_bytes. The builder picks the request up from
+// its next heartbeat and runs it once it has no build running; the result
+// is reported in its health and as builder.gc_completed.
+func (s *Server) handleBuilderGC(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxFreedBytes int64 `json:"max_freed_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+	if req.MaxFreedBytes < 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "max_freed_bytes must not be negative")
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	gc := &models.BuilderGCRequest{
+		ID:            uuid.New().String(),
+		MaxFreedBytes: req.MaxFreedBytes,
+		RequestedAt:   time.Now(),
+	}
+	if claims, ok := auth.GetClaims(r); ok {
+		gc.RequestedBy = claims.Username
+	}
+
+	found, err := s.db.RequestBuilderGC(name, gc)
+	if err != nil {
+		respondInternalError(w, err, "failed to request garbage collection")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, CodeBuilderNotFound, "builder not found")
+		return
+	}
+
+	builder, err := s.db.GetBuilder(name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	log.Printf("Garbage collection requested on builder %s", name)
+	respondJSON(w, http.StatusAccepted, builder)
+}
+
+// handleCordonBuilder stops a builder claiming new builds, e.g. before
+// maintenance. Builds it is running carry on.
+func (s *Server) handleCordonBuilder(w http.ResponseWriter, r *http.Request) {
+	s.setBuilderCordoned(w, mux.Vars(r)["name"], true)
+}
+
+// handleUncordonBuilder lets a cordoned builder claim builds again
+func (s *Server) handleUncordonBuilder(w http.ResponseWriter, r *http.Request) {
+	s.setBuilderCordoned(w, mux.Vars(r)["name"], false)
+}
+
+func (s *Server) setBuilderCordoned(w http.ResponseWriter, name string, cordoned bool) {
+	found, err := s.db.SetBuilderCordoned(name, cordoned)
+	if err != nil {
+		respondInternalError(w, err, "failed to update builder")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, CodeBuilderNotFound, "builder not found")
+		return
+	}
+
+	builder, err := s.db.GetBuilder(name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	log.Printf("Builder %s cordoned: %t", name, cordoned)
+	respondJSON(w, http.StatusOK, builder)
+}
+
+// StartUnschedulableCheck marks builds unschedulable once they have been
+// pending for longer than timeout with no online, uncordoned builder able
+// to run them. They stay queued: any builder that can run one claims it,
+// and they go back to pending once such a builder is available.
+func (s *Server) StartUnschedulableCheck(timeout time.Duration) {
+	go func() {
+		log.Printf("Unschedulable build check started (timeout: %s)", timeout)
+
+		ticker := time.NewTicker(unschedulableCheckTick)
+		defer ticker.Stop()
+
+		for {
+			if s.leadJob("unschedulable-check", unschedulableCheckTick) {
+				s.checkUnschedulable(timeout)
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// checkUnschedulable marks builds pending for longer than timeout that no
+// available builder can run as unschedulable, and unschedulable builds
+// that one now can run as pending again
+func (s *Server) checkUnschedulable(timeout time.Duration) {
+	builders, err := s.db.ListBuilders()
+	if err != nil {
+		log.Printf("Unschedulable build check failed: %v", err)
+		return
+	}
+	queued, err := s.db.ListQueuedBuilds()
+	if err != nil {
+		log.Printf("Unschedulable build check failed: %v", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-timeout)
+	for _, build := range queued {
+		canRun := schedulable(builders, build)
+
+		if build.Status == "unschedulable" && canRun {
+			if _, err := s.db.SetBuildUnschedulable(build.ID, false); err != nil {
+				log.Printf("Failed to requeue build %s: %v", build.ID, err)
+			}
+			continue
+		}
+		if build.Status != "pending" || canRun || build.CreatedAt.After(cutoff) {
+			continue
+		}
+
+		marked, err := s.db.SetBuildUnschedulable(build.ID, true)
+		if err != nil {
+			log.Printf("Failed to mark build %s unschedulable: %v", build.ID, err)
+			continue
+		}
+		if !marked {
+			continue
+		}
+
+		log.Printf("Build %s is unschedulable: no builder for architecture %q with labels %v",
+			build.ID, build.Architecture, build.RequiredLabels)
+		s.publish(context.Background(), events.Event{
+			Type:      events.MachineBuildUnschedulable,
+			MachineID: build.MachineID,
+			Data: events.BuildUnschedulableData{
+				BuildID:        build.ID,
+				Architecture:   build.Architecture,
+				RequiredLabels: build.RequiredLabels,
+			},
+		})
+	}
+}
+
+// schedulable reports whether an online, uncordoned builder can run build
+func schedulable(builders []*models.Builder, build *models.BuildRequest) bool {
+	for _, builder := range builders {
+		if builder.Online && !builder.Cordoned && builder.CanBuild(build.BuildRequirements) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,25 +1,30 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
 )
 
 // handleBulkOperation handles bulk operations on machines
 func (s *Server) handleBulkOperation(w http.ResponseWriter, r *http.Request) {
 	var req models.BulkOperationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate operation type
 	if req.Operation == "" {
-		respondError(w, http.StatusBadRequest, "operation is required")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "operation is required")
 		return
 	}
 
@@ -29,8 +34,7 @@ func (s *Server) handleBulkOperation(w http.ResponseWriter, r *http.Request) {
 		// Get machines from group
 		machines, err := s.db.GetGroupMachines(req.GroupID)
 		if err != nil {
-			log.Printf("Failed to get group machines: %v", err)
-			respondError(w, http.StatusInternalServerError, "failed to get group machines")
+			respondInternalError(w, err, "failed to get group machines")
 			return
 		}
 		for _, m := range machines {
@@ -39,54 +43,136 @@ func (s *Server) handleBulkOperation(w http.ResponseWriter, r *http.Request) {
 	} else if len(req.MachineIDs) > 0 {
 		machineIDs = req.MachineIDs
 	} else {
-		respondError(w, http.StatusBadRequest, "either machine_ids or group_id is required")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "either machine_ids or group_id is required")
 		return
 	}
 
 	if len(machineIDs) == 0 {
-		respondError(w, http.StatusBadRequest, "no machines to operate on")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "no machines to operate on")
 		return
 	}
 
+	if (req.DryRun || req.ConfirmationToken != "") && req.Operation != "update" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "dry_run and confirmation_token are only supported for update")
+		return
+	}
+
+	// Builds and deletes are subject to maintenance windows for every
+	// machine in the request
+	switch req.Operation {
+	case "build":
+		if !s.checkMaintenance(w, r, machineIDs, models.MaintenanceOpBuild) {
+			return
+		}
+	case "delete":
+		if !s.checkMaintenance(w, r, machineIDs, models.MaintenanceOpDelete) {
+			return
+		}
+	}
+
 	// Execute the operation
 	var result models.BulkOperationResult
 	result.TotalCount = len(machineIDs)
 
 	switch req.Operation {
 	case "update":
-		result = s.bulkUpdate(machineIDs, req.Data)
+		tags, err := parseBulkTagChange(req.Data)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		ownership, err := parseBulkOwnership(req.Data)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		// Hostnames are unique, so only one machine can get a given one
+		if hostname, _ := req.Data["hostname"].(string); hostname != "" && len(machineIDs) > 1 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest,
+				"hostname can only be set on one machine at a time, since hostnames are unique")
+			return
+		}
+		dataHash, err := bulkDataHash(req.Data)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if req.DryRun {
+			result = s.bulkUpdate(r.Context(), machineIDs, req.Data, tags, ownership, true)
+			result.ConfirmationToken = s.jwtManager.GenerateBulkToken(req.Operation, machineIDs, dataHash)
+			break
+		}
+		if !s.checkBulkConfirmation(w, &req, machineIDs, dataHash) {
+			return
+		}
+		result = s.bulkUpdate(r.Context(), machineIDs, req.Data, tags, ownership, false)
 	case "build":
-		result = s.bulkBuild(machineIDs)
+		var priority string
+		if v, ok := req.Data["priority"]; ok {
+			if priority, ok = v.(string); !ok {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest, "priority must be a string")
+				return
+			}
+		}
+		if priority != "" && !s.checkBuildPriority(w, r, priority) {
+			return
+		}
+		// Each build counts against the user's quota as it is queued, so
+		// a bulk build the quota can't cover is refused before any start
+		if !s.checkQuota(w, r, models.QuotaBuilds, len(machineIDs)) {
+			return
+		}
+		result = s.bulkBuild(r.Context(), machineIDs, priority)
 	case "delete":
-		result = s.bulkDelete(machineIDs)
+		result = s.bulkDelete(r.Context(), machineIDs)
+	case "rotate_bmc":
+		concurrency := s.config.BMCPollConcurrency
+		if v, ok := req.Data["concurrency"]; ok {
+			n, ok := v.(float64)
+			if !ok || n != float64(int(n)) || n < 1 || n > maxBulkRotationConcurrency {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest,
+					fmt.Sprintf("concurrency must be a whole number between 1 and %d", maxBulkRotationConcurrency))
+				return
+			}
+			concurrency = int(n)
+		}
+		userID := "system"
+		if claims, ok := auth.GetClaims(r); ok {
+			userID = claims.UserID
+		}
+		result = s.bulkRotateBMC(machineIDs, concurrency, userID)
 	default:
-		respondError(w, http.StatusBadRequest, "invalid operation")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid operation")
 		return
 	}
 
-	log.Printf("Bulk operation %s: %d/%d succeeded", req.Operation, result.SuccessCount, result.TotalCount)
+	if result.DryRun {
+		log.Printf("Bulk operation %s (dry run): %d/%d would succeed", req.Operation, result.SuccessCount, result.TotalCount)
+	} else {
+		log.Printf("Bulk operation %s: %d/%d succeeded", req.Operation, result.SuccessCount, result.TotalCount)
+	}
 	respondJSON(w, http.StatusOK, result)
 }
 
-// bulkUpdate updates multiple machines
-func (s *Server) bulkUpdate(machineIDs []string, data map[string]interface{}) models.BulkOperationResult {
+// bulkUpdate updates multiple machines, reporting the fields it changed on
+// each. With dryRun, nothing is saved, and the report is of what would
+// change. A non-nil ownership replaces theirs, and an empty one removes it.
+func (s *Server) bulkUpdate(ctx context.Context, machineIDs []string, data map[string]interface{}, tags *bulkTagChange, ownership *models.Ownership, dryRun bool) models.BulkOperationResult {
 	result := models.BulkOperationResult{
+		DryRun:     dryRun,
 		TotalCount: len(machineIDs),
 	}
 
 	for _, id := range machineIDs {
 		machine, err := s.db.GetMachine(id)
-		if err != nil {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: %v", id, err))
-			continue
+		if err == nil && machine == nil {
+			err = fmt.Errorf("not found")
 		}
-
-		if machine == nil {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: not found", id))
+		if err != nil {
+			result.Fail(id, err)
 			continue
 		}
+		before := *machine
 
 		// Update fields from data
 		if hostname, ok := data["hostname"].(string); ok && hostname != "" {
@@ -97,83 +183,331 @@ func (s *Server) bulkUpdate(machineIDs []string, data map[string]interface{}) mo
 		}
 		if nixosConfig, ok := data["nixos_config"].(string); ok && nixosConfig != "" {
 			machine.NixOSConfig = nixosConfig
-			machine.Status = models.StatusConfigured
+			machine.TemplateID = ""
+			machine.TemplateVariables = nil
+			if machine.CanProvision() {
+				machine.Status = models.StatusConfigured
+			}
+			if err := s.service.AssignHostname(machine); err != nil {
+				result.Fail(id, err)
+				continue
+			}
+		}
+		if tags != nil {
+			updated, err := tags.apply(machine.Tags)
+			if err != nil {
+				result.Fail(id, err)
+				continue
+			}
+			machine.Tags = updated
+		}
+		if ownership != nil {
+			machine.Ownership = ownership
+			if ownership.IsZero() {
+				machine.Ownership = nil
+			}
+		}
+
+		changes := bulkChanges(&before, machine)
+		if len(changes) == 0 {
+			result.Succeed(id, nil)
+			continue
+		}
+		if dryRun {
+			// A hostname another machine has would fail the update
+			if machine.Hostname != before.Hostname {
+				if err := s.db.CheckHostname(id, machine.Hostname); err != nil {
+					result.Fail(id, err)
+					continue
+				}
+			}
+			result.Succeed(id, changes)
+			continue
 		}
 
+		// Saving records the configuration's hash, which flags the
+		// machine's build as stale if the configuration changed
 		if err := s.db.UpdateMachine(machine); err != nil {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: %v", id, err))
+			result.Fail(id, err)
 			continue
 		}
+		if machine.NixOSConfig != before.NixOSConfig {
+			s.service.LintSaved(machine)
+		}
+		s.publishStatusChange(ctx, machine, before.Status, "")
 
-		result.SuccessCount++
+		result.Succeed(id, changes)
 	}
 
 	return result
 }
 
-// bulkBuild triggers builds for multiple machines
-func (s *Server) bulkBuild(machineIDs []string) models.BulkOperationResult {
+// bulkChanges lists the fields a bulk update changes on a machine.
+// Configurations are summarized, since a bulk update gives every machine
+// the same one.
+func bulkChanges(before, after *models.Machine) []models.FieldChange {
+	var changes []models.FieldChange
+	change := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, models.FieldChange{Field: field, From: from, To: to})
+		}
+	}
+
+	change("hostname", before.Hostname, after.Hostname)
+	change("description", before.Description, after.Description)
+	if before.NixOSConfig != after.NixOSConfig {
+		delta := lineCount(after.NixOSConfig) - lineCount(before.NixOSConfig)
+		changes = append(changes, models.FieldChange{
+			Field:     "nixos_config",
+			From:      configSummary(before.NixOSConfig),
+			To:        configSummary(after.NixOSConfig),
+			LineDelta: &delta,
+		})
+	}
+	change("template_id", before.TemplateID, after.TemplateID)
+	change("tags", strings.Join(before.Tags, ", "), strings.Join(after.Tags, ", "))
+	change("ownership", ownershipText(before.Ownership), ownershipText(after.Ownership))
+	change("status", string(before.Status), string(after.Status))
+	return changes
+}
+
+// configSummary describes a configuration by the start of its hash and
+// its line count
+func configSummary(config string) string {
+	hash := models.ConfigHash(config)
+	if hash == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s (%d lines)", hash[:12], lineCount(config))
+}
+
+// lineCount counts a configuration's lines, a last line without a newline
+// included
+func lineCount(config string) int {
+	if config == "" {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(config, "\n"), "\n") + 1
+}
+
+// ownershipText describes ownership as its fields that are set
+func ownershipText(o *models.Ownership) string {
+	if o == nil {
+		return ""
+	}
+	var parts []string
+	for _, field := range []struct{ name, value string }{
+		{"team", o.Team},
+		{"contact_email", o.ContactEmail},
+		{"slack_channel", o.SlackChannel},
+		{"environment", o.Environment},
+	} {
+		if field.value != "" {
+			parts = append(parts, field.name+"="+field.value)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// bulkDataHash hashes a bulk operation's data, for its confirmation token.
+// Keys are encoded in order, so the same data always hashes the same.
+func bulkDataHash(data map[string]interface{}) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("data cannot be encoded: %v", err)
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkBulkConfirmation responds and returns false if a bulk update's
+// confirmation token isn't that of a dry run of the same update, or if it
+// has none and the server requires one
+func (s *Server) checkBulkConfirmation(w http.ResponseWriter, req *models.BulkOperationRequest, machineIDs []string, dataHash string) bool {
+	if req.ConfirmationToken == "" {
+		if !s.config.BulkRequireConfirmation {
+			return true
+		}
+		respondError(w, http.StatusPreconditionRequired, CodeConfirmationRequired,
+			"bulk updates require the confirmation_token of a dry run of the same update")
+		return false
+	}
+	if !s.jwtManager.ValidateBulkToken(req.Operation, machineIDs, dataHash, req.ConfirmationToken) {
+		respondError(w, http.StatusConflict, CodeConflict,
+			"confirmation_token doesn't match this update: its machines or data differ from the dry run")
+		return false
+	}
+	return true
+}
+
+// bulkBuild triggers builds for multiple machines. Where approval is
+// required, the builds wait for it whoever queued them.
+func (s *Server) bulkBuild(ctx context.Context, machineIDs []string, priority string) models.BulkOperationResult {
 	result := models.BulkOperationResult{
 		TotalCount: len(machineIDs),
 	}
 
 	for _, id := range machineIDs {
 		machine, err := s.db.GetMachine(id)
+		if err == nil && machine == nil {
+			err = fmt.Errorf("not found")
+		}
 		if err != nil {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: %v", id, err))
+			result.Fail(id, err)
 			continue
 		}
 
-		if machine == nil {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: not found", id))
+		if !machine.CanProvision() {
+			result.Fail(id, fmt.Errorf("%s", machine.Status))
 			continue
 		}
 
-		if machine.NixOSConfig == "" {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: no configuration", id))
+		build, err := s.service.StartBuild(ctx, machine, service.BuildOptions{Priority: priority, Bulk: true})
+		if err != nil {
+			result.Fail(id, err)
 			continue
 		}
+		if build.Status == models.BuildStatusAwaitingApproval {
+			result.AwaitingApprovalCount++
+		}
 
-		// Create build request
-		build, err := s.db.CreateBuild(machine.ID, machine.NixOSConfig)
-		if err != nil {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: %v", id, err))
+		result.Succeed(id, nil)
+	}
+
+	return result
+}
+
+// bulkTagChange is how a bulk update changes each machine's tags: tags
+// replaces them, then add_tags and remove_tags add and remove individual
+// tags
+type bulkTagChange struct {
+	replace bool
+	set     []string
+	add     []string
+	remove  []string
+}
+
+// parseBulkTagChange reads the tag keys of bulk update data. It returns nil
+// if there are none.
+func parseBulkTagChange(data map[string]interface{}) (*bulkTagChange, error) {
+	change := &bulkTagChange{}
+	found := false
+
+	for _, key := range []string{"tags", "add_tags", "remove_tags"} {
+		value, ok := data[key]
+		if !ok {
 			continue
 		}
+		found = true
 
-		// Update machine status
-		machine.Status = models.StatusBuilding
-		machine.LastBuildID = &build.ID
-		if err := s.db.UpdateMachine(machine); err != nil {
-			log.Printf("Failed to update machine status: %v", err)
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be a list of strings", key)
+		}
+		tags := make([]string, 0, len(list))
+		for _, item := range list {
+			tag, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of strings", key)
+			}
+			tags = append(tags, tag)
 		}
 
-		log.Printf("Build requested for machine %s: build_id=%s", machine.ID, build.ID)
-		result.SuccessCount++
+		normalized, err := models.NormalizeTags(tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+
+		switch key {
+		case "tags":
+			change.replace = true
+			change.set = normalized
+		case "add_tags":
+			change.add = normalized
+		case "remove_tags":
+			change.remove = normalized
+		}
 	}
 
-	return result
+	if !found {
+		return nil, nil
+	}
+	return change, nil
 }
 
-// bulkDelete deletes multiple machines
-func (s *Server) bulkDelete(machineIDs []string) models.BulkOperationResult {
+// parseBulkOwnership reads the ownership object of a bulk update's data. It
+// returns nil if there is none.
+func parseBulkOwnership(data map[string]interface{}) (*models.Ownership, error) {
+	value, ok := data["ownership"]
+	if !ok {
+		return nil, nil
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ownership must be an object")
+	}
+
+	ownership := &models.Ownership{}
+	for key, value := range fields {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("ownership.%s must be a string", key)
+		}
+		switch key {
+		case "team":
+			ownership.Team = str
+		case "contact_email":
+			ownership.ContactEmail = str
+		case "slack_channel":
+			ownership.SlackChannel = str
+		case "environment":
+			ownership.Environment = str
+		default:
+			return nil, fmt.Errorf("unknown ownership field %q", key)
+		}
+	}
+	if err := ownership.Normalize(); err != nil {
+		return nil, fmt.Errorf("ownership: %v", err)
+	}
+	return ownership, nil
+}
+
+// apply returns a machine's tags after the change
+func (c *bulkTagChange) apply(current []string) ([]string, error) {
+	tags := current
+	if c.replace {
+		tags = c.set
+	}
+
+	updated := append([]string{}, c.add...)
+	for _, tag := range tags {
+		if !models.HasTag(c.remove, tag) {
+			updated = append(updated, tag)
+		}
+	}
+	return models.NormalizeTags(updated)
+}
+
+// bulkDelete moves multiple machines to the trash
+func (s *Server) bulkDelete(ctx context.Context, machineIDs []string) models.BulkOperationResult {
 	result := models.BulkOperationResult{
 		TotalCount: len(machineIDs),
 	}
 
 	for _, id := range machineIDs {
-		if err := s.db.DeleteMachine(id); err != nil {
-			result.FailureCount++
-			result.Errors = append(result.Errors, fmt.Sprintf("machine %s: %v", id, err))
+		machine, err := s.db.GetMachine(id)
+		if err == nil && machine == nil {
+			err = fmt.Errorf("machine not found")
+		}
+		if err == nil {
+			err = s.trashMachine(ctx, machine)
+		}
+		if err != nil {
+			result.Fail(id, err)
 			continue
 		}
 
-		result.SuccessCount++
+		result.Succeed(id, nil)
 	}
 
 	return result
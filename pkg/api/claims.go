@@ -0,0 +1,235 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// enrollmentResponse adds a claim code to the response to an enrollment of
+// an unclaimed machine, when claim codes are enabled. A machine that
+// re-enrolls gets a new code, which replaces the old one. Failing to issue
+// a code doesn't fail the enrollment.
+func (s *Server) enrollmentResponse(machine *models.Machine) models.EnrollmentResponse {
+	response := models.EnrollmentResponse{Machine: machine}
+	if !s.config.EnableAuth || s.config.ClaimCodeTTL <= 0 || machine.OwnerUserID != "" {
+		return response
+	}
+
+	code, err := models.NewClaimCode()
+	if err != nil {
+		log.Printf("Failed to generate claim code for %s: %v", machine.ID, err)
+		return response
+	}
+
+	expiresAt := time.Now().Add(s.config.ClaimCodeTTL)
+	if err := s.db.CreateClaimCode(machine.ID, hashClaimCode(code), expiresAt); err != nil {
+		log.Printf("Failed to store claim code for %s: %v", machine.ID, err)
+		return response
+	}
+
+	response.ClaimCode = models.FormatClaimCode(code)
+	response.ClaimCodeExpiresAt = &expiresAt
+	return response
+}
+
+// handleClaimMachine makes the current user the owner of the machine a
+// claim code was issued to, and adds the machine to the user's default
+// group. Unknown, expired, used, and malformed codes get the same response,
+// so it says nothing about which codes exist.
+func (s *Server) handleClaimMachine(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetClaims(r)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+		return
+	}
+
+	var req models.ClaimRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	machineID := ""
+	if code := models.NormalizeClaimCode(req.Code); code != "" {
+		var err error
+		machineID, err = s.db.ClaimMachine(hashClaimCode(code), claims.UserID)
+		if err != nil {
+			respondInternalError(w, err, "failed to claim machine")
+			return
+		}
+	}
+	if machineID == "" {
+		respondError(w, http.StatusNotFound, CodeClaimCodeInvalid, "claim code is invalid or has expired")
+		return
+	}
+
+	user, err := s.db.GetUser(claims.UserID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	groupID := ""
+	if user != nil && user.DefaultGroupID != "" {
+		if err := s.db.AddMachineToGroup(user.DefaultGroupID, machineID); err != nil {
+			// The claim stands; the machine can be added to the group by hand
+			log.Printf("Failed to add claimed machine %s to group %s: %v", machineID, user.DefaultGroupID, err)
+		} else {
+			groupID = user.DefaultGroupID
+		}
+	}
+
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	log.Printf("Machine %s (service_tag: %s) claimed by %s", machine.ID, machine.ServiceTag, claims.Username)
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineClaimed,
+		MachineID: machine.ID,
+		Actor:     claims.Username,
+		Data: events.ClaimedData{
+			ServiceTag: machine.ServiceTag,
+			Owner:      claims.Username,
+			GroupID:    groupID,
+		},
+	})
+
+	respondJSON(w, http.StatusOK, machine)
+}
+
+// handleUnclaimMachine clears a machine's owner. The machine gets a new
+// claim code the next time it enrolls.
+func (s *Server) handleUnclaimMachine(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if machine.OwnerUserID == "" {
+		respondError(w, http.StatusConflict, CodeConflict, "machine is not claimed")
+		return
+	}
+
+	if err := s.db.UnclaimMachine(machine.ID); err != nil {
+		respondInternalError(w, err, "failed to unclaim machine")
+		return
+	}
+
+	actor := ""
+	if claims, ok := auth.GetClaims(r); ok {
+		actor = claims.Username
+	}
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineUnclaimed,
+		MachineID: machine.ID,
+		Actor:     actor,
+		Data: events.UnclaimedData{
+			ServiceTag:  machine.ServiceTag,
+			OwnerUserID: machine.OwnerUserID,
+		},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// visibleTo returns the ID of the viewer making a request, whose listings
+// leave out machines claimed by other users, or "" for operators and
+// admins, who see every machine
+func visibleTo(r *http.Request) string {
+	if claims, ok := auth.GetClaims(r); ok && claims.Role == models.RoleViewer {
+		return claims.UserID
+	}
+	return ""
+}
+
+// claimedMachineAccess keeps viewers away from machines claimed by other
+// users: requests naming such a machine, whatever their method, get the
+// same 404 as a machine that doesn't exist. Operators and admins can reach
+// every machine. Machines and iPXE servers reporting with a viewer's token
+// can report only for unclaimed machines and that viewer's own.
+func (s *Server) claimedMachineAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := visibleTo(r)
+		if userID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		vars := mux.Vars(r)
+		for _, id := range []string{vars["id"], vars["other_id"]} {
+			if id == "" {
+				continue
+			}
+			owner, err := s.db.GetMachineOwner(id)
+			if err != nil {
+				respondInternalError(w, err, "database error")
+				return
+			}
+			if owner != "" && owner != userID {
+				respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// claimedBuildAccess keeps viewers away from the builds of machines claimed
+// by other users, as claimedMachineAccess does the machines
+func (s *Server) claimedBuildAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := visibleTo(r)
+		id := mux.Vars(r)["id"]
+		if userID == "" || id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		build, err := s.db.GetBuild(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if build != nil && build.MachineID != "" {
+			owner, err := s.db.GetMachineOwner(build.MachineID)
+			if err != nil {
+				respondInternalError(w, err, "database error")
+				return
+			}
+			if owner != "" && owner != userID {
+				respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hashClaimCode returns the form a normalized claim code is stored in
+func hashClaimCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,213 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// claimFor claims a machine for userID the way a claim code does
+func claimFor(t *testing.T, env *testutil.Env, machineID, userID string) {
+	t.Helper()
+
+	hash := "hash-" + machineID
+	if err := env.DB.CreateClaimCode(machineID, hash, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.DB.ClaimMachine(hash, userID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestViewersDontSeeOthersClaimedMachines checks every route naming or
+// listing machines hides those claimed by other users from viewers, while
+// operators still see them
+func TestViewersDontSeeOthersClaimedMachines(t *testing.T) {
+	env := testutil.New(t)
+	other, err := env.DB.CreateUser("other", "other@example.com", "x", models.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed := env.EnrollMachine("CLAIMED01")
+	mine := env.EnrollMachine("MINE01")
+	unclaimed := env.EnrollMachine("UNCLAIMED01")
+	claimFor(t, env, claimed.ID, other.ID)
+	claimFor(t, env, mine.ID, env.Users[models.RoleViewer].ID)
+
+	env.ConfigureMachine(claimed.ID, testutil.FixtureConfig)
+	var build models.BuildRequest
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+claimed.ID+"/build", nil, http.StatusCreated, &build)
+
+	group := env.CreateGroup("mixed")
+	for _, m := range []*models.Machine{claimed, mine, unclaimed} {
+		env.MustJSON(models.RoleOperator, http.MethodPut, "/api/v1/groups/"+group.ID+"/machines/"+m.ID, nil, http.StatusNoContent, nil)
+	}
+
+	// Routes naming the machine, whatever their method
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/api/v1/machines/" + claimed.ID},
+		{http.MethodGet, "/api/v1/machines/" + claimed.ID + "/events"},
+		{http.MethodGet, "/api/v1/machines/" + unclaimed.ID + "/compare/" + claimed.ID},
+		{http.MethodPost, "/api/v1/machines/" + claimed.ID + "/assemble"},
+		{http.MethodPost, "/api/v1/machines/" + claimed.ID + "/metrics"},
+		{http.MethodPost, "/api/v1/machines/" + claimed.ID + "/boot-history"},
+		{http.MethodGet, "/api/v1/builds/" + build.ID},
+		{http.MethodGet, "/api/v1/builds/" + build.ID + "/logs"},
+		{http.MethodGet, "/api/v1/builds/" + build.ID + "/artifacts"},
+	} {
+		if code := hiddenCode(t, env, models.RoleViewer, route.method, route.path); code == "" {
+			t.Errorf("viewer %s %s: not hidden", route.method, route.path)
+		}
+		if code := hiddenCode(t, env, models.RoleOperator, route.method, route.path); code != "" {
+			t.Errorf("operator %s %s: %s", route.method, route.path, code)
+		}
+	}
+
+	// The viewer's own machine is still theirs to reach
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/"+mine.ID, nil, http.StatusOK, nil)
+
+	// A serial number the claimed machine shares with an unclaimed one, and
+	// a long silence since the reports above, make both a conflict and stale
+	if _, err := env.DB.Exec("UPDATE machines SET hardware = json_set(hardware, '$.serial_number', 'SHARED'), last_seen_at = ? WHERE id IN (?, ?)",
+		time.Now().AddDate(0, 0, -60), claimed.ID, unclaimed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listings leave it out
+	listings := map[string]func(role models.UserRole) []string{
+		"machines": func(role models.UserRole) []string {
+			var machines []models.MachineSummary
+			env.MustJSON(role, http.MethodGet, "/api/v1/machines", nil, http.StatusOK, &machines)
+			return summaryIDs(machines)
+		},
+		"stale": func(role models.UserRole) []string {
+			var machines []models.MachineSummary
+			env.MustJSON(role, http.MethodGet, "/api/v1/machines/stale", nil, http.StatusOK, &machines)
+			return summaryIDs(machines)
+		},
+		"group machines": func(role models.UserRole) []string {
+			var machines []models.Machine
+			env.MustJSON(role, http.MethodGet, "/api/v1/groups/"+group.ID+"/machines", nil, http.StatusOK, &machines)
+			var ids []string
+			for _, m := range machines {
+				ids = append(ids, m.ID)
+			}
+			return ids
+		},
+		"group drift": func(role models.UserRole) []string {
+			var report models.GroupDrift
+			env.MustJSON(role, http.MethodGet, "/api/v1/groups/"+group.ID+"/drift", nil, http.StatusOK, &report)
+			var ids []string
+			for _, cluster := range report.Clusters {
+				ids = append(ids, cluster.MachineIDs...)
+			}
+			return ids
+		},
+		"conflicts": func(role models.UserRole) []string {
+			var duplicates []models.MachineDuplicate
+			env.MustJSON(role, http.MethodGet, "/api/v1/machines/conflicts?type=serial_number", nil, http.StatusOK, &duplicates)
+			var ids []string
+			for _, duplicate := range duplicates {
+				for _, m := range duplicate.Machines {
+					ids = append(ids, m.ID)
+				}
+			}
+			return ids
+		},
+		"metrics": func(role models.UserRole) []string {
+			var entries []struct {
+				Machine models.MachineSummary `json:"machine"`
+			}
+			env.MustJSON(role, http.MethodGet, "/api/v1/metrics/machines", nil, http.StatusOK, &entries)
+			var ids []string
+			for _, entry := range entries {
+				ids = append(ids, entry.Machine.ID)
+			}
+			return ids
+		},
+		"builds": func(role models.UserRole) []string {
+			var builds []models.BuildRequest
+			env.MustJSON(role, http.MethodGet, "/api/v1/builds", nil, http.StatusOK, &builds)
+			var ids []string
+			for _, b := range builds {
+				ids = append(ids, b.MachineID)
+			}
+			return ids
+		},
+		"events": func(role models.UserRole) []string {
+			var events []models.MachineEvent
+			env.MustJSON(role, http.MethodGet, "/api/v1/events", nil, http.StatusOK, &events)
+			var ids []string
+			for _, event := range events {
+				ids = append(ids, event.MachineID)
+			}
+			return ids
+		},
+	}
+	for name, list := range listings {
+		if ids := list(models.RoleViewer); contains(ids, claimed.ID) {
+			t.Errorf("viewer's %s list the claimed machine", name)
+		}
+		if ids := list(models.RoleOperator); !contains(ids, claimed.ID) {
+			t.Errorf("operator's %s leave out the claimed machine", name)
+		}
+	}
+
+	// Trashed machines too
+	env.MustJSON(models.RoleOperator, http.MethodDelete, "/api/v1/machines/"+claimed.ID, nil, http.StatusNoContent, nil)
+	var trash []models.MachineSummary
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/trash", nil, http.StatusOK, &trash)
+	if contains(summaryIDs(trash), claimed.ID) {
+		t.Error("viewer's trash lists the claimed machine")
+	}
+	env.MustJSON(models.RoleOperator, http.MethodGet, "/api/v1/machines/trash", nil, http.StatusOK, &trash)
+	if !contains(summaryIDs(trash), claimed.ID) {
+		t.Error("operator's trash leaves out the claimed machine")
+	}
+
+	// And the counts of stats
+	var viewerStats, operatorStats models.Stats
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/stats", nil, http.StatusOK, &viewerStats)
+	env.MustJSON(models.RoleOperator, http.MethodGet, "/api/v1/stats", nil, http.StatusOK, &operatorStats)
+	if viewerStats.Builds.Total != 0 || operatorStats.Builds.Total != 1 {
+		t.Errorf("builds counted: viewer %d, operator %d; want 0 and 1", viewerStats.Builds.Total, operatorStats.Builds.Total)
+	}
+}
+
+// hiddenCode returns the error code of a response that hides a machine or
+// build as if it didn't exist, or "" if the response doesn't hide one
+func hiddenCode(t *testing.T, env *testutil.Env, role models.UserRole, method, path string) string {
+	t.Helper()
+
+	resp := env.Do(role, method, path, map[string]interface{}{})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		return ""
+	}
+	apiErr, ok := decodeError(t, resp)
+	if !ok || (apiErr.Code != "machine_not_found" && apiErr.Code != "build_not_found") {
+		return ""
+	}
+	return apiErr.Code
+}
+
+func summaryIDs(machines []models.MachineSummary) []string {
+	var ids []string
+	for _, m := range machines {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func contains(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
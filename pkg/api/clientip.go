@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// ParseTrustedProxies parses addresses and CIDR ranges of proxies whose
+// X-Forwarded-For headers are believed. A plain address matches only
+// itself.
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			proxies = append(proxies, network)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return proxies, nil
+}
+
+// clientIPMiddleware works out the address each request came from, for
+// handlers, the audit log, and rate limiting to share. X-Forwarded-For is
+// only believed when the request comes from a trusted proxy.
+func (s *Server) clientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.resolveClientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// resolveClientIP returns the address a request came from. When it came
+// through trusted proxies, that is the nearest X-Forwarded-For hop that
+// isn't one of them; the hops are read from the right, since those to the
+// left of the last untrusted one could say anything.
+func (s *Server) resolveClientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !s.trustedProxy(host) {
+		return host
+	}
+
+	hops := r.Header.Values("X-Forwarded-For")
+	var addrs []string
+	for _, header := range hops {
+		for _, addr := range strings.Split(header, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			// A malformed hop can't be traced past
+			break
+		}
+		host = ip.String()
+		if !s.trustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxy reports whether an address is one of the trusted proxies
+func (s *Server) trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request came from, as worked out by
+// clientIPMiddleware, or the connection's address if it didn't run
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// remoteHost returns the address a request's connection came from,
+// without its port, or the zone of a link-local IPv6 address, which only
+// names one of the server's interfaces
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	host, _, _ = strings.Cut(host, "%")
+	return host
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// clientIPServer returns a server with just trusted proxies configured
+func clientIPServer(t *testing.T, trusted ...string) *Server {
+	t.Helper()
+
+	proxies, err := ParseTrustedProxies(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{config: Config{TrustedProxies: proxies}}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []string
+		remoteAddr string
+		xff        []string // X-Forwarded-For headers, in order
+		want       string
+	}{
+		{
+			name:       "no proxy",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "198.51.100.7:40000",
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "trusted proxy",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:40000",
+			xff:        []string{"198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "untrusted proxy's header is ignored",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "203.0.113.9:40000",
+			xff:        []string{"198.51.100.7"},
+			want:       "203.0.113.9",
+		},
+		{
+			name:       "no trusted proxies configured",
+			remoteAddr: "127.0.0.1:40000",
+			xff:        []string{"198.51.100.7"},
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "multi-hop through trusted proxies",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:40000",
+			xff:        []string{"198.51.100.7, 10.0.0.3, 10.0.0.2"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "hops spoofed left of the client are ignored",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:40000",
+			xff:        []string{"6.6.6.6, 10.0.0.9, 198.51.100.7, 10.0.0.2"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "hops split across headers",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:40000",
+			xff:        []string{"6.6.6.6", "198.51.100.7, 10.0.0.2"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "every hop trusted",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:40000",
+			xff:        []string{"10.0.0.3, 10.0.0.2"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "malformed hop",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.0.0.1:40000",
+			xff:        []string{"198.51.100.7, not-an-ip"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "plain address is trusted, not its network",
+			trusted:    []string{"10.0.0.1"},
+			remoteAddr: "10.0.0.2:40000",
+			xff:        []string{"198.51.100.7"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "IPv6",
+			trusted:    []string{"::1", "fd00::/8"},
+			remoteAddr: "[::1]:40000",
+			xff:        []string{"2001:db8::5, fd00::2"},
+			want:       "2001:db8::5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := clientIPServer(t, tt.trusted...)
+
+			var got string
+			handler := s.clientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.xff {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("client IP %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalidEntries(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "proxy.example.com", "10.0.0"} {
+		if _, err := ParseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+
+	proxies, err := ParseTrustedProxies([]string{" 10.0.0.1 ", "", "192.168.0.0/16"})
+	if err != nil || len(proxies) != 2 {
+		t.Errorf("got %v, %v, want two proxies", proxies, err)
+	}
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// respondEnrollmentHeld tells a machine that its enrollment is held
+func (s *Server) respondEnrollmentHeld(w http.ResponseWriter, machine *models.Machine) {
+	message := fmt.Sprintf("enrollment of machine %s is held until an operator resolves its conflict with another machine", machine.ID)
+
+	conflict, err := s.db.GetMachineConflict(machine.ID)
+	if err != nil {
+		log.Printf("Failed to get conflict of machine %s: %v", machine.ID, err)
+	} else if conflict != nil {
+		message = fmt.Sprintf("enrollment of machine %s is held until an operator resolves it: %s %s belongs to machine %s",
+			machine.ID, conflict.Field, conflict.Value, conflict.ExistingMachineID)
+	}
+
+	respondError(w, http.StatusConflict, CodeEnrollmentConflict, message)
+}
+
+// handleListMachineConflicts reports the MAC addresses and serial numbers
+// that more than one machine has: held enrollments, and duplicates recorded
+// before enrollment checked for them. It also reports hostnames more than
+// one machine had before they had to be unique. ?type= picks one of
+// mac_address, serial_number, or hostname.
+func (s *Server) handleListMachineConflicts(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("type")
+	switch kind {
+	case "", models.IdentityMACAddress, models.IdentitySerialNumber, models.DuplicateHostname:
+	default:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "type must be mac_address, serial_number, or hostname")
+		return
+	}
+
+	duplicates := []*models.MachineDuplicate{}
+	if kind != models.DuplicateHostname {
+		identities, err := s.db.ListMachineDuplicates()
+		if err != nil {
+			respondInternalError(w, err, "failed to list machine conflicts")
+			return
+		}
+		for _, duplicate := range identities {
+			if kind == "" || duplicate.Field == kind {
+				duplicates = append(duplicates, duplicate)
+			}
+		}
+	}
+	if kind == "" || kind == models.DuplicateHostname {
+		hostnames, err := s.db.ListHostnameDuplicates()
+		if err != nil {
+			respondInternalError(w, err, "failed to list hostname conflicts")
+			return
+		}
+		duplicates = append(duplicates, hostnames...)
+	}
+
+	// Viewers see the conflicts between machines they can see
+	if userID := visibleTo(r); userID != "" {
+		hidden, err := s.db.HiddenMachineIDs(userID)
+		if err != nil {
+			respondInternalError(w, err, "failed to list claimed machines")
+			return
+		}
+		visible := []*models.MachineDuplicate{}
+		for _, duplicate := range duplicates {
+			var machines []*models.DuplicateMachine
+			for _, m := range duplicate.Machines {
+				if !hidden[m.ID] {
+					machines = append(machines, m)
+				}
+			}
+			if len(machines) > 1 {
+				duplicate.Machines = machines
+				visible = append(visible, duplicate)
+			}
+		}
+		duplicates = visible
+	}
+
+	respondJSON(w, http.StatusOK, duplicates)
+}
+
+// handleResolveMachineConflict resolves a conflict between a machine and
+// another machine with the same MAC address or serial number. merge merges
+// the machine into the other one; supersede keeps the machine and
+// decommissions the other; reject deletes a held enrollment.
+func (s *Server) handleResolveMachineConflict(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	machine, err := s.db.GetMachine(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	var req models.ConflictResolution
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	switch req.Action {
+	case models.ConflictMerge, models.ConflictSupersede, models.ConflictReject:
+	default:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "action must be merge, supersede, or reject")
+		return
+	}
+
+	if req.Action == models.ConflictReject {
+		s.rejectEnrollment(w, r, machine)
+		return
+	}
+
+	otherID := req.MachineID
+	if otherID == "" {
+		conflict, err := s.db.GetMachineConflict(machine.ID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if conflict == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "machine_id is required for machines whose enrollment is not held")
+			return
+		}
+		otherID = conflict.ExistingMachineID
+	}
+
+	if otherID == machine.ID {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "machine_id must be another machine")
+		return
+	}
+
+	other, err := s.db.GetMachine(otherID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	var field, value string
+	if other != nil {
+		field, value = sharedIdentity(machine, other)
+	}
+
+	if field == "" {
+		// A held enrollment whose conflicting machine has since been
+		// deleted, or no longer has its MAC address or serial number, has
+		// nothing left to supersede
+		if req.Action == models.ConflictSupersede && req.MachineID == "" {
+			s.releaseMachine(w, r, machine)
+			return
+		}
+		if other == nil {
+			respondError(w, http.StatusNotFound, CodeMachineNotFound, fmt.Sprintf("machine %s not found", otherID))
+			return
+		}
+		respondError(w, http.StatusConflict, CodeConflict, "the machines have neither a MAC address nor a serial number in common")
+		return
+	}
+
+	if req.Action == models.ConflictMerge {
+		s.mergeMachine(w, r, machine, other, field, value)
+	} else {
+		s.supersedeMachine(w, r, machine, other, field, value)
+	}
+}
+
+// mergeMachine merges machine into other, and responds with the merged
+// record
+func (s *Server) mergeMachine(w http.ResponseWriter, r *http.Request, machine, other *models.Machine, field, value string) {
+	if err := s.db.MergeMachine(machine, other); err != nil {
+		respondInternalError(w, err, "failed to merge machines")
+		return
+	}
+
+	merged, err := s.db.GetMachine(other.ID)
+	if err != nil || merged == nil {
+		respondInternalError(w, err, "failed to get merged machine")
+		return
+	}
+
+	log.Printf("Merged machine %s (service_tag: %s) into %s", machine.ID, machine.ServiceTag, merged.ID)
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineDeleted,
+		MachineID: machine.ID,
+		Data: events.DeletedData{
+			Permanent: true,
+			Reason:    "merged into machine " + merged.ID,
+		},
+	})
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineConflictResolved,
+		MachineID: merged.ID,
+		Data: events.ConflictResolvedData{
+			Action:             models.ConflictMerge,
+			Field:              field,
+			Value:              value,
+			MergedMachineID:    machine.ID,
+			ServiceTag:         merged.ServiceTag,
+			PreviousServiceTag: other.ServiceTag,
+		},
+	})
+	s.publishStatusChange(r.Context(), merged, other.Status, "")
+
+	respondJSON(w, http.StatusOK, merged)
+}
+
+// supersedeMachine keeps machine, releasing it if it is held, and
+// decommissions other
+func (s *Server) supersedeMachine(w http.ResponseWriter, r *http.Request, machine, other *models.Machine, field, value string) {
+	if other.Status != models.StatusDecommissioned {
+		reason := fmt.Sprintf("superseded by machine %s (service_tag: %s)", machine.ID, machine.ServiceTag)
+		if err := s.decommission(r.Context(), other, reason, false, ""); err != nil {
+			respondInternalError(w, err, "failed to decommission superseded machine")
+			return
+		}
+	}
+
+	oldStatus := machine.Status
+	if oldStatus == models.StatusConflict {
+		if err := s.db.ReleaseMachine(machine.ID); err != nil {
+			respondInternalError(w, err, "failed to release machine")
+			return
+		}
+		machine.Status = models.StatusEnrolled
+	}
+
+	log.Printf("Machine %s (service_tag: %s) superseded %s", machine.ID, machine.ServiceTag, other.ID)
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineConflictResolved,
+		MachineID: machine.ID,
+		Data: events.ConflictResolvedData{
+			Action:               models.ConflictSupersede,
+			Field:                field,
+			Value:                value,
+			SupersededMachineID:  other.ID,
+			SupersededServiceTag: other.ServiceTag,
+		},
+	})
+	s.publishStatusChange(r.Context(), machine, oldStatus, "")
+
+	respondJSON(w, http.StatusOK, machine)
+}
+
+// releaseMachine releases a held machine without changing any other
+func (s *Server) releaseMachine(w http.ResponseWriter, r *http.Request, machine *models.Machine) {
+	if err := s.db.ReleaseMachine(machine.ID); err != nil {
+		respondInternalError(w, err, "failed to release machine")
+		return
+	}
+
+	oldStatus := machine.Status
+	machine.Status = models.StatusEnrolled
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineConflictResolved,
+		MachineID: machine.ID,
+		Data:      events.ConflictResolvedData{Action: models.ConflictSupersede},
+	})
+	s.publishStatusChange(r.Context(), machine, oldStatus, "")
+
+	respondJSON(w, http.StatusOK, machine)
+}
+
+// rejectEnrollment deletes a held enrollment. The machine is held again if
+// it enrolls again with the same MAC address or serial number.
+func (s *Server) rejectEnrollment(w http.ResponseWriter, r *http.Request, machine *models.Machine) {
+	if machine.Status != models.StatusConflict {
+		respondError(w, http.StatusConflict, CodeConflict, "only held enrollments can be rejected")
+		return
+	}
+
+	conflict, err := s.db.GetMachineConflict(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if err := s.db.DeleteMachine(machine.ID); err != nil {
+		respondInternalError(w, err, "failed to delete machine")
+		return
+	}
+
+	log.Printf("Rejected held enrollment of %s (service_tag: %s)", machine.ID, machine.ServiceTag)
+	s.removeUnusedAttachments()
+
+	// The rejected machine's log is gone, so the rejection is recorded on
+	// the machine it conflicted with
+	if conflict != nil {
+		s.publish(r.Context(), events.Event{
+			Type:      events.MachineConflictResolved,
+			MachineID: conflict.ExistingMachineID,
+			Data: events.ConflictResolvedData{
+				Action:             models.ConflictReject,
+				Field:              conflict.Field,
+				Value:              conflict.Value,
+				RejectedMachineID:  machine.ID,
+				RejectedServiceTag: machine.ServiceTag,
+			},
+		})
+	}
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineDeleted,
+		MachineID: machine.ID,
+		Data: events.DeletedData{
+			Permanent: true,
+			Reason:    "held enrollment rejected",
+		},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedIdentity returns a MAC address or serial number two machines have
+// in common, and which one it is, or "" if they have none
+func sharedIdentity(a, b *models.Machine) (string, string) {
+	macA, errA := models.NormalizeMAC(a.MACAddress)
+	macB, errB := models.NormalizeMAC(b.MACAddress)
+	if errA == nil && errB == nil && macA == macB {
+		return models.IdentityMACAddress, macA
+	}
+
+	serial := models.NormalizeSerialNumber(a.Hardware.SerialNumber)
+	if serial != "" && serial == models.NormalizeSerialNumber(b.Hardware.SerialNumber) {
+		return models.IdentitySerialNumber, serial
+	}
+
+	return "", ""
+}
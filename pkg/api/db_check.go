@@ -0,0 +1,22 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// handleCheckDatabase runs the database's integrity_check and quick_check.
+// A database that fails them is reported unhealthy until a check passes.
+func (s *Server) handleCheckDatabase(w http.ResponseWriter, r *http.Request) {
+	check, err := s.db.CheckIntegrity(true)
+	if err != nil {
+		respondInternalError(w, err, "failed to check database")
+		return
+	}
+	if !check.OK {
+		log.Printf("Database failed its integrity check: %s", strings.Join(append(check.IntegrityCheck, check.QuickCheck...), "; "))
+	}
+
+	respondJSON(w, http.StatusOK, check)
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/dcim"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleDCIMSync syncs machines from the DCIM now and responds with the
+// sync report. Fields edited here since the last sync are reported as
+// conflicts and left alone, unless the request sets force.
+func (s *Server) handleDCIMSync(w http.ResponseWriter, r *http.Request) {
+	if s.config.DCIM == nil {
+		respondError(w, http.StatusServiceUnavailable, CodeDCIMNotConfigured, "no DCIM is configured; set NETBOX_URL")
+		return
+	}
+
+	// The body is optional
+	var req models.DCIMSyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+
+	if !s.dcimSyncMu.TryLock() {
+		respondError(w, http.StatusConflict, CodeConflict, "a DCIM sync is already running")
+		return
+	}
+	defer s.dcimSyncMu.Unlock()
+
+	report, err := dcim.Sync(r.Context(), s.db, s.config.DCIM, req.Force)
+	if err != nil {
+		respondInternalError(w, err, "failed to record sync report")
+		return
+	}
+	logDCIMSync(report)
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// handleListDCIMSyncReports lists recent sync reports from the DCIM, newest
+// first, without their items
+func (s *Server) handleListDCIMSyncReports(w http.ResponseWriter, r *http.Request) {
+	if s.config.DCIM == nil {
+		respondError(w, http.StatusServiceUnavailable, CodeDCIMNotConfigured, "no DCIM is configured; set NETBOX_URL")
+		return
+	}
+
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		limit = l
+	}
+
+	reports, err := s.db.ListDCIMSyncReports(s.config.DCIM.Name(), limit)
+	if err != nil {
+		respondInternalError(w, err, "failed to list sync reports")
+		return
+	}
+	if reports == nil {
+		reports = []*models.DCIMSyncReport{}
+	}
+
+	respondJSON(w, http.StatusOK, reports)
+}
+
+// handleGetDCIMSyncReport returns a sync report with what happened to each
+// device that wasn't unchanged
+func (s *Server) handleGetDCIMSyncReport(w http.ResponseWriter, r *http.Request) {
+	report, err := s.db.GetDCIMSyncReport(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "failed to get sync report")
+		return
+	}
+	if report == nil {
+		respondError(w, http.StatusNotFound, CodeSyncReportNotFound, "sync report not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// StartDCIMSync syncs machines from the DCIM every interval, never forcing
+// over fields edited here
+func (s *Server) StartDCIMSync(interval time.Duration) {
+	if s.config.DCIM == nil {
+		return
+	}
+
+	go func() {
+		log.Printf("DCIM sync started (source: %s, interval: %s)", s.config.DCIM.Name(), interval)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if s.leadJob("dcim-sync", interval) && s.dcimSyncMu.TryLock() {
+				report, err := dcim.Sync(context.Background(), s.db, s.config.DCIM, false)
+				s.dcimSyncMu.Unlock()
+				if err != nil {
+					log.Printf("Failed to record DCIM sync report: %v", err)
+				}
+				logDCIMSync(report)
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+func logDCIMSync(report *models.DCIMSyncReport) {
+	if report.Error != "" {
+		log.Printf("DCIM sync from %s failed: %s", report.Source, report.Error)
+	}
+	log.Printf("DCIM sync from %s: %d created, %d updated, %d unchanged, %d skipped, %d conflicts",
+		report.Source, report.Created, report.Updated, report.Unchanged, report.Skipped, report.Conflicts)
+}
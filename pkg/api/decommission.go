@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultStaleDays      = 30
+	decommissionPurgeTick = time.Hour
+)
+
+// handleDecommissionMachine takes a machine out of service. The iPXE server
+// stops booting it, it leaves all groups, pending builds are cancelled, and
+// the record is deleted once the retention period has passed.
+func (s *Server) handleDecommissionMachine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if machine.Status == models.StatusDecommissioned {
+		respondError(w, http.StatusConflict, CodeConflict, "machine is already decommissioned")
+		return
+	}
+
+	// The body is optional
+	var req models.DecommissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+
+	if req.PowerOff {
+		if machine.BMCInfo == nil {
+			respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
+			return
+		}
+		if !s.checkMaintenance(w, r, []string{machine.ID}, models.MaintenanceOpPower) {
+			return
+		}
+	}
+
+	var userID string
+	if claims, ok := auth.GetClaims(r); ok {
+		userID = claims.UserID
+	}
+
+	if err := s.decommission(r.Context(), machine, req.Reason, req.PowerOff, userID); err != nil {
+		respondInternalError(w, err, "failed to update machine")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, machine)
+}
+
+// decommission takes a machine out of service, powering it off if powerOff
+// is set, and publishes machine.decommissioned
+func (s *Server) decommission(ctx context.Context, machine *models.Machine, reason string, powerOff bool, userID string) error {
+	oldStatus := machine.Status
+	now := time.Now()
+	machine.Status = models.StatusDecommissioned
+	machine.DecommissionedAt = &now
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		return err
+	}
+
+	if err := s.db.RemoveMachineFromAllGroups(machine.ID); err != nil {
+		log.Printf("Failed to remove decommissioned machine %s from groups: %v", machine.ID, err)
+	}
+
+	cancelled, err := s.db.CancelPendingBuilds(machine.ID)
+	if err != nil {
+		log.Printf("Failed to cancel builds for decommissioned machine %s: %v", machine.ID, err)
+	}
+	if _, err := s.db.CancelPendingDeployments(machine.ID); err != nil {
+		log.Printf("Failed to cancel deployments for decommissioned machine %s: %v", machine.ID, err)
+	}
+
+	if powerOff {
+		s.powerOffDecommissioned(machine, userID)
+	}
+
+	log.Printf("Decommissioned machine %s (service_tag: %s)", machine.ID, machine.ServiceTag)
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineDecommissioned,
+		MachineID: machine.ID,
+		Data: events.DecommissionedData{
+			ServiceTag:      machine.ServiceTag,
+			OldStatus:       oldStatus,
+			Reason:          reason,
+			PowerOff:        powerOff,
+			CancelledBuilds: cancelled,
+		},
+	})
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+
+	return nil
+}
+
+// powerOffDecommissioned powers a machine off in the background, recording
+// the operation like any other power request
+func (s *Server) powerOffDecommissioned(machine *models.Machine, userID string) {
+	if userID == "" {
+		userID = "system"
+	}
+
+	powerOp := &models.PowerOperation{
+		MachineID:   machine.ID,
+		Operation:   "off",
+		Status:      "pending",
+		InitiatedBy: userID,
+	}
+	if err := s.db.CreatePowerOperation(powerOp); err != nil {
+		log.Printf("Failed to create power operation for %s: %v", machine.ID, err)
+		return
+	}
+
+	go func() {
+		result, err := s.powerController().PowerOff(machine.BMCInfo)
+
+		now := time.Now()
+		powerOp.CompletedAt = &now
+		if err != nil {
+			powerOp.Status = "failed"
+			powerOp.Error = err.Error()
+		} else {
+			powerOp.Status = "success"
+			powerOp.Result = result
+		}
+
+		s.finishPowerOperation(powerOp)
+		s.publishPowerOperation(powerOp)
+	}()
+}
+
+// handleApproveReenrollment returns a decommissioned machine to service so
+// that it can enroll again
+func (s *Server) handleApproveReenrollment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if machine.Status != models.StatusDecommissioned {
+		respondError(w, http.StatusConflict, CodeConflict, "machine is not decommissioned")
+		return
+	}
+
+	machine.Status = models.StatusEnrolled
+	machine.DecommissionedAt = nil
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		respondInternalError(w, err, "failed to update machine")
+		return
+	}
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineReenrollmentApproved,
+		MachineID: machine.ID,
+		Data:      events.ReenrollmentData{ServiceTag: machine.ServiceTag},
+	})
+	s.publishStatusChange(r.Context(), machine, models.StatusDecommissioned, "")
+
+	respondJSON(w, http.StatusOK, machine)
+}
+
+// handleListStaleMachines reports machines not seen for more than ?days=N
+// days (default 30), oldest first. These are candidates for decommissioning.
+func (s *Server) handleListStaleMachines(w http.ResponseWriter, r *http.Request) {
+	days := defaultStaleDays
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		d, err := strconv.Atoi(daysStr)
+		if err != nil || d <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "days must be a positive integer")
+			return
+		}
+		days = d
+	}
+
+	machines, err := s.db.ListMachineSummaries(database.MachineFilter{VisibleTo: visibleTo(r)})
+	if err != nil {
+		respondInternalError(w, err, "failed to list machines")
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	stale := []*models.MachineSummary{}
+	for _, m := range machines {
+		if m.Status == models.StatusDecommissioned {
+			continue
+		}
+		if lastSeen(m).Before(cutoff) {
+			stale = append(stale, m)
+		}
+	}
+
+	sort.Slice(stale, func(i, j int) bool {
+		return lastSeen(stale[i]).Before(lastSeen(stale[j]))
+	})
+
+	respondJSON(w, http.StatusOK, stale)
+}
+
+// lastSeen is when the machine last contacted the server, or when it
+// enrolled if it never has since
+func lastSeen(m *models.MachineSummary) time.Time {
+	if m.LastSeenAt != nil {
+		return *m.LastSeenAt
+	}
+	return m.EnrolledAt
+}
+
+// StartDecommissionPurger deletes decommissioned machines once they have been
+// decommissioned for longer than retention
+func (s *Server) StartDecommissionPurger(retention time.Duration) {
+	go func() {
+		log.Printf("Decommission purger started (retention: %s)", retention)
+
+		ticker := time.NewTicker(decommissionPurgeTick)
+		defer ticker.Stop()
+
+		for {
+			if s.leadJob("decommission-purger", decommissionPurgeTick) {
+				s.purgeDecommissioned(retention)
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// purgeDecommissioned deletes machines decommissioned longer than retention
+// ago
+func (s *Server) purgeDecommissioned(retention time.Duration) {
+	purged, err := s.db.PurgeDecommissionedMachines(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Decommission purger failed: %v", err)
+	}
+	if len(purged) > 0 {
+		s.removeUnusedAttachments()
+	}
+	for _, id := range purged {
+		log.Printf("Deleted decommissioned machine %s after retention period", id)
+		s.publish(context.Background(), events.Event{
+			Type:      events.MachineDeleted,
+			MachineID: id,
+			Data: events.DeletedData{
+				Permanent: true,
+				Reason:    "decommission retention expired",
+			},
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// deployBlocker returns why a machine can't be deployed to, or "" if it can.
+// Deployments need an SSH target and a machine that is in service.
+func deployBlocker(machine *models.Machine) string {
+	if !machine.CanProvision() {
+		return "machine is " + string(machine.Status)
+	}
+	if machine.SSHAddress == "" {
+		return "machine has no ssh_address"
+	}
+	return ""
+}
+
+// validHealthCheck responds with 400 and returns false if a requested
+// health check is incomplete
+func validHealthCheck(w http.ResponseWriter, check *models.HealthCheck) bool {
+	if check == nil {
+		return true
+	}
+	if err := check.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// handleDeployMachine queues a deployment of a successful build to a running
+// machine. The builder copies the system closure over SSH and switches to it.
+func (s *Server) handleDeployMachine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	// The body is optional
+	var req models.DeployRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+	if !validHealthCheck(w, req.HealthCheck) {
+		return
+	}
+
+	if reason := deployBlocker(machine); reason != "" {
+		respondError(w, http.StatusConflict, CodeConflict, reason)
+		return
+	}
+
+	var build *models.BuildRequest
+	if req.BuildID != "" {
+		build, err = s.db.GetBuild(req.BuildID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if build == nil || build.MachineID != machine.ID {
+			respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
+			return
+		}
+		if build.Status != "success" {
+			respondError(w, http.StatusConflict, CodeConflict, "build has not succeeded")
+			return
+		}
+	} else {
+		build, err = s.db.GetLatestSuccessfulBuild(machine.ID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if build == nil {
+			respondError(w, http.StatusConflict, CodeConflict, "machine has no successful build")
+			return
+		}
+	}
+
+	if !s.checkMaintenance(w, r, []string{machine.ID}, models.MaintenanceOpDeploy) {
+		return
+	}
+
+	active, err := s.db.GetActiveDeployment(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if active != nil {
+		respondError(w, http.StatusConflict, CodeConflict, "machine already has a deployment in progress")
+		return
+	}
+
+	deployment := &models.Deployment{
+		MachineID:   machine.ID,
+		BuildID:     build.ID,
+		Status:      models.DeploymentPending,
+		HealthCheck: req.HealthCheck,
+	}
+	if claims, ok := auth.GetClaims(r); ok {
+		deployment.CreatedBy = claims.Username
+	}
+
+	if err := s.db.CreateDeployment(deployment); err != nil {
+		respondInternalError(w, err, "failed to create deployment")
+		return
+	}
+
+	log.Printf("Deployment requested for machine %s: deployment_id=%s build_id=%s", machine.ID, deployment.ID, build.ID)
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineDeployRequested,
+		MachineID: machine.ID,
+		Data: events.DeployRequestedData{
+			DeploymentID: deployment.ID,
+			BuildID:      build.ID,
+		},
+	})
+
+	respondJSON(w, http.StatusCreated, deployment)
+}
+
+// handleListDeployments lists a machine's deployments, newest first
+func (s *Server) handleListDeployments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	machineID := vars["id"]
+
+	deployments, err := s.db.ListDeployments(machineID)
+	if err != nil {
+		respondInternalError(w, err, "failed to list deployments")
+		return
+	}
+
+	if deployments == nil {
+		deployments = []*models.Deployment{}
+	}
+
+	respondJSON(w, http.StatusOK, deployments)
+}
+
+// handleGetDeployment retrieves a deployment, including its log
+func (s *Server) handleGetDeployment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	deployment, err := s.db.GetDeployment(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if deployment == nil {
+		respondError(w, http.StatusNotFound, CodeDeploymentNotFound, "deployment not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, deployment)
+}
+
+// handleDeployGroup starts a rolling deployment of each group member's most
+// recent successful build. The builder runs at most max_unavailable of the
+// rollout's deployments at once and cancels the rest if one fails.
+// Machines that can't be deployed to are skipped and listed in the response.
+func (s *Server) handleDeployGroup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["id"]
+
+	group, err := s.db.GetGroup(groupID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if group == nil {
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+		return
+	}
+
+	// The body is optional
+	var req models.GroupDeployRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+	if !validHealthCheck(w, req.HealthCheck) {
+		return
+	}
+
+	if req.MaxUnavailable < 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "max_unavailable must not be negative")
+		return
+	}
+	if req.MaxUnavailable == 0 {
+		req.MaxUnavailable = 1
+	}
+
+	members, err := s.db.GetGroupMachines(groupID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get group machines")
+		return
+	}
+
+	machineIDs := make([]string, len(members))
+	for i, m := range members {
+		machineIDs[i] = m.ID
+	}
+	if !s.checkMaintenance(w, r, machineIDs, models.MaintenanceOpDeploy) {
+		return
+	}
+
+	var createdBy string
+	if claims, ok := auth.GetClaims(r); ok {
+		createdBy = claims.Username
+	}
+
+	response := models.GroupDeployResponse{
+		RolloutID:   uuid.New().String(),
+		Deployments: []*models.Deployment{},
+	}
+	skip := func(machineID, reason string) {
+		response.Skipped = append(response.Skipped, models.SkippedMachine{MachineID: machineID, Reason: reason})
+	}
+
+	for _, member := range members {
+		// Group listings leave out the SSH target
+		machine, err := s.db.GetMachine(member.ID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if machine == nil {
+			continue
+		}
+
+		if reason := deployBlocker(machine); reason != "" {
+			skip(machine.ID, reason)
+			continue
+		}
+
+		build, err := s.db.GetLatestSuccessfulBuild(machine.ID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if build == nil {
+			skip(machine.ID, "machine has no successful build")
+			continue
+		}
+
+		active, err := s.db.GetActiveDeployment(machine.ID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if active != nil {
+			skip(machine.ID, "machine already has a deployment in progress")
+			continue
+		}
+
+		deployment := &models.Deployment{
+			MachineID:      machine.ID,
+			BuildID:        build.ID,
+			Status:         models.DeploymentPending,
+			HealthCheck:    req.HealthCheck,
+			RolloutID:      response.RolloutID,
+			MaxUnavailable: req.MaxUnavailable,
+			CreatedBy:      createdBy,
+		}
+
+		if err := s.db.CreateDeployment(deployment); err != nil {
+			respondInternalError(w, err, "failed to create deployment")
+			return
+		}
+		response.Deployments = append(response.Deployments, deployment)
+
+		s.publish(r.Context(), events.Event{
+			Type:      events.MachineDeployRequested,
+			MachineID: machine.ID,
+			Data: events.DeployRequestedData{
+				DeploymentID: deployment.ID,
+				BuildID:      build.ID,
+				RolloutID:    response.RolloutID,
+			},
+		})
+	}
+
+	log.Printf("Rollout %s started for group %s: %d deployment(s), %d skipped, max unavailable %d",
+		response.RolloutID, group.ID, len(response.Deployments), len(response.Skipped), req.MaxUnavailable)
+
+	respondJSON(w, http.StatusCreated, response)
+}
+
+// handleGetRollout lists the deployments of a group rollout
+func (s *Server) handleGetRollout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	deployments, err := s.db.ListRolloutDeployments(id)
+	if err != nil {
+		respondInternalError(w, err, "failed to list deployments")
+		return
+	}
+
+	if len(deployments) == 0 {
+		respondError(w, http.StatusNotFound, CodeRolloutNotFound, "rollout not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, deployments)
+}
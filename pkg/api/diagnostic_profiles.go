@@ -0,0 +1,181 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleCreateDiagnosticProfile creates a diagnostic profile
+func (s *Server) handleCreateDiagnosticProfile(w http.ResponseWriter, r *http.Request) {
+	var profile models.DiagnosticProfile
+	if !decodeJSON(w, r, &profile) {
+		return
+	}
+
+	if err := profile.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if !s.checkDiagnosticProfileAssets(w, &profile) {
+		return
+	}
+
+	existing, err := s.db.GetDiagnosticProfileByName(profile.Name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if existing != nil {
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "diagnostic profile with this name already exists")
+		return
+	}
+
+	if err := s.db.CreateDiagnosticProfile(&profile); err != nil {
+		respondInternalError(w, err, "failed to create diagnostic profile")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, profile)
+}
+
+// handleListDiagnosticProfiles lists all diagnostic profiles by name
+func (s *Server) handleListDiagnosticProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := s.db.ListDiagnosticProfiles()
+	if err != nil {
+		respondInternalError(w, err, "failed to list diagnostic profiles")
+		return
+	}
+
+	if profiles == nil {
+		profiles = []*models.DiagnosticProfile{}
+	}
+
+	respondJSON(w, http.StatusOK, profiles)
+}
+
+// handleGetDiagnosticProfile retrieves a single diagnostic profile
+func (s *Server) handleGetDiagnosticProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.diagnosticProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, profile)
+}
+
+// handleUpdateDiagnosticProfile updates a diagnostic profile. Machines in
+// diagnostics keep booting what the profile was when they started.
+func (s *Server) handleUpdateDiagnosticProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.diagnosticProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	var updates models.UpdateDiagnosticProfileRequest
+	if !decodeJSON(w, r, &updates) {
+		return
+	}
+
+	if updates.Name != "" && updates.Name != profile.Name {
+		existing, err := s.db.GetDiagnosticProfileByName(updates.Name)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if existing != nil {
+			respondError(w, http.StatusConflict, CodeAlreadyExists, "diagnostic profile with this name already exists")
+			return
+		}
+		profile.Name = updates.Name
+	}
+	if updates.Description != nil {
+		profile.Description = *updates.Description
+	}
+	if updates.KernelAssetID != "" {
+		profile.KernelAssetID = updates.KernelAssetID
+	}
+	if updates.InitrdAssetID != nil {
+		profile.InitrdAssetID = *updates.InitrdAssetID
+	}
+	if updates.Cmdline != nil {
+		profile.Cmdline = *updates.Cmdline
+	}
+
+	if err := profile.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if !s.checkDiagnosticProfileAssets(w, profile) {
+		return
+	}
+
+	if err := s.db.UpdateDiagnosticProfile(profile); err != nil {
+		respondInternalError(w, err, "failed to update diagnostic profile")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, profile)
+}
+
+// handleDeleteDiagnosticProfile deletes a diagnostic profile. Machines in
+// its diagnostics stay there until their runs end.
+func (s *Server) handleDeleteDiagnosticProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.diagnosticProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	if err := s.db.DeleteDiagnosticProfile(profile.ID); err != nil {
+		respondInternalError(w, err, "failed to delete diagnostic profile")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// diagnosticProfile looks up the diagnostic profile of a request. It
+// responds with an error and returns nil if there is no such profile.
+func (s *Server) diagnosticProfile(w http.ResponseWriter, r *http.Request) *models.DiagnosticProfile {
+	profile, err := s.db.GetDiagnosticProfile(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if profile == nil {
+		respondError(w, http.StatusNotFound, CodeDiagnosticProfileNotFound, "diagnostic profile not found")
+		return nil
+	}
+	return profile
+}
+
+// checkDiagnosticProfileAssets checks that a profile's kernel and initrd
+// are boot assets of those kinds. It responds with an error and returns
+// false if not.
+func (s *Server) checkDiagnosticProfileAssets(w http.ResponseWriter, profile *models.DiagnosticProfile) bool {
+	for _, ref := range []struct {
+		field, id, kind string
+	}{
+		{"kernel_asset_id", profile.KernelAssetID, models.BootAssetKernel},
+		{"initrd_asset_id", profile.InitrdAssetID, models.BootAssetInitrd},
+	} {
+		if ref.id == "" {
+			continue
+		}
+		asset, err := s.db.GetBootAsset(ref.id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return false
+		}
+		if asset == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, ref.field+" is not a boot asset")
+			return false
+		}
+		if asset.Kind != ref.kind {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, ref.field+" must be an asset of kind "+ref.kind)
+			return false
+		}
+	}
+	return true
+}
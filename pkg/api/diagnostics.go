@@ -0,0 +1,347 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+const diagnosticsWatchdogTick = time.Minute
+
+// handleStartDiagnostics boots a machine into a diagnostic profile for a
+// while, with a boot override that expires when the run ends. With
+// power_cycle, the machine is set to boot from the network once and power
+// cycled through its BMC, and power cycled again when the run ends.
+func (s *Server) handleStartDiagnostics(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	var req models.StartDiagnosticsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := req.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if !machine.CanProvision() || machine.Status == models.StatusBuilding {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("machine is %s", machine.Status))
+		return
+	}
+
+	profile, err := s.db.GetDiagnosticProfile(req.ProfileID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if profile == nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "profile_id is not a diagnostic profile")
+		return
+	}
+
+	if req.PowerCycle {
+		if machine.BMCInfo == nil || !machine.BMCInfo.Enabled {
+			respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "power_cycle needs the machine's BMC")
+			return
+		}
+		if !s.checkMaintenance(w, r, []string{machine.ID}, models.MaintenanceOpPower) {
+			return
+		}
+	}
+
+	// An override that has run out doesn't stand in the way
+	if _, err := s.activeBootOverride(r.Context(), machine.ID); err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	run := &models.DiagnosticRun{
+		MachineID:   machine.ID,
+		ProfileID:   profile.ID,
+		ProfileName: profile.Name,
+		PowerCycle:  req.PowerCycle,
+		RequestedBy: "system",
+		EndsAt:      time.Now().Add(time.Duration(req.DurationMinutes) * time.Minute),
+	}
+	if claims, ok := auth.GetClaims(r); ok {
+		run.RequestedBy = claims.Username
+	}
+	override := &models.BootOverride{
+		MachineID:     machine.ID,
+		KernelAssetID: profile.KernelAssetID,
+		InitrdAssetID: profile.InitrdAssetID,
+		Cmdline:       profile.Cmdline,
+		ExpiresAt:     &run.EndsAt,
+		CreatedBy:     run.RequestedBy,
+	}
+
+	started, err := s.db.StartDiagnosticRun(run, override)
+	if err != nil {
+		respondInternalError(w, err, "failed to start diagnostics")
+		return
+	}
+	if !started {
+		respondError(w, http.StatusConflict, CodeConflict, "machine already has diagnostics running or a boot override")
+		return
+	}
+
+	log.Printf("Diagnostics %s (%s) started on machine %s until %s", run.ID, profile.Name, machine.ID, run.EndsAt.Format(time.RFC3339))
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineDiagnosticsStarted,
+		MachineID: machine.ID,
+		Data: events.DiagnosticsStartedData{
+			RunID:       run.ID,
+			Profile:     run.ProfileName,
+			EndsAt:      run.EndsAt,
+			PowerCycle:  run.PowerCycle,
+			RequestedBy: run.RequestedBy,
+		},
+	})
+
+	if run.PowerCycle {
+		go s.diagnosticsPowerCycle(machine, run.RequestedBy, true)
+	}
+
+	respondJSON(w, http.StatusCreated, run)
+}
+
+// handleListDiagnostics lists a machine's diagnostic runs, newest first
+func (s *Server) handleListDiagnostics(w http.ResponseWriter, r *http.Request) {
+	runs, err := s.db.ListDiagnosticRuns(mux.Vars(r)["id"], 0)
+	if err != nil {
+		respondInternalError(w, err, "failed to list diagnostic runs")
+		return
+	}
+
+	if runs == nil {
+		runs = []*models.DiagnosticRun{}
+	}
+
+	respondJSON(w, http.StatusOK, runs)
+}
+
+// handleGetDiagnosticRun returns a single diagnostic run
+func (s *Server) handleGetDiagnosticRun(w http.ResponseWriter, r *http.Request) {
+	run := s.diagnosticRun(w, r)
+	if run == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, run)
+}
+
+// handleDiagnosticResults records the results the diagnostics image posts
+// when it is done, and boots the machine back out of diagnostics
+func (s *Server) handleDiagnosticResults(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !s.jwtManager.ValidateDiagnosticsToken(mux.Vars(r)["run_id"], token) {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid diagnostics token")
+		return
+	}
+
+	run := s.diagnosticRun(w, r)
+	if run == nil {
+		return
+	}
+	if run.Status != models.DiagnosticsRunning {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("diagnostic run is already %s", run.Status))
+		return
+	}
+
+	var results models.DiagnosticResults
+	if !decodeJSON(w, r, &results) {
+		return
+	}
+
+	finished, err := s.finishDiagnostics(r.Context(), run, models.DiagnosticsCompleted, &results)
+	if err != nil {
+		respondInternalError(w, err, "failed to record diagnostic results")
+		return
+	}
+	if !finished {
+		respondError(w, http.StatusConflict, CodeConflict, "diagnostic run has already finished")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, run)
+}
+
+// handleGetDiagnosticsToken returns the token the diagnostics image of a
+// running diagnostic run posts its results with, for the iPXE server to put
+// on its kernel command line
+func (s *Server) handleGetDiagnosticsToken(w http.ResponseWriter, r *http.Request) {
+	run := s.diagnosticRun(w, r)
+	if run == nil {
+		return
+	}
+	if run.Status != models.DiagnosticsRunning {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("diagnostic run is already %s", run.Status))
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"run_id": run.ID, "token": s.jwtManager.GenerateDiagnosticsToken(run.ID)})
+}
+
+// handleCancelDiagnostics ends a machine's running diagnostics early
+func (s *Server) handleCancelDiagnostics(w http.ResponseWriter, r *http.Request) {
+	run, err := s.db.GetActiveDiagnosticRun(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if run == nil {
+		respondError(w, http.StatusNotFound, CodeDiagnosticRunNotFound, "machine has no diagnostics running")
+		return
+	}
+
+	finished, err := s.finishDiagnostics(r.Context(), run, models.DiagnosticsCancelled, nil)
+	if err != nil {
+		respondInternalError(w, err, "failed to cancel diagnostics")
+		return
+	}
+	if !finished {
+		respondError(w, http.StatusConflict, CodeConflict, "diagnostic run has already finished")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, run)
+}
+
+// diagnosticRun looks up the diagnostic run of a request. It responds with
+// an error and returns nil if the machine has no such run.
+func (s *Server) diagnosticRun(w http.ResponseWriter, r *http.Request) *models.DiagnosticRun {
+	vars := mux.Vars(r)
+
+	run, err := s.db.GetDiagnosticRun(vars["run_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if run == nil || run.MachineID != vars["id"] {
+		respondError(w, http.StatusNotFound, CodeDiagnosticRunNotFound, "diagnostic run not found")
+		return nil
+	}
+	return run
+}
+
+// finishDiagnostics ends a running diagnostic run: it clears the boot
+// override the run set, unless it has been replaced, and power cycles the
+// machine back into what it normally boots if the run power cycled it into
+// diagnostics. It returns false if the run had already finished.
+func (s *Server) finishDiagnostics(ctx context.Context, run *models.DiagnosticRun, status string, results *models.DiagnosticResults) (bool, error) {
+	run.Status = status
+	run.Results = results
+	finished, err := s.db.FinishDiagnosticRun(run)
+	if err != nil || !finished {
+		return false, err
+	}
+
+	cleared, err := s.db.ClearDiagnosticBootOverride(run.MachineID, run.ID)
+	if err != nil {
+		log.Printf("Failed to clear diagnostics boot override of machine %s: %v", run.MachineID, err)
+	} else if cleared {
+		s.publishBootOverrideCleared(ctx, run.MachineID, overrideDiagnosticsEnded)
+	}
+
+	log.Printf("Diagnostics %s on machine %s %s", run.ID, run.MachineID, run.Status)
+	s.publish(ctx, events.Event{
+		Type:      events.MachineDiagnosticsFinished,
+		MachineID: run.MachineID,
+		Data: events.DiagnosticsFinishedData{
+			RunID:   run.ID,
+			Profile: run.ProfileName,
+			Status:  run.Status,
+			Results: run.Results,
+		},
+	})
+
+	if run.PowerCycle {
+		machine, err := s.db.GetMachine(run.MachineID)
+		if err != nil || machine == nil {
+			log.Printf("Failed to get machine %s to power cycle it out of diagnostics: %v", run.MachineID, err)
+		} else if machine.BMCInfo != nil && machine.BMCInfo.Enabled {
+			go s.diagnosticsPowerCycle(machine, "system", false)
+		}
+	}
+
+	return true, nil
+}
+
+// diagnosticsPowerCycle power cycles a machine through its BMC into or out
+// of diagnostics, recording it as a power operation. Into diagnostics, the
+// machine is first set to boot from the network once.
+func (s *Server) diagnosticsPowerCycle(machine *models.Machine, initiatedBy string, pxe bool) {
+	op := &models.PowerOperation{
+		MachineID:   machine.ID,
+		Operation:   string(ipmi.PowerCycle),
+		Method:      models.PowerMethodBMC,
+		Status:      "pending",
+		InitiatedBy: initiatedBy,
+	}
+	if err := s.db.CreatePowerOperation(op); err != nil {
+		log.Printf("Failed to create power operation for machine %s: %v", machine.ID, err)
+		return
+	}
+
+	controller := s.powerController()
+	var err error
+	if pxe {
+		err = controller.SetNextBootPXE(machine.BMCInfo)
+	}
+	if err == nil {
+		op.Result, err = controller.PowerCycle(machine.BMCInfo)
+	}
+
+	now := time.Now()
+	op.CompletedAt = &now
+	if err != nil {
+		op.Status = "failed"
+		op.Error = err.Error()
+	} else {
+		op.Status = "success"
+	}
+
+	s.finishPowerOperation(op)
+	s.publishPowerOperation(op)
+}
+
+// StartDiagnosticsWatchdog ends diagnostic runs whose time has run out
+// without results
+func (s *Server) StartDiagnosticsWatchdog() {
+	go func() {
+		log.Printf("Diagnostics watchdog started")
+
+		ticker := time.NewTicker(diagnosticsWatchdogTick)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !s.leadJob("diagnostics-watchdog", diagnosticsWatchdogTick) {
+				continue
+			}
+
+			runs, err := s.db.ListEndedDiagnosticRuns(time.Now())
+			if err != nil {
+				log.Printf("Diagnostics watchdog failed to list runs: %v", err)
+				continue
+			}
+
+			for _, run := range runs {
+				if _, err := s.finishDiagnostics(context.Background(), run, models.DiagnosticsExpired, nil); err != nil {
+					log.Printf("Failed to end diagnostics %s: %v", run.ID, err)
+				}
+			}
+		}
+	}()
+}
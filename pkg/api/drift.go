@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/drift"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleGetGroupDrift compares the members of a group: it clusters them by
+// normalized configuration and lists the machines whose configuration,
+// hardware, or build state differs from what most of the group has.
+// Hardware tolerances are taken from the query string.
+func (s *Server) handleGetGroupDrift(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	opts, err := drift.ParseOptions(r.URL.Query())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	report, err := drift.CheckGroup(s.db, id, opts)
+	if err != nil {
+		respondInternalError(w, err, "failed to compare group machines")
+		return
+	}
+	if report == nil {
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+		return
+	}
+
+	// Viewers don't see machines other users have claimed
+	if userID := visibleTo(r); userID != "" {
+		hidden, err := s.db.HiddenMachineIDs(userID)
+		if err != nil {
+			respondInternalError(w, err, "failed to list claimed machines")
+			return
+		}
+		hideDriftMachines(report, hidden)
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// hideDriftMachines removes hidden machines from a drift report
+func hideDriftMachines(report *models.GroupDrift, hidden map[string]bool) {
+	clusters := []models.ConfigCluster{}
+	count := 0
+	for _, cluster := range report.Clusters {
+		var ids []string
+		for _, id := range cluster.MachineIDs {
+			if !hidden[id] {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			cluster.MachineIDs = ids
+			clusters = append(clusters, cluster)
+			count += len(ids)
+		}
+	}
+
+	outliers := []models.DriftOutlier{}
+	for _, outlier := range report.Outliers {
+		if hidden[outlier.MachineID] {
+			continue
+		}
+		if hidden[outlier.CompareWith] {
+			outlier.CompareWith = ""
+		}
+		outliers = append(outliers, outlier)
+	}
+
+	report.Clusters = clusters
+	report.Outliers = outliers
+	report.MachineCount = count
+}
+
+// handleCompareMachines diffs two machines' normalized configurations,
+// hardware, and build state
+func (s *Server) handleCompareMachines(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	opts, err := drift.ParseOptions(r.URL.Query())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	var profiles []*drift.Profile
+	for _, id := range []string{vars["id"], vars["other_id"]} {
+		machine, err := s.db.GetMachine(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if machine == nil {
+			respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine "+id+" not found")
+			return
+		}
+
+		profile, err := drift.LoadProfile(s.db, machine, opts)
+		if err != nil {
+			respondInternalError(w, err, "failed to load machine build")
+			return
+		}
+		profiles = append(profiles, profile)
+	}
+
+	respondJSON(w, http.StatusOK, drift.Compare(profiles[0], profiles[1], opts))
+}
@@ -0,0 +1,169 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// loadEnrollments is how many machines enroll at once in the load test, a
+// few racks powering on together
+const loadEnrollments = 200
+
+// enrollResult is how one enrollment of the load test was answered
+type enrollResult struct {
+	status     int
+	retryAfter string
+	latency    time.Duration
+	err        error
+}
+
+// TestEnrollmentLoad sends 200 enrollments at once against SQLite, through
+// a queue smaller than the defaults, with a webhook receiver that never
+// answers. Every enrollment is answered within the queue timeout, with 201
+// or with 503 and a Retry-After to spread the retries, and retrying those
+// turned away enrolls every machine once.
+func TestEnrollmentLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test; skipped with -short")
+	}
+
+	const queueTimeout = 2 * time.Second
+	env := testutil.New(t, func(config *api.Config) {
+		config.EnrollConcurrency = 4
+		config.EnrollQueueDepth = 16
+		config.EnrollQueueTimeout = queueTimeout
+	})
+
+	// A receiver that holds every delivery until the test ends, which must
+	// not hold the enrollments that caused them
+	hung := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	t.Cleanup(func() { close(hung) })
+	env.MustJSON(models.RoleAdmin, http.MethodPost, "/api/v1/webhooks", models.Webhook{
+		Name:                 "hung",
+		URL:                  receiver.URL,
+		Events:               []string{events.MachineEnrolled},
+		Active:               true,
+		AllowPrivateNetworks: true,
+	}, http.StatusCreated, nil)
+
+	client := env.Server.Client()
+	enroll := func(serviceTag string) enrollResult {
+		body, err := json.Marshal(models.EnrollmentRequest{
+			ServiceTag: serviceTag,
+			MACAddress: testutil.FixtureMAC(serviceTag),
+			Hardware:   testutil.FixtureHardware(serviceTag),
+		})
+		if err != nil {
+			return enrollResult{err: err}
+		}
+		start := time.Now()
+		resp, err := client.Post(env.URL("/api/v1/enroll"), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return enrollResult{err: err}
+		}
+		resp.Body.Close()
+		return enrollResult{status: resp.StatusCode, retryAfter: resp.Header.Get("Retry-After"), latency: time.Since(start)}
+	}
+
+	tags := make([]string, loadEnrollments)
+	for i := range tags {
+		tags[i] = fmt.Sprintf("LOAD%04d", i)
+	}
+	results := make([]enrollResult, len(tags))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		wg.Add(1)
+		go func(i int, tag string) {
+			defer wg.Done()
+			<-start
+			results[i] = enroll(tag)
+		}(i, tag)
+	}
+	close(start)
+	wg.Wait()
+
+	var enrolled, overloaded int
+	var latencies []time.Duration
+	var retry []string
+	for i, result := range results {
+		if result.err != nil {
+			t.Fatalf("%s: %v", tags[i], result.err)
+		}
+		latencies = append(latencies, result.latency)
+		switch result.status {
+		case http.StatusCreated:
+			enrolled++
+		case http.StatusServiceUnavailable:
+			overloaded++
+			retry = append(retry, tags[i])
+			if seconds, err := strconv.Atoi(result.retryAfter); err != nil || seconds < 5 || seconds > 10 {
+				t.Errorf("%s: Retry-After %q, want 5 to 10 seconds", tags[i], result.retryAfter)
+			}
+		default:
+			t.Errorf("%s: status %d, want 201 or 503", tags[i], result.status)
+		}
+	}
+
+	// Waiting is bounded by the queue timeout, and the enrollment itself
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	median, slowest := latencies[len(latencies)/2], latencies[len(latencies)-1]
+	t.Logf("%d enrolled, %d turned away; latency median %s, slowest %s", enrolled, overloaded, median, slowest)
+	if limit := queueTimeout + 3*time.Second; slowest > limit {
+		t.Errorf("slowest enrollment took %s, want under %s", slowest, limit)
+	}
+	if enrolled < 4 {
+		t.Errorf("%d enrollments admitted, want at least the 4 that run at once", enrolled)
+	}
+
+	// Agents retry those turned away, which enrolls them; the test doesn't
+	// wait out their Retry-After
+	for len(retry) > 0 {
+		tag := retry[0]
+		switch result := enroll(tag); {
+		case result.err != nil:
+			t.Fatalf("%s: %v", tag, result.err)
+		case result.status == http.StatusCreated:
+			retry = retry[1:]
+		case result.status == http.StatusServiceUnavailable:
+			time.Sleep(10 * time.Millisecond)
+		default:
+			t.Fatalf("%s: retry answered %d", tag, result.status)
+		}
+	}
+
+	machines, err := env.DB.ListMachines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, machine := range machines {
+		if seen[machine.ServiceTag] {
+			t.Errorf("%s enrolled twice", machine.ServiceTag)
+		}
+		seen[machine.ServiceTag] = true
+	}
+	if len(seen) != loadEnrollments {
+		t.Errorf("%d machines enrolled, want %d", len(seen), loadEnrollments)
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Enrollment admission defaults. A rack powering on at once sends dozens
+// of enrollments together; beyond what the database keeps up with, making
+// agents wait longer only makes them time out and send the work again.
+const (
+	defaultEnrollConcurrency  = 8
+	defaultEnrollQueueDepth   = 64
+	defaultEnrollQueueTimeout = 10 * time.Second
+
+	// enrollRetryAfter is the least Retry-After that turned away
+	// enrollments are told to wait. Each gets up to as much again at
+	// random, so their retries spread out.
+	enrollRetryAfter = 5 * time.Second
+)
+
+// enrollQueue admits enrollment requests: slots bounds how many run at
+// once, and at most depth more wait for a slot, each for at most timeout
+type enrollQueue struct {
+	slots   chan struct{}
+	depth   int64
+	timeout time.Duration
+	waiting atomic.Int64
+}
+
+func newEnrollQueue(concurrency, depth int, timeout time.Duration) *enrollQueue {
+	return &enrollQueue{
+		slots:   make(chan struct{}, concurrency),
+		depth:   int64(depth),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a slot, and reports whether it got one. It gives up at
+// once when the queue is full, and when the request waited too long or
+// went away.
+func (q *enrollQueue) acquire(ctx context.Context) bool {
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if q.waiting.Add(1) > q.depth {
+		q.waiting.Add(-1)
+		return false
+	}
+	defer q.waiting.Add(-1)
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (q *enrollQueue) release() {
+	<-q.slots
+}
+
+// admitEnrollment runs enrollments through the enrollment queue. Those it
+// turns away get 503 with a Retry-After of enrollRetryAfter plus jitter.
+// The queue depth, enrollments running, and enrollment latency, including
+// the wait, are exported as metrics.
+func (s *Server) admitEnrollment(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		s.metrics.enrollQueueDepth.Inc()
+		admitted := s.enrollQueue.acquire(r.Context())
+		s.metrics.enrollQueueDepth.Dec()
+		if !admitted {
+			s.metrics.enrollments.WithLabelValues("overloaded").Inc()
+			s.metrics.enrollDuration.WithLabelValues(strconv.Itoa(http.StatusServiceUnavailable)).Observe(time.Since(start).Seconds())
+
+			base := int(enrollRetryAfter.Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(base+rand.Intn(base+1)))
+			respondError(w, http.StatusServiceUnavailable, CodeOverloaded, "too many enrollments in progress; retry later")
+			return
+		}
+		defer s.enrollQueue.release()
+
+		s.metrics.enrollInFlight.Inc()
+		defer s.metrics.enrollInFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		s.metrics.enrollDuration.WithLabelValues(strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueServer returns a server with just the enrollment queue and metrics,
+// and a handler behind admitEnrollment that holds each enrollment until
+// release is closed
+func queueServer(concurrency, depth int, timeout time.Duration) (*Server, http.HandlerFunc, chan struct{}) {
+	s := &Server{
+		metrics:     newServerMetrics(),
+		enrollQueue: newEnrollQueue(concurrency, depth, timeout),
+	}
+	release := make(chan struct{})
+	handler := s.admitEnrollment(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	return s, handler, release
+}
+
+// enroll sends an enrollment through handler in the background
+func enroll(handler http.HandlerFunc, wg *sync.WaitGroup) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", nil))
+	}()
+	return rec
+}
+
+// metricValue returns the value of a gauge, or the count of a counter with
+// label set to value, from the server's registry
+func metricValue(t *testing.T, s *Server, name, label, value string) float64 {
+	t.Helper()
+
+	families, err := s.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if label == "" {
+				return metric.GetGauge().GetValue()
+			}
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// waitForGauge waits for a gauge to reach want, or fails the test
+func waitForGauge(t *testing.T, s *Server, name string, want float64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for metricValue(t, s, name, "", "") != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v, want %v", name, metricValue(t, s, name, "", ""), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEnrollQueueOverload(t *testing.T) {
+	s, handler, release := queueServer(1, 1, time.Minute)
+	var wg sync.WaitGroup
+
+	// One enrollment runs and one waits for its turn
+	running := enroll(handler, &wg)
+	waitForGauge(t, s, "metal_enrollment_enroll_in_flight", 1)
+	waiting := enroll(handler, &wg)
+	waitForGauge(t, s, "metal_enrollment_enroll_queue_depth", 1)
+
+	// Any more are turned away at once, told to retry in 5 to 10 seconds
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("enrollment beyond the queue: status = %d, want 503", rec.Code)
+		}
+		retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		if err != nil || retryAfter < 5 || retryAfter > 10 {
+			t.Errorf("Retry-After = %q, want 5 to 10 seconds", rec.Header().Get("Retry-After"))
+		}
+	}
+	if got := metricValue(t, s, "metal_enrollment_enrollments_total", "result", "overloaded"); got != 20 {
+		t.Errorf("overloaded enrollments = %v, want 20", got)
+	}
+
+	// The gauges count the two enrollments admitted until they are done
+	if got := metricValue(t, s, "metal_enrollment_enroll_in_flight", "", ""); got != 1 {
+		t.Errorf("in flight = %v, want 1", got)
+	}
+	close(release)
+	wg.Wait()
+	for _, rec := range []*httptest.ResponseRecorder{running, waiting} {
+		if rec.Code != http.StatusCreated {
+			t.Errorf("admitted enrollment: status = %d, want 201", rec.Code)
+		}
+	}
+	for _, name := range []string{"metal_enrollment_enroll_in_flight", "metal_enrollment_enroll_queue_depth"} {
+		if got := metricValue(t, s, name, "", ""); got != 0 {
+			t.Errorf("%s after the enrollments = %v, want 0", name, got)
+		}
+	}
+}
+
+func TestEnrollQueueTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	s, handler, release := queueServer(1, 4, timeout)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(release)
+
+	enroll(handler, &wg)
+	waitForGauge(t, s, "metal_enrollment_enroll_in_flight", 1)
+
+	// An enrollment that waits too long for a turn is turned away
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("timed out enrollment: status = %d, Retry-After %q; want 503 with one", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if waited := time.Since(start); waited < timeout {
+		t.Errorf("gave up after %s, before the %s timeout", waited, timeout)
+	}
+	if got := metricValue(t, s, "metal_enrollment_enroll_queue_depth", "", ""); got != 0 {
+		t.Errorf("queue depth after the timeout = %v, want 0", got)
+	}
+}
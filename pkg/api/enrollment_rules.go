@@ -0,0 +1,183 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleCreateEnrollmentRule creates an enrollment rule. Rules are enabled
+// unless the request says otherwise.
+func (s *Server) handleCreateEnrollmentRule(w http.ResponseWriter, r *http.Request) {
+	rule := models.EnrollmentRule{Enabled: true}
+	if !decodeJSON(w, r, &rule) {
+		return
+	}
+
+	if !s.checkEnrollmentRule(w, "", &rule) {
+		return
+	}
+
+	if err := s.db.CreateEnrollmentRule(&rule); err != nil {
+		respondInternalError(w, err, "failed to create enrollment rule")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, rule)
+}
+
+// handleListEnrollmentRules lists all enrollment rules in the order they
+// are evaluated
+func (s *Server) handleListEnrollmentRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.db.ListEnrollmentRules()
+	if err != nil {
+		respondInternalError(w, err, "failed to list enrollment rules")
+		return
+	}
+
+	if rules == nil {
+		rules = []*models.EnrollmentRule{}
+	}
+
+	respondJSON(w, http.StatusOK, rules)
+}
+
+// handleGetEnrollmentRule retrieves a single enrollment rule
+func (s *Server) handleGetEnrollmentRule(w http.ResponseWriter, r *http.Request) {
+	rule := s.enrollmentRule(w, r)
+	if rule == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rule)
+}
+
+// handleUpdateEnrollmentRule replaces an enrollment rule. Machines it
+// already placed are left as they are.
+func (s *Server) handleUpdateEnrollmentRule(w http.ResponseWriter, r *http.Request) {
+	existing := s.enrollmentRule(w, r)
+	if existing == nil {
+		return
+	}
+
+	rule := models.EnrollmentRule{Enabled: existing.Enabled}
+	if !decodeJSON(w, r, &rule) {
+		return
+	}
+
+	if !s.checkEnrollmentRule(w, existing.ID, &rule) {
+		return
+	}
+
+	rule.ID = existing.ID
+	rule.CreatedAt = existing.CreatedAt
+
+	if err := s.db.UpdateEnrollmentRule(&rule); err != nil {
+		respondInternalError(w, err, "failed to update enrollment rule")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rule)
+}
+
+// handleDeleteEnrollmentRule deletes an enrollment rule
+func (s *Server) handleDeleteEnrollmentRule(w http.ResponseWriter, r *http.Request) {
+	rule := s.enrollmentRule(w, r)
+	if rule == nil {
+		return
+	}
+
+	if err := s.db.DeleteEnrollmentRule(rule.ID); err != nil {
+		respondInternalError(w, err, "failed to delete enrollment rule")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTestEnrollmentRules reports what the enrollment rules would do
+// with a sample enrollment request, without enrolling anything
+func (s *Server) handleTestEnrollmentRules(w http.ResponseWriter, r *http.Request) {
+	var req models.EnrollmentRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	test, err := s.service.TestEnrollmentRules(req)
+	if err != nil {
+		respondServiceError(w, err, "failed to test enrollment rules")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, test)
+}
+
+// enrollmentRule looks up the enrollment rule of a request. It responds
+// with an error and returns nil if there is no such rule.
+func (s *Server) enrollmentRule(w http.ResponseWriter, r *http.Request) *models.EnrollmentRule {
+	rule, err := s.db.GetEnrollmentRule(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if rule == nil {
+		respondError(w, http.StatusNotFound, CodeEnrollmentRuleNotFound, "enrollment rule not found")
+		return nil
+	}
+	return rule
+}
+
+// checkEnrollmentRule validates a rule, and checks that its name is free
+// and that its groups and template exist. It responds with an error and
+// returns false if not.
+func (s *Server) checkEnrollmentRule(w http.ResponseWriter, ruleID string, rule *models.EnrollmentRule) bool {
+	if err := rule.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return false
+	}
+
+	existing, err := s.db.GetEnrollmentRuleByName(rule.Name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return false
+	}
+	if existing != nil && existing.ID != ruleID {
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "enrollment rule with this name already exists")
+		return false
+	}
+
+	seen := make(map[string]bool, len(rule.GroupIDs))
+	for _, id := range rule.GroupIDs {
+		if seen[id] {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("group %q is listed twice", id))
+			return false
+		}
+		seen[id] = true
+
+		group, err := s.db.GetGroup(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return false
+		}
+		if group == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("group %q not found", id))
+			return false
+		}
+	}
+
+	if rule.TemplateID != "" {
+		template, err := s.db.GetTemplate(rule.TemplateID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return false
+		}
+		if template == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("template %q not found", rule.TemplateID))
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/google/uuid"
+)
+
+// ErrorCode identifies the kind of failure in an error response
+type ErrorCode string
+
+// Error codes returned by the API
+const (
+	CodeInvalidRequest       ErrorCode = "invalid_request"
+	CodeUnauthorized         ErrorCode = "unauthorized"
+	CodeInvalidCredentials   ErrorCode = "invalid_credentials"
+	CodeForbidden            ErrorCode = "forbidden"
+	CodeNotFound             ErrorCode = "not_found"
+	CodeMethodNotAllowed     ErrorCode = "method_not_allowed"
+	CodeConflict             ErrorCode = "conflict"
+	CodeAlreadyExists        ErrorCode = "already_exists"
+	CodeBodyTooLarge         ErrorCode = "body_too_large"
+	CodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	CodeMaintenanceWindow    ErrorCode = "maintenance_window"
+	CodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	CodeRateLimited          ErrorCode = "rate_limited"
+	CodeQuotaExceeded        ErrorCode = "quota_exceeded"
+	CodeOverloaded           ErrorCode = "overloaded"
+	CodeEnrollmentConflict   ErrorCode = "enrollment_conflict"
+	CodeMachineInTrash       ErrorCode = "machine_in_trash"
+	CodeClaimCodeInvalid     ErrorCode = "claim_code_invalid"
+	CodeIdentityMismatch     ErrorCode = "identity_mismatch"
+	CodeHostnameTaken        ErrorCode = "hostname_taken"
+	CodeImpersonating        ErrorCode = "impersonating"
+	CodeConfirmationRequired ErrorCode = "confirmation_required"
+	CodeInternal             ErrorCode = "internal_error"
+
+	CodeMachineNotFound             ErrorCode = "machine_not_found"
+	CodeBuildNotFound               ErrorCode = "build_not_found"
+	CodeBuildLogNotFound            ErrorCode = "build_log_not_found"
+	CodeGroupNotFound               ErrorCode = "group_not_found"
+	CodeTemplateNotFound            ErrorCode = "template_not_found"
+	CodeUserNotFound                ErrorCode = "user_not_found"
+	CodeWebhookNotFound             ErrorCode = "webhook_not_found"
+	CodeNotificationChannelNotFound ErrorCode = "notification_channel_not_found"
+	CodeMaintenanceWindowNotFound   ErrorCode = "maintenance_window_not_found"
+	CodeWipeJobNotFound             ErrorCode = "wipe_job_not_found"
+	CodeImageTestNotFound           ErrorCode = "image_test_not_found"
+	CodeOperationNotFound           ErrorCode = "operation_not_found"
+	CodeMetricsNotFound             ErrorCode = "metrics_not_found"
+	CodeDeploymentNotFound          ErrorCode = "deployment_not_found"
+	CodeRolloutNotFound             ErrorCode = "rollout_not_found"
+	CodeNoteNotFound                ErrorCode = "note_not_found"
+	CodeAttachmentNotFound          ErrorCode = "attachment_not_found"
+	CodeFragmentNotFound            ErrorCode = "fragment_not_found"
+	CodeBootProfileNotFound         ErrorCode = "boot_profile_not_found"
+	CodeBuilderNotFound             ErrorCode = "builder_not_found"
+	CodeSyncReportNotFound          ErrorCode = "sync_report_not_found"
+	CodeBootAssetNotFound           ErrorCode = "boot_asset_not_found"
+	CodeBootOverrideNotFound        ErrorCode = "boot_override_not_found"
+	CodeSystemImageNotFound         ErrorCode = "system_image_not_found"
+	CodeDiagnosticProfileNotFound   ErrorCode = "diagnostic_profile_not_found"
+	CodeDiagnosticRunNotFound       ErrorCode = "diagnostic_run_not_found"
+	CodeBuildScheduleNotFound       ErrorCode = "build_schedule_not_found"
+	CodeEnrollmentRuleNotFound      ErrorCode = "enrollment_rule_not_found"
+	CodeHardwareProfileNotFound     ErrorCode = "hardware_profile_not_found"
+	CodeShareNotFound               ErrorCode = "share_not_found"
+	CodeLintRuleNotFound            ErrorCode = "lint_rule_not_found"
+	CodeArtifactNotFound            ErrorCode = "artifact_not_found"
+	CodeHookRunNotFound             ErrorCode = "hook_run_not_found"
+	CodeQuotaGrantNotFound          ErrorCode = "quota_grant_not_found"
+	CodeSubscriptionNotFound        ErrorCode = "subscription_not_found"
+
+	CodeBMCNotConfigured ErrorCode = "bmc_not_configured"
+	CodeBMCAuthFailed    ErrorCode = "bmc_auth_failed"
+	CodeBMCUnreachable   ErrorCode = "bmc_unreachable"
+	CodeBMCUnsupported   ErrorCode = "bmc_unsupported"
+	CodeBMCError         ErrorCode = "bmc_error"
+	CodeWOLNotConfigured ErrorCode = "wol_not_configured"
+
+	CodeBootServerNotConfigured ErrorCode = "boot_server_not_configured"
+	CodeBootServerError         ErrorCode = "boot_server_error"
+
+	CodeAttachmentsNotConfigured ErrorCode = "attachments_not_configured"
+	CodeBootAssetsNotConfigured  ErrorCode = "boot_assets_not_configured"
+
+	CodeDCIMNotConfigured ErrorCode = "dcim_not_configured"
+
+	CodeLintRulesNotConfigured ErrorCode = "lint_rules_not_configured"
+
+	CodeConfigInvalid    ErrorCode = "config_invalid"
+	CodeConfigLintFailed ErrorCode = "config_lint_failed"
+	CodeBuilderError     ErrorCode = "builder_error"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// validRequestID matches request IDs accepted from clients and proxies
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware gives every request an ID, reusing one set by a proxy
+// in front of the server, and returns it in the X-Request-ID header
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of a request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// respondError writes an error response. The request ID is taken from the
+// response header set by requestIDMiddleware.
+func respondError(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	respondJSON(w, status, models.ErrorResponse{Error: models.APIError{
+		Code:      string(code),
+		Message:   message,
+		RequestID: w.Header().Get(requestIDHeader),
+	}})
+}
+
+// respondInternalError logs err with the request ID and responds with 500.
+// The client only gets message, since err may describe the database.
+func respondInternalError(w http.ResponseWriter, err error, message string) {
+	log.Printf("[%s] %s: %v", w.Header().Get(requestIDHeader), message, err)
+	respondError(w, http.StatusInternalServerError, CodeInternal, message)
+}
+
+// respondBMCError responds with 502 for a failed BMC command, classifying
+// the failure when ipmitool's output allowed it. Errors from the ipmi
+// package have the BMC password redacted, so they are passed on.
+func respondBMCError(w http.ResponseWriter, err error, message string) {
+	code := CodeBMCError
+	switch {
+	case errors.Is(err, ipmi.ErrAuthentication):
+		code = CodeBMCAuthFailed
+	case errors.Is(err, ipmi.ErrUnreachable):
+		code = CodeBMCUnreachable
+	case errors.Is(err, ipmi.ErrUnsupported):
+		code = CodeBMCUnsupported
+	}
+	respondError(w, http.StatusBadGateway, code, message+": "+err.Error())
+}
+
+// respondServiceError responds with why a service operation failed,
+// including building a configuration assembled from fragments. Other
+// errors get a 500 with message.
+func respondServiceError(w http.ResponseWriter, err error, message string) {
+	var invalidReq *service.InvalidError
+	var conflict *service.ConflictError
+	var trashed *service.TrashedError
+	var blocked *service.MaintenanceError
+	var invalidConfig *fragments.InvalidError
+	var builderErr *fragments.BuilderError
+	var hostnameTaken *database.HostnameTakenError
+	var lintFailed *service.LintError
+	var quota *service.QuotaError
+	switch {
+	case errors.Is(err, service.ErrMachineNotFound):
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, err.Error())
+	case errors.Is(err, service.ErrTemplateNotFound):
+		respondError(w, http.StatusNotFound, CodeTemplateNotFound, err.Error())
+	case errors.Is(err, service.ErrBuildNotFound):
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, err.Error())
+	case errors.As(err, &invalidReq):
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+	case errors.As(err, &conflict):
+		respondError(w, http.StatusConflict, CodeConflict, err.Error())
+	case errors.As(err, &trashed):
+		respondError(w, http.StatusConflict, CodeMachineInTrash, err.Error())
+	case errors.As(err, &hostnameTaken):
+		respondError(w, http.StatusConflict, CodeHostnameTaken, err.Error())
+	case errors.As(err, &blocked):
+		respondError(w, http.StatusLocked, CodeMaintenanceWindow, err.Error())
+	case errors.Is(err, fragments.ErrNoConfiguration):
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+	case errors.As(err, &invalidConfig):
+		respondError(w, http.StatusUnprocessableEntity, CodeConfigInvalid, err.Error())
+	case errors.As(err, &lintFailed):
+		respondError(w, http.StatusUnprocessableEntity, CodeConfigLintFailed, err.Error())
+	case errors.As(err, &builderErr):
+		respondError(w, http.StatusBadGateway, CodeBuilderError, err.Error())
+	case errors.As(err, &quota):
+		respondQuotaExceeded(w, quota)
+	default:
+		respondInternalError(w, err, message)
+	}
+}
+
+// respondQuotaExceeded responds with 429 for a used up quota. Like rate
+// limited responses, it carries Retry-After, along with X-Quota-Limit,
+// X-Quota-Remaining, and X-Quota-Reset, the Unix time at which more of the
+// quota is available.
+func respondQuotaExceeded(w http.ResponseWriter, err *service.QuotaError) {
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(err.Limit))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(err.Remaining()))
+	if err.ResetsAt != nil {
+		w.Header().Set("X-Quota-Reset", strconv.FormatInt(err.ResetsAt.Unix(), 10))
+		retry := int(math.Ceil(time.Until(*err.ResetsAt).Seconds()))
+		if retry < 1 {
+			retry = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+	}
+	respondError(w, http.StatusTooManyRequests, CodeQuotaExceeded, err.Error())
+}
+
+// handleNotFound answers requests that match no route
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	respondError(w, http.StatusNotFound, CodeNotFound, "no such endpoint")
+}
+
+// handleMethodNotAllowed answers requests to a route with the wrong method
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" is not allowed here")
+}
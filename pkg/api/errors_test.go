@@ -0,0 +1,122 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+	"github.com/gorilla/mux"
+)
+
+// routeVar matches a variable in a route's path template
+var routeVar = regexp.MustCompile(`\{[^}]+\}`)
+
+// decodeError checks that resp is a JSON error response whose request ID
+// matches the X-Request-ID header and returns its error
+func decodeError(t *testing.T, resp *http.Response) (*models.APIError, bool) {
+	t.Helper()
+
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("%s %s: %d response has Content-Type %q: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, ct, body)
+		return nil, false
+	}
+
+	var errResp models.ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error.Code == "" || errResp.Error.Message == "" {
+		t.Errorf("%s %s: %d response is no error body: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, body)
+		return nil, false
+	}
+	if errResp.Error.RequestID == "" || errResp.Error.RequestID != resp.Header.Get("X-Request-ID") {
+		t.Errorf("%s %s: request_id %q, header %q", resp.Request.Method, resp.Request.URL.Path, errResp.Error.RequestID, resp.Header.Get("X-Request-ID"))
+	}
+	return &errResp.Error, true
+}
+
+// TestRoutesWithBogusIDsRespondWithJSONErrors walks every registered API
+// route, filling its path variables with an ID nothing has, and checks
+// that each failure comes back as a structured JSON error
+func TestRoutesWithBogusIDsRespondWithJSONErrors(t *testing.T) {
+	env := testutil.New(t)
+
+	routes := 0
+	err := env.API.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/v1/") || !routeVar.MatchString(template) {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path := routeVar.ReplaceAllString(template, "does-not-exist")
+		for _, method := range methods {
+			routes++
+			resp := env.Do(models.RoleAdmin, method, path, map[string]interface{}{})
+			if resp.StatusCode >= 400 {
+				decodeError(t, resp)
+			} else if method != http.MethodGet && method != http.MethodDelete {
+				// Nothing can be done to what doesn't exist, though deleting
+				// it is allowed to succeed
+				t.Errorf("%s %s: status %d, want an error", method, template, resp.StatusCode)
+			}
+			resp.Body.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes == 0 {
+		t.Fatal("walked no routes")
+	}
+}
+
+func TestUnknownRouteRespondsWithJSONError(t *testing.T) {
+	env := testutil.New(t)
+
+	resp := env.Do(models.RoleAdmin, http.MethodGet, "/api/v1/no-such-thing", nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d, want 404", resp.StatusCode)
+	}
+	if apiErr, ok := decodeError(t, resp); ok && apiErr.Code != "not_found" {
+		t.Errorf("code %q, want not_found", apiErr.Code)
+	}
+}
+
+func TestBMCRoutesWithoutBMC(t *testing.T) {
+	env := testutil.New(t)
+	machine := env.EnrollMachine("NOBMC1")
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/power"},
+		{http.MethodGet, "/power/status"},
+		{http.MethodPost, "/bmc/test"},
+		{http.MethodGet, "/bmc/info"},
+		{http.MethodGet, "/bmc/sensors"},
+	} {
+		var body interface{}
+		if route.method == http.MethodPost {
+			body = map[string]string{"operation": "on"}
+		}
+		resp := env.Do(models.RoleOperator, route.method, "/api/v1/machines/"+machine.ID+route.path, body)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d, want 400", route.method, route.path, resp.StatusCode)
+		}
+		apiErr, ok := decodeError(t, resp)
+		resp.Body.Close()
+		if !ok {
+			continue
+		}
+		if apiErr.Code != "bmc_not_configured" || apiErr.Message != "BMC is not configured for this machine" {
+			t.Errorf("%s %s: error = %+v", route.method, route.path, apiErr)
+		}
+	}
+}
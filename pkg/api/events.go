@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultEventLimit = 50
+	maxEventLimit     = 1000
+)
+
+// handleListEvents lists events across all machines, newest first
+func (s *Server) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	s.respondEventPage(w, filter)
+}
+
+// handleGetMachineEvents retrieves events for a machine
+func (s *Server) handleGetMachineEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	filter.MachineID = vars["id"]
+
+	s.respondEventPage(w, filter)
+}
+
+// respondEventPage writes one page of events. When the page is full, the
+// X-Next-Cursor header carries the cursor for the following page.
+func (s *Server) respondEventPage(w http.ResponseWriter, filter database.EventFilter) {
+	events, err := s.db.SearchEvents(filter)
+	if err != nil {
+		respondInternalError(w, err, "failed to list events")
+		return
+	}
+
+	if events == nil {
+		events = []*models.MachineEvent{}
+	}
+
+	if len(events) == filter.Limit {
+		last := events[len(events)-1]
+		w.Header().Set("X-Next-Cursor", encodeEventCursor(database.EventCursor{CreatedAt: last.CreatedAt, ID: last.ID}))
+	}
+
+	respondJSON(w, http.StatusOK, events)
+}
+
+// handleExportEvents streams events oldest first as newline-delimited JSON,
+// for shipping to log collectors
+func (s *Server) handleExportEvents(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "ndjson" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "format must be ndjson")
+		return
+	}
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	filter.Ascending = true
+	if r.URL.Query().Get("limit") == "" {
+		filter.Limit = 0
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	count := 0
+
+	err = s.db.StreamEvents(filter, func(event *models.MachineEvent) error {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%100 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// The status has been sent; a truncated stream is all the client
+		// can be told
+		log.Printf("Event export failed after %d events: %v", count, err)
+	}
+}
+
+// parseEventFilter reads the event filters shared by the event endpoints:
+// machine_id, event, user, since, until, cursor, and limit. since and until
+// take an RFC 3339 time or a duration before now (e.g. 24h).
+func parseEventFilter(r *http.Request) (database.EventFilter, error) {
+	query := r.URL.Query()
+
+	filter := database.EventFilter{
+		MachineID: query.Get("machine_id"),
+		Event:     query.Get("event"),
+		CreatedBy: query.Get("user"),
+		Limit:     defaultEventLimit,
+		VisibleTo: visibleTo(r),
+	}
+
+	var err error
+	if filter.Since, err = parseEventTime(query.Get("since")); err != nil {
+		return filter, fmt.Errorf("invalid since: %w", err)
+	}
+	if filter.Until, err = parseEventTime(query.Get("until")); err != nil {
+		return filter, fmt.Errorf("invalid until: %w", err)
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeEventCursor(cursor)
+		if err != nil {
+			return filter, err
+		}
+		filter.After = &after
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return filter, fmt.Errorf("limit must be a positive integer")
+		}
+		if limit > maxEventLimit {
+			limit = maxEventLimit
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// parseEventTime parses an RFC 3339 time or a duration before now
+func parseEventTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// encodeEventCursor encodes a cursor as an opaque token
+func encodeEventCursor(c database.EventCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func decodeEventCursor(token string) (database.EventCursor, error) {
+	var c database.EventCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return c, fmt.Errorf("invalid cursor")
+	}
+
+	if c.CreatedAt, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	// SQLite compares timestamps as text, written in the server's zone
+	c.CreatedAt = c.CreatedAt.Local()
+	c.ID = id
+
+	return c, nil
+}
+
+// publish emits an event through the server's publisher. Events that cannot
+// be recorded are logged; the change they describe has already happened.
+func (s *Server) publish(ctx context.Context, event events.Event) {
+	if err := s.events.Publish(ctx, event); err != nil {
+		log.Printf("Failed to publish event: %v", err)
+	}
+}
+
+// handleGetEventSchema describes the data of every event type, and the
+// payload schema versions webhooks can pin
+func (s *Server) handleGetEventSchema(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, events.DescribeSchema())
+}
+
+// validSubscribedEvents checks that a webhook or notification channel
+// subscribes only to event types that are published, or to "*"
+func validSubscribedEvents(w http.ResponseWriter, types []string) bool {
+	for _, t := range types {
+		if t != "*" && !events.IsKnown(t) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("unknown event type %q", t))
+			return false
+		}
+	}
+	return true
+}
+
+// publishStatusChange publishes machine.status_changed when a machine's
+// status is no longer oldStatus
+func (s *Server) publishStatusChange(ctx context.Context, machine *models.Machine, oldStatus models.MachineStatus, actor string) {
+	if machine.Status == oldStatus {
+		return
+	}
+	s.publish(ctx, events.Event{
+		Type:      events.MachineStatusChanged,
+		MachineID: machine.ID,
+		Actor:     actor,
+		Data: events.StatusChangedData{
+			OldStatus: oldStatus,
+			NewStatus: machine.Status,
+		},
+	})
+}
+
+// operationActor returns the user who started a BMC operation
+func operationActor(op *models.PowerOperation) string {
+	if op.InitiatedBy == "system" {
+		return ""
+	}
+	return op.InitiatedBy
+}
@@ -0,0 +1,418 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleCreateFragment creates a configuration fragment
+func (s *Server) handleCreateFragment(w http.ResponseWriter, r *http.Request) {
+	var fragment models.ConfigFragment
+	if !decodeJSON(w, r, &fragment) {
+		return
+	}
+
+	if fragment.Name == "" || fragment.NixOSConfig == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "name and nixos_config are required")
+		return
+	}
+
+	if s.config.EnableAuth {
+		if claims, ok := auth.GetClaims(r); ok {
+			fragment.CreatedBy = claims.UserID
+		}
+	}
+	if fragment.CreatedBy == "" {
+		fragment.CreatedBy = "system"
+	}
+
+	existing, err := s.db.GetFragmentByName(fragment.Name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if existing != nil {
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "fragment with this name already exists")
+		return
+	}
+
+	if err := s.db.CreateFragment(&fragment); err != nil {
+		respondInternalError(w, err, "failed to create fragment")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, fragment)
+}
+
+// handleListFragments lists all fragments, in assembly order
+func (s *Server) handleListFragments(w http.ResponseWriter, r *http.Request) {
+	list, err := s.db.ListFragments()
+	if err != nil {
+		respondInternalError(w, err, "failed to list fragments")
+		return
+	}
+
+	if list == nil {
+		list = []*models.ConfigFragment{}
+	}
+
+	respondJSON(w, http.StatusOK, list)
+}
+
+// handleGetFragment retrieves a single fragment
+func (s *Server) handleGetFragment(w http.ResponseWriter, r *http.Request) {
+	fragment := s.fragment(w, r)
+	if fragment == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, fragment)
+}
+
+// handleUpdateFragment updates a fragment. Machines using it get the change
+// in their next build.
+func (s *Server) handleUpdateFragment(w http.ResponseWriter, r *http.Request) {
+	fragment := s.fragment(w, r)
+	if fragment == nil {
+		return
+	}
+
+	var updates models.UpdateFragmentRequest
+	if !decodeJSON(w, r, &updates) {
+		return
+	}
+
+	if updates.Name != "" && updates.Name != fragment.Name {
+		existing, err := s.db.GetFragmentByName(updates.Name)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if existing != nil {
+			respondError(w, http.StatusConflict, CodeAlreadyExists, "fragment with this name already exists")
+			return
+		}
+		fragment.Name = updates.Name
+	}
+	if updates.Description != nil {
+		fragment.Description = *updates.Description
+	}
+	if updates.NixOSConfig != "" {
+		fragment.NixOSConfig = updates.NixOSConfig
+	}
+	if updates.Weight != nil {
+		fragment.Weight = *updates.Weight
+	}
+	if updates.Variables != nil {
+		fragment.Variables = updates.Variables
+	}
+
+	if err := s.db.UpdateFragment(fragment); err != nil {
+		respondInternalError(w, err, "failed to update fragment")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, fragment)
+}
+
+// handleDeleteFragment deletes a fragment no machine or group uses
+func (s *Server) handleDeleteFragment(w http.ResponseWriter, r *http.Request) {
+	fragment := s.fragment(w, r)
+	if fragment == nil {
+		return
+	}
+
+	machines, groups, err := s.db.FragmentUsage(fragment.ID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machines > 0 || groups > 0 {
+		respondError(w, http.StatusConflict, CodeConflict,
+			fmt.Sprintf("fragment is used by %d machine(s) and %d group(s)", machines, groups))
+		return
+	}
+
+	if err := s.db.DeleteFragment(fragment.ID); err != nil {
+		respondInternalError(w, err, "failed to delete fragment")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetMachineFragments lists the fragments a machine's configuration
+// is assembled from, including its groups' defaults
+func (s *Server) handleGetMachineFragments(w http.ResponseWriter, r *http.Request) {
+	machine := s.fragmentMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	_, refs, err := s.db.MachineConfigFragments(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get fragments")
+		return
+	}
+
+	if refs == nil {
+		refs = []models.FragmentRef{}
+	}
+
+	respondJSON(w, http.StatusOK, refs)
+}
+
+// handleSetMachineFragments replaces the fragments a machine lists. Its
+// nixos_config stays, as the override block of the assembled configuration.
+func (s *Server) handleSetMachineFragments(w http.ResponseWriter, r *http.Request) {
+	machine := s.fragmentMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	var req models.FragmentListRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	list, ok := s.resolveFragments(w, req.Fragments)
+	if !ok {
+		return
+	}
+
+	if err := s.db.SetMachineFragments(machine.ID, fragmentIDs(list)); err != nil {
+		respondInternalError(w, err, "failed to set fragments")
+		return
+	}
+
+	// Like setting a nixos_config, listing fragments configures the
+	// machine, and names it if it has no hostname
+	oldStatus := machine.Status
+	if len(list) > 0 && machine.CanProvision() && machine.Status != models.StatusConfigured {
+		machine.Status = models.StatusConfigured
+		if err := s.service.AssignHostname(machine); err != nil {
+			respondServiceError(w, err, "failed to name machine")
+			return
+		}
+		if err := s.db.UpdateMachine(machine); err != nil {
+			respondServiceError(w, err, "failed to update machine")
+			return
+		}
+		s.publishStatusChange(r.Context(), machine, oldStatus, "")
+	}
+	s.service.LintSaved(machine)
+
+	s.handleGetMachineFragments(w, r)
+}
+
+// handleGetGroupFragments lists the fragments a group gives its members
+func (s *Server) handleGetGroupFragments(w http.ResponseWriter, r *http.Request) {
+	group := s.fragmentGroup(w, r)
+	if group == nil {
+		return
+	}
+
+	list, err := s.db.GetGroupFragments(group.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get fragments")
+		return
+	}
+
+	if list == nil {
+		list = []*models.ConfigFragment{}
+	}
+
+	respondJSON(w, http.StatusOK, list)
+}
+
+// handleSetGroupFragments replaces the fragments a group gives its members
+// by default
+func (s *Server) handleSetGroupFragments(w http.ResponseWriter, r *http.Request) {
+	group := s.fragmentGroup(w, r)
+	if group == nil {
+		return
+	}
+
+	var req models.FragmentListRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	list, ok := s.resolveFragments(w, req.Fragments)
+	if !ok {
+		return
+	}
+
+	if err := s.db.SetGroupFragments(group.ID, fragmentIDs(list)); err != nil {
+		respondInternalError(w, err, "failed to set fragments")
+		return
+	}
+
+	s.handleGetGroupFragments(w, r)
+}
+
+// handleAssembleConfig shows the configuration a machine's next build would
+// use, without building it. The body is optional: it can stand in a
+// fragment list or nixos_config for the machine's own, and ask for the
+// builder to validate the result.
+func (s *Server) handleAssembleConfig(w http.ResponseWriter, r *http.Request) {
+	machine := s.fragmentMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	var req models.AssembleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+
+	list, refs, err := s.db.MachineConfigFragments(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get fragments")
+		return
+	}
+
+	if req.Fragments != nil {
+		own, ok := s.resolveFragments(w, req.Fragments)
+		if !ok {
+			return
+		}
+		list, refs = replaceMachineFragments(list, refs, own)
+	}
+
+	override := machine.NixOSConfig
+	if req.NixOSConfig != nil {
+		override = *req.NixOSConfig
+	}
+
+	assembled := fragments.Assemble(machine, list, refs, override)
+	if req.Validate {
+		if s.builder == nil {
+			respondError(w, http.StatusServiceUnavailable, CodeBuilderError, "no builder is configured")
+			return
+		}
+		if err := fragments.Validate(r.Context(), s.builder, assembled); err != nil {
+			respondError(w, http.StatusBadGateway, CodeBuilderError, err.Error())
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusOK, assembled)
+}
+
+// fragment looks up the fragment of a request. It responds with an error
+// and returns nil if there is no such fragment.
+func (s *Server) fragment(w http.ResponseWriter, r *http.Request) *models.ConfigFragment {
+	fragment, err := s.db.GetFragment(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if fragment == nil {
+		respondError(w, http.StatusNotFound, CodeFragmentNotFound, "fragment not found")
+		return nil
+	}
+	return fragment
+}
+
+// fragmentMachine looks up the machine of a machine fragments request. It
+// responds with an error and returns nil if there is no such machine.
+func (s *Server) fragmentMachine(w http.ResponseWriter, r *http.Request) *models.Machine {
+	machine, err := s.db.GetMachine(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return nil
+	}
+	return machine
+}
+
+// fragmentGroup looks up the group of a group fragments request. It
+// responds with an error and returns nil if there is no such group.
+func (s *Server) fragmentGroup(w http.ResponseWriter, r *http.Request) *models.MachineGroup {
+	group, err := s.db.GetGroup(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if group == nil {
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+		return nil
+	}
+	return group
+}
+
+// resolveFragments looks up the entries of a fragment list, each a fragment
+// ID or name. It responds with an error and returns false if one doesn't
+// exist or is listed twice.
+func (s *Server) resolveFragments(w http.ResponseWriter, entries []string) ([]*models.ConfigFragment, bool) {
+	list := make([]*models.ConfigFragment, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		fragment, err := s.db.GetFragment(entry)
+		if err == nil && fragment == nil {
+			fragment, err = s.db.GetFragmentByName(entry)
+		}
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return nil, false
+		}
+		if fragment == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("fragment %q not found", entry))
+			return nil, false
+		}
+		if seen[fragment.ID] {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("fragment %q is listed twice", fragment.Name))
+			return nil, false
+		}
+		seen[fragment.ID] = true
+		list = append(list, fragment)
+	}
+	return list, true
+}
+
+// replaceMachineFragments replaces a machine's own fragments in the list
+// MachineConfigFragments returns with own, keeping its groups' defaults
+func replaceMachineFragments(list []*models.ConfigFragment, refs []models.FragmentRef, own []*models.ConfigFragment) ([]*models.ConfigFragment, []models.FragmentRef) {
+	var keptList []*models.ConfigFragment
+	var keptRefs []models.FragmentRef
+	seen := make(map[string]bool)
+	for i, ref := range refs {
+		if ref.GroupID != "" {
+			keptList = append(keptList, list[i])
+			keptRefs = append(keptRefs, ref)
+			seen[ref.ID] = true
+		}
+	}
+
+	for _, fragment := range own {
+		if seen[fragment.ID] {
+			continue
+		}
+		keptList = append(keptList, fragment)
+		keptRefs = append(keptRefs, models.FragmentRef{ID: fragment.ID, Name: fragment.Name, Weight: fragment.Weight})
+	}
+	return keptList, keptRefs
+}
+
+// fragmentIDs returns the IDs of fragments
+func fragmentIDs(list []*models.ConfigFragment) []string {
+	ids := make([]string, len(list))
+	for i, fragment := range list {
+		ids[i] = fragment.ID
+	}
+	return ids
+}
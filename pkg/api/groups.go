@@ -1,7 +1,6 @@
 package api
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
 
@@ -12,34 +11,42 @@ import (
 // handleCreateGroup creates a new machine group
 func (s *Server) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
 	var req models.CreateGroupRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
 	// Validate required fields
 	if req.Name == "" {
-		respondError(w, http.StatusBadRequest, "name is required")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "name is required")
 		return
 	}
 
+	if err := models.ValidateHostnamePattern(req.HostnamePattern); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "hostname_pattern: "+err.Error())
+		return
+	}
+	if req.Ownership != nil {
+		if err := req.Ownership.Normalize(); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "ownership: "+err.Error())
+			return
+		}
+	}
+
 	// Check if group already exists
 	existing, err := s.db.GetGroupByName(req.Name)
 	if err != nil {
-		log.Printf("Failed to check existing group: %v", err)
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 	if existing != nil {
-		respondError(w, http.StatusConflict, "group already exists")
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "group already exists")
 		return
 	}
 
 	// Create group
-	group, err := s.db.CreateGroup(req.Name, req.Description, req.Tags)
+	group, err := s.db.CreateGroup(req.Name, req.Description, req.Tags, req.BuildLimits, req.BuilderLabels, req.RequireBuildApproval, req.HostnamePattern, req.Ownership)
 	if err != nil {
-		log.Printf("Failed to create group: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to create group")
+		respondInternalError(w, err, "failed to create group")
 		return
 	}
 
@@ -51,8 +58,7 @@ func (s *Server) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleListGroups(w http.ResponseWriter, r *http.Request) {
 	groups, err := s.db.ListGroups()
 	if err != nil {
-		log.Printf("Failed to list groups: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to list groups")
+		respondInternalError(w, err, "failed to list groups")
 		return
 	}
 
@@ -66,13 +72,12 @@ func (s *Server) handleGetGroup(w http.ResponseWriter, r *http.Request) {
 
 	group, err := s.db.GetGroup(id)
 	if err != nil {
-		log.Printf("Failed to get group: %v", err)
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if group == nil {
-		respondError(w, http.StatusNotFound, "group not found")
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
 		return
 	}
 
@@ -86,18 +91,17 @@ func (s *Server) handleUpdateGroup(w http.ResponseWriter, r *http.Request) {
 
 	group, err := s.db.GetGroup(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if group == nil {
-		respondError(w, http.StatusNotFound, "group not found")
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
 		return
 	}
 
 	var req models.UpdateGroupRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
@@ -111,10 +115,39 @@ func (s *Server) handleUpdateGroup(w http.ResponseWriter, r *http.Request) {
 	if req.Tags != nil {
 		group.Tags = req.Tags
 	}
+	if req.BuildLimits != nil {
+		group.BuildLimits = req.BuildLimits
+	}
+	if req.BuilderLabels != nil {
+		group.BuilderLabels = req.BuilderLabels
+	}
+	if req.RequireBuildApproval != nil {
+		if group.RequireBuildApproval && !*req.RequireBuildApproval && !s.isAdmin(r) {
+			respondError(w, http.StatusForbidden, CodeForbidden, "only admins can stop requiring build approval")
+			return
+		}
+		group.RequireBuildApproval = *req.RequireBuildApproval
+	}
+	if req.HostnamePattern != nil {
+		if err := models.ValidateHostnamePattern(*req.HostnamePattern); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "hostname_pattern: "+err.Error())
+			return
+		}
+		group.HostnamePattern = *req.HostnamePattern
+	}
+	if req.Ownership != nil {
+		if err := req.Ownership.Normalize(); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "ownership: "+err.Error())
+			return
+		}
+		group.Ownership = req.Ownership
+		if req.Ownership.IsZero() {
+			group.Ownership = nil
+		}
+	}
 
 	if err := s.db.UpdateGroup(group); err != nil {
-		log.Printf("Failed to update group: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to update group")
+		respondInternalError(w, err, "failed to update group")
 		return
 	}
 
@@ -127,8 +160,7 @@ func (s *Server) handleDeleteGroup(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	if err := s.db.DeleteGroup(id); err != nil {
-		log.Printf("Failed to delete group: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to delete group")
+		respondInternalError(w, err, "failed to delete group")
 		return
 	}
 
@@ -142,11 +174,21 @@ func (s *Server) handleGetGroupMachines(w http.ResponseWriter, r *http.Request)
 
 	machines, err := s.db.GetGroupMachines(groupID)
 	if err != nil {
-		log.Printf("Failed to get group machines: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to get group machines")
+		respondInternalError(w, err, "failed to get group machines")
 		return
 	}
 
+	// Viewers don't see machines other users have claimed
+	if userID := visibleTo(r); userID != "" {
+		visible := []*models.Machine{}
+		for _, m := range machines {
+			if m.OwnerUserID == "" || m.OwnerUserID == userID {
+				visible = append(visible, m)
+			}
+		}
+		machines = visible
+	}
+
 	respondJSON(w, http.StatusOK, machines)
 }
 
@@ -159,29 +201,28 @@ func (s *Server) handleAddMachineToGroup(w http.ResponseWriter, r *http.Request)
 	// Verify group exists
 	group, err := s.db.GetGroup(groupID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 	if group == nil {
-		respondError(w, http.StatusNotFound, "group not found")
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
 		return
 	}
 
 	// Verify machine exists
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 	if machine == nil {
-		respondError(w, http.StatusNotFound, "machine not found")
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	// Add machine to group
 	if err := s.db.AddMachineToGroup(groupID, machineID); err != nil {
-		log.Printf("Failed to add machine to group: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to add machine to group")
+		respondInternalError(w, err, "failed to add machine to group")
 		return
 	}
 
@@ -195,9 +236,22 @@ func (s *Server) handleRemoveMachineFromGroup(w http.ResponseWriter, r *http.Req
 	groupID := vars["id"]
 	machineID := vars["machine_id"]
 
+	// Leaving a group that requires build approval would stop requiring it
+	// for the machine
+	if !s.isAdmin(r) {
+		group, err := s.db.GetGroup(groupID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if group != nil && group.RequireBuildApproval {
+			respondError(w, http.StatusForbidden, CodeForbidden, "only admins can remove machines from groups that require build approval")
+			return
+		}
+	}
+
 	if err := s.db.RemoveMachineFromGroup(groupID, machineID); err != nil {
-		log.Printf("Failed to remove machine from group: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to remove machine from group")
+		respondInternalError(w, err, "failed to remove machine from group")
 		return
 	}
 
@@ -212,8 +266,7 @@ func (s *Server) handleGetMachineGroups(w http.ResponseWriter, r *http.Request)
 
 	groups, err := s.db.GetMachineGroups(machineID)
 	if err != nil {
-		log.Printf("Failed to get machine groups: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to get machine groups")
+		respondInternalError(w, err, "failed to get machine groups")
 		return
 	}
 
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleCreateHardwareProfile creates a hardware profile and checks the
+// machines again
+func (s *Server) handleCreateHardwareProfile(w http.ResponseWriter, r *http.Request) {
+	var profile models.HardwareProfile
+	if !decodeJSON(w, r, &profile) {
+		return
+	}
+
+	if !s.checkHardwareProfile(w, "", &profile) {
+		return
+	}
+
+	if err := s.db.CreateHardwareProfile(&profile); err != nil {
+		respondInternalError(w, err, "failed to create hardware profile")
+		return
+	}
+
+	go s.service.RecheckHardwareCompliance(context.Background())
+
+	respondJSON(w, http.StatusCreated, profile)
+}
+
+// handleListHardwareProfiles lists all hardware profiles
+func (s *Server) handleListHardwareProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := s.db.ListHardwareProfiles()
+	if err != nil {
+		respondInternalError(w, err, "failed to list hardware profiles")
+		return
+	}
+
+	if profiles == nil {
+		profiles = []*models.HardwareProfile{}
+	}
+
+	respondJSON(w, http.StatusOK, profiles)
+}
+
+// handleGetHardwareProfile retrieves a single hardware profile
+func (s *Server) handleGetHardwareProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.hardwareProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, profile)
+}
+
+// handleUpdateHardwareProfile replaces a hardware profile and checks the
+// machines again
+func (s *Server) handleUpdateHardwareProfile(w http.ResponseWriter, r *http.Request) {
+	existing := s.hardwareProfile(w, r)
+	if existing == nil {
+		return
+	}
+
+	var profile models.HardwareProfile
+	if !decodeJSON(w, r, &profile) {
+		return
+	}
+
+	if !s.checkHardwareProfile(w, existing.ID, &profile) {
+		return
+	}
+
+	profile.ID = existing.ID
+	profile.CreatedAt = existing.CreatedAt
+
+	if err := s.db.UpdateHardwareProfile(&profile); err != nil {
+		respondInternalError(w, err, "failed to update hardware profile")
+		return
+	}
+
+	go s.service.RecheckHardwareCompliance(context.Background())
+
+	respondJSON(w, http.StatusOK, profile)
+}
+
+// handleDeleteHardwareProfile deletes a hardware profile. Its machines are
+// checked again, against another profile if one applies.
+func (s *Server) handleDeleteHardwareProfile(w http.ResponseWriter, r *http.Request) {
+	profile := s.hardwareProfile(w, r)
+	if profile == nil {
+		return
+	}
+
+	if err := s.db.DeleteHardwareProfile(profile.ID); err != nil {
+		respondInternalError(w, err, "failed to delete hardware profile")
+		return
+	}
+
+	go s.service.RecheckHardwareCompliance(context.Background())
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hardwareProfile looks up the hardware profile of a request. It responds
+// with an error and returns nil if there is no such profile.
+func (s *Server) hardwareProfile(w http.ResponseWriter, r *http.Request) *models.HardwareProfile {
+	profile, err := s.db.GetHardwareProfile(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if profile == nil {
+		respondError(w, http.StatusNotFound, CodeHardwareProfileNotFound, "hardware profile not found")
+		return nil
+	}
+	return profile
+}
+
+// checkHardwareProfile validates a profile, and checks that its name and
+// its manufacturer and model are free and that its groups exist. It
+// responds with an error and returns false if not.
+func (s *Server) checkHardwareProfile(w http.ResponseWriter, profileID string, profile *models.HardwareProfile) bool {
+	if err := profile.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return false
+	}
+
+	profiles, err := s.db.ListHardwareProfiles()
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return false
+	}
+	for _, other := range profiles {
+		if other.ID == profileID {
+			continue
+		}
+		if other.Name == profile.Name {
+			respondError(w, http.StatusConflict, CodeAlreadyExists, "hardware profile with this name already exists")
+			return false
+		}
+		if profile.Manufacturer != "" && strings.EqualFold(other.Manufacturer, profile.Manufacturer) && strings.EqualFold(other.Model, profile.Model) {
+			respondError(w, http.StatusConflict, CodeAlreadyExists,
+				fmt.Sprintf("hardware profile %s already applies to %s %s", other.Name, other.Manufacturer, other.Model))
+			return false
+		}
+	}
+
+	seen := make(map[string]bool, len(profile.GroupIDs))
+	for _, id := range profile.GroupIDs {
+		if seen[id] {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("group %q is listed twice", id))
+			return false
+		}
+		seen[id] = true
+
+		group, err := s.db.GetGroup(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return false
+		}
+		if group == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("group %q not found", id))
+			return false
+		}
+	}
+
+	return true
+}
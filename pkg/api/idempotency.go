@@ -0,0 +1,144 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	idempotencyReplayed  = "Idempotent-Replayed"
+
+	defaultIdempotencyTTL  = 24 * time.Hour
+	idempotencyCleanupTick = time.Hour
+)
+
+// validIdempotencyKey matches keys accepted from clients: printable ASCII
+// without spaces, such as a UUID
+var validIdempotencyKey = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// responseCapture records the status and body a handler writes while
+// passing them through
+type responseCapture struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// idempotent lets clients retry a POST safely. When a request carries an
+// Idempotency-Key header, the response is stored under the key, the user,
+// and the endpoint, and a retry with the same key and body gets the stored
+// response without the handler running again. Reusing a key with a
+// different body is rejected with 422. Server errors aren't stored, so the
+// request can be retried for real. With authentication enabled, requests
+// without a user are handled as if they had no key, since a stored response
+// could be replayed to any other client.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		claims, authenticated := auth.GetClaims(r)
+		if s.config.EnableAuth && !authenticated {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey.MatchString(key) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "Idempotency-Key must be 1 to 255 printable characters without spaces")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if !respondBodyError(w, err) {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest, "failed to read request body")
+			}
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		now := time.Now()
+		record := &models.IdempotencyRecord{
+			Key:         key,
+			Endpoint:    r.Method + " " + r.URL.Path,
+			RequestHash: hex.EncodeToString(hash[:]),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(s.config.IdempotencyTTL),
+		}
+		if authenticated {
+			record.Username = claims.Username
+		}
+
+		existing, err := s.db.ReserveIdempotencyKey(record)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.RequestHash != record.RequestHash:
+				respondError(w, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request body")
+			case !existing.Completed():
+				respondError(w, http.StatusConflict, CodeConflict, "a request with this Idempotency-Key is still being handled")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(idempotencyReplayed, "true")
+				w.WriteHeader(existing.StatusCode)
+				io.WriteString(w, existing.ResponseBody)
+			}
+			return
+		}
+
+		capture := &responseCapture{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next(capture, r)
+
+		if capture.status >= 500 {
+			err = s.db.DeleteIdempotencyRecord(record)
+		} else {
+			record.StatusCode = capture.status
+			record.ResponseBody = capture.body.String()
+			err = s.db.CompleteIdempotencyRecord(record)
+		}
+		if err != nil {
+			log.Printf("[%s] Failed to store response for Idempotency-Key: %v", w.Header().Get(requestIDHeader), err)
+		}
+	}
+}
+
+// StartIdempotencyCleanup deletes expired idempotency keys hourly
+func (s *Server) StartIdempotencyCleanup() {
+	go func() {
+		ticker := time.NewTicker(idempotencyCleanupTick)
+		defer ticker.Stop()
+
+		for {
+			if s.leadJob("idempotency-cleanup", idempotencyCleanupTick) {
+				deleted, err := s.db.DeleteExpiredIdempotencyRecords(time.Now())
+				if err != nil {
+					log.Printf("Idempotency key cleanup failed: %v", err)
+				} else if deleted > 0 {
+					log.Printf("Deleted %d expired idempotency keys", deleted)
+				}
+			}
+
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,107 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// postWithKey posts body with an Idempotency-Key, as the user with token
+// or anonymously, and decodes the response into out
+func postWithKey(t *testing.T, env *testutil.Env, token, path, key string, body, out interface{}) *http.Response {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, env.URL(path), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := env.Server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("POST %s: decode %d response: %v", path, resp.StatusCode, err)
+	}
+	return resp
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	env := testutil.New(t)
+	machine := env.EnrollMachine("IDEMPOTENT01")
+	env.ConfigureMachine(machine.ID, testutil.FixtureConfig)
+	path := "/api/v1/machines/" + machine.ID + "/build"
+
+	var first, second models.BuildRequest
+	resp := postWithKey(t, env, env.Tokens[models.RoleOperator], path, "build-1", nil, &first)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first build: status %d, replayed %q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	resp = postWithKey(t, env, env.Tokens[models.RoleOperator], path, "build-1", nil, &second)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "true" || second.ID != first.ID {
+		t.Errorf("retried build: status %d, replayed %q, build %s; want build %s replayed with 201",
+			resp.StatusCode, resp.Header.Get("Idempotent-Replayed"), second.ID, first.ID)
+	}
+
+	// Keys are the user's own: another user's request with the same key
+	// runs rather than getting the operator's response
+	var third models.BuildRequest
+	resp = postWithKey(t, env, env.Tokens[models.RoleAdmin], path, "build-1", nil, &third)
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("admin's request replayed the operator's response")
+	}
+}
+
+// TestEnrollmentIsNotReplayed checks an enrollment's response, and the
+// claim code in it, is never replayed to whoever repeats its
+// Idempotency-Key and body; each enrollment gets a code of its own
+func TestEnrollmentIsNotReplayed(t *testing.T) {
+	env := testutil.New(t, func(config *api.Config) {
+		config.ClaimCodeTTL = time.Hour
+	})
+	req := models.EnrollmentRequest{
+		ServiceTag: "REPLAY01",
+		MACAddress: testutil.FixtureMAC("REPLAY01"),
+		Hardware:   testutil.FixtureHardware("REPLAY01"),
+	}
+
+	var first, second models.EnrollmentResponse
+	resp := postWithKey(t, env, "", "/api/v1/enroll", "enroll-1", req, &first)
+	if resp.StatusCode != http.StatusCreated || first.ClaimCode == "" {
+		t.Fatalf("enroll: status %d, claim code %q", resp.StatusCode, first.ClaimCode)
+	}
+	resp = postWithKey(t, env, "", "/api/v1/enroll", "enroll-1", req, &second)
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatal("enrollment response replayed")
+	}
+	if resp.StatusCode != http.StatusOK || second.ID != first.ID || second.ClaimCode == "" || second.ClaimCode == first.ClaimCode {
+		t.Errorf("enrolling again: status %d, machine %s, claim code %q; want 200, machine %s, and a new code",
+			resp.StatusCode, second.ID, second.ClaimCode, first.ID)
+	}
+
+	// The first code was replaced, so it claims nothing
+	var apiErr models.ErrorResponse
+	claim := models.ClaimRequest{Code: first.ClaimCode}
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/machines/claim", claim, http.StatusNotFound, &apiErr)
+	if apiErr.Error.Code != string(api.CodeClaimCodeInvalid) {
+		t.Errorf("claiming with the first code: %+v, want %s", apiErr.Error, api.CodeClaimCodeInvalid)
+	}
+	claim.Code = second.ClaimCode
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/machines/claim", claim, http.StatusOK, nil)
+}
@@ -1,11 +1,14 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 	"github.com/gorilla/mux"
 )
@@ -13,23 +16,38 @@ import (
 // handleCreateImageTest creates a new image test
 func (s *Server) handleCreateImageTest(w http.ResponseWriter, r *http.Request) {
 	var test models.ImageTest
-	if err := json.NewDecoder(r.Body).Decode(&test); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeJSON(w, r, &test) {
 		return
 	}
 
 	// Validate required fields
 	if test.ImagePath == "" || test.ImageType == "" || test.TestType == "" {
-		http.Error(w, "image_path, image_type, and test_type are required", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "image_path, image_type, and test_type are required")
 		return
 	}
 
+	// A test of a build defaults to the build's machine
+	if test.BuildID != nil {
+		build, err := s.db.GetBuild(*test.BuildID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if build == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "build not found")
+			return
+		}
+		if test.MachineID == nil && build.MachineID != "" {
+			test.MachineID = &build.MachineID
+		}
+	}
+
 	// Set initial status
 	test.Status = "pending"
 
 	// Create test
 	if err := s.db.CreateImageTest(&test); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create image test: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to create image test")
 		return
 	}
 
@@ -45,11 +63,11 @@ func (s *Server) handleGetImageTest(w http.ResponseWriter, r *http.Request) {
 
 	test, err := s.db.GetImageTest(testID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get image test: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get image test")
 		return
 	}
 	if test == nil {
-		http.Error(w, "Image test not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeImageTestNotFound, "image test not found")
 		return
 	}
 
@@ -60,20 +78,19 @@ func (s *Server) handleGetImageTest(w http.ResponseWriter, r *http.Request) {
 // handleListImageTests retrieves image tests
 func (s *Server) handleListImageTests(w http.ResponseWriter, r *http.Request) {
 	// Parse query parameters
-	imageType := r.URL.Query().Get("image_type")
-	limitStr := r.URL.Query().Get("limit")
-
-	// Default limit to 50
-	limit := 50
-	if limitStr != "" {
+	filter := database.ImageTestFilter{
+		ImageType: r.URL.Query().Get("image_type"),
+		BuildID:   r.URL.Query().Get("build_id"),
+	}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+			filter.Limit = l
 		}
 	}
 
-	tests, err := s.db.ListImageTests(imageType, limit)
+	tests, err := s.db.ListImageTests(filter)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list image tests: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to list image tests")
 		return
 	}
 
@@ -89,22 +106,22 @@ func (s *Server) handleUpdateImageTest(w http.ResponseWriter, r *http.Request) {
 	// Get existing test
 	test, err := s.db.GetImageTest(testID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get image test: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get image test")
 		return
 	}
 	if test == nil {
-		http.Error(w, "Image test not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeImageTestNotFound, "image test not found")
 		return
 	}
 
 	// Parse update
 	var update models.ImageTest
-	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeJSON(w, r, &update) {
 		return
 	}
 
 	// Update fields
+	oldStatus := test.Status
 	if update.Status != "" {
 		test.Status = update.Status
 	}
@@ -120,10 +137,107 @@ func (s *Server) handleUpdateImageTest(w http.ResponseWriter, r *http.Request) {
 
 	// Update in database
 	if err := s.db.UpdateImageTest(test); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update image test: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to update image test")
 		return
 	}
 
+	if test.BuildID != nil && test.Status != oldStatus {
+		s.applyBuildTestResult(r.Context(), test)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(test)
 }
+
+// handleListBuildTests lists the image tests of a build
+func (s *Server) handleListBuildTests(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	build, err := s.db.GetBuild(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if build == nil {
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
+		return
+	}
+
+	tests, err := s.db.ListImageTests(database.ImageTestFilter{BuildID: build.ID})
+	if err != nil {
+		respondInternalError(w, err, "failed to list image tests")
+		return
+	}
+	if tests == nil {
+		tests = []*models.ImageTest{}
+	}
+
+	respondJSON(w, http.StatusOK, tests)
+}
+
+// applyBuildTestResult acts on a finished test of a build. A failed test
+// marks the build tested_failed; either result moves a machine waiting in
+// testing on that build, or the system image version it builds, out of it.
+func (s *Server) applyBuildTestResult(ctx context.Context, test *models.ImageTest) {
+	if test.Status != "passed" && test.Status != "failed" {
+		return
+	}
+
+	build, err := s.db.GetBuild(*test.BuildID)
+	if err != nil || build == nil {
+		log.Printf("Failed to get build %s of image test %s: %v", *test.BuildID, test.ID, err)
+		return
+	}
+
+	if test.Status == "failed" && build.Status == "success" {
+		build.Status = "tested_failed"
+		if err := s.db.UpdateBuild(build); err != nil {
+			log.Printf("Failed to update build %s: %v", build.ID, err)
+		}
+	}
+
+	if models.IsSystemImage(build.Type) {
+		s.applySystemImageTestResult(build, test)
+		return
+	}
+
+	machine, err := s.db.GetMachine(build.MachineID)
+	if err != nil || machine == nil {
+		log.Printf("Failed to get machine %s of build %s: %v", build.MachineID, build.ID, err)
+		return
+	}
+
+	if test.Status == "failed" {
+		log.Printf("Image test %s of build %s failed for machine %s", test.ID, build.ID, machine.ID)
+
+		s.publish(ctx, events.Event{
+			Type:      events.MachineImageTestFailed,
+			MachineID: machine.ID,
+			Data: events.ImageTestFailedData{
+				BuildID: build.ID,
+				TestID:  test.ID,
+				Error:   test.Error,
+			},
+		})
+	}
+
+	if machine.Status != models.StatusTesting || machine.LastBuildID == nil || *machine.LastBuildID != build.ID {
+		return
+	}
+
+	oldStatus := machine.Status
+	if test.Status == "passed" {
+		machine.Status = models.StatusReady
+	} else {
+		machine.Status = models.StatusFailed
+	}
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		log.Printf("Failed to update machine %s: %v", machine.ID, err)
+		return
+	}
+
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+}
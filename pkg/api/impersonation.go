@@ -0,0 +1,130 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// authenticate checks a request's token like auth.AuthMiddleware, and
+// refuses impersonation tokens whose session was ended before the token
+// expired
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	checkSession := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := auth.GetClaims(r)
+		if ok && claims.Impersonating() {
+			session, err := s.db.GetImpersonationSession(claims.ID)
+			if err != nil {
+				respondInternalError(w, err, "database error")
+				return
+			}
+			if session == nil || !session.Active(time.Now()) {
+				respondError(w, http.StatusUnauthorized, CodeUnauthorized, "impersonation session has ended")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+	return auth.AuthMiddleware(s.jwtManager)(checkSession)
+}
+
+// denyImpersonated refuses requests made while impersonating a user, for
+// routes an admin must not use as someone else, such as user management
+func (s *Server) denyImpersonated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, ok := auth.GetClaims(r); ok && claims.Impersonating() {
+			respondError(w, http.StatusForbidden, CodeImpersonating, "not allowed while impersonating a user")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleImpersonate starts an impersonation session, in which an admin
+// acts as another user to see what the user can see and do. The token it
+// returns lasts models.ImpersonationDuration and can't be refreshed.
+func (s *Server) handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetClaims(r)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+		return
+	}
+	if claims.Impersonating() {
+		respondError(w, http.StatusForbidden, CodeImpersonating, "cannot impersonate while impersonating a user; end the session first")
+		return
+	}
+
+	userID := mux.Vars(r)["user_id"]
+	if userID == claims.UserID {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "cannot impersonate yourself")
+		return
+	}
+
+	user, err := s.db.GetUser(userID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if user == nil {
+		respondError(w, http.StatusNotFound, CodeUserNotFound, "user not found")
+		return
+	}
+	if !user.Active {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "user is disabled")
+		return
+	}
+
+	now := time.Now()
+	session := &models.ImpersonationSession{
+		ImpersonatorID: claims.UserID,
+		Impersonator:   claims.Username,
+		UserID:         user.ID,
+		Username:       user.Username,
+		StartedAt:      now,
+		ExpiresAt:      now.Add(models.ImpersonationDuration),
+	}
+	if err := s.db.CreateImpersonationSession(session); err != nil {
+		respondInternalError(w, err, "failed to start impersonation")
+		return
+	}
+
+	token, err := s.jwtManager.GenerateImpersonationToken(user, session)
+	if err != nil {
+		respondInternalError(w, err, "failed to generate token")
+		return
+	}
+
+	log.Printf("Admin %s started impersonating %s (session %s)", session.Impersonator, session.Username, session.ID)
+	respondJSON(w, http.StatusCreated, models.ImpersonationResponse{
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
+		User:      *user,
+		Session:   *session,
+	})
+}
+
+// handleEndImpersonation ends the impersonation session of the request's
+// token before it expires
+func (s *Server) handleEndImpersonation(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetClaims(r)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+		return
+	}
+	if !claims.Impersonating() {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "not impersonating a user")
+		return
+	}
+
+	if _, err := s.db.EndImpersonationSession(claims.ID, time.Now()); err != nil {
+		respondInternalError(w, err, "failed to end impersonation")
+		return
+	}
+
+	log.Printf("Admin %s stopped impersonating %s (session %s)", claims.Impersonator, claims.Username, claims.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,150 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// impersonate starts a session as the admin impersonating userID and
+// returns its token
+func impersonate(env *testutil.Env, userID string) string {
+	var session models.ImpersonationResponse
+	env.MustJSON(models.RoleAdmin, http.MethodPost, "/api/v1/auth/impersonate/"+userID, nil, http.StatusCreated, &session)
+	return session.Token
+}
+
+// doJSON makes a request with token and decodes its body into out, failing
+// the test unless the response has status want
+func doJSON(t *testing.T, env *testutil.Env, token, method, path string, body interface{}, want int, out interface{}) {
+	t.Helper()
+
+	resp := env.DoToken(token, method, path, body)
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		data, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: got status %d, want %d: %s", method, path, resp.StatusCode, want, data)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+}
+
+// TestImpersonationIsAttributed checks that what an admin does as another
+// user is recorded as the user's, with the admin as impersonator, in the
+// audit log and in the machine's events
+func TestImpersonationIsAttributed(t *testing.T) {
+	env := testutil.New(t, func(config *api.Config) {
+		config.AuditFields = api.DefaultAuditFields
+	})
+	admin, operator := env.Users[models.RoleAdmin], env.Users[models.RoleOperator]
+	machine := env.EnrollMachine("IMPERSONATE01")
+
+	token := impersonate(env, operator.ID)
+	doJSON(t, env, token, http.MethodPut, "/api/v1/machines/"+machine.ID,
+		map[string]interface{}{"nixos_config": testutil.FixtureConfig}, http.StatusOK, nil)
+
+	var entries []*models.AuditEntry
+	env.MustJSON(models.RoleAdmin, http.MethodGet, "/api/v1/audit?route="+url.QueryEscape("/api/v1/machines/{id}"), nil, http.StatusOK, &entries)
+	if len(entries) != 1 {
+		t.Fatalf("found %d machine entries, want the update", len(entries))
+	}
+	if entry := entries[0]; entry.Actor != "operator" || entry.ActorID != operator.ID ||
+		entry.Impersonator != "admin" || entry.ImpersonatorID != admin.ID {
+		t.Errorf("audit entry = %+v, want the operator's, impersonated by the admin", entry)
+	}
+
+	// The audit log can be searched by impersonator
+	env.MustJSON(models.RoleAdmin, http.MethodGet, "/api/v1/audit?impersonator=admin", nil, http.StatusOK, &entries)
+	for _, entry := range entries {
+		if entry.Impersonator != "admin" {
+			t.Errorf("entry %+v found by impersonator admin", entry)
+		}
+	}
+	if len(entries) == 0 {
+		t.Error("no entries found by impersonator admin")
+	}
+
+	var events []*models.MachineEvent
+	env.MustJSON(models.RoleAdmin, http.MethodGet, "/api/v1/machines/"+machine.ID+"/events", nil, http.StatusOK, &events)
+	var impersonated int
+	for _, event := range events {
+		if event.ImpersonatedBy == nil {
+			continue
+		}
+		impersonated++
+		if *event.ImpersonatedBy != "admin" || event.CreatedBy == nil || *event.CreatedBy != "operator" {
+			t.Errorf("%s event by %v, impersonated by %s; want the operator, impersonated by the admin", event.Event, event.CreatedBy, *event.ImpersonatedBy)
+		}
+	}
+	if impersonated == 0 {
+		t.Errorf("none of %d events was recorded as impersonated", len(events))
+	}
+
+	// Events the admin causes as themselves have no impersonator
+	env.MustJSON(models.RoleAdmin, http.MethodPut, "/api/v1/machines/"+machine.ID,
+		map[string]interface{}{"hostname": "impersonate-01"}, http.StatusOK, nil)
+	env.MustJSON(models.RoleAdmin, http.MethodGet, "/api/v1/machines/"+machine.ID+"/events", nil, http.StatusOK, &events)
+	for _, event := range events {
+		if event.CreatedBy != nil && *event.CreatedBy == "admin" && event.ImpersonatedBy != nil {
+			t.Errorf("admin's own %s event impersonated by %s", event.Event, *event.ImpersonatedBy)
+		}
+	}
+}
+
+// TestImpersonatedAdminIsDenied checks every route an admin must not use as
+// someone else refuses an impersonation token, even one of another admin,
+// as does starting a second session or refreshing the token
+func TestImpersonatedAdminIsDenied(t *testing.T) {
+	env := testutil.New(t)
+	viewer := env.Users[models.RoleViewer]
+
+	var other models.User
+	env.MustJSON(models.RoleAdmin, http.MethodPost, "/api/v1/users", models.RegisterRequest{
+		Username: "other-admin",
+		Email:    "other-admin@example.com",
+		Password: "password",
+		Role:     models.RoleAdmin,
+	}, http.StatusCreated, &other)
+	token := impersonate(env, other.ID)
+
+	routes := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodGet, "/api/v1/users", nil},
+		{http.MethodPost, "/api/v1/users", models.RegisterRequest{Username: "new", Email: "new@example.com", Password: "password", Role: models.RoleViewer}},
+		{http.MethodGet, "/api/v1/users/" + viewer.ID, nil},
+		{http.MethodPut, "/api/v1/users/" + viewer.ID, models.UpdateUserRequest{Role: models.RoleAdmin, Active: true}},
+		{http.MethodDelete, "/api/v1/users/" + viewer.ID, nil},
+		{http.MethodGet, "/api/v1/users/" + viewer.ID + "/usage", nil},
+		{http.MethodPut, "/api/v1/users/" + viewer.ID + "/quota", map[string]int{"max_machines": 10}},
+		{http.MethodPost, "/api/v1/users/" + viewer.ID + "/quota/grants", map[string]int{"machines": 5}},
+		{http.MethodDelete, "/api/v1/users/" + viewer.ID + "/quota/grants/some-grant", nil},
+		{http.MethodPost, "/api/v1/auth/impersonate/" + viewer.ID, nil},
+		{http.MethodPost, "/api/v1/auth/refresh", nil},
+	}
+	for _, route := range routes {
+		resp := env.DoToken(token, route.method, route.path, route.body)
+		expectError(t, resp, http.StatusForbidden, string(api.CodeImpersonating))
+		resp.Body.Close()
+	}
+
+	// None of them changed the viewer
+	var got models.User
+	env.MustJSON(models.RoleAdmin, http.MethodGet, "/api/v1/users/"+viewer.ID, nil, http.StatusOK, &got)
+	if got.Role != models.RoleViewer || !got.Active {
+		t.Errorf("viewer = %+v after denied requests", got)
+	}
+
+	// The same token may still read what the other admin can
+	doJSON(t, env, token, http.MethodGet, "/api/v1/machines", nil, http.StatusOK, nil)
+}
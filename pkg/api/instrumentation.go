@@ -0,0 +1,194 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverMetrics holds the counters and histograms updated as the server
+// works. Machine gauges, which need database queries, are collected
+// separately by machineCollector.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	buildDuration     *prometheus.HistogramVec
+	buildRunDuration  *prometheus.HistogramVec
+	buildPeakMemory   *prometheus.HistogramVec
+	buildsTotal       *prometheus.CounterVec
+	enrollments       *prometheus.CounterVec
+	enrollDuration    *prometheus.HistogramVec
+	enrollQueueDepth  prometheus.Gauge
+	enrollInFlight    prometheus.Gauge
+	powerOperations   *prometheus.CounterVec
+	webhookDeliveries *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	lastBackup        prometheus.Gauge
+
+	machines *machineCollector
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		buildDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "metal_enrollment_build_duration_seconds",
+			Help: "Time from build request to completion, by outcome and machine model",
+			// 30s to a bit over an hour
+			Buckets: prometheus.ExponentialBuckets(30, 2, 8),
+		}, []string{"status", "model"}),
+		buildRunDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "metal_enrollment_build_run_seconds",
+			Help:    "Time a builder spent running a build, by outcome and builder",
+			Buckets: prometheus.ExponentialBuckets(30, 2, 8),
+		}, []string{"status", "builder"}),
+		buildPeakMemory: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "metal_enrollment_build_peak_memory_bytes",
+			Help: "Peak memory use of builds, by builder, where the builder measures it",
+			// 256 MiB to 32 GiB
+			Buckets: prometheus.ExponentialBuckets(256<<20, 2, 8),
+		}, []string{"builder"}),
+		buildsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metal_enrollment_builds_total",
+			Help: "Finished builds by outcome, builder, and nix version",
+		}, []string{"status", "builder", "nix_version"}),
+		enrollments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metal_enrollment_enrollments_total",
+			Help: "Enrollment requests by result (new, returning, rejected, overloaded)",
+		}, []string{"result"}),
+		enrollDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "metal_enrollment_enroll_duration_seconds",
+			Help:    "Enrollment latency by status code, including time waiting in the enrollment queue",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code"}),
+		enrollQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "metal_enrollment_enroll_queue_depth",
+			Help: "Enrollment requests waiting for a turn",
+		}),
+		enrollInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "metal_enrollment_enroll_in_flight",
+			Help: "Enrollment requests being processed",
+		}),
+		powerOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metal_enrollment_power_operations_total",
+			Help: "Finished BMC operations by operation and outcome",
+		}, []string{"operation", "status"}),
+		webhookDeliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "metal_enrollment_webhook_deliveries_total",
+			Help: "Webhook deliveries by webhook name and outcome, after retries",
+		}, []string{"webhook", "outcome"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "metal_enrollment_http_request_duration_seconds",
+			Help:    "API request latency by route template, method, and status code",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		lastBackup: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "metal_enrollment_backup_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful backup",
+		}),
+		machines: &machineCollector{},
+	}
+
+	m.registry.MustRegister(
+		m.buildDuration,
+		m.buildRunDuration,
+		m.buildPeakMemory,
+		m.buildsTotal,
+		m.enrollments,
+		m.enrollDuration,
+		m.enrollQueueDepth,
+		m.enrollInFlight,
+		m.powerOperations,
+		m.webhookDeliveries,
+		m.requestDuration,
+		m.lastBackup,
+		m.machines,
+	)
+
+	return m
+}
+
+// observeBuild records a finished build
+func (m *serverMetrics) observeBuild(build *models.BuildRequest, model string) {
+	if model == "" {
+		model = "unknown"
+	}
+	builder, nixVersion := build.Builder, ""
+	if builder == "" {
+		builder = "unknown"
+	}
+	if build.Environment != nil {
+		nixVersion = build.Environment.NixVersion
+	}
+
+	m.buildsTotal.WithLabelValues(build.Status, builder, nixVersion).Inc()
+	if build.CompletedAt != nil {
+		m.buildDuration.WithLabelValues(build.Status, model).Observe(build.CompletedAt.Sub(build.CreatedAt).Seconds())
+	}
+	if build.DurationMS > 0 {
+		m.buildRunDuration.WithLabelValues(build.Status, builder).Observe(float64(build.DurationMS) / 1000)
+	}
+	if build.PeakMemoryBytes > 0 {
+		m.buildPeakMemory.WithLabelValues(builder).Observe(float64(build.PeakMemoryBytes))
+	}
+}
+
+// observeWebhookDelivery records a finished webhook delivery
+func (m *serverMetrics) observeWebhookDelivery(webhook *models.Webhook, delivery *models.WebhookDelivery) {
+	outcome := "success"
+	if !delivery.Success {
+		outcome = "failure"
+	}
+	m.webhookDeliveries.WithLabelValues(webhook.Name, outcome).Inc()
+}
+
+// finishPowerOperation stores a completed BMC operation, counts it, and
+// records the power state it leaves the machine in
+func (s *Server) finishPowerOperation(op *models.PowerOperation) {
+	s.db.UpdatePowerOperation(op)
+	s.metrics.powerOperations.WithLabelValues(op.Operation, op.Status).Inc()
+	s.recordPowerOperationState(op)
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentationMiddleware records request latency per route. Routes are
+// labeled by their template (/api/v1/machines/{id}) so that the number of
+// series stays bounded.
+func (s *Server) instrumentationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		s.metrics.requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).
+			Observe(time.Since(start).Seconds())
+	})
+}
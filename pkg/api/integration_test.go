@@ -0,0 +1,257 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+func TestEnrollment(t *testing.T) {
+	env := testutil.New(t)
+
+	machine := env.EnrollMachine("ENROLL01")
+	if machine.ServiceTag != "ENROLL01" || machine.Status != models.StatusEnrolled {
+		t.Fatalf("enrolled machine = %s, %s; want ENROLL01, enrolled", machine.ServiceTag, machine.Status)
+	}
+	if machine.Hardware.CPU.Cores != 64 || len(machine.Hardware.Disks) != 2 {
+		t.Errorf("hardware = %+v, want the fixture's", machine.Hardware)
+	}
+
+	// Enrolling again returns the machine rather than adding another, and
+	// keeps its inventory until a hardware refresh is requested
+	req := models.EnrollmentRequest{
+		ServiceTag: "ENROLL01",
+		MACAddress: testutil.FixtureMAC("ENROLL01"),
+		Hardware:   testutil.FixtureHardware("ENROLL01"),
+	}
+	req.Hardware.BIOSVersion = "1.11.0"
+	var again models.EnrollmentResponse
+	env.MustJSON(testutil.Anonymous, http.MethodPost, "/api/v1/enroll", req, http.StatusOK, &again)
+	if again.Machine == nil || again.ID != machine.ID || again.Hardware.BIOSVersion != "1.10.2" {
+		t.Errorf("re-enrolled machine = %+v, want %s as it was", again.Machine, machine.ID)
+	}
+
+	var machines []models.MachineSummary
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines", nil, http.StatusOK, &machines)
+	if len(machines) != 1 {
+		t.Errorf("%d machines listed, want 1", len(machines))
+	}
+
+	// A request missing the service tag is refused
+	resp := env.Do(testutil.Anonymous, http.MethodPost, "/api/v1/enroll", models.EnrollmentRequest{MACAddress: testutil.FixtureMAC("X")})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("enrollment without a service tag: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestEnrollmentRecordsClientIP(t *testing.T) {
+	loopback := &net.IPNet{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)}
+
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+		want    string
+	}{
+		{"behind a trusted proxy", []*net.IPNet{loopback}, "198.51.100.7"},
+		{"spoofed header", nil, "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testutil.New(t, func(config *api.Config) {
+				config.TrustedProxies = tt.trusted
+			})
+
+			body, _ := json.Marshal(models.EnrollmentRequest{
+				ServiceTag: "CLIENTIP1",
+				MACAddress: testutil.FixtureMAC("CLIENTIP1"),
+				Hardware:   testutil.FixtureHardware("CLIENTIP1"),
+			})
+			req, _ := http.NewRequest(http.MethodPost, env.URL("/api/v1/enroll"), bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Forwarded-For", "6.6.6.6, 198.51.100.7")
+
+			var enrolled models.EnrollmentResponse
+			resp, err := env.Server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(&enrolled); err != nil || enrolled.Machine == nil {
+				t.Fatalf("enroll: status %d, %v", resp.StatusCode, err)
+			}
+
+			var machine models.Machine
+			env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/"+enrolled.ID, nil, http.StatusOK, &machine)
+			if machine.CurrentIP != tt.want {
+				t.Errorf("current IP = %q, want %s", machine.CurrentIP, tt.want)
+			}
+		})
+	}
+}
+
+func TestMachineCRUD(t *testing.T) {
+	env := testutil.New(t)
+	machine := env.EnrollMachine("CRUD01")
+	path := "/api/v1/machines/" + machine.ID
+
+	var got models.Machine
+	env.MustJSON(models.RoleViewer, http.MethodGet, path, nil, http.StatusOK, &got)
+	if got.ID != machine.ID {
+		t.Fatalf("GET %s = %s", path, got.ID)
+	}
+
+	env.MustJSON(models.RoleOperator, http.MethodPut, path,
+		map[string]interface{}{"hostname": "crud-01", "description": "rack a", "tags": []string{"gpu"}}, http.StatusOK, &got)
+	if got.Hostname != "crud-01" || got.Description != "rack a" || len(got.Tags) != 1 {
+		t.Errorf("updated machine = %+v", got)
+	}
+
+	updated := env.ConfigureMachine(machine.ID, testutil.FixtureConfig)
+	if updated.Status != models.StatusConfigured || updated.NixOSConfig != testutil.FixtureConfig {
+		t.Errorf("configured machine = %s with %q", updated.Status, updated.NixOSConfig)
+	}
+
+	// Deleting moves it to the trash, out of the machine routes
+	env.MustJSON(models.RoleOperator, http.MethodDelete, path, nil, http.StatusNoContent, nil)
+	env.MustJSON(models.RoleViewer, http.MethodGet, path, nil, http.StatusNotFound, nil)
+
+	var trash []models.MachineSummary
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/trash", nil, http.StatusOK, &trash)
+	if !contains(summaryIDs(trash), machine.ID) {
+		t.Error("deleted machine is not in the trash")
+	}
+}
+
+// TestRoleEnforcement makes a request on a representative route of each
+// role as every role, and checks only those with the role get through
+func TestRoleEnforcement(t *testing.T) {
+	env := testutil.New(t)
+	machine := env.EnrollMachine("ROLE01")
+
+	routes := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		needs  models.UserRole
+		status int
+	}{
+		{"list machines", http.MethodGet, "/api/v1/machines", nil, models.RoleViewer, http.StatusOK},
+		{"update machine", http.MethodPut, "/api/v1/machines/" + machine.ID, map[string]string{"description": "x"}, models.RoleOperator, http.StatusOK},
+		{"list users", http.MethodGet, "/api/v1/users", nil, models.RoleAdmin, http.StatusOK},
+	}
+	rank := map[models.UserRole]int{testutil.Anonymous: 0, models.RoleViewer: 1, models.RoleOperator: 2, models.RoleAdmin: 3}
+
+	for _, route := range routes {
+		for _, role := range append([]models.UserRole{testutil.Anonymous}, testutil.Roles...) {
+			want := route.status
+			switch {
+			case role == testutil.Anonymous:
+				want = http.StatusUnauthorized
+			case rank[role] < rank[route.needs]:
+				want = http.StatusForbidden
+			}
+
+			resp := env.Do(role, route.method, route.path, route.body)
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("%s as %q: status = %d, want %d", route.name, role, resp.StatusCode, want)
+			}
+		}
+	}
+}
+
+func TestBuildTriggering(t *testing.T) {
+	env := testutil.New(t)
+	machine := env.EnrollMachine("BUILD01")
+
+	// A machine without a configuration has nothing to build
+	resp := env.Do(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+machine.ID+"/build", nil)
+	resp.Body.Close()
+	if resp.StatusCode < 400 {
+		t.Errorf("build without a configuration: status = %d, want an error", resp.StatusCode)
+	}
+
+	env.ConfigureMachine(machine.ID, testutil.FixtureConfig)
+
+	// Viewers can't trigger builds
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/machines/"+machine.ID+"/build", nil, http.StatusForbidden, nil)
+
+	var build models.BuildRequest
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+machine.ID+"/build", nil, http.StatusCreated, &build)
+	if build.MachineID != machine.ID || build.Config != testutil.FixtureConfig {
+		t.Errorf("build = %+v, want one of the machine's configuration", build)
+	}
+
+	var got models.BuildRequest
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/builds/"+build.ID, nil, http.StatusOK, &got)
+	if got.ID != build.ID {
+		t.Errorf("GET build = %s, want %s", got.ID, build.ID)
+	}
+
+	var builds []models.BuildRequest
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/"+machine.ID+"/builds", nil, http.StatusOK, &builds)
+	if len(builds) != 1 || builds[0].ID != build.ID {
+		t.Errorf("machine's builds = %+v, want the one triggered", builds)
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	env := testutil.New(t)
+	first := env.EnrollMachine("GROUP01")
+	second := env.EnrollMachine("GROUP02")
+	group := env.CreateGroup("rack-a")
+	members := "/api/v1/groups/" + group.ID + "/machines"
+
+	listed := func() []string {
+		t.Helper()
+		var machines []models.Machine
+		env.MustJSON(models.RoleViewer, http.MethodGet, members, nil, http.StatusOK, &machines)
+		var ids []string
+		for _, m := range machines {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	// Viewers can't change membership
+	env.MustJSON(models.RoleViewer, http.MethodPut, members+"/"+first.ID, nil, http.StatusForbidden, nil)
+
+	env.MustJSON(models.RoleOperator, http.MethodPut, members+"/"+first.ID, nil, http.StatusNoContent, nil)
+	env.MustJSON(models.RoleOperator, http.MethodPut, members+"/"+second.ID, nil, http.StatusNoContent, nil)
+	if ids := listed(); len(ids) != 2 || !contains(ids, first.ID) || !contains(ids, second.ID) {
+		t.Errorf("group machines = %v, want both", ids)
+	}
+
+	env.MustJSON(models.RoleOperator, http.MethodDelete, members+"/"+first.ID, nil, http.StatusNoContent, nil)
+	if ids := listed(); len(ids) != 1 || ids[0] != second.ID {
+		t.Errorf("group machines after removal = %v, want %s", ids, second.ID)
+	}
+}
+
+func TestWebhookFiring(t *testing.T) {
+	env := testutil.New(t)
+	receiver := testutil.NewWebhookReceiver(t)
+	env.AddWebhook(receiver, events.MachineEnrolled)
+
+	machine := env.EnrollMachine("HOOK01")
+
+	delivery := receiver.WaitFor(t, events.MachineEnrolled, 5*time.Second)
+	subject, _ := delivery.Payload["machine"].(map[string]interface{})
+	if subject["id"] != machine.ID || subject["service_tag"] != "HOOK01" {
+		t.Errorf("delivery = %s, want one for machine %s", delivery.Body, machine.ID)
+	}
+	if delivery.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("delivery Content-Type = %q", delivery.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/redfish"
+	"github.com/gorilla/mux"
+)
+
+// handleRefreshInventory collects hardware inventory from the machine's BMC.
+// Collection runs asynchronously and is tracked as a BMC operation that can
+// be polled via GET /machines/{id}/bmc/operations/{op_id}.
+func (s *Server) handleRefreshInventory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	machineID := vars["id"]
+
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if machine.BMCInfo == nil || !machine.BMCInfo.Enabled {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
+		return
+	}
+
+	userID := "system"
+	if claims, ok := auth.GetClaims(r); ok {
+		userID = claims.UserID
+	}
+
+	op := &models.PowerOperation{
+		MachineID:   machineID,
+		Operation:   "inventory",
+		Status:      "pending",
+		InitiatedBy: userID,
+	}
+
+	if err := s.db.CreatePowerOperation(op); err != nil {
+		respondInternalError(w, err, "failed to create BMC operation")
+		return
+	}
+
+	bmc := *machine.BMCInfo
+	go s.refreshInventory(machineID, &bmc, op)
+
+	respondJSON(w, http.StatusAccepted, op)
+}
+
+// refreshInventory performs the BMC inventory collection for an operation
+func (s *Server) refreshInventory(machineID string, bmc *models.BMCInfo, op *models.PowerOperation) {
+	inventory, err := s.collectBMCInventory(bmc)
+
+	var machine *models.Machine
+	if err == nil {
+		// Re-read the machine so we merge into whatever enrollment stored
+		// while the BMC call was in flight
+		machine, err = s.db.GetMachine(machineID)
+		if err == nil && machine == nil {
+			err = fmt.Errorf("machine no longer exists")
+		}
+	}
+
+	if err == nil {
+		machine.Hardware.MergeMissing(*inventory)
+		err = s.db.UpdateMachine(machine)
+	}
+
+	now := time.Now()
+	op.CompletedAt = &now
+
+	if err != nil {
+		log.Printf("BMC inventory refresh failed for machine %s: %v", machineID, err)
+		op.Status = "failed"
+		op.Error = err.Error()
+		s.finishPowerOperation(op)
+		return
+	}
+
+	op.Status = "success"
+	op.Result = fmt.Sprintf("collected %d memory modules, %d disks, %d NICs",
+		len(inventory.Memory.Modules), len(inventory.Disks), len(inventory.NICs))
+	s.finishPowerOperation(op)
+
+	s.publish(context.Background(), events.Event{
+		Type:      events.MachineInventoryRefreshed,
+		MachineID: machine.ID,
+		Actor:     operationActor(op),
+		Data: events.InventoryRefreshedData{
+			OperationID:  op.ID,
+			Source:       bmcSource(bmc),
+			Manufacturer: machine.Hardware.Manufacturer,
+			Model:        machine.Hardware.Model,
+		},
+	})
+
+	if _, err := s.service.CheckHardwareCompliance(context.Background(), machine); err != nil {
+		log.Printf("Failed to check hardware compliance of machine %s: %v", machine.ID, err)
+	}
+}
+
+// handleRefreshHardware sends a machine to the registration image on its
+// next boot, so its hardware inventory is collected again
+func (s *Server) handleRefreshHardware(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.db.GetMachine(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if err := s.service.RequestHardwareRefresh(r.Context(), machine); err != nil {
+		respondServiceError(w, err, "failed to request hardware refresh")
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, machine)
+}
+
+// handleCancelHardwareRefresh lets a machine boot its own image again
+// without its hardware inventory having been collected
+func (s *Server) handleCancelHardwareRefresh(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.db.GetMachine(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if err := s.service.CancelHardwareRefresh(machine); err != nil {
+		respondInternalError(w, err, "failed to cancel hardware refresh")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, machine)
+}
+
+// handleGetBMCOperation returns the status of an asynchronous BMC operation
+func (s *Server) handleGetBMCOperation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	machineID := vars["id"]
+	opID := vars["op_id"]
+
+	op, err := s.db.GetPowerOperation(opID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if op == nil || op.MachineID != machineID {
+		respondError(w, http.StatusNotFound, CodeOperationNotFound, "operation not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, op)
+}
+
+// collectBMCInventory reads inventory using the protocol the BMC speaks
+func (s *Server) collectBMCInventory(bmc *models.BMCInfo) (*models.HardwareInfo, error) {
+	if bmcSource(bmc) == "redfish" {
+		client, err := redfish.NewClient(bmc)
+		if err != nil {
+			return nil, err
+		}
+		return client.GetInventory()
+	}
+
+	return s.powerController().GetFRUInventory(bmc)
+}
+
+// bmcSource normalizes the BMC type to the protocol used to talk to it
+func bmcSource(bmc *models.BMCInfo) string {
+	if strings.EqualFold(bmc.Type, "redfish") {
+		return "redfish"
+	}
+	return "ipmi"
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/dhcp"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// LeaseImportResponse summarizes a DHCP lease import
+type LeaseImportResponse struct {
+	Leases  int `json:"leases"`
+	Updated int `json:"updated"`
+}
+
+// handleImportLeases imports a DHCP lease file posted as the request body.
+// The format is detected automatically unless ?format=isc|dnsmasq is given.
+func (s *Server) handleImportLeases(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if respondBodyError(w, err) {
+			return
+		}
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "failed to read request body")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = dhcp.DetectFormat(body)
+	}
+
+	leases, err := dhcp.Parse(bytes.NewReader(body), format)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, LeaseImportResponse{
+		Leases:  len(leases),
+		Updated: s.ApplyLeases(leases),
+	})
+}
+
+// ApplyLeases stores the leased address on every machine whose MAC address
+// appears in leases and returns the number of machines whose IP changed
+func (s *Server) ApplyLeases(leases []dhcp.Lease) int {
+	// A MAC can hold several leases; keep the one that expires last
+	latest := make(map[string]dhcp.Lease)
+	for _, lease := range leases {
+		if existing, ok := latest[lease.MACAddress]; ok && existing.Expires.After(lease.Expires) {
+			continue
+		}
+		latest[lease.MACAddress] = lease
+	}
+
+	updated := 0
+	for mac, lease := range latest {
+		ip, err := models.NormalizeIP(lease.IPAddress)
+		if err != nil {
+			log.Printf("Ignoring lease of %s: %v", mac, err)
+			continue
+		}
+		lease.IPAddress = ip
+
+		machineID, err := s.db.UpdateMachineCurrentIP(mac, lease.IPAddress)
+		if err != nil {
+			log.Printf("Failed to update IP for %s: %v", mac, err)
+			continue
+		}
+		if machineID == "" {
+			continue
+		}
+
+		updated++
+		s.publish(context.Background(), events.Event{
+			Type:      events.MachineIPChanged,
+			MachineID: machineID,
+			Data: events.IPChangedData{
+				CurrentIP:  lease.IPAddress,
+				MACAddress: mac,
+			},
+		})
+	}
+
+	return updated
+}
+
+// StartLeaseWatcher loads the DHCP lease file at path and keeps machine IPs
+// in sync as the DHCP server rewrites it
+func (s *Server) StartLeaseWatcher(path string) error {
+	watcher, err := dhcp.NewWatcher(path, func(leases []dhcp.Lease) {
+		if updated := s.ApplyLeases(leases); updated > 0 {
+			log.Printf("Updated IP address for %d machines from %s", updated, path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Watching DHCP lease file %s", path)
+	watcher.Start()
+	return nil
+}
@@ -0,0 +1,69 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+func TestImportLeases(t *testing.T) {
+	env := testutil.New(t)
+
+	// Machines enrolled with the MACs leased in pkg/dhcp's fixtures
+	enroll := func(serviceTag, mac string) *models.Machine {
+		var resp models.EnrollmentResponse
+		req := models.EnrollmentRequest{ServiceTag: serviceTag, MACAddress: mac, Hardware: testutil.FixtureHardware(serviceTag)}
+		env.MustJSON(testutil.Anonymous, http.MethodPost, "/api/v1/enroll", req, http.StatusCreated, &resp)
+		return resp.Machine
+	}
+	isc := enroll("LEASE01", "52:54:00:aa:10:21")
+	dnsmasq := enroll("LEASE02", "52:54:00:BB:20:32")
+	unleased := enroll("LEASE03", "52:54:00:aa:10:22")
+
+	tests := []struct {
+		fixture string
+		leases  int
+	}{
+		{"dhcpd.leases", 2},
+		{"dnsmasq.leases", 3},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join("..", "dhcp", "testdata", tt.fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := sendBody(t, env, models.RoleOperator, http.MethodPost, "/api/v1/dhcp/leases", "text/plain", data, false)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.fixture, resp.StatusCode)
+		}
+		var result api.LeaseImportResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Leases != tt.leases || result.Updated != 1 {
+			t.Errorf("%s: %+v, want %d leases updating one machine", tt.fixture, result, tt.leases)
+		}
+	}
+
+	// The machine whose lease expired keeps the address it enrolled from
+	want := map[string]string{isc.ID: "10.0.10.21", dnsmasq.ID: "10.0.20.32", unleased.ID: "127.0.0.1"}
+	for id, ip := range want {
+		var machine models.Machine
+		env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/"+id, nil, http.StatusOK, &machine)
+		if machine.CurrentIP != ip {
+			t.Errorf("%s: current IP %q, want %q", machine.ServiceTag, machine.CurrentIP, ip)
+		}
+	}
+
+	// Viewers can't import leases
+	resp := sendBody(t, env, models.RoleViewer, http.MethodPost, "/api/v1/dhcp/leases", "text/plain", []byte("lease 10.0.0.5 {\n}\n"), false)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer import: status %d, want 403", resp.StatusCode)
+	}
+}
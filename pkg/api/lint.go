@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/lint"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// handleGetMachineConfigLint lints a machine's configuration with the
+// current rules, recording the result on the machine
+func (s *Server) handleGetMachineConfigLint(w http.ResponseWriter, r *http.Request) {
+	machine := s.fragmentMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	result, err := s.service.LintMachine(machine)
+	if err != nil {
+		respondInternalError(w, err, "failed to lint configuration")
+		return
+	}
+	if result == nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fragments.ErrNoConfiguration.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, result)
+}
+
+// handleListLintRules lists the built-in checks, with their severities,
+// and the rules of the rules file
+func (s *Server) handleListLintRules(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, s.config.LintRules.List())
+}
+
+// handleCreateLintRule adds a rule to the rules file
+func (s *Server) handleCreateLintRule(w http.ResponseWriter, r *http.Request) {
+	var rule models.LintRule
+	if !decodeJSON(w, r, &rule) {
+		return
+	}
+
+	if err := rule.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := s.config.LintRules.CreateRule(rule); err != nil {
+		respondLintRuleError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, rule)
+}
+
+// handleUpdateLintRule replaces a rule of the rules file, or changes the
+// severity of a built-in check
+func (s *Server) handleUpdateLintRule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if lint.IsBuiltin(id) {
+		var req models.LintSeverityRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if !models.IsValidLintSeverity(req.Severity) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "severity must be error, warning, or off")
+			return
+		}
+		if err := s.config.LintRules.SetBuiltinSeverity(id, req.Severity); err != nil {
+			respondLintRuleError(w, err)
+			return
+		}
+		for _, builtin := range lint.Builtins(s.config.LintRules.Rules()) {
+			if builtin.ID == id {
+				respondJSON(w, http.StatusOK, builtin)
+				return
+			}
+		}
+		return
+	}
+
+	var rule models.LintRule
+	if !decodeJSON(w, r, &rule) {
+		return
+	}
+	rule.ID = id
+
+	if err := rule.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := s.config.LintRules.UpdateRule(rule); err != nil {
+		respondLintRuleError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rule)
+}
+
+// handleDeleteLintRule removes a rule from the rules file
+func (s *Server) handleDeleteLintRule(w http.ResponseWriter, r *http.Request) {
+	if err := s.config.LintRules.DeleteRule(mux.Vars(r)["id"]); err != nil {
+		respondLintRuleError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respondLintRuleError responds with why a change to the rules file failed
+func respondLintRuleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, lint.ErrNoRulesFile):
+		respondError(w, http.StatusServiceUnavailable, CodeLintRulesNotConfigured, err.Error())
+	case errors.Is(err, lint.ErrRuleNotFound):
+		respondError(w, http.StatusNotFound, CodeLintRuleNotFound, err.Error())
+	case errors.Is(err, lint.ErrRuleExists):
+		respondError(w, http.StatusConflict, CodeAlreadyExists, err.Error())
+	case errors.Is(err, lint.ErrBuiltinRule):
+		respondError(w, http.StatusConflict, CodeConflict, err.Error())
+	default:
+		respondInternalError(w, err, "failed to save lint rules")
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// jobLockGrace is added to twice a job's interval to get the lease on
+	// its lock, so a slow run or a missed tick doesn't hand the job to
+	// another server
+	jobLockGrace = time.Minute
+
+	// rolloutLockName serializes changes to build rollouts across servers.
+	// Its holder releases it as soon as it is done; the lease only matters
+	// if the holder dies.
+	rolloutLockName  = "build-rollouts"
+	rolloutLockLease = 5 * time.Minute
+
+	// rolloutLockWait is how long a request that changes a rollout waits
+	// for another server's orchestrator pass to finish
+	rolloutLockWait  = 10 * time.Second
+	rolloutLockRetry = 100 * time.Millisecond
+)
+
+// leadJob reports whether this server should run a periodic job now. Jobs
+// run on one server at a time: the first server to ask takes the job's lock
+// and keeps it by asking every interval, and the others skip the job until
+// the lock stops being renewed.
+func (s *Server) leadJob(job string, interval time.Duration) bool {
+	ok, err := s.db.AcquireLock("job:"+job, s.instanceID, 2*interval+jobLockGrace)
+	if err != nil {
+		log.Printf("Failed to take the %s job lock: %v", job, err)
+		ok = false
+	}
+
+	if _, led := s.ledJobs.Load(job); ok && !led {
+		s.ledJobs.Store(job, struct{}{})
+		log.Printf("Running the %s job on this server (%s)", job, s.instanceID)
+	} else if !ok && led {
+		s.ledJobs.Delete(job)
+		log.Printf("The %s job moved to another server", job)
+	}
+
+	return ok
+}
+
+// ReleaseJobLocks gives up the locks of the jobs this server runs, so that
+// another server takes them over without waiting for their leases to expire
+func (s *Server) ReleaseJobLocks() {
+	s.ledJobs.Range(func(job, _ any) bool {
+		if err := s.db.ReleaseLock("job:"+job.(string), s.instanceID); err != nil {
+			log.Printf("%v", err)
+		}
+		s.ledJobs.Delete(job)
+		return true
+	})
+}
+
+// lockBuildRollouts takes the lock on build rollouts, waiting up to wait
+// for another server to release it, and reports whether it was taken
+func (s *Server) lockBuildRollouts(wait time.Duration) bool {
+	s.rolloutMu.Lock()
+
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := s.db.AcquireLock(rolloutLockName, s.instanceID, rolloutLockLease)
+		if err != nil {
+			log.Printf("Failed to lock build rollouts: %v", err)
+		}
+		if ok {
+			return true
+		}
+		if time.Now().After(deadline) {
+			s.rolloutMu.Unlock()
+			return false
+		}
+		time.Sleep(rolloutLockRetry)
+	}
+}
+
+// unlockBuildRollouts releases the lock taken by lockBuildRollouts
+func (s *Server) unlockBuildRollouts() {
+	if err := s.db.ReleaseLock(rolloutLockName, s.instanceID); err != nil {
+		log.Printf("%v", err)
+	}
+	s.rolloutMu.Unlock()
+}
+
+// respondRolloutsBusy reports that another server held the rollout lock for
+// too long
+func respondRolloutsBusy(w http.ResponseWriter) {
+	respondError(w, http.StatusConflict, CodeConflict, "build rollouts are being updated by another server; retry")
+}
+
+// newInstanceID names this server process in lock tables: its hostname and
+// a random suffix, since replicas can share a hostname
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "server"
+	}
+	return host + "-" + uuid.NewString()[:8]
+}
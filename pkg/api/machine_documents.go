@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// machineDocumentYAML is a machine document as it is read. It has a field
+// for each of models.IgnoredDocumentFields, so documents copied from the
+// machines API decode, while misspelled fields don't.
+type machineDocumentYAML struct {
+	models.MachineDocument `yaml:",inline"`
+
+	ID               interface{} `yaml:"id"`
+	MACAddress       interface{} `yaml:"mac_address"`
+	Status           interface{} `yaml:"status"`
+	Hardware         interface{} `yaml:"hardware"`
+	EnrolledAt       interface{} `yaml:"enrolled_at"`
+	UpdatedAt        interface{} `yaml:"updated_at"`
+	LastSeenAt       interface{} `yaml:"last_seen_at"`
+	LastBuildID      interface{} `yaml:"last_build_id"`
+	LastBuildTime    interface{} `yaml:"last_build_time"`
+	DecommissionedAt interface{} `yaml:"decommissioned_at"`
+	DeletedAt        interface{} `yaml:"deleted_at"`
+}
+
+// handleExportMachine returns a machine's document as YAML
+func (s *Server) handleExportMachine(w http.ResponseWriter, r *http.Request) {
+	machine, err := s.db.GetMachine(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	doc, err := s.service.ExportMachine(machine)
+	if err != nil {
+		respondInternalError(w, err, "failed to export machine")
+		return
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		respondInternalError(w, err, "failed to export machine")
+		return
+	}
+	enc.Close()
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
+
+// handleApplyMachines reconciles machines with the YAML documents in the
+// body: one or more documents separated by ---, or a list of them. JSON is
+// read as YAML. With dry_run=true, it only reports what would change;
+// force=true applies documents whose machines changed since their
+// revision.
+func (s *Server) handleApplyMachines(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+	force, _ := strconv.ParseBool(query.Get("force"))
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "failed to read request body")
+		}
+		return
+	}
+
+	docs, ignored, err := parseMachineDocuments(body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if len(docs) == 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "no machine documents given")
+		return
+	}
+
+	report := s.service.ApplyMachineDocuments(r.Context(), docs, service.ApplyOptions{
+		DryRun: dryRun,
+		Force:  force,
+		Admin:  s.isAdmin(r),
+	})
+	for i := range report.Items {
+		report.Items[i].Ignored = ignored[i]
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// parseMachineDocuments reads the machine documents of a YAML stream,
+// returning, for each, the server-owned fields it had. Documents are read
+// twice: once as nodes, to see whether each is a document or a list of
+// them and which fields it has, and once strictly into documents.
+func parseMachineDocuments(data []byte) ([]models.MachineDocument, [][]string, error) {
+	var nodes []*yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var node yaml.Node
+		err := dec.Decode(&node)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid YAML: %v", err)
+		}
+		nodes = append(nodes, &node)
+	}
+
+	var docs []models.MachineDocument
+	var ignored [][]string
+	strict := yaml.NewDecoder(bytes.NewReader(data))
+	strict.KnownFields(true)
+	for i, node := range nodes {
+		var content *yaml.Node
+		if len(node.Content) > 0 {
+			content = node.Content[0]
+		}
+
+		switch {
+		case content == nil || (content.Kind == yaml.ScalarNode && content.Tag == "!!null"):
+			// An empty document, such as after a trailing ---
+			var skip interface{}
+			strict.Decode(&skip)
+		case content.Kind == yaml.SequenceNode:
+			var list []machineDocumentYAML
+			if err := strict.Decode(&list); err != nil {
+				return nil, nil, documentError(i, err)
+			}
+			for j := range list {
+				docs = append(docs, list[j].MachineDocument)
+				ignored = append(ignored, ignoredFields(content.Content[j]))
+			}
+		case content.Kind == yaml.MappingNode:
+			var doc machineDocumentYAML
+			if err := strict.Decode(&doc); err != nil {
+				return nil, nil, documentError(i, err)
+			}
+			docs = append(docs, doc.MachineDocument)
+			ignored = append(ignored, ignoredFields(content))
+		default:
+			return nil, nil, fmt.Errorf("document %d: a machine document or a list of them is required", i+1)
+		}
+	}
+
+	return docs, ignored, nil
+}
+
+// goTypeName matches the Go types YAML decoding errors name
+var goTypeName = regexp.MustCompile(` in type [\w.]+`)
+
+// documentError describes why the i'th document in a stream didn't decode,
+// without naming Go types
+func documentError(i int, err error) error {
+	return fmt.Errorf("document %d: %s", i+1, goTypeName.ReplaceAllString(err.Error(), ""))
+}
+
+// ignoredFields lists the server-owned fields a document's mapping has
+func ignoredFields(node *yaml.Node) []string {
+	var fields []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		for _, field := range models.IgnoredDocumentFields {
+			if key == field {
+				fields = append(fields, key)
+			}
+		}
+	}
+	return fields
+}
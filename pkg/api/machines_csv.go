@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// machinesCSVHeader names the columns of the machine list CSV export
+var machinesCSVHeader = []string{
+	"id", "service_tag", "mac_address", "status", "hostname",
+	"manufacturer", "model", "cpu_model", "cpu_cores", "memory_gb", "disk_count",
+	"gpu_count", "gpu_model", "current_ip", "tags",
+	"enrolled_at", "last_seen_at", "metadata",
+	"owner_team", "owner_email", "owner_slack_channel", "environment",
+}
+
+// writeMachinesCSV writes machine summaries as CSV, one row per machine.
+// Tags are separated by spaces, since they can't contain any, and metadata
+// is a JSON object. Ownership is the effective ownership, including what
+// machines inherit from their groups. Text reported by machines, such as service tags and
+// models, goes through csvCell.
+func writeMachinesCSV(w http.ResponseWriter, machines []*models.MachineSummary) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="machines.csv"`)
+
+	out := csv.NewWriter(w)
+	out.Write(machinesCSVHeader)
+
+	for _, m := range machines {
+		lastSeen := ""
+		if m.LastSeenAt != nil {
+			lastSeen = m.LastSeenAt.Format(time.RFC3339)
+		}
+		metadata := ""
+		if len(m.Metadata) > 0 {
+			data, _ := json.Marshal(m.Metadata)
+			metadata = string(data)
+		}
+		var owner models.Ownership
+		if m.EffectiveOwnership != nil {
+			owner = *m.EffectiveOwnership
+		}
+
+		out.Write([]string{
+			m.ID,
+			csvCell(m.ServiceTag),
+			csvCell(m.MACAddress),
+			string(m.Status),
+			csvCell(m.Hostname),
+			csvCell(m.Manufacturer),
+			csvCell(m.Model),
+			csvCell(m.CPUModel),
+			strconv.Itoa(m.CPUCores),
+			strconv.FormatFloat(m.MemoryGB, 'f', -1, 64),
+			strconv.Itoa(m.DiskCount),
+			strconv.Itoa(m.GPUCount),
+			csvCell(m.GPUModel),
+			csvCell(m.CurrentIP),
+			strings.Join(m.Tags, " "),
+			m.EnrolledAt.Format(time.RFC3339),
+			lastSeen,
+			csvCell(metadata),
+			csvCell(owner.Team),
+			csvCell(owner.ContactEmail),
+			csvCell(owner.SlackChannel),
+			owner.Environment,
+		})
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Failed to write machines CSV: %v", err)
+	}
+}
+
+// csvCell stops spreadsheets from reading text as a formula, since enrolling
+// machines choose their own service tags and hardware strings
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/maintenance"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/gorilla/mux"
+)
+
+// handleCreateMaintenanceWindow creates a new maintenance window
+func (s *Server) handleCreateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	// Windows are enforced unless created disabled
+	window := models.MaintenanceWindow{Enabled: true}
+	if !decodeJSON(w, r, &window) {
+		return
+	}
+
+	if err := maintenance.Validate(&window); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if claims, ok := auth.GetClaims(r); ok {
+		window.CreatedBy = claims.Username
+	}
+
+	if err := s.db.CreateMaintenanceWindow(&window); err != nil {
+		respondInternalError(w, err, "failed to create maintenance window")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, window)
+}
+
+// handleListMaintenanceWindows lists all maintenance windows
+func (s *Server) handleListMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	windows, err := s.db.ListMaintenanceWindows()
+	if err != nil {
+		respondInternalError(w, err, "failed to list maintenance windows")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, windows)
+}
+
+// handleGetMaintenanceWindow retrieves a single maintenance window
+func (s *Server) handleGetMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	window, err := s.db.GetMaintenanceWindow(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if window == nil {
+		respondError(w, http.StatusNotFound, CodeMaintenanceWindowNotFound, "maintenance window not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, window)
+}
+
+// handleUpdateMaintenanceWindow replaces a maintenance window's definition
+func (s *Server) handleUpdateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	existing, err := s.db.GetMaintenanceWindow(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if existing == nil {
+		respondError(w, http.StatusNotFound, CodeMaintenanceWindowNotFound, "maintenance window not found")
+		return
+	}
+
+	window := models.MaintenanceWindow{Enabled: existing.Enabled}
+	if !decodeJSON(w, r, &window) {
+		return
+	}
+
+	if err := maintenance.Validate(&window); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	window.ID = existing.ID
+	window.CreatedBy = existing.CreatedBy
+	window.CreatedAt = existing.CreatedAt
+
+	if err := s.db.UpdateMaintenanceWindow(&window); err != nil {
+		respondInternalError(w, err, "failed to update maintenance window")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, window)
+}
+
+// handleDeleteMaintenanceWindow deletes a maintenance window
+func (s *Server) handleDeleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if err := s.db.DeleteMaintenanceWindow(id); err != nil {
+		respondInternalError(w, err, "failed to delete maintenance window")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetActiveMaintenance returns the windows in progress and the next
+// window to start
+func (s *Server) handleGetActiveMaintenance(w http.ResponseWriter, r *http.Request) {
+	windows, err := s.db.ListEnabledMaintenanceWindows()
+	if err != nil {
+		respondInternalError(w, err, "failed to list maintenance windows")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, maintenance.Summarize(windows, time.Now().UTC()))
+}
+
+// checkMaintenance enforces maintenance windows for op on the given machines.
+// It writes a 423 Locked response naming the next window and returns false
+// when the operation is blocked. Admins may pass ?override=true to proceed
+// anyway; each override is recorded in the machine's event log.
+func (s *Server) checkMaintenance(w http.ResponseWriter, r *http.Request, machineIDs []string, op string) bool {
+	requested, allowed := s.maintenanceOverride(r)
+	err := s.service.CheckMaintenance(r.Context(), machineIDs, op, allowed)
+	if err == nil {
+		return true
+	}
+
+	if !respondOverrideForbidden(w, err, requested) {
+		respondServiceError(w, err, "failed to check maintenance windows")
+	}
+	return false
+}
+
+// maintenanceOverride reports whether a request asks to override
+// maintenance windows with ?override=true, and whether its user may
+func (s *Server) maintenanceOverride(r *http.Request) (requested, allowed bool) {
+	if r.URL.Query().Get("override") != "true" {
+		return false, false
+	}
+	if !s.config.EnableAuth {
+		return true, true
+	}
+	claims, ok := auth.GetClaims(r)
+	return true, ok && claims.Role == models.RoleAdmin
+}
+
+// respondOverrideForbidden responds with 403 and returns true when err is
+// a maintenance window blocking an operation whose user asked to override
+// it, and may not
+func respondOverrideForbidden(w http.ResponseWriter, err error, requested bool) bool {
+	var blocked *service.MaintenanceError
+	if !requested || !errors.As(err, &blocked) {
+		return false
+	}
+	respondError(w, http.StatusForbidden, CodeForbidden, "only admins can override maintenance windows")
+	return true
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// metadataError is a merged metadata object that failed validation
+type metadataError struct{ err error }
+
+func (e metadataError) Error() string { return e.err.Error() }
+
+// handleUpdateMachineMetadata applies a JSON merge patch to a machine's
+// metadata: keys in the patch are set, keys set to null are removed, and
+// nested objects are merged the same way
+func (s *Server) handleUpdateMachineMetadata(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var patch map[string]interface{}
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+
+	found, err := s.db.UpdateMachineMetadata(id, func(metadata map[string]interface{}) (map[string]interface{}, error) {
+		merged := models.MergeMetadata(metadata, patch)
+		if err := models.ValidateMetadata(merged); err != nil {
+			return nil, metadataError{err}
+		}
+		return merged, nil
+	})
+	var invalid metadataError
+	if errors.As(err, &invalid) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, invalid.Error())
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to update machine metadata")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, machine)
+}
@@ -6,8 +6,11 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 	"github.com/gorilla/mux"
 )
@@ -20,44 +23,123 @@ func (s *Server) handleSubmitMetrics(w http.ResponseWriter, r *http.Request) {
 	// Verify machine exists
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	// Parse metrics
 	var metrics models.MachineMetrics
-	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeJSON(w, r, &metrics) {
 		return
 	}
 
+	// Metrics from a host that isn't the machine, such as a clone whose
+	// agent config was copied, would pollute the machine's history
+	if !machine.IdentityExempt {
+		ok, err := s.checkReportedIdentity(r, machine, &metrics)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if !ok {
+			respondError(w, http.StatusConflict, CodeIdentityMismatch, "reported identity does not match the machine")
+			return
+		}
+	}
+
 	// Set machine ID and timestamp
 	metrics.MachineID = machineID
 	metrics.Timestamp = time.Now()
 
 	// Save metrics
 	if err := s.db.CreateMachineMetrics(&metrics); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to save metrics: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to save metrics")
 		return
 	}
 
-	// Update machine last_seen_at
-	now := time.Now()
-	machine.LastSeenAt = &now
-	if err := s.db.UpdateMachine(machine); err != nil {
-		// Log but don't fail the request
-		log.Printf("Failed to update machine last_seen_at: %v", err)
-	}
+	// Metrics are the machine's heartbeat, so they update last_seen_at
+	// and the address it reports from
+	s.service.RecordAddress(r.Context(), machine, clientIP(r))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(metrics)
 }
 
+// checkReportedIdentity reports whether the service tag and MAC address a
+// metrics submission reports are the machine's, publishing
+// machine.identity_mismatch when they aren't. Agents that report no
+// identity aren't checked.
+func (s *Server) checkReportedIdentity(r *http.Request, machine *models.Machine, metrics *models.MachineMetrics) (bool, error) {
+	if metrics.ReportedMAC != "" {
+		mac, err := models.NormalizeMAC(metrics.ReportedMAC)
+		if err != nil {
+			return false, fmt.Errorf("reported_mac %q is not a valid MAC address", metrics.ReportedMAC)
+		}
+		metrics.ReportedMAC = mac
+	}
+	metrics.ReportedServiceTag = strings.TrimSpace(metrics.ReportedServiceTag)
+
+	tagMatches := metrics.ReportedServiceTag == "" || strings.EqualFold(metrics.ReportedServiceTag, machine.ServiceTag)
+	macMatches := metrics.ReportedMAC == "" || metrics.ReportedMAC == machine.MACAddress
+	if tagMatches && macMatches {
+		return true, nil
+	}
+
+	log.Printf("Rejected metrics for machine %s from %s reporting service tag %q and MAC %q",
+		machine.ID, clientIP(r), metrics.ReportedServiceTag, metrics.ReportedMAC)
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineIdentityMismatch,
+		MachineID: machine.ID,
+		Data: events.IdentityMismatchData{
+			ServiceTag:         machine.ServiceTag,
+			MACAddress:         machine.MACAddress,
+			ReportedServiceTag: metrics.ReportedServiceTag,
+			ReportedMAC:        metrics.ReportedMAC,
+			SourceIP:           clientIP(r),
+		},
+	})
+	return false, nil
+}
+
+// handleSetIdentityExempt sets whether a machine's metrics submissions skip
+// the identity check
+func (s *Server) handleSetIdentityExempt(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var req models.IdentityExemptRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.IdentityExempt == nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "identity_exempt is required")
+		return
+	}
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if err := s.db.SetMachineIdentityExempt(id, *req.IdentityExempt); err != nil {
+		respondInternalError(w, err, "failed to update machine")
+		return
+	}
+	machine.IdentityExempt = *req.IdentityExempt
+
+	log.Printf("Machine %s identity exempt set to %t", machine.ID, machine.IdentityExempt)
+	respondJSON(w, http.StatusOK, machine)
+}
+
 // handleGetLatestMetrics retrieves the latest metrics for a machine
 func (s *Server) handleGetLatestMetrics(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -66,23 +148,23 @@ func (s *Server) handleGetLatestMetrics(w http.ResponseWriter, r *http.Request)
 	// Verify machine exists
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	// Get latest metrics
 	metrics, err := s.db.GetLatestMetrics(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get metrics: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get metrics")
 		return
 	}
 
 	if metrics == nil {
-		http.Error(w, "No metrics found for this machine", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMetricsNotFound, "no metrics found for this machine")
 		return
 	}
 
@@ -98,11 +180,11 @@ func (s *Server) handleGetMetricsHistory(w http.ResponseWriter, r *http.Request)
 	// Verify machine exists
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
@@ -130,7 +212,7 @@ func (s *Server) handleGetMetricsHistory(w http.ResponseWriter, r *http.Request)
 	// Get metrics history
 	metrics, err := s.db.ListMetrics(machineID, since, limit)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get metrics: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get metrics")
 		return
 	}
 
@@ -141,15 +223,15 @@ func (s *Server) handleGetMetricsHistory(w http.ResponseWriter, r *http.Request)
 // handleGetAllMachinesMetrics retrieves latest metrics for all machines
 func (s *Server) handleGetAllMachinesMetrics(w http.ResponseWriter, r *http.Request) {
 	// Get all machines
-	machines, err := s.db.ListMachines()
+	machines, err := s.db.ListMachineSummaries(database.MachineFilter{VisibleTo: visibleTo(r)})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machines: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machines")
 		return
 	}
 
 	// Get latest metrics for each machine
 	type MachineWithMetrics struct {
-		Machine *models.Machine        `json:"machine"`
+		Machine *models.MachineSummary `json:"machine"`
 		Metrics *models.MachineMetrics `json:"metrics,omitempty"`
 	}
 
@@ -0,0 +1,110 @@
+package api_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+func TestMetricsIdentityCheck(t *testing.T) {
+	env := testutil.New(t)
+	machine := env.EnrollMachine("IDENT01")
+	path := "/api/v1/machines/" + machine.ID + "/metrics"
+	mac := testutil.FixtureMAC("IDENT01")
+
+	tests := []struct {
+		name       string
+		serviceTag string
+		mac        string
+		want       int
+	}{
+		{"match", "IDENT01", mac, http.StatusCreated},
+		{"match in another case and notation", "ident01", strings.ToUpper(strings.ReplaceAll(mac, ":", "-")), http.StatusCreated},
+		{"no identity reported", "", "", http.StatusCreated},
+		{"service tag only", "IDENT01", "", http.StatusCreated},
+		{"service tag mismatch", "CLONE01", mac, http.StatusConflict},
+		{"MAC mismatch", "IDENT01", "02:00:00:00:00:99", http.StatusConflict},
+		{"invalid MAC", "IDENT01", "not-a-mac", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := models.MachineMetrics{CPUUsagePercent: 12.5, ReportedServiceTag: tt.serviceTag, ReportedMAC: tt.mac}
+			resp := env.Do(models.RoleOperator, http.MethodPost, path, metrics)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusConflict {
+				if apiErr, ok := decodeError(t, resp); ok && apiErr.Code != "identity_mismatch" {
+					t.Errorf("code %s, want identity_mismatch", apiErr.Code)
+				}
+			}
+		})
+	}
+
+	// Only the matching submissions were stored
+	var history []models.MachineMetrics
+	env.MustJSON(models.RoleViewer, http.MethodGet, path+"/history", nil, http.StatusOK, &history)
+	if len(history) != 4 {
+		t.Errorf("%d submissions stored, want 4", len(history))
+	}
+}
+
+func TestMetricsIdentityMismatchEvent(t *testing.T) {
+	env := testutil.New(t)
+	receiver := testutil.NewWebhookReceiver(t)
+	env.AddWebhook(receiver, events.MachineIdentityMismatch)
+	machine := env.EnrollMachine("IDENT02")
+
+	metrics := models.MachineMetrics{ReportedServiceTag: "CLONE02", ReportedMAC: "02:00:00:00:00:99"}
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+machine.ID+"/metrics", metrics, http.StatusConflict, nil)
+
+	// The event names both identities, so the misconfigured host can be
+	// found
+	delivery := receiver.WaitFor(t, events.MachineIdentityMismatch, 5*time.Second)
+	data, _ := delivery.Payload["data"].(map[string]interface{})
+	want := map[string]string{
+		"service_tag":          "IDENT02",
+		"mac_address":          testutil.FixtureMAC("IDENT02"),
+		"reported_service_tag": "CLONE02",
+		"reported_mac":         "02:00:00:00:00:99",
+		"source_ip":            "127.0.0.1",
+	}
+	for key, value := range want {
+		if data[key] != value {
+			t.Errorf("%s = %v, want %s", key, data[key], value)
+		}
+	}
+}
+
+func TestMetricsIdentityExempt(t *testing.T) {
+	env := testutil.New(t)
+	machine := env.EnrollMachine("IDENT03")
+	path := "/api/v1/machines/" + machine.ID + "/metrics"
+	exempt := "/api/v1/machines/" + machine.ID + "/identity-exempt"
+
+	// A chassis swapped pending re-enrollment reports the new service tag
+	swapped := models.MachineMetrics{ReportedServiceTag: "SWAP03", ReportedMAC: "02:00:00:00:00:33"}
+	env.MustJSON(models.RoleOperator, http.MethodPost, path, swapped, http.StatusConflict, nil)
+
+	// Viewers can't exempt machines
+	env.MustJSON(models.RoleViewer, http.MethodPut, exempt, map[string]bool{"identity_exempt": true}, http.StatusForbidden, nil)
+
+	var updated models.Machine
+	env.MustJSON(models.RoleOperator, http.MethodPut, exempt, map[string]bool{"identity_exempt": true}, http.StatusOK, &updated)
+	if !updated.IdentityExempt {
+		t.Fatal("machine not exempt")
+	}
+	env.MustJSON(models.RoleOperator, http.MethodPost, path, swapped, http.StatusCreated, nil)
+
+	// Lifting the exemption checks submissions again
+	env.MustJSON(models.RoleOperator, http.MethodPut, exempt, map[string]bool{"identity_exempt": false}, http.StatusOK, nil)
+	env.MustJSON(models.RoleOperator, http.MethodPost, path, swapped, http.StatusConflict, nil)
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// maxNoteBytes limits the markdown body of a note
+const maxNoteBytes = 64 << 10
+
+// handleListMachineNotes lists a machine's notes, newest first
+func (s *Server) handleListMachineNotes(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	notes, err := s.db.ListMachineNotes(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to list notes")
+		return
+	}
+
+	if notes == nil {
+		notes = []*models.MachineNote{}
+	}
+
+	respondJSON(w, http.StatusOK, notes)
+}
+
+// handleCreateMachineNote adds a note to a machine
+func (s *Server) handleCreateMachineNote(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	var req models.MachineNoteRequest
+	if !decodeJSON(w, r, &req) || !checkNoteBody(w, req.Body) {
+		return
+	}
+
+	note := &models.MachineNote{
+		MachineID: machine.ID,
+		Body:      req.Body,
+	}
+	if claims, ok := auth.GetClaims(r); ok {
+		note.Author = claims.Username
+	}
+
+	if err := s.db.CreateMachineNote(note); err != nil {
+		respondInternalError(w, err, "failed to create note")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, note)
+}
+
+// handleUpdateMachineNote replaces the body of a note. With authentication
+// on, only its author or an admin can edit it.
+func (s *Server) handleUpdateMachineNote(w http.ResponseWriter, r *http.Request) {
+	note := s.ownNote(w, r)
+	if note == nil {
+		return
+	}
+
+	var req models.MachineNoteRequest
+	if !decodeJSON(w, r, &req) || !checkNoteBody(w, req.Body) {
+		return
+	}
+
+	note.Body = req.Body
+	if err := s.db.UpdateMachineNote(note); err != nil {
+		respondInternalError(w, err, "failed to update note")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, note)
+}
+
+// handleDeleteMachineNote deletes a note. With authentication on, only its
+// author or an admin can delete it.
+func (s *Server) handleDeleteMachineNote(w http.ResponseWriter, r *http.Request) {
+	note := s.ownNote(w, r)
+	if note == nil {
+		return
+	}
+
+	if _, err := s.db.DeleteMachineNote(note.MachineID, note.ID); err != nil {
+		respondInternalError(w, err, "failed to delete note")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// noteMachine looks up the machine of a notes or attachments request. It
+// responds with an error and returns nil if there is no such machine.
+func (s *Server) noteMachine(w http.ResponseWriter, r *http.Request) *models.Machine {
+	machine, err := s.db.GetMachine(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return nil
+	}
+	return machine
+}
+
+// ownNote looks up the note of a request that changes it, and checks the
+// user may change it. It responds with an error and returns nil otherwise.
+func (s *Server) ownNote(w http.ResponseWriter, r *http.Request) *models.MachineNote {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return nil
+	}
+
+	note, err := s.db.GetMachineNote(machine.ID, mux.Vars(r)["note_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if note == nil {
+		respondError(w, http.StatusNotFound, CodeNoteNotFound, "note not found")
+		return nil
+	}
+
+	if s.config.EnableAuth {
+		claims, ok := auth.GetClaims(r)
+		if !ok || (claims.Username != note.Author && claims.Role != models.RoleAdmin) {
+			respondError(w, http.StatusForbidden, CodeForbidden, "only the author of a note or an admin can change it")
+			return nil
+		}
+	}
+
+	return note
+}
+
+// checkNoteBody responds with an error and returns false if body is not a
+// usable note
+func checkNoteBody(w http.ResponseWriter, body string) bool {
+	if strings.TrimSpace(body) == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "body is required")
+		return false
+	}
+	if len(body) > maxNoteBytes {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "body must be at most 64 KiB")
+		return false
+	}
+	return true
+}
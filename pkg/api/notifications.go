@@ -0,0 +1,195 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/notify"
+	"github.com/gorilla/mux"
+)
+
+// handleCreateNotificationChannel creates a new notification channel
+func (s *Server) handleCreateNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	var channel models.NotificationChannel
+	if !decodeJSON(w, r, &channel) {
+		return
+	}
+
+	// Validate required fields
+	if channel.Name == "" || channel.Type == "" || len(channel.Events) == 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "name, type, and events are required")
+		return
+	}
+
+	if !validSubscribedEvents(w, channel.Events) {
+		return
+	}
+
+	if err := notify.ValidateConfig(&channel); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	// Set defaults
+	if channel.RateLimit == 0 {
+		channel.RateLimit = 5
+	}
+	if channel.RateWindow == 0 {
+		channel.RateWindow = 60
+	}
+
+	if err := s.db.CreateNotificationChannel(&channel); err != nil {
+		respondInternalError(w, err, "failed to create notification channel")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, channel)
+}
+
+// handleListNotificationChannels lists all notification channels
+func (s *Server) handleListNotificationChannels(w http.ResponseWriter, r *http.Request) {
+	channels, err := s.db.ListNotificationChannels()
+	if err != nil {
+		respondInternalError(w, err, "failed to list notification channels")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, channels)
+}
+
+// handleGetNotificationChannel retrieves a single notification channel
+func (s *Server) handleGetNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	channel, err := s.db.GetNotificationChannel(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if channel == nil {
+		respondError(w, http.StatusNotFound, CodeNotificationChannelNotFound, "notification channel not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, channel)
+}
+
+// handleUpdateNotificationChannel updates a notification channel. The type
+// of a channel cannot be changed.
+func (s *Server) handleUpdateNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	channel, err := s.db.GetNotificationChannel(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if channel == nil {
+		respondError(w, http.StatusNotFound, CodeNotificationChannelNotFound, "notification channel not found")
+		return
+	}
+
+	var updates models.NotificationChannel
+	if !decodeJSON(w, r, &updates) {
+		return
+	}
+
+	// Update fields
+	if updates.Name != "" {
+		channel.Name = updates.Name
+	}
+	if len(updates.Events) > 0 {
+		if !validSubscribedEvents(w, updates.Events) {
+			return
+		}
+		channel.Events = updates.Events
+	}
+	if updates.Config != nil {
+		channel.Config = updates.Config
+	}
+	channel.Active = updates.Active
+	if updates.RateLimit > 0 {
+		channel.RateLimit = updates.RateLimit
+	}
+	if updates.RateWindow > 0 {
+		channel.RateWindow = updates.RateWindow
+	}
+
+	if err := notify.ValidateConfig(channel); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := s.db.UpdateNotificationChannel(channel); err != nil {
+		respondInternalError(w, err, "failed to update notification channel")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, channel)
+}
+
+// handleDeleteNotificationChannel deletes a notification channel
+func (s *Server) handleDeleteNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if err := s.db.DeleteNotificationChannel(id); err != nil {
+		respondInternalError(w, err, "failed to delete notification channel")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTestNotificationChannel sends a test message through a channel and
+// returns the delivery record
+func (s *Server) handleTestNotificationChannel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	channel, err := s.db.GetNotificationChannel(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if channel == nil {
+		respondError(w, http.StatusNotFound, CodeNotificationChannelNotFound, "notification channel not found")
+		return
+	}
+
+	delivery := s.notifyService.SendTest(channel)
+	status := http.StatusOK
+	if !delivery.Success {
+		status = http.StatusBadGateway
+	}
+
+	respondJSON(w, status, delivery)
+}
+
+// handleListNotificationDeliveries lists deliveries for a notification channel
+func (s *Server) handleListNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	limitStr := r.URL.Query().Get("limit")
+	limit := 50
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	deliveries, err := s.db.ListNotificationDeliveries(id, limit)
+	if err != nil {
+		respondInternalError(w, err, "failed to list deliveries")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, deliveries)
+}
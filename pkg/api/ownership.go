@@ -0,0 +1,28 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// handleListUnownedMachines reports the machines in service that nobody
+// can be paged about: neither they nor any of their groups set an owner
+// team or contact email
+func (s *Server) handleListUnownedMachines(w http.ResponseWriter, r *http.Request) {
+	machines, err := s.db.ListMachineSummaries(database.MachineFilter{Unowned: true, VisibleTo: visibleTo(r)})
+	if err != nil {
+		respondInternalError(w, err, "failed to list machines")
+		return
+	}
+
+	unowned := []*models.MachineSummary{}
+	for _, m := range machines {
+		if m.Status != models.StatusDecommissioned {
+			unowned = append(unowned, m)
+		}
+	}
+
+	respondJSON(w, http.StatusOK, unowned)
+}
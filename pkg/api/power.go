@@ -1,16 +1,33 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 	"github.com/gorilla/mux"
 )
 
+// SetIPMIRunner has BMC operations over IPMI run ipmitool through runner,
+// such as a command.Fake, instead of executing it
+func (s *Server) SetIPMIRunner(runner command.Runner) {
+	s.ipmiRunner = runner
+}
+
+// powerController returns the IPMI power controller BMC operations use
+func (s *Server) powerController() *ipmi.PowerController {
+	if s.ipmiRunner == nil {
+		return ipmi.NewPowerController()
+	}
+	return ipmi.NewPowerControllerWithRunner(s.ipmiRunner)
+}
+
 // PowerRequest represents a power control request
 type PowerRequest struct {
 	Operation string `json:"operation"` // on, off, reset, cycle, status
@@ -24,24 +41,40 @@ func (s *Server) handlePowerControl(w http.ResponseWriter, r *http.Request) {
 	// Get machine
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
-	// Check if BMC is configured
-	if machine.BMCInfo == nil {
-		http.Error(w, "BMC is not configured for this machine", http.StatusBadRequest)
+	// Check if BMC is configured. Machines without one can still be
+	// powered on with Wake-on-LAN, and virtual machines need neither.
+	if !machine.Virtual && machine.BMCInfo == nil && machine.WakeOnLANMAC() == "" {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
 		return
 	}
 
 	// Parse request
 	var req PowerRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if !machine.Virtual && machine.BMCInfo == nil && req.Operation != "on" {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine; Wake-on-LAN can only power it on")
+		return
+	}
+
+	// Status queries are always allowed; anything that changes power state
+	// is subject to maintenance windows
+	if req.Operation != "status" && !s.checkMaintenance(w, r, []string{machineID}, models.MaintenanceOpPower) {
+		return
+	}
+
+	// Operations that change power state count against the user's quota
+	if req.Operation != "status" && !s.consumeQuota(w, r, models.QuotaPowerOperations, 1) {
 		return
 	}
 
@@ -51,22 +84,35 @@ func (s *Server) handlePowerControl(w http.ResponseWriter, r *http.Request) {
 		userID = user.ID
 	}
 
+	// Virtual machines have nothing to power; operations on them succeed
+	// and are recorded as simulated
+	if machine.Virtual {
+		s.simulatePower(w, machine, req.Operation, userID)
+		return
+	}
+
+	if machine.BMCInfo == nil {
+		s.wakeMachine(w, r, machine, userID)
+		return
+	}
+
 	// Create power operation record
 	powerOp := &models.PowerOperation{
 		MachineID:   machineID,
 		Operation:   req.Operation,
+		Method:      models.PowerMethodBMC,
 		Status:      "pending",
 		InitiatedBy: userID,
 	}
 
 	if err := s.db.CreatePowerOperation(powerOp); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create power operation: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to create power operation")
 		return
 	}
 
 	// Execute power operation asynchronously
 	go func() {
-		controller := ipmi.NewPowerController()
+		controller := s.powerController()
 		var result string
 		var err error
 
@@ -97,13 +143,33 @@ func (s *Server) handlePowerControl(w http.ResponseWriter, r *http.Request) {
 			powerOp.Result = result
 		}
 
-		s.db.UpdatePowerOperation(powerOp)
+		s.finishPowerOperation(powerOp)
+		if req.Operation != "status" {
+			s.publishPowerOperation(powerOp)
+		}
 	}()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(powerOp)
 }
 
+// publishPowerOperation publishes the outcome of an operation that changed,
+// or tried to change, a machine's power state
+func (s *Server) publishPowerOperation(op *models.PowerOperation) {
+	s.publish(context.Background(), events.Event{
+		Type:      events.MachinePowerOperation,
+		MachineID: op.MachineID,
+		Actor:     operationActor(op),
+		Data: events.PowerOperationData{
+			OperationID: op.ID,
+			Operation:   op.Operation,
+			Method:      op.Method,
+			Status:      op.Status,
+			Error:       op.Error,
+		},
+	})
+}
+
 // handleGetPowerStatus gets the current power status
 func (s *Server) handleGetPowerStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -112,27 +178,51 @@ func (s *Server) handleGetPowerStatus(w http.ResponseWriter, r *http.Request) {
 	// Get machine
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	// A virtual machine is in the state its last simulated operation left
+	if machine.Virtual {
+		status := machine.PowerState
+		if status == "" || status == models.PowerStateUnknown {
+			status = models.PowerStateOff
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"machine_id": machineID,
+			"status":     status,
+			"simulated":  true,
+			"timestamp":  time.Now().Format(time.RFC3339),
+		})
+		return
+	}
+
+	// The power state of a machine without a BMC can only be inferred
+	if machine.BMCInfo == nil && machine.WakeOnLANMAC() != "" {
+		respondJSON(w, http.StatusOK, inferPowerStatus(r.Context(), machine))
 		return
 	}
 
 	// Check if BMC is configured
 	if machine.BMCInfo == nil {
-		http.Error(w, "BMC is not configured for this machine", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
 		return
 	}
 
 	// Get power status
-	controller := ipmi.NewPowerController()
+	controller := s.powerController()
 	status, err := controller.GetPowerStatus(machine.BMCInfo)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get power status: %v", err), http.StatusInternalServerError)
+		respondBMCError(w, err, "failed to get power status")
 		return
 	}
+	if status != models.PowerStateUnknown {
+		s.recordPowerState(machine.ID, status, "")
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -150,18 +240,18 @@ func (s *Server) handleGetPowerOperations(w http.ResponseWriter, r *http.Request
 	// Get machine
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	// Get power operations
 	operations, err := s.db.ListPowerOperations(machineID, 50)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get power operations: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get power operations")
 		return
 	}
 
@@ -177,41 +267,32 @@ func (s *Server) handleTestBMC(w http.ResponseWriter, r *http.Request) {
 	// Get machine
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	// Check if BMC is configured
 	if machine.BMCInfo == nil {
-		http.Error(w, "BMC is not configured for this machine", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
 		return
 	}
 
 	// Test connection
-	controller := ipmi.NewPowerController()
-	err = controller.TestConnection(machine.BMCInfo)
-
-	response := map[string]interface{}{
-		"machine_id": machineID,
-		"timestamp":  time.Now().Format(time.RFC3339),
-	}
-
-	if err != nil {
-		response["status"] = "failed"
-		response["error"] = err.Error()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	controller := s.powerController()
+	if err := controller.TestConnection(machine.BMCInfo); err != nil {
+		respondBMCError(w, err, "BMC connection test failed")
 		return
 	}
 
-	response["status"] = "success"
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"machine_id": machineID,
+		"status":     "success",
+		"timestamp":  time.Now().Format(time.RFC3339),
+	})
 }
 
 // handleGetBMCInfo retrieves BMC information
@@ -222,25 +303,25 @@ func (s *Server) handleGetBMCInfo(w http.ResponseWriter, r *http.Request) {
 	// Get machine
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	// Check if BMC is configured
 	if machine.BMCInfo == nil {
-		http.Error(w, "BMC is not configured for this machine", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
 		return
 	}
 
 	// Get BMC info
-	controller := ipmi.NewPowerController()
+	controller := s.powerController()
 	info, err := controller.GetBMCInfo(machine.BMCInfo)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get BMC info: %v", err), http.StatusInternalServerError)
+		respondBMCError(w, err, "failed to get BMC info")
 		return
 	}
 
@@ -256,25 +337,25 @@ func (s *Server) handleGetSensors(w http.ResponseWriter, r *http.Request) {
 	// Get machine
 	machine, err := s.db.GetMachine(machineID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machine: %v", err), http.StatusInternalServerError)
+		respondInternalError(w, err, "failed to get machine")
 		return
 	}
 	if machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	// Check if BMC is configured
 	if machine.BMCInfo == nil {
-		http.Error(w, "BMC is not configured for this machine", http.StatusBadRequest)
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
 		return
 	}
 
 	// Get sensor readings
-	controller := ipmi.NewPowerController()
+	controller := s.powerController()
 	sensors, err := controller.GetSensorReadings(machine.BMCInfo)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get sensor readings: %v", err), http.StatusInternalServerError)
+		respondBMCError(w, err, "failed to get sensor readings")
 		return
 	}
 
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// abandonedPowerOperationAge is how long a power operation can stay pending
+// before the power poller stops waiting for it. Operations finish within
+// ipmitool's timeouts, so an older one was left by a server that stopped.
+const abandonedPowerOperationAge = 10 * time.Minute
+
+// StartPowerPoller periodically reads the power state of every machine with
+// an enabled BMC. BMC connections are limited by Config.BMCPollConcurrency,
+// shared with the BMC health checks.
+func (s *Server) StartPowerPoller(interval time.Duration) {
+	go func() {
+		log.Printf("Power poller started (interval: %s)", interval)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if s.leadJob("power-poller", interval) {
+				s.pollPowerStates()
+			}
+		}
+	}()
+}
+
+// pollPowerStates runs one power poll over all enabled BMCs. Machines with
+// a power operation under way are skipped, so the poll doesn't race the
+// operation recording its own result.
+func (s *Server) pollPowerStates() {
+	machines, err := s.db.ListMachines()
+	if err != nil {
+		log.Printf("Power poller failed to list machines: %v", err)
+		return
+	}
+
+	busy, err := s.db.MachinesWithPendingPowerOperations(time.Now().Add(-abandonedPowerOperationAge))
+	if err != nil {
+		log.Printf("Power poller failed to list pending power operations: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, machine := range machines {
+		if machine.BMCInfo == nil || !machine.BMCInfo.Enabled || busy[machine.ID] {
+			continue
+		}
+
+		wg.Add(1)
+		go func(m *models.Machine) {
+			defer wg.Done()
+			s.pollPowerState(m)
+		}(machine)
+	}
+	wg.Wait()
+}
+
+// pollPowerState reads and records a machine's power state. A BMC that
+// can't be read leaves the last known state in place.
+func (s *Server) pollPowerState(machine *models.Machine) {
+	s.bmcSlots <- struct{}{}
+	defer func() { <-s.bmcSlots }()
+
+	started := time.Now()
+	state, err := s.powerController().GetPowerStatus(machine.BMCInfo)
+	if err != nil {
+		log.Printf("Power poll failed for machine %s: %v", machine.ID, err)
+		return
+	}
+	if state == models.PowerStateUnknown {
+		return
+	}
+
+	// A power operation that started during the poll may already have
+	// recorded a newer state
+	if raced, err := s.db.PowerOperationStartedSince(machine.ID, started); err != nil || raced {
+		return
+	}
+
+	s.recordPowerState(machine.ID, state, "")
+}
+
+// recordPowerOperationState records the power state a finished BMC
+// operation leaves a machine in, if it says
+func (s *Server) recordPowerOperationState(op *models.PowerOperation) {
+	if op.Method != models.PowerMethodBMC || op.Status != "success" {
+		return
+	}
+
+	var state string
+	switch op.Operation {
+	case "on", "reset", "cycle":
+		state = models.PowerStateOn
+	case "off":
+		state = models.PowerStateOff
+	case "status":
+		state = ipmi.ParsePowerStatus(op.Result)
+	}
+	if state == "" || state == models.PowerStateUnknown {
+		return
+	}
+
+	s.recordPowerState(op.MachineID, state, operationActor(op))
+}
+
+// recordPowerState stores a machine's power state and publishes
+// machine.power_changed if it changed. The first state read for a machine
+// is not a change.
+func (s *Server) recordPowerState(machineID, state, actor string) {
+	previous, changed, err := s.db.UpdateMachinePowerState(machineID, state, time.Now())
+	if err != nil {
+		log.Printf("Failed to record power state for machine %s: %v", machineID, err)
+		return
+	}
+	if !changed || previous == "" {
+		return
+	}
+
+	s.publish(context.Background(), events.Event{
+		Type:      events.MachinePowerChanged,
+		MachineID: machineID,
+		Actor:     actor,
+		Data: events.PowerChangedData{
+			From: previous,
+			To:   state,
+		},
+	})
+}
@@ -1,107 +1,354 @@
 package api
 
 import (
-	"fmt"
+	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// buildSettleDelay keeps the build accounting window behind the clock so
+// that a build the builder stamped completed but has not yet committed is
+// picked up on the next refresh rather than skipped
+const buildSettleDelay = 10 * time.Second
+
+// groupBuildWindow is how far back the group build success ratio looks
+const groupBuildWindow = 24 * time.Hour
+
+var (
+	machineLabels = []string{"machine_id", "hostname", "service_tag"}
+
+	machinesTotalDesc = prometheus.NewDesc("metal_enrollment_machines_total",
+		"Total number of enrolled machines", nil, nil)
+	machinesByStatusDesc = prometheus.NewDesc("metal_enrollment_machines_by_status",
+		"Number of machines by status", []string{"status"}, nil)
+	imageTestsByStatusDesc = prometheus.NewDesc("metal_enrollment_image_tests_by_status",
+		"Number of image tests by status", []string{"status"}, nil)
+
+	cpuUsageDesc = prometheus.NewDesc("metal_machine_cpu_usage_percent",
+		"CPU usage percentage", machineLabels, nil)
+	memoryUsedDesc = prometheus.NewDesc("metal_machine_memory_used_bytes",
+		"Memory used in bytes", machineLabels, nil)
+	memoryTotalDesc = prometheus.NewDesc("metal_machine_memory_total_bytes",
+		"Total memory in bytes", machineLabels, nil)
+	diskUsedDesc = prometheus.NewDesc("metal_machine_disk_used_bytes",
+		"Disk used in bytes", machineLabels, nil)
+	diskTotalDesc = prometheus.NewDesc("metal_machine_disk_total_bytes",
+		"Total disk space in bytes", machineLabels, nil)
+	networkRxDesc = prometheus.NewDesc("metal_machine_network_rx_bytes",
+		"Network received bytes", machineLabels, nil)
+	networkTxDesc = prometheus.NewDesc("metal_machine_network_tx_bytes",
+		"Network transmitted bytes", machineLabels, nil)
+	loadAverageDesc = prometheus.NewDesc("metal_machine_load_average",
+		"Load average", append(machineLabels, "period"), nil)
+	temperatureDesc = prometheus.NewDesc("metal_machine_temperature_celsius",
+		"Machine temperature in Celsius", machineLabels, nil)
+	uptimeDesc = prometheus.NewDesc("metal_machine_uptime_seconds",
+		"Machine uptime in seconds", machineLabels, nil)
+	powerOnDesc = prometheus.NewDesc("metal_machine_power_on",
+		"Whether the machine is powered on, as last read from its BMC or else as it reported", machineLabels, nil)
+	gpuCountDesc = prometheus.NewDesc("metal_machine_gpu_count",
+		"Number of GPUs in the machine's hardware inventory", machineLabels, nil)
+	gpuTemperatureDesc = prometheus.NewDesc("metal_machine_gpu_temperature_celsius",
+		"GPU temperature in Celsius", append(machineLabels, "gpu", "uuid"), nil)
+
+	bmcHealthDesc = prometheus.NewDesc("metal_machine_bmc_health",
+		"BMC sensor health state (1 for the current state)", append(machineLabels, "state"), nil)
+	bmcUnreachableDesc = prometheus.NewDesc("metal_machine_bmc_unreachable",
+		"Whether the last BMC poll failed to connect", machineLabels, nil)
+
+	builderInfoDesc = prometheus.NewDesc("metal_enrollment_builder_info",
+		"Builder toolchain as of its last heartbeat", []string{"builder", "builder_version", "nix_version", "nixpkgs_version", "nixpkgs_revision"}, nil)
+	builderOnlineDesc = prometheus.NewDesc("metal_enrollment_builder_online",
+		"Whether the builder has sent a heartbeat recently", []string{"builder"}, nil)
+	builderLastSeenDesc = prometheus.NewDesc("metal_enrollment_builder_last_seen_timestamp_seconds",
+		"Unix time of the builder's last heartbeat", []string{"builder"}, nil)
+	builderLowDiskDesc = prometheus.NewDesc("metal_enrollment_builder_low_disk",
+		"Whether a filesystem of the builder is below its free space threshold, so it claims no builds", []string{"builder"}, nil)
+	builderDiskFreeDesc = prometheus.NewDesc("metal_enrollment_builder_disk_free_bytes",
+		"Free space on a filesystem the builder writes to", []string{"builder", "disk"}, nil)
+	builderDiskTotalDesc = prometheus.NewDesc("metal_enrollment_builder_disk_total_bytes",
+		"Size of a filesystem the builder writes to", []string{"builder", "disk"}, nil)
+	builderNixStoreDesc = prometheus.NewDesc("metal_enrollment_builder_nix_store_bytes",
+		"Size of the builder's nix store", []string{"builder"}, nil)
+
+	imagesArtifactBytesDesc = prometheus.NewDesc("metal_enrollment_images_artifact_bytes",
+		"Space the artifacts in the images directory take up, as recorded", nil, nil)
+	imagesFilesystemBytesDesc = prometheus.NewDesc("metal_enrollment_images_filesystem_bytes",
+		"Size of the filesystem the images directory is on", nil, nil)
+	imagesFilesystemFreeDesc = prometheus.NewDesc("metal_enrollment_images_filesystem_free_bytes",
+		"Free space on the filesystem the images directory is on", nil, nil)
+	machineArtifactBytesDesc = prometheus.NewDesc("metal_machine_artifact_bytes",
+		"Space the machine's images take up in the images directory", machineLabels, nil)
+
+	// Group membership is an info series of its own rather than a label on
+	// the machine series, since a machine can be in any number of groups
+	groupInfoDesc = prometheus.NewDesc("metal_machine_group_info",
+		"Group membership of a machine, one series per group it is in", []string{"machine_id", "group"}, nil)
+	groupMachinesDesc = prometheus.NewDesc("metal_enrollment_group_machines",
+		"Number of machines in the group", []string{"group"}, nil)
+	groupMachinesByStatusDesc = prometheus.NewDesc("metal_enrollment_group_machines_by_status",
+		"Number of machines in the group by status", []string{"group", "status"}, nil)
+	groupBuildSuccessDesc = prometheus.NewDesc("metal_enrollment_group_build_success_ratio",
+		"Fraction of the group's builds finished in the last 24 hours that succeeded", []string{"group"}, nil)
+)
+
+// machineCollector serves the per-machine gauges from a snapshot taken by
+// the metrics refresher, so scrapes never touch the database
+type machineCollector struct {
+	mu       sync.RWMutex
+	snapshot []prometheus.Metric
+}
+
+// Describe sends no descriptors, making this an unchecked collector; the
+// set of series changes as machines come and go
+func (c *machineCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the latest snapshot
+func (c *machineCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, m := range c.snapshot {
+		ch <- m
+	}
+}
+
+func (c *machineCollector) set(snapshot []prometheus.Metric) {
+	c.mu.Lock()
+	c.snapshot = snapshot
+	c.mu.Unlock()
+}
+
 // handlePrometheusMetrics exports metrics in Prometheus format
 func (s *Server) handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
-	// Get all machines
-	machines, err := s.db.ListMachines()
+	promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// StartMetricsRefresher rebuilds the machine gauges and accounts for newly
+// finished builds every interval. Builds are written by the builder service,
+// so they are picked up from the database rather than observed in-process;
+// only builds finishing after the server started are counted.
+func (s *Server) StartMetricsRefresher(interval time.Duration) {
+	go func() {
+		log.Printf("Metrics refresher started (interval: %s)", interval)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		buildsSince := time.Now().Add(-buildSettleDelay)
+		for {
+			s.refreshMachineMetrics()
+			buildsSince = s.accountBuilds(buildsSince)
+
+			<-ticker.C
+		}
+	}()
+}
+
+// refreshMachineMetrics replaces the machine gauge snapshot. Virtual
+// machines are left out unless Config.MetricsIncludeVirtual is set.
+func (s *Server) refreshMachineMetrics() {
+	filter := database.MachineFilter{}
+	if !s.config.MetricsIncludeVirtual {
+		virtual := false
+		filter.Virtual = &virtual
+	}
+	machines, err := s.db.ListMachineSummaries(filter)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get machines: %v", err), http.StatusInternalServerError)
+		log.Printf("Failed to refresh machine metrics: %v", err)
 		return
 	}
 
-	var output strings.Builder
+	var snapshot []prometheus.Metric
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		snapshot = append(snapshot, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...))
+	}
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		snapshot = append(snapshot, prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...))
+	}
 
-	// Write Prometheus format metrics
-	output.WriteString("# HELP metal_enrollment_machines_total Total number of enrolled machines\n")
-	output.WriteString("# TYPE metal_enrollment_machines_total gauge\n")
-	output.WriteString(fmt.Sprintf("metal_enrollment_machines_total %d\n", len(machines)))
-	output.WriteString("\n")
+	gauge(machinesTotalDesc, float64(len(machines)))
 
-	// Machine status counts
 	statusCounts := make(map[string]int)
 	for _, machine := range machines {
 		statusCounts[string(machine.Status)]++
 	}
-
-	output.WriteString("# HELP metal_enrollment_machines_by_status Number of machines by status\n")
-	output.WriteString("# TYPE metal_enrollment_machines_by_status gauge\n")
 	for status, count := range statusCounts {
-		output.WriteString(fmt.Sprintf("metal_enrollment_machines_by_status{status=\"%s\"} %d\n", status, count))
+		gauge(machinesByStatusDesc, float64(count), status)
 	}
-	output.WriteString("\n")
-
-	// Metrics for each machine
-	output.WriteString("# HELP metal_machine_cpu_usage_percent CPU usage percentage\n")
-	output.WriteString("# TYPE metal_machine_cpu_usage_percent gauge\n")
-
-	output.WriteString("# HELP metal_machine_memory_used_bytes Memory used in bytes\n")
-	output.WriteString("# TYPE metal_machine_memory_used_bytes gauge\n")
 
-	output.WriteString("# HELP metal_machine_memory_total_bytes Total memory in bytes\n")
-	output.WriteString("# TYPE metal_machine_memory_total_bytes gauge\n")
+	if builders, err := s.db.ListBuilders(); err != nil {
+		log.Printf("Failed to list builders: %v", err)
+	} else {
+		for _, builder := range builders {
+			env := builder.Environment
+			gauge(builderInfoDesc, 1, builder.Name, env.BuilderVersion, env.NixVersion, env.NixpkgsVersion, env.NixpkgsRevision)
+			gauge(builderOnlineDesc, boolValue(builder.Online), builder.Name)
+			gauge(builderLastSeenDesc, float64(builder.LastSeenAt.Unix()), builder.Name)
+			if health := builder.Health; health != nil {
+				gauge(builderLowDiskDesc, boolValue(health.LowDisk()), builder.Name)
+				for _, disk := range health.Disks {
+					gauge(builderDiskFreeDesc, float64(disk.FreeBytes), builder.Name, disk.Name)
+					gauge(builderDiskTotalDesc, float64(disk.TotalBytes), builder.Name, disk.Name)
+				}
+				if health.NixStoreBytes > 0 {
+					gauge(builderNixStoreDesc, float64(health.NixStoreBytes), builder.Name)
+				}
+			}
+		}
+	}
 
-	output.WriteString("# HELP metal_machine_disk_used_bytes Disk used in bytes\n")
-	output.WriteString("# TYPE metal_machine_disk_used_bytes gauge\n")
+	// Memberships are read afresh every refresh, so a machine's info series
+	// goes away once it leaves the group
+	if groups, err := s.db.GetGroupMetrics(time.Now().Add(-groupBuildWindow), s.config.MetricsIncludeVirtual); err != nil {
+		log.Printf("Failed to read group metrics: %v", err)
+	} else {
+		for name, group := range groups {
+			gauge(groupMachinesDesc, float64(len(group.MachineIDs)), name)
+			for status, count := range group.MachinesByStatus {
+				gauge(groupMachinesByStatusDesc, float64(count), name, status)
+			}
+			if group.BuildsFinished > 0 {
+				gauge(groupBuildSuccessDesc, float64(group.BuildsSucceeded)/float64(group.BuildsFinished), name)
+			}
+			for _, machineID := range group.MachineIDs {
+				gauge(groupInfoDesc, 1, machineID, name)
+			}
+		}
+	}
 
-	output.WriteString("# HELP metal_machine_disk_total_bytes Total disk space in bytes\n")
-	output.WriteString("# TYPE metal_machine_disk_total_bytes gauge\n")
+	if usage, err := s.service.StorageUsage(); err != nil {
+		log.Printf("Failed to read storage usage: %v", err)
+	} else {
+		gauge(imagesArtifactBytesDesc, float64(usage.ArtifactBytes))
+		if usage.FilesystemBytes > 0 {
+			gauge(imagesFilesystemBytesDesc, float64(usage.FilesystemBytes))
+			gauge(imagesFilesystemFreeDesc, float64(usage.FilesystemFreeBytes))
+		}
+	}
 
-	output.WriteString("# HELP metal_machine_network_rx_bytes Network received bytes\n")
-	output.WriteString("# TYPE metal_machine_network_rx_bytes counter\n")
+	if testCounts, err := s.db.CountImageTestsByStatus(); err != nil {
+		log.Printf("Failed to count image tests: %v", err)
+	} else {
+		for status, count := range testCounts {
+			gauge(imageTestsByStatusDesc, float64(count), status)
+		}
+	}
 
-	output.WriteString("# HELP metal_machine_network_tx_bytes Network transmitted bytes\n")
-	output.WriteString("# TYPE metal_machine_network_tx_bytes counter\n")
+	for _, machine := range machines {
+		labels := []string{machine.ID, machine.Hostname, machine.ServiceTag}
 
-	output.WriteString("# HELP metal_machine_load_average Load average\n")
-	output.WriteString("# TYPE metal_machine_load_average gauge\n")
+		gauge(gpuCountDesc, float64(machine.GPUCount), labels...)
+		gauge(machineArtifactBytesDesc, float64(machine.ArtifactBytes), labels...)
 
-	output.WriteString("# HELP metal_machine_temperature_celsius Machine temperature in Celsius\n")
-	output.WriteString("# TYPE metal_machine_temperature_celsius gauge\n")
+		// BMC health from the last on-demand or scheduled poll, one series
+		// per state
+		if machine.BMCEnabled {
+			current := machine.BMCHealth
+			if current == "" || machine.BMCUnreachable {
+				current = ipmi.HealthUnknown
+			}
+			for _, state := range []string{ipmi.HealthOK, ipmi.HealthWarning, ipmi.HealthCritical, ipmi.HealthUnknown} {
+				gauge(bmcHealthDesc, boolValue(state == current), append(labels, state)...)
+			}
+			gauge(bmcUnreachableDesc, boolValue(machine.BMCUnreachable), labels...)
+		}
 
-	output.WriteString("# HELP metal_machine_uptime_seconds Machine uptime in seconds\n")
-	output.WriteString("# TYPE metal_machine_uptime_seconds counter\n")
+		// Power state read from the BMC covers machines that are off, which
+		// don't submit metrics
+		knownPower := machine.PowerState != models.PowerStateUnknown
+		if knownPower {
+			gauge(powerOnDesc, boolValue(machine.PowerState == models.PowerStateOn), labels...)
+		}
 
-	// Get metrics for each machine
-	for _, machine := range machines {
 		metrics, err := s.db.GetLatestMetrics(machine.ID)
 		if err != nil || metrics == nil {
 			continue
 		}
 
-		labels := fmt.Sprintf("machine_id=\"%s\",hostname=\"%s\",service_tag=\"%s\"",
-			machine.ID, machine.Hostname, machine.ServiceTag)
-
-		output.WriteString(fmt.Sprintf("metal_machine_cpu_usage_percent{%s} %.2f\n", labels, metrics.CPUUsagePercent))
-		output.WriteString(fmt.Sprintf("metal_machine_memory_used_bytes{%s} %d\n", labels, metrics.MemoryUsedBytes))
-		output.WriteString(fmt.Sprintf("metal_machine_memory_total_bytes{%s} %d\n", labels, metrics.MemoryTotalBytes))
-		output.WriteString(fmt.Sprintf("metal_machine_disk_used_bytes{%s} %d\n", labels, metrics.DiskUsedBytes))
-		output.WriteString(fmt.Sprintf("metal_machine_disk_total_bytes{%s} %d\n", labels, metrics.DiskTotalBytes))
-		output.WriteString(fmt.Sprintf("metal_machine_network_rx_bytes{%s} %d\n", labels, metrics.NetworkRxBytes))
-		output.WriteString(fmt.Sprintf("metal_machine_network_tx_bytes{%s} %d\n", labels, metrics.NetworkTxBytes))
-		output.WriteString(fmt.Sprintf("metal_machine_load_average{%s,period=\"1m\"} %.2f\n", labels, metrics.LoadAverage1))
-		output.WriteString(fmt.Sprintf("metal_machine_load_average{%s,period=\"5m\"} %.2f\n", labels, metrics.LoadAverage5))
-		output.WriteString(fmt.Sprintf("metal_machine_load_average{%s,period=\"15m\"} %.2f\n", labels, metrics.LoadAverage15))
-
+		gauge(cpuUsageDesc, metrics.CPUUsagePercent, labels...)
+		gauge(memoryUsedDesc, float64(metrics.MemoryUsedBytes), labels...)
+		gauge(memoryTotalDesc, float64(metrics.MemoryTotalBytes), labels...)
+		gauge(diskUsedDesc, float64(metrics.DiskUsedBytes), labels...)
+		gauge(diskTotalDesc, float64(metrics.DiskTotalBytes), labels...)
+		counter(networkRxDesc, float64(metrics.NetworkRxBytes), labels...)
+		counter(networkTxDesc, float64(metrics.NetworkTxBytes), labels...)
+		gauge(loadAverageDesc, metrics.LoadAverage1, append(labels, "1m")...)
+		gauge(loadAverageDesc, metrics.LoadAverage5, append(labels, "5m")...)
+		gauge(loadAverageDesc, metrics.LoadAverage15, append(labels, "15m")...)
 		if metrics.Temperature != nil {
-			output.WriteString(fmt.Sprintf("metal_machine_temperature_celsius{%s} %.2f\n", labels, *metrics.Temperature))
+			gauge(temperatureDesc, *metrics.Temperature, labels...)
+		}
+		counter(uptimeDesc, float64(metrics.Uptime), labels...)
+		if !knownPower {
+			gauge(powerOnDesc, boolValue(metrics.PowerState == "on"), labels...)
 		}
+		for _, gpu := range metrics.GPUs {
+			if gpu.Temperature != nil {
+				gauge(gpuTemperatureDesc, *gpu.Temperature, append(labels, strconv.Itoa(gpu.Index), gpu.UUID)...)
+			}
+		}
+	}
 
-		output.WriteString(fmt.Sprintf("metal_machine_uptime_seconds{%s} %d\n", labels, metrics.Uptime))
+	s.metrics.machines.set(snapshot)
+}
+
+// accountBuilds records builds that finished after since and returns the
+// point to continue from on the next refresh. Builds of virtual machines
+// are left out unless Config.MetricsIncludeVirtual is set.
+func (s *Server) accountBuilds(since time.Time) time.Time {
+	until := time.Now().Add(-buildSettleDelay)
+
+	builds, err := s.db.ListBuildsCompletedBetween(since, until)
+	if err != nil {
+		log.Printf("Failed to account builds: %v", err)
+		return since
+	}
 
-		// Power state as a boolean
-		powerOn := 0
-		if metrics.PowerState == "on" {
-			powerOn = 1
+	machines := make(map[string]*models.Machine)
+	for _, build := range builds {
+		machine, ok := machines[build.MachineID]
+		if !ok {
+			machine = buildMachine(s.db.GetMachine(build.MachineID))
+			machines[build.MachineID] = machine
 		}
-		output.WriteString(fmt.Sprintf("metal_machine_power_on{%s} %d\n", labels, powerOn))
+		if machine != nil && machine.Virtual && !s.config.MetricsIncludeVirtual {
+			continue
+		}
+		s.metrics.observeBuild(build, machineModel(machine))
 	}
 
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-	w.Write([]byte(output.String()))
+	return until
+}
+
+// buildMachine returns the machine of a build for build accounting, or
+// nil if it can't be read
+func buildMachine(machine *models.Machine, err error) *models.Machine {
+	if err != nil {
+		return nil
+	}
+	return machine
+}
+
+// machineModel returns the hardware model for build accounting
+func machineModel(machine *models.Machine) string {
+	if machine == nil {
+		return ""
+	}
+	return machine.Hardware.Model
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,848 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// provisioningTick is how often running provisioning cycles are
+	// advanced past retry delays and timeouts
+	provisioningTick = 15 * time.Second
+
+	// hookPollInterval is how often wait-for-endpoint hooks poll
+	hookPollInterval = 5 * time.Second
+
+	// serverHookGrace is how long past its deadline a server hook may
+	// still be running before it is taken for interrupted, as when the
+	// server running it stopped
+	serverHookGrace = time.Minute
+
+	// hookResponseLogBytes bounds how much of a response a server hook
+	// logs
+	hookResponseLogBytes = 4 << 10
+)
+
+// hookClient makes the requests of server hooks. Each attempt's context
+// carries its timeout.
+var hookClient = &http.Client{}
+
+// handleGetMachineHooks returns a machine's own provisioning hooks, and
+// the hooks it runs with its template's and groups'
+func (s *Server) handleGetMachineHooks(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	own, err := s.db.GetProvisioningHooks(models.HookScopeMachine, machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get provisioning hooks")
+		return
+	}
+	resolved, err := s.machineProvisioningHooks(machine)
+	if err != nil {
+		respondInternalError(w, err, "failed to resolve provisioning hooks")
+		return
+	}
+
+	if own == nil {
+		own = []models.ProvisioningHook{}
+	}
+	if resolved == nil {
+		resolved = []models.ProvisioningHook{}
+	}
+
+	respondJSON(w, http.StatusOK, models.MachineHookList{Hooks: own, Resolved: resolved})
+}
+
+// handleSetMachineHooks replaces a machine's own provisioning hooks. They
+// apply from the machine's next provisioning cycle.
+func (s *Server) handleSetMachineHooks(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+	s.setProvisioningHooks(w, r, models.HookScopeMachine, machine.ID)
+}
+
+// handleGetGroupHooks returns the provisioning hooks of a group
+func (s *Server) handleGetGroupHooks(w http.ResponseWriter, r *http.Request) {
+	group := s.hooksGroup(w, r)
+	if group == nil {
+		return
+	}
+	s.getProvisioningHooks(w, models.HookScopeGroup, group.ID)
+}
+
+// handleSetGroupHooks replaces the provisioning hooks of a group, which its
+// members run after their template's and before their own
+func (s *Server) handleSetGroupHooks(w http.ResponseWriter, r *http.Request) {
+	group := s.hooksGroup(w, r)
+	if group == nil {
+		return
+	}
+	s.setProvisioningHooks(w, r, models.HookScopeGroup, group.ID)
+}
+
+// handleGetTemplateHooks returns the provisioning hooks of a template
+func (s *Server) handleGetTemplateHooks(w http.ResponseWriter, r *http.Request) {
+	template := s.hooksTemplate(w, r)
+	if template == nil {
+		return
+	}
+	s.getProvisioningHooks(w, models.HookScopeTemplate, template.ID)
+}
+
+// handleSetTemplateHooks replaces the provisioning hooks of a template,
+// which machines whose configuration was applied from it run first
+func (s *Server) handleSetTemplateHooks(w http.ResponseWriter, r *http.Request) {
+	template := s.hooksTemplate(w, r)
+	if template == nil {
+		return
+	}
+	s.setProvisioningHooks(w, r, models.HookScopeTemplate, template.ID)
+}
+
+func (s *Server) getProvisioningHooks(w http.ResponseWriter, scope, scopeID string) {
+	hooks, err := s.db.GetProvisioningHooks(scope, scopeID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get provisioning hooks")
+		return
+	}
+
+	if hooks == nil {
+		hooks = []models.ProvisioningHook{}
+	}
+
+	respondJSON(w, http.StatusOK, models.ProvisioningHookList{Hooks: hooks})
+}
+
+func (s *Server) setProvisioningHooks(w http.ResponseWriter, r *http.Request, scope, scopeID string) {
+	var list models.ProvisioningHookList
+	if !decodeJSON(w, r, &list) {
+		return
+	}
+	if err := list.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if list.Hooks == nil {
+		list.Hooks = []models.ProvisioningHook{}
+	}
+	for i := range list.Hooks {
+		list.Hooks[i].Scope = ""
+	}
+
+	if err := s.db.SetProvisioningHooks(scope, scopeID, list.Hooks); err != nil {
+		respondInternalError(w, err, "failed to set provisioning hooks")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, list)
+}
+
+// hooksGroup looks up the group of a request. It responds with an error and
+// returns nil if there is no such group.
+func (s *Server) hooksGroup(w http.ResponseWriter, r *http.Request) *models.MachineGroup {
+	group, err := s.db.GetGroup(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if group == nil {
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+		return nil
+	}
+	return group
+}
+
+// hooksTemplate looks up the template of a request. It responds with an
+// error and returns nil if there is no such template.
+func (s *Server) hooksTemplate(w http.ResponseWriter, r *http.Request) *models.MachineTemplate {
+	template, err := s.db.GetTemplate(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if template == nil {
+		respondError(w, http.StatusNotFound, CodeTemplateNotFound, "template not found")
+		return nil
+	}
+	return template
+}
+
+// machineProvisioningHooks resolves the hooks a machine runs: its
+// template's, its groups' by name, then its own
+func (s *Server) machineProvisioningHooks(machine *models.Machine) ([]models.ProvisioningHook, error) {
+	var scopes []string
+	var lists [][]models.ProvisioningHook
+
+	if machine.TemplateID != "" {
+		hooks, err := s.db.GetProvisioningHooks(models.HookScopeTemplate, machine.TemplateID)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, models.HookScopeTemplate)
+		lists = append(lists, hooks)
+	}
+
+	groups, err := s.db.GetMachineGroups(machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		hooks, err := s.db.GetProvisioningHooks(models.HookScopeGroup, group.ID)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, models.HookScopeGroup)
+		lists = append(lists, hooks)
+	}
+
+	hooks, err := s.db.GetProvisioningHooks(models.HookScopeMachine, machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	scopes = append(scopes, models.HookScopeMachine)
+	lists = append(lists, hooks)
+
+	return models.ResolveProvisioningHooks(scopes, lists), nil
+}
+
+// handleGetProvisioning returns a machine's latest provisioning cycle and
+// the state and log of each of its hook runs
+func (s *Server) handleGetProvisioning(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	cycle, err := s.db.GetLatestProvisioningCycle(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get provisioning cycle")
+		return
+	}
+	if cycle == nil {
+		respondError(w, http.StatusNotFound, CodeNotFound, "machine has no provisioning cycle")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, cycle)
+}
+
+// handleRetryHookRun re-runs a failed hook of a machine's latest
+// provisioning cycle, from its first attempt, without redoing the hooks
+// that succeeded. A failed cycle runs again.
+func (s *Server) handleRetryHookRun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	run, err := s.db.GetHookRun(vars["run_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if run == nil || run.MachineID != vars["id"] {
+		respondError(w, http.StatusNotFound, CodeHookRunNotFound, "hook run not found")
+		return
+	}
+	if run.Status != models.HookRunFailed {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("hook run is %s; only failed runs can be retried", run.Status))
+		return
+	}
+
+	cycle, err := s.db.GetLatestProvisioningCycle(run.MachineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if cycle == nil || cycle.ID != run.CycleID {
+		respondError(w, http.StatusConflict, CodeConflict, "hook run is of an earlier provisioning cycle")
+		return
+	}
+
+	run.Status = models.HookRunPending
+	run.Attempts = 0
+	run.NextAttemptAt = nil
+	run.Deadline = nil
+	run.StartedAt = nil
+	run.FinishedAt = nil
+	run.ExitCode = nil
+	run.Log = ""
+	run.Error = ""
+	retried, err := s.db.UpdateHookRun(run, models.HookRunFailed)
+	if err != nil {
+		respondInternalError(w, err, "failed to retry hook run")
+		return
+	}
+	if !retried {
+		respondError(w, http.StatusConflict, CodeConflict, "hook run is no longer failed")
+		return
+	}
+
+	if cycle.Status != models.ProvisioningRunning {
+		from := cycle.Status
+		cycle.Status = models.ProvisioningRunning
+		if _, err := s.db.SetProvisioningCycleStatus(cycle, from); err != nil {
+			respondInternalError(w, err, "failed to resume provisioning cycle")
+			return
+		}
+	}
+
+	log.Printf("Hook %s of machine %s retried in provisioning cycle %s", run.Hook.Name, run.MachineID, cycle.ID)
+	s.advanceProvisioning(r.Context(), cycle.ID)
+
+	respondJSON(w, http.StatusOK, run)
+}
+
+// handleGetHooksToken returns the token a machine's agent authenticates
+// to the hook routes with, for the iPXE server to put on the kernel
+// command line of the machine's image
+func (s *Server) handleGetHooksToken(w http.ResponseWriter, r *http.Request) {
+	machine := s.noteMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"token": s.jwtManager.GenerateHooksToken(machine.ID)})
+}
+
+// handleNextHook hands the machine's agent the script hook to run now, if
+// any, and says whether its provisioning cycle is still running. A script
+// it was already handed is handed again, so an agent that restarted picks
+// it back up.
+func (s *Server) handleNextHook(w http.ResponseWriter, r *http.Request) {
+	machine := s.hooksMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	cycle, err := s.db.GetLatestProvisioningCycle(machine.ID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if cycle == nil {
+		respondJSON(w, http.StatusOK, models.HookAssignment{})
+		return
+	}
+
+	// Timeouts and retry delays may have moved the cycle on since the
+	// last tick
+	if cycle.Status == models.ProvisioningRunning {
+		s.advanceProvisioning(r.Context(), cycle.ID)
+		if cycle, err = s.db.GetProvisioningCycle(cycle.ID); err != nil || cycle == nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+	}
+
+	assignment := models.HookAssignment{CycleStatus: cycle.Status}
+	if cycle.Status == models.ProvisioningRunning {
+		if run := currentHookRun(cycle); run != nil && !run.Hook.RunsOnServer() {
+			switch {
+			case run.Status == models.HookRunRunning:
+				assignment.Run = run
+			case run.NextAttemptAt == nil || !time.Now().Before(*run.NextAttemptAt):
+				started, err := s.startHookAttempt(run)
+				if err != nil {
+					respondInternalError(w, err, "failed to start hook run")
+					return
+				}
+				if started {
+					assignment.Run = run
+				}
+			}
+		}
+	}
+
+	respondJSON(w, http.StatusOK, assignment)
+}
+
+// handleHookResult records the result of a script hook the agent ran, and
+// moves the machine's provisioning cycle on
+func (s *Server) handleHookResult(w http.ResponseWriter, r *http.Request) {
+	machine := s.hooksMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	run, err := s.db.GetHookRun(mux.Vars(r)["run_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if run == nil || run.MachineID != machine.ID || run.Hook.RunsOnServer() {
+		respondError(w, http.StatusNotFound, CodeHookRunNotFound, "hook run not found")
+		return
+	}
+	if run.Status != models.HookRunRunning {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("hook run is %s", run.Status))
+		return
+	}
+
+	var result models.HookResult
+	if !decodeJSON(w, r, &result) {
+		return
+	}
+
+	run.ExitCode = result.ExitCode
+	run.Log = models.TruncateHookLog(result.Output)
+	var recorded bool
+	if result.Success {
+		recorded, err = s.finishHookAttempt(run, models.HookRunRunning, "")
+	} else {
+		reason := result.Error
+		if reason == "" && result.ExitCode != nil {
+			reason = fmt.Sprintf("exited with status %d", *result.ExitCode)
+		}
+		if reason == "" {
+			reason = "script failed"
+		}
+		recorded, err = s.finishHookAttempt(run, models.HookRunRunning, reason)
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to record hook result")
+		return
+	}
+	if !recorded {
+		respondError(w, http.StatusConflict, CodeConflict, "hook run has timed out or been retried")
+		return
+	}
+
+	s.advanceProvisioning(r.Context(), run.CycleID)
+
+	respondJSON(w, http.StatusOK, run)
+}
+
+// hooksMachine looks up the machine of a request from its agent, which
+// authenticates with the machine's hooks token as a bearer token. It
+// responds with an error and returns nil if the token isn't the machine's.
+func (s *Server) hooksMachine(w http.ResponseWriter, r *http.Request) *models.Machine {
+	id := mux.Vars(r)["id"]
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !s.jwtManager.ValidateHooksToken(id, token) {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid machine token")
+		return nil
+	}
+
+	return s.noteMachine(w, r)
+}
+
+// startProvisioning starts a provisioning cycle when a machine is served
+// the image of a build it hasn't been provisioned with yet, if it has
+// hooks. Booting the same build again leaves its cycle alone.
+func (s *Server) startProvisioning(ctx context.Context, machine *models.Machine, boot *models.BootRequest) {
+	if boot.Decision != models.BootDecisionCustom || boot.ArtifactsVersion == "" {
+		return
+	}
+
+	latest, err := s.db.GetLatestProvisioningCycle(machine.ID)
+	if err != nil {
+		log.Printf("Failed to get provisioning cycle of machine %s: %v", machine.ID, err)
+		return
+	}
+	if latest != nil && latest.BuildID == boot.ArtifactsVersion {
+		return
+	}
+
+	hooks, err := s.machineProvisioningHooks(machine)
+	if err != nil {
+		log.Printf("Failed to resolve provisioning hooks of machine %s: %v", machine.ID, err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	cycle := &models.ProvisioningCycle{MachineID: machine.ID, BuildID: boot.ArtifactsVersion}
+	for _, hook := range hooks {
+		cycle.Runs = append(cycle.Runs, &models.HookRun{Hook: hook})
+	}
+	if err := s.db.CreateProvisioningCycle(cycle); err != nil {
+		log.Printf("Failed to start provisioning cycle of machine %s: %v", machine.ID, err)
+		return
+	}
+
+	log.Printf("Provisioning cycle %s of machine %s started with %d hooks for build %s", cycle.ID, machine.ID, len(hooks), cycle.BuildID)
+	s.advanceProvisioning(ctx, cycle.ID)
+}
+
+// advanceProvisioning moves a running provisioning cycle on: it times out
+// attempts that ran out of time, starts the next server hook once the
+// hooks before it are done, and finishes the cycle when every hook is
+// done or a required one has failed. Script hooks wait for the agent,
+// which has a hook's timeout to fetch it.
+func (s *Server) advanceProvisioning(ctx context.Context, cycleID string) {
+	cycle, err := s.db.GetProvisioningCycle(cycleID)
+	if err != nil {
+		log.Printf("Failed to get provisioning cycle %s: %v", cycleID, err)
+		return
+	}
+	if cycle == nil || cycle.Status != models.ProvisioningRunning {
+		return
+	}
+
+	now := time.Now()
+	for _, run := range cycle.Runs {
+		if err := s.timeOutHookAttempt(run, now); err != nil {
+			log.Printf("Failed to time out hook run %s: %v", run.ID, err)
+			return
+		}
+		if run.Done() {
+			continue
+		}
+
+		switch {
+		case run.Status == models.HookRunFailed:
+			s.failProvisioning(ctx, cycle, run)
+		case run.Status == models.HookRunRunning:
+		case run.NextAttemptAt != nil && now.Before(*run.NextAttemptAt):
+		case run.Hook.RunsOnServer():
+			started, err := s.startHookAttempt(run)
+			if err != nil {
+				log.Printf("Failed to start hook run %s: %v", run.ID, err)
+			} else if started {
+				go s.runServerHook(run)
+			}
+		case run.Deadline == nil:
+			// The agent has the hook's timeout to fetch it
+			deadline := now.Add(run.Hook.Timeout())
+			run.Deadline = &deadline
+			if _, err := s.db.UpdateHookRun(run, models.HookRunPending); err != nil {
+				log.Printf("Failed to update hook run %s: %v", run.ID, err)
+			}
+		}
+		return
+	}
+
+	s.completeProvisioning(ctx, cycle)
+}
+
+// currentHookRun returns the run of a running cycle that holds up the
+// others, or nil if every run is done
+func currentHookRun(cycle *models.ProvisioningCycle) *models.HookRun {
+	for _, run := range cycle.Runs {
+		if !run.Done() {
+			return run
+		}
+	}
+	return nil
+}
+
+// timeOutHookAttempt fails the attempt of a run whose deadline has passed:
+// a script the agent didn't fetch or report in time, or a server hook the
+// server stopped running
+func (s *Server) timeOutHookAttempt(run *models.HookRun, now time.Time) error {
+	if run.Deadline == nil || (run.Status != models.HookRunPending && run.Status != models.HookRunRunning) {
+		return nil
+	}
+
+	deadline := *run.Deadline
+	if run.Hook.RunsOnServer() {
+		deadline = deadline.Add(serverHookGrace)
+	}
+	if now.Before(deadline) {
+		return nil
+	}
+
+	from := run.Status
+	reason := "timed out waiting for the agent's result"
+	switch {
+	case from == models.HookRunPending:
+		// Not fetching the script counts as an attempt
+		run.Attempts++
+		reason = "timed out waiting for the agent to fetch the script"
+	case run.Hook.RunsOnServer():
+		reason = "interrupted: the server running the hook stopped"
+	}
+	_, err := s.finishHookAttempt(run, from, reason)
+	return err
+}
+
+// startHookAttempt starts the next attempt of a pending run, if nothing
+// else has. It returns false if the run was no longer pending.
+func (s *Server) startHookAttempt(run *models.HookRun) (bool, error) {
+	// A script's attempt counts from when the agent fetches it, not from
+	// when it became due
+	now := time.Now()
+	deadline := now.Add(run.Hook.Timeout())
+
+	run.Status = models.HookRunRunning
+	run.Attempts++
+	run.NextAttemptAt = nil
+	run.Deadline = &deadline
+	run.StartedAt = &now
+	run.FinishedAt = nil
+	run.ExitCode = nil
+	run.Log = ""
+	run.Error = ""
+	return s.db.UpdateHookRun(run, models.HookRunPending)
+}
+
+// finishHookAttempt records how an attempt of a run in status from ended:
+// success if reason is empty. A failed run with attempts left is retried
+// after its retry delay. It returns false if the run had moved on.
+func (s *Server) finishHookAttempt(run *models.HookRun, from, reason string) (bool, error) {
+	now := time.Now()
+	run.Deadline = nil
+	run.NextAttemptAt = nil
+	run.Error = reason
+
+	switch {
+	case reason == "":
+		run.Status = models.HookRunSucceeded
+		run.FinishedAt = &now
+	case run.Attempts <= run.Hook.Retries:
+		run.Status = models.HookRunPending
+		next := now.Add(run.Hook.RetryDelay())
+		run.NextAttemptAt = &next
+	default:
+		run.Status = models.HookRunFailed
+		run.FinishedAt = &now
+	}
+
+	finished, err := s.db.UpdateHookRun(run, from)
+	if err != nil || !finished {
+		return false, err
+	}
+
+	switch run.Status {
+	case models.HookRunSucceeded:
+		log.Printf("Hook %s of machine %s succeeded", run.Hook.Name, run.MachineID)
+	case models.HookRunPending:
+		log.Printf("Hook %s of machine %s failed attempt %d, retrying at %s: %s", run.Hook.Name, run.MachineID, run.Attempts, run.NextAttemptAt.Format(time.RFC3339), reason)
+	default:
+		log.Printf("Hook %s of machine %s failed after %d attempts: %s", run.Hook.Name, run.MachineID, run.Attempts, reason)
+	}
+	return true, nil
+}
+
+// completeProvisioning finishes a cycle whose hooks are all done, and
+// marks the machine provisioned if it is still ready
+func (s *Server) completeProvisioning(ctx context.Context, cycle *models.ProvisioningCycle) {
+	cycle.Status = models.ProvisioningSucceeded
+	finished, err := s.db.SetProvisioningCycleStatus(cycle, models.ProvisioningRunning)
+	if err != nil {
+		log.Printf("Failed to finish provisioning cycle %s: %v", cycle.ID, err)
+		return
+	}
+	if !finished {
+		return
+	}
+	log.Printf("Provisioning cycle %s of machine %s succeeded", cycle.ID, cycle.MachineID)
+
+	provisioned, err := s.db.MarkMachineProvisioned(cycle.MachineID)
+	if err != nil {
+		log.Printf("Failed to mark machine %s provisioned: %v", cycle.MachineID, err)
+		return
+	}
+	if provisioned {
+		s.publish(ctx, events.Event{
+			Type:      events.MachineStatusChanged,
+			MachineID: cycle.MachineID,
+			Data: events.StatusChangedData{
+				OldStatus: models.StatusReady,
+				NewStatus: models.StatusProvisioned,
+			},
+		})
+	}
+}
+
+// failProvisioning fails a cycle held up by a required hook that ran out
+// of attempts. The machine stays ready until the hook is re-run and the
+// cycle completes.
+func (s *Server) failProvisioning(ctx context.Context, cycle *models.ProvisioningCycle, run *models.HookRun) {
+	cycle.Status = models.ProvisioningFailed
+	failed, err := s.db.SetProvisioningCycleStatus(cycle, models.ProvisioningRunning)
+	if err != nil {
+		log.Printf("Failed to fail provisioning cycle %s: %v", cycle.ID, err)
+		return
+	}
+	if !failed {
+		return
+	}
+
+	log.Printf("Provisioning cycle %s of machine %s failed: hook %s: %s", cycle.ID, cycle.MachineID, run.Hook.Name, run.Error)
+	s.publish(ctx, events.Event{
+		Type:      events.MachineProvisioningFailed,
+		MachineID: cycle.MachineID,
+		Data: events.ProvisioningFailedData{
+			CycleID:  cycle.ID,
+			BuildID:  cycle.BuildID,
+			RunID:    run.ID,
+			Hook:     run.Hook.Name,
+			HookType: run.Hook.Type,
+			Attempts: run.Attempts,
+			Error:    run.Error,
+		},
+	})
+}
+
+// runServerHook runs an attempt of a hook the server runs itself, records
+// how it ended, and moves the cycle on
+func (s *Server) runServerHook(run *models.HookRun) {
+	var output string
+	machine, err := s.db.GetMachine(run.MachineID)
+	if err == nil && machine == nil {
+		err = fmt.Errorf("machine no longer exists")
+	}
+	if err == nil {
+		ctx, cancel := context.WithDeadline(context.Background(), *run.Deadline)
+		url := expandHookURL(run.Hook.URL, machine)
+		if run.Hook.Type == models.HookTypeWaitForEndpoint {
+			output, err = waitForEndpoint(ctx, url)
+		} else {
+			output, err = callHookWebhook(ctx, url, machine, run)
+		}
+		cancel()
+	}
+
+	run.Log = models.TruncateHookLog(output)
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	if _, err := s.finishHookAttempt(run, models.HookRunRunning, reason); err != nil {
+		log.Printf("Failed to record hook run %s: %v", run.ID, err)
+		return
+	}
+
+	s.advanceProvisioning(context.Background(), run.CycleID)
+}
+
+// expandHookURL fills the machine placeholders of a hook's URL
+func expandHookURL(rawURL string, machine *models.Machine) string {
+	return strings.NewReplacer(
+		"{{hostname}}", machine.Hostname,
+		"{{service_tag}}", machine.ServiceTag,
+		"{{machine_id}}", machine.ID,
+		"{{ip}}", machine.CurrentIP,
+	).Replace(rawURL)
+}
+
+// hookWebhookPayload is the body webhook-call hooks POST
+type hookWebhookPayload struct {
+	Hook       string `json:"hook"`
+	CycleID    string `json:"cycle_id"`
+	Attempt    int    `json:"attempt"`
+	MachineID  string `json:"machine_id"`
+	Hostname   string `json:"hostname"`
+	ServiceTag string `json:"service_tag"`
+	IPAddress  string `json:"ip_address,omitempty"`
+}
+
+// callHookWebhook POSTs the machine to a webhook-call hook's URL. Any 2xx
+// response succeeds.
+func callHookWebhook(ctx context.Context, url string, machine *models.Machine, run *models.HookRun) (string, error) {
+	body, err := json.Marshal(hookWebhookPayload{
+		Hook:       run.Hook.Name,
+		CycleID:    run.CycleID,
+		Attempt:    run.Attempts,
+		MachineID:  machine.ID,
+		Hostname:   machine.Hostname,
+		ServiceTag: machine.ServiceTag,
+		IPAddress:  machine.CurrentIP,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return fmt.Sprintf("POST %s: %v\n", url, err), err
+	}
+	defer resp.Body.Close()
+
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, hookResponseLogBytes))
+	output := fmt.Sprintf("POST %s: %s\n%s", url, resp.Status, response)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return output, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return output, nil
+}
+
+// waitForEndpoint polls url until it answers with a 2xx status or ctx is
+// done. The output logs each poll that changed the outcome.
+func waitForEndpoint(ctx context.Context, url string) (string, error) {
+	var output strings.Builder
+	last := ""
+	for {
+		outcome, ok := pollEndpoint(ctx, url)
+		if outcome != last {
+			fmt.Fprintf(&output, "%s GET %s: %s\n", time.Now().UTC().Format(time.RFC3339), url, outcome)
+			last = outcome
+		}
+		if ok {
+			return output.String(), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return output.String(), fmt.Errorf("endpoint didn't answer in time, last: %s", last)
+		case <-time.After(hookPollInterval):
+		}
+	}
+}
+
+// pollEndpoint GETs url once, and returns its status or error, and whether
+// it was a 2xx status
+func pollEndpoint(ctx context.Context, url string) (string, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err.Error(), false
+	}
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return err.Error(), false
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, hookResponseLogBytes))
+	resp.Body.Close()
+	return resp.Status, resp.StatusCode >= 200 && resp.StatusCode <= 299
+}
+
+// StartProvisioningWatchdog advances running provisioning cycles past
+// retry delays and timeouts
+func (s *Server) StartProvisioningWatchdog() {
+	go func() {
+		log.Printf("Provisioning watchdog started")
+
+		ticker := time.NewTicker(provisioningTick)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !s.leadJob("provisioning-watchdog", provisioningTick) {
+				continue
+			}
+
+			ids, err := s.db.ListRunningProvisioningCycleIDs()
+			if err != nil {
+				log.Printf("Provisioning watchdog failed to list cycles: %v", err)
+				continue
+			}
+
+			for _, id := range ids {
+				s.advanceProvisioning(context.Background(), id)
+			}
+		}
+	}()
+}
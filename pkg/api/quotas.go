@@ -0,0 +1,180 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// maxQuotaGrantDuration is the longest a quota grant may last
+const maxQuotaGrantDuration = 30 * 24 * time.Hour
+
+// checkQuota checks that the user making a request has units of a quota
+// kind left, without counting them, for operations that count each unit
+// as they go, such as bulk builds. It responds with 429 and returns false
+// if not.
+func (s *Server) checkQuota(w http.ResponseWriter, r *http.Request, kind string, units int) bool {
+	user, err := s.service.QuotaUser(r.Context(), "")
+	if err != nil {
+		respondInternalError(w, err, "failed to check quota")
+		return false
+	}
+	if _, err := s.service.CheckQuota(user, kind, units); err != nil {
+		respondServiceError(w, err, "failed to check quota")
+		return false
+	}
+	return true
+}
+
+// consumeQuota counts units of a quota kind against the user making a
+// request. It responds with 429 and returns false if they don't have that
+// many left.
+func (s *Server) consumeQuota(w http.ResponseWriter, r *http.Request, kind string, units int) bool {
+	user, err := s.service.QuotaUser(r.Context(), "")
+	if err != nil {
+		respondInternalError(w, err, "failed to check quota")
+		return false
+	}
+	if err := s.service.ConsumeQuota(r.Context(), user, kind, units); err != nil {
+		respondServiceError(w, err, "failed to check quota")
+		return false
+	}
+	return true
+}
+
+// quotaUser returns the user a quota endpoint is for, responding with 404
+// and returning nil if there is no such user
+func (s *Server) quotaUser(w http.ResponseWriter, r *http.Request) *models.User {
+	user, err := s.db.GetUser(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if user == nil {
+		respondError(w, http.StatusNotFound, CodeUserNotFound, "user not found")
+		return nil
+	}
+	return user
+}
+
+// handleGetUserUsage returns a user's quota usage over the last
+// models.QuotaWindow and their active grants (admin only)
+func (s *Server) handleGetUserUsage(w http.ResponseWriter, r *http.Request) {
+	user := s.quotaUser(w, r)
+	if user == nil {
+		return
+	}
+
+	usage, err := s.service.UserUsage(user)
+	if err != nil {
+		respondInternalError(w, err, "failed to get usage")
+		return
+	}
+	respondJSON(w, http.StatusOK, usage)
+}
+
+// handleSetUserQuota sets a user's own quota limits, which take precedence
+// over their role's. A null body clears them (admin only).
+func (s *Server) handleSetUserQuota(w http.ResponseWriter, r *http.Request) {
+	user := s.quotaUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var limits *models.QuotaLimits
+	if !decodeJSON(w, r, &limits) {
+		return
+	}
+	if err := limits.Validate(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if limits != nil && limits.Builds == nil && limits.PowerOperations == nil {
+		limits = nil
+	}
+
+	if err := s.db.SetUserQuota(user.ID, limits); err != nil {
+		respondInternalError(w, err, "failed to set quota")
+		return
+	}
+	user.Quota = limits
+
+	usage, err := s.service.UserUsage(user)
+	if err != nil {
+		respondInternalError(w, err, "failed to get usage")
+		return
+	}
+	respondJSON(w, http.StatusOK, usage)
+}
+
+// handleCreateQuotaGrant temporarily raises a user's quota of one kind
+// (admin only)
+func (s *Server) handleCreateQuotaGrant(w http.ResponseWriter, r *http.Request) {
+	user := s.quotaUser(w, r)
+	if user == nil {
+		return
+	}
+
+	var req models.CreateQuotaGrantRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !models.IsValidQuotaKind(req.Kind) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "kind must be one of "+strings.Join(models.QuotaKinds, ", "))
+		return
+	}
+	if req.Units < 1 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "units must be at least 1")
+		return
+	}
+	duration := models.QuotaWindow
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxQuotaGrantDuration {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "duration must be a positive duration of at most "+maxQuotaGrantDuration.String())
+			return
+		}
+		duration = d
+	}
+
+	grantedBy := "admin"
+	if claims, ok := auth.GetClaims(r); ok {
+		grantedBy = claims.Username
+	}
+
+	grant := &models.QuotaGrant{
+		UserID:    user.ID,
+		Kind:      req.Kind,
+		Units:     req.Units,
+		Reason:    req.Reason,
+		GrantedBy: grantedBy,
+		ExpiresAt: time.Now().Add(duration),
+	}
+	if err := s.db.CreateQuotaGrant(grant); err != nil {
+		respondInternalError(w, err, "failed to create quota grant")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, grant)
+}
+
+// handleDeleteQuotaGrant revokes one of a user's quota grants (admin only)
+func (s *Server) handleDeleteQuotaGrant(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	deleted, err := s.db.DeleteQuotaGrant(vars["id"], vars["grant_id"])
+	if err != nil {
+		respondInternalError(w, err, "failed to delete quota grant")
+		return
+	}
+	if !deleted {
+		respondError(w, http.StatusNotFound, CodeQuotaGrantNotFound, "quota grant not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// Route groups with their own rate limits
+const (
+	rateLimitEnroll  = "enroll"
+	rateLimitClaim   = "claim"
+	rateLimitMetrics = "metrics"
+	rateLimitPower   = "power"
+	rateLimitDefault = "default"
+)
+
+// Default rate limits. Enrollment is counted per source address, metrics
+// submissions per machine, and everything else per user, or per source
+// address without credentials. Claims are kept slow so claim codes can't be
+// guessed.
+var (
+	defaultEnrollRateLimit  = ratelimit.Limit{Requests: 30, Period: time.Minute}
+	defaultClaimRateLimit   = ratelimit.Limit{Requests: 10, Period: time.Minute}
+	defaultMetricsRateLimit = ratelimit.Limit{Requests: 12, Period: time.Minute}
+	defaultPowerRateLimit   = ratelimit.Limit{Requests: 30, Period: time.Minute}
+	defaultRateLimit        = ratelimit.Limit{Requests: 600, Period: time.Minute}
+)
+
+// rateLimitRoutes puts routes in a group other than the default. The power
+// group covers every route that talks to a BMC.
+var rateLimitRoutes = map[string]string{
+	"/api/v1/enroll":                      rateLimitEnroll,
+	"/api/v1/machines/claim":              rateLimitClaim,
+	"/api/v1/machines/{id}/metrics":       rateLimitMetrics,
+	"/api/v1/machines/{id}/power":         rateLimitPower,
+	"/api/v1/machines/{id}/power/status":  rateLimitPower,
+	"/api/v1/machines/{id}/bmc/test":      rateLimitPower,
+	"/api/v1/machines/{id}/bmc/info":      rateLimitPower,
+	"/api/v1/machines/{id}/bmc/sensors":   rateLimitPower,
+	"/api/v1/machines/{id}/bmc/health":    rateLimitPower,
+	"/api/v1/machines/{id}/bmc/inventory": rateLimitPower,
+	"/api/v1/machines/{id}/bmc/rotate":    rateLimitPower,
+}
+
+// RateLimitConfig limits how fast each client can make requests, per route
+// group. A zero limit uses the group's default.
+type RateLimitConfig struct {
+	Disabled bool
+
+	Enroll  ratelimit.Limit
+	Claim   ratelimit.Limit
+	Metrics ratelimit.Limit
+	Power   ratelimit.Limit
+	Default ratelimit.Limit
+
+	// ExemptUsers are usernames that are never limited, such as the
+	// account a Prometheus scraper uses
+	ExemptUsers []string
+
+	// Limiter counts requests. It defaults to one in memory, which limits
+	// each server separately.
+	Limiter ratelimit.Limiter
+}
+
+// withDefaults fills in unset limits and the limiter
+func (c RateLimitConfig) withDefaults() RateLimitConfig {
+	limits := []struct {
+		limit    *ratelimit.Limit
+		fallback ratelimit.Limit
+	}{
+		{&c.Enroll, defaultEnrollRateLimit},
+		{&c.Claim, defaultClaimRateLimit},
+		{&c.Metrics, defaultMetricsRateLimit},
+		{&c.Power, defaultPowerRateLimit},
+		{&c.Default, defaultRateLimit},
+	}
+	for _, l := range limits {
+		if l.limit.Requests <= 0 || l.limit.Period <= 0 {
+			*l.limit = l.fallback
+		}
+	}
+
+	if c.Limiter == nil {
+		c.Limiter = ratelimit.NewMemory(0)
+	}
+	return c
+}
+
+// limit returns a route group's limit
+func (c RateLimitConfig) limit(group string) ratelimit.Limit {
+	switch group {
+	case rateLimitEnroll:
+		return c.Enroll
+	case rateLimitClaim:
+		return c.Claim
+	case rateLimitMetrics:
+		return c.Metrics
+	case rateLimitPower:
+		return c.Power
+	default:
+		return c.Default
+	}
+}
+
+// rateLimitMiddleware counts each request against its route group's limit
+// and rejects it with 429 once the client is over it. Every limited
+// response carries X-RateLimit-Limit, X-RateLimit-Remaining, and
+// X-RateLimit-Reset, the Unix time at which the full limit is available
+// again.
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := s.config.RateLimits
+		if config.Disabled || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		group := rateLimitRoutes[route]
+		if group == "" {
+			group = rateLimitDefault
+		}
+
+		client, exempt := s.rateLimitClient(r, group)
+		if exempt {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result, err := config.Limiter.Allow(r.Context(), group+":"+client, config.limit(group))
+		if err != nil {
+			// Better to serve without a limit than to fail every request
+			log.Printf("Rate limiter failed: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(result.Reset.UnixNano())/1e9)), 10))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			respondError(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded; retry later")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitClient identifies who a request counts against: the machine for
+// metrics submissions, the user when the request carries a valid token, and
+// otherwise the source address. It also reports whether the user is exempt.
+func (s *Server) rateLimitClient(r *http.Request, group string) (string, bool) {
+	if group == rateLimitMetrics {
+		return "machine:" + mux.Vars(r)["id"], false
+	}
+
+	if claims := s.requestClaims(r); claims != nil {
+		for _, exempt := range s.config.RateLimits.ExemptUsers {
+			if claims.Username == exempt {
+				return "", true
+			}
+		}
+		return "user:" + claims.UserID, false
+	}
+
+	return "ip:" + clientIP(r), false
+}
@@ -0,0 +1,71 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// TestReplicasPurgeTrashOnce starts the trash purger on two replicas
+// sharing a database at the same moment. Only the replica that takes the
+// job's lock purges, so each machine's permanent deletion reaches webhooks
+// once.
+func TestReplicasPurgeTrashOnce(t *testing.T) {
+	env := testutil.New(t)
+	receiver := testutil.NewWebhookReceiver(t)
+	env.AddWebhook(receiver, "machine.deleted")
+
+	// Enough machines that unlocked purges would overlap
+	const machines = 20
+	for i := 0; i < machines; i++ {
+		machine := env.EnrollMachine(fmt.Sprintf("REPLICA%02d", i))
+		env.MustJSON(models.RoleOperator, http.MethodDelete, "/api/v1/machines/"+machine.ID, nil, http.StatusNoContent, nil)
+	}
+
+	replicas := []interface{ StartTrashPurger(time.Duration) }{env.API, env.NewReplica()}
+	var start sync.WaitGroup
+	start.Add(1)
+	for _, replica := range replicas {
+		go func(replica interface{ StartTrashPurger(time.Duration) }) {
+			start.Wait()
+			replica.StartTrashPurger(0)
+		}(replica)
+	}
+	start.Done()
+
+	// The machines go to the trash first, then for good
+	deadline := time.Now().Add(5 * time.Second)
+	for countPermanentDeletes(receiver) < machines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give a second purge, if there were one, time to deliver
+	time.Sleep(200 * time.Millisecond)
+
+	if got := countPermanentDeletes(receiver); got != machines {
+		t.Errorf("%d permanent machine.deleted deliveries, want %d", got, machines)
+	}
+
+	var trash []models.Machine
+	env.MustJSON(models.RoleAdmin, http.MethodGet, "/api/v1/machines/trash", nil, http.StatusOK, &trash)
+	if len(trash) != 0 {
+		t.Errorf("%d machines left in the trash", len(trash))
+	}
+}
+
+// countPermanentDeletes counts the machine.deleted deliveries for machines
+// deleted for good
+func countPermanentDeletes(receiver *testutil.WebhookReceiver) int {
+	count := 0
+	for _, delivery := range receiver.Deliveries() {
+		data, _ := delivery.Payload["data"].(map[string]interface{})
+		if delivery.Event() == "machine.deleted" && data["permanent"] == true {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const retentionTick = time.Hour
+
+// RetentionConfig controls how long events, metrics, build logs, audit
+// entries, and webhook deliveries are kept. A zero duration keeps that data
+// forever.
+type RetentionConfig struct {
+	Events            time.Duration
+	Metrics           time.Duration
+	BuildLogs         time.Duration
+	Audit             time.Duration
+	WebhookDeliveries time.Duration
+
+	// ArchiveDir, when set, receives a gzipped NDJSON file of each batch of
+	// pruned events before they are deleted
+	ArchiveDir string
+}
+
+// StartRetention prunes events, metrics, build logs, audit entries, and
+// webhook deliveries past their retention period
+func (s *Server) StartRetention(config RetentionConfig) {
+	go func() {
+		log.Printf("Retention started (events: %s, metrics: %s, build logs: %s, audit: %s, webhook deliveries: %s)",
+			config.Events, config.Metrics, config.BuildLogs, config.Audit, config.WebhookDeliveries)
+
+		ticker := time.NewTicker(retentionTick)
+		defer ticker.Stop()
+
+		for {
+			if s.leadJob("retention", retentionTick) {
+				s.applyRetention(config, time.Now())
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// applyRetention makes one retention pass
+func (s *Server) applyRetention(config RetentionConfig, now time.Time) {
+	if config.Events > 0 {
+		if err := s.pruneEvents(now.Add(-config.Events), config.ArchiveDir); err != nil {
+			log.Printf("Event retention failed: %v", err)
+		}
+	}
+
+	if config.Metrics > 0 {
+		if err := s.db.DeleteOldMetrics(now.Add(-config.Metrics)); err != nil {
+			log.Printf("Metrics retention failed: %v", err)
+		}
+	}
+
+	if config.BuildLogs > 0 {
+		cutoff := now.Add(-config.BuildLogs)
+		deleted, err := s.db.DeleteBuildLogsBefore(cutoff)
+		if err != nil {
+			log.Printf("Build log retention failed: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Pruned %d logs of builds created before %s", deleted, cutoff.Format(time.RFC3339))
+		}
+	}
+
+	if config.Audit > 0 {
+		cutoff := now.Add(-config.Audit)
+		deleted, err := s.db.DeleteAuditEntriesBefore(cutoff)
+		if err != nil {
+			log.Printf("Audit retention failed: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Pruned %d audit entries recorded before %s", deleted, cutoff.Format(time.RFC3339))
+		}
+	}
+
+	// Each webhook's last failure is kept, so why it failed can be seen
+	if config.WebhookDeliveries > 0 {
+		cutoff := now.Add(-config.WebhookDeliveries)
+		deleted, err := s.db.DeleteWebhookDeliveriesBefore(cutoff)
+		if err != nil {
+			log.Printf("Webhook delivery retention failed: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Pruned %d webhook deliveries recorded before %s", deleted, cutoff.Format(time.RFC3339))
+		}
+	}
+}
+
+// pruneEvents deletes events recorded before cutoff, archiving them first
+// when archiveDir is set. Nothing is deleted if the archive can't be written.
+func (s *Server) pruneEvents(cutoff time.Time, archiveDir string) error {
+	if archiveDir != "" {
+		archived, err := s.archiveEvents(cutoff, archiveDir)
+		if err != nil {
+			return fmt.Errorf("failed to archive events: %w", err)
+		}
+		if archived > 0 {
+			log.Printf("Archived %d events recorded before %s", archived, cutoff.Format(time.RFC3339))
+		}
+	}
+
+	deleted, err := s.db.DeleteEventsBefore(cutoff)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("Pruned %d events recorded before %s", deleted, cutoff.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// archiveEvents writes events recorded before cutoff to
+// <dir>/events-<cutoff>.ndjson.gz and returns how many were written
+func (s *Server) archiveEvents(cutoff time.Time, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return 0, err
+	}
+
+	name := filepath.Join(dir, fmt.Sprintf("events-%s.ndjson.gz", cutoff.UTC().Format("20060102T150405Z")))
+	tmp, err := os.CreateTemp(dir, ".events-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	encoder := json.NewEncoder(gz)
+	count := 0
+
+	err = s.db.StreamEvents(database.EventFilter{Until: cutoff, Ascending: true}, func(event *models.MachineEvent) error {
+		count++
+		return encoder.Encode(event)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	return count, os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,643 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipmi"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/gorilla/mux"
+)
+
+const (
+	buildRolloutTick = 10 * time.Second
+
+	defaultRolloutWaitTimeout = 3600 // Seconds
+)
+
+// handleCreateBuildRollout starts a build rollout of a group's machines,
+// in hostname order. Members that can't be built are skipped and listed
+// in the rollout; the orchestrator builds the rest batch by batch.
+func (s *Server) handleCreateBuildRollout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["id"]
+
+	group, err := s.db.GetGroup(groupID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if group == nil {
+		respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+		return
+	}
+
+	// The body is optional
+	var req models.BuildRolloutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+	if !validBuildRolloutRequest(w, &req) {
+		return
+	}
+
+	if !s.lockBuildRollouts(rolloutLockWait) {
+		respondRolloutsBusy(w)
+		return
+	}
+	defer s.unlockBuildRollouts()
+
+	existing, err := s.db.ListBuildRollouts(groupID)
+	if err != nil {
+		respondInternalError(w, err, "failed to list rollouts")
+		return
+	}
+	for _, rollout := range existing {
+		if rollout.IsActive() {
+			respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("group already has a %s rollout: %s", rollout.Status, rollout.ID))
+			return
+		}
+	}
+
+	members, err := s.db.GetGroupMachines(groupID)
+	if err != nil {
+		respondInternalError(w, err, "failed to get group machines")
+		return
+	}
+
+	machineIDs := make([]string, len(members))
+	for i, m := range members {
+		machineIDs[i] = m.ID
+	}
+	if !s.checkMaintenance(w, r, machineIDs, models.MaintenanceOpBuild) {
+		return
+	}
+	if req.PowerCycle && !s.checkMaintenance(w, r, machineIDs, models.MaintenanceOpPower) {
+		return
+	}
+
+	rollout := &models.BuildRollout{
+		GroupID:         group.ID,
+		Status:          models.BuildRolloutRunning,
+		BatchSize:       req.BatchSize,
+		MaxFailures:     req.MaxFailures,
+		WaitForStatus:   req.WaitForStatus,
+		WaitTimeout:     req.WaitTimeout,
+		InterBatchDelay: req.InterBatchDelay,
+		PowerCycle:      req.PowerCycle,
+		Machines:        []models.BuildRolloutMachine{},
+	}
+	if claims, ok := auth.GetClaims(r); ok {
+		rollout.CreatedBy = claims.Username
+	}
+
+	queued := 0
+	for _, member := range members {
+		// Group listings leave out the BMC settings
+		machine, err := s.db.GetMachine(member.ID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if machine == nil {
+			continue
+		}
+
+		entry := models.BuildRolloutMachine{
+			MachineID: machine.ID,
+			Hostname:  machine.Hostname,
+			Status:    models.RolloutMachinePending,
+		}
+		if reason := s.rolloutBlocker(machine, req.PowerCycle); reason != "" {
+			entry.Status = models.RolloutMachineSkipped
+			entry.Error = reason
+		} else {
+			entry.Batch = queued/req.BatchSize + 1
+			queued++
+		}
+		rollout.Machines = append(rollout.Machines, entry)
+	}
+
+	if queued == 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "group has no machines that can be built")
+		return
+	}
+
+	if err := s.db.CreateBuildRollout(rollout); err != nil {
+		respondInternalError(w, err, "failed to create rollout")
+		return
+	}
+
+	log.Printf("Build rollout %s started for group %s: %d machine(s) in batches of %d, %d skipped",
+		rollout.ID, group.ID, queued, rollout.BatchSize, len(rollout.Machines)-queued)
+	s.publishRolloutEvent(rollout, events.RolloutStarted, events.RolloutData{})
+	s.wakeRolloutOrchestrator()
+
+	respondJSON(w, http.StatusCreated, rollout)
+}
+
+// validBuildRolloutRequest checks a rollout request and fills in defaults
+func validBuildRolloutRequest(w http.ResponseWriter, req *models.BuildRolloutRequest) bool {
+	if req.BatchSize < 0 || req.MaxFailures < 0 || req.WaitTimeout < 0 || req.InterBatchDelay < 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "batch_size, max_failures, wait_timeout_seconds, and inter_batch_delay_seconds must not be negative")
+		return false
+	}
+
+	switch req.WaitForStatus {
+	case "":
+		req.WaitForStatus = models.StatusReady
+	case models.StatusReady, models.StatusProvisioned:
+	default:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "wait_for_status must be ready or provisioned")
+		return false
+	}
+
+	if req.BatchSize == 0 {
+		req.BatchSize = 1
+	}
+	if req.WaitTimeout == 0 {
+		req.WaitTimeout = defaultRolloutWaitTimeout
+	}
+	return true
+}
+
+// rolloutBlocker returns why a machine can't be part of a build rollout, or
+// "" if it can
+func (s *Server) rolloutBlocker(machine *models.Machine, powerCycle bool) string {
+	switch {
+	case !machine.CanProvision():
+		return fmt.Sprintf("machine is %s", machine.Status)
+	case powerCycle && machine.BMCInfo == nil:
+		return "machine has no BMC to power cycle"
+	}
+
+	assembled, err := fragments.MachineConfig(s.db, machine)
+	if err != nil {
+		return fmt.Sprintf("failed to get configuration: %v", err)
+	}
+	if assembled.Config == "" {
+		return "machine has no configuration"
+	}
+	return ""
+}
+
+// handleListBuildRollouts lists a group's build rollouts, newest first
+func (s *Server) handleListBuildRollouts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rollouts, err := s.db.ListBuildRollouts(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "failed to list rollouts")
+		return
+	}
+
+	if rollouts == nil {
+		rollouts = []*models.BuildRollout{}
+	}
+
+	respondJSON(w, http.StatusOK, rollouts)
+}
+
+// handleGetBuildRollout returns a build rollout and its per-machine progress
+func (s *Server) handleGetBuildRollout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rollout, err := s.db.GetBuildRollout(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if rollout == nil {
+		respondError(w, http.StatusNotFound, CodeRolloutNotFound, "rollout not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rollout)
+}
+
+// handlePauseBuildRollout stops a rollout from starting more builds.
+// Builds already started are still followed to completion.
+func (s *Server) handlePauseBuildRollout(w http.ResponseWriter, r *http.Request) {
+	s.changeBuildRollout(w, r, models.BuildRolloutRunning, func(rollout *models.BuildRollout, by string) {
+		rollout.Status = models.BuildRolloutPaused
+		rollout.PausedReason = "paused by " + by
+		s.publishRolloutEvent(rollout, events.RolloutPaused, events.RolloutData{Reason: rollout.PausedReason})
+	})
+}
+
+// handleResumeBuildRollout continues a paused rollout. The failure count
+// starts over, so a rollout paused at its failure threshold can fail
+// max_failures more machines before it pauses again.
+func (s *Server) handleResumeBuildRollout(w http.ResponseWriter, r *http.Request) {
+	s.changeBuildRollout(w, r, models.BuildRolloutPaused, func(rollout *models.BuildRollout, by string) {
+		rollout.Status = models.BuildRolloutRunning
+		rollout.PausedReason = ""
+		rollout.Failures = 0
+		s.wakeRolloutOrchestrator()
+	})
+}
+
+// handleAbortBuildRollout ends a rollout for good. Machines it had not
+// finished with are marked aborted; builds already started are left to
+// finish but no longer followed.
+func (s *Server) handleAbortBuildRollout(w http.ResponseWriter, r *http.Request) {
+	s.changeBuildRollout(w, r, "", func(rollout *models.BuildRollout, by string) {
+		now := time.Now()
+		for i := range rollout.Machines {
+			m := &rollout.Machines[i]
+			if !m.IsDone() {
+				m.Status = models.RolloutMachineAborted
+				m.CompletedAt = &now
+			}
+		}
+
+		rollout.Status = models.BuildRolloutAborted
+		rollout.NextBatchAt = nil
+		rollout.CompletedAt = &now
+		s.publishRolloutEvent(rollout, events.RolloutAborted, events.RolloutData{AbortedBy: by})
+	})
+}
+
+// changeBuildRollout applies a state change to a rollout in status from,
+// or to any active rollout if from is empty
+func (s *Server) changeBuildRollout(w http.ResponseWriter, r *http.Request, from string, change func(*models.BuildRollout, string)) {
+	vars := mux.Vars(r)
+
+	if !s.lockBuildRollouts(rolloutLockWait) {
+		respondRolloutsBusy(w)
+		return
+	}
+	defer s.unlockBuildRollouts()
+
+	rollout, err := s.db.GetBuildRollout(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if rollout == nil {
+		respondError(w, http.StatusNotFound, CodeRolloutNotFound, "rollout not found")
+		return
+	}
+
+	if (from != "" && rollout.Status != from) || !rollout.IsActive() {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("rollout is %s", rollout.Status))
+		return
+	}
+
+	by := "system"
+	if claims, ok := auth.GetClaims(r); ok {
+		by = claims.Username
+	}
+
+	change(rollout, by)
+	if err := s.db.UpdateBuildRollout(rollout); err != nil {
+		respondInternalError(w, err, "failed to update rollout")
+		return
+	}
+
+	log.Printf("Build rollout %s is now %s (%s)", rollout.ID, rollout.Status, by)
+	respondJSON(w, http.StatusOK, rollout)
+}
+
+// StartBuildRolloutOrchestrator runs active build rollouts. Rollouts left
+// running or paused by a previous server are picked up on the first pass.
+func (s *Server) StartBuildRolloutOrchestrator() {
+	go func() {
+		log.Printf("Build rollout orchestrator started")
+
+		ticker := time.NewTicker(buildRolloutTick)
+		defer ticker.Stop()
+
+		for {
+			s.advanceBuildRollouts()
+
+			select {
+			case <-ticker.C:
+			case <-s.rolloutWake:
+			}
+		}
+	}()
+}
+
+// wakeRolloutOrchestrator makes the orchestrator run without waiting for
+// its next tick
+func (s *Server) wakeRolloutOrchestrator() {
+	select {
+	case s.rolloutWake <- struct{}{}:
+	default:
+	}
+}
+
+// advanceBuildRollouts makes one pass over the active build rollouts,
+// unless another server is making one
+func (s *Server) advanceBuildRollouts() {
+	if !s.lockBuildRollouts(0) {
+		return
+	}
+	defer s.unlockBuildRollouts()
+
+	rollouts, err := s.db.ListActiveBuildRollouts()
+	if err != nil {
+		log.Printf("Rollout orchestrator failed to list rollouts: %v", err)
+		return
+	}
+
+	for _, rollout := range rollouts {
+		s.advanceBuildRollout(rollout)
+	}
+}
+
+// advanceBuildRollout follows the builds a rollout has started, pauses it
+// at its failure threshold, and starts its next batch once the current one
+// is done. Paused rollouts follow their started builds but start no more.
+func (s *Server) advanceBuildRollout(rollout *models.BuildRollout) {
+	changed := false
+	for i := range rollout.Machines {
+		m := &rollout.Machines[i]
+		switch m.Status {
+		case models.RolloutMachineBuilding:
+			changed = s.checkRolloutBuild(rollout, m) || changed
+		case models.RolloutMachineWaiting:
+			changed = s.checkRolloutWait(rollout, m) || changed
+		}
+	}
+
+	if rollout.Status == models.BuildRolloutRunning && rollout.Failures > rollout.MaxFailures {
+		rollout.Status = models.BuildRolloutPaused
+		rollout.PausedReason = fmt.Sprintf("%d machine(s) failed, more than max_failures (%d)", rollout.Failures, rollout.MaxFailures)
+		changed = true
+
+		log.Printf("Build rollout %s paused: %s", rollout.ID, rollout.PausedReason)
+		s.publishRolloutEvent(rollout, events.RolloutPaused, events.RolloutData{Reason: rollout.PausedReason})
+	}
+
+	if rollout.Status == models.BuildRolloutRunning && rolloutBatchDone(rollout, rollout.CurrentBatch) {
+		changed = s.startNextRolloutBatch(rollout) || changed
+	}
+
+	if changed {
+		s.saveBuildRollout(rollout)
+	}
+}
+
+// startNextRolloutBatch starts the builds of the batch after the current
+// one once the inter-batch delay has passed, or completes the rollout if
+// there are no more batches
+func (s *Server) startNextRolloutBatch(rollout *models.BuildRollout) bool {
+	now := time.Now()
+	next := rollout.CurrentBatch + 1
+
+	pending := false
+	for _, m := range rollout.Machines {
+		pending = pending || (m.Batch == next && m.Status == models.RolloutMachinePending)
+	}
+	if !pending {
+		s.completeBuildRollout(rollout)
+		return true
+	}
+
+	if rollout.CurrentBatch > 0 && rollout.InterBatchDelay > 0 {
+		if rollout.NextBatchAt == nil {
+			at := now.Add(time.Duration(rollout.InterBatchDelay) * time.Second)
+			rollout.NextBatchAt = &at
+			return true
+		}
+		if now.Before(*rollout.NextBatchAt) {
+			return false
+		}
+	}
+
+	rollout.CurrentBatch = next
+	rollout.NextBatchAt = nil
+	log.Printf("Build rollout %s starting batch %d", rollout.ID, next)
+
+	for i := range rollout.Machines {
+		m := &rollout.Machines[i]
+		if m.Batch != next || m.Status != models.RolloutMachinePending {
+			continue
+		}
+
+		s.startRolloutMachine(rollout, m)
+
+		// Saved after each build so that a restart never builds a machine
+		// twice
+		s.saveBuildRollout(rollout)
+	}
+	return true
+}
+
+// startRolloutMachine builds one machine of a rollout
+func (s *Server) startRolloutMachine(rollout *models.BuildRollout, m *models.BuildRolloutMachine) {
+	now := time.Now()
+	m.StartedAt = &now
+
+	machine, err := s.db.GetMachine(m.MachineID)
+	if err != nil {
+		s.failRolloutMachine(rollout, m, fmt.Sprintf("failed to get machine: %v", err))
+		return
+	}
+	if machine == nil {
+		s.failRolloutMachine(rollout, m, "machine no longer exists")
+		return
+	}
+	if reason := s.rolloutBlocker(machine, rollout.PowerCycle); reason != "" {
+		s.failRolloutMachine(rollout, m, reason)
+		return
+	}
+
+	build, err := s.service.StartBuild(context.Background(), machine, service.BuildOptions{Actor: rollout.CreatedBy, Bulk: true})
+	if err != nil {
+		s.failRolloutMachine(rollout, m, fmt.Sprintf("failed to create build: %v", err))
+		return
+	}
+
+	m.Status = models.RolloutMachineBuilding
+	m.BuildID = build.ID
+}
+
+// checkRolloutBuild follows a machine's build. Once it succeeds, the
+// machine is power cycled if the rollout asks for it and then waits for
+// the rollout's status.
+func (s *Server) checkRolloutBuild(rollout *models.BuildRollout, m *models.BuildRolloutMachine) bool {
+	build, err := s.db.GetBuild(m.BuildID)
+	if err != nil {
+		log.Printf("Build rollout %s: failed to get build %s: %v", rollout.ID, m.BuildID, err)
+		return false
+	}
+	if build == nil {
+		s.failRolloutMachine(rollout, m, "build no longer exists")
+		return true
+	}
+
+	switch build.Status {
+	case models.BuildStatusAwaitingApproval, "pending", "unschedulable", "building":
+		return false
+	case "success":
+	default:
+		reason := fmt.Sprintf("build %s", build.Status)
+		if build.Error != "" {
+			reason += ": " + build.Error
+		}
+		s.failRolloutMachine(rollout, m, reason)
+		return true
+	}
+
+	if rollout.PowerCycle {
+		if err := s.powerCycleBuiltMachine(m.MachineID, rollout.CreatedBy); err != nil {
+			s.failRolloutMachine(rollout, m, fmt.Sprintf("power cycle failed: %v", err))
+			return true
+		}
+	}
+
+	now := time.Now()
+	m.Status = models.RolloutMachineWaiting
+	m.BuiltAt = &now
+	s.checkRolloutWait(rollout, m)
+	return true
+}
+
+// checkRolloutWait checks whether a built machine has reached the status
+// the rollout waits for. A provisioned machine counts as ready.
+func (s *Server) checkRolloutWait(rollout *models.BuildRollout, m *models.BuildRolloutMachine) bool {
+	machine, err := s.db.GetMachine(m.MachineID)
+	if err != nil {
+		log.Printf("Build rollout %s: failed to get machine %s: %v", rollout.ID, m.MachineID, err)
+		return false
+	}
+	if machine == nil {
+		s.failRolloutMachine(rollout, m, "machine no longer exists")
+		return true
+	}
+
+	switch {
+	case machine.Status == rollout.WaitForStatus,
+		rollout.WaitForStatus == models.StatusReady && machine.Status == models.StatusProvisioned:
+		now := time.Now()
+		m.Status = models.RolloutMachineSucceeded
+		m.CompletedAt = &now
+		return true
+	case machine.Status == models.StatusFailed:
+		s.failRolloutMachine(rollout, m, "machine failed")
+		return true
+	}
+
+	timeout := time.Duration(rollout.WaitTimeout) * time.Second
+	if m.BuiltAt != nil && time.Since(*m.BuiltAt) > timeout {
+		s.failRolloutMachine(rollout, m, fmt.Sprintf("machine is still %s after %s waiting for %s",
+			machine.Status, timeout, rollout.WaitForStatus))
+		return true
+	}
+	return false
+}
+
+// powerCycleBuiltMachine power cycles a freshly built machine so that it
+// boots its new image, recording the operation like any other
+func (s *Server) powerCycleBuiltMachine(machineID, initiatedBy string) error {
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		return err
+	}
+	if machine == nil || machine.BMCInfo == nil {
+		return fmt.Errorf("machine has no BMC")
+	}
+
+	powerOp := &models.PowerOperation{
+		MachineID:   machine.ID,
+		Operation:   string(ipmi.PowerCycle),
+		Status:      "pending",
+		InitiatedBy: initiatedBy,
+	}
+	if powerOp.InitiatedBy == "" {
+		powerOp.InitiatedBy = "system"
+	}
+	if err := s.db.CreatePowerOperation(powerOp); err != nil {
+		return err
+	}
+
+	result, err := s.powerController().PowerCycle(machine.BMCInfo)
+
+	now := time.Now()
+	powerOp.CompletedAt = &now
+	if err != nil {
+		powerOp.Status = "failed"
+		powerOp.Error = err.Error()
+	} else {
+		powerOp.Status = "success"
+		powerOp.Result = result
+	}
+	s.finishPowerOperation(powerOp)
+	s.publishPowerOperation(powerOp)
+
+	return err
+}
+
+// failRolloutMachine records a machine's failure, which counts toward the
+// rollout's failure threshold
+func (s *Server) failRolloutMachine(rollout *models.BuildRollout, m *models.BuildRolloutMachine, reason string) {
+	now := time.Now()
+	m.Status = models.RolloutMachineFailed
+	m.Error = reason
+	m.CompletedAt = &now
+	rollout.Failures++
+
+	log.Printf("Build rollout %s: machine %s failed: %s", rollout.ID, m.MachineID, reason)
+}
+
+// completeBuildRollout finishes a rollout whose every batch is done
+func (s *Server) completeBuildRollout(rollout *models.BuildRollout) {
+	now := time.Now()
+	rollout.Status = models.BuildRolloutCompleted
+	rollout.NextBatchAt = nil
+	rollout.CompletedAt = &now
+
+	log.Printf("Build rollout %s completed", rollout.ID)
+	s.publishRolloutEvent(rollout, events.RolloutCompleted, events.RolloutData{})
+}
+
+func (s *Server) saveBuildRollout(rollout *models.BuildRollout) {
+	if err := s.db.UpdateBuildRollout(rollout); err != nil {
+		log.Printf("Failed to update build rollout %s: %v", rollout.ID, err)
+	}
+}
+
+// rolloutBatchDone reports whether every machine in a batch is done. Batch
+// 0, before the first, is always done.
+func rolloutBatchDone(rollout *models.BuildRollout, batch int) bool {
+	for _, m := range rollout.Machines {
+		if m.Batch == batch && !m.IsDone() {
+			return false
+		}
+	}
+	return true
+}
+
+// publishRolloutEvent publishes a rollout event, filling in the rollout's
+// state and the number of machines in each state around the event-specific
+// fields of data. Rollout events belong to no single machine.
+func (s *Server) publishRolloutEvent(rollout *models.BuildRollout, eventType string, data events.RolloutData) {
+	counts := map[string]int{}
+	for _, m := range rollout.Machines {
+		counts[m.Status]++
+	}
+
+	data.RolloutID = rollout.ID
+	data.GroupID = rollout.GroupID
+	data.Status = rollout.Status
+	data.CurrentBatch = rollout.CurrentBatch
+	data.Failures = rollout.Failures
+	data.Machines = counts
+
+	s.publish(context.Background(), events.Event{Type: eventType, Data: data})
+}
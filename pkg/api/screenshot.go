@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/redfish"
+	"github.com/gorilla/mux"
+)
+
+// defaultMaxBMCScreenshots is how many BMC screenshots each machine keeps
+// unless configured otherwise
+const defaultMaxBMCScreenshots = 10
+
+// handleBMCScreenshot captures a machine's console through its Redfish BMC
+// and returns the image. A copy is kept as an attachment, if attachments
+// are configured. BMCs that can't capture the screen get 501, which is
+// remembered in the machine's bmc_info so they aren't asked again.
+func (s *Server) handleBMCScreenshot(w http.ResponseWriter, r *http.Request) {
+	machineID := mux.Vars(r)["id"]
+
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if machine.BMCInfo == nil || !machine.BMCInfo.Enabled {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, "BMC is not configured for this machine")
+		return
+	}
+	if bmcSource(machine.BMCInfo) != "redfish" {
+		respondError(w, http.StatusNotImplemented, CodeBMCUnsupported, "screenshots need a Redfish BMC")
+		return
+	}
+	if supported := machine.BMCInfo.ScreenshotSupported; supported != nil && !*supported {
+		respondError(w, http.StatusNotImplemented, CodeBMCUnsupported, "screen capture is not supported by this BMC")
+		return
+	}
+
+	client, err := redfish.NewClient(machine.BMCInfo)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeBMCNotConfigured, err.Error())
+		return
+	}
+
+	s.bmcSlots <- struct{}{}
+	screenshot, err := client.Screenshot()
+	<-s.bmcSlots
+
+	if errors.Is(err, redfish.ErrScreenshotUnsupported) {
+		s.setScreenshotSupported(machine, false)
+		respondError(w, http.StatusNotImplemented, CodeBMCUnsupported, "screen capture is not supported by this BMC")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusBadGateway, CodeBMCError, "failed to capture screenshot: "+err.Error())
+		return
+	}
+	if machine.BMCInfo.ScreenshotSupported == nil {
+		s.setScreenshotSupported(machine, true)
+	}
+
+	// The image is served even if it can't be kept
+	if s.config.AttachmentsDir != "" {
+		uploadedBy := ""
+		if claims, ok := auth.GetClaims(r); ok {
+			uploadedBy = claims.Username
+		}
+		attachment, err := s.storeScreenshot(machine.ID, screenshot, uploadedBy)
+		if err != nil {
+			log.Printf("[%s] Failed to keep screenshot of machine %s: %v", requestID(r), machine.ID, err)
+		} else {
+			w.Header().Set("X-Attachment-ID", attachment.ID)
+		}
+	}
+
+	log.Printf("Captured screenshot of machine %s (%s, %d bytes)", machine.ID, screenshot.ContentType, len(screenshot.Data))
+
+	w.Header().Set("Content-Type", screenshot.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(screenshot.Data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(screenshot.Data)
+}
+
+// storeScreenshot keeps a screenshot as an attachment of its machine,
+// named for when it was taken, and removes the machine's oldest
+// screenshots beyond Config.MaxBMCScreenshots
+func (s *Server) storeScreenshot(machineID string, screenshot *redfish.Screenshot, uploadedBy string) (*models.MachineAttachment, error) {
+	tmpPath, size, hash, err := receiveFile(s.config.AttachmentsDir, bytes.NewReader(screenshot.Data), s.config.MaxAttachmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	ext := ".png"
+	if screenshot.ContentType == "image/jpeg" {
+		ext = ".jpg"
+	}
+
+	attachment := &models.MachineAttachment{
+		MachineID:   machineID,
+		Filename:    "screenshot-" + time.Now().UTC().Format("20060102-150405") + ext,
+		ContentType: screenshot.ContentType,
+		Size:        size,
+		SHA256:      hash,
+		UploadedBy:  uploadedBy,
+		Source:      models.AttachmentSourceBMCScreenshot,
+	}
+	if err := s.storeAttachment(attachment, tmpPath); err != nil {
+		return nil, err
+	}
+
+	pruned, err := s.db.PruneMachineAttachments(machineID, models.AttachmentSourceBMCScreenshot, s.config.MaxBMCScreenshots)
+	if err != nil {
+		log.Printf("Failed to prune screenshots of machine %s: %v", machineID, err)
+	}
+	if pruned > 0 {
+		s.removeUnusedAttachments()
+	}
+
+	return attachment, nil
+}
+
+// setScreenshotSupported records in a machine's bmc_info whether its BMC
+// can capture the screen. The machine is read again so nothing changed
+// while the BMC was asked is lost, and left alone if its BMC changed.
+func (s *Server) setScreenshotSupported(machine *models.Machine, supported bool) {
+	current, err := s.db.GetMachine(machine.ID)
+	if err != nil || current == nil || current.BMCInfo == nil {
+		return
+	}
+	if current.BMCInfo.IPAddress != machine.BMCInfo.IPAddress || !strings.EqualFold(current.BMCInfo.Type, machine.BMCInfo.Type) {
+		return
+	}
+
+	current.BMCInfo.ScreenshotSupported = &supported
+	if err := s.db.UpdateMachine(current); err != nil {
+		log.Printf("Failed to record screenshot support of machine %s: %v", machine.ID, err)
+	}
+}
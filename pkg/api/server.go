@@ -2,14 +2,28 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/builder"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/dcim"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipxe"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/lint"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/notify"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/webhook"
 	"github.com/gorilla/mux"
 )
@@ -21,93 +35,518 @@ type Server struct {
 	config         Config
 	jwtManager     *auth.JWTManager
 	webhookService *webhook.Service
+	notifyService  *notify.Service
+	events         *events.Publisher
+	bmcSlots       chan struct{}
+	metrics        *serverMetrics
+	ipxe           *ipxe.Client
+	builder        *builder.Client
+
+	// enrollQueue bounds the enrollments processed at once
+	enrollQueue *enrollQueue
+
+	// ipmiRunner runs ipmitool for BMC operations over IPMI; nil executes
+	// it
+	ipmiRunner command.Runner
+
+	// service carries out the machine operations that the dashboard and
+	// other tools share with the API
+	service *service.Service
+
+	// rolloutMu serializes changes to build rollouts between the
+	// orchestrator and the API within this server, and the build-rollouts
+	// lock across servers; rolloutWake starts an orchestrator pass early
+	rolloutMu   sync.Mutex
+	rolloutWake chan struct{}
+
+	// instanceID identifies this server as the holder of database locks;
+	// ledJobs holds the names of the periodic jobs it runs
+	instanceID string
+	ledJobs    sync.Map
+
+	// bmcRotations holds the IDs of machines whose BMC password is being
+	// rotated
+	bmcRotations sync.Map
+
+	// attachmentsMu keeps unused attachment files from being removed while
+	// an upload of the same file is being recorded
+	attachmentsMu sync.Mutex
+
+	// bootAssetsMu does the same for boot asset files
+	bootAssetsMu sync.Mutex
+
+	// dcimSyncMu keeps a manual DCIM sync and a scheduled one from running
+	// at once
+	dcimSyncMu sync.Mutex
+
+	// systemImagesMu serializes promotions, which swap the current link
+	// of a system image
+	systemImagesMu sync.Mutex
+
+	// statsCache holds recent stats summaries by their query
+	statsMu    sync.Mutex
+	statsCache map[string]cachedStats
+
+	// revokedShares caches the IDs of revoked shares that haven't expired,
+	// loaded at revokedSharesAt, so share links are checked without a
+	// query each
+	sharesMu        sync.Mutex
+	revokedShares   map[string]bool
+	revokedSharesAt time.Time
 }
 
 // Config holds server configuration
 type Config struct {
-	ListenAddr    string
-	BuilderURL    string
-	JWTSecret     string
-	JWTExpiry     time.Duration
-	EnableAuth    bool
+	ListenAddr string
+	BuilderURL string
+	JWTSecret  string
+	JWTExpiry  time.Duration
+	EnableAuth bool
+
+	// BMCPollConcurrency limits concurrent BMC connections for health checks
+	BMCPollConcurrency int
+
+	// EnrollConcurrency limits the enrollments processed at once, and
+	// EnrollQueueDepth how many more wait for a turn, each for at most
+	// EnrollQueueTimeout. Enrollments beyond them are answered with 503
+	// and a Retry-After.
+	EnrollConcurrency  int
+	EnrollQueueDepth   int
+	EnrollQueueTimeout time.Duration
+
+	// ImagesDir holds built artifacts, which backups list in their manifest
+	// and system image promotions link the current version in. Their disk
+	// usage is recorded as builds finish.
+	ImagesDir string
+
+	// StorageAlertPercent is how full, in percent, the filesystem of
+	// ImagesDir gets before storage.usage_high is published, and the
+	// dashboard warns. 0 turns the alert off.
+	StorageAlertPercent int
+
+	// NixOSDir holds the NixOS configurations of system images, such as
+	// the registration image, beside the files they refer to
+	NixOSDir string
+
+	// BackupDir receives stored and scheduled backups; BackupKeep is how
+	// many of them rotation keeps
+	BackupDir  string
+	BackupKeep int
+
+	// MaxBodyBytes limits request bodies. Login and enrollment, which need
+	// no credentials, get SmallBodyBytes; NixOS configurations, templates,
+	// bulk operations, and lease imports get LargeBodyBytes.
+	MaxBodyBytes   int64
+	SmallBodyBytes int64
+	LargeBodyBytes int64
+
+	// IdempotencyTTL is how long responses to requests with an
+	// Idempotency-Key are kept for replay
+	IdempotencyTTL time.Duration
+
+	// EventDedupeWindow is how long after a machine's event an identical
+	// one is dropped rather than recorded and delivered again. Zero turns
+	// deduplication off.
+	EventDedupeWindow time.Duration
+
+	// WebhookAllowHTTP permits webhook URLs that use plain http rather
+	// than https
+	WebhookAllowHTTP bool
+
+	// WebhookDisableAfterFailures is the failure streak webhooks are
+	// deactivated at, once it has lasted WebhookDisableAfter, unless they
+	// set their own. Zero failures never deactivates them.
+	WebhookDisableAfterFailures int
+	WebhookDisableAfter         time.Duration
+
+	// PublicURL is the server's URL as clients reach it, the source of
+	// CloudEvents webhook deliveries and the base of unsubscribe links
+	PublicURL string
+
+	// SubscriptionChannel is the name or ID of the email notification
+	// channel users' own subscriptions are emailed through; empty uses the
+	// oldest active email channel. MaxSubscriptions is how many
+	// subscriptions each user may have.
+	SubscriptionChannel string
+	MaxSubscriptions    int
+
+	// RequireImageTest holds machines in testing after a build until the
+	// build's boot test passes, rather than marking them ready
+	RequireImageTest bool
+
+	// RequireBuildApproval holds builds for an admin's approval unless an
+	// admin queued them. Groups can require approval for their members
+	// alone.
+	RequireBuildApproval bool
+
+	// MaxBuildLogBytes caps build logs moved out of the builds table on
+	// first access
+	MaxBuildLogBytes int
+
+	// RateLimits limits how fast each client can make requests
+	RateLimits RateLimitConfig
+
+	// IPXEURL is the iPXE server's base URL, which boot script previews
+	// are fetched from
+	IPXEURL string
+
+	// WOLMode is how Wake-on-LAN packets for machines without a BMC are
+	// sent: WOLModeRelay through the iPXE server, WOLModeBroadcast from
+	// this server to WOLBroadcastAddr, or not at all if empty.
+	// WOLRelayToken authenticates this server to the relay.
+	WOLMode          string
+	WOLBroadcastAddr string
+	WOLRelayToken    string
+
+	// TrashedEnrollment is what happens when a machine in the trash
+	// enrolls: TrashedEnrollmentBlock or TrashedEnrollmentRestore. Defaults
+	// to TrashedEnrollmentBlock.
+	TrashedEnrollment string
+
+	// AttachmentsDir stores files attached to machines, named by their
+	// SHA-256. Attachments can't be uploaded if it is empty.
+	// MaxAttachmentBytes limits the size of each file.
+	AttachmentsDir     string
+	MaxAttachmentBytes int64
+
+	// MaxBMCScreenshots is how many screenshots of its console captured
+	// through its BMC each machine keeps as attachments, oldest removed
+	// first. Defaults to 10.
+	MaxBMCScreenshots int
+
+	// BootAssetsDir stores files uploaded for boot overrides, named by
+	// their SHA-256, for the iPXE server to serve. Assets can't be uploaded
+	// if it is empty. MaxBootAssetBytes limits the size of each file.
+	BootAssetsDir     string
+	MaxBootAssetBytes int64
+
+	// ClaimCodeTTL is how long the claim code an unclaimed machine gets
+	// when it enrolls stays valid. Claim codes are only issued when auth
+	// is enabled and ClaimCodeTTL is positive.
+	ClaimCodeTTL time.Duration
+
+	// AuditFields are the top-level request body fields kept in the audit
+	// log. Nothing else from request bodies is kept, and fields named like
+	// passwords, secrets, tokens, or keys never are.
+	AuditFields []string
+
+	// DCIM is the DCIM machines are synced from, if any
+	DCIM dcim.Source
+
+	// TrustedProxies are the proxies whose X-Forwarded-For headers are
+	// believed when working out where a request came from
+	TrustedProxies []*net.IPNet
+
+	// MetricsIncludeVirtual exports virtual machines, and their builds,
+	// in the Prometheus metrics, which leave them out otherwise
+	MetricsIncludeVirtual bool
+
+	// BulkRequireConfirmation refuses bulk updates without the
+	// confirmation token of a dry run of the same update
+	BulkRequireConfirmation bool
+
+	// LintRules are the rules of the lint rules file, which configurations
+	// are linted with besides the built-in checks. Without them, only the
+	// built-in checks run and rules can't be changed.
+	LintRules *lint.Store
+
+	// Quotas are how many builds and power operations users of each role
+	// may start per models.QuotaWindow. Users may have limits of their
+	// own instead, and roles not listed are unlimited.
+	Quotas map[models.UserRole]*models.QuotaLimits
 }
 
 // New creates a new API server
 func New(db *database.DB, config Config) *Server {
+	if config.BMCPollConcurrency <= 0 {
+		config.BMCPollConcurrency = defaultBMCPollConcurrency
+	}
+	if config.EnrollConcurrency <= 0 {
+		config.EnrollConcurrency = defaultEnrollConcurrency
+	}
+	if config.EnrollQueueDepth <= 0 {
+		config.EnrollQueueDepth = defaultEnrollQueueDepth
+	}
+	if config.EnrollQueueTimeout <= 0 {
+		config.EnrollQueueTimeout = defaultEnrollQueueTimeout
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if config.SmallBodyBytes <= 0 {
+		config.SmallBodyBytes = defaultSmallBodyBytes
+	}
+	if config.LargeBodyBytes <= 0 {
+		config.LargeBodyBytes = defaultLargeBodyBytes
+	}
+	if config.MaxAttachmentBytes <= 0 {
+		config.MaxAttachmentBytes = defaultMaxAttachmentBytes
+	}
+	if config.MaxBMCScreenshots <= 0 {
+		config.MaxBMCScreenshots = defaultMaxBMCScreenshots
+	}
+	if config.MaxBootAssetBytes <= 0 {
+		config.MaxBootAssetBytes = defaultMaxBootAssetBytes
+	}
+	if config.MaxSubscriptions <= 0 {
+		config.MaxSubscriptions = models.DefaultMaxSubscriptions
+	}
+	if config.IdempotencyTTL <= 0 {
+		config.IdempotencyTTL = defaultIdempotencyTTL
+	}
+	config.RateLimits = config.RateLimits.withDefaults()
+	if config.TrashedEnrollment == "" {
+		config.TrashedEnrollment = TrashedEnrollmentBlock
+	}
+	if config.LintRules == nil {
+		config.LintRules, _ = lint.Open("")
+	}
+
 	s := &Server{
 		db:             db,
 		Router:         mux.NewRouter(),
 		config:         config,
 		jwtManager:     auth.NewJWTManager(config.JWTSecret, config.JWTExpiry),
 		webhookService: webhook.NewService(db),
+		notifyService:  notify.NewService(db),
+		events:         events.NewPublisher(db),
+		bmcSlots:       make(chan struct{}, config.BMCPollConcurrency),
+		metrics:        newServerMetrics(),
+		enrollQueue:    newEnrollQueue(config.EnrollConcurrency, config.EnrollQueueDepth, config.EnrollQueueTimeout),
+		rolloutWake:    make(chan struct{}, 1),
+		instanceID:     newInstanceID(),
 	}
 
+	if config.IPXEURL != "" {
+		s.ipxe = ipxe.NewClient(config.IPXEURL, config.WOLRelayToken)
+	}
+	if config.BuilderURL != "" {
+		s.builder = builder.NewClient(config.BuilderURL)
+	}
+
+	// Every published event is recorded and goes out to webhooks and
+	// notification channels
+	s.events.SetDedupeWindow(config.EventDedupeWindow)
+	s.events.Subscribe(s.webhookService.HandleEvent)
+	s.events.Subscribe(s.notifyService.HandleEvent)
+	s.webhookService.OnDelivery(s.metrics.observeWebhookDelivery)
+	s.webhookService.SetSource(config.PublicURL)
+	s.notifyService.SetSubscriptions(notify.SubscriptionConfig{
+		Channel:        config.SubscriptionChannel,
+		UnsubscribeURL: s.unsubscribeURL,
+	})
+	s.webhookService.SetPublisher(s.events)
+	s.webhookService.SetAutoDisable(config.WebhookDisableAfterFailures, config.WebhookDisableAfter)
+
+	s.service = service.New(db, s.events, s.builder, service.Config{
+		RequireImageTest:     config.RequireImageTest,
+		RestoreTrashed:       config.TrashedEnrollment == TrashedEnrollmentRestore,
+		RequireBuildApproval: config.RequireBuildApproval,
+		LintRules:            config.LintRules,
+		Quotas:               config.Quotas,
+		ImagesDir:            config.ImagesDir,
+		StorageAlertPercent:  config.StorageAlertPercent,
+	})
+
 	s.setupRoutes()
 	return s
 }
 
+// Service returns the service the server carries out machine operations
+// with, whose events reach the server's webhooks and notification channels
+func (s *Server) Service() *service.Service {
+	return s.service
+}
+
 // setupRoutes configures all API routes
 func (s *Server) setupRoutes() {
 	// API routes
 	api := s.Router.PathPrefix("/api/v1").Subrouter()
 
+	// Mutating requests are audited. This runs after routing, unlike the
+	// global middleware, so the route and its variables are known.
+	api.Use(s.auditMiddleware)
+
 	// Public routes (no auth required)
 	api.HandleFunc("/login", s.handleLogin).Methods("POST")
-	api.HandleFunc("/enroll", s.handleEnroll).Methods("POST")
+	// Enrollment takes no Idempotency-Key: its response holds the claim
+	// code, which a replay would hand to anyone repeating the key and the
+	// machine's details. Enrolling again is safe anyway; it returns the
+	// same machine with a new code.
+	api.HandleFunc("/enroll", s.admitEnrollment(s.handleEnroll)).Methods("POST")
 	api.HandleFunc("/health", s.handleHealth).Methods("GET")
 
+	// Unsubscribe links in subscription emails (authorized by their token)
+	api.HandleFunc("/subscriptions/{id}/unsubscribe", s.handleUnsubscribe).Methods("GET", "POST")
+
+	// Certificates boot artifacts are signed with (public)
+	api.HandleFunc("/boot-signing/keys", s.handleListBootSigningKeys).Methods("GET")
+	api.HandleFunc("/boot-signing/certificates.pem", s.handleBootSigningCertificates).Methods("GET")
+
 	// Prometheus metrics endpoint (public)
 	api.HandleFunc("/metrics", s.handlePrometheusMetrics).Methods("GET")
 
+	// Share links (authorized by the token in the path)
+	api.HandleFunc("/shared/{token}", s.sharedAccess(models.ShareScopeMachine, s.handleSharedMachine)).Methods("GET")
+	api.HandleFunc("/shared/{token}/hardware", s.sharedAccess(models.ShareScopeHardware, s.handleSharedHardware)).Methods("GET")
+	api.HandleFunc("/shared/{token}/events", s.sharedAccess(models.ShareScopeEvents, s.handleSharedEvents)).Methods("GET")
+	api.HandleFunc("/shared/{token}/builds", s.sharedAccess(models.ShareScopeBuildLogs, s.handleSharedBuilds)).Methods("GET")
+	api.HandleFunc("/shared/{token}/builds/{build_id}/logs", s.sharedAccess(models.ShareScopeBuildLogs, s.handleSharedBuildLog)).Methods("GET")
+
+	// Provisioning hooks - the machine's agent fetches and reports (authorized by the machine's hooks token)
+	api.HandleFunc("/machines/{id}/hooks/next", s.handleNextHook).Methods("GET")
+	api.HandleFunc("/machines/{id}/hooks/runs/{run_id}/result", s.handleHookResult).Methods("POST")
+
+	// Wipe progress - the wipe image reports (authorized by the job's wipe token)
+	api.HandleFunc("/machines/{id}/wipe/{job_id}/status", s.handleWipeStatus).Methods("POST")
+
+	// Diagnostic results - the diagnostics image reports (authorized by the run's diagnostics token)
+	api.HandleFunc("/machines/{id}/diagnostics/{run_id}/results", s.handleDiagnosticResults).Methods("POST")
+
 	if s.config.EnableAuth {
 		// Auth middleware for protected routes
-		authMiddleware := auth.AuthMiddleware(s.jwtManager)
+		authMiddleware := s.authenticate
 
 		// Authentication routes
 		authAPI := api.PathPrefix("/auth").Subrouter()
 		authAPI.Use(authMiddleware)
 		authAPI.HandleFunc("/refresh", s.handleRefreshToken).Methods("POST")
 		authAPI.HandleFunc("/me", s.handleGetCurrentUser).Methods("GET")
+		authAPI.HandleFunc("/impersonate", s.handleEndImpersonation).Methods("DELETE")
+
+		authAdminRoutes := authAPI.PathPrefix("").Subrouter()
+		authAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		authAdminRoutes.HandleFunc("/impersonate/{user_id}", s.handleImpersonate).Methods("POST")
 
-		// User management routes (admin only)
+		// The requesting user's own subscriptions (any role)
+		meAPI := api.PathPrefix("/me").Subrouter()
+		meAPI.Use(authMiddleware)
+		meAPI.HandleFunc("/subscriptions", s.handleListSubscriptions).Methods("GET")
+		meAPI.HandleFunc("/subscriptions", s.handleCreateSubscription).Methods("POST")
+		meAPI.HandleFunc("/subscriptions/{id}", s.handleDeleteSubscription).Methods("DELETE")
+
+		// User management routes (admin only, and never while impersonating)
 		usersAPI := api.PathPrefix("/users").Subrouter()
 		usersAPI.Use(authMiddleware)
+		usersAPI.Use(s.denyImpersonated)
 		usersAPI.Use(auth.RequireRole(models.RoleAdmin))
 		usersAPI.HandleFunc("", s.handleListUsers).Methods("GET")
 		usersAPI.HandleFunc("", s.handleRegister).Methods("POST")
 		usersAPI.HandleFunc("/{id}", s.handleGetUser).Methods("GET")
 		usersAPI.HandleFunc("/{id}", s.handleUpdateUser).Methods("PUT")
 		usersAPI.HandleFunc("/{id}", s.handleDeleteUser).Methods("DELETE")
+		usersAPI.HandleFunc("/{id}/usage", s.handleGetUserUsage).Methods("GET")
+		usersAPI.HandleFunc("/{id}/quota", s.handleSetUserQuota).Methods("PUT")
+		usersAPI.HandleFunc("/{id}/quota/grants", s.handleCreateQuotaGrant).Methods("POST")
+		usersAPI.HandleFunc("/{id}/quota/grants/{grant_id}", s.handleDeleteQuotaGrant).Methods("DELETE")
 
 		// Machine routes (authenticated)
 		machinesAPI := api.PathPrefix("/machines").Subrouter()
 		machinesAPI.Use(authMiddleware)
+		machinesAPI.Use(s.claimedMachineAccess)
+
+		// Any user can claim a machine with the code its console shows
+		machinesAPI.HandleFunc("/claim", s.handleClaimMachine).Methods("POST")
 
 		// Viewers can read
 		machinesAPI.HandleFunc("", s.handleListMachines).Methods("GET")
+		machinesAPI.HandleFunc("/stale", s.handleListStaleMachines).Methods("GET")
+		machinesAPI.HandleFunc("/unowned", s.handleListUnownedMachines).Methods("GET")
+		machinesAPI.HandleFunc("/conflicts", s.handleListMachineConflicts).Methods("GET")
+		machinesAPI.HandleFunc("/trash", s.handleListTrash).Methods("GET")
 		machinesAPI.HandleFunc("/{id}", s.handleGetMachine).Methods("GET")
 		machinesAPI.HandleFunc("/{id}/builds", s.handleListBuilds).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/builds/diff", s.handleDiffBuilds).Methods("GET")
 		machinesAPI.HandleFunc("/{id}/groups", s.handleGetMachineGroups).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/compare/{other_id}", s.handleCompareMachines).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/wipe", s.handleListWipeJobs).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/wipe/active", s.handleGetActiveWipeJob).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/wipe/{job_id}", s.handleGetWipeJob).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/diagnostics", s.handleListDiagnostics).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/diagnostics/{run_id}", s.handleGetDiagnosticRun).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/schedule", s.handleGetMachineSchedule).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/schedule/runs", s.handleListMachineScheduleRuns).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/deployments", s.handleListDeployments).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/ipxe", s.handleGetBootScript).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/boot-history", s.handleListBootHistory).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/boot-override", s.handleGetBootOverride).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/notes", s.handleListMachineNotes).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/attachments", s.handleListMachineAttachments).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/attachments/{attachment_id}", s.handleDownloadMachineAttachment).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/fragments", s.handleGetMachineFragments).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/hooks", s.handleGetMachineHooks).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/provisioning", s.handleGetProvisioning).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/config/lint", s.handleGetMachineConfigLint).Methods("GET")
+		machinesAPI.HandleFunc("/{id}/export", s.handleExportMachine).Methods("GET")
+		// Assembling only previews, so viewers can too
+		machinesAPI.HandleFunc("/{id}/assemble", s.handleAssembleConfig).Methods("POST")
 
 		// Operators and admins can modify
 		operatorRoutes := machinesAPI.PathPrefix("").Subrouter()
 		operatorRoutes.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
 		operatorRoutes.HandleFunc("/{id}", s.handleUpdateMachine).Methods("PUT")
-		operatorRoutes.HandleFunc("/{id}/build", s.handleBuildMachine).Methods("POST")
+		// Deletes go to the trash; only admins can delete permanently
+		operatorRoutes.HandleFunc("/{id}", s.handleDeleteMachine).Methods("DELETE")
+		operatorRoutes.HandleFunc("/{id}/build", s.idempotent(s.handleBuildMachine)).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/decommission", s.handleDecommissionMachine).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/reenroll", s.handleApproveReenrollment).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/resolve-conflict", s.handleResolveMachineConflict).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/restore", s.handleRestoreMachine).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/wipe", s.handleCreateWipeJob).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/wipe/active/token", s.handleGetWipeToken).Methods("GET")
+		operatorRoutes.HandleFunc("/{id}/diagnostics", s.handleStartDiagnostics).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/diagnostics", s.handleCancelDiagnostics).Methods("DELETE")
+		operatorRoutes.HandleFunc("/{id}/diagnostics/{run_id}/token", s.handleGetDiagnosticsToken).Methods("GET")
+		operatorRoutes.HandleFunc("/{id}/schedule", s.handleSetMachineSchedule).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/schedule", s.handleDeleteMachineSchedule).Methods("DELETE")
+		operatorRoutes.HandleFunc("", s.handleCreateMachine).Methods("POST")
+		operatorRoutes.HandleFunc("", s.handleDeleteVirtualMachines).Methods("DELETE")
+		operatorRoutes.HandleFunc("/adopt", s.handleAdoptMachine).Methods("POST")
+		operatorRoutes.HandleFunc("/apply", s.handleApplyMachines).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/convert", s.handleConvertMachine).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/deploy", s.handleDeployMachine).Methods("POST")
+		// Only a note's author or an admin can change it
+		operatorRoutes.HandleFunc("/{id}/notes", s.handleCreateMachineNote).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/notes/{note_id}", s.handleUpdateMachineNote).Methods("PUT")
+		operatorRoutes.HandleFunc("/{id}/notes/{note_id}", s.handleDeleteMachineNote).Methods("DELETE")
+		operatorRoutes.HandleFunc("/{id}/attachments", s.handleUploadMachineAttachment).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/attachments/{attachment_id}", s.handleDeleteMachineAttachment).Methods("DELETE")
+		operatorRoutes.HandleFunc("/{id}/fragments", s.handleSetMachineFragments).Methods("PUT")
+		operatorRoutes.HandleFunc("/{id}/hooks", s.handleSetMachineHooks).Methods("PUT")
+		operatorRoutes.HandleFunc("/{id}/hooks/token", s.handleGetHooksToken).Methods("GET")
+		operatorRoutes.HandleFunc("/{id}/provisioning/runs/{run_id}/retry", s.handleRetryHookRun).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/metadata", s.handleUpdateMachineMetadata).Methods("PUT")
+		operatorRoutes.HandleFunc("/{id}/identity-exempt", s.handleSetIdentityExempt).Methods("PUT")
+		operatorRoutes.HandleFunc("/{id}/claim", s.handleUnclaimMachine).Methods("DELETE")
+		operatorRoutes.HandleFunc("/{id}/boot-override", s.handleSetBootOverride).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/boot-override", s.handleClearBootOverride).Methods("DELETE")
+		operatorRoutes.HandleFunc("/{id}/share", s.handleCreateMachineShare).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/shares", s.handleListMachineShares).Methods("GET")
+		operatorRoutes.HandleFunc("/{id}/shares/{share_id}", s.handleRevokeMachineShare).Methods("DELETE")
 
 		// Power control routes (operators and admins only)
-		operatorRoutes.HandleFunc("/{id}/power", s.handlePowerControl).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/power", s.idempotent(s.handlePowerControl)).Methods("POST")
 		operatorRoutes.HandleFunc("/{id}/power/status", s.handleGetPowerStatus).Methods("GET")
 		operatorRoutes.HandleFunc("/{id}/power/operations", s.handleGetPowerOperations).Methods("GET")
 		operatorRoutes.HandleFunc("/{id}/bmc/test", s.handleTestBMC).Methods("POST")
 		operatorRoutes.HandleFunc("/{id}/bmc/info", s.handleGetBMCInfo).Methods("GET")
 		operatorRoutes.HandleFunc("/{id}/bmc/sensors", s.handleGetSensors).Methods("GET")
+		operatorRoutes.HandleFunc("/{id}/bmc/health", s.handleGetBMCHealth).Methods("GET")
+		operatorRoutes.HandleFunc("/{id}/bmc/screenshot", s.handleBMCScreenshot).Methods("GET")
+		operatorRoutes.HandleFunc("/{id}/bmc/inventory", s.handleRefreshInventory).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/refresh-hardware", s.handleRefreshHardware).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/refresh-hardware", s.handleCancelHardwareRefresh).Methods("DELETE")
+		operatorRoutes.HandleFunc("/{id}/bmc/rotate", s.handleRotateBMCPassword).Methods("POST")
+		operatorRoutes.HandleFunc("/{id}/bmc/operations/{op_id}", s.handleGetBMCOperation).Methods("GET")
 
 		// Metrics routes - machines can submit (authenticated but no role check)
 		machinesAPI.HandleFunc("/{id}/metrics", s.handleSubmitMetrics).Methods("POST")
 		machinesAPI.HandleFunc("/{id}/metrics/latest", s.handleGetLatestMetrics).Methods("GET")
 		machinesAPI.HandleFunc("/{id}/metrics/history", s.handleGetMetricsHistory).Methods("GET")
 
+		// Boot requests - the iPXE server reports (authenticated but no role check)
+		machinesAPI.HandleFunc("/{id}/boot-history", s.handleRecordBootRequest).Methods("POST")
+
 		// All machines metrics (authenticated)
 		metricsAPI := api.PathPrefix("/metrics").Subrouter()
 		metricsAPI.Use(authMiddleware)
@@ -122,15 +561,80 @@ func (s *Server) setupRoutes() {
 		imageTestsAPI.HandleFunc("/{id}", s.handleGetImageTest).Methods("GET")
 		imageTestsAPI.HandleFunc("/{id}", s.handleUpdateImageTest).Methods("PUT")
 
-		// Only admins can delete
-		adminRoutes := machinesAPI.PathPrefix("").Subrouter()
-		adminRoutes.Use(auth.RequireRole(models.RoleAdmin))
-		adminRoutes.HandleFunc("/{id}", s.handleDeleteMachine).Methods("DELETE")
-
 		// Build routes (authenticated)
 		buildsAPI := api.PathPrefix("/builds").Subrouter()
 		buildsAPI.Use(authMiddleware)
+		buildsAPI.Use(s.claimedBuildAccess)
+		buildsAPI.HandleFunc("", s.handleListAllBuilds).Methods("GET")
 		buildsAPI.HandleFunc("/{id}", s.handleGetBuild).Methods("GET")
+		buildsAPI.HandleFunc("/{id}/tests", s.handleListBuildTests).Methods("GET")
+		buildsAPI.HandleFunc("/{id}/logs", s.handleGetBuildLog).Methods("GET")
+		buildsAPI.HandleFunc("/{id}/artifacts", s.handleListBuildArtifacts).Methods("GET")
+		buildsAPI.HandleFunc("/{id}/artifacts/{name}", s.handleDownloadBuildArtifact).Methods("GET")
+
+		buildOperatorRoutes := buildsAPI.PathPrefix("").Subrouter()
+		buildOperatorRoutes.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		buildOperatorRoutes.HandleFunc("/{id}/priority", s.handleSetBuildPriority).Methods("PUT")
+
+		buildAdminRoutes := buildsAPI.PathPrefix("").Subrouter()
+		buildAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		buildAdminRoutes.HandleFunc("/{id}/approve", s.handleApproveBuild).Methods("POST")
+		buildAdminRoutes.HandleFunc("/{id}/reject", s.handleRejectBuild).Methods("POST")
+
+		buildersAPI := api.PathPrefix("/builders").Subrouter()
+		buildersAPI.Use(authMiddleware)
+		buildersAPI.HandleFunc("", s.handleListBuilders).Methods("GET")
+
+		builderAdminRoutes := buildersAPI.PathPrefix("").Subrouter()
+		builderAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		builderAdminRoutes.HandleFunc("/{name}/cordon", s.handleCordonBuilder).Methods("POST")
+		builderAdminRoutes.HandleFunc("/{name}/uncordon", s.handleUncordonBuilder).Methods("POST")
+		builderAdminRoutes.HandleFunc("/{name}/gc", s.handleBuilderGC).Methods("POST")
+
+		// Fleet stats (viewers can read)
+		statsAPI := api.PathPrefix("/stats").Subrouter()
+		statsAPI.Use(authMiddleware)
+		statsAPI.HandleFunc("", s.handleGetStats).Methods("GET")
+
+		// Disk usage of built images (operator and admin)
+		storageAPI := api.PathPrefix("/storage").Subrouter()
+		storageAPI.Use(authMiddleware)
+		storageAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		storageAPI.HandleFunc("/usage", s.handleStorageUsage).Methods("GET")
+
+		// Builder registration and build work, with an operator's token
+		internalAPI := api.PathPrefix("/internal").Subrouter()
+		internalAPI.Use(authMiddleware)
+		internalAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		internalAPI.HandleFunc("/builders/register", s.handleRegisterBuilder).Methods("POST")
+		internalAPI.HandleFunc("/builds/next", s.handleClaimBuild).Methods("GET")
+		internalAPI.HandleFunc("/builds/{id}/progress", s.handleBuildProgress).Methods("POST")
+		internalAPI.HandleFunc("/builds/{id}/complete", s.handleCompleteBuild).Methods("POST")
+
+		// Deployment routes (authenticated)
+		deploymentsAPI := api.PathPrefix("/deployments").Subrouter()
+		deploymentsAPI.Use(authMiddleware)
+		deploymentsAPI.HandleFunc("/{id}", s.handleGetDeployment).Methods("GET")
+
+		rolloutsAPI := api.PathPrefix("/rollouts").Subrouter()
+		rolloutsAPI.Use(authMiddleware)
+		rolloutsAPI.HandleFunc("/{id}", s.handleGetRollout).Methods("GET")
+
+		// Build rollouts (viewers can read, operators and admins can control)
+		buildRolloutsAPI := api.PathPrefix("/build-rollouts").Subrouter()
+		buildRolloutsAPI.Use(authMiddleware)
+		buildRolloutsAPI.HandleFunc("/{id}", s.handleGetBuildRollout).Methods("GET")
+
+		buildRolloutOperatorRoutes := buildRolloutsAPI.PathPrefix("").Subrouter()
+		buildRolloutOperatorRoutes.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		buildRolloutOperatorRoutes.HandleFunc("/{id}/pause", s.handlePauseBuildRollout).Methods("POST")
+		buildRolloutOperatorRoutes.HandleFunc("/{id}/resume", s.handleResumeBuildRollout).Methods("POST")
+		buildRolloutOperatorRoutes.HandleFunc("/{id}/abort", s.handleAbortBuildRollout).Methods("POST")
+
+		// Build schedules (viewers can read; they are set on machines and groups)
+		buildSchedulesAPI := api.PathPrefix("/build-schedules").Subrouter()
+		buildSchedulesAPI.Use(authMiddleware)
+		buildSchedulesAPI.HandleFunc("", s.handleListBuildSchedules).Methods("GET")
 
 		// Group routes (authenticated)
 		groupsAPI := api.PathPrefix("/groups").Subrouter()
@@ -140,6 +644,12 @@ func (s *Server) setupRoutes() {
 		groupsAPI.HandleFunc("", s.handleListGroups).Methods("GET")
 		groupsAPI.HandleFunc("/{id}", s.handleGetGroup).Methods("GET")
 		groupsAPI.HandleFunc("/{id}/machines", s.handleGetGroupMachines).Methods("GET")
+		groupsAPI.HandleFunc("/{id}/rollouts", s.handleListBuildRollouts).Methods("GET")
+		groupsAPI.HandleFunc("/{id}/drift", s.handleGetGroupDrift).Methods("GET")
+		groupsAPI.HandleFunc("/{id}/fragments", s.handleGetGroupFragments).Methods("GET")
+		groupsAPI.HandleFunc("/{id}/hooks", s.handleGetGroupHooks).Methods("GET")
+		groupsAPI.HandleFunc("/{id}/schedule", s.handleGetGroupSchedule).Methods("GET")
+		groupsAPI.HandleFunc("/{id}/schedule/runs", s.handleListGroupScheduleRuns).Methods("GET")
 
 		// Operators and admins can modify
 		groupOperatorRoutes := groupsAPI.PathPrefix("").Subrouter()
@@ -148,6 +658,12 @@ func (s *Server) setupRoutes() {
 		groupOperatorRoutes.HandleFunc("/{id}", s.handleUpdateGroup).Methods("PUT")
 		groupOperatorRoutes.HandleFunc("/{id}/machines/{machine_id}", s.handleAddMachineToGroup).Methods("PUT")
 		groupOperatorRoutes.HandleFunc("/{id}/machines/{machine_id}", s.handleRemoveMachineFromGroup).Methods("DELETE")
+		groupOperatorRoutes.HandleFunc("/{id}/deploy", s.handleDeployGroup).Methods("POST")
+		groupOperatorRoutes.HandleFunc("/{id}/rollout", s.idempotent(s.handleCreateBuildRollout)).Methods("POST")
+		groupOperatorRoutes.HandleFunc("/{id}/fragments", s.handleSetGroupFragments).Methods("PUT")
+		groupOperatorRoutes.HandleFunc("/{id}/hooks", s.handleSetGroupHooks).Methods("PUT")
+		groupOperatorRoutes.HandleFunc("/{id}/schedule", s.handleSetGroupSchedule).Methods("POST")
+		groupOperatorRoutes.HandleFunc("/{id}/schedule", s.handleDeleteGroupSchedule).Methods("DELETE")
 
 		// Only admins can delete groups
 		groupAdminRoutes := groupsAPI.PathPrefix("").Subrouter()
@@ -158,18 +674,59 @@ func (s *Server) setupRoutes() {
 		bulkAPI := api.PathPrefix("/bulk").Subrouter()
 		bulkAPI.Use(authMiddleware)
 		bulkAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
-		bulkAPI.HandleFunc("", s.handleBulkOperation).Methods("POST")
+		bulkAPI.HandleFunc("", s.idempotent(s.handleBulkOperation)).Methods("POST")
 
 		// Webhook routes (operators and admins only)
 		webhooksAPI := api.PathPrefix("/webhooks").Subrouter()
 		webhooksAPI.Use(authMiddleware)
 		webhooksAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
 		webhooksAPI.HandleFunc("", s.handleListWebhooks).Methods("GET")
-		webhooksAPI.HandleFunc("", s.handleCreateWebhook).Methods("POST")
+		webhooksAPI.HandleFunc("", s.idempotent(s.handleCreateWebhook)).Methods("POST")
 		webhooksAPI.HandleFunc("/{id}", s.handleGetWebhook).Methods("GET")
 		webhooksAPI.HandleFunc("/{id}", s.handleUpdateWebhook).Methods("PUT")
 		webhooksAPI.HandleFunc("/{id}", s.handleDeleteWebhook).Methods("DELETE")
 		webhooksAPI.HandleFunc("/{id}/deliveries", s.handleListWebhookDeliveries).Methods("GET")
+		webhooksAPI.HandleFunc("/{id}/test", s.handleTestWebhook).Methods("POST")
+		webhooksAPI.HandleFunc("/{id}/reactivate", s.handleReactivateWebhook).Methods("POST")
+
+		// Notification channel routes (operators and admins only)
+		notificationsAPI := api.PathPrefix("/notifications").Subrouter()
+		notificationsAPI.Use(authMiddleware)
+		notificationsAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		notificationsAPI.HandleFunc("", s.handleListNotificationChannels).Methods("GET")
+		notificationsAPI.HandleFunc("", s.handleCreateNotificationChannel).Methods("POST")
+		notificationsAPI.HandleFunc("/{id}", s.handleGetNotificationChannel).Methods("GET")
+		notificationsAPI.HandleFunc("/{id}", s.handleUpdateNotificationChannel).Methods("PUT")
+		notificationsAPI.HandleFunc("/{id}", s.handleDeleteNotificationChannel).Methods("DELETE")
+		notificationsAPI.HandleFunc("/{id}/test", s.handleTestNotificationChannel).Methods("POST")
+		notificationsAPI.HandleFunc("/{id}/deliveries", s.handleListNotificationDeliveries).Methods("GET")
+
+		// DCIM sync (operators and admins only)
+		integrationsAPI := api.PathPrefix("/integrations").Subrouter()
+		integrationsAPI.Use(authMiddleware)
+		integrationsAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		integrationsAPI.HandleFunc("/netbox/sync", s.handleDCIMSync).Methods("POST")
+		integrationsAPI.HandleFunc("/netbox/sync-reports", s.handleListDCIMSyncReports).Methods("GET")
+		integrationsAPI.HandleFunc("/netbox/sync-reports/{id}", s.handleGetDCIMSyncReport).Methods("GET")
+
+		// DHCP lease import (operators and admins only)
+		dhcpAPI := api.PathPrefix("/dhcp").Subrouter()
+		dhcpAPI.Use(authMiddleware)
+		dhcpAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		dhcpAPI.HandleFunc("/leases", s.handleImportLeases).Methods("POST")
+
+		// Maintenance window routes (viewers can read, admins can modify)
+		maintenanceAPI := api.PathPrefix("/maintenance").Subrouter()
+		maintenanceAPI.Use(authMiddleware)
+		maintenanceAPI.HandleFunc("", s.handleListMaintenanceWindows).Methods("GET")
+		maintenanceAPI.HandleFunc("/active", s.handleGetActiveMaintenance).Methods("GET")
+		maintenanceAPI.HandleFunc("/{id}", s.handleGetMaintenanceWindow).Methods("GET")
+
+		maintenanceAdminRoutes := maintenanceAPI.PathPrefix("").Subrouter()
+		maintenanceAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		maintenanceAdminRoutes.HandleFunc("", s.handleCreateMaintenanceWindow).Methods("POST")
+		maintenanceAdminRoutes.HandleFunc("/{id}", s.handleUpdateMaintenanceWindow).Methods("PUT")
+		maintenanceAdminRoutes.HandleFunc("/{id}", s.handleDeleteMaintenanceWindow).Methods("DELETE")
 
 		// Template routes (operators and admins only)
 		templatesAPI := api.PathPrefix("/templates").Subrouter()
@@ -180,29 +737,215 @@ func (s *Server) setupRoutes() {
 		templatesAPI.HandleFunc("/{id}", s.handleGetTemplate).Methods("GET")
 		templatesAPI.HandleFunc("/{id}", s.handleUpdateTemplate).Methods("PUT")
 		templatesAPI.HandleFunc("/{id}", s.handleDeleteTemplate).Methods("DELETE")
+		templatesAPI.HandleFunc("/{id}/hooks", s.handleGetTemplateHooks).Methods("GET")
+		templatesAPI.HandleFunc("/{id}/hooks", s.handleSetTemplateHooks).Methods("PUT")
+
+		// Configuration fragment routes (operators and admins only)
+		fragmentsAPI := api.PathPrefix("/fragments").Subrouter()
+		fragmentsAPI.Use(authMiddleware)
+		fragmentsAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		fragmentsAPI.HandleFunc("", s.handleListFragments).Methods("GET")
+		fragmentsAPI.HandleFunc("", s.handleCreateFragment).Methods("POST")
+		fragmentsAPI.HandleFunc("/{id}", s.handleGetFragment).Methods("GET")
+		fragmentsAPI.HandleFunc("/{id}", s.handleUpdateFragment).Methods("PUT")
+		fragmentsAPI.HandleFunc("/{id}", s.handleDeleteFragment).Methods("DELETE")
+
+		// Boot profile routes (viewers can read, admins can modify)
+		bootProfilesAPI := api.PathPrefix("/boot-profiles").Subrouter()
+		bootProfilesAPI.Use(authMiddleware)
+		bootProfilesAPI.HandleFunc("", s.handleListBootProfiles).Methods("GET")
+		bootProfilesAPI.HandleFunc("/{id}", s.handleGetBootProfile).Methods("GET")
+
+		bootProfileAdminRoutes := bootProfilesAPI.PathPrefix("").Subrouter()
+		bootProfileAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		bootProfileAdminRoutes.HandleFunc("", s.handleCreateBootProfile).Methods("POST")
+		bootProfileAdminRoutes.HandleFunc("/{id}", s.handleUpdateBootProfile).Methods("PUT")
+		bootProfileAdminRoutes.HandleFunc("/{id}", s.handleDeleteBootProfile).Methods("DELETE")
+
+		// Enrollment rule routes (viewers can read and test, admins can
+		// modify)
+		enrollmentRulesAPI := api.PathPrefix("/enrollment-rules").Subrouter()
+		enrollmentRulesAPI.Use(authMiddleware)
+		enrollmentRulesAPI.HandleFunc("", s.handleListEnrollmentRules).Methods("GET")
+		enrollmentRulesAPI.HandleFunc("/test", s.handleTestEnrollmentRules).Methods("POST")
+		enrollmentRulesAPI.HandleFunc("/{id}", s.handleGetEnrollmentRule).Methods("GET")
+
+		enrollmentRuleAdminRoutes := enrollmentRulesAPI.PathPrefix("").Subrouter()
+		enrollmentRuleAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		enrollmentRuleAdminRoutes.HandleFunc("", s.handleCreateEnrollmentRule).Methods("POST")
+		enrollmentRuleAdminRoutes.HandleFunc("/{id}", s.handleUpdateEnrollmentRule).Methods("PUT")
+		enrollmentRuleAdminRoutes.HandleFunc("/{id}", s.handleDeleteEnrollmentRule).Methods("DELETE")
+
+		// Hardware profile routes (viewers can read, admins can modify)
+		hardwareProfilesAPI := api.PathPrefix("/hardware-profiles").Subrouter()
+		hardwareProfilesAPI.Use(authMiddleware)
+		hardwareProfilesAPI.HandleFunc("", s.handleListHardwareProfiles).Methods("GET")
+		hardwareProfilesAPI.HandleFunc("/{id}", s.handleGetHardwareProfile).Methods("GET")
+
+		hardwareProfileAdminRoutes := hardwareProfilesAPI.PathPrefix("").Subrouter()
+		hardwareProfileAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		hardwareProfileAdminRoutes.HandleFunc("", s.handleCreateHardwareProfile).Methods("POST")
+		hardwareProfileAdminRoutes.HandleFunc("/{id}", s.handleUpdateHardwareProfile).Methods("PUT")
+		hardwareProfileAdminRoutes.HandleFunc("/{id}", s.handleDeleteHardwareProfile).Methods("DELETE")
+
+		// Lint rule routes (viewers can read, admins can modify)
+		lintRulesAPI := api.PathPrefix("/lint-rules").Subrouter()
+		lintRulesAPI.Use(authMiddleware)
+		lintRulesAPI.HandleFunc("", s.handleListLintRules).Methods("GET")
+
+		lintRuleAdminRoutes := lintRulesAPI.PathPrefix("").Subrouter()
+		lintRuleAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		lintRuleAdminRoutes.HandleFunc("", s.handleCreateLintRule).Methods("POST")
+		lintRuleAdminRoutes.HandleFunc("/{id}", s.handleUpdateLintRule).Methods("PUT")
+		lintRuleAdminRoutes.HandleFunc("/{id}", s.handleDeleteLintRule).Methods("DELETE")
+
+		// Diagnostic profile routes (viewers can read, admins can modify)
+		diagnosticProfilesAPI := api.PathPrefix("/diagnostic-profiles").Subrouter()
+		diagnosticProfilesAPI.Use(authMiddleware)
+		diagnosticProfilesAPI.HandleFunc("", s.handleListDiagnosticProfiles).Methods("GET")
+		diagnosticProfilesAPI.HandleFunc("/{id}", s.handleGetDiagnosticProfile).Methods("GET")
+
+		diagnosticProfileAdminRoutes := diagnosticProfilesAPI.PathPrefix("").Subrouter()
+		diagnosticProfileAdminRoutes.Use(auth.RequireRole(models.RoleAdmin))
+		diagnosticProfileAdminRoutes.HandleFunc("", s.handleCreateDiagnosticProfile).Methods("POST")
+		diagnosticProfileAdminRoutes.HandleFunc("/{id}", s.handleUpdateDiagnosticProfile).Methods("PUT")
+		diagnosticProfileAdminRoutes.HandleFunc("/{id}", s.handleDeleteDiagnosticProfile).Methods("DELETE")
+
+		// Boot asset routes (operators and admins only)
+		bootAssetsAPI := api.PathPrefix("/boot-assets").Subrouter()
+		bootAssetsAPI.Use(authMiddleware)
+		bootAssetsAPI.Use(auth.RequireRole(models.RoleOperator, models.RoleAdmin))
+		bootAssetsAPI.HandleFunc("", s.handleListBootAssets).Methods("GET")
+		bootAssetsAPI.HandleFunc("", s.handleUploadBootAsset).Methods("POST")
+		bootAssetsAPI.HandleFunc("/{id}", s.handleGetBootAsset).Methods("GET")
+		bootAssetsAPI.HandleFunc("/{id}", s.handleDeleteBootAsset).Methods("DELETE")
 
 		// Apply template to machine (operators and admins only)
 		operatorRoutes.HandleFunc("/{id}/template/{template_id}", s.handleApplyTemplate).Methods("POST")
 
 		// Machine events (viewers can read)
 		machinesAPI.HandleFunc("/{id}/events", s.handleGetMachineEvents).Methods("GET")
+
+		// Event log across machines (viewers can read, admins can export)
+		eventsAPI := api.PathPrefix("/events").Subrouter()
+		eventsAPI.Use(authMiddleware)
+		eventsAPI.HandleFunc("", s.handleListEvents).Methods("GET")
+		eventsAPI.HandleFunc("/schema", s.handleGetEventSchema).Methods("GET")
+		eventsAPI.Handle("/export", auth.RequireRole(models.RoleAdmin)(http.HandlerFunc(s.handleExportEvents))).Methods("GET")
+
+		// Administration (admins only)
+		adminAPI := api.PathPrefix("/admin").Subrouter()
+		adminAPI.Use(authMiddleware)
+		adminAPI.Use(auth.RequireRole(models.RoleAdmin))
+		adminAPI.HandleFunc("/backup", s.handleBackup).Methods("POST")
+		adminAPI.HandleFunc("/db/check", s.handleCheckDatabase).Methods("POST")
+
+		// System images (admins only)
+		systemImagesAPI := api.PathPrefix("/system-images").Subrouter()
+		systemImagesAPI.Use(authMiddleware)
+		systemImagesAPI.Use(auth.RequireRole(models.RoleAdmin))
+		systemImagesAPI.HandleFunc("/{name}", s.handleListSystemImages).Methods("GET")
+		systemImagesAPI.HandleFunc("/{name}/config", s.handleGetSystemImageConfig).Methods("GET")
+		systemImagesAPI.HandleFunc("/{name}/config", s.handleUpdateSystemImageConfig).Methods("PUT")
+		systemImagesAPI.HandleFunc("/{name}/build", s.handleBuildSystemImage).Methods("POST")
+		systemImagesAPI.HandleFunc("/{name}/rollback", s.handleRollbackSystemImage).Methods("POST")
+		systemImagesAPI.HandleFunc("/{name}/versions/{version}/promote", s.handlePromoteSystemImage).Methods("POST")
+
+		// Boot manifest for iPXE servers that can't reach the API (admins only)
+		bootManifestAPI := api.PathPrefix("/boot-manifest").Subrouter()
+		bootManifestAPI.Use(authMiddleware)
+		bootManifestAPI.Use(auth.RequireRole(models.RoleAdmin))
+		bootManifestAPI.HandleFunc("", s.handleExportBootManifest).Methods("GET")
+
+		// Audit log (admins only)
+		auditAPI := api.PathPrefix("/audit").Subrouter()
+		auditAPI.Use(authMiddleware)
+		auditAPI.Use(auth.RequireRole(models.RoleAdmin))
+		auditAPI.HandleFunc("", s.handleListAudit).Methods("GET")
 	} else {
 		// No auth - all routes are public
 		api.HandleFunc("/machines", s.handleListMachines).Methods("GET")
+		api.HandleFunc("/machines", s.handleCreateMachine).Methods("POST")
+		api.HandleFunc("/machines", s.handleDeleteVirtualMachines).Methods("DELETE")
+		api.HandleFunc("/machines/stale", s.handleListStaleMachines).Methods("GET")
+		api.HandleFunc("/machines/unowned", s.handleListUnownedMachines).Methods("GET")
+		api.HandleFunc("/machines/conflicts", s.handleListMachineConflicts).Methods("GET")
+		api.HandleFunc("/machines/trash", s.handleListTrash).Methods("GET")
 		api.HandleFunc("/machines/{id}", s.handleGetMachine).Methods("GET")
 		api.HandleFunc("/machines/{id}", s.handleUpdateMachine).Methods("PUT")
 		api.HandleFunc("/machines/{id}", s.handleDeleteMachine).Methods("DELETE")
-		api.HandleFunc("/machines/{id}/build", s.handleBuildMachine).Methods("POST")
+		api.HandleFunc("/machines/{id}/build", s.idempotent(s.handleBuildMachine)).Methods("POST")
+		api.HandleFunc("/machines/{id}/decommission", s.handleDecommissionMachine).Methods("POST")
+		api.HandleFunc("/machines/{id}/reenroll", s.handleApproveReenrollment).Methods("POST")
+		api.HandleFunc("/machines/{id}/resolve-conflict", s.handleResolveMachineConflict).Methods("POST")
+		api.HandleFunc("/machines/{id}/restore", s.handleRestoreMachine).Methods("POST")
+		api.HandleFunc("/machines/adopt", s.handleAdoptMachine).Methods("POST")
+		api.HandleFunc("/machines/apply", s.handleApplyMachines).Methods("POST")
+		api.HandleFunc("/machines/{id}/convert", s.handleConvertMachine).Methods("POST")
+		api.HandleFunc("/machines/{id}/deploy", s.handleDeployMachine).Methods("POST")
+		api.HandleFunc("/machines/{id}/deployments", s.handleListDeployments).Methods("GET")
 		api.HandleFunc("/machines/{id}/builds", s.handleListBuilds).Methods("GET")
+		api.HandleFunc("/machines/{id}/builds/diff", s.handleDiffBuilds).Methods("GET")
 		api.HandleFunc("/machines/{id}/groups", s.handleGetMachineGroups).Methods("GET")
+		api.HandleFunc("/machines/{id}/compare/{other_id}", s.handleCompareMachines).Methods("GET")
+		api.HandleFunc("/machines/{id}/wipe", s.handleCreateWipeJob).Methods("POST")
+		api.HandleFunc("/machines/{id}/wipe", s.handleListWipeJobs).Methods("GET")
+		api.HandleFunc("/machines/{id}/wipe/active", s.handleGetActiveWipeJob).Methods("GET")
+		api.HandleFunc("/machines/{id}/wipe/active/token", s.handleGetWipeToken).Methods("GET")
+		api.HandleFunc("/machines/{id}/wipe/{job_id}", s.handleGetWipeJob).Methods("GET")
+		api.HandleFunc("/machines/{id}/diagnostics", s.handleStartDiagnostics).Methods("POST")
+		api.HandleFunc("/machines/{id}/diagnostics", s.handleListDiagnostics).Methods("GET")
+		api.HandleFunc("/machines/{id}/diagnostics", s.handleCancelDiagnostics).Methods("DELETE")
+		api.HandleFunc("/machines/{id}/diagnostics/{run_id}", s.handleGetDiagnosticRun).Methods("GET")
+		api.HandleFunc("/machines/{id}/diagnostics/{run_id}/token", s.handleGetDiagnosticsToken).Methods("GET")
+		api.HandleFunc("/machines/{id}/schedule", s.handleGetMachineSchedule).Methods("GET")
+		api.HandleFunc("/machines/{id}/schedule", s.handleSetMachineSchedule).Methods("POST")
+		api.HandleFunc("/machines/{id}/schedule", s.handleDeleteMachineSchedule).Methods("DELETE")
+		api.HandleFunc("/machines/{id}/schedule/runs", s.handleListMachineScheduleRuns).Methods("GET")
+		api.HandleFunc("/machines/{id}/ipxe", s.handleGetBootScript).Methods("GET")
+		api.HandleFunc("/machines/{id}/boot-history", s.handleListBootHistory).Methods("GET")
+		api.HandleFunc("/machines/{id}/boot-history", s.handleRecordBootRequest).Methods("POST")
+		api.HandleFunc("/machines/{id}/boot-override", s.handleGetBootOverride).Methods("GET")
+		api.HandleFunc("/machines/{id}/boot-override", s.handleSetBootOverride).Methods("POST")
+		api.HandleFunc("/machines/{id}/boot-override", s.handleClearBootOverride).Methods("DELETE")
+		api.HandleFunc("/machines/{id}/share", s.handleCreateMachineShare).Methods("POST")
+		api.HandleFunc("/machines/{id}/shares", s.handleListMachineShares).Methods("GET")
+		api.HandleFunc("/machines/{id}/shares/{share_id}", s.handleRevokeMachineShare).Methods("DELETE")
+		api.HandleFunc("/machines/{id}/notes", s.handleListMachineNotes).Methods("GET")
+		api.HandleFunc("/machines/{id}/notes", s.handleCreateMachineNote).Methods("POST")
+		api.HandleFunc("/machines/{id}/notes/{note_id}", s.handleUpdateMachineNote).Methods("PUT")
+		api.HandleFunc("/machines/{id}/notes/{note_id}", s.handleDeleteMachineNote).Methods("DELETE")
+		api.HandleFunc("/machines/{id}/attachments", s.handleListMachineAttachments).Methods("GET")
+		api.HandleFunc("/machines/{id}/attachments", s.handleUploadMachineAttachment).Methods("POST")
+		api.HandleFunc("/machines/{id}/attachments/{attachment_id}", s.handleDownloadMachineAttachment).Methods("GET")
+		api.HandleFunc("/machines/{id}/attachments/{attachment_id}", s.handleDeleteMachineAttachment).Methods("DELETE")
+		api.HandleFunc("/machines/{id}/fragments", s.handleGetMachineFragments).Methods("GET")
+		api.HandleFunc("/machines/{id}/fragments", s.handleSetMachineFragments).Methods("PUT")
+		api.HandleFunc("/machines/{id}/hooks", s.handleGetMachineHooks).Methods("GET")
+		api.HandleFunc("/machines/{id}/hooks", s.handleSetMachineHooks).Methods("PUT")
+		api.HandleFunc("/machines/{id}/hooks/token", s.handleGetHooksToken).Methods("GET")
+		api.HandleFunc("/machines/{id}/provisioning", s.handleGetProvisioning).Methods("GET")
+		api.HandleFunc("/machines/{id}/provisioning/runs/{run_id}/retry", s.handleRetryHookRun).Methods("POST")
+		api.HandleFunc("/machines/{id}/config/lint", s.handleGetMachineConfigLint).Methods("GET")
+		api.HandleFunc("/machines/{id}/export", s.handleExportMachine).Methods("GET")
+		api.HandleFunc("/machines/{id}/metadata", s.handleUpdateMachineMetadata).Methods("PUT")
+		api.HandleFunc("/machines/{id}/identity-exempt", s.handleSetIdentityExempt).Methods("PUT")
+		api.HandleFunc("/machines/{id}/assemble", s.handleAssembleConfig).Methods("POST")
 
 		// Power control routes (no auth)
-		api.HandleFunc("/machines/{id}/power", s.handlePowerControl).Methods("POST")
+		api.HandleFunc("/machines/{id}/power", s.idempotent(s.handlePowerControl)).Methods("POST")
 		api.HandleFunc("/machines/{id}/power/status", s.handleGetPowerStatus).Methods("GET")
 		api.HandleFunc("/machines/{id}/power/operations", s.handleGetPowerOperations).Methods("GET")
 		api.HandleFunc("/machines/{id}/bmc/test", s.handleTestBMC).Methods("POST")
 		api.HandleFunc("/machines/{id}/bmc/info", s.handleGetBMCInfo).Methods("GET")
 		api.HandleFunc("/machines/{id}/bmc/sensors", s.handleGetSensors).Methods("GET")
+		api.HandleFunc("/machines/{id}/bmc/health", s.handleGetBMCHealth).Methods("GET")
+		api.HandleFunc("/machines/{id}/bmc/screenshot", s.handleBMCScreenshot).Methods("GET")
+		api.HandleFunc("/machines/{id}/bmc/inventory", s.handleRefreshInventory).Methods("POST")
+		api.HandleFunc("/machines/{id}/refresh-hardware", s.handleRefreshHardware).Methods("POST")
+		api.HandleFunc("/machines/{id}/refresh-hardware", s.handleCancelHardwareRefresh).Methods("DELETE")
+		api.HandleFunc("/machines/{id}/bmc/rotate", s.handleRotateBMCPassword).Methods("POST")
+		api.HandleFunc("/machines/{id}/bmc/operations/{op_id}", s.handleGetBMCOperation).Methods("GET")
 
 		// Metrics routes (no auth)
 		api.HandleFunc("/machines/{id}/metrics", s.handleSubmitMetrics).Methods("POST")
@@ -216,7 +959,34 @@ func (s *Server) setupRoutes() {
 		api.HandleFunc("/image-tests/{id}", s.handleGetImageTest).Methods("GET")
 		api.HandleFunc("/image-tests/{id}", s.handleUpdateImageTest).Methods("PUT")
 
+		api.HandleFunc("/builds", s.handleListAllBuilds).Methods("GET")
 		api.HandleFunc("/builds/{id}", s.handleGetBuild).Methods("GET")
+		api.HandleFunc("/builds/{id}/tests", s.handleListBuildTests).Methods("GET")
+		api.HandleFunc("/builds/{id}/logs", s.handleGetBuildLog).Methods("GET")
+		api.HandleFunc("/builds/{id}/artifacts", s.handleListBuildArtifacts).Methods("GET")
+		api.HandleFunc("/builds/{id}/artifacts/{name}", s.handleDownloadBuildArtifact).Methods("GET")
+		api.HandleFunc("/builds/{id}/priority", s.handleSetBuildPriority).Methods("PUT")
+		api.HandleFunc("/builds/{id}/approve", s.handleApproveBuild).Methods("POST")
+		api.HandleFunc("/builds/{id}/reject", s.handleRejectBuild).Methods("POST")
+		api.HandleFunc("/builders", s.handleListBuilders).Methods("GET")
+		api.HandleFunc("/builders/{name}/cordon", s.handleCordonBuilder).Methods("POST")
+		api.HandleFunc("/builders/{name}/uncordon", s.handleUncordonBuilder).Methods("POST")
+		api.HandleFunc("/builders/{name}/gc", s.handleBuilderGC).Methods("POST")
+		api.HandleFunc("/internal/builders/register", s.handleRegisterBuilder).Methods("POST")
+		api.HandleFunc("/internal/builds/next", s.handleClaimBuild).Methods("GET")
+		api.HandleFunc("/internal/builds/{id}/progress", s.handleBuildProgress).Methods("POST")
+		api.HandleFunc("/internal/builds/{id}/complete", s.handleCompleteBuild).Methods("POST")
+		api.HandleFunc("/stats", s.handleGetStats).Methods("GET")
+		api.HandleFunc("/storage/usage", s.handleStorageUsage).Methods("GET")
+		api.HandleFunc("/integrations/netbox/sync", s.handleDCIMSync).Methods("POST")
+		api.HandleFunc("/integrations/netbox/sync-reports", s.handleListDCIMSyncReports).Methods("GET")
+		api.HandleFunc("/integrations/netbox/sync-reports/{id}", s.handleGetDCIMSyncReport).Methods("GET")
+		api.HandleFunc("/deployments/{id}", s.handleGetDeployment).Methods("GET")
+		api.HandleFunc("/rollouts/{id}", s.handleGetRollout).Methods("GET")
+		api.HandleFunc("/build-rollouts/{id}", s.handleGetBuildRollout).Methods("GET")
+		api.HandleFunc("/build-rollouts/{id}/pause", s.handlePauseBuildRollout).Methods("POST")
+		api.HandleFunc("/build-rollouts/{id}/resume", s.handleResumeBuildRollout).Methods("POST")
+		api.HandleFunc("/build-rollouts/{id}/abort", s.handleAbortBuildRollout).Methods("POST")
 
 		// Groups
 		api.HandleFunc("/groups", s.handleListGroups).Methods("GET")
@@ -227,17 +997,52 @@ func (s *Server) setupRoutes() {
 		api.HandleFunc("/groups/{id}/machines", s.handleGetGroupMachines).Methods("GET")
 		api.HandleFunc("/groups/{id}/machines/{machine_id}", s.handleAddMachineToGroup).Methods("PUT")
 		api.HandleFunc("/groups/{id}/machines/{machine_id}", s.handleRemoveMachineFromGroup).Methods("DELETE")
+		api.HandleFunc("/groups/{id}/deploy", s.handleDeployGroup).Methods("POST")
+		api.HandleFunc("/groups/{id}/rollout", s.idempotent(s.handleCreateBuildRollout)).Methods("POST")
+		api.HandleFunc("/groups/{id}/rollouts", s.handleListBuildRollouts).Methods("GET")
+		api.HandleFunc("/groups/{id}/drift", s.handleGetGroupDrift).Methods("GET")
+		api.HandleFunc("/groups/{id}/fragments", s.handleGetGroupFragments).Methods("GET")
+		api.HandleFunc("/groups/{id}/fragments", s.handleSetGroupFragments).Methods("PUT")
+		api.HandleFunc("/groups/{id}/hooks", s.handleGetGroupHooks).Methods("GET")
+		api.HandleFunc("/groups/{id}/hooks", s.handleSetGroupHooks).Methods("PUT")
+		api.HandleFunc("/groups/{id}/schedule", s.handleGetGroupSchedule).Methods("GET")
+		api.HandleFunc("/groups/{id}/schedule", s.handleSetGroupSchedule).Methods("POST")
+		api.HandleFunc("/groups/{id}/schedule", s.handleDeleteGroupSchedule).Methods("DELETE")
+		api.HandleFunc("/groups/{id}/schedule/runs", s.handleListGroupScheduleRuns).Methods("GET")
+		api.HandleFunc("/build-schedules", s.handleListBuildSchedules).Methods("GET")
 
 		// Bulk operations
-		api.HandleFunc("/bulk", s.handleBulkOperation).Methods("POST")
+		api.HandleFunc("/bulk", s.idempotent(s.handleBulkOperation)).Methods("POST")
 
 		// Webhooks (no auth)
 		api.HandleFunc("/webhooks", s.handleListWebhooks).Methods("GET")
-		api.HandleFunc("/webhooks", s.handleCreateWebhook).Methods("POST")
+		api.HandleFunc("/webhooks", s.idempotent(s.handleCreateWebhook)).Methods("POST")
 		api.HandleFunc("/webhooks/{id}", s.handleGetWebhook).Methods("GET")
 		api.HandleFunc("/webhooks/{id}", s.handleUpdateWebhook).Methods("PUT")
 		api.HandleFunc("/webhooks/{id}", s.handleDeleteWebhook).Methods("DELETE")
 		api.HandleFunc("/webhooks/{id}/deliveries", s.handleListWebhookDeliveries).Methods("GET")
+		api.HandleFunc("/webhooks/{id}/test", s.handleTestWebhook).Methods("POST")
+		api.HandleFunc("/webhooks/{id}/reactivate", s.handleReactivateWebhook).Methods("POST")
+
+		// Notification channels (no auth)
+		api.HandleFunc("/notifications", s.handleListNotificationChannels).Methods("GET")
+		api.HandleFunc("/notifications", s.handleCreateNotificationChannel).Methods("POST")
+		api.HandleFunc("/notifications/{id}", s.handleGetNotificationChannel).Methods("GET")
+		api.HandleFunc("/notifications/{id}", s.handleUpdateNotificationChannel).Methods("PUT")
+		api.HandleFunc("/notifications/{id}", s.handleDeleteNotificationChannel).Methods("DELETE")
+		api.HandleFunc("/notifications/{id}/test", s.handleTestNotificationChannel).Methods("POST")
+		api.HandleFunc("/notifications/{id}/deliveries", s.handleListNotificationDeliveries).Methods("GET")
+
+		// DHCP lease import (no auth)
+		api.HandleFunc("/dhcp/leases", s.handleImportLeases).Methods("POST")
+
+		// Maintenance windows (no auth)
+		api.HandleFunc("/maintenance", s.handleListMaintenanceWindows).Methods("GET")
+		api.HandleFunc("/maintenance", s.handleCreateMaintenanceWindow).Methods("POST")
+		api.HandleFunc("/maintenance/active", s.handleGetActiveMaintenance).Methods("GET")
+		api.HandleFunc("/maintenance/{id}", s.handleGetMaintenanceWindow).Methods("GET")
+		api.HandleFunc("/maintenance/{id}", s.handleUpdateMaintenanceWindow).Methods("PUT")
+		api.HandleFunc("/maintenance/{id}", s.handleDeleteMaintenanceWindow).Methods("DELETE")
 
 		// Templates (no auth)
 		api.HandleFunc("/templates", s.handleListTemplates).Methods("GET")
@@ -245,15 +1050,91 @@ func (s *Server) setupRoutes() {
 		api.HandleFunc("/templates/{id}", s.handleGetTemplate).Methods("GET")
 		api.HandleFunc("/templates/{id}", s.handleUpdateTemplate).Methods("PUT")
 		api.HandleFunc("/templates/{id}", s.handleDeleteTemplate).Methods("DELETE")
+		api.HandleFunc("/templates/{id}/hooks", s.handleGetTemplateHooks).Methods("GET")
+		api.HandleFunc("/templates/{id}/hooks", s.handleSetTemplateHooks).Methods("PUT")
 		api.HandleFunc("/machines/{id}/template/{template_id}", s.handleApplyTemplate).Methods("POST")
 
+		// Configuration fragments (no auth)
+		api.HandleFunc("/fragments", s.handleListFragments).Methods("GET")
+		api.HandleFunc("/fragments", s.handleCreateFragment).Methods("POST")
+		api.HandleFunc("/fragments/{id}", s.handleGetFragment).Methods("GET")
+		api.HandleFunc("/fragments/{id}", s.handleUpdateFragment).Methods("PUT")
+		api.HandleFunc("/fragments/{id}", s.handleDeleteFragment).Methods("DELETE")
+
+		// Boot assets (no auth)
+		api.HandleFunc("/boot-assets", s.handleListBootAssets).Methods("GET")
+		api.HandleFunc("/boot-assets", s.handleUploadBootAsset).Methods("POST")
+		api.HandleFunc("/boot-assets/{id}", s.handleGetBootAsset).Methods("GET")
+		api.HandleFunc("/boot-assets/{id}", s.handleDeleteBootAsset).Methods("DELETE")
+
+		// Diagnostic profiles (no auth)
+		api.HandleFunc("/diagnostic-profiles", s.handleListDiagnosticProfiles).Methods("GET")
+		api.HandleFunc("/diagnostic-profiles", s.handleCreateDiagnosticProfile).Methods("POST")
+		api.HandleFunc("/diagnostic-profiles/{id}", s.handleGetDiagnosticProfile).Methods("GET")
+		api.HandleFunc("/diagnostic-profiles/{id}", s.handleUpdateDiagnosticProfile).Methods("PUT")
+		api.HandleFunc("/diagnostic-profiles/{id}", s.handleDeleteDiagnosticProfile).Methods("DELETE")
+
+		// Boot profiles (no auth)
+		api.HandleFunc("/boot-profiles", s.handleListBootProfiles).Methods("GET")
+		api.HandleFunc("/boot-profiles", s.handleCreateBootProfile).Methods("POST")
+		api.HandleFunc("/boot-profiles/{id}", s.handleGetBootProfile).Methods("GET")
+		api.HandleFunc("/boot-profiles/{id}", s.handleUpdateBootProfile).Methods("PUT")
+		api.HandleFunc("/boot-profiles/{id}", s.handleDeleteBootProfile).Methods("DELETE")
+
+		// Enrollment rules (no auth)
+		api.HandleFunc("/enrollment-rules", s.handleListEnrollmentRules).Methods("GET")
+		api.HandleFunc("/enrollment-rules", s.handleCreateEnrollmentRule).Methods("POST")
+		api.HandleFunc("/enrollment-rules/test", s.handleTestEnrollmentRules).Methods("POST")
+		api.HandleFunc("/enrollment-rules/{id}", s.handleGetEnrollmentRule).Methods("GET")
+		api.HandleFunc("/enrollment-rules/{id}", s.handleUpdateEnrollmentRule).Methods("PUT")
+		api.HandleFunc("/enrollment-rules/{id}", s.handleDeleteEnrollmentRule).Methods("DELETE")
+
+		// Hardware profiles (no auth)
+		api.HandleFunc("/hardware-profiles", s.handleListHardwareProfiles).Methods("GET")
+		api.HandleFunc("/hardware-profiles", s.handleCreateHardwareProfile).Methods("POST")
+		api.HandleFunc("/hardware-profiles/{id}", s.handleGetHardwareProfile).Methods("GET")
+		api.HandleFunc("/hardware-profiles/{id}", s.handleUpdateHardwareProfile).Methods("PUT")
+		api.HandleFunc("/hardware-profiles/{id}", s.handleDeleteHardwareProfile).Methods("DELETE")
+
+		// Lint rules (no auth)
+		api.HandleFunc("/lint-rules", s.handleListLintRules).Methods("GET")
+		api.HandleFunc("/lint-rules", s.handleCreateLintRule).Methods("POST")
+		api.HandleFunc("/lint-rules/{id}", s.handleUpdateLintRule).Methods("PUT")
+		api.HandleFunc("/lint-rules/{id}", s.handleDeleteLintRule).Methods("DELETE")
+
 		// Machine events (no auth)
 		api.HandleFunc("/machines/{id}/events", s.handleGetMachineEvents).Methods("GET")
+		api.HandleFunc("/events", s.handleListEvents).Methods("GET")
+		api.HandleFunc("/events/schema", s.handleGetEventSchema).Methods("GET")
+		api.HandleFunc("/events/export", s.handleExportEvents).Methods("GET")
+
+		// Administration (no auth)
+		api.HandleFunc("/admin/backup", s.handleBackup).Methods("POST")
+		api.HandleFunc("/admin/db/check", s.handleCheckDatabase).Methods("POST")
+		api.HandleFunc("/audit", s.handleListAudit).Methods("GET")
+		api.HandleFunc("/boot-manifest", s.handleExportBootManifest).Methods("GET")
+
+		// System images (no auth)
+		api.HandleFunc("/system-images/{name}", s.handleListSystemImages).Methods("GET")
+		api.HandleFunc("/system-images/{name}/config", s.handleGetSystemImageConfig).Methods("GET")
+		api.HandleFunc("/system-images/{name}/config", s.handleUpdateSystemImageConfig).Methods("PUT")
+		api.HandleFunc("/system-images/{name}/build", s.handleBuildSystemImage).Methods("POST")
+		api.HandleFunc("/system-images/{name}/rollback", s.handleRollbackSystemImage).Methods("POST")
+		api.HandleFunc("/system-images/{name}/versions/{version}/promote", s.handlePromoteSystemImage).Methods("POST")
 	}
 
 	// Global middleware
+	s.Router.Use(requestIDMiddleware)
+	s.Router.Use(s.clientIPMiddleware)
 	s.Router.Use(loggingMiddleware)
+	s.Router.Use(s.instrumentationMiddleware)
 	s.Router.Use(corsMiddleware)
+	s.Router.Use(s.bodyLimitMiddleware)
+	s.Router.Use(s.rateLimitMiddleware)
+
+	// Middleware only runs on matched routes
+	s.Router.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(handleNotFound))
+	s.Router.MethodNotAllowedHandler = requestIDMiddleware(http.HandlerFunc(handleMethodNotAllowed))
 }
 
 // Start starts the HTTP server
@@ -265,121 +1146,205 @@ func (s *Server) Start() error {
 // handleEnroll handles machine enrollment requests
 func (s *Server) handleEnroll(w http.ResponseWriter, r *http.Request) {
 	var req models.EnrollmentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeStrictJSON(w, r, &req) {
 		return
 	}
 
-	// Validate required fields
-	if req.ServiceTag == "" || req.MACAddress == "" {
-		respondError(w, http.StatusBadRequest, "service_tag and mac_address are required")
+	// Events go out once the enrollment is stored, without holding up the
+	// response or the enrollment's turn in the queue
+	ctx, publishEvents := s.service.DeferEvents(r.Context())
+	enrollment, err := s.service.EnrollMachine(ctx, req, clientIP(r))
+	go publishEvents()
+
+	var conflict *service.ConflictError
+	var trashed *service.TrashedError
+	if errors.As(err, &conflict) || errors.As(err, &trashed) {
+		s.metrics.enrollments.WithLabelValues("rejected").Inc()
+	}
+	if err != nil {
+		respondServiceError(w, err, "failed to enroll machine")
 		return
 	}
 
-	// Check if machine already exists
-	existing, err := s.db.GetMachineByServiceTag(req.ServiceTag)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+	s.metrics.enrollments.WithLabelValues(enrollment.Outcome).Inc()
+	switch enrollment.Outcome {
+	case service.EnrollmentHeld:
+		s.respondEnrollmentHeld(w, enrollment.Machine)
+	case service.EnrollmentNew:
+		respondJSON(w, http.StatusCreated, s.enrollmentResponse(enrollment.Machine))
+	default:
+		respondJSON(w, http.StatusOK, s.enrollmentResponse(enrollment.Machine))
+	}
+}
+
+// handleListMachines lists machines. The default summary view leaves out
+// hardware details and NixOS configurations; ?view=full returns whole machine
+// records, still without configurations, which are only served by
+// handleGetMachine. ?format=csv returns the summary view as CSV. Virtual
+// machines are left out unless ?virtual=true or ?virtual=all.
+func (s *Server) handleListMachines(w http.ResponseWriter, r *http.Request) {
+	// Parse query parameters for filtering
+	query := r.URL.Query()
+
+	filter := database.MachineFilter{
+		Status:       query.Get("status"),
+		Hostname:     query.Get("hostname"),
+		ServiceTag:   query.Get("service_tag"),
+		MACAddress:   query.Get("mac_address"),
+		Manufacturer: query.Get("manufacturer"),
+		Model:        query.Get("model"),
+		Search:       query.Get("search"),
+		IPAddress:    query.Get("ip"),
+		GPUVendor:    query.Get("gpu_vendor"),
+		GPUModel:     query.Get("gpu_model"),
+		Datacenter:   query.Get("datacenter"),
+		Rack:         query.Get("rack"),
+		Compliance:   query.Get("compliance"),
+		OwnerTeam:    query.Get("owner_team"),
+		Environment:  query.Get("environment"),
+	}
+
+	if filter.Compliance != "" && !models.IsValidComplianceFilter(filter.Compliance) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "compliance must be compliant, failed, or unchecked")
 		return
 	}
+	if filter.IPAddress != "" {
+		if _, err := models.NormalizeIP(filter.IPAddress); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "ip: "+err.Error())
+			return
+		}
+	}
 
-	if existing != nil {
-		// Update last_seen_at
-		now := time.Now()
-		existing.LastSeenAt = &now
-		if err := s.db.UpdateMachine(existing); err != nil {
-			log.Printf("Failed to update last_seen_at: %v", err)
+	if staleStr := query.Get("stale"); staleStr != "" {
+		stale, err := strconv.ParseBool(staleStr)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "stale must be true or false")
+			return
 		}
-		respondJSON(w, http.StatusOK, existing)
-		return
+		filter.StaleBuild = &stale
 	}
 
-	// Create new machine
-	machine, err := s.db.CreateMachine(req)
+	// Virtual machines are left out unless asked for
+	virtual, err := virtualFilter(query.Get("virtual"))
 	if err != nil {
-		log.Printf("Failed to create machine: %v", err)
-		respondError(w, http.StatusInternalServerError, "failed to create machine")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 		return
 	}
+	filter.Virtual = virtual
 
-	log.Printf("Enrolled new machine: %s (service_tag: %s)", machine.ID, machine.ServiceTag)
-
-	// Trigger webhook event
-	if s.webhookService != nil {
-		go s.webhookService.TriggerEvent("machine.enrolled", map[string]interface{}{
-			"machine_id":  machine.ID,
-			"service_tag": machine.ServiceTag,
-			"mac_address": machine.MACAddress,
-			"status":      machine.Status,
-			"manufacturer": machine.Hardware.Manufacturer,
-			"model":       machine.Hardware.Model,
-		})
+	if unownedStr := query.Get("unowned"); unownedStr != "" {
+		unowned, err := strconv.ParseBool(unownedStr)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "unowned must be true or false")
+			return
+		}
+		filter.Unowned = unowned
 	}
 
-	// Create event record
-	s.db.EmitMachineEvent(machine.ID, "machine.enrolled", map[string]interface{}{
-		"service_tag": machine.ServiceTag,
-		"mac_address": machine.MACAddress,
-	}, nil)
+	if countStr := query.Get("min_gpu_count"); countStr != "" {
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "min_gpu_count must be a non-negative integer")
+			return
+		}
+		filter.MinGPUCount = count
+	}
 
-	respondJSON(w, http.StatusCreated, machine)
-}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "format must be json or csv")
+		return
+	}
 
-// handleListMachines lists all machines with optional filtering
-func (s *Server) handleListMachines(w http.ResponseWriter, r *http.Request) {
-	// Parse query parameters for filtering
-	query := r.URL.Query()
+	// ?sort=artifact_bytes lists the machines whose images take up the
+	// most space first
+	if order := query.Get("sort"); order != "" {
+		if order != database.MachineSortArtifactBytes {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "sort must be artifact_bytes")
+			return
+		}
+		filter.Sort = order
+	}
 
-	// Check if any filters are provided
-	hasFilters := query.Get("status") != "" ||
-		query.Get("hostname") != "" ||
-		query.Get("service_tag") != "" ||
-		query.Get("mac_address") != "" ||
-		query.Get("manufacturer") != "" ||
-		query.Get("model") != "" ||
-		query.Get("search") != "" ||
-		query.Get("limit") != "" ||
-		query.Get("offset") != ""
-
-	var machines []*models.Machine
-	var err error
-
-	if hasFilters {
-		// Use advanced filtering
-		filter := database.MachineFilter{
-			Status:       query.Get("status"),
-			Hostname:     query.Get("hostname"),
-			ServiceTag:   query.Get("service_tag"),
-			MACAddress:   query.Get("mac_address"),
-			Manufacturer: query.Get("manufacturer"),
-			Model:        query.Get("model"),
-			Search:       query.Get("search"),
+	// Repeated tags must all be present
+	if len(query["tag"]) > 0 {
+		tags, err := models.NormalizeTags(query["tag"])
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
 		}
+		filter.Tags = tags
+	}
 
-		// Parse pagination parameters
-		if limitStr := query.Get("limit"); limitStr != "" {
-			if limit, err := strconv.Atoi(limitStr); err == nil && limit > 0 {
-				filter.Limit = limit
-			}
+	// metadata.<path>=<value> matches a metadata field's value
+	for param, values := range query {
+		path, ok := strings.CutPrefix(param, "metadata.")
+		if !ok {
+			continue
 		}
-		if offsetStr := query.Get("offset"); offsetStr != "" {
-			if offset, err := strconv.Atoi(offsetStr); err == nil && offset >= 0 {
-				filter.Offset = offset
-			}
+		if models.ParseMetadataPath(path) == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid metadata filter: "+param)
+			return
 		}
-
-		machines, err = s.db.SearchMachines(filter)
-	} else {
-		// List all machines
-		machines, err = s.db.ListMachines()
+		if filter.Metadata == nil {
+			filter.Metadata = make(map[string]string)
+		}
+		filter.Metadata[path] = values[0]
 	}
 
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list machines")
-		return
+	// Viewers don't see machines other users have claimed
+	filter.VisibleTo = visibleTo(r)
+
+	// Parse pagination parameters
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if limit, err := strconv.Atoi(limitStr); err == nil && limit > 0 {
+			filter.Limit = limit
+		}
+	}
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		if offset, err := strconv.Atoi(offsetStr); err == nil && offset >= 0 {
+			filter.Offset = offset
+		}
 	}
 
-	respondJSON(w, http.StatusOK, machines)
+	switch query.Get("view") {
+	case "", "summary":
+		machines, err := s.db.ListMachineSummaries(filter)
+		if err != nil {
+			respondInternalError(w, err, "failed to list machines")
+			return
+		}
+		if machines == nil {
+			machines = []*models.MachineSummary{}
+		}
+		if format == "csv" {
+			writeMachinesCSV(w, machines)
+			return
+		}
+		respondJSON(w, http.StatusOK, machines)
+
+	case "full":
+		if format == "csv" {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "csv is only available for the summary view")
+			return
+		}
+
+		machines, err := s.db.SearchMachines(filter)
+		if err != nil {
+			respondInternalError(w, err, "failed to list machines")
+			return
+		}
+		if machines == nil {
+			machines = []*models.Machine{}
+		}
+		for _, m := range machines {
+			m.NixOSConfig = ""
+		}
+		respondJSON(w, http.StatusOK, machines)
+
+	default:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "view must be summary or full")
+	}
 }
 
 // handleGetMachine retrieves a single machine
@@ -389,166 +1354,120 @@ func (s *Server) handleGetMachine(w http.ResponseWriter, r *http.Request) {
 
 	machine, err := s.db.GetMachine(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if machine == nil {
-		respondError(w, http.StatusNotFound, "machine not found")
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
 		return
 	}
 
 	respondJSON(w, http.StatusOK, machine)
 }
 
-// handleUpdateMachine updates a machine
+// handleUpdateMachine updates the fields of a machine set in the request
 func (s *Server) handleUpdateMachine(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	machine, err := s.db.GetMachine(id)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+	var patch models.Machine
+	if !decodeJSON(w, r, &patch) {
 		return
 	}
 
-	if machine == nil {
-		respondError(w, http.StatusNotFound, "machine not found")
+	machine, err := s.service.UpdateMachine(r.Context(), mux.Vars(r)["id"], &patch)
+	if err != nil {
+		respondServiceError(w, err, "failed to update machine")
 		return
 	}
 
-	oldStatus := machine.Status
+	respondJSON(w, http.StatusOK, machine)
+}
 
-	var updates models.Machine
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+// handleBuildMachine triggers a build for a machine
+func (s *Server) handleBuildMachine(w http.ResponseWriter, r *http.Request) {
+	// The body is optional
+	var req models.BuildMachineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
 		return
 	}
-
-	// Update fields
-	if updates.Hostname != "" {
-		machine.Hostname = updates.Hostname
-	}
-	if updates.Description != "" {
-		machine.Description = updates.Description
-	}
-	if updates.NixOSConfig != "" {
-		machine.NixOSConfig = updates.NixOSConfig
-		machine.Status = models.StatusConfigured
-	}
-
-	if err := s.db.UpdateMachine(machine); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to update machine")
+	if req.Priority != "" && !s.checkBuildPriority(w, r, req.Priority) {
 		return
 	}
 
-	// Trigger webhook if status changed
-	if oldStatus != machine.Status {
-		if s.webhookService != nil {
-			go s.webhookService.TriggerEvent("machine.status_changed", map[string]interface{}{
-				"machine_id": machine.ID,
-				"old_status": oldStatus,
-				"new_status": machine.Status,
-			})
+	requested, allowed := s.maintenanceOverride(r)
+	build, err := s.service.TriggerBuild(r.Context(), mux.Vars(r)["id"], service.BuildOptions{
+		Priority:            req.Priority,
+		Target:              req.Target,
+		OverrideMaintenance: allowed,
+		Admin:               s.isAdmin(r),
+	})
+	if err != nil {
+		if !respondOverrideForbidden(w, err, requested) {
+			respondServiceError(w, err, "failed to create build")
 		}
-
-		s.db.EmitMachineEvent(machine.ID, "machine.status_changed", map[string]interface{}{
-			"old_status": oldStatus,
-			"new_status": machine.Status,
-		}, nil)
-	}
-
-	respondJSON(w, http.StatusOK, machine)
-}
-
-// handleDeleteMachine deletes a machine
-func (s *Server) handleDeleteMachine(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	if err := s.db.DeleteMachine(id); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to delete machine")
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	s.setQueuePosition(build)
+	respondJSON(w, http.StatusCreated, build)
 }
 
-// handleBuildMachine triggers a build for a machine
-func (s *Server) handleBuildMachine(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	machine, err := s.db.GetMachine(id)
+// handleListBuilds lists builds for a machine, filtered by the status and
+// limit query parameters
+func (s *Server) handleListBuilds(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseBuildFilter(r)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 		return
 	}
+	filter.MachineID = mux.Vars(r)["id"]
 
-	if machine == nil {
-		respondError(w, http.StatusNotFound, "machine not found")
+	builds, err := s.db.ListBuilds(filter)
+	if err != nil {
+		respondInternalError(w, err, "failed to list builds")
 		return
 	}
 
-	if machine.NixOSConfig == "" {
-		respondError(w, http.StatusBadRequest, "machine has no configuration")
-		return
-	}
+	respondJSON(w, http.StatusOK, builds)
+}
 
-	// Create build request
-	build, err := s.db.CreateBuild(machine.ID, machine.NixOSConfig)
+// handleListAllBuilds lists builds across machines, filtered by the
+// machine_id, status, and limit query parameters
+func (s *Server) handleListAllBuilds(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseBuildFilter(r)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to create build")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
 		return
 	}
+	filter.MachineID = r.URL.Query().Get("machine_id")
+	filter.VisibleTo = visibleTo(r)
 
-	// Update machine status
-	oldStatus := machine.Status
-	machine.Status = models.StatusBuilding
-	machine.LastBuildID = &build.ID
-	if err := s.db.UpdateMachine(machine); err != nil {
-		log.Printf("Failed to update machine status: %v", err)
-	}
-
-	// Trigger webhook event
-	if s.webhookService != nil {
-		go s.webhookService.TriggerEvent("machine.build_started", map[string]interface{}{
-			"machine_id": machine.ID,
-			"build_id":   build.ID,
-		})
-
-		if oldStatus != machine.Status {
-			go s.webhookService.TriggerEvent("machine.status_changed", map[string]interface{}{
-				"machine_id": machine.ID,
-				"old_status": oldStatus,
-				"new_status": machine.Status,
-			})
-		}
+	builds, err := s.db.ListBuilds(filter)
+	if err != nil {
+		respondInternalError(w, err, "failed to list builds")
+		return
 	}
 
-	// Create event record
-	s.db.EmitMachineEvent(machine.ID, "machine.build_started", map[string]interface{}{
-		"build_id": build.ID,
-	}, nil)
-
-	// TODO: Send build request to builder service
-	log.Printf("Build requested for machine %s: build_id=%s", machine.ID, build.ID)
-
-	respondJSON(w, http.StatusCreated, build)
+	respondJSON(w, http.StatusOK, builds)
 }
 
-// handleListBuilds lists builds for a machine
-func (s *Server) handleListBuilds(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	machineID := vars["id"]
+// parseBuildFilter reads the status and limit query parameters shared by
+// the build listings
+func parseBuildFilter(r *http.Request) (database.BuildFilter, error) {
+	query := r.URL.Query()
+	filter := database.BuildFilter{Status: query.Get("status")}
 
-	builds, err := s.db.ListBuildsByMachine(machineID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list builds")
-		return
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return filter, fmt.Errorf("limit must be a positive integer")
+		}
+		filter.Limit = limit
 	}
 
-	respondJSON(w, http.StatusOK, builds)
+	return filter, nil
 }
 
 // handleGetBuild retrieves a build
@@ -558,46 +1477,33 @@ func (s *Server) handleGetBuild(w http.ResponseWriter, r *http.Request) {
 
 	build, err := s.db.GetBuild(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if build == nil {
-		respondError(w, http.StatusNotFound, "build not found")
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
 		return
 	}
 
+	s.setQueuePosition(build)
 	respondJSON(w, http.StatusOK, build)
 }
 
-// handleGetMachineEvents retrieves events for a machine
-func (s *Server) handleGetMachineEvents(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	machineID := vars["id"]
-
-	limitStr := r.URL.Query().Get("limit")
-	limit := 50
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-		}
-	}
-
-	events, err := s.db.ListMachineEvents(machineID, limit)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list events")
-		return
-	}
-
-	respondJSON(w, http.StatusOK, events)
-}
-
-// handleHealth returns server health status
+// handleHealth returns server health status, which is unhealthy once the
+// database fails an integrity check
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, http.StatusOK, map[string]string{
+	status, health := http.StatusOK, map[string]interface{}{
 		"status": "healthy",
 		"time":   time.Now().Format(time.RFC3339),
-	})
+	}
+	if check := s.db.LastCheck(); check != nil {
+		health["database"] = check
+		if !check.OK {
+			status, health["status"] = http.StatusServiceUnavailable, "unhealthy"
+		}
+	}
+	respondJSON(w, status, health)
 }
 
 // Helper functions
@@ -608,15 +1514,11 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
-func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
-}
-
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.RequestURI, time.Since(start))
+		log.Printf("[%s] %s %s %s", requestID(r), r.Method, redactSharePath(r.RequestURI), time.Since(start))
 	})
 }
 
@@ -624,7 +1526,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,427 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// revokedSharesRefresh is how long the cached list of revoked shares is
+// used before it is loaded again, which is how long a share revoked
+// through another server keeps working here
+const revokedSharesRefresh = 30 * time.Second
+
+// sharedPathPrefix is where share links are served
+const sharedPathPrefix = "/api/v1/shared/"
+
+// sharedEvent is what a share link shows of an event: its data without
+// fields that may hold secrets, and without the user who caused it
+type sharedEvent struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Sequence  int64           `json:"sequence,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type shareContextKey struct{}
+
+// handleCreateMachineShare creates a share link for a machine. The body is
+// optional; by default the link grants every scope for 72 hours. The token
+// is only returned here.
+func (s *Server) handleCreateMachineShare(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
+		return
+	}
+
+	machine, err := s.db.GetMachine(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	expiry, err := req.Expiry()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	if err := req.ValidateScopes(); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	share := &models.MachineShare{
+		MachineID: machine.ID,
+		Scopes:    req.Scopes,
+		BuildID:   req.BuildID,
+		Note:      req.Note,
+		ExpiresAt: time.Now().Add(expiry),
+	}
+
+	if share.BuildID != "" {
+		if !share.HasScope(models.ShareScopeBuildLogs) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "build_id needs the build_logs scope")
+			return
+		}
+		build, err := s.db.GetBuild(share.BuildID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if build == nil || build.MachineID != machine.ID {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "build_id is not a build of this machine")
+			return
+		}
+	}
+
+	if claims, ok := auth.GetClaims(r); ok {
+		share.CreatedBy = claims.Username
+	}
+
+	if err := s.db.CreateMachineShare(share); err != nil {
+		respondInternalError(w, err, "failed to create share")
+		return
+	}
+
+	token, err := s.jwtManager.GenerateShareToken(share)
+	if err != nil {
+		respondInternalError(w, err, "failed to sign share token")
+		return
+	}
+
+	log.Printf("Machine %s shared until %s (share %s)", machine.ID, share.ExpiresAt.Format(time.RFC3339), share.ID)
+	respondJSON(w, http.StatusCreated, models.CreatedShare{
+		MachineShare: share,
+		Token:        token,
+		Path:         sharedPathPrefix + token,
+	})
+}
+
+// handleListMachineShares lists a machine's shares, newest first, without
+// their tokens
+func (s *Server) handleListMachineShares(w http.ResponseWriter, r *http.Request) {
+	shares, err := s.db.ListMachineShares(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "failed to list shares")
+		return
+	}
+
+	if shares == nil {
+		shares = []*models.MachineShare{}
+	}
+
+	respondJSON(w, http.StatusOK, shares)
+}
+
+// handleRevokeMachineShare revokes a share, so its link stops working.
+// Revoking a revoked share changes nothing.
+func (s *Server) handleRevokeMachineShare(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	share, err := s.db.GetMachineShare(vars["id"], vars["share_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if share == nil {
+		respondError(w, http.StatusNotFound, CodeShareNotFound, "share not found")
+		return
+	}
+
+	var revokedBy string
+	if claims, ok := auth.GetClaims(r); ok {
+		revokedBy = claims.Username
+	}
+
+	if _, err := s.db.RevokeMachineShare(share.ID, revokedBy, time.Now()); err != nil {
+		respondInternalError(w, err, "failed to revoke share")
+		return
+	}
+
+	s.sharesMu.Lock()
+	if s.revokedShares != nil {
+		s.revokedShares[share.ID] = true
+	}
+	s.sharesMu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shareRevoked reports whether a share was revoked, from a list of revoked
+// shares loaded at most revokedSharesRefresh ago
+func (s *Server) shareRevoked(id string) (bool, error) {
+	s.sharesMu.Lock()
+	defer s.sharesMu.Unlock()
+
+	now := time.Now()
+	if s.revokedShares == nil || now.Sub(s.revokedSharesAt) >= revokedSharesRefresh {
+		ids, err := s.db.ListRevokedShareIDs(now)
+		if err != nil {
+			return false, err
+		}
+		s.revokedShares = make(map[string]bool, len(ids))
+		for _, revoked := range ids {
+			s.revokedShares[revoked] = true
+		}
+		s.revokedSharesAt = now
+	}
+
+	return s.revokedShares[id], nil
+}
+
+// sharedAccess serves a share link's request with next if the link's
+// token is valid, unexpired, and unrevoked, and grants scope. Every use of
+// a link, allowed or not, is recorded in the audit log with the client's
+// address.
+func (s *Server) sharedAccess(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		claims, err := s.jwtManager.ValidateShareToken(vars["token"])
+		if err != nil {
+			respondError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid or expired share link")
+			return
+		}
+		share := claims.Share()
+
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		entry := &models.AuditEntry{
+			Actor:     "share:" + share.ID,
+			Method:    r.Method,
+			Route:     route,
+			Targets:   map[string]string{"machine_id": share.MachineID, "share_id": share.ID},
+			SourceIP:  clientIP(r),
+			RequestID: requestID(r),
+		}
+		if buildID := vars["build_id"]; buildID != "" {
+			entry.Targets["build_id"] = buildID
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			entry.Status = rec.status
+			if err := s.db.CreateAuditEntry(entry); err != nil {
+				log.Printf("[%s] Failed to record use of share %s: %v", entry.RequestID, share.ID, err)
+			}
+		}()
+
+		revoked, err := s.shareRevoked(share.ID)
+		if err != nil {
+			respondInternalError(rec, err, "database error")
+			return
+		}
+		if revoked {
+			respondError(rec, http.StatusUnauthorized, CodeUnauthorized, "share link has been revoked")
+			return
+		}
+		if !share.HasScope(scope) {
+			respondError(rec, http.StatusForbidden, CodeForbidden, "share link does not grant "+scope)
+			return
+		}
+
+		next(rec, r.WithContext(context.WithValue(r.Context(), shareContextKey{}, share)))
+	}
+}
+
+// requestShare returns the share a request through sharedAccess is for
+func requestShare(r *http.Request) *models.MachineShare {
+	share, _ := r.Context().Value(shareContextKey{}).(*models.MachineShare)
+	return share
+}
+
+// sharedMachine looks up a share's machine. It responds with an error and
+// returns nil if the machine is gone or in the trash.
+func (s *Server) sharedMachine(w http.ResponseWriter, share *models.MachineShare) *models.Machine {
+	machine, err := s.db.GetMachine(share.MachineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return nil
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return nil
+	}
+	return machine
+}
+
+// handleSharedMachine shows a shared machine, with its hardware if the
+// share grants the hardware scope
+func (s *Server) handleSharedMachine(w http.ResponseWriter, r *http.Request) {
+	share := requestShare(r)
+	machine := s.sharedMachine(w, share)
+	if machine == nil {
+		return
+	}
+
+	shared := models.NewSharedMachine(machine, share.HasScope(models.ShareScopeHardware))
+	shared.ExpiresAt = share.ExpiresAt
+	respondJSON(w, http.StatusOK, shared)
+}
+
+// handleSharedHardware shows a shared machine's hardware inventory
+func (s *Server) handleSharedHardware(w http.ResponseWriter, r *http.Request) {
+	machine := s.sharedMachine(w, requestShare(r))
+	if machine == nil {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.NewSharedMachine(machine, true).Hardware)
+}
+
+// handleSharedEvents lists a shared machine's events, newest first, with
+// the same paging and filters as the machine's event history
+func (s *Server) handleSharedEvents(w http.ResponseWriter, r *http.Request) {
+	share := requestShare(r)
+	if s.sharedMachine(w, share) == nil {
+		return
+	}
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	filter.MachineID = share.MachineID
+	filter.CreatedBy = ""
+
+	events, err := s.db.SearchEvents(filter)
+	if err != nil {
+		respondInternalError(w, err, "failed to list events")
+		return
+	}
+
+	shared := make([]sharedEvent, 0, len(events))
+	for _, event := range events {
+		shared = append(shared, sharedEvent{
+			ID:        event.ID,
+			Event:     event.Event,
+			Data:      redactSecretFields(event.Data),
+			Sequence:  event.Sequence,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+
+	if len(events) == filter.Limit {
+		last := events[len(events)-1]
+		w.Header().Set("X-Next-Cursor", encodeEventCursor(database.EventCursor{CreatedAt: last.CreatedAt, ID: last.ID}))
+	}
+
+	respondJSON(w, http.StatusOK, shared)
+}
+
+// handleSharedBuilds lists a shared machine's builds, newest first, or
+// only the build the share is restricted to
+func (s *Server) handleSharedBuilds(w http.ResponseWriter, r *http.Request) {
+	share := requestShare(r)
+	if s.sharedMachine(w, share) == nil {
+		return
+	}
+
+	builds, err := s.db.ListBuildsByMachine(share.MachineID)
+	if err != nil {
+		respondInternalError(w, err, "failed to list builds")
+		return
+	}
+
+	shared := []*models.SharedBuild{}
+	for _, build := range builds {
+		if share.BuildID == "" || build.ID == share.BuildID {
+			shared = append(shared, models.NewSharedBuild(build))
+		}
+	}
+
+	respondJSON(w, http.StatusOK, shared)
+}
+
+// handleSharedBuildLog streams the log of one of a shared machine's builds
+func (s *Server) handleSharedBuildLog(w http.ResponseWriter, r *http.Request) {
+	share := requestShare(r)
+	buildID := mux.Vars(r)["build_id"]
+
+	if share.BuildID != "" && buildID != share.BuildID {
+		respondError(w, http.StatusForbidden, CodeForbidden, "share link is for another build")
+		return
+	}
+	if s.sharedMachine(w, share) == nil {
+		return
+	}
+
+	build, err := s.db.GetBuild(buildID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if build == nil || build.MachineID != share.MachineID {
+		respondError(w, http.StatusNotFound, CodeBuildNotFound, "build not found")
+		return
+	}
+
+	s.respondBuildLog(w, r, build.ID)
+}
+
+// redactSecretFields removes the fields of JSON data, at any depth, whose
+// names mark them as secrets, the same names the audit log never keeps
+func redactSecretFields(data json.RawMessage) json.RawMessage {
+	if len(data) == 0 {
+		return data
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return json.RawMessage("null")
+	}
+	redacted, err := json.Marshal(redactSecretValue(value))
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return redacted
+}
+
+func redactSecretValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if isSecretField(name) {
+				delete(v, name)
+				continue
+			}
+			v[name] = redactSecretValue(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactSecretValue(item)
+		}
+	}
+	return value
+}
+
+// redactSharePath hides the token in a share link's path, for logging
+func redactSharePath(uri string) string {
+	rest, ok := strings.CutPrefix(uri, sharedPathPrefix)
+	if !ok {
+		return uri
+	}
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		return sharedPathPrefix + "<token>" + rest[i:]
+	}
+	return sharedPathPrefix + "<token>"
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const (
+	// statsCacheTTL is how long a stats summary is reused, so dashboards
+	// that refresh often don't each query the database
+	statsCacheTTL = 5 * time.Second
+
+	// statsWindow is how far back builds and webhook deliveries are
+	// counted
+	statsWindow = 24 * time.Hour
+
+	defaultStatsTop          = 10
+	maxStatsTop              = 100
+	defaultStatsOfflineAfter = 24 * time.Hour
+)
+
+// cachedStats is a stats summary and when it stops being reused
+type cachedStats struct {
+	stats   *models.Stats
+	expires time.Time
+}
+
+// handleGetStats summarizes the fleet for dashboards: machines by status
+// and hardware, offline machines, builds and webhook deliveries in the last
+// 24 hours, and stored metrics. ?group_id= limits it to a group's machines,
+// ?top=N lists N manufacturer and model pairs (default 10), and
+// ?offline_after= is how long a machine goes unseen before it is offline
+// (default 24h). Virtual machines are left out unless ?include_virtual=true.
+func (s *Server) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	groupID := query.Get("group_id")
+
+	top := defaultStatsTop
+	if topStr := query.Get("top"); topStr != "" {
+		n, err := strconv.Atoi(topStr)
+		if err != nil || n <= 0 || n > maxStatsTop {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "top must be an integer from 1 to 100")
+			return
+		}
+		top = n
+	}
+
+	offlineAfter := defaultStatsOfflineAfter
+	if offlineStr := query.Get("offline_after"); offlineStr != "" {
+		d, err := time.ParseDuration(offlineStr)
+		if err != nil || d <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "offline_after must be a positive duration, e.g. 1h")
+			return
+		}
+		offlineAfter = d
+	}
+
+	if groupID != "" {
+		group, err := s.db.GetGroup(groupID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if group == nil {
+			respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+			return
+		}
+	}
+
+	includeVirtual := false
+	if virtualStr := query.Get("include_virtual"); virtualStr != "" {
+		include, err := strconv.ParseBool(virtualStr)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "include_virtual must be true or false")
+			return
+		}
+		includeVirtual = include
+	}
+
+	viewer := visibleTo(r)
+	key := groupID + "\x00" + strconv.Itoa(top) + "\x00" + offlineAfter.String() + "\x00" + strconv.FormatBool(includeVirtual) + "\x00" + viewer
+	now := time.Now()
+
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	if cached, ok := s.statsCache[key]; ok && now.Before(cached.expires) {
+		respondJSON(w, http.StatusOK, cached.stats)
+		return
+	}
+
+	stats, err := s.db.GetStats(database.StatsFilter{
+		GroupID:        groupID,
+		IncludeVirtual: includeVirtual,
+		VisibleTo:      viewer,
+		TopHardware:    top,
+		OfflineSince:   now.Add(-offlineAfter),
+		Since:          now.Add(-statsWindow),
+	})
+	if err != nil {
+		respondInternalError(w, err, "failed to compute stats")
+		return
+	}
+
+	// Drop summaries that have expired, so the cache holds only those
+	// asked for recently
+	for k, cached := range s.statsCache {
+		if !now.Before(cached.expires) {
+			delete(s.statsCache, k)
+		}
+	}
+	if s.statsCache == nil {
+		s.statsCache = make(map[string]cachedStats)
+	}
+	s.statsCache[key] = cachedStats{stats: stats, expires: now.Add(statsCacheTTL)}
+
+	respondJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,79 @@
+package api_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+func TestGetStats(t *testing.T) {
+	env := testutil.New(t)
+
+	// Three machines, two configured and in a group, and one of them with
+	// a successful build
+	machines := []*models.Machine{env.EnrollMachine("STATS01"), env.EnrollMachine("STATS02"), env.EnrollMachine("STATS03")}
+	env.ConfigureMachine(machines[0].ID, testutil.FixtureConfig)
+	env.ConfigureMachine(machines[1].ID, testutil.FixtureConfig)
+	group := env.CreateGroup("stats")
+	for _, m := range machines[:2] {
+		if err := env.DB.AddMachineToGroup(group.ID, m.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build, err := env.DB.CreateBuild(machines[0].ID, testutil.FixtureConfig, "", "", false, false, "", models.BuildRequirements{}, "", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build.Status, build.DurationMS = "success", 42000
+	if err := env.DB.UpdateBuild(build); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats models.Stats
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/stats", nil, http.StatusOK, &stats)
+	wantStatus := map[models.MachineStatus]int{models.StatusEnrolled: 1, models.StatusConfigured: 2}
+	if stats.Machines.Total != 3 || !reflect.DeepEqual(stats.Machines.ByStatus, wantStatus) || stats.Machines.Offline != 0 {
+		t.Errorf("machines = %+v, want 3 online %v", stats.Machines, wantStatus)
+	}
+	wantHardware := []models.HardwareCount{{Manufacturer: "Dell Inc.", Model: "PowerEdge R650", Count: 3}}
+	if !reflect.DeepEqual(stats.Machines.ByHardware, wantHardware) {
+		t.Errorf("by hardware = %v, want %v", stats.Machines.ByHardware, wantHardware)
+	}
+	if got := stats.Builds.ByStatus["success"]; stats.Builds.Total != 1 || got.Count != 1 || got.AverageDurationSeconds != 42 {
+		t.Errorf("builds = %+v, want one 42s success", stats.Builds)
+	}
+	if stats.Webhooks.Deliveries != 0 || stats.Webhooks.SuccessRate != nil {
+		t.Errorf("webhooks = %+v, want no deliveries and no rate", stats.Webhooks)
+	}
+
+	// A group's stats count its machines alone
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/stats?group_id="+group.ID, nil, http.StatusOK, &stats)
+	if stats.GroupID != group.ID || stats.Machines.Total != 2 || stats.Machines.ByStatus[models.StatusConfigured] != 2 || stats.Builds.Total != 1 {
+		t.Errorf("group stats = %+v, want two configured machines and one build", stats)
+	}
+
+	// Summaries are reused for a few seconds
+	env.EnrollMachine("STATS04")
+	env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/stats", nil, http.StatusOK, &stats)
+	if stats.Machines.Total != 3 {
+		t.Errorf("machines = %d, want the cached 3", stats.Machines.Total)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		code   api.ErrorCode
+	}{
+		{"/api/v1/stats?group_id=00000000-0000-0000-0000-000000000000", http.StatusNotFound, api.CodeGroupNotFound},
+		{"/api/v1/stats?top=0", http.StatusBadRequest, api.CodeInvalidRequest},
+		{"/api/v1/stats?top=101", http.StatusBadRequest, api.CodeInvalidRequest},
+		{"/api/v1/stats?offline_after=-1h", http.StatusBadRequest, api.CodeInvalidRequest},
+		{"/api/v1/stats?include_virtual=maybe", http.StatusBadRequest, api.CodeInvalidRequest},
+	} {
+		expectError(t, env.Do(models.RoleViewer, http.MethodGet, tt.path, nil), tt.status, string(tt.code))
+	}
+}
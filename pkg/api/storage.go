@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// storageCheckTick is how often the images directory's filesystem is
+// checked against the storage alert
+const storageCheckTick = 5 * time.Minute
+
+// handleStorageUsage returns the disk usage of the images directory: the
+// space artifacts take up, by machine and by other directory, largest
+// first, and how full its filesystem is. ?limit=N lists only the N largest
+// machines.
+func (s *Server) handleStorageUsage(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	usage, err := s.service.StorageUsage()
+	if err != nil {
+		respondInternalError(w, err, "failed to read storage usage")
+		return
+	}
+	if limit > 0 && len(usage.Machines) > limit {
+		usage.Machines = usage.Machines[:limit]
+	}
+
+	respondJSON(w, http.StatusOK, usage)
+}
+
+// StartStorageAccounting walks the images directory every interval to
+// correct the usage recorded as builds finish, and checks its filesystem
+// against the storage alert every few minutes. The first walk is right
+// away, so usage is known before any build finishes; an interval of 0
+// never walks it.
+func (s *Server) StartStorageAccounting(interval time.Duration) {
+	go func() {
+		log.Printf("Storage accounting started (reconcile interval: %s, alert: %d%%)", interval, s.config.StorageAlertPercent)
+
+		ticker := time.NewTicker(storageCheckTick)
+		defer ticker.Stop()
+
+		var reconciledAt time.Time
+		for {
+			if s.leadJob("storage-accounting", storageCheckTick) {
+				if interval > 0 && time.Since(reconciledAt) >= interval {
+					drift, err := s.service.ReconcileStorage()
+					if err != nil {
+						log.Printf("Storage reconciliation failed: %v", err)
+					} else {
+						reconciledAt = time.Now()
+						if drift != 0 {
+							log.Printf("Storage reconciliation corrected recorded artifact usage by %d bytes", drift)
+						}
+					}
+				}
+				if err := s.service.CheckStorageAlert(context.Background()); err != nil {
+					log.Printf("Storage alert check failed: %v", err)
+				}
+			}
+
+			<-ticker.C
+		}
+	}()
+}
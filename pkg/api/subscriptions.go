@@ -0,0 +1,242 @@
+package api
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// DefaultSubscriptionDigestInterval is how often digest subscriptions are
+// sent unless the server says otherwise
+const DefaultSubscriptionDigestInterval = time.Hour
+
+// handleListSubscriptions lists the requesting user's subscriptions
+func (s *Server) handleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetClaims(r)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+		return
+	}
+
+	subs, err := s.db.ListUserSubscriptions(claims.UserID)
+	if err != nil {
+		respondInternalError(w, err, "failed to list subscriptions")
+		return
+	}
+	respondJSON(w, http.StatusOK, subs)
+}
+
+// handleCreateSubscription subscribes the requesting user to events of a
+// machine or a group, emailed to their account's address. Any user can
+// subscribe to machines and groups they can read, up to
+// Config.MaxSubscriptions subscriptions.
+func (s *Server) handleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetClaims(r)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+		return
+	}
+
+	var req models.CreateSubscriptionRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := req.Validate(events.IsKnown); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	user, err := s.db.GetUser(claims.UserID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if user == nil {
+		respondError(w, http.StatusNotFound, CodeUserNotFound, "user not found")
+		return
+	}
+	if user.Email == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "your account has no email address to send to")
+		return
+	}
+
+	if req.MachineID != "" {
+		machine, err := s.db.GetMachine(req.MachineID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		// Viewers can't subscribe to what they can't read
+		if machine == nil || (claims.Role == models.RoleViewer && machine.OwnerUserID != "" && machine.OwnerUserID != claims.UserID) {
+			respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+			return
+		}
+	} else {
+		group, err := s.db.GetGroup(req.GroupID)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return
+		}
+		if group == nil {
+			respondError(w, http.StatusNotFound, CodeGroupNotFound, "group not found")
+			return
+		}
+	}
+
+	count, err := s.db.CountUserSubscriptions(claims.UserID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if count >= s.config.MaxSubscriptions {
+		respondError(w, http.StatusConflict, CodeConflict,
+			fmt.Sprintf("you already have the most subscriptions allowed (%d); delete one first", s.config.MaxSubscriptions))
+		return
+	}
+
+	channel, err := s.notifyService.SubscriptionChannel()
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if channel == nil {
+		respondError(w, http.StatusConflict, CodeConflict, "no email notification channel is set up to send subscription emails")
+		return
+	}
+
+	sub := &models.Subscription{
+		UserID:    claims.UserID,
+		MachineID: req.MachineID,
+		GroupID:   req.GroupID,
+		Events:    req.Events,
+		Digest:    req.Digest,
+	}
+	if err := s.db.CreateSubscription(sub); err != nil {
+		respondInternalError(w, err, "failed to create subscription")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, sub)
+}
+
+// handleDeleteSubscription deletes one of the requesting user's
+// subscriptions
+func (s *Server) handleDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.GetClaims(r)
+	if !ok {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+		return
+	}
+
+	sub, err := s.db.GetSubscription(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if sub == nil || sub.UserID != claims.UserID {
+		respondError(w, http.StatusNotFound, CodeSubscriptionNotFound, "subscription not found")
+		return
+	}
+
+	if _, err := s.db.DeleteSubscription(sub.ID); err != nil {
+		respondInternalError(w, err, "failed to delete subscription")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unsubscribePage is served for the link in subscription emails. Opening
+// the link only asks to confirm; the form posts back to it to unsubscribe.
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>Unsubscribe - Metal Enrollment</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; max-width: 480px; margin: 80px auto; padding: 0 20px; color: #333; }
+        button { background: #e74c3c; color: white; border: none; padding: 10px 20px; border-radius: 4px; font-size: 14px; cursor: pointer; }
+    </style>
+</head>
+<body>
+    <h1>Metal Enrollment</h1>
+{{if .Unsubscribed}}
+    <p>You are unsubscribed and won't get these emails anymore.</p>
+{{else}}
+    <p>Stop getting emails for this subscription?</p>
+    <form method="post" action="{{.Action}}">
+        <button type="submit">Unsubscribe</button>
+    </form>
+{{end}}
+</body>
+</html>
+`))
+
+// handleUnsubscribe serves the link in subscription emails, authorized by
+// the link's token rather than a login. GET only asks to confirm, so that
+// link scanners and prefetching don't unsubscribe anyone; POST, from the
+// page's form or a mail client's one-click unsubscribe (RFC 8058), deletes
+// the subscription. Unsubscribing twice succeeds.
+func (s *Server) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !s.jwtManager.ValidateUnsubscribeToken(id, r.URL.Query().Get("token")) {
+		respondError(w, http.StatusNotFound, CodeSubscriptionNotFound, "subscription not found")
+		return
+	}
+
+	page := struct {
+		Action       string
+		Unsubscribed bool
+	}{Action: r.URL.RequestURI()}
+
+	if r.Method == http.MethodPost {
+		deleted, err := s.db.DeleteSubscription(id)
+		if err != nil {
+			respondInternalError(w, err, "failed to delete subscription")
+			return
+		}
+		if deleted {
+			log.Printf("Subscription %s unsubscribed through its email link", id)
+		}
+		page.Unsubscribed = true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := unsubscribePage.Execute(w, page); err != nil {
+		log.Printf("Failed to render unsubscribe page: %v", err)
+	}
+}
+
+// unsubscribeURL returns the link in a subscription's emails that deletes
+// it. It is relative to PublicURL, and only a path if that is not set.
+func (s *Server) unsubscribeURL(subscriptionID string) string {
+	return fmt.Sprintf("%s/api/v1/subscriptions/%s/unsubscribe?token=%s",
+		strings.TrimSuffix(s.config.PublicURL, "/"),
+		url.PathEscape(subscriptionID),
+		url.QueryEscape(s.jwtManager.GenerateUnsubscribeToken(subscriptionID)))
+}
+
+// StartSubscriptionDigests emails the events held for digest subscriptions
+// every interval
+func (s *Server) StartSubscriptionDigests(interval time.Duration) {
+	go func() {
+		log.Printf("Subscription digests started (interval: %s)", interval)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if s.leadJob("subscription-digests", interval) {
+				s.notifyService.SendSubscriptionDigests()
+			}
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package api_test
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// addEmailChannel sets up the email channel subscription emails are sent
+// with; the tests below send none
+func addEmailChannel(t *testing.T, env *testutil.Env) {
+	t.Helper()
+
+	channel := &models.NotificationChannel{
+		Name:   "email",
+		Type:   models.NotificationEmail,
+		Events: []string{events.RolloutStarted},
+		Config: []byte(`{"host":"127.0.0.1","port":2525,"from":"metal@example.com","to":["ops@example.com"],"tls":"none"}`),
+		Active: true,
+	}
+	if err := env.DB.CreateNotificationChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listSubscriptions(env *testutil.Env, role models.UserRole) []models.Subscription {
+	var subs []models.Subscription
+	env.MustJSON(role, http.MethodGet, "/api/v1/me/subscriptions", nil, http.StatusOK, &subs)
+	return subs
+}
+
+func TestSubscriptionCap(t *testing.T) {
+	env := testutil.New(t, func(config *api.Config) { config.MaxSubscriptions = 2 })
+	addEmailChannel(t, env)
+	machine := env.EnrollMachine("SUBCAP01")
+
+	req := models.CreateSubscriptionRequest{MachineID: machine.ID, Events: []string{events.MachineBuildSucceeded}}
+	var first models.Subscription
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/me/subscriptions", req, http.StatusCreated, &first)
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/me/subscriptions", req, http.StatusCreated, nil)
+
+	// The third is one too many
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/me/subscriptions", req, http.StatusConflict, nil)
+	if subs := listSubscriptions(env, models.RoleViewer); len(subs) != 2 {
+		t.Errorf("%d subscriptions, want 2", len(subs))
+	}
+
+	// The cap is each user's own
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/me/subscriptions", req, http.StatusCreated, nil)
+
+	// Deleting one makes room, and only its owner can
+	env.MustJSON(models.RoleOperator, http.MethodDelete, "/api/v1/me/subscriptions/"+first.ID, nil, http.StatusNotFound, nil)
+	env.MustJSON(models.RoleViewer, http.MethodDelete, "/api/v1/me/subscriptions/"+first.ID, nil, http.StatusNoContent, nil)
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/me/subscriptions", req, http.StatusCreated, nil)
+}
+
+func TestSubscriptionsDeletedWithTheirTarget(t *testing.T) {
+	env := testutil.New(t)
+	addEmailChannel(t, env)
+	machine := env.EnrollMachine("SUBDEL01")
+	group := env.CreateGroup("subscribed")
+
+	for _, req := range []models.CreateSubscriptionRequest{
+		{MachineID: machine.ID, Events: []string{events.MachineBuildSucceeded}},
+		{GroupID: group.ID, Events: []string{"*"}},
+	} {
+		env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/me/subscriptions", req, http.StatusCreated, nil)
+	}
+
+	// The trash keeps them, for the machine may be restored
+	env.MustJSON(models.RoleOperator, http.MethodDelete, "/api/v1/machines/"+machine.ID, nil, http.StatusNoContent, nil)
+	if subs := listSubscriptions(env, models.RoleViewer); len(subs) != 2 {
+		t.Fatalf("%d subscriptions after trashing the machine, want 2", len(subs))
+	}
+
+	env.MustJSON(models.RoleAdmin, http.MethodDelete, "/api/v1/machines/"+machine.ID+"?hard=true", nil, http.StatusNoContent, nil)
+	subs := listSubscriptions(env, models.RoleViewer)
+	if len(subs) != 1 || subs[0].GroupID != group.ID {
+		t.Fatalf("subscriptions after deleting the machine = %+v, want the group's", subs)
+	}
+
+	env.MustJSON(models.RoleAdmin, http.MethodDelete, "/api/v1/groups/"+group.ID, nil, http.StatusNoContent, nil)
+	if subs := listSubscriptions(env, models.RoleViewer); len(subs) != 0 {
+		t.Errorf("subscriptions after deleting the group = %+v, want none", subs)
+	}
+}
+
+// TestUnsubscribeLink checks that opening an email's unsubscribe link only
+// asks to confirm, and that posting to it unsubscribes
+func TestUnsubscribeLink(t *testing.T) {
+	env := testutil.New(t)
+	addEmailChannel(t, env)
+	machine := env.EnrollMachine("UNSUB01")
+
+	var sub models.Subscription
+	env.MustJSON(models.RoleViewer, http.MethodPost, "/api/v1/me/subscriptions",
+		models.CreateSubscriptionRequest{MachineID: machine.ID, Events: []string{events.MachineBuildSucceeded}}, http.StatusCreated, &sub)
+	token := env.JWTManager().GenerateUnsubscribeToken(sub.ID)
+	link := "/api/v1/subscriptions/" + sub.ID + "/unsubscribe?token=" + url.QueryEscape(token)
+
+	request := func(method, path string) (int, string) {
+		t.Helper()
+		var body io.Reader
+		if method == http.MethodPost {
+			body = strings.NewReader("List-Unsubscribe=One-Click")
+		}
+		req, err := http.NewRequest(method, env.URL(path), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		resp, err := env.Server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		page, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(page)
+	}
+
+	// A link with another subscription's token, or none, is refused
+	otherToken := env.JWTManager().GenerateUnsubscribeToken("other")
+	for _, bad := range []string{"/api/v1/subscriptions/" + sub.ID + "/unsubscribe", "/api/v1/subscriptions/" + sub.ID + "/unsubscribe?token=" + otherToken} {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			if status, _ := request(method, bad); status != http.StatusNotFound {
+				t.Errorf("%s %s: status = %d, want 404", method, bad, status)
+			}
+		}
+	}
+
+	// Opening the link asks to confirm with a form that posts back to it
+	status, page := request(http.MethodGet, link)
+	if status != http.StatusOK || !strings.Contains(page, `<form method="post"`) || !strings.Contains(page, url.QueryEscape(token)) {
+		t.Errorf("GET link: status = %d, page:\n%s", status, page)
+	}
+	if subs := listSubscriptions(env, models.RoleViewer); len(subs) != 1 {
+		t.Fatalf("%d subscriptions after opening the link, want 1", len(subs))
+	}
+
+	// Posting to it unsubscribes, as many times as it is posted
+	for i := 0; i < 2; i++ {
+		status, page := request(http.MethodPost, link)
+		if status != http.StatusOK || !strings.Contains(page, "You are unsubscribed") {
+			t.Errorf("POST link: status = %d, page:\n%s", status, page)
+		}
+	}
+	if subs := listSubscriptions(env, models.RoleViewer); len(subs) != 0 {
+		t.Errorf("subscriptions after unsubscribing = %+v, want none", subs)
+	}
+}
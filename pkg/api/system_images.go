@@ -0,0 +1,320 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// systemImageFiles are the files a netboot system image version is made of
+var systemImageFiles = []string{"bzImage", "initrd"}
+
+// systemImageName returns the system image a request is for, answering 404
+// for names that aren't system images
+func systemImageName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := mux.Vars(r)["name"]
+	if !models.IsSystemImage(name) {
+		respondError(w, http.StatusNotFound, CodeSystemImageNotFound, "system image not found")
+		return "", false
+	}
+	return name, true
+}
+
+// systemImageConfigPath is where a system image's NixOS configuration is
+// kept, beside the files it refers to
+func (s *Server) systemImageConfigPath(name string) string {
+	return filepath.Join(s.config.NixOSDir, name, "configuration.nix")
+}
+
+// handleListSystemImages lists the versions of a system image, newest first
+func (s *Server) handleListSystemImages(w http.ResponseWriter, r *http.Request) {
+	name, ok := systemImageName(w, r)
+	if !ok {
+		return
+	}
+
+	images, err := s.db.ListSystemImages(name)
+	if err != nil {
+		respondInternalError(w, err, "failed to list system images")
+		return
+	}
+	if images == nil {
+		images = []*models.SystemImage{}
+	}
+
+	respondJSON(w, http.StatusOK, images)
+}
+
+// handleGetSystemImageConfig returns the NixOS configuration the next
+// version of a system image will be built from
+func (s *Server) handleGetSystemImageConfig(w http.ResponseWriter, r *http.Request) {
+	name, ok := systemImageName(w, r)
+	if !ok {
+		return
+	}
+
+	config, err := os.ReadFile(s.systemImageConfigPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		respondError(w, http.StatusNotFound, CodeSystemImageNotFound, "system image has no configuration")
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to read configuration")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.SystemImageConfig{Config: string(config)})
+}
+
+// handleUpdateSystemImageConfig replaces a system image's NixOS
+// configuration. When a builder is configured, configurations that don't
+// parse are refused.
+func (s *Server) handleUpdateSystemImageConfig(w http.ResponseWriter, r *http.Request) {
+	name, ok := systemImageName(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.SystemImageConfig
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Config == "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "config is required")
+		return
+	}
+
+	if s.builder != nil {
+		result, err := s.builder.Validate(r.Context(), req.Config)
+		if err != nil {
+			respondError(w, http.StatusBadGateway, CodeBuilderError, err.Error())
+			return
+		}
+		if !result.Valid {
+			respondError(w, http.StatusUnprocessableEntity, CodeConfigInvalid, result.Error)
+			return
+		}
+	}
+
+	// Builds read the file while it is replaced, so it never appears half
+	// written
+	path := s.systemImageConfigPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		respondInternalError(w, err, "failed to write configuration")
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".configuration-*.nix")
+	if err != nil {
+		respondInternalError(w, err, "failed to write configuration")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(req.Config)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to write configuration")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, req)
+}
+
+// handleBuildSystemImage queues a build of the next version of a system
+// image from its current configuration. The version is boot tested when
+// the build succeeds, and can be promoted once the test passes.
+func (s *Server) handleBuildSystemImage(w http.ResponseWriter, r *http.Request) {
+	name, ok := systemImageName(w, r)
+	if !ok {
+		return
+	}
+
+	config, err := os.ReadFile(s.systemImageConfigPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		respondError(w, http.StatusConflict, CodeConflict, "system image has no configuration")
+		return
+	}
+	if err != nil {
+		respondInternalError(w, err, "failed to read configuration")
+		return
+	}
+
+	var createdBy string
+	if claims, ok := auth.GetClaims(r); ok {
+		createdBy = claims.Username
+	}
+
+	image, _, err := s.db.CreateSystemImageBuild(name, string(config), createdBy)
+	if err != nil {
+		respondInternalError(w, err, "failed to create build")
+		return
+	}
+
+	log.Printf("Queued build %s of %s image version %d", image.BuildID, name, image.Version)
+	respondJSON(w, http.StatusAccepted, image)
+}
+
+// handlePromoteSystemImage makes a version of a system image the one the
+// iPXE server boots. Only versions whose boot test passed can be promoted.
+func (s *Server) handlePromoteSystemImage(w http.ResponseWriter, r *http.Request) {
+	name, ok := systemImageName(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeSystemImageNotFound, "system image version not found")
+		return
+	}
+
+	s.systemImagesMu.Lock()
+	defer s.systemImagesMu.Unlock()
+
+	image, err := s.db.GetSystemImage(name, version)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if image == nil {
+		respondError(w, http.StatusNotFound, CodeSystemImageNotFound, "system image version not found")
+		return
+	}
+	if image.Current {
+		respondError(w, http.StatusConflict, CodeConflict, "version is already current")
+		return
+	}
+	if image.Status != models.SystemImageReady {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("version is %s, not ready", image.Status))
+		return
+	}
+
+	if !s.promoteSystemImage(w, r, image, false) {
+		return
+	}
+	respondJSON(w, http.StatusOK, image)
+}
+
+// handleRollbackSystemImage promotes the version of a system image that was
+// current before the current one
+func (s *Server) handleRollbackSystemImage(w http.ResponseWriter, r *http.Request) {
+	name, ok := systemImageName(w, r)
+	if !ok {
+		return
+	}
+
+	s.systemImagesMu.Lock()
+	defer s.systemImagesMu.Unlock()
+
+	image, err := s.db.GetPreviousSystemImage(name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if image == nil {
+		respondError(w, http.StatusConflict, CodeConflict, "no previous version to roll back to")
+		return
+	}
+
+	if !s.promoteSystemImage(w, r, image, true) {
+		return
+	}
+	respondJSON(w, http.StatusOK, image)
+}
+
+// promoteSystemImage points the system image's current link at a version
+// and records it as current. The caller holds systemImagesMu.
+func (s *Server) promoteSystemImage(w http.ResponseWriter, r *http.Request, image *models.SystemImage, rollback bool) bool {
+	dir := filepath.Join(s.config.ImagesDir, image.Name)
+	for _, file := range systemImageFiles {
+		if _, err := os.Stat(filepath.Join(dir, strconv.Itoa(image.Version), file)); err != nil {
+			respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("version %d is missing %s", image.Version, file))
+			return false
+		}
+	}
+
+	previous, err := s.db.GetCurrentSystemImage(image.Name)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return false
+	}
+
+	// The iPXE server follows the link on every request, so it is replaced
+	// in one rename rather than removed and recreated
+	current := filepath.Join(dir, "current")
+	tmp := current + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(strconv.Itoa(image.Version), tmp); err != nil {
+		respondInternalError(w, err, "failed to promote version")
+		return false
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		os.Remove(tmp)
+		respondInternalError(w, err, "failed to promote version")
+		return false
+	}
+
+	if err := s.db.PromoteSystemImage(image); err != nil {
+		respondInternalError(w, err, "failed to promote version")
+		return false
+	}
+
+	data := events.RegistrationImageUpdatedData{
+		Version:  image.Version,
+		BuildID:  image.BuildID,
+		Rollback: rollback,
+	}
+	if previous != nil {
+		data.PreviousVersion = previous.Version
+	}
+	if claims, ok := auth.GetClaims(r); ok {
+		data.PromotedBy = claims.Username
+	}
+	log.Printf("Promoted %s image version %d", image.Name, image.Version)
+	s.publish(r.Context(), events.Event{
+		Type: events.SystemRegistrationImageUpdated,
+		Data: data,
+	})
+	return true
+}
+
+// applySystemImageTestResult moves a system image version waiting on its
+// boot test to ready or failed
+func (s *Server) applySystemImageTestResult(build *models.BuildRequest, test *models.ImageTest) {
+	image, err := s.db.GetSystemImageByBuild(build.ID)
+	if err != nil || image == nil {
+		log.Printf("Failed to get system image of build %s: %v", build.ID, err)
+		return
+	}
+	if image.Status != models.SystemImageTesting || image.TestID != test.ID {
+		return
+	}
+
+	if test.Status == "passed" {
+		image.Status = models.SystemImageReady
+	} else {
+		image.Status = models.SystemImageFailed
+		image.Error = test.Error
+		if image.Error == "" {
+			image.Error = "boot test failed"
+		}
+	}
+	if err := s.db.UpdateSystemImageStatus(image); err != nil {
+		log.Printf("Failed to update %s image version %d: %v", image.Name, image.Version, err)
+	}
+}
@@ -2,6 +2,8 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
@@ -13,14 +15,34 @@ import (
 // handleCreateTemplate creates a new machine template
 func (s *Server) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
 	var template models.MachineTemplate
-	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &template) {
 		return
 	}
 
 	// Validate required fields
 	if template.Name == "" || template.NixOSConfig == "" {
-		respondError(w, http.StatusBadRequest, "name and nixos_config are required")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "name and nixos_config are required")
+		return
+	}
+	if template.BMCConfig != nil {
+		if err := template.BMCConfig.ValidateIPMIOptions(); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if err := template.BMCConfig.NormalizeAddress(); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	if !validRequiredHardware(w, template.RequiredHardware) {
+		return
+	}
+	if template.BuildTarget != "" && !validBuildTarget(w, template.BuildTarget) {
+		return
+	}
+
+	if template.HasTag(models.TrustedTemplateTag) && !s.isAdmin(r) {
+		respondError(w, http.StatusForbidden, CodeForbidden, "only admins can create trusted templates")
 		return
 	}
 
@@ -39,16 +61,16 @@ func (s *Server) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
 	// Check if template with same name already exists
 	existing, err := s.db.GetTemplateByName(template.Name)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 	if existing != nil {
-		respondError(w, http.StatusConflict, "template with this name already exists")
+		respondError(w, http.StatusConflict, CodeAlreadyExists, "template with this name already exists")
 		return
 	}
 
 	if err := s.db.CreateTemplate(&template); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to create template")
+		respondInternalError(w, err, "failed to create template")
 		return
 	}
 
@@ -59,7 +81,7 @@ func (s *Server) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleListTemplates(w http.ResponseWriter, r *http.Request) {
 	templates, err := s.db.ListTemplates()
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list templates")
+		respondInternalError(w, err, "failed to list templates")
 		return
 	}
 
@@ -73,12 +95,12 @@ func (s *Server) handleGetTemplate(w http.ResponseWriter, r *http.Request) {
 
 	template, err := s.db.GetTemplate(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if template == nil {
-		respondError(w, http.StatusNotFound, "template not found")
+		respondError(w, http.StatusNotFound, CodeTemplateNotFound, "template not found")
 		return
 	}
 
@@ -92,18 +114,24 @@ func (s *Server) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
 
 	template, err := s.db.GetTemplate(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if template == nil {
-		respondError(w, http.StatusNotFound, "template not found")
+		respondError(w, http.StatusNotFound, CodeTemplateNotFound, "template not found")
 		return
 	}
 
 	var updates models.MachineTemplate
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &updates) {
+		return
+	}
+
+	// Builds of trusted templates don't wait for approval, so only admins
+	// can change what they build
+	if (template.HasTag(models.TrustedTemplateTag) || updates.HasTag(models.TrustedTemplateTag)) && !s.isAdmin(r) {
+		respondError(w, http.StatusForbidden, CodeForbidden, "only admins can change trusted templates")
 		return
 	}
 
@@ -112,11 +140,11 @@ func (s *Server) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
 		// Check if new name conflicts
 		existing, err := s.db.GetTemplateByName(updates.Name)
 		if err != nil {
-			respondError(w, http.StatusInternalServerError, "database error")
+			respondInternalError(w, err, "database error")
 			return
 		}
 		if existing != nil {
-			respondError(w, http.StatusConflict, "template with this name already exists")
+			respondError(w, http.StatusConflict, CodeAlreadyExists, "template with this name already exists")
 			return
 		}
 		template.Name = updates.Name
@@ -128,6 +156,14 @@ func (s *Server) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
 		template.NixOSConfig = updates.NixOSConfig
 	}
 	if updates.BMCConfig != nil {
+		if err := updates.BMCConfig.ValidateIPMIOptions(); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if err := updates.BMCConfig.NormalizeAddress(); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
 		template.BMCConfig = updates.BMCConfig
 	}
 	if updates.Tags != nil {
@@ -136,103 +172,82 @@ func (s *Server) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
 	if updates.Variables != nil {
 		template.Variables = updates.Variables
 	}
+	if updates.RequiredHardware != nil {
+		if !validRequiredHardware(w, updates.RequiredHardware) {
+			return
+		}
+		template.RequiredHardware = updates.RequiredHardware
+	}
+	if updates.BuildTarget != "" {
+		if !validBuildTarget(w, updates.BuildTarget) {
+			return
+		}
+		template.BuildTarget = updates.BuildTarget
+	}
 
 	if err := s.db.UpdateTemplate(template); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to update template")
+		respondInternalError(w, err, "failed to update template")
 		return
 	}
 
 	respondJSON(w, http.StatusOK, template)
 }
 
+// validRequiredHardware responds with 400 and returns false if a template
+// requires a hardware field that isn't one of models.HardwareFields
+func validRequiredHardware(w http.ResponseWriter, fields []string) bool {
+	for _, field := range fields {
+		if !models.IsHardwareField(field) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest,
+				fmt.Sprintf("required_hardware: %q is not one of %s", field, strings.Join(models.HardwareFields, ", ")))
+			return false
+		}
+	}
+	return true
+}
+
+// validBuildTarget responds with 400 and returns false if a template's
+// build target isn't one of models.BuildTargets
+func validBuildTarget(w http.ResponseWriter, target string) bool {
+	if !models.IsValidBuildTarget(target) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest,
+			fmt.Sprintf("build_target must be one of %s", strings.Join(models.BuildTargets, ", ")))
+		return false
+	}
+	return true
+}
+
 // handleDeleteTemplate deletes a template
 func (s *Server) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
 	if err := s.db.DeleteTemplate(id); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to delete template")
+		respondInternalError(w, err, "failed to delete template")
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// handleApplyTemplate applies a template to a machine
+// handleApplyTemplate applies a template to a machine. The optional body
+// sets the template's variables.
 func (s *Server) handleApplyTemplate(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	machineID := vars["id"]
-	templateID := vars["template_id"]
 
-	// Get machine
-	machine, err := s.db.GetMachine(machineID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
-		return
-	}
-	if machine == nil {
-		respondError(w, http.StatusNotFound, "machine not found")
+	var req models.ApplyTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		if !respondBodyError(w, err) {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request body")
+		}
 		return
 	}
 
-	// Get template
-	template, err := s.db.GetTemplate(templateID)
+	machine, err := s.service.ApplyTemplate(r.Context(), vars["id"], vars["template_id"], req.Variables)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondServiceError(w, err, "failed to apply template")
 		return
 	}
-	if template == nil {
-		respondError(w, http.StatusNotFound, "template not found")
-		return
-	}
-
-	// Apply template configuration
-	config := template.NixOSConfig
-
-	// Replace variables if present
-	if template.Variables != nil {
-		var variables map[string]string
-		if err := json.Unmarshal(template.Variables, &variables); err == nil {
-			// Replace placeholders in config
-			for key, value := range variables {
-				// Check if machine has this variable in its hardware info or hostname
-				actualValue := value
-				switch key {
-				case "hostname":
-					if machine.Hostname != "" {
-						actualValue = machine.Hostname
-					}
-				case "service_tag":
-					actualValue = machine.ServiceTag
-				case "mac_address":
-					actualValue = machine.MACAddress
-				}
-				config = strings.ReplaceAll(config, "{{"+key+"}}", actualValue)
-			}
-		}
-	}
-
-	// Update machine configuration
-	machine.NixOSConfig = config
-	machine.Status = models.StatusConfigured
-
-	// Apply BMC config if template has it and machine doesn't
-	if template.BMCConfig != nil && machine.BMCInfo == nil {
-		machine.BMCInfo = template.BMCConfig
-	}
-
-	if err := s.db.UpdateMachine(machine); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to update machine")
-		return
-	}
-
-	// Trigger event
-	if s.webhookService != nil {
-		s.webhookService.TriggerEvent("machine.template_applied", map[string]interface{}{
-			"machine_id":  machine.ID,
-			"template_id": template.ID,
-		})
-	}
 
 	respondJSON(w, http.StatusOK, machine)
 }
@@ -0,0 +1,268 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// reportWipe posts a wipe status update with token and returns the
+// response's status and, if it succeeded, the job
+func reportWipe(t *testing.T, env *testutil.Env, token, machineID, jobID string, update models.WipeStatusUpdate) (int, *models.WipeJob) {
+	t.Helper()
+
+	resp := env.DoToken(token, http.MethodPost, "/api/v1/machines/"+machineID+"/wipe/"+jobID+"/status", update)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	var job models.WipeJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatalf("decode wipe job: %v", err)
+	}
+	return resp.StatusCode, &job
+}
+
+// startWipe requests a wipe of the machine as an operator and fetches the
+// job's wipe token the way the iPXE server does
+func startWipe(t *testing.T, env *testutil.Env, machineID string) (string, string) {
+	t.Helper()
+
+	var job models.WipeJob
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+machineID+"/wipe", nil, http.StatusCreated, &job)
+
+	var token struct {
+		JobID string `json:"job_id"`
+		Token string `json:"token"`
+	}
+	env.MustJSON(models.RoleOperator, http.MethodGet, "/api/v1/machines/"+machineID+"/wipe/active/token", nil, http.StatusOK, &token)
+	if token.JobID != job.ID || token.Token == "" {
+		t.Fatalf("wipe token = %+v, want one for job %s", token, job.ID)
+	}
+	return job.ID, token.Token
+}
+
+// finishWipe reports a wipe through to completion as the wipe image does:
+// the first report starts the job and hands the image its plan
+func finishWipe(t *testing.T, env *testutil.Env, token, machineID, jobID string) {
+	t.Helper()
+
+	status, started := reportWipe(t, env, token, machineID, jobID, models.WipeStatusUpdate{Status: models.WipeRunning})
+	if status != http.StatusOK {
+		t.Fatalf("first report: status = %d, want 200", status)
+	}
+	if started.Status != models.WipeRunning || len(started.Disks) != 2 {
+		t.Fatalf("started job = %s with %d disks, want running with 2", started.Status, len(started.Disks))
+	}
+
+	var disks []models.WipeDisk
+	for _, disk := range started.Disks {
+		disks = append(disks, models.WipeDisk{Serial: disk.Serial, Device: disk.Device, Status: models.WipeCompleted})
+	}
+	status, done := reportWipe(t, env, token, machineID, jobID, models.WipeStatusUpdate{Status: models.WipeCompleted, Disks: disks})
+	if status != http.StatusOK || done.Status != models.WipeCompleted {
+		t.Fatalf("final report: status = %d, job = %+v", status, done)
+	}
+
+	var got models.Machine
+	env.MustJSON(models.RoleOperator, http.MethodGet, "/api/v1/machines/"+machineID, nil, http.StatusOK, &got)
+	if got.Status != models.StatusEnrolled {
+		t.Errorf("machine status = %s, want enrolled", got.Status)
+	}
+}
+
+// startDiagnostics runs a diagnostic profile on the machine as an operator
+// and fetches the run's diagnostics token the way the iPXE server does
+func startDiagnostics(t *testing.T, env *testutil.Env, machineID string) (string, string) {
+	t.Helper()
+
+	kernel := &models.BootAsset{Name: "memtest.efi", Kind: models.BootAssetKernel, SHA256: strings.Repeat("a", 64)}
+	if err := env.DB.CreateBootAsset(kernel); err != nil {
+		t.Fatal(err)
+	}
+	profile := &models.DiagnosticProfile{Name: "memtest-" + machineID, KernelAssetID: kernel.ID}
+	if err := env.DB.CreateDiagnosticProfile(profile); err != nil {
+		t.Fatal(err)
+	}
+
+	var run models.DiagnosticRun
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+machineID+"/diagnostics",
+		models.StartDiagnosticsRequest{ProfileID: profile.ID, DurationMinutes: 60}, http.StatusCreated, &run)
+
+	var token struct {
+		RunID string `json:"run_id"`
+		Token string `json:"token"`
+	}
+	env.MustJSON(models.RoleOperator, http.MethodGet, "/api/v1/machines/"+machineID+"/diagnostics/"+run.ID+"/token", nil, http.StatusOK, &token)
+	if token.RunID != run.ID || token.Token == "" {
+		t.Fatalf("diagnostics token = %+v, want one for run %s", token, run.ID)
+	}
+	return run.ID, token.Token
+}
+
+// postResults posts diagnostic results with token and returns the status
+func postResults(env *testutil.Env, token, machineID, runID string) int {
+	resp := env.DoToken(token, http.MethodPost, "/api/v1/machines/"+machineID+"/diagnostics/"+runID+"/results",
+		models.DiagnosticResults{Passed: true})
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func diagnosticRun(t *testing.T, env *testutil.Env, machineID, runID string) models.DiagnosticRun {
+	t.Helper()
+
+	var run models.DiagnosticRun
+	env.MustJSON(models.RoleOperator, http.MethodGet, "/api/v1/machines/"+machineID+"/diagnostics/"+runID, nil, http.StatusOK, &run)
+	return run
+}
+
+// audience is a kind of token that signs one resource's ID for an image
+// to report on the resource with, and no more
+type audience struct {
+	name     string
+	generate func(m *auth.JWTManager, id string) string
+
+	// start creates a resource of the machine and returns its ID and
+	// token; tokenPath, if set, is where the token is fetched
+	start     func(t *testing.T, env *testutil.Env, machineID string) (string, string)
+	tokenPath func(machineID, id string) string
+
+	// report makes the request the token authorizes and returns its
+	// status; untouched reports whether the resource is as it was
+	// before any report
+	report    func(env *testutil.Env, token, machineID, id string) int
+	untouched func(t *testing.T, env *testutil.Env, machineID, id string) bool
+
+	// finish reports on the resource with its token until it is done;
+	// spent is set if a done resource takes no more reports
+	finish func(t *testing.T, env *testutil.Env, token, machineID, id string)
+	spent  bool
+}
+
+var audiences = []audience{
+	{
+		name:     "wipe",
+		generate: (*auth.JWTManager).GenerateWipeToken,
+		start:    startWipe,
+		tokenPath: func(machineID, _ string) string {
+			return "/api/v1/machines/" + machineID + "/wipe/active/token"
+		},
+		report: func(env *testutil.Env, token, machineID, id string) int {
+			resp := env.DoToken(token, http.MethodPost, "/api/v1/machines/"+machineID+"/wipe/"+id+"/status",
+				models.WipeStatusUpdate{Status: models.WipeCompleted})
+			resp.Body.Close()
+			return resp.StatusCode
+		},
+		untouched: func(t *testing.T, env *testutil.Env, machineID, id string) bool {
+			var job models.WipeJob
+			env.MustJSON(models.RoleOperator, http.MethodGet, "/api/v1/machines/"+machineID+"/wipe/"+id, nil, http.StatusOK, &job)
+			return job.Status == models.WipePending
+		},
+		finish: finishWipe,
+		spent:  true,
+	},
+	{
+		name:     "diagnostics",
+		generate: (*auth.JWTManager).GenerateDiagnosticsToken,
+		start:    startDiagnostics,
+		tokenPath: func(machineID, id string) string {
+			return "/api/v1/machines/" + machineID + "/diagnostics/" + id + "/token"
+		},
+		report: postResults,
+		untouched: func(t *testing.T, env *testutil.Env, machineID, id string) bool {
+			return diagnosticRun(t, env, machineID, id).Status == models.DiagnosticsRunning
+		},
+		finish: func(t *testing.T, env *testutil.Env, token, machineID, id string) {
+			if status := postResults(env, token, machineID, id); status != http.StatusOK {
+				t.Fatalf("results with the run's token: status = %d, want 200", status)
+			}
+			if run := diagnosticRun(t, env, machineID, id); run.Status != models.DiagnosticsCompleted || run.Results == nil || !run.Results.Passed {
+				t.Errorf("run after results = %+v, want completed and passed", run)
+			}
+		},
+		spent: true,
+	},
+	{
+		name:     "hooks",
+		generate: (*auth.JWTManager).GenerateHooksToken,
+		start: func(t *testing.T, env *testutil.Env, machineID string) (string, string) {
+			return machineID, env.JWTManager().GenerateHooksToken(machineID)
+		},
+		report: func(env *testutil.Env, token, machineID, _ string) int {
+			resp := env.DoToken(token, http.MethodGet, "/api/v1/machines/"+machineID+"/hooks/next", nil)
+			resp.Body.Close()
+			return resp.StatusCode
+		},
+		finish: func(t *testing.T, env *testutil.Env, token, machineID, id string) {
+			resp := env.DoToken(token, http.MethodGet, "/api/v1/machines/"+machineID+"/hooks/next", nil)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("next hook with the machine's token: status = %d, want 200", resp.StatusCode)
+			}
+		},
+	},
+}
+
+// TestScopedTokens checks each audience's token passes for its own
+// resource alone: not for another resource, not as another audience's
+// token for the same ID, and not as a login, nor logins as it
+func TestScopedTokens(t *testing.T) {
+	env := testutil.New(t)
+
+	for i, a := range audiences {
+		t.Run(a.name, func(t *testing.T) {
+			machine := env.EnrollMachine("SCOPED" + string(rune('A'+2*i)))
+			other := env.EnrollMachine("SCOPED" + string(rune('B'+2*i)))
+			id, token := a.start(t, env, machine.ID)
+			_, otherToken := a.start(t, env, other.ID)
+
+			// Only operators get the token
+			if a.tokenPath != nil {
+				env.MustJSON(models.RoleViewer, http.MethodGet, a.tokenPath(machine.ID, id), nil, http.StatusForbidden, nil)
+			}
+
+			forged := map[string]string{
+				"no token":         "",
+				"viewer login":     env.Tokens[models.RoleViewer],
+				"admin login":      env.Tokens[models.RoleAdmin],
+				"other's token":    otherToken,
+				"truncated token":  token[:len(token)-1],
+				"token of nothing": "not-a-token",
+			}
+			for _, b := range audiences {
+				if b.name != a.name {
+					forged[b.name+" token for the same ID"] = b.generate(env.JWTManager(), id)
+				}
+			}
+			for name, bearer := range forged {
+				if status := a.report(env, bearer, machine.ID, id); status != http.StatusUnauthorized {
+					t.Errorf("%s: status = %d, want 401", name, status)
+				}
+			}
+			if a.untouched != nil && !a.untouched(t, env, machine.ID, id) {
+				t.Error("rejected reports changed the resource")
+			}
+
+			// The token is no login
+			resp := env.DoToken(token, http.MethodGet, "/api/v1/machines/"+machine.ID, nil)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("GET machine with the token: status = %d, want 401", resp.StatusCode)
+			}
+
+			// Its own token does
+			a.finish(t, env, token, machine.ID, id)
+			if a.spent {
+				if status := a.report(env, token, machine.ID, id); status != http.StatusConflict {
+					t.Errorf("report when done: status = %d, want 409", status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+// What happens when a machine enrolls with the service tag of a machine in
+// the trash
+const (
+	// TrashedEnrollmentBlock rejects the enrollment until an operator
+	// restores the machine or deletes it permanently
+	TrashedEnrollmentBlock = "block"
+
+	// TrashedEnrollmentRestore restores the machine and enrolls it as a
+	// returning machine
+	TrashedEnrollmentRestore = "restore"
+)
+
+// trashPurgeTick is how often machines past the trash retention are purged
+const trashPurgeTick = time.Hour
+
+// handleDeleteMachine moves a machine to the trash. With ?hard=true, which
+// only admins may pass, it deletes the machine permanently instead, in or
+// out of the trash.
+func (s *Server) handleDeleteMachine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	hard := r.URL.Query().Get("hard") == "true"
+	if hard && s.config.EnableAuth {
+		claims, ok := auth.GetClaims(r)
+		if !ok || claims.Role != models.RoleAdmin {
+			respondError(w, http.StatusForbidden, CodeForbidden, "only admins can delete machines permanently")
+			return
+		}
+	}
+
+	if !s.checkMaintenance(w, r, []string{id}, models.MaintenanceOpDelete) {
+		return
+	}
+
+	if hard {
+		s.deleteMachinePermanently(w, r, id)
+		return
+	}
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if err := s.trashMachine(r.Context(), machine); err != nil {
+		respondInternalError(w, err, "failed to delete machine")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashMachine moves a machine to the trash, cancels its pending builds and
+// deployments, and publishes machine.deleted
+func (s *Server) trashMachine(ctx context.Context, machine *models.Machine) error {
+	trashed, err := s.db.TrashMachine(machine.ID)
+	if err != nil {
+		return err
+	}
+	if !trashed {
+		return fmt.Errorf("machine %s is already in the trash", machine.ID)
+	}
+
+	cancelled, err := s.db.CancelPendingBuilds(machine.ID)
+	if err != nil {
+		log.Printf("Failed to cancel builds for deleted machine %s: %v", machine.ID, err)
+	}
+	if _, err := s.db.CancelPendingDeployments(machine.ID); err != nil {
+		log.Printf("Failed to cancel deployments for deleted machine %s: %v", machine.ID, err)
+	}
+
+	log.Printf("Moved machine %s (service_tag: %s) to the trash", machine.ID, machine.ServiceTag)
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineDeleted,
+		MachineID: machine.ID,
+		Data: events.DeletedData{
+			Permanent:       false,
+			ServiceTag:      machine.ServiceTag,
+			CancelledBuilds: cancelled,
+		},
+	})
+
+	return nil
+}
+
+// deleteMachinePermanently deletes a machine, in or out of the trash, with
+// everything that belongs to it
+func (s *Server) deleteMachinePermanently(w http.ResponseWriter, r *http.Request, id string) {
+	machine, err := s.db.GetMachine(id)
+	if err == nil && machine == nil {
+		machine, err = s.db.GetTrashedMachine(id)
+	}
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if err := s.db.DeleteMachine(id); err != nil {
+		respondInternalError(w, err, "failed to delete machine")
+		return
+	}
+
+	log.Printf("Permanently deleted machine %s (service_tag: %s)", machine.ID, machine.ServiceTag)
+	s.removeUnusedAttachments()
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineDeleted,
+		MachineID: id,
+		Data: events.DeletedData{
+			Permanent:  true,
+			ServiceTag: machine.ServiceTag,
+		},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListTrash lists the machines in the trash, most recently deleted
+// first
+func (s *Server) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	machines, err := s.db.ListMachineSummaries(database.MachineFilter{Trashed: true, VisibleTo: visibleTo(r)})
+	if err != nil {
+		respondInternalError(w, err, "failed to list trash")
+		return
+	}
+
+	if machines == nil {
+		machines = []*models.MachineSummary{}
+	}
+
+	respondJSON(w, http.StatusOK, machines)
+}
+
+// handleRestoreMachine takes a machine out of the trash
+func (s *Server) handleRestoreMachine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	machine, err := s.db.GetTrashedMachine(vars["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found in the trash")
+		return
+	}
+
+	if err := s.service.RestoreMachine(r.Context(), machine, ""); err != nil {
+		respondInternalError(w, err, "failed to restore machine")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, machine)
+}
+
+// StartTrashPurger permanently deletes machines once they have been in the
+// trash for longer than retention
+func (s *Server) StartTrashPurger(retention time.Duration) {
+	go func() {
+		log.Printf("Trash purger started (retention: %s)", retention)
+
+		ticker := time.NewTicker(trashPurgeTick)
+		defer ticker.Stop()
+
+		for {
+			if s.leadJob("trash-purger", trashPurgeTick) {
+				s.purgeTrash(retention)
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// purgeTrash permanently deletes machines moved to the trash longer than
+// retention ago
+func (s *Server) purgeTrash(retention time.Duration) {
+	purged, err := s.db.PurgeTrashedMachines(time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Trash purger failed: %v", err)
+	}
+	if len(purged) > 0 {
+		s.removeUnusedAttachments()
+	}
+	for _, id := range purged {
+		log.Printf("Permanently deleted machine %s after trash retention period", id)
+		s.publish(context.Background(), events.Event{
+			Type:      events.MachineDeleted,
+			MachineID: id,
+			Data: events.DeletedData{
+				Permanent: true,
+				Reason:    "trash retention expired",
+			},
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// handleCreateMachine creates a virtual machine from the full definition
+// in the request, hardware included, for pipelines that exercise
+// enrollment, configuration, and builds without hardware. Real machines
+// are only ever created by enrolling.
+func (s *Server) handleCreateMachine(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateMachineRequest
+	if !decodeStrictJSON(w, r, &req) {
+		return
+	}
+
+	machine, err := s.service.CreateVirtualMachine(r.Context(), req)
+	if err != nil {
+		respondServiceError(w, err, "failed to create machine")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, machine)
+}
+
+// handleDeleteVirtualMachines permanently deletes virtual machines in bulk:
+// ?virtual=true is required, and ?older_than= limits it to machines
+// created longer ago than a duration, such as 24h
+func (s *Server) handleDeleteVirtualMachines(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("virtual") != "true" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "virtual=true is required; only virtual machines can be deleted in bulk")
+		return
+	}
+
+	var olderThan time.Duration
+	if olderStr := query.Get("older_than"); olderStr != "" {
+		d, err := time.ParseDuration(olderStr)
+		if err != nil || d < 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "older_than must be a duration, e.g. 24h")
+			return
+		}
+		olderThan = d
+	}
+
+	purged, err := s.service.PurgeVirtualMachines(r.Context(), olderThan)
+	if len(purged) > 0 {
+		s.removeUnusedAttachments()
+	}
+	if err != nil {
+		respondInternalError(w, err, fmt.Sprintf("failed to delete virtual machines after deleting %d", len(purged)))
+		return
+	}
+
+	if purged == nil {
+		purged = []string{}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"deleted":     len(purged),
+		"machine_ids": purged,
+	})
+}
+
+// virtualFilter parses the virtual machine listing filter: true lists only
+// virtual machines, false or nothing only real ones, and all both
+func virtualFilter(value string) (*bool, error) {
+	if value == "" {
+		virtual := false
+		return &virtual, nil
+	}
+	if value == "all" {
+		return nil, nil
+	}
+	virtual, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("virtual must be true, false, or all")
+	}
+	return &virtual, nil
+}
+
+// simulatePower records a power operation on a virtual machine, which
+// succeeds without reaching anything, and the power state it leaves the
+// machine in
+func (s *Server) simulatePower(w http.ResponseWriter, machine *models.Machine, operation, userID string) {
+	var state string
+	switch operation {
+	case "on", "reset", "cycle":
+		state = models.PowerStateOn
+	case "off":
+		state = models.PowerStateOff
+	case "status":
+		state = machine.PowerState
+		if state == "" || state == models.PowerStateUnknown {
+			state = models.PowerStateOff
+		}
+	default:
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("unsupported operation: %s", operation))
+		return
+	}
+
+	now := time.Now()
+	powerOp := &models.PowerOperation{
+		MachineID:   machine.ID,
+		Operation:   operation,
+		Method:      models.PowerMethodSimulated,
+		Status:      "pending",
+		InitiatedBy: userID,
+	}
+	if err := s.db.CreatePowerOperation(powerOp); err != nil {
+		respondInternalError(w, err, "failed to create power operation")
+		return
+	}
+
+	powerOp.Status = "success"
+	powerOp.Result = "simulated: virtual machine is " + state
+	powerOp.CompletedAt = &now
+	s.finishPowerOperation(powerOp)
+	s.recordPowerState(machine.ID, state, operationActor(powerOp))
+	if operation != "status" {
+		s.publishPowerOperation(powerOp)
+	}
+
+	respondJSON(w, http.StatusOK, powerOp)
+}
@@ -1,25 +1,57 @@
 package api
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/netguard"
 	"github.com/gorilla/mux"
 )
 
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 1000
+)
+
+// webhookStatsWindow is how far back a webhook's delivery stats go
+const webhookStatsWindow = 24 * time.Hour
+
+// SetWebhookSleeper has webhook deliveries wait between attempts through
+// sleep, such as one that records the waits, instead of sleeping
+func (s *Server) SetWebhookSleeper(sleep func(time.Duration)) {
+	s.webhookService.SetSleeper(sleep)
+}
+
 // handleCreateWebhook creates a new webhook
 func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
 	var webhook models.Webhook
-	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &webhook) {
 		return
 	}
 
 	// Validate required fields
 	if webhook.Name == "" || webhook.URL == "" || len(webhook.Events) == 0 {
-		respondError(w, http.StatusBadRequest, "name, url, and events are required")
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "name, url, and events are required")
+		return
+	}
+
+	if webhook.SchemaVersion == "" {
+		webhook.SchemaVersion = events.SchemaVersion
+	}
+	if webhook.Format == "" {
+		webhook.Format = models.WebhookFormatDefault
+	}
+
+	if !validSubscribedEvents(w, webhook.Events) || !validSchemaVersion(w, webhook.SchemaVersion) ||
+		!validWebhookFormat(w, webhook.Format) || !validDisableAfter(w, webhook.DisableAfterSeconds) ||
+		!validRetryPolicy(w, webhook.Retry) || !s.validWebhookScope(w, &webhook) || !s.validWebhookURL(w, r, &webhook) {
 		return
 	}
 
@@ -31,40 +63,157 @@ func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
 		webhook.MaxRetries = 3
 	}
 
+	// A new webhook starts active, without a failure streak
+	webhook.ConsecutiveFailures = 0
+	webhook.FailingSince = nil
+	webhook.AutoDisabledAt = nil
+	webhook.DisabledReason = ""
+
 	if err := s.db.CreateWebhook(&webhook); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to create webhook")
+		respondInternalError(w, err, "failed to create webhook")
 		return
 	}
+	s.setFailureLimit(&webhook)
 
 	respondJSON(w, http.StatusCreated, webhook)
 }
 
-// handleListWebhooks lists all webhooks
+// validSchemaVersion responds with 400 and returns false if a webhook pins
+// a payload schema version that doesn't exist
+func validSchemaVersion(w http.ResponseWriter, version string) bool {
+	if !events.IsSupportedSchema(version) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest,
+			fmt.Sprintf("schema_version must be one of %s", strings.Join(events.SchemaVersions, ", ")))
+		return false
+	}
+	return true
+}
+
+// validWebhookFormat responds with 400 and returns false if a webhook's
+// delivery format doesn't exist
+func validWebhookFormat(w http.ResponseWriter, format string) bool {
+	if !models.IsValidWebhookFormat(format) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest,
+			fmt.Sprintf("format must be %s or %s", models.WebhookFormatDefault, models.WebhookFormatCloudEvents))
+		return false
+	}
+	return true
+}
+
+// validDisableAfter responds with 400 and returns false if a webhook's
+// failure streak must last a negative time before it is deactivated
+func validDisableAfter(w http.ResponseWriter, seconds int) bool {
+	if seconds < 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "disable_after_seconds must not be negative")
+		return false
+	}
+	return true
+}
+
+// validRetryPolicy responds with 400 and returns false if a webhook's
+// retry policy is invalid or overrides an event type that doesn't exist
+func validRetryPolicy(w http.ResponseWriter, policy *models.WebhookRetryPolicy) bool {
+	if policy == nil {
+		return true
+	}
+	if err := policy.Validate(events.IsKnown); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// setFailureLimit sets the failure streak a webhook is deactivated at, for
+// clients to warn about webhooks close to it
+func (s *Server) setFailureLimit(webhook *models.Webhook) {
+	webhook.FailureLimit, _ = s.webhookService.FailureLimit(webhook)
+}
+
+// validWebhookScope responds with 400 and returns false if a webhook is
+// scoped to a group that doesn't exist or to an invalid tag. Tags are
+// normalized.
+func (s *Server) validWebhookScope(w http.ResponseWriter, webhook *models.Webhook) bool {
+	tags, err := models.NormalizeTags(webhook.Tags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return false
+	}
+	webhook.Tags = tags
+
+	for _, id := range webhook.GroupIDs {
+		group, err := s.db.GetGroup(id)
+		if err != nil {
+			respondInternalError(w, err, "database error")
+			return false
+		}
+		if group == nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "group "+id+" does not exist")
+			return false
+		}
+	}
+	return true
+}
+
+// validWebhookURL responds and returns false if a webhook's URL is not one
+// the server may deliver to. Only admins may let a webhook reach private
+// networks.
+func (s *Server) validWebhookURL(w http.ResponseWriter, r *http.Request, webhook *models.Webhook) bool {
+	if webhook.AllowPrivateNetworks && s.config.EnableAuth {
+		claims, ok := auth.GetClaims(r)
+		if !ok || claims.Role != models.RoleAdmin {
+			respondError(w, http.StatusForbidden, CodeForbidden, "only admins can allow webhooks to reach private networks")
+			return false
+		}
+	}
+
+	guard := netguard.New(netguard.Policy{
+		AllowHTTP:    s.config.WebhookAllowHTTP,
+		AllowPrivate: webhook.AllowPrivateNetworks,
+	})
+	if _, err := guard.CheckURL(r.Context(), webhook.URL); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "url: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// handleListWebhooks lists all webhooks, with their failure streaks
 func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
 	webhooks, err := s.db.ListWebhooks()
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list webhooks")
+		respondInternalError(w, err, "failed to list webhooks")
 		return
 	}
+	for _, webhook := range webhooks {
+		s.setFailureLimit(webhook)
+	}
 
 	respondJSON(w, http.StatusOK, webhooks)
 }
 
-// handleGetWebhook retrieves a single webhook
+// handleGetWebhook retrieves a single webhook, with stats of its
+// deliveries in the last day
 func (s *Server) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
 	webhook, err := s.db.GetWebhook(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if webhook == nil {
-		respondError(w, http.StatusNotFound, "webhook not found")
+		respondError(w, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
+		return
+	}
+
+	webhook.Stats, err = s.db.GetWebhookDeliveryStats(webhook.ID, time.Now().Add(-webhookStatsWindow))
+	if err != nil {
+		respondInternalError(w, err, "failed to compute delivery stats")
 		return
 	}
+	s.setFailureLimit(webhook)
 
 	respondJSON(w, http.StatusOK, webhook)
 }
@@ -76,18 +225,17 @@ func (s *Server) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
 
 	webhook, err := s.db.GetWebhook(id)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "database error")
+		respondInternalError(w, err, "database error")
 		return
 	}
 
 	if webhook == nil {
-		respondError(w, http.StatusNotFound, "webhook not found")
+		respondError(w, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
 		return
 	}
 
 	var updates models.Webhook
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !decodeJSON(w, r, &updates) {
 		return
 	}
 
@@ -99,6 +247,9 @@ func (s *Server) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
 		webhook.URL = updates.URL
 	}
 	if len(updates.Events) > 0 {
+		if !validSubscribedEvents(w, updates.Events) {
+			return
+		}
 		webhook.Events = updates.Events
 	}
 	if updates.Secret != "" {
@@ -114,11 +265,59 @@ func (s *Server) handleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
 	if updates.MaxRetries > 0 {
 		webhook.MaxRetries = updates.MaxRetries
 	}
+	// The retry policy is replaced when given; an empty one restores the
+	// defaults
+	if updates.Retry != nil {
+		if !validRetryPolicy(w, updates.Retry) {
+			return
+		}
+		webhook.Retry = updates.Retry
+	}
+	// Scoping is replaced when given; an empty list removes it
+	if updates.GroupIDs != nil {
+		webhook.GroupIDs = updates.GroupIDs
+	}
+	if updates.Statuses != nil {
+		webhook.Statuses = updates.Statuses
+	}
+	if updates.Tags != nil {
+		webhook.Tags = updates.Tags
+	}
+	if updates.Fields != nil {
+		webhook.Fields = updates.Fields
+	}
+	if updates.SchemaVersion != "" {
+		if !validSchemaVersion(w, updates.SchemaVersion) {
+			return
+		}
+		webhook.SchemaVersion = updates.SchemaVersion
+	}
+	if updates.Format != "" {
+		if !validWebhookFormat(w, updates.Format) {
+			return
+		}
+		webhook.Format = updates.Format
+	}
+	webhook.AllowPrivateNetworks = updates.AllowPrivateNetworks
+	if updates.DisableAfterFailures != 0 {
+		webhook.DisableAfterFailures = updates.DisableAfterFailures
+	}
+	if updates.DisableAfterSeconds != 0 {
+		if !validDisableAfter(w, updates.DisableAfterSeconds) {
+			return
+		}
+		webhook.DisableAfterSeconds = updates.DisableAfterSeconds
+	}
+
+	if !s.validWebhookScope(w, webhook) || !s.validWebhookURL(w, r, webhook) {
+		return
+	}
 
 	if err := s.db.UpdateWebhook(webhook); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to update webhook")
+		respondInternalError(w, err, "failed to update webhook")
 		return
 	}
+	s.setFailureLimit(webhook)
 
 	respondJSON(w, http.StatusOK, webhook)
 }
@@ -129,31 +328,152 @@ func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	if err := s.db.DeleteWebhook(id); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to delete webhook")
+		respondInternalError(w, err, "failed to delete webhook")
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// handleListWebhookDeliveries lists deliveries for a webhook
+// handleTestWebhook sends a test event to a webhook, in its format, and
+// returns the delivery
+func (s *Server) handleTestWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := s.db.GetWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if webhook == nil {
+		respondError(w, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
+		return
+	}
+
+	delivery, err := s.webhookService.Test(webhook)
+	if err != nil {
+		respondInternalError(w, err, "failed to send test delivery")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, delivery)
+}
+
+// handleReactivateWebhook sends a test delivery to a webhook and, if it
+// succeeds, activates the webhook with its failure streak cleared. If it
+// fails, the webhook is left as it was.
+func (s *Server) handleReactivateWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := s.db.GetWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if webhook == nil {
+		respondError(w, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
+		return
+	}
+
+	delivery, err := s.webhookService.Test(webhook)
+	if err != nil {
+		respondInternalError(w, err, "failed to send test delivery")
+		return
+	}
+	if !delivery.Success {
+		respondError(w, http.StatusConflict, CodeConflict,
+			fmt.Sprintf("test delivery failed, webhook not reactivated: %s", delivery.Error))
+		return
+	}
+
+	if err := s.db.ReactivateWebhook(webhook.ID); err != nil {
+		respondInternalError(w, err, "failed to reactivate webhook")
+		return
+	}
+
+	webhook, err = s.db.GetWebhook(webhook.ID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if webhook == nil {
+		respondError(w, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
+		return
+	}
+	s.setFailureLimit(webhook)
+
+	respondJSON(w, http.StatusOK, webhook)
+}
+
+// handleListWebhookDeliveries lists a webhook's deliveries newest first,
+// filtered by the success, since, and until query parameters. since and
+// until take an RFC 3339 time or a duration before now. When the page is
+// full, the X-Next-Cursor header carries the cursor for the following page.
 func (s *Server) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+	webhook, err := s.db.GetWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if webhook == nil {
+		respondError(w, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := database.WebhookDeliveryFilter{
+		WebhookID: webhook.ID,
+		Limit:     defaultDeliveryLimit,
+	}
 
-	limitStr := r.URL.Query().Get("limit")
-	limit := 50
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+	if value := query.Get("success"); value != "" {
+		success, err := strconv.ParseBool(value)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "success must be true or false")
+			return
 		}
+		filter.Success = &success
+	}
+	if filter.Since, err = parseEventTime(query.Get("since")); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid since: %v", err))
+		return
+	}
+	if filter.Until, err = parseEventTime(query.Get("until")); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid until: %v", err))
+		return
 	}
 
-	deliveries, err := s.db.ListWebhookDeliveries(id, limit)
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeEventCursor(cursor)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		filter.After = &after
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		if limit > maxDeliveryLimit {
+			limit = maxDeliveryLimit
+		}
+		filter.Limit = limit
+	}
+
+	deliveries, err := s.db.ListWebhookDeliveries(filter)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list deliveries")
+		respondInternalError(w, err, "failed to list deliveries")
 		return
 	}
 
+	if deliveries == nil {
+		deliveries = []*models.WebhookDelivery{}
+	}
+
+	if len(deliveries) == filter.Limit {
+		last := deliveries[len(deliveries)-1]
+		w.Header().Set("X-Next-Cursor", encodeEventCursor(database.EventCursor{CreatedAt: last.CreatedAt, ID: last.ID}))
+	}
+
 	respondJSON(w, http.StatusOK, deliveries)
 }
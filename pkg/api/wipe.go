@@ -0,0 +1,391 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/gorilla/mux"
+)
+
+const wipeWatchdogTick = time.Minute
+
+// handleCreateWipeJob requests a wipe of every disk in the machine's
+// inventory. The machine stops booting its own image immediately and boots
+// the wipe image on its next network boot.
+func (s *Server) handleCreateWipeJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if machine == nil {
+		respondError(w, http.StatusNotFound, CodeMachineNotFound, "machine not found")
+		return
+	}
+
+	if !machine.CanProvision() {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("machine is %s", machine.Status))
+		return
+	}
+
+	if len(machine.Hardware.Disks) == 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "machine has no disks in its hardware inventory")
+		return
+	}
+
+	job := &models.WipeJob{
+		MachineID:   machine.ID,
+		Status:      models.WipePending,
+		RequestedBy: "system",
+	}
+	if claims, ok := auth.GetClaims(r); ok {
+		job.RequestedBy = claims.Username
+	}
+
+	for _, disk := range machine.Hardware.Disks {
+		job.Disks = append(job.Disks, models.WipeDisk{
+			Device:    disk.Device,
+			Serial:    disk.Serial,
+			Model:     disk.Model,
+			SizeBytes: disk.SizeBytes,
+			Method:    models.WipeMethodFor(disk),
+			Status:    models.WipePending,
+		})
+	}
+
+	if err := s.db.CreateWipeJob(job); err != nil {
+		respondInternalError(w, err, "failed to create wipe job")
+		return
+	}
+
+	if _, err := s.db.CancelPendingBuilds(machine.ID); err != nil {
+		log.Printf("Failed to cancel builds for machine %s: %v", machine.ID, err)
+	}
+	if _, err := s.db.CancelPendingDeployments(machine.ID); err != nil {
+		log.Printf("Failed to cancel deployments for machine %s: %v", machine.ID, err)
+	}
+
+	// Forget the last build so the iPXE server no longer offers the
+	// machine's previous image, even after the wipe completes
+	oldStatus := machine.Status
+	machine.Status = models.StatusWiping
+	machine.LastBuildID = nil
+	machine.LastBuildTime = nil
+	if err := s.db.UpdateMachine(machine); err != nil {
+		log.Printf("Failed to update machine status: %v", err)
+	}
+
+	s.publish(r.Context(), events.Event{
+		Type:      events.MachineWipeRequested,
+		MachineID: machine.ID,
+		Data: events.WipeRequestedData{
+			JobID: job.ID,
+			Disks: len(job.Disks),
+		},
+	})
+	s.publishStatusChange(r.Context(), machine, oldStatus, "")
+
+	respondJSON(w, http.StatusCreated, job)
+}
+
+// handleListWipeJobs lists a machine's wipe jobs, newest first
+func (s *Server) handleListWipeJobs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	machineID := vars["id"]
+
+	jobs, err := s.db.ListWipeJobs(machineID)
+	if err != nil {
+		respondInternalError(w, err, "failed to list wipe jobs")
+		return
+	}
+
+	if jobs == nil {
+		jobs = []*models.WipeJob{}
+	}
+
+	respondJSON(w, http.StatusOK, jobs)
+}
+
+// handleGetActiveWipeJob returns the machine's pending or running wipe job
+func (s *Server) handleGetActiveWipeJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	machineID := vars["id"]
+
+	job, err := s.db.GetActiveWipeJob(machineID)
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if job == nil {
+		respondError(w, http.StatusNotFound, CodeWipeJobNotFound, "no active wipe job")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// handleGetWipeToken returns the machine's active wipe job's ID and the
+// token the wipe image reports its progress with, for the iPXE server to
+// put on the kernel command line of the wipe image
+func (s *Server) handleGetWipeToken(w http.ResponseWriter, r *http.Request) {
+	job, err := s.db.GetActiveWipeJob(mux.Vars(r)["id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+	if job == nil {
+		respondError(w, http.StatusNotFound, CodeWipeJobNotFound, "no active wipe job")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"job_id": job.ID, "token": s.jwtManager.GenerateWipeToken(job.ID)})
+}
+
+// handleGetWipeJob returns a single wipe job
+func (s *Server) handleGetWipeJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	job, err := s.db.GetWipeJob(vars["job_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if job == nil || job.MachineID != vars["id"] {
+		respondError(w, http.StatusNotFound, CodeWipeJobNotFound, "wipe job not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// handleWipeStatus records progress reported by the wipe image, which
+// authenticates with the job's wipe token as a bearer token, and returns
+// the job. The job fails as soon as any disk fails or disappears, and
+// completes once every planned disk has been wiped. The image's first
+// report starts the job and gets it its disk plan.
+func (s *Server) handleWipeStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !s.jwtManager.ValidateWipeToken(vars["job_id"], token) {
+		respondError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid wipe token")
+		return
+	}
+
+	job, err := s.db.GetWipeJob(vars["job_id"])
+	if err != nil {
+		respondInternalError(w, err, "database error")
+		return
+	}
+
+	if job == nil || job.MachineID != vars["id"] {
+		respondError(w, http.StatusNotFound, CodeWipeJobNotFound, "wipe job not found")
+		return
+	}
+
+	if !job.IsActive() {
+		respondError(w, http.StatusConflict, CodeConflict, fmt.Sprintf("wipe job is already %s", job.Status))
+		return
+	}
+
+	var update models.WipeStatusUpdate
+	if !decodeJSON(w, r, &update) {
+		return
+	}
+
+	now := time.Now()
+	if job.Status == models.WipePending {
+		job.Status = models.WipeRunning
+		job.StartedAt = &now
+	}
+
+	for _, reported := range update.Disks {
+		disk := findWipeDisk(job, reported)
+		if disk == nil {
+			log.Printf("Wipe job %s: ignoring unplanned disk %s (%s)", job.ID, reported.Device, reported.Serial)
+			continue
+		}
+
+		if reported.Device != "" {
+			disk.Device = reported.Device
+		}
+		if reported.Status != "" {
+			disk.Status = reported.Status
+		}
+		disk.Progress = clampPercent(reported.Progress)
+		disk.Error = reported.Error
+		if disk.Status == models.WipeCompleted && disk.CompletedAt == nil {
+			disk.Progress = 100
+			disk.CompletedAt = &now
+		}
+	}
+
+	job.Status, job.Error = wipeOutcome(job, update)
+	if !job.IsActive() {
+		job.CompletedAt = &now
+	}
+
+	if err := s.db.UpdateWipeJob(job); err != nil {
+		respondInternalError(w, err, "failed to update wipe job")
+		return
+	}
+
+	if !job.IsActive() {
+		s.finishWipe(job)
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// findWipeDisk matches a reported disk to the job's plan by serial, or by
+// device for disks the inventory has no serial for
+func findWipeDisk(job *models.WipeJob, reported models.WipeDisk) *models.WipeDisk {
+	for i := range job.Disks {
+		disk := &job.Disks[i]
+		if hasSerial(disk.Serial) {
+			if disk.Serial == reported.Serial {
+				return disk
+			}
+		} else if disk.Device == reported.Device {
+			return disk
+		}
+	}
+	return nil
+}
+
+// hasSerial reports whether an inventory serial identifies a disk
+func hasSerial(serial string) bool {
+	return serial != "" && serial != "Unknown"
+}
+
+func clampPercent(p int) int {
+	if p < 0 {
+		return 0
+	}
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
+// wipeOutcome works out the job status after an update
+func wipeOutcome(job *models.WipeJob, update models.WipeStatusUpdate) (string, string) {
+	for _, disk := range job.Disks {
+		switch disk.Status {
+		case models.WipeMissing:
+			return models.WipeFailed, fmt.Sprintf("disk %s (%s) disappeared during the wipe", disk.Serial, disk.Device)
+		case models.WipeFailed:
+			return models.WipeFailed, fmt.Sprintf("disk %s (%s) failed: %s", disk.Serial, disk.Device, disk.Error)
+		}
+	}
+
+	if update.Status == models.WipeFailed {
+		if update.Error == "" {
+			update.Error = "wipe image reported failure"
+		}
+		return models.WipeFailed, update.Error
+	}
+
+	for _, disk := range job.Disks {
+		if disk.Status != models.WipeCompleted {
+			if update.Status == models.WipeCompleted {
+				return models.WipeFailed, fmt.Sprintf("wipe reported complete but disk %s (%s) is %s", disk.Serial, disk.Device, disk.Status)
+			}
+			return models.WipeRunning, ""
+		}
+	}
+
+	return models.WipeCompleted, ""
+}
+
+// finishWipe moves the machine out of the wiping state and records the
+// outcome. A wiped machine goes back to enrolled, ready to be provisioned
+// again; a failed wipe leaves it failed.
+func (s *Server) finishWipe(job *models.WipeJob) {
+	machine, err := s.db.GetMachine(job.MachineID)
+	if err != nil || machine == nil {
+		log.Printf("Failed to get machine for wipe job %s: %v", job.ID, err)
+		return
+	}
+
+	oldStatus := machine.Status
+	eventType := events.MachineWipeCompleted
+	data := events.WipeFinishedData{JobID: job.ID}
+
+	if job.Status == models.WipeCompleted {
+		machine.Status = models.StatusEnrolled
+
+		for _, disk := range job.Disks {
+			data.Disks = append(data.Disks, events.WipedDisk{
+				Serial:      disk.Serial,
+				Model:       disk.Model,
+				Device:      disk.Device,
+				Method:      disk.Method,
+				CompletedAt: disk.CompletedAt,
+			})
+		}
+		log.Printf("Wipe job %s completed for machine %s", job.ID, machine.ID)
+	} else {
+		machine.Status = models.StatusFailed
+		eventType = events.MachineWipeFailed
+		data.Error = job.Error
+		log.Printf("Wipe job %s failed for machine %s: %s", job.ID, machine.ID, job.Error)
+	}
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		log.Printf("Failed to update machine status: %v", err)
+	}
+
+	ctx := context.Background()
+	s.publish(ctx, events.Event{Type: eventType, MachineID: machine.ID, Data: data})
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+}
+
+// StartWipeWatchdog fails running wipe jobs that report no progress for
+// longer than timeout, e.g. because the machine hung or lost power
+func (s *Server) StartWipeWatchdog(timeout time.Duration) {
+	go func() {
+		log.Printf("Wipe watchdog started (timeout: %s)", timeout)
+
+		ticker := time.NewTicker(wipeWatchdogTick)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !s.leadJob("wipe-watchdog", wipeWatchdogTick) {
+				continue
+			}
+
+			jobs, err := s.db.ListStalledWipeJobs(time.Now().Add(-timeout))
+			if err != nil {
+				log.Printf("Wipe watchdog failed to list jobs: %v", err)
+				continue
+			}
+
+			for _, job := range jobs {
+				now := time.Now()
+				job.Status = models.WipeFailed
+				job.Error = fmt.Sprintf("no progress reported for %s", timeout)
+				job.CompletedAt = &now
+
+				if err := s.db.UpdateWipeJob(job); err != nil {
+					log.Printf("Failed to update wipe job %s: %v", job.ID, err)
+					continue
+				}
+				s.finishWipe(job)
+			}
+		}
+	}()
+}
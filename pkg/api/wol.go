@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/wol"
+)
+
+// Ways of sending Wake-on-LAN packets
+const (
+	// WOLModeRelay has the iPXE server, which is on the provisioning
+	// network, broadcast the packets
+	WOLModeRelay = "relay"
+
+	// WOLModeBroadcast broadcasts the packets from the API server, for
+	// when it shares a segment with the machines
+	WOLModeBroadcast = "broadcast"
+)
+
+const (
+	// wolTimeout bounds a request to the iPXE server's Wake-on-LAN relay
+	wolTimeout = 10 * time.Second
+
+	// pingTimeout bounds the ping that infers a machine's power state
+	pingTimeout = 3 * time.Second
+
+	// inferredOnWindow is how recently a machine must have been seen for
+	// it to be inferred to be on when it doesn't answer a ping
+	inferredOnWindow = 10 * time.Minute
+)
+
+// InferredPowerStatus is the power state of a machine without a BMC, which
+// can't be read and is inferred instead
+type InferredPowerStatus struct {
+	MachineID string `json:"machine_id"`
+	Status    string `json:"status"` // on or off
+	Inferred  bool   `json:"inferred"`
+
+	// What the status was inferred from: ping, last_seen, or none
+	Basis      string     `json:"basis"`
+	CurrentIP  string     `json:"current_ip,omitempty"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	Timestamp  string     `json:"timestamp"`
+}
+
+// wakeMachine powers a machine without a BMC on with a Wake-on-LAN packet,
+// recorded as a power operation with the wol method
+func (s *Server) wakeMachine(w http.ResponseWriter, r *http.Request, machine *models.Machine, userID string) {
+	if s.config.WOLMode == "" {
+		respondError(w, http.StatusServiceUnavailable, CodeWOLNotConfigured, "Wake-on-LAN is not configured on this server; set WOL_MODE")
+		return
+	}
+
+	mac := machine.WakeOnLANMAC()
+	powerOp := &models.PowerOperation{
+		MachineID:   machine.ID,
+		Operation:   "on",
+		Method:      models.PowerMethodWOL,
+		Status:      "pending",
+		InitiatedBy: userID,
+	}
+
+	if err := s.db.CreatePowerOperation(powerOp); err != nil {
+		respondInternalError(w, err, "failed to create power operation")
+		return
+	}
+
+	// A magic packet is fire and forget: success means it was sent, not
+	// that the machine woke up
+	err := s.sendWakeOnLAN(r.Context(), mac)
+
+	now := time.Now()
+	powerOp.CompletedAt = &now
+	if err != nil {
+		log.Printf("Failed to send Wake-on-LAN packet to %s for machine %s: %v", mac, machine.ID, err)
+		powerOp.Status = "failed"
+		powerOp.Error = err.Error()
+	} else {
+		powerOp.Status = "success"
+		powerOp.Result = fmt.Sprintf("magic packet for %s sent by %s", mac, s.config.WOLMode)
+	}
+
+	s.finishPowerOperation(powerOp)
+	s.publishPowerOperation(powerOp)
+
+	respondJSON(w, http.StatusOK, powerOp)
+}
+
+// sendWakeOnLAN sends a magic packet for mac the way the server is
+// configured to
+func (s *Server) sendWakeOnLAN(ctx context.Context, mac string) error {
+	switch s.config.WOLMode {
+	case WOLModeRelay:
+		ctx, cancel := context.WithTimeout(ctx, wolTimeout)
+		defer cancel()
+		return s.ipxe.Wake(ctx, mac)
+	case WOLModeBroadcast:
+		return wol.Send(mac, s.config.WOLBroadcastAddr)
+	default:
+		return fmt.Errorf("unsupported Wake-on-LAN mode %q", s.config.WOLMode)
+	}
+}
+
+// inferPowerStatus infers the power state of a machine without a BMC. It
+// is on if its leased address answers a ping or it has reported in within
+// inferredOnWindow, and off otherwise.
+func inferPowerStatus(ctx context.Context, machine *models.Machine) *InferredPowerStatus {
+	status := &InferredPowerStatus{
+		MachineID:  machine.ID,
+		Status:     "off",
+		Inferred:   true,
+		Basis:      "none",
+		CurrentIP:  machine.CurrentIP,
+		LastSeenAt: machine.LastSeenAt,
+		Timestamp:  time.Now().Format(time.RFC3339),
+	}
+
+	if machine.CurrentIP != "" {
+		ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+		if _, _, err := (command.Exec{}).Run(ctx, "ping", "-c", "1", "-W", "2", machine.CurrentIP); err == nil {
+			status.Status = "on"
+			status.Basis = "ping"
+			return status
+		}
+		status.Basis = "ping"
+	}
+
+	if machine.LastSeenAt != nil {
+		if time.Since(*machine.LastSeenAt) < inferredOnWindow {
+			status.Status = "on"
+			status.Basis = "last_seen"
+		} else if status.Basis == "none" {
+			status.Basis = "last_seen"
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// audienceKey derives the key tokens of an audience are made with from
+// the secret key, so a token of one audience never passes for another's,
+// or as a user's token, or the reverse
+func audienceKey(secret []byte, audience string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(audience))
+	return mac.Sum(nil)
+}
+
+// signAudience returns the token of audience for message: an HMAC of the
+// message under the audience's key, which passes for no other message
+func (m *JWTManager) signAudience(audience, message string) string {
+	mac := hmac.New(sha256.New, audienceKey(m.secretKey, audience))
+	mac.Write([]byte(message))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAudience reports whether token is the token of audience for
+// message
+func (m *JWTManager) verifyAudience(audience, message, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(m.signAudience(audience, message)))
+}
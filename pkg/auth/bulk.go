@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"sort"
+	"strings"
+)
+
+// bulkAudience marks bulk operation confirmation tokens
+const bulkAudience = "bulk-confirmation"
+
+// GenerateBulkToken returns the token a dry run of a bulk operation hands
+// out for the real run: an HMAC of the operation, the machines it targets
+// in any order, and the hash of its data. It passes only for the same
+// operation with the same data on the same machines.
+func (m *JWTManager) GenerateBulkToken(operation string, machineIDs []string, dataHash string) string {
+	return m.signAudience(bulkAudience, bulkMessage(operation, machineIDs, dataHash))
+}
+
+// ValidateBulkToken reports whether token is the confirmation token of the
+// bulk operation
+func (m *JWTManager) ValidateBulkToken(operation string, machineIDs []string, dataHash, token string) bool {
+	return m.verifyAudience(bulkAudience, bulkMessage(operation, machineIDs, dataHash), token)
+}
+
+// bulkMessage is what a confirmation token is made from, with the
+// machines sorted so their order doesn't matter
+func bulkMessage(operation string, machineIDs []string, dataHash string) string {
+	ids := append([]string(nil), machineIDs...)
+	sort.Strings(ids)
+	return operation + "\n" + dataHash + "\n" + strings.Join(ids, ",")
+}
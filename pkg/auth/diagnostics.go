@@ -0,0 +1,16 @@
+package auth
+
+// diagnosticsAudience marks diagnostics tokens
+const diagnosticsAudience = "diagnostics"
+
+// GenerateDiagnosticsToken returns the token a diagnostics image posts the
+// results of its run with: an HMAC of the run's ID, which passes for no
+// other run and no user. A run that has finished takes no more results.
+func (m *JWTManager) GenerateDiagnosticsToken(runID string) string {
+	return m.signAudience(diagnosticsAudience, runID)
+}
+
+// ValidateDiagnosticsToken reports whether token is the diagnostic run's token
+func (m *JWTManager) ValidateDiagnosticsToken(runID, token string) bool {
+	return m.verifyAudience(diagnosticsAudience, runID, token)
+}
@@ -0,0 +1,18 @@
+package auth
+
+// hooksAudience marks provisioning hook tokens
+const hooksAudience = "provisioning-hooks"
+
+// GenerateHooksToken returns the token a machine's agent fetches and
+// reports its provisioning hooks with: an HMAC of the machine's ID, which
+// passes for no other machine and no user. The iPXE server puts it on the
+// kernel command line of the machine's image. It doesn't expire; changing
+// the secret key revokes every machine's.
+func (m *JWTManager) GenerateHooksToken(machineID string) string {
+	return m.signAudience(hooksAudience, machineID)
+}
+
+// ValidateHooksToken reports whether token is the machine's hooks token
+func (m *JWTManager) ValidateHooksToken(machineID, token string) bool {
+	return m.verifyAudience(hooksAudience, machineID, token)
+}
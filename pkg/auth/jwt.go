@@ -15,8 +15,8 @@ const (
 
 // JWTManager handles JWT token generation and validation
 type JWTManager struct {
-	secretKey     []byte
-	tokenExpiry   time.Duration
+	secretKey   []byte
+	tokenExpiry time.Duration
 }
 
 // Claims represents the JWT claims
@@ -24,9 +24,20 @@ type Claims struct {
 	UserID   string          `json:"user_id"`
 	Username string          `json:"username"`
 	Role     models.UserRole `json:"role"`
+
+	// Set in impersonation tokens: the admin acting as the user
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
+	Impersonator   string `json:"impersonator,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
+// Impersonating reports whether the token is an admin's impersonating the
+// user. Its ID is then the impersonation session's.
+func (c *Claims) Impersonating() bool {
+	return c.ImpersonatorID != ""
+}
+
 // NewJWTManager creates a new JWT manager
 func NewJWTManager(secretKey string, expiry time.Duration) *JWTManager {
 	if expiry == 0 {
@@ -92,6 +103,9 @@ func (m *JWTManager) RefreshToken(oldToken string) (string, time.Time, error) {
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("invalid token: %w", err)
 	}
+	if claims.Impersonating() {
+		return "", time.Time{}, ErrImpersonationNotRefreshable
+	}
 
 	// Generate new token with updated expiry
 	expiresAt := time.Now().Add(m.tokenExpiry)
@@ -0,0 +1,14 @@
+package auth
+
+import "crypto/ed25519"
+
+// manifestAudience marks the boot manifest signing key
+const manifestAudience = "boot-manifest"
+
+// BootManifestKey returns the Ed25519 key boot manifests are signed with.
+// It is derived from the secret key, so it stays the same across restarts
+// and on every server sharing the secret; iPXE servers verify manifests
+// with its public half.
+func (m *JWTManager) BootManifestKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(audienceKey(m.secretKey, manifestAudience))
+}
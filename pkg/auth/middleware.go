@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"strings"
 
@@ -25,14 +26,14 @@ func AuthMiddleware(jwtManager *JWTManager) func(http.Handler) http.Handler {
 			// Get token from Authorization header
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				http.Error(w, "missing authorization header", http.StatusUnauthorized)
+				writeError(w, http.StatusUnauthorized, "unauthorized", "missing authorization header")
 				return
 			}
 
 			// Extract token from "Bearer <token>"
 			parts := strings.SplitN(authHeader, " ", 2)
 			if len(parts) != 2 || parts[0] != "Bearer" {
-				http.Error(w, "invalid authorization header format", http.StatusUnauthorized)
+				writeError(w, http.StatusUnauthorized, "unauthorized", "invalid authorization header format")
 				return
 			}
 
@@ -41,7 +42,7 @@ func AuthMiddleware(jwtManager *JWTManager) func(http.Handler) http.Handler {
 			// Validate token
 			claims, err := jwtManager.ValidateToken(token)
 			if err != nil {
-				http.Error(w, "invalid token", http.StatusUnauthorized)
+				writeError(w, http.StatusUnauthorized, "unauthorized", "invalid token")
 				return
 			}
 
@@ -58,7 +59,7 @@ func RequireRole(allowedRoles ...models.UserRole) func(http.Handler) http.Handle
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			claims, ok := r.Context().Value(ClaimsContextKey).(*Claims)
 			if !ok {
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				writeError(w, http.StatusUnauthorized, "unauthorized", "unauthorized")
 				return
 			}
 
@@ -72,7 +73,7 @@ func RequireRole(allowedRoles ...models.UserRole) func(http.Handler) http.Handle
 			}
 
 			if !hasRole {
-				http.Error(w, "forbidden: insufficient permissions", http.StatusForbidden)
+				writeError(w, http.StatusForbidden, "forbidden", "insufficient permissions")
 				return
 			}
 
@@ -123,3 +124,15 @@ func GetClaims(r *http.Request) (*Claims, bool) {
 	claims, ok := r.Context().Value(ClaimsContextKey).(*Claims)
 	return claims, ok
 }
+
+// writeError writes an error response in the API's format. The request ID
+// header is set by the API server before authentication runs.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.ErrorResponse{Error: models.APIError{
+		Code:      code,
+		Message:   message,
+		RequestID: w.Header().Get("X-Request-ID"),
+	}})
+}
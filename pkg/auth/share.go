@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// shareAudience marks share tokens
+const shareAudience = "machine-share"
+
+// ShareClaims are the claims of a share link's token. The share ID is the
+// token's ID and the machine its subject.
+type ShareClaims struct {
+	Scopes  []string `json:"scopes"`
+	BuildID string   `json:"build_id,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Share builds the share the claims grant, without what only the database
+// records
+func (c *ShareClaims) Share() *models.MachineShare {
+	share := &models.MachineShare{
+		ID:        c.ID,
+		MachineID: c.Subject,
+		Scopes:    c.Scopes,
+		BuildID:   c.BuildID,
+	}
+	if c.ExpiresAt != nil {
+		share.ExpiresAt = c.ExpiresAt.Time
+	}
+	return share
+}
+
+// GenerateShareToken signs a token granting what share grants until it
+// expires
+func (m *JWTManager) GenerateShareToken(share *models.MachineShare) (string, error) {
+	claims := &ShareClaims{
+		Scopes:  share.Scopes,
+		BuildID: share.BuildID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        share.ID,
+			Subject:   share.MachineID,
+			Audience:  jwt.ClaimStrings{shareAudience},
+			ExpiresAt: jwt.NewNumericDate(share.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(share.CreatedAt),
+			Issuer:    "metal-enrollment",
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(audienceKey(m.secretKey, shareAudience))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign share token: %w", err)
+	}
+	return tokenString, nil
+}
+
+// ValidateShareToken checks a share token's signature and expiry and
+// returns its claims. Whether the share was revoked is up to the caller.
+func (m *JWTManager) ValidateShareToken(tokenString string) (*ShareClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ShareClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return audienceKey(m.secretKey, shareAudience), nil
+	}, jwt.WithAudience(shareAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse share token: %w", err)
+	}
+
+	claims, ok := token.Claims.(*ShareClaims)
+	if !ok || !token.Valid || claims.ID == "" || claims.Subject == "" {
+		return nil, fmt.Errorf("invalid share token")
+	}
+	return claims, nil
+}
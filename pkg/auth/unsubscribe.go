@@ -0,0 +1,18 @@
+package auth
+
+// unsubscribeAudience marks unsubscribe tokens
+const unsubscribeAudience = "unsubscribe"
+
+// GenerateUnsubscribeToken returns the token that the unsubscribe link in a
+// subscription's emails carries: an HMAC of the subscription's ID, which
+// deletes that subscription and nothing else, without logging in. It
+// doesn't expire; it stops working with the subscription.
+func (m *JWTManager) GenerateUnsubscribeToken(subscriptionID string) string {
+	return m.signAudience(unsubscribeAudience, subscriptionID)
+}
+
+// ValidateUnsubscribeToken reports whether token is the subscription's
+// unsubscribe token
+func (m *JWTManager) ValidateUnsubscribeToken(subscriptionID, token string) bool {
+	return m.verifyAudience(unsubscribeAudience, subscriptionID, token)
+}
@@ -0,0 +1,18 @@
+package auth
+
+// wipeAudience marks disk wipe tokens
+const wipeAudience = "disk-wipe"
+
+// GenerateWipeToken returns the token the wipe image reports the progress
+// of a wipe job with: an HMAC of the job's ID, which passes for no other
+// job and no user. The iPXE server puts it on the kernel command line of
+// the wipe image. A job that has finished takes no more reports, so the
+// token is useless once it has.
+func (m *JWTManager) GenerateWipeToken(jobID string) string {
+	return m.signAudience(wipeAudience, jobID)
+}
+
+// ValidateWipeToken reports whether token is the wipe job's token
+func (m *JWTManager) ValidateWipeToken(jobID, token string) bool {
+	return m.verifyAudience(wipeAudience, jobID, token)
+}
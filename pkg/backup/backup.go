@@ -0,0 +1,245 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+)
+
+const (
+	// FormatVersion is the manifest version written by this package
+	FormatVersion = 1
+
+	manifestName = "manifest.json"
+	filePrefix   = "metal-enrollment-"
+	fileSuffix   = ".tar.gz"
+)
+
+// Manifest describes the contents of a backup
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Driver    string    `json:"driver"`
+
+	// Database is the snapshot file inside the archive
+	Database File `json:"database"`
+
+	// Artifacts are files under the images directory, relative to it
+	Artifacts []File `json:"artifacts"`
+}
+
+// File is a file recorded in a manifest
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Create writes a backup archive of db to dir, named by its creation time,
+// and returns its path.
+//
+// The archive holds a consistent database snapshot and a manifest. The
+// manifest lists the built artifacts under artifactsDir with their
+// checksums; the artifacts themselves are not bundled, since they can be
+// rebuilt and dwarf the database. BMC passwords in the snapshot stay
+// encrypted and the key is never included, so restoring needs the original
+// key.
+func Create(dir string, db *database.DB, artifactsDir string) (string, *Manifest, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", nil, err
+	}
+
+	work, err := os.MkdirTemp("", "metal-backup-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(work)
+
+	manifest := &Manifest{
+		Version:   FormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Driver:    db.Driver(),
+	}
+
+	dbName := "database.sqlite"
+	if db.Driver() == "postgres" {
+		dbName = "database.pgdump"
+	}
+	snapshot := filepath.Join(work, dbName)
+	if err := db.Snapshot(snapshot); err != nil {
+		return "", nil, err
+	}
+
+	if manifest.Database, err = describeFile(snapshot); err != nil {
+		return "", nil, err
+	}
+	manifest.Database.Path = dbName
+
+	if manifest.Artifacts, err = listArtifacts(artifactsDir); err != nil {
+		return "", nil, fmt.Errorf("failed to list artifacts: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".backup-*.tmp")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeArchive(tmp, manifest, snapshot); err != nil {
+		return "", nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", nil, err
+	}
+
+	path := filepath.Join(dir, filePrefix+manifest.CreatedAt.Format("20060102T150405Z")+fileSuffix)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", nil, err
+	}
+
+	return path, manifest, nil
+}
+
+// Rotate deletes all but the newest keep backups in dir
+func Rotate(dir string, keep int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Names embed the creation time, so they sort oldest first
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+
+	var removed []string
+	for len(backups) > keep {
+		path := filepath.Join(dir, backups[0])
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+		backups = backups[1:]
+	}
+
+	return removed, nil
+}
+
+func writeArchive(w io.Writer, manifest *Manifest, snapshot string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The manifest goes first so restores can validate before extracting
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0640,
+		Size:    int64(len(manifestJSON)),
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifest.Database.Path,
+		Mode:    0600,
+		Size:    manifest.Database.Size,
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// listArtifacts records every regular file under dir. A missing directory
+// has no artifacts.
+func listArtifacts(dir string) ([]File, error) {
+	files := []File{}
+	if dir == "" {
+		return files, nil
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		file, err := describeFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		file.Path = filepath.ToSlash(rel)
+		files = append(files, file)
+		return nil
+	})
+
+	return files, err
+}
+
+// describeFile returns a file's size and checksum
+func describeFile(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return File{}, err
+	}
+
+	return File{Path: path, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,217 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+)
+
+// RestoreReport describes a completed restore
+type RestoreReport struct {
+	Manifest *Manifest
+
+	// PreviousDatabase is where an existing SQLite database was moved
+	PreviousDatabase string
+
+	// Missing and Changed list artifacts from the manifest that are absent
+	// from or differ in the images directory; they need to be rebuilt
+	Missing []string
+	Changed []string
+}
+
+// Restore validates a backup archive and restores its database into the
+// database described by cfg. The archive's BMC credentials are checked
+// against secretKey first, so a restore with the wrong key fails before
+// anything is replaced where the driver allows it. Artifacts are compared
+// against artifactsDir and reported, not restored.
+func Restore(archive string, cfg database.Config, secretKey, artifactsDir string) (*RestoreReport, error) {
+	work, err := os.MkdirTemp("", "metal-restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work)
+
+	manifest, snapshot, err := extract(archive, work)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Driver != cfg.Driver {
+		return nil, fmt.Errorf("backup is of a %s database, but the server is configured for %s", manifest.Driver, cfg.Driver)
+	}
+
+	report := &RestoreReport{Manifest: manifest}
+
+	switch cfg.Driver {
+	case "sqlite3":
+		if err := verifyKey(database.Config{Driver: "sqlite3", DSN: snapshot}, secretKey); err != nil {
+			return nil, err
+		}
+		if report.PreviousDatabase, err = restoreSQLite(snapshot, cfg.DSN); err != nil {
+			return nil, err
+		}
+
+	case "postgres":
+		cmd := exec.Command("pg_restore", "--clean", "--if-exists", "--no-owner", "--dbname="+cfg.DSN, snapshot)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("pg_restore failed: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+		if err := verifyKey(cfg, secretKey); err != nil {
+			return nil, fmt.Errorf("database was restored, but %w", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("restores are not supported for driver %s", cfg.Driver)
+	}
+
+	for _, artifact := range manifest.Artifacts {
+		current, err := describeFile(filepath.Join(artifactsDir, filepath.FromSlash(artifact.Path)))
+		switch {
+		case err != nil:
+			report.Missing = append(report.Missing, artifact.Path)
+		case current.SHA256 != artifact.SHA256:
+			report.Changed = append(report.Changed, artifact.Path)
+		}
+	}
+
+	return report, nil
+}
+
+// extract reads the manifest and database snapshot from an archive into
+// dir and checks the snapshot against the manifest
+func extract(archive, dir string) (*Manifest, string, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("not a backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != manifestName {
+		return nil, "", fmt.Errorf("not a backup archive: %s must be the first entry", manifestName)
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Version != FormatVersion {
+		return nil, "", fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	if manifest.Database.Path == "" || strings.ContainsAny(manifest.Database.Path, `/\`) {
+		return nil, "", fmt.Errorf("invalid manifest: bad database path %q", manifest.Database.Path)
+	}
+
+	snapshot := filepath.Join(dir, manifest.Database.Path)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, "", fmt.Errorf("backup is missing %s", manifest.Database.Path)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if hdr.Name != manifest.Database.Path {
+			continue
+		}
+
+		out, err := os.OpenFile(snapshot, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		break
+	}
+
+	got, err := describeFile(snapshot)
+	if err != nil {
+		return nil, "", err
+	}
+	if got.Size != manifest.Database.Size || got.SHA256 != manifest.Database.SHA256 {
+		return nil, "", fmt.Errorf("database snapshot does not match the manifest checksum")
+	}
+
+	return &manifest, snapshot, nil
+}
+
+// verifyKey opens a database and checks its BMC credentials decrypt with key
+func verifyKey(cfg database.Config, key string) error {
+	db, err := database.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.SetSecretKey(key); err != nil {
+		return err
+	}
+	return db.VerifySecretKey()
+}
+
+// restoreSQLite moves any existing database aside and copies the snapshot
+// into its place, returning where the old database went
+func restoreSQLite(snapshot, dsn string) (string, error) {
+	path, err := database.SQLitePath(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	var previous string
+	if _, err := os.Stat(path); err == nil {
+		previous = fmt.Sprintf("%s.pre-restore-%s", path, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(path, previous); err != nil {
+			return "", err
+		}
+		// Journal files belong to the old database
+		for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+			if _, err := os.Stat(path + suffix); err == nil {
+				if err := os.Rename(path+suffix, previous+suffix); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	src, err := os.Open(snapshot)
+	if err != nil {
+		return previous, err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return previous, err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return previous, err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return previous, err
+	}
+
+	return previous, dst.Close()
+}
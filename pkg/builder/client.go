@@ -0,0 +1,74 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// validateTimeout bounds a validation, which runs nix on the builder
+const validateTimeout = 30 * time.Second
+
+// ValidateRequest asks the builder whether a configuration parses
+type ValidateRequest struct {
+	Config string `json:"config"`
+}
+
+// ValidateResponse is the builder's verdict on a configuration. Error is
+// nix's parse error when it doesn't parse.
+type ValidateResponse struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// Client talks to the image builder service
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient returns a client for the builder at baseURL
+func NewClient(baseURL string) *Client {
+	return &Client{
+		url:  strings.TrimSuffix(baseURL, "/"),
+		http: &http.Client{Timeout: validateTimeout},
+	}
+}
+
+// Validate has the builder parse a NixOS configuration with nix. It returns
+// an error only if the builder couldn't be asked; a configuration that
+// doesn't parse is reported in the response.
+func (c *Client) Validate(ctx context.Context, config string) (*ValidateResponse, error) {
+	body, err := json.Marshal(ValidateRequest{Config: config})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/validate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("builder unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("builder returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result ValidateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode validation: %w", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,36 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"time"
+)
+
+// waitDelay bounds how long Run waits for output after a cancelled
+// command's process group has been killed
+const waitDelay = 5 * time.Second
+
+// Runner runs external commands. Code that shells out takes a Runner so
+// that tests can script the results instead of needing the real binaries.
+type Runner interface {
+	Run(ctx context.Context, name string, args ...string) (stdout, stderr string, err error)
+}
+
+// Exec is the Runner that executes commands. Each command runs in its own
+// process group, and cancelling ctx kills the whole group.
+type Exec struct{}
+
+// Run runs a command to completion or until ctx is done
+func (Exec) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = waitDelay
+	setProcessGroup(cmd)
+
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
@@ -0,0 +1,57 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Fake is a Runner that records calls and replays scripted results, for
+// tests
+type Fake struct {
+	mu      sync.Mutex
+	calls   [][]string
+	results []FakeResult
+}
+
+// FakeResult is the scripted outcome of one command
+type FakeResult struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+// Script queues results, returned in order by the following calls to Run
+func (f *Fake) Script(results ...FakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results = append(f.results, results...)
+}
+
+// Calls returns each command run so far, as its name followed by its args
+func (f *Fake) Calls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.calls...)
+}
+
+// Run records the command and returns the next scripted result. It fails
+// when the script has run out.
+func (f *Fake) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, append([]string{name}, args...))
+
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	if len(f.results) == 0 {
+		return "", "", fmt.Errorf("unscripted command: %s %s", name, strings.Join(args, " "))
+	}
+
+	result := f.results[0]
+	f.results = f.results[1:]
+	return result.Stdout, result.Stderr, result.Err
+}
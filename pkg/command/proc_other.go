@@ -0,0 +1,12 @@
+//go:build !unix
+
+package command
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// KilledBySignal reports whether err is from a command killed by SIGKILL
+func KilledBySignal(err error) bool {
+	return false
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+// AuditFilter selects audit entries. Since is inclusive and Until is
+// exclusive; zero values leave the range open. Entries are listed newest
+// first, by (created_at, id), so pages stay stable while requests are
+// recorded.
+type AuditFilter struct {
+	Actor        string
+	Impersonator string
+	Route        string
+	Since        time.Time
+	Until        time.Time
+
+	// After continues from the last entry of a previous page
+	After *EventCursor
+
+	Limit int
+}
+
+// CreateAuditEntry records an audit entry
+func (db *DB) CreateAuditEntry(entry *models.AuditEntry) error {
+	entry.ID = uuid.New().String()
+	entry.CreatedAt = time.Now()
+
+	targets, err := marshalJSONColumn(entry.Targets)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit targets: %w", err)
+	}
+
+	query := `
+		INSERT INTO audit_log (
+			id, actor, actor_id, impersonator, impersonator_id, method, route, targets, fields, status, source_ip, request_id, created_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO audit_log (
+				id, actor, actor_id, impersonator, impersonator_id, method, route, targets, fields, status, source_ip, request_id, created_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		`
+	}
+
+	_, err = db.Exec(query,
+		entry.ID,
+		entry.Actor,
+		entry.ActorID,
+		entry.Impersonator,
+		entry.ImpersonatorID,
+		entry.Method,
+		entry.Route,
+		targets,
+		jsonColumn(entry.Fields),
+		entry.Status,
+		entry.SourceIP,
+		entry.RequestID,
+		entry.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+
+	return nil
+}
+
+// ListAuditEntries lists audit entries matching filter, newest first
+func (db *DB) ListAuditEntries(filter AuditFilter) ([]*models.AuditEntry, error) {
+	query := `
+		SELECT id, actor, actor_id, impersonator, impersonator_id, method, route, targets, fields, status, source_ip, request_id, created_at
+		FROM audit_log
+		WHERE 1=1
+	`
+
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		if db.driver == "postgres" {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
+	}
+
+	if filter.Actor != "" {
+		query += " AND actor = " + arg(filter.Actor)
+	}
+	if filter.Impersonator != "" {
+		query += " AND impersonator = " + arg(filter.Impersonator)
+	}
+	if filter.Route != "" {
+		query += " AND route = " + arg(filter.Route)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND created_at >= " + arg(filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query += " AND created_at < " + arg(filter.Until)
+	}
+	if filter.After != nil {
+		query += fmt.Sprintf(" AND (created_at < %s OR (created_at = %s AND id < %s))",
+			arg(filter.After.CreatedAt), arg(filter.After.CreatedAt), arg(filter.After.ID))
+	}
+
+	query += " ORDER BY created_at DESC, id DESC"
+
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*models.AuditEntry
+	for rows.Next() {
+		var entry models.AuditEntry
+		var targets, fields jsonColumn
+		err := rows.Scan(
+			&entry.ID,
+			&entry.Actor,
+			&entry.ActorID,
+			&entry.Impersonator,
+			&entry.ImpersonatorID,
+			&entry.Method,
+			&entry.Route,
+			&targets,
+			&fields,
+			&entry.Status,
+			&entry.SourceIP,
+			&entry.RequestID,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		if err := targets.Unmarshal(&entry.Targets); err != nil {
+			return nil, fmt.Errorf("failed to decode audit targets: %w", err)
+		}
+		entry.Fields = fields.RawMessage()
+		entries = append(entries, &entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// DeleteAuditEntriesBefore removes audit entries recorded before the given
+// time
+func (db *DB) DeleteAuditEntriesBefore(before time.Time) (int64, error) {
+	query := "DELETE FROM audit_log WHERE created_at < ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM audit_log WHERE created_at < $1"
+	}
+
+	result, err := db.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old audit entries: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+func (db *DB) createAuditLogTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id TEXT PRIMARY KEY,
+			actor TEXT NOT NULL DEFAULT '',
+			actor_id TEXT NOT NULL DEFAULT '',
+			impersonator TEXT NOT NULL DEFAULT '',
+			impersonator_id TEXT NOT NULL DEFAULT '',
+			method TEXT NOT NULL,
+			route TEXT NOT NULL,
+			targets %s,
+			fields %s,
+			status INTEGER NOT NULL,
+			source_ip TEXT NOT NULL DEFAULT '',
+			request_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL
+		)
+	`, jsonType, jsonType)
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+// BootHistoryKeep is how many boot requests are kept per machine
+const BootHistoryKeep = 100
+
+const bootRequestColumns = `
+	id, machine_id, service_tag, client_ip, flavor, arch, boot_mode,
+	decision, reason, script, redirect, status, artifacts_version, requested_at
+`
+
+// RecordBootRequest adds a boot request to its machine's boot history,
+// dropping the oldest requests beyond BootHistoryKeep
+func (db *DB) RecordBootRequest(req *models.BootRequest) error {
+	req.ID = uuid.New().String()
+	if req.RequestedAt.IsZero() {
+		req.RequestedAt = time.Now()
+	}
+
+	insert := `INSERT INTO boot_requests (` + bootRequestColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	trim := `DELETE FROM boot_requests WHERE machine_id = ? AND id NOT IN (
+		SELECT id FROM boot_requests WHERE machine_id = ? ORDER BY requested_at DESC LIMIT ?
+	)`
+
+	if db.driver == "postgres" {
+		insert = `INSERT INTO boot_requests (` + bootRequestColumns + `)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+		trim = `DELETE FROM boot_requests WHERE machine_id = $1 AND id NOT IN (
+			SELECT id FROM boot_requests WHERE machine_id = $2 ORDER BY requested_at DESC LIMIT $3
+		)`
+	}
+
+	_, err := db.Exec(insert,
+		req.ID,
+		req.MachineID,
+		req.ServiceTag,
+		req.ClientIP,
+		req.Flavor,
+		req.Arch,
+		req.BootMode,
+		req.Decision,
+		req.Reason,
+		req.Script,
+		req.Redirect,
+		req.Status,
+		req.ArtifactsVersion,
+		req.RequestedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record boot request: %w", err)
+	}
+
+	if _, err := db.Exec(trim, req.MachineID, req.MachineID, BootHistoryKeep); err != nil {
+		return fmt.Errorf("failed to trim boot history: %w", err)
+	}
+
+	return nil
+}
+
+// ListBootRequests lists a machine's most recent boot requests, newest first
+func (db *DB) ListBootRequests(machineID string, limit int) ([]*models.BootRequest, error) {
+	query := `SELECT` + bootRequestColumns + `FROM boot_requests
+		WHERE machine_id = ? ORDER BY requested_at DESC LIMIT ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + bootRequestColumns + `FROM boot_requests
+			WHERE machine_id = $1 ORDER BY requested_at DESC LIMIT $2`
+	}
+
+	rows, err := db.Query(query, machineID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []*models.BootRequest
+	for rows.Next() {
+		req, err := scanBootRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+
+	return requests, rows.Err()
+}
+
+// GetLastBootRequest retrieves a machine's most recent boot request. It
+// returns nil, nil if the machine has not network booted since it was
+// enrolled.
+func (db *DB) GetLastBootRequest(machineID string) (*models.BootRequest, error) {
+	query := `SELECT` + bootRequestColumns + `FROM boot_requests
+		WHERE machine_id = ? ORDER BY requested_at DESC LIMIT 1`
+	if db.driver == "postgres" {
+		query = `SELECT` + bootRequestColumns + `FROM boot_requests
+			WHERE machine_id = $1 ORDER BY requested_at DESC LIMIT 1`
+	}
+
+	req, err := scanBootRequest(db.QueryRow(query, machineID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return req, err
+}
+
+func scanBootRequest(row rowScanner) (*models.BootRequest, error) {
+	var req models.BootRequest
+	var clientIP, reason, script, redirect, artifactsVersion sql.NullString
+
+	err := row.Scan(
+		&req.ID,
+		&req.MachineID,
+		&req.ServiceTag,
+		&clientIP,
+		&req.Flavor,
+		&req.Arch,
+		&req.BootMode,
+		&req.Decision,
+		&reason,
+		&script,
+		&redirect,
+		&req.Status,
+		&artifactsVersion,
+		&req.RequestedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ClientIP = clientIP.String
+	req.Reason = reason.String
+	req.Script = script.String
+	req.Redirect = redirect.String
+	req.ArtifactsVersion = artifactsVersion.String
+
+	return &req, nil
+}
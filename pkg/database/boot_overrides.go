@@ -0,0 +1,363 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const bootAssetColumns = ` id, name, kind, size, sha256, uploaded_by, created_at `
+
+const bootOverrideColumns = `
+	machine_id, script, kernel_asset_id, initrd_asset_id, iso_asset_id, cmdline,
+	max_boots, boots_served, expires_at, created_by, created_at, diagnostic_run_id
+`
+
+// CreateBootAsset records an uploaded boot asset. The file must already be
+// stored under its SHA-256.
+func (db *DB) CreateBootAsset(asset *models.BootAsset) error {
+	asset.ID = uuid.New().String()
+	asset.CreatedAt = time.Now()
+
+	query := `INSERT INTO boot_assets (` + bootAssetColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO boot_assets (` + bootAssetColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	}
+
+	_, err := db.Exec(query,
+		asset.ID,
+		asset.Name,
+		asset.Kind,
+		asset.Size,
+		asset.SHA256,
+		asset.UploadedBy,
+		asset.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create boot asset: %w", err)
+	}
+	return nil
+}
+
+// GetBootAsset retrieves a boot asset. It returns nil, nil if there is no
+// such asset.
+func (db *DB) GetBootAsset(id string) (*models.BootAsset, error) {
+	query := `SELECT` + bootAssetColumns + `FROM boot_assets WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + bootAssetColumns + `FROM boot_assets WHERE id = $1`
+	}
+
+	asset, err := scanBootAsset(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot asset: %w", err)
+	}
+	return asset, nil
+}
+
+// ListBootAssets lists boot assets, newest first
+func (db *DB) ListBootAssets() ([]*models.BootAsset, error) {
+	rows, err := db.Query(`SELECT` + bootAssetColumns + `FROM boot_assets ORDER BY created_at DESC, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot assets: %w", err)
+	}
+	defer rows.Close()
+
+	var assets []*models.BootAsset
+	for rows.Next() {
+		asset, err := scanBootAsset(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan boot asset: %w", err)
+		}
+		assets = append(assets, asset)
+	}
+
+	return assets, rows.Err()
+}
+
+// DeleteBootAsset deletes a boot asset's record, leaving its file. It
+// returns false if there is no such asset.
+func (db *DB) DeleteBootAsset(id string) (bool, error) {
+	query := "DELETE FROM boot_assets WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM boot_assets WHERE id = $1"
+	}
+
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete boot asset: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// BootAssetHashes returns the SHA-256 of every boot asset, for finding
+// stored files nothing refers to any more
+func (db *DB) BootAssetHashes() (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT sha256 FROM boot_assets")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot asset hashes: %w", err)
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("failed to scan boot asset hash: %w", err)
+		}
+		hashes[hash] = true
+	}
+
+	return hashes, rows.Err()
+}
+
+// BootAssetOverrides returns the IDs of the machines whose boot overrides
+// use an asset, expired ones included
+func (db *DB) BootAssetOverrides(assetID string) ([]string, error) {
+	query := `SELECT machine_id FROM boot_overrides
+		WHERE kernel_asset_id = ? OR initrd_asset_id = ? OR iso_asset_id = ? ORDER BY machine_id`
+	if db.driver == "postgres" {
+		query = `SELECT machine_id FROM boot_overrides
+			WHERE kernel_asset_id = $1 OR initrd_asset_id = $1 OR iso_asset_id = $1 ORDER BY machine_id`
+	}
+
+	args := []interface{}{assetID, assetID, assetID}
+	if db.driver == "postgres" {
+		args = args[:1]
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot overrides of asset: %w", err)
+	}
+	defer rows.Close()
+
+	var machineIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan boot override: %w", err)
+		}
+		machineIDs = append(machineIDs, id)
+	}
+
+	return machineIDs, rows.Err()
+}
+
+// SetBootOverride sets a machine's boot override, replacing any it has
+func (db *DB) SetBootOverride(override *models.BootOverride) error {
+	override.BootsServed = 0
+	override.CreatedAt = time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	remove := "DELETE FROM boot_overrides WHERE machine_id = ?"
+	if db.driver == "postgres" {
+		remove = "DELETE FROM boot_overrides WHERE machine_id = $1"
+	}
+
+	if _, err := tx.Exec(remove, override.MachineID); err != nil {
+		return fmt.Errorf("failed to replace boot override: %w", err)
+	}
+	if err := db.insertBootOverride(tx, override); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) insertBootOverride(tx *sql.Tx, override *models.BootOverride) error {
+	query := `INSERT INTO boot_overrides (` + bootOverrideColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO boot_overrides (` + bootOverrideColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	}
+
+	_, err := tx.Exec(query,
+		override.MachineID,
+		override.Script,
+		override.KernelAssetID,
+		override.InitrdAssetID,
+		override.ISOAssetID,
+		override.Cmdline,
+		override.MaxBoots,
+		override.BootsServed,
+		override.ExpiresAt,
+		override.CreatedBy,
+		override.CreatedAt,
+		override.DiagnosticRunID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set boot override: %w", err)
+	}
+	return nil
+}
+
+// GetBootOverride returns a machine's boot override, even if it has
+// expired. It returns nil, nil if the machine has none.
+func (db *DB) GetBootOverride(machineID string) (*models.BootOverride, error) {
+	query := `SELECT` + bootOverrideColumns + `FROM boot_overrides WHERE machine_id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + bootOverrideColumns + `FROM boot_overrides WHERE machine_id = $1`
+	}
+
+	override, err := scanBootOverride(db.QueryRow(query, machineID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot override: %w", err)
+	}
+	return override, nil
+}
+
+// CountBootOverrideServe counts a serve of a machine's boot override and
+// returns the override as counted, or nil if the machine has none
+func (db *DB) CountBootOverrideServe(machineID string) (*models.BootOverride, error) {
+	query := "UPDATE boot_overrides SET boots_served = boots_served + 1 WHERE machine_id = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE boot_overrides SET boots_served = boots_served + 1 WHERE machine_id = $1"
+	}
+
+	if _, err := db.Exec(query, machineID); err != nil {
+		return nil, fmt.Errorf("failed to count boot override serve: %w", err)
+	}
+	return db.GetBootOverride(machineID)
+}
+
+// ClearBootOverride removes a machine's boot override. It returns false if
+// the machine has none.
+func (db *DB) ClearBootOverride(machineID string) (bool, error) {
+	query := "DELETE FROM boot_overrides WHERE machine_id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM boot_overrides WHERE machine_id = $1"
+	}
+
+	result, err := db.Exec(query, machineID)
+	if err != nil {
+		return false, fmt.Errorf("failed to clear boot override: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ClearDiagnosticBootOverride removes a machine's boot override if the
+// diagnostic run set it. It returns false if the machine has no override,
+// or another one.
+func (db *DB) ClearDiagnosticBootOverride(machineID, runID string) (bool, error) {
+	query := "DELETE FROM boot_overrides WHERE machine_id = ? AND diagnostic_run_id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM boot_overrides WHERE machine_id = $1 AND diagnostic_run_id = $2"
+	}
+
+	result, err := db.Exec(query, machineID, runID)
+	if err != nil {
+		return false, fmt.Errorf("failed to clear boot override: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func scanBootAsset(row rowScanner) (*models.BootAsset, error) {
+	var asset models.BootAsset
+	var uploadedBy sql.NullString
+
+	err := row.Scan(
+		&asset.ID,
+		&asset.Name,
+		&asset.Kind,
+		&asset.Size,
+		&asset.SHA256,
+		&uploadedBy,
+		&asset.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	asset.UploadedBy = uploadedBy.String
+	return &asset, nil
+}
+
+func scanBootOverride(row rowScanner) (*models.BootOverride, error) {
+	var override models.BootOverride
+	var expiresAt sql.NullTime
+
+	err := row.Scan(
+		&override.MachineID,
+		&override.Script,
+		&override.KernelAssetID,
+		&override.InitrdAssetID,
+		&override.ISOAssetID,
+		&override.Cmdline,
+		&override.MaxBoots,
+		&override.BootsServed,
+		&expiresAt,
+		&override.CreatedBy,
+		&override.CreatedAt,
+		&override.DiagnosticRunID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiresAt.Valid {
+		override.ExpiresAt = &expiresAt.Time
+	}
+	return &override, nil
+}
+
+func (db *DB) createBootAssetsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS boot_assets (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			sha256 TEXT NOT NULL,
+			uploaded_by TEXT,
+			created_at TIMESTAMP NOT NULL
+		)
+	`
+}
+
+func (db *DB) createBootOverridesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS boot_overrides (
+			machine_id TEXT PRIMARY KEY,
+			script TEXT NOT NULL DEFAULT '',
+			kernel_asset_id TEXT NOT NULL DEFAULT '',
+			initrd_asset_id TEXT NOT NULL DEFAULT '',
+			iso_asset_id TEXT NOT NULL DEFAULT '',
+			cmdline TEXT NOT NULL DEFAULT '',
+			max_boots INTEGER NOT NULL DEFAULT 0,
+			boots_served INTEGER NOT NULL DEFAULT 0,
+			expires_at TIMESTAMP,
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`
+}
@@ -0,0 +1,354 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const bootProfileColumns = `
+	id, name, description, kernel_path, initrd_path, extra_cmdline,
+	enrollment_url, subnets, created_at, updated_at
+`
+
+// CreateBootProfile creates a boot profile and assigns it its groups
+func (db *DB) CreateBootProfile(profile *models.BootProfile) error {
+	profile.ID = uuid.New().String()
+	profile.CreatedAt = time.Now()
+	profile.UpdatedAt = profile.CreatedAt
+
+	query := `INSERT INTO boot_profiles (` + bootProfileColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO boot_profiles (` + bootProfileColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	}
+
+	subnets, err := marshalJSONColumn(profile.Subnets)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query,
+		profile.ID,
+		profile.Name,
+		profile.Description,
+		profile.KernelPath,
+		profile.InitrdPath,
+		profile.ExtraCmdline,
+		profile.EnrollmentURL,
+		subnets,
+		profile.CreatedAt,
+		profile.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create boot profile: %w", err)
+	}
+
+	if err := db.setBootProfileGroups(tx, profile.ID, profile.GroupIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetBootProfile retrieves a boot profile by ID. It returns nil, nil if
+// there is no such profile.
+func (db *DB) GetBootProfile(id string) (*models.BootProfile, error) {
+	query := `SELECT` + bootProfileColumns + `FROM boot_profiles WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + bootProfileColumns + `FROM boot_profiles WHERE id = $1`
+	}
+	return db.getBootProfile(query, id)
+}
+
+// GetBootProfileByName retrieves a boot profile by name. It returns nil,
+// nil if there is no such profile.
+func (db *DB) GetBootProfileByName(name string) (*models.BootProfile, error) {
+	query := `SELECT` + bootProfileColumns + `FROM boot_profiles WHERE name = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + bootProfileColumns + `FROM boot_profiles WHERE name = $1`
+	}
+	return db.getBootProfile(query, name)
+}
+
+func (db *DB) getBootProfile(query string, arg string) (*models.BootProfile, error) {
+	profile, err := scanBootProfile(db.QueryRow(query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot profile: %w", err)
+	}
+
+	groups, err := db.bootProfileGroups()
+	if err != nil {
+		return nil, err
+	}
+	profile.GroupIDs = append(profile.GroupIDs, groups[profile.ID]...)
+
+	return profile, nil
+}
+
+// ListBootProfiles lists all boot profiles by name, with their groups
+func (db *DB) ListBootProfiles() ([]*models.BootProfile, error) {
+	rows, err := db.Query(`SELECT` + bootProfileColumns + `FROM boot_profiles ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []*models.BootProfile
+	for rows.Next() {
+		profile, err := scanBootProfile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan boot profile: %w", err)
+		}
+		profiles = append(profiles, profile)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups, err := db.bootProfileGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		profile.GroupIDs = append(profile.GroupIDs, groups[profile.ID]...)
+	}
+
+	return profiles, nil
+}
+
+// UpdateBootProfile updates a boot profile and replaces its groups
+func (db *DB) UpdateBootProfile(profile *models.BootProfile) error {
+	profile.UpdatedAt = time.Now()
+
+	query := `UPDATE boot_profiles
+		SET name = ?, description = ?, kernel_path = ?, initrd_path = ?, extra_cmdline = ?,
+			enrollment_url = ?, subnets = ?, updated_at = ?
+		WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE boot_profiles
+			SET name = $1, description = $2, kernel_path = $3, initrd_path = $4, extra_cmdline = $5,
+				enrollment_url = $6, subnets = $7, updated_at = $8
+			WHERE id = $9`
+	}
+
+	subnets, err := marshalJSONColumn(profile.Subnets)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query,
+		profile.Name,
+		profile.Description,
+		profile.KernelPath,
+		profile.InitrdPath,
+		profile.ExtraCmdline,
+		profile.EnrollmentURL,
+		subnets,
+		profile.UpdatedAt,
+		profile.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update boot profile: %w", err)
+	}
+
+	if err := db.setBootProfileGroups(tx, profile.ID, profile.GroupIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteBootProfile deletes a boot profile. Its groups go back to the
+// profile selected by subnet, or the built-in registration image.
+func (db *DB) DeleteBootProfile(id string) error {
+	groups := "DELETE FROM boot_profile_groups WHERE profile_id = ?"
+	query := "DELETE FROM boot_profiles WHERE id = ?"
+	if db.driver == "postgres" {
+		groups = "DELETE FROM boot_profile_groups WHERE profile_id = $1"
+		query = "DELETE FROM boot_profiles WHERE id = $1"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(groups, id); err != nil {
+		return fmt.Errorf("failed to delete boot profile groups: %w", err)
+	}
+	if _, err := tx.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to delete boot profile: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// GroupBootProfiles returns the boot profile each of groupIDs is assigned,
+// by group ID. Groups without a profile are left out.
+func (db *DB) GroupBootProfiles(groupIDs []string) (map[string]string, error) {
+	assigned := make(map[string]string)
+	if len(groupIDs) == 0 {
+		return assigned, nil
+	}
+
+	query := "SELECT group_id, profile_id FROM boot_profile_groups WHERE group_id IN ("
+	args := make([]interface{}, len(groupIDs))
+	for i, id := range groupIDs {
+		if i > 0 {
+			query += ", "
+		}
+		if db.driver == "postgres" {
+			query += fmt.Sprintf("$%d", i+1)
+		} else {
+			query += "?"
+		}
+		args[i] = id
+	}
+	query += ")"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up group boot profiles: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var groupID, profileID string
+		if err := rows.Scan(&groupID, &profileID); err != nil {
+			return nil, err
+		}
+		assigned[groupID] = profileID
+	}
+
+	return assigned, rows.Err()
+}
+
+// bootProfileGroups returns the groups assigned to each profile, by profile
+// ID
+func (db *DB) bootProfileGroups() (map[string][]string, error) {
+	rows, err := db.Query("SELECT profile_id, group_id FROM boot_profile_groups ORDER BY group_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot profile groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := make(map[string][]string)
+	for rows.Next() {
+		var profileID, groupID string
+		if err := rows.Scan(&profileID, &groupID); err != nil {
+			return nil, err
+		}
+		groups[profileID] = append(groups[profileID], groupID)
+	}
+
+	return groups, rows.Err()
+}
+
+// setBootProfileGroups replaces the groups assigned to a profile
+func (db *DB) setBootProfileGroups(tx *sql.Tx, profileID string, groupIDs []string) error {
+	deleteGroups := "DELETE FROM boot_profile_groups WHERE profile_id = ?"
+	insert := "INSERT INTO boot_profile_groups (group_id, profile_id) VALUES (?, ?)"
+	if db.driver == "postgres" {
+		deleteGroups = "DELETE FROM boot_profile_groups WHERE profile_id = $1"
+		insert = "INSERT INTO boot_profile_groups (group_id, profile_id) VALUES ($1, $2)"
+	}
+
+	if _, err := tx.Exec(deleteGroups, profileID); err != nil {
+		return fmt.Errorf("failed to clear boot profile groups: %w", err)
+	}
+	for _, groupID := range groupIDs {
+		if _, err := tx.Exec(insert, groupID, profileID); err != nil {
+			return fmt.Errorf("failed to assign group %s to boot profile: %w", groupID, err)
+		}
+	}
+	return nil
+}
+
+func scanBootProfile(row rowScanner) (*models.BootProfile, error) {
+	var profile models.BootProfile
+	var description, extraCmdline, enrollmentURL sql.NullString
+	var subnets jsonColumn
+
+	err := row.Scan(
+		&profile.ID,
+		&profile.Name,
+		&description,
+		&profile.KernelPath,
+		&profile.InitrdPath,
+		&extraCmdline,
+		&enrollmentURL,
+		&subnets,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	profile.Description = description.String
+	profile.ExtraCmdline = extraCmdline.String
+	profile.EnrollmentURL = enrollmentURL.String
+	if err := subnets.Unmarshal(&profile.Subnets); err != nil {
+		return nil, fmt.Errorf("failed to decode subnets: %w", err)
+	}
+	if profile.Subnets == nil {
+		profile.Subnets = []string{}
+	}
+	profile.GroupIDs = []string{}
+
+	return &profile, nil
+}
+
+func (db *DB) createBootProfilesTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS boot_profiles (
+			id TEXT PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT,
+			kernel_path TEXT NOT NULL,
+			initrd_path TEXT NOT NULL,
+			extra_cmdline TEXT,
+			enrollment_url TEXT,
+			subnets %s,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)
+	`, jsonType)
+}
+
+// A group has at most one boot profile, so group_id is the key
+func (db *DB) createBootProfileGroupsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS boot_profile_groups (
+			group_id TEXT PRIMARY KEY,
+			profile_id TEXT NOT NULL,
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE,
+			FOREIGN KEY (profile_id) REFERENCES boot_profiles(id) ON DELETE CASCADE
+		)
+	`
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const bootSigningKeyColumns = `
+	fingerprint, subject, not_after, certificate, first_used_at, last_used_at
+`
+
+// RecordBootSigningKey records that a key is signing boot artifacts,
+// adding it if it is new and updating when it was last used
+func (db *DB) RecordBootSigningKey(key *models.BootSigningKey) error {
+	now := time.Now()
+	query := `
+		INSERT INTO boot_signing_keys (` + bootSigningKeyColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (fingerprint) DO UPDATE SET last_used_at = excluded.last_used_at
+	`
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO boot_signing_keys (` + bootSigningKeyColumns + `)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (fingerprint) DO UPDATE SET last_used_at = excluded.last_used_at
+		`
+	}
+
+	_, err := db.Exec(query, key.Fingerprint, key.Subject, key.NotAfter, key.Certificate, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to record boot signing key: %w", err)
+	}
+	return nil
+}
+
+// ListBootSigningKeys lists every key that has signed boot artifacts,
+// oldest first
+func (db *DB) ListBootSigningKeys() ([]*models.BootSigningKey, error) {
+	rows, err := db.Query(`SELECT` + bootSigningKeyColumns + `FROM boot_signing_keys ORDER BY first_used_at, fingerprint`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list boot signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*models.BootSigningKey
+	for rows.Next() {
+		key := &models.BootSigningKey{}
+		if err := rows.Scan(&key.Fingerprint, &key.Subject, &key.NotAfter, &key.Certificate,
+			&key.FirstUsedAt, &key.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan boot signing key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (db *DB) createBootSigningKeysTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS boot_signing_keys (
+			fingerprint TEXT PRIMARY KEY,
+			subject TEXT NOT NULL,
+			not_after TIMESTAMP NOT NULL,
+			certificate TEXT NOT NULL,
+			first_used_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP NOT NULL
+		)
+	`
+}
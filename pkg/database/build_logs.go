@@ -0,0 +1,201 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// SaveBuildLog stores a build's log gzipped, replacing any log the build
+// already has. A log longer than maxBytes keeps its start and end, with a
+// marker in place of the middle; maxBytes of 0 stores the whole log.
+func (db *DB) SaveBuildLog(buildID, output string, maxBytes int) error {
+	output, truncated := truncateMiddle(output, maxBytes)
+
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	if _, err := gz.Write([]byte(output)); err != nil {
+		return fmt.Errorf("failed to compress build log: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress build log: %w", err)
+	}
+
+	query := `
+		INSERT INTO build_logs (build_id, data, size, truncated_bytes, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (build_id) DO UPDATE SET
+			data = excluded.data, size = excluded.size,
+			truncated_bytes = excluded.truncated_bytes, created_at = excluded.created_at
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO build_logs (build_id, data, size, truncated_bytes, created_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (build_id) DO UPDATE SET
+				data = excluded.data, size = excluded.size,
+				truncated_bytes = excluded.truncated_bytes, created_at = excluded.created_at
+		`
+	}
+
+	if _, err := db.Exec(query, buildID, data.Bytes(), len(output), truncated, time.Now()); err != nil {
+		return fmt.Errorf("failed to save build log: %w", err)
+	}
+
+	return nil
+}
+
+// OpenBuildLog returns a reader of a build's decompressed log. It returns
+// nil, nil if the build has no stored log.
+func (db *DB) OpenBuildLog(buildID string) (io.ReadCloser, error) {
+	query := "SELECT data FROM build_logs WHERE build_id = ?"
+	if db.driver == "postgres" {
+		query = "SELECT data FROM build_logs WHERE build_id = $1"
+	}
+
+	var data []byte
+	err := db.QueryRow(query, buildID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get build log: %w", err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress build log: %w", err)
+	}
+
+	return gz, nil
+}
+
+// MigrateBuildLog moves a log stored inline in the builds table, as logs
+// were before build_logs existed, to log storage. It reports whether there
+// was a log to move. A log is only cleared from the build once it is
+// stored, so an interrupted migration is safe to repeat.
+func (db *DB) MigrateBuildLog(buildID string, maxBytes int) (bool, error) {
+	query := "SELECT log_output FROM builds WHERE id = ?"
+	clear := "UPDATE builds SET log_output = NULL WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "SELECT log_output FROM builds WHERE id = $1"
+		clear = "UPDATE builds SET log_output = NULL WHERE id = $1"
+	}
+
+	var output sql.NullString
+	err := db.QueryRow(query, buildID).Scan(&output)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get inline build log: %w", err)
+	}
+	if output.String == "" {
+		return false, nil
+	}
+
+	if err := db.SaveBuildLog(buildID, output.String, maxBytes); err != nil {
+		return false, err
+	}
+	if _, err := db.Exec(clear, buildID); err != nil {
+		return false, fmt.Errorf("failed to clear inline build log: %w", err)
+	}
+
+	return true, nil
+}
+
+// MigrateBuildLogs moves every inline build log to log storage and returns
+// how many were moved
+func (db *DB) MigrateBuildLogs(maxBytes int) (int, error) {
+	rows, err := db.Query("SELECT id FROM builds WHERE log_output IS NOT NULL AND log_output <> ''")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list inline build logs: %w", err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan build id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range ids {
+		ok, err := db.MigrateBuildLog(id, maxBytes)
+		if err != nil {
+			return moved, fmt.Errorf("build %s: %w", id, err)
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	return moved, nil
+}
+
+// DeleteBuildLogsBefore deletes the logs of builds created before cutoff,
+// whether stored or still inline, and returns how many were deleted. The
+// builds themselves are kept.
+func (db *DB) DeleteBuildLogsBefore(cutoff time.Time) (int64, error) {
+	deleteLogs := "DELETE FROM build_logs WHERE build_id IN (SELECT id FROM builds WHERE created_at < ?)"
+	clearInline := "UPDATE builds SET log_output = NULL WHERE log_output IS NOT NULL AND created_at < ?"
+	if db.driver == "postgres" {
+		deleteLogs = "DELETE FROM build_logs WHERE build_id IN (SELECT id FROM builds WHERE created_at < $1)"
+		clearInline = "UPDATE builds SET log_output = NULL WHERE log_output IS NOT NULL AND created_at < $1"
+	}
+
+	var deleted int64
+	for _, query := range []string{deleteLogs, clearInline} {
+		result, err := db.Exec(query, cutoff)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete build logs: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+
+	return deleted, nil
+}
+
+// truncateMiddle shortens s to about maxBytes by cutting out its middle on
+// line boundaries, and returns the result and how many bytes were cut. The
+// start of a failed build shows what it was building and the end shows why
+// it failed, so both are kept.
+func truncateMiddle(s string, maxBytes int) (string, int) {
+	if maxBytes <= 0 || len(s) <= maxBytes {
+		return s, 0
+	}
+
+	head := s[:maxBytes/2]
+	if i := strings.LastIndexByte(head, '\n'); i >= 0 {
+		head = head[:i+1]
+	}
+	tail := s[len(s)-maxBytes/2:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+
+	cut := len(s) - len(head) - len(tail)
+	marker := fmt.Sprintf("... [%d bytes truncated] ...\n", cut)
+	if head != "" && !strings.HasSuffix(head, "\n") {
+		marker = "\n" + marker
+	}
+
+	return head + marker + tail, cut
+}
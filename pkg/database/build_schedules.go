@@ -0,0 +1,416 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const buildScheduleColumns = `
+	id, scope, scope_id, cron, timezone, mode, skip_unchanged, grace_minutes,
+	enabled, next_run_at, last_run_at, created_by, created_at, updated_at
+`
+
+const buildScheduleRunColumns = `
+	id, schedule_id, machine_id, scheduled_for, status, build_id, reason, created_at, completed_at
+`
+
+// CreateBuildSchedule creates a build schedule
+func (db *DB) CreateBuildSchedule(schedule *models.BuildSchedule) error {
+	schedule.ID = uuid.New().String()
+	schedule.CreatedAt = time.Now()
+	schedule.UpdatedAt = schedule.CreatedAt
+
+	query := `INSERT INTO build_schedules (` + buildScheduleColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO build_schedules (` + buildScheduleColumns + `)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+	}
+
+	_, err := db.Exec(query,
+		schedule.ID,
+		schedule.Scope,
+		schedule.ScopeID,
+		schedule.Cron,
+		schedule.Timezone,
+		schedule.Mode,
+		schedule.SkipUnchanged,
+		schedule.GraceMinutes,
+		schedule.Enabled,
+		schedule.NextRunAt,
+		schedule.LastRunAt,
+		schedule.CreatedBy,
+		schedule.CreatedAt,
+		schedule.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create build schedule: %w", err)
+	}
+	return nil
+}
+
+// UpdateBuildSchedule updates a build schedule's settings and next run
+func (db *DB) UpdateBuildSchedule(schedule *models.BuildSchedule) error {
+	schedule.UpdatedAt = time.Now()
+
+	query := `
+		UPDATE build_schedules SET
+			cron = ?, timezone = ?, mode = ?, skip_unchanged = ?, grace_minutes = ?,
+			enabled = ?, next_run_at = ?, updated_at = ?
+		WHERE id = ?
+	`
+	if db.driver == "postgres" {
+		query = `
+			UPDATE build_schedules SET
+				cron = $1, timezone = $2, mode = $3, skip_unchanged = $4, grace_minutes = $5,
+				enabled = $6, next_run_at = $7, updated_at = $8
+			WHERE id = $9
+		`
+	}
+
+	_, err := db.Exec(query,
+		schedule.Cron,
+		schedule.Timezone,
+		schedule.Mode,
+		schedule.SkipUnchanged,
+		schedule.GraceMinutes,
+		schedule.Enabled,
+		schedule.NextRunAt,
+		schedule.UpdatedAt,
+		schedule.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update build schedule: %w", err)
+	}
+	return nil
+}
+
+// AdvanceBuildSchedule moves a schedule that was due at dueAt on to its
+// next run, recording that it ran at ranAt. It returns false if the
+// schedule is no longer due at dueAt, because it was changed or another
+// server ran it, so each due time runs once.
+func (db *DB) AdvanceBuildSchedule(id string, dueAt time.Time, nextRunAt *time.Time, ranAt time.Time) (bool, error) {
+	query := `UPDATE build_schedules SET next_run_at = ?, last_run_at = ? WHERE id = ? AND next_run_at = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE build_schedules SET next_run_at = $1, last_run_at = $2 WHERE id = $3 AND next_run_at = $4`
+	}
+
+	result, err := db.Exec(query, nextRunAt, ranAt, id, dueAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to advance build schedule: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetBuildSchedule retrieves a build schedule. It returns nil, nil if there
+// is no such schedule.
+func (db *DB) GetBuildSchedule(id string) (*models.BuildSchedule, error) {
+	query := `SELECT` + buildScheduleColumns + `FROM build_schedules WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildScheduleColumns + `FROM build_schedules WHERE id = $1`
+	}
+	return db.getBuildSchedule(query, id)
+}
+
+// GetBuildScheduleFor retrieves the build schedule of a machine or group.
+// It returns nil, nil if it has none.
+func (db *DB) GetBuildScheduleFor(scope, scopeID string) (*models.BuildSchedule, error) {
+	query := `SELECT` + buildScheduleColumns + `FROM build_schedules WHERE scope = ? AND scope_id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildScheduleColumns + `FROM build_schedules WHERE scope = $1 AND scope_id = $2`
+	}
+	return db.getBuildSchedule(query, scope, scopeID)
+}
+
+func (db *DB) getBuildSchedule(query string, args ...interface{}) (*models.BuildSchedule, error) {
+	schedule, err := scanBuildSchedule(db.QueryRow(query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get build schedule: %w", err)
+	}
+	return schedule, nil
+}
+
+// ListBuildSchedules lists all build schedules, soonest next run first
+func (db *DB) ListBuildSchedules() ([]*models.BuildSchedule, error) {
+	return db.queryBuildSchedules(`SELECT` + buildScheduleColumns + `FROM build_schedules
+		ORDER BY enabled DESC, next_run_at IS NULL, next_run_at, created_at`)
+}
+
+// ListDueBuildSchedules lists enabled build schedules whose next run is
+// at or before now
+func (db *DB) ListDueBuildSchedules(now time.Time) ([]*models.BuildSchedule, error) {
+	query := `SELECT` + buildScheduleColumns + `FROM build_schedules
+		WHERE enabled = true AND next_run_at IS NOT NULL AND next_run_at <= ? ORDER BY next_run_at`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildScheduleColumns + `FROM build_schedules
+			WHERE enabled = true AND next_run_at IS NOT NULL AND next_run_at <= $1 ORDER BY next_run_at`
+	}
+	return db.queryBuildSchedules(query, now)
+}
+
+// ListMachineBuildSchedules lists the build schedules that cover a
+// machine: its own and those of its groups
+func (db *DB) ListMachineBuildSchedules(machineID string) ([]*models.BuildSchedule, error) {
+	query := `SELECT` + buildScheduleColumns + `FROM build_schedules
+		WHERE (scope = 'machine' AND scope_id = ?)
+			OR (scope = 'group' AND scope_id IN (SELECT group_id FROM group_memberships WHERE machine_id = ?))
+		ORDER BY next_run_at IS NULL, next_run_at`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildScheduleColumns + `FROM build_schedules
+			WHERE (scope = 'machine' AND scope_id = $1)
+				OR (scope = 'group' AND scope_id IN (SELECT group_id FROM group_memberships WHERE machine_id = $2))
+			ORDER BY next_run_at IS NULL, next_run_at`
+	}
+	return db.queryBuildSchedules(query, machineID, machineID)
+}
+
+func (db *DB) queryBuildSchedules(query string, args ...interface{}) ([]*models.BuildSchedule, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []*models.BuildSchedule
+	for rows.Next() {
+		schedule, err := scanBuildSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan build schedule: %w", err)
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, rows.Err()
+}
+
+// DeleteBuildSchedule deletes a build schedule and its run history
+func (db *DB) DeleteBuildSchedule(id string) error {
+	runs := "DELETE FROM build_schedule_runs WHERE schedule_id = ?"
+	query := "DELETE FROM build_schedules WHERE id = ?"
+	if db.driver == "postgres" {
+		runs = "DELETE FROM build_schedule_runs WHERE schedule_id = $1"
+		query = "DELETE FROM build_schedules WHERE id = $1"
+	}
+
+	// SQLite doesn't enforce the runs' foreign key, so they don't cascade
+	if _, err := db.Exec(runs, id); err != nil {
+		return fmt.Errorf("failed to delete build schedule runs: %w", err)
+	}
+	if _, err := db.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to delete build schedule: %w", err)
+	}
+	return nil
+}
+
+// deleteScopeBuildSchedule deletes the build schedule of a machine or
+// group that is being deleted, with its run history
+func (db *DB) deleteScopeBuildSchedule(exec execer, scope, scopeID string) error {
+	runs := "DELETE FROM build_schedule_runs WHERE schedule_id IN (SELECT id FROM build_schedules WHERE scope = ? AND scope_id = ?)"
+	query := "DELETE FROM build_schedules WHERE scope = ? AND scope_id = ?"
+	if db.driver == "postgres" {
+		runs = "DELETE FROM build_schedule_runs WHERE schedule_id IN (SELECT id FROM build_schedules WHERE scope = $1 AND scope_id = $2)"
+		query = "DELETE FROM build_schedules WHERE scope = $1 AND scope_id = $2"
+	}
+
+	if _, err := exec.Exec(runs, scope, scopeID); err != nil {
+		return fmt.Errorf("failed to delete build schedule runs: %w", err)
+	}
+	if _, err := exec.Exec(query, scope, scopeID); err != nil {
+		return fmt.Errorf("failed to delete build schedule: %w", err)
+	}
+	return nil
+}
+
+// CreateBuildScheduleRun records what a scheduled run did for a machine
+func (db *DB) CreateBuildScheduleRun(run *models.BuildScheduleRun) error {
+	run.ID = uuid.New().String()
+	run.CreatedAt = time.Now()
+
+	query := `INSERT INTO build_schedule_runs (` + buildScheduleRunColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO build_schedule_runs (` + buildScheduleRunColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	}
+
+	_, err := db.Exec(query,
+		run.ID,
+		run.ScheduleID,
+		run.MachineID,
+		run.ScheduledFor,
+		run.Status,
+		run.BuildID,
+		run.Reason,
+		run.CreatedAt,
+		run.CompletedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create build schedule run: %w", err)
+	}
+	return nil
+}
+
+// UpdateBuildScheduleRun stores a scheduled run's progress
+func (db *DB) UpdateBuildScheduleRun(run *models.BuildScheduleRun) error {
+	query := `UPDATE build_schedule_runs SET status = ?, reason = ?, completed_at = ? WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE build_schedule_runs SET status = $1, reason = $2, completed_at = $3 WHERE id = $4`
+	}
+
+	if _, err := db.Exec(query, run.Status, run.Reason, run.CompletedAt, run.ID); err != nil {
+		return fmt.Errorf("failed to update build schedule run: %w", err)
+	}
+	return nil
+}
+
+// ListBuildScheduleRuns lists a schedule's runs, newest first. A limit of
+// 0 lists them all.
+func (db *DB) ListBuildScheduleRuns(scheduleID string, limit int) ([]*models.BuildScheduleRun, error) {
+	query := `SELECT` + buildScheduleRunColumns + `FROM build_schedule_runs WHERE schedule_id = ? ORDER BY created_at DESC`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildScheduleRunColumns + `FROM build_schedule_runs WHERE schedule_id = $1 ORDER BY created_at DESC`
+	}
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return db.queryBuildScheduleRuns(query, scheduleID)
+}
+
+// ListActiveBuildScheduleRuns lists runs still waiting to power cycle
+// their machine, oldest first
+func (db *DB) ListActiveBuildScheduleRuns() ([]*models.BuildScheduleRun, error) {
+	return db.queryBuildScheduleRuns(`SELECT` + buildScheduleRunColumns + `FROM build_schedule_runs
+		WHERE status IN ('building', 'waiting') ORDER BY created_at`)
+}
+
+func (db *DB) queryBuildScheduleRuns(query string, args ...interface{}) ([]*models.BuildScheduleRun, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build schedule runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []*models.BuildScheduleRun
+	for rows.Next() {
+		run, err := scanBuildScheduleRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan build schedule run: %w", err)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func scanBuildSchedule(row rowScanner) (*models.BuildSchedule, error) {
+	var schedule models.BuildSchedule
+	var createdBy sql.NullString
+	var nextRunAt, lastRunAt sql.NullTime
+
+	err := row.Scan(
+		&schedule.ID,
+		&schedule.Scope,
+		&schedule.ScopeID,
+		&schedule.Cron,
+		&schedule.Timezone,
+		&schedule.Mode,
+		&schedule.SkipUnchanged,
+		&schedule.GraceMinutes,
+		&schedule.Enabled,
+		&nextRunAt,
+		&lastRunAt,
+		&createdBy,
+		&schedule.CreatedAt,
+		&schedule.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule.CreatedBy = createdBy.String
+	if nextRunAt.Valid {
+		schedule.NextRunAt = &nextRunAt.Time
+	}
+	if lastRunAt.Valid {
+		schedule.LastRunAt = &lastRunAt.Time
+	}
+	return &schedule, nil
+}
+
+func scanBuildScheduleRun(row rowScanner) (*models.BuildScheduleRun, error) {
+	var run models.BuildScheduleRun
+	var machineID, buildID, reason sql.NullString
+	var completedAt sql.NullTime
+
+	err := row.Scan(
+		&run.ID,
+		&run.ScheduleID,
+		&machineID,
+		&run.ScheduledFor,
+		&run.Status,
+		&buildID,
+		&reason,
+		&run.CreatedAt,
+		&completedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	run.MachineID = machineID.String
+	run.BuildID = buildID.String
+	run.Reason = reason.String
+	if completedAt.Valid {
+		run.CompletedAt = &completedAt.Time
+	}
+	return &run, nil
+}
+
+func (db *DB) createBuildSchedulesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS build_schedules (
+			id TEXT PRIMARY KEY,
+			scope TEXT NOT NULL,
+			scope_id TEXT NOT NULL,
+			cron TEXT NOT NULL,
+			timezone TEXT NOT NULL DEFAULT 'UTC',
+			mode TEXT NOT NULL,
+			skip_unchanged BOOLEAN NOT NULL DEFAULT FALSE,
+			grace_minutes INTEGER NOT NULL DEFAULT 60,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			next_run_at TIMESTAMP,
+			last_run_at TIMESTAMP,
+			created_by TEXT,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			UNIQUE (scope, scope_id)
+		)
+	`
+}
+
+func (db *DB) createBuildScheduleRunsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS build_schedule_runs (
+			id TEXT PRIMARY KEY,
+			schedule_id TEXT NOT NULL,
+			machine_id TEXT,
+			scheduled_for TIMESTAMP NOT NULL,
+			status TEXT NOT NULL,
+			build_id TEXT,
+			reason TEXT,
+			created_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			FOREIGN KEY (schedule_id) REFERENCES build_schedules(id) ON DELETE CASCADE
+		)
+	`
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// RenewBuildLease extends a builder's lease on a build it is building. It
+// returns false if the build isn't building on that builder, because its
+// lease ran out and it went back in the queue or it has finished.
+func (db *DB) RenewBuildLease(id, builder string, leaseExpiresAt time.Time) (bool, error) {
+	query := `UPDATE builds SET lease_expires_at = ? WHERE id = ? AND status = 'building' AND builder = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE builds SET lease_expires_at = $1 WHERE id = $2 AND status = 'building' AND builder = $3`
+	}
+
+	result, err := db.Exec(query, leaseExpiresAt, id, builder)
+	if err != nil {
+		return false, fmt.Errorf("failed to renew build lease: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// FinishBuild records the outcome of a build that is building on its
+// builder, and releases its lease. It returns false if the build isn't
+// building on that builder.
+func (db *DB) FinishBuild(build *models.BuildRequest) (bool, error) {
+	warningsJSON, err := marshalJSONColumn(build.Warnings)
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+		UPDATE builds SET
+			status = ?, error = ?, artifact_url = ?, completed_at = ?,
+			duration_ms = ?, peak_memory_bytes = ?, system_path = ?,
+			closure_diff_from = ?, closure_diff = ?, signing_key = ?,
+			warnings = ?, artifact_bytes = ?, lease_expires_at = NULL
+		WHERE id = ? AND status = 'building' AND builder = ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE builds SET
+				status = $1, error = $2, artifact_url = $3, completed_at = $4,
+				duration_ms = $5, peak_memory_bytes = $6, system_path = $7,
+				closure_diff_from = $8, closure_diff = $9, signing_key = $10,
+				warnings = $11, artifact_bytes = $12, lease_expires_at = NULL
+			WHERE id = $13 AND status = 'building' AND builder = $14
+		`
+	}
+
+	result, err := db.Exec(query,
+		build.Status,
+		build.Error,
+		build.ArtifactURL,
+		build.CompletedAt,
+		build.DurationMS,
+		build.PeakMemoryBytes,
+		build.SystemPath,
+		build.ClosureDiffFrom,
+		build.ClosureDiff,
+		build.SigningKey,
+		warningsJSON,
+		build.ArtifactBytes,
+		build.ID,
+		build.Builder,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to finish build: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		build.LeaseExpiresAt = nil
+	}
+	return n > 0, nil
+}
+
+// ListExpiredBuildLeases lists building builds whose lease ran out before
+// now. Builds claimed without a lease, by builders from before leases,
+// never expire.
+func (db *DB) ListExpiredBuildLeases(now time.Time) ([]*models.BuildRequest, error) {
+	query := `SELECT` + buildColumns + `FROM builds
+		WHERE status = 'building' AND lease_expires_at IS NOT NULL AND lease_expires_at < ?
+		ORDER BY lease_expires_at`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildColumns + `FROM builds
+			WHERE status = 'building' AND lease_expires_at IS NOT NULL AND lease_expires_at < $1
+			ORDER BY lease_expires_at`
+	}
+
+	rows, err := db.Query(query, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired build leases: %w", err)
+	}
+	defer rows.Close()
+
+	var builds []*models.BuildRequest
+	for rows.Next() {
+		build, err := scanBuild(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan build: %w", err)
+		}
+		builds = append(builds, build)
+	}
+
+	return builds, rows.Err()
+}
+
+// RequeueBuild puts a build whose lease ran out back in the queue. It
+// returns false if the build is no longer building on builder, or its
+// lease was renewed.
+func (db *DB) RequeueBuild(id, builder string, now time.Time) (bool, error) {
+	query := `
+		UPDATE builds SET status = 'pending', builder = NULL, lease_expires_at = NULL
+		WHERE id = ? AND status = 'building' AND builder = ? AND lease_expires_at < ?
+	`
+	if db.driver == "postgres" {
+		query = `
+			UPDATE builds SET status = 'pending', builder = NULL, lease_expires_at = NULL
+			WHERE id = $1 AND status = 'building' AND builder = $2 AND lease_expires_at < $3
+		`
+	}
+
+	result, err := db.Exec(query, id, builder, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to requeue build: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// AppendBuildLog adds output to the end of a build's log, which keeps its
+// start and end when it grows past maxBytes, as SaveBuildLog does
+func (db *DB) AppendBuildLog(buildID, output string, maxBytes int) error {
+	existing, err := db.OpenBuildLog(buildID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		data, err := io.ReadAll(existing)
+		existing.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read build log: %w", err)
+		}
+		output = string(data) + output
+	}
+
+	return db.SaveBuildLog(buildID, output, maxBytes)
+}
@@ -0,0 +1,299 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const builderColumns = `
+	name, builder_version, nix_version, nixpkgs_version, nixpkgs_revision,
+	architectures, labels, max_concurrent_builds, cordoned, started_at,
+	last_seen_at, health, gc_request_id, gc_max_freed_bytes, gc_requested_by,
+	gc_requested_at
+`
+
+// RecordBuilderHeartbeat registers a builder or updates its environment,
+// capabilities, health, and last-seen time. Whether the builder is
+// cordoned, and any garbage collection asked of it, are left alone.
+func (db *DB) RecordBuilderHeartbeat(builder *models.Builder) error {
+	architecturesJSON, err := marshalJSONColumn(nonNilStrings(builder.Architectures))
+	if err != nil {
+		return fmt.Errorf("failed to marshal architectures: %w", err)
+	}
+	labelsJSON, err := marshalJSONColumn(nonNilStrings(builder.Labels))
+	if err != nil {
+		return fmt.Errorf("failed to marshal labels: %w", err)
+	}
+	healthJSON, err := marshalJSONColumn(builder.Health)
+	if err != nil {
+		return fmt.Errorf("failed to marshal health: %w", err)
+	}
+
+	query := `
+		INSERT INTO builders (name, builder_version, nix_version, nixpkgs_version,
+			nixpkgs_revision, architectures, labels, max_concurrent_builds,
+			started_at, last_seen_at, health)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			builder_version = excluded.builder_version, nix_version = excluded.nix_version,
+			nixpkgs_version = excluded.nixpkgs_version, nixpkgs_revision = excluded.nixpkgs_revision,
+			architectures = excluded.architectures, labels = excluded.labels,
+			max_concurrent_builds = excluded.max_concurrent_builds,
+			started_at = excluded.started_at, last_seen_at = excluded.last_seen_at,
+			health = excluded.health
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO builders (name, builder_version, nix_version, nixpkgs_version,
+				nixpkgs_revision, architectures, labels, max_concurrent_builds,
+				started_at, last_seen_at, health)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (name) DO UPDATE SET
+				builder_version = excluded.builder_version, nix_version = excluded.nix_version,
+				nixpkgs_version = excluded.nixpkgs_version, nixpkgs_revision = excluded.nixpkgs_revision,
+				architectures = excluded.architectures, labels = excluded.labels,
+				max_concurrent_builds = excluded.max_concurrent_builds,
+				started_at = excluded.started_at, last_seen_at = excluded.last_seen_at,
+			health = excluded.health
+		`
+	}
+
+	_, err = db.Exec(query,
+		builder.Name,
+		builder.Environment.BuilderVersion,
+		builder.Environment.NixVersion,
+		builder.Environment.NixpkgsVersion,
+		builder.Environment.NixpkgsRevision,
+		architecturesJSON,
+		labelsJSON,
+		builder.MaxConcurrentBuilds,
+		builder.StartedAt,
+		builder.LastSeenAt,
+		healthJSON,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record builder heartbeat: %w", err)
+	}
+
+	return nil
+}
+
+// GetBuilder retrieves a builder by name. It returns nil, nil if no such
+// builder has registered. Current builds and queue depth are not filled in.
+func (db *DB) GetBuilder(name string) (*models.Builder, error) {
+	query := `SELECT` + builderColumns + `FROM builders WHERE name = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + builderColumns + `FROM builders WHERE name = $1`
+	}
+
+	builder, err := scanBuilder(db.QueryRow(query, name), time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get builder: %w", err)
+	}
+
+	return builder, nil
+}
+
+// ListBuilders lists every builder that has registered, by name, with the
+// builds each is running
+func (db *DB) ListBuilders() ([]*models.Builder, error) {
+	rows, err := db.Query(`SELECT` + builderColumns + `FROM builders ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list builders: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var builders []*models.Builder
+	byName := map[string]*models.Builder{}
+	for rows.Next() {
+		builder, err := scanBuilder(rows, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan builder: %w", err)
+		}
+		builders = append(builders, builder)
+		byName[builder.Name] = builder
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	running, err := db.Query(`
+		SELECT builder, id FROM builds
+		WHERE status = 'building' AND builder IS NOT NULL
+		ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list running builds: %w", err)
+	}
+	defer running.Close()
+
+	for running.Next() {
+		var name, buildID string
+		if err := running.Scan(&name, &buildID); err != nil {
+			return nil, fmt.Errorf("failed to scan running build: %w", err)
+		}
+		if builder := byName[name]; builder != nil {
+			builder.CurrentBuildIDs = append(builder.CurrentBuildIDs, buildID)
+		}
+	}
+
+	return builders, running.Err()
+}
+
+// SetBuilderCordoned cordons a builder, so it claims no new builds, or
+// uncordons it. It returns false if no such builder has registered.
+func (db *DB) SetBuilderCordoned(name string, cordoned bool) (bool, error) {
+	query := "UPDATE builders SET cordoned = ? WHERE name = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE builders SET cordoned = $1 WHERE name = $2"
+	}
+
+	result, err := db.Exec(query, cordoned, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to cordon builder: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RequestBuilderGC asks a builder to collect garbage, replacing any request
+// it hasn't run yet. It returns false if no such builder has registered.
+func (db *DB) RequestBuilderGC(name string, req *models.BuilderGCRequest) (bool, error) {
+	query := `UPDATE builders
+		SET gc_request_id = ?, gc_max_freed_bytes = ?, gc_requested_by = ?, gc_requested_at = ?
+		WHERE name = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE builders
+			SET gc_request_id = $1, gc_max_freed_bytes = $2, gc_requested_by = $3, gc_requested_at = $4
+			WHERE name = $5`
+	}
+
+	result, err := db.Exec(query, req.ID, req.MaxFreedBytes, req.RequestedBy, req.RequestedAt, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to request builder garbage collection: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ClearBuilderGCRequest clears a builder's garbage collection request once
+// it has run, unless it has since been replaced by another
+func (db *DB) ClearBuilderGCRequest(name, requestID string) error {
+	query := `UPDATE builders
+		SET gc_request_id = NULL, gc_max_freed_bytes = NULL, gc_requested_by = NULL, gc_requested_at = NULL
+		WHERE name = ? AND gc_request_id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE builders
+			SET gc_request_id = NULL, gc_max_freed_bytes = NULL, gc_requested_by = NULL, gc_requested_at = NULL
+			WHERE name = $1 AND gc_request_id = $2`
+	}
+
+	if _, err := db.Exec(query, name, requestID); err != nil {
+		return fmt.Errorf("failed to clear builder garbage collection request: %w", err)
+	}
+	return nil
+}
+
+// scanBuilder reads a row of builderColumns. Online is judged as of now.
+func scanBuilder(row rowScanner, now time.Time) (*models.Builder, error) {
+	builder := &models.Builder{}
+	var builderVersion, nixVersion, nixpkgsVersion, nixpkgsRevision sql.NullString
+	var architecturesJSON, labelsJSON jsonColumn
+	var maxBuilds sql.NullInt64
+	var health jsonColumn
+	var gcRequestID, gcRequestedBy sql.NullString
+	var gcMaxFreed sql.NullInt64
+	var gcRequestedAt sql.NullTime
+
+	err := row.Scan(
+		&builder.Name,
+		&builderVersion,
+		&nixVersion,
+		&nixpkgsVersion,
+		&nixpkgsRevision,
+		&architecturesJSON,
+		&labelsJSON,
+		&maxBuilds,
+		&builder.Cordoned,
+		&builder.StartedAt,
+		&builder.LastSeenAt,
+		&health,
+		&gcRequestID,
+		&gcMaxFreed,
+		&gcRequestedBy,
+		&gcRequestedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	builder.Environment = models.BuildEnvironment{
+		BuilderVersion:  builderVersion.String,
+		NixVersion:      nixVersion.String,
+		NixpkgsVersion:  nixpkgsVersion.String,
+		NixpkgsRevision: nixpkgsRevision.String,
+	}
+	if err := architecturesJSON.Unmarshal(&builder.Architectures); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal architectures: %w", err)
+	}
+	if err := labelsJSON.Unmarshal(&builder.Labels); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal labels: %w", err)
+	}
+	builder.MaxConcurrentBuilds = int(maxBuilds.Int64)
+	builder.Online = now.Sub(builder.LastSeenAt) < models.BuilderOfflineAfter
+
+	if err := health.Unmarshal(&builder.Health); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal health: %w", err)
+	}
+	if builder.Health != nil && builder.Health.LowDisk() {
+		builder.Conditions = append(builder.Conditions, models.BuilderConditionLowDisk)
+	}
+	if gcRequestID.String != "" {
+		builder.PendingGC = &models.BuilderGCRequest{
+			ID:            gcRequestID.String,
+			MaxFreedBytes: gcMaxFreed.Int64,
+			RequestedBy:   gcRequestedBy.String,
+			RequestedAt:   gcRequestedAt.Time,
+		}
+	}
+
+	return builder, nil
+}
+
+func (db *DB) createBuildersTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS builders (
+			name TEXT PRIMARY KEY,
+			builder_version TEXT,
+			nix_version TEXT,
+			nixpkgs_version TEXT,
+			nixpkgs_revision TEXT,
+			architectures %s,
+			labels %s,
+			max_concurrent_builds INTEGER,
+			cordoned BOOLEAN NOT NULL DEFAULT FALSE,
+			started_at TIMESTAMP NOT NULL,
+			last_seen_at TIMESTAMP NOT NULL
+		)
+	`, jsonType, jsonType)
+}
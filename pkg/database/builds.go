@@ -2,81 +2,167 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 	"github.com/google/uuid"
 )
 
-// CreateBuild creates a new build request
-func (db *DB) CreateBuild(machineID, config string) (*models.BuildRequest, error) {
-	build := &models.BuildRequest{
-		ID:        uuid.New().String(),
-		MachineID: machineID,
-		Status:    "pending",
-		Config:    config,
-		CreatedAt: time.Now(),
+const buildColumns = `
+	id, machine_id, status, config, require_test, priority, error,
+	artifact_url, created_at, completed_at, builder, builder_version,
+	nix_version, nixpkgs_version, nixpkgs_revision, duration_ms,
+	peak_memory_bytes, architecture, required_labels, type,
+	system_path, closure_diff, closure_diff_from, requested_by, reviewed_by,
+	reviewed_at, signing_key, lease_expires_at, attempts, lint, target,
+	config_hash, dry_run, warnings, artifact_bytes
+`
+
+// buildRankExpr ranks a build by priority, most urgent first. buildRank
+// ranks priorities the same way in Go.
+const buildRankExpr = `CASE priority WHEN 'urgent' THEN 0 WHEN 'high' THEN 1 WHEN 'low' THEN 3 ELSE 2 END`
+
+// buildQueueOrder orders pending builds the way they are claimed: most
+// urgent first, then oldest first
+const buildQueueOrder = " " + buildRankExpr + ", created_at, id "
+
+func buildRank(priority string) int {
+	switch priority {
+	case models.BuildPriorityUrgent:
+		return 0
+	case models.BuildPriorityHigh:
+		return 1
+	case models.BuildPriorityLow:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// CreateBuild creates a new build request of target, queued at priority,
+// or normal priority if empty. If requireTest is set, the machine is not ready after
+// the build until the build's boot test passes. If awaitingApproval is
+// set, the build isn't queued until an admin approves it. lint, the result
+// of linting the configuration, is recorded with the build, as is
+// configHash, the machine's ConfigHash. A dryRun build is evaluated but
+// not built.
+func (db *DB) CreateBuild(machineID, config, configHash, target string, requireTest, dryRun bool, priority string, requirements models.BuildRequirements, requestedBy string, awaitingApproval bool, lint *models.LintResult) (*models.BuildRequest, error) {
+	build := newBuild(machineID, config, target, priority, requestedBy, lint)
+	build.ConfigHash = configHash
+	build.RequireTest = requireTest
+	build.DryRun = dryRun
+	build.BuildRequirements = requirements
+	if awaitingApproval {
+		build.Status = models.BuildStatusAwaitingApproval
+	}
+
+	if err := db.insertBuild(build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// CreateLintFailedBuild records a build of a machine's configuration that
+// failed before it was queued, because linting the configuration found
+// errors. The errors are its error, so the build history says why the
+// configuration wasn't built.
+func (db *DB) CreateLintFailedBuild(machineID, config, target, priority, requestedBy string, lint *models.LintResult) (*models.BuildRequest, error) {
+	build := newBuild(machineID, config, target, priority, requestedBy, lint)
+	build.Status = "failed"
+	build.Error = lint.Summary()
+	build.CompletedAt = &build.CreatedAt
+
+	if err := db.insertBuild(build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func newBuild(machineID, config, target, priority, requestedBy string, lint *models.LintResult) *models.BuildRequest {
+	if priority == "" {
+		priority = models.BuildPriorityNormal
+	}
+
+	return &models.BuildRequest{
+		ID:          uuid.New().String(),
+		Type:        models.BuildTypeMachine,
+		MachineID:   machineID,
+		Status:      "pending",
+		Config:      config,
+		Priority:    priority,
+		Target:      target,
+		CreatedAt:   time.Now(),
+		RequestedBy: requestedBy,
+		Lint:        lint,
+	}
+}
+
+func (db *DB) insertBuild(build *models.BuildRequest) error {
+	labelsJSON, err := marshalBuilderLabels(build.RequiredLabels)
+	if err != nil {
+		return err
+	}
+	lintJSON, err := marshalJSONColumn(build.Lint)
+	if err != nil {
+		return err
 	}
 
 	query := `
-		INSERT INTO builds (id, machine_id, status, config, created_at)
-		VALUES (?, ?, ?, ?, ?)
+		INSERT INTO builds (id, machine_id, status, config, require_test, priority, created_at,
+			architecture, required_labels, requested_by, error, completed_at, lint, target,
+			config_hash, dry_run)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	if db.driver == "postgres" {
 		query = `
-			INSERT INTO builds (id, machine_id, status, config, created_at)
-			VALUES ($1, $2, $3, $4, $5)
+			INSERT INTO builds (id, machine_id, status, config, require_test, priority, created_at,
+				architecture, required_labels, requested_by, error, completed_at, lint, target,
+				config_hash, dry_run)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 		`
 	}
 
-	_, err := db.Exec(query,
+	_, err = db.Exec(query,
 		build.ID,
 		build.MachineID,
 		build.Status,
 		build.Config,
+		build.RequireTest,
+		build.Priority,
 		build.CreatedAt,
+		build.Architecture,
+		labelsJSON,
+		build.RequestedBy,
+		build.Error,
+		build.CompletedAt,
+		lintJSON,
+		build.Target,
+		build.ConfigHash,
+		build.DryRun,
 	)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to create build: %w", err)
+		return fmt.Errorf("failed to create build: %w", err)
 	}
 
-	return build, nil
+	return nil
 }
 
-// GetBuild retrieves a build by ID
+// GetBuild retrieves a build by ID. It returns nil, nil if there is no such
+// build.
 func (db *DB) GetBuild(id string) (*models.BuildRequest, error) {
-	build := &models.BuildRequest{}
-
-	query := `
-		SELECT id, machine_id, status, config, log_output, error, artifact_url,
-		       created_at, completed_at
-		FROM builds WHERE id = ?
-	`
-
+	query := `SELECT` + buildColumns + `FROM builds WHERE id = ?`
 	if db.driver == "postgres" {
-		query = `
-			SELECT id, machine_id, status, config, log_output, error, artifact_url,
-			       created_at, completed_at
-			FROM builds WHERE id = $1
-		`
+		query = `SELECT` + buildColumns + `FROM builds WHERE id = $1`
 	}
 
-	err := db.QueryRow(query, id).Scan(
-		&build.ID,
-		&build.MachineID,
-		&build.Status,
-		&build.Config,
-		&build.LogOutput,
-		&build.Error,
-		&build.ArtifactURL,
-		&build.CreatedAt,
-		&build.CompletedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	build, err := scanBuild(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
@@ -86,27 +172,59 @@ func (db *DB) GetBuild(id string) (*models.BuildRequest, error) {
 	return build, nil
 }
 
+// BuildFilter selects builds. Zero values match everything; a zero Limit
+// returns every matching build.
+type BuildFilter struct {
+	MachineID string
+	Status    string
+	Limit     int
+
+	// VisibleTo leaves out builds of machines claimed by users other than
+	// this one
+	VisibleTo string
+}
+
 // ListBuildsByMachine retrieves all builds for a machine
 func (db *DB) ListBuildsByMachine(machineID string) ([]*models.BuildRequest, error) {
-	query := `
-		SELECT id, machine_id, status, config, log_output, error, artifact_url,
-		       created_at, completed_at
-		FROM builds
-		WHERE machine_id = ?
-		ORDER BY created_at DESC
-	`
+	return db.ListBuilds(BuildFilter{MachineID: machineID})
+}
 
-	if db.driver == "postgres" {
-		query = `
-			SELECT id, machine_id, status, config, log_output, error, artifact_url,
-			       created_at, completed_at
-			FROM builds
-			WHERE machine_id = $1
-			ORDER BY created_at DESC
-		`
+// ListBuilds retrieves the builds matching filter, newest first. Successful
+// builds are listed by completion rather than creation.
+func (db *DB) ListBuilds(filter BuildFilter) ([]*models.BuildRequest, error) {
+	query := `SELECT` + buildColumns + `FROM builds WHERE 1=1`
+
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		if db.driver == "postgres" {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
 	}
 
-	rows, err := db.Query(query, machineID)
+	if filter.MachineID != "" {
+		query += " AND machine_id = " + arg(filter.MachineID)
+	}
+	if filter.Status != "" {
+		query += " AND status = " + arg(filter.Status)
+	}
+	if filter.VisibleTo != "" {
+		query += " AND " + visibleMachineCondition("machine_id", arg(filter.VisibleTo))
+	}
+
+	// Successful builds are ordered the way GetLatestSuccessfulBuild picks
+	// one, so the first is the build a deployment defaults to
+	if filter.Status == "success" {
+		query += " ORDER BY completed_at DESC, id DESC"
+	} else {
+		query += " ORDER BY created_at DESC, id DESC"
+	}
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list builds: %w", err)
 	}
@@ -114,18 +232,7 @@ func (db *DB) ListBuildsByMachine(machineID string) ([]*models.BuildRequest, err
 
 	var builds []*models.BuildRequest
 	for rows.Next() {
-		build := &models.BuildRequest{}
-		err := rows.Scan(
-			&build.ID,
-			&build.MachineID,
-			&build.Status,
-			&build.Config,
-			&build.LogOutput,
-			&build.Error,
-			&build.ArtifactURL,
-			&build.CreatedAt,
-			&build.CompletedAt,
-		)
+		build, err := scanBuild(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan build: %w", err)
 		}
@@ -135,28 +242,55 @@ func (db *DB) ListBuildsByMachine(machineID string) ([]*models.BuildRequest, err
 	return builds, nil
 }
 
+// GetLatestSuccessfulBuild retrieves a machine's most recent successful
+// netboot build, the image it boots; builds of other targets are
+// installers and bundles. It returns nil, nil if the machine has none.
+func (db *DB) GetLatestSuccessfulBuild(machineID string) (*models.BuildRequest, error) {
+	query := `SELECT` + buildColumns + `FROM builds
+		WHERE machine_id = ? AND status = 'success' AND target = 'netboot'
+		ORDER BY completed_at DESC LIMIT 1`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildColumns + `FROM builds
+			WHERE machine_id = $1 AND status = 'success' AND target = 'netboot'
+			ORDER BY completed_at DESC LIMIT 1`
+	}
+
+	build, err := scanBuild(db.QueryRow(query, machineID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get build: %w", err)
+	}
+
+	return build, nil
+}
+
 // UpdateBuild updates a build record
 func (db *DB) UpdateBuild(build *models.BuildRequest) error {
 	query := `
 		UPDATE builds SET
-			status = ?, log_output = ?, error = ?, artifact_url = ?, completed_at = ?
+			status = ?, error = ?, artifact_url = ?, completed_at = ?,
+			duration_ms = ?, peak_memory_bytes = ?
 		WHERE id = ?
 	`
 
 	if db.driver == "postgres" {
 		query = `
 			UPDATE builds SET
-				status = $1, log_output = $2, error = $3, artifact_url = $4, completed_at = $5
-			WHERE id = $6
+				status = $1, error = $2, artifact_url = $3, completed_at = $4,
+				duration_ms = $5, peak_memory_bytes = $6
+			WHERE id = $7
 		`
 	}
 
 	_, err := db.Exec(query,
 		build.Status,
-		build.LogOutput,
 		build.Error,
 		build.ArtifactURL,
 		build.CompletedAt,
+		build.DurationMS,
+		build.PeakMemoryBytes,
 		build.ID,
 	)
 
@@ -166,3 +300,450 @@ func (db *DB) UpdateBuild(build *models.BuildRequest) error {
 
 	return nil
 }
+
+// SetBuildEnvironment records the builder a build runs on and its
+// toolchain
+func (db *DB) SetBuildEnvironment(id, builder string, env models.BuildEnvironment) error {
+	query := `
+		UPDATE builds SET
+			builder = ?, builder_version = ?, nix_version = ?,
+			nixpkgs_version = ?, nixpkgs_revision = ?
+		WHERE id = ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE builds SET
+				builder = $1, builder_version = $2, nix_version = $3,
+				nixpkgs_version = $4, nixpkgs_revision = $5
+			WHERE id = $6
+		`
+	}
+
+	_, err := db.Exec(query,
+		builder,
+		env.BuilderVersion,
+		env.NixVersion,
+		env.NixpkgsVersion,
+		env.NixpkgsRevision,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set build environment: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimPendingBuild atomically claims the next queued build the builder can
+// run, moving it to building and recording the builder on it with a lease
+// until leaseExpiresAt. Builds are claimed most urgent first, then oldest
+// first, skipping those that need an architecture or label the builder
+// lacks. A cordoned builder claims nothing. It returns nil, nil if there is
+// nothing to claim.
+func (db *DB) ClaimPendingBuild(builder *models.Builder, leaseExpiresAt time.Time) (*models.BuildRequest, error) {
+	architectures, err := json.Marshal(nonNilStrings(builder.Architectures))
+	if err != nil {
+		return nil, err
+	}
+	labels, err := json.Marshal(nonNilStrings(builder.Labels))
+	if err != nil {
+		return nil, err
+	}
+
+	if db.driver == "postgres" {
+		query := `
+			UPDATE builds SET status = 'building', builder = $1, lease_expires_at = $4,
+				attempts = attempts + 1
+			WHERE id = (
+				SELECT id FROM builds
+				WHERE status IN ('pending', 'unschedulable')
+				AND (architecture IS NULL OR architecture = '' OR $2::jsonb ? architecture)
+				AND (required_labels IS NULL OR required_labels <@ $3::jsonb)
+				AND NOT EXISTS (SELECT 1 FROM builders WHERE name = $1 AND cordoned)
+				ORDER BY` + buildQueueOrder + `LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING` + buildColumns
+
+		build, err := scanBuild(db.QueryRow(query, builder.Name, string(architectures), string(labels), leaseExpiresAt))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim build: %w", err)
+		}
+		return build, nil
+	}
+
+	// SQLite has no row locks to skip, so pick a build and claim it only if
+	// it is still queued, trying the next one if another builder got there
+	// first
+	for {
+		build, err := scanBuild(db.QueryRow(`SELECT`+buildColumns+`FROM builds
+			WHERE status IN ('pending', 'unschedulable')
+			AND (architecture IS NULL OR architecture = ''
+				OR architecture IN (SELECT value FROM json_each(?)))
+			AND (required_labels IS NULL OR NOT EXISTS (
+				SELECT 1 FROM json_each(required_labels)
+				WHERE value NOT IN (SELECT value FROM json_each(?))))
+			AND NOT EXISTS (SELECT 1 FROM builders WHERE name = ? AND cordoned)
+			ORDER BY`+buildQueueOrder+`LIMIT 1`,
+			string(architectures), string(labels), builder.Name))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pending build: %w", err)
+		}
+
+		result, err := db.Exec(`UPDATE builds SET status = 'building', builder = ?, lease_expires_at = ?,
+				attempts = attempts + 1
+			WHERE id = ? AND status IN ('pending', 'unschedulable')`, builder.Name, leaseExpiresAt, build.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim build: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			build.Status = "building"
+			build.Builder = builder.Name
+			build.LeaseExpiresAt = &leaseExpiresAt
+			build.Attempts++
+			return build, nil
+		}
+	}
+}
+
+// ListQueuedBuilds lists the builds waiting for a builder, pending or
+// unschedulable, in the order they would be claimed
+func (db *DB) ListQueuedBuilds() ([]*models.BuildRequest, error) {
+	rows, err := db.Query(`SELECT` + buildColumns + `FROM builds
+		WHERE status IN ('pending', 'unschedulable')
+		ORDER BY` + buildQueueOrder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list queued builds: %w", err)
+	}
+	defer rows.Close()
+
+	var builds []*models.BuildRequest
+	for rows.Next() {
+		build, err := scanBuild(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan build: %w", err)
+		}
+		builds = append(builds, build)
+	}
+
+	return builds, rows.Err()
+}
+
+// SetBuildUnschedulable moves a pending build to unschedulable, or an
+// unschedulable build back to pending. It returns false if the build was
+// in neither state it is moved from.
+func (db *DB) SetBuildUnschedulable(id string, unschedulable bool) (bool, error) {
+	from, to := "pending", "unschedulable"
+	if !unschedulable {
+		from, to = to, from
+	}
+
+	query := "UPDATE builds SET status = ? WHERE id = ? AND status = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE builds SET status = $1 WHERE id = $2 AND status = $3"
+	}
+
+	result, err := db.Exec(query, to, id, from)
+	if err != nil {
+		return false, fmt.Errorf("failed to update build status: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ReviewBuild approves a build awaiting approval, queueing it, or rejects
+// it with reason as its error, recording reviewer as the admin who
+// reviewed it. It returns false if the build wasn't awaiting approval.
+func (db *DB) ReviewBuild(id string, approve bool, reviewer, reason string) (bool, error) {
+	now := time.Now()
+
+	var query string
+	var args []interface{}
+	if approve {
+		query = "UPDATE builds SET status = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ? AND status = ?"
+		if db.driver == "postgres" {
+			query = "UPDATE builds SET status = $1, reviewed_by = $2, reviewed_at = $3 WHERE id = $4 AND status = $5"
+		}
+		args = []interface{}{"pending", reviewer, now, id, models.BuildStatusAwaitingApproval}
+	} else {
+		query = `
+			UPDATE builds SET status = ?, reviewed_by = ?, reviewed_at = ?, error = ?, completed_at = ?
+			WHERE id = ? AND status = ?
+		`
+		if db.driver == "postgres" {
+			query = `
+				UPDATE builds SET status = $1, reviewed_by = $2, reviewed_at = $3, error = $4, completed_at = $5
+				WHERE id = $6 AND status = $7
+			`
+		}
+		args = []interface{}{models.BuildStatusRejected, reviewer, now, reason, now, id, models.BuildStatusAwaitingApproval}
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to review build: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// BuildRequirements returns what a build of machine needs of its builder:
+// the machine's architecture, and the builder labels of all its groups
+func (db *DB) BuildRequirements(machine *models.Machine) (models.BuildRequirements, error) {
+	requirements := models.BuildRequirements{
+		Architecture: models.NormalizeArchitecture(machine.Hardware.CPU.Architecture),
+	}
+
+	groups, err := db.GetMachineGroups(machine.ID)
+	if err != nil {
+		return requirements, err
+	}
+
+	seen := map[string]bool{}
+	for _, group := range groups {
+		for _, label := range group.BuilderLabels {
+			if !seen[label] {
+				seen[label] = true
+				requirements.RequiredLabels = append(requirements.RequiredLabels, label)
+			}
+		}
+	}
+	sort.Strings(requirements.RequiredLabels)
+
+	return requirements, nil
+}
+
+// nonNilStrings keeps a nil slice from encoding as the JSON null
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// SetBuildPriority changes the priority of a queued build, pending or
+// unschedulable, or of one awaiting approval. It returns false if the
+// build is in none of those states.
+func (db *DB) SetBuildPriority(id, priority string) (bool, error) {
+	query := "UPDATE builds SET priority = ? WHERE id = ? AND status IN ('awaiting_approval', 'pending', 'unschedulable')"
+	if db.driver == "postgres" {
+		query = "UPDATE builds SET priority = $1 WHERE id = $2 AND status IN ('awaiting_approval', 'pending', 'unschedulable')"
+	}
+
+	result, err := db.Exec(query, priority, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to set build priority: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// BuildQueuePosition returns where a pending build is in the queue,
+// starting at 1 for the build that will be claimed next
+func (db *DB) BuildQueuePosition(build *models.BuildRequest) (int, error) {
+	query := `SELECT COUNT(*) FROM builds WHERE status = 'pending' AND (` + buildRankExpr + ` < ?
+		OR (` + buildRankExpr + ` = ? AND (created_at < ? OR (created_at = ? AND id < ?))))`
+	if db.driver == "postgres" {
+		query = `SELECT COUNT(*) FROM builds WHERE status = 'pending' AND (` + buildRankExpr + ` < $1
+			OR (` + buildRankExpr + ` = $2 AND (created_at < $3 OR (created_at = $4 AND id < $5))))`
+	}
+
+	r := buildRank(build.Priority)
+	var ahead int
+	if err := db.QueryRow(query, r, r, build.CreatedAt, build.CreatedAt, build.ID).Scan(&ahead); err != nil {
+		return 0, fmt.Errorf("failed to get queue position: %w", err)
+	}
+
+	return ahead + 1, nil
+}
+
+// CancelPendingBuilds marks a machine's pending and running builds, and
+// those awaiting approval, as cancelled and returns how many were cancelled
+func (db *DB) CancelPendingBuilds(machineID string) (int64, error) {
+	query := `
+		UPDATE builds SET status = 'cancelled', completed_at = ?
+		WHERE machine_id = ? AND status IN ('awaiting_approval', 'pending', 'unschedulable', 'building')
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE builds SET status = 'cancelled', completed_at = $1
+			WHERE machine_id = $2 AND status IN ('awaiting_approval', 'pending', 'unschedulable', 'building')
+		`
+	}
+
+	result, err := db.Exec(query, time.Now(), machineID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel builds: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// ListBuildsCompletedBetween returns builds that finished in (since, until],
+// oldest first. Only the fields needed for accounting are loaded.
+func (db *DB) ListBuildsCompletedBetween(since, until time.Time) ([]*models.BuildRequest, error) {
+	query := `
+		SELECT id, machine_id, status, created_at, completed_at, builder,
+		       nix_version, duration_ms, peak_memory_bytes
+		FROM builds
+		WHERE completed_at > ? AND completed_at <= ?
+		ORDER BY completed_at ASC
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			SELECT id, machine_id, status, created_at, completed_at, builder,
+			       nix_version, duration_ms, peak_memory_bytes
+			FROM builds
+			WHERE completed_at > $1 AND completed_at <= $2
+			ORDER BY completed_at ASC
+		`
+	}
+
+	rows, err := db.Query(query, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list completed builds: %w", err)
+	}
+	defer rows.Close()
+
+	var builds []*models.BuildRequest
+	for rows.Next() {
+		build := &models.BuildRequest{}
+		var machineID, builder, nixVersion sql.NullString
+		var durationMS, peakMemory, artifactBytes sql.NullInt64
+		if err := rows.Scan(&build.ID, &machineID, &build.Status, &build.CreatedAt, &build.CompletedAt,
+			&builder, &nixVersion, &durationMS, &peakMemory); err != nil {
+			return nil, fmt.Errorf("failed to scan build: %w", err)
+		}
+		build.MachineID = machineID.String
+		build.Builder = builder.String
+		if nixVersion.String != "" {
+			build.Environment = &models.BuildEnvironment{NixVersion: nixVersion.String}
+		}
+		build.DurationMS = durationMS.Int64
+		build.PeakMemoryBytes = peakMemory.Int64
+		build.ArtifactBytes = artifactBytes.Int64
+		builds = append(builds, build)
+	}
+
+	return builds, rows.Err()
+}
+
+// scanBuild reads a row of buildColumns. The output columns stay NULL until
+// the build finishes.
+func scanBuild(row rowScanner) (*models.BuildRequest, error) {
+	build := &models.BuildRequest{}
+	var machineID, errorMsg, artifactURL sql.NullString
+	var builder, builderVersion, nixVersion, nixpkgsVersion, nixpkgsRevision sql.NullString
+	var durationMS, peakMemory, artifactBytes sql.NullInt64
+	var architecture sql.NullString
+	var labelsJSON jsonColumn
+	var systemPath, closureDiff, closureDiffFrom sql.NullString
+	var requestedBy, reviewedBy, signingKey sql.NullString
+	var reviewedAt, leaseExpiresAt sql.NullTime
+	var lintJSON, warningsJSON jsonColumn
+
+	err := row.Scan(
+		&build.ID,
+		&machineID,
+		&build.Status,
+		&build.Config,
+		&build.RequireTest,
+		&build.Priority,
+		&errorMsg,
+		&artifactURL,
+		&build.CreatedAt,
+		&build.CompletedAt,
+		&builder,
+		&builderVersion,
+		&nixVersion,
+		&nixpkgsVersion,
+		&nixpkgsRevision,
+		&durationMS,
+		&peakMemory,
+		&architecture,
+		&labelsJSON,
+		&build.Type,
+		&systemPath,
+		&closureDiff,
+		&closureDiffFrom,
+		&requestedBy,
+		&reviewedBy,
+		&reviewedAt,
+		&signingKey,
+		&leaseExpiresAt,
+		&build.Attempts,
+		&lintJSON,
+		&build.Target,
+		&build.ConfigHash,
+		&build.DryRun,
+		&warningsJSON,
+		&artifactBytes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	build.MachineID = machineID.String
+	build.Error = errorMsg.String
+	build.ArtifactURL = artifactURL.String
+	build.Builder = builder.String
+	env := models.BuildEnvironment{
+		BuilderVersion:  builderVersion.String,
+		NixVersion:      nixVersion.String,
+		NixpkgsVersion:  nixpkgsVersion.String,
+		NixpkgsRevision: nixpkgsRevision.String,
+	}
+	if env != (models.BuildEnvironment{}) {
+		build.Environment = &env
+	}
+	build.DurationMS = durationMS.Int64
+	build.PeakMemoryBytes = peakMemory.Int64
+	build.ArtifactBytes = artifactBytes.Int64
+	build.Architecture = architecture.String
+	build.SystemPath = systemPath.String
+	build.ClosureDiff = closureDiff.String
+	build.ClosureDiffFrom = closureDiffFrom.String
+	build.RequestedBy = requestedBy.String
+	build.ReviewedBy = reviewedBy.String
+	build.SigningKey = signingKey.String
+	if leaseExpiresAt.Valid {
+		build.LeaseExpiresAt = &leaseExpiresAt.Time
+	}
+	if reviewedAt.Valid {
+		build.ReviewedAt = &reviewedAt.Time
+	}
+	if err := labelsJSON.Unmarshal(&build.RequiredLabels); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal required labels: %w", err)
+	}
+	if err := lintJSON.Unmarshal(&build.Lint); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lint: %w", err)
+	}
+	if err := warningsJSON.Unmarshal(&build.Warnings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal warnings: %w", err)
+	}
+
+	return build, nil
+}
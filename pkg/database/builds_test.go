@@ -0,0 +1,107 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// queueBuilds creates a pending build of a new machine for each priority,
+// a second apart in the order given, and returns them
+func queueBuilds(t *testing.T, db *DB, priorities ...string) []*models.BuildRequest {
+	t.Helper()
+
+	machine, err := db.CreateMachine(models.EnrollmentRequest{ServiceTag: "QUEUE01", MACAddress: "00:11:22:33:44:66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	builds := make([]*models.BuildRequest, 0, len(priorities))
+	for i, priority := range priorities {
+		build, err := db.CreateBuild(machine.ID, "{ ... }: { }", "", "", false, false, priority, models.BuildRequirements{}, "", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE builds SET created_at = ? WHERE id = ?", start.Add(time.Duration(i)*time.Second), build.ID); err != nil {
+			t.Fatal(err)
+		}
+		if build, err = db.GetBuild(build.ID); err != nil {
+			t.Fatal(err)
+		}
+		builds = append(builds, build)
+	}
+	return builds
+}
+
+// claimAll claims builds until none is left and returns their IDs in the
+// order they were claimed
+func claimAll(t *testing.T, db *DB) []string {
+	t.Helper()
+
+	builder := &models.Builder{Name: "builder-1"}
+	var claimed []string
+	for {
+		build, err := db.ClaimPendingBuild(builder, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if build == nil {
+			return claimed
+		}
+		claimed = append(claimed, build.ID)
+	}
+}
+
+func TestClaimPendingBuildOrdersByPriority(t *testing.T) {
+	db := newTestDB(t)
+	builds := queueBuilds(t, db, "low", "normal", "high", "normal", "urgent", "low", "high")
+
+	// Most urgent first, oldest first within a priority
+	want := []int{4, 2, 6, 1, 3, 0, 5}
+
+	for position, i := range want {
+		got, err := db.BuildQueuePosition(builds[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != position+1 {
+			t.Errorf("%s build %d: queue position %d, want %d", builds[i].Priority, i, got, position+1)
+		}
+	}
+
+	claimed := claimAll(t, db)
+	if len(claimed) != len(want) {
+		t.Fatalf("claimed %d builds, want %d", len(claimed), len(want))
+	}
+	for n, i := range want {
+		if claimed[n] != builds[i].ID {
+			t.Errorf("claim %d: got build %s, want the %s build %d", n, claimed[n], builds[i].Priority, i)
+		}
+	}
+}
+
+func TestSetBuildPriorityReordersQueue(t *testing.T) {
+	db := newTestDB(t)
+	builds := queueBuilds(t, db, "normal", "normal", "low")
+
+	// The newest, least urgent build jumps the queue
+	if ok, err := db.SetBuildPriority(builds[2].ID, models.BuildPriorityHigh); err != nil || !ok {
+		t.Fatalf("set priority: %v, %v", ok, err)
+	}
+	builds[2].Priority = models.BuildPriorityHigh
+	if got, err := db.BuildQueuePosition(builds[2]); err != nil || got != 1 {
+		t.Errorf("queue position %d, %v, want 1", got, err)
+	}
+
+	claimed := claimAll(t, db)
+	if len(claimed) != 3 || claimed[0] != builds[2].ID || claimed[1] != builds[0].ID || claimed[2] != builds[1].ID {
+		t.Errorf("claimed %v, want builds 2, 0, 1", claimed)
+	}
+
+	// Claimed builds keep their priority
+	if ok, err := db.SetBuildPriority(builds[0].ID, models.BuildPriorityUrgent); err != nil || ok {
+		t.Errorf("set priority of a building build: %v, %v, want false", ok, err)
+	}
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CreateClaimCode stores the hash of a machine's claim code, replacing any
+// code the machine already has. Expired codes are cleaned up on the way.
+func (db *DB) CreateClaimCode(machineID, codeHash string, expiresAt time.Time) error {
+	deleteCodes := "DELETE FROM claim_codes WHERE machine_id = ? OR expires_at < ?"
+	insert := "INSERT INTO claim_codes (code_hash, machine_id, expires_at, created_at) VALUES (?, ?, ?, ?)"
+	if db.driver == "postgres" {
+		deleteCodes = "DELETE FROM claim_codes WHERE machine_id = $1 OR expires_at < $2"
+		insert = "INSERT INTO claim_codes (code_hash, machine_id, expires_at, created_at) VALUES ($1, $2, $3, $4)"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec(deleteCodes, machineID, now); err != nil {
+		return fmt.Errorf("failed to delete old claim codes: %w", err)
+	}
+	if _, err := tx.Exec(insert, codeHash, machineID, expiresAt, now); err != nil {
+		return fmt.Errorf("failed to create claim code: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ClaimMachine redeems a claim code, making userID the owner of its
+// machine. The code is used up whether or not the claim succeeds. It
+// returns the machine's ID, or "" if the code is unknown or expired or the
+// machine already has an owner.
+func (db *DB) ClaimMachine(codeHash, userID string) (string, error) {
+	selectCode := "SELECT machine_id FROM claim_codes WHERE code_hash = ? AND expires_at >= ?"
+	deleteCode := "DELETE FROM claim_codes WHERE code_hash = ?"
+	claim := `UPDATE machines SET owner_user_id = ?, claimed_at = ?, updated_at = ?
+		WHERE id = ? AND (owner_user_id IS NULL OR owner_user_id = '')`
+	if db.driver == "postgres" {
+		selectCode = "SELECT machine_id FROM claim_codes WHERE code_hash = $1 AND expires_at >= $2"
+		deleteCode = "DELETE FROM claim_codes WHERE code_hash = $1"
+		claim = `UPDATE machines SET owner_user_id = $1, claimed_at = $2, updated_at = $3
+			WHERE id = $4 AND (owner_user_id IS NULL OR owner_user_id = '')`
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var machineID string
+	err = tx.QueryRow(selectCode, codeHash, now).Scan(&machineID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up claim code: %w", err)
+	}
+
+	// Deleting the code is what makes it single-use: of two concurrent
+	// claims, only one deletes a row
+	result, err := tx.Exec(deleteCode, codeHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to use claim code: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", nil
+	}
+
+	result, err = tx.Exec(claim, userID, now, now, machineID)
+	if err != nil {
+		return "", fmt.Errorf("failed to claim machine: %w", err)
+	}
+	claimed, _ := result.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	if claimed == 0 {
+		return "", nil
+	}
+	return machineID, nil
+}
+
+// UnclaimMachine clears a machine's owner and deletes its claim codes, so
+// the machine gets a new code the next time it enrolls
+func (db *DB) UnclaimMachine(id string) error {
+	release := "UPDATE machines SET owner_user_id = NULL, claimed_at = NULL, updated_at = ? WHERE id = ?"
+	deleteCodes := "DELETE FROM claim_codes WHERE machine_id = ?"
+	if db.driver == "postgres" {
+		release = "UPDATE machines SET owner_user_id = NULL, claimed_at = NULL, updated_at = $1 WHERE id = $2"
+		deleteCodes = "DELETE FROM claim_codes WHERE machine_id = $1"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(release, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to release machine: %w", err)
+	}
+	if _, err := tx.Exec(deleteCodes, id); err != nil {
+		return fmt.Errorf("failed to delete claim codes: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// GetMachineOwner returns the ID of the user who claimed a machine, or ""
+// if it is unclaimed or doesn't exist
+func (db *DB) GetMachineOwner(id string) (string, error) {
+	query := "SELECT owner_user_id FROM machines WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "SELECT owner_user_id FROM machines WHERE id = $1"
+	}
+
+	var owner sql.NullString
+	err := db.QueryRow(query, id).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get machine owner: %w", err)
+	}
+
+	return owner.String, nil
+}
+
+// HiddenMachineIDs returns the IDs of the machines claimed by users other
+// than userID, which a viewer with that ID doesn't see
+func (db *DB) HiddenMachineIDs(userID string) (map[string]bool, error) {
+	query := "SELECT id FROM machines WHERE " + hiddenMachineCondition("?")
+	if db.driver == "postgres" {
+		query = "SELECT id FROM machines WHERE " + hiddenMachineCondition("$1")
+	}
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list claimed machines: %w", err)
+	}
+	defer rows.Close()
+
+	hidden := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan machine ID: %w", err)
+		}
+		hidden[id] = true
+	}
+	return hidden, rows.Err()
+}
+
+// hiddenMachineCondition matches machines claimed by a user other than the
+// one whose ID is bound to placeholder
+func hiddenMachineCondition(placeholder string) string {
+	return "COALESCE(owner_user_id, '') NOT IN ('', " + placeholder + ")"
+}
+
+// visibleMachineCondition keeps rows whose machine, in machineColumn, isn't
+// claimed by a user other than the one whose ID is bound to placeholder.
+// Rows without a machine are kept.
+func visibleMachineCondition(machineColumn, placeholder string) string {
+	return "COALESCE(" + machineColumn + ", '') NOT IN (SELECT id FROM machines WHERE " + hiddenMachineCondition(placeholder) + ")"
+}
+
+// Claim codes are stored as SHA-256 hashes, so the table alone can't be
+// used to claim machines
+func (db *DB) createClaimCodesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS claim_codes (
+			code_hash TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`
+}
@@ -0,0 +1,375 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// machineHistoryTables hold rows that belong to a machine and move with it
+// when it is merged into another machine. Group memberships are moved
+// separately, since both machines may be in the same group.
+var machineHistoryTables = []string{
+	"builds",
+	"machine_events",
+	"machine_metrics",
+	"power_operations",
+	"image_tests",
+	"wipe_jobs",
+	"deployments",
+	"boot_requests",
+	"machine_notes",
+	"machine_attachments",
+}
+
+// FindIdentityOwner finds the machine that already has a MAC address or,
+// failing that, a normalized serial number, and returns it along with the
+// field that matched. Decommissioned machines, held enrollments, and
+// machines in the trash own neither. It returns nil if no machine does.
+func (db *DB) FindIdentityOwner(macAddress, serialNumber string) (*models.Machine, string, error) {
+	byMAC := `SELECT id FROM machines WHERE mac_address = ? AND status NOT IN (?, ?) AND deleted_at IS NULL
+		ORDER BY enrolled_at LIMIT 1`
+	bySerial := `SELECT id FROM machines WHERE UPPER(TRIM(json_extract(hardware, '$.serial_number'))) = ?
+		AND status NOT IN (?, ?) AND deleted_at IS NULL ORDER BY enrolled_at LIMIT 1`
+
+	if db.driver == "postgres" {
+		byMAC = `SELECT id FROM machines WHERE mac_address = $1 AND status NOT IN ($2, $3) AND deleted_at IS NULL
+			ORDER BY enrolled_at LIMIT 1`
+		bySerial = `SELECT id FROM machines WHERE UPPER(TRIM(hardware->>'serial_number')) = $1
+			AND status NOT IN ($2, $3) AND deleted_at IS NULL ORDER BY enrolled_at LIMIT 1`
+	}
+
+	lookups := []struct{ field, query, value string }{
+		{models.IdentityMACAddress, byMAC, macAddress},
+		{models.IdentitySerialNumber, bySerial, serialNumber},
+	}
+
+	for _, lookup := range lookups {
+		if lookup.value == "" {
+			continue
+		}
+
+		var id string
+		err := db.QueryRow(lookup.query, lookup.value, models.StatusDecommissioned, models.StatusConflict).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look up machine by %s: %w", lookup.field, err)
+		}
+
+		machine, err := db.GetMachine(id)
+		if err != nil || machine == nil {
+			return nil, "", err
+		}
+		return machine, lookup.field, nil
+	}
+
+	return nil, "", nil
+}
+
+// HoldMachine creates the record for a machine whose enrollment conflicts
+// with an existing machine. The record is in the conflict status until the
+// conflict is resolved.
+func (db *DB) HoldMachine(req models.EnrollmentRequest, conflict *models.MachineConflict) (*models.Machine, error) {
+	machine := newEnrolledMachine(req, models.StatusConflict)
+	conflict.MachineID = machine.ID
+	conflict.CreatedAt = machine.EnrolledAt
+
+	query := `INSERT INTO machine_conflicts (machine_id, existing_machine_id, field, value, created_at)
+		VALUES (?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO machine_conflicts (machine_id, existing_machine_id, field, value, created_at)
+			VALUES ($1, $2, $3, $4, $5)`
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := db.insertEnrolledMachine(tx, machine); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(query, conflict.MachineID, conflict.ExistingMachineID, conflict.Field, conflict.Value, conflict.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record machine conflict: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+// GetMachineConflict retrieves the conflict a held enrollment is held for.
+// It returns nil, nil if the machine is not held.
+func (db *DB) GetMachineConflict(machineID string) (*models.MachineConflict, error) {
+	query := `SELECT machine_id, existing_machine_id, field, value, created_at
+		FROM machine_conflicts WHERE machine_id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT machine_id, existing_machine_id, field, value, created_at
+			FROM machine_conflicts WHERE machine_id = $1`
+	}
+
+	var c models.MachineConflict
+	err := db.QueryRow(query, machineID).Scan(&c.MachineID, &c.ExistingMachineID, &c.Field, &c.Value, &c.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get machine conflict: %w", err)
+	}
+
+	return &c, nil
+}
+
+// ReleaseMachine ends a machine's hold, returning it to the enrolled status
+func (db *DB) ReleaseMachine(machineID string) error {
+	release := "UPDATE machines SET status = ?, updated_at = ? WHERE id = ? AND status = ?"
+	forget := "DELETE FROM machine_conflicts WHERE machine_id = ?"
+	if db.driver == "postgres" {
+		release = "UPDATE machines SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4"
+		forget = "DELETE FROM machine_conflicts WHERE machine_id = $1"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(release, models.StatusEnrolled, time.Now(), machineID, models.StatusConflict); err != nil {
+		return fmt.Errorf("failed to release machine: %w", err)
+	}
+	if _, err := tx.Exec(forget, machineID); err != nil {
+		return fmt.Errorf("failed to delete machine conflict: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// MergeMachine merges from into into in one transaction. from's builds,
+// events, metrics, and other history, and its group memberships, move to
+// into, and from is deleted. into takes from's service tag, MAC address,
+// hardware report, boot mode, and last seen time, which describe the
+// machine as it is now, and its last build if into has none. Its
+// configuration, hostname, tags, and BMC settings are kept. A held into is
+// released.
+func (db *DB) MergeMachine(from, into *models.Machine) error {
+	hardwareJSON, err := json.Marshal(from.Hardware)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hardware: %w", err)
+	}
+
+	moveGroups := `UPDATE group_memberships SET machine_id = ? WHERE machine_id = ?
+		AND group_id NOT IN (SELECT group_id FROM group_memberships WHERE machine_id = ?)`
+	leaveGroups := "DELETE FROM group_memberships WHERE machine_id = ?"
+	forgetConflicts := "DELETE FROM machine_conflicts WHERE machine_id IN (?, ?)"
+	moveConflicts := "UPDATE machine_conflicts SET existing_machine_id = ? WHERE existing_machine_id = ?"
+	forgetFragments := "DELETE FROM machine_fragments WHERE machine_id = ?"
+	forgetClaimCodes := "DELETE FROM claim_codes WHERE machine_id = ?"
+	deleteMachine := "DELETE FROM machines WHERE id = ?"
+	updateInto := `UPDATE machines SET
+			service_tag = ?, mac_address = ?, hardware = ?, boot_mode = ?, last_seen_at = ?,
+			last_build_id = COALESCE(last_build_id, ?), last_build_time = COALESCE(last_build_time, ?),
+			status = CASE WHEN status = ? THEN ? ELSE status END, updated_at = ?
+		WHERE id = ?`
+	moveHistory := "UPDATE %s SET machine_id = ? WHERE machine_id = ?"
+
+	if db.driver == "postgres" {
+		moveGroups = `UPDATE group_memberships SET machine_id = $1 WHERE machine_id = $2
+			AND group_id NOT IN (SELECT group_id FROM group_memberships WHERE machine_id = $3)`
+		leaveGroups = "DELETE FROM group_memberships WHERE machine_id = $1"
+		forgetConflicts = "DELETE FROM machine_conflicts WHERE machine_id IN ($1, $2)"
+		moveConflicts = "UPDATE machine_conflicts SET existing_machine_id = $1 WHERE existing_machine_id = $2"
+		forgetFragments = "DELETE FROM machine_fragments WHERE machine_id = $1"
+		forgetClaimCodes = "DELETE FROM claim_codes WHERE machine_id = $1"
+		deleteMachine = "DELETE FROM machines WHERE id = $1"
+		updateInto = `UPDATE machines SET
+				service_tag = $1, mac_address = $2, hardware = $3, boot_mode = $4, last_seen_at = $5,
+				last_build_id = COALESCE(last_build_id, $6), last_build_time = COALESCE(last_build_time, $7),
+				status = CASE WHEN status = $8 THEN $9 ELSE status END, updated_at = $10
+			WHERE id = $11`
+		moveHistory = "UPDATE %s SET machine_id = $1 WHERE machine_id = $2"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range machineHistoryTables {
+		if _, err := tx.Exec(fmt.Sprintf(moveHistory, table), into.ID, from.ID); err != nil {
+			return fmt.Errorf("failed to move %s: %w", table, err)
+		}
+	}
+
+	// Memberships of groups into is already in go with from
+	if _, err := tx.Exec(moveGroups, into.ID, from.ID, into.ID); err != nil {
+		return fmt.Errorf("failed to move group memberships: %w", err)
+	}
+	if _, err := tx.Exec(leaveGroups, from.ID); err != nil {
+		return fmt.Errorf("failed to remove merged machine from groups: %w", err)
+	}
+
+	// Other enrollments held against from are now held against into
+	if _, err := tx.Exec(forgetConflicts, from.ID, into.ID); err != nil {
+		return fmt.Errorf("failed to delete machine conflicts: %w", err)
+	}
+	if _, err := tx.Exec(moveConflicts, into.ID, from.ID); err != nil {
+		return fmt.Errorf("failed to move machine conflicts: %w", err)
+	}
+
+	// into keeps its own configuration, fragments included
+	if _, err := tx.Exec(forgetFragments, from.ID); err != nil {
+		return fmt.Errorf("failed to delete merged machine's fragments: %w", err)
+	}
+	if _, err := tx.Exec(forgetClaimCodes, from.ID); err != nil {
+		return fmt.Errorf("failed to delete merged machine's claim codes: %w", err)
+	}
+
+	// The service tag is unique, so from goes before into takes it
+	if _, err := tx.Exec(deleteMachine, from.ID); err != nil {
+		return fmt.Errorf("failed to delete merged machine: %w", err)
+	}
+
+	_, err = tx.Exec(updateInto,
+		from.ServiceTag,
+		from.MACAddress,
+		hardwareJSON,
+		from.BootMode,
+		from.LastSeenAt,
+		from.LastBuildID,
+		from.LastBuildTime,
+		models.StatusConflict,
+		models.StatusEnrolled,
+		time.Now(),
+		into.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update merged machine: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ListMachineDuplicates lists the MAC addresses and serial numbers that
+// more than one machine has, including held enrollments. Decommissioned
+// machines and machines in the trash are left out.
+func (db *DB) ListMachineDuplicates() ([]*models.MachineDuplicate, error) {
+	query := `
+		SELECT m.id, m.service_tag, m.mac_address, json_extract(m.hardware, '$.serial_number'),
+		       m.status, m.hostname, m.enrolled_at, m.last_seen_at, c.existing_machine_id
+		FROM machines m LEFT JOIN machine_conflicts c ON c.machine_id = m.id
+		WHERE m.status <> ? AND m.deleted_at IS NULL
+		ORDER BY m.enrolled_at
+	`
+	if db.driver == "postgres" {
+		query = `
+			SELECT m.id, m.service_tag, m.mac_address, m.hardware->>'serial_number',
+			       m.status, m.hostname, m.enrolled_at, m.last_seen_at, c.existing_machine_id
+			FROM machines m LEFT JOIN machine_conflicts c ON c.machine_id = m.id
+			WHERE m.status <> $1 AND m.deleted_at IS NULL
+			ORDER BY m.enrolled_at
+		`
+	}
+
+	rows, err := db.Query(query, models.StatusDecommissioned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machines: %w", err)
+	}
+	defer rows.Close()
+
+	// Machines are grouped by normalized MAC address and serial number, so
+	// records stored before MAC addresses were normalized are found too
+	type key struct{ field, value string }
+	groups := map[key][]*models.DuplicateMachine{}
+	var keys []key
+
+	add := func(k key, m *models.DuplicateMachine) {
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], m)
+	}
+
+	for rows.Next() {
+		m := &models.DuplicateMachine{}
+		var serial, hostname, conflictsWith sql.NullString
+		var lastSeenAt sql.NullTime
+
+		err := rows.Scan(&m.ID, &m.ServiceTag, &m.MACAddress, &serial, &m.Status, &hostname, &m.EnrolledAt, &lastSeenAt, &conflictsWith)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan machine: %w", err)
+		}
+		m.SerialNumber = serial.String
+		m.Hostname = hostname.String
+		m.ConflictsWith = conflictsWith.String
+		if lastSeenAt.Valid {
+			m.LastSeenAt = &lastSeenAt.Time
+		}
+
+		mac, err := models.NormalizeMAC(m.MACAddress)
+		if err != nil {
+			mac = m.MACAddress
+		}
+		add(key{models.IdentityMACAddress, mac}, m)
+
+		if serial := models.NormalizeSerialNumber(m.SerialNumber); serial != "" {
+			add(key{models.IdentitySerialNumber, serial}, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	duplicates := []*models.MachineDuplicate{}
+	for _, k := range keys {
+		if machines := groups[k]; len(machines) > 1 {
+			duplicates = append(duplicates, &models.MachineDuplicate{Field: k.field, Value: k.value, Machines: machines})
+		}
+	}
+
+	sort.SliceStable(duplicates, func(i, j int) bool {
+		if duplicates[i].Field != duplicates[j].Field {
+			return duplicates[i].Field < duplicates[j].Field
+		}
+		return duplicates[i].Value < duplicates[j].Value
+	})
+
+	return duplicates, nil
+}
+
+// normalizeMACAddresses rewrites stored MAC addresses in the lowercase,
+// colon-separated form new ones are stored in, so that lookups can compare
+// them directly
+func (db *DB) normalizeMACAddresses() error {
+	_, err := db.Exec(`
+		UPDATE machines SET mac_address = LOWER(REPLACE(mac_address, '-', ':'))
+		WHERE mac_address <> LOWER(REPLACE(mac_address, '-', ':'))
+	`)
+	return err
+}
+
+func (db *DB) createMachineConflictsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS machine_conflicts (
+			machine_id TEXT PRIMARY KEY,
+			existing_machine_id TEXT NOT NULL,
+			field TEXT NOT NULL,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// NextCounter increments a named counter and returns its new value. A
+// counter that doesn't exist yet starts at 1. The increment is a single
+// upsert, so concurrent callers never get the same value.
+func (db *DB) NextCounter(name string) (int64, error) {
+	upsert := `
+		INSERT INTO counters (name, value) VALUES (?, 1)
+		ON CONFLICT (name) DO UPDATE SET value = counters.value + 1
+	`
+	query := "SELECT value FROM counters WHERE name = ?"
+	if db.driver == "postgres" {
+		upsert = `
+			INSERT INTO counters (name, value) VALUES ($1, 1)
+			ON CONFLICT (name) DO UPDATE SET value = counters.value + 1
+		`
+		query = "SELECT value FROM counters WHERE name = $1"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(upsert, name); err != nil {
+		return 0, fmt.Errorf("failed to increment counter %s: %w", name, err)
+	}
+	var value int64
+	if err := tx.QueryRow(query, name).Scan(&value); err != nil {
+		return 0, fmt.Errorf("failed to read counter %s: %w", name, err)
+	}
+
+	return value, tx.Commit()
+}
+
+// PeekCounter returns a named counter's current value without changing it,
+// or 0 if it doesn't exist yet
+func (db *DB) PeekCounter(name string) (int64, error) {
+	query := "SELECT value FROM counters WHERE name = ?"
+	if db.driver == "postgres" {
+		query = "SELECT value FROM counters WHERE name = $1"
+	}
+
+	var value int64
+	err := db.QueryRow(query, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read counter %s: %w", name, err)
+	}
+	return value, nil
+}
+
+func (db *DB) createCountersTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS counters (
+			name TEXT PRIMARY KEY,
+			value BIGINT NOT NULL
+		)
+	`
+}
@@ -1,10 +1,14 @@
 package database
 
 import (
+	"crypto/cipher"
 	"database/sql"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -19,6 +23,14 @@ type Config struct {
 type DB struct {
 	*sql.DB
 	driver string
+	dsn    string
+
+	// secrets encrypts BMC passwords at rest; nil stores them as given
+	secrets cipher.AEAD
+
+	// lastCheck is the result of the latest integrity check
+	checkMu   sync.Mutex
+	lastCheck *models.DatabaseCheck
 }
 
 // New creates a new database connection
@@ -38,7 +50,7 @@ func New(cfg Config) (*DB, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &DB{DB: db, driver: cfg.Driver}, nil
+	return &DB{DB: db, driver: cfg.Driver, dsn: cfg.DSN}, nil
 }
 
 // Driver returns the database driver name
@@ -46,8 +58,17 @@ func (db *DB) Driver() string {
 	return db.driver
 }
 
-// Migrate runs database migrations
+// Migrate runs database migrations. A SQLite database with migrations
+// pending is first backed up beside itself, in case they go wrong.
 func (db *DB) Migrate() error {
+	if err := db.backupBeforeMigrate(); err != nil {
+		return err
+	}
+	return db.migrate()
+}
+
+// migrate creates and alters the tables to the current schema
+func (db *DB) migrate() error {
 	migrations := []string{
 		db.createMachinesTable(),
 		db.createBuildsTable(),
@@ -62,6 +83,53 @@ func (db *DB) Migrate() error {
 		db.createWebhookDeliveriesTable(),
 		db.createMachineTemplatesTable(),
 		db.createMachineEventsTable(),
+		db.createNotificationChannelsTable(),
+		db.createNotificationDeliveriesTable(),
+		db.createMaintenanceWindowsTable(),
+		db.createWipeJobsTable(),
+		db.createDeploymentsTable(),
+		db.createIdempotencyKeysTable(),
+		db.createBuildRolloutsTable(),
+		db.createBuildLogsTable(),
+		db.createLocksTable(),
+		db.createBootRequestsTable(),
+		db.createMachineConflictsTable(),
+		db.createMachineNotesTable(),
+		db.createMachineAttachmentsTable(),
+		db.createConfigFragmentsTable(),
+		db.createMachineFragmentsTable(),
+		db.createGroupFragmentsTable(),
+		db.createAuditLogTable(),
+		db.createBootProfilesTable(),
+		db.createBootProfileGroupsTable(),
+		db.createClaimCodesTable(),
+		db.createBuildersTable(),
+		db.createDCIMRecordsTable(),
+		db.createDCIMSyncReportsTable(),
+		db.createBootAssetsTable(),
+		db.createBootOverridesTable(),
+		db.createSystemImagesTable(),
+		db.createDiagnosticProfilesTable(),
+		db.createDiagnosticRunsTable(),
+		db.createBootSigningKeysTable(),
+		db.createBuildSchedulesTable(),
+		db.createBuildScheduleRunsTable(),
+		db.createEnrollmentRulesTable(),
+		db.createEnrollmentRuleGroupsTable(),
+		db.createCountersTable(),
+		db.createHardwareProfilesTable(),
+		db.createHardwareProfileGroupsTable(),
+		db.createMachineSharesTable(),
+		db.createImpersonationSessionsTable(),
+		db.createProvisioningHooksTable(),
+		db.createProvisioningCyclesTable(),
+		db.createHookRunsTable(),
+		db.createQuotaUsageTable(),
+		db.createQuotaGrantsTable(),
+		db.createArtifactUsageTable(),
+		db.createUserSubscriptionsTable(),
+		db.createUserSubscriptionEventsTable(),
+		db.createSubscriptionDigestItemsTable(),
 	}
 
 	for i, migration := range migrations {
@@ -74,6 +142,440 @@ func (db *DB) Migrate() error {
 	if err := db.addBMCInfoColumn(); err != nil {
 		return fmt.Errorf("failed to add bmc_info column: %w", err)
 	}
+	if err := db.addBMCStatusColumns(); err != nil {
+		return fmt.Errorf("failed to add bmc status columns: %w", err)
+	}
+
+	if err := db.addColumn("machines", "current_ip", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add current_ip column: %w", err)
+	}
+	if err := db.addColumn("machines", "current_ip_updated_at", "TIMESTAMP"); err != nil {
+		return fmt.Errorf("failed to add current_ip_updated_at column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "boot_mode", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add boot_mode column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "decommissioned_at", "TIMESTAMP"); err != nil {
+		return fmt.Errorf("failed to add decommissioned_at column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "deploy_mode", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add deploy_mode column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "ssh_address", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add ssh_address column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "ssh_user", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add ssh_user column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "ssh_key", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add ssh_key column: %w", err)
+	}
+
+	if err := db.addBuildLimitsColumn(); err != nil {
+		return fmt.Errorf("failed to add build_limits column: %w", err)
+	}
+
+	if err := db.addMachineTagsColumn(); err != nil {
+		return fmt.Errorf("failed to add tags column: %w", err)
+	}
+
+	if err := db.addWebhookScopeColumns(); err != nil {
+		return fmt.Errorf("failed to add webhook scope columns: %w", err)
+	}
+
+	if err := db.addColumn("webhooks", "allow_private_networks", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return fmt.Errorf("failed to add allow_private_networks column: %w", err)
+	}
+
+	if err := db.addColumn("webhooks", "schema_version", "TEXT NOT NULL DEFAULT '1'"); err != nil {
+		return fmt.Errorf("failed to add schema_version column: %w", err)
+	}
+
+	if err := db.addColumn("webhooks", "format", "TEXT NOT NULL DEFAULT 'default'"); err != nil {
+		return fmt.Errorf("failed to add format column: %w", err)
+	}
+
+	// Webhooks track their failure streak, and are deactivated when it
+	// goes on too long
+	for _, col := range []struct{ name, definition string }{
+		{"disable_after_failures", "INTEGER NOT NULL DEFAULT 0"},
+		{"disable_after_seconds", "INTEGER NOT NULL DEFAULT 0"},
+		{"consecutive_failures", "INTEGER NOT NULL DEFAULT 0"},
+		{"failing_since", "TIMESTAMP"},
+		{"auto_disabled_at", "TIMESTAMP"},
+		{"disabled_reason", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := db.addColumn("webhooks", col.name, col.definition); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", col.name, err)
+		}
+	}
+
+	if err := db.addWebhookRetryColumns(); err != nil {
+		return fmt.Errorf("failed to add webhook retry columns: %w", err)
+	}
+
+	if err := db.addColumn("image_tests", "build_id", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add build_id column: %w", err)
+	}
+
+	if err := db.addColumn("builds", "require_test", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return fmt.Errorf("failed to add require_test column: %w", err)
+	}
+
+	if err := db.addColumn("machine_metrics", "gpus", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add gpus column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "wol_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return fmt.Errorf("failed to add wol_enabled column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "wol_mac_address", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add wol_mac_address column: %w", err)
+	}
+
+	if err := db.addColumn("power_operations", "method", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add method column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "deleted_at", "TIMESTAMP"); err != nil {
+		return fmt.Errorf("failed to add deleted_at column: %w", err)
+	}
+
+	if err := db.addColumn("builds", "priority", "TEXT NOT NULL DEFAULT 'normal'"); err != nil {
+		return fmt.Errorf("failed to add priority column: %w", err)
+	}
+
+	for _, column := range []string{"datacenter", "rack"} {
+		if err := db.addColumn("machines", column, "TEXT"); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", column, err)
+		}
+	}
+	if err := db.addColumn("machines", "rack_unit", "INTEGER"); err != nil {
+		return fmt.Errorf("failed to add rack_unit column: %w", err)
+	}
+
+	for _, col := range []struct{ name, definition string }{
+		{"power_state", "TEXT"},
+		{"power_state_updated_at", "TIMESTAMP"},
+	} {
+		if err := db.addColumn("machines", col.name, col.definition); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", col.name, err)
+		}
+	}
+
+	for _, col := range []struct{ table, name, definition string }{
+		{"machines", "owner_user_id", "TEXT"},
+		{"machines", "claimed_at", "TIMESTAMP"},
+		{"users", "default_group_id", "TEXT"},
+	} {
+		if err := db.addColumn(col.table, col.name, col.definition); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", col.name, err)
+		}
+	}
+
+	if err := db.addMachineMetadataColumn(); err != nil {
+		return fmt.Errorf("failed to add metadata column: %w", err)
+	}
+
+	// Builds record the builder and toolchain they ran with, and what they
+	// need of a builder
+	for _, col := range []struct{ name, definition string }{
+		{"builder", "TEXT"},
+		{"builder_version", "TEXT"},
+		{"nix_version", "TEXT"},
+		{"nixpkgs_version", "TEXT"},
+		{"nixpkgs_revision", "TEXT"},
+		{"duration_ms", "BIGINT"},
+		{"peak_memory_bytes", "BIGINT"},
+		{"architecture", "TEXT"},
+	} {
+		if err := db.addColumn("builds", col.name, col.definition); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", col.name, err)
+		}
+	}
+	if err := db.addBuildRequiredLabelsColumn(); err != nil {
+		return fmt.Errorf("failed to add required_labels column: %w", err)
+	}
+	if err := db.addBuildTypeColumn(); err != nil {
+		return fmt.Errorf("failed to add type column: %w", err)
+	}
+	if err := db.addColumn("machines", "identity_exempt", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return fmt.Errorf("failed to add identity_exempt column: %w", err)
+	}
+	for _, col := range []string{"system_path", "closure_diff", "closure_diff_from"} {
+		if err := db.addColumn("builds", col, "TEXT"); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", col, err)
+		}
+	}
+	if err := db.addColumn("machines", "template_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add template_id column: %w", err)
+	}
+	if err := db.addColumn("groups", "require_build_approval", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return fmt.Errorf("failed to add require_build_approval column: %w", err)
+	}
+	if err := db.addColumn("groups", "hostname_pattern", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add hostname_pattern column: %w", err)
+	}
+	for _, col := range []string{"requested_by", "reviewed_by"} {
+		if err := db.addColumn("builds", col, "TEXT"); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", col, err)
+		}
+	}
+	if err := db.addColumn("builds", "reviewed_at", "TIMESTAMP"); err != nil {
+		return fmt.Errorf("failed to add reviewed_at column: %w", err)
+	}
+
+	if err := db.addColumn("boot_overrides", "diagnostic_run_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add diagnostic_run_id column: %w", err)
+	}
+	if err := db.addColumn("builds", "signing_key", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add signing_key column: %w", err)
+	}
+	if err := db.addColumn("builds", "lease_expires_at", "TIMESTAMP"); err != nil {
+		return fmt.Errorf("failed to add lease_expires_at column: %w", err)
+	}
+	if err := db.addColumn("builds", "attempts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to add attempts column: %w", err)
+	}
+	if err := db.addColumn("machines", "event_sequence", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to add event_sequence column: %w", err)
+	}
+	if err := db.addColumn("machine_events", "sequence", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to add sequence column: %w", err)
+	}
+	if err := db.addColumn("machine_events", "data_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add data_hash column: %w", err)
+	}
+	if err := db.addColumn("webhook_deliveries", "event_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add event_id column: %w", err)
+	}
+	if err := db.addColumn("webhook_deliveries", "machine_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add webhook delivery machine_id column: %w", err)
+	}
+	if err := db.addColumn("webhook_deliveries", "payload_size", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to add payload_size column: %w", err)
+	}
+	if err := db.addColumn("webhook_deliveries", "duration_ms", "INTEGER"); err != nil {
+		return fmt.Errorf("failed to add duration_ms column: %w", err)
+	}
+	if err := db.addBuilderHealthColumns(); err != nil {
+		return fmt.Errorf("failed to add builder health columns: %w", err)
+	}
+	if err := db.addHardwareComplianceColumns(); err != nil {
+		return fmt.Errorf("failed to add hardware compliance columns: %w", err)
+	}
+	if err := db.addLintColumns(); err != nil {
+		return fmt.Errorf("failed to add lint columns: %w", err)
+	}
+	if err := db.addTemplateVariablesColumn(); err != nil {
+		return fmt.Errorf("failed to add template_variables column: %w", err)
+	}
+
+	if err := db.addRequiredHardwareColumn(); err != nil {
+		return fmt.Errorf("failed to add required_hardware column: %w", err)
+	}
+
+	if err := db.addColumn("machines", "hardware_refresh_requested_at", "TIMESTAMP"); err != nil {
+		return fmt.Errorf("failed to add hardware_refresh_requested_at column: %w", err)
+	}
+
+	// Builds produce a netboot image unless they are of another target
+	if err := db.addColumn("builds", "target", "TEXT NOT NULL DEFAULT 'netboot'"); err != nil {
+		return fmt.Errorf("failed to add build target column: %w", err)
+	}
+	if err := db.addColumn("machines", "build_target", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add machine build_target column: %w", err)
+	}
+	if err := db.addColumn("machine_templates", "build_target", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add template build_target column: %w", err)
+	}
+
+	// What admins do while impersonating a user is recorded under both
+	if err := db.addColumn("audit_log", "impersonator", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add audit impersonator column: %w", err)
+	}
+	if err := db.addColumn("audit_log", "impersonator_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add audit impersonator_id column: %w", err)
+	}
+	if err := db.addColumn("machine_events", "impersonated_by", "TEXT"); err != nil {
+		return fmt.Errorf("failed to add impersonated_by column: %w", err)
+	}
+
+	// A machine's build is stale once its configuration's hash differs
+	// from the one its last successful build was queued with
+	if err := db.addConfigHashColumns(); err != nil {
+		return fmt.Errorf("failed to add config hash columns: %w", err)
+	}
+
+	// Machines and groups record who owns them; machines inherit what they
+	// don't set from their groups
+	for _, table := range []string{"machines", "groups"} {
+		for _, column := range ownershipColumns {
+			if err := db.addColumn(table, column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return fmt.Errorf("failed to add %s %s column: %w", table, column, err)
+			}
+		}
+	}
+
+	// Virtual machines are created through the API to exercise the
+	// pipeline; their builds may be dry runs
+	if err := db.addVirtualMachineColumns(); err != nil {
+		return fmt.Errorf("failed to add virtual machine columns: %w", err)
+	}
+
+	// Users may have quota limits of their own in place of their role's
+	if err := db.addUserQuotaColumn(); err != nil {
+		return fmt.Errorf("failed to add user quota column: %w", err)
+	}
+
+	// BMC screenshots are kept as attachments, pruned apart from uploads
+	if err := db.addColumn("machine_attachments", "source", "TEXT NOT NULL DEFAULT 'upload'"); err != nil {
+		return fmt.Errorf("failed to add attachment source column: %w", err)
+	}
+	if err := db.addBuildWarningsColumn(); err != nil {
+		return fmt.Errorf("failed to add build warnings column: %w", err)
+	}
+	if err := db.addColumn("builds", "artifact_bytes", "BIGINT"); err != nil {
+		return fmt.Errorf("failed to add artifact_bytes column: %w", err)
+	}
+
+	// Enrollment looks machines up by MAC address to find duplicates
+	if err := db.normalizeMACAddresses(); err != nil {
+		return fmt.Errorf("failed to normalize mac addresses: %w", err)
+	}
+	if err := db.createIndex("idx_machines_mac_address", "machines", "mac_address"); err != nil {
+		return fmt.Errorf("failed to create machines index: %w", err)
+	}
+
+	// Hostnames are unique, ignoring case
+	if err := db.createHostnameIndex(); err != nil {
+		return fmt.Errorf("failed to create hostname index: %w", err)
+	}
+
+	// Event listing filters by machine or event type and orders by time
+	if err := db.createIndex("idx_machine_events_machine_created", "machine_events", "machine_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create machine_events index: %w", err)
+	}
+	if err := db.createIndex("idx_machine_events_event_created", "machine_events", "event, created_at"); err != nil {
+		return fmt.Errorf("failed to create machine_events index: %w", err)
+	}
+
+	// Webhook deliveries are listed per webhook, newest first, and pruned
+	// by age
+	if err := db.createIndex("idx_webhook_deliveries_webhook_created", "webhook_deliveries", "webhook_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create webhook_deliveries index: %w", err)
+	}
+	if err := db.createIndex("idx_webhook_deliveries_created", "webhook_deliveries", "created_at"); err != nil {
+		return fmt.Errorf("failed to create webhook_deliveries index: %w", err)
+	}
+
+	// A machine's latest provisioning cycle is looked up on every boot of
+	// its image, and a cycle's runs in order
+	if err := db.createIndex("idx_provisioning_cycles_machine_started", "provisioning_cycles", "machine_id, started_at"); err != nil {
+		return fmt.Errorf("failed to create provisioning_cycles index: %w", err)
+	}
+	if err := db.createIndex("idx_hook_runs_cycle_position", "hook_runs", "cycle_id, position"); err != nil {
+		return fmt.Errorf("failed to create hook_runs index: %w", err)
+	}
+
+	// The deploy worker looks up deployments by status, and rollouts by ID
+	if err := db.createIndex("idx_deployments_status_created", "deployments", "status, created_at"); err != nil {
+		return fmt.Errorf("failed to create deployments index: %w", err)
+	}
+	if err := db.createIndex("idx_deployments_rollout", "deployments", "rollout_id"); err != nil {
+		return fmt.Errorf("failed to create deployments index: %w", err)
+	}
+
+	// Builds list their tests
+	if err := db.createIndex("idx_image_tests_build", "image_tests", "build_id"); err != nil {
+		return fmt.Errorf("failed to create image_tests index: %w", err)
+	}
+
+	// The rollout orchestrator looks up rollouts by status, and groups
+	// list theirs
+	if err := db.createIndex("idx_build_rollouts_status", "build_rollouts", "status"); err != nil {
+		return fmt.Errorf("failed to create build_rollouts index: %w", err)
+	}
+	if err := db.createIndex("idx_build_rollouts_group_created", "build_rollouts", "group_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create build_rollouts index: %w", err)
+	}
+
+	// Expired idempotency keys are cleaned up by expiry
+	if err := db.createIndex("idx_idempotency_keys_expires", "idempotency_keys", "expires_at"); err != nil {
+		return fmt.Errorf("failed to create idempotency_keys index: %w", err)
+	}
+
+	// Notes and attachments are listed per machine
+	if err := db.createIndex("idx_machine_notes_machine_created", "machine_notes", "machine_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create machine_notes index: %w", err)
+	}
+	if err := db.createIndex("idx_machine_attachments_machine_created", "machine_attachments", "machine_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create machine_attachments index: %w", err)
+	}
+
+	// Boot history is read and trimmed per machine, newest first
+	if err := db.createIndex("idx_boot_requests_machine_requested", "boot_requests", "machine_id, requested_at"); err != nil {
+		return fmt.Errorf("failed to create boot_requests index: %w", err)
+	}
+
+	// The power poller looks for pending operations before and after each
+	// machine's poll
+	if err := db.createIndex("idx_power_operations_status_created", "power_operations", "status, created_at"); err != nil {
+		return fmt.Errorf("failed to create power_operations status index: %w", err)
+	}
+	if err := db.createIndex("idx_power_operations_machine_created", "power_operations", "machine_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create power_operations machine index: %w", err)
+	}
+
+	// The audit log is read newest first, by actor or route
+	if err := db.createIndex("idx_audit_log_created", "audit_log", "created_at"); err != nil {
+		return fmt.Errorf("failed to create audit_log index: %w", err)
+	}
+	if err := db.createIndex("idx_audit_log_actor_created", "audit_log", "actor, created_at"); err != nil {
+		return fmt.Errorf("failed to create audit_log actor index: %w", err)
+	}
+	if err := db.createIndex("idx_audit_log_route_created", "audit_log", "route, created_at"); err != nil {
+		return fmt.Errorf("failed to create audit_log route index: %w", err)
+	}
+
+	// The diagnostics watchdog looks for running diagnostics past their end
+	if err := db.createIndex("idx_diagnostic_runs_status_ends", "diagnostic_runs", "status, ends_at"); err != nil {
+		return fmt.Errorf("failed to create diagnostic_runs index: %w", err)
+	}
+
+	if err := db.createIndex("idx_build_schedule_runs_schedule_created", "build_schedule_runs", "schedule_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create build_schedule_runs index: %w", err)
+	}
+
+	// Quota usage is summed per user and kind over a rolling window
+	if err := db.createIndex("idx_quota_usage_user_kind_created", "quota_usage", "user_id, kind, created_at"); err != nil {
+		return fmt.Errorf("failed to create quota_usage index: %w", err)
+	}
+	if err := db.createIndex("idx_quota_grants_user_expires", "quota_grants", "user_id, expires_at"); err != nil {
+		return fmt.Errorf("failed to create quota_grants index: %w", err)
+	}
+
+	// Events look up the subscriptions to their machine, and to its
+	// groups, by event type
+	if err := db.createIndex("idx_user_subscription_events_machine", "user_subscription_events", "machine_id, event"); err != nil {
+		return fmt.Errorf("failed to create user_subscription_events index: %w", err)
+	}
+	if err := db.createIndex("idx_user_subscription_events_group", "user_subscription_events", "group_id, event"); err != nil {
+		return fmt.Errorf("failed to create user_subscription_events index: %w", err)
+	}
+	if err := db.createIndex("idx_user_subscriptions_user", "user_subscriptions", "user_id"); err != nil {
+		return fmt.Errorf("failed to create user_subscriptions index: %w", err)
+	}
+	if err := db.createIndex("idx_subscription_digest_items_user_created", "subscription_digest_items", "user_id, created_at"); err != nil {
+		return fmt.Errorf("failed to create subscription_digest_items index: %w", err)
+	}
 
 	return nil
 }
@@ -121,6 +623,57 @@ func (db *DB) createBuildsTable() string {
 	`
 }
 
+func (db *DB) createBuildLogsTable() string {
+	blobType := "BLOB"
+	if db.driver == "postgres" {
+		blobType = "BYTEA"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS build_logs (
+			build_id TEXT PRIMARY KEY,
+			data %s NOT NULL,
+			size INTEGER NOT NULL,
+			truncated_bytes INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (build_id) REFERENCES builds(id) ON DELETE CASCADE
+		)
+	`, blobType)
+}
+
+func (db *DB) createLocksTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS locks (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			acquired_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)
+	`
+}
+
+func (db *DB) createBootRequestsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS boot_requests (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			service_tag TEXT NOT NULL,
+			client_ip TEXT,
+			flavor TEXT NOT NULL,
+			arch TEXT NOT NULL,
+			boot_mode TEXT NOT NULL,
+			decision TEXT NOT NULL,
+			reason TEXT,
+			script TEXT,
+			redirect TEXT,
+			status INTEGER NOT NULL,
+			artifacts_version TEXT,
+			requested_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`
+}
+
 func (db *DB) createUsersTable() string {
 	return `
 		CREATE TABLE IF NOT EXISTS users (
@@ -250,10 +803,250 @@ func (db *DB) addBMCInfoColumn() error {
 		jsonType = "JSONB"
 	}
 
+	return db.addColumn("machines", "bmc_info", jsonType)
+}
+
+// addBuildLimitsColumn adds per-group builder resource limits and builder
+// label requirements
+func (db *DB) addBuildLimitsColumn() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	if err := db.addColumn("groups", "build_limits", jsonType); err != nil {
+		return err
+	}
+	return db.addColumn("groups", "builder_labels", jsonType)
+}
+
+// addBuildRequiredLabelsColumn adds the builder labels a build requires
+func (db *DB) addBuildRequiredLabelsColumn() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return db.addColumn("builds", "required_labels", jsonType)
+}
+
+// addBuilderHealthColumns adds the disk usage builders report, and the
+// garbage collection an admin asked one for
+func (db *DB) addBuilderHealthColumns() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	for _, col := range []struct{ name, definition string }{
+		{"health", jsonType},
+		{"gc_request_id", "TEXT"},
+		{"gc_max_freed_bytes", "BIGINT"},
+		{"gc_requested_by", "TEXT"},
+		{"gc_requested_at", "TIMESTAMP"},
+	} {
+		if err := db.addColumn("builders", col.name, col.definition); err != nil {
+			return fmt.Errorf("failed to add %s column: %w", col.name, err)
+		}
+	}
+	return nil
+}
+
+// addHardwareComplianceColumns adds the result of the last hardware profile
+// check to machines, with its status in a column of its own to filter on
+func (db *DB) addHardwareComplianceColumns() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	if err := db.addColumn("machines", "hardware_compliance", jsonType); err != nil {
+		return err
+	}
+	return db.addColumn("machines", "compliance_status", "TEXT NOT NULL DEFAULT ''")
+}
+
+// addConfigHashColumns adds the hashes of machines' configurations, when
+// they last changed, and the hash each build was queued with, and hashes
+// the configurations of machines saved before there were hashes
+func (db *DB) addConfigHashColumns() error {
+	columns := []struct{ table, name, definition string }{
+		{"machines", "config_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"machines", "config_updated_at", "TIMESTAMP"},
+		{"machines", "built_config_hash", "TEXT NOT NULL DEFAULT ''"},
+		{"builds", "config_hash", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, col := range columns {
+		if err := db.addColumn(col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	return db.hashMachineConfigs()
+}
+
+// addVirtualMachineColumns adds whether machines are virtual and have their
+// builds dry run, and whether each build is a dry run
+func (db *DB) addVirtualMachineColumns() error {
+	columns := []struct{ table, name, definition string }{
+		{"machines", "is_virtual", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"machines", "dry_run_builds", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"builds", "dry_run", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	}
+	for _, col := range columns {
+		if err := db.addColumn(col.table, col.name, col.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLintColumns adds the result of linting a machine's configuration to
+// machines, for its last save, and to builds, for the configuration built
+func (db *DB) addLintColumns() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	if err := db.addColumn("machines", "config_lint", jsonType); err != nil {
+		return err
+	}
+	return db.addColumn("builds", "lint", jsonType)
+}
+
+// addBuildWarningsColumn adds the warnings builders report with a build's
+// result
+func (db *DB) addBuildWarningsColumn() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+	return db.addColumn("builds", "warnings", jsonType)
+}
+
+// addTemplateVariablesColumn adds the values given for the variables of the
+// template a machine's configuration was applied from
+func (db *DB) addTemplateVariablesColumn() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+	return db.addColumn("machines", "template_variables", jsonType)
+}
+
+// addRequiredHardwareColumn adds the hardware fields templates require of
+// the machines they are applied to
+func (db *DB) addRequiredHardwareColumn() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+	return db.addColumn("machine_templates", "required_hardware", jsonType)
+}
+
+// addBuildTypeColumn adds the build type. System image builds belong to no
+// machine, so PostgreSQL, which enforces the machines foreign key, stores
+// NULL as their machine; SQLite, which doesn't, stores an empty one.
+func (db *DB) addBuildTypeColumn() error {
+	if err := db.addColumn("builds", "type", "TEXT NOT NULL DEFAULT 'machine'"); err != nil {
+		return err
+	}
+
+	if db.driver == "postgres" {
+		if _, err := db.Exec("ALTER TABLE builds ALTER COLUMN machine_id DROP NOT NULL"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addWebhookScopeColumns adds webhook group and status scoping and the
+// payload field list
+func (db *DB) addWebhookScopeColumns() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	for _, column := range []string{"group_ids", "statuses", "fields", "tags"} {
+		if err := db.addColumn("webhooks", column, jsonType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addWebhookRetryColumns adds webhooks' retry policies and the attempt
+// history of their deliveries
+func (db *DB) addWebhookRetryColumns() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	if err := db.addColumn("webhooks", "retry_policy", jsonType); err != nil {
+		return err
+	}
+	return db.addColumn("webhook_deliveries", "attempt_history", jsonType)
+}
+
+// addUserQuotaColumn adds users' own quota limits
+func (db *DB) addUserQuotaColumn() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+	return db.addColumn("users", "quota", jsonType)
+}
+
+// addMachineTagsColumn adds the machine tags column. On postgres, tag
+// filters use JSON containment, which a GIN index serves.
+func (db *DB) addMachineTagsColumn() error {
+	if db.driver != "postgres" {
+		return db.addColumn("machines", "tags", "TEXT")
+	}
+
+	if err := db.addColumn("machines", "tags", "JSONB"); err != nil {
+		return err
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_machines_tags ON machines USING GIN (tags)")
+	return err
+}
+
+// addMachineMetadataColumn adds the free-form machine metadata column
+func (db *DB) addMachineMetadataColumn() error {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return db.addColumn("machines", "metadata", jsonType)
+}
+
+// addBMCStatusColumns adds the BMC firmware and health tracking columns
+func (db *DB) addBMCStatusColumns() error {
+	columns := []struct{ name, definition string }{
+		{"bmc_firmware", "TEXT"},
+		{"bmc_health", "TEXT"},
+		{"bmc_unreachable", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"bmc_checked_at", "TIMESTAMP"},
+	}
+
+	for _, col := range columns {
+		if err := db.addColumn("machines", col.name, col.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addColumn adds a column to a table if it doesn't already exist
+func (db *DB) addColumn(table, column, definition string) error {
 	// For SQLite, check if column exists first
 	if db.driver == "sqlite3" {
 		var count int
-		err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('machines') WHERE name='bmc_info'").Scan(&count)
+		err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name='%s'", table, column)).Scan(&count)
 		if err != nil {
 			return err
 		}
@@ -261,15 +1054,21 @@ func (db *DB) addBMCInfoColumn() error {
 			return nil // Column already exists
 		}
 
-		_, err = db.Exec(fmt.Sprintf("ALTER TABLE machines ADD COLUMN bmc_info %s", jsonType))
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 		return err
 	}
 
 	// For PostgreSQL
 	_, err := db.Exec(fmt.Sprintf(`
-		ALTER TABLE machines
-		ADD COLUMN IF NOT EXISTS bmc_info %s
-	`, jsonType))
+		ALTER TABLE %s
+		ADD COLUMN IF NOT EXISTS %s %s
+	`, table, column, definition))
+	return err
+}
+
+// createIndex creates an index if it doesn't already exist
+func (db *DB) createIndex(name, table, columns string) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", name, table, columns))
 	return err
 }
 
@@ -317,6 +1116,173 @@ func (db *DB) createWebhookDeliveriesTable() string {
 	`
 }
 
+func (db *DB) createNotificationChannelsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS notification_channels (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			events %s NOT NULL,
+			config %s NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			rate_limit INTEGER NOT NULL DEFAULT 5,
+			rate_window INTEGER NOT NULL DEFAULT 60,
+			last_success TIMESTAMP,
+			last_failure TIMESTAMP,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)
+	`, jsonType, jsonType)
+}
+
+func (db *DB) createNotificationDeliveriesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS notification_deliveries (
+			id TEXT PRIMARY KEY,
+			channel_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			event_count INTEGER NOT NULL DEFAULT 1,
+			payload TEXT NOT NULL,
+			error TEXT,
+			attempts INTEGER NOT NULL DEFAULT 1,
+			success BOOLEAN NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			FOREIGN KEY (channel_id) REFERENCES notification_channels(id) ON DELETE CASCADE
+		)
+	`
+}
+
+func (db *DB) createMaintenanceWindowsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS maintenance_windows (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT,
+			scope TEXT NOT NULL,
+			scope_id TEXT,
+			operations %s NOT NULL,
+			schedule TEXT,
+			duration INTEGER NOT NULL DEFAULT 0,
+			starts_at TIMESTAMP,
+			ends_at TIMESTAMP,
+			timezone TEXT NOT NULL DEFAULT 'UTC',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_by TEXT,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)
+	`, jsonType)
+}
+
+func (db *DB) createWipeJobsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS wipe_jobs (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			disks %s NOT NULL,
+			error TEXT,
+			requested_by TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			started_at TIMESTAMP,
+			completed_at TIMESTAMP,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`, jsonType)
+}
+
+func (db *DB) createDeploymentsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS deployments (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			build_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			health_check %s,
+			rollout_id TEXT,
+			max_unavailable INTEGER NOT NULL DEFAULT 0,
+			system_path TEXT,
+			previous_system TEXT,
+			log_output TEXT,
+			error TEXT,
+			created_by TEXT,
+			created_at TIMESTAMP NOT NULL,
+			started_at TIMESTAMP,
+			completed_at TIMESTAMP,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`, jsonType)
+}
+
+func (db *DB) createBuildRolloutsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS build_rollouts (
+			id TEXT PRIMARY KEY,
+			group_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			batch_size INTEGER NOT NULL,
+			max_failures INTEGER NOT NULL,
+			wait_for_status TEXT NOT NULL,
+			wait_timeout INTEGER NOT NULL,
+			inter_batch_delay INTEGER NOT NULL,
+			power_cycle BOOLEAN NOT NULL DEFAULT FALSE,
+			machines %s NOT NULL,
+			current_batch INTEGER NOT NULL DEFAULT 0,
+			failures INTEGER NOT NULL DEFAULT 0,
+			paused_reason TEXT,
+			next_batch_at TIMESTAMP,
+			created_by TEXT,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+		)
+	`, jsonType)
+}
+
+func (db *DB) createIdempotencyKeysTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			idempotency_key TEXT NOT NULL,
+			username TEXT NOT NULL,
+			endpoint TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			response_body TEXT,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (idempotency_key, username, endpoint)
+		)
+	`
+}
+
 func (db *DB) createMachineTemplatesTable() string {
 	jsonType := "TEXT"
 	if db.driver == "postgres" {
@@ -0,0 +1,370 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+// dcimSyncReportsKept is how many sync reports are kept per source
+const dcimSyncReportsKept = 100
+
+const dcimSyncReportColumns = `
+	id, source, force, started_at, finished_at, created, updated, unchanged,
+	skipped, conflicts, error
+`
+
+// CreatePreregisteredMachine creates the record for a machine imported from
+// a DCIM before it has enrolled. It has no MAC address or hardware until it
+// does. It returns a HostnameTakenError if another machine has the
+// hostname.
+func (db *DB) CreatePreregisteredMachine(serviceTag, hostname string, fields models.DCIMFields) (*models.Machine, error) {
+	if err := db.CheckHostname("", hostname); err != nil {
+		return nil, err
+	}
+
+	machine := newEnrolledMachine(models.EnrollmentRequest{ServiceTag: serviceTag}, models.StatusPreregistered)
+	machine.Hostname = hostname
+	machine.SetDCIMFields(fields)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := db.insertEnrolledMachine(tx, machine); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// The insert only covers what enrollment sets
+	if err := db.UpdateMachine(machine); err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+// CompletePreregistration fills in a preregistered machine from its first
+// enrollment and moves it to enrolled. BMC details the machine reports are
+// merged into any the DCIM provided. It returns false if the machine is no
+// longer preregistered.
+func (db *DB) CompletePreregistration(machine *models.Machine, req models.EnrollmentRequest) (bool, error) {
+	now := time.Now()
+
+	bmcInfo := machine.BMCInfo
+	if req.BMC != nil {
+		bmcInfo, _ = req.BMC.MergeInto(bmcInfo)
+	}
+
+	hardwareJSON, err := json.Marshal(req.Hardware)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal hardware: %w", err)
+	}
+	var bmcJSON []byte
+	if bmcInfo != nil {
+		if bmcJSON, err = db.marshalBMCInfo(bmcInfo); err != nil {
+			return false, err
+		}
+	}
+
+	query := `
+		UPDATE machines SET
+			mac_address = ?, hardware = ?, boot_mode = ?, bmc_info = ?, status = ?,
+			enrolled_at = ?, last_seen_at = ?, updated_at = ?
+		WHERE id = ? AND status = ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE machines SET
+				mac_address = $1, hardware = $2, boot_mode = $3, bmc_info = $4, status = $5,
+				enrolled_at = $6, last_seen_at = $7, updated_at = $8
+			WHERE id = $9 AND status = $10
+		`
+	}
+
+	result, err := db.Exec(query,
+		req.MACAddress,
+		hardwareJSON,
+		req.BootMode,
+		bmcJSON,
+		models.StatusEnrolled,
+		now,
+		now,
+		now,
+		machine.ID,
+		models.StatusPreregistered,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to complete preregistration: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	machine.MACAddress = req.MACAddress
+	machine.Hardware = req.Hardware
+	machine.HardwareCompleteness = machine.Hardware.Completeness()
+	machine.BootMode = req.BootMode
+	machine.BMCInfo = bmcInfo
+	machine.Status = models.StatusEnrolled
+	machine.EnrolledAt = now
+	machine.LastSeenAt = &now
+	machine.UpdatedAt = now
+	return true, nil
+}
+
+// GetDCIMRecord returns what a source last synced to a machine. It returns
+// nil, nil if the source never has.
+func (db *DB) GetDCIMRecord(source, machineID string) (*models.DCIMRecord, error) {
+	query := `SELECT external_id, synced, synced_at FROM dcim_records WHERE source = ? AND machine_id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT external_id, synced, synced_at FROM dcim_records WHERE source = $1 AND machine_id = $2`
+	}
+
+	record := &models.DCIMRecord{Source: source, MachineID: machineID}
+	var synced jsonColumn
+	err := db.QueryRow(query, source, machineID).Scan(&record.ExternalID, &synced, &record.SyncedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dcim record: %w", err)
+	}
+	if err := synced.Unmarshal(&record.Synced); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal synced fields: %w", err)
+	}
+
+	return record, nil
+}
+
+// SaveDCIMRecord records what a source synced to a machine
+func (db *DB) SaveDCIMRecord(record *models.DCIMRecord) error {
+	synced, err := marshalJSONColumn(record.Synced)
+	if err != nil {
+		return fmt.Errorf("failed to marshal synced fields: %w", err)
+	}
+
+	query := `
+		INSERT INTO dcim_records (source, machine_id, external_id, synced, synced_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (source, machine_id) DO UPDATE SET
+			external_id = excluded.external_id, synced = excluded.synced,
+			synced_at = excluded.synced_at
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO dcim_records (source, machine_id, external_id, synced, synced_at)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (source, machine_id) DO UPDATE SET
+				external_id = excluded.external_id, synced = excluded.synced,
+				synced_at = excluded.synced_at
+		`
+	}
+
+	_, err = db.Exec(query, record.Source, record.MachineID, record.ExternalID, synced, record.SyncedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save dcim record: %w", err)
+	}
+
+	return nil
+}
+
+// CreateDCIMSyncReport stores a sync report, dropping the oldest reports of
+// its source beyond the last dcimSyncReportsKept
+func (db *DB) CreateDCIMSyncReport(report *models.DCIMSyncReport) error {
+	if report.ID == "" {
+		report.ID = uuid.New().String()
+	}
+
+	items, err := marshalJSONColumn(report.Items)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync items: %w", err)
+	}
+
+	query := `
+		INSERT INTO dcim_sync_reports (` + dcimSyncReportColumns + `, items)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	prune := `
+		DELETE FROM dcim_sync_reports WHERE source = ? AND id NOT IN (
+			SELECT id FROM dcim_sync_reports WHERE source = ?
+			ORDER BY started_at DESC LIMIT ?
+		)
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO dcim_sync_reports (` + dcimSyncReportColumns + `, items)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		`
+		prune = `
+			DELETE FROM dcim_sync_reports WHERE source = $1 AND id NOT IN (
+				SELECT id FROM dcim_sync_reports WHERE source = $2
+				ORDER BY started_at DESC LIMIT $3
+			)
+		`
+	}
+
+	_, err = db.Exec(query,
+		report.ID,
+		report.Source,
+		report.Force,
+		report.StartedAt,
+		report.FinishedAt,
+		report.Created,
+		report.Updated,
+		report.Unchanged,
+		report.Skipped,
+		report.Conflicts,
+		report.Error,
+		items,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create sync report: %w", err)
+	}
+
+	if _, err := db.Exec(prune, report.Source, report.Source, dcimSyncReportsKept); err != nil {
+		return fmt.Errorf("failed to prune sync reports: %w", err)
+	}
+
+	return nil
+}
+
+// ListDCIMSyncReports lists a source's sync reports, newest first, without
+// their items
+func (db *DB) ListDCIMSyncReports(source string, limit int) ([]*models.DCIMSyncReport, error) {
+	query := `SELECT` + dcimSyncReportColumns + `FROM dcim_sync_reports WHERE source = ?
+		ORDER BY started_at DESC, id LIMIT ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + dcimSyncReportColumns + `FROM dcim_sync_reports WHERE source = $1
+			ORDER BY started_at DESC, id LIMIT $2`
+	}
+	if limit <= 0 {
+		limit = dcimSyncReportsKept
+	}
+
+	rows, err := db.Query(query, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sync reports: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []*models.DCIMSyncReport
+	for rows.Next() {
+		report, err := scanDCIMSyncReport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan sync report: %w", err)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, rows.Err()
+}
+
+// GetDCIMSyncReport retrieves a sync report with its items. It returns nil,
+// nil if there is no such report.
+func (db *DB) GetDCIMSyncReport(id string) (*models.DCIMSyncReport, error) {
+	query := `SELECT` + dcimSyncReportColumns + `, items FROM dcim_sync_reports WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + dcimSyncReportColumns + `, items FROM dcim_sync_reports WHERE id = $1`
+	}
+
+	var items jsonColumn
+	report, err := scanDCIMSyncReport(db.QueryRow(query, id), &items)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sync report: %w", err)
+	}
+	if err := items.Unmarshal(&report.Items); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sync items: %w", err)
+	}
+
+	return report, nil
+}
+
+// scanDCIMSyncReport reads a row of dcimSyncReportColumns, followed by any
+// extra columns into extra
+func scanDCIMSyncReport(row rowScanner, extra ...interface{}) (*models.DCIMSyncReport, error) {
+	report := &models.DCIMSyncReport{}
+	var errorMsg sql.NullString
+
+	dest := []interface{}{
+		&report.ID,
+		&report.Source,
+		&report.Force,
+		&report.StartedAt,
+		&report.FinishedAt,
+		&report.Created,
+		&report.Updated,
+		&report.Unchanged,
+		&report.Skipped,
+		&report.Conflicts,
+		&errorMsg,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	report.Error = errorMsg.String
+	return report, nil
+}
+
+func (db *DB) createDCIMRecordsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS dcim_records (
+			source TEXT NOT NULL,
+			machine_id TEXT NOT NULL,
+			external_id TEXT NOT NULL,
+			synced %s,
+			synced_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (source, machine_id),
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`, jsonType)
+}
+
+func (db *DB) createDCIMSyncReportsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS dcim_sync_reports (
+			id TEXT PRIMARY KEY,
+			source TEXT NOT NULL,
+			force BOOLEAN NOT NULL DEFAULT FALSE,
+			started_at TIMESTAMP NOT NULL,
+			finished_at TIMESTAMP,
+			created INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL DEFAULT 0,
+			unchanged INTEGER NOT NULL DEFAULT 0,
+			skipped INTEGER NOT NULL DEFAULT 0,
+			conflicts INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			items %s
+		)
+	`, jsonType)
+}
@@ -0,0 +1,277 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const deploymentColumns = `
+	id, machine_id, build_id, status, health_check, rollout_id, max_unavailable,
+	system_path, previous_system, log_output, error, created_by,
+	created_at, started_at, completed_at
+`
+
+// CreateDeployment creates a new deployment
+func (db *DB) CreateDeployment(d *models.Deployment) error {
+	d.ID = uuid.New().String()
+	d.CreatedAt = time.Now()
+
+	healthCheckJSON, err := marshalHealthCheck(d.HealthCheck)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO deployments (
+			id, machine_id, build_id, status, health_check, rollout_id,
+			max_unavailable, created_by, created_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO deployments (
+				id, machine_id, build_id, status, health_check, rollout_id,
+				max_unavailable, created_by, created_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`
+	}
+
+	_, err = db.Exec(query,
+		d.ID,
+		d.MachineID,
+		d.BuildID,
+		d.Status,
+		healthCheckJSON,
+		d.RolloutID,
+		d.MaxUnavailable,
+		d.CreatedBy,
+		d.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create deployment: %w", err)
+	}
+
+	return nil
+}
+
+// GetDeployment retrieves a deployment by ID. It returns nil, nil if there
+// is no such deployment.
+func (db *DB) GetDeployment(id string) (*models.Deployment, error) {
+	query := `SELECT` + deploymentColumns + `FROM deployments WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + deploymentColumns + `FROM deployments WHERE id = $1`
+	}
+
+	d, err := scanDeployment(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	return d, nil
+}
+
+// GetActiveDeployment retrieves the pending or running deployment for a
+// machine. It returns nil, nil if the machine has none.
+func (db *DB) GetActiveDeployment(machineID string) (*models.Deployment, error) {
+	query := `SELECT` + deploymentColumns + `FROM deployments
+		WHERE machine_id = ? AND status IN ('pending', 'running')
+		ORDER BY created_at DESC LIMIT 1`
+	if db.driver == "postgres" {
+		query = `SELECT` + deploymentColumns + `FROM deployments
+			WHERE machine_id = $1 AND status IN ('pending', 'running')
+			ORDER BY created_at DESC LIMIT 1`
+	}
+
+	d, err := scanDeployment(db.QueryRow(query, machineID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	return d, nil
+}
+
+// ListDeployments lists a machine's deployments, newest first
+func (db *DB) ListDeployments(machineID string) ([]*models.Deployment, error) {
+	query := `SELECT` + deploymentColumns + `FROM deployments WHERE machine_id = ? ORDER BY created_at DESC`
+	if db.driver == "postgres" {
+		query = `SELECT` + deploymentColumns + `FROM deployments WHERE machine_id = $1 ORDER BY created_at DESC`
+	}
+
+	return db.queryDeployments(query, machineID)
+}
+
+// ListRolloutDeployments lists the deployments of a group rollout in the
+// order they were created
+func (db *DB) ListRolloutDeployments(rolloutID string) ([]*models.Deployment, error) {
+	query := `SELECT` + deploymentColumns + `FROM deployments WHERE rollout_id = ? ORDER BY created_at ASC`
+	if db.driver == "postgres" {
+		query = `SELECT` + deploymentColumns + `FROM deployments WHERE rollout_id = $1 ORDER BY created_at ASC`
+	}
+
+	return db.queryDeployments(query, rolloutID)
+}
+
+// ListDeploymentsByStatus lists deployments in a status, oldest first
+func (db *DB) ListDeploymentsByStatus(status string) ([]*models.Deployment, error) {
+	query := `SELECT` + deploymentColumns + `FROM deployments WHERE status = ? ORDER BY created_at ASC`
+	if db.driver == "postgres" {
+		query = `SELECT` + deploymentColumns + `FROM deployments WHERE status = $1 ORDER BY created_at ASC`
+	}
+
+	return db.queryDeployments(query, status)
+}
+
+func (db *DB) queryDeployments(query string, args ...interface{}) ([]*models.Deployment, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %w", err)
+	}
+	defer rows.Close()
+
+	var deployments []*models.Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan deployment: %w", err)
+		}
+		deployments = append(deployments, d)
+	}
+
+	return deployments, rows.Err()
+}
+
+// UpdateDeployment records a deployment's progress
+func (db *DB) UpdateDeployment(d *models.Deployment) error {
+	query := `
+		UPDATE deployments SET
+			status = ?, system_path = ?, previous_system = ?, log_output = ?, error = ?,
+			started_at = ?, completed_at = ?
+		WHERE id = ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE deployments SET
+				status = $1, system_path = $2, previous_system = $3, log_output = $4, error = $5,
+				started_at = $6, completed_at = $7
+			WHERE id = $8
+		`
+	}
+
+	_, err := db.Exec(query,
+		d.Status,
+		d.SystemPath,
+		d.PreviousSystem,
+		d.LogOutput,
+		d.Error,
+		d.StartedAt,
+		d.CompletedAt,
+		d.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update deployment: %w", err)
+	}
+
+	return nil
+}
+
+// CancelPendingDeployments cancels a machine's deployments that haven't
+// started and returns how many were cancelled
+func (db *DB) CancelPendingDeployments(machineID string) (int64, error) {
+	return db.cancelDeployments("machine_id", machineID)
+}
+
+// CancelPendingRollout cancels the deployments of a rollout that haven't
+// started and returns how many were cancelled
+func (db *DB) CancelPendingRollout(rolloutID string) (int64, error) {
+	return db.cancelDeployments("rollout_id", rolloutID)
+}
+
+func (db *DB) cancelDeployments(column, value string) (int64, error) {
+	query := fmt.Sprintf(`
+		UPDATE deployments SET status = 'cancelled', completed_at = ?
+		WHERE %s = ? AND status = 'pending'
+	`, column)
+
+	if db.driver == "postgres" {
+		query = fmt.Sprintf(`
+			UPDATE deployments SET status = 'cancelled', completed_at = $1
+			WHERE %s = $2 AND status = 'pending'
+		`, column)
+	}
+
+	result, err := db.Exec(query, time.Now(), value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel deployments: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+func marshalHealthCheck(check *models.HealthCheck) (interface{}, error) {
+	if check == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(check)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal health check: %w", err)
+	}
+	return string(data), nil
+}
+
+// scanDeployment reads a row of deploymentColumns
+func scanDeployment(row rowScanner) (*models.Deployment, error) {
+	d := &models.Deployment{}
+	var healthCheckJSON []byte
+	var rolloutID, systemPath, previousSystem, logOutput, errorMsg, createdBy sql.NullString
+
+	err := row.Scan(
+		&d.ID,
+		&d.MachineID,
+		&d.BuildID,
+		&d.Status,
+		&healthCheckJSON,
+		&rolloutID,
+		&d.MaxUnavailable,
+		&systemPath,
+		&previousSystem,
+		&logOutput,
+		&errorMsg,
+		&createdBy,
+		&d.CreatedAt,
+		&d.StartedAt,
+		&d.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	d.RolloutID = rolloutID.String
+	d.SystemPath = systemPath.String
+	d.PreviousSystem = previousSystem.String
+	d.LogOutput = logOutput.String
+	d.Error = errorMsg.String
+	d.CreatedBy = createdBy.String
+
+	if len(healthCheckJSON) > 0 {
+		d.HealthCheck = &models.HealthCheck{}
+		if err := json.Unmarshal(healthCheckJSON, d.HealthCheck); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal health check: %w", err)
+		}
+	}
+
+	return d, nil
+}
@@ -0,0 +1,441 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const diagnosticProfileColumns = `
+	id, name, description, kernel_asset_id, initrd_asset_id, cmdline, created_at, updated_at
+`
+
+const diagnosticRunColumns = `
+	id, machine_id, profile_id, profile_name, status, power_cycle, results,
+	requested_by, created_at, ends_at, completed_at
+`
+
+// CreateDiagnosticProfile creates a diagnostic profile
+func (db *DB) CreateDiagnosticProfile(profile *models.DiagnosticProfile) error {
+	profile.ID = uuid.New().String()
+	profile.CreatedAt = time.Now()
+	profile.UpdatedAt = profile.CreatedAt
+
+	query := `INSERT INTO diagnostic_profiles (` + diagnosticProfileColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO diagnostic_profiles (` + diagnosticProfileColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	}
+
+	_, err := db.Exec(query,
+		profile.ID,
+		profile.Name,
+		profile.Description,
+		profile.KernelAssetID,
+		profile.InitrdAssetID,
+		profile.Cmdline,
+		profile.CreatedAt,
+		profile.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create diagnostic profile: %w", err)
+	}
+	return nil
+}
+
+// GetDiagnosticProfile retrieves a diagnostic profile. It returns nil, nil
+// if there is no such profile.
+func (db *DB) GetDiagnosticProfile(id string) (*models.DiagnosticProfile, error) {
+	query := `SELECT` + diagnosticProfileColumns + `FROM diagnostic_profiles WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + diagnosticProfileColumns + `FROM diagnostic_profiles WHERE id = $1`
+	}
+	return db.getDiagnosticProfile(query, id)
+}
+
+// GetDiagnosticProfileByName retrieves a diagnostic profile by name. It
+// returns nil, nil if there is no such profile.
+func (db *DB) GetDiagnosticProfileByName(name string) (*models.DiagnosticProfile, error) {
+	query := `SELECT` + diagnosticProfileColumns + `FROM diagnostic_profiles WHERE name = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + diagnosticProfileColumns + `FROM diagnostic_profiles WHERE name = $1`
+	}
+	return db.getDiagnosticProfile(query, name)
+}
+
+func (db *DB) getDiagnosticProfile(query string, arg string) (*models.DiagnosticProfile, error) {
+	profile, err := scanDiagnosticProfile(db.QueryRow(query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get diagnostic profile: %w", err)
+	}
+	return profile, nil
+}
+
+// ListDiagnosticProfiles lists diagnostic profiles by name
+func (db *DB) ListDiagnosticProfiles() ([]*models.DiagnosticProfile, error) {
+	rows, err := db.Query(`SELECT` + diagnosticProfileColumns + `FROM diagnostic_profiles ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list diagnostic profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []*models.DiagnosticProfile
+	for rows.Next() {
+		profile, err := scanDiagnosticProfile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan diagnostic profile: %w", err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, rows.Err()
+}
+
+// UpdateDiagnosticProfile updates a diagnostic profile. Running diagnostics
+// keep booting what the profile was when they started.
+func (db *DB) UpdateDiagnosticProfile(profile *models.DiagnosticProfile) error {
+	profile.UpdatedAt = time.Now()
+
+	query := `
+		UPDATE diagnostic_profiles SET
+			name = ?, description = ?, kernel_asset_id = ?, initrd_asset_id = ?, cmdline = ?, updated_at = ?
+		WHERE id = ?
+	`
+	if db.driver == "postgres" {
+		query = `
+			UPDATE diagnostic_profiles SET
+				name = $1, description = $2, kernel_asset_id = $3, initrd_asset_id = $4, cmdline = $5, updated_at = $6
+			WHERE id = $7
+		`
+	}
+
+	_, err := db.Exec(query,
+		profile.Name,
+		profile.Description,
+		profile.KernelAssetID,
+		profile.InitrdAssetID,
+		profile.Cmdline,
+		profile.UpdatedAt,
+		profile.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update diagnostic profile: %w", err)
+	}
+	return nil
+}
+
+// DeleteDiagnosticProfile deletes a diagnostic profile. Past runs keep its
+// name.
+func (db *DB) DeleteDiagnosticProfile(id string) error {
+	query := "DELETE FROM diagnostic_profiles WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM diagnostic_profiles WHERE id = $1"
+	}
+
+	if _, err := db.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to delete diagnostic profile: %w", err)
+	}
+	return nil
+}
+
+// BootAssetDiagnosticProfiles returns the names of the diagnostic profiles
+// that boot an asset
+func (db *DB) BootAssetDiagnosticProfiles(assetID string) ([]string, error) {
+	query := `SELECT name FROM diagnostic_profiles
+		WHERE kernel_asset_id = ? OR initrd_asset_id = ? ORDER BY name`
+	args := []interface{}{assetID, assetID}
+	if db.driver == "postgres" {
+		query = `SELECT name FROM diagnostic_profiles
+			WHERE kernel_asset_id = $1 OR initrd_asset_id = $1 ORDER BY name`
+		args = args[:1]
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list diagnostic profiles of asset: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan diagnostic profile: %w", err)
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// StartDiagnosticRun records a diagnostic run and sets the boot override
+// that boots the machine into it, unless the machine already has a running
+// diagnostic run or a boot override. It returns false if it does.
+func (db *DB) StartDiagnosticRun(run *models.DiagnosticRun, override *models.BootOverride) (bool, error) {
+	run.ID = uuid.New().String()
+	run.Status = models.DiagnosticsRunning
+	run.CreatedAt = time.Now()
+	override.DiagnosticRunID = run.ID
+	override.BootsServed = 0
+	override.CreatedAt = run.CreatedAt
+
+	query := `
+		INSERT INTO diagnostic_runs (` + diagnosticRunColumns + `)
+		SELECT ?, ?, ?, ?, ?, ?, NULL, ?, ?, ?, NULL
+		WHERE NOT EXISTS (SELECT 1 FROM diagnostic_runs WHERE machine_id = ? AND status = 'running')
+		AND NOT EXISTS (SELECT 1 FROM boot_overrides WHERE machine_id = ?)
+	`
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO diagnostic_runs (` + diagnosticRunColumns + `)
+			SELECT $1, $2, $3, $4, $5, $6, NULL, $7, $8, $9, NULL
+			WHERE NOT EXISTS (SELECT 1 FROM diagnostic_runs WHERE machine_id = $2 AND status = 'running')
+			AND NOT EXISTS (SELECT 1 FROM boot_overrides WHERE machine_id = $2)
+		`
+	}
+
+	args := []interface{}{
+		run.ID,
+		run.MachineID,
+		run.ProfileID,
+		run.ProfileName,
+		run.Status,
+		run.PowerCycle,
+		run.RequestedBy,
+		run.CreatedAt,
+		run.EndsAt,
+		run.MachineID,
+		run.MachineID,
+	}
+	if db.driver == "postgres" {
+		args = args[:9]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to create diagnostic run: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if err := db.insertBootOverride(tx, override); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetDiagnosticRun retrieves a diagnostic run. It returns nil, nil if there
+// is no such run.
+func (db *DB) GetDiagnosticRun(id string) (*models.DiagnosticRun, error) {
+	query := `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE id = $1`
+	}
+
+	run, err := scanDiagnosticRun(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get diagnostic run: %w", err)
+	}
+	return run, nil
+}
+
+// GetActiveDiagnosticRun retrieves a machine's running diagnostic run. It
+// returns nil, nil if the machine has none.
+func (db *DB) GetActiveDiagnosticRun(machineID string) (*models.DiagnosticRun, error) {
+	query := `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE machine_id = ? AND status = 'running'`
+	if db.driver == "postgres" {
+		query = `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE machine_id = $1 AND status = 'running'`
+	}
+
+	run, err := scanDiagnosticRun(db.QueryRow(query, machineID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get diagnostic run: %w", err)
+	}
+	return run, nil
+}
+
+// ListDiagnosticRuns lists a machine's diagnostic runs, newest first, up to
+// limit if it is positive
+func (db *DB) ListDiagnosticRuns(machineID string, limit int) ([]*models.DiagnosticRun, error) {
+	query := `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE machine_id = ? ORDER BY created_at DESC`
+	if db.driver == "postgres" {
+		query = `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE machine_id = $1 ORDER BY created_at DESC`
+	}
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	return db.queryDiagnosticRuns(query, machineID)
+}
+
+// ListEndedDiagnosticRuns lists running diagnostic runs that ended before
+func (db *DB) ListEndedDiagnosticRuns(before time.Time) ([]*models.DiagnosticRun, error) {
+	query := `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE status = 'running' AND ends_at < ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + diagnosticRunColumns + `FROM diagnostic_runs WHERE status = 'running' AND ends_at < $1`
+	}
+
+	return db.queryDiagnosticRuns(query, before)
+}
+
+func (db *DB) queryDiagnosticRuns(query string, args ...interface{}) ([]*models.DiagnosticRun, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list diagnostic runs: %w", err)
+	}
+	defer rows.Close()
+
+	var runs []*models.DiagnosticRun
+	for rows.Next() {
+		run, err := scanDiagnosticRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan diagnostic run: %w", err)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// FinishDiagnosticRun records the outcome of a running diagnostic run. It
+// returns false if the run has already finished.
+func (db *DB) FinishDiagnosticRun(run *models.DiagnosticRun) (bool, error) {
+	now := time.Now()
+	run.CompletedAt = &now
+
+	results, err := marshalJSONColumn(run.Results)
+	if err != nil {
+		return false, err
+	}
+
+	query := `UPDATE diagnostic_runs SET status = ?, results = ?, completed_at = ? WHERE id = ? AND status = 'running'`
+	if db.driver == "postgres" {
+		query = `UPDATE diagnostic_runs SET status = $1, results = $2, completed_at = $3 WHERE id = $4 AND status = 'running'`
+	}
+
+	result, err := db.Exec(query, run.Status, results, run.CompletedAt, run.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to finish diagnostic run: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func scanDiagnosticProfile(row rowScanner) (*models.DiagnosticProfile, error) {
+	var profile models.DiagnosticProfile
+	var description sql.NullString
+
+	err := row.Scan(
+		&profile.ID,
+		&profile.Name,
+		&description,
+		&profile.KernelAssetID,
+		&profile.InitrdAssetID,
+		&profile.Cmdline,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	profile.Description = description.String
+	return &profile, nil
+}
+
+func scanDiagnosticRun(row rowScanner) (*models.DiagnosticRun, error) {
+	var run models.DiagnosticRun
+	var results jsonColumn
+	var completedAt sql.NullTime
+
+	err := row.Scan(
+		&run.ID,
+		&run.MachineID,
+		&run.ProfileID,
+		&run.ProfileName,
+		&run.Status,
+		&run.PowerCycle,
+		&results,
+		&run.RequestedBy,
+		&run.CreatedAt,
+		&run.EndsAt,
+		&completedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if results != nil {
+		run.Results = &models.DiagnosticResults{}
+		if err := results.Unmarshal(run.Results); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal diagnostic results: %w", err)
+		}
+	}
+	if completedAt.Valid {
+		run.CompletedAt = &completedAt.Time
+	}
+	return &run, nil
+}
+
+func (db *DB) createDiagnosticProfilesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS diagnostic_profiles (
+			id TEXT PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT,
+			kernel_asset_id TEXT NOT NULL,
+			initrd_asset_id TEXT NOT NULL DEFAULT '',
+			cmdline TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)
+	`
+}
+
+func (db *DB) createDiagnosticRunsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS diagnostic_runs (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			profile_id TEXT NOT NULL,
+			profile_name TEXT NOT NULL,
+			status TEXT NOT NULL,
+			power_cycle BOOLEAN NOT NULL DEFAULT FALSE,
+			results %s,
+			requested_by TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			ends_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`, jsonType)
+}
@@ -0,0 +1,315 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const enrollmentRuleColumns = `
+	id, name, description, priority, enabled, conditions, continues,
+	template_id, hostname_pattern, created_at, updated_at
+`
+
+// CreateEnrollmentRule creates an enrollment rule and its groups
+func (db *DB) CreateEnrollmentRule(rule *models.EnrollmentRule) error {
+	rule.ID = uuid.New().String()
+	rule.CreatedAt = time.Now()
+	rule.UpdatedAt = rule.CreatedAt
+
+	query := `INSERT INTO enrollment_rules (` + enrollmentRuleColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO enrollment_rules (` + enrollmentRuleColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	}
+
+	match, err := marshalJSONColumn(rule.Match)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query,
+		rule.ID,
+		rule.Name,
+		rule.Description,
+		rule.Priority,
+		rule.Enabled,
+		match,
+		rule.Continue,
+		rule.TemplateID,
+		rule.HostnamePattern,
+		rule.CreatedAt,
+		rule.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create enrollment rule: %w", err)
+	}
+
+	if err := db.setEnrollmentRuleGroups(tx, rule.ID, rule.GroupIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetEnrollmentRule retrieves an enrollment rule by ID. It returns nil, nil
+// if there is no such rule.
+func (db *DB) GetEnrollmentRule(id string) (*models.EnrollmentRule, error) {
+	query := `SELECT` + enrollmentRuleColumns + `FROM enrollment_rules WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + enrollmentRuleColumns + `FROM enrollment_rules WHERE id = $1`
+	}
+	return db.getEnrollmentRule(query, id)
+}
+
+// GetEnrollmentRuleByName retrieves an enrollment rule by name. It returns
+// nil, nil if there is no such rule.
+func (db *DB) GetEnrollmentRuleByName(name string) (*models.EnrollmentRule, error) {
+	query := `SELECT` + enrollmentRuleColumns + `FROM enrollment_rules WHERE name = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + enrollmentRuleColumns + `FROM enrollment_rules WHERE name = $1`
+	}
+	return db.getEnrollmentRule(query, name)
+}
+
+func (db *DB) getEnrollmentRule(query string, arg string) (*models.EnrollmentRule, error) {
+	rule, err := scanEnrollmentRule(db.QueryRow(query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get enrollment rule: %w", err)
+	}
+
+	groups, err := db.enrollmentRuleGroups()
+	if err != nil {
+		return nil, err
+	}
+	rule.GroupIDs = append(rule.GroupIDs, groups[rule.ID]...)
+
+	return rule, nil
+}
+
+// ListEnrollmentRules lists all enrollment rules in the order they are
+// evaluated, with their groups
+func (db *DB) ListEnrollmentRules() ([]*models.EnrollmentRule, error) {
+	rows, err := db.Query(`SELECT` + enrollmentRuleColumns + `FROM enrollment_rules ORDER BY priority, name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enrollment rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []*models.EnrollmentRule
+	for rows.Next() {
+		rule, err := scanEnrollmentRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan enrollment rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups, err := db.enrollmentRuleGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		rule.GroupIDs = append(rule.GroupIDs, groups[rule.ID]...)
+	}
+
+	return rules, nil
+}
+
+// UpdateEnrollmentRule updates an enrollment rule and replaces its groups
+func (db *DB) UpdateEnrollmentRule(rule *models.EnrollmentRule) error {
+	rule.UpdatedAt = time.Now()
+
+	query := `UPDATE enrollment_rules
+		SET name = ?, description = ?, priority = ?, enabled = ?, conditions = ?, continues = ?,
+			template_id = ?, hostname_pattern = ?, updated_at = ?
+		WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE enrollment_rules
+			SET name = $1, description = $2, priority = $3, enabled = $4, conditions = $5, continues = $6,
+				template_id = $7, hostname_pattern = $8, updated_at = $9
+			WHERE id = $10`
+	}
+
+	match, err := marshalJSONColumn(rule.Match)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query,
+		rule.Name,
+		rule.Description,
+		rule.Priority,
+		rule.Enabled,
+		match,
+		rule.Continue,
+		rule.TemplateID,
+		rule.HostnamePattern,
+		rule.UpdatedAt,
+		rule.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update enrollment rule: %w", err)
+	}
+
+	if err := db.setEnrollmentRuleGroups(tx, rule.ID, rule.GroupIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteEnrollmentRule deletes an enrollment rule. Machines it placed keep
+// their groups, template, and hostname.
+func (db *DB) DeleteEnrollmentRule(id string) error {
+	groups := "DELETE FROM enrollment_rule_groups WHERE rule_id = ?"
+	query := "DELETE FROM enrollment_rules WHERE id = ?"
+	if db.driver == "postgres" {
+		groups = "DELETE FROM enrollment_rule_groups WHERE rule_id = $1"
+		query = "DELETE FROM enrollment_rules WHERE id = $1"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(groups, id); err != nil {
+		return fmt.Errorf("failed to delete enrollment rule groups: %w", err)
+	}
+	if _, err := tx.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to delete enrollment rule: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// enrollmentRuleGroups returns the groups of each rule, by rule ID
+func (db *DB) enrollmentRuleGroups() (map[string][]string, error) {
+	rows, err := db.Query("SELECT rule_id, group_id FROM enrollment_rule_groups ORDER BY group_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enrollment rule groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := make(map[string][]string)
+	for rows.Next() {
+		var ruleID, groupID string
+		if err := rows.Scan(&ruleID, &groupID); err != nil {
+			return nil, err
+		}
+		groups[ruleID] = append(groups[ruleID], groupID)
+	}
+
+	return groups, rows.Err()
+}
+
+// setEnrollmentRuleGroups replaces the groups of a rule
+func (db *DB) setEnrollmentRuleGroups(tx *sql.Tx, ruleID string, groupIDs []string) error {
+	deleteGroups := "DELETE FROM enrollment_rule_groups WHERE rule_id = ?"
+	insert := "INSERT INTO enrollment_rule_groups (rule_id, group_id) VALUES (?, ?) ON CONFLICT DO NOTHING"
+	if db.driver == "postgres" {
+		deleteGroups = "DELETE FROM enrollment_rule_groups WHERE rule_id = $1"
+		insert = "INSERT INTO enrollment_rule_groups (rule_id, group_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	}
+
+	if _, err := tx.Exec(deleteGroups, ruleID); err != nil {
+		return fmt.Errorf("failed to clear enrollment rule groups: %w", err)
+	}
+	for _, groupID := range groupIDs {
+		if _, err := tx.Exec(insert, ruleID, groupID); err != nil {
+			return fmt.Errorf("failed to add group %s to enrollment rule: %w", groupID, err)
+		}
+	}
+	return nil
+}
+
+func scanEnrollmentRule(row rowScanner) (*models.EnrollmentRule, error) {
+	var rule models.EnrollmentRule
+	var description, templateID, hostnamePattern sql.NullString
+	var match jsonColumn
+
+	err := row.Scan(
+		&rule.ID,
+		&rule.Name,
+		&description,
+		&rule.Priority,
+		&rule.Enabled,
+		&match,
+		&rule.Continue,
+		&templateID,
+		&hostnamePattern,
+		&rule.CreatedAt,
+		&rule.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rule.Description = description.String
+	rule.TemplateID = templateID.String
+	rule.HostnamePattern = hostnamePattern.String
+	if err := match.Unmarshal(&rule.Match); err != nil {
+		return nil, fmt.Errorf("failed to decode match: %w", err)
+	}
+	rule.GroupIDs = []string{}
+
+	return &rule, nil
+}
+
+func (db *DB) createEnrollmentRulesTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS enrollment_rules (
+			id TEXT PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT,
+			priority INTEGER NOT NULL DEFAULT 0,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			conditions %s NOT NULL,
+			continues BOOLEAN NOT NULL DEFAULT FALSE,
+			template_id TEXT,
+			hostname_pattern TEXT,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)
+	`, jsonType)
+}
+
+func (db *DB) createEnrollmentRuleGroupsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS enrollment_rule_groups (
+			rule_id TEXT NOT NULL,
+			group_id TEXT NOT NULL,
+			PRIMARY KEY (rule_id, group_id),
+			FOREIGN KEY (rule_id) REFERENCES enrollment_rules(id) ON DELETE CASCADE,
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+		)
+	`
+}
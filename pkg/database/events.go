@@ -1,147 +1,237 @@
 package database
 
 import (
-	"encoding/json"
+	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 	"github.com/google/uuid"
 )
 
-// CreateMachineEvent creates a new machine event
-func (db *DB) CreateMachineEvent(event *models.MachineEvent) error {
+// RecordMachineEvent records a machine event, numbering it after the
+// machine's previous event. With a positive dedupeWindow, an event with the
+// same type and data hash as one recorded for the machine within the window
+// is not recorded, and RecordMachineEvent returns false.
+//
+// The machine's row is locked while the event is recorded, so that events
+// published at once by different processes get distinct, increasing
+// sequence numbers and only one of two identical events is recorded. Events
+// of machines that no longer exist are recorded without a sequence number.
+func (db *DB) RecordMachineEvent(event *models.MachineEvent, dedupeWindow time.Duration) (bool, error) {
 	event.ID = uuid.New().String()
 	event.CreatedAt = time.Now()
 
-	query := `
-		INSERT INTO machine_events (id, machine_id, event, data, created_at, created_by)
-		VALUES ($1, $2, $3, $4, $5, $6)
+	next := "UPDATE machines SET event_sequence = event_sequence + 1 WHERE id = $1"
+	duplicate := `SELECT COUNT(*) FROM machine_events
+		WHERE machine_id = $1 AND event = $2 AND data_hash = $3 AND created_at >= $4`
+	sequence := "SELECT event_sequence FROM machines WHERE id = $1"
+	insert := `
+		INSERT INTO machine_events (id, machine_id, event, data, created_at, created_by, impersonated_by, sequence, data_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
-
 	if db.driver == "sqlite3" {
-		query = `
-			INSERT INTO machine_events (id, machine_id, event, data, created_at, created_by)
-			VALUES (?, ?, ?, ?, ?, ?)
+		next = "UPDATE machines SET event_sequence = event_sequence + 1 WHERE id = ?"
+		duplicate = `SELECT COUNT(*) FROM machine_events
+			WHERE machine_id = ? AND event = ? AND data_hash = ? AND created_at >= ?`
+		sequence = "SELECT event_sequence FROM machines WHERE id = ?"
+		insert = `
+			INSERT INTO machine_events (id, machine_id, event, data, created_at, created_by, impersonated_by, sequence, data_hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`
 	}
 
-	_, err := db.Exec(query,
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Taking the next number first locks the machine's row until commit
+	if _, err := tx.Exec(next, event.MachineID); err != nil {
+		return false, fmt.Errorf("failed to number event: %w", err)
+	}
+
+	if dedupeWindow > 0 {
+		var count int
+		err := tx.QueryRow(duplicate, event.MachineID, event.Event, event.DataHash, event.CreatedAt.Add(-dedupeWindow)).Scan(&count)
+		if err != nil {
+			return false, fmt.Errorf("failed to check for duplicate event: %w", err)
+		}
+		if count > 0 {
+			return false, nil
+		}
+	}
+
+	err = tx.QueryRow(sequence, event.MachineID).Scan(&event.Sequence)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to number event: %w", err)
+	}
+
+	_, err = tx.Exec(insert,
 		event.ID,
 		event.MachineID,
 		event.Event,
-		event.Data,
+		jsonColumn(event.Data),
 		event.CreatedAt,
 		event.CreatedBy,
+		event.ImpersonatedBy,
+		event.Sequence,
+		event.DataHash,
 	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
 
-	return err
+// EventFilter selects machine events. Since is inclusive and Until is
+// exclusive; zero values leave the range open.
+type EventFilter struct {
+	MachineID string
+	Event     string
+	CreatedBy string
+	Since     time.Time
+	Until     time.Time
+
+	// Ascending orders oldest first; the default is newest first. Events
+	// are ordered by (created_at, id) so that pages stay stable while new
+	// events are recorded.
+	Ascending bool
+
+	// After continues from the last event of a previous page
+	After *EventCursor
+
+	// VisibleTo leaves out events of machines claimed by users other than
+	// this one
+	VisibleTo string
+
+	Limit int
+}
+
+// EventCursor identifies a position in the event ordering
+type EventCursor struct {
+	CreatedAt time.Time
+	ID        string
 }
 
 // ListMachineEvents lists events for a machine
 func (db *DB) ListMachineEvents(machineID string, limit int) ([]*models.MachineEvent, error) {
+	return db.SearchEvents(EventFilter{MachineID: machineID, Limit: limit})
+}
+
+// ListAllEvents lists all events (for audit purposes)
+func (db *DB) ListAllEvents(limit int) ([]*models.MachineEvent, error) {
+	return db.SearchEvents(EventFilter{Limit: limit})
+}
+
+// SearchEvents lists events matching filter
+func (db *DB) SearchEvents(filter EventFilter) ([]*models.MachineEvent, error) {
+	var events []*models.MachineEvent
+	err := db.StreamEvents(filter, func(event *models.MachineEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
+
+// StreamEvents calls fn for each event matching filter without loading them
+// all into memory. It stops at the first error fn returns.
+func (db *DB) StreamEvents(filter EventFilter, fn func(*models.MachineEvent) error) error {
 	query := `
-		SELECT id, machine_id, event, data, created_at, created_by
+		SELECT id, machine_id, event, data, created_at, created_by, impersonated_by, sequence
 		FROM machine_events
-		WHERE machine_id = $1
-		ORDER BY created_at DESC
-		LIMIT $2
+		WHERE 1=1
 	`
 
-	if db.driver == "sqlite3" {
-		query = `
-			SELECT id, machine_id, event, data, created_at, created_by
-			FROM machine_events
-			WHERE machine_id = ?
-			ORDER BY created_at DESC
-			LIMIT ?
-		`
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		if db.driver == "postgres" {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
 	}
 
-	rows, err := db.Query(query, machineID, limit)
-	if err != nil {
-		return nil, err
+	if filter.MachineID != "" {
+		query += " AND machine_id = " + arg(filter.MachineID)
+	}
+	if filter.Event != "" {
+		query += " AND event = " + arg(filter.Event)
+	}
+	if filter.CreatedBy != "" {
+		query += " AND created_by = " + arg(filter.CreatedBy)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND created_at >= " + arg(filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query += " AND created_at < " + arg(filter.Until)
+	}
+	if filter.VisibleTo != "" {
+		query += " AND " + visibleMachineCondition("machine_id", arg(filter.VisibleTo))
 	}
-	defer rows.Close()
-
-	var events []*models.MachineEvent
-	for rows.Next() {
-		var event models.MachineEvent
-		err := rows.Scan(
-			&event.ID,
-			&event.MachineID,
-			&event.Event,
-			&event.Data,
-			&event.CreatedAt,
-			&event.CreatedBy,
-		)
-		if err != nil {
-			return nil, err
-		}
 
-		events = append(events, &event)
+	order, cmp := "DESC", "<"
+	if filter.Ascending {
+		order, cmp = "ASC", ">"
 	}
 
-	return events, nil
-}
+	if filter.After != nil {
+		query += fmt.Sprintf(" AND (created_at %s %s OR (created_at = %s AND id %s %s))",
+			cmp, arg(filter.After.CreatedAt), arg(filter.After.CreatedAt), cmp, arg(filter.After.ID))
+	}
 
-// ListAllEvents lists all events (for audit purposes)
-func (db *DB) ListAllEvents(limit int) ([]*models.MachineEvent, error) {
-	query := `
-		SELECT id, machine_id, event, data, created_at, created_by
-		FROM machine_events
-		ORDER BY created_at DESC
-		LIMIT $1
-	`
+	query += fmt.Sprintf(" ORDER BY created_at %s, id %s", order, order)
 
-	if db.driver == "sqlite3" {
-		query = `
-			SELECT id, machine_id, event, data, created_at, created_by
-			FROM machine_events
-			ORDER BY created_at DESC
-			LIMIT ?
-		`
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
 	}
 
-	rows, err := db.Query(query, limit)
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var events []*models.MachineEvent
 	for rows.Next() {
 		var event models.MachineEvent
+		var data jsonColumn
 		err := rows.Scan(
 			&event.ID,
 			&event.MachineID,
 			&event.Event,
-			&event.Data,
+			&data,
 			&event.CreatedAt,
 			&event.CreatedBy,
+			&event.ImpersonatedBy,
+			&event.Sequence,
 		)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		event.Data = data.RawMessage()
 
-		events = append(events, &event)
+		if err := fn(&event); err != nil {
+			return err
+		}
 	}
 
-	return events, nil
+	return rows.Err()
 }
 
-// EmitMachineEvent is a helper to create an event and trigger webhooks
-func (db *DB) EmitMachineEvent(machineID, eventType string, data interface{}, createdBy *string) error {
-	dataJSON, err := json.Marshal(data)
-	if err != nil {
-		return err
+// DeleteEventsBefore removes events recorded before the given time
+func (db *DB) DeleteEventsBefore(before time.Time) (int64, error) {
+	query := "DELETE FROM machine_events WHERE created_at < ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM machine_events WHERE created_at < $1"
 	}
 
-	event := &models.MachineEvent{
-		MachineID: machineID,
-		Event:     eventType,
-		Data:      dataJSON,
-		CreatedBy: createdBy,
+	result, err := db.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old events: %w", err)
 	}
 
-	return db.CreateMachineEvent(event)
+	return result.RowsAffected()
 }
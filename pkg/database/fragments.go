@@ -0,0 +1,420 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const fragmentColumns = `
+	id, name, description, nixos_config, weight, variables,
+	created_at, updated_at, created_by
+`
+
+// joinedFragmentColumns are fragmentColumns of config_fragments joined as f
+const joinedFragmentColumns = `
+	f.id, f.name, f.description, f.nixos_config, f.weight, f.variables,
+	f.created_at, f.updated_at, f.created_by
+`
+
+// CreateFragment creates a configuration fragment
+func (db *DB) CreateFragment(fragment *models.ConfigFragment) error {
+	fragment.ID = uuid.New().String()
+	fragment.CreatedAt = time.Now()
+	fragment.UpdatedAt = fragment.CreatedAt
+
+	query := `INSERT INTO config_fragments (` + fragmentColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO config_fragments (` + fragmentColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	}
+
+	variables, err := marshalFragmentVariables(fragment.Variables)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(query,
+		fragment.ID,
+		fragment.Name,
+		fragment.Description,
+		fragment.NixOSConfig,
+		fragment.Weight,
+		variables,
+		fragment.CreatedAt,
+		fragment.UpdatedAt,
+		fragment.CreatedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create fragment: %w", err)
+	}
+	return nil
+}
+
+// GetFragment retrieves a fragment by ID. It returns nil, nil if there is
+// no such fragment.
+func (db *DB) GetFragment(id string) (*models.ConfigFragment, error) {
+	query := `SELECT` + fragmentColumns + `FROM config_fragments WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + fragmentColumns + `FROM config_fragments WHERE id = $1`
+	}
+
+	fragment, err := scanFragment(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return fragment, err
+}
+
+// GetFragmentByName retrieves a fragment by name. It returns nil, nil if
+// there is no such fragment.
+func (db *DB) GetFragmentByName(name string) (*models.ConfigFragment, error) {
+	query := `SELECT` + fragmentColumns + `FROM config_fragments WHERE name = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + fragmentColumns + `FROM config_fragments WHERE name = $1`
+	}
+
+	fragment, err := scanFragment(db.QueryRow(query, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return fragment, err
+}
+
+// ListFragments lists all fragments in assembly order
+func (db *DB) ListFragments() ([]*models.ConfigFragment, error) {
+	rows, err := db.Query(`SELECT` + fragmentColumns + `FROM config_fragments ORDER BY weight, name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list fragments: %w", err)
+	}
+	defer rows.Close()
+
+	var fragments []*models.ConfigFragment
+	for rows.Next() {
+		fragment, err := scanFragment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan fragment: %w", err)
+		}
+		fragments = append(fragments, fragment)
+	}
+
+	return fragments, rows.Err()
+}
+
+// UpdateFragment updates a fragment
+func (db *DB) UpdateFragment(fragment *models.ConfigFragment) error {
+	fragment.UpdatedAt = time.Now()
+
+	query := `UPDATE config_fragments
+		SET name = ?, description = ?, nixos_config = ?, weight = ?, variables = ?, updated_at = ?
+		WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE config_fragments
+			SET name = $1, description = $2, nixos_config = $3, weight = $4, variables = $5, updated_at = $6
+			WHERE id = $7`
+	}
+
+	variables, err := marshalFragmentVariables(fragment.Variables)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(query,
+		fragment.Name,
+		fragment.Description,
+		fragment.NixOSConfig,
+		fragment.Weight,
+		variables,
+		fragment.UpdatedAt,
+		fragment.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update fragment: %w", err)
+	}
+	return nil
+}
+
+// DeleteFragment deletes a fragment. Callers check it is unused first.
+func (db *DB) DeleteFragment(id string) error {
+	query := "DELETE FROM config_fragments WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM config_fragments WHERE id = $1"
+	}
+
+	if _, err := db.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to delete fragment: %w", err)
+	}
+	return nil
+}
+
+// FragmentUsage counts the machines and groups that list a fragment
+func (db *DB) FragmentUsage(id string) (machines, groups int, err error) {
+	machineQuery := "SELECT COUNT(*) FROM machine_fragments WHERE fragment_id = ?"
+	groupQuery := "SELECT COUNT(*) FROM group_fragments WHERE fragment_id = ?"
+	if db.driver == "postgres" {
+		machineQuery = "SELECT COUNT(*) FROM machine_fragments WHERE fragment_id = $1"
+		groupQuery = "SELECT COUNT(*) FROM group_fragments WHERE fragment_id = $1"
+	}
+
+	if err := db.QueryRow(machineQuery, id).Scan(&machines); err != nil {
+		return 0, 0, fmt.Errorf("failed to count machines using fragment: %w", err)
+	}
+	if err := db.QueryRow(groupQuery, id).Scan(&groups); err != nil {
+		return 0, 0, fmt.Errorf("failed to count groups using fragment: %w", err)
+	}
+	return machines, groups, nil
+}
+
+// SetMachineFragments replaces the fragments a machine lists, in order
+func (db *DB) SetMachineFragments(machineID string, fragmentIDs []string) error {
+	return db.setFragmentList("machine_fragments", "machine_id", machineID, fragmentIDs)
+}
+
+// SetGroupFragments replaces the fragments a group gives its members by
+// default, in order
+func (db *DB) SetGroupFragments(groupID string, fragmentIDs []string) error {
+	return db.setFragmentList("group_fragments", "group_id", groupID, fragmentIDs)
+}
+
+// setFragmentList replaces the ordered fragment list of the owner with ID
+// ownerID in table
+func (db *DB) setFragmentList(table, ownerColumn, ownerID string, fragmentIDs []string) error {
+	deleteList := fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, ownerColumn)
+	insert := fmt.Sprintf("INSERT INTO %s (%s, fragment_id, position) VALUES (?, ?, ?)", table, ownerColumn)
+	if db.driver == "postgres" {
+		deleteList = fmt.Sprintf("DELETE FROM %s WHERE %s = $1", table, ownerColumn)
+		insert = fmt.Sprintf("INSERT INTO %s (%s, fragment_id, position) VALUES ($1, $2, $3)", table, ownerColumn)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(deleteList, ownerID); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", table, err)
+	}
+	for i, id := range fragmentIDs {
+		if _, err := tx.Exec(insert, ownerID, id, i); err != nil {
+			return fmt.Errorf("failed to add to %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetMachineFragments lists the fragments a machine lists itself, in
+// order, leaving out its groups' defaults
+func (db *DB) GetMachineFragments(machineID string) ([]*models.ConfigFragment, error) {
+	query := `SELECT` + joinedFragmentColumns + `FROM machine_fragments mf
+		INNER JOIN config_fragments f ON f.id = mf.fragment_id
+		WHERE mf.machine_id = ? ORDER BY mf.position`
+	if db.driver == "postgres" {
+		query = `SELECT` + joinedFragmentColumns + `FROM machine_fragments mf
+			INNER JOIN config_fragments f ON f.id = mf.fragment_id
+			WHERE mf.machine_id = $1 ORDER BY mf.position`
+	}
+
+	rows, err := db.Query(query, machineID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get machine fragments: %w", err)
+	}
+	defer rows.Close()
+
+	var fragments []*models.ConfigFragment
+	for rows.Next() {
+		fragment, err := scanFragment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan fragment: %w", err)
+		}
+		fragments = append(fragments, fragment)
+	}
+
+	return fragments, rows.Err()
+}
+
+// GetGroupFragments lists the fragments a group gives its members, in order
+func (db *DB) GetGroupFragments(groupID string) ([]*models.ConfigFragment, error) {
+	query := `SELECT` + joinedFragmentColumns + `FROM group_fragments gf
+		INNER JOIN config_fragments f ON f.id = gf.fragment_id
+		WHERE gf.group_id = ? ORDER BY gf.position`
+	if db.driver == "postgres" {
+		query = `SELECT` + joinedFragmentColumns + `FROM group_fragments gf
+			INNER JOIN config_fragments f ON f.id = gf.fragment_id
+			WHERE gf.group_id = $1 ORDER BY gf.position`
+	}
+
+	rows, err := db.Query(query, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group fragments: %w", err)
+	}
+	defer rows.Close()
+
+	var fragments []*models.ConfigFragment
+	for rows.Next() {
+		fragment, err := scanFragment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan fragment: %w", err)
+		}
+		fragments = append(fragments, fragment)
+	}
+
+	return fragments, rows.Err()
+}
+
+// MachineConfigFragments lists the fragments a machine's configuration is
+// assembled from: the defaults of its groups, by group name, then its own,
+// each in the order listed and each fragment once. refs[i] says where
+// fragments[i] came from. Assembly orders them by weight.
+func (db *DB) MachineConfigFragments(machineID string) (fragments []*models.ConfigFragment, refs []models.FragmentRef, err error) {
+	query := `
+		SELECT` + joinedFragmentColumns + `, l.group_id, l.group_name
+		FROM (
+			SELECT gf.fragment_id, 0 AS source, g.id AS group_id, g.name AS group_name, gf.position
+			FROM group_fragments gf
+			INNER JOIN group_memberships gm ON gm.group_id = gf.group_id
+			INNER JOIN groups g ON g.id = gf.group_id
+			WHERE gm.machine_id = ?
+			UNION ALL
+			SELECT fragment_id, 1, '', '', position FROM machine_fragments WHERE machine_id = ?
+		) l
+		INNER JOIN config_fragments f ON f.id = l.fragment_id
+		ORDER BY l.source, l.group_name, l.position
+	`
+	if db.driver == "postgres" {
+		query = `
+			SELECT` + joinedFragmentColumns + `, l.group_id, l.group_name
+			FROM (
+				SELECT gf.fragment_id, 0 AS source, g.id AS group_id, g.name AS group_name, gf.position
+				FROM group_fragments gf
+				INNER JOIN group_memberships gm ON gm.group_id = gf.group_id
+				INNER JOIN groups g ON g.id = gf.group_id
+				WHERE gm.machine_id = $1
+				UNION ALL
+				SELECT fragment_id, 1, '', '', position FROM machine_fragments WHERE machine_id = $2
+			) l
+			INNER JOIN config_fragments f ON f.id = l.fragment_id
+			ORDER BY l.source, l.group_name, l.position
+		`
+	}
+
+	rows, err := db.Query(query, machineID, machineID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get machine fragments: %w", err)
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var groupID, groupName string
+		fragment, err := scanFragment(rows, &groupID, &groupName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan fragment: %w", err)
+		}
+		if seen[fragment.ID] {
+			continue
+		}
+		seen[fragment.ID] = true
+
+		fragments = append(fragments, fragment)
+		refs = append(refs, models.FragmentRef{
+			ID:        fragment.ID,
+			Name:      fragment.Name,
+			Weight:    fragment.Weight,
+			GroupID:   groupID,
+			GroupName: groupName,
+		})
+	}
+
+	return fragments, refs, rows.Err()
+}
+
+// scanFragment reads a row of fragmentColumns, followed by extra columns
+func scanFragment(row rowScanner, extra ...interface{}) (*models.ConfigFragment, error) {
+	var fragment models.ConfigFragment
+	var description, createdBy sql.NullString
+	var variables jsonColumn
+
+	dest := append([]interface{}{
+		&fragment.ID,
+		&fragment.Name,
+		&description,
+		&fragment.NixOSConfig,
+		&fragment.Weight,
+		&variables,
+		&fragment.CreatedAt,
+		&fragment.UpdatedAt,
+		&createdBy,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	fragment.Description = description.String
+	fragment.CreatedBy = createdBy.String
+	if err := variables.Unmarshal(&fragment.Variables); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fragment variables: %w", err)
+	}
+
+	return &fragment, nil
+}
+
+// marshalFragmentVariables encodes a fragment's variables, storing NULL
+// when it has none
+func marshalFragmentVariables(variables map[string]string) (jsonColumn, error) {
+	if len(variables) == 0 {
+		return nil, nil
+	}
+	return marshalJSONColumn(variables)
+}
+
+func (db *DB) createConfigFragmentsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS config_fragments (
+			id TEXT PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT,
+			nixos_config TEXT NOT NULL,
+			weight INTEGER NOT NULL DEFAULT 0,
+			variables %s,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			created_by TEXT
+		)
+	`, jsonType)
+}
+
+func (db *DB) createMachineFragmentsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS machine_fragments (
+			machine_id TEXT NOT NULL,
+			fragment_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (machine_id, fragment_id),
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE,
+			FOREIGN KEY (fragment_id) REFERENCES config_fragments(id)
+		)
+	`
+}
+
+func (db *DB) createGroupFragmentsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS group_fragments (
+			group_id TEXT NOT NULL,
+			fragment_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (group_id, fragment_id),
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE,
+			FOREIGN KEY (fragment_id) REFERENCES config_fragments(id)
+		)
+	`
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// GetGroupMetrics returns every group's members, their count by status, and
+// their builds that finished since buildsSince, by group name. Groups
+// without members are included; deleted machines aren't, nor are virtual
+// machines unless includeVirtual is set.
+func (db *DB) GetGroupMetrics(buildsSince time.Time, includeVirtual bool) (map[string]*models.GroupMetrics, error) {
+	virtualMembers, virtualBuilds := " AND NOT m.is_virtual", " AND b.machine_id NOT IN (SELECT id FROM machines WHERE is_virtual)"
+	if includeVirtual {
+		virtualMembers, virtualBuilds = "", ""
+	}
+
+	rows, err := db.Query("SELECT name FROM groups")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := make(map[string]*models.GroupMetrics)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan group: %w", err)
+		}
+		groups[name] = &models.GroupMetrics{Name: name, MachinesByStatus: make(map[string]int)}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := db.Query(`
+		SELECT g.name, m.id, m.status
+		FROM group_memberships gm
+		JOIN groups g ON g.id = gm.group_id
+		JOIN machines m ON m.id = gm.machine_id
+		WHERE m.deleted_at IS NULL` + virtualMembers + `
+		ORDER BY g.name, m.id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list group members: %w", err)
+	}
+	defer members.Close()
+
+	for members.Next() {
+		var name, machineID, status string
+		if err := members.Scan(&name, &machineID, &status); err != nil {
+			return nil, fmt.Errorf("failed to scan group member: %w", err)
+		}
+		if group := groups[name]; group != nil {
+			group.MachineIDs = append(group.MachineIDs, machineID)
+			group.MachinesByStatus[status]++
+		}
+	}
+	if err := members.Err(); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT g.name, b.status, COUNT(*)
+		FROM builds b
+		JOIN group_memberships gm ON gm.machine_id = b.machine_id
+		JOIN groups g ON g.id = gm.group_id
+		WHERE b.completed_at >= ? AND b.status IN ('success', 'failed')` + virtualBuilds + `
+		GROUP BY g.name, b.status
+	`
+	if db.driver == "postgres" {
+		query = `
+			SELECT g.name, b.status, COUNT(*)
+			FROM builds b
+			JOIN group_memberships gm ON gm.machine_id = b.machine_id
+			JOIN groups g ON g.id = gm.group_id
+			WHERE b.completed_at >= $1 AND b.status IN ('success', 'failed')` + virtualBuilds + `
+			GROUP BY g.name, b.status
+		`
+	}
+	builds, err := db.Query(query, buildsSince)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count group builds: %w", err)
+	}
+	defer builds.Close()
+
+	for builds.Next() {
+		var name, status string
+		var count int
+		if err := builds.Scan(&name, &status, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan group build count: %w", err)
+		}
+		if group := groups[name]; group != nil {
+			group.BuildsFinished += count
+			if status == "success" {
+				group.BuildsSucceeded += count
+			}
+		}
+	}
+
+	return groups, builds.Err()
+}
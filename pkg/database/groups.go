@@ -2,7 +2,7 @@ package database
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,31 +10,58 @@ import (
 	"github.com/google/uuid"
 )
 
+const groupColumns = `
+	id, name, description, tags, build_limits, builder_labels, require_build_approval,
+	hostname_pattern, owner_team, owner_email, owner_slack_channel, environment,
+	created_at, updated_at
+`
+
 // CreateGroup creates a new machine group
-func (db *DB) CreateGroup(name, description string, tags []string) (*models.MachineGroup, error) {
+func (db *DB) CreateGroup(name, description string, tags []string, limits *models.BuildLimits, builderLabels []string, requireBuildApproval bool, hostnamePattern string, ownership *models.Ownership) (*models.MachineGroup, error) {
 	group := &models.MachineGroup{
-		ID:          uuid.New().String(),
-		Name:        name,
-		Description: description,
-		Tags:        tags,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		ID:                   uuid.New().String(),
+		Name:                 name,
+		Description:          description,
+		Tags:                 tags,
+		BuildLimits:          limits,
+		BuilderLabels:        builderLabels,
+		RequireBuildApproval: requireBuildApproval,
+		HostnamePattern:      hostnamePattern,
+		Ownership:            ownershipOrNil(derefOwnership(ownership)),
+		CreatedAt:            time.Now(),
+		UpdatedAt:            time.Now(),
 	}
 
-	tagsJSON, err := json.Marshal(group.Tags)
+	tagsJSON, err := marshalJSONColumn(group.Tags)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal tags: %w", err)
 	}
 
+	limitsJSON, err := marshalBuildLimits(group.BuildLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	labelsJSON, err := marshalBuilderLabels(group.BuilderLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := derefOwnership(group.Ownership)
+
 	query := `
-		INSERT INTO groups (id, name, description, tags, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO groups (id, name, description, tags, build_limits, builder_labels,
+			require_build_approval, hostname_pattern, owner_team, owner_email,
+			owner_slack_channel, environment, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	if db.driver == "postgres" {
 		query = `
-			INSERT INTO groups (id, name, description, tags, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6)
+			INSERT INTO groups (id, name, description, tags, build_limits, builder_labels,
+				require_build_approval, hostname_pattern, owner_team, owner_email,
+				owner_slack_channel, environment, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 		`
 	}
 
@@ -43,6 +70,14 @@ func (db *DB) CreateGroup(name, description string, tags []string) (*models.Mach
 		group.Name,
 		group.Description,
 		tagsJSON,
+		limitsJSON,
+		labelsJSON,
+		group.RequireBuildApproval,
+		group.HostnamePattern,
+		owner.Team,
+		owner.ContactEmail,
+		owner.SlackChannel,
+		owner.Environment,
 		group.CreatedAt,
 		group.UpdatedAt,
 	)
@@ -54,168 +89,91 @@ func (db *DB) CreateGroup(name, description string, tags []string) (*models.Mach
 	return group, nil
 }
 
-// GetGroup retrieves a group by ID
+// GetGroup retrieves a group by ID. It returns nil, nil if there is no such
+// group.
 func (db *DB) GetGroup(id string) (*models.MachineGroup, error) {
-	group := &models.MachineGroup{}
-	var tagsJSON []byte
-	var description sql.NullString
-
-	query := `
-		SELECT id, name, description, tags, created_at, updated_at
-		FROM groups WHERE id = ?
-	`
-
+	query := `SELECT` + groupColumns + `FROM groups WHERE id = ?`
 	if db.driver == "postgres" {
-		query = `
-			SELECT id, name, description, tags, created_at, updated_at
-			FROM groups WHERE id = $1
-		`
+		query = `SELECT` + groupColumns + `FROM groups WHERE id = $1`
 	}
 
-	err := db.QueryRow(query, id).Scan(
-		&group.ID,
-		&group.Name,
-		&description,
-		&tagsJSON,
-		&group.CreatedAt,
-		&group.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	group, err := scanGroup(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get group: %w", err)
 	}
 
-	if description.Valid {
-		group.Description = description.String
-	}
-
-	if tagsJSON != nil {
-		if err := json.Unmarshal(tagsJSON, &group.Tags); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
-		}
-	}
-
 	return group, nil
 }
 
-// GetGroupByName retrieves a group by name
+// GetGroupByName retrieves a group by name. It returns nil, nil if there is
+// no such group.
 func (db *DB) GetGroupByName(name string) (*models.MachineGroup, error) {
-	group := &models.MachineGroup{}
-	var tagsJSON []byte
-	var description sql.NullString
-
-	query := `
-		SELECT id, name, description, tags, created_at, updated_at
-		FROM groups WHERE name = ?
-	`
-
+	query := `SELECT` + groupColumns + `FROM groups WHERE name = ?`
 	if db.driver == "postgres" {
-		query = `
-			SELECT id, name, description, tags, created_at, updated_at
-			FROM groups WHERE name = $1
-		`
+		query = `SELECT` + groupColumns + `FROM groups WHERE name = $1`
 	}
 
-	err := db.QueryRow(query, name).Scan(
-		&group.ID,
-		&group.Name,
-		&description,
-		&tagsJSON,
-		&group.CreatedAt,
-		&group.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	group, err := scanGroup(db.QueryRow(query, name))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get group: %w", err)
 	}
 
-	if description.Valid {
-		group.Description = description.String
-	}
-
-	if tagsJSON != nil {
-		if err := json.Unmarshal(tagsJSON, &group.Tags); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
-		}
-	}
-
 	return group, nil
 }
 
 // ListGroups retrieves all groups
 func (db *DB) ListGroups() ([]*models.MachineGroup, error) {
-	query := `
-		SELECT id, name, description, tags, created_at, updated_at
-		FROM groups
-		ORDER BY name ASC
-	`
-
-	rows, err := db.Query(query)
+	rows, err := db.Query(`SELECT` + groupColumns + `FROM groups ORDER BY name ASC`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list groups: %w", err)
 	}
 	defer rows.Close()
 
-	var groups []*models.MachineGroup
-	for rows.Next() {
-		group := &models.MachineGroup{}
-		var tagsJSON []byte
-		var description sql.NullString
-
-		err := rows.Scan(
-			&group.ID,
-			&group.Name,
-			&description,
-			&tagsJSON,
-			&group.CreatedAt,
-			&group.UpdatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan group: %w", err)
-		}
-
-		if description.Valid {
-			group.Description = description.String
-		}
-
-		if tagsJSON != nil {
-			if err := json.Unmarshal(tagsJSON, &group.Tags); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
-			}
-		}
-
-		groups = append(groups, group)
-	}
-
-	return groups, nil
+	return scanGroups(rows)
 }
 
 // UpdateGroup updates a group record
 func (db *DB) UpdateGroup(group *models.MachineGroup) error {
 	group.UpdatedAt = time.Now()
 
-	tagsJSON, err := json.Marshal(group.Tags)
+	tagsJSON, err := marshalJSONColumn(group.Tags)
 	if err != nil {
 		return fmt.Errorf("failed to marshal tags: %w", err)
 	}
 
+	limitsJSON, err := marshalBuildLimits(group.BuildLimits)
+	if err != nil {
+		return err
+	}
+
+	labelsJSON, err := marshalBuilderLabels(group.BuilderLabels)
+	if err != nil {
+		return err
+	}
+
+	owner := derefOwnership(group.Ownership)
+
 	query := `
 		UPDATE groups SET
-			name = ?, description = ?, tags = ?, updated_at = ?
+			name = ?, description = ?, tags = ?, build_limits = ?, builder_labels = ?,
+			require_build_approval = ?, hostname_pattern = ?, owner_team = ?, owner_email = ?,
+			owner_slack_channel = ?, environment = ?, updated_at = ?
 		WHERE id = ?
 	`
 
 	if db.driver == "postgres" {
 		query = `
 			UPDATE groups SET
-				name = $1, description = $2, tags = $3, updated_at = $4
-			WHERE id = $5
+				name = $1, description = $2, tags = $3, build_limits = $4, builder_labels = $5,
+				require_build_approval = $6, hostname_pattern = $7, owner_team = $8, owner_email = $9,
+				owner_slack_channel = $10, environment = $11, updated_at = $12
+			WHERE id = $13
 		`
 	}
 
@@ -223,6 +181,14 @@ func (db *DB) UpdateGroup(group *models.MachineGroup) error {
 		group.Name,
 		group.Description,
 		tagsJSON,
+		limitsJSON,
+		labelsJSON,
+		group.RequireBuildApproval,
+		group.HostnamePattern,
+		owner.Team,
+		owner.ContactEmail,
+		owner.SlackChannel,
+		owner.Environment,
 		group.UpdatedAt,
 		group.ID,
 	)
@@ -237,8 +203,40 @@ func (db *DB) UpdateGroup(group *models.MachineGroup) error {
 // DeleteGroup deletes a group and its memberships
 func (db *DB) DeleteGroup(id string) error {
 	query := "DELETE FROM groups WHERE id = ?"
+	fragments := "DELETE FROM group_fragments WHERE group_id = ?"
+	bootProfiles := "DELETE FROM boot_profile_groups WHERE group_id = ?"
+	enrollmentRules := "DELETE FROM enrollment_rule_groups WHERE group_id = ?"
+	hardwareProfiles := "DELETE FROM hardware_profile_groups WHERE group_id = ?"
 	if db.driver == "postgres" {
 		query = "DELETE FROM groups WHERE id = $1"
+		fragments = "DELETE FROM group_fragments WHERE group_id = $1"
+		bootProfiles = "DELETE FROM boot_profile_groups WHERE group_id = $1"
+		enrollmentRules = "DELETE FROM enrollment_rule_groups WHERE group_id = $1"
+		hardwareProfiles = "DELETE FROM hardware_profile_groups WHERE group_id = $1"
+	}
+
+	// Fragments can't be deleted while a group lists them, so the list
+	// goes with the group
+	if _, err := db.Exec(fragments, id); err != nil {
+		return fmt.Errorf("failed to delete group fragments: %w", err)
+	}
+	if _, err := db.Exec(bootProfiles, id); err != nil {
+		return fmt.Errorf("failed to delete group boot profile: %w", err)
+	}
+	if _, err := db.Exec(enrollmentRules, id); err != nil {
+		return fmt.Errorf("failed to remove group from enrollment rules: %w", err)
+	}
+	if _, err := db.Exec(hardwareProfiles, id); err != nil {
+		return fmt.Errorf("failed to remove group from hardware profiles: %w", err)
+	}
+	if err := db.deleteScopeProvisioningHooks(db, models.HookScopeGroup, id); err != nil {
+		return err
+	}
+	if err := db.deleteScopeBuildSchedule(db, models.BuildScheduleScopeGroup, id); err != nil {
+		return err
+	}
+	if _, err := db.deleteSubscriptions(db, "group_id", id); err != nil {
+		return err
 	}
 
 	_, err := db.Exec(query, id)
@@ -288,28 +286,33 @@ func (db *DB) RemoveMachineFromGroup(groupID, machineID string) error {
 	return nil
 }
 
+// RemoveMachineFromAllGroups removes a machine from every group it belongs to
+func (db *DB) RemoveMachineFromAllGroups(machineID string) error {
+	query := "DELETE FROM group_memberships WHERE machine_id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM group_memberships WHERE machine_id = $1"
+	}
+
+	_, err := db.Exec(query, machineID)
+	if err != nil {
+		return fmt.Errorf("failed to remove machine from groups: %w", err)
+	}
+
+	return nil
+}
+
 // GetGroupMachines retrieves all machines in a group
 func (db *DB) GetGroupMachines(groupID string) ([]*models.Machine, error) {
-	query := `
-		SELECT m.id, m.service_tag, m.mac_address, m.status, m.hostname, m.description,
-		       m.hardware, m.nixos_config, m.last_build_id, m.last_build_time,
-		       m.enrolled_at, m.updated_at, m.last_seen_at
-		FROM machines m
-		INNER JOIN group_memberships gm ON m.id = gm.machine_id
-		WHERE gm.group_id = ?
-		ORDER BY m.hostname ASC
-	`
+	query := `SELECT` + machineColumns + `FROM machines
+		WHERE id IN (SELECT machine_id FROM group_memberships WHERE group_id = ?)
+		  AND deleted_at IS NULL
+		ORDER BY hostname ASC`
 
 	if db.driver == "postgres" {
-		query = `
-			SELECT m.id, m.service_tag, m.mac_address, m.status, m.hostname, m.description,
-			       m.hardware, m.nixos_config, m.last_build_id, m.last_build_time,
-			       m.enrolled_at, m.updated_at, m.last_seen_at
-			FROM machines m
-			INNER JOIN group_memberships gm ON m.id = gm.machine_id
-			WHERE gm.group_id = $1
-			ORDER BY m.hostname ASC
-		`
+		query = `SELECT` + machineColumns + `FROM machines
+			WHERE id IN (SELECT machine_id FROM group_memberships WHERE group_id = $1)
+			  AND deleted_at IS NULL
+			ORDER BY hostname ASC`
 	}
 
 	rows, err := db.Query(query, groupID)
@@ -318,68 +321,15 @@ func (db *DB) GetGroupMachines(groupID string) ([]*models.Machine, error) {
 	}
 	defer rows.Close()
 
-	var machines []*models.Machine
-	for rows.Next() {
-		machine := &models.Machine{}
-		var hardwareJSON []byte
-		var hostname, description, nixosConfig sql.NullString
-		var lastBuildID sql.NullString
-		var lastBuildTime, lastSeenAt sql.NullTime
-
-		err := rows.Scan(
-			&machine.ID,
-			&machine.ServiceTag,
-			&machine.MACAddress,
-			&machine.Status,
-			&hostname,
-			&description,
-			&hardwareJSON,
-			&nixosConfig,
-			&lastBuildID,
-			&lastBuildTime,
-			&machine.EnrolledAt,
-			&machine.UpdatedAt,
-			&lastSeenAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan machine: %w", err)
-		}
-
-		// Convert nullable fields
-		if hostname.Valid {
-			machine.Hostname = hostname.String
-		}
-		if description.Valid {
-			machine.Description = description.String
-		}
-		if nixosConfig.Valid {
-			machine.NixOSConfig = nixosConfig.String
-		}
-		if lastBuildID.Valid {
-			id := lastBuildID.String
-			machine.LastBuildID = &id
-		}
-		if lastBuildTime.Valid {
-			machine.LastBuildTime = &lastBuildTime.Time
-		}
-		if lastSeenAt.Valid {
-			machine.LastSeenAt = &lastSeenAt.Time
-		}
-
-		if err := json.Unmarshal(hardwareJSON, &machine.Hardware); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal hardware: %w", err)
-		}
-
-		machines = append(machines, machine)
-	}
-
-	return machines, nil
+	return db.scanMachines(rows)
 }
 
 // GetMachineGroups retrieves all groups a machine belongs to
 func (db *DB) GetMachineGroups(machineID string) ([]*models.MachineGroup, error) {
 	query := `
-		SELECT g.id, g.name, g.description, g.tags, g.created_at, g.updated_at
+		SELECT g.id, g.name, g.description, g.tags, g.build_limits, g.builder_labels,
+		       g.require_build_approval, g.hostname_pattern, g.owner_team, g.owner_email,
+		       g.owner_slack_channel, g.environment, g.created_at, g.updated_at
 		FROM groups g
 		INNER JOIN group_memberships gm ON g.id = gm.group_id
 		WHERE gm.machine_id = ?
@@ -388,7 +338,9 @@ func (db *DB) GetMachineGroups(machineID string) ([]*models.MachineGroup, error)
 
 	if db.driver == "postgres" {
 		query = `
-			SELECT g.id, g.name, g.description, g.tags, g.created_at, g.updated_at
+			SELECT g.id, g.name, g.description, g.tags, g.build_limits, g.builder_labels,
+			       g.require_build_approval, g.hostname_pattern, g.owner_team, g.owner_email,
+			       g.owner_slack_channel, g.environment, g.created_at, g.updated_at
 			FROM groups g
 			INNER JOIN group_memberships gm ON g.id = gm.group_id
 			WHERE gm.machine_id = $1
@@ -402,36 +354,103 @@ func (db *DB) GetMachineGroups(machineID string) ([]*models.MachineGroup, error)
 	}
 	defer rows.Close()
 
+	return scanGroups(rows)
+}
+
+// marshalBuildLimits encodes a group's build limits for storage; no limits
+// are stored as NULL
+func marshalBuildLimits(limits *models.BuildLimits) (jsonColumn, error) {
+	if limits == nil || *limits == (models.BuildLimits{}) {
+		return nil, nil
+	}
+
+	data, err := marshalJSONColumn(limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal build limits: %w", err)
+	}
+	return data, nil
+}
+
+// marshalBuilderLabels encodes a group's builder labels for storage; no
+// labels are stored as NULL
+func marshalBuilderLabels(labels []string) (jsonColumn, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	data, err := marshalJSONColumn(labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal builder labels: %w", err)
+	}
+	return data, nil
+}
+
+func unmarshalBuildLimits(data jsonColumn) (*models.BuildLimits, error) {
+	if data.RawMessage() == nil {
+		return nil, nil
+	}
+
+	var limits models.BuildLimits
+	if err := data.Unmarshal(&limits); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal build limits: %w", err)
+	}
+	return &limits, nil
+}
+
+// scanGroup reads a row of groupColumns. The description and the JSON
+// columns are optional and may be NULL.
+func scanGroup(row rowScanner) (*models.MachineGroup, error) {
+	group := &models.MachineGroup{}
+	var tagsJSON, limitsJSON, labelsJSON jsonColumn
+	var description, hostnamePattern sql.NullString
+	var ownership models.Ownership
+
+	err := row.Scan(
+		&group.ID,
+		&group.Name,
+		&description,
+		&tagsJSON,
+		&limitsJSON,
+		&labelsJSON,
+		&group.RequireBuildApproval,
+		&hostnamePattern,
+		&ownership.Team,
+		&ownership.ContactEmail,
+		&ownership.SlackChannel,
+		&ownership.Environment,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	group.Description = description.String
+	group.HostnamePattern = hostnamePattern.String
+	group.Ownership = ownershipOrNil(ownership)
+	if err := tagsJSON.Unmarshal(&group.Tags); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+	}
+	if group.BuildLimits, err = unmarshalBuildLimits(limitsJSON); err != nil {
+		return nil, err
+	}
+	if err := labelsJSON.Unmarshal(&group.BuilderLabels); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal builder labels: %w", err)
+	}
+
+	return group, nil
+}
+
+// scanGroups reads every row of groupColumns
+func scanGroups(rows *sql.Rows) ([]*models.MachineGroup, error) {
 	var groups []*models.MachineGroup
 	for rows.Next() {
-		group := &models.MachineGroup{}
-		var tagsJSON []byte
-		var description sql.NullString
-
-		err := rows.Scan(
-			&group.ID,
-			&group.Name,
-			&description,
-			&tagsJSON,
-			&group.CreatedAt,
-			&group.UpdatedAt,
-		)
+		group, err := scanGroup(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan group: %w", err)
 		}
-
-		if description.Valid {
-			group.Description = description.String
-		}
-
-		if tagsJSON != nil {
-			if err := json.Unmarshal(tagsJSON, &group.Tags); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
-			}
-		}
-
 		groups = append(groups, group)
 	}
 
-	return groups, nil
+	return groups, rows.Err()
 }
@@ -0,0 +1,322 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const hardwareProfileColumns = `
+	id, name, description, manufacturer, model, expected, created_at, updated_at
+`
+
+// CreateHardwareProfile creates a hardware profile and its groups
+func (db *DB) CreateHardwareProfile(profile *models.HardwareProfile) error {
+	profile.ID = uuid.New().String()
+	profile.CreatedAt = time.Now()
+	profile.UpdatedAt = profile.CreatedAt
+
+	query := `INSERT INTO hardware_profiles (` + hardwareProfileColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO hardware_profiles (` + hardwareProfileColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	}
+
+	expected, err := marshalJSONColumn(profile.Expected)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query,
+		profile.ID,
+		profile.Name,
+		profile.Description,
+		profile.Manufacturer,
+		profile.Model,
+		expected,
+		profile.CreatedAt,
+		profile.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create hardware profile: %w", err)
+	}
+
+	if err := db.setHardwareProfileGroups(tx, profile.ID, profile.GroupIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetHardwareProfile retrieves a hardware profile by ID. It returns nil, nil
+// if there is no such profile.
+func (db *DB) GetHardwareProfile(id string) (*models.HardwareProfile, error) {
+	query := `SELECT` + hardwareProfileColumns + `FROM hardware_profiles WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + hardwareProfileColumns + `FROM hardware_profiles WHERE id = $1`
+	}
+	return db.getHardwareProfile(query, id)
+}
+
+// GetHardwareProfileByName retrieves a hardware profile by name. It returns
+// nil, nil if there is no such profile.
+func (db *DB) GetHardwareProfileByName(name string) (*models.HardwareProfile, error) {
+	query := `SELECT` + hardwareProfileColumns + `FROM hardware_profiles WHERE name = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + hardwareProfileColumns + `FROM hardware_profiles WHERE name = $1`
+	}
+	return db.getHardwareProfile(query, name)
+}
+
+func (db *DB) getHardwareProfile(query string, arg string) (*models.HardwareProfile, error) {
+	profile, err := scanHardwareProfile(db.QueryRow(query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hardware profile: %w", err)
+	}
+
+	groups, err := db.hardwareProfileGroups()
+	if err != nil {
+		return nil, err
+	}
+	profile.GroupIDs = append(profile.GroupIDs, groups[profile.ID]...)
+
+	return profile, nil
+}
+
+// ListHardwareProfiles lists all hardware profiles by name, with their
+// groups
+func (db *DB) ListHardwareProfiles() ([]*models.HardwareProfile, error) {
+	rows, err := db.Query(`SELECT` + hardwareProfileColumns + `FROM hardware_profiles ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hardware profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []*models.HardwareProfile
+	for rows.Next() {
+		profile, err := scanHardwareProfile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan hardware profile: %w", err)
+		}
+		profiles = append(profiles, profile)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups, err := db.hardwareProfileGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		profile.GroupIDs = append(profile.GroupIDs, groups[profile.ID]...)
+	}
+
+	return profiles, nil
+}
+
+// UpdateHardwareProfile updates a hardware profile and replaces its groups
+func (db *DB) UpdateHardwareProfile(profile *models.HardwareProfile) error {
+	profile.UpdatedAt = time.Now()
+
+	query := `UPDATE hardware_profiles
+		SET name = ?, description = ?, manufacturer = ?, model = ?, expected = ?, updated_at = ?
+		WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE hardware_profiles
+			SET name = $1, description = $2, manufacturer = $3, model = $4, expected = $5, updated_at = $6
+			WHERE id = $7`
+	}
+
+	expected, err := marshalJSONColumn(profile.Expected)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query,
+		profile.Name,
+		profile.Description,
+		profile.Manufacturer,
+		profile.Model,
+		expected,
+		profile.UpdatedAt,
+		profile.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update hardware profile: %w", err)
+	}
+
+	if err := db.setHardwareProfileGroups(tx, profile.ID, profile.GroupIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteHardwareProfile deletes a hardware profile
+func (db *DB) DeleteHardwareProfile(id string) error {
+	groups := "DELETE FROM hardware_profile_groups WHERE profile_id = ?"
+	query := "DELETE FROM hardware_profiles WHERE id = ?"
+	if db.driver == "postgres" {
+		groups = "DELETE FROM hardware_profile_groups WHERE profile_id = $1"
+		query = "DELETE FROM hardware_profiles WHERE id = $1"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(groups, id); err != nil {
+		return fmt.Errorf("failed to delete hardware profile groups: %w", err)
+	}
+	if _, err := tx.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to delete hardware profile: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// SetMachineHardwareCompliance records the result of checking a machine
+// against its hardware profile, or clears it if compliance is nil
+func (db *DB) SetMachineHardwareCompliance(id string, compliance *models.HardwareCompliance) error {
+	query := `UPDATE machines SET hardware_compliance = ?, compliance_status = ? WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE machines SET hardware_compliance = $1, compliance_status = $2 WHERE id = $3`
+	}
+
+	value, err := marshalJSONColumn(compliance)
+	if err != nil {
+		return err
+	}
+	status := ""
+	if compliance != nil {
+		status = compliance.Status
+	}
+
+	if _, err := db.Exec(query, value, status, id); err != nil {
+		return fmt.Errorf("failed to update hardware compliance: %w", err)
+	}
+	return nil
+}
+
+// hardwareProfileGroups returns the groups of each profile, by profile ID
+func (db *DB) hardwareProfileGroups() (map[string][]string, error) {
+	rows, err := db.Query("SELECT profile_id, group_id FROM hardware_profile_groups ORDER BY group_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hardware profile groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups := make(map[string][]string)
+	for rows.Next() {
+		var profileID, groupID string
+		if err := rows.Scan(&profileID, &groupID); err != nil {
+			return nil, err
+		}
+		groups[profileID] = append(groups[profileID], groupID)
+	}
+
+	return groups, rows.Err()
+}
+
+// setHardwareProfileGroups replaces the groups of a profile
+func (db *DB) setHardwareProfileGroups(tx *sql.Tx, profileID string, groupIDs []string) error {
+	deleteGroups := "DELETE FROM hardware_profile_groups WHERE profile_id = ?"
+	insert := "INSERT INTO hardware_profile_groups (profile_id, group_id) VALUES (?, ?) ON CONFLICT DO NOTHING"
+	if db.driver == "postgres" {
+		deleteGroups = "DELETE FROM hardware_profile_groups WHERE profile_id = $1"
+		insert = "INSERT INTO hardware_profile_groups (profile_id, group_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	}
+
+	if _, err := tx.Exec(deleteGroups, profileID); err != nil {
+		return fmt.Errorf("failed to clear hardware profile groups: %w", err)
+	}
+	for _, groupID := range groupIDs {
+		if _, err := tx.Exec(insert, profileID, groupID); err != nil {
+			return fmt.Errorf("failed to add group %s to hardware profile: %w", groupID, err)
+		}
+	}
+	return nil
+}
+
+func scanHardwareProfile(row rowScanner) (*models.HardwareProfile, error) {
+	var profile models.HardwareProfile
+	var description, manufacturer, model sql.NullString
+	var expected jsonColumn
+
+	err := row.Scan(
+		&profile.ID,
+		&profile.Name,
+		&description,
+		&manufacturer,
+		&model,
+		&expected,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	profile.Description = description.String
+	profile.Manufacturer = manufacturer.String
+	profile.Model = model.String
+	if err := expected.Unmarshal(&profile.Expected); err != nil {
+		return nil, fmt.Errorf("failed to decode expected hardware: %w", err)
+	}
+	profile.GroupIDs = []string{}
+
+	return &profile, nil
+}
+
+func (db *DB) createHardwareProfilesTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS hardware_profiles (
+			id TEXT PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT,
+			manufacturer TEXT,
+			model TEXT,
+			expected %s NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)
+	`, jsonType)
+}
+
+func (db *DB) createHardwareProfileGroupsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS hardware_profile_groups (
+			profile_id TEXT NOT NULL,
+			group_id TEXT NOT NULL,
+			PRIMARY KEY (profile_id, group_id),
+			FOREIGN KEY (profile_id) REFERENCES hardware_profiles(id) ON DELETE CASCADE,
+			FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+		)
+	`
+}
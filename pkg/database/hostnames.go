@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// hostnameIndex keeps hostnames unique, ignoring case. Machines without a
+// hostname don't take part. Once machines belong to projects, hostnames
+// need only be unique within one.
+const hostnameIndex = "idx_machines_hostname"
+
+// HostnameTakenError is returned when a machine would get a hostname
+// another machine already has
+type HostnameTakenError struct {
+	Hostname   string
+	MachineID  string
+	ServiceTag string
+}
+
+func (e *HostnameTakenError) Error() string {
+	return fmt.Sprintf("hostname %s is already used by machine %s (%s)", e.Hostname, e.MachineID, e.ServiceTag)
+}
+
+// CheckHostname returns a HostnameTakenError if a machine other than
+// machineID has hostname, ignoring case. Machines in the trash keep their
+// hostnames, so that they can be restored. An empty hostname is never
+// taken.
+func (db *DB) CheckHostname(machineID, hostname string) error {
+	if hostname == "" {
+		return nil
+	}
+
+	query := `SELECT id, service_tag FROM machines WHERE LOWER(hostname) = LOWER(?) AND id <> ?
+		ORDER BY enrolled_at LIMIT 1`
+	if db.driver == "postgres" {
+		query = `SELECT id, service_tag FROM machines WHERE LOWER(hostname) = LOWER($1) AND id <> $2
+			ORDER BY enrolled_at LIMIT 1`
+	}
+
+	taken := &HostnameTakenError{Hostname: hostname}
+	err := db.QueryRow(query, hostname, machineID).Scan(&taken.MachineID, &taken.ServiceTag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check hostname: %w", err)
+	}
+	return taken
+}
+
+// checkHostnameChange checks the hostname a machine is about to be saved
+// with, if it differs from the stored one. Hostnames that were duplicated
+// before they had to be unique can be kept, so that the machines can still
+// be changed otherwise.
+func (db *DB) checkHostnameChange(machineID, hostname string) error {
+	if hostname == "" {
+		return nil
+	}
+
+	query := "SELECT hostname FROM machines WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "SELECT hostname FROM machines WHERE id = $1"
+	}
+
+	var stored sql.NullString
+	err := db.QueryRow(query, machineID).Scan(&stored)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to check hostname: %w", err)
+	}
+	if strings.EqualFold(stored.String, hostname) {
+		return nil
+	}
+	return db.CheckHostname(machineID, hostname)
+}
+
+// hostnameViolation turns a write that failed on the hostname index, which
+// happens when another machine took the hostname after it was checked, into
+// a HostnameTakenError. Other errors are returned as they are.
+func (db *DB) hostnameViolation(machineID, hostname string, err error) error {
+	if !strings.Contains(err.Error(), hostnameIndex) {
+		return err
+	}
+	if taken := db.CheckHostname(machineID, hostname); taken != nil {
+		return taken
+	}
+	return err
+}
+
+// ListHostnameDuplicates lists the hostnames, ignoring case, that more than
+// one machine has. They were given before hostnames had to be unique, and
+// keep the unique index from being created until they are changed.
+// Machines in the trash are included, since they keep their hostnames.
+func (db *DB) ListHostnameDuplicates() ([]*models.MachineDuplicate, error) {
+	rows, err := db.Query(`
+		SELECT id, service_tag, mac_address, status, hostname, enrolled_at, last_seen_at, deleted_at
+		FROM machines
+		WHERE LOWER(hostname) IN (
+			SELECT LOWER(hostname) FROM machines WHERE hostname <> ''
+			GROUP BY LOWER(hostname) HAVING COUNT(*) > 1
+		)
+		ORDER BY LOWER(hostname), enrolled_at
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list duplicate hostnames: %w", err)
+	}
+	defer rows.Close()
+
+	duplicates := []*models.MachineDuplicate{}
+	var current *models.MachineDuplicate
+	for rows.Next() {
+		m := &models.DuplicateMachine{}
+		var lastSeenAt, deletedAt sql.NullTime
+
+		err := rows.Scan(&m.ID, &m.ServiceTag, &m.MACAddress, &m.Status, &m.Hostname, &m.EnrolledAt, &lastSeenAt, &deletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan machine: %w", err)
+		}
+		if lastSeenAt.Valid {
+			m.LastSeenAt = &lastSeenAt.Time
+		}
+		m.InTrash = deletedAt.Valid
+
+		value := strings.ToLower(m.Hostname)
+		if current == nil || current.Value != value {
+			current = &models.MachineDuplicate{Field: models.DuplicateHostname, Value: value}
+			duplicates = append(duplicates, current)
+		}
+		current.Machines = append(current.Machines, m)
+	}
+
+	return duplicates, rows.Err()
+}
+
+// createHostnameIndex creates the unique hostname index. If hostnames are
+// already duplicated, it logs them and leaves the index for a later start:
+// until then, hostnames are still checked when they change, and the
+// duplicates are listed as machine conflicts.
+func (db *DB) createHostnameIndex() error {
+	_, err := db.Exec(fmt.Sprintf(
+		"CREATE UNIQUE INDEX IF NOT EXISTS %s ON machines (LOWER(hostname)) WHERE hostname IS NOT NULL AND hostname <> ''",
+		hostnameIndex))
+	if err == nil {
+		return nil
+	}
+
+	duplicates, listErr := db.ListHostnameDuplicates()
+	if listErr != nil || len(duplicates) == 0 {
+		return err
+	}
+
+	var hostnames []string
+	for _, duplicate := range duplicates {
+		hostnames = append(hostnames, duplicate.Value)
+	}
+	log.Printf("Warning: hostnames used by more than one machine: %s. Hostnames are checked when they change, "+
+		"but the unique index is only created once these are fixed; see GET /api/v1/machines/conflicts?type=hostname.",
+		strings.Join(hostnames, ", "))
+	return nil
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const idempotencyColumns = `
+	idempotency_key, username, endpoint, request_hash, status_code, response_body,
+	created_at, expires_at
+`
+
+// ReserveIdempotencyKey claims a key for a request that is about to be
+// handled. If the key is already claimed and hasn't expired, nothing is
+// stored and the existing record is returned instead.
+func (db *DB) ReserveIdempotencyKey(record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	existing, err := db.GetIdempotencyRecord(record.Key, record.Username, record.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if time.Now().Before(existing.ExpiresAt) {
+			return existing, nil
+		}
+		if err := db.DeleteIdempotencyRecord(existing); err != nil {
+			return nil, err
+		}
+	}
+
+	query := `
+		INSERT INTO idempotency_keys (` + idempotencyColumns + `)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO idempotency_keys (` + idempotencyColumns + `)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT DO NOTHING
+		`
+	}
+
+	result, err := db.Exec(query,
+		record.Key,
+		record.Username,
+		record.Endpoint,
+		record.RequestHash,
+		record.StatusCode,
+		record.ResponseBody,
+		record.CreatedAt,
+		record.ExpiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+
+	// A concurrent request claimed the key first
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return db.GetIdempotencyRecord(record.Key, record.Username, record.Endpoint)
+	}
+
+	return nil, nil
+}
+
+// GetIdempotencyRecord retrieves the record of a key. It returns nil, nil if
+// the key hasn't been used.
+func (db *DB) GetIdempotencyRecord(key, username, endpoint string) (*models.IdempotencyRecord, error) {
+	query := `SELECT` + idempotencyColumns + `FROM idempotency_keys
+		WHERE idempotency_key = ? AND username = ? AND endpoint = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + idempotencyColumns + `FROM idempotency_keys
+			WHERE idempotency_key = $1 AND username = $2 AND endpoint = $3`
+	}
+
+	record := &models.IdempotencyRecord{}
+	var responseBody sql.NullString
+	err := db.QueryRow(query, key, username, endpoint).Scan(
+		&record.Key,
+		&record.Username,
+		&record.Endpoint,
+		&record.RequestHash,
+		&record.StatusCode,
+		&responseBody,
+		&record.CreatedAt,
+		&record.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	record.ResponseBody = responseBody.String
+
+	return record, nil
+}
+
+// CompleteIdempotencyRecord stores the response to a reserved key
+func (db *DB) CompleteIdempotencyRecord(record *models.IdempotencyRecord) error {
+	query := `
+		UPDATE idempotency_keys SET status_code = ?, response_body = ?
+		WHERE idempotency_key = ? AND username = ? AND endpoint = ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE idempotency_keys SET status_code = $1, response_body = $2
+			WHERE idempotency_key = $3 AND username = $4 AND endpoint = $5
+		`
+	}
+
+	_, err := db.Exec(query, record.StatusCode, record.ResponseBody, record.Key, record.Username, record.Endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteIdempotencyRecord releases a key, so that it can be used again
+func (db *DB) DeleteIdempotencyRecord(record *models.IdempotencyRecord) error {
+	query := `DELETE FROM idempotency_keys WHERE idempotency_key = ? AND username = ? AND endpoint = ?`
+	if db.driver == "postgres" {
+		query = `DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND username = $2 AND endpoint = $3`
+	}
+
+	if _, err := db.Exec(query, record.Key, record.Username, record.Endpoint); err != nil {
+		return fmt.Errorf("failed to delete idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyRecords deletes records that expired before now
+// and returns how many were deleted
+func (db *DB) DeleteExpiredIdempotencyRecords(now time.Time) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE expires_at < ?`
+	if db.driver == "postgres" {
+		query = `DELETE FROM idempotency_keys WHERE expires_at < $1`
+	}
+
+	result, err := db.Exec(query, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+
+	return result.RowsAffected()
+}
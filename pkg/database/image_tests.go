@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,6 +10,19 @@ import (
 	"github.com/google/uuid"
 )
 
+const imageTestColumns = `
+	id, image_path, image_type, test_type, status, result, error, machine_id,
+	build_id, created_at, completed_at
+`
+
+// ImageTestFilter selects image tests. Zero values match everything except
+// Limit, which defaults to 50.
+type ImageTestFilter struct {
+	ImageType string
+	BuildID   string
+	Limit     int
+}
+
 // CreateImageTest creates a new image test record
 func (db *DB) CreateImageTest(test *models.ImageTest) error {
 	test.ID = uuid.New().String()
@@ -16,15 +30,15 @@ func (db *DB) CreateImageTest(test *models.ImageTest) error {
 
 	query := `
 		INSERT INTO image_tests (
-			id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			id, image_path, image_type, test_type, status, result, error, machine_id, build_id, created_at, completed_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	if db.driver == "postgres" {
 		query = `
 			INSERT INTO image_tests (
-				id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+				id, image_path, image_type, test_type, status, result, error, machine_id, build_id, created_at, completed_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		`
 	}
 
@@ -37,6 +51,7 @@ func (db *DB) CreateImageTest(test *models.ImageTest) error {
 		test.Result,
 		test.Error,
 		test.MachineID,
+		test.BuildID,
 		test.CreatedAt,
 		test.CompletedAt,
 	)
@@ -79,103 +94,51 @@ func (db *DB) UpdateImageTest(test *models.ImageTest) error {
 	return nil
 }
 
-// GetImageTest retrieves an image test by ID
+// GetImageTest retrieves an image test by ID. It returns nil, nil if there
+// is no such test.
 func (db *DB) GetImageTest(id string) (*models.ImageTest, error) {
-	test := &models.ImageTest{}
-	var result, errorMsg sql.NullString
-	var machineID sql.NullString
-	var completedAt sql.NullTime
-
-	query := `
-		SELECT id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-		FROM image_tests WHERE id = ?
-	`
-
+	query := `SELECT` + imageTestColumns + `FROM image_tests WHERE id = ?`
 	if db.driver == "postgres" {
-		query = `
-			SELECT id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-			FROM image_tests WHERE id = $1
-		`
+		query = `SELECT` + imageTestColumns + `FROM image_tests WHERE id = $1`
 	}
 
-	err := db.QueryRow(query, id).Scan(
-		&test.ID,
-		&test.ImagePath,
-		&test.ImageType,
-		&test.TestType,
-		&test.Status,
-		&result,
-		&errorMsg,
-		&machineID,
-		&test.CreatedAt,
-		&completedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	test, err := scanImageTest(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get image test: %w", err)
 	}
 
-	if result.Valid {
-		test.Result = result.String
-	}
-	if errorMsg.Valid {
-		test.Error = errorMsg.String
-	}
-	if machineID.Valid {
-		mid := machineID.String
-		test.MachineID = &mid
-	}
-	if completedAt.Valid {
-		test.CompletedAt = &completedAt.Time
-	}
-
 	return test, nil
 }
 
-// ListImageTests retrieves image tests
-func (db *DB) ListImageTests(imageType string, limit int) ([]*models.ImageTest, error) {
-	var query string
-	var args []interface{}
+// ListImageTests retrieves image tests matching a filter, newest first
+func (db *DB) ListImageTests(filter ImageTestFilter) ([]*models.ImageTest, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 50
+	}
+
+	query := `SELECT` + imageTestColumns + `FROM image_tests WHERE 1=1`
 
-	if imageType != "" {
-		query = `
-			SELECT id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-			FROM image_tests
-			WHERE image_type = ?
-			ORDER BY created_at DESC
-			LIMIT ?
-		`
-		if db.driver == "postgres" {
-			query = `
-				SELECT id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-				FROM image_tests
-				WHERE image_type = $1
-				ORDER BY created_at DESC
-				LIMIT $2
-			`
-		}
-		args = []interface{}{imageType, limit}
-	} else {
-		query = `
-			SELECT id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-			FROM image_tests
-			ORDER BY created_at DESC
-			LIMIT ?
-		`
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
 		if db.driver == "postgres" {
-			query = `
-				SELECT id, image_path, image_type, test_type, status, result, error, machine_id, created_at, completed_at
-				FROM image_tests
-				ORDER BY created_at DESC
-				LIMIT $1
-			`
+			return fmt.Sprintf("$%d", len(args))
 		}
-		args = []interface{}{limit}
+		return "?"
+	}
+
+	if filter.ImageType != "" {
+		query += " AND image_type = " + arg(filter.ImageType)
+	}
+	if filter.BuildID != "" {
+		query += " AND build_id = " + arg(filter.BuildID)
 	}
 
+	query += " ORDER BY created_at DESC LIMIT " + arg(filter.Limit)
+
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list image tests: %w", err)
@@ -184,43 +147,71 @@ func (db *DB) ListImageTests(imageType string, limit int) ([]*models.ImageTest,
 
 	var tests []*models.ImageTest
 	for rows.Next() {
-		test := &models.ImageTest{}
-		var result, errorMsg sql.NullString
-		var machineID sql.NullString
-		var completedAt sql.NullTime
-
-		err := rows.Scan(
-			&test.ID,
-			&test.ImagePath,
-			&test.ImageType,
-			&test.TestType,
-			&test.Status,
-			&result,
-			&errorMsg,
-			&machineID,
-			&test.CreatedAt,
-			&completedAt,
-		)
+		test, err := scanImageTest(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan image test: %w", err)
 		}
+		tests = append(tests, test)
+	}
 
-		if result.Valid {
-			test.Result = result.String
-		}
-		if errorMsg.Valid {
-			test.Error = errorMsg.String
-		}
-		if machineID.Valid {
-			mid := machineID.String
-			test.MachineID = &mid
-		}
-		if completedAt.Valid {
-			test.CompletedAt = &completedAt.Time
+	return tests, rows.Err()
+}
+
+// CountImageTestsByStatus returns the number of image tests in each status
+func (db *DB) CountImageTestsByStatus() (map[string]int, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM image_tests GROUP BY status`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count image tests: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan image test count: %w", err)
 		}
+		counts[status] = count
+	}
 
-		tests = append(tests, test)
+	return counts, rows.Err()
+}
+
+// scanImageTest reads a row of imageTestColumns
+func scanImageTest(row rowScanner) (*models.ImageTest, error) {
+	test := &models.ImageTest{}
+	var result, errorMsg, machineID, buildID sql.NullString
+	var completedAt sql.NullTime
+
+	err := row.Scan(
+		&test.ID,
+		&test.ImagePath,
+		&test.ImageType,
+		&test.TestType,
+		&test.Status,
+		&result,
+		&errorMsg,
+		&machineID,
+		&buildID,
+		&test.CreatedAt,
+		&completedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	test.Result = result.String
+	test.Error = errorMsg.String
+	if machineID.Valid {
+		test.MachineID = &machineID.String
+	}
+	if buildID.Valid {
+		test.BuildID = &buildID.String
+	}
+	if completedAt.Valid {
+		test.CompletedAt = &completedAt.Time
 	}
 
-	return tests, nil
+	return test, nil
 }
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const impersonationSessionColumns = `
+	id, impersonator_id, impersonator, user_id, username, started_at, expires_at, ended_at
+`
+
+// CreateImpersonationSession records an impersonation session. The
+// session's ExpiresAt must be set.
+func (db *DB) CreateImpersonationSession(session *models.ImpersonationSession) error {
+	session.ID = uuid.New().String()
+	session.EndedAt = nil
+
+	query := `INSERT INTO impersonation_sessions (` + impersonationSessionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO impersonation_sessions (` + impersonationSessionColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	}
+
+	_, err := db.Exec(query,
+		session.ID,
+		session.ImpersonatorID,
+		session.Impersonator,
+		session.UserID,
+		session.Username,
+		session.StartedAt,
+		session.ExpiresAt,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create impersonation session: %w", err)
+	}
+	return nil
+}
+
+// GetImpersonationSession retrieves an impersonation session. It returns
+// nil, nil if there is no such session.
+func (db *DB) GetImpersonationSession(id string) (*models.ImpersonationSession, error) {
+	query := `SELECT` + impersonationSessionColumns + `FROM impersonation_sessions WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + impersonationSessionColumns + `FROM impersonation_sessions WHERE id = $1`
+	}
+
+	var session models.ImpersonationSession
+	var endedAt sql.NullTime
+	err := db.QueryRow(query, id).Scan(
+		&session.ID,
+		&session.ImpersonatorID,
+		&session.Impersonator,
+		&session.UserID,
+		&session.Username,
+		&session.StartedAt,
+		&session.ExpiresAt,
+		&endedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get impersonation session: %w", err)
+	}
+	if endedAt.Valid {
+		session.EndedAt = &endedAt.Time
+	}
+	return &session, nil
+}
+
+// EndImpersonationSession ends a session before it expires. It returns
+// false if the session had already ended.
+func (db *DB) EndImpersonationSession(id string, endedAt time.Time) (bool, error) {
+	query := `UPDATE impersonation_sessions SET ended_at = ? WHERE id = ? AND ended_at IS NULL`
+	if db.driver == "postgres" {
+		query = `UPDATE impersonation_sessions SET ended_at = $1 WHERE id = $2 AND ended_at IS NULL`
+	}
+
+	result, err := db.Exec(query, endedAt, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to end impersonation session: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db *DB) createImpersonationSessionsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS impersonation_sessions (
+			id TEXT PRIMARY KEY,
+			impersonator_id TEXT NOT NULL,
+			impersonator TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			username TEXT NOT NULL,
+			started_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			ended_at TIMESTAMP
+		)
+	`
+}
@@ -0,0 +1,221 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// CheckIntegrity checks a SQLite database for corruption with PRAGMA
+// integrity_check, and with quick_check as well if quick is set. PostgreSQL
+// databases aren't checked; amcheck does that. The result is kept for
+// LastCheck.
+func (db *DB) CheckIntegrity(quick bool) (*models.DatabaseCheck, error) {
+	check := &models.DatabaseCheck{Driver: db.driver, OK: true, CheckedAt: time.Now()}
+
+	if db.driver != "sqlite3" {
+		check.Message = "integrity checks are only run on SQLite; check PostgreSQL with pg_amcheck"
+	} else {
+		var err error
+		if check.IntegrityCheck, err = db.pragmaCheck("integrity_check"); err != nil {
+			return nil, err
+		}
+		if quick {
+			if check.QuickCheck, err = db.pragmaCheck("quick_check"); err != nil {
+				return nil, err
+			}
+		}
+		check.OK = checkPassed(check.IntegrityCheck) && (!quick || checkPassed(check.QuickCheck))
+	}
+
+	db.checkMu.Lock()
+	db.lastCheck = check
+	db.checkMu.Unlock()
+	return check, nil
+}
+
+// LastCheck returns the result of the latest integrity check, or nil if
+// there hasn't been one
+func (db *DB) LastCheck() *models.DatabaseCheck {
+	db.checkMu.Lock()
+	defer db.checkMu.Unlock()
+	return db.lastCheck
+}
+
+// pragmaCheck runs an integrity checking pragma, returning what it reported
+func (db *DB) pragmaCheck(pragma string) ([]string, error) {
+	rows, err := db.Query("PRAGMA " + pragma)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", pragma, err)
+	}
+	defer rows.Close()
+
+	var findings []string
+	for rows.Next() {
+		var finding string
+		if err := rows.Scan(&finding); err != nil {
+			return nil, fmt.Errorf("failed to run %s: %w", pragma, err)
+		}
+		findings = append(findings, finding)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", pragma, err)
+	}
+	return findings, nil
+}
+
+// checkPassed reports whether an integrity checking pragma found nothing
+func checkPassed(findings []string) bool {
+	return len(findings) == 1 && findings[0] == "ok"
+}
+
+// Checkpoint moves the SQLite write-ahead log into the database file and
+// truncates it, so the file alone is the whole database after shutdown. It
+// does nothing for PostgreSQL.
+func (db *DB) Checkpoint() error {
+	if db.driver != "sqlite3" {
+		return nil
+	}
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+	return nil
+}
+
+// backupBeforeMigrate copies a SQLite database with migrations pending to
+// <path>.pre-migrate.<time>, with SQLite's backup API. New databases and
+// in-memory ones aren't copied. PostgreSQL databases should be dumped with
+// pg_dump before upgrading.
+func (db *DB) backupBeforeMigrate() error {
+	if db.driver != "sqlite3" {
+		return nil
+	}
+	path, err := SQLitePath(db.dsn)
+	if err != nil {
+		return nil
+	}
+
+	have, err := db.schemaObjects()
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	if len(have) == 0 {
+		return nil
+	}
+	pending, err := db.migrationsPending(have)
+	if err != nil || !pending {
+		return err
+	}
+
+	backup := fmt.Sprintf("%s.pre-migrate.%s", path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := db.backupTo(backup); err != nil {
+		return fmt.Errorf("failed to back up database before migrating: %w", err)
+	}
+	log.Printf("Backed up database to %s before migrating", backup)
+	return nil
+}
+
+// migrationsPending reports whether migrating would add to a SQLite schema.
+// It migrates an empty in-memory database and looks for anything it has
+// that the schema doesn't.
+func (db *DB) migrationsPending(have map[string]bool) (bool, error) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return false, fmt.Errorf("failed to plan migrations: %w", err)
+	}
+	defer conn.Close()
+	// Each connection to :memory: is its own database
+	conn.SetMaxOpenConns(1)
+
+	target := &DB{DB: conn, driver: db.driver}
+	if err := target.migrate(); err != nil {
+		return false, fmt.Errorf("failed to plan migrations: %w", err)
+	}
+	want, err := target.schemaObjects()
+	if err != nil {
+		return false, fmt.Errorf("failed to plan migrations: %w", err)
+	}
+
+	for object := range want {
+		if !have[object] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// schemaObjects lists the tables, columns, and indexes of a SQLite database
+func (db *DB) schemaObjects() (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT m.type, m.name, COALESCE(c.name, '')
+		FROM sqlite_master m
+		LEFT JOIN pragma_table_info(m.name) c
+		WHERE m.type IN ('table', 'index') AND m.name NOT LIKE 'sqlite_%'
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := make(map[string]bool)
+	for rows.Next() {
+		var kind, name, column string
+		if err := rows.Scan(&kind, &name, &column); err != nil {
+			return nil, err
+		}
+		objects[kind+" "+name+" "+column] = true
+	}
+	return objects, rows.Err()
+}
+
+// backupTo copies a SQLite database to a new file with SQLite's backup API,
+// which is consistent while the database is in use
+func (db *DB) backupTo(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSQLite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			srcSQLite, ok2 := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return fmt.Errorf("not a SQLite connection")
+			}
+
+			backup, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// jsonColumn is a JSON document stored in a nullable column, JSONB on
+// PostgreSQL and TEXT on SQLite. It is written as text, which both drivers
+// store the same way, and SQL NULL, an empty document, and the JSON null
+// are all the same: NULL in the database and empty in Go.
+type jsonColumn []byte
+
+// Value implements driver.Valuer. It rejects invalid JSON, which SQLite
+// would otherwise store as is.
+func (j jsonColumn) Value() (driver.Value, error) {
+	if j.isNull() {
+		return nil, nil
+	}
+	if !json.Valid(j) {
+		return nil, errors.New("invalid JSON document")
+	}
+	return string(j), nil
+}
+
+// Scan implements sql.Scanner. The document is copied, since drivers may
+// reuse the buffer they return.
+func (j *jsonColumn) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*j = nil
+	case []byte:
+		*j = append(jsonColumn(nil), v...)
+	case string:
+		*j = jsonColumn(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a JSON column", src)
+	}
+
+	if j.isNull() {
+		*j = nil
+	}
+	return nil
+}
+
+// RawMessage returns the document, or nil if it is empty
+func (j jsonColumn) RawMessage() json.RawMessage {
+	if j.isNull() {
+		return nil
+	}
+	return json.RawMessage(j)
+}
+
+// Unmarshal decodes the document into v, leaving v alone if it is empty
+func (j jsonColumn) Unmarshal(v interface{}) error {
+	if j.isNull() {
+		return nil
+	}
+	return json.Unmarshal(j, v)
+}
+
+func (j jsonColumn) isNull() bool {
+	return len(j) == 0 || string(j) == "null"
+}
+
+// marshalJSONColumn encodes v for a jsonColumn. Nil values, which encode to
+// the JSON null, are stored as NULL.
+func marshalJSONColumn(v interface{}) (jsonColumn, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return jsonColumn(data), nil
+}
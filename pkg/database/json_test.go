@@ -0,0 +1,137 @@
+package database
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// jsonDocuments are the documents each JSON column is written with, and
+// what reading it back gives: nothing for the empty documents, and an equal
+// document, not necessarily byte for byte, for the others
+var jsonDocuments = []struct {
+	name      string
+	write     json.RawMessage
+	wantEmpty bool
+}{
+	{"nil", nil, true},
+	{"JSON null", json.RawMessage("null"), true},
+	{"empty array", json.RawMessage("[]"), false},
+	{"empty object", json.RawMessage("{}"), false},
+	{"populated", json.RawMessage(`{"region": "eu-west", "racks": [1, 2], "nested": {"ok": true}}`), false},
+}
+
+// checkJSON reports whether got reads back as want was written
+func checkJSON(t *testing.T, column string, got, want json.RawMessage, wantEmpty bool) {
+	t.Helper()
+
+	if wantEmpty {
+		if got != nil {
+			t.Errorf("%s = %s, want nil", column, got)
+		}
+		return
+	}
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Errorf("%s = %q: %v", column, got, err)
+		return
+	}
+	json.Unmarshal(want, &wantValue)
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("%s = %s, want %s", column, got, want)
+	}
+}
+
+func TestJSONColumnsRoundTrip(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *DB) {
+		machine, err := db.CreateMachine(models.EnrollmentRequest{ServiceTag: "JSON01", MACAddress: "02:00:00:00:00:01"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, doc := range jsonDocuments {
+			t.Run(doc.name, func(t *testing.T) {
+				template := &models.MachineTemplate{Name: "template " + doc.name, NixOSConfig: "{ ... }: { }", Tags: doc.write, Variables: doc.write}
+				if err := db.CreateTemplate(template); err != nil {
+					t.Fatal(err)
+				}
+				got, err := db.GetTemplate(template.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkJSON(t, "template tags", got.Tags, doc.write, doc.wantEmpty)
+				checkJSON(t, "template variables", got.Variables, doc.write, doc.wantEmpty)
+
+				// Updating replaces the documents, clearing them too
+				got.Tags, got.Variables = json.RawMessage(`["updated"]`), nil
+				if err := db.UpdateTemplate(got); err != nil {
+					t.Fatal(err)
+				}
+				if got, err = db.GetTemplate(template.ID); err != nil {
+					t.Fatal(err)
+				}
+				checkJSON(t, "updated template tags", got.Tags, json.RawMessage(`["updated"]`), false)
+				checkJSON(t, "updated template variables", got.Variables, nil, true)
+
+				webhook := &models.Webhook{Name: "webhook " + doc.name, URL: "https://hooks.example.com/", Events: []string{"machine.enrolled"}, Active: true, Headers: doc.write}
+				if err := db.CreateWebhook(webhook); err != nil {
+					t.Fatal(err)
+				}
+				gotWebhook, err := db.GetWebhook(webhook.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkJSON(t, "webhook headers", gotWebhook.Headers, doc.write, doc.wantEmpty)
+
+				event := &models.MachineEvent{MachineID: machine.ID, Event: "json." + doc.name, Data: doc.write}
+				if _, err := db.RecordMachineEvent(event, 0); err != nil {
+					t.Fatal(err)
+				}
+				events, err := db.SearchEvents(EventFilter{MachineID: machine.ID, Event: event.Event})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(events) != 1 {
+					t.Fatalf("found %d events, want 1", len(events))
+				}
+				checkJSON(t, "event data", events[0].Data, doc.write, doc.wantEmpty)
+			})
+		}
+
+		// Groups hold Go values rather than documents
+		groups := []struct {
+			name   string
+			tags   []string
+			limits *models.BuildLimits
+		}{
+			{"nil", nil, nil},
+			{"empty", []string{}, &models.BuildLimits{}},
+			{"populated", []string{"gpu", "dc1"}, &models.BuildLimits{TimeoutMinutes: 90, MemoryMB: 8192}},
+		}
+		for _, tt := range groups {
+			group, err := db.CreateGroup("group "+tt.name, "", tt.tags, tt.limits, nil, false, "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := db.GetGroup(group.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Tags) != len(tt.tags) || (len(tt.tags) > 0 && !reflect.DeepEqual(got.Tags, tt.tags)) {
+				t.Errorf("group %s: tags = %q, want %q", tt.name, got.Tags, tt.tags)
+			}
+			if (got.BuildLimits == nil) != (tt.limits == nil || *tt.limits == models.BuildLimits{}) ||
+				(got.BuildLimits != nil && *got.BuildLimits != *tt.limits) {
+				t.Errorf("group %s: build limits = %+v, want %+v", tt.name, got.BuildLimits, tt.limits)
+			}
+		}
+
+		// Invalid documents are refused rather than stored
+		invalid := &models.MachineTemplate{Name: "invalid", NixOSConfig: "{ ... }: { }", Tags: json.RawMessage(`["unterminated"`)}
+		if err := db.CreateTemplate(invalid); err == nil {
+			t.Error("created a template with invalid tags")
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// SetMachineConfigLint records the result of linting a machine's
+// configuration, or clears it if result is nil
+func (db *DB) SetMachineConfigLint(id string, result *models.LintResult) error {
+	query := `UPDATE machines SET config_lint = ? WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE machines SET config_lint = $1 WHERE id = $2`
+	}
+
+	value, err := marshalJSONColumn(result)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(query, value, id); err != nil {
+		return fmt.Errorf("failed to set config lint: %w", err)
+	}
+	return nil
+}
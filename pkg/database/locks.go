@@ -0,0 +1,62 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// AcquireLock takes the named lock for holder until ttl from now, and
+// reports whether holder has it. A lock whose lease has expired can be
+// taken by anyone. Acquiring a lock holder already has renews its lease,
+// so a job that runs periodically keeps its lock by acquiring it each time
+// it runs, and loses it to another holder if it stops for longer than ttl.
+func (db *DB) AcquireLock(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	query := `
+		INSERT INTO locks (name, holder, acquired_at, expires_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			holder = excluded.holder,
+			acquired_at = CASE WHEN locks.holder = excluded.holder THEN locks.acquired_at ELSE excluded.acquired_at END,
+			expires_at = excluded.expires_at
+		WHERE locks.holder = excluded.holder OR locks.expires_at < ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO locks (name, holder, acquired_at, expires_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (name) DO UPDATE SET
+				holder = excluded.holder,
+				acquired_at = CASE WHEN locks.holder = excluded.holder THEN locks.acquired_at ELSE excluded.acquired_at END,
+				expires_at = excluded.expires_at
+			WHERE locks.holder = excluded.holder OR locks.expires_at < $5
+		`
+	}
+
+	result, err := db.Exec(query, name, holder, now, now.Add(ttl), now)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lock %s: %w", name, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseLock gives up the named lock if holder has it, so that another
+// holder can take it without waiting for the lease to expire
+func (db *DB) ReleaseLock(name, holder string) error {
+	query := "DELETE FROM locks WHERE name = ? AND holder = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM locks WHERE name = $1 AND holder = $2"
+	}
+
+	if _, err := db.Exec(query, name, holder); err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// newTestDB opens a migrated SQLite database in a file for one test. A
+// file, rather than shared-cache memory, makes concurrent writers wait for
+// each other as they would on a real database.
+func newTestDB(t testing.TB) *DB {
+	t.Helper()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=10000&_journal_mode=WAL"
+	db, err := New(Config{Driver: "sqlite3", DSN: dsn})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	return db
+}
+
+func TestAcquireLock(t *testing.T) {
+	db := newTestDB(t)
+
+	acquire := func(holder string, ttl time.Duration) bool {
+		t.Helper()
+		ok, err := db.AcquireLock("job:test", holder, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !acquire("a", time.Minute) {
+		t.Fatal("a could not take a free lock")
+	}
+	if acquire("b", time.Minute) {
+		t.Error("b took a's lock")
+	}
+	if !acquire("a", time.Minute) {
+		t.Error("a could not renew its lock")
+	}
+
+	// Another lock is another matter
+	if ok, err := db.AcquireLock("job:other", "b", time.Minute); err != nil || !ok {
+		t.Errorf("b could not take another lock: %v", err)
+	}
+
+	// Releasing hands the lock over at once; releasing someone else's
+	// lock does nothing
+	if err := db.ReleaseLock("job:test", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if acquire("b", time.Minute) {
+		t.Error("b took a's lock after releasing a lock it didn't hold")
+	}
+	if err := db.ReleaseLock("job:test", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if !acquire("b", time.Minute) {
+		t.Error("b could not take a released lock")
+	}
+}
+
+func TestAcquireLockAfterLeaseExpires(t *testing.T) {
+	db := newTestDB(t)
+
+	if ok, err := db.AcquireLock("job:test", "a", 10*time.Millisecond); err != nil || !ok {
+		t.Fatalf("a could not take a free lock: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// a stopped renewing, so the job moves to b, and a can't take it back
+	if ok, err := db.AcquireLock("job:test", "b", time.Minute); err != nil || !ok {
+		t.Fatalf("b could not take an expired lock: %v", err)
+	}
+	if ok, err := db.AcquireLock("job:test", "a", time.Minute); err != nil || ok {
+		t.Errorf("a took b's lock back: %v", err)
+	}
+}
+
+func TestAcquireLockConcurrently(t *testing.T) {
+	db := newTestDB(t)
+
+	// Replicas starting at once race for the same job
+	const holders = 8
+	var mu sync.Mutex
+	var winners []string
+	var wg sync.WaitGroup
+	for i := 0; i < holders; i++ {
+		wg.Add(1)
+		go func(holder string) {
+			defer wg.Done()
+			ok, err := db.AcquireLock("job:test", holder, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				winners = append(winners, holder)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("replica-%d", i))
+	}
+	wg.Wait()
+
+	if len(winners) != 1 {
+		t.Errorf("%v took the lock, want exactly one holder", winners)
+	}
+}
+
+func TestClaimPendingBuildConcurrently(t *testing.T) {
+	db := newTestDB(t)
+
+	const builds = 6
+	for i := 0; i < builds; i++ {
+		machine, err := db.CreateMachine(models.EnrollmentRequest{
+			ServiceTag: fmt.Sprintf("CLAIM%d", i),
+			MACAddress: fmt.Sprintf("02:00:00:00:00:%02x", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.CreateBuild(machine.ID, "{ }", "", "", false, false, "", models.BuildRequirements{}, "", false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Builders poll two replicas, which share the database, at once
+	var mu sync.Mutex
+	claims := make(map[string][]string)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(builder *models.Builder) {
+			defer wg.Done()
+			for {
+				build, err := db.ClaimPendingBuild(builder, time.Now().Add(time.Minute))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if build == nil {
+					return
+				}
+				mu.Lock()
+				claims[build.ID] = append(claims[build.ID], builder.Name)
+				mu.Unlock()
+			}
+		}(&models.Builder{Name: fmt.Sprintf("builder-%d", i), Architectures: []string{"x86_64"}})
+	}
+	wg.Wait()
+
+	if len(claims) != builds {
+		t.Errorf("claimed %d builds, want %d", len(claims), builds)
+	}
+	for id, builders := range claims {
+		if len(builders) != 1 {
+			t.Errorf("build %s claimed by %v", id, builders)
+			continue
+		}
+		build, err := db.GetBuild(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if build.Status != "building" || build.Builder != builders[0] || build.Attempts != 1 {
+			t.Errorf("build %s is %s by %q after %d attempts, want building by %s once", id, build.Status, build.Builder, build.Attempts, builders[0])
+		}
+	}
+}
@@ -3,7 +3,10 @@ package database
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
@@ -12,231 +15,233 @@ import (
 
 // CreateMachine creates a new machine record
 func (db *DB) CreateMachine(req models.EnrollmentRequest) (*models.Machine, error) {
+	machine := newEnrolledMachine(req, models.StatusEnrolled)
+	if err := db.insertEnrolledMachine(db, machine); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+// CreateVirtualMachine creates the record for a virtual machine, which is
+// enrolled like a real one but can never be made real, nor a real machine
+// virtual. dryRunBuilds has its builds evaluated but not built.
+func (db *DB) CreateVirtualMachine(req models.EnrollmentRequest, dryRunBuilds bool) (*models.Machine, error) {
+	machine := newEnrolledMachine(req, models.StatusEnrolled)
+	machine.Virtual = true
+	machine.DryRunBuilds = dryRunBuilds
+	if err := db.insertEnrolledMachine(db, machine); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+// execer runs statements on the database or in a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// newEnrolledMachine returns the record for a machine enrolling for the
+// first time
+func newEnrolledMachine(req models.EnrollmentRequest, status models.MachineStatus) *models.Machine {
 	machine := &models.Machine{
-		ID:          uuid.New().String(),
-		ServiceTag:  req.ServiceTag,
-		MACAddress:  req.MACAddress,
-		Status:      models.StatusEnrolled,
-		Hardware:    req.Hardware,
-		EnrolledAt:  time.Now(),
-		UpdatedAt:   time.Now(),
+		ID:         uuid.New().String(),
+		ServiceTag: req.ServiceTag,
+		MACAddress: req.MACAddress,
+		Status:     status,
+		Hardware:   req.Hardware,
+		BootMode:   req.BootMode,
+		EnrolledAt: time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+
+	if req.BMC != nil {
+		machine.BMCInfo, _ = req.BMC.MergeInto(nil)
 	}
+	machine.HardwareCompleteness = machine.Hardware.Completeness()
+
+	return machine
+}
 
+// insertEnrolledMachine inserts a record made by newEnrolledMachine
+func (db *DB) insertEnrolledMachine(ex execer, machine *models.Machine) error {
 	hardwareJSON, err := json.Marshal(machine.Hardware)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal hardware: %w", err)
+		return fmt.Errorf("failed to marshal hardware: %w", err)
+	}
+
+	var bmcJSON []byte
+	if machine.BMCInfo != nil {
+		bmcJSON, err = db.marshalBMCInfo(machine.BMCInfo)
+		if err != nil {
+			return err
+		}
 	}
 
 	query := `
 		INSERT INTO machines (
-			id, service_tag, mac_address, status, hardware, enrolled_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?)
+			id, service_tag, mac_address, status, hardware, bmc_info, boot_mode, enrolled_at, updated_at,
+			is_virtual, dry_run_builds
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	if db.driver == "postgres" {
 		query = `
 			INSERT INTO machines (
-				id, service_tag, mac_address, status, hardware, enrolled_at, updated_at
-			) VALUES ($1, $2, $3, $4, $5, $6, $7)
+				id, service_tag, mac_address, status, hardware, bmc_info, boot_mode, enrolled_at, updated_at,
+				is_virtual, dry_run_builds
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		`
 	}
 
-	_, err = db.Exec(query,
+	_, err = ex.Exec(query,
 		machine.ID,
 		machine.ServiceTag,
 		machine.MACAddress,
 		machine.Status,
 		hardwareJSON,
+		bmcJSON,
+		machine.BootMode,
 		machine.EnrolledAt,
 		machine.UpdatedAt,
+		machine.Virtual,
+		machine.DryRunBuilds,
 	)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to create machine: %w", err)
+		return fmt.Errorf("failed to create machine: %w", err)
 	}
 
-	return machine, nil
+	return nil
 }
 
-// GetMachine retrieves a machine by ID
-func (db *DB) GetMachine(id string) (*models.Machine, error) {
-	machine := &models.Machine{}
-	var hardwareJSON, bmcJSON []byte
-	var hostname, description, nixosConfig sql.NullString
-	var lastBuildID sql.NullString
-	var lastBuildTime, lastSeenAt sql.NullTime
+// AdoptMachine creates the record for a machine that is already running
+// NixOS. It starts out in the adopted status and switch deploy mode, with
+// the machine's current configuration, if given, as its NixOS config. It
+// returns a HostnameTakenError if another machine has the hostname.
+func (db *DB) AdoptMachine(req models.AdoptRequest) (*models.Machine, error) {
+	if err := db.CheckHostname("", req.Hostname); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	machine := &models.Machine{
+		ID:          uuid.New().String(),
+		ServiceTag:  req.ServiceTag,
+		MACAddress:  req.MACAddress,
+		Status:      models.StatusAdopted,
+		Hostname:    req.Hostname,
+		Description: req.Description,
+		NixOSConfig: req.NixOSConfig,
+		ConfigHash:  models.ConfigHash(req.NixOSConfig),
+		DeployMode:  models.DeployModeSwitch,
+		SSHAddress:  req.SSHAddress,
+		SSHUser:     req.SSHUser,
+		SSHKey:      req.SSHKey,
+		EnrolledAt:  now,
+		UpdatedAt:   now,
+	}
+	if machine.ConfigHash != "" {
+		machine.ConfigUpdatedAt = &now
+	}
+
+	hardwareJSON, err := json.Marshal(machine.Hardware)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal hardware: %w", err)
+	}
 
 	query := `
-		SELECT id, service_tag, mac_address, status, hostname, description,
-		       hardware, nixos_config, last_build_id, last_build_time,
-		       enrolled_at, updated_at, last_seen_at, bmc_info
-		FROM machines WHERE id = ?
+		INSERT INTO machines (
+			id, service_tag, mac_address, status, hostname, description, hardware,
+			nixos_config, deploy_mode, ssh_address, ssh_user, ssh_key, enrolled_at, updated_at,
+			config_hash, config_updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	if db.driver == "postgres" {
 		query = `
-			SELECT id, service_tag, mac_address, status, hostname, description,
-			       hardware, nixos_config, last_build_id, last_build_time,
-			       enrolled_at, updated_at, last_seen_at, bmc_info
-			FROM machines WHERE id = $1
+			INSERT INTO machines (
+				id, service_tag, mac_address, status, hostname, description, hardware,
+				nixos_config, deploy_mode, ssh_address, ssh_user, ssh_key, enrolled_at, updated_at,
+				config_hash, config_updated_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 		`
 	}
 
-	err := db.QueryRow(query, id).Scan(
-		&machine.ID,
-		&machine.ServiceTag,
-		&machine.MACAddress,
-		&machine.Status,
-		&hostname,
-		&description,
-		&hardwareJSON,
-		&nixosConfig,
-		&lastBuildID,
-		&lastBuildTime,
-		&machine.EnrolledAt,
-		&machine.UpdatedAt,
-		&lastSeenAt,
-		&bmcJSON,
+	_, err = db.Exec(query,
+		machine.ID,
+		machine.ServiceTag,
+		machine.MACAddress,
+		machine.Status,
+		machine.Hostname,
+		machine.Description,
+		hardwareJSON,
+		machine.NixOSConfig,
+		machine.DeployMode,
+		machine.SSHAddress,
+		machine.SSHUser,
+		machine.SSHKey,
+		machine.EnrolledAt,
+		machine.UpdatedAt,
+		machine.ConfigHash,
+		machine.ConfigUpdatedAt,
 	)
 
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get machine: %w", err)
-	}
-
-	// Convert nullable fields
-	if hostname.Valid {
-		machine.Hostname = hostname.String
-	}
-	if description.Valid {
-		machine.Description = description.String
-	}
-	if nixosConfig.Valid {
-		machine.NixOSConfig = nixosConfig.String
-	}
-	if lastBuildID.Valid {
-		id := lastBuildID.String
-		machine.LastBuildID = &id
-	}
-	if lastBuildTime.Valid {
-		machine.LastBuildTime = &lastBuildTime.Time
-	}
-	if lastSeenAt.Valid {
-		machine.LastSeenAt = &lastSeenAt.Time
-	}
-
-	if err := json.Unmarshal(hardwareJSON, &machine.Hardware); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal hardware: %w", err)
-	}
-
-	// Unmarshal BMC info if present
-	if len(bmcJSON) > 0 {
-		var bmcInfo models.BMCInfo
-		if err := json.Unmarshal(bmcJSON, &bmcInfo); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal bmc_info: %w", err)
-		}
-		machine.BMCInfo = &bmcInfo
+		return nil, db.hostnameViolation(machine.ID, machine.Hostname, fmt.Errorf("failed to adopt machine: %w", err))
 	}
 
 	return machine, nil
 }
 
-// GetMachineByServiceTag retrieves a machine by service tag
+// GetMachine retrieves a machine by ID. It returns nil, nil if there is no
+// such machine, or it is in the trash.
+func (db *DB) GetMachine(id string) (*models.Machine, error) {
+	return db.getMachine("id = %s AND deleted_at IS NULL", id)
+}
+
+// GetMachineByServiceTag retrieves a machine by service tag. It returns
+// nil, nil if no machine has the tag, or the machine is in the trash.
 func (db *DB) GetMachineByServiceTag(serviceTag string) (*models.Machine, error) {
-	machine := &models.Machine{}
-	var hardwareJSON, bmcJSON []byte
-	var hostname, description, nixosConfig sql.NullString
-	var lastBuildID sql.NullString
-	var lastBuildTime, lastSeenAt sql.NullTime
+	return db.getMachine("service_tag = %s AND deleted_at IS NULL", serviceTag)
+}
 
-	query := `
-		SELECT id, service_tag, mac_address, status, hostname, description,
-		       hardware, nixos_config, last_build_id, last_build_time,
-		       enrolled_at, updated_at, last_seen_at, bmc_info
-		FROM machines WHERE service_tag = ?
-	`
+// GetTrashedMachine retrieves a machine in the trash by ID. It returns nil,
+// nil if there is no such machine in the trash.
+func (db *DB) GetTrashedMachine(id string) (*models.Machine, error) {
+	return db.getMachine("id = %s AND deleted_at IS NOT NULL", id)
+}
+
+// GetTrashedMachineByServiceTag retrieves a machine in the trash by service
+// tag. It returns nil, nil if no machine in the trash has the tag.
+func (db *DB) GetTrashedMachineByServiceTag(serviceTag string) (*models.Machine, error) {
+	return db.getMachine("service_tag = %s AND deleted_at IS NOT NULL", serviceTag)
+}
 
+// getMachine retrieves the machine matching condition, in which %s is the
+// placeholder for arg. It returns nil, nil if there is no such machine.
+func (db *DB) getMachine(condition string, arg interface{}) (*models.Machine, error) {
+	placeholder := "?"
 	if db.driver == "postgres" {
-		query = `
-			SELECT id, service_tag, mac_address, status, hostname, description,
-			       hardware, nixos_config, last_build_id, last_build_time,
-			       enrolled_at, updated_at, last_seen_at, bmc_info
-			FROM machines WHERE service_tag = $1
-		`
+		placeholder = "$1"
 	}
+	query := `SELECT` + machineColumns + `FROM machines WHERE ` + fmt.Sprintf(condition, placeholder)
 
-	err := db.QueryRow(query, serviceTag).Scan(
-		&machine.ID,
-		&machine.ServiceTag,
-		&machine.MACAddress,
-		&machine.Status,
-		&hostname,
-		&description,
-		&hardwareJSON,
-		&nixosConfig,
-		&lastBuildID,
-		&lastBuildTime,
-		&machine.EnrolledAt,
-		&machine.UpdatedAt,
-		&lastSeenAt,
-		&bmcJSON,
-	)
-
-	if err == sql.ErrNoRows {
+	machine, err := db.scanMachine(db.QueryRow(query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get machine: %w", err)
 	}
 
-	// Convert nullable fields
-	if hostname.Valid {
-		machine.Hostname = hostname.String
-	}
-	if description.Valid {
-		machine.Description = description.String
-	}
-	if nixosConfig.Valid {
-		machine.NixOSConfig = nixosConfig.String
-	}
-	if lastBuildID.Valid {
-		id := lastBuildID.String
-		machine.LastBuildID = &id
-	}
-	if lastBuildTime.Valid {
-		machine.LastBuildTime = &lastBuildTime.Time
-	}
-	if lastSeenAt.Valid {
-		machine.LastSeenAt = &lastSeenAt.Time
-	}
-
-	if err := json.Unmarshal(hardwareJSON, &machine.Hardware); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal hardware: %w", err)
-	}
-
-	// Unmarshal BMC info if present
-	if len(bmcJSON) > 0 {
-		var bmcInfo models.BMCInfo
-		if err := json.Unmarshal(bmcJSON, &bmcInfo); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal bmc_info: %w", err)
-		}
-		machine.BMCInfo = &bmcInfo
-	}
-
 	return machine, nil
 }
 
 // ListMachines retrieves all machines
 func (db *DB) ListMachines() ([]*models.Machine, error) {
-	query := `
-		SELECT id, service_tag, mac_address, status, hostname, description,
-		       hardware, nixos_config, last_build_id, last_build_time,
-		       enrolled_at, updated_at, last_seen_at, bmc_info
-		FROM machines
-		ORDER BY enrolled_at DESC
-	`
+	query := `SELECT` + machineColumns + `FROM machines
+		WHERE deleted_at IS NULL
+		ORDER BY enrolled_at DESC`
 
 	rows, err := db.Query(query)
 	if err != nil {
@@ -244,77 +249,23 @@ func (db *DB) ListMachines() ([]*models.Machine, error) {
 	}
 	defer rows.Close()
 
-	var machines []*models.Machine
-	for rows.Next() {
-		machine := &models.Machine{}
-		var hardwareJSON, bmcJSON []byte
-		var hostname, description, nixosConfig sql.NullString
-		var lastBuildID sql.NullString
-		var lastBuildTime, lastSeenAt sql.NullTime
-
-		err := rows.Scan(
-			&machine.ID,
-			&machine.ServiceTag,
-			&machine.MACAddress,
-			&machine.Status,
-			&hostname,
-			&description,
-			&hardwareJSON,
-			&nixosConfig,
-			&lastBuildID,
-			&lastBuildTime,
-			&machine.EnrolledAt,
-			&machine.UpdatedAt,
-			&lastSeenAt,
-			&bmcJSON,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan machine: %w", err)
-		}
-
-		// Convert nullable fields
-		if hostname.Valid {
-			machine.Hostname = hostname.String
-		}
-		if description.Valid {
-			machine.Description = description.String
-		}
-		if nixosConfig.Valid {
-			machine.NixOSConfig = nixosConfig.String
-		}
-		if lastBuildID.Valid {
-			id := lastBuildID.String
-			machine.LastBuildID = &id
-		}
-		if lastBuildTime.Valid {
-			machine.LastBuildTime = &lastBuildTime.Time
-		}
-		if lastSeenAt.Valid {
-			machine.LastSeenAt = &lastSeenAt.Time
-		}
-
-		if err := json.Unmarshal(hardwareJSON, &machine.Hardware); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal hardware: %w", err)
-		}
-
-		// Unmarshal BMC info if present
-		if len(bmcJSON) > 0 {
-			var bmcInfo models.BMCInfo
-			if err := json.Unmarshal(bmcJSON, &bmcInfo); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal bmc_info: %w", err)
-			}
-			machine.BMCInfo = &bmcInfo
-		}
-
-		machines = append(machines, machine)
-	}
-
-	return machines, nil
+	return db.scanMachines(rows)
 }
 
-// UpdateMachine updates a machine record
+// UpdateMachine updates a machine record. It returns a HostnameTakenError
+// if the machine's hostname changed to one another machine has.
 func (db *DB) UpdateMachine(machine *models.Machine) error {
+	if err := db.checkHostnameChange(machine.ID, machine.Hostname); err != nil {
+		return err
+	}
+
 	machine.UpdatedAt = time.Now()
+	if hash := models.ConfigHash(machine.NixOSConfig); hash != machine.ConfigHash {
+		updatedAt := machine.UpdatedAt
+		machine.ConfigHash = hash
+		machine.ConfigUpdatedAt = &updatedAt
+	}
+	machine.StaleBuild = machine.BuildIsStale()
 
 	hardwareJSON, err := json.Marshal(machine.Hardware)
 	if err != nil {
@@ -323,9 +274,35 @@ func (db *DB) UpdateMachine(machine *models.Machine) error {
 
 	var bmcJSON []byte
 	if machine.BMCInfo != nil {
-		bmcJSON, err = json.Marshal(machine.BMCInfo)
+		bmcJSON, err = db.marshalBMCInfo(machine.BMCInfo)
 		if err != nil {
-			return fmt.Errorf("failed to marshal bmc_info: %w", err)
+			return err
+		}
+	}
+
+	tagsJSON, err := marshalTags(machine.Tags)
+	if err != nil {
+		return err
+	}
+
+	var wolEnabled bool
+	var wolMAC string
+	if machine.WakeOnLAN != nil {
+		wolEnabled = machine.WakeOnLAN.Enabled
+		wolMAC = machine.WakeOnLAN.MACAddress
+	}
+
+	var location models.Location
+	if machine.Location != nil {
+		location = *machine.Location
+	}
+
+	ownership := derefOwnership(machine.Ownership)
+
+	var templateVariables jsonColumn
+	if len(machine.TemplateVariables) > 0 {
+		if templateVariables, err = marshalJSONColumn(machine.TemplateVariables); err != nil {
+			return fmt.Errorf("failed to marshal template variables: %w", err)
 		}
 	}
 
@@ -333,7 +310,12 @@ func (db *DB) UpdateMachine(machine *models.Machine) error {
 		UPDATE machines SET
 			hostname = ?, description = ?, hardware = ?, nixos_config = ?,
 			status = ?, last_build_id = ?, last_build_time = ?, updated_at = ?,
-			last_seen_at = ?, bmc_info = ?
+			last_seen_at = ?, bmc_info = ?, boot_mode = ?, decommissioned_at = ?,
+			deploy_mode = ?, ssh_address = ?, ssh_user = ?, ssh_key = ?, tags = ?,
+			wol_enabled = ?, wol_mac_address = ?, datacenter = ?, rack = ?, rack_unit = ?,
+			template_id = ?, template_variables = ?, build_target = ?,
+			config_hash = ?, config_updated_at = ?, built_config_hash = ?,
+			owner_team = ?, owner_email = ?, owner_slack_channel = ?, environment = ?
 		WHERE id = ?
 	`
 
@@ -342,8 +324,14 @@ func (db *DB) UpdateMachine(machine *models.Machine) error {
 			UPDATE machines SET
 				hostname = $1, description = $2, hardware = $3, nixos_config = $4,
 				status = $5, last_build_id = $6, last_build_time = $7, updated_at = $8,
-				last_seen_at = $9, bmc_info = $10
-			WHERE id = $11
+				last_seen_at = $9, bmc_info = $10, boot_mode = $11, decommissioned_at = $12,
+				deploy_mode = $13, ssh_address = $14, ssh_user = $15, ssh_key = $16, tags = $17,
+				wol_enabled = $18, wol_mac_address = $19, datacenter = $20, rack = $21,
+				rack_unit = $22, template_id = $23, template_variables = $24,
+				build_target = $25, config_hash = $26, config_updated_at = $27,
+				built_config_hash = $28, owner_team = $29, owner_email = $30,
+				owner_slack_channel = $31, environment = $32
+			WHERE id = $33
 		`
 	}
 
@@ -358,76 +346,548 @@ func (db *DB) UpdateMachine(machine *models.Machine) error {
 		machine.UpdatedAt,
 		machine.LastSeenAt,
 		bmcJSON,
+		machine.BootMode,
+		machine.DecommissionedAt,
+		machine.DeployMode,
+		machine.SSHAddress,
+		machine.SSHUser,
+		machine.SSHKey,
+		tagsJSON,
+		wolEnabled,
+		wolMAC,
+		location.Datacenter,
+		location.Rack,
+		location.RackUnit,
+		machine.TemplateID,
+		templateVariables,
+		machine.BuildTarget,
+		machine.ConfigHash,
+		machine.ConfigUpdatedAt,
+		machine.BuiltConfigHash,
+		ownership.Team,
+		ownership.ContactEmail,
+		ownership.SlackChannel,
+		ownership.Environment,
 		machine.ID,
 	)
 
 	if err != nil {
-		return fmt.Errorf("failed to update machine: %w", err)
+		return db.hostnameViolation(machine.ID, machine.Hostname, fmt.Errorf("failed to update machine: %w", err))
 	}
 
 	return nil
 }
 
-// DeleteMachine deletes a machine record
-func (db *DB) DeleteMachine(id string) error {
-	query := "DELETE FROM machines WHERE id = ?"
+// SetMachineIdentityExempt records whether metrics submitted for a machine
+// skip the identity check
+func (db *DB) SetMachineIdentityExempt(id string, exempt bool) error {
+	query := `UPDATE machines SET identity_exempt = ?, updated_at = ? WHERE id = ?`
 	if db.driver == "postgres" {
-		query = "DELETE FROM machines WHERE id = $1"
+		query = `UPDATE machines SET identity_exempt = $1, updated_at = $2 WHERE id = $3`
 	}
 
-	_, err := db.Exec(query, id)
-	if err != nil {
-		return fmt.Errorf("failed to delete machine: %w", err)
+	if _, err := db.Exec(query, exempt, time.Now(), id); err != nil {
+		return fmt.Errorf("failed to update machine: %w", err)
 	}
-
 	return nil
 }
 
-// MachineFilter represents filter criteria for searching machines
-type MachineFilter struct {
-	Status       string
-	Hostname     string
-	ServiceTag   string
-	MACAddress   string
-	Manufacturer string
-	Model        string
-	Search       string // General search across multiple fields
-	Limit        int
-	Offset       int
+// SetHardwareRefreshRequested records when a machine was sent to the
+// registration image to collect its hardware inventory again, or clears it
+// if requestedAt is nil
+func (db *DB) SetHardwareRefreshRequested(id string, requestedAt *time.Time) error {
+	query := `UPDATE machines SET hardware_refresh_requested_at = ? WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE machines SET hardware_refresh_requested_at = $1 WHERE id = $2`
+	}
+
+	if _, err := db.Exec(query, requestedAt, id); err != nil {
+		return fmt.Errorf("failed to update machine: %w", err)
+	}
+	return nil
 }
 
-// SearchMachines searches machines with advanced filtering
-func (db *DB) SearchMachines(filter MachineFilter) ([]*models.Machine, error) {
+// UpdateMachineBMCStatus records the result of a BMC poll without touching
+// the rest of the machine record
+func (db *DB) UpdateMachineBMCStatus(id, firmware, health string, unreachable bool, checkedAt time.Time) error {
 	query := `
-		SELECT id, service_tag, mac_address, status, hostname, description,
-		       hardware, nixos_config, last_build_id, last_build_time,
-		       enrolled_at, updated_at, last_seen_at, bmc_info
-		FROM machines
-		WHERE 1=1
+		UPDATE machines SET
+			bmc_firmware = COALESCE(NULLIF(?, ''), bmc_firmware),
+			bmc_health = COALESCE(NULLIF(?, ''), bmc_health),
+			bmc_unreachable = ?, bmc_checked_at = ?
+		WHERE id = ?
 	`
 
-	args := []interface{}{}
-	argIdx := 1
+	if db.driver == "postgres" {
+		query = `
+			UPDATE machines SET
+				bmc_firmware = COALESCE(NULLIF($1, ''), bmc_firmware),
+				bmc_health = COALESCE(NULLIF($2, ''), bmc_health),
+				bmc_unreachable = $3, bmc_checked_at = $4
+			WHERE id = $5
+		`
+	}
 
-	// Add status filter
-	if filter.Status != "" {
-		if db.driver == "postgres" {
-			query += fmt.Sprintf(" AND status = $%d", argIdx)
-		} else {
-			query += " AND status = ?"
-		}
-		args = append(args, filter.Status)
-		argIdx++
+	_, err := db.Exec(query, firmware, health, unreachable, checkedAt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update machine bmc status: %w", err)
 	}
 
-	// Add hostname filter (partial match)
-	if filter.Hostname != "" {
-		if db.driver == "postgres" {
-			query += fmt.Sprintf(" AND hostname ILIKE $%d", argIdx)
-			args = append(args, "%"+filter.Hostname+"%")
-		} else {
-			query += " AND hostname LIKE ?"
-			args = append(args, "%"+filter.Hostname+"%")
+	return nil
+}
+
+// UpdateMachinePowerState records a machine's power state as read at
+// checkedAt. previous is the state recorded before, or "" if there was
+// none, and changed whether state differs from it.
+func (db *DB) UpdateMachinePowerState(id, state string, checkedAt time.Time) (previous string, changed bool, err error) {
+	selectQuery := "SELECT power_state FROM machines WHERE id = ?"
+	updateQuery := "UPDATE machines SET power_state = ?, power_state_updated_at = ? WHERE id = ?"
+	if db.driver == "postgres" {
+		selectQuery = "SELECT power_state FROM machines WHERE id = $1 FOR UPDATE"
+		updateQuery = "UPDATE machines SET power_state = $1, power_state_updated_at = $2 WHERE id = $3"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullString
+	err = tx.QueryRow(selectQuery, id).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get machine power state: %w", err)
+	}
+
+	if _, err := tx.Exec(updateQuery, state, checkedAt, id); err != nil {
+		return "", false, fmt.Errorf("failed to update machine power state: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+
+	return current.String, current.String != state, nil
+}
+
+// UpdateMachineCurrentIP records the leased address for the machine with the
+// given MAC address. It returns the machine ID, or an empty string if no
+// machine outside the trash has the MAC or the address is unchanged.
+func (db *DB) UpdateMachineCurrentIP(macAddress, ip string) (string, error) {
+	query := `
+		UPDATE machines SET current_ip = ?, current_ip_updated_at = CURRENT_TIMESTAMP
+		WHERE LOWER(mac_address) = LOWER(?) AND (current_ip IS NULL OR current_ip <> ?) AND deleted_at IS NULL
+		RETURNING id
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE machines SET current_ip = $1, current_ip_updated_at = CURRENT_TIMESTAMP
+			WHERE LOWER(mac_address) = LOWER($2) AND (current_ip IS NULL OR current_ip <> $3) AND deleted_at IS NULL
+			RETURNING id
+		`
+	}
+
+	var id string
+	err := db.QueryRow(query, ip, macAddress, ip).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to update machine current ip: %w", err)
+	}
+
+	return id, nil
+}
+
+// RecordMachineAddress records that a machine was seen at an address,
+// such as when it enrolls or submits metrics
+func (db *DB) RecordMachineAddress(id, ip string, seenAt time.Time) error {
+	query := `UPDATE machines SET current_ip = ?, current_ip_updated_at = ?, last_seen_at = ? WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE machines SET current_ip = $1, current_ip_updated_at = $2, last_seen_at = $3 WHERE id = $4`
+	}
+
+	if _, err := db.Exec(query, ip, seenAt, seenAt, id); err != nil {
+		return fmt.Errorf("failed to record machine address: %w", err)
+	}
+	return nil
+}
+
+// DeleteMachine permanently deletes a machine, in or out of the trash, with
+// its builds, history, group memberships, and the conflict it is held for
+func (db *DB) DeleteMachine(id string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := db.deleteMachine(tx, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeDecommissionedMachines permanently deletes machines that were
+// decommissioned before cutoff, and returns the deleted IDs
+func (db *DB) PurgeDecommissionedMachines(cutoff time.Time) ([]string, error) {
+	query := "SELECT id FROM machines WHERE status = ? AND decommissioned_at < ?"
+	if db.driver == "postgres" {
+		query = "SELECT id FROM machines WHERE status = $1 AND decommissioned_at < $2"
+	}
+
+	return db.purgeMachines("decommissioned", query, models.StatusDecommissioned, cutoff)
+}
+
+// MachineFilter represents filter criteria for searching machines
+type MachineFilter struct {
+	Status       string
+	Hostname     string
+	ServiceTag   string
+	MACAddress   string
+	Manufacturer string
+	Model        string
+	Search       string   // General search across multiple fields
+	Tags         []string // Normalized tags, all of which must be present
+	Datacenter   string   // Exact location matches
+	Rack         string
+
+	// IPAddress matches machines whose current IP or BMC address is this
+	// IPv4 or IPv6 address, however either was written
+	IPAddress string
+
+	// Compliance is a hardware compliance status, or unchecked for
+	// machines no hardware profile applies to
+	Compliance string
+
+	// StaleBuild, if set, keeps machines whose configuration has or hasn't
+	// changed since their last successful build
+	StaleBuild *bool
+
+	// Virtual, if set, keeps only virtual machines or only real ones
+	Virtual *bool
+
+	// Trashed lists machines in the trash instead of the others, most
+	// recently deleted first
+	Trashed bool
+
+	// Machines with at least MinGPUCount GPUs matching GPUVendor and
+	// GPUModel (partial matches), or at least one if MinGPUCount is 0
+	GPUVendor   string
+	GPUModel    string
+	MinGPUCount int
+
+	// VisibleTo leaves out machines claimed by users other than this one
+	VisibleTo string
+
+	// Metadata maps dotted metadata paths, such as team.name, to the value
+	// they must have. Numbers and booleans match their JSON text.
+	Metadata map[string]string
+
+	// OwnerTeam and Environment match machines' effective ownership
+	// exactly, and Unowned keeps machines with neither an owner team nor
+	// a contact email of their own or from a group
+	OwnerTeam   string
+	Environment string
+	Unowned     bool
+
+	// Sort is MachineSortArtifactBytes, or empty to list the most
+	// recently enrolled machines first
+	Sort string
+
+	Limit  int
+	Offset int
+}
+
+// MachineSortArtifactBytes sorts the machines whose images take up the
+// most space first
+const MachineSortArtifactBytes = "artifact_bytes"
+
+// staleBuildCondition matches machines whose configuration has changed
+// since their last successful build, as Machine.BuildIsStale does
+const staleBuildCondition = `(last_build_id IS NOT NULL AND built_config_hash <> '' AND config_hash <> built_config_hash)`
+
+// machineSummaryColumns selects a MachineSummary, pulling the few hardware
+// fields it needs out of the JSON in the database
+const machineSummaryColumns = `
+	id, service_tag, mac_address, status, hostname, description,
+	json_extract(hardware, '$.manufacturer'), json_extract(hardware, '$.model'),
+	json_extract(hardware, '$.cpu.model'), json_extract(hardware, '$.cpu.cores'),
+	json_extract(hardware, '$.memory.total_gb'), json_array_length(hardware, '$.disks'),
+	json_array_length(hardware, '$.gpus'), json_extract(hardware, '$.gpus[0].model'),
+	COALESCE(nixos_config, '') <> '', current_ip, current_ip_updated_at, deploy_mode,
+	json_extract(bmc_info, '$.enabled'), bmc_health, bmc_unreachable,
+	last_build_id, last_build_time, enrolled_at, updated_at, last_seen_at,
+	decommissioned_at, tags, deleted_at, datacenter, rack, rack_unit,
+	power_state, power_state_updated_at, owner_user_id, metadata,
+	hardware_refresh_requested_at, ` + staleBuildCondition + `, is_virtual,
+	` + machineArtifactBytes + `
+`
+
+const postgresMachineSummaryColumns = `
+	id, service_tag, mac_address, status, hostname, description,
+	hardware->>'manufacturer', hardware->>'model',
+	hardware->'cpu'->>'model', (hardware->'cpu'->>'cores')::int,
+	(hardware->'memory'->>'total_gb')::float8,
+	CASE WHEN jsonb_typeof(hardware->'disks') = 'array' THEN jsonb_array_length(hardware->'disks') ELSE 0 END,
+	CASE WHEN jsonb_typeof(hardware->'gpus') = 'array' THEN jsonb_array_length(hardware->'gpus') ELSE 0 END,
+	hardware->'gpus'->0->>'model',
+	COALESCE(nixos_config, '') <> '', current_ip, current_ip_updated_at, deploy_mode,
+	(bmc_info->>'enabled')::boolean, bmc_health, bmc_unreachable,
+	last_build_id, last_build_time, enrolled_at, updated_at, last_seen_at,
+	decommissioned_at, tags, deleted_at, datacenter, rack, rack_unit,
+	power_state, power_state_updated_at, owner_user_id, metadata,
+	hardware_refresh_requested_at, ` + staleBuildCondition + `, is_virtual,
+	` + machineArtifactBytes + `
+`
+
+// ListMachineSummaries lists machines matching a filter without loading
+// their hardware details, NixOS configurations, or BMC credentials. An empty
+// filter lists all machines.
+func (db *DB) ListMachineSummaries(filter MachineFilter) ([]*models.MachineSummary, error) {
+	columns := machineSummaryColumns
+	if db.driver == "postgres" {
+		columns = postgresMachineSummaryColumns
+	}
+	columns += ", " + effectiveOwnershipSelect + " "
+
+	where, args := db.machineFilterClause(filter)
+	rows, err := db.Query(`SELECT`+columns+`FROM machines`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machines: %w", err)
+	}
+	defer rows.Close()
+
+	var machines []*models.MachineSummary
+	for rows.Next() {
+		m := &models.MachineSummary{}
+		var tagsJSON []byte
+		var hostname, description, manufacturer, model, cpuModel, gpuModel, currentIP, deployMode, bmcHealth, lastBuildID sql.NullString
+		var cpuCores, diskCount, gpuCount sql.NullInt64
+		var memoryGB sql.NullFloat64
+		var bmcEnabled sql.NullBool
+		var lastBuildTime, lastSeenAt, decommissionedAt, deletedAt, powerStateUpdatedAt, currentIPUpdatedAt, hardwareRefresh sql.NullTime
+		var datacenter, rack, powerState, ownerUserID sql.NullString
+		var metadataJSON jsonColumn
+		var rackUnit sql.NullInt64
+		var ownership models.Ownership
+
+		err := rows.Scan(
+			&m.ID,
+			&m.ServiceTag,
+			&m.MACAddress,
+			&m.Status,
+			&hostname,
+			&description,
+			&manufacturer,
+			&model,
+			&cpuModel,
+			&cpuCores,
+			&memoryGB,
+			&diskCount,
+			&gpuCount,
+			&gpuModel,
+			&m.HasConfig,
+			&currentIP,
+			&currentIPUpdatedAt,
+			&deployMode,
+			&bmcEnabled,
+			&bmcHealth,
+			&m.BMCUnreachable,
+			&lastBuildID,
+			&lastBuildTime,
+			&m.EnrolledAt,
+			&m.UpdatedAt,
+			&lastSeenAt,
+			&decommissionedAt,
+			&tagsJSON,
+			&deletedAt,
+			&datacenter,
+			&rack,
+			&rackUnit,
+			&powerState,
+			&powerStateUpdatedAt,
+			&ownerUserID,
+			&metadataJSON,
+			&hardwareRefresh,
+			&m.StaleBuild,
+			&m.Virtual,
+			&m.ArtifactBytes,
+			&ownership.Team,
+			&ownership.ContactEmail,
+			&ownership.SlackChannel,
+			&ownership.Environment,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan machine: %w", err)
+		}
+
+		m.Hostname = hostname.String
+		m.Description = description.String
+		m.Manufacturer = manufacturer.String
+		m.Model = model.String
+		m.CPUModel = cpuModel.String
+		m.CPUCores = int(cpuCores.Int64)
+		m.MemoryGB = memoryGB.Float64
+		m.DiskCount = int(diskCount.Int64)
+		m.GPUCount = int(gpuCount.Int64)
+		m.GPUModel = gpuModel.String
+		m.CurrentIP = currentIP.String
+		if currentIPUpdatedAt.Valid {
+			m.CurrentIPUpdatedAt = &currentIPUpdatedAt.Time
+		}
+		m.DeployMode = deployMode.String
+		m.BMCEnabled = bmcEnabled.Bool
+		m.BMCHealth = bmcHealth.String
+		if lastBuildID.Valid {
+			m.LastBuildID = &lastBuildID.String
+		}
+		if lastBuildTime.Valid {
+			m.LastBuildTime = &lastBuildTime.Time
+		}
+		if lastSeenAt.Valid {
+			m.LastSeenAt = &lastSeenAt.Time
+		}
+		if decommissionedAt.Valid {
+			m.DecommissionedAt = &decommissionedAt.Time
+		}
+		if deletedAt.Valid {
+			m.DeletedAt = &deletedAt.Time
+		}
+		if hardwareRefresh.Valid {
+			m.HardwareRefreshRequestedAt = &hardwareRefresh.Time
+		}
+		m.Location = scanLocation(datacenter, rack, rackUnit)
+		m.PowerState, m.PowerStateUpdatedAt = scanPowerState(powerState, powerStateUpdatedAt)
+		m.OwnerUserID = ownerUserID.String
+		m.EffectiveOwnership = ownershipOrNil(ownership)
+		if err := metadataJSON.Unmarshal(&m.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+		}
+		if m.Tags, err = unmarshalTags(tagsJSON); err != nil {
+			return nil, err
+		}
+
+		machines = append(machines, m)
+	}
+
+	return machines, rows.Err()
+}
+
+// machineFilterClause builds the WHERE, ORDER BY, and LIMIT clauses for a
+// machine filter, and their arguments
+func (db *DB) machineFilterClause(filter MachineFilter) (string, []interface{}) {
+	clause := " WHERE deleted_at IS NULL"
+	if filter.Trashed {
+		clause = " WHERE deleted_at IS NOT NULL"
+	}
+
+	args := []interface{}{}
+	argIdx := 1
+
+	// Add status filter
+	if filter.Status != "" {
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(" AND status = $%d", argIdx)
+		} else {
+			clause += " AND status = ?"
+		}
+		args = append(args, filter.Status)
+		argIdx++
+	}
+
+	// Add hardware compliance filter
+	if filter.Compliance != "" {
+		status := filter.Compliance
+		if status == models.ComplianceUnchecked {
+			status = ""
+		}
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(" AND compliance_status = $%d", argIdx)
+		} else {
+			clause += " AND compliance_status = ?"
+		}
+		args = append(args, status)
+		argIdx++
+	}
+
+	if filter.StaleBuild != nil {
+		if *filter.StaleBuild {
+			clause += " AND " + staleBuildCondition
+		} else {
+			clause += " AND NOT " + staleBuildCondition
+		}
+	}
+
+	if filter.Virtual != nil {
+		if *filter.Virtual {
+			clause += " AND is_virtual"
+		} else {
+			clause += " AND NOT is_virtual"
+		}
+	}
+
+	// Leave out other users' machines
+	if filter.VisibleTo != "" {
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(" AND (owner_user_id IS NULL OR owner_user_id = '' OR owner_user_id = $%d)", argIdx)
+		} else {
+			clause += " AND (owner_user_id IS NULL OR owner_user_id = '' OR owner_user_id = ?)"
+		}
+		args = append(args, filter.VisibleTo)
+		argIdx++
+	}
+
+	// Add location filters (exact match)
+	for _, location := range []struct{ column, value string }{
+		{"datacenter", filter.Datacenter},
+		{"rack", filter.Rack},
+	} {
+		if location.value == "" {
+			continue
+		}
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(" AND %s = $%d", location.column, argIdx)
+		} else {
+			clause += " AND " + location.column + " = ?"
+		}
+		args = append(args, location.value)
+		argIdx++
+	}
+
+	// Add ownership filters, on the values machines inherit from their
+	// groups as well as their own
+	for _, owner := range []struct{ column, value string }{
+		{"owner_team", filter.OwnerTeam},
+		{"environment", filter.Environment},
+	} {
+		if owner.value == "" {
+			continue
+		}
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(" AND %s = $%d", effectiveOwnershipColumn(owner.column), argIdx)
+		} else {
+			clause += " AND " + effectiveOwnershipColumn(owner.column) + " = ?"
+		}
+		args = append(args, owner.value)
+		argIdx++
+	}
+	if filter.Unowned {
+		clause += " AND " + effectiveOwnershipColumn("owner_team") + " = '' AND " + effectiveOwnershipColumn("owner_email") + " = ''"
+	}
+
+	// Add hostname filter (partial match)
+	if filter.Hostname != "" {
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(" AND hostname ILIKE $%d", argIdx)
+			args = append(args, "%"+filter.Hostname+"%")
+		} else {
+			clause += " AND hostname LIKE ?"
+			args = append(args, "%"+filter.Hostname+"%")
 		}
 		argIdx++
 	}
@@ -435,10 +895,10 @@ func (db *DB) SearchMachines(filter MachineFilter) ([]*models.Machine, error) {
 	// Add service tag filter (partial match)
 	if filter.ServiceTag != "" {
 		if db.driver == "postgres" {
-			query += fmt.Sprintf(" AND service_tag ILIKE $%d", argIdx)
+			clause += fmt.Sprintf(" AND service_tag ILIKE $%d", argIdx)
 			args = append(args, "%"+filter.ServiceTag+"%")
 		} else {
-			query += " AND service_tag LIKE ?"
+			clause += " AND service_tag LIKE ?"
 			args = append(args, "%"+filter.ServiceTag+"%")
 		}
 		argIdx++
@@ -447,22 +907,46 @@ func (db *DB) SearchMachines(filter MachineFilter) ([]*models.Machine, error) {
 	// Add MAC address filter (partial match)
 	if filter.MACAddress != "" {
 		if db.driver == "postgres" {
-			query += fmt.Sprintf(" AND mac_address ILIKE $%d", argIdx)
+			clause += fmt.Sprintf(" AND mac_address ILIKE $%d", argIdx)
 			args = append(args, "%"+filter.MACAddress+"%")
 		} else {
-			query += " AND mac_address LIKE ?"
+			clause += " AND mac_address LIKE ?"
 			args = append(args, "%"+filter.MACAddress+"%")
 		}
 		argIdx++
 	}
 
+	// Add IP address filter, on the current IP and the BMC's address, in
+	// each form stored addresses may be spelled in
+	if filter.IPAddress != "" {
+		forms := models.IPForms(filter.IPAddress)
+		if forms == nil {
+			clause += " AND 1 = 0"
+		} else if db.driver == "postgres" {
+			placeholders := make([]string, len(forms))
+			for i, form := range forms {
+				placeholders[i] = fmt.Sprintf("$%d", argIdx)
+				args = append(args, form)
+				argIdx++
+			}
+			in := strings.Join(placeholders, ", ")
+			clause += fmt.Sprintf(" AND (LOWER(current_ip) IN (%s) OR LOWER(bmc_info->>'ip_address') IN (%s))", in, in)
+		} else {
+			in := strings.TrimSuffix(strings.Repeat("?, ", len(forms)), ", ")
+			clause += fmt.Sprintf(" AND (LOWER(current_ip) IN (%s) OR LOWER(json_extract(bmc_info, '$.ip_address')) IN (%s))", in, in)
+			for _, form := range append(forms, forms...) {
+				args = append(args, form)
+			}
+		}
+	}
+
 	// Add manufacturer filter (JSON field search)
 	if filter.Manufacturer != "" {
 		if db.driver == "postgres" {
-			query += fmt.Sprintf(" AND hardware->>'manufacturer' ILIKE $%d", argIdx)
+			clause += fmt.Sprintf(" AND hardware->>'manufacturer' ILIKE $%d", argIdx)
 			args = append(args, "%"+filter.Manufacturer+"%")
 		} else {
-			query += " AND json_extract(hardware, '$.manufacturer') LIKE ?"
+			clause += " AND json_extract(hardware, '$.manufacturer') LIKE ?"
 			args = append(args, "%"+filter.Manufacturer+"%")
 		}
 		argIdx++
@@ -471,122 +955,441 @@ func (db *DB) SearchMachines(filter MachineFilter) ([]*models.Machine, error) {
 	// Add model filter (JSON field search)
 	if filter.Model != "" {
 		if db.driver == "postgres" {
-			query += fmt.Sprintf(" AND hardware->>'model' ILIKE $%d", argIdx)
+			clause += fmt.Sprintf(" AND hardware->>'model' ILIKE $%d", argIdx)
 			args = append(args, "%"+filter.Model+"%")
 		} else {
-			query += " AND json_extract(hardware, '$.model') LIKE ?"
+			clause += " AND json_extract(hardware, '$.model') LIKE ?"
 			args = append(args, "%"+filter.Model+"%")
 		}
 		argIdx++
 	}
 
-	// Add general search (searches across multiple fields)
+	// Add general search (searches across multiple fields). An IP address
+	// is searched for as current IPs are stored.
 	if filter.Search != "" {
+		search := filter.Search
+		if ip, err := models.NormalizeIP(search); err == nil {
+			search = ip
+		}
 		if db.driver == "postgres" {
-			query += fmt.Sprintf(" AND (hostname ILIKE $%d OR service_tag ILIKE $%d OR mac_address ILIKE $%d OR description ILIKE $%d)", argIdx, argIdx, argIdx, argIdx)
-			args = append(args, "%"+filter.Search+"%")
+			clause += fmt.Sprintf(" AND (hostname ILIKE $%d OR service_tag ILIKE $%d OR mac_address ILIKE $%d OR description ILIKE $%d OR current_ip ILIKE $%d)", argIdx, argIdx, argIdx, argIdx, argIdx)
+			args = append(args, "%"+search+"%")
 		} else {
-			query += " AND (hostname LIKE ? OR service_tag LIKE ? OR mac_address LIKE ? OR description LIKE ?)"
-			args = append(args, "%"+filter.Search+"%", "%"+filter.Search+"%", "%"+filter.Search+"%", "%"+filter.Search+"%")
+			clause += " AND (hostname LIKE ? OR service_tag LIKE ? OR mac_address LIKE ? OR description LIKE ? OR current_ip LIKE ?)"
+			args = append(args, "%"+search+"%", "%"+search+"%", "%"+search+"%", "%"+search+"%", "%"+search+"%")
 		}
 		argIdx++
 	}
 
+	// Add tag filter. Tags are stored as a JSON array and never contain
+	// quotes, so on sqlite a quoted tag matches only that exact element.
+	if len(filter.Tags) > 0 {
+		if db.driver == "postgres" {
+			tagsJSON, _ := json.Marshal(filter.Tags)
+			clause += fmt.Sprintf(" AND tags @> $%d::jsonb", argIdx)
+			args = append(args, string(tagsJSON))
+			argIdx++
+		} else {
+			for _, tag := range filter.Tags {
+				clause += ` AND tags LIKE ? ESCAPE '\'`
+				args = append(args, `%"`+escapeLike(tag)+`"%`)
+			}
+		}
+	}
+
+	// Add GPU filter, counting the GPUs that match. Machines without a
+	// gpus array have none.
+	if filter.GPUVendor != "" || filter.GPUModel != "" || filter.MinGPUCount > 0 {
+		minCount := max(filter.MinGPUCount, 1)
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(` AND (
+				SELECT COUNT(*) FROM jsonb_array_elements(
+					CASE WHEN jsonb_typeof(hardware->'gpus') = 'array' THEN hardware->'gpus' ELSE '[]'::jsonb END
+				) AS gpu
+				WHERE jsonb_typeof(gpu) = 'object'
+				AND COALESCE(gpu->>'vendor', '') ILIKE $%d AND COALESCE(gpu->>'model', '') ILIKE $%d
+			) >= $%d`, argIdx, argIdx+1, argIdx+2)
+			argIdx += 3
+		} else {
+			clause += ` AND (
+				SELECT COUNT(*) FROM json_each(hardware, '$.gpus')
+				WHERE type = 'object'
+				AND COALESCE(json_extract(value, '$.vendor'), '') LIKE ?
+				AND COALESCE(json_extract(value, '$.model'), '') LIKE ?
+			) >= ?`
+		}
+		args = append(args, "%"+filter.GPUVendor+"%", "%"+filter.GPUModel+"%", minCount)
+	}
+
+	// Add metadata filters. Paths are made of identifier keys, so they are
+	// safe to pass as JSON paths. sqlite extracts booleans as 1 and 0, so
+	// they are matched by type instead.
+	paths := make([]string, 0, len(filter.Metadata))
+	for path := range filter.Metadata {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if db.driver == "postgres" {
+			clause += fmt.Sprintf(" AND metadata #>> $%d::text[] = $%d", argIdx, argIdx+1)
+			args = append(args, "{"+strings.ReplaceAll(path, ".", ",")+"}", filter.Metadata[path])
+			argIdx += 2
+		} else {
+			clause += ` AND CASE json_type(metadata, ?)
+				WHEN 'true' THEN 'true' WHEN 'false' THEN 'false'
+				ELSE CAST(json_extract(metadata, ?) AS TEXT) END = ?`
+			args = append(args, "$."+path, "$."+path, filter.Metadata[path])
+		}
+	}
+
 	// Add ordering
-	query += " ORDER BY enrolled_at DESC"
+	if filter.Trashed {
+		clause += " ORDER BY deleted_at DESC"
+	} else if filter.Sort == MachineSortArtifactBytes {
+		clause += " ORDER BY " + machineArtifactBytes + " DESC, enrolled_at DESC"
+	} else {
+		clause += " ORDER BY enrolled_at DESC"
+	}
 
 	// Add pagination
 	if filter.Limit > 0 {
 		if db.driver == "postgres" {
-			query += fmt.Sprintf(" LIMIT $%d", argIdx)
+			clause += fmt.Sprintf(" LIMIT $%d", argIdx)
 			args = append(args, filter.Limit)
 			argIdx++
 
 			if filter.Offset > 0 {
-				query += fmt.Sprintf(" OFFSET $%d", argIdx)
+				clause += fmt.Sprintf(" OFFSET $%d", argIdx)
 				args = append(args, filter.Offset)
 			}
 		} else {
-			query += " LIMIT ?"
+			clause += " LIMIT ?"
 			args = append(args, filter.Limit)
 
 			if filter.Offset > 0 {
-				query += " OFFSET ?"
+				clause += " OFFSET ?"
 				args = append(args, filter.Offset)
 			}
 		}
 	}
 
+	return clause, args
+}
+
+// SearchMachines searches machines with advanced filtering
+func (db *DB) SearchMachines(filter MachineFilter) ([]*models.Machine, error) {
+	query := `SELECT` + machineColumns + `FROM machines`
+
+	where, args := db.machineFilterClause(filter)
+	query += where
+
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to search machines: %w", err)
 	}
 	defer rows.Close()
 
+	return db.scanMachines(rows)
+}
+
+// machineColumns are the columns scanMachine reads, in order. Every query
+// returning whole machines selects them, so none can miss a column; like
+// ownershipSelect they must be selected from machines without an alias.
+var machineColumns = `
+	id, service_tag, mac_address, status, hostname, description,
+	hardware, nixos_config, last_build_id, last_build_time,
+	enrolled_at, updated_at, last_seen_at, bmc_info,
+	bmc_firmware, bmc_health, bmc_unreachable, bmc_checked_at,
+	current_ip, current_ip_updated_at, boot_mode, decommissioned_at, deploy_mode, ssh_address,
+	ssh_user, ssh_key, tags, wol_enabled, wol_mac_address,
+	datacenter, rack, rack_unit, power_state, power_state_updated_at,
+	owner_user_id, claimed_at, metadata, deleted_at, identity_exempt, template_id, template_variables, hardware_compliance, config_lint,
+	hardware_refresh_requested_at, build_target, config_hash, config_updated_at, built_config_hash,
+	is_virtual, dry_run_builds, ` + ownershipSelect + `
+`
+
+// scanMachine reads a row of machineColumns, converting nullable columns
+// to zero values and decoding the JSON ones
+func (db *DB) scanMachine(row rowScanner) (*models.Machine, error) {
+	machine := &models.Machine{}
+	var hardwareJSON, bmcJSON, tagsJSON []byte
+	var hostname, description, nixosConfig, bmcFirmware, bmcHealth, currentIP, bootMode, deployMode, sshAddress, sshUser, sshKey, wolMAC sql.NullString
+	var wolEnabled bool
+	var datacenter, rack, powerState, ownerUserID sql.NullString
+	var metadataJSON, templateVariables, compliance, configLint jsonColumn
+	var rackUnit sql.NullInt64
+	var ownership ownershipRow
+	var lastBuildID sql.NullString
+	var lastBuildTime, lastSeenAt, bmcCheckedAt, powerStateUpdatedAt, claimedAt, decommissionedAt, deletedAt, currentIPUpdatedAt, hardwareRefresh, configUpdatedAt sql.NullTime
+
+	err := row.Scan(
+		&machine.ID,
+		&machine.ServiceTag,
+		&machine.MACAddress,
+		&machine.Status,
+		&hostname,
+		&description,
+		&hardwareJSON,
+		&nixosConfig,
+		&lastBuildID,
+		&lastBuildTime,
+		&machine.EnrolledAt,
+		&machine.UpdatedAt,
+		&lastSeenAt,
+		&bmcJSON,
+		&bmcFirmware,
+		&bmcHealth,
+		&machine.BMCUnreachable,
+		&bmcCheckedAt,
+		&currentIP,
+		&currentIPUpdatedAt,
+		&bootMode,
+		&decommissionedAt,
+		&deployMode,
+		&sshAddress,
+		&sshUser,
+		&sshKey,
+		&tagsJSON,
+		&wolEnabled,
+		&wolMAC,
+		&datacenter,
+		&rack,
+		&rackUnit,
+		&powerState,
+		&powerStateUpdatedAt,
+		&ownerUserID,
+		&claimedAt,
+		&metadataJSON,
+		&deletedAt,
+		&machine.IdentityExempt,
+		&machine.TemplateID,
+		&templateVariables,
+		&compliance,
+		&configLint,
+		&hardwareRefresh,
+		&machine.BuildTarget,
+		&machine.ConfigHash,
+		&configUpdatedAt,
+		&machine.BuiltConfigHash,
+		&machine.Virtual,
+		&machine.DryRunBuilds,
+		&ownership.own.Team,
+		&ownership.own.ContactEmail,
+		&ownership.own.SlackChannel,
+		&ownership.own.Environment,
+		&ownership.effective.Team,
+		&ownership.effective.ContactEmail,
+		&ownership.effective.SlackChannel,
+		&ownership.effective.Environment,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert nullable fields
+	if hostname.Valid {
+		machine.Hostname = hostname.String
+	}
+	if description.Valid {
+		machine.Description = description.String
+	}
+	if nixosConfig.Valid {
+		machine.NixOSConfig = nixosConfig.String
+	}
+	if lastBuildID.Valid {
+		id := lastBuildID.String
+		machine.LastBuildID = &id
+	}
+	if lastBuildTime.Valid {
+		machine.LastBuildTime = &lastBuildTime.Time
+	}
+	if lastSeenAt.Valid {
+		machine.LastSeenAt = &lastSeenAt.Time
+	}
+	if bmcFirmware.Valid {
+		machine.BMCFirmware = bmcFirmware.String
+	}
+	if bmcHealth.Valid {
+		machine.BMCHealth = bmcHealth.String
+	}
+	if bmcCheckedAt.Valid {
+		machine.BMCCheckedAt = &bmcCheckedAt.Time
+	}
+	if currentIP.Valid {
+		machine.CurrentIP = currentIP.String
+	}
+	if currentIPUpdatedAt.Valid {
+		machine.CurrentIPUpdatedAt = &currentIPUpdatedAt.Time
+	}
+	if bootMode.Valid {
+		machine.BootMode = bootMode.String
+	}
+	if decommissionedAt.Valid {
+		machine.DecommissionedAt = &decommissionedAt.Time
+	}
+	if deletedAt.Valid {
+		machine.DeletedAt = &deletedAt.Time
+	}
+	if deployMode.Valid {
+		machine.DeployMode = deployMode.String
+	}
+	if sshAddress.Valid {
+		machine.SSHAddress = sshAddress.String
+	}
+	if sshUser.Valid {
+		machine.SSHUser = sshUser.String
+	}
+	if sshKey.Valid {
+		machine.SSHKey = sshKey.String
+	}
+	if wolEnabled || wolMAC.String != "" {
+		machine.WakeOnLAN = &models.WakeOnLAN{Enabled: wolEnabled, MACAddress: wolMAC.String}
+	}
+	machine.Location = scanLocation(datacenter, rack, rackUnit)
+	machine.Ownership, machine.EffectiveOwnership = ownership.owned(), ownership.effectiveOwnership()
+	machine.PowerState, machine.PowerStateUpdatedAt = scanPowerState(powerState, powerStateUpdatedAt)
+	machine.OwnerUserID = ownerUserID.String
+	if claimedAt.Valid {
+		machine.ClaimedAt = &claimedAt.Time
+	}
+	if hardwareRefresh.Valid {
+		machine.HardwareRefreshRequestedAt = &hardwareRefresh.Time
+	}
+	if err := metadataJSON.Unmarshal(&machine.Metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+	if err := templateVariables.Unmarshal(&machine.TemplateVariables); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal template variables: %w", err)
+	}
+	if err := compliance.Unmarshal(&machine.HardwareCompliance); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal hardware compliance: %w", err)
+	}
+	if err := configLint.Unmarshal(&machine.ConfigLint); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config lint: %w", err)
+	}
+
+	if err := json.Unmarshal(hardwareJSON, &machine.Hardware); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal hardware: %w", err)
+	}
+	machine.HardwareCompleteness = machine.Hardware.Completeness()
+	if configUpdatedAt.Valid {
+		machine.ConfigUpdatedAt = &configUpdatedAt.Time
+	}
+	machine.StaleBuild = machine.BuildIsStale()
+
+	if machine.Tags, err = unmarshalTags(tagsJSON); err != nil {
+		return nil, err
+	}
+
+	// Unmarshal BMC info if present
+	if len(bmcJSON) > 0 {
+		bmcInfo, err := db.unmarshalBMCInfo(bmcJSON)
+		if err != nil {
+			return nil, err
+		}
+		machine.BMCInfo = bmcInfo
+	}
+
+	return machine, nil
+}
+
+// scanMachines reads every row of machineColumns
+func (db *DB) scanMachines(rows *sql.Rows) ([]*models.Machine, error) {
 	var machines []*models.Machine
 	for rows.Next() {
-		machine := &models.Machine{}
-		var hardwareJSON, bmcJSON []byte
-		var hostname, description, nixosConfig sql.NullString
-		var lastBuildID sql.NullString
-		var lastBuildTime, lastSeenAt sql.NullTime
-
-		err := rows.Scan(
-			&machine.ID,
-			&machine.ServiceTag,
-			&machine.MACAddress,
-			&machine.Status,
-			&hostname,
-			&description,
-			&hardwareJSON,
-			&nixosConfig,
-			&lastBuildID,
-			&lastBuildTime,
-			&machine.EnrolledAt,
-			&machine.UpdatedAt,
-			&lastSeenAt,
-			&bmcJSON,
-		)
+		machine, err := db.scanMachine(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan machine: %w", err)
 		}
+		machines = append(machines, machine)
+	}
 
-		// Convert nullable fields
-		if hostname.Valid {
-			machine.Hostname = hostname.String
-		}
-		if description.Valid {
-			machine.Description = description.String
-		}
-		if nixosConfig.Valid {
-			machine.NixOSConfig = nixosConfig.String
-		}
-		if lastBuildID.Valid {
-			id := lastBuildID.String
-			machine.LastBuildID = &id
-		}
-		if lastBuildTime.Valid {
-			machine.LastBuildTime = &lastBuildTime.Time
-		}
-		if lastSeenAt.Valid {
-			machine.LastSeenAt = &lastSeenAt.Time
-		}
+	return machines, rows.Err()
+}
 
-		if err := json.Unmarshal(hardwareJSON, &machine.Hardware); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal hardware: %w", err)
-		}
+// marshalTags encodes a machine's tags as a JSON array, or NULL if it has
+// none
+func marshalTags(tags []string) (interface{}, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tags: %w", err)
+	}
+	return string(data), nil
+}
 
-		// Unmarshal BMC info if present
-		if len(bmcJSON) > 0 {
-			var bmcInfo models.BMCInfo
-			if err := json.Unmarshal(bmcJSON, &bmcInfo); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal bmc_info: %w", err)
-			}
-			machine.BMCInfo = &bmcInfo
-		}
+func unmarshalTags(data []byte) ([]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var tags []string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+	}
+	return tags, nil
+}
 
-		machines = append(machines, machine)
+// scanLocation builds a machine's location from its columns, or nil if it
+// has none
+func scanLocation(datacenter, rack sql.NullString, rackUnit sql.NullInt64) *models.Location {
+	if datacenter.String == "" && rack.String == "" && rackUnit.Int64 == 0 {
+		return nil
+	}
+	return &models.Location{
+		Datacenter: datacenter.String,
+		Rack:       rack.String,
+		RackUnit:   int(rackUnit.Int64),
+	}
+}
+
+// scanPowerState converts the power state columns, which are unset until a
+// machine's power state is first read
+func scanPowerState(state sql.NullString, updatedAt sql.NullTime) (string, *time.Time) {
+	if !state.Valid || state.String == "" {
+		return models.PowerStateUnknown, nil
+	}
+	if !updatedAt.Valid {
+		return state.String, nil
+	}
+	return state.String, &updatedAt.Time
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// hashMachineConfigs sets the config hash of machines whose configuration
+// was saved before machines had one
+func (db *DB) hashMachineConfigs() error {
+	rows, err := db.Query("SELECT id, nixos_config FROM machines WHERE config_hash = '' AND COALESCE(nixos_config, '') <> ''")
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var id, config string
+		if err := rows.Scan(&id, &config); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = models.ConfigHash(config)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	return machines, nil
+	query := "UPDATE machines SET config_hash = ? WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE machines SET config_hash = $1 WHERE id = $2"
+	}
+	for id, hash := range hashes {
+		if _, err := db.Exec(query, hash, id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
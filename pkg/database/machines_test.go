@@ -0,0 +1,217 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// newFullMachine creates a machine with every column of machineColumns set
+func newFullMachine(t *testing.T, db *DB) *models.Machine {
+	t.Helper()
+
+	machine, err := db.CreateMachine(models.EnrollmentRequest{
+		ServiceTag: "FULL001",
+		MACAddress: "00:11:22:33:44:55",
+		BootMode:   "uefi",
+		Hardware: models.HardwareInfo{
+			Manufacturer: "Dell Inc.",
+			Model:        "PowerEdge R650",
+			SerialNumber: "SN-FULL001",
+			Disks:        []models.DiskInfo{{Device: "/dev/sda"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	buildID := "build-1"
+	machine.Status = models.StatusReady
+	machine.Hostname = "full-01"
+	machine.Description = "Every column set"
+	machine.NixOSConfig = "{ ... }: { }"
+	machine.LastBuildID = &buildID
+	machine.LastBuildTime = &now
+	machine.BMCInfo = &models.BMCInfo{
+		IPAddress: "10.0.0.50",
+		Username:  "root",
+		Password:  "calvin",
+		Type:      "IPMI",
+		Port:      623,
+		Enabled:   true,
+		Interface: "lanplus",
+		Channel:   1,
+	}
+	machine.Tags = []string{"gpu", "rack-a"}
+	machine.Location = &models.Location{Datacenter: "dc1", Rack: "a1", RackUnit: 12}
+	machine.WakeOnLAN = &models.WakeOnLAN{Enabled: true, MACAddress: "00:11:22:33:44:56"}
+	machine.Ownership = &models.Ownership{Team: "platform", Environment: "prod"}
+	machine.Metadata = map[string]interface{}{"asset": "A-1"}
+	machine.TemplateVariables = map[string]string{"role": "worker"}
+	machine.DeployMode = models.DeployModeNetboot
+	machine.BuildTarget = "toplevel"
+	if err := db.UpdateMachine(machine); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateMachineBMCStatus(machine.ID, "2.10", "ok", false, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.UpdateMachinePowerState(machine.ID, "on", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpdateMachineCurrentIP(machine.MACAddress, "10.0.1.5"); err != nil {
+		t.Fatal(err)
+	}
+	return machine
+}
+
+// TestMachineQueriesAgree reads one machine through every query that
+// returns whole machines and checks each gives the same struct, so none
+// can drop a column the others read
+func TestMachineQueriesAgree(t *testing.T) {
+	db := newTestDB(t)
+	machine := newFullMachine(t, db)
+
+	group, err := db.CreateGroup("full", "", nil, nil, nil, false, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddMachineToGroup(group.ID, machine.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := db.GetMachine(machine.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.BMCInfo == nil || want.BMCInfo.Password != "calvin" || want.Location == nil || want.WakeOnLAN == nil || want.PowerState != "on" || want.CurrentIP != "10.0.1.5" {
+		t.Fatalf("GetMachine = %+v, want every column read", want)
+	}
+
+	only := func(name string, machines []*models.Machine, err error) *models.Machine {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(machines) != 1 {
+			t.Fatalf("%s returned %d machines, want 1", name, len(machines))
+		}
+		return machines[0]
+	}
+
+	got := map[string]*models.Machine{}
+	got["GetMachineByServiceTag"], err = db.GetMachineByServiceTag(machine.ServiceTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machines, err := db.ListMachines()
+	got["ListMachines"] = only("ListMachines", machines, err)
+	machines, err = db.SearchMachines(MachineFilter{ServiceTag: machine.ServiceTag})
+	got["SearchMachines"] = only("SearchMachines", machines, err)
+	machines, err = db.GetGroupMachines(group.ID)
+	got["GetGroupMachines"] = only("GetGroupMachines", machines, err)
+
+	for name, machine := range got {
+		if !reflect.DeepEqual(machine, want) {
+			t.Errorf("%s differs from GetMachine:\n got %+v\nwant %+v", name, machine, want)
+		}
+	}
+
+	// The trash is read by its own queries
+	if trashed, err := db.TrashMachine(machine.ID); err != nil || !trashed {
+		t.Fatalf("TrashMachine = %v, %v", trashed, err)
+	}
+	trashed, err := db.GetTrashedMachine(machine.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trashed == nil {
+		t.Fatal("machine not in the trash")
+	}
+	if trashed.DeletedAt == nil || trashed.BMCInfo == nil || !reflect.DeepEqual(trashed.BMCInfo, want.BMCInfo) {
+		t.Errorf("GetTrashedMachine = %+v", trashed)
+	}
+	byTag, err := db.GetTrashedMachineByServiceTag(machine.ServiceTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machines, err = db.SearchMachines(MachineFilter{Trashed: true})
+	got = map[string]*models.Machine{
+		"GetTrashedMachineByServiceTag": byTag,
+		"SearchMachines(Trashed)":       only("SearchMachines(Trashed)", machines, err),
+	}
+	for name, machine := range got {
+		if !reflect.DeepEqual(machine, trashed) {
+			t.Errorf("%s differs from GetTrashedMachine:\n got %+v\nwant %+v", name, machine, trashed)
+		}
+	}
+}
+
+// seedMachines enrolls n configured machines with an inventory and a
+// configuration about the size of a real server's
+func seedMachines(b *testing.B, db *DB, n int) {
+	b.Helper()
+
+	hardware := models.HardwareInfo{
+		Manufacturer: "Dell Inc.",
+		Model:        "PowerEdge R650",
+		BIOSVersion:  "1.13.2",
+		CPU:          models.CPUInfo{Model: "Intel(R) Xeon(R) Gold 6338 CPU @ 2.00GHz", Cores: 64, Threads: 128, Sockets: 2, Architecture: "x86_64"},
+		Memory:       models.MemoryInfo{TotalBytes: 512 << 30, TotalGB: 512},
+	}
+	for i := 0; i < 16; i++ {
+		hardware.Memory.Modules = append(hardware.Memory.Modules, models.MemorySlot{Slot: fmt.Sprintf("DIMM.Socket.A%d", i), SizeBytes: 32 << 30, Type: "DDR4", Speed: 3200})
+	}
+	for i := 0; i < 8; i++ {
+		hardware.Disks = append(hardware.Disks, models.DiskInfo{Device: fmt.Sprintf("/dev/nvme%dn1", i), Model: "Dell Ent NVMe P5600 MU U.2 3.2TB", SizeBytes: 3200 << 30, Type: "NVMe", Serial: fmt.Sprintf("PHAB%08d", i)})
+	}
+	for i := 0; i < 4; i++ {
+		hardware.NICs = append(hardware.NICs, models.NICInfo{Name: fmt.Sprintf("eno%d", i+1), MACAddress: fmt.Sprintf("b0:7b:25:00:00:%02x", i), Driver: "mlx5_core", Speed: "25Gbps", LinkStatus: "up"})
+	}
+	config := "{ config, pkgs, ... }:\n{\n" + strings.Repeat("  services.openssh.enable = true;\n", 500) + "}\n"
+
+	for i := 0; i < n; i++ {
+		hardware.SerialNumber = fmt.Sprintf("SN%06d", i)
+		machine, err := db.CreateMachine(models.EnrollmentRequest{
+			ServiceTag: fmt.Sprintf("BENCH%05d", i),
+			MACAddress: fmt.Sprintf("02:00:00:00:%02x:%02x", i>>8, i&0xff),
+			Hardware:   hardware,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		machine.Hostname = fmt.Sprintf("node-%05d", i)
+		machine.NixOSConfig = config
+		machine.Status = models.StatusConfigured
+		if err := db.UpdateMachine(machine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkListMachines compares loading every machine in full, as list
+// views used to, with loading their summaries
+func BenchmarkListMachines(b *testing.B) {
+	db := newTestDB(b)
+	seedMachines(b, db, 1000)
+
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.ListMachines(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("summary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.ListMachineSummaries(MachineFilter{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const maintenanceWindowColumns = `
+	id, name, description, scope, scope_id, operations, schedule, duration,
+	starts_at, ends_at, timezone, enabled, created_by, created_at, updated_at
+`
+
+// CreateMaintenanceWindow creates a new maintenance window
+func (db *DB) CreateMaintenanceWindow(window *models.MaintenanceWindow) error {
+	window.ID = uuid.New().String()
+	window.CreatedAt = time.Now().UTC()
+	window.UpdatedAt = window.CreatedAt
+
+	operationsJSON, err := json.Marshal(window.Operations)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO maintenance_windows (id, name, description, scope, scope_id, operations, schedule, duration,
+			starts_at, ends_at, timezone, enabled, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+	`
+
+	if db.driver == "sqlite3" {
+		query = `
+			INSERT INTO maintenance_windows (id, name, description, scope, scope_id, operations, schedule, duration,
+				starts_at, ends_at, timezone, enabled, created_by, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`
+	}
+
+	_, err = db.Exec(query,
+		window.ID,
+		window.Name,
+		window.Description,
+		window.Scope,
+		window.ScopeID,
+		string(operationsJSON),
+		window.Schedule,
+		window.Duration,
+		window.StartsAt,
+		window.EndsAt,
+		window.Timezone,
+		window.Enabled,
+		window.CreatedBy,
+		window.CreatedAt,
+		window.UpdatedAt,
+	)
+
+	return err
+}
+
+// GetMaintenanceWindow retrieves a maintenance window by ID. It returns
+// nil, nil if there is no such window.
+func (db *DB) GetMaintenanceWindow(id string) (*models.MaintenanceWindow, error) {
+	query := `SELECT` + maintenanceWindowColumns + `FROM maintenance_windows WHERE id = $1`
+	if db.driver == "sqlite3" {
+		query = `SELECT` + maintenanceWindowColumns + `FROM maintenance_windows WHERE id = ?`
+	}
+
+	window, err := scanMaintenanceWindow(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return window, err
+}
+
+// ListMaintenanceWindows lists all maintenance windows
+func (db *DB) ListMaintenanceWindows() ([]*models.MaintenanceWindow, error) {
+	return db.queryMaintenanceWindows(`SELECT` + maintenanceWindowColumns + `FROM maintenance_windows ORDER BY name`)
+}
+
+// ListEnabledMaintenanceWindows lists the maintenance windows that are enforced
+func (db *DB) ListEnabledMaintenanceWindows() ([]*models.MaintenanceWindow, error) {
+	return db.queryMaintenanceWindows(`SELECT` + maintenanceWindowColumns + `FROM maintenance_windows WHERE enabled = true ORDER BY name`)
+}
+
+func (db *DB) queryMaintenanceWindows(query string) ([]*models.MaintenanceWindow, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []*models.MaintenanceWindow
+	for rows.Next() {
+		window, err := scanMaintenanceWindow(rows)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+
+	return windows, rows.Err()
+}
+
+// UpdateMaintenanceWindow updates a maintenance window
+func (db *DB) UpdateMaintenanceWindow(window *models.MaintenanceWindow) error {
+	window.UpdatedAt = time.Now().UTC()
+
+	operationsJSON, err := json.Marshal(window.Operations)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE maintenance_windows
+		SET name = $1, description = $2, scope = $3, scope_id = $4, operations = $5, schedule = $6,
+		    duration = $7, starts_at = $8, ends_at = $9, timezone = $10, enabled = $11, updated_at = $12
+		WHERE id = $13
+	`
+
+	if db.driver == "sqlite3" {
+		query = `
+			UPDATE maintenance_windows
+			SET name = ?, description = ?, scope = ?, scope_id = ?, operations = ?, schedule = ?,
+			    duration = ?, starts_at = ?, ends_at = ?, timezone = ?, enabled = ?, updated_at = ?
+			WHERE id = ?
+		`
+	}
+
+	_, err = db.Exec(query,
+		window.Name,
+		window.Description,
+		window.Scope,
+		window.ScopeID,
+		string(operationsJSON),
+		window.Schedule,
+		window.Duration,
+		window.StartsAt,
+		window.EndsAt,
+		window.Timezone,
+		window.Enabled,
+		window.UpdatedAt,
+		window.ID,
+	)
+
+	return err
+}
+
+// DeleteMaintenanceWindow deletes a maintenance window
+func (db *DB) DeleteMaintenanceWindow(id string) error {
+	query := `DELETE FROM maintenance_windows WHERE id = $1`
+	if db.driver == "sqlite3" {
+		query = `DELETE FROM maintenance_windows WHERE id = ?`
+	}
+
+	_, err := db.Exec(query, id)
+	return err
+}
+
+func scanMaintenanceWindow(row rowScanner) (*models.MaintenanceWindow, error) {
+	var window models.MaintenanceWindow
+	var description, scopeID, schedule, createdBy sql.NullString
+	var operationsJSON string
+
+	err := row.Scan(
+		&window.ID,
+		&window.Name,
+		&description,
+		&window.Scope,
+		&scopeID,
+		&operationsJSON,
+		&schedule,
+		&window.Duration,
+		&window.StartsAt,
+		&window.EndsAt,
+		&window.Timezone,
+		&window.Enabled,
+		&createdBy,
+		&window.CreatedAt,
+		&window.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	window.Description = description.String
+	window.ScopeID = scopeID.String
+	window.Schedule = schedule.String
+	window.CreatedBy = createdBy.String
+
+	if err := json.Unmarshal([]byte(operationsJSON), &window.Operations); err != nil {
+		return nil, err
+	}
+
+	return &window, nil
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UpdateMachineMetadata replaces a machine's metadata with the result of
+// update, which is given the current metadata. The read and the write
+// happen in one transaction, so concurrent updates of different keys don't
+// lose each other's changes. Errors from update are returned as is. It
+// returns false if the machine doesn't exist.
+func (db *DB) UpdateMachineMetadata(id string, update func(map[string]interface{}) (map[string]interface{}, error)) (bool, error) {
+	selectQuery := "SELECT metadata FROM machines WHERE id = ?"
+	updateQuery := "UPDATE machines SET metadata = ?, updated_at = ? WHERE id = ?"
+	if db.driver == "postgres" {
+		selectQuery = "SELECT metadata FROM machines WHERE id = $1 FOR UPDATE"
+		updateQuery = "UPDATE machines SET metadata = $1, updated_at = $2 WHERE id = $3"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var current jsonColumn
+	err = tx.QueryRow(selectQuery, id).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get machine metadata: %w", err)
+	}
+
+	var metadata map[string]interface{}
+	if err := current.Unmarshal(&metadata); err != nil {
+		return false, fmt.Errorf("failed to unmarshal metadata: %w", err)
+	}
+
+	metadata, err = update(metadata)
+	if err != nil {
+		return false, err
+	}
+
+	// An emptied metadata object is stored as NULL
+	var metadataJSON jsonColumn
+	if len(metadata) > 0 {
+		if metadataJSON, err = marshalJSONColumn(metadata); err != nil {
+			return false, fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(updateQuery, metadataJSON, time.Now(), id); err != nil {
+		return false, fmt.Errorf("failed to update machine metadata: %w", err)
+	}
+
+	return true, tx.Commit()
+}
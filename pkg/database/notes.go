@@ -0,0 +1,337 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const machineNoteColumns = ` id, machine_id, author, body, created_at, updated_at `
+
+const machineAttachmentColumns = `
+	id, machine_id, filename, content_type, size, sha256, uploaded_by, source, created_at
+`
+
+// CreateMachineNote adds a note to a machine
+func (db *DB) CreateMachineNote(note *models.MachineNote) error {
+	note.ID = uuid.New().String()
+	note.CreatedAt = time.Now()
+	note.UpdatedAt = nil
+
+	query := `INSERT INTO machine_notes (` + machineNoteColumns + `) VALUES (?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO machine_notes (` + machineNoteColumns + `) VALUES ($1, $2, $3, $4, $5, $6)`
+	}
+
+	_, err := db.Exec(query, note.ID, note.MachineID, note.Author, note.Body, note.CreatedAt, note.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create machine note: %w", err)
+	}
+	return nil
+}
+
+// GetMachineNote retrieves a machine's note. It returns nil, nil if the
+// machine has no such note.
+func (db *DB) GetMachineNote(machineID, id string) (*models.MachineNote, error) {
+	query := `SELECT` + machineNoteColumns + `FROM machine_notes WHERE machine_id = ? AND id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + machineNoteColumns + `FROM machine_notes WHERE machine_id = $1 AND id = $2`
+	}
+
+	note, err := scanMachineNote(db.QueryRow(query, machineID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get machine note: %w", err)
+	}
+	return note, nil
+}
+
+// ListMachineNotes lists a machine's notes, newest first
+func (db *DB) ListMachineNotes(machineID string) ([]*models.MachineNote, error) {
+	query := `SELECT` + machineNoteColumns + `FROM machine_notes WHERE machine_id = ? ORDER BY created_at DESC, id`
+	if db.driver == "postgres" {
+		query = `SELECT` + machineNoteColumns + `FROM machine_notes WHERE machine_id = $1 ORDER BY created_at DESC, id`
+	}
+
+	rows, err := db.Query(query, machineID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machine notes: %w", err)
+	}
+	defer rows.Close()
+
+	var notes []*models.MachineNote
+	for rows.Next() {
+		note, err := scanMachineNote(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan machine note: %w", err)
+		}
+		notes = append(notes, note)
+	}
+
+	return notes, rows.Err()
+}
+
+// UpdateMachineNote replaces the body of a note
+func (db *DB) UpdateMachineNote(note *models.MachineNote) error {
+	now := time.Now()
+
+	query := "UPDATE machine_notes SET body = ?, updated_at = ? WHERE machine_id = ? AND id = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE machine_notes SET body = $1, updated_at = $2 WHERE machine_id = $3 AND id = $4"
+	}
+
+	if _, err := db.Exec(query, note.Body, now, note.MachineID, note.ID); err != nil {
+		return fmt.Errorf("failed to update machine note: %w", err)
+	}
+	note.UpdatedAt = &now
+	return nil
+}
+
+// DeleteMachineNote deletes a machine's note. It returns false if the
+// machine has no such note.
+func (db *DB) DeleteMachineNote(machineID, id string) (bool, error) {
+	query := "DELETE FROM machine_notes WHERE machine_id = ? AND id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM machine_notes WHERE machine_id = $1 AND id = $2"
+	}
+
+	result, err := db.Exec(query, machineID, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete machine note: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func scanMachineNote(row rowScanner) (*models.MachineNote, error) {
+	var note models.MachineNote
+	var updatedAt sql.NullTime
+
+	err := row.Scan(&note.ID, &note.MachineID, &note.Author, &note.Body, &note.CreatedAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if updatedAt.Valid {
+		note.UpdatedAt = &updatedAt.Time
+	}
+	return &note, nil
+}
+
+// CreateMachineAttachment records a file attached to a machine. The file
+// must already be stored under its SHA-256.
+func (db *DB) CreateMachineAttachment(attachment *models.MachineAttachment) error {
+	attachment.ID = uuid.New().String()
+	attachment.CreatedAt = time.Now()
+	if attachment.Source == "" {
+		attachment.Source = models.AttachmentSourceUpload
+	}
+
+	query := `INSERT INTO machine_attachments (` + machineAttachmentColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO machine_attachments (` + machineAttachmentColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	}
+
+	_, err := db.Exec(query,
+		attachment.ID,
+		attachment.MachineID,
+		attachment.Filename,
+		attachment.ContentType,
+		attachment.Size,
+		attachment.SHA256,
+		attachment.UploadedBy,
+		attachment.Source,
+		attachment.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create machine attachment: %w", err)
+	}
+	return nil
+}
+
+// GetMachineAttachment retrieves a machine's attachment. It returns nil, nil
+// if the machine has no such attachment.
+func (db *DB) GetMachineAttachment(machineID, id string) (*models.MachineAttachment, error) {
+	query := `SELECT` + machineAttachmentColumns + `FROM machine_attachments WHERE machine_id = ? AND id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + machineAttachmentColumns + `FROM machine_attachments WHERE machine_id = $1 AND id = $2`
+	}
+
+	attachment, err := scanMachineAttachment(db.QueryRow(query, machineID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get machine attachment: %w", err)
+	}
+	return attachment, nil
+}
+
+// ListMachineAttachments lists a machine's attachments, newest first
+func (db *DB) ListMachineAttachments(machineID string) ([]*models.MachineAttachment, error) {
+	query := `SELECT` + machineAttachmentColumns + `FROM machine_attachments WHERE machine_id = ? ORDER BY created_at DESC, id`
+	if db.driver == "postgres" {
+		query = `SELECT` + machineAttachmentColumns + `FROM machine_attachments WHERE machine_id = $1 ORDER BY created_at DESC, id`
+	}
+
+	rows, err := db.Query(query, machineID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machine attachments: %w", err)
+	}
+	defer rows.Close()
+
+	var attachments []*models.MachineAttachment
+	for rows.Next() {
+		attachment, err := scanMachineAttachment(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan machine attachment: %w", err)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+// PruneMachineAttachments deletes the records of a machine's attachments
+// from source beyond the newest keep, leaving their files. It returns how
+// many it deleted.
+func (db *DB) PruneMachineAttachments(machineID, source string, keep int) (int, error) {
+	query := `SELECT id FROM machine_attachments WHERE machine_id = ? AND source = ? ORDER BY created_at DESC, id`
+	if db.driver == "postgres" {
+		query = `SELECT id FROM machine_attachments WHERE machine_id = $1 AND source = $2 ORDER BY created_at DESC, id`
+	}
+
+	rows, err := db.Query(query, machineID, source)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list machine attachments: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan machine attachment: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list machine attachments: %w", err)
+	}
+
+	pruned := 0
+	for i := keep; i < len(ids); i++ {
+		deleted, err := db.DeleteMachineAttachment(machineID, ids[i])
+		if err != nil {
+			return pruned, err
+		}
+		if deleted {
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// DeleteMachineAttachment deletes a machine's attachment record, leaving its
+// file. It returns false if the machine has no such attachment.
+func (db *DB) DeleteMachineAttachment(machineID, id string) (bool, error) {
+	query := "DELETE FROM machine_attachments WHERE machine_id = ? AND id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM machine_attachments WHERE machine_id = $1 AND id = $2"
+	}
+
+	result, err := db.Exec(query, machineID, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete machine attachment: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// AttachmentHashes returns the SHA-256 of every attached file, for finding
+// stored files nothing refers to any more
+func (db *DB) AttachmentHashes() (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT sha256 FROM machine_attachments")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachment hashes: %w", err)
+	}
+	defer rows.Close()
+
+	hashes := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment hash: %w", err)
+		}
+		hashes[hash] = true
+	}
+
+	return hashes, rows.Err()
+}
+
+func scanMachineAttachment(row rowScanner) (*models.MachineAttachment, error) {
+	var attachment models.MachineAttachment
+	var uploadedBy sql.NullString
+
+	err := row.Scan(
+		&attachment.ID,
+		&attachment.MachineID,
+		&attachment.Filename,
+		&attachment.ContentType,
+		&attachment.Size,
+		&attachment.SHA256,
+		&uploadedBy,
+		&attachment.Source,
+		&attachment.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment.UploadedBy = uploadedBy.String
+	return &attachment, nil
+}
+
+func (db *DB) createMachineNotesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS machine_notes (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			author TEXT NOT NULL,
+			body TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`
+}
+
+func (db *DB) createMachineAttachmentsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS machine_attachments (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			sha256 TEXT NOT NULL,
+			uploaded_by TEXT,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// postgresDSNEnv names a PostgreSQL database the store tests also run
+// against, each in a schema of its own. Without it they run on SQLite only.
+const postgresDSNEnv = "METAL_TEST_POSTGRES_DSN"
+
+// forEachDriver runs test against a migrated SQLite database, and against
+// PostgreSQL when postgresDSNEnv is set
+func forEachDriver(t *testing.T, test func(t *testing.T, db *DB)) {
+	t.Run("sqlite3", func(t *testing.T) {
+		test(t, newTestDB(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(postgresDSNEnv)
+		if dsn == "" {
+			t.Skipf("%s is not set", postgresDSNEnv)
+		}
+		test(t, newPostgresTestDB(t, dsn))
+	})
+}
+
+// newPostgresTestDB returns a database migrated in a new schema of the
+// PostgreSQL database at dsn, dropped when the test ends
+func newPostgresTestDB(t *testing.T, dsn string) *DB {
+	t.Helper()
+
+	admin, err := New(Config{Driver: "postgres", DSN: dsn})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := "test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	// lib/pq passes unknown parameters on as run-time settings
+	switch {
+	case strings.Contains(dsn, "://") && strings.Contains(dsn, "?"):
+		dsn += "&search_path=" + schema
+	case strings.Contains(dsn, "://"):
+		dsn += "?search_path=" + schema
+	default:
+		dsn += " search_path=" + schema
+	}
+	db, err := New(Config{Driver: "postgres", DSN: dsn})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	return db
+}
+
+// TestGetMissingReturnsNil checks the store's not-found convention: a Get
+// of a row that doesn't exist returns nil and no error
+func TestGetMissingReturnsNil(t *testing.T) {
+	const missing = "00000000-0000-0000-0000-000000000000"
+
+	gets := map[string]func(db *DB) (interface{}, error){
+		"GetActiveDeployment":        func(db *DB) (interface{}, error) { return db.GetActiveDeployment(missing) },
+		"GetActiveDiagnosticRun":     func(db *DB) (interface{}, error) { return db.GetActiveDiagnosticRun(missing) },
+		"GetActiveWipeJob":           func(db *DB) (interface{}, error) { return db.GetActiveWipeJob(missing) },
+		"GetBootAsset":               func(db *DB) (interface{}, error) { return db.GetBootAsset(missing) },
+		"GetBootOverride":            func(db *DB) (interface{}, error) { return db.GetBootOverride(missing) },
+		"GetBootProfile":             func(db *DB) (interface{}, error) { return db.GetBootProfile(missing) },
+		"GetBootProfileByName":       func(db *DB) (interface{}, error) { return db.GetBootProfileByName("missing") },
+		"GetBuild":                   func(db *DB) (interface{}, error) { return db.GetBuild(missing) },
+		"GetBuildRollout":            func(db *DB) (interface{}, error) { return db.GetBuildRollout(missing) },
+		"GetBuildSchedule":           func(db *DB) (interface{}, error) { return db.GetBuildSchedule(missing) },
+		"GetBuildScheduleFor":        func(db *DB) (interface{}, error) { return db.GetBuildScheduleFor("group", missing) },
+		"GetBuilder":                 func(db *DB) (interface{}, error) { return db.GetBuilder("missing") },
+		"GetCurrentSystemImage":      func(db *DB) (interface{}, error) { return db.GetCurrentSystemImage("missing") },
+		"GetDCIMRecord":              func(db *DB) (interface{}, error) { return db.GetDCIMRecord("netbox", missing) },
+		"GetDCIMSyncReport":          func(db *DB) (interface{}, error) { return db.GetDCIMSyncReport(missing) },
+		"GetDeployment":              func(db *DB) (interface{}, error) { return db.GetDeployment(missing) },
+		"GetDiagnosticProfile":       func(db *DB) (interface{}, error) { return db.GetDiagnosticProfile(missing) },
+		"GetDiagnosticProfileByName": func(db *DB) (interface{}, error) { return db.GetDiagnosticProfileByName("missing") },
+		"GetDiagnosticRun":           func(db *DB) (interface{}, error) { return db.GetDiagnosticRun(missing) },
+		"GetEffectiveOwnership":      func(db *DB) (interface{}, error) { return db.GetEffectiveOwnership(missing) },
+		"GetEnrollmentRule":          func(db *DB) (interface{}, error) { return db.GetEnrollmentRule(missing) },
+		"GetEnrollmentRuleByName":    func(db *DB) (interface{}, error) { return db.GetEnrollmentRuleByName("missing") },
+		"GetFragment":                func(db *DB) (interface{}, error) { return db.GetFragment(missing) },
+		"GetFragmentByName":          func(db *DB) (interface{}, error) { return db.GetFragmentByName("missing") },
+		"GetGroup":                   func(db *DB) (interface{}, error) { return db.GetGroup(missing) },
+		"GetGroupByName":             func(db *DB) (interface{}, error) { return db.GetGroupByName("missing") },
+		"GetHardwareProfile":         func(db *DB) (interface{}, error) { return db.GetHardwareProfile(missing) },
+		"GetHardwareProfileByName":   func(db *DB) (interface{}, error) { return db.GetHardwareProfileByName("missing") },
+		"GetHookRun":                 func(db *DB) (interface{}, error) { return db.GetHookRun(missing) },
+		"GetIdempotencyRecord": func(db *DB) (interface{}, error) {
+			return db.GetIdempotencyRecord("missing", "admin", "/api/v1/groups")
+		},
+		"GetImageTest":                  func(db *DB) (interface{}, error) { return db.GetImageTest(missing) },
+		"GetImpersonationSession":       func(db *DB) (interface{}, error) { return db.GetImpersonationSession(missing) },
+		"GetLastBootRequest":            func(db *DB) (interface{}, error) { return db.GetLastBootRequest(missing) },
+		"GetLatestMetrics":              func(db *DB) (interface{}, error) { return db.GetLatestMetrics(missing) },
+		"GetLatestProvisioningCycle":    func(db *DB) (interface{}, error) { return db.GetLatestProvisioningCycle(missing) },
+		"GetLatestSuccessfulBuild":      func(db *DB) (interface{}, error) { return db.GetLatestSuccessfulBuild(missing) },
+		"GetMachine":                    func(db *DB) (interface{}, error) { return db.GetMachine(missing) },
+		"GetMachineAttachment":          func(db *DB) (interface{}, error) { return db.GetMachineAttachment(missing, missing) },
+		"GetMachineByServiceTag":        func(db *DB) (interface{}, error) { return db.GetMachineByServiceTag("MISSING") },
+		"GetMachineConflict":            func(db *DB) (interface{}, error) { return db.GetMachineConflict(missing) },
+		"GetMachineNote":                func(db *DB) (interface{}, error) { return db.GetMachineNote(missing, missing) },
+		"GetMachineShare":               func(db *DB) (interface{}, error) { return db.GetMachineShare(missing, missing) },
+		"GetMaintenanceWindow":          func(db *DB) (interface{}, error) { return db.GetMaintenanceWindow(missing) },
+		"GetNotificationChannel":        func(db *DB) (interface{}, error) { return db.GetNotificationChannel(missing) },
+		"GetPowerOperation":             func(db *DB) (interface{}, error) { return db.GetPowerOperation(missing) },
+		"GetPreviousSystemImage":        func(db *DB) (interface{}, error) { return db.GetPreviousSystemImage("missing") },
+		"GetProvisioningCycle":          func(db *DB) (interface{}, error) { return db.GetProvisioningCycle(missing) },
+		"GetSubscription":               func(db *DB) (interface{}, error) { return db.GetSubscription(missing) },
+		"GetSystemImage":                func(db *DB) (interface{}, error) { return db.GetSystemImage("missing", 1) },
+		"GetSystemImageByBuild":         func(db *DB) (interface{}, error) { return db.GetSystemImageByBuild(missing) },
+		"GetTemplate":                   func(db *DB) (interface{}, error) { return db.GetTemplate(missing) },
+		"GetTemplateByName":             func(db *DB) (interface{}, error) { return db.GetTemplateByName("missing") },
+		"GetTrashedMachine":             func(db *DB) (interface{}, error) { return db.GetTrashedMachine(missing) },
+		"GetTrashedMachineByServiceTag": func(db *DB) (interface{}, error) { return db.GetTrashedMachineByServiceTag("MISSING") },
+		"GetUser":                       func(db *DB) (interface{}, error) { return db.GetUser(missing) },
+		"GetUserByUsername":             func(db *DB) (interface{}, error) { return db.GetUserByUsername("missing") },
+		"GetWebhook":                    func(db *DB) (interface{}, error) { return db.GetWebhook(missing) },
+		"GetWipeJob":                    func(db *DB) (interface{}, error) { return db.GetWipeJob(missing) },
+	}
+
+	forEachDriver(t, func(t *testing.T, db *DB) {
+		for name, get := range gets {
+			got, err := get(db)
+			if err != nil {
+				t.Errorf("%s: %v, want no error", name, err)
+			} else if !reflect.ValueOf(got).IsNil() {
+				t.Errorf("%s = %+v, want nil", name, got)
+			}
+		}
+	})
+}
+
+// TestGetRowsWithNullColumns reads a template and a webhook inserted with
+// only their required columns, as rows written before the optional
+// columns were added are
+func TestGetRowsWithNullColumns(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *DB) {
+		now := time.Now().UTC()
+		inserts := []struct {
+			sqlite, postgres string
+			args             []interface{}
+		}{
+			{
+				"INSERT INTO machine_templates (id, name, nixos_config, created_at, updated_at, created_by) VALUES (?, ?, ?, ?, ?, ?)",
+				"INSERT INTO machine_templates (id, name, nixos_config, created_at, updated_at, created_by) VALUES ($1, $2, $3, $4, $5, $6)",
+				[]interface{}{"template-1", "bare", "{ ... }: { }", now, now, "admin"},
+			},
+			{
+				"INSERT INTO webhooks (id, name, url, events, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+				"INSERT INTO webhooks (id, name, url, events, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6)",
+				[]interface{}{"webhook-1", "bare", "https://hooks.example.com/", `["machine.enrolled"]`, now, now},
+			},
+		}
+		for _, insert := range inserts {
+			query := insert.sqlite
+			if db.driver == "postgres" {
+				query = insert.postgres
+			}
+			if _, err := db.Exec(query, insert.args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, get := range []func() (interface{}, error){
+			func() (interface{}, error) { return db.GetTemplate("template-1") },
+			func() (interface{}, error) { return db.GetTemplateByName("bare") },
+			func() (interface{}, error) { return db.GetWebhook("webhook-1") },
+		} {
+			got, err := get()
+			if err != nil {
+				t.Errorf("%v", err)
+				continue
+			}
+			if reflect.ValueOf(got).IsNil() {
+				t.Errorf("%T not found", got)
+			}
+		}
+
+		template, err := db.GetTemplate("template-1")
+		if err == nil && template != nil && (template.BMCConfig != nil || template.Description != "" || template.BuildTarget != "") {
+			t.Errorf("template = %+v, want empty optional fields", template)
+		}
+		webhook, err := db.GetWebhook("webhook-1")
+		if err == nil && webhook != nil && (webhook.Secret != "" || webhook.Retry != nil || len(webhook.Events) != 1) {
+			t.Errorf("webhook = %+v, want its one event and empty optional fields", webhook)
+		}
+	})
+}
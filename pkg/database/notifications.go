@@ -0,0 +1,309 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const notificationChannelColumns = `
+	id, name, type, events, config, active, rate_limit, rate_window,
+	last_success, last_failure, created_at, updated_at
+`
+
+// CreateNotificationChannel creates a new notification channel
+func (db *DB) CreateNotificationChannel(channel *models.NotificationChannel) error {
+	channel.ID = uuid.New().String()
+	channel.CreatedAt = time.Now()
+	channel.UpdatedAt = time.Now()
+
+	eventsJSON, err := json.Marshal(channel.Events)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO notification_channels (id, name, type, events, config, active, rate_limit, rate_window, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	if db.driver == "sqlite3" {
+		query = `
+			INSERT INTO notification_channels (id, name, type, events, config, active, rate_limit, rate_window, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`
+	}
+
+	_, err = db.Exec(query,
+		channel.ID,
+		channel.Name,
+		channel.Type,
+		string(eventsJSON),
+		jsonColumn(channel.Config),
+		channel.Active,
+		channel.RateLimit,
+		channel.RateWindow,
+		channel.CreatedAt,
+		channel.UpdatedAt,
+	)
+
+	return err
+}
+
+// GetNotificationChannel retrieves a notification channel by ID. It returns
+// nil, nil if there is no such channel.
+func (db *DB) GetNotificationChannel(id string) (*models.NotificationChannel, error) {
+	query := `SELECT` + notificationChannelColumns + `FROM notification_channels WHERE id = $1`
+	if db.driver == "sqlite3" {
+		query = `SELECT` + notificationChannelColumns + `FROM notification_channels WHERE id = ?`
+	}
+
+	channel, err := scanNotificationChannel(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return channel, err
+}
+
+// ListNotificationChannels lists all notification channels
+func (db *DB) ListNotificationChannels() ([]*models.NotificationChannel, error) {
+	query := `SELECT` + notificationChannelColumns + `FROM notification_channels ORDER BY created_at DESC`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []*models.NotificationChannel
+	for rows.Next() {
+		channel, err := scanNotificationChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+
+	return channels, rows.Err()
+}
+
+// GetNotificationChannelsByEvent retrieves all active channels subscribed to an event
+func (db *DB) GetNotificationChannelsByEvent(event string) ([]*models.NotificationChannel, error) {
+	query := `SELECT` + notificationChannelColumns + `FROM notification_channels WHERE active = true`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []*models.NotificationChannel
+	for rows.Next() {
+		channel, err := scanNotificationChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		// Filter by event
+		for _, e := range channel.Events {
+			if e == event || e == "*" {
+				channels = append(channels, channel)
+				break
+			}
+		}
+	}
+
+	return channels, rows.Err()
+}
+
+// UpdateNotificationChannel updates a notification channel
+func (db *DB) UpdateNotificationChannel(channel *models.NotificationChannel) error {
+	channel.UpdatedAt = time.Now()
+
+	eventsJSON, err := json.Marshal(channel.Events)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE notification_channels
+		SET name = $1, events = $2, config = $3, active = $4,
+		    rate_limit = $5, rate_window = $6, updated_at = $7
+		WHERE id = $8
+	`
+
+	if db.driver == "sqlite3" {
+		query = `
+			UPDATE notification_channels
+			SET name = ?, events = ?, config = ?, active = ?,
+			    rate_limit = ?, rate_window = ?, updated_at = ?
+			WHERE id = ?
+		`
+	}
+
+	_, err = db.Exec(query,
+		channel.Name,
+		string(eventsJSON),
+		jsonColumn(channel.Config),
+		channel.Active,
+		channel.RateLimit,
+		channel.RateWindow,
+		channel.UpdatedAt,
+		channel.ID,
+	)
+
+	return err
+}
+
+// DeleteNotificationChannel deletes a notification channel
+func (db *DB) DeleteNotificationChannel(id string) error {
+	query := `DELETE FROM notification_channels WHERE id = $1`
+	if db.driver == "sqlite3" {
+		query = `DELETE FROM notification_channels WHERE id = ?`
+	}
+
+	_, err := db.Exec(query, id)
+	return err
+}
+
+// CreateNotificationDelivery creates a new notification delivery record
+func (db *DB) CreateNotificationDelivery(delivery *models.NotificationDelivery) error {
+	delivery.ID = uuid.New().String()
+	delivery.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO notification_deliveries (id, channel_id, event, event_count, payload, error, attempts, success, created_at, completed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	if db.driver == "sqlite3" {
+		query = `
+			INSERT INTO notification_deliveries (id, channel_id, event, event_count, payload, error, attempts, success, created_at, completed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`
+	}
+
+	_, err := db.Exec(query,
+		delivery.ID,
+		delivery.ChannelID,
+		delivery.Event,
+		delivery.EventCount,
+		delivery.Payload,
+		delivery.Error,
+		delivery.Attempts,
+		delivery.Success,
+		delivery.CreatedAt,
+		delivery.CompletedAt,
+	)
+
+	return err
+}
+
+// ListNotificationDeliveries lists deliveries for a notification channel
+func (db *DB) ListNotificationDeliveries(channelID string, limit int) ([]*models.NotificationDelivery, error) {
+	query := `
+		SELECT id, channel_id, event, event_count, payload, error, attempts, success, created_at, completed_at
+		FROM notification_deliveries
+		WHERE channel_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+
+	if db.driver == "sqlite3" {
+		query = `
+			SELECT id, channel_id, event, event_count, payload, error, attempts, success, created_at, completed_at
+			FROM notification_deliveries
+			WHERE channel_id = ?
+			ORDER BY created_at DESC
+			LIMIT ?
+		`
+	}
+
+	rows, err := db.Query(query, channelID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*models.NotificationDelivery
+	for rows.Next() {
+		var delivery models.NotificationDelivery
+		var errorText sql.NullString
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.ChannelID,
+			&delivery.Event,
+			&delivery.EventCount,
+			&delivery.Payload,
+			&errorText,
+			&delivery.Attempts,
+			&delivery.Success,
+			&delivery.CreatedAt,
+			&delivery.CompletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Error = errorText.String
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// UpdateNotificationDeliveryStatus updates the channel last success/failure timestamps
+func (db *DB) UpdateNotificationDeliveryStatus(channelID string, success bool) error {
+	column := "last_failure"
+	if success {
+		column = "last_success"
+	}
+
+	query := `UPDATE notification_channels SET ` + column + ` = $1 WHERE id = $2`
+	if db.driver == "sqlite3" {
+		query = `UPDATE notification_channels SET ` + column + ` = ? WHERE id = ?`
+	}
+
+	_, err := db.Exec(query, time.Now(), channelID)
+	return err
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanNotificationChannel(row rowScanner) (*models.NotificationChannel, error) {
+	var channel models.NotificationChannel
+	var eventsJSON string
+	var configJSON jsonColumn
+
+	err := row.Scan(
+		&channel.ID,
+		&channel.Name,
+		&channel.Type,
+		&eventsJSON,
+		&configJSON,
+		&channel.Active,
+		&channel.RateLimit,
+		&channel.RateWindow,
+		&channel.LastSuccess,
+		&channel.LastFailure,
+		&channel.CreatedAt,
+		&channel.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(eventsJSON), &channel.Events); err != nil {
+		return nil, err
+	}
+	channel.Config = configJSON.RawMessage()
+
+	return &channel, nil
+}
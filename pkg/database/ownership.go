@@ -0,0 +1,91 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// ownershipColumns are the columns machines and groups store their
+// Ownership in
+var ownershipColumns = []string{"owner_team", "owner_email", "owner_slack_channel", "environment"}
+
+// ownershipSelect selects a machine's own ownership columns followed by
+// effectiveOwnershipSelect, for scanning into an ownershipRow. Like
+// effectiveOwnershipSelect it must be used in queries that select from
+// machines without an alias.
+var ownershipSelect = "machines." + strings.Join(ownershipColumns, ", machines.") + ", " + effectiveOwnershipSelect
+
+// effectiveOwnershipSelect selects the effective value of each ownership
+// column, in the order of ownershipColumns
+var effectiveOwnershipSelect = func() string {
+	columns := make([]string, len(ownershipColumns))
+	for i, column := range ownershipColumns {
+		columns[i] = effectiveOwnershipColumn(column)
+	}
+	return strings.Join(columns, ", ")
+}()
+
+// GetEffectiveOwnership returns a machine's ownership with the fields it
+// doesn't set inherited from its groups, or nil if neither it nor its
+// groups set any
+func (db *DB) GetEffectiveOwnership(machineID string) (*models.Ownership, error) {
+	query := "SELECT " + effectiveOwnershipSelect + " FROM machines WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "SELECT " + effectiveOwnershipSelect + " FROM machines WHERE id = $1"
+	}
+
+	var o models.Ownership
+	err := db.QueryRow(query, machineID).Scan(&o.Team, &o.ContactEmail, &o.SlackChannel, &o.Environment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get machine ownership: %w", err)
+	}
+	return ownershipOrNil(o), nil
+}
+
+// effectiveOwnershipColumn is the machine's own value of an ownership
+// column or, when it doesn't set it, the value of the first of its groups
+// by name that does
+func effectiveOwnershipColumn(column string) string {
+	return fmt.Sprintf(`COALESCE(NULLIF(machines.%[1]s, ''), (
+		SELECT g.%[1]s FROM groups g INNER JOIN group_memberships gm ON g.id = gm.group_id
+		WHERE gm.machine_id = machines.id AND g.%[1]s <> '' ORDER BY g.name LIMIT 1
+	), '')`, column)
+}
+
+// ownershipRow is scanned from ownershipSelect, own fields first
+type ownershipRow struct {
+	own, effective models.Ownership
+}
+
+// owned returns the machine's own ownership, or nil if it sets none
+func (r *ownershipRow) owned() *models.Ownership {
+	return ownershipOrNil(r.own)
+}
+
+// effectiveOwnership returns the machine's effective ownership, or nil if neither
+// it nor its groups set any
+func (r *ownershipRow) effectiveOwnership() *models.Ownership {
+	return ownershipOrNil(r.effective)
+}
+
+func ownershipOrNil(o models.Ownership) *models.Ownership {
+	if o.IsZero() {
+		return nil
+	}
+	return &o
+}
+
+// derefOwnership returns *o, or no ownership if o is nil
+func derefOwnership(o *models.Ownership) models.Ownership {
+	if o == nil {
+		return models.Ownership{}
+	}
+	return *o
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,18 +14,21 @@ import (
 func (db *DB) CreatePowerOperation(op *models.PowerOperation) error {
 	op.ID = uuid.New().String()
 	op.CreatedAt = time.Now()
+	if op.Method == "" {
+		op.Method = models.PowerMethodBMC
+	}
 
 	query := `
 		INSERT INTO power_operations (
-			id, machine_id, operation, status, result, error, initiated_by, created_at, completed_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			id, machine_id, operation, method, status, result, error, initiated_by, created_at, completed_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	if db.driver == "postgres" {
 		query = `
 			INSERT INTO power_operations (
-				id, machine_id, operation, status, result, error, initiated_by, created_at, completed_at
-			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+				id, machine_id, operation, method, status, result, error, initiated_by, created_at, completed_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 		`
 	}
 
@@ -32,6 +36,7 @@ func (db *DB) CreatePowerOperation(op *models.PowerOperation) error {
 		op.ID,
 		op.MachineID,
 		op.Operation,
+		op.Method,
 		op.Status,
 		op.Result,
 		op.Error,
@@ -78,20 +83,21 @@ func (db *DB) UpdatePowerOperation(op *models.PowerOperation) error {
 	return nil
 }
 
-// GetPowerOperation retrieves a power operation by ID
+// GetPowerOperation retrieves a power operation by ID. It returns nil, nil
+// if there is no such operation.
 func (db *DB) GetPowerOperation(id string) (*models.PowerOperation, error) {
 	op := &models.PowerOperation{}
-	var result, errorMsg sql.NullString
+	var method, result, errorMsg sql.NullString
 	var completedAt sql.NullTime
 
 	query := `
-		SELECT id, machine_id, operation, status, result, error, initiated_by, created_at, completed_at
+		SELECT id, machine_id, operation, method, status, result, error, initiated_by, created_at, completed_at
 		FROM power_operations WHERE id = ?
 	`
 
 	if db.driver == "postgres" {
 		query = `
-			SELECT id, machine_id, operation, status, result, error, initiated_by, created_at, completed_at
+			SELECT id, machine_id, operation, method, status, result, error, initiated_by, created_at, completed_at
 			FROM power_operations WHERE id = $1
 		`
 	}
@@ -100,6 +106,7 @@ func (db *DB) GetPowerOperation(id string) (*models.PowerOperation, error) {
 		&op.ID,
 		&op.MachineID,
 		&op.Operation,
+		&method,
 		&op.Status,
 		&result,
 		&errorMsg,
@@ -108,13 +115,18 @@ func (db *DB) GetPowerOperation(id string) (*models.PowerOperation, error) {
 		&completedAt,
 	)
 
-	if err == sql.ErrNoRows {
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get power operation: %w", err)
 	}
 
+	// Operations from before Wake-on-LAN were all through the BMC
+	op.Method = models.PowerMethodBMC
+	if method.Valid && method.String != "" {
+		op.Method = method.String
+	}
 	if result.Valid {
 		op.Result = result.String
 	}
@@ -131,7 +143,7 @@ func (db *DB) GetPowerOperation(id string) (*models.PowerOperation, error) {
 // ListPowerOperations retrieves power operations for a machine
 func (db *DB) ListPowerOperations(machineID string, limit int) ([]*models.PowerOperation, error) {
 	query := `
-		SELECT id, machine_id, operation, status, result, error, initiated_by, created_at, completed_at
+		SELECT id, machine_id, operation, method, status, result, error, initiated_by, created_at, completed_at
 		FROM power_operations
 		WHERE machine_id = ?
 		ORDER BY created_at DESC
@@ -140,7 +152,7 @@ func (db *DB) ListPowerOperations(machineID string, limit int) ([]*models.PowerO
 
 	if db.driver == "postgres" {
 		query = `
-			SELECT id, machine_id, operation, status, result, error, initiated_by, created_at, completed_at
+			SELECT id, machine_id, operation, method, status, result, error, initiated_by, created_at, completed_at
 			FROM power_operations
 			WHERE machine_id = $1
 			ORDER BY created_at DESC
@@ -157,13 +169,14 @@ func (db *DB) ListPowerOperations(machineID string, limit int) ([]*models.PowerO
 	var operations []*models.PowerOperation
 	for rows.Next() {
 		op := &models.PowerOperation{}
-		var result, errorMsg sql.NullString
+		var method, result, errorMsg sql.NullString
 		var completedAt sql.NullTime
 
 		err := rows.Scan(
 			&op.ID,
 			&op.MachineID,
 			&op.Operation,
+			&method,
 			&op.Status,
 			&result,
 			&errorMsg,
@@ -175,6 +188,10 @@ func (db *DB) ListPowerOperations(machineID string, limit int) ([]*models.PowerO
 			return nil, fmt.Errorf("failed to scan power operation: %w", err)
 		}
 
+		op.Method = models.PowerMethodBMC
+		if method.Valid && method.String != "" {
+			op.Method = method.String
+		}
 		if result.Valid {
 			op.Result = result.String
 		}
@@ -190,3 +207,45 @@ func (db *DB) ListPowerOperations(machineID string, limit int) ([]*models.PowerO
 
 	return operations, nil
 }
+
+// MachinesWithPendingPowerOperations returns the IDs of machines with a
+// power operation pending that started after since. Operations pending from
+// before since are taken to have been abandoned by a server that stopped.
+func (db *DB) MachinesWithPendingPowerOperations(since time.Time) (map[string]bool, error) {
+	query := "SELECT DISTINCT machine_id FROM power_operations WHERE status = 'pending' AND created_at > ?"
+	if db.driver == "postgres" {
+		query = "SELECT DISTINCT machine_id FROM power_operations WHERE status = 'pending' AND created_at > $1"
+	}
+
+	rows, err := db.Query(query, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending power operations: %w", err)
+	}
+	defer rows.Close()
+
+	machines := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan power operation: %w", err)
+		}
+		machines[id] = true
+	}
+
+	return machines, rows.Err()
+}
+
+// PowerOperationStartedSince reports whether a power operation on a machine
+// started after since
+func (db *DB) PowerOperationStartedSince(machineID string, since time.Time) (bool, error) {
+	query := "SELECT COUNT(*) FROM power_operations WHERE machine_id = ? AND created_at > ?"
+	if db.driver == "postgres" {
+		query = "SELECT COUNT(*) FROM power_operations WHERE machine_id = $1 AND created_at > $2"
+	}
+
+	var count int
+	if err := db.QueryRow(query, machineID, since).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to count power operations: %w", err)
+	}
+	return count > 0, nil
+}
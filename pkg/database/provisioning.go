@@ -0,0 +1,468 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const provisioningCycleColumns = `
+	id, machine_id, build_id, status, started_at, finished_at
+`
+
+const hookRunColumns = `
+	id, cycle_id, machine_id, position, name, hook, status, attempts,
+	next_attempt_at, deadline, started_at, finished_at, exit_code, log, error
+`
+
+// GetProvisioningHooks returns the hooks of a template, group, or machine,
+// in order
+func (db *DB) GetProvisioningHooks(scope, scopeID string) ([]models.ProvisioningHook, error) {
+	query := "SELECT hooks FROM provisioning_hooks WHERE scope = ? AND scope_id = ?"
+	if db.driver == "postgres" {
+		query = "SELECT hooks FROM provisioning_hooks WHERE scope = $1 AND scope_id = $2"
+	}
+
+	var hooksJSON jsonColumn
+	err := db.QueryRow(query, scope, scopeID).Scan(&hooksJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get provisioning hooks: %w", err)
+	}
+
+	var hooks []models.ProvisioningHook
+	if err := hooksJSON.Unmarshal(&hooks); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal provisioning hooks: %w", err)
+	}
+	return hooks, nil
+}
+
+// SetProvisioningHooks replaces the hooks of a template, group, or machine.
+// An empty list removes them. Running provisioning cycles keep the hooks
+// they started with.
+func (db *DB) SetProvisioningHooks(scope, scopeID string, hooks []models.ProvisioningHook) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := db.deleteScopeProvisioningHooks(tx, scope, scopeID); err != nil {
+		return err
+	}
+
+	if len(hooks) > 0 {
+		hooksJSON, err := marshalJSONColumn(hooks)
+		if err != nil {
+			return err
+		}
+
+		query := "INSERT INTO provisioning_hooks (scope, scope_id, hooks, updated_at) VALUES (?, ?, ?, ?)"
+		if db.driver == "postgres" {
+			query = "INSERT INTO provisioning_hooks (scope, scope_id, hooks, updated_at) VALUES ($1, $2, $3, $4)"
+		}
+		if _, err := tx.Exec(query, scope, scopeID, hooksJSON, time.Now()); err != nil {
+			return fmt.Errorf("failed to set provisioning hooks: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deleteScopeProvisioningHooks deletes the hooks of a template, group, or
+// machine
+func (db *DB) deleteScopeProvisioningHooks(exec execer, scope, scopeID string) error {
+	query := "DELETE FROM provisioning_hooks WHERE scope = ? AND scope_id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM provisioning_hooks WHERE scope = $1 AND scope_id = $2"
+	}
+
+	if _, err := exec.Exec(query, scope, scopeID); err != nil {
+		return fmt.Errorf("failed to delete provisioning hooks: %w", err)
+	}
+	return nil
+}
+
+// CreateProvisioningCycle starts a provisioning cycle with a pending run of
+// each of the cycle's Runs' hooks, in order. A running cycle of the same
+// machine is cancelled.
+func (db *DB) CreateProvisioningCycle(cycle *models.ProvisioningCycle) error {
+	cycle.ID = uuid.New().String()
+	cycle.Status = models.ProvisioningRunning
+	cycle.StartedAt = time.Now()
+	cycle.FinishedAt = nil
+
+	cancel := "UPDATE provisioning_cycles SET status = ?, finished_at = ? WHERE machine_id = ? AND status = ?"
+	insert := `INSERT INTO provisioning_cycles (` + provisioningCycleColumns + `) VALUES (?, ?, ?, ?, ?, ?)`
+	insertRun := `INSERT INTO hook_runs (` + hookRunColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		cancel = "UPDATE provisioning_cycles SET status = $1, finished_at = $2 WHERE machine_id = $3 AND status = $4"
+		insert = `INSERT INTO provisioning_cycles (` + provisioningCycleColumns + `) VALUES ($1, $2, $3, $4, $5, $6)`
+		insertRun = `INSERT INTO hook_runs (` + hookRunColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(cancel, models.ProvisioningCancelled, cycle.StartedAt, cycle.MachineID, models.ProvisioningRunning); err != nil {
+		return fmt.Errorf("failed to cancel provisioning cycle: %w", err)
+	}
+	if _, err := tx.Exec(insert, cycle.ID, cycle.MachineID, cycle.BuildID, cycle.Status, cycle.StartedAt, nil); err != nil {
+		return fmt.Errorf("failed to create provisioning cycle: %w", err)
+	}
+
+	for i, run := range cycle.Runs {
+		run.ID = uuid.New().String()
+		run.CycleID = cycle.ID
+		run.MachineID = cycle.MachineID
+		run.Position = i
+		run.Status = models.HookRunPending
+
+		hookJSON, err := marshalJSONColumn(run.Hook)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(insertRun,
+			run.ID, run.CycleID, run.MachineID, run.Position, run.Hook.Name, hookJSON, run.Status, 0,
+			nil, nil, nil, nil, nil, "", "",
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create hook run: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetProvisioningCycle retrieves a provisioning cycle with its runs. It
+// returns nil, nil if there is no such cycle.
+func (db *DB) GetProvisioningCycle(id string) (*models.ProvisioningCycle, error) {
+	query := `SELECT` + provisioningCycleColumns + `FROM provisioning_cycles WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + provisioningCycleColumns + `FROM provisioning_cycles WHERE id = $1`
+	}
+	return db.getProvisioningCycle(query, id)
+}
+
+// GetLatestProvisioningCycle retrieves the last provisioning cycle a
+// machine started, with its runs. It returns nil, nil if the machine never
+// started one.
+func (db *DB) GetLatestProvisioningCycle(machineID string) (*models.ProvisioningCycle, error) {
+	query := `SELECT` + provisioningCycleColumns + `FROM provisioning_cycles WHERE machine_id = ? ORDER BY started_at DESC LIMIT 1`
+	if db.driver == "postgres" {
+		query = `SELECT` + provisioningCycleColumns + `FROM provisioning_cycles WHERE machine_id = $1 ORDER BY started_at DESC LIMIT 1`
+	}
+	return db.getProvisioningCycle(query, machineID)
+}
+
+func (db *DB) getProvisioningCycle(query string, arg string) (*models.ProvisioningCycle, error) {
+	cycle, err := scanProvisioningCycle(db.QueryRow(query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get provisioning cycle: %w", err)
+	}
+
+	if cycle.Runs, err = db.listHookRuns(cycle.ID); err != nil {
+		return nil, err
+	}
+	return cycle, nil
+}
+
+// ListRunningProvisioningCycleIDs lists the IDs of running provisioning
+// cycles
+func (db *DB) ListRunningProvisioningCycleIDs() ([]string, error) {
+	query := "SELECT id FROM provisioning_cycles WHERE status = ?"
+	if db.driver == "postgres" {
+		query = "SELECT id FROM provisioning_cycles WHERE status = $1"
+	}
+
+	rows, err := db.Query(query, models.ProvisioningRunning)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list provisioning cycles: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan provisioning cycle: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SetProvisioningCycleStatus moves a provisioning cycle from status from to
+// the cycle's status, stamping when it finished unless it is running
+// again. It returns false if the cycle wasn't in status from.
+func (db *DB) SetProvisioningCycleStatus(cycle *models.ProvisioningCycle, from string) (bool, error) {
+	cycle.FinishedAt = nil
+	if cycle.Status != models.ProvisioningRunning {
+		now := time.Now()
+		cycle.FinishedAt = &now
+	}
+
+	query := "UPDATE provisioning_cycles SET status = ?, finished_at = ? WHERE id = ? AND status = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE provisioning_cycles SET status = $1, finished_at = $2 WHERE id = $3 AND status = $4"
+	}
+
+	result, err := db.Exec(query, cycle.Status, cycle.FinishedAt, cycle.ID, from)
+	if err != nil {
+		return false, fmt.Errorf("failed to update provisioning cycle: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetHookRun retrieves a hook run. It returns nil, nil if there is no such
+// run.
+func (db *DB) GetHookRun(id string) (*models.HookRun, error) {
+	query := `SELECT` + hookRunColumns + `FROM hook_runs WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + hookRunColumns + `FROM hook_runs WHERE id = $1`
+	}
+
+	run, err := scanHookRun(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hook run: %w", err)
+	}
+	return run, nil
+}
+
+func (db *DB) listHookRuns(cycleID string) ([]*models.HookRun, error) {
+	query := `SELECT` + hookRunColumns + `FROM hook_runs WHERE cycle_id = ? ORDER BY position`
+	if db.driver == "postgres" {
+		query = `SELECT` + hookRunColumns + `FROM hook_runs WHERE cycle_id = $1 ORDER BY position`
+	}
+
+	rows, err := db.Query(query, cycleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hook runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []*models.HookRun{}
+	for rows.Next() {
+		run, err := scanHookRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan hook run: %w", err)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// UpdateHookRun saves a hook run's state if it is still in status from, so
+// the server and the agent never both act on a run. It returns false if the
+// run has since moved on.
+func (db *DB) UpdateHookRun(run *models.HookRun, from string) (bool, error) {
+	query := `
+		UPDATE hook_runs SET
+			status = ?, attempts = ?, next_attempt_at = ?, deadline = ?,
+			started_at = ?, finished_at = ?, exit_code = ?, log = ?, error = ?
+		WHERE id = ? AND status = ?
+	`
+	if db.driver == "postgres" {
+		query = `
+			UPDATE hook_runs SET
+				status = $1, attempts = $2, next_attempt_at = $3, deadline = $4,
+				started_at = $5, finished_at = $6, exit_code = $7, log = $8, error = $9
+			WHERE id = $10 AND status = $11
+		`
+	}
+
+	result, err := db.Exec(query,
+		run.Status,
+		run.Attempts,
+		run.NextAttemptAt,
+		run.Deadline,
+		run.StartedAt,
+		run.FinishedAt,
+		run.ExitCode,
+		run.Log,
+		run.Error,
+		run.ID,
+		from,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update hook run: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// MarkMachineProvisioned moves a ready machine to provisioned. It returns
+// false if the machine wasn't ready.
+func (db *DB) MarkMachineProvisioned(machineID string) (bool, error) {
+	query := "UPDATE machines SET status = ?, updated_at = ? WHERE id = ? AND status = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE machines SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4"
+	}
+
+	result, err := db.Exec(query, models.StatusProvisioned, time.Now(), machineID, models.StatusReady)
+	if err != nil {
+		return false, fmt.Errorf("failed to update machine status: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func scanProvisioningCycle(row rowScanner) (*models.ProvisioningCycle, error) {
+	var cycle models.ProvisioningCycle
+	var finishedAt sql.NullTime
+
+	err := row.Scan(
+		&cycle.ID,
+		&cycle.MachineID,
+		&cycle.BuildID,
+		&cycle.Status,
+		&cycle.StartedAt,
+		&finishedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if finishedAt.Valid {
+		cycle.FinishedAt = &finishedAt.Time
+	}
+	return &cycle, nil
+}
+
+func scanHookRun(row rowScanner) (*models.HookRun, error) {
+	var run models.HookRun
+	var name string
+	var hookJSON jsonColumn
+	var nextAttemptAt, deadline, startedAt, finishedAt sql.NullTime
+	var exitCode sql.NullInt64
+	var log, runError sql.NullString
+
+	err := row.Scan(
+		&run.ID,
+		&run.CycleID,
+		&run.MachineID,
+		&run.Position,
+		&name,
+		&hookJSON,
+		&run.Status,
+		&run.Attempts,
+		&nextAttemptAt,
+		&deadline,
+		&startedAt,
+		&finishedAt,
+		&exitCode,
+		&log,
+		&runError,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hookJSON.Unmarshal(&run.Hook); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal hook: %w", err)
+	}
+	if nextAttemptAt.Valid {
+		run.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deadline.Valid {
+		run.Deadline = &deadline.Time
+	}
+	if startedAt.Valid {
+		run.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		run.FinishedAt = &finishedAt.Time
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		run.ExitCode = &code
+	}
+	run.Log = log.String
+	run.Error = runError.String
+	return &run, nil
+}
+
+func (db *DB) createProvisioningHooksTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS provisioning_hooks (
+			scope TEXT NOT NULL,
+			scope_id TEXT NOT NULL,
+			hooks %s NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (scope, scope_id)
+		)
+	`, jsonType)
+}
+
+func (db *DB) createProvisioningCyclesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS provisioning_cycles (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			build_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			started_at TIMESTAMP NOT NULL,
+			finished_at TIMESTAMP,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`
+}
+
+func (db *DB) createHookRunsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS hook_runs (
+			id TEXT PRIMARY KEY,
+			cycle_id TEXT NOT NULL,
+			machine_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			hook %s NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMP,
+			deadline TIMESTAMP,
+			started_at TIMESTAMP,
+			finished_at TIMESTAMP,
+			exit_code INTEGER,
+			log TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (cycle_id) REFERENCES provisioning_cycles(id) ON DELETE CASCADE
+		)
+	`, jsonType)
+}
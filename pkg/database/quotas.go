@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+// SetUserQuota sets the quota limits of a user, or clears them so the
+// user's role's apply if limits is nil
+func (db *DB) SetUserQuota(userID string, limits *models.QuotaLimits) error {
+	quota, err := marshalJSONColumn(limits)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE users SET quota = ?, updated_at = ? WHERE id = ?"
+	if db.driver == "postgres" {
+		query = "UPDATE users SET quota = $1, updated_at = $2 WHERE id = $3"
+	}
+
+	if _, err := db.Exec(query, quota, time.Now(), userID); err != nil {
+		return fmt.Errorf("failed to set user quota: %w", err)
+	}
+	return nil
+}
+
+// RecordQuotaUsage counts units of a quota kind against a user. Usage that
+// has left the quota window is removed as it goes.
+func (db *DB) RecordQuotaUsage(userID, kind string, units int, at time.Time) error {
+	insert := "INSERT INTO quota_usage (id, user_id, kind, units, created_at) VALUES (?, ?, ?, ?, ?)"
+	prune := "DELETE FROM quota_usage WHERE user_id = ? AND kind = ? AND created_at < ?"
+	if db.driver == "postgres" {
+		insert = "INSERT INTO quota_usage (id, user_id, kind, units, created_at) VALUES ($1, $2, $3, $4, $5)"
+		prune = "DELETE FROM quota_usage WHERE user_id = $1 AND kind = $2 AND created_at < $3"
+	}
+
+	if _, err := db.Exec(insert, uuid.New().String(), userID, kind, units, at); err != nil {
+		return fmt.Errorf("failed to record quota usage: %w", err)
+	}
+	if _, err := db.Exec(prune, userID, kind, at.Add(-models.QuotaWindow)); err != nil {
+		return fmt.Errorf("failed to prune quota usage: %w", err)
+	}
+	return nil
+}
+
+// QuotaUsed returns how many units of a quota kind a user has used since a
+// time, and when the oldest of them was used, or nil if none were
+func (db *DB) QuotaUsed(userID, kind string, since time.Time) (int, *time.Time, error) {
+	sum := "SELECT COALESCE(SUM(units), 0) FROM quota_usage WHERE user_id = ? AND kind = ? AND created_at >= ?"
+	oldest := "SELECT created_at FROM quota_usage WHERE user_id = ? AND kind = ? AND created_at >= ? ORDER BY created_at LIMIT 1"
+	if db.driver == "postgres" {
+		sum = "SELECT COALESCE(SUM(units), 0) FROM quota_usage WHERE user_id = $1 AND kind = $2 AND created_at >= $3"
+		oldest = "SELECT created_at FROM quota_usage WHERE user_id = $1 AND kind = $2 AND created_at >= $3 ORDER BY created_at LIMIT 1"
+	}
+
+	var used int
+	if err := db.QueryRow(sum, userID, kind, since).Scan(&used); err != nil {
+		return 0, nil, fmt.Errorf("failed to count quota usage: %w", err)
+	}
+
+	var at time.Time
+	err := db.QueryRow(oldest, userID, kind, since).Scan(&at)
+	if errors.Is(err, sql.ErrNoRows) {
+		return used, nil, nil
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to count quota usage: %w", err)
+	}
+	return used, &at, nil
+}
+
+const quotaGrantColumns = `id, user_id, kind, units, reason, granted_by, expires_at, created_at`
+
+// CreateQuotaGrant records a temporary quota raise
+func (db *DB) CreateQuotaGrant(grant *models.QuotaGrant) error {
+	grant.ID = uuid.New().String()
+	grant.CreatedAt = time.Now()
+
+	query := `INSERT INTO quota_grants (` + quotaGrantColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO quota_grants (` + quotaGrantColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	}
+
+	_, err := db.Exec(query, grant.ID, grant.UserID, grant.Kind, grant.Units, grant.Reason, grant.GrantedBy, grant.ExpiresAt, grant.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create quota grant: %w", err)
+	}
+	return nil
+}
+
+// ListQuotaGrants lists a user's grants that haven't expired by a time,
+// soonest to expire first
+func (db *DB) ListQuotaGrants(userID string, at time.Time) ([]models.QuotaGrant, error) {
+	query := `SELECT ` + quotaGrantColumns + ` FROM quota_grants WHERE user_id = ? AND expires_at > ? ORDER BY expires_at`
+	if db.driver == "postgres" {
+		query = `SELECT ` + quotaGrantColumns + ` FROM quota_grants WHERE user_id = $1 AND expires_at > $2 ORDER BY expires_at`
+	}
+
+	rows, err := db.Query(query, userID, at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list quota grants: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []models.QuotaGrant{}
+	for rows.Next() {
+		var grant models.QuotaGrant
+		if err := rows.Scan(&grant.ID, &grant.UserID, &grant.Kind, &grant.Units, &grant.Reason, &grant.GrantedBy, &grant.ExpiresAt, &grant.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan quota grant: %w", err)
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// DeleteQuotaGrant revokes one of a user's grants. It returns false if the
+// user has no such grant.
+func (db *DB) DeleteQuotaGrant(userID, id string) (bool, error) {
+	query := "DELETE FROM quota_grants WHERE id = ? AND user_id = ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM quota_grants WHERE id = $1 AND user_id = $2"
+	}
+
+	result, err := db.Exec(query, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete quota grant: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db *DB) createQuotaUsageTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS quota_usage (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			units INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`
+}
+
+func (db *DB) createQuotaGrantsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS quota_grants (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			units INTEGER NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			granted_by TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`
+}
@@ -0,0 +1,216 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const buildRolloutColumns = `
+	id, group_id, status, batch_size, max_failures, wait_for_status, wait_timeout,
+	inter_batch_delay, power_cycle, machines, current_batch, failures, paused_reason,
+	next_batch_at, created_by, created_at, updated_at, completed_at
+`
+
+// CreateBuildRollout creates a new build rollout
+func (db *DB) CreateBuildRollout(rollout *models.BuildRollout) error {
+	rollout.ID = uuid.New().String()
+	rollout.CreatedAt = time.Now()
+	rollout.UpdatedAt = rollout.CreatedAt
+
+	machinesJSON, err := json.Marshal(rollout.Machines)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO build_rollouts (
+			id, group_id, status, batch_size, max_failures, wait_for_status, wait_timeout,
+			inter_batch_delay, power_cycle, machines, current_batch, failures, created_by,
+			created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO build_rollouts (
+				id, group_id, status, batch_size, max_failures, wait_for_status, wait_timeout,
+				inter_batch_delay, power_cycle, machines, current_batch, failures, created_by,
+				created_at, updated_at
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		`
+	}
+
+	_, err = db.Exec(query,
+		rollout.ID,
+		rollout.GroupID,
+		rollout.Status,
+		rollout.BatchSize,
+		rollout.MaxFailures,
+		rollout.WaitForStatus,
+		rollout.WaitTimeout,
+		rollout.InterBatchDelay,
+		rollout.PowerCycle,
+		string(machinesJSON),
+		rollout.CurrentBatch,
+		rollout.Failures,
+		rollout.CreatedBy,
+		rollout.CreatedAt,
+		rollout.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create build rollout: %w", err)
+	}
+
+	return nil
+}
+
+// GetBuildRollout retrieves a build rollout by ID. It returns nil, nil if
+// there is no such rollout.
+func (db *DB) GetBuildRollout(id string) (*models.BuildRollout, error) {
+	query := `SELECT` + buildRolloutColumns + `FROM build_rollouts WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildRolloutColumns + `FROM build_rollouts WHERE id = $1`
+	}
+
+	rollout, err := scanBuildRollout(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get build rollout: %w", err)
+	}
+	return rollout, nil
+}
+
+// ListBuildRollouts lists a group's build rollouts, newest first
+func (db *DB) ListBuildRollouts(groupID string) ([]*models.BuildRollout, error) {
+	query := `SELECT` + buildRolloutColumns + `FROM build_rollouts WHERE group_id = ? ORDER BY created_at DESC`
+	if db.driver == "postgres" {
+		query = `SELECT` + buildRolloutColumns + `FROM build_rollouts WHERE group_id = $1 ORDER BY created_at DESC`
+	}
+
+	return db.queryBuildRollouts(query, groupID)
+}
+
+// ListActiveBuildRollouts lists running and paused build rollouts, oldest
+// first
+func (db *DB) ListActiveBuildRollouts() ([]*models.BuildRollout, error) {
+	query := `SELECT` + buildRolloutColumns + `FROM build_rollouts
+		WHERE status IN ('running', 'paused') ORDER BY created_at ASC`
+
+	return db.queryBuildRollouts(query)
+}
+
+func (db *DB) queryBuildRollouts(query string, args ...interface{}) ([]*models.BuildRollout, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build rollouts: %w", err)
+	}
+	defer rows.Close()
+
+	var rollouts []*models.BuildRollout
+	for rows.Next() {
+		rollout, err := scanBuildRollout(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan build rollout: %w", err)
+		}
+		rollouts = append(rollouts, rollout)
+	}
+
+	return rollouts, rows.Err()
+}
+
+// UpdateBuildRollout stores a build rollout's status and progress
+func (db *DB) UpdateBuildRollout(rollout *models.BuildRollout) error {
+	rollout.UpdatedAt = time.Now()
+
+	machinesJSON, err := json.Marshal(rollout.Machines)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE build_rollouts SET
+			status = ?, machines = ?, current_batch = ?, failures = ?, paused_reason = ?,
+			next_batch_at = ?, updated_at = ?, completed_at = ?
+		WHERE id = ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE build_rollouts SET
+				status = $1, machines = $2, current_batch = $3, failures = $4, paused_reason = $5,
+				next_batch_at = $6, updated_at = $7, completed_at = $8
+			WHERE id = $9
+		`
+	}
+
+	_, err = db.Exec(query,
+		rollout.Status,
+		string(machinesJSON),
+		rollout.CurrentBatch,
+		rollout.Failures,
+		rollout.PausedReason,
+		rollout.NextBatchAt,
+		rollout.UpdatedAt,
+		rollout.CompletedAt,
+		rollout.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update build rollout: %w", err)
+	}
+
+	return nil
+}
+
+// scanBuildRollout reads a row of buildRolloutColumns
+func scanBuildRollout(row rowScanner) (*models.BuildRollout, error) {
+	var rollout models.BuildRollout
+	var machinesJSON string
+	var pausedReason, createdBy sql.NullString
+	var nextBatchAt, completedAt sql.NullTime
+
+	err := row.Scan(
+		&rollout.ID,
+		&rollout.GroupID,
+		&rollout.Status,
+		&rollout.BatchSize,
+		&rollout.MaxFailures,
+		&rollout.WaitForStatus,
+		&rollout.WaitTimeout,
+		&rollout.InterBatchDelay,
+		&rollout.PowerCycle,
+		&machinesJSON,
+		&rollout.CurrentBatch,
+		&rollout.Failures,
+		&pausedReason,
+		&nextBatchAt,
+		&createdBy,
+		&rollout.CreatedAt,
+		&rollout.UpdatedAt,
+		&completedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rollout.PausedReason = pausedReason.String
+	rollout.CreatedBy = createdBy.String
+	if nextBatchAt.Valid {
+		rollout.NextBatchAt = &nextBatchAt.Time
+	}
+	if completedAt.Valid {
+		rollout.CompletedAt = &completedAt.Time
+	}
+	if err := json.Unmarshal([]byte(machinesJSON), &rollout.Machines); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rollout machines: %w", err)
+	}
+
+	return &rollout, nil
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// encryptedPrefix marks an encrypted BMC password in stored bmc_info
+const encryptedPrefix = "enc:v1:"
+
+// ErrSecretKey is returned when stored BMC credentials can't be decrypted
+// with the configured key
+var ErrSecretKey = errors.New("BMC credentials cannot be decrypted: the BMC encryption key is missing or differs from the one they were encrypted with")
+
+// SetSecretKey enables encryption of BMC passwords at rest. The key is a
+// passphrase; AES-256-GCM is keyed with its SHA-256 hash. Without a key,
+// passwords are stored as given and encrypted ones are left untouched, which
+// lets processes that never use BMC credentials (the builder) share the
+// database without the key.
+func (db *DB) SetSecretKey(passphrase string) error {
+	if passphrase == "" {
+		db.secrets = nil
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	db.secrets = gcm
+	return nil
+}
+
+// VerifySecretKey checks the configured key against a stored encrypted BMC
+// password. It fails if encrypted credentials exist but there is no key, or
+// the key doesn't decrypt them.
+func (db *DB) VerifySecretKey() error {
+	query := `SELECT bmc_info FROM machines WHERE bmc_info LIKE ? LIMIT 1`
+	pattern := "%" + encryptedPrefix + "%"
+
+	if db.driver == "postgres" {
+		query = `SELECT bmc_info FROM machines WHERE bmc_info->>'password' LIKE $1 LIMIT 1`
+		pattern = encryptedPrefix + "%"
+	}
+
+	var bmcJSON []byte
+	err := db.QueryRow(query, pattern).Scan(&bmcJSON)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil // Nothing encrypted yet
+		}
+		return fmt.Errorf("failed to read BMC credentials: %w", err)
+	}
+
+	if db.secrets == nil {
+		return ErrSecretKey
+	}
+
+	var info models.BMCInfo
+	if err := json.Unmarshal(bmcJSON, &info); err != nil {
+		return fmt.Errorf("failed to unmarshal bmc_info: %w", err)
+	}
+	if _, err := db.decryptSecret(info.Password); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// marshalBMCInfo encodes BMC info for storage, encrypting the password when
+// a key is configured
+func (db *DB) marshalBMCInfo(info *models.BMCInfo) ([]byte, error) {
+	stored := *info
+	if db.secrets != nil && stored.Password != "" && !strings.HasPrefix(stored.Password, encryptedPrefix) {
+		nonce := make([]byte, db.secrets.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("failed to encrypt BMC password: %w", err)
+		}
+		sealed := db.secrets.Seal(nonce, nonce, []byte(stored.Password), nil)
+		stored.Password = encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal bmc_info: %w", err)
+	}
+	return data, nil
+}
+
+// unmarshalBMCInfo decodes stored BMC info, decrypting the password when a
+// key is configured
+func (db *DB) unmarshalBMCInfo(data []byte) (*models.BMCInfo, error) {
+	var info models.BMCInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bmc_info: %w", err)
+	}
+
+	if db.secrets != nil && strings.HasPrefix(info.Password, encryptedPrefix) {
+		password, err := db.decryptSecret(info.Password)
+		if err != nil {
+			return nil, err
+		}
+		info.Password = password
+	}
+
+	return &info, nil
+}
+
+func (db *DB) decryptSecret(value string) (string, error) {
+	if db.secrets == nil {
+		return "", ErrSecretKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < db.secrets.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted BMC password")
+	}
+
+	nonce, ciphertext := sealed[:db.secrets.NonceSize()], sealed[db.secrets.NonceSize():]
+	plain, err := db.secrets.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrSecretKey
+	}
+
+	return string(plain), nil
+}
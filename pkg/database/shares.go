@@ -0,0 +1,198 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const machineShareColumns = `
+	id, machine_id, scopes, build_id, note, created_by, created_at, expires_at, revoked_at, revoked_by
+`
+
+// CreateMachineShare records a share link for a machine. The share's
+// ExpiresAt must be set.
+func (db *DB) CreateMachineShare(share *models.MachineShare) error {
+	share.ID = uuid.New().String()
+	share.CreatedAt = time.Now()
+	share.RevokedAt = nil
+	share.RevokedBy = ""
+
+	query := `INSERT INTO machine_shares (` + machineShareColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		query = `INSERT INTO machine_shares (` + machineShareColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	}
+
+	scopes, err := marshalJSONColumn(share.Scopes)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(query,
+		share.ID,
+		share.MachineID,
+		scopes,
+		share.BuildID,
+		share.Note,
+		share.CreatedBy,
+		share.CreatedAt,
+		share.ExpiresAt,
+		nil,
+		"",
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create machine share: %w", err)
+	}
+	return nil
+}
+
+// GetMachineShare retrieves a machine's share. It returns nil, nil if the
+// machine has no such share.
+func (db *DB) GetMachineShare(machineID, id string) (*models.MachineShare, error) {
+	query := `SELECT` + machineShareColumns + `FROM machine_shares WHERE machine_id = ? AND id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + machineShareColumns + `FROM machine_shares WHERE machine_id = $1 AND id = $2`
+	}
+
+	share, err := scanMachineShare(db.QueryRow(query, machineID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get machine share: %w", err)
+	}
+	return share, nil
+}
+
+// ListMachineShares lists a machine's shares, newest first, including
+// expired and revoked ones
+func (db *DB) ListMachineShares(machineID string) ([]*models.MachineShare, error) {
+	query := `SELECT` + machineShareColumns + `FROM machine_shares WHERE machine_id = ? ORDER BY created_at DESC, id`
+	if db.driver == "postgres" {
+		query = `SELECT` + machineShareColumns + `FROM machine_shares WHERE machine_id = $1 ORDER BY created_at DESC, id`
+	}
+
+	rows, err := db.Query(query, machineID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list machine shares: %w", err)
+	}
+	defer rows.Close()
+
+	var shares []*models.MachineShare
+	for rows.Next() {
+		share, err := scanMachineShare(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan machine share: %w", err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// RevokeMachineShare revokes a share. It returns false if the share was
+// already revoked.
+func (db *DB) RevokeMachineShare(id, revokedBy string, revokedAt time.Time) (bool, error) {
+	query := `UPDATE machine_shares SET revoked_at = ?, revoked_by = ? WHERE id = ? AND revoked_at IS NULL`
+	if db.driver == "postgres" {
+		query = `UPDATE machine_shares SET revoked_at = $1, revoked_by = $2 WHERE id = $3 AND revoked_at IS NULL`
+	}
+
+	result, err := db.Exec(query, revokedAt, revokedBy, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke machine share: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ListRevokedShareIDs returns the IDs of revoked shares that haven't
+// expired yet. Tokens of expired shares are refused anyway, so they
+// needn't be listed.
+func (db *DB) ListRevokedShareIDs(now time.Time) ([]string, error) {
+	query := `SELECT id FROM machine_shares WHERE revoked_at IS NOT NULL AND expires_at > ?`
+	if db.driver == "postgres" {
+		query = `SELECT id FROM machine_shares WHERE revoked_at IS NOT NULL AND expires_at > $1`
+	}
+
+	rows, err := db.Query(query, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revoked shares: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func scanMachineShare(row rowScanner) (*models.MachineShare, error) {
+	var share models.MachineShare
+	var scopes jsonColumn
+	var buildID, note, createdBy, revokedBy sql.NullString
+	var revokedAt sql.NullTime
+
+	err := row.Scan(
+		&share.ID,
+		&share.MachineID,
+		&scopes,
+		&buildID,
+		&note,
+		&createdBy,
+		&share.CreatedAt,
+		&share.ExpiresAt,
+		&revokedAt,
+		&revokedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	share.BuildID = buildID.String
+	share.Note = note.String
+	share.CreatedBy = createdBy.String
+	share.RevokedBy = revokedBy.String
+	if revokedAt.Valid {
+		share.RevokedAt = &revokedAt.Time
+	}
+	if err := scopes.Unmarshal(&share.Scopes); err != nil {
+		return nil, fmt.Errorf("failed to decode scopes: %w", err)
+	}
+
+	return &share, nil
+}
+
+func (db *DB) createMachineSharesTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS machine_shares (
+			id TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL,
+			scopes %s NOT NULL,
+			build_id TEXT,
+			note TEXT,
+			created_by TEXT,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			revoked_by TEXT,
+			FOREIGN KEY (machine_id) REFERENCES machines(id) ON DELETE CASCADE
+		)
+	`, jsonType)
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Snapshot writes a consistent copy of the database to path while it stays
+// in use. SQLite databases are copied with VACUUM INTO; PostgreSQL databases
+// are dumped with pg_dump in its custom format, for pg_restore.
+func (db *DB) Snapshot(path string) error {
+	switch db.driver {
+	case "sqlite3":
+		if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+			return fmt.Errorf("failed to snapshot database: %w", err)
+		}
+		return nil
+
+	case "postgres":
+		cmd := exec.Command("pg_dump", "--format=custom", "--no-owner", "--file="+path, "--dbname="+db.dsn)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("pg_dump failed: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("snapshots are not supported for driver %s", db.driver)
+}
+
+// SQLitePath returns the database file named by a SQLite DSN
+func SQLitePath(dsn string) (string, error) {
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" || path == ":memory:" {
+		return "", fmt.Errorf("DSN %q does not name a database file", dsn)
+	}
+	return path, nil
+}
@@ -0,0 +1,210 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// StatsFilter selects what GetStats counts
+type StatsFilter struct {
+	// GroupID limits the counts to a group's machines, if set
+	GroupID string
+
+	// IncludeVirtual counts virtual machines, and their builds and
+	// metrics, which are left out otherwise
+	IncludeVirtual bool
+
+	// VisibleTo leaves out machines claimed by users other than this one,
+	// with their builds and metrics
+	VisibleTo string
+
+	// TopHardware is how many manufacturer and model pairs to list, if any
+	TopHardware int
+
+	// Machines not seen since OfflineSince are offline, and builds and
+	// webhook deliveries since Since are counted
+	OfflineSince time.Time
+	Since        time.Time
+}
+
+// GetStats summarizes the fleet with aggregate queries, without loading
+// any machines
+func (db *DB) GetStats(filter StatsFilter) (*models.Stats, error) {
+	stats := &models.Stats{
+		GroupID:     filter.GroupID,
+		GeneratedAt: time.Now(),
+	}
+
+	if err := db.machineStats(filter, &stats.Machines); err != nil {
+		return nil, err
+	}
+	if err := db.buildStats(filter, &stats.Builds); err != nil {
+		return nil, err
+	}
+	if err := db.webhookStats(filter, &stats.Webhooks); err != nil {
+		return nil, err
+	}
+
+	query, args := db.statsQuery(filter, `SELECT COUNT(*) FROM machine_metrics WHERE 1=1`, "machine_id")
+	if err := db.QueryRow(query, args...).Scan(&stats.MetricsRows); err != nil {
+		return nil, fmt.Errorf("failed to count metrics: %w", err)
+	}
+
+	return stats, nil
+}
+
+// statsQuery limits a query to the filter's group and visible machines, by
+// the column holding the machine ID, and leaves out virtual machines unless
+// the filter includes them. It returns the query with the args of the placeholders it
+// added, numbered after those of args.
+func (db *DB) statsQuery(filter StatsFilter, query, machineColumn string, args ...interface{}) (string, []interface{}) {
+	if !filter.IncludeVirtual {
+		// Builds of system images have no machine
+		query += " AND COALESCE(" + machineColumn + ", '') NOT IN (SELECT id FROM machines WHERE is_virtual)"
+	}
+
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		if db.driver == "postgres" {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
+	}
+	if filter.VisibleTo != "" {
+		query += " AND " + visibleMachineCondition(machineColumn, arg(filter.VisibleTo))
+	}
+	if filter.GroupID != "" {
+		query += " AND " + machineColumn + " IN (SELECT machine_id FROM group_memberships WHERE group_id = " + arg(filter.GroupID) + ")"
+	}
+	return query, args
+}
+
+func (db *DB) machineStats(filter StatsFilter, stats *models.MachineStats) error {
+	stats.ByStatus = make(map[models.MachineStatus]int)
+	stats.ByHardware = []models.HardwareCount{}
+	stats.OfflineSince = filter.OfflineSince
+
+	query, args := db.statsQuery(filter, `SELECT status, COUNT(*) FROM machines WHERE deleted_at IS NULL`, "id")
+	rows, err := db.Query(query+" GROUP BY status", args...)
+	if err != nil {
+		return fmt.Errorf("failed to count machines: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status models.MachineStatus
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return fmt.Errorf("failed to scan machine count: %w", err)
+		}
+		stats.ByStatus[status] = count
+		if status != models.StatusDecommissioned {
+			stats.Total += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	hardware := `SELECT COALESCE(json_extract(hardware, '$.manufacturer'), ''), COALESCE(json_extract(hardware, '$.model'), ''), COUNT(*)
+		FROM machines WHERE deleted_at IS NULL`
+	if db.driver == "postgres" {
+		hardware = `SELECT COALESCE(hardware->>'manufacturer', ''), COALESCE(hardware->>'model', ''), COUNT(*)
+			FROM machines WHERE deleted_at IS NULL`
+	}
+	query, args = db.statsQuery(filter, hardware, "id")
+	query += " GROUP BY 1, 2 ORDER BY 3 DESC, 1, 2 LIMIT " + fmt.Sprint(filter.TopHardware)
+	hwRows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to count machine hardware: %w", err)
+	}
+	defer hwRows.Close()
+
+	for hwRows.Next() {
+		var count models.HardwareCount
+		if err := hwRows.Scan(&count.Manufacturer, &count.Model, &count.Count); err != nil {
+			return fmt.Errorf("failed to scan hardware count: %w", err)
+		}
+		stats.ByHardware = append(stats.ByHardware, count)
+	}
+	if err := hwRows.Err(); err != nil {
+		return err
+	}
+
+	offline := `SELECT COUNT(*) FROM machines
+		WHERE deleted_at IS NULL AND status <> ? AND COALESCE(last_seen_at, enrolled_at) < ?`
+	if db.driver == "postgres" {
+		offline = `SELECT COUNT(*) FROM machines
+			WHERE deleted_at IS NULL AND status <> $1 AND COALESCE(last_seen_at, enrolled_at) < $2`
+	}
+	query, args = db.statsQuery(filter, offline, "id", models.StatusDecommissioned, filter.OfflineSince)
+	if err := db.QueryRow(query, args...).Scan(&stats.Offline); err != nil {
+		return fmt.Errorf("failed to count offline machines: %w", err)
+	}
+
+	noncompliant := `SELECT COUNT(*) FROM machines WHERE deleted_at IS NULL AND compliance_status = ?`
+	if db.driver == "postgres" {
+		noncompliant = `SELECT COUNT(*) FROM machines WHERE deleted_at IS NULL AND compliance_status = $1`
+	}
+	query, args = db.statsQuery(filter, noncompliant, "id", models.ComplianceFailed)
+	if err := db.QueryRow(query, args...).Scan(&stats.HardwareNoncompliant); err != nil {
+		return fmt.Errorf("failed to count noncompliant machines: %w", err)
+	}
+
+	return nil
+}
+
+func (db *DB) buildStats(filter StatsFilter, stats *models.BuildStats) error {
+	stats.Since = filter.Since
+	stats.ByStatus = make(map[string]models.BuildStatusStats)
+
+	builds := `SELECT status, COUNT(*), AVG(duration_ms) FROM builds WHERE created_at >= ?`
+	if db.driver == "postgres" {
+		builds = `SELECT status, COUNT(*), AVG(duration_ms) FROM builds WHERE created_at >= $1`
+	}
+	query, args := db.statsQuery(filter, builds, "machine_id", filter.Since)
+	rows, err := db.Query(query+" GROUP BY status", args...)
+	if err != nil {
+		return fmt.Errorf("failed to count builds: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		var avgMillis sql.NullFloat64
+		if err := rows.Scan(&status, &count, &avgMillis); err != nil {
+			return fmt.Errorf("failed to scan build count: %w", err)
+		}
+		stats.ByStatus[status] = models.BuildStatusStats{
+			Count:                  count,
+			AverageDurationSeconds: avgMillis.Float64 / 1000,
+		}
+		stats.Total += count
+	}
+
+	return rows.Err()
+}
+
+func (db *DB) webhookStats(filter StatsFilter, stats *models.WebhookStats) error {
+	stats.Since = filter.Since
+
+	query := `SELECT COUNT(*), COALESCE(SUM(CASE WHEN success THEN 1 ELSE 0 END), 0)
+		FROM webhook_deliveries WHERE created_at >= ?`
+	if db.driver == "postgres" {
+		query = `SELECT COUNT(*), COALESCE(SUM(CASE WHEN success THEN 1 ELSE 0 END), 0)
+			FROM webhook_deliveries WHERE created_at >= $1`
+	}
+
+	if err := db.QueryRow(query, filter.Since).Scan(&stats.Deliveries, &stats.Succeeded); err != nil {
+		return fmt.Errorf("failed to count webhook deliveries: %w", err)
+	}
+	if stats.Deliveries > 0 {
+		rate := float64(stats.Succeeded) / float64(stats.Deliveries)
+		stats.SuccessRate = &rate
+	}
+	return nil
+}
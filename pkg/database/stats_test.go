@@ -0,0 +1,186 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// setColumn sets a column of the row with id, for the timestamps and flags
+// the store sets itself
+func setColumn(t *testing.T, db *DB, table, column string, value interface{}, id string) {
+	t.Helper()
+
+	query := fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", table, column)
+	if db.driver == "postgres" {
+		query = fmt.Sprintf("UPDATE %s SET %s = $1 WHERE id = $2", table, column)
+	}
+	if _, err := db.Exec(query, value, id); err != nil {
+		t.Fatalf("set %s.%s: %v", table, column, err)
+	}
+}
+
+// seedStats creates a fleet with something for each stats number to count
+// or leave out, and returns the ID of a group holding two of its machines
+func seedStats(t *testing.T, db *DB) string {
+	t.Helper()
+
+	now := time.Now().UTC()
+	old := now.Add(-48 * time.Hour)
+
+	type seed struct {
+		serviceTag          string
+		manufacturer, model string
+		status              models.MachineStatus
+		lastSeen            *time.Time
+	}
+	machines := map[string]*models.Machine{}
+	for i, s := range []seed{
+		{"STATS01", "Dell Inc.", "PowerEdge R650", models.StatusEnrolled, &now},
+		{"STATS02", "Dell Inc.", "PowerEdge R650", models.StatusConfigured, &old}, // offline
+		{"STATS03", "HPE", "ProLiant DL360", models.StatusConfigured, nil},        // never seen, enrolled long ago
+		{"STATS04", "Dell Inc.", "PowerEdge R650", models.StatusDecommissioned, &old},
+		{"STATS05", "QEMU", "Standard PC", models.StatusEnrolled, &now},         // virtual
+		{"STATS06", "Dell Inc.", "PowerEdge R650", models.StatusEnrolled, &now}, // trashed
+	} {
+		hardware := models.HardwareInfo{Manufacturer: s.manufacturer, Model: s.model}
+		machine, err := db.CreateMachine(models.EnrollmentRequest{ServiceTag: s.serviceTag, MACAddress: fmt.Sprintf("02:00:00:00:00:%02x", i), Hardware: hardware})
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine.Status = s.status
+		if err := db.UpdateMachine(machine); err != nil {
+			t.Fatal(err)
+		}
+		setColumn(t, db, "machines", "enrolled_at", old, machine.ID)
+		if s.lastSeen != nil {
+			setColumn(t, db, "machines", "last_seen_at", *s.lastSeen, machine.ID)
+		}
+		machines[s.serviceTag] = machine
+	}
+	setColumn(t, db, "machines", "compliance_status", models.ComplianceFailed, machines["STATS02"].ID)
+	setColumn(t, db, "machines", "is_virtual", true, machines["STATS05"].ID)
+	setColumn(t, db, "machines", "deleted_at", now, machines["STATS06"].ID)
+
+	group, err := db.CreateGroup("stats", "", nil, nil, nil, false, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"STATS01", "STATS02"} {
+		if err := db.AddMachineToGroup(group.ID, machines[tag].ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := func(tag, status string, duration time.Duration, created time.Time) {
+		t.Helper()
+		b, err := db.CreateBuild(machines[tag].ID, "{ ... }: { }", "", "", false, false, "", models.BuildRequirements{}, "", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Status, b.DurationMS = status, duration.Milliseconds()
+		if err := db.UpdateBuild(b); err != nil {
+			t.Fatal(err)
+		}
+		setColumn(t, db, "builds", "created_at", created, b.ID)
+	}
+	build("STATS01", "success", time.Minute, now)
+	build("STATS01", "success", 2*time.Minute, now)
+	build("STATS01", "failed", 30*time.Second, now)
+	build("STATS02", "success", time.Minute, old) // before the window
+	build("STATS03", "pending", 0, now)
+	build("STATS05", "success", time.Minute, now)
+
+	webhook := &models.Webhook{Name: "stats", URL: "https://hooks.example.com/", Events: []string{"machine.enrolled"}, Active: true}
+	if err := db.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	for i, success := range []bool{true, true, true, false, false} {
+		delivery := &models.WebhookDelivery{WebhookID: webhook.ID, Event: "machine.enrolled", Success: success}
+		if err := db.CreateWebhookDelivery(delivery); err != nil {
+			t.Fatal(err)
+		}
+		if i == 4 {
+			setColumn(t, db, "webhook_deliveries", "created_at", old, delivery.ID)
+		}
+	}
+
+	for _, tag := range []string{"STATS01", "STATS01", "STATS02", "STATS05"} {
+		if err := db.CreateMachineMetrics(&models.MachineMetrics{MachineID: machines[tag].ID, Timestamp: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return group.ID
+}
+
+func TestGetStats(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, db *DB) {
+		groupID := seedStats(t, db)
+		now := time.Now()
+		filter := StatsFilter{TopHardware: 10, OfflineSince: now.Add(-24 * time.Hour), Since: now.Add(-24 * time.Hour)}
+
+		stats, err := db.GetStats(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		machines := stats.Machines
+		wantStatus := map[models.MachineStatus]int{models.StatusEnrolled: 1, models.StatusConfigured: 2, models.StatusDecommissioned: 1}
+		if machines.Total != 3 || !reflect.DeepEqual(machines.ByStatus, wantStatus) {
+			t.Errorf("machines = %d %v, want 3 %v", machines.Total, machines.ByStatus, wantStatus)
+		}
+		wantHardware := []models.HardwareCount{{Manufacturer: "Dell Inc.", Model: "PowerEdge R650", Count: 3}, {Manufacturer: "HPE", Model: "ProLiant DL360", Count: 1}}
+		if !reflect.DeepEqual(machines.ByHardware, wantHardware) {
+			t.Errorf("by hardware = %v, want %v", machines.ByHardware, wantHardware)
+		}
+		if machines.Offline != 2 || machines.HardwareNoncompliant != 1 {
+			t.Errorf("offline, noncompliant = %d, %d, want 2, 1", machines.Offline, machines.HardwareNoncompliant)
+		}
+
+		wantBuilds := map[string]models.BuildStatusStats{
+			"success": {Count: 2, AverageDurationSeconds: 90},
+			"failed":  {Count: 1, AverageDurationSeconds: 30},
+			"pending": {Count: 1, AverageDurationSeconds: 0},
+		}
+		if stats.Builds.Total != 4 || !reflect.DeepEqual(stats.Builds.ByStatus, wantBuilds) {
+			t.Errorf("builds = %d %v, want 4 %v", stats.Builds.Total, stats.Builds.ByStatus, wantBuilds)
+		}
+		if webhooks := stats.Webhooks; webhooks.Deliveries != 4 || webhooks.Succeeded != 3 || webhooks.SuccessRate == nil || *webhooks.SuccessRate != 0.75 {
+			t.Errorf("webhooks = %+v, want 3 of 4 deliveries succeeded", webhooks)
+		}
+		if stats.MetricsRows != 3 {
+			t.Errorf("metrics rows = %d, want 3", stats.MetricsRows)
+		}
+
+		// A group's numbers are its machines', except for webhooks
+		filter.GroupID = groupID
+		filter.TopHardware = 1
+		if stats, err = db.GetStats(filter); err != nil {
+			t.Fatal(err)
+		}
+		wantStatus = map[models.MachineStatus]int{models.StatusEnrolled: 1, models.StatusConfigured: 1}
+		if stats.Machines.Total != 2 || !reflect.DeepEqual(stats.Machines.ByStatus, wantStatus) ||
+			stats.Machines.Offline != 1 || stats.Machines.HardwareNoncompliant != 1 {
+			t.Errorf("group machines = %+v", stats.Machines)
+		}
+		if want := []models.HardwareCount{{Manufacturer: "Dell Inc.", Model: "PowerEdge R650", Count: 2}}; !reflect.DeepEqual(stats.Machines.ByHardware, want) {
+			t.Errorf("group hardware = %v, want %v", stats.Machines.ByHardware, want)
+		}
+		if stats.Builds.Total != 3 || stats.MetricsRows != 3 || stats.Webhooks.Deliveries != 4 {
+			t.Errorf("group builds, metrics rows, deliveries = %d, %d, %d, want 3, 3, 4", stats.Builds.Total, stats.MetricsRows, stats.Webhooks.Deliveries)
+		}
+
+		// Virtual machines count when asked for
+		filter = StatsFilter{IncludeVirtual: true, OfflineSince: now.Add(-24 * time.Hour), Since: now.Add(-24 * time.Hour)}
+		if stats, err = db.GetStats(filter); err != nil {
+			t.Fatal(err)
+		}
+		if stats.Machines.Total != 4 || stats.Builds.Total != 5 || stats.MetricsRows != 4 || len(stats.Machines.ByHardware) != 0 {
+			t.Errorf("with virtual machines: machines %d, builds %d, metrics rows %d, hardware %v, want 4, 5, 4, none",
+				stats.Machines.Total, stats.Builds.Total, stats.MetricsRows, stats.Machines.ByHardware)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// machineArtifactBytes is the space a machine's images take up, for
+// selecting and ordering machines by it
+const machineArtifactBytes = `COALESCE((SELECT SUM(bytes) FROM artifact_usage WHERE artifact_usage.service_tag = machines.service_tag AND artifact_usage.service_tag <> ''), 0)`
+
+// SetArtifactUsage records the space a directory of the images directory
+// takes up, as measured when its artifacts were written
+func (db *DB) SetArtifactUsage(usage models.ArtifactUsage) error {
+	query := `
+		INSERT INTO artifact_usage (path, service_tag, bytes, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET
+			service_tag = excluded.service_tag, bytes = excluded.bytes, updated_at = excluded.updated_at
+	`
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO artifact_usage (path, service_tag, bytes, updated_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (path) DO UPDATE SET
+				service_tag = excluded.service_tag, bytes = excluded.bytes, updated_at = excluded.updated_at
+		`
+	}
+
+	if _, err := db.Exec(query, usage.Path, usage.ServiceTag, usage.Bytes, usage.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to record artifact usage: %w", err)
+	}
+	return nil
+}
+
+// ReplaceArtifactUsage replaces the recorded usage of every directory with
+// that of a walk of the whole images directory
+func (db *DB) ReplaceArtifactUsage(usage []models.ArtifactUsage) error {
+	insert := "INSERT INTO artifact_usage (path, service_tag, bytes, updated_at) VALUES (?, ?, ?, ?)"
+	if db.driver == "postgres" {
+		insert = "INSERT INTO artifact_usage (path, service_tag, bytes, updated_at) VALUES ($1, $2, $3, $4)"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM artifact_usage"); err != nil {
+		return fmt.Errorf("failed to clear artifact usage: %w", err)
+	}
+	for _, u := range usage {
+		if _, err := tx.Exec(insert, u.Path, u.ServiceTag, u.Bytes, u.UpdatedAt); err != nil {
+			return fmt.Errorf("failed to record artifact usage: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListArtifactUsage lists the recorded usage of the images directory's
+// directories, largest first, with the machine each machine directory
+// belongs to, if it still exists
+func (db *DB) ListArtifactUsage() ([]models.ArtifactUsage, error) {
+	rows, err := db.Query(`
+		SELECT u.path, u.service_tag, m.id, m.hostname, u.bytes, u.updated_at
+		FROM artifact_usage u
+		LEFT JOIN machines m ON u.service_tag <> '' AND m.service_tag = u.service_tag AND m.deleted_at IS NULL
+		ORDER BY u.bytes DESC, u.path ASC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artifact usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := []models.ArtifactUsage{}
+	for rows.Next() {
+		var u models.ArtifactUsage
+		var machineID, hostname sql.NullString
+		if err := rows.Scan(&u.Path, &u.ServiceTag, &machineID, &hostname, &u.Bytes, &u.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan artifact usage: %w", err)
+		}
+		u.MachineID = machineID.String
+		u.Hostname = hostname.String
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+func (db *DB) createArtifactUsageTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS artifact_usage (
+			path TEXT PRIMARY KEY,
+			service_tag TEXT NOT NULL DEFAULT '',
+			bytes BIGINT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		)
+	`
+}
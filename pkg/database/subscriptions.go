@@ -0,0 +1,318 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const subscriptionColumns = `s.id, s.user_id, s.machine_id, s.group_id, s.events, s.digest, s.created_at`
+
+// CreateSubscription records a user's subscription. Each of its event
+// types is indexed with its machine or group, so the subscriptions an
+// event matches are looked up rather than found by checking them all.
+func (db *DB) CreateSubscription(sub *models.Subscription) error {
+	sub.ID = uuid.New().String()
+	sub.CreatedAt = time.Now()
+
+	insert := "INSERT INTO user_subscriptions (id, user_id, machine_id, group_id, events, digest, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	insertEvent := "INSERT INTO user_subscription_events (subscription_id, event, machine_id, group_id) VALUES (?, ?, ?, ?)"
+	if db.driver == "postgres" {
+		insert = "INSERT INTO user_subscriptions (id, user_id, machine_id, group_id, events, digest, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+		insertEvent = "INSERT INTO user_subscription_events (subscription_id, event, machine_id, group_id) VALUES ($1, $2, $3, $4)"
+	}
+
+	eventsJSON, err := marshalJSONColumn(sub.Events)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(insert, sub.ID, sub.UserID, sub.MachineID, sub.GroupID, eventsJSON, sub.Digest, sub.CreatedAt); err != nil {
+		return fmt.Errorf("failed to create subscription: %w", err)
+	}
+	for _, event := range sub.Events {
+		if _, err := tx.Exec(insertEvent, sub.ID, event, sub.MachineID, sub.GroupID); err != nil {
+			return fmt.Errorf("failed to index subscription: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSubscription retrieves a subscription. It returns nil, nil if there
+// is no such subscription.
+func (db *DB) GetSubscription(id string) (*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + ` FROM user_subscriptions s WHERE s.id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT ` + subscriptionColumns + ` FROM user_subscriptions s WHERE s.id = $1`
+	}
+
+	sub, err := scanSubscription(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	return sub, nil
+}
+
+// ListUserSubscriptions lists a user's subscriptions, oldest first
+func (db *DB) ListUserSubscriptions(userID string) ([]*models.Subscription, error) {
+	query := `SELECT ` + subscriptionColumns + ` FROM user_subscriptions s WHERE s.user_id = ? ORDER BY s.created_at, s.id`
+	if db.driver == "postgres" {
+		query = `SELECT ` + subscriptionColumns + ` FROM user_subscriptions s WHERE s.user_id = $1 ORDER BY s.created_at, s.id`
+	}
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subs := []*models.Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// CountUserSubscriptions returns how many subscriptions a user has
+func (db *DB) CountUserSubscriptions(userID string) (int, error) {
+	query := "SELECT COUNT(*) FROM user_subscriptions WHERE user_id = ?"
+	if db.driver == "postgres" {
+		query = "SELECT COUNT(*) FROM user_subscriptions WHERE user_id = $1"
+	}
+
+	var n int
+	if err := db.QueryRow(query, userID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count subscriptions: %w", err)
+	}
+	return n, nil
+}
+
+// ListSubscriptionsForEvent returns the subscriptions of active users to
+// events of eventType for a machine, directly or through one of its
+// groups, with the users' email addresses and roles
+func (db *DB) ListSubscriptionsForEvent(machineID, eventType string) ([]*models.Subscription, error) {
+	query := `
+		SELECT ` + subscriptionColumns + `, u.email, u.role
+		FROM user_subscription_events e
+		JOIN user_subscriptions s ON s.id = e.subscription_id
+		JOIN users u ON u.id = s.user_id
+		WHERE e.event IN (?, '*')
+			AND (e.machine_id = ? OR e.group_id IN (SELECT group_id FROM group_memberships WHERE machine_id = ?))
+			AND u.active
+		ORDER BY s.created_at, s.id
+	`
+	args := []interface{}{eventType, machineID, machineID}
+	if db.driver == "postgres" {
+		query = `
+			SELECT ` + subscriptionColumns + `, u.email, u.role
+			FROM user_subscription_events e
+			JOIN user_subscriptions s ON s.id = e.subscription_id
+			JOIN users u ON u.id = s.user_id
+			WHERE e.event IN ($1, '*')
+				AND (e.machine_id = $2 OR e.group_id IN (SELECT group_id FROM group_memberships WHERE machine_id = $2))
+				AND u.active
+			ORDER BY s.created_at, s.id
+		`
+		args = args[:2]
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []*models.Subscription
+	for rows.Next() {
+		var email string
+		var role models.UserRole
+		sub, err := scanSubscription(rows, &email, &role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		sub.Email = email
+		sub.Role = role
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// DeleteSubscription deletes a subscription and the events held for its
+// digest. It returns false if there is no such subscription.
+func (db *DB) DeleteSubscription(id string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	n, err := db.deleteSubscriptions(tx, "id", id)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+// deleteSubscriptions deletes the subscriptions whose column is id, such
+// as a machine's or a user's, with their index and held digest events. It
+// returns how many it deleted.
+func (db *DB) deleteSubscriptions(exec execer, column, id string) (int64, error) {
+	match := fmt.Sprintf("SELECT id FROM user_subscriptions WHERE %s = ?", column)
+	query := fmt.Sprintf("DELETE FROM user_subscriptions WHERE %s = ?", column)
+	if db.driver == "postgres" {
+		match = fmt.Sprintf("SELECT id FROM user_subscriptions WHERE %s = $1", column)
+		query = fmt.Sprintf("DELETE FROM user_subscriptions WHERE %s = $1", column)
+	}
+
+	for _, table := range []string{"subscription_digest_items", "user_subscription_events"} {
+		if _, err := exec.Exec(fmt.Sprintf("DELETE FROM %s WHERE subscription_id IN (%s)", table, match), id); err != nil {
+			return 0, fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+	result, err := exec.Exec(query, id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete subscriptions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// AddSubscriptionDigestItem holds an event for a digest subscription's
+// next digest
+func (db *DB) AddSubscriptionDigestItem(item *models.SubscriptionDigestItem) error {
+	item.ID = uuid.New().String()
+	item.CreatedAt = time.Now()
+
+	query := "INSERT INTO subscription_digest_items (id, subscription_id, user_id, event, created_at) VALUES (?, ?, ?, ?, ?)"
+	if db.driver == "postgres" {
+		query = "INSERT INTO subscription_digest_items (id, subscription_id, user_id, event, created_at) VALUES ($1, $2, $3, $4, $5)"
+	}
+
+	if _, err := db.Exec(query, item.ID, item.SubscriptionID, item.UserID, string(item.Event), item.CreatedAt); err != nil {
+		return fmt.Errorf("failed to hold event for digest: %w", err)
+	}
+	return nil
+}
+
+// ListSubscriptionDigestItems lists the events held for digests, by user
+// and then in the order they happened
+func (db *DB) ListSubscriptionDigestItems() ([]*models.SubscriptionDigestItem, error) {
+	rows, err := db.Query(`
+		SELECT id, subscription_id, user_id, event, created_at
+		FROM subscription_digest_items
+		ORDER BY user_id, created_at, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list digest events: %w", err)
+	}
+	defer rows.Close()
+
+	var items []*models.SubscriptionDigestItem
+	for rows.Next() {
+		var item models.SubscriptionDigestItem
+		var event string
+		if err := rows.Scan(&item.ID, &item.SubscriptionID, &item.UserID, &event, &item.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan digest event: %w", err)
+		}
+		item.Event = []byte(event)
+		items = append(items, &item)
+	}
+	return items, rows.Err()
+}
+
+// DeleteSubscriptionDigestItems deletes a user's events held for digests
+// up to and including through, once their digest is sent
+func (db *DB) DeleteSubscriptionDigestItems(userID string, through time.Time) error {
+	query := "DELETE FROM subscription_digest_items WHERE user_id = ? AND created_at <= ?"
+	if db.driver == "postgres" {
+		query = "DELETE FROM subscription_digest_items WHERE user_id = $1 AND created_at <= $2"
+	}
+
+	if _, err := db.Exec(query, userID, through); err != nil {
+		return fmt.Errorf("failed to delete digest events: %w", err)
+	}
+	return nil
+}
+
+// scanSubscription scans a subscription's columns, followed by extra
+func scanSubscription(row rowScanner, extra ...interface{}) (*models.Subscription, error) {
+	var sub models.Subscription
+	var events jsonColumn
+
+	dest := append([]interface{}{
+		&sub.ID,
+		&sub.UserID,
+		&sub.MachineID,
+		&sub.GroupID,
+		&events,
+		&sub.Digest,
+		&sub.CreatedAt,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	if err := events.Unmarshal(&sub.Events); err != nil {
+		return nil, fmt.Errorf("failed to decode subscription events: %w", err)
+	}
+	return &sub, nil
+}
+
+func (db *DB) createUserSubscriptionsTable() string {
+	jsonType := "TEXT"
+	if db.driver == "postgres" {
+		jsonType = "JSONB"
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS user_subscriptions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			machine_id TEXT NOT NULL DEFAULT '',
+			group_id TEXT NOT NULL DEFAULT '',
+			events %s NOT NULL,
+			digest BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP NOT NULL
+		)
+	`, jsonType)
+}
+
+func (db *DB) createUserSubscriptionEventsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS user_subscription_events (
+			subscription_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			machine_id TEXT NOT NULL DEFAULT '',
+			group_id TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (subscription_id, event)
+		)
+	`
+}
+
+func (db *DB) createSubscriptionDigestItemsTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS subscription_digest_items (
+			id TEXT PRIMARY KEY,
+			subscription_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`
+}
@@ -0,0 +1,284 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const systemImageColumns = `
+	id, name, version, status, error, build_id, test_id, current,
+	promoted_at, created_by, created_at
+`
+
+// CreateSystemImageBuild queues a build of the next version of a system
+// image from config, recording the version as building. System image
+// builds belong to no machine and need an x86_64 builder, since the top of
+// the image directory is the x86_64 layout.
+func (db *DB) CreateSystemImageBuild(name, config, createdBy string) (*models.SystemImage, *models.BuildRequest, error) {
+	now := time.Now()
+	build := &models.BuildRequest{
+		ID:        uuid.New().String(),
+		Type:      name,
+		Status:    "pending",
+		Config:    config,
+		Priority:  models.BuildPriorityNormal,
+		CreatedAt: now,
+
+		BuildRequirements: models.BuildRequirements{Architecture: "x86_64"},
+	}
+	image := &models.SystemImage{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Status:    models.SystemImageBuilding,
+		BuildID:   build.ID,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+	}
+
+	// PostgreSQL enforces the machines foreign key, which NULL satisfies
+	var machineID interface{} = ""
+	buildQuery := `
+		INSERT INTO builds (id, type, machine_id, status, config, require_test, priority, created_at, architecture)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	versionQuery := `SELECT COALESCE(MAX(version), 0) + 1 FROM system_images WHERE name = ?`
+	imageQuery := `INSERT INTO system_images (` + systemImageColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if db.driver == "postgres" {
+		machineID = nil
+		buildQuery = `
+			INSERT INTO builds (id, type, machine_id, status, config, require_test, priority, created_at, architecture)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`
+		versionQuery = `SELECT COALESCE(MAX(version), 0) + 1 FROM system_images WHERE name = $1`
+		imageQuery = `INSERT INTO system_images (` + systemImageColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(versionQuery, name).Scan(&image.Version); err != nil {
+		return nil, nil, fmt.Errorf("failed to number system image: %w", err)
+	}
+
+	_, err = tx.Exec(buildQuery,
+		build.ID,
+		build.Type,
+		machineID,
+		build.Status,
+		build.Config,
+		false,
+		build.Priority,
+		build.CreatedAt,
+		build.Architecture,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create build: %w", err)
+	}
+
+	// Two builds started at once get the same version; the unique index
+	// fails the second
+	_, err = tx.Exec(imageQuery,
+		image.ID,
+		image.Name,
+		image.Version,
+		image.Status,
+		image.Error,
+		image.BuildID,
+		image.TestID,
+		image.Current,
+		image.PromotedAt,
+		image.CreatedBy,
+		image.CreatedAt,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create system image: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return image, build, nil
+}
+
+// GetSystemImage retrieves a version of a system image. It returns nil,
+// nil if there is no such version.
+func (db *DB) GetSystemImage(name string, version int) (*models.SystemImage, error) {
+	query := `SELECT` + systemImageColumns + `FROM system_images WHERE name = ? AND version = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + systemImageColumns + `FROM system_images WHERE name = $1 AND version = $2`
+	}
+	return db.getSystemImage(query, name, version)
+}
+
+// GetSystemImageByBuild retrieves the system image version a build builds.
+// It returns nil, nil for builds of machines.
+func (db *DB) GetSystemImageByBuild(buildID string) (*models.SystemImage, error) {
+	query := `SELECT` + systemImageColumns + `FROM system_images WHERE build_id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + systemImageColumns + `FROM system_images WHERE build_id = $1`
+	}
+	return db.getSystemImage(query, buildID)
+}
+
+// GetCurrentSystemImage retrieves the version of a system image being
+// served. It returns nil, nil if no version has been promoted.
+func (db *DB) GetCurrentSystemImage(name string) (*models.SystemImage, error) {
+	query := `SELECT` + systemImageColumns + `FROM system_images WHERE name = ? AND current`
+	if db.driver == "postgres" {
+		query = `SELECT` + systemImageColumns + `FROM system_images WHERE name = $1 AND current`
+	}
+	return db.getSystemImage(query, name)
+}
+
+// GetPreviousSystemImage retrieves the version of a system image that was
+// served before the current one: the most recently promoted other version.
+// It returns nil, nil if there is none.
+func (db *DB) GetPreviousSystemImage(name string) (*models.SystemImage, error) {
+	query := `SELECT` + systemImageColumns + `FROM system_images
+		WHERE name = ? AND NOT current AND promoted_at IS NOT NULL
+		ORDER BY promoted_at DESC LIMIT 1`
+	if db.driver == "postgres" {
+		query = `SELECT` + systemImageColumns + `FROM system_images
+			WHERE name = $1 AND NOT current AND promoted_at IS NOT NULL
+			ORDER BY promoted_at DESC LIMIT 1`
+	}
+	return db.getSystemImage(query, name)
+}
+
+func (db *DB) getSystemImage(query string, args ...interface{}) (*models.SystemImage, error) {
+	image, err := scanSystemImage(db.QueryRow(query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system image: %w", err)
+	}
+	return image, nil
+}
+
+// ListSystemImages lists the versions of a system image, newest first
+func (db *DB) ListSystemImages(name string) ([]*models.SystemImage, error) {
+	query := `SELECT` + systemImageColumns + `FROM system_images WHERE name = ? ORDER BY version DESC`
+	if db.driver == "postgres" {
+		query = `SELECT` + systemImageColumns + `FROM system_images WHERE name = $1 ORDER BY version DESC`
+	}
+
+	rows, err := db.Query(query, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list system images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []*models.SystemImage
+	for rows.Next() {
+		image, err := scanSystemImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan system image: %w", err)
+		}
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+// UpdateSystemImageStatus records a system image version's status, error,
+// and boot test
+func (db *DB) UpdateSystemImageStatus(image *models.SystemImage) error {
+	query := `UPDATE system_images SET status = ?, error = ?, test_id = ? WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `UPDATE system_images SET status = $1, error = $2, test_id = $3 WHERE id = $4`
+	}
+
+	if _, err := db.Exec(query, image.Status, image.Error, image.TestID, image.ID); err != nil {
+		return fmt.Errorf("failed to update system image: %w", err)
+	}
+	return nil
+}
+
+// PromoteSystemImage makes a version of a system image the current one,
+// recording when it was promoted
+func (db *DB) PromoteSystemImage(image *models.SystemImage) error {
+	clearQuery := `UPDATE system_images SET current = FALSE WHERE name = ? AND current`
+	promoteQuery := `UPDATE system_images SET current = TRUE, promoted_at = ? WHERE id = ?`
+	if db.driver == "postgres" {
+		clearQuery = `UPDATE system_images SET current = FALSE WHERE name = $1 AND current`
+		promoteQuery = `UPDATE system_images SET current = TRUE, promoted_at = $1 WHERE id = $2`
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(clearQuery, image.Name); err != nil {
+		return fmt.Errorf("failed to promote system image: %w", err)
+	}
+	now := time.Now()
+	if _, err := tx.Exec(promoteQuery, now, image.ID); err != nil {
+		return fmt.Errorf("failed to promote system image: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	image.Current = true
+	image.PromotedAt = &now
+	return nil
+}
+
+// scanSystemImage reads a row of systemImageColumns
+func scanSystemImage(row rowScanner) (*models.SystemImage, error) {
+	var image models.SystemImage
+	var errorMsg, testID, createdBy sql.NullString
+
+	err := row.Scan(
+		&image.ID,
+		&image.Name,
+		&image.Version,
+		&image.Status,
+		&errorMsg,
+		&image.BuildID,
+		&testID,
+		&image.Current,
+		&image.PromotedAt,
+		&createdBy,
+		&image.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	image.Error = errorMsg.String
+	image.TestID = testID.String
+	image.CreatedBy = createdBy.String
+	return &image, nil
+}
+
+func (db *DB) createSystemImagesTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS system_images (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			error TEXT,
+			build_id TEXT NOT NULL,
+			test_id TEXT,
+			current BOOLEAN NOT NULL DEFAULT FALSE,
+			promoted_at TIMESTAMP,
+			created_by TEXT,
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE (name, version),
+			FOREIGN KEY (build_id) REFERENCES builds(id)
+		)
+	`
+}
@@ -2,12 +2,18 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 	"github.com/google/uuid"
 )
 
+const templateColumns = `
+	id, name, description, nixos_config, bmc_config, tags, variables,
+	required_hardware, build_target, created_at, updated_at, created_by
+`
+
 // CreateTemplate creates a new machine template
 func (db *DB) CreateTemplate(template *models.MachineTemplate) error {
 	template.ID = uuid.New().String()
@@ -15,18 +21,22 @@ func (db *DB) CreateTemplate(template *models.MachineTemplate) error {
 	template.UpdatedAt = time.Now()
 
 	query := `
-		INSERT INTO machine_templates (id, name, description, nixos_config, bmc_config, tags, variables, created_at, updated_at, created_by)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO machine_templates (id, name, description, nixos_config, bmc_config, tags, variables, required_hardware, build_target, created_at, updated_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 	`
 
 	if db.driver == "sqlite3" {
 		query = `
-			INSERT INTO machine_templates (id, name, description, nixos_config, bmc_config, tags, variables, created_at, updated_at, created_by)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			INSERT INTO machine_templates (id, name, description, nixos_config, bmc_config, tags, variables, required_hardware, build_target, created_at, updated_at, created_by)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`
 	}
 
-	bmcConfigJSON, err := template.BMCConfig.Value()
+	bmcConfigJSON, err := marshalTemplateBMCConfig(template.BMCConfig)
+	if err != nil {
+		return err
+	}
+	requiredHardware, err := marshalRequiredHardware(template.RequiredHardware)
 	if err != nil {
 		return err
 	}
@@ -37,8 +47,10 @@ func (db *DB) CreateTemplate(template *models.MachineTemplate) error {
 		template.Description,
 		template.NixOSConfig,
 		bmcConfigJSON,
-		template.Tags,
-		template.Variables,
+		jsonColumn(template.Tags),
+		jsonColumn(template.Variables),
+		requiredHardware,
+		template.BuildTarget,
 		template.CreatedAt,
 		template.UpdatedAt,
 		template.CreatedBy,
@@ -47,95 +59,39 @@ func (db *DB) CreateTemplate(template *models.MachineTemplate) error {
 	return err
 }
 
-// GetTemplate retrieves a template by ID
+// GetTemplate retrieves a template by ID. It returns nil, nil if there is
+// no such template.
 func (db *DB) GetTemplate(id string) (*models.MachineTemplate, error) {
-	var template models.MachineTemplate
-
-	query := `
-		SELECT id, name, description, nixos_config, bmc_config, tags, variables, created_at, updated_at, created_by
-		FROM machine_templates
-		WHERE id = $1
-	`
-
+	query := `SELECT` + templateColumns + `FROM machine_templates WHERE id = $1`
 	if db.driver == "sqlite3" {
-		query = `
-			SELECT id, name, description, nixos_config, bmc_config, tags, variables, created_at, updated_at, created_by
-			FROM machine_templates
-			WHERE id = ?
-		`
+		query = `SELECT` + templateColumns + `FROM machine_templates WHERE id = ?`
 	}
 
-	err := db.QueryRow(query, id).Scan(
-		&template.ID,
-		&template.Name,
-		&template.Description,
-		&template.NixOSConfig,
-		&template.BMCConfig,
-		&template.Tags,
-		&template.Variables,
-		&template.CreatedAt,
-		&template.UpdatedAt,
-		&template.CreatedBy,
-	)
-
-	if err == sql.ErrNoRows {
+	template, err := scanTemplate(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
-
-	return &template, nil
+	return template, err
 }
 
-// GetTemplateByName retrieves a template by name
+// GetTemplateByName retrieves a template by name. It returns nil, nil if
+// there is no such template.
 func (db *DB) GetTemplateByName(name string) (*models.MachineTemplate, error) {
-	var template models.MachineTemplate
-
-	query := `
-		SELECT id, name, description, nixos_config, bmc_config, tags, variables, created_at, updated_at, created_by
-		FROM machine_templates
-		WHERE name = $1
-	`
-
+	query := `SELECT` + templateColumns + `FROM machine_templates WHERE name = $1`
 	if db.driver == "sqlite3" {
-		query = `
-			SELECT id, name, description, nixos_config, bmc_config, tags, variables, created_at, updated_at, created_by
-			FROM machine_templates
-			WHERE name = ?
-		`
+		query = `SELECT` + templateColumns + `FROM machine_templates WHERE name = ?`
 	}
 
-	err := db.QueryRow(query, name).Scan(
-		&template.ID,
-		&template.Name,
-		&template.Description,
-		&template.NixOSConfig,
-		&template.BMCConfig,
-		&template.Tags,
-		&template.Variables,
-		&template.CreatedAt,
-		&template.UpdatedAt,
-		&template.CreatedBy,
-	)
-
-	if err == sql.ErrNoRows {
+	template, err := scanTemplate(db.QueryRow(query, name))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
-
-	return &template, nil
+	return template, err
 }
 
 // ListTemplates lists all templates
 func (db *DB) ListTemplates() ([]*models.MachineTemplate, error) {
-	query := `
-		SELECT id, name, description, nixos_config, bmc_config, tags, variables, created_at, updated_at, created_by
-		FROM machine_templates
-		ORDER BY name ASC
-	`
+	query := `SELECT` + templateColumns + `FROM machine_templates ORDER BY name ASC`
 
 	rows, err := db.Query(query)
 	if err != nil {
@@ -145,24 +101,12 @@ func (db *DB) ListTemplates() ([]*models.MachineTemplate, error) {
 
 	var templates []*models.MachineTemplate
 	for rows.Next() {
-		var template models.MachineTemplate
-		err := rows.Scan(
-			&template.ID,
-			&template.Name,
-			&template.Description,
-			&template.NixOSConfig,
-			&template.BMCConfig,
-			&template.Tags,
-			&template.Variables,
-			&template.CreatedAt,
-			&template.UpdatedAt,
-			&template.CreatedBy,
-		)
+		template, err := scanTemplate(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		templates = append(templates, &template)
+		templates = append(templates, template)
 	}
 
 	return templates, nil
@@ -175,20 +119,26 @@ func (db *DB) UpdateTemplate(template *models.MachineTemplate) error {
 	query := `
 		UPDATE machine_templates
 		SET name = $1, description = $2, nixos_config = $3, bmc_config = $4,
-		    tags = $5, variables = $6, updated_at = $7
-		WHERE id = $8
+		    tags = $5, variables = $6, required_hardware = $7, build_target = $8,
+		    updated_at = $9
+		WHERE id = $10
 	`
 
 	if db.driver == "sqlite3" {
 		query = `
 			UPDATE machine_templates
 			SET name = ?, description = ?, nixos_config = ?, bmc_config = ?,
-			    tags = ?, variables = ?, updated_at = ?
+			    tags = ?, variables = ?, required_hardware = ?, build_target = ?,
+			    updated_at = ?
 			WHERE id = ?
 		`
 	}
 
-	bmcConfigJSON, err := template.BMCConfig.Value()
+	bmcConfigJSON, err := marshalTemplateBMCConfig(template.BMCConfig)
+	if err != nil {
+		return err
+	}
+	requiredHardware, err := marshalRequiredHardware(template.RequiredHardware)
 	if err != nil {
 		return err
 	}
@@ -198,8 +148,10 @@ func (db *DB) UpdateTemplate(template *models.MachineTemplate) error {
 		template.Description,
 		template.NixOSConfig,
 		bmcConfigJSON,
-		template.Tags,
-		template.Variables,
+		jsonColumn(template.Tags),
+		jsonColumn(template.Variables),
+		requiredHardware,
+		template.BuildTarget,
 		template.UpdatedAt,
 		template.ID,
 	)
@@ -207,13 +159,76 @@ func (db *DB) UpdateTemplate(template *models.MachineTemplate) error {
 	return err
 }
 
-// DeleteTemplate deletes a template
+// DeleteTemplate deletes a template and its provisioning hooks
 func (db *DB) DeleteTemplate(id string) error {
 	query := `DELETE FROM machine_templates WHERE id = $1`
 	if db.driver == "sqlite3" {
 		query = `DELETE FROM machine_templates WHERE id = ?`
 	}
 
+	if err := db.deleteScopeProvisioningHooks(db, models.HookScopeTemplate, id); err != nil {
+		return err
+	}
+
 	_, err := db.Exec(query, id)
 	return err
 }
+
+// scanTemplate reads a row of templateColumns. The description and the JSON
+// columns are optional and may be NULL.
+func scanTemplate(row rowScanner) (*models.MachineTemplate, error) {
+	var template models.MachineTemplate
+	var description sql.NullString
+	var bmcConfigJSON, tagsJSON, variablesJSON, requiredHardware jsonColumn
+
+	err := row.Scan(
+		&template.ID,
+		&template.Name,
+		&description,
+		&template.NixOSConfig,
+		&bmcConfigJSON,
+		&tagsJSON,
+		&variablesJSON,
+		&requiredHardware,
+		&template.BuildTarget,
+		&template.CreatedAt,
+		&template.UpdatedAt,
+		&template.CreatedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	template.Description = description.String
+	if bmcConfigJSON.RawMessage() != nil {
+		template.BMCConfig = &models.BMCInfo{}
+		if err := bmcConfigJSON.Unmarshal(template.BMCConfig); err != nil {
+			return nil, err
+		}
+	}
+	template.Tags = tagsJSON.RawMessage()
+	template.Variables = variablesJSON.RawMessage()
+	if err := requiredHardware.Unmarshal(&template.RequiredHardware); err != nil {
+		return nil, err
+	}
+
+	return &template, nil
+}
+
+// marshalRequiredHardware encodes the hardware fields a template requires,
+// storing NULL when it requires none
+func marshalRequiredHardware(fields []string) (jsonColumn, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return marshalJSONColumn(fields)
+}
+
+// marshalTemplateBMCConfig encodes a template's BMC settings, storing NULL
+// when it has none
+func marshalTemplateBMCConfig(config *models.BMCInfo) (jsonColumn, error) {
+	if config == nil {
+		return nil, nil
+	}
+	return marshalJSONColumn(config)
+}
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// machineOwnedTables hold rows that are deleted with their machine. The
+// foreign keys of most of them cascade, but SQLite doesn't enforce foreign
+// keys and builds don't cascade, so they are deleted explicitly.
+var machineOwnedTables = []string{
+	"builds",
+	"machine_events",
+	"machine_metrics",
+	"power_operations",
+	"wipe_jobs",
+	"deployments",
+	"boot_requests",
+	"group_memberships",
+	"machine_conflicts",
+	"machine_notes",
+	"machine_attachments",
+	"machine_fragments",
+	"claim_codes",
+	"dcim_records",
+	"boot_overrides",
+	"build_schedule_runs",
+	"machine_shares",
+	"hook_runs",
+	"provisioning_cycles",
+}
+
+// TrashMachine moves a machine to the trash. Machines in the trash keep
+// their configuration, BMC credentials, history, and group memberships but
+// are left out of everything except the trash listing until restored or
+// purged. It returns false if there is no such machine outside the trash.
+func (db *DB) TrashMachine(id string) (bool, error) {
+	query := "UPDATE machines SET deleted_at = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL"
+	if db.driver == "postgres" {
+		query = "UPDATE machines SET deleted_at = $1, updated_at = $2 WHERE id = $3 AND deleted_at IS NULL"
+	}
+
+	now := time.Now()
+	result, err := db.Exec(query, now, now, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to trash machine: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RestoreMachine takes a machine out of the trash. It returns false if the
+// machine is not in the trash.
+func (db *DB) RestoreMachine(id string) (bool, error) {
+	query := "UPDATE machines SET deleted_at = NULL, updated_at = ? WHERE id = ? AND deleted_at IS NOT NULL"
+	if db.driver == "postgres" {
+		query = "UPDATE machines SET deleted_at = NULL, updated_at = $1 WHERE id = $2 AND deleted_at IS NOT NULL"
+	}
+
+	result, err := db.Exec(query, time.Now(), id)
+	if err != nil {
+		return false, fmt.Errorf("failed to restore machine: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// PurgeTrashedMachines permanently deletes machines that were moved to the
+// trash before cutoff, and returns the deleted IDs
+func (db *DB) PurgeTrashedMachines(cutoff time.Time) ([]string, error) {
+	query := "SELECT id FROM machines WHERE deleted_at < ?"
+	if db.driver == "postgres" {
+		query = "SELECT id FROM machines WHERE deleted_at < $1"
+	}
+
+	return db.purgeMachines("trashed", query, cutoff)
+}
+
+// PurgeVirtualMachines permanently deletes virtual machines, in or out of
+// the trash, enrolled before cutoff, and returns the deleted IDs
+func (db *DB) PurgeVirtualMachines(cutoff time.Time) ([]string, error) {
+	query := "SELECT id FROM machines WHERE is_virtual AND enrolled_at < ?"
+	if db.driver == "postgres" {
+		query = "SELECT id FROM machines WHERE is_virtual AND enrolled_at < $1"
+	}
+
+	return db.purgeMachines("virtual", query, cutoff)
+}
+
+// purgeMachines permanently deletes the machines whose IDs query selects,
+// each in its own transaction, and returns the deleted IDs
+func (db *DB) purgeMachines(kind, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s machines: %w", kind, err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan machine id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, id := range ids {
+		if err := db.DeleteMachine(id); err != nil {
+			return purged, err
+		}
+		purged = append(purged, id)
+	}
+
+	return purged, nil
+}
+
+// deleteMachine permanently deletes a machine and everything that belongs
+// to it within tx. Image tests of its builds are kept without the machine.
+func (db *DB) deleteMachine(tx *sql.Tx, id string) error {
+	deleteLogs := "DELETE FROM build_logs WHERE build_id IN (SELECT id FROM builds WHERE machine_id = ?)"
+	detachTests := "UPDATE image_tests SET machine_id = NULL WHERE machine_id = ?"
+	deleteOwned := "DELETE FROM %s WHERE machine_id = ?"
+	deleteMachine := "DELETE FROM machines WHERE id = ?"
+	if db.driver == "postgres" {
+		deleteLogs = "DELETE FROM build_logs WHERE build_id IN (SELECT id FROM builds WHERE machine_id = $1)"
+		detachTests = "UPDATE image_tests SET machine_id = NULL WHERE machine_id = $1"
+		deleteOwned = "DELETE FROM %s WHERE machine_id = $1"
+		deleteMachine = "DELETE FROM machines WHERE id = $1"
+	}
+
+	if _, err := tx.Exec(deleteLogs, id); err != nil {
+		return fmt.Errorf("failed to delete build logs for machine %s: %w", id, err)
+	}
+	if _, err := tx.Exec(detachTests, id); err != nil {
+		return fmt.Errorf("failed to detach image tests from machine %s: %w", id, err)
+	}
+	for _, table := range machineOwnedTables {
+		if _, err := tx.Exec(fmt.Sprintf(deleteOwned, table), id); err != nil {
+			return fmt.Errorf("failed to delete %s for machine %s: %w", table, id, err)
+		}
+	}
+	if err := db.deleteScopeBuildSchedule(tx, models.BuildScheduleScopeMachine, id); err != nil {
+		return err
+	}
+	if err := db.deleteScopeProvisioningHooks(tx, models.HookScopeMachine, id); err != nil {
+		return err
+	}
+	if _, err := db.deleteSubscriptions(tx, "machine_id", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteMachine, id); err != nil {
+		return fmt.Errorf("failed to delete machine %s: %w", id, err)
+	}
+
+	return nil
+}
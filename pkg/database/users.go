@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -52,19 +53,22 @@ func (db *DB) CreateUser(username, email, passwordHash string, role models.UserR
 	return user, nil
 }
 
-// GetUser retrieves a user by ID
+// GetUser retrieves a user by ID. It returns nil, nil if there is no such
+// user.
 func (db *DB) GetUser(id string) (*models.User, error) {
 	user := &models.User{}
 	var lastLoginAt sql.NullTime
+	var defaultGroupID sql.NullString
+	var quota jsonColumn
 
 	query := `
-		SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at
+		SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at, default_group_id, quota
 		FROM users WHERE id = ?
 	`
 
 	if db.driver == "postgres" {
 		query = `
-			SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at
+			SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at, default_group_id, quota
 			FROM users WHERE id = $1
 		`
 	}
@@ -79,9 +83,11 @@ func (db *DB) GetUser(id string) (*models.User, error) {
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&lastLoginAt,
+		&defaultGroupID,
+		&quota,
 	)
 
-	if err == sql.ErrNoRows {
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
@@ -91,23 +97,30 @@ func (db *DB) GetUser(id string) (*models.User, error) {
 	if lastLoginAt.Valid {
 		user.LastLoginAt = &lastLoginAt.Time
 	}
+	user.DefaultGroupID = defaultGroupID.String
+	if err := quota.Unmarshal(&user.Quota); err != nil {
+		return nil, fmt.Errorf("failed to decode user quota: %w", err)
+	}
 
 	return user, nil
 }
 
-// GetUserByUsername retrieves a user by username
+// GetUserByUsername retrieves a user by username. It returns nil, nil if
+// there is no such user.
 func (db *DB) GetUserByUsername(username string) (*models.User, error) {
 	user := &models.User{}
 	var lastLoginAt sql.NullTime
+	var defaultGroupID sql.NullString
+	var quota jsonColumn
 
 	query := `
-		SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at
+		SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at, default_group_id, quota
 		FROM users WHERE username = ?
 	`
 
 	if db.driver == "postgres" {
 		query = `
-			SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at
+			SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at, default_group_id, quota
 			FROM users WHERE username = $1
 		`
 	}
@@ -122,9 +135,11 @@ func (db *DB) GetUserByUsername(username string) (*models.User, error) {
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&lastLoginAt,
+		&defaultGroupID,
+		&quota,
 	)
 
-	if err == sql.ErrNoRows {
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	if err != nil {
@@ -134,6 +149,10 @@ func (db *DB) GetUserByUsername(username string) (*models.User, error) {
 	if lastLoginAt.Valid {
 		user.LastLoginAt = &lastLoginAt.Time
 	}
+	user.DefaultGroupID = defaultGroupID.String
+	if err := quota.Unmarshal(&user.Quota); err != nil {
+		return nil, fmt.Errorf("failed to decode user quota: %w", err)
+	}
 
 	return user, nil
 }
@@ -141,7 +160,7 @@ func (db *DB) GetUserByUsername(username string) (*models.User, error) {
 // ListUsers retrieves all users
 func (db *DB) ListUsers() ([]*models.User, error) {
 	query := `
-		SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at
+		SELECT id, username, email, password_hash, role, active, created_at, updated_at, last_login_at, default_group_id, quota
 		FROM users
 		ORDER BY created_at DESC
 	`
@@ -156,6 +175,8 @@ func (db *DB) ListUsers() ([]*models.User, error) {
 	for rows.Next() {
 		user := &models.User{}
 		var lastLoginAt sql.NullTime
+		var defaultGroupID sql.NullString
+		var quota jsonColumn
 
 		err := rows.Scan(
 			&user.ID,
@@ -167,6 +188,8 @@ func (db *DB) ListUsers() ([]*models.User, error) {
 			&user.CreatedAt,
 			&user.UpdatedAt,
 			&lastLoginAt,
+			&defaultGroupID,
+			&quota,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan user: %w", err)
@@ -175,6 +198,10 @@ func (db *DB) ListUsers() ([]*models.User, error) {
 		if lastLoginAt.Valid {
 			user.LastLoginAt = &lastLoginAt.Time
 		}
+		user.DefaultGroupID = defaultGroupID.String
+		if err := quota.Unmarshal(&user.Quota); err != nil {
+			return nil, fmt.Errorf("failed to decode user quota: %w", err)
+		}
 
 		users = append(users, user)
 	}
@@ -188,15 +215,17 @@ func (db *DB) UpdateUser(user *models.User) error {
 
 	query := `
 		UPDATE users SET
-			email = ?, password_hash = ?, role = ?, active = ?, updated_at = ?, last_login_at = ?
+			email = ?, password_hash = ?, role = ?, active = ?, updated_at = ?, last_login_at = ?,
+			default_group_id = ?
 		WHERE id = ?
 	`
 
 	if db.driver == "postgres" {
 		query = `
 			UPDATE users SET
-				email = $1, password_hash = $2, role = $3, active = $4, updated_at = $5, last_login_at = $6
-			WHERE id = $7
+				email = $1, password_hash = $2, role = $3, active = $4, updated_at = $5, last_login_at = $6,
+				default_group_id = $7
+			WHERE id = $8
 		`
 	}
 
@@ -207,6 +236,7 @@ func (db *DB) UpdateUser(user *models.User) error {
 		user.Active,
 		user.UpdatedAt,
 		user.LastLoginAt,
+		user.DefaultGroupID,
 		user.ID,
 	)
 
@@ -224,6 +254,9 @@ func (db *DB) DeleteUser(id string) error {
 		query = "DELETE FROM users WHERE id = $1"
 	}
 
+	if _, err := db.deleteSubscriptions(db, "user_id", id); err != nil {
+		return err
+	}
 	_, err := db.Exec(query, id)
 	if err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
@@ -3,12 +3,22 @@ package database
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 	"github.com/google/uuid"
 )
 
+const webhookColumns = `
+	id, name, url, events, secret, active, headers, timeout, max_retries,
+	group_ids, statuses, tags, fields, allow_private_networks, schema_version,
+	format, disable_after_failures, disable_after_seconds, consecutive_failures,
+	failing_since, auto_disabled_at, disabled_reason, last_success, last_failure,
+	created_at, updated_at, retry_policy
+`
+
 // CreateWebhook creates a new webhook
 func (db *DB) CreateWebhook(webhook *models.Webhook) error {
 	webhook.ID = uuid.New().String()
@@ -19,16 +29,32 @@ func (db *DB) CreateWebhook(webhook *models.Webhook) error {
 	if err != nil {
 		return err
 	}
+	groupIDs, statuses, tags, fields, err := marshalWebhookScope(webhook)
+	if err != nil {
+		return err
+	}
+	retryPolicy, err := marshalJSONColumn(webhook.Retry)
+	if err != nil {
+		return err
+	}
 
 	query := `
-		INSERT INTO webhooks (id, name, url, events, secret, active, headers, timeout, max_retries, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		INSERT INTO webhooks (
+			id, name, url, events, secret, active, headers, timeout, max_retries,
+			group_ids, statuses, tags, fields, allow_private_networks, schema_version,
+			format, disable_after_failures, disable_after_seconds, created_at, updated_at,
+			retry_policy
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
 	`
 
 	if db.driver == "sqlite3" {
 		query = `
-			INSERT INTO webhooks (id, name, url, events, secret, active, headers, timeout, max_retries, created_at, updated_at)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			INSERT INTO webhooks (
+				id, name, url, events, secret, active, headers, timeout, max_retries,
+				group_ids, statuses, tags, fields, allow_private_networks, schema_version,
+				format, disable_after_failures, disable_after_seconds, created_at, updated_at,
+				retry_policy
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`
 	}
 
@@ -39,75 +65,44 @@ func (db *DB) CreateWebhook(webhook *models.Webhook) error {
 		string(eventsJSON),
 		webhook.Secret,
 		webhook.Active,
-		webhook.Headers,
+		jsonColumn(webhook.Headers),
 		webhook.Timeout,
 		webhook.MaxRetries,
+		groupIDs,
+		statuses,
+		tags,
+		fields,
+		webhook.AllowPrivateNetworks,
+		webhook.SchemaVersion,
+		webhook.Format,
+		webhook.DisableAfterFailures,
+		webhook.DisableAfterSeconds,
 		webhook.CreatedAt,
 		webhook.UpdatedAt,
+		retryPolicy,
 	)
 
 	return err
 }
 
-// GetWebhook retrieves a webhook by ID
+// GetWebhook retrieves a webhook by ID. It returns nil, nil if there is no
+// such webhook.
 func (db *DB) GetWebhook(id string) (*models.Webhook, error) {
-	var webhook models.Webhook
-	var eventsJSON string
-
-	query := `
-		SELECT id, name, url, events, secret, active, headers, timeout, max_retries,
-		       last_success, last_failure, created_at, updated_at
-		FROM webhooks
-		WHERE id = $1
-	`
-
+	query := `SELECT` + webhookColumns + `FROM webhooks WHERE id = $1`
 	if db.driver == "sqlite3" {
-		query = `
-			SELECT id, name, url, events, secret, active, headers, timeout, max_retries,
-			       last_success, last_failure, created_at, updated_at
-			FROM webhooks
-			WHERE id = ?
-		`
+		query = `SELECT` + webhookColumns + `FROM webhooks WHERE id = ?`
 	}
 
-	err := db.QueryRow(query, id).Scan(
-		&webhook.ID,
-		&webhook.Name,
-		&webhook.URL,
-		&eventsJSON,
-		&webhook.Secret,
-		&webhook.Active,
-		&webhook.Headers,
-		&webhook.Timeout,
-		&webhook.MaxRetries,
-		&webhook.LastSuccess,
-		&webhook.LastFailure,
-		&webhook.CreatedAt,
-		&webhook.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	webhook, err := scanWebhook(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
-
-	if err := json.Unmarshal([]byte(eventsJSON), &webhook.Events); err != nil {
-		return nil, err
-	}
-
-	return &webhook, nil
+	return webhook, err
 }
 
 // ListWebhooks lists all webhooks
 func (db *DB) ListWebhooks() ([]*models.Webhook, error) {
-	query := `
-		SELECT id, name, url, events, secret, active, headers, timeout, max_retries,
-		       last_success, last_failure, created_at, updated_at
-		FROM webhooks
-		ORDER BY created_at DESC
-	`
+	query := `SELECT` + webhookColumns + `FROM webhooks ORDER BY created_at DESC`
 
 	rows, err := db.Query(query)
 	if err != nil {
@@ -117,33 +112,12 @@ func (db *DB) ListWebhooks() ([]*models.Webhook, error) {
 
 	var webhooks []*models.Webhook
 	for rows.Next() {
-		var webhook models.Webhook
-		var eventsJSON string
-
-		err := rows.Scan(
-			&webhook.ID,
-			&webhook.Name,
-			&webhook.URL,
-			&eventsJSON,
-			&webhook.Secret,
-			&webhook.Active,
-			&webhook.Headers,
-			&webhook.Timeout,
-			&webhook.MaxRetries,
-			&webhook.LastSuccess,
-			&webhook.LastFailure,
-			&webhook.CreatedAt,
-			&webhook.UpdatedAt,
-		)
+		webhook, err := scanWebhook(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := json.Unmarshal([]byte(eventsJSON), &webhook.Events); err != nil {
-			return nil, err
-		}
-
-		webhooks = append(webhooks, &webhook)
+		webhooks = append(webhooks, webhook)
 	}
 
 	return webhooks, nil
@@ -157,19 +131,33 @@ func (db *DB) UpdateWebhook(webhook *models.Webhook) error {
 	if err != nil {
 		return err
 	}
+	groupIDs, statuses, tags, fields, err := marshalWebhookScope(webhook)
+	if err != nil {
+		return err
+	}
+	retryPolicy, err := marshalJSONColumn(webhook.Retry)
+	if err != nil {
+		return err
+	}
 
 	query := `
 		UPDATE webhooks
 		SET name = $1, url = $2, events = $3, secret = $4, active = $5,
-		    headers = $6, timeout = $7, max_retries = $8, updated_at = $9
-		WHERE id = $10
+		    headers = $6, timeout = $7, max_retries = $8, group_ids = $9,
+		    statuses = $10, tags = $11, fields = $12, allow_private_networks = $13,
+		    schema_version = $14, format = $15, disable_after_failures = $16,
+		    disable_after_seconds = $17, updated_at = $18, retry_policy = $19
+		WHERE id = $20
 	`
 
 	if db.driver == "sqlite3" {
 		query = `
 			UPDATE webhooks
 			SET name = ?, url = ?, events = ?, secret = ?, active = ?,
-			    headers = ?, timeout = ?, max_retries = ?, updated_at = ?
+			    headers = ?, timeout = ?, max_retries = ?, group_ids = ?,
+			    statuses = ?, tags = ?, fields = ?, allow_private_networks = ?,
+			    schema_version = ?, format = ?, disable_after_failures = ?,
+			    disable_after_seconds = ?, updated_at = ?, retry_policy = ?
 			WHERE id = ?
 		`
 	}
@@ -180,10 +168,20 @@ func (db *DB) UpdateWebhook(webhook *models.Webhook) error {
 		string(eventsJSON),
 		webhook.Secret,
 		webhook.Active,
-		webhook.Headers,
+		jsonColumn(webhook.Headers),
 		webhook.Timeout,
 		webhook.MaxRetries,
+		groupIDs,
+		statuses,
+		tags,
+		fields,
+		webhook.AllowPrivateNetworks,
+		webhook.SchemaVersion,
+		webhook.Format,
+		webhook.DisableAfterFailures,
+		webhook.DisableAfterSeconds,
 		webhook.UpdatedAt,
+		retryPolicy,
 		webhook.ID,
 	)
 
@@ -201,18 +199,10 @@ func (db *DB) DeleteWebhook(id string) error {
 	return err
 }
 
-// GetWebhooksByEvent retrieves all active webhooks for a specific event
+// GetWebhooksByEvent retrieves all active webhooks for a specific event.
+// Events are matched in Go, the same way on both drivers.
 func (db *DB) GetWebhooksByEvent(event string) ([]*models.Webhook, error) {
-	query := `
-		SELECT id, name, url, events, secret, active, headers, timeout, max_retries,
-		       last_success, last_failure, created_at, updated_at
-		FROM webhooks
-		WHERE active = true
-	`
-
-	if db.driver == "sqlite3" {
-		query += ` AND json_array_length(events) > 0`
-	}
+	query := `SELECT` + webhookColumns + `FROM webhooks WHERE active = true`
 
 	rows, err := db.Query(query)
 	if err != nil {
@@ -222,36 +212,15 @@ func (db *DB) GetWebhooksByEvent(event string) ([]*models.Webhook, error) {
 
 	var webhooks []*models.Webhook
 	for rows.Next() {
-		var webhook models.Webhook
-		var eventsJSON string
-
-		err := rows.Scan(
-			&webhook.ID,
-			&webhook.Name,
-			&webhook.URL,
-			&eventsJSON,
-			&webhook.Secret,
-			&webhook.Active,
-			&webhook.Headers,
-			&webhook.Timeout,
-			&webhook.MaxRetries,
-			&webhook.LastSuccess,
-			&webhook.LastFailure,
-			&webhook.CreatedAt,
-			&webhook.UpdatedAt,
-		)
+		webhook, err := scanWebhook(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := json.Unmarshal([]byte(eventsJSON), &webhook.Events); err != nil {
-			return nil, err
-		}
-
 		// Filter by event
 		for _, e := range webhook.Events {
 			if e == event || e == "*" {
-				webhooks = append(webhooks, &webhook)
+				webhooks = append(webhooks, webhook)
 				break
 			}
 		}
@@ -265,15 +234,29 @@ func (db *DB) CreateWebhookDelivery(delivery *models.WebhookDelivery) error {
 	delivery.ID = uuid.New().String()
 	delivery.CreatedAt = time.Now()
 
+	var history jsonColumn
+	if len(delivery.AttemptHistory) > 0 {
+		var err error
+		if history, err = marshalJSONColumn(delivery.AttemptHistory); err != nil {
+			return err
+		}
+	}
+
 	query := `
-		INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status_code, response, error, attempts, success, created_at, completed_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		INSERT INTO webhook_deliveries (
+			id, webhook_id, event, payload, status_code, response, error, attempts, success,
+			created_at, completed_at, event_id, machine_id, payload_size, duration_ms,
+			attempt_history
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 	`
 
 	if db.driver == "sqlite3" {
 		query = `
-			INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status_code, response, error, attempts, success, created_at, completed_at)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			INSERT INTO webhook_deliveries (
+				id, webhook_id, event, payload, status_code, response, error, attempts, success,
+				created_at, completed_at, event_id, machine_id, payload_size, duration_ms,
+				attempt_history
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`
 	}
 
@@ -289,32 +272,75 @@ func (db *DB) CreateWebhookDelivery(delivery *models.WebhookDelivery) error {
 		delivery.Success,
 		delivery.CreatedAt,
 		delivery.CompletedAt,
+		delivery.EventID,
+		delivery.MachineID,
+		delivery.PayloadSize,
+		delivery.DurationMS,
+		history,
 	)
 
 	return err
 }
 
-// ListWebhookDeliveries lists deliveries for a webhook
-func (db *DB) ListWebhookDeliveries(webhookID string, limit int) ([]*models.WebhookDelivery, error) {
+// WebhookDeliveryFilter selects a webhook's deliveries. Since is inclusive
+// and Until is exclusive; zero values leave the range open. Deliveries are
+// listed newest first, by (created_at, id), so pages stay stable while
+// deliveries are recorded.
+type WebhookDeliveryFilter struct {
+	WebhookID string
+	Success   *bool
+	Since     time.Time
+	Until     time.Time
+
+	// After continues from the last delivery of a previous page
+	After *EventCursor
+
+	Limit int
+}
+
+// ListWebhookDeliveries lists a webhook's deliveries matching filter,
+// newest first, with the current hostnames of the machines they were about
+func (db *DB) ListWebhookDeliveries(filter WebhookDeliveryFilter) ([]*models.WebhookDelivery, error) {
 	query := `
-		SELECT id, webhook_id, event, payload, status_code, response, error, attempts, success, created_at, completed_at
-		FROM webhook_deliveries
-		WHERE webhook_id = $1
-		ORDER BY created_at DESC
-		LIMIT $2
+		SELECT d.id, d.webhook_id, d.event, d.payload, d.status_code, d.response, d.error, d.attempts, d.success,
+		       d.created_at, d.completed_at, d.event_id, d.machine_id, d.payload_size, d.duration_ms, d.attempt_history,
+		       m.hostname
+		FROM webhook_deliveries d
+		LEFT JOIN machines m ON m.id = d.machine_id
+		WHERE 1=1
 	`
 
-	if db.driver == "sqlite3" {
-		query = `
-			SELECT id, webhook_id, event, payload, status_code, response, error, attempts, success, created_at, completed_at
-			FROM webhook_deliveries
-			WHERE webhook_id = ?
-			ORDER BY created_at DESC
-			LIMIT ?
-		`
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		if db.driver == "postgres" {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
+	}
+
+	query += " AND d.webhook_id = " + arg(filter.WebhookID)
+	if filter.Success != nil {
+		query += " AND d.success = " + arg(*filter.Success)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND d.created_at >= " + arg(filter.Since)
 	}
+	if !filter.Until.IsZero() {
+		query += " AND d.created_at < " + arg(filter.Until)
+	}
+	if filter.After != nil {
+		query += fmt.Sprintf(" AND (d.created_at < %s OR (d.created_at = %s AND d.id < %s))",
+			arg(filter.After.CreatedAt), arg(filter.After.CreatedAt), arg(filter.After.ID))
+	}
+
+	query += " ORDER BY d.created_at DESC, d.id DESC"
 
-	rows, err := db.Query(query, webhookID, limit)
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -323,38 +349,160 @@ func (db *DB) ListWebhookDeliveries(webhookID string, limit int) ([]*models.Webh
 	var deliveries []*models.WebhookDelivery
 	for rows.Next() {
 		var delivery models.WebhookDelivery
+		var response, deliveryError, eventID, machineID, hostname sql.NullString
+		var durationMS sql.NullInt64
+		var history jsonColumn
 		err := rows.Scan(
 			&delivery.ID,
 			&delivery.WebhookID,
 			&delivery.Event,
 			&delivery.Payload,
 			&delivery.StatusCode,
-			&delivery.Response,
-			&delivery.Error,
+			&response,
+			&deliveryError,
 			&delivery.Attempts,
 			&delivery.Success,
 			&delivery.CreatedAt,
 			&delivery.CompletedAt,
+			&eventID,
+			&machineID,
+			&delivery.PayloadSize,
+			&durationMS,
+			&history,
+			&hostname,
 		)
 		if err != nil {
 			return nil, err
 		}
 
+		delivery.Response = response.String
+		delivery.Error = deliveryError.String
+		delivery.EventID = eventID.String
+		delivery.MachineID = machineID.String
+		delivery.MachineHostname = hostname.String
+		delivery.PayloadTruncated = delivery.PayloadSize > len(delivery.Payload)
+		if durationMS.Valid {
+			delivery.DurationMS = &durationMS.Int64
+		}
+		if err := history.Unmarshal(&delivery.AttemptHistory); err != nil {
+			return nil, err
+		}
+
 		deliveries = append(deliveries, &delivery)
 	}
 
-	return deliveries, nil
+	return deliveries, rows.Err()
+}
+
+// GetWebhookDeliveryStats summarizes a webhook's deliveries recorded since
+// the given time
+func (db *DB) GetWebhookDeliveryStats(webhookID string, since time.Time) (*models.WebhookDeliveryStats, error) {
+	counts := `
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN success THEN 0 ELSE 1 END), 0)
+		FROM webhook_deliveries
+		WHERE webhook_id = $1 AND created_at >= $2
+	`
+	timed := `
+		SELECT COUNT(*) FROM webhook_deliveries
+		WHERE webhook_id = $1 AND created_at >= $2 AND duration_ms IS NOT NULL
+	`
+	percentile := `
+		SELECT duration_ms FROM webhook_deliveries
+		WHERE webhook_id = $1 AND created_at >= $2 AND duration_ms IS NOT NULL
+		ORDER BY duration_ms
+		LIMIT 1 OFFSET $3
+	`
+	if db.driver == "sqlite3" {
+		counts = `
+			SELECT COUNT(*), COALESCE(SUM(CASE WHEN success THEN 0 ELSE 1 END), 0)
+			FROM webhook_deliveries
+			WHERE webhook_id = ? AND created_at >= ?
+		`
+		timed = `
+			SELECT COUNT(*) FROM webhook_deliveries
+			WHERE webhook_id = ? AND created_at >= ? AND duration_ms IS NOT NULL
+		`
+		percentile = `
+			SELECT duration_ms FROM webhook_deliveries
+			WHERE webhook_id = ? AND created_at >= ? AND duration_ms IS NOT NULL
+			ORDER BY duration_ms
+			LIMIT 1 OFFSET ?
+		`
+	}
+
+	stats := &models.WebhookDeliveryStats{Since: since}
+	if err := db.QueryRow(counts, webhookID, since).Scan(&stats.Deliveries, &stats.Failures); err != nil {
+		return nil, fmt.Errorf("failed to count webhook deliveries: %w", err)
+	}
+	if stats.Deliveries > 0 {
+		stats.SuccessRate = float64(stats.Deliveries-stats.Failures) / float64(stats.Deliveries)
+	}
+
+	var n int
+	if err := db.QueryRow(timed, webhookID, since).Scan(&n); err != nil {
+		return nil, fmt.Errorf("failed to count webhook deliveries: %w", err)
+	}
+	if n > 0 {
+		// The nearest-rank 95th percentile: the smallest duration at
+		// least 95% of durations don't exceed
+		rank := (95*n + 99) / 100
+		var p95 int64
+		if err := db.QueryRow(percentile, webhookID, since, rank-1).Scan(&p95); err != nil {
+			return nil, fmt.Errorf("failed to compute webhook delivery latency: %w", err)
+		}
+		stats.P95LatencyMS = &p95
+	}
+
+	return stats, nil
 }
 
-// UpdateWebhookDeliveryStatus updates the webhook last success/failure timestamps
+// DeleteWebhookDeliveriesBefore removes deliveries recorded before the
+// given time, except each webhook's most recent failure, which is kept
+// however old it is so why the webhook last failed can still be seen
+func (db *DB) DeleteWebhookDeliveriesBefore(before time.Time) (int64, error) {
+	query := `
+		DELETE FROM webhook_deliveries
+		WHERE created_at < $1
+		AND id NOT IN (
+			SELECT d.id FROM webhook_deliveries d
+			WHERE d.success = false AND d.created_at = (
+				SELECT MAX(f.created_at) FROM webhook_deliveries f
+				WHERE f.webhook_id = d.webhook_id AND f.success = false
+			)
+		)
+	`
+	if db.driver == "sqlite3" {
+		query = `
+			DELETE FROM webhook_deliveries
+			WHERE created_at < ?
+			AND id NOT IN (
+				SELECT d.id FROM webhook_deliveries d
+				WHERE d.success = false AND d.created_at = (
+					SELECT MAX(f.created_at) FROM webhook_deliveries f
+					WHERE f.webhook_id = d.webhook_id AND f.success = false
+				)
+			)
+		`
+	}
+
+	result, err := db.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old webhook deliveries: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// UpdateWebhookDeliveryStatus updates the webhook last success/failure
+// timestamps. A success ends the webhook's failure streak.
 func (db *DB) UpdateWebhookDeliveryStatus(webhookID string, success bool) error {
 	now := time.Now()
 	var query string
 
 	if success {
-		query = `UPDATE webhooks SET last_success = $1 WHERE id = $2`
+		query = `UPDATE webhooks SET last_success = $1, consecutive_failures = 0, failing_since = NULL WHERE id = $2`
 		if db.driver == "sqlite3" {
-			query = `UPDATE webhooks SET last_success = ? WHERE id = ?`
+			query = `UPDATE webhooks SET last_success = ?, consecutive_failures = 0, failing_since = NULL WHERE id = ?`
 		}
 	} else {
 		query = `UPDATE webhooks SET last_failure = $1 WHERE id = $2`
@@ -366,3 +514,167 @@ func (db *DB) UpdateWebhookDeliveryStatus(webhookID string, success bool) error
 	_, err := db.Exec(query, now, webhookID)
 	return err
 }
+
+// AddWebhookFailures adds weight to a webhook's failure streak, starting
+// the streak if there is none, and returns the webhook as it is now. It
+// returns nil, nil if the webhook has been deleted.
+func (db *DB) AddWebhookFailures(webhookID string, weight int) (*models.Webhook, error) {
+	query := `
+		UPDATE webhooks
+		SET consecutive_failures = consecutive_failures + $1,
+		    failing_since = COALESCE(failing_since, $2)
+		WHERE id = $3
+	`
+	if db.driver == "sqlite3" {
+		query = `
+			UPDATE webhooks
+			SET consecutive_failures = consecutive_failures + ?,
+			    failing_since = COALESCE(failing_since, ?)
+			WHERE id = ?
+		`
+	}
+
+	if _, err := db.Exec(query, weight, time.Now(), webhookID); err != nil {
+		return nil, fmt.Errorf("failed to update webhook failure streak: %w", err)
+	}
+	return db.GetWebhook(webhookID)
+}
+
+// AutoDisableWebhook deactivates a failing webhook, recording why. It
+// reports whether the webhook was active, so that of several deliveries
+// failing at once only one reports the webhook deactivated.
+func (db *DB) AutoDisableWebhook(webhookID, reason string) (bool, error) {
+	now := time.Now()
+	query := `
+		UPDATE webhooks
+		SET active = false, auto_disabled_at = $1, disabled_reason = $2, updated_at = $3
+		WHERE id = $4 AND active = true
+	`
+	if db.driver == "sqlite3" {
+		query = `
+			UPDATE webhooks
+			SET active = false, auto_disabled_at = ?, disabled_reason = ?, updated_at = ?
+			WHERE id = ? AND active = true
+		`
+	}
+
+	result, err := db.Exec(query, now, reason, now, webhookID)
+	if err != nil {
+		return false, fmt.Errorf("failed to deactivate webhook: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReactivateWebhook activates a webhook and clears its failure streak and
+// why it was deactivated
+func (db *DB) ReactivateWebhook(webhookID string) error {
+	query := `
+		UPDATE webhooks
+		SET active = true, consecutive_failures = 0, failing_since = NULL,
+		    auto_disabled_at = NULL, disabled_reason = '', updated_at = $1
+		WHERE id = $2
+	`
+	if db.driver == "sqlite3" {
+		query = `
+			UPDATE webhooks
+			SET active = true, consecutive_failures = 0, failing_since = NULL,
+			    auto_disabled_at = NULL, disabled_reason = '', updated_at = ?
+			WHERE id = ?
+		`
+	}
+
+	if _, err := db.Exec(query, time.Now(), webhookID); err != nil {
+		return fmt.Errorf("failed to reactivate webhook: %w", err)
+	}
+	return nil
+}
+
+// marshalWebhookScope encodes a webhook's scoping lists, leaving unset ones
+// NULL
+func marshalWebhookScope(webhook *models.Webhook) (groupIDs, statuses, tags, fields jsonColumn, err error) {
+	encode := func(list []string) (jsonColumn, error) {
+		if len(list) == 0 {
+			return nil, nil
+		}
+		return marshalJSONColumn(list)
+	}
+
+	if groupIDs, err = encode(webhook.GroupIDs); err != nil {
+		return
+	}
+	if statuses, err = encode(webhook.Statuses); err != nil {
+		return
+	}
+	if tags, err = encode(webhook.Tags); err != nil {
+		return
+	}
+	fields, err = encode(webhook.Fields)
+	return
+}
+
+// scanWebhook reads a row of webhookColumns. Secret, headers, and the
+// scoping lists are optional and may be NULL.
+func scanWebhook(row rowScanner) (*models.Webhook, error) {
+	var webhook models.Webhook
+	var eventsJSON string
+	var secret sql.NullString
+	var headersJSON, groupIDsJSON, statusesJSON, tagsJSON, fieldsJSON, retryJSON jsonColumn
+
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.Name,
+		&webhook.URL,
+		&eventsJSON,
+		&secret,
+		&webhook.Active,
+		&headersJSON,
+		&webhook.Timeout,
+		&webhook.MaxRetries,
+		&groupIDsJSON,
+		&statusesJSON,
+		&tagsJSON,
+		&fieldsJSON,
+		&webhook.AllowPrivateNetworks,
+		&webhook.SchemaVersion,
+		&webhook.Format,
+		&webhook.DisableAfterFailures,
+		&webhook.DisableAfterSeconds,
+		&webhook.ConsecutiveFailures,
+		&webhook.FailingSince,
+		&webhook.AutoDisabledAt,
+		&webhook.DisabledReason,
+		&webhook.LastSuccess,
+		&webhook.LastFailure,
+		&webhook.CreatedAt,
+		&webhook.UpdatedAt,
+		&retryJSON,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(eventsJSON), &webhook.Events); err != nil {
+		return nil, err
+	}
+	webhook.Secret = secret.String
+	webhook.Headers = headersJSON.RawMessage()
+	if err := retryJSON.Unmarshal(&webhook.Retry); err != nil {
+		return nil, err
+	}
+	for _, list := range []struct {
+		data jsonColumn
+		dest *[]string
+	}{
+		{groupIDsJSON, &webhook.GroupIDs},
+		{statusesJSON, &webhook.Statuses},
+		{tagsJSON, &webhook.Tags},
+		{fieldsJSON, &webhook.Fields},
+	} {
+		if err := list.data.Unmarshal(list.dest); err != nil {
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+const wipeJobColumns = `
+	id, machine_id, status, disks, error, requested_by,
+	created_at, updated_at, started_at, completed_at
+`
+
+// CreateWipeJob creates a new wipe job
+func (db *DB) CreateWipeJob(job *models.WipeJob) error {
+	job.ID = uuid.New().String()
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+
+	disksJSON, err := json.Marshal(job.Disks)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO wipe_jobs (id, machine_id, status, disks, requested_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			INSERT INTO wipe_jobs (id, machine_id, status, disks, requested_by, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`
+	}
+
+	_, err = db.Exec(query,
+		job.ID,
+		job.MachineID,
+		job.Status,
+		string(disksJSON),
+		job.RequestedBy,
+		job.CreatedAt,
+		job.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create wipe job: %w", err)
+	}
+
+	return nil
+}
+
+// GetWipeJob retrieves a wipe job by ID. It returns nil, nil if there is no
+// such job.
+func (db *DB) GetWipeJob(id string) (*models.WipeJob, error) {
+	query := `SELECT` + wipeJobColumns + `FROM wipe_jobs WHERE id = ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + wipeJobColumns + `FROM wipe_jobs WHERE id = $1`
+	}
+
+	job, err := scanWipeJob(db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return job, err
+}
+
+// GetActiveWipeJob retrieves the pending or running wipe job for a machine.
+// It returns nil, nil if the machine has none.
+func (db *DB) GetActiveWipeJob(machineID string) (*models.WipeJob, error) {
+	query := `SELECT` + wipeJobColumns + `FROM wipe_jobs
+		WHERE machine_id = ? AND status IN ('pending', 'running')
+		ORDER BY created_at DESC LIMIT 1`
+	if db.driver == "postgres" {
+		query = `SELECT` + wipeJobColumns + `FROM wipe_jobs
+			WHERE machine_id = $1 AND status IN ('pending', 'running')
+			ORDER BY created_at DESC LIMIT 1`
+	}
+
+	job, err := scanWipeJob(db.QueryRow(query, machineID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return job, err
+}
+
+// ListWipeJobs lists the wipe jobs for a machine, newest first
+func (db *DB) ListWipeJobs(machineID string) ([]*models.WipeJob, error) {
+	query := `SELECT` + wipeJobColumns + `FROM wipe_jobs WHERE machine_id = ? ORDER BY created_at DESC`
+	if db.driver == "postgres" {
+		query = `SELECT` + wipeJobColumns + `FROM wipe_jobs WHERE machine_id = $1 ORDER BY created_at DESC`
+	}
+
+	return db.queryWipeJobs(query, machineID)
+}
+
+// ListStalledWipeJobs lists running wipe jobs with no progress since before
+func (db *DB) ListStalledWipeJobs(before time.Time) ([]*models.WipeJob, error) {
+	query := `SELECT` + wipeJobColumns + `FROM wipe_jobs WHERE status = 'running' AND updated_at < ?`
+	if db.driver == "postgres" {
+		query = `SELECT` + wipeJobColumns + `FROM wipe_jobs WHERE status = 'running' AND updated_at < $1`
+	}
+
+	return db.queryWipeJobs(query, before)
+}
+
+func (db *DB) queryWipeJobs(query string, args ...interface{}) ([]*models.WipeJob, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wipe jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*models.WipeJob
+	for rows.Next() {
+		job, err := scanWipeJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// UpdateWipeJob updates a wipe job's status and disk progress
+func (db *DB) UpdateWipeJob(job *models.WipeJob) error {
+	job.UpdatedAt = time.Now()
+
+	disksJSON, err := json.Marshal(job.Disks)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE wipe_jobs SET
+			status = ?, disks = ?, error = ?, updated_at = ?, started_at = ?, completed_at = ?
+		WHERE id = ?
+	`
+
+	if db.driver == "postgres" {
+		query = `
+			UPDATE wipe_jobs SET
+				status = $1, disks = $2, error = $3, updated_at = $4, started_at = $5, completed_at = $6
+			WHERE id = $7
+		`
+	}
+
+	_, err = db.Exec(query,
+		job.Status,
+		string(disksJSON),
+		job.Error,
+		job.UpdatedAt,
+		job.StartedAt,
+		job.CompletedAt,
+		job.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update wipe job: %w", err)
+	}
+
+	return nil
+}
+
+func scanWipeJob(row rowScanner) (*models.WipeJob, error) {
+	var job models.WipeJob
+	var disksJSON string
+	var errorText sql.NullString
+
+	err := row.Scan(
+		&job.ID,
+		&job.MachineID,
+		&job.Status,
+		&disksJSON,
+		&errorText,
+		&job.RequestedBy,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.StartedAt,
+		&job.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Error = errorText.String
+	if err := json.Unmarshal([]byte(disksJSON), &job.Disks); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal wipe disks: %w", err)
+	}
+
+	return &job, nil
+}
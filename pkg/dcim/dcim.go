@@ -0,0 +1,29 @@
+// Package dcim imports machines from a data center infrastructure
+// management system, which is the source of truth for where machines are
+// racked, their BMC addresses, and their tags. Each DCIM is a Source; Sync
+// works the same with any of them.
+package dcim
+
+import "context"
+
+// Device is a server as a DCIM describes it
+type Device struct {
+	ID     string // The DCIM's own ID for the device
+	Name   string
+	Serial string // Matched against machines' service tags
+
+	Datacenter string
+	Rack       string
+	RackUnit   int    // Lowest rack unit the device occupies, 0 if unknown
+	BMCAddress string // IP address of the out-of-band management interface
+	Tags       []string
+}
+
+// Source is a DCIM that devices are synced from
+type Source interface {
+	// Name identifies the source in sync records and reports, e.g. netbox
+	Name() string
+
+	// Devices returns every device the sync covers
+	Devices(ctx context.Context) ([]Device, error)
+}
@@ -0,0 +1,158 @@
+package dcim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// netboxTimeout bounds each page fetched from NetBox
+	netboxTimeout = 30 * time.Second
+
+	// netboxPageSize is how many devices are fetched per page
+	netboxPageSize = 200
+)
+
+// NetBox is a Source that pulls devices from NetBox's DCIM API
+type NetBox struct {
+	url    string
+	token  string
+	filter url.Values
+	http   *http.Client
+}
+
+// NewNetBox returns a source for the NetBox instance at baseURL. filter is
+// a query string of NetBox device filters, e.g. site=ams1&role=server,
+// selecting the devices to sync; empty syncs every device.
+func NewNetBox(baseURL, token, filter string) (*NetBox, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(filter, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NetBox filter: %w", err)
+	}
+	return &NetBox{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		token:  token,
+		filter: values,
+		http:   &http.Client{Timeout: netboxTimeout},
+	}, nil
+}
+
+// Name implements Source
+func (n *NetBox) Name() string {
+	return "netbox"
+}
+
+// netboxDevice is the part of a NetBox device the sync reads
+type netboxDevice struct {
+	ID       int      `json:"id"`
+	Name     *string  `json:"name"`
+	Serial   string   `json:"serial"`
+	Position *float64 `json:"position"`
+	Site     *struct {
+		Name string `json:"name"`
+	} `json:"site"`
+	Rack *struct {
+		Name string `json:"name"`
+	} `json:"rack"`
+	OOBIP *struct {
+		Address string `json:"address"`
+	} `json:"oob_ip"`
+	Tags []struct {
+		Slug string `json:"slug"`
+	} `json:"tags"`
+}
+
+// netboxPage is one page of a NetBox list response
+type netboxPage struct {
+	Next    *string        `json:"next"`
+	Results []netboxDevice `json:"results"`
+}
+
+// Devices implements Source, following NetBox's pagination until every
+// device matching the filter has been fetched
+func (n *NetBox) Devices(ctx context.Context) ([]Device, error) {
+	query := url.Values{}
+	for key, values := range n.filter {
+		query[key] = values
+	}
+	query.Set("limit", fmt.Sprint(netboxPageSize))
+	next := fmt.Sprintf("%s/api/dcim/devices/?%s", n.url, query.Encode())
+
+	var devices []Device
+	for next != "" {
+		page, err := n.fetch(ctx, next)
+		if err != nil {
+			return devices, err
+		}
+		for _, d := range page.Results {
+			devices = append(devices, d.device())
+		}
+
+		next = ""
+		if page.Next != nil {
+			next = *page.Next
+		}
+	}
+	return devices, nil
+}
+
+func (n *NetBox) fetch(ctx context.Context, pageURL string) (*netboxPage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Token "+n.token)
+	}
+
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("NetBox unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("NetBox returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var page netboxPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to decode NetBox devices: %w", err)
+	}
+	return &page, nil
+}
+
+func (d netboxDevice) device() Device {
+	device := Device{
+		ID:     fmt.Sprint(d.ID),
+		Serial: d.Serial,
+	}
+	if d.Name != nil {
+		device.Name = *d.Name
+	}
+	if d.Site != nil {
+		device.Datacenter = d.Site.Name
+	}
+	if d.Rack != nil {
+		device.Rack = d.Rack.Name
+	}
+	if d.Position != nil {
+		device.RackUnit = int(*d.Position)
+	}
+	if d.OOBIP != nil {
+		// NetBox addresses carry their prefix length, e.g. 10.0.0.5/24
+		device.BMCAddress, _, _ = strings.Cut(d.OOBIP.Address, "/")
+	}
+	for _, tag := range d.Tags {
+		device.Tags = append(device.Tags, tag.Slug)
+	}
+	return device
+}
@@ -0,0 +1,104 @@
+package dcim
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readFixture reads a NetBox response recorded in testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newNetBoxServer serves the recorded device pages, by offset, as NetBox
+// at its URL would, and records the requests it gets
+func newNetBoxServer(t *testing.T) (*httptest.Server, *[]*http.Request) {
+	t.Helper()
+
+	var requests []*http.Request
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.Header.Get("Authorization") != "Token secret-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(readFixture(t, "netbox_forbidden.json"))
+			return
+		}
+		page := "netbox_devices_1.json"
+		if r.URL.Query().Get("offset") != "" {
+			page = "netbox_devices_2.json"
+		}
+		// The pages link to each other under the URL they were recorded at
+		w.Write(bytes.ReplaceAll(readFixture(t, page), []byte("http://netbox.example.com"), []byte(server.URL)))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestNetBoxDevices(t *testing.T) {
+	server, requests := newNetBoxServer(t)
+
+	netbox, err := NewNetBox(server.URL+"/", "secret-token", "?site=ams1&role=server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := netbox.Devices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Device{
+		{ID: "101", Name: "ams1-r01-u10", Serial: "ABC1234", Datacenter: "ams1", Rack: "R01", RackUnit: 10, BMCAddress: "10.20.1.10", Tags: []string{"gpu", "row-3"}},
+		{ID: "102", Serial: "ABC1235", Datacenter: "ams1"},
+		{ID: "103", Name: "ams1-r02-u20", Datacenter: "ams1", Rack: "R02", RackUnit: 20},
+		{ID: "104", Name: "ams1-r02-u22", Serial: "SM998877", Datacenter: "ams1", Rack: "R02", RackUnit: 22, BMCAddress: "fd00:20::22", Tags: []string{"row-3"}},
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("devices = %+v\nwant %+v", devices, want)
+	}
+
+	// The filter is sent with the first page, and the second page is
+	// where NetBox said it would be
+	if len(*requests) != 2 {
+		t.Fatalf("made %d requests, want 2", len(*requests))
+	}
+	first := (*requests)[0]
+	if first.URL.Path != "/api/dcim/devices/" || first.URL.Query().Get("site") != "ams1" ||
+		first.URL.Query().Get("role") != "server" || first.URL.Query().Get("limit") != "200" {
+		t.Errorf("first request %s, want the filtered device list", first.URL)
+	}
+	if second := (*requests)[1]; second.URL.Query().Get("offset") != "2" {
+		t.Errorf("second request %s, want the next page", second.URL)
+	}
+}
+
+func TestNetBoxDevicesRejected(t *testing.T) {
+	server, _ := newNetBoxServer(t)
+
+	netbox, err := NewNetBox(server.URL, "wrong-token", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = netbox.Devices(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "Invalid token") {
+		t.Errorf("err = %v, want NetBox's status and reason", err)
+	}
+}
+
+func TestNewNetBoxInvalidFilter(t *testing.T) {
+	if _, err := NewNetBox("http://netbox.example.com", "", "site=%zz"); err == nil {
+		t.Error("accepted an invalid filter")
+	}
+}
@@ -0,0 +1,220 @@
+package dcim
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Sync fields, as named in sync reports
+const (
+	fieldDatacenter = "datacenter"
+	fieldRack       = "rack"
+	fieldRackUnit   = "rack_unit"
+	fieldBMCAddress = "bmc_address"
+	fieldTags       = "tags"
+)
+
+// Sync pulls every device from source and creates or updates the matching
+// machines, keyed by service tag. Devices without a machine become
+// preregistered machines. A field that was edited here since source last
+// synced it is a conflict and left alone, unless force is set. The report
+// is stored whether or not the sync succeeds; the error is only for
+// failures to store it.
+func Sync(ctx context.Context, db *database.DB, source Source, force bool) (*models.DCIMSyncReport, error) {
+	report := &models.DCIMSyncReport{
+		Source:    source.Name(),
+		Force:     force,
+		StartedAt: time.Now(),
+	}
+
+	devices, err := source.Devices(ctx)
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	seen := map[string]string{}
+	for _, device := range devices {
+		item := syncDevice(db, source.Name(), device, force, seen)
+		switch item.Action {
+		case models.DCIMSyncCreated:
+			report.Created++
+		case models.DCIMSyncUpdated:
+			report.Updated++
+		case models.DCIMSyncSkipped:
+			report.Skipped++
+		case models.DCIMSyncConflict:
+			report.Conflicts++
+		default:
+			report.Unchanged++
+			continue
+		}
+		report.Items = append(report.Items, item)
+	}
+
+	finished := time.Now()
+	report.FinishedAt = &finished
+
+	if err := db.CreateDCIMSyncReport(report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// syncDevice syncs one device and returns what it did, with no action if
+// the machine was already up to date. seen maps the service tags synced so
+// far to their devices' names.
+func syncDevice(db *database.DB, source string, device Device, force bool, seen map[string]string) models.DCIMSyncItem {
+	item := models.DCIMSyncItem{Device: device.Name, ExternalID: device.ID}
+	skip := func(format string, args ...interface{}) models.DCIMSyncItem {
+		item.Action = models.DCIMSyncSkipped
+		item.Message = fmt.Sprintf(format, args...)
+		return item
+	}
+
+	serviceTag := strings.TrimSpace(device.Serial)
+	if models.NormalizeSerialNumber(serviceTag) == "" {
+		return skip("device has no serial number")
+	}
+	item.ServiceTag = serviceTag
+	if other, ok := seen[serviceTag]; ok {
+		return skip("serial number is also on device %s", other)
+	}
+	seen[serviceTag] = device.Name
+
+	tags, err := models.NormalizeTags(device.Tags)
+	if err != nil {
+		return skip("invalid tags: %v", err)
+	}
+	bmcAddress := device.BMCAddress
+	if bmcAddress != "" {
+		if bmcAddress, err = models.NormalizeIP(bmcAddress); err != nil {
+			return skip("invalid out-of-band IP: %v", err)
+		}
+	}
+	want := models.DCIMFields{
+		Datacenter: strings.TrimSpace(device.Datacenter),
+		Rack:       strings.TrimSpace(device.Rack),
+		RackUnit:   device.RackUnit,
+		BMCAddress: bmcAddress,
+		Tags:       tags,
+	}
+
+	machine, err := db.GetMachineByServiceTag(serviceTag)
+	if err != nil {
+		return skip("failed to look up machine: %v", err)
+	}
+
+	if machine == nil {
+		trashed, err := db.GetTrashedMachineByServiceTag(serviceTag)
+		if err != nil {
+			return skip("failed to look up machine: %v", err)
+		}
+		if trashed != nil {
+			item.MachineID = trashed.ID
+			return skip("machine is in the trash")
+		}
+
+		machine, err = db.CreatePreregisteredMachine(serviceTag, device.Name, want)
+		if err != nil {
+			return skip("failed to create machine: %v", err)
+		}
+		item.MachineID = machine.ID
+		item.Action = models.DCIMSyncCreated
+		if err := saveRecord(db, source, device, machine.ID, want); err != nil {
+			item.Message = err.Error()
+		}
+		return item
+	}
+	item.MachineID = machine.ID
+
+	record, err := db.GetDCIMRecord(source, machine.ID)
+	if err != nil {
+		return skip("%v", err)
+	}
+
+	// A field was edited here if it no longer has the value last synced,
+	// or, for a machine never synced, if it has a value at all
+	var previous models.DCIMFields
+	if record != nil {
+		previous = record.Synced
+	}
+	have := machine.DCIMFields()
+	synced := want
+	var updated, conflicts []string
+
+	for _, field := range []struct {
+		name                 string
+		have, want, previous string
+		apply                func()
+		keepPrevious         func()
+	}{
+		{fieldDatacenter, have.Datacenter, want.Datacenter, previous.Datacenter,
+			func() { have.Datacenter = want.Datacenter }, func() { synced.Datacenter = previous.Datacenter }},
+		{fieldRack, have.Rack, want.Rack, previous.Rack,
+			func() { have.Rack = want.Rack }, func() { synced.Rack = previous.Rack }},
+		{fieldRackUnit, unitString(have.RackUnit), unitString(want.RackUnit), unitString(previous.RackUnit),
+			func() { have.RackUnit = want.RackUnit }, func() { synced.RackUnit = previous.RackUnit }},
+		{fieldBMCAddress, have.BMCAddress, want.BMCAddress, previous.BMCAddress,
+			func() { have.BMCAddress = want.BMCAddress }, func() { synced.BMCAddress = previous.BMCAddress }},
+		{fieldTags, strings.Join(have.Tags, " "), strings.Join(want.Tags, " "), strings.Join(previous.Tags, " "),
+			func() { have.Tags = want.Tags }, func() { synced.Tags = previous.Tags }},
+	} {
+		if field.have == field.want {
+			continue
+		}
+		if field.have != field.previous && !force {
+			conflicts = append(conflicts, field.name)
+			field.keepPrevious()
+			continue
+		}
+		field.apply()
+		updated = append(updated, field.name)
+	}
+
+	if len(updated) > 0 {
+		machine.SetDCIMFields(have)
+		if err := db.UpdateMachine(machine); err != nil {
+			return skip("failed to update machine: %v", err)
+		}
+	}
+	if err := saveRecord(db, source, device, machine.ID, synced); err != nil {
+		item.Message = err.Error()
+	}
+
+	switch {
+	case len(conflicts) > 0:
+		item.Action = models.DCIMSyncConflict
+		item.Fields = conflicts
+		item.Message = "edited since the last sync; sync with force to overwrite"
+		if len(updated) > 0 {
+			item.Message += "; updated " + strings.Join(updated, ", ")
+		}
+	case len(updated) > 0:
+		item.Action = models.DCIMSyncUpdated
+		item.Fields = updated
+	}
+	return item
+}
+
+// saveRecord records the field values synced to a machine from device
+func saveRecord(db *database.DB, source string, device Device, machineID string, synced models.DCIMFields) error {
+	return db.SaveDCIMRecord(&models.DCIMRecord{
+		MachineID:  machineID,
+		Source:     source,
+		ExternalID: device.ID,
+		Synced:     synced,
+		SyncedAt:   time.Now(),
+	})
+}
+
+func unitString(unit int) string {
+	if unit == 0 {
+		return ""
+	}
+	return fmt.Sprint(unit)
+}
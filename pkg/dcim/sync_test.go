@@ -0,0 +1,171 @@
+package dcim
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// staticSource is a Source with a fixed list of devices
+type staticSource []Device
+
+func (s *staticSource) Name() string { return "static" }
+
+func (s *staticSource) Devices(ctx context.Context) ([]Device, error) { return *s, nil }
+
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	db, err := database.New(database.Config{Driver: "sqlite3", DSN: "file:" + filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=10000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// checkReport compares a report's counts and its items' actions, by
+// service tag, or device name for devices without one
+func checkReport(t *testing.T, report *models.DCIMSyncReport, created, updated, unchanged, skipped, conflicts int, actions map[string]string) {
+	t.Helper()
+
+	got := [5]int{report.Created, report.Updated, report.Unchanged, report.Skipped, report.Conflicts}
+	if want := [5]int{created, updated, unchanged, skipped, conflicts}; got != want {
+		t.Errorf("created, updated, unchanged, skipped, conflicts = %v, want %v", got, want)
+	}
+	gotActions := map[string]string{}
+	for _, item := range report.Items {
+		key := item.ServiceTag
+		if key == "" {
+			key = item.Device
+		}
+		gotActions[key] = item.Action
+	}
+	if !reflect.DeepEqual(gotActions, actions) {
+		t.Errorf("actions = %v, want %v", gotActions, actions)
+	}
+}
+
+func TestSyncFromNetBox(t *testing.T) {
+	db := newTestDB(t)
+	server, _ := newNetBoxServer(t)
+	netbox, err := NewNetBox(server.URL, "secret-token", "site=ams1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Sync(context.Background(), db, netbox, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Error != "" {
+		t.Fatalf("sync failed: %s", report.Error)
+	}
+	checkReport(t, report, 3, 0, 0, 1, 0, map[string]string{
+		"ABC1234":      models.DCIMSyncCreated,
+		"ABC1235":      models.DCIMSyncCreated,
+		"SM998877":     models.DCIMSyncCreated,
+		"ams1-r02-u20": models.DCIMSyncSkipped,
+	})
+
+	machine, err := db.GetMachineByServiceTag("ABC1234")
+	if err != nil || machine == nil {
+		t.Fatalf("machine ABC1234 = %v, %v", machine, err)
+	}
+	want := models.DCIMFields{Datacenter: "ams1", Rack: "R01", RackUnit: 10, BMCAddress: "10.20.1.10", Tags: []string{"gpu", "row-3"}}
+	if machine.Status != models.StatusPreregistered || machine.Hostname != "ams1-r01-u10" || !reflect.DeepEqual(machine.DCIMFields(), want) {
+		t.Errorf("machine = %s %q %+v, want preregistered ams1-r01-u10 %+v", machine.Status, machine.Hostname, machine.DCIMFields(), want)
+	}
+
+	// Nothing changed in NetBox, so nothing changes here
+	report, err = Sync(context.Background(), db, netbox, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReport(t, report, 0, 0, 3, 1, 0, map[string]string{"ams1-r02-u20": models.DCIMSyncSkipped})
+
+	// Reports are kept
+	stored, err := db.GetDCIMSyncReport(report.ID)
+	if err != nil || stored == nil || stored.Unchanged != 3 {
+		t.Errorf("stored report = %+v, %v", stored, err)
+	}
+}
+
+func TestSyncConflicts(t *testing.T) {
+	db := newTestDB(t)
+	source := &staticSource{
+		{ID: "1", Name: "node-1", Serial: "NODE0001", Datacenter: "ams1", Rack: "R01", RackUnit: 4, BMCAddress: "10.0.0.4"},
+		{ID: "2", Name: "node-2", Serial: "NODE0002", Datacenter: "ams1", Rack: "R01", RackUnit: 6},
+	}
+	sync := func(force bool) *models.DCIMSyncReport {
+		t.Helper()
+		report, err := Sync(context.Background(), db, source, force)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	sync(false)
+
+	// The rack is corrected here, then the machine moves datacenter in
+	// the DCIM, which still has the old rack
+	machine, _ := db.GetMachineByServiceTag("NODE0001")
+	machine.Location.Rack = "R09"
+	if err := db.UpdateMachine(machine); err != nil {
+		t.Fatal(err)
+	}
+	(*source)[0].Datacenter = "ams2"
+	(*source)[0].Rack = "R02"
+
+	report := sync(false)
+	checkReport(t, report, 0, 0, 1, 0, 1, map[string]string{"NODE0001": models.DCIMSyncConflict})
+	if item := report.Items[0]; !reflect.DeepEqual(item.Fields, []string{fieldRack}) ||
+		item.Message != "edited since the last sync; sync with force to overwrite; updated datacenter" {
+		t.Errorf("item = %+v, want a rack conflict and the datacenter updated", item)
+	}
+	machine, _ = db.GetMachineByServiceTag("NODE0001")
+	if machine.Location.Datacenter != "ams2" || machine.Location.Rack != "R09" {
+		t.Errorf("location = %+v, want the new datacenter and the rack set here", machine.Location)
+	}
+
+	// The conflict stands until the sync is forced
+	checkReport(t, sync(false), 0, 0, 1, 0, 1, map[string]string{"NODE0001": models.DCIMSyncConflict})
+	checkReport(t, sync(true), 0, 1, 1, 0, 0, map[string]string{"NODE0001": models.DCIMSyncUpdated})
+	machine, _ = db.GetMachineByServiceTag("NODE0001")
+	if machine.Location.Rack != "R02" {
+		t.Errorf("rack = %q after a forced sync, want R02", machine.Location.Rack)
+	}
+	checkReport(t, sync(false), 0, 0, 2, 0, 0, map[string]string{})
+}
+
+func TestSyncSkipsInvalidDevices(t *testing.T) {
+	db := newTestDB(t)
+	source := &staticSource{
+		{ID: "1", Name: "no-serial"},
+		{ID: "2", Name: "first", Serial: "DUP0001"},
+		{ID: "3", Name: "second", Serial: "DUP0001"},
+		{ID: "4", Name: "bad-ip", Serial: "BADIP001", BMCAddress: "10.0.0.300"},
+	}
+
+	report, err := Sync(context.Background(), db, source, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Created != 1 || report.Skipped != 3 {
+		t.Errorf("created %d, skipped %d, want 1 and 3", report.Created, report.Skipped)
+	}
+	messages := map[string]string{}
+	for _, item := range report.Items {
+		messages[item.Device] = item.Message
+	}
+	if messages["second"] != "serial number is also on device first" || messages["no-serial"] != "device has no serial number" {
+		t.Errorf("messages = %q", messages)
+	}
+}
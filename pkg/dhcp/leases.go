@@ -0,0 +1,183 @@
+package dhcp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lease file formats understood by the parser
+const (
+	FormatISC     = "isc"
+	FormatDnsmasq = "dnsmasq"
+)
+
+// Lease is a single MAC to IP binding from a DHCP server
+type Lease struct {
+	MACAddress string    `json:"mac_address"`
+	IPAddress  string    `json:"ip_address"`
+	Hostname   string    `json:"hostname,omitempty"`
+	Expires    time.Time `json:"expires,omitempty"`
+}
+
+// ParseFile reads a lease file, detecting whether it was written by ISC
+// dhcpd or dnsmasq
+func ParseFile(path string) ([]Lease, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease file: %w", err)
+	}
+
+	return Parse(bytes.NewReader(data), DetectFormat(data))
+}
+
+// Parse reads leases in the given format
+func Parse(r io.Reader, format string) ([]Lease, error) {
+	switch format {
+	case FormatISC:
+		return ParseISC(r)
+	case FormatDnsmasq:
+		return ParseDnsmasq(r)
+	}
+	return nil, fmt.Errorf("unsupported lease format: %s", format)
+}
+
+// DetectFormat guesses the lease file format from its contents. dhcpd.leases
+// is made of `lease <ip> { ... }` blocks; dnsmasq writes one lease per line
+// starting with the expiry timestamp.
+func DetectFormat(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "lease ") || strings.HasPrefix(line, "authoring-byte-order") ||
+			strings.HasPrefix(line, "server-duid") {
+			return FormatISC
+		}
+		return FormatDnsmasq
+	}
+	return FormatDnsmasq
+}
+
+// ParseISC parses an ISC dhcpd leases file. dhcpd appends a new block each
+// time a lease changes, so later blocks replace earlier ones for the same
+// address. Leases that are not in the active binding state are dropped.
+func ParseISC(r io.Reader) ([]Lease, error) {
+	byIP := make(map[string]int)
+	var leases []Lease
+	var active []bool
+
+	var current *Lease
+	var state string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current == nil {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "lease" {
+				current = &Lease{IPAddress: fields[1]}
+				state = ""
+			}
+			continue
+		}
+
+		if line == "}" {
+			if current.MACAddress != "" {
+				if i, ok := byIP[current.IPAddress]; ok {
+					leases[i] = *current
+					active[i] = state == "" || state == "active"
+				} else {
+					byIP[current.IPAddress] = len(leases)
+					leases = append(leases, *current)
+					active = append(active, state == "" || state == "active")
+				}
+			}
+			current = nil
+			continue
+		}
+
+		statement := strings.TrimSuffix(line, ";")
+		fields := strings.Fields(statement)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "hardware" && len(fields) >= 3:
+			current.MACAddress = strings.ToLower(fields[2])
+		case fields[0] == "client-hostname":
+			current.Hostname = strings.Trim(fields[1], `"`)
+		case fields[0] == "ends" && len(fields) >= 4:
+			// ends <weekday> <yyyy/mm/dd> <hh:mm:ss>
+			if t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+				current.Expires = t
+			}
+		case fields[0] == "binding" && len(fields) >= 3 && fields[1] == "state":
+			state = fields[2]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read leases: %w", err)
+	}
+
+	var result []Lease
+	for i, lease := range leases {
+		if active[i] {
+			result = append(result, lease)
+		}
+	}
+	return result, nil
+}
+
+// ParseDnsmasq parses a dnsmasq leases file, one lease per line:
+// <expiry epoch> <mac> <ip> <hostname|*> <client-id|*>
+func ParseDnsmasq(r io.Reader) ([]Lease, error) {
+	var leases []Lease
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// DHCPv6 leases follow the server "duid" line and carry an IAID
+		// instead of a MAC, so nothing after it can be matched to a machine
+		if len(fields) > 0 && fields[0] == "duid" {
+			break
+		}
+		if len(fields) < 4 {
+			continue
+		}
+
+		lease := Lease{
+			MACAddress: strings.ToLower(fields[1]),
+			IPAddress:  fields[2],
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		// An expiry of 0 means the lease is infinite
+		if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expiry > 0 {
+			lease.Expires = time.Unix(expiry, 0).UTC()
+		}
+
+		leases = append(leases, lease)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read leases: %w", err)
+	}
+
+	return leases, nil
+}
@@ -0,0 +1,121 @@
+package dhcp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFixture returns a captured lease file from testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseISC(t *testing.T) {
+	leases, err := ParseFile(filepath.Join("testdata", "dhcpd.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The renewal of .21 replaces its first lease, .22 and .23 are no
+	// longer bound, and .25 has no hardware address
+	want := []Lease{
+		{MACAddress: "52:54:00:aa:10:21", IPAddress: "10.0.10.21", Hostname: "node-21", Expires: time.Date(2026, 10, 14, 21, 12, 4, 0, time.UTC)},
+		{MACAddress: "52:54:00:aa:10:24", IPAddress: "10.0.10.24"},
+	}
+	if !reflect.DeepEqual(leases, want) {
+		t.Errorf("leases = %+v, want %+v", leases, want)
+	}
+}
+
+func TestParseDnsmasq(t *testing.T) {
+	leases, err := ParseFile(filepath.Join("testdata", "dnsmasq.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Malformed lines and the DHCPv6 leases after the duid are skipped
+	want := []Lease{
+		{MACAddress: "52:54:00:bb:20:31", IPAddress: "10.0.20.31", Hostname: "node-31", Expires: time.Date(2026, 10, 15, 8, 0, 0, 0, time.UTC)},
+		{MACAddress: "52:54:00:bb:20:32", IPAddress: "10.0.20.32", Expires: time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)},
+		{MACAddress: "52:54:00:bb:20:33", IPAddress: "10.0.20.33", Hostname: "static-33"},
+	}
+	if !reflect.DeepEqual(leases, want) {
+		t.Errorf("leases = %+v, want %+v", leases, want)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"dhcpd.leases", readFixture(t, "dhcpd.leases"), FormatISC},
+		{"dnsmasq.leases", readFixture(t, "dnsmasq.leases"), FormatDnsmasq},
+		{"lease block first", []byte("lease 10.0.0.5 {\n}\n"), FormatISC},
+		{"empty", nil, FormatDnsmasq},
+	}
+
+	for _, tt := range tests {
+		if got := DetectFormat(tt.data); got != tt.want {
+			t.Errorf("%s: format %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseUnsupportedFormat(t *testing.T) {
+	if _, err := Parse(strings.NewReader(""), "kea"); err == nil {
+		t.Error("parsed leases in an unknown format")
+	}
+	if _, err := ParseFile(filepath.Join("testdata", "missing.leases")); err == nil {
+		t.Error("parsed a missing file")
+	}
+}
+
+func TestWatcherReloadsReplacedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dnsmasq.leases")
+	if err := os.WriteFile(path, []byte("0 52:54:00:bb:20:33 10.0.20.33 * *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loads := make(chan []Lease, 4)
+	w, err := NewWatcher(path, func(leases []Lease) { loads <- leases })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Start()
+
+	if leases := <-loads; len(leases) != 1 {
+		t.Fatalf("initial load: %d leases, want 1", len(leases))
+	}
+
+	// DHCP servers rename a new file over the old one
+	tmp := filepath.Join(dir, ".dnsmasq.leases.new")
+	if err := os.WriteFile(tmp, readFixture(t, "dnsmasq.leases"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case leases := <-loads:
+		if len(leases) != 3 {
+			t.Errorf("reload: %d leases, want 3", len(leases))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease file not reloaded")
+	}
+}
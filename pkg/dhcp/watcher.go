@@ -0,0 +1,89 @@
+package dhcp
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay collapses the burst of events a DHCP server produces while
+// rewriting its lease file into a single reload
+const reloadDelay = 500 * time.Millisecond
+
+// Watcher reloads a lease file whenever it changes
+type Watcher struct {
+	path     string
+	onChange func([]Lease)
+	watcher  *fsnotify.Watcher
+}
+
+// NewWatcher creates a watcher that calls onChange with the full lease set
+// every time the file at path is written or replaced
+func NewWatcher(path string, onChange func([]Lease)) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	// Watch the directory rather than the file: dhcpd and dnsmasq replace
+	// the lease file by renaming a new one over it, which drops file watches
+	if err := fsw.Add(filepath.Dir(path)); err != nil {
+		fsw.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+
+	return &Watcher{
+		path:     filepath.Clean(path),
+		onChange: onChange,
+		watcher:  fsw,
+	}, nil
+}
+
+// Start loads the lease file once and then reloads it on every change
+func (w *Watcher) Start() {
+	w.reload()
+
+	go func() {
+		var pending <-chan time.Time
+
+		for {
+			select {
+			case event, ok := <-w.watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != w.path {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					pending = time.After(reloadDelay)
+				}
+			case <-pending:
+				pending = nil
+				w.reload()
+			case err, ok := <-w.watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Lease file watcher error: %v", err)
+			}
+		}
+	}()
+}
+
+// Close stops watching the lease file
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *Watcher) reload() {
+	leases, err := ParseFile(w.path)
+	if err != nil {
+		log.Printf("Failed to load leases from %s: %v", w.path, err)
+		return
+	}
+	w.onChange(leases)
+}
@@ -0,0 +1,349 @@
+package drift
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Field is one compared value of a machine
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Profile is everything a machine is compared on
+type Profile struct {
+	Machine     *models.Machine
+	Config      string // Normalized
+	Fingerprint string
+	Hardware    []Field
+	Build       []Field
+}
+
+// LoadProfile builds a machine's profile, looking up its last build
+func LoadProfile(db *database.DB, machine *models.Machine, opts models.DriftOptions) (*Profile, error) {
+	var build *models.BuildRequest
+	if machine.LastBuildID != nil {
+		var err error
+		if build, err = db.GetBuild(*machine.LastBuildID); err != nil {
+			return nil, err
+		}
+	}
+	return NewProfile(machine, build, opts), nil
+}
+
+// NewProfile builds a machine's profile. build is the machine's last build,
+// if any.
+func NewProfile(machine *models.Machine, build *models.BuildRequest, opts models.DriftOptions) *Profile {
+	config := NormalizeConfig(machine.NixOSConfig, machine)
+	return &Profile{
+		Machine:     machine,
+		Config:      config,
+		Fingerprint: Fingerprint(config),
+		Hardware:    hardwareFields(&machine.Hardware, opts),
+		Build:       buildFields(machine, build, config),
+	}
+}
+
+// ParseOptions reads tolerance rules from query parameters, starting from
+// the defaults: ignore_serials, ignore_macs, disk_bucket_gb, and
+// memory_bucket_gb
+func ParseOptions(query url.Values) (models.DriftOptions, error) {
+	opts := models.DefaultDriftOptions()
+
+	bools := []struct {
+		name  string
+		value *bool
+	}{
+		{"ignore_serials", &opts.IgnoreSerials},
+		{"ignore_macs", &opts.IgnoreMACs},
+	}
+	for _, b := range bools {
+		if v := query.Get(b.name); v != "" {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be true or false", b.name)
+			}
+			*b.value = parsed
+		}
+	}
+
+	buckets := []struct {
+		name  string
+		value *float64
+	}{
+		{"disk_bucket_gb", &opts.DiskBucketGB},
+		{"memory_bucket_gb", &opts.MemoryBucketGB},
+	}
+	for _, b := range buckets {
+		if v := query.Get(b.name); v != "" {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil || parsed < 0 || math.IsInf(parsed, 0) || math.IsNaN(parsed) {
+				return opts, fmt.Errorf("%s must be a non-negative number", b.name)
+			}
+			*b.value = parsed
+		}
+	}
+
+	return opts, nil
+}
+
+// Compare diffs two machines' profiles, reporting only the fields that
+// differ
+func Compare(a, b *Profile, opts models.DriftOptions) *models.MachineComparison {
+	return &models.MachineComparison{
+		A:               machineRef(a.Machine),
+		B:               machineRef(b.Machine),
+		Options:         opts,
+		ConfigIdentical: a.Config == b.Config,
+		ConfigDiff:      UnifiedDiff(a.Machine.ServiceTag, b.Machine.ServiceTag, withNewline(a.Config), withNewline(b.Config)),
+		Hardware:        diffFields(a.Hardware, b.Hardware),
+		Build:           diffFields(a.Build, b.Build),
+	}
+}
+
+// CheckGroup compares the members of a group. It returns nil if the group
+// does not exist.
+func CheckGroup(db *database.DB, groupID string, opts models.DriftOptions) (*models.GroupDrift, error) {
+	group, err := db.GetGroup(groupID)
+	if err != nil || group == nil {
+		return nil, err
+	}
+
+	machines, err := db.GetGroupMachines(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make([]*Profile, 0, len(machines))
+	for _, machine := range machines {
+		profile, err := LoadProfile(db, machine, opts)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	drift := Group(profiles)
+	drift.GroupID = groupID
+	drift.Options = opts
+	return drift, nil
+}
+
+// Group clusters profiles by configuration and finds the machines that
+// differ from the most common value of any field. Ties go to the value
+// seen first.
+func Group(profiles []*Profile) *models.GroupDrift {
+	drift := &models.GroupDrift{
+		MachineCount: len(profiles),
+		Clusters:     []models.ConfigCluster{},
+		Outliers:     []models.DriftOutlier{},
+	}
+
+	// Configuration clusters, largest first
+	index := map[string]int{}
+	for _, p := range profiles {
+		i, ok := index[p.Fingerprint]
+		if !ok {
+			i = len(drift.Clusters)
+			index[p.Fingerprint] = i
+			drift.Clusters = append(drift.Clusters, models.ConfigCluster{Fingerprint: p.Fingerprint})
+		}
+		drift.Clusters[i].MachineIDs = append(drift.Clusters[i].MachineIDs, p.Machine.ID)
+	}
+	sort.SliceStable(drift.Clusters, func(i, j int) bool {
+		return len(drift.Clusters[i].MachineIDs) > len(drift.Clusters[j].MachineIDs)
+	})
+	if len(profiles) == 0 {
+		return drift
+	}
+
+	// Compare every field with the most common value in the group
+	usual := map[string]string{"config": drift.Clusters[0].Fingerprint}
+	reference := drift.Clusters[0].MachineIDs[0]
+	for _, name := range fieldNames(profiles) {
+		usual[name] = mostCommon(profiles, name)
+	}
+
+	for _, p := range profiles {
+		var diffs []models.DriftField
+		if p.Fingerprint != usual["config"] {
+			diffs = append(diffs, models.DriftField{Field: "config", Expected: usual["config"], Actual: p.Fingerprint})
+		}
+		for _, f := range p.fields() {
+			if f.Value != usual[f.Name] {
+				diffs = append(diffs, models.DriftField{Field: f.Name, Expected: usual[f.Name], Actual: f.Value})
+			}
+		}
+		if len(diffs) == 0 {
+			continue
+		}
+
+		outlier := models.DriftOutlier{
+			MachineID:   p.Machine.ID,
+			ServiceTag:  p.Machine.ServiceTag,
+			Hostname:    p.Machine.Hostname,
+			Differences: diffs,
+		}
+		if p.Machine.ID != reference {
+			outlier.CompareWith = reference
+		}
+		drift.Outliers = append(drift.Outliers, outlier)
+	}
+
+	return drift
+}
+
+// fields returns every compared field but the configuration
+func (p *Profile) fields() []Field {
+	return append(append([]Field{}, p.Hardware...), p.Build...)
+}
+
+// fieldNames lists the fields of profiles in order. All profiles built with
+// the same options have the same fields.
+func fieldNames(profiles []*Profile) []string {
+	var names []string
+	for _, f := range profiles[0].fields() {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func mostCommon(profiles []*Profile, name string) string {
+	counts := map[string]int{}
+	var best string
+	for _, p := range profiles {
+		for _, f := range p.fields() {
+			if f.Name != name {
+				continue
+			}
+			counts[f.Value]++
+			if counts[f.Value] > counts[best] {
+				best = f.Value
+			}
+		}
+	}
+	return best
+}
+
+func diffFields(a, b []Field) []models.FieldDiff {
+	diffs := []models.FieldDiff{}
+	for i := range a {
+		if a[i].Value != b[i].Value {
+			diffs = append(diffs, models.FieldDiff{Field: a[i].Name, A: a[i].Value, B: b[i].Value})
+		}
+	}
+	return diffs
+}
+
+// hardwareFields flattens a hardware profile, applying the tolerance rules.
+// Disks and NICs are compared as sorted lists, so device naming order does
+// not matter.
+func hardwareFields(hw *models.HardwareInfo, opts models.DriftOptions) []Field {
+	fields := []Field{
+		{"manufacturer", hw.Manufacturer},
+		{"model", hw.Model},
+		{"bios_version", hw.BIOSVersion},
+	}
+	if !opts.IgnoreSerials {
+		fields = append(fields, Field{"serial_number", hw.SerialNumber})
+	}
+
+	memoryGB := hw.Memory.TotalGB
+	if memoryGB == 0 {
+		memoryGB = float64(hw.Memory.TotalBytes) / 1e9
+	}
+
+	fields = append(fields,
+		Field{"cpu.model", hw.CPU.Model},
+		Field{"cpu.sockets", strconv.Itoa(hw.CPU.Sockets)},
+		Field{"cpu.cores", strconv.Itoa(hw.CPU.Cores)},
+		Field{"cpu.threads", strconv.Itoa(hw.CPU.Threads)},
+		Field{"memory.total_gb", bucket(memoryGB, opts.MemoryBucketGB)},
+	)
+
+	var disks, diskSerials []string
+	for _, d := range hw.Disks {
+		sizeGB := d.SizeGB
+		if sizeGB == 0 {
+			sizeGB = float64(d.SizeBytes) / 1e9
+		}
+		disks = append(disks, fmt.Sprintf("%s %sGB", strings.ToLower(d.Type), bucket(sizeGB, opts.DiskBucketGB)))
+		diskSerials = append(diskSerials, d.Serial)
+	}
+	fields = append(fields,
+		Field{"disks.count", strconv.Itoa(len(hw.Disks))},
+		Field{"disks.layout", sortedList(disks)},
+	)
+	if !opts.IgnoreSerials {
+		fields = append(fields, Field{"disks.serials", sortedList(diskSerials)})
+	}
+
+	var drivers, macs, gpus []string
+	for _, n := range hw.NICs {
+		drivers = append(drivers, n.Driver)
+		macs = append(macs, strings.ToLower(n.MACAddress))
+	}
+	for _, g := range hw.GPUs {
+		gpus = append(gpus, g.Model)
+	}
+	fields = append(fields,
+		Field{"nics.count", strconv.Itoa(len(hw.NICs))},
+		Field{"nics.drivers", sortedList(drivers)},
+	)
+	if !opts.IgnoreMACs {
+		fields = append(fields, Field{"nics.macs", sortedList(macs)})
+	}
+	fields = append(fields, Field{"gpus", sortedList(gpus)})
+
+	return fields
+}
+
+// buildFields describes where a machine is in provisioning: its status,
+// how its last build went, and whether that build is of its current
+// configuration
+func buildFields(machine *models.Machine, build *models.BuildRequest, config string) []Field {
+	buildStatus, current := "none", false
+	if build != nil {
+		buildStatus = build.Status
+		current = NormalizeConfig(build.Config, machine) == config
+	}
+	return []Field{
+		{"status", string(machine.Status)},
+		{"build.status", buildStatus},
+		{"build.current_config", strconv.FormatBool(current)},
+	}
+}
+
+// bucket rounds a size to the nearest multiple of size, or to two decimals
+// if size is 0
+func bucket(value, size float64) string {
+	if size <= 0 {
+		return strconv.FormatFloat(value, 'f', 2, 64)
+	}
+	return strconv.FormatFloat(math.Round(value/size)*size, 'f', -1, 64)
+}
+
+func sortedList(values []string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
+
+func machineRef(m *models.Machine) models.MachineRef {
+	return models.MachineRef{ID: m.ID, ServiceTag: m.ServiceTag, Hostname: m.Hostname}
+}
+
+func withNewline(s string) string {
+	if s == "" {
+		return ""
+	}
+	return s + "\n"
+}
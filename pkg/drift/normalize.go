@@ -0,0 +1,123 @@
+package drift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// NormalizeConfig reduces a machine's NixOS configuration to what matters
+// when comparing it with other machines' configurations. Comments, blank
+// lines, and indentation are dropped, and the machine's own hostname,
+// service tag, and MAC address are replaced by the placeholders templates
+// use, so that configurations rendered from one template compare equal.
+func NormalizeConfig(config string, machine *models.Machine) string {
+	config = stripComments(config)
+
+	placeholders := []struct{ value, placeholder string }{
+		{machine.Hostname, "{{hostname}}"},
+		{machine.ServiceTag, "{{service_tag}}"},
+		{machine.MACAddress, "{{mac_address}}"},
+	}
+	for _, p := range placeholders {
+		if p.value == "" {
+			continue
+		}
+		re := regexp.MustCompile(`(?i)(^|[^A-Za-z0-9_-])` + regexp.QuoteMeta(p.value) + `($|[^A-Za-z0-9_-])`)
+		config = re.ReplaceAllString(config, "${1}"+p.placeholder+"${2}")
+	}
+
+	var lines []string
+	for _, line := range strings.Split(config, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Fingerprint identifies a normalized configuration. It is empty for an
+// empty configuration.
+func Fingerprint(normalized string) string {
+	if normalized == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// stripComments removes Nix comments, leaving strings alone: flake
+// references and URLs in strings often contain '#'
+func stripComments(config string) string {
+	var out strings.Builder
+	inString, inIndented := false, false
+
+	for i := 0; i < len(config); i++ {
+		c := config[i]
+		switch {
+		case inString:
+			out.WriteByte(c)
+			if c == '\\' && i+1 < len(config) {
+				i++
+				out.WriteByte(config[i])
+			} else if c == '"' {
+				inString = false
+			}
+
+		case inIndented:
+			if strings.HasPrefix(config[i:], "''") {
+				// ''' , ''$ and ''\ are escapes, not the end of the string
+				if i+2 < len(config) && strings.ContainsRune(`'$\`, rune(config[i+2])) {
+					out.WriteString(config[i : i+3])
+					i += 2
+					continue
+				}
+				out.WriteString("''")
+				i++
+				inIndented = false
+				continue
+			}
+			out.WriteByte(c)
+
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+
+		case strings.HasPrefix(config[i:], "''"):
+			inIndented = true
+			out.WriteString("''")
+			i++
+
+		case c == '#':
+			for i < len(config) && config[i] != '\n' {
+				i++
+			}
+			if i < len(config) {
+				out.WriteByte('\n')
+			}
+
+		case strings.HasPrefix(config[i:], "/*"):
+			end := strings.Index(config[i+2:], "*/")
+			if end < 0 {
+				i = len(config)
+			} else {
+				// Keep the text on either side of a multi-line comment on
+				// separate lines
+				if strings.Contains(config[i:i+2+end], "\n") {
+					out.WriteByte('\n')
+				} else {
+					out.WriteByte(' ')
+				}
+				i += end + 3
+			}
+
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.String()
+}
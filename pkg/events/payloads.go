@@ -0,0 +1,538 @@
+package events
+
+import (
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Event data. Every event type has exactly one of these structs as its
+// data, listed in payloads; webhooks, notification channels, and the event
+// log receive it as JSON. Fields may be added to a schema version, but not
+// renamed, retyped, or removed; that takes a new version.
+
+// EnrolledData is the data of machine.enrolled
+type EnrolledData struct {
+	ServiceTag   string               `json:"service_tag"`
+	MACAddress   string               `json:"mac_address"`
+	Status       models.MachineStatus `json:"status"`
+	Manufacturer string               `json:"manufacturer"`
+	Model        string               `json:"model"`
+	CurrentIP    string               `json:"current_ip"`
+	Virtual      bool                 `json:"virtual,omitempty"` // Created through the API, with no hardware
+
+	// MatchedRules are the enrollment rules that placed the machine, in
+	// the order they applied
+	MatchedRules []string `json:"matched_rules,omitempty"`
+}
+
+// ReenrollmentData is the data of machine.reenrollment_requested and
+// machine.reenrollment_approved. MACAddress is the address the machine
+// asked to re-enroll with.
+type ReenrollmentData struct {
+	ServiceTag string `json:"service_tag"`
+	MACAddress string `json:"mac_address,omitempty"`
+}
+
+// EnrollmentConflictData is the data of machine.enrollment_conflict. Field
+// names what the held machine shares with the existing machine, and Value
+// is the shared MAC address or serial number.
+type EnrollmentConflictData struct {
+	ServiceTag         string `json:"service_tag"`
+	MACAddress         string `json:"mac_address"`
+	SerialNumber       string `json:"serial_number"`
+	Field              string `json:"field"`
+	Value              string `json:"value"`
+	ExistingMachineID  string `json:"existing_machine_id"`
+	ExistingServiceTag string `json:"existing_service_tag"`
+}
+
+// ConflictResolvedData is the data of machine.conflict_resolved. Which of
+// the machine fields are set depends on Action.
+type ConflictResolvedData struct {
+	Action               string `json:"action"` // merge, supersede, reject
+	Field                string `json:"field,omitempty"`
+	Value                string `json:"value,omitempty"`
+	ServiceTag           string `json:"service_tag,omitempty"`
+	MergedMachineID      string `json:"merged_machine_id,omitempty"`
+	PreviousServiceTag   string `json:"previous_service_tag,omitempty"`
+	SupersededMachineID  string `json:"superseded_machine_id,omitempty"`
+	SupersededServiceTag string `json:"superseded_service_tag,omitempty"`
+	RejectedMachineID    string `json:"rejected_machine_id,omitempty"`
+	RejectedServiceTag   string `json:"rejected_service_tag,omitempty"`
+}
+
+// AdoptedData is the data of machine.adopted
+type AdoptedData struct {
+	ServiceTag string               `json:"service_tag"`
+	MACAddress string               `json:"mac_address"`
+	Hostname   string               `json:"hostname"`
+	Status     models.MachineStatus `json:"status"`
+	SSHAddress string               `json:"ssh_address"`
+	HasConfig  bool                 `json:"has_config"`
+}
+
+// ConvertedData is the data of machine.converted
+type ConvertedData struct {
+	OldStatus  models.MachineStatus `json:"old_status"`
+	DeployMode string               `json:"deploy_mode"`
+}
+
+// StatusChangedData is the data of machine.status_changed
+type StatusChangedData struct {
+	OldStatus models.MachineStatus `json:"old_status"`
+	NewStatus models.MachineStatus `json:"new_status"`
+}
+
+// TemplateAppliedData is the data of machine.template_applied
+type TemplateAppliedData struct {
+	TemplateID   string `json:"template_id"`
+	TemplateName string `json:"template_name"`
+}
+
+// DecommissionedData is the data of machine.decommissioned
+type DecommissionedData struct {
+	ServiceTag      string               `json:"service_tag"`
+	OldStatus       models.MachineStatus `json:"old_status"`
+	Reason          string               `json:"reason"`
+	PowerOff        bool                 `json:"power_off"`
+	CancelledBuilds int64                `json:"cancelled_builds"`
+}
+
+// DeletedData is the data of machine.deleted. Permanent is false when the
+// machine was moved to the trash.
+type DeletedData struct {
+	Permanent       bool   `json:"permanent"`
+	ServiceTag      string `json:"service_tag,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	CancelledBuilds int64  `json:"cancelled_builds,omitempty"`
+}
+
+// RestoredData is the data of machine.restored. Reason is set when the
+// machine wasn't restored by an operator.
+type RestoredData struct {
+	ServiceTag string     `json:"service_tag"`
+	DeletedAt  *time.Time `json:"deleted_at"`
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// IPChangedData is the data of machine.ip_changed. PreviousIP is empty
+// when the change came from a DHCP lease.
+type IPChangedData struct {
+	CurrentIP  string `json:"current_ip"`
+	PreviousIP string `json:"previous_ip,omitempty"`
+	MACAddress string `json:"mac_address"`
+}
+
+// BootRequestedData is the data of machine.boot_requested
+type BootRequestedData struct {
+	Decision         string               `json:"decision"`
+	Reason           string               `json:"reason"`
+	ClientIP         string               `json:"client_ip"`
+	Flavor           string               `json:"flavor"`
+	ArtifactsVersion string               `json:"artifacts_version"`
+	MachineStatus    models.MachineStatus `json:"machine_status"`
+}
+
+// BootWithStaleConfigData is the data of machine.boot_with_stale_config:
+// the build whose image a machine booted, and when its configuration
+// changed since
+type BootWithStaleConfigData struct {
+	ArtifactsVersion string     `json:"artifacts_version"`
+	ConfigUpdatedAt  *time.Time `json:"config_updated_at,omitempty"`
+	ClientIP         string     `json:"client_ip"`
+}
+
+// IdentityMismatchData is the data of machine.identity_mismatch: the
+// identity on record and the one a metrics submission reported, and the
+// address it came from. Reported fields the host left out are empty.
+type IdentityMismatchData struct {
+	ServiceTag         string `json:"service_tag"`
+	MACAddress         string `json:"mac_address"`
+	ReportedServiceTag string `json:"reported_service_tag"`
+	ReportedMAC        string `json:"reported_mac"`
+	SourceIP           string `json:"source_ip"`
+}
+
+// BootOverrideSetData is the data of machine.boot_override_set. Script
+// reports whether the override has a custom script, not the script.
+type BootOverrideSetData struct {
+	KernelAssetID string     `json:"kernel_asset_id"`
+	ISOAssetID    string     `json:"iso_asset_id"`
+	Script        bool       `json:"script"`
+	MaxBoots      int        `json:"max_boots"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	CreatedBy     string     `json:"created_by"`
+}
+
+// BootOverrideClearedData is the data of machine.boot_override_cleared
+type BootOverrideClearedData struct {
+	Reason string `json:"reason"` // cleared, expired, boots_used, diagnostics_ended
+}
+
+// MaintenanceOverrideData is the data of machine.maintenance_override
+type MaintenanceOverrideData struct {
+	Operation string `json:"operation"`
+}
+
+// ClaimedData is the data of machine.claimed
+type ClaimedData struct {
+	ServiceTag string `json:"service_tag"`
+	Owner      string `json:"owner"`
+	GroupID    string `json:"group_id,omitempty"`
+}
+
+// UnclaimedData is the data of machine.unclaimed
+type UnclaimedData struct {
+	ServiceTag  string `json:"service_tag"`
+	OwnerUserID string `json:"owner_user_id"`
+}
+
+// BuildAwaitingApprovalData is the data of machine.build_awaiting_approval
+type BuildAwaitingApprovalData struct {
+	BuildID     string `json:"build_id"`
+	Priority    string `json:"priority"`
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// BuildReviewedData is the data of machine.build_approved and of
+// machine.build_rejected, with the reason it was rejected
+type BuildReviewedData struct {
+	BuildID     string `json:"build_id"`
+	RequestedBy string `json:"requested_by,omitempty"`
+	ReviewedBy  string `json:"reviewed_by,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// BuildStartedData is the data of machine.build_started
+type BuildStartedData struct {
+	BuildID  string `json:"build_id"`
+	Priority string `json:"priority"`
+	Target   string `json:"target"`
+}
+
+// ScheduledBuildStartedData is the data of machine.scheduled_build_started
+type ScheduledBuildStartedData struct {
+	ScheduleID   string    `json:"schedule_id"`
+	BuildID      string    `json:"build_id"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+	Mode         string    `json:"mode"` // rebuild, rebuild_reboot
+}
+
+// BuildPriorityChangedData is the data of machine.build_priority_changed
+type BuildPriorityChangedData struct {
+	BuildID     string `json:"build_id"`
+	Priority    string `json:"priority"`
+	OldPriority string `json:"old_priority"`
+}
+
+// BuildUnschedulableData is the data of machine.build_unschedulable
+type BuildUnschedulableData struct {
+	BuildID        string   `json:"build_id"`
+	Architecture   string   `json:"architecture"`
+	RequiredLabels []string `json:"required_labels"`
+}
+
+// BuildSucceededData is the data of machine.build_succeeded. ClosureDiff
+// counts the packages that changed since the machine's previous successful
+// build, when the builder could compare their closures.
+type BuildSucceededData struct {
+	BuildID     string                     `json:"build_id"`
+	Target      string                     `json:"target"`
+	ArtifactURL string                     `json:"artifact_url"`
+	ClosureDiff *models.ClosureDiffSummary `json:"closure_diff,omitempty"`
+}
+
+// BuildFailedData is the data of machine.build_failed
+type BuildFailedData struct {
+	BuildID string `json:"build_id"`
+	Error   string `json:"error"`
+}
+
+// ImageTestFailedData is the data of machine.image_test_failed
+type ImageTestFailedData struct {
+	BuildID string `json:"build_id"`
+	TestID  string `json:"test_id"`
+	Error   string `json:"error"`
+}
+
+// DeployRequestedData is the data of machine.deploy_requested
+type DeployRequestedData struct {
+	DeploymentID string `json:"deployment_id"`
+	BuildID      string `json:"build_id"`
+	RolloutID    string `json:"rollout_id,omitempty"`
+}
+
+// DeployFinishedData is the data of machine.deployed, with SystemPath, and
+// of machine.deploy_failed, with Error
+type DeployFinishedData struct {
+	DeploymentID string `json:"deployment_id"`
+	BuildID      string `json:"build_id"`
+	Status       string `json:"status"`
+	RolloutID    string `json:"rollout_id,omitempty"`
+	SystemPath   string `json:"system_path,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// WipeRequestedData is the data of machine.wipe_requested. Disks is how
+// many disks will be wiped.
+type WipeRequestedData struct {
+	JobID string `json:"job_id"`
+	Disks int    `json:"disks"`
+}
+
+// WipeFinishedData is the data of machine.wipe_completed, with the wiped
+// disks, and of machine.wipe_failed, with Error
+type WipeFinishedData struct {
+	JobID string      `json:"job_id"`
+	Disks []WipedDisk `json:"disks,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// WipedDisk is a disk in WipeFinishedData
+type WipedDisk struct {
+	Serial      string     `json:"serial"`
+	Model       string     `json:"model"`
+	Device      string     `json:"device"`
+	Method      string     `json:"method"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// DiagnosticsStartedData is the data of machine.diagnostics_started
+type DiagnosticsStartedData struct {
+	RunID       string    `json:"run_id"`
+	Profile     string    `json:"profile"`
+	EndsAt      time.Time `json:"ends_at"`
+	PowerCycle  bool      `json:"power_cycle"`
+	RequestedBy string    `json:"requested_by"`
+}
+
+// DiagnosticsFinishedData is the data of machine.diagnostics_finished.
+// Results are what the diagnostics image reported, if it did.
+type DiagnosticsFinishedData struct {
+	RunID   string                    `json:"run_id"`
+	Profile string                    `json:"profile"`
+	Status  string                    `json:"status"` // completed, expired, cancelled
+	Results *models.DiagnosticResults `json:"results,omitempty"`
+}
+
+// ProvisioningFailedData is the data of machine.provisioning_failed: a
+// required hook ran out of attempts, holding up the provisioning cycle
+// until it is re-run
+type ProvisioningFailedData struct {
+	CycleID  string `json:"cycle_id"`
+	BuildID  string `json:"build_id"`
+	RunID    string `json:"run_id"`
+	Hook     string `json:"hook"`
+	HookType string `json:"hook_type"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// PowerOperationData is the data of machine.power_operation
+type PowerOperationData struct {
+	OperationID string `json:"operation_id"`
+	Operation   string `json:"operation"`
+	Method      string `json:"method"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// PowerChangedData is the data of machine.power_changed
+type PowerChangedData struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// InventoryRefreshedData is the data of machine.inventory_refreshed
+type InventoryRefreshedData struct {
+	OperationID  string `json:"operation_id"`
+	Source       string `json:"source"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+}
+
+// HardwareRefreshRequestedData is the data of
+// machine.hardware_refresh_requested. Missing lists the hardware fields
+// the machine's inventory lacked.
+type HardwareRefreshRequestedData struct {
+	Missing []string `json:"missing,omitempty"`
+}
+
+// HardwareNoncompliantData is the data of machine.hardware_noncompliant
+type HardwareNoncompliantData struct {
+	ProfileID   string                     `json:"profile_id"`
+	ProfileName string                     `json:"profile_name"`
+	Deviations  []models.HardwareDeviation `json:"deviations"`
+}
+
+// BMCDiscoveredData is the data of machine.bmc_discovered
+type BMCDiscoveredData struct {
+	IPAddress  string `json:"ip_address"`
+	MACAddress string `json:"mac_address"`
+	Channel    int    `json:"channel"`
+}
+
+// BMCPasswordRotatedData is the data of machine.bmc_password_rotated. The
+// password itself is never part of an event.
+type BMCPasswordRotatedData struct {
+	OperationID string `json:"operation_id"`
+	Username    string `json:"username"`
+	Source      string `json:"source"`
+}
+
+// BMCPasswordRotationFailedData is the data of
+// machine.bmc_password_rotation_failed
+type BMCPasswordRotationFailedData struct {
+	OperationID string `json:"operation_id"`
+	Error       string `json:"error"`
+	RolledBack  bool   `json:"rolled_back"`
+}
+
+// RolloutData is the data of rollout events. Machines counts the rollout's
+// machines in each state. Reason is set on rollout.paused, and AbortedBy on
+// rollout.aborted.
+type RolloutData struct {
+	RolloutID    string         `json:"rollout_id"`
+	GroupID      string         `json:"group_id"`
+	Status       string         `json:"status"`
+	CurrentBatch int            `json:"current_batch"`
+	Failures     int            `json:"failures"`
+	Machines     map[string]int `json:"machines"`
+	Reason       string         `json:"reason,omitempty"`
+	AbortedBy    string         `json:"aborted_by,omitempty"`
+}
+
+// RegistrationImageUpdatedData is the data of
+// system.registration_image_updated. PreviousVersion is the version that was
+// served before, if any, and Rollback is set when the update went back to
+// it.
+type RegistrationImageUpdatedData struct {
+	Version         int    `json:"version"`
+	PreviousVersion int    `json:"previous_version,omitempty"`
+	BuildID         string `json:"build_id"`
+	Rollback        bool   `json:"rollback"`
+	PromotedBy      string `json:"promoted_by,omitempty"`
+}
+
+// BuilderLowDiskData is the data of builder.low_disk, published when one of
+// a builder's filesystems drops below its free space threshold. Disks are
+// all of the builder's filesystems, low or not.
+type BuilderLowDiskData struct {
+	Builder       string               `json:"builder"`
+	Disks         []models.BuilderDisk `json:"disks"`
+	NixStoreBytes int64                `json:"nix_store_bytes,omitempty"`
+}
+
+// BuilderGCCompletedData is the data of builder.gc_completed. RequestedBy
+// is the admin who asked for the garbage collection, and is empty for one
+// the builder started because its nix store was low on space. Error is set
+// if nix-collect-garbage failed.
+type BuilderGCCompletedData struct {
+	Builder       string `json:"builder"`
+	RequestedBy   string `json:"requested_by,omitempty"`
+	MaxFreedBytes int64  `json:"max_freed_bytes,omitempty"`
+	FreedBytes    int64  `json:"freed_bytes"`
+	DurationMS    int64  `json:"duration_ms"`
+	Error         string `json:"error,omitempty"`
+}
+
+// StorageUsageHighData is the data of storage.usage_high, published when
+// the filesystem of the images directory fills past the alert percentage.
+// Machines are the machines' directories taking up the most space.
+type StorageUsageHighData struct {
+	UsedPercent         float64                `json:"used_percent"`
+	AlertPercent        int                    `json:"alert_percent"`
+	FilesystemBytes     int64                  `json:"filesystem_bytes"`
+	FilesystemFreeBytes int64                  `json:"filesystem_free_bytes"`
+	ArtifactBytes       int64                  `json:"artifact_bytes"`
+	Machines            []models.ArtifactUsage `json:"machines"`
+}
+
+// WebhookAutoDisabledData is the data of webhook.auto_disabled, published
+// when a webhook is deactivated because its deliveries kept failing.
+// StatusCode and Error are those of the delivery that deactivated it.
+type WebhookAutoDisabledData struct {
+	WebhookID           string    `json:"webhook_id"`
+	Name                string    `json:"name"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	FailingSince        time.Time `json:"failing_since"`
+	StatusCode          int       `json:"status_code,omitempty"`
+	Error               string    `json:"error,omitempty"`
+	Reason              string    `json:"reason"`
+}
+
+// QuotaData is the data of user.quota_warning and user.quota_exhausted,
+// published when a user's use of a quota crosses 80% and 100% of its
+// limit. ResetsAt is when the oldest use counted leaves the window.
+type QuotaData struct {
+	UserID   string     `json:"user_id"`
+	Username string     `json:"username"`
+	Kind     string     `json:"kind"`
+	Limit    int        `json:"limit"`
+	Used     int        `json:"used"`
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+// payloads maps each event type to its data struct
+var payloads = map[string]interface{}{
+	MachineEnrolled:                  EnrolledData{},
+	MachineReenrollmentRequested:     ReenrollmentData{},
+	MachineReenrollmentApproved:      ReenrollmentData{},
+	MachineEnrollmentConflict:        EnrollmentConflictData{},
+	MachineConflictResolved:          ConflictResolvedData{},
+	MachineAdopted:                   AdoptedData{},
+	MachineConverted:                 ConvertedData{},
+	MachineStatusChanged:             StatusChangedData{},
+	MachineTemplateApplied:           TemplateAppliedData{},
+	MachineDecommissioned:            DecommissionedData{},
+	MachineDeleted:                   DeletedData{},
+	MachineRestored:                  RestoredData{},
+	MachineIPChanged:                 IPChangedData{},
+	MachineBootRequested:             BootRequestedData{},
+	MachineBootWithStaleConfig:       BootWithStaleConfigData{},
+	MachineBootOverrideSet:           BootOverrideSetData{},
+	MachineBootOverrideCleared:       BootOverrideClearedData{},
+	MachineMaintenanceOverride:       MaintenanceOverrideData{},
+	MachineClaimed:                   ClaimedData{},
+	MachineUnclaimed:                 UnclaimedData{},
+	MachineIdentityMismatch:          IdentityMismatchData{},
+	MachineBuildAwaitingApproval:     BuildAwaitingApprovalData{},
+	MachineBuildApproved:             BuildReviewedData{},
+	MachineBuildRejected:             BuildReviewedData{},
+	MachineBuildStarted:              BuildStartedData{},
+	MachineScheduledBuildStarted:     ScheduledBuildStartedData{},
+	MachineBuildPriorityChanged:      BuildPriorityChangedData{},
+	MachineBuildUnschedulable:        BuildUnschedulableData{},
+	MachineBuildSucceeded:            BuildSucceededData{},
+	MachineBuildFailed:               BuildFailedData{},
+	MachineImageTestFailed:           ImageTestFailedData{},
+	MachineDeployRequested:           DeployRequestedData{},
+	MachineDeployed:                  DeployFinishedData{},
+	MachineDeployFailed:              DeployFinishedData{},
+	MachineWipeRequested:             WipeRequestedData{},
+	MachineWipeCompleted:             WipeFinishedData{},
+	MachineWipeFailed:                WipeFinishedData{},
+	MachineDiagnosticsStarted:        DiagnosticsStartedData{},
+	MachineDiagnosticsFinished:       DiagnosticsFinishedData{},
+	MachineProvisioningFailed:        ProvisioningFailedData{},
+	MachinePowerOperation:            PowerOperationData{},
+	MachinePowerChanged:              PowerChangedData{},
+	MachineInventoryRefreshed:        InventoryRefreshedData{},
+	MachineHardwareRefreshRequested:  HardwareRefreshRequestedData{},
+	MachineBMCDiscovered:             BMCDiscoveredData{},
+	MachineBMCPasswordRotated:        BMCPasswordRotatedData{},
+	MachineBMCPasswordRotationFailed: BMCPasswordRotationFailedData{},
+	MachineHardwareNoncompliant:      HardwareNoncompliantData{},
+	RolloutStarted:                   RolloutData{},
+	RolloutPaused:                    RolloutData{},
+	RolloutCompleted:                 RolloutData{},
+	RolloutAborted:                   RolloutData{},
+	SystemRegistrationImageUpdated:   RegistrationImageUpdatedData{},
+	BuilderLowDisk:                   BuilderLowDiskData{},
+	BuilderGCCompleted:               BuilderGCCompletedData{},
+	StorageUsageHigh:                 StorageUsageHighData{},
+	WebhookAutoDisabled:              WebhookAutoDisabledData{},
+	UserQuotaWarning:                 QuotaData{},
+	UserQuotaExhausted:               QuotaData{},
+}
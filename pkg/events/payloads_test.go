@@ -0,0 +1,125 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update rewrites golden files with what the code produces now, for
+// changes to payloads that are meant
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// sampleTime is the time every timestamp in sample data is set to
+var sampleTime = time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+
+// sampleData returns data of type t with every field set, strings to their
+// JSON names, so that a golden file shows each field as it is sent
+func sampleData(t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+	fillSample(v, "value")
+	return v
+}
+
+func fillSample(v reflect.Value, name string) {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Time{}):
+		v.Set(reflect.ValueOf(sampleTime))
+		return
+	case v.Type() == reflect.TypeOf(json.RawMessage{}):
+		v.SetBytes([]byte(`{"` + name + `":true}`))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(name)
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(3)
+	case reflect.Float64:
+		v.SetFloat(91.5)
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillSample(v.Elem(), name)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillSample(v.Index(0), name)
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fillSample(elem, name)
+		v.SetMapIndex(reflect.ValueOf(name+"_key").Convert(v.Type().Key()), elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fieldName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if fieldName == "-" {
+				continue
+			}
+			if fieldName == "" {
+				fieldName = field.Name
+			}
+			fillSample(v.Field(i), fieldName)
+		}
+	}
+}
+
+// TestPayloadsMatchGoldenFiles marshals sample data of every event type and
+// compares it with testdata/<event type>.golden, so that a change to what
+// subscribers receive fails here unless the golden file is updated with
+// -update. Keys are sorted, as subscribers get them from Event.Fields.
+func TestPayloadsMatchGoldenFiles(t *testing.T) {
+	for eventType, payload := range payloads {
+		data, err := json.Marshal(sampleData(reflect.TypeOf(payload)).Interface())
+		if err != nil {
+			t.Fatalf("%s: %v", eventType, err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("%s: %v", eventType, err)
+		}
+		got, err := json.MarshalIndent(fields, "", "  ")
+		if err != nil {
+			t.Fatalf("%s: %v", eventType, err)
+		}
+		got = append(got, '\n')
+
+		golden := filepath.Join("testdata", eventType+".golden")
+		if *update {
+			if err := os.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: %v; run go test -update to create it", eventType, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s payload changed; if that's meant, run go test -update\ngot:\n%s\nwant:\n%s", eventType, got, want)
+		}
+	}
+
+	// Every golden file is of an event type that still exists
+	files, err := filepath.Glob(filepath.Join("testdata", "*.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if _, ok := payloads[strings.TrimSuffix(filepath.Base(file), ".golden")]; !ok {
+			t.Errorf("%s is of no event type", file)
+		}
+	}
+}
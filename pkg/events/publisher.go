@@ -0,0 +1,217 @@
+package events
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+// Event is something that happened to a machine, or to no machine in
+// particular for fleet-wide events such as rollouts
+type Event struct {
+	Type      string
+	MachineID string      // Empty for events about no single machine
+	Actor     string      // User who caused the event, empty for the system
+	Data      interface{} // The event type's data struct, such as StatusChangedData
+
+	// Impersonator is the admin who caused the event while impersonating
+	// Actor
+	Impersonator string
+
+	// Set by Publish. Sequence numbers the machine's recorded events; it
+	// is zero for events that aren't recorded.
+	ID        string
+	Sequence  int64
+	Timestamp time.Time
+	fields    map[string]interface{}
+}
+
+// Fields returns the event's data as it is sent as JSON, keyed by field
+// name, for subscribers that don't care which event type they received
+func (e Event) Fields() map[string]interface{} {
+	return e.fields
+}
+
+// DefaultDedupeWindow is how long after an event an identical one is
+// dropped, unless SetDedupeWindow says otherwise
+const DefaultDedupeWindow = 2 * time.Second
+
+// Subscriber receives published events. Events of one machine are delivered
+// one at a time, in the order they were published.
+type Subscriber func(event Event)
+
+// Publisher is the single place events are emitted from. It records each
+// event in the machine's event log and then hands it to every subscriber,
+// so the audit log and what webhooks and notification channels receive
+// never diverge.
+type Publisher struct {
+	db           *database.DB
+	subscribers  []Subscriber
+	dedupeWindow time.Duration
+
+	mu     sync.Mutex
+	queues map[string][]Event // Undelivered events by machine ID; present while being drained
+
+	// publishing serializes recording and queueing the events of a
+	// machine, so that they are queued in sequence order. Machines share
+	// locks by hash of their ID.
+	publishing [64]sync.Mutex
+}
+
+// NewPublisher creates a publisher that records events in db
+func NewPublisher(db *database.DB) *Publisher {
+	return &Publisher{
+		db:           db,
+		queues:       make(map[string][]Event),
+		dedupeWindow: DefaultDedupeWindow,
+	}
+}
+
+// SetDedupeWindow sets how long after a machine's event an event of the
+// same type with the same data is dropped instead of recorded and
+// delivered, such as the second of two status changes reported for one
+// transition by requests that raced. Zero turns this off. It must be set
+// before anything is published.
+func (p *Publisher) SetDedupeWindow(window time.Duration) {
+	p.dedupeWindow = window
+}
+
+// Subscribe registers a subscriber. Subscribers must be registered before
+// anything is published.
+func (p *Publisher) Subscribe(subscriber Subscriber) {
+	p.subscribers = append(p.subscribers, subscriber)
+}
+
+// Publish records an event and queues it for subscribers. The event's data
+// must be its type's data struct. An event without
+// an actor is attributed to the user authenticated in ctx, if any, and to
+// the admin impersonating them as well. Events
+// without a machine, and machine.deleted for permanent deletes, whose log
+// goes with the machine, only go to subscribers. The event is not delivered
+// if it cannot be recorded, or if it duplicates one recorded within the
+// dedupe window.
+func (p *Publisher) Publish(ctx context.Context, event Event) error {
+	if !IsKnown(event.Type) {
+		return fmt.Errorf("unknown event type %q", event.Type)
+	}
+	if reflect.TypeOf(event.Data) != reflect.TypeOf(payloads[event.Type]) {
+		return fmt.Errorf("%s event has %T data, not %T", event.Type, event.Data, payloads[event.Type])
+	}
+
+	dataJSON, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", event.Type, err)
+	}
+	if err := json.Unmarshal(dataJSON, &event.fields); err != nil {
+		return fmt.Errorf("failed to marshal %s event: %w", event.Type, err)
+	}
+
+	if claims, ok := ctx.Value(auth.ClaimsContextKey).(*auth.Claims); ok {
+		if event.Actor == "" {
+			event.Actor = claims.Username
+		}
+		if event.Impersonator == "" && event.Actor == claims.Username {
+			event.Impersonator = claims.Impersonator
+		}
+	}
+
+	// Held until the event is queued: another event of the machine could
+	// otherwise be numbered after this one but queued before it
+	lock := p.machineLock(event.MachineID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if event.MachineID != "" && !isPermanentDelete(event) {
+		hash := sha256.Sum256(dataJSON)
+		record := &models.MachineEvent{
+			MachineID: event.MachineID,
+			Event:     event.Type,
+			Data:      dataJSON,
+			DataHash:  hex.EncodeToString(hash[:]),
+		}
+		if event.Actor != "" {
+			record.CreatedBy = &event.Actor
+		}
+		if event.Impersonator != "" {
+			record.ImpersonatedBy = &event.Impersonator
+		}
+		recorded, err := p.db.RecordMachineEvent(record, p.dedupeWindow)
+		if err != nil {
+			return fmt.Errorf("failed to record %s event: %w", event.Type, err)
+		}
+		if !recorded {
+			log.Printf("Dropped duplicate %s event for machine %s", event.Type, event.MachineID)
+			return nil
+		}
+
+		event.ID = record.ID
+		event.Sequence = record.Sequence
+		event.Timestamp = record.CreatedAt
+	} else {
+		event.ID = uuid.New().String()
+		event.Timestamp = time.Now()
+	}
+
+	p.enqueue(event)
+	return nil
+}
+
+// machineLock returns the lock serializing the publishing of a machine's
+// events
+func (p *Publisher) machineLock(machineID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(machineID))
+	return &p.publishing[h.Sum32()%uint32(len(p.publishing))]
+}
+
+// enqueue adds an event to its machine's queue, starting a goroutine to
+// drain the queue if none is running
+func (p *Publisher) enqueue(event Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queue, draining := p.queues[event.MachineID]
+	p.queues[event.MachineID] = append(queue, event)
+	if !draining {
+		go p.drain(event.MachineID)
+	}
+}
+
+// drain delivers a machine's queued events in order until the queue is empty
+func (p *Publisher) drain(machineID string) {
+	for {
+		p.mu.Lock()
+		queue := p.queues[machineID]
+		if len(queue) == 0 {
+			delete(p.queues, machineID)
+			p.mu.Unlock()
+			return
+		}
+		event := queue[0]
+		p.queues[machineID] = queue[1:]
+		p.mu.Unlock()
+
+		for _, subscriber := range p.subscribers {
+			subscriber(event)
+		}
+	}
+}
+
+// isPermanentDelete reports whether event is a machine.deleted event for a
+// machine that is gone, rather than moved to the trash
+func isPermanentDelete(event Event) bool {
+	data, ok := event.Data.(DeletedData)
+	return ok && data.Permanent
+}
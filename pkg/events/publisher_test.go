@@ -0,0 +1,398 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// newTestDB opens a migrated database for one test. It is a file rather
+// than shared-cache memory, whose table locks fail concurrent writers
+// rather than waiting.
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "events.db") + "?_busy_timeout=10000&_journal_mode=WAL"
+	db, err := database.New(database.Config{Driver: "sqlite3", DSN: dsn})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate database: %v", err)
+	}
+	return db
+}
+
+// newTestMachine enrolls a machine to publish events for
+func newTestMachine(t *testing.T, db *database.DB, serviceTag string) *models.Machine {
+	t.Helper()
+
+	machine, err := db.CreateMachine(models.EnrollmentRequest{ServiceTag: serviceTag, MACAddress: "52:54:00:00:00:01"})
+	if err != nil {
+		t.Fatalf("create machine: %v", err)
+	}
+	return machine
+}
+
+// collector is a subscriber that keeps what it receives
+type collector struct {
+	mu       sync.Mutex
+	events   []Event
+	received chan struct{}
+}
+
+func newCollector(p *Publisher) *collector {
+	c := &collector{received: make(chan struct{}, 1000)}
+	p.Subscribe(func(event Event) {
+		c.mu.Lock()
+		c.events = append(c.events, event)
+		c.mu.Unlock()
+		c.received <- struct{}{}
+	})
+	return c
+}
+
+// wait returns the events received once there are n of them
+func (c *collector) wait(t *testing.T, n int) []Event {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-c.received:
+		case <-timeout:
+			t.Fatalf("received %d events, want %d", i, n)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Event(nil), c.events...)
+}
+
+// statusChange is a machine.status_changed event, numbered by its data so
+// that no two are duplicates
+func statusChange(machineID string, n int) Event {
+	return Event{
+		Type:      MachineStatusChanged,
+		MachineID: machineID,
+		Data:      StatusChangedData{OldStatus: models.StatusEnrolled, NewStatus: models.MachineStatus(strconv.Itoa(n))},
+	}
+}
+
+func TestPublishDeliversEachMachinesEventsInSequenceOrder(t *testing.T) {
+	db := newTestDB(t)
+	p := NewPublisher(db)
+	p.SetDedupeWindow(0)
+	received := newCollector(p)
+
+	machines := []*models.Machine{newTestMachine(t, db, "ORDER1"), newTestMachine(t, db, "ORDER2")}
+	const perMachine = 25
+
+	// Concurrent requests publish for the same machines at once
+	var wg sync.WaitGroup
+	for _, machine := range machines {
+		for i := 0; i < perMachine; i++ {
+			wg.Add(1)
+			go func(machineID string, n int) {
+				defer wg.Done()
+				if err := p.Publish(context.Background(), statusChange(machineID, n)); err != nil {
+					t.Error(err)
+				}
+			}(machine.ID, i)
+		}
+	}
+	wg.Wait()
+
+	last := make(map[string]int64)
+	for _, event := range received.wait(t, len(machines)*perMachine) {
+		if event.Sequence <= last[event.MachineID] {
+			t.Errorf("machine %s: event %d delivered after %d", event.MachineID, event.Sequence, last[event.MachineID])
+		}
+		last[event.MachineID] = event.Sequence
+	}
+	for _, machine := range machines {
+		if last[machine.ID] != perMachine {
+			t.Errorf("machine %s: last sequence %d, want %d", machine.ID, last[machine.ID], perMachine)
+		}
+	}
+}
+
+func TestPublishDeliversRecordedEvents(t *testing.T) {
+	db := newTestDB(t)
+	p := NewPublisher(db)
+	received := newCollector(p)
+	machine := newTestMachine(t, db, "RECORD1")
+
+	if err := p.Publish(context.Background(), Event{
+		Type:      MachinePowerOperation,
+		MachineID: machine.ID,
+		Actor:     "operator",
+		Data:      PowerOperationData{Operation: "on", Method: "ipmi", Status: "completed"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	event := received.wait(t, 1)[0]
+	recorded, err := db.ListMachineEvents(machine.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 1 {
+		t.Fatalf("recorded %d events, want 1", len(recorded))
+	}
+	if record := recorded[0]; record.ID != event.ID || record.Sequence != event.Sequence || record.Event != MachinePowerOperation {
+		t.Errorf("delivered %+v, recorded %+v", event, record)
+	}
+	if event.Sequence != 1 || event.Actor != "operator" || event.Fields()["operation"] != "on" {
+		t.Errorf("delivered %+v", event)
+	}
+}
+
+func TestPublishDropsDuplicatesWithinWindow(t *testing.T) {
+	db := newTestDB(t)
+	p := NewPublisher(db)
+	p.SetDedupeWindow(time.Minute)
+	received := newCollector(p)
+	machine := newTestMachine(t, db, "DEDUPE1")
+	other := newTestMachine(t, db, "DEDUPE2")
+
+	// Two requests report the same transition
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(context.Background(), statusChange(machine.ID, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Other data, another type, and another machine aren't duplicates
+	for _, event := range []Event{
+		statusChange(machine.ID, 2),
+		{Type: MachinePowerChanged, MachineID: machine.ID, Data: PowerChangedData{From: "off", To: "on"}},
+		statusChange(other.ID, 1),
+	} {
+		if err := p.Publish(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	delivered := received.wait(t, 4)
+	select {
+	case <-received.received:
+		t.Errorf("the duplicate was delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var sequences []int64
+	for _, event := range delivered {
+		if event.MachineID == machine.ID {
+			sequences = append(sequences, event.Sequence)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	if fmt.Sprint(sequences) != "[1 2 3]" {
+		t.Errorf("sequences = %v, want [1 2 3] with no gap for the duplicate", sequences)
+	}
+
+	recorded, err := db.ListMachineEvents(machine.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 3 {
+		t.Errorf("recorded %d events, want 3", len(recorded))
+	}
+}
+
+func TestPublishWithoutDedupeWindowKeepsDuplicates(t *testing.T) {
+	db := newTestDB(t)
+	p := NewPublisher(db)
+	p.SetDedupeWindow(0)
+	received := newCollector(p)
+	machine := newTestMachine(t, db, "DEDUPE3")
+
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(context.Background(), statusChange(machine.ID, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivered := received.wait(t, 2); delivered[0].ID == delivered[1].ID {
+		t.Errorf("both deliveries are event %s", delivered[0].ID)
+	}
+}
+
+func TestPublishEventsWithoutMachine(t *testing.T) {
+	db := newTestDB(t)
+	p := NewPublisher(db)
+	received := newCollector(p)
+
+	event := Event{Type: RolloutStarted, Data: RolloutData{}}
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not recorded, so neither numbered nor deduplicated
+	for _, got := range received.wait(t, 2) {
+		if got.ID == "" || got.Sequence != 0 || got.Timestamp.IsZero() {
+			t.Errorf("delivered %+v", got)
+		}
+	}
+	recorded, err := db.ListAllEvents(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 0 {
+		t.Errorf("recorded %d events, want none", len(recorded))
+	}
+}
+
+func TestPublishRejectsUnknownAndMistypedEvents(t *testing.T) {
+	db := newTestDB(t)
+	p := NewPublisher(db)
+	received := newCollector(p)
+	machine := newTestMachine(t, db, "REJECT1")
+
+	for _, event := range []Event{
+		{Type: "machine.exploded", MachineID: machine.ID, Data: StatusChangedData{}},
+		{Type: MachineStatusChanged, MachineID: machine.ID, Data: PowerChangedData{}},
+		{Type: MachineStatusChanged, MachineID: machine.ID, Data: &StatusChangedData{}},
+		{Type: MachineStatusChanged, MachineID: machine.ID, Data: map[string]string{"new_status": "ready"}},
+	} {
+		if err := p.Publish(context.Background(), event); err == nil {
+			t.Errorf("published %s with %T data", event.Type, event.Data)
+		}
+	}
+
+	select {
+	case <-received.received:
+		t.Errorf("a rejected event was delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// eventConstants returns the event type constants declared in types.go by
+// name
+func eventConstants(t *testing.T) map[string]string {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "types.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	constants := make(map[string]string)
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			value := spec.(*ast.ValueSpec)
+			for i, name := range value.Names {
+				lit, ok := value.Values[i].(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+				constants[name.Name], _ = strconv.Unquote(lit.Value)
+			}
+		}
+	}
+	return constants
+}
+
+// TestEveryEmittedEventGoesThroughThePublisher reads the rest of the
+// codebase for the event types it uses. Every one must be known to the
+// publisher with a data struct, event types may only be named by their
+// constants, and nothing but the publisher may record machine events.
+func TestEveryEmittedEventGoesThroughThePublisher(t *testing.T) {
+	constants := eventConstants(t)
+	if len(constants) != len(Types) {
+		t.Errorf("types.go declares %d event types, Types lists %d", len(constants), len(Types))
+	}
+	for name, eventType := range constants {
+		if !IsKnown(eventType) {
+			t.Errorf("%s (%s) is not in Types", name, eventType)
+		}
+		if _, ok := payloads[eventType]; !ok {
+			t.Errorf("%s (%s) has no data struct", name, eventType)
+		}
+	}
+
+	emitted := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, root := range []string{"../../pkg", "../../cmd"} {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+				return nil
+			}
+			dir := filepath.ToSlash(filepath.Dir(path))
+			if strings.HasSuffix(dir, "pkg/events") {
+				return nil
+			}
+
+			file, err := parser.ParseFile(fset, path, nil, 0)
+			if err != nil {
+				return err
+			}
+			ast.Inspect(file, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.SelectorExpr:
+					if pkg, ok := n.X.(*ast.Ident); ok && pkg.Name == "events" {
+						if eventType, ok := constants[n.Sel.Name]; ok {
+							emitted[eventType] = true
+						}
+					}
+					if n.Sel.Name == "RecordMachineEvent" && !strings.HasSuffix(dir, "pkg/database") {
+						t.Errorf("%s records machine events around the publisher", fset.Position(n.Pos()))
+					}
+				case *ast.CompositeLit:
+					sel, ok := n.Type.(*ast.SelectorExpr)
+					if !ok || sel.Sel.Name != "Event" {
+						return true
+					}
+					if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "events" {
+						return true
+					}
+					for _, elt := range n.Elts {
+						kv, ok := elt.(*ast.KeyValueExpr)
+						if !ok {
+							continue
+						}
+						if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Type" {
+							if _, ok := kv.Value.(*ast.BasicLit); ok {
+								t.Errorf("%s names an event type with a literal, not a constant", fset.Position(kv.Pos()))
+							}
+						}
+					}
+				}
+				return true
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, eventType := range Types {
+		if !emitted[eventType] {
+			t.Errorf("%s is never emitted", eventType)
+		}
+	}
+}
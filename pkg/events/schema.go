@@ -0,0 +1,110 @@
+package events
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// SchemaVersion is the version of the webhook payload schema new webhooks
+// receive. Webhooks keep the version they were created with, so a change
+// that would break receivers bumps it instead of changing what existing
+// webhooks are sent.
+const SchemaVersion = "1"
+
+// SchemaVersions lists every payload schema version webhooks can pin
+var SchemaVersions = []string{"1"}
+
+// IsSupportedSchema reports whether version is one of SchemaVersions
+func IsSupportedSchema(version string) bool {
+	for _, v := range SchemaVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// MachineSnapshot is the machine an event is about as it was when the event
+// was delivered. Only the ID is set if the machine has since been deleted.
+// Ownership is the machine's effective ownership, so whoever receives the
+// event knows whom to escalate to.
+type MachineSnapshot struct {
+	ID         string               `json:"id"`
+	ServiceTag string               `json:"service_tag,omitempty"`
+	Hostname   string               `json:"hostname,omitempty"`
+	Status     models.MachineStatus `json:"status,omitempty"`
+	Ownership  *models.Ownership    `json:"ownership,omitempty"`
+}
+
+// NewMachineSnapshot returns the snapshot of the machine with the given ID.
+// machine is nil if it has been deleted.
+func NewMachineSnapshot(id string, machine *models.Machine) *MachineSnapshot {
+	if machine == nil {
+		return &MachineSnapshot{ID: id}
+	}
+	return &MachineSnapshot{
+		ID:         machine.ID,
+		ServiceTag: machine.ServiceTag,
+		Hostname:   machine.Hostname,
+		Status:     machine.Status,
+		Ownership:  machine.EffectiveOwnership,
+	}
+}
+
+// Schema describes the data of every event type, as published at
+// /api/v1/events/schema
+type Schema struct {
+	Current  string                       `json:"current"`
+	Versions []string                     `json:"versions"`
+	Events   map[string]map[string]string `json:"events"` // Field types by name, by event type
+}
+
+// DescribeSchema describes the current schema from the event data structs.
+// Field types are string, integer, boolean, timestamp, array, or object;
+// fields that are left out when empty are marked optional.
+func DescribeSchema() *Schema {
+	schema := &Schema{
+		Current:  SchemaVersion,
+		Versions: SchemaVersions,
+		Events:   make(map[string]map[string]string, len(payloads)),
+	}
+	for eventType, payload := range payloads {
+		fields := map[string]string{}
+		t := reflect.TypeOf(payload)
+		for i := 0; i < t.NumField(); i++ {
+			name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			kind := fieldKind(t.Field(i).Type)
+			if opts == "omitempty" {
+				kind += ", optional"
+			}
+			fields[name] = kind
+		}
+		schema.Events[eventType] = fields
+	}
+	return schema
+}
+
+// fieldKind names the JSON type a field is sent as
+func fieldKind(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return "timestamp"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	case reflect.Slice:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,151 @@
+package events
+
+// Event types. Every event published must be one of these, so this list is
+// the complete set of events webhooks and notification channels can
+// subscribe to.
+const (
+	MachineEnrolled              = "machine.enrolled"
+	MachineReenrollmentRequested = "machine.reenrollment_requested"
+	MachineReenrollmentApproved  = "machine.reenrollment_approved"
+	MachineEnrollmentConflict    = "machine.enrollment_conflict"
+	MachineConflictResolved      = "machine.conflict_resolved"
+	MachineAdopted               = "machine.adopted"
+	MachineConverted             = "machine.converted"
+	MachineStatusChanged         = "machine.status_changed"
+	MachineTemplateApplied       = "machine.template_applied"
+	MachineDecommissioned        = "machine.decommissioned"
+	MachineDeleted               = "machine.deleted"
+	MachineRestored              = "machine.restored"
+	MachineIPChanged             = "machine.ip_changed"
+	MachineBootRequested         = "machine.boot_requested"
+	MachineBootWithStaleConfig   = "machine.boot_with_stale_config"
+	MachineBootOverrideSet       = "machine.boot_override_set"
+	MachineBootOverrideCleared   = "machine.boot_override_cleared"
+	MachineMaintenanceOverride   = "machine.maintenance_override"
+	MachineClaimed               = "machine.claimed"
+	MachineUnclaimed             = "machine.unclaimed"
+	MachineIdentityMismatch      = "machine.identity_mismatch"
+
+	MachineBuildAwaitingApproval = "machine.build_awaiting_approval"
+	MachineBuildApproved         = "machine.build_approved"
+	MachineBuildRejected         = "machine.build_rejected"
+	MachineBuildStarted          = "machine.build_started"
+	MachineScheduledBuildStarted = "machine.scheduled_build_started"
+	MachineBuildPriorityChanged  = "machine.build_priority_changed"
+	MachineBuildUnschedulable    = "machine.build_unschedulable"
+	MachineBuildSucceeded        = "machine.build_succeeded"
+	MachineBuildFailed           = "machine.build_failed"
+	MachineImageTestFailed       = "machine.image_test_failed"
+
+	MachineDeployRequested = "machine.deploy_requested"
+	MachineDeployed        = "machine.deployed"
+	MachineDeployFailed    = "machine.deploy_failed"
+
+	MachineWipeRequested = "machine.wipe_requested"
+	MachineWipeCompleted = "machine.wipe_completed"
+	MachineWipeFailed    = "machine.wipe_failed"
+
+	MachineDiagnosticsStarted  = "machine.diagnostics_started"
+	MachineDiagnosticsFinished = "machine.diagnostics_finished"
+
+	MachineProvisioningFailed = "machine.provisioning_failed"
+
+	MachinePowerOperation            = "machine.power_operation"
+	MachinePowerChanged              = "machine.power_changed"
+	MachineInventoryRefreshed        = "machine.inventory_refreshed"
+	MachineHardwareRefreshRequested  = "machine.hardware_refresh_requested"
+	MachineBMCDiscovered             = "machine.bmc_discovered"
+	MachineBMCPasswordRotated        = "machine.bmc_password_rotated"
+	MachineBMCPasswordRotationFailed = "machine.bmc_password_rotation_failed"
+	MachineHardwareNoncompliant      = "machine.hardware_noncompliant"
+
+	RolloutStarted   = "rollout.started"
+	RolloutPaused    = "rollout.paused"
+	RolloutCompleted = "rollout.completed"
+	RolloutAborted   = "rollout.aborted"
+
+	SystemRegistrationImageUpdated = "system.registration_image_updated"
+
+	BuilderLowDisk     = "builder.low_disk"
+	BuilderGCCompleted = "builder.gc_completed"
+
+	StorageUsageHigh = "storage.usage_high"
+
+	WebhookAutoDisabled = "webhook.auto_disabled"
+
+	UserQuotaWarning   = "user.quota_warning"
+	UserQuotaExhausted = "user.quota_exhausted"
+)
+
+// Types lists every event type
+var Types = []string{
+	MachineEnrolled,
+	MachineReenrollmentRequested,
+	MachineReenrollmentApproved,
+	MachineEnrollmentConflict,
+	MachineConflictResolved,
+	MachineAdopted,
+	MachineConverted,
+	MachineStatusChanged,
+	MachineTemplateApplied,
+	MachineDecommissioned,
+	MachineDeleted,
+	MachineRestored,
+	MachineIPChanged,
+	MachineBootRequested,
+	MachineBootWithStaleConfig,
+	MachineBootOverrideSet,
+	MachineBootOverrideCleared,
+	MachineMaintenanceOverride,
+	MachineClaimed,
+	MachineUnclaimed,
+	MachineIdentityMismatch,
+	MachineBuildAwaitingApproval,
+	MachineBuildApproved,
+	MachineBuildRejected,
+	MachineBuildStarted,
+	MachineScheduledBuildStarted,
+	MachineBuildPriorityChanged,
+	MachineBuildUnschedulable,
+	MachineBuildSucceeded,
+	MachineBuildFailed,
+	MachineImageTestFailed,
+	MachineDeployRequested,
+	MachineDeployed,
+	MachineDeployFailed,
+	MachineWipeRequested,
+	MachineWipeCompleted,
+	MachineWipeFailed,
+	MachineDiagnosticsStarted,
+	MachineDiagnosticsFinished,
+	MachineProvisioningFailed,
+	MachinePowerOperation,
+	MachinePowerChanged,
+	MachineInventoryRefreshed,
+	MachineHardwareRefreshRequested,
+	MachineBMCDiscovered,
+	MachineBMCPasswordRotated,
+	MachineBMCPasswordRotationFailed,
+	MachineHardwareNoncompliant,
+	RolloutStarted,
+	RolloutPaused,
+	RolloutCompleted,
+	RolloutAborted,
+	SystemRegistrationImageUpdated,
+	BuilderLowDisk,
+	BuilderGCCompleted,
+	StorageUsageHigh,
+	WebhookAutoDisabled,
+	UserQuotaWarning,
+	UserQuotaExhausted,
+}
+
+// IsKnown reports whether eventType is one of Types
+func IsKnown(eventType string) bool {
+	for _, t := range Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
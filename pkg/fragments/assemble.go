@@ -0,0 +1,109 @@
+package fragments
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// MachineConfig returns the configuration a machine's next build uses: its
+// group defaults and own fragments assembled with its nixos_config as the
+// override block, or its nixos_config as is if it has no fragments. Config
+// is empty if the machine has neither.
+func MachineConfig(db *database.DB, machine *models.Machine) (*models.AssembledConfig, error) {
+	fragments, refs, err := db.MachineConfigFragments(machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	return Assemble(machine, fragments, refs, machine.NixOSConfig), nil
+}
+
+// Assemble builds a machine's configuration from fragments and an override
+// block. refs[i] describes fragments[i]. Fragments are ordered by weight,
+// keeping the given order between equal weights, and imported as modules by
+// a generated wrapper module, with the override block imported last.
+func Assemble(machine *models.Machine, fragments []*models.ConfigFragment, refs []models.FragmentRef, override string) *models.AssembledConfig {
+	if len(fragments) == 0 {
+		return &models.AssembledConfig{Config: override, Fragments: []models.FragmentRef{}}
+	}
+
+	order := make([]int, len(fragments))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return fragments[order[a]].Weight < fragments[order[b]].Weight
+	})
+
+	names := make([]string, len(order))
+	for i, idx := range order {
+		names[i] = fragments[idx].Name
+	}
+
+	var config strings.Builder
+	fmt.Fprintf(&config, "# Assembled by metal-enrollment for %s from the fragments\n", machine.ServiceTag)
+	fmt.Fprintf(&config, "# %s", strings.Join(names, ", "))
+	if strings.TrimSpace(override) != "" {
+		config.WriteString(" and the machine's override block")
+	}
+	config.WriteString(".\n# Change those rather than this file.\n")
+	config.WriteString("{ ... }:\n\n{\n  imports = [\n")
+
+	assembled := &models.AssembledConfig{Assembled: true, Fragments: make([]models.FragmentRef, 0, len(order))}
+	for _, idx := range order {
+		fragment := fragments[idx]
+		source := "machine"
+		if refs[idx].GroupName != "" {
+			source = "group " + refs[idx].GroupName
+		}
+
+		fmt.Fprintf(&config, "    # Fragment %s (weight %d, from %s)\n", fragment.Name, fragment.Weight, source)
+		writeModule(&config, substitute(fragment.NixOSConfig, fragment.Variables, machine))
+		assembled.Fragments = append(assembled.Fragments, refs[idx])
+	}
+
+	if strings.TrimSpace(override) != "" {
+		config.WriteString("    # Machine override block\n")
+		writeModule(&config, override)
+	}
+
+	config.WriteString("  ];\n}\n")
+	assembled.Config = config.String()
+	return assembled
+}
+
+// writeModule writes a module into the imports list. It is parenthesized
+// rather than indented, which would change the contents of its indented
+// strings.
+func writeModule(config *strings.Builder, module string) {
+	config.WriteString("    (\n")
+	config.WriteString(strings.TrimRight(module, " \t\n"))
+	config.WriteString("\n    )\n\n")
+}
+
+// substitute replaces {{name}} placeholders with variables, and the
+// hostname, service_tag, mac_address, and metadata.<key> placeholders with
+// the machine's own values. A hostname placeholder keeps its default while
+// the machine has no hostname.
+func substitute(config string, variables map[string]string, machine *models.Machine) string {
+	values := make(map[string]string, len(variables)+3)
+	for key, value := range variables {
+		values[key] = value
+	}
+	for name, value := range models.MetadataPlaceholders(machine.Metadata) {
+		values[name] = value
+	}
+	if machine.Hostname != "" {
+		values["hostname"] = machine.Hostname
+	}
+	values["service_tag"] = machine.ServiceTag
+	values["mac_address"] = machine.MACAddress
+
+	for key, value := range values {
+		config = strings.ReplaceAll(config, "{{"+key+"}}", value)
+	}
+	return config
+}
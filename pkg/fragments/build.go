@@ -0,0 +1,75 @@
+package fragments
+
+import (
+	"context"
+	"errors"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/builder"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// ErrNoConfiguration is returned by BuildConfig for a machine with neither
+// fragments nor a nixos_config
+var ErrNoConfiguration = errors.New("machine has no configuration")
+
+// InvalidError is an assembled configuration that doesn't parse
+type InvalidError struct {
+	Message string
+}
+
+func (e *InvalidError) Error() string {
+	return "assembled configuration does not parse: " + e.Message
+}
+
+// BuilderError is a validation the builder couldn't do
+type BuilderError struct {
+	Err error
+}
+
+func (e *BuilderError) Error() string {
+	return "failed to validate assembled configuration: " + e.Err.Error()
+}
+
+func (e *BuilderError) Unwrap() error {
+	return e.Err
+}
+
+// BuildConfig returns the configuration a build of machine should use. An
+// assembled configuration is first validated by the builder at client,
+// unless client is nil; a machine without fragments has its nixos_config
+// built as is, as it always has been.
+func BuildConfig(ctx context.Context, db *database.DB, client *builder.Client, machine *models.Machine) (string, error) {
+	assembled, err := MachineConfig(db, machine)
+	if err != nil {
+		return "", err
+	}
+	if assembled.Config == "" {
+		return "", ErrNoConfiguration
+	}
+
+	if assembled.Assembled && client != nil {
+		if err := Validate(ctx, client, assembled); err != nil {
+			return "", err
+		}
+		if !*assembled.Valid {
+			return "", &InvalidError{Message: assembled.Error}
+		}
+	}
+
+	return assembled.Config, nil
+}
+
+// Validate has the builder at client check that an assembled configuration
+// parses, recording the verdict in its Valid and Error. It returns a
+// BuilderError if the builder couldn't be asked.
+func Validate(ctx context.Context, client *builder.Client, assembled *models.AssembledConfig) error {
+	result, err := client.Validate(ctx, assembled.Config)
+	if err != nil {
+		return &BuilderError{Err: err}
+	}
+
+	assembled.Valid = &result.Valid
+	assembled.Error = result.Error
+	return nil
+}
@@ -0,0 +1,38 @@
+// Package fsusage measures disk space: of the filesystem a path is on, and
+// of the files under a directory
+package fsusage
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+)
+
+// DirBytes returns the size of the regular files under dir, following no
+// links. A directory that doesn't exist has none.
+func DirBytes(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files removed during the walk, such as a build's staging
+			// directory, are no longer taking up space
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fsusage
+
+import "errors"
+
+// Filesystem is only implemented on unix, where the servers and builders
+// run
+func Filesystem(path string) (total, free int64, err error) {
+	return 0, 0, errors.New("filesystem usage is not supported on this platform")
+}
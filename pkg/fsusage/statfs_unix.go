@@ -0,0 +1,15 @@
+//go:build unix
+
+package fsusage
+
+import "syscall"
+
+// Filesystem returns the size of the filesystem path is on, and the space
+// on it available to unprivileged users
+func Filesystem(path string) (total, free int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize), nil
+}
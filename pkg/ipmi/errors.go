@@ -0,0 +1,86 @@
+package ipmi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Classified ipmitool failures. Errors from PowerController wrap one of
+// these when the cause is recognizable.
+var (
+	ErrAuthentication = errors.New("BMC authentication failed (check the username, password, privilege level, and cipher suite)")
+	ErrUnreachable    = errors.New("BMC unreachable")
+	ErrUnsupported    = errors.New("command not supported by the BMC")
+)
+
+// Substrings of ipmitool's stderr, lowercased, for each class. Session
+// setup failures print "Unable to establish ..." after the real cause, so
+// authentication is matched before reachability.
+var (
+	authenticationErrors = []string{
+		"unauthorized name",
+		"invalid user name",
+		"hmac is invalid",
+		"password invalid",
+		"invalid session",
+		"activate session error",
+		"insufficient privilege",
+		"set session privilege level",
+		"requested privilege level exceeds",
+		"no matching cipher suite",
+		"invalid role",
+	}
+	unreachableErrors = []string{
+		"unable to establish",
+		"no response from remote controller",
+		"get auth capabilities error",
+		"address lookup for",
+		"connection refused",
+		"no route to host",
+		"network is unreachable",
+		"host is unreachable",
+	}
+	unsupportedErrors = []string{
+		"invalid command",
+		"not supported",
+		"unsupported",
+		"unknown command",
+		"invalid data field",
+	}
+)
+
+// classifyError returns the class of an ipmitool failure from its stderr,
+// or nil when it isn't recognized
+func classifyError(stderr string) error {
+	stderr = strings.ToLower(stderr)
+
+	for _, class := range []struct {
+		err      error
+		patterns []string
+	}{
+		{ErrAuthentication, authenticationErrors},
+		{ErrUnreachable, unreachableErrors},
+		{ErrUnsupported, unsupportedErrors},
+	} {
+		for _, pattern := range class.patterns {
+			if strings.Contains(stderr, pattern) {
+				return class.err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ipmitoolError builds the error for a failed ipmitool run from its exit
+// error and stderr, with the password redacted
+func ipmitoolError(err error, stderr, password string) error {
+	// ipmitool can echo its arguments in usage errors
+	detail := strings.TrimSpace(Redact(stderr, password))
+
+	if class := classifyError(stderr); class != nil {
+		return fmt.Errorf("%w: %s", class, detail)
+	}
+	return fmt.Errorf("ipmitool error: %w, stderr: %s", err, detail)
+}
@@ -0,0 +1,80 @@
+package ipmi
+
+import "strings"
+
+// Health states reported for a BMC, ordered from best to worst
+const (
+	HealthOK       = "ok"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+	HealthUnknown  = "unknown"
+)
+
+// HealthReport is the health roll-up derived from a set of sensor readings
+type HealthReport struct {
+	State    string          `json:"state"`
+	Warning  []SensorReading `json:"warning,omitempty"`
+	Critical []SensorReading `json:"critical,omitempty"`
+	Sensors  int             `json:"sensors"`
+}
+
+// FirmwareVersion extracts the BMC firmware version from `mc info` output
+// as returned by GetBMCInfo
+func FirmwareVersion(info map[string]string) string {
+	version := info["Firmware Revision"]
+	if version == "" {
+		return ""
+	}
+
+	// Some BMCs report an auxiliary revision that distinguishes builds of
+	// the same major.minor firmware (e.g. iDRAC "2.50" + "0x00 0x0f ...")
+	if aux := strings.TrimSpace(info["Aux Firmware Rev Info"]); aux != "" {
+		return version + " (" + strings.Join(strings.Fields(aux), " ") + ")"
+	}
+
+	return version
+}
+
+// ClassifySensor maps an ipmitool sensor status column onto a health state.
+// ipmitool uses ok, nc (non-critical), cr (critical), and nr
+// (non-recoverable), optionally prefixed with l/u for lower/upper threshold.
+// Sensors reporting "ns" (no sensor / not readable) are not classified.
+func ClassifySensor(status string) string {
+	switch strings.ToLower(strings.TrimSpace(status)) {
+	case "ok":
+		return HealthOK
+	case "nc", "lnc", "unc":
+		return HealthWarning
+	case "cr", "lcr", "ucr", "nr", "lnr", "unr":
+		return HealthCritical
+	}
+	return HealthUnknown
+}
+
+// SummarizeHealth rolls sensor readings up into a single health state: the
+// worst classified sensor wins, and a BMC with no readable sensors is unknown
+func SummarizeHealth(readings []SensorReading) HealthReport {
+	report := HealthReport{State: HealthUnknown}
+
+	for _, reading := range readings {
+		switch ClassifySensor(reading.Status) {
+		case HealthOK:
+			report.Sensors++
+			if report.State == HealthUnknown {
+				report.State = HealthOK
+			}
+		case HealthWarning:
+			report.Sensors++
+			report.Warning = append(report.Warning, reading)
+			if report.State != HealthCritical {
+				report.State = HealthWarning
+			}
+		case HealthCritical:
+			report.Sensors++
+			report.Critical = append(report.Critical, reading)
+			report.State = HealthCritical
+		}
+	}
+
+	return report
+}
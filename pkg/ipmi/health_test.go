@@ -0,0 +1,90 @@
+package ipmi
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+)
+
+// readFixture returns a captured ipmitool output from testdata
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseSensorsIDRAC(t *testing.T) {
+	readings := ParseSensors(readFixture(t, "sdr_list_idrac.txt"))
+	if len(readings) != 17 {
+		t.Fatalf("parsed %d readings, want 17", len(readings))
+	}
+
+	want := []SensorReading{
+		{Name: "Fan1 RPM", Value: "3360 RPM", Status: "ok"},
+		{Name: "Fan2 RPM", Value: "3480 RPM", Status: "ok"},
+		{Name: "Fan6 RPM", Value: "no reading", Status: "ns"},
+	}
+	if !reflect.DeepEqual(readings[:3], want) {
+		t.Errorf("first readings = %+v, want %+v", readings[:3], want)
+	}
+
+	report := SummarizeHealth(readings)
+	if report.State != HealthCritical {
+		t.Errorf("state = %s, want critical", report.State)
+	}
+	if len(report.Critical) != 1 || report.Critical[0].Name != "PS2 Status" {
+		t.Errorf("critical = %+v, want PS2 Status", report.Critical)
+	}
+	// Sensors that aren't readable aren't counted
+	if report.Sensors != 14 {
+		t.Errorf("sensors = %d, want 14", report.Sensors)
+	}
+}
+
+func TestParseSensorsSupermicro(t *testing.T) {
+	readings := ParseSensors(readFixture(t, "sdr_list_supermicro.txt"))
+	if len(readings) != 16 {
+		t.Fatalf("parsed %d readings, want 16 (blank lines skipped)", len(readings))
+	}
+	if got := readings[12]; got != (SensorReading{Name: "3.3VCC", Value: "3.38 Volts", Status: "ok"}) {
+		t.Errorf("3.3VCC = %+v", got)
+	}
+
+	report := SummarizeHealth(readings)
+	if report.State != HealthWarning {
+		t.Errorf("state = %s, want warning", report.State)
+	}
+	if len(report.Warning) != 1 || report.Warning[0].Name != "FAN2" {
+		t.Errorf("warning = %+v, want FAN2", report.Warning)
+	}
+}
+
+func TestGetSensorReadings(t *testing.T) {
+	runner := &command.Fake{}
+	runner.Script(command.FakeResult{Stdout: readFixture(t, "sdr_list_supermicro.txt")})
+
+	readings, err := NewPowerControllerWithRunner(runner).GetSensorReadings(testBMC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 16 {
+		t.Errorf("got %d readings, want 16", len(readings))
+	}
+	if argv := runner.Calls()[0]; !reflect.DeepEqual(argv[len(argv)-2:], []string{"sdr", "list"}) {
+		t.Errorf("ran %v, want sdr list", argv)
+	}
+}
+
+func TestSummarizeHealthWithoutReadableSensors(t *testing.T) {
+	report := SummarizeHealth(ParseSensors("Fan1 | no reading | ns\nTemp | Not Readable | ns\n"))
+	if report.State != HealthUnknown || report.Sensors != 0 {
+		t.Errorf("report = %+v, want unknown with no sensors", report)
+	}
+}
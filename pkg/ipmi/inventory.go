@@ -0,0 +1,60 @@
+package ipmi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// GetFRUInventory reads the FRU data of the builtin FRU device and maps it
+// into a HardwareInfo. IPMI FRU only describes the chassis, board, and
+// product, so memory, disk, and NIC inventory are left empty.
+func (pc *PowerController) GetFRUInventory(bmc *models.BMCInfo) (*models.HardwareInfo, error) {
+	if bmc == nil {
+		return nil, fmt.Errorf("BMC info is required")
+	}
+
+	if !bmc.Enabled {
+		return nil, fmt.Errorf("BMC is not enabled for this machine")
+	}
+
+	output, err := pc.ipmitool(bmc, "fru", "print", "0")
+	if err != nil {
+		return nil, err
+	}
+
+	hw := ParseFRU(output)
+	return &hw, nil
+}
+
+// ParseFRU parses `ipmitool fru print` output for a single FRU device
+func ParseFRU(output string) models.HardwareInfo {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if _, seen := fields[key]; !seen && value != "" {
+			fields[key] = value
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if v := fields[key]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	return models.HardwareInfo{
+		Manufacturer: first("Product Manufacturer", "Board Mfg"),
+		Model:        first("Product Name", "Board Product"),
+		SerialNumber: first("Product Serial", "Chassis Serial", "Board Serial"),
+	}
+}
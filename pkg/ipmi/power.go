@@ -1,12 +1,15 @@
 package ipmi
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
 )
 
@@ -24,12 +27,20 @@ const (
 // PowerController handles IPMI power operations
 type PowerController struct {
 	timeout time.Duration
+	runner  command.Runner
 }
 
 // NewPowerController creates a new IPMI power controller
 func NewPowerController() *PowerController {
+	return NewPowerControllerWithRunner(command.Exec{})
+}
+
+// NewPowerControllerWithRunner creates an IPMI power controller that runs
+// ipmitool through runner
+func NewPowerControllerWithRunner(runner command.Runner) *PowerController {
 	return &PowerController{
 		timeout: 30 * time.Second,
+		runner:  runner,
 	}
 }
 
@@ -47,50 +58,12 @@ func (pc *PowerController) ExecutePowerOperation(bmc *models.BMCInfo, operation
 		return "", fmt.Errorf("BMC IP address is required")
 	}
 
-	// Build ipmitool command
-	args := []string{
-		"-I", "lanplus",
-		"-H", bmc.IPAddress,
-		"-U", bmc.Username,
-	}
-
-	// Add password if provided
-	if bmc.Password != "" {
-		args = append(args, "-P", bmc.Password)
-	}
-
-	// Add port if specified
-	if bmc.Port > 0 {
-		args = append(args, "-p", fmt.Sprintf("%d", bmc.Port))
+	output, err := pc.ipmitool(bmc, "power", string(operation))
+	if err != nil {
+		return "", err
 	}
 
-	// Add the power command
-	args = append(args, "power", string(operation))
-
-	// Execute the command
-	cmd := exec.Command("ipmitool", args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	// Set timeout
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Run()
-	}()
-
-	select {
-	case err := <-done:
-		if err != nil {
-			return "", fmt.Errorf("ipmitool error: %w, stderr: %s", err, stderr.String())
-		}
-		return strings.TrimSpace(stdout.String()), nil
-	case <-time.After(pc.timeout):
-		if cmd.Process != nil {
-			cmd.Process.Kill()
-		}
-		return "", fmt.Errorf("ipmitool command timed out after %s", pc.timeout)
-	}
+	return strings.TrimSpace(output), nil
 }
 
 // GetPowerStatus gets the current power status of a machine
@@ -100,16 +73,26 @@ func (pc *PowerController) GetPowerStatus(bmc *models.BMCInfo) (string, error) {
 		return "unknown", err
 	}
 
-	// Parse the result
-	// ipmitool returns "Chassis Power is on" or "Chassis Power is off"
-	result = strings.ToLower(result)
-	if strings.Contains(result, "on") {
-		return "on", nil
-	} else if strings.Contains(result, "off") {
-		return "off", nil
+	return ParsePowerStatus(result), nil
+}
+
+// ParsePowerStatus parses `ipmitool power status` output into "on", "off",
+// or "unknown"
+func ParsePowerStatus(output string) string {
+	// ipmitool returns "Chassis Power is on" or "Chassis Power is off".
+	// Only the last word counts: anything else may contain "on" or "off",
+	// as "session" does.
+	fields := strings.Fields(strings.ToLower(output))
+	if len(fields) > 0 {
+		switch fields[len(fields)-1] {
+		case "on":
+			return "on"
+		case "off":
+			return "off"
+		}
 	}
 
-	return "unknown", nil
+	return "unknown"
 }
 
 // PowerOn turns on a machine
@@ -132,6 +115,17 @@ func (pc *PowerController) PowerCycle(bmc *models.BMCInfo) (string, error) {
 	return pc.ExecutePowerOperation(bmc, PowerCycle)
 }
 
+// SetNextBootPXE makes a machine boot from the network on its next boot
+// only, whatever its boot order
+func (pc *PowerController) SetNextBootPXE(bmc *models.BMCInfo) error {
+	if bmc == nil || !bmc.Enabled || bmc.IPAddress == "" {
+		return fmt.Errorf("BMC is not configured for this machine")
+	}
+
+	_, err := pc.ipmitool(bmc, "chassis", "bootdev", "pxe")
+	return err
+}
+
 // TestConnection tests the connection to the BMC
 func (pc *PowerController) TestConnection(bmc *models.BMCInfo) error {
 	_, err := pc.GetPowerStatus(bmc)
@@ -144,128 +138,133 @@ func (pc *PowerController) GetBMCInfo(bmc *models.BMCInfo) (map[string]string, e
 		return nil, fmt.Errorf("BMC info is required")
 	}
 
-	args := []string{
-		"-I", "lanplus",
-		"-H", bmc.IPAddress,
-		"-U", bmc.Username,
+	output, err := pc.ipmitool(bmc, "mc", "info")
+	if err != nil {
+		return nil, err
 	}
 
-	if bmc.Password != "" {
-		args = append(args, "-P", bmc.Password)
-	}
+	return ParseMCInfo(output), nil
+}
 
-	if bmc.Port > 0 {
-		args = append(args, "-p", fmt.Sprintf("%d", bmc.Port))
+// ParseMCInfo parses `ipmitool mc info` output into its fields
+func ParseMCInfo(output string) map[string]string {
+	info := make(map[string]string)
+	lines := strings.Split(output, "\n")
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			key := strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+			info[key] = value
+		}
 	}
 
-	args = append(args, "mc", "info")
+	return info
+}
 
-	cmd := exec.Command("ipmitool", args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// GetSensorReadings retrieves sensor readings from the BMC
+func (pc *PowerController) GetSensorReadings(bmc *models.BMCInfo) ([]SensorReading, error) {
+	if bmc == nil {
+		return nil, fmt.Errorf("BMC info is required")
+	}
+
+	output, err := pc.ipmitool(bmc, "sdr", "list")
+	if err != nil {
+		return nil, err
+	}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Run()
-	}()
+	return ParseSensors(output), nil
+}
 
-	select {
-	case err := <-done:
-		if err != nil {
-			return nil, fmt.Errorf("ipmitool error: %w, stderr: %s", err, stderr.String())
+// ParseSensors parses `ipmitool sdr list` output
+func ParseSensors(output string) []SensorReading {
+	var readings []SensorReading
+	lines := strings.Split(output, "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
 		}
 
-		// Parse the output
-		info := make(map[string]string)
-		lines := strings.Split(stdout.String(), "\n")
-		for _, line := range lines {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				info[key] = value
+		parts := strings.Split(line, "|")
+		if len(parts) >= 3 {
+			reading := SensorReading{
+				Name:   strings.TrimSpace(parts[0]),
+				Value:  strings.TrimSpace(parts[1]),
+				Status: strings.TrimSpace(parts[2]),
 			}
+			readings = append(readings, reading)
 		}
-
-		return info, nil
-	case <-time.After(pc.timeout):
-		if cmd.Process != nil {
-			cmd.Process.Kill()
-		}
-		return nil, fmt.Errorf("ipmitool command timed out after %s", pc.timeout)
 	}
+
+	return readings
 }
 
-// GetSensorReadings retrieves sensor readings from the BMC
-func (pc *PowerController) GetSensorReadings(bmc *models.BMCInfo) ([]SensorReading, error) {
-	if bmc == nil {
-		return nil, fmt.Errorf("BMC info is required")
+// SensorReading represents a sensor reading from IPMI
+type SensorReading struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Status string `json:"status"`
+}
+
+// bareHost returns a BMC address without the brackets an IPv6 literal may
+// have been saved with; ipmitool's -H takes IPv6 addresses bare
+func bareHost(addr string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// ipmitool runs an ipmitool command against a BMC, killing it after the
+// controller's timeout, and returns its output. The password goes through
+// a temporary file, since arguments are visible to every local user.
+func (pc *PowerController) ipmitool(bmc *models.BMCInfo, command ...string) (string, error) {
+	iface := bmc.Interface
+	if iface == "" {
+		iface = models.IPMIInterfaceLANPlus
 	}
 
 	args := []string{
-		"-I", "lanplus",
-		"-H", bmc.IPAddress,
+		"-I", iface,
+		"-H", bareHost(bmc.IPAddress),
 		"-U", bmc.Username,
 	}
 
+	if bmc.CipherSuite > 0 {
+		args = append(args, "-C", strconv.Itoa(bmc.CipherSuite))
+	}
+	if bmc.PrivilegeLevel != "" {
+		args = append(args, "-L", bmc.PrivilegeLevel)
+	}
+	if bmc.Retries > 0 {
+		args = append(args, "-R", strconv.Itoa(bmc.Retries))
+	}
+
+	// Add password if provided
 	if bmc.Password != "" {
-		args = append(args, "-P", bmc.Password)
+		passwordFile, err := writeSecretFile(bmc.Password)
+		if err != nil {
+			return "", fmt.Errorf("failed to write BMC password file: %w", err)
+		}
+		defer os.Remove(passwordFile)
+
+		args = append(args, "-f", passwordFile)
 	}
 
+	// Add port if specified
 	if bmc.Port > 0 {
 		args = append(args, "-p", fmt.Sprintf("%d", bmc.Port))
 	}
 
-	args = append(args, "sdr", "list")
-
-	cmd := exec.Command("ipmitool", args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	args = append(args, command...)
 
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Run()
-	}()
+	ctx, cancel := context.WithTimeout(context.Background(), pc.timeout)
+	defer cancel()
 
-	select {
-	case err := <-done:
-		if err != nil {
-			return nil, fmt.Errorf("ipmitool error: %w, stderr: %s", err, stderr.String())
-		}
-
-		// Parse sensor readings
-		var readings []SensorReading
-		lines := strings.Split(stdout.String(), "\n")
-		for _, line := range lines {
-			if line == "" {
-				continue
-			}
-
-			parts := strings.Split(line, "|")
-			if len(parts) >= 3 {
-				reading := SensorReading{
-					Name:   strings.TrimSpace(parts[0]),
-					Value:  strings.TrimSpace(parts[1]),
-					Status: strings.TrimSpace(parts[2]),
-				}
-				readings = append(readings, reading)
-			}
-		}
-
-		return readings, nil
-	case <-time.After(pc.timeout):
-		if cmd.Process != nil {
-			cmd.Process.Kill()
-		}
-		return nil, fmt.Errorf("ipmitool command timed out after %s", pc.timeout)
+	stdout, stderr, err := pc.runner.Run(ctx, "ipmitool", args...)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("%w: ipmitool command timed out after %s", ErrUnreachable, pc.timeout)
+	}
+	if err != nil {
+		return "", ipmitoolError(err, stderr, bmc.Password)
 	}
-}
 
-// SensorReading represents a sensor reading from IPMI
-type SensorReading struct {
-	Name   string `json:"name"`
-	Value  string `json:"value"`
-	Status string `json:"status"`
+	return stdout, nil
 }
@@ -0,0 +1,166 @@
+package ipmi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// testBMC is an enabled IPMI BMC with credentials
+func testBMC() *models.BMCInfo {
+	return &models.BMCInfo{
+		IPAddress: "10.0.0.5",
+		Username:  "root",
+		Password:  "calvin",
+		Type:      "IPMI",
+		Enabled:   true,
+	}
+}
+
+func TestParsePowerStatus(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"Chassis Power is on\n", "on"},
+		{"Chassis Power is off\n", "off"},
+		{"Chassis Power is ON", "on"},
+		{"", "unknown"},
+		{"Error: Unable to establish IPMI v2 / RMCP+ session", "unknown"},
+		{"Chassis Power Control: Up/On", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := ParsePowerStatus(tt.output); got != tt.want {
+			t.Errorf("ParsePowerStatus(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestGetPowerStatus(t *testing.T) {
+	runner := &command.Fake{}
+	runner.Script(command.FakeResult{Stdout: "Chassis Power is on\n"})
+	pc := NewPowerControllerWithRunner(runner)
+
+	bmc := testBMC()
+	bmc.IPAddress = "[2001:db8::5]"
+	bmc.Port = 6230
+	bmc.CipherSuite = 17
+
+	status, err := pc.GetPowerStatus(bmc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "on" {
+		t.Errorf("status = %q, want on", status)
+	}
+
+	calls := runner.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("ran %d commands, want 1", len(calls))
+	}
+	argv := strings.Join(calls[0], " ")
+	for _, want := range []string{"ipmitool -I lanplus -H 2001:db8::5 -U root -C 17", "-p 6230", "power status"} {
+		if !strings.Contains(argv, want) {
+			t.Errorf("argv %q does not contain %q", argv, want)
+		}
+	}
+	if !strings.HasSuffix(argv, " power status") {
+		t.Errorf("argv %q does not end with the command", argv)
+	}
+}
+
+func TestExecutePowerOperationRequiresBMC(t *testing.T) {
+	runner := &command.Fake{}
+	pc := NewPowerControllerWithRunner(runner)
+
+	disabled := testBMC()
+	disabled.Enabled = false
+	noAddress := testBMC()
+	noAddress.IPAddress = ""
+
+	for name, bmc := range map[string]*models.BMCInfo{"nil": nil, "disabled": disabled, "no address": noAddress} {
+		if _, err := pc.ExecutePowerOperation(bmc, PowerOn); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("ran %v without a usable BMC", calls)
+	}
+}
+
+func TestIPMIToolErrorsAreClassified(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   error
+	}{
+		{"Error: Unable to establish IPMI v2 / RMCP+ session", ErrUnreachable},
+		{"Error in open session response message : invalid user name\nError: Unable to establish IPMI v2 / RMCP+ session", ErrAuthentication},
+		{"RAKP 2 HMAC is invalid", ErrAuthentication},
+		{"Invalid command", ErrUnsupported},
+	}
+	for _, tt := range tests {
+		runner := &command.Fake{}
+		runner.Script(command.FakeResult{Stderr: tt.stderr, Err: fmt.Errorf("exit status 1")})
+
+		_, err := NewPowerControllerWithRunner(runner).PowerOn(testBMC())
+		if !errors.Is(err, tt.want) {
+			t.Errorf("stderr %q: err = %v, want %v", tt.stderr, err, tt.want)
+		}
+	}
+
+	runner := &command.Fake{}
+	runner.Script(command.FakeResult{Stderr: "something odd", Err: fmt.Errorf("exit status 1")})
+	_, err := NewPowerControllerWithRunner(runner).PowerOn(testBMC())
+	if err == nil || errors.Is(err, ErrUnreachable) || errors.Is(err, ErrAuthentication) || errors.Is(err, ErrUnsupported) {
+		t.Errorf("unrecognized failure: err = %v, want an unclassified error", err)
+	}
+}
+
+// hangingRunner runs commands that never finish on their own
+type hangingRunner struct{}
+
+func (hangingRunner) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	<-ctx.Done()
+	return "", "", ctx.Err()
+}
+
+func TestIPMIToolTimeout(t *testing.T) {
+	pc := NewPowerControllerWithRunner(hangingRunner{})
+	pc.timeout = 10 * time.Millisecond
+
+	_, err := pc.GetPowerStatus(testBMC())
+	if !errors.Is(err, ErrUnreachable) || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("err = %v, want a timeout classified as unreachable", err)
+	}
+}
+
+func TestGetBMCInfo(t *testing.T) {
+	runner := &command.Fake{}
+	runner.Script(command.FakeResult{Stdout: `Device ID                 : 32
+Device Revision           : 1
+Firmware Revision         : 2.50
+IPMI Version              : 2.0
+Manufacturer ID           : 674
+Manufacturer Name         : DELL Inc
+Aux Firmware Rev Info     :
+    0x00
+    0x0f
+`})
+
+	info, err := NewPowerControllerWithRunner(runner).GetBMCInfo(testBMC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["Manufacturer Name"] != "DELL Inc" || info["IPMI Version"] != "2.0" {
+		t.Errorf("info = %v", info)
+	}
+	if got := FirmwareVersion(info); got != "2.50" {
+		t.Errorf("FirmwareVersion = %q, want 2.50", got)
+	}
+}
@@ -0,0 +1,54 @@
+package ipmi
+
+import (
+	"os"
+	"strings"
+)
+
+// redacted stands in for a BMC password in anything that might be logged
+const redacted = "********"
+
+// Redact replaces every occurrence of password in text
+func Redact(text, password string) string {
+	if password == "" {
+		return text
+	}
+	return strings.ReplaceAll(text, password, redacted)
+}
+
+// redactedError hides a secret in the message of the error it wraps
+type redactedError struct {
+	err    error
+	secret string
+}
+
+func (e *redactedError) Error() string {
+	return Redact(e.err.Error(), e.secret)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// writeSecretFile writes secret to a new file readable only by the current
+// user, for ipmitool -f or exec, and returns its path. The caller removes it.
+func writeSecretFile(secret string) (string, error) {
+	f, err := os.CreateTemp("", "ipmi-secret-*")
+	if err != nil {
+		return "", err
+	}
+
+	// CreateTemp makes files 0600, but don't depend on it for a secret
+	if err := f.Chmod(0600); err == nil {
+		_, err = f.WriteString(secret)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,184 @@
+package ipmi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/command"
+)
+
+// fileRunner is a Runner that replays scripted results and, since the
+// files are gone once the call returns, records the contents and mode of
+// the files ipmitool is handed with -f and exec while it runs
+type fileRunner struct {
+	command.Fake
+	files map[string]string
+	modes map[string]os.FileMode
+}
+
+func (r *fileRunner) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	for i, arg := range args {
+		if i == 0 || (args[i-1] != "-f" && args[i-1] != "exec") {
+			continue
+		}
+		data, _ := os.ReadFile(arg)
+		r.files[arg] = string(data)
+		if info, err := os.Stat(arg); err == nil {
+			r.modes[arg] = info.Mode().Perm()
+		}
+	}
+	return r.Fake.Run(ctx, name, args...)
+}
+
+func newFileRunner() *fileRunner {
+	return &fileRunner{files: map[string]string{}, modes: map[string]os.FileMode{}}
+}
+
+// argAfter returns the argument following flag in argv
+func argAfter(t *testing.T, argv []string, flag string) string {
+	t.Helper()
+
+	for i, arg := range argv[:len(argv)-1] {
+		if arg == flag {
+			return argv[i+1]
+		}
+	}
+	t.Fatalf("argv %v has no %s", argv, flag)
+	return ""
+}
+
+func TestPasswordIsNeverAnArgument(t *testing.T) {
+	runner := newFileRunner()
+	runner.Script(command.FakeResult{Stdout: "Chassis Power is on\n"})
+
+	bmc := testBMC()
+	bmc.Password = "s3cr3t-Pa55"
+	if _, err := NewPowerControllerWithRunner(runner).GetPowerStatus(bmc); err != nil {
+		t.Fatal(err)
+	}
+
+	argv := runner.Calls()[0]
+	for _, arg := range argv {
+		if strings.Contains(arg, bmc.Password) {
+			t.Errorf("argv %v contains the password", argv)
+		}
+	}
+	for _, flag := range []string{"-P", "-E"} {
+		for _, arg := range argv {
+			if arg == flag {
+				t.Errorf("argv %v passes the password with %s", argv, flag)
+			}
+		}
+	}
+
+	passwordFile := argAfter(t, argv, "-f")
+	if got := runner.files[passwordFile]; got != bmc.Password {
+		t.Errorf("password file held %q, want the password", got)
+	}
+	if mode := runner.modes[passwordFile]; mode != 0600 {
+		t.Errorf("password file mode = %v, want 0600", mode)
+	}
+	if _, err := os.Stat(passwordFile); !os.IsNotExist(err) {
+		t.Errorf("password file is left behind: %v", err)
+	}
+}
+
+func TestNoPasswordNoFile(t *testing.T) {
+	runner := newFileRunner()
+	runner.Script(command.FakeResult{Stdout: "Chassis Power is off\n"})
+
+	bmc := testBMC()
+	bmc.Password = ""
+	if _, err := NewPowerControllerWithRunner(runner).GetPowerStatus(bmc); err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range runner.Calls()[0] {
+		if arg == "-f" {
+			t.Errorf("argv %v has a password file without a password", runner.Calls()[0])
+		}
+	}
+}
+
+func TestSetPasswordGoesThroughExec(t *testing.T) {
+	runner := newFileRunner()
+	runner.Script(
+		command.FakeResult{Stdout: "ID  Name             Callin  Link Auth  IPMI Msg   Channel Priv Limit\n" +
+			"1                    true    false      false      Unknown (0x00)\n" +
+			"2   root             false   true       true       ADMINISTRATOR\n"},
+		command.FakeResult{},
+	)
+
+	newPassword := "n3w-Pa55word"
+	if err := NewPowerControllerWithRunner(runner).SetPassword(testBMC(), newPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := runner.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("ran %d commands, want 2", len(calls))
+	}
+	for _, argv := range calls {
+		for _, arg := range argv {
+			if strings.Contains(arg, newPassword) || strings.Contains(arg, "calvin") {
+				t.Errorf("argv %v contains a password", argv)
+			}
+		}
+	}
+
+	commandFile := argAfter(t, calls[1], "exec")
+	if got, want := runner.files[commandFile], "user set password 2 "+newPassword+" 20\n"; got != want {
+		t.Errorf("command file held %q, want %q", got, want)
+	}
+	if mode := runner.modes[commandFile]; mode != 0600 {
+		t.Errorf("command file mode = %v, want 0600", mode)
+	}
+	if _, err := os.Stat(commandFile); !os.IsNotExist(err) {
+		t.Errorf("command file is left behind: %v", err)
+	}
+}
+
+func TestErrorsAreRedacted(t *testing.T) {
+	runner := &command.Fake{}
+	// ipmitool echoes its arguments in usage errors
+	runner.Script(command.FakeResult{Stderr: "Invalid password: calvin", Err: fmt.Errorf("exit status 1")})
+
+	_, err := NewPowerControllerWithRunner(runner).PowerOn(testBMC())
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if strings.Contains(err.Error(), "calvin") {
+		t.Errorf("err = %q contains the password", err)
+	}
+	if !strings.Contains(err.Error(), redacted) {
+		t.Errorf("err = %q, want the password redacted", err)
+	}
+}
+
+func TestSetPasswordErrorsAreRedacted(t *testing.T) {
+	runner := &command.Fake{}
+	runner.Script(
+		command.FakeResult{Stdout: "2   root             false   true       true       ADMINISTRATOR\n"},
+		command.FakeResult{Stderr: "user set password 2 n3w-Pa55word 20: Invalid command", Err: fmt.Errorf("exit status 1")},
+	)
+
+	err := NewPowerControllerWithRunner(runner).SetPassword(testBMC(), "n3w-Pa55word")
+	if err == nil || strings.Contains(err.Error(), "n3w-Pa55word") {
+		t.Errorf("err = %v, want the new password redacted", err)
+	}
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("err = %v, want the ipmitool failure to stay classified", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	if got := Redact("-U root -P calvin power on", "calvin"); got != "-U root -P "+redacted+" power on" {
+		t.Errorf("Redact = %q", got)
+	}
+	if got := Redact("nothing to hide", ""); got != "nothing to hide" {
+		t.Errorf("Redact with no password = %q", got)
+	}
+}
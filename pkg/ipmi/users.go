@@ -0,0 +1,90 @@
+package ipmi
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Maximum password lengths: IPMI 2.0 (lanplus) allows 20 bytes, IPMI 1.5
+// (lan) only 16
+const (
+	MaxPasswordLength   = 20
+	MaxPasswordLength15 = 16
+)
+
+// PasswordLength returns the longest password the BMC's session interface
+// accepts
+func PasswordLength(bmc *models.BMCInfo) int {
+	if bmc.Interface == models.IPMIInterfaceLAN {
+		return MaxPasswordLength15
+	}
+	return MaxPasswordLength
+}
+
+// SetPassword changes the password of the BMC user the controller logs in
+// as. The user is looked up by name on the BMC's LAN channel. The command
+// goes through ipmitool exec so the new password never appears in the
+// process list.
+func (pc *PowerController) SetPassword(bmc *models.BMCInfo, password string) error {
+	if bmc == nil {
+		return fmt.Errorf("BMC info is required")
+	}
+
+	if bmc.Username == "" {
+		return fmt.Errorf("BMC username is required")
+	}
+
+	if len(password) > PasswordLength(bmc) {
+		return fmt.Errorf("password is longer than %d characters", PasswordLength(bmc))
+	}
+
+	channel := bmc.Channel
+	if channel == 0 {
+		channel = 1
+	}
+
+	output, err := pc.ipmitool(bmc, "user", "list", strconv.Itoa(channel))
+	if err != nil {
+		return err
+	}
+
+	userID, ok := ParseUserID(output, bmc.Username)
+	if !ok {
+		return fmt.Errorf("no BMC user named %q on channel %d", bmc.Username, channel)
+	}
+
+	command := fmt.Sprintf("user set password %d %s", userID, password)
+	if PasswordLength(bmc) == MaxPasswordLength {
+		command += " 20"
+	}
+
+	commandFile, err := writeSecretFile(command + "\n")
+	if err != nil {
+		return fmt.Errorf("failed to write ipmitool command file: %w", err)
+	}
+	defer os.Remove(commandFile)
+
+	if _, err := pc.ipmitool(bmc, "exec", commandFile); err != nil {
+		return &redactedError{err: err, secret: password}
+	}
+
+	return nil
+}
+
+// ParseUserID finds a user's ID in `ipmitool user list` output
+func ParseUserID(output, username string) (int, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != username {
+			continue
+		}
+		if id, err := strconv.Atoi(fields[0]); err == nil {
+			return id, true
+		}
+	}
+	return 0, false
+}
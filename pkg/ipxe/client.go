@@ -0,0 +1,106 @@
+package ipxe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// previewTimeout bounds a preview, which waits on the iPXE server's own
+// machine lookup
+const previewTimeout = 15 * time.Second
+
+// Client asks an iPXE server what it would serve machines, and has it send
+// Wake-on-LAN packets on the provisioning network
+type Client struct {
+	url  string
+	http *http.Client
+
+	// Bearer token for the Wake-on-LAN relay
+	relayToken string
+}
+
+// NewClient returns a client for the iPXE server at baseURL. relayToken is
+// sent with Wake-on-LAN requests if the relay requires one.
+func NewClient(baseURL, relayToken string) *Client {
+	return &Client{
+		url:        strings.TrimSuffix(baseURL, "/"),
+		http:       &http.Client{Timeout: previewTimeout},
+		relayToken: relayToken,
+	}
+}
+
+// Preview returns the boot script the iPXE server would serve the machine
+// with serviceTag right now, and why. params may set flavor, arch, uefi, and
+// secureboot as a booting client would.
+func (c *Client) Preview(ctx context.Context, serviceTag string, params url.Values) (*models.BootRequest, error) {
+	reqURL := fmt.Sprintf("%s/preview/%s", c.url, url.PathEscape(serviceTag))
+	if len(params) > 0 {
+		reqURL += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("iPXE server unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("iPXE server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var preview models.BootRequest
+	if err := json.NewDecoder(resp.Body).Decode(&preview); err != nil {
+		return nil, fmt.Errorf("failed to decode preview: %w", err)
+	}
+	return &preview, nil
+}
+
+// WakeRequest asks the iPXE server's Wake-on-LAN relay to wake a NIC
+type WakeRequest struct {
+	MACAddress string `json:"mac_address"`
+}
+
+// Wake has the iPXE server broadcast a Wake-on-LAN magic packet for the NIC
+// with the MAC address mac
+func (c *Client) Wake(ctx context.Context, mac string) error {
+	body, err := json.Marshal(WakeRequest{MACAddress: mac})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/wol", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.relayToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.relayToken)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("iPXE server unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("iPXE server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+// Package lint checks machine configurations for mistakes that fail their
+// builds or their boots, before they are built. Built-in checks catch the
+// common ones; a rules file adds checks of its own and changes how severe
+// the built-in ones are. Lint is separate from syntax validation, which
+// the builder does: a configuration that doesn't parse is linted as far
+// as it can be.
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// config is a configuration being linted, with what the checks need to
+// know about it
+type config struct {
+	lines    []string
+	settings []Setting
+	machine  *models.Machine
+}
+
+// find returns the settings of option or of options below it, leaving out
+// those within another one that is found
+func (c *config) find(option string) []*Setting {
+	return c.findPath(strings.Split(option, "."))
+}
+
+// findPath is find for an option path whose attribute names may have dots
+func (c *config) findPath(path []string) []*Setting {
+	found := make([]bool, len(c.settings))
+	var settings []*Setting
+	for i := range c.settings {
+		setting := &c.settings[i]
+		if !hasPrefix(setting.Path, path) {
+			continue
+		}
+		found[i] = true
+		if setting.Parent >= 0 && found[setting.Parent] {
+			continue
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
+
+// values returns the settings of option or of options below it that are
+// set to a value rather than an attribute set
+func (c *config) values(option string) []*Setting {
+	path := strings.Split(option, ".")
+	var settings []*Setting
+	for i := range c.settings {
+		if setting := &c.settings[i]; !setting.Nested && hasPrefix(setting.Path, path) {
+			settings = append(settings, setting)
+		}
+	}
+	return settings
+}
+
+// attrRef is an attribute name, such as a mount point or an interface,
+// with the line it is first set on
+type attrRef struct {
+	name string
+	line int
+}
+
+// names returns the attribute names set below an option path, such as
+// the mount points of fileSystems
+func (c *config) names(path []string) []attrRef {
+	seen := map[string]bool{}
+	var names []attrRef
+	for i := range c.settings {
+		setting := &c.settings[i]
+		if len(setting.Path) <= len(path) || !hasPrefix(setting.Path, path) {
+			continue
+		}
+		name := setting.Path[len(path)]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, attrRef{name: name, line: setting.Line})
+		}
+	}
+	return names
+}
+
+func hasPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// netboot reports whether the machine is served a netboot image
+func (c *config) netboot() bool {
+	return c.machine == nil || !c.machine.BootsFromDisk()
+}
+
+// builtin is a check every configuration gets, unless the rules file turns
+// it off
+type builtin struct {
+	id          string
+	description string
+	severity    string
+	check       func(c *config, report func(message string, line int))
+}
+
+// builtins are the built-in checks, in the order they run
+var builtins = []builtin{
+	{
+		id:          "state-version",
+		description: "system.stateVersion must be set",
+		severity:    models.LintSeverityError,
+		check: func(c *config, report func(string, int)) {
+			if len(c.find("system.stateVersion")) == 0 {
+				report("system.stateVersion is not set, so NixOS can't tell which release the machine's state was created with", 0)
+			}
+		},
+	},
+	{
+		id:          "netboot-root-filesystem",
+		description: "Netboot images bring their own root filesystem and can't declare one",
+		severity:    models.LintSeverityError,
+		check: func(c *config, report func(string, int)) {
+			if !c.netboot() {
+				return
+			}
+			for _, setting := range c.findPath([]string{"fileSystems", "/"}) {
+				report(`fileSystems."/" conflicts with the netboot image's root filesystem; mount disks elsewhere`, setting.Line)
+			}
+		},
+	},
+	{
+		id:          "netboot-supported-filesystems",
+		description: "Netboot configurations that mount filesystems must list their types in boot.supportedFilesystems",
+		severity:    models.LintSeverityError,
+		check: func(c *config, report func(string, int)) {
+			if !c.netboot() || len(c.find("boot.supportedFilesystems")) > 0 {
+				return
+			}
+			for _, mount := range c.names([]string{"fileSystems"}) {
+				if mount.name == "/" {
+					continue
+				}
+				report(fmt.Sprintf("fileSystems.%q is mounted, but boot.supportedFilesystems is not set, so the netboot initrd may lack its filesystem",
+					mount.name), mount.line)
+				return
+			}
+		},
+	},
+	{
+		id:          "netboot-conflicts",
+		description: "Netboot images have no boot loader to install and no system to upgrade in place",
+		severity:    models.LintSeverityError,
+		check: func(c *config, report func(string, int)) {
+			if !c.netboot() {
+				return
+			}
+			for _, option := range netbootConflicts {
+				for _, setting := range c.values(option) {
+					if strings.HasSuffix(setting.Name(), ".enable") && setting.Value != "true" {
+						continue
+					}
+					report(fmt.Sprintf("%s conflicts with the netboot profile", setting.Name()), setting.Line)
+				}
+			}
+		},
+	},
+	{
+		id:          "unknown-interface",
+		description: "Network interfaces named in the configuration must be in the machine's NIC inventory",
+		severity:    models.LintSeverityWarning,
+		check: func(c *config, report func(string, int)) {
+			if c.machine == nil || len(c.machine.Hardware.NICs) == 0 {
+				return
+			}
+			known := make(map[string]bool, len(c.machine.Hardware.NICs))
+			for _, nic := range c.machine.Hardware.NICs {
+				known[nic.Name] = true
+			}
+			for _, ref := range c.interfaces() {
+				if !known[ref.name] {
+					report(fmt.Sprintf("interface %s is not one of the machine's NICs (%s)", ref.name, nicNames(c.machine)), ref.line)
+				}
+			}
+		},
+	},
+}
+
+// netbootConflicts are the options the netboot-conflicts check reports
+// being set. Those ending in .enable are only reported when set to true.
+var netbootConflicts = []string{
+	"boot.loader.grub.enable",
+	"boot.loader.grub.device",
+	"boot.loader.grub.devices",
+	"boot.loader.systemd-boot.enable",
+	"boot.loader.efi.canTouchEfiVariables",
+	"system.autoUpgrade.enable",
+}
+
+// interfaceName matches the quoted names in a list of interfaces
+var interfaceName = regexp.MustCompile(`"([^"]+)"`)
+
+// interfaces returns the interfaces the configuration names: those it
+// configures under networking.interfaces, and the members of its bonds
+// and bridges. Names of interfaces the configuration creates, such as
+// bonds, bridges, and VLANs, aren't included.
+func (c *config) interfaces() []attrRef {
+	created := map[string]bool{}
+	for _, kind := range []string{"bonds", "bridges", "vlans", "macvlans"} {
+		for _, ref := range c.names([]string{"networking", kind}) {
+			created[ref.name] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	var refs []attrRef
+	add := func(name string, line int) {
+		if created[name] || seen[name] {
+			return
+		}
+		seen[name] = true
+		refs = append(refs, attrRef{name: name, line: line})
+	}
+
+	for _, ref := range c.names([]string{"networking", "interfaces"}) {
+		add(ref.name, ref.line)
+	}
+	for i := range c.settings {
+		setting := &c.settings[i]
+		if len(setting.Path) != 4 || setting.Path[0] != "networking" || setting.Path[3] != "interfaces" ||
+			(setting.Path[1] != "bonds" && setting.Path[1] != "bridges") {
+			continue
+		}
+		for _, match := range interfaceName.FindAllStringSubmatch(setting.Value, -1) {
+			add(match[1], setting.Line)
+		}
+	}
+	return refs
+}
+
+func nicNames(machine *models.Machine) string {
+	var names []string
+	for _, nic := range machine.Hardware.NICs {
+		names = append(names, nic.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Builtins lists the built-in checks with the severities rules gives them
+func Builtins(rules *models.LintRules) []models.BuiltinLintRule {
+	list := make([]models.BuiltinLintRule, 0, len(builtins))
+	for _, b := range builtins {
+		list = append(list, models.BuiltinLintRule{
+			ID:              b.id,
+			Description:     b.description,
+			Severity:        builtinSeverity(b, rules),
+			DefaultSeverity: b.severity,
+		})
+	}
+	return list
+}
+
+// IsBuiltin reports whether id is a built-in check
+func IsBuiltin(id string) bool {
+	for _, b := range builtins {
+		if b.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func builtinSeverity(b builtin, rules *models.LintRules) string {
+	if rules != nil {
+		if severity, ok := rules.Builtins[b.id]; ok {
+			return severity
+		}
+	}
+	return b.severity
+}
+
+// Check lints a machine's configuration with the built-in checks and
+// rules. Findings are ordered by line, with what is missing first.
+func Check(text string, machine *models.Machine, rules *models.LintRules) *models.LintResult {
+	c := &config{
+		lines:    strings.Split(text, "\n"),
+		settings: Settings(text),
+		machine:  machine,
+	}
+	result := &models.LintResult{Findings: []models.LintFinding{}, CheckedAt: time.Now()}
+
+	for _, b := range builtins {
+		severity := builtinSeverity(b, rules)
+		if severity == models.LintSeverityOff {
+			continue
+		}
+		b.check(c, func(message string, line int) {
+			result.Add(models.LintFinding{Rule: b.id, Severity: severity, Message: message, Line: line})
+		})
+	}
+
+	if rules != nil {
+		for i := range rules.Rules {
+			checkRule(c, &rules.Rules[i], result)
+		}
+	}
+
+	sort.SliceStable(result.Findings, func(i, j int) bool {
+		return result.Findings[i].Line < result.Findings[j].Line
+	})
+	return result
+}
+
+// checkRule runs a rule of the rules file. Rules are validated when they
+// are loaded, so their expressions compile.
+func checkRule(c *config, rule *models.LintRule, result *models.LintResult) {
+	if rule.DeployMode != "" {
+		mode := models.DeployModeNetboot
+		if !c.netboot() {
+			mode = models.DeployModeSwitch
+		}
+		if rule.DeployMode != mode {
+			return
+		}
+	}
+
+	message := rule.Message
+	if message == "" {
+		message = rule.Description
+	}
+	if message == "" {
+		message = "matched rule " + rule.ID
+	}
+
+	var lines []int
+	if rule.Pattern != "" {
+		pattern := regexp.MustCompile(rule.Pattern)
+		for i, line := range c.lines {
+			if pattern.MatchString(line) {
+				lines = append(lines, i+1)
+			}
+		}
+	} else {
+		settings := c.find(rule.Option)
+		if rule.Value != "" {
+			value := regexp.MustCompile(rule.Value)
+			settings = nil
+			for _, setting := range c.values(rule.Option) {
+				if value.MatchString(setting.Value) {
+					settings = append(settings, setting)
+				}
+			}
+		}
+		for _, setting := range settings {
+			lines = append(lines, setting.Line)
+		}
+	}
+
+	if rule.Absent {
+		if len(lines) == 0 {
+			result.Add(models.LintFinding{Rule: rule.ID, Severity: rule.Severity, Message: message})
+		}
+		return
+	}
+	for _, line := range lines {
+		result.Add(models.LintFinding{Rule: rule.ID, Severity: rule.Severity, Message: message, Line: line})
+	}
+}
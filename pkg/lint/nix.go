@@ -0,0 +1,414 @@
+package lint
+
+import (
+	"strings"
+)
+
+// Setting is an option set by a configuration, such as
+// services.openssh.enable, with the value it is set to as written. Options
+// set to an attribute set are settings too, with the options in the set
+// settings of their own; their Value is empty and Nested is true.
+type Setting struct {
+	Path   []string
+	Value  string
+	Nested bool
+	Line   int
+
+	// Parent is the index of the setting whose attribute set this one is
+	// in, or -1
+	Parent int
+}
+
+// Name is the setting's option path
+func (s *Setting) Name() string {
+	return strings.Join(s.Path, ".")
+}
+
+// maxValueLength is how much of a value is kept for matching
+const maxValueLength = 512
+
+type tokenKind int
+
+const (
+	tokenIdent tokenKind = iota
+	tokenString
+	tokenDot
+	tokenEquals
+	tokenOpenBrace
+	tokenCloseBrace
+	tokenSemicolon
+	tokenOpenBracket
+	tokenCloseBracket
+	tokenOpenParen
+	tokenCloseParen
+	tokenOther
+)
+
+type token struct {
+	kind       tokenKind
+	text       string // Identifier, or the contents of a string
+	line       int
+	start, end int
+}
+
+// tokenize splits Nix source into the tokens Settings needs, leaving out
+// comments. It is lenient: what it doesn't recognize becomes tokenOther.
+func tokenize(src string) []token {
+	var tokens []token
+	line := 1
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		start, startLine := i, line
+
+		switch {
+		case c == '\n':
+			line++
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 4
+			}
+			line += strings.Count(src[i:i+end+4], "\n")
+			i += end + 4
+			continue
+		case c == '"':
+			var text string
+			text, i = scanString(src, i+1)
+			line += strings.Count(src[start:i], "\n")
+			tokens = append(tokens, token{kind: tokenString, text: text, line: startLine, start: start, end: i})
+			continue
+		case strings.HasPrefix(src[i:], "''"):
+			var text string
+			text, i = scanIndentedString(src, i+2)
+			line += strings.Count(src[start:i], "\n")
+			tokens = append(tokens, token{kind: tokenString, text: text, line: startLine, start: start, end: i})
+			continue
+		case strings.HasPrefix(src[i:], "${"):
+			// An interpolated attribute name, which can't be matched
+			i = skipInterpolation(src, i+2)
+			line += strings.Count(src[start:i], "\n")
+			tokens = append(tokens, token{kind: tokenOther, line: startLine, start: start, end: i})
+			continue
+		case isIdentStart(c):
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[start:i], line: line, start: start, end: i})
+			continue
+		}
+
+		kind := tokenOther
+		switch c {
+		case '.':
+			kind = tokenDot
+		case '=':
+			kind = tokenEquals
+			if i+1 < len(src) && src[i+1] == '=' {
+				kind = tokenOther
+				i++
+			}
+		case '{':
+			kind = tokenOpenBrace
+		case '}':
+			kind = tokenCloseBrace
+		case ';':
+			kind = tokenSemicolon
+		case '[':
+			kind = tokenOpenBracket
+		case ']':
+			kind = tokenCloseBracket
+		case '(':
+			kind = tokenOpenParen
+		case ')':
+			kind = tokenCloseParen
+		case '!', '<', '>':
+			// !=, <=, and >= aren't assignments
+			if i+1 < len(src) && src[i+1] == '=' {
+				i++
+			}
+		}
+		i++
+		tokens = append(tokens, token{kind: kind, line: line, start: start, end: i})
+	}
+	return tokens
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9') || c == '-' || c == '\''
+}
+
+// scanString reads a double-quoted string from i, just past its opening
+// quote, returning its contents and the index past its closing quote
+func scanString(src string, i int) (string, int) {
+	var b strings.Builder
+	for i < len(src) {
+		switch {
+		case src[i] == '\\' && i+1 < len(src):
+			b.WriteByte(src[i+1])
+			i += 2
+		case src[i] == '"':
+			return b.String(), i + 1
+		case strings.HasPrefix(src[i:], "${"):
+			end := skipInterpolation(src, i+2)
+			b.WriteString(src[i:end])
+			i = end
+		default:
+			b.WriteByte(src[i])
+			i++
+		}
+	}
+	return b.String(), i
+}
+
+// scanIndentedString reads an indented string from i, just past its opening
+// quotes, returning its contents and the index past its closing quotes
+func scanIndentedString(src string, i int) (string, int) {
+	var b strings.Builder
+	for i < len(src) {
+		switch {
+		case strings.HasPrefix(src[i:], "'''"):
+			b.WriteString("''")
+			i += 3
+		case strings.HasPrefix(src[i:], "''$"):
+			b.WriteByte('$')
+			i += 3
+		case strings.HasPrefix(src[i:], "''\\") && i+3 < len(src):
+			b.WriteByte(src[i+3])
+			i += 4
+		case strings.HasPrefix(src[i:], "''"):
+			return b.String(), i + 2
+		case strings.HasPrefix(src[i:], "${"):
+			end := skipInterpolation(src, i+2)
+			b.WriteString(src[i:end])
+			i = end
+		default:
+			b.WriteByte(src[i])
+			i++
+		}
+	}
+	return b.String(), i
+}
+
+// skipInterpolation returns the index past the brace closing an
+// interpolation whose contents start at i
+func skipInterpolation(src string, i int) int {
+	depth := 1
+	for i < len(src) {
+		switch src[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case '"':
+			_, i = scanString(src, i+1)
+			continue
+		}
+		i++
+	}
+	return i
+}
+
+// Scopes a configuration is scanned in. Attribute sets and let bindings
+// hold assignments; lists and parentheses hold expressions.
+type scopeKind int
+
+const (
+	scopeAttrs scopeKind = iota
+	scopeLet
+	scopeList
+	scopeParen
+)
+
+type scope struct {
+	kind   scopeKind
+	prefix []string
+
+	// record is false in let bindings and lists, whose assignments aren't
+	// options
+	record bool
+
+	// parent is the setting the scope's attribute set is the value of,
+	// or -1
+	parent int
+
+	// pending is the setting whose value is being read, or -1; atStart is
+	// whether the next token starts an assignment. skipSemicolons counts
+	// the semicolons of with and assert expressions, which don't end an
+	// assignment.
+	pending        int
+	valueStart     int
+	atStart        bool
+	skipSemicolons int
+}
+
+// Settings scans a NixOS configuration for the options it sets. It is not
+// a Nix evaluator: options set by imported modules, computed attribute
+// names, and the like aren't found, and assignments in let bindings and
+// lists aren't options. The function a module is, and wrappers such as
+// mkIf and mkForce, are seen through.
+func Settings(src string) []Setting {
+	tokens := tokenize(src)
+	var settings []Setting
+	var hidden []bool
+
+	stack := []*scope{{kind: scopeParen, record: true, parent: -1, pending: -1}}
+	top := func() *scope { return stack[len(stack)-1] }
+
+	// push opens a scope within the value of the current scope's pending
+	// setting, or within the current scope if it has none
+	push := func(kind scopeKind) {
+		current := top()
+		s := &scope{kind: kind, prefix: current.prefix, record: current.record, parent: current.parent, pending: -1,
+			atStart: kind == scopeAttrs || kind == scopeLet}
+		if current.pending >= 0 {
+			s.prefix = settings[current.pending].Path
+			s.parent = current.pending
+			if kind == scopeAttrs && current.record {
+				settings[current.pending].Nested = true
+			}
+		}
+		// Attribute sets in lists, such as addresses, aren't options
+		if kind == scopeLet || kind == scopeList {
+			s.record = false
+		}
+		stack = append(stack, s)
+	}
+
+	// finish ends the current scope's pending setting at offset end
+	finish := func(end int) {
+		current := top()
+		if current.pending >= 0 && !settings[current.pending].Nested {
+			value := strings.Join(strings.Fields(src[current.valueStart:end]), " ")
+			if len(value) > maxValueLength {
+				value = value[:maxValueLength]
+			}
+			settings[current.pending].Value = value
+		}
+		current.pending = -1
+		current.atStart = true
+		current.skipSemicolons = 0
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		current := top()
+
+		if current.atStart && (current.kind == scopeAttrs || current.kind == scopeLet) {
+			current.atStart = false
+			if path, next := attrPath(tokens, i); path != nil {
+				full := append(append([]string{}, current.prefix...), path...)
+				settings = append(settings, Setting{Path: full, Line: tok.line, Parent: current.parent})
+				hidden = append(hidden, !current.record)
+				current.pending = len(settings) - 1
+				current.valueStart = tokens[next].end
+				i = next
+				continue
+			}
+			if tok.kind == tokenIdent && tok.text == "inherit" {
+				continue
+			}
+		}
+
+		switch tok.kind {
+		case tokenIdent:
+			switch tok.text {
+			case "let":
+				push(scopeLet)
+			case "in":
+				if current.kind == scopeLet {
+					stack = stack[:len(stack)-1]
+				}
+			case "with", "assert":
+				current.skipSemicolons++
+			}
+		case tokenOpenBrace:
+			push(scopeAttrs)
+		case tokenOpenBracket:
+			push(scopeList)
+		case tokenOpenParen:
+			push(scopeParen)
+		case tokenCloseBrace:
+			// Close the attribute set, and any let it left open
+			for len(stack) > 1 {
+				kind := top().kind
+				stack = stack[:len(stack)-1]
+				if kind == scopeAttrs {
+					break
+				}
+			}
+		case tokenCloseBracket, tokenCloseParen:
+			if len(stack) > 1 && (current.kind == scopeList || current.kind == scopeParen) {
+				stack = stack[:len(stack)-1]
+			}
+		case tokenSemicolon:
+			if current.kind != scopeAttrs && current.kind != scopeLet {
+				continue
+			}
+			if current.skipSemicolons > 0 {
+				current.skipSemicolons--
+				continue
+			}
+			finish(tok.start)
+		}
+	}
+
+	return options(settings, hidden)
+}
+
+// options leaves out the hidden settings, which are let bindings rather
+// than options, renumbering the parents of the rest
+func options(settings []Setting, hidden []bool) []Setting {
+	index := make([]int, len(settings))
+	var kept []Setting
+	for i, setting := range settings {
+		index[i] = -1
+		if hidden[i] {
+			continue
+		}
+		if setting.Parent >= 0 {
+			setting.Parent = index[setting.Parent]
+		}
+		index[i] = len(kept)
+		kept = append(kept, setting)
+	}
+	return kept
+}
+
+// attrPath reads the attribute path of an assignment starting at token i,
+// returning it and the index of its equals sign, or nil if no assignment
+// starts there
+func attrPath(tokens []token, i int) ([]string, int) {
+	var path []string
+	for {
+		if i >= len(tokens) || (tokens[i].kind != tokenIdent && tokens[i].kind != tokenString) {
+			return nil, 0
+		}
+		path = append(path, tokens[i].text)
+		i++
+		if i < len(tokens) && tokens[i].kind == tokenEquals {
+			return path, i
+		}
+		if i >= len(tokens) || tokens[i].kind != tokenDot {
+			return nil, 0
+		}
+		i++
+	}
+}
@@ -0,0 +1,273 @@
+package lint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Errors of rule changes
+var (
+	ErrNoRulesFile  = errors.New("no lint rules file is configured")
+	ErrRuleNotFound = errors.New("lint rule not found")
+	ErrRuleExists   = errors.New("a lint rule with this id already exists")
+	ErrBuiltinRule  = errors.New("built-in checks can't be replaced or deleted, only have their severity changed")
+	ErrUnknownCheck = errors.New("no built-in check has this id")
+)
+
+// Store holds the rules of the lint rules file. Changes made through it
+// are written back to the file; changes made to the file by hand, or by
+// another server sharing it, are read again the next time the rules are
+// used.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	rules   *models.LintRules
+	modTime time.Time
+}
+
+// Open reads the lint rules file at path. A file that doesn't exist yet
+// has no rules, and is created when rules are added. With an empty path,
+// only the built-in checks run, at their default severities.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, rules: &models.LintRules{Rules: []models.LintRule{}}}
+	if path == "" {
+		return s, nil
+	}
+
+	rules, modTime, err := readRules(path)
+	if err != nil {
+		return nil, err
+	}
+	if rules != nil {
+		s.rules, s.modTime = rules, modTime
+	}
+	return s, nil
+}
+
+// readRules reads and validates a rules file, returning nil rules if it
+// doesn't exist
+func readRules(path string) (*models.LintRules, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read lint rules: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read lint rules: %w", err)
+	}
+
+	rules := &models.LintRules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse lint rules %s: %w", path, err)
+	}
+	if err := validateRules(rules); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid lint rules %s: %w", path, err)
+	}
+	if rules.Rules == nil {
+		rules.Rules = []models.LintRule{}
+	}
+	return rules, info.ModTime(), nil
+}
+
+func validateRules(rules *models.LintRules) error {
+	for id, severity := range rules.Builtins {
+		if !IsBuiltin(id) {
+			return fmt.Errorf("builtins: %s: %w", id, ErrUnknownCheck)
+		}
+		if !models.IsValidLintSeverity(severity) {
+			return fmt.Errorf("builtins: %s: severity must be error, warning, or off", id)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+		if IsBuiltin(rule.ID) {
+			return fmt.Errorf("rule %q: %w", rule.ID, ErrBuiltinRule)
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("rule %q: %w", rule.ID, ErrRuleExists)
+		}
+		seen[rule.ID] = true
+	}
+	return nil
+}
+
+// Rules returns the current rules, reading the file again if it changed.
+// If it no longer reads, the rules it last had are kept. The rules
+// returned aren't changed afterwards; changes replace them.
+func (s *Store) Rules() *models.LintRules {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current()
+}
+
+// current returns the current rules like Rules, with s.mu held
+func (s *Store) current() *models.LintRules {
+	if s.path == "" {
+		return s.rules
+	}
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return s.rules
+	}
+
+	rules, modTime, err := readRules(s.path)
+	if err != nil {
+		log.Printf("Keeping the previous lint rules: %v", err)
+		s.modTime = info.ModTime()
+	} else if rules != nil {
+		s.rules, s.modTime = rules, modTime
+	}
+	return s.rules
+}
+
+// List lists the built-in checks and the rules of the file
+func (s *Store) List() models.LintRuleList {
+	rules := s.Rules()
+	return models.LintRuleList{Builtins: Builtins(rules), Rules: rules.Rules}
+}
+
+// CreateRule adds a rule
+func (s *Store) CreateRule(rule models.LintRule) error {
+	return s.change(func(rules *models.LintRules) error {
+		for _, r := range rules.Rules {
+			if r.ID == rule.ID {
+				return ErrRuleExists
+			}
+		}
+		rules.Rules = append(rules.Rules, rule)
+		return nil
+	})
+}
+
+// UpdateRule replaces the rule with rule's ID
+func (s *Store) UpdateRule(rule models.LintRule) error {
+	return s.change(func(rules *models.LintRules) error {
+		for i := range rules.Rules {
+			if rules.Rules[i].ID == rule.ID {
+				rules.Rules[i] = rule
+				return nil
+			}
+		}
+		return ErrRuleNotFound
+	})
+}
+
+// DeleteRule removes a rule
+func (s *Store) DeleteRule(id string) error {
+	return s.change(func(rules *models.LintRules) error {
+		for i := range rules.Rules {
+			if rules.Rules[i].ID == id {
+				rules.Rules = append(rules.Rules[:i], rules.Rules[i+1:]...)
+				return nil
+			}
+		}
+		if IsBuiltin(id) {
+			return ErrBuiltinRule
+		}
+		return ErrRuleNotFound
+	})
+}
+
+// SetBuiltinSeverity changes the severity of a built-in check. Setting it
+// back to its default removes it from the file.
+func (s *Store) SetBuiltinSeverity(id, severity string) error {
+	return s.change(func(rules *models.LintRules) error {
+		for _, b := range builtins {
+			if b.id != id {
+				continue
+			}
+			builtins := make(map[string]string, len(rules.Builtins)+1)
+			for k, v := range rules.Builtins {
+				builtins[k] = v
+			}
+			if severity == b.severity {
+				delete(builtins, id)
+			} else {
+				builtins[id] = severity
+			}
+			rules.Builtins = builtins
+			return nil
+		}
+		return ErrUnknownCheck
+	})
+}
+
+// change applies fn to a copy of the current rules, validates the result,
+// and writes it to the file
+func (s *Store) change(fn func(rules *models.LintRules) error) error {
+	if s == nil || s.path == "" {
+		return ErrNoRulesFile
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.current()
+	rules := &models.LintRules{
+		Builtins: current.Builtins,
+		Rules:    append([]models.LintRule{}, current.Rules...),
+	}
+	if err := fn(rules); err != nil {
+		return err
+	}
+	if err := validateRules(rules); err != nil {
+		return err
+	}
+	if len(rules.Builtins) == 0 {
+		rules.Builtins = nil
+	}
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written beside the file and renamed over it, so a server reading it
+	// never sees half of it
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".lint-rules-*")
+	if err != nil {
+		return fmt.Errorf("failed to write lint rules: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write lint rules: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write lint rules: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write lint rules: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write lint rules: %w", err)
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to write lint rules: %w", err)
+	}
+	s.rules, s.modTime = rules, info.ModTime()
+	return nil
+}
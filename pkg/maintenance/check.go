@@ -0,0 +1,48 @@
+package maintenance
+
+import (
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+)
+
+// CheckMachines decides whether op may run now on every listed machine. The
+// returned decision is blocked if any machine is blocked, and names the
+// earliest next window among them.
+func CheckMachines(db *database.DB, machineIDs []string, op string) (Decision, []string, error) {
+	decision := Decision{Allowed: true}
+
+	windows, err := db.ListEnabledMaintenanceWindows()
+	if err != nil || len(windows) == 0 {
+		return decision, nil, err
+	}
+
+	now := time.Now().UTC()
+	var blocked []string
+	for _, id := range machineIDs {
+		groups, err := db.GetMachineGroups(id)
+		if err != nil {
+			return decision, nil, err
+		}
+		groupIDs := make([]string, 0, len(groups))
+		for _, g := range groups {
+			groupIDs = append(groupIDs, g.ID)
+		}
+
+		d := Check(windows, id, groupIDs, op, now)
+		if d.Allowed {
+			if decision.Active == nil {
+				decision.Active = d.Active
+			}
+			continue
+		}
+
+		blocked = append(blocked, id)
+		decision.Allowed = false
+		if d.Next != nil && (decision.Next == nil || d.Next.Start.Before(decision.Next.Start)) {
+			decision.Next = d.Next
+		}
+	}
+
+	return decision, blocked, nil
+}
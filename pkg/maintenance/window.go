@@ -0,0 +1,237 @@
+package maintenance
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Period is one occurrence of a maintenance window
+type Period struct {
+	Window *models.MaintenanceWindow `json:"window"`
+	Start  time.Time                 `json:"start"`
+	End    time.Time                 `json:"end"`
+}
+
+// Decision is the outcome of checking an operation against the windows
+type Decision struct {
+	Allowed bool    `json:"allowed"`
+	Active  *Period `json:"active,omitempty"` // The active window that allows the operation
+	Next    *Period `json:"next,omitempty"`   // The next window that would allow it
+}
+
+// Validate checks a window's scope, operations, time zone, and timing.
+// It also normalises explicit start/end times to UTC.
+func Validate(w *models.MaintenanceWindow) error {
+	if w.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch w.Scope {
+	case models.MaintenanceScopeAll:
+		w.ScopeID = ""
+	case models.MaintenanceScopeGroup, models.MaintenanceScopeMachine:
+		if w.ScopeID == "" {
+			return fmt.Errorf("scope_id is required for %s scope", w.Scope)
+		}
+	default:
+		return fmt.Errorf("scope must be all, group, or machine")
+	}
+
+	for _, op := range w.Operations {
+		switch op {
+		case models.MaintenanceOpPower, models.MaintenanceOpBuild, models.MaintenanceOpDelete, models.MaintenanceOpDeploy:
+		default:
+			return fmt.Errorf("invalid operation: %s", op)
+		}
+	}
+
+	if w.Timezone == "" {
+		w.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %s", w.Timezone)
+	}
+
+	if w.Schedule != "" {
+		if w.StartsAt != nil || w.EndsAt != nil {
+			return fmt.Errorf("use either schedule and duration or starts_at and ends_at")
+		}
+		if _, err := ParseSchedule(w.Schedule); err != nil {
+			return err
+		}
+		if w.Duration <= 0 {
+			return fmt.Errorf("duration (minutes) is required for a recurring window")
+		}
+		return nil
+	}
+
+	if w.StartsAt == nil || w.EndsAt == nil {
+		return fmt.Errorf("either schedule and duration or starts_at and ends_at are required")
+	}
+	if !w.EndsAt.After(*w.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	start, end := w.StartsAt.UTC(), w.EndsAt.UTC()
+	w.StartsAt, w.EndsAt = &start, &end
+	w.Duration = 0
+
+	return nil
+}
+
+// location returns the window's time zone, falling back to UTC
+func location(w *models.MaintenanceWindow) *time.Location {
+	if loc, err := time.LoadLocation(w.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// Current returns the occurrence of the window in progress at now, if any
+func Current(w *models.MaintenanceWindow, now time.Time) *Period {
+	if w.Schedule == "" {
+		if w.StartsAt == nil || w.EndsAt == nil {
+			return nil
+		}
+		if !now.Before(*w.StartsAt) && now.Before(*w.EndsAt) {
+			return &Period{Window: w, Start: w.StartsAt.UTC(), End: w.EndsAt.UTC()}
+		}
+		return nil
+	}
+
+	schedule, err := ParseSchedule(w.Schedule)
+	if err != nil {
+		return nil
+	}
+
+	// Only occurrences starting within the last duration can still be
+	// running. Recurrence is evaluated in the window's time zone so that
+	// "0 22 * * *" follows local wall clock time across DST changes.
+	duration := time.Duration(w.Duration) * time.Minute
+	start := schedule.Next(now.Add(-duration).Add(-time.Minute).In(location(w)))
+	for !start.IsZero() && !start.After(now) {
+		if end := start.Add(duration); now.Before(end) {
+			return &Period{Window: w, Start: start.UTC(), End: end.UTC()}
+		}
+		start = schedule.Next(start)
+	}
+
+	return nil
+}
+
+// Next returns the first occurrence of the window starting after now, or nil
+// if there is none, e.g. a one-off window in the past
+func Next(w *models.MaintenanceWindow, now time.Time) *Period {
+	if w.Schedule == "" {
+		if w.StartsAt == nil || w.EndsAt == nil || !w.StartsAt.After(now) {
+			return nil
+		}
+		return &Period{Window: w, Start: w.StartsAt.UTC(), End: w.EndsAt.UTC()}
+	}
+
+	schedule, err := ParseSchedule(w.Schedule)
+	if err != nil {
+		return nil
+	}
+
+	start := schedule.Next(now.In(location(w)))
+	if start.IsZero() {
+		return nil
+	}
+
+	return &Period{
+		Window: w,
+		Start:  start.UTC(),
+		End:    start.Add(time.Duration(w.Duration) * time.Minute).UTC(),
+	}
+}
+
+// Applies reports whether the window gates op on a machine in the given groups
+func Applies(w *models.MaintenanceWindow, machineID string, groupIDs []string, op string) bool {
+	if !w.Enabled || !w.CoversOperation(op) {
+		return false
+	}
+
+	switch w.Scope {
+	case models.MaintenanceScopeAll:
+		return true
+	case models.MaintenanceScopeMachine:
+		return w.ScopeID == machineID
+	case models.MaintenanceScopeGroup:
+		for _, id := range groupIDs {
+			if id == w.ScopeID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check decides whether op may run on a machine now. Machines that no
+// window applies to are unrestricted; otherwise one of the applicable
+// windows must be active. One-off windows that have ended no longer apply,
+// so a past window does not lock its machines forever.
+func Check(windows []*models.MaintenanceWindow, machineID string, groupIDs []string, op string, now time.Time) Decision {
+	decision := Decision{Allowed: true}
+
+	for _, w := range windows {
+		if !Applies(w, machineID, groupIDs, op) {
+			continue
+		}
+		if w.Schedule == "" && w.EndsAt != nil && !now.Before(*w.EndsAt) {
+			continue
+		}
+
+		if current := Current(w, now); current != nil {
+			return Decision{Allowed: true, Active: current}
+		}
+
+		decision.Allowed = false
+		if next := Next(w, now); next != nil && (decision.Next == nil || next.Start.Before(decision.Next.Start)) {
+			decision.Next = next
+		}
+	}
+
+	return decision
+}
+
+// Message explains a blocked decision, naming the next window in its own
+// time zone
+func (d Decision) Message(op string) string {
+	if d.Next == nil {
+		return fmt.Sprintf("%s operations are only allowed during a maintenance window and none is scheduled", op)
+	}
+
+	loc := location(d.Next.Window)
+	return fmt.Sprintf("%s operations are only allowed during a maintenance window; next window is %q from %s to %s",
+		op, d.Next.Window.Name,
+		d.Next.Start.In(loc).Format("2006-01-02 15:04 MST"),
+		d.Next.End.In(loc).Format("2006-01-02 15:04 MST"))
+}
+
+// Summary is the overall maintenance state shown on the dashboard
+type Summary struct {
+	Active []*Period `json:"active"`
+	Next   *Period   `json:"next,omitempty"`
+}
+
+// Summarize returns the enabled windows in progress at now and the next one
+// to start
+func Summarize(windows []*models.MaintenanceWindow, now time.Time) Summary {
+	summary := Summary{Active: []*Period{}}
+
+	for _, w := range windows {
+		if !w.Enabled {
+			continue
+		}
+		if current := Current(w, now); current != nil {
+			summary.Active = append(summary.Active, current)
+		}
+		if next := Next(w, now); next != nil && (summary.Next == nil || next.Start.Before(summary.Next.Start)) {
+			summary.Next = next
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// NormalizeIP returns an IPv4 or IPv6 address in the form addresses are
+// stored in: IPv4 in dotted decimal, including IPv4-mapped IPv6 addresses,
+// and IPv6 compressed and lowercase (RFC 5952). Brackets around an IPv6
+// literal are dropped. Zones are refused, since they only mean something
+// on the host that wrote them.
+func NormalizeIP(ip string) (string, error) {
+	raw := strings.TrimSpace(ip)
+	if strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]") {
+		raw = raw[1 : len(raw)-1]
+	}
+
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid IP address", ip)
+	}
+	if addr.Zone() != "" {
+		return "", fmt.Errorf("%q has a zone, which only applies on one host", ip)
+	}
+	return addr.Unmap().String(), nil
+}
+
+// IPForms returns the spellings of an address that stored addresses may
+// have, for matching it exactly: its normalized form, and for IPv4 its
+// IPv4-mapped IPv6 form, or for IPv6 its fully expanded form. It returns
+// nil if ip is not an IP address.
+func IPForms(ip string) []string {
+	normalized, err := NormalizeIP(ip)
+	if err != nil {
+		return nil
+	}
+
+	addr := netip.MustParseAddr(normalized)
+	if addr.Is4() {
+		return []string{normalized, "::ffff:" + normalized}
+	}
+	if expanded := addr.StringExpanded(); expanded != normalized {
+		return []string{normalized, expanded}
+	}
+	return []string{normalized}
+}
+
+// NormalizeHost returns a host name or IP address, such as a BMC's, in its
+// stored form: IP addresses normalized by NormalizeIP and host names
+// lowercase
+func NormalizeHost(host string) (string, error) {
+	host = strings.TrimSpace(host)
+	if ip, err := NormalizeIP(host); err == nil {
+		return ip, nil
+	}
+	if strings.ContainsAny(host, ":[]%") {
+		return "", fmt.Errorf("%q is not a valid IP address", host)
+	}
+	if !validHostName(host) {
+		return "", fmt.Errorf("%q is not a valid host name or IP address", host)
+	}
+	return strings.ToLower(host), nil
+}
+
+// validHostName reports whether s is a DNS name: dot-separated labels of
+// letters, digits, and hyphens, neither starting nor ending with a hyphen
+func validHostName(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// NormalizeAddress validates the BMC's address and puts it in its stored
+// form. An empty address is left alone; BMCs can be saved before they are
+// reachable.
+func (b *BMCInfo) NormalizeAddress() error {
+	if b.IPAddress == "" {
+		return nil
+	}
+	host, err := NormalizeHost(b.IPAddress)
+	if err != nil {
+		return fmt.Errorf("ip_address: %w", err)
+	}
+	b.IPAddress = host
+	return nil
+}
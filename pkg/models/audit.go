@@ -0,0 +1,28 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry records one mutating API request or login attempt: who made
+// it, what it targeted, and how it ended. Request bodies are not kept,
+// except for the fields in the server's audit allowlist.
+type AuditEntry struct {
+	ID      string `json:"id"`
+	Actor   string `json:"actor,omitempty"` // Username; for logins, the username tried
+	ActorID string `json:"actor_id,omitempty"`
+
+	// The admin who made the request while impersonating the actor
+	Impersonator   string `json:"impersonator,omitempty"`
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
+
+	Method    string            `json:"method"`
+	Route     string            `json:"route"` // Route template, e.g. /api/v1/machines/{id}
+	Targets   map[string]string `json:"targets,omitempty"`
+	Fields    json.RawMessage   `json:"fields,omitempty"`
+	Status    int               `json:"status"`
+	SourceIP  string            `json:"source_ip"`
+	RequestID string            `json:"request_id,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
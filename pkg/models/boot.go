@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Boot decisions: which script the iPXE server serves a machine
+const (
+	BootDecisionCustom         = "custom"         // The machine's own image
+	BootDecisionRegistration   = "registration"   // The registration image
+	BootDecisionWipe           = "wipe"           // The disk wipe image
+	BootDecisionLocalDisk      = "local_disk"     // Exit to boot NixOS from disk
+	BootDecisionDecommissioned = "decommissioned" // Refuse to boot
+	BootDecisionOverride       = "override"       // The machine's boot override
+)
+
+// BootRequest records a boot script the iPXE server served to a machine, or
+// would serve it now when previewed. Reason explains the decision, such as
+// why a machine got the registration image instead of its own.
+type BootRequest struct {
+	ID         string `json:"id,omitempty"`
+	MachineID  string `json:"machine_id,omitempty"`
+	ServiceTag string `json:"service_tag"`
+	ClientIP   string `json:"client_ip,omitempty"`
+
+	// Client platform, as detected by the iPXE server
+	Flavor   string `json:"flavor"` // ipxe, grub, efi
+	Arch     string `json:"arch"`
+	BootMode string `json:"boot_mode"`
+
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+
+	// Script is the boot script served. UEFI HTTP boot clients get a
+	// redirect to Redirect instead, or an HTTP error Status.
+	Script   string `json:"script,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	Status   int    `json:"status"`
+
+	// ArtifactsVersion is the build whose image was served
+	ArtifactsVersion string    `json:"artifacts_version,omitempty"`
+	RequestedAt      time.Time `json:"requested_at"`
+}
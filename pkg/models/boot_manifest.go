@@ -0,0 +1,123 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BootManifest is everything an iPXE server needs to serve machines
+// without reaching the API: each machine's boot decision inputs and image,
+// and the registration image unknown machines get
+type BootManifest struct {
+	GeneratedAt  time.Time             `json:"generated_at"`
+	Registration BootManifestImage     `json:"registration"`
+	Machines     []BootManifestMachine `json:"machines"`
+}
+
+// BootManifestMachine is what the iPXE server decides a machine's boot
+// from, as it would from the machine's record in the API
+type BootManifestMachine struct {
+	ID              string `json:"id"`
+	ServiceTag      string `json:"service_tag"`
+	Hostname        string `json:"hostname,omitempty"`
+	Status          string `json:"status"`
+	BootMode        string `json:"boot_mode,omitempty"`
+	Arch            string `json:"arch,omitempty"`
+	DeployMode      string `json:"deploy_mode,omitempty"`
+	HardwareRefresh bool   `json:"hardware_refresh,omitempty"`
+	LastBuildID     string `json:"last_build_id,omitempty"`
+	StaleBuild      bool   `json:"stale_build,omitempty"`
+
+	// Image is the machine's netboot image, if it has a successful build
+	Image *BootManifestImage `json:"image,omitempty"`
+}
+
+// BootManifestImage is an image directory the iPXE server serves, and the
+// files in it the manifest vouches for
+type BootManifestImage struct {
+	// Dir is slash-separated, relative to the images directory
+	Dir     string `json:"dir"`
+	Version int    `json:"version,omitempty"` // Of a promoted system image
+
+	// Init is the NixOS init path the kernel command line boots
+	Init      string                 `json:"init,omitempty"`
+	Artifacts []BootManifestArtifact `json:"artifacts"`
+}
+
+// BootManifestArtifact is a file of an image, by name within its directory
+type BootManifestArtifact struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Artifact returns the image's file with a name, or nil
+func (i *BootManifestImage) Artifact(name string) *BootManifestArtifact {
+	for k := range i.Artifacts {
+		if i.Artifacts[k].Name == name {
+			return &i.Artifacts[k]
+		}
+	}
+	return nil
+}
+
+// SignedBootManifest is a boot manifest as exported: its JSON exactly as
+// signed, the Ed25519 signature of those bytes, and the public key that
+// verifies it. iPXE servers verify against a key they are configured with,
+// never the one in the file.
+type SignedBootManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+	PublicKey string          `json:"public_key"`
+}
+
+// ErrBootManifestSignature is returned for manifests that don't verify
+var ErrBootManifestSignature = errors.New("boot manifest signature does not verify")
+
+// SignBootManifest encodes and signs a boot manifest
+func SignBootManifest(manifest *BootManifest, key ed25519.PrivateKey) (*SignedBootManifest, error) {
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedBootManifest{
+		Manifest:  payload,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}, nil
+}
+
+// Verify checks the manifest's signature against publicKey and decodes it.
+// The manifest is signed as compact JSON, so a file that was reindented
+// still verifies.
+func (m *SignedBootManifest) Verify(publicKey ed25519.PublicKey) (*BootManifest, error) {
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, m.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode boot manifest: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil || !ed25519.Verify(publicKey, payload.Bytes(), signature) {
+		return nil, ErrBootManifestSignature
+	}
+
+	var manifest BootManifest
+	if err := json.Unmarshal(payload.Bytes(), &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode boot manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// ParseBootManifestKey decodes a base64 Ed25519 public key, as exported
+// with boot manifests
+func ParseBootManifestKey(value string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("boot manifest public key must be a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
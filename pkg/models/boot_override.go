@@ -0,0 +1,155 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Boot asset kinds
+const (
+	BootAssetKernel = "kernel"
+	BootAssetInitrd = "initrd"
+	BootAssetISO    = "iso"
+)
+
+// MaxBootOverrideScriptBytes limits the size of a raw boot override script
+const MaxBootOverrideScriptBytes = 64 << 10
+
+// BootAsset is a file uploaded for boot overrides, such as a vendor
+// firmware-update ISO or an installer's kernel. The iPXE server serves it
+// from its boot assets directory, where it is stored under its SHA-256.
+type BootAsset struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Kind       string    `json:"kind"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	UploadedBy string    `json:"uploaded_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// BootOverride makes the iPXE server serve a machine something other than
+// what its status calls for, such as a Debian installer, until it has been
+// served MaxBoots times or ExpiresAt passes. It serves either Script as is,
+// or a script that boots the Kernel asset with Initrd and Cmdline, or
+// sanboots the ISO asset.
+type BootOverride struct {
+	MachineID string `json:"machine_id"`
+
+	Script        string `json:"script,omitempty"`
+	KernelAssetID string `json:"kernel_asset_id,omitempty"`
+	InitrdAssetID string `json:"initrd_asset_id,omitempty"`
+	ISOAssetID    string `json:"iso_asset_id,omitempty"`
+	Cmdline       string `json:"cmdline,omitempty"`
+
+	// The assets, filled in when the override is read
+	Kernel *BootAsset `json:"kernel,omitempty"`
+	Initrd *BootAsset `json:"initrd,omitempty"`
+	ISO    *BootAsset `json:"iso,omitempty"`
+
+	// MaxBoots is how many times the override is served, or 0 for no
+	// limit; BootsServed counts them
+	MaxBoots    int        `json:"max_boots,omitempty"`
+	BootsServed int        `json:"boots_served"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+
+	// DiagnosticRunID is the diagnostic run that set the override, if one
+	// did
+	DiagnosticRunID string `json:"diagnostic_run_id,omitempty"`
+
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Expired reports whether the override has been used up or has expired
+func (o *BootOverride) Expired(now time.Time) bool {
+	if o.MaxBoots > 0 && o.BootsServed >= o.MaxBoots {
+		return true
+	}
+	return o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
+}
+
+// SetBootOverrideRequest sets a machine's boot override, replacing any it
+// has. It needs exactly one of Script, KernelAssetID, or ISOAssetID, and
+// MaxBoots, ExpiresAt, or both.
+type SetBootOverrideRequest struct {
+	Script        string     `json:"script,omitempty"`
+	KernelAssetID string     `json:"kernel_asset_id,omitempty"`
+	InitrdAssetID string     `json:"initrd_asset_id,omitempty"`
+	ISOAssetID    string     `json:"iso_asset_id,omitempty"`
+	Cmdline       string     `json:"cmdline,omitempty"`
+	MaxBoots      int        `json:"max_boots,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+}
+
+// bootCmdlinePattern is what a boot override's kernel command line may
+// contain. It is written into an iPXE script, where ${...} would be
+// expanded and a line break would start another command.
+var bootCmdlinePattern = regexp.MustCompile(`^[A-Za-z0-9 =,._:/+@%~-]*$`)
+
+// bootAssetNamePattern is what an asset's file name may be. It ends up in
+// the URL of the served script.
+var bootAssetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,127}$`)
+
+// Validate checks a boot override request
+func (r *SetBootOverrideRequest) Validate(now time.Time) error {
+	set := 0
+	for _, v := range []string{r.Script, r.KernelAssetID, r.ISOAssetID} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of script, kernel_asset_id, or iso_asset_id is required")
+	}
+
+	if r.Script != "" {
+		if len(r.Script) > MaxBootOverrideScriptBytes {
+			return fmt.Errorf("script must be at most %d bytes", MaxBootOverrideScriptBytes)
+		}
+		if !strings.HasPrefix(r.Script, "#!ipxe") {
+			return fmt.Errorf("script must be an iPXE script starting with #!ipxe")
+		}
+		if strings.ContainsRune(r.Script, 0) {
+			return fmt.Errorf("script cannot contain NUL bytes")
+		}
+	}
+	if r.KernelAssetID == "" && (r.InitrdAssetID != "" || r.Cmdline != "") {
+		return fmt.Errorf("initrd_asset_id and cmdline need kernel_asset_id")
+	}
+	if !ValidBootCmdline(r.Cmdline) {
+		return fmt.Errorf("cmdline must be at most 1024 letters, digits, spaces, and = , . _ : / + @ %% ~ -")
+	}
+
+	if r.MaxBoots < 0 {
+		return fmt.Errorf("max_boots cannot be negative")
+	}
+	if r.MaxBoots == 0 && r.ExpiresAt == nil {
+		return fmt.Errorf("max_boots or expires_at is required")
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+		return fmt.Errorf("expires_at must be in the future")
+	}
+	return nil
+}
+
+// ValidBootCmdline reports whether a kernel command line is safe to write
+// into a boot script
+func ValidBootCmdline(cmdline string) bool {
+	return len(cmdline) <= 1024 && bootCmdlinePattern.MatchString(cmdline)
+}
+
+// ValidateBootAsset checks an uploaded asset's name and kind
+func ValidateBootAsset(name, kind string) error {
+	switch kind {
+	case BootAssetKernel, BootAssetInitrd, BootAssetISO:
+	default:
+		return fmt.Errorf("kind must be kernel, initrd, or iso")
+	}
+	if !bootAssetNamePattern.MatchString(name) {
+		return fmt.Errorf("file name must be 1-128 letters, digits, and . _ + -, starting with a letter or digit")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// BootProfile is a registration image the iPXE server can serve in place of
+// the built-in one, such as one with extra debugging tools for a lab
+// network. The iPXE server picks a profile for a registration boot by the
+// machine's groups, then by the profile the DHCP configuration names in the
+// boot URL, then by the subnet the request comes from.
+type BootProfile struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// KernelPath and InitrdPath are relative to the iPXE server's images
+	// directory, or absolute http(s) URLs
+	KernelPath string `json:"kernel_path"`
+	InitrdPath string `json:"initrd_path"`
+
+	// ExtraCmdline is appended to the kernel command line
+	ExtraCmdline string `json:"extra_cmdline,omitempty"`
+
+	// EnrollmentURL replaces the iPXE server's enrollment URL
+	EnrollmentURL string `json:"enrollment_url,omitempty"`
+
+	// Subnets are CIDRs of the client addresses the profile is served to
+	Subnets []string `json:"subnets"`
+
+	// GroupIDs are groups whose members get the profile when they fall
+	// back to registration. A group has at most one profile.
+	GroupIDs []string `json:"group_ids"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UpdateBootProfileRequest changes the fields of a boot profile that are
+// given. Subnets and GroupIDs are replaced when given; [] removes them.
+type UpdateBootProfileRequest struct {
+	Name          string    `json:"name,omitempty"`
+	Description   *string   `json:"description,omitempty"`
+	KernelPath    string    `json:"kernel_path,omitempty"`
+	InitrdPath    string    `json:"initrd_path,omitempty"`
+	ExtraCmdline  *string   `json:"extra_cmdline,omitempty"`
+	EnrollmentURL *string   `json:"enrollment_url,omitempty"`
+	Subnets       *[]string `json:"subnets,omitempty"`
+	GroupIDs      *[]string `json:"group_ids,omitempty"`
+}
+
+// bootProfileNamePattern keeps names usable as a query parameter in DHCP
+// configurations
+var bootProfileNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// Validate checks a profile and normalizes its subnets
+func (p *BootProfile) Validate() error {
+	if !bootProfileNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, dots, dashes, or underscores")
+	}
+	if p.KernelPath == "" || p.InitrdPath == "" {
+		return fmt.Errorf("kernel_path and initrd_path are required")
+	}
+	for _, path := range []string{p.KernelPath, p.InitrdPath} {
+		if strings.ContainsAny(path, " \t\r\n") {
+			return fmt.Errorf("kernel and initrd paths cannot contain whitespace")
+		}
+		if strings.Contains(path, "://") {
+			if u, err := url.Parse(path); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("kernel and initrd URLs must be http or https")
+			}
+		} else if strings.Contains("/"+path+"/", "/../") {
+			return fmt.Errorf("kernel and initrd paths cannot leave the images directory")
+		}
+	}
+	if strings.ContainsAny(p.ExtraCmdline, "\r\n") {
+		return fmt.Errorf("extra_cmdline must be a single line")
+	}
+	if p.EnrollmentURL != "" {
+		u, err := url.Parse(p.EnrollmentURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("enrollment_url must be an http or https URL")
+		}
+	}
+
+	subnets := make([]string, 0, len(p.Subnets))
+	for _, subnet := range p.Subnets {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(subnet))
+		if err != nil {
+			return fmt.Errorf("invalid subnet %q: must be a CIDR such as 10.0.0.0/24 or 2001:db8::/64", subnet)
+		}
+		subnets = append(subnets, network.String())
+	}
+	p.Subnets = subnets
+
+	if p.GroupIDs == nil {
+		p.GroupIDs = []string{}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// BootSigningKey is a certificate the builder has signed boot artifacts
+// with. Keys are kept after they are rotated out, so the artifacts they
+// signed can still be verified.
+type BootSigningKey struct {
+	// Fingerprint is the SHA-256 of the signing certificate in DER, in
+	// hex, which builds record as their signing key
+	Fingerprint string    `json:"fingerprint"`
+	Subject     string    `json:"subject"`
+	NotAfter    time.Time `json:"not_after"`
+
+	// Certificate is the signing certificate in PEM, followed by any CA
+	// certificates it chains to
+	Certificate string `json:"certificate"`
+
+	FirstUsedAt time.Time `json:"first_used_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+}
@@ -0,0 +1,78 @@
+package models
+
+import "strings"
+
+// BuildDiffPendingConfig names, in place of a build, the configuration a
+// machine's next build would use
+const BuildDiffPendingConfig = "pending-config"
+
+// BuildDiff is what changes between two builds of a machine, or between a
+// build and the machine's next one
+type BuildDiff struct {
+	From string `json:"from"` // Build ID
+	To   string `json:"to"`   // Build ID, or BuildDiffPendingConfig
+
+	// ConfigDiff is a unified diff of the configurations, empty if they
+	// are the same
+	ConfigDiff string `json:"config_diff"`
+
+	// ClosureDiff lists the packages that changed between the system
+	// closures, as the builder recorded it when To was built. It is only
+	// known when To is a build that was diffed against From; otherwise
+	// the diff is of the configurations alone.
+	ClosureDiff    string              `json:"closure_diff,omitempty"`
+	ClosureSummary *ClosureDiffSummary `json:"closure_summary,omitempty"`
+}
+
+// ClosureDiffSummary counts the packages a closure diff adds, removes, and
+// changes the version of. Upgraded counts downgrades too.
+type ClosureDiffSummary struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Upgraded int `json:"upgraded"`
+}
+
+// SummarizeClosureDiff counts the package changes in the output of
+// `nix store diff-closures` or `nvd diff`. Lines that only change a
+// package's size are not counted.
+func SummarizeClosureDiff(diff string) ClosureDiffSummary {
+	var summary ClosureDiffSummary
+	for _, line := range strings.Split(diff, "\n") {
+		line = strings.TrimSpace(line)
+
+		// nvd: "[U.]  #1  name  1.0 -> 1.1", with A added, R removed,
+		// and U, D, or C for version changes
+		if len(line) > 2 && line[0] == '[' {
+			switch line[1] {
+			case 'A':
+				summary.Added++
+			case 'R':
+				summary.Removed++
+			case 'U', 'D', 'C':
+				summary.Upgraded++
+			}
+			continue
+		}
+
+		// diff-closures: "name: 1.0 → 1.1, +1.2 KiB", with ∅ for a
+		// version that isn't there. Lines without an arrow only change
+		// the size.
+		_, change, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		before, after, ok := strings.Cut(change, " → ")
+		if !ok {
+			continue
+		}
+		switch {
+		case strings.Contains(before, "∅") && !strings.Contains(after, "∅"):
+			summary.Added++
+		case strings.Contains(after, "∅") && !strings.Contains(before, "∅"):
+			summary.Removed++
+		default:
+			summary.Upgraded++
+		}
+	}
+	return summary
+}
@@ -0,0 +1,89 @@
+package models
+
+import "time"
+
+// Build schedule scopes
+const (
+	BuildScheduleScopeMachine = "machine"
+	BuildScheduleScopeGroup   = "group"
+)
+
+// Build schedule modes
+const (
+	BuildScheduleRebuild       = "rebuild"        // Queue a build
+	BuildScheduleRebuildReboot = "rebuild_reboot" // Queue a build, then power cycle the machine into it in a maintenance window
+)
+
+// Build schedule run states
+const (
+	ScheduleRunQueued   = "queued"   // Build queued; final for rebuild schedules
+	ScheduleRunBuilding = "building" // Waiting for the build to power cycle into it
+	ScheduleRunWaiting  = "waiting"  // Built, waiting for a maintenance window that allows power operations
+	ScheduleRunRebooted = "rebooted"
+	ScheduleRunSkipped  = "skipped"
+	ScheduleRunFailed   = "failed"
+)
+
+// DefaultScheduleGraceMinutes is how late a schedule still runs when the
+// server was down at its scheduled time
+const DefaultScheduleGraceMinutes = 60
+
+// BuildSchedule rebuilds a machine, or every machine in a group, on a cron
+// schedule, e.g. monthly so machines pick up nixpkgs updates. A machine or
+// group has at most one schedule. The server runs a schedule at most once
+// per due time: a run missed while the server was down happens once when
+// it comes back if it is no more than GraceMinutes late, and is skipped
+// otherwise.
+type BuildSchedule struct {
+	ID      string `json:"id" db:"id"`
+	Scope   string `json:"scope" db:"scope"` // machine, group
+	ScopeID string `json:"scope_id" db:"scope_id"`
+
+	Cron     string `json:"cron" db:"cron"`         // minute hour day-of-month month day-of-week
+	Timezone string `json:"timezone" db:"timezone"` // IANA name the cron expression is in, defaults to UTC
+	Mode     string `json:"mode" db:"mode"`         // rebuild, rebuild_reboot
+
+	// SkipUnchanged skips machines whose configuration is the same as
+	// their latest successful build's
+	SkipUnchanged bool `json:"skip_unchanged" db:"skip_unchanged"`
+	GraceMinutes  int  `json:"grace_minutes" db:"grace_minutes"`
+	Enabled       bool `json:"enabled" db:"enabled"`
+
+	NextRunAt *time.Time `json:"next_run_at,omitempty" db:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty" db:"last_run_at"`
+
+	CreatedBy string    `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// BuildScheduleRequest creates or replaces a machine's or group's build
+// schedule
+type BuildScheduleRequest struct {
+	Cron          string `json:"cron"`
+	Timezone      string `json:"timezone,omitempty"`
+	Mode          string `json:"mode,omitempty"` // Defaults to rebuild
+	SkipUnchanged bool   `json:"skip_unchanged,omitempty"`
+	GraceMinutes  *int   `json:"grace_minutes,omitempty"` // Defaults to DefaultScheduleGraceMinutes
+	Enabled       *bool  `json:"enabled,omitempty"`       // Defaults to true
+}
+
+// BuildScheduleRun is what one scheduled run did for one machine. A run
+// that didn't reach any machine, such as one missed by more than the
+// grace period, has no machine.
+type BuildScheduleRun struct {
+	ID           string     `json:"id" db:"id"`
+	ScheduleID   string     `json:"schedule_id" db:"schedule_id"`
+	MachineID    string     `json:"machine_id,omitempty" db:"machine_id"`
+	ScheduledFor time.Time  `json:"scheduled_for" db:"scheduled_for"`
+	Status       string     `json:"status" db:"status"` // queued, building, waiting, rebooted, skipped, failed
+	BuildID      string     `json:"build_id,omitempty" db:"build_id"`
+	Reason       string     `json:"reason,omitempty" db:"reason"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+}
+
+// IsDone reports whether nothing more will happen for the run
+func (r *BuildScheduleRun) IsDone() bool {
+	return r.Status != ScheduleRunBuilding && r.Status != ScheduleRunWaiting
+}
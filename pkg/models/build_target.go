@@ -0,0 +1,104 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Build targets: what a build of a machine's configuration produces. A
+// netboot build is the image the iPXE server boots the machine with, or
+// the system of a machine that boots from disk. The others are installers
+// and bundles built from the same configuration, which leave what the
+// machine boots as it is.
+const (
+	BuildTargetNetboot = "netboot"  // config.system.build.netbootRamdisk: a kernel and initrd
+	BuildTargetISO     = "iso"      // config.system.build.isoImage: one bootable .iso file
+	BuildTargetSDImage = "sd-image" // config.system.build.sdImage: one disk image, for boards that boot from SD cards
+	BuildTargetKexec   = "kexec"    // config.system.build.kexecTree: a kernel, initrd, and script to kexec into them
+)
+
+// BuildTargets lists the build targets
+var BuildTargets = []string{
+	BuildTargetNetboot,
+	BuildTargetISO,
+	BuildTargetSDImage,
+	BuildTargetKexec,
+}
+
+// buildTargetArchitectures are the architectures each target can be built
+// for, where not all of them. NixOS only builds SD images for ARM boards.
+var buildTargetArchitectures = map[string][]string{
+	BuildTargetISO:     {"x86_64", "aarch64", "i686"},
+	BuildTargetSDImage: {"aarch64", "armv7l", "armv6l"},
+	BuildTargetKexec:   {"x86_64", "aarch64"},
+}
+
+// IsValidBuildTarget reports whether target is a build target
+func IsValidBuildTarget(target string) bool {
+	for _, t := range BuildTargets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckBuildTarget returns an error if target isn't a build target, or
+// can't be built for arch. A machine that didn't report its architecture
+// can be built for any target, as it can be built on any builder.
+func CheckBuildTarget(target, arch string) error {
+	if !IsValidBuildTarget(target) {
+		return fmt.Errorf("target must be one of %s", strings.Join(BuildTargets, ", "))
+	}
+
+	arch = NormalizeArchitecture(arch)
+	supported, limited := buildTargetArchitectures[target]
+	if arch == "" || !limited || containsString(supported, arch) {
+		return nil
+	}
+	return fmt.Errorf("%s builds are not supported for %s machines, only %s", target, arch, strings.Join(supported, ", "))
+}
+
+// BootsMachine reports whether the build is of what the machine boots,
+// rather than an installer or bundle built from its configuration. Builds
+// from before targets were recorded are netboot builds.
+func (b *BuildRequest) BootsMachine() bool {
+	return b.Target == "" || b.Target == BuildTargetNetboot
+}
+
+// BuildArtifactMarker is the file in the directory of a build's artifacts
+// that holds the build's ID, so a download can tell whether a later build
+// of the same target replaced them
+const BuildArtifactMarker = ".build-id"
+
+// ArtifactContentTypes are the content types of built artifacts, by file
+// extension, where Go doesn't know them
+var ArtifactContentTypes = map[string]string{
+	".iso": "application/x-iso9660-image",
+	".img": "application/octet-stream",
+	".zst": "application/zstd",
+	".xz":  "application/x-xz",
+	".gz":  "application/gzip",
+}
+
+// ArtifactContentType returns the content type to serve a built artifact
+// with
+func ArtifactContentType(name string) string {
+	if name == "kexec-boot" {
+		return "text/x-shellscript"
+	}
+	if contentType, ok := ArtifactContentTypes[strings.ToLower(path.Ext(name))]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// BuildArtifact is a file a build produced, as the API lists it for
+// download
+type BuildArtifact struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	URL         string `json:"url"`
+}
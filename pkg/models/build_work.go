@@ -0,0 +1,78 @@
+package models
+
+import "time"
+
+// BuildLease is how long a builder holds a build it claimed without
+// renewing the lease. A build whose lease runs out goes back in the queue.
+const BuildLease = 2 * time.Minute
+
+// MaxBuildAttempts is how many times a build is claimed before a lease
+// running out fails it rather than queueing it again
+const MaxBuildAttempts = 3
+
+// MaxBuildClaimWait bounds how long a claim waits for a build to be queued
+const MaxBuildClaimWait = 60 * time.Second
+
+// BuildJob is a build a builder has claimed, with what it needs to run
+// the build
+type BuildJob struct {
+	Build *BuildRequest `json:"build"`
+
+	// Machine builds have the machine, the groups whose build limits
+	// apply, and the machine's latest successful build to diff the
+	// system closure against
+	Machine       *Machine        `json:"machine,omitempty"`
+	Groups        []*MachineGroup `json:"groups,omitempty"`
+	PreviousBuild *BuildRequest   `json:"previous_build,omitempty"`
+
+	// MachineToken is the machine's hooks token, which the builder puts
+	// in the machine's image. Only the API can issue it, so builders that
+	// claim builds from the database build without it.
+	MachineToken string `json:"machine_token,omitempty"`
+
+	// System image builds have the image version being built
+	SystemImage *SystemImage `json:"system_image,omitempty"`
+}
+
+// BuildProgress renews a builder's lease on a build, and reports how far
+// the build has got. Log is appended to the build's log, which keeps at
+// most MaxLogBytes.
+type BuildProgress struct {
+	Builder     string            `json:"builder"`
+	Stage       string            `json:"stage,omitempty"`
+	Environment *BuildEnvironment `json:"environment,omitempty"`
+	Log         string            `json:"log,omitempty"`
+	MaxLogBytes int               `json:"max_log_bytes,omitempty"`
+}
+
+// BuildResult is how a build ended, as its builder reports it. Log
+// replaces whatever log was sent with progress reports.
+type BuildResult struct {
+	Builder string `json:"builder"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+
+	ArtifactURL     string            `json:"artifact_url,omitempty"`
+	ArtifactBytes   int64             `json:"artifact_bytes,omitempty"`
+	CompletedAt     time.Time         `json:"completed_at"`
+	DurationMS      int64             `json:"duration_ms,omitempty"`
+	PeakMemoryBytes int64             `json:"peak_memory_bytes,omitempty"`
+	Environment     *BuildEnvironment `json:"environment,omitempty"`
+
+	SystemPath      string `json:"system_path,omitempty"`
+	ClosureDiffFrom string `json:"closure_diff_from,omitempty"`
+	ClosureDiff     string `json:"closure_diff,omitempty"`
+
+	// SigningKey is the key that signed the build's artifacts, if any
+	SigningKey *BootSigningKey `json:"signing_key,omitempty"`
+
+	// CreateBootTest creates a pending boot test of a successful machine
+	// build even if the build doesn't require one
+	CreateBootTest bool `json:"create_boot_test,omitempty"`
+
+	// Warnings are problems that didn't fail the build
+	Warnings []string `json:"warnings,omitempty"`
+
+	Log         string `json:"log,omitempty"`
+	MaxLogBytes int    `json:"max_log_bytes,omitempty"`
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Builders send a heartbeat every BuilderHeartbeatInterval, and are offline
+// once they have missed a few
+const (
+	BuilderHeartbeatInterval = 30 * time.Second
+	BuilderOfflineAfter      = 3 * BuilderHeartbeatInterval
+)
+
+// BuildEnvironment is the toolchain a builder builds with. Builds record
+// the environment they ran in, so a failure can be traced to a nix upgrade
+// or a channel update.
+type BuildEnvironment struct {
+	BuilderVersion  string `json:"builder_version,omitempty"`
+	NixVersion      string `json:"nix_version,omitempty"`      // nix --version
+	NixpkgsVersion  string `json:"nixpkgs_version,omitempty"`  // lib.version of <nixpkgs>, e.g. 24.05.20240601.abcdef0
+	NixpkgsRevision string `json:"nixpkgs_revision,omitempty"` // Git revision of <nixpkgs>, when known
+}
+
+// Builder is a builder service instance, as of its last heartbeat
+type Builder struct {
+	Name        string           `json:"name"` // Hostname unless configured otherwise
+	Environment BuildEnvironment `json:"environment"`
+	StartedAt   time.Time        `json:"started_at"`
+	LastSeenAt  time.Time        `json:"last_seen_at"`
+
+	// Architectures are the CPU architectures the builder builds for, such
+	// as x86_64 and aarch64, and Labels what else it offers builds, such
+	// as gpu for a builder with CUDA substituters configured
+	Architectures       []string `json:"architectures"`
+	Labels              []string `json:"labels,omitempty"`
+	MaxConcurrentBuilds int      `json:"max_concurrent_builds"`
+
+	// Cordoned builders finish the builds they have but claim no more
+	Cordoned bool `json:"cordoned"`
+
+	// Online is whether the builder has sent a heartbeat recently
+	Online bool `json:"online"`
+
+	// CurrentBuildIDs are the builds the builder is running, and
+	// QueueDepth how many queued builds it could claim
+	CurrentBuildIDs []string `json:"current_build_ids,omitempty"`
+	QueueDepth      int      `json:"queue_depth"`
+
+	// Health is the builder's disk usage as of its last heartbeat, and
+	// Conditions what is wrong with it, such as BuilderConditionLowDisk
+	Health     *BuilderHealth `json:"health,omitempty"`
+	Conditions []string       `json:"conditions,omitempty"`
+
+	// PendingGC is a garbage collection an admin asked for that the
+	// builder hasn't reported yet
+	PendingGC *BuilderGCRequest `json:"pending_gc,omitempty"`
+}
+
+// BuilderConditionLowDisk is the condition of a builder with a filesystem
+// below its free space threshold. It claims no builds until space is freed.
+const BuilderConditionLowDisk = "builder_low_disk"
+
+// Filesystems a builder reports on
+const (
+	BuilderDiskBuildDir  = "build_dir"
+	BuilderDiskOutputDir = "output_dir"
+	BuilderDiskNixStore  = "nix_store"
+)
+
+// BuilderDisk is the usage of a filesystem the builder writes to
+type BuilderDisk struct {
+	Name       string `json:"name"` // One of the BuilderDisk constants
+	Path       string `json:"path"`
+	TotalBytes int64  `json:"total_bytes"`
+	FreeBytes  int64  `json:"free_bytes"`
+
+	// MinFreeBytes is the free space below which the builder claims no
+	// builds; 0 if it has no threshold
+	MinFreeBytes int64 `json:"min_free_bytes,omitempty"`
+}
+
+// Low reports whether the filesystem is below its threshold
+func (d BuilderDisk) Low() bool {
+	return d.MinFreeBytes > 0 && d.FreeBytes < d.MinFreeBytes
+}
+
+// BuilderHealth is what a builder reports about its disks
+type BuilderHealth struct {
+	Disks []BuilderDisk `json:"disks"`
+
+	// NixStoreBytes is the size of the nix store, measured every few
+	// minutes; 0 until first measured
+	NixStoreBytes int64 `json:"nix_store_bytes,omitempty"`
+
+	// LastGC is the builder's most recent garbage collection since it
+	// started
+	LastGC *BuilderGC `json:"last_gc,omitempty"`
+
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// LowDisk reports whether any of the builder's filesystems is below its
+// threshold
+func (h *BuilderHealth) LowDisk() bool {
+	for _, disk := range h.Disks {
+		if disk.Low() {
+			return true
+		}
+	}
+	return false
+}
+
+// BuilderGC is a run of nix-collect-garbage on a builder
+type BuilderGC struct {
+	// RequestID is the ID of the request the run answered, or empty for
+	// a run the builder started because its nix store was low on space
+	RequestID string `json:"request_id,omitempty"`
+
+	MaxFreedBytes int64     `json:"max_freed_bytes,omitempty"` // 0 for no limit
+	FreedBytes    int64     `json:"freed_bytes"`
+	StartedAt     time.Time `json:"started_at"`
+	CompletedAt   time.Time `json:"completed_at"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// BuilderGCRequest asks a builder to collect garbage. The builder picks it
+// up from its next heartbeat and runs it once no build is running.
+type BuilderGCRequest struct {
+	ID            string    `json:"id"`
+	MaxFreedBytes int64     `json:"max_freed_bytes,omitempty"` // 0 for no limit
+	RequestedBy   string    `json:"requested_by,omitempty"`
+	RequestedAt   time.Time `json:"requested_at"`
+}
+
+// RegisterBuilderRequest registers a builder, or renews its registration as
+// a heartbeat
+type RegisterBuilderRequest struct {
+	Name                string           `json:"name"`
+	Environment         BuildEnvironment `json:"environment"`
+	StartedAt           time.Time        `json:"started_at"`
+	Architectures       []string         `json:"architectures"`
+	Labels              []string         `json:"labels,omitempty"`
+	MaxConcurrentBuilds int              `json:"max_concurrent_builds"`
+	Health              *BuilderHealth   `json:"health,omitempty"`
+}
+
+// BuildRequirements are what a build needs of the builder that runs it: the
+// machine's architecture, and the builder labels its groups require
+type BuildRequirements struct {
+	Architecture   string   `json:"architecture,omitempty"`
+	RequiredLabels []string `json:"required_labels,omitempty"`
+}
+
+// CanBuild reports whether the builder has what a build requires. A build
+// with no architecture, from a machine that didn't report one, can run on
+// any builder.
+func (b *Builder) CanBuild(req BuildRequirements) bool {
+	if req.Architecture != "" && !containsString(b.Architectures, req.Architecture) {
+		return false
+	}
+	for _, label := range req.RequiredLabels {
+		if !containsString(b.Labels, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeArchitecture maps the names Go, the kernel, and vendors use for
+// a CPU architecture onto the kernel's, which is what nix systems use
+func NormalizeArchitecture(arch string) string {
+	switch arch = strings.ToLower(strings.TrimSpace(arch)); arch {
+	case "amd64", "x86-64", "x64":
+		return "x86_64"
+	case "arm64", "armv8":
+		return "aarch64"
+	case "386", "i686", "i386":
+		return "i686"
+	}
+	return arch
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+)
+
+// ClaimCodeLength is the number of characters in a claim code, not counting
+// the dash it is displayed with. Each character carries 5 bits.
+const ClaimCodeLength = 10
+
+// claimCodeAlphabet is Crockford's base32, which leaves out I, L, O, and U
+// so codes can be read off a console and typed without confusion
+const claimCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// EnrollmentResponse is the machine an enrollment created or found. An
+// unclaimed machine gets a new claim code each time it enrolls, when claim
+// codes are enabled; the registration image shows it on the console.
+type EnrollmentResponse struct {
+	*Machine
+	ClaimCode          string     `json:"claim_code,omitempty"`
+	ClaimCodeExpiresAt *time.Time `json:"claim_code_expires_at,omitempty"`
+}
+
+// ClaimRequest claims a machine with the code its console shows
+type ClaimRequest struct {
+	Code string `json:"code"`
+}
+
+// FormatClaimCode formats a code as two dash-separated halves, e.g.
+// 7K2M9-QX4TD
+func FormatClaimCode(code string) string {
+	half := len(code) / 2
+	return code[:half] + "-" + code[half:]
+}
+
+// NormalizeClaimCode reads a code as typed: case, dashes, and spaces don't
+// matter, and the letters Crockford's base32 leaves out are read as the
+// digits they look like. It returns "" if the result can't be a code.
+func NormalizeClaimCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "", "O", "0", "I", "1", "L", "1").Replace(code)
+	if len(code) != ClaimCodeLength {
+		return ""
+	}
+	for _, c := range code {
+		if !strings.ContainsRune(claimCodeAlphabet, c) {
+			return ""
+		}
+	}
+	return code
+}
+
+// NewClaimCode generates a random claim code
+func NewClaimCode() (string, error) {
+	random := make([]byte, ClaimCodeLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	// The alphabet has 32 characters, so the low 5 bits pick one evenly
+	code := make([]byte, ClaimCodeLength)
+	for i, b := range random {
+		code[i] = claimCodeAlphabet[b&31]
+	}
+	return string(code), nil
+}
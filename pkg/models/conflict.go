@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// Machine identity fields that must not be shared between machines
+const (
+	IdentityMACAddress   = "mac_address"
+	IdentitySerialNumber = "serial_number"
+)
+
+// DuplicateHostname marks a MachineDuplicate of machines with the same
+// hostname. Hostnames aren't identity, but two machines must not share one
+// either.
+const DuplicateHostname = "hostname"
+
+// Ways of resolving a conflict between two machines with the same MAC
+// address or serial number
+const (
+	// ConflictMerge merges the machine into the other one, which takes its
+	// service tag, MAC address, and hardware report along with its builds,
+	// events, metrics, and group memberships
+	ConflictMerge = "merge"
+
+	// ConflictSupersede keeps the machine and decommissions the other one
+	ConflictSupersede = "supersede"
+
+	// ConflictReject deletes a held enrollment and leaves the other machine
+	// as it is
+	ConflictReject = "reject"
+)
+
+// MachineConflict records why an enrollment is held: a MAC address or
+// serial number it reported already belongs to another machine
+type MachineConflict struct {
+	MachineID         string    `json:"machine_id"`
+	ExistingMachineID string    `json:"existing_machine_id"`
+	Field             string    `json:"field"` // mac_address or serial_number
+	Value             string    `json:"value"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// ConflictResolution resolves a conflict between a machine and another
+// machine with the same MAC address or serial number
+type ConflictResolution struct {
+	Action string `json:"action"` // merge, supersede, or reject
+
+	// The other machine. It defaults to the machine a held enrollment
+	// conflicts with.
+	MachineID string `json:"machine_id,omitempty"`
+}
+
+// MachineDuplicate is a MAC address, serial number, or hostname that more
+// than one machine claims
+type MachineDuplicate struct {
+	Field    string              `json:"field"` // mac_address, serial_number, or hostname
+	Value    string              `json:"value"`
+	Machines []*DuplicateMachine `json:"machines"` // Oldest first
+}
+
+// DuplicateMachine is one of the machines in a MachineDuplicate
+type DuplicateMachine struct {
+	ID           string        `json:"id"`
+	ServiceTag   string        `json:"service_tag"`
+	MACAddress   string        `json:"mac_address"`
+	SerialNumber string        `json:"serial_number,omitempty"`
+	Status       MachineStatus `json:"status"`
+	Hostname     string        `json:"hostname,omitempty"`
+	EnrolledAt   time.Time     `json:"enrolled_at"`
+	LastSeenAt   *time.Time    `json:"last_seen_at,omitempty"`
+
+	// The machine a held enrollment conflicts with
+	ConflictsWith string `json:"conflicts_with,omitempty"`
+
+	// InTrash is set for a machine in the trash, which keeps its hostname
+	InTrash bool `json:"in_trash,omitempty"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// DatabaseCheck is the result of checking the database for corruption.
+// SQLite databases are checked with PRAGMA integrity_check, and on demand
+// also with quick_check; other databases aren't checked.
+type DatabaseCheck struct {
+	Driver string `json:"driver"`
+	OK     bool   `json:"ok"`
+
+	// IntegrityCheck and QuickCheck are what the pragmas reported: "ok",
+	// or the problems they found
+	IntegrityCheck []string `json:"integrity_check,omitempty"`
+	QuickCheck     []string `json:"quick_check,omitempty"`
+
+	// Message says why the database wasn't checked
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
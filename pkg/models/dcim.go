@@ -0,0 +1,105 @@
+package models
+
+import "time"
+
+// DCIM sync actions, one per device in a sync report
+const (
+	DCIMSyncCreated  = "created"  // A preregistered machine was created
+	DCIMSyncUpdated  = "updated"  // Synced fields of a machine were updated
+	DCIMSyncSkipped  = "skipped"  // The device couldn't be synced, e.g. it has no serial number
+	DCIMSyncConflict = "conflict" // Fields edited here since the last sync were left alone
+)
+
+// DCIMFields are the machine fields a DCIM is the source of truth for
+type DCIMFields struct {
+	Datacenter string   `json:"datacenter,omitempty"`
+	Rack       string   `json:"rack,omitempty"`
+	RackUnit   int      `json:"rack_unit,omitempty"`
+	BMCAddress string   `json:"bmc_address,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// DCIMRecord links a machine to the DCIM device it was synced from, with
+// the field values the last sync wrote. A field that no longer has its
+// synced value was edited here.
+type DCIMRecord struct {
+	MachineID  string     `json:"machine_id"`
+	Source     string     `json:"source"`
+	ExternalID string     `json:"external_id"`
+	Synced     DCIMFields `json:"synced"`
+	SyncedAt   time.Time  `json:"synced_at"`
+}
+
+// DCIMSyncReport is the outcome of one sync from a DCIM
+type DCIMSyncReport struct {
+	ID         string     `json:"id"`
+	Source     string     `json:"source"`
+	Force      bool       `json:"force"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"`
+	Conflicts int `json:"conflicts"`
+
+	// Error is why the sync failed, if it did; devices fetched before
+	// that are still reported
+	Error string `json:"error,omitempty"`
+
+	// Items lists every device that was not unchanged
+	Items []DCIMSyncItem `json:"items,omitempty"`
+}
+
+// DCIMSyncItem is what a sync did with one device
+type DCIMSyncItem struct {
+	Device     string   `json:"device"` // The device's name in the DCIM
+	ExternalID string   `json:"external_id,omitempty"`
+	ServiceTag string   `json:"service_tag,omitempty"`
+	MachineID  string   `json:"machine_id,omitempty"`
+	Action     string   `json:"action"`
+	Fields     []string `json:"fields,omitempty"` // Fields updated, or in conflict
+	Message    string   `json:"message,omitempty"`
+}
+
+// DCIMSyncRequest starts a sync. Force overwrites fields edited here since
+// the last sync.
+type DCIMSyncRequest struct {
+	Force bool `json:"force"`
+}
+
+// DCIMFields returns the machine's values of the fields a DCIM syncs
+func (m *Machine) DCIMFields() DCIMFields {
+	var fields DCIMFields
+	if m.Location != nil {
+		fields.Datacenter = m.Location.Datacenter
+		fields.Rack = m.Location.Rack
+		fields.RackUnit = m.Location.RackUnit
+	}
+	if m.BMCInfo != nil {
+		fields.BMCAddress = m.BMCInfo.IPAddress
+	}
+	fields.Tags = m.Tags
+	return fields
+}
+
+// SetDCIMFields sets the fields a DCIM syncs, leaving the rest of the
+// machine's BMC details alone
+func (m *Machine) SetDCIMFields(fields DCIMFields) {
+	location := Location{Datacenter: fields.Datacenter, Rack: fields.Rack, RackUnit: fields.RackUnit}
+	if location == (Location{}) {
+		m.Location = nil
+	} else {
+		m.Location = &location
+	}
+
+	if m.BMCInfo == nil && fields.BMCAddress != "" {
+		m.BMCInfo = &BMCInfo{}
+	}
+	if m.BMCInfo != nil {
+		m.BMCInfo.IPAddress = fields.BMCAddress
+	}
+
+	m.Tags = fields.Tags
+}
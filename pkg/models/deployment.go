@@ -0,0 +1,113 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Deployment states
+const (
+	DeploymentPending    = "pending"
+	DeploymentRunning    = "running"
+	DeploymentSucceeded  = "succeeded"
+	DeploymentFailed     = "failed"
+	DeploymentRolledBack = "rolled_back" // The switch or health check failed and the previous generation was restored
+	DeploymentCancelled  = "cancelled"   // An earlier deployment in the rollout failed
+)
+
+// Health check types
+const (
+	HealthCheckHTTP    = "http"
+	HealthCheckCommand = "command"
+)
+
+// Deployment switches a running machine to the system built by a successful
+// build. The builder copies the closure over SSH, activates it, runs the
+// health check, and rolls back to the previous generation if either fails.
+type Deployment struct {
+	ID        string `json:"id" db:"id"`
+	MachineID string `json:"machine_id" db:"machine_id"`
+	BuildID   string `json:"build_id" db:"build_id"`
+	Status    string `json:"status" db:"status"` // pending, running, succeeded, failed, rolled_back, cancelled
+
+	HealthCheck *HealthCheck `json:"health_check,omitempty" db:"health_check"`
+
+	// Set for deployments that are part of a group rollout. At most
+	// MaxUnavailable deployments of a rollout run at once, and the rest are
+	// cancelled if one fails.
+	RolloutID      string `json:"rollout_id,omitempty" db:"rollout_id"`
+	MaxUnavailable int    `json:"max_unavailable,omitempty" db:"max_unavailable"`
+
+	SystemPath     string `json:"system_path,omitempty" db:"system_path"`         // Store path that was deployed
+	PreviousSystem string `json:"previous_system,omitempty" db:"previous_system"` // What the machine ran before
+	LogOutput      string `json:"log_output,omitempty" db:"log_output"`
+	Error          string `json:"error,omitempty" db:"error"`
+
+	CreatedBy   string     `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty" db:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+}
+
+// IsActive reports whether the deployment is waiting to run or running
+func (d *Deployment) IsActive() bool {
+	return d.Status == DeploymentPending || d.Status == DeploymentRunning
+}
+
+// HealthCheck is run after a machine switches to a new system. Until it
+// passes or Timeout runs out, it is retried every few seconds.
+type HealthCheck struct {
+	Type    string `json:"type"`                      // http or command
+	URL     string `json:"url,omitempty"`             // http: must answer with a 2xx status
+	Command string `json:"command,omitempty"`         // command: run on the machine over SSH, must exit 0
+	Timeout int    `json:"timeout_seconds,omitempty"` // Default 60
+}
+
+// Validate checks that the health check has what its type needs
+func (h *HealthCheck) Validate() error {
+	switch h.Type {
+	case HealthCheckHTTP:
+		if h.URL == "" {
+			return fmt.Errorf("health_check.url is required for http checks")
+		}
+	case HealthCheckCommand:
+		if h.Command == "" {
+			return fmt.Errorf("health_check.command is required for command checks")
+		}
+	default:
+		return fmt.Errorf("health_check.type must be http or command")
+	}
+
+	if h.Timeout < 0 {
+		return fmt.Errorf("health_check.timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+// DeployRequest deploys a build to a machine. Without a build ID, the
+// machine's most recent successful build is deployed.
+type DeployRequest struct {
+	BuildID     string       `json:"build_id,omitempty"`
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+// GroupDeployRequest deploys each machine in a group's most recent
+// successful build, MaxUnavailable machines at a time
+type GroupDeployRequest struct {
+	MaxUnavailable int          `json:"max_unavailable,omitempty"` // Default 1
+	HealthCheck    *HealthCheck `json:"health_check,omitempty"`
+}
+
+// GroupDeployResponse lists the deployments a group rollout created and the
+// machines it left out
+type GroupDeployResponse struct {
+	RolloutID   string           `json:"rollout_id"`
+	Deployments []*Deployment    `json:"deployments"`
+	Skipped     []SkippedMachine `json:"skipped,omitempty"`
+}
+
+// SkippedMachine is a group member a rollout could not deploy to
+type SkippedMachine struct {
+	MachineID string `json:"machine_id"`
+	Reason    string `json:"reason"`
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Diagnostic run states
+const (
+	DiagnosticsRunning   = "running"
+	DiagnosticsCompleted = "completed" // The diagnostics image posted its results
+	DiagnosticsExpired   = "expired"   // The duration ran out without results
+	DiagnosticsCancelled = "cancelled"
+)
+
+// MaxDiagnosticsMinutes bounds how long a machine can be kept in
+// diagnostics
+const MaxDiagnosticsMinutes = 7 * 24 * 60
+
+// DiagnosticProfile is a diagnostics image a machine can be booted into for
+// a while, such as memtest or a stress-ng live image, booted from uploaded
+// boot assets
+type DiagnosticProfile struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Description   string    `json:"description,omitempty"`
+	KernelAssetID string    `json:"kernel_asset_id"`
+	InitrdAssetID string    `json:"initrd_asset_id,omitempty"`
+	Cmdline       string    `json:"cmdline,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// UpdateDiagnosticProfileRequest changes the fields of a diagnostic profile
+// that are given
+type UpdateDiagnosticProfileRequest struct {
+	Name          string  `json:"name,omitempty"`
+	Description   *string `json:"description,omitempty"`
+	KernelAssetID string  `json:"kernel_asset_id,omitempty"`
+	InitrdAssetID *string `json:"initrd_asset_id,omitempty"` // "" removes it
+	Cmdline       *string `json:"cmdline,omitempty"`
+}
+
+// Validate checks a diagnostic profile. Its assets are checked by the
+// caller.
+func (p *DiagnosticProfile) Validate() error {
+	if !bootProfileNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, dots, dashes, or underscores")
+	}
+	if p.KernelAssetID == "" {
+		return fmt.Errorf("kernel_asset_id is required")
+	}
+	if !ValidBootCmdline(p.Cmdline) {
+		return fmt.Errorf("cmdline must be at most 1024 letters, digits, spaces, and = , . _ : / + @ %% ~ -")
+	}
+	return nil
+}
+
+// DiagnosticRun boots a machine into a diagnostic profile until its
+// diagnostics image posts results or EndsAt passes, and then back to what
+// it normally boots. The machine's status is left alone throughout.
+type DiagnosticRun struct {
+	ID          string `json:"id"`
+	MachineID   string `json:"machine_id"`
+	ProfileID   string `json:"profile_id"`
+	ProfileName string `json:"profile_name"`
+	Status      string `json:"status"` // running, completed, expired, cancelled
+
+	// PowerCycle is whether the machine is power cycled through its BMC
+	// into diagnostics, set to boot from the network, and again out of
+	// them
+	PowerCycle bool `json:"power_cycle"`
+
+	Results *DiagnosticResults `json:"results,omitempty"`
+
+	RequestedBy string     `json:"requested_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	EndsAt      time.Time  `json:"ends_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// DiagnosticResults is what a diagnostics image reports when it is done
+type DiagnosticResults struct {
+	Passed  bool   `json:"passed"`
+	Memtest string `json:"memtest,omitempty"` // passed or failed, if memtest ran
+	Stress  string `json:"stress,omitempty"`  // Summary of the stress test, if one ran
+	Details string `json:"details,omitempty"` // Anything else, such as vendor tool output
+}
+
+// StartDiagnosticsRequest boots a machine into a diagnostic profile for
+// DurationMinutes
+type StartDiagnosticsRequest struct {
+	ProfileID       string `json:"profile_id"`
+	DurationMinutes int    `json:"duration_minutes"`
+	PowerCycle      bool   `json:"power_cycle"`
+}
+
+// Validate checks a request to start diagnostics
+func (r *StartDiagnosticsRequest) Validate() error {
+	if r.ProfileID == "" {
+		return fmt.Errorf("profile_id is required")
+	}
+	if r.DurationMinutes <= 0 || r.DurationMinutes > MaxDiagnosticsMinutes {
+		return fmt.Errorf("duration_minutes must be between 1 and %d", MaxDiagnosticsMinutes)
+	}
+	return nil
+}
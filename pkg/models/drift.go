@@ -0,0 +1,82 @@
+package models
+
+// DriftOptions are the tolerance rules for comparing machines. Sizes are
+// compared rounded to the nearest bucket; a bucket of 0 compares them
+// exactly.
+type DriftOptions struct {
+	IgnoreSerials  bool    `json:"ignore_serials"`
+	IgnoreMACs     bool    `json:"ignore_macs"`
+	DiskBucketGB   float64 `json:"disk_bucket_gb"`
+	MemoryBucketGB float64 `json:"memory_bucket_gb"`
+}
+
+// DefaultDriftOptions ignores serial numbers and MAC addresses, which
+// always differ between machines, and absorbs small differences in
+// reported sizes
+func DefaultDriftOptions() DriftOptions {
+	return DriftOptions{
+		IgnoreSerials:  true,
+		IgnoreMACs:     true,
+		DiskBucketGB:   10,
+		MemoryBucketGB: 1,
+	}
+}
+
+// GroupDrift reports how a group's members differ from each other
+type GroupDrift struct {
+	GroupID      string          `json:"group_id"`
+	MachineCount int             `json:"machine_count"`
+	Options      DriftOptions    `json:"options"`
+	Clusters     []ConfigCluster `json:"clusters"` // Largest first
+	Outliers     []DriftOutlier  `json:"outliers"`
+}
+
+// ConfigCluster is a set of machines whose normalized configurations are
+// identical
+type ConfigCluster struct {
+	Fingerprint string   `json:"fingerprint"` // Empty for machines without a configuration
+	MachineIDs  []string `json:"machine_ids"`
+}
+
+// DriftOutlier is a machine that differs from the rest of its group in at
+// least one field
+type DriftOutlier struct {
+	MachineID   string       `json:"machine_id"`
+	ServiceTag  string       `json:"service_tag"`
+	Hostname    string       `json:"hostname,omitempty"`
+	CompareWith string       `json:"compare_with,omitempty"` // A machine with the group's most common configuration
+	Differences []DriftField `json:"differences"`
+}
+
+// DriftField is a field in which an outlier differs from the value most
+// of its group has
+type DriftField struct {
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// MachineComparison is a structured diff between two machines
+type MachineComparison struct {
+	A               MachineRef   `json:"a"`
+	B               MachineRef   `json:"b"`
+	Options         DriftOptions `json:"options"`
+	ConfigIdentical bool         `json:"config_identical"`
+	ConfigDiff      string       `json:"config_diff,omitempty"` // Unified diff of the normalized configurations
+	Hardware        []FieldDiff  `json:"hardware"`              // Only the fields that differ
+	Build           []FieldDiff  `json:"build"`
+}
+
+// MachineRef identifies a machine in a comparison
+type MachineRef struct {
+	ID         string `json:"id"`
+	ServiceTag string `json:"service_tag"`
+	Hostname   string `json:"hostname,omitempty"`
+}
+
+// FieldDiff is a field that differs between two compared machines
+type FieldDiff struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
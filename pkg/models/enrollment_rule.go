@@ -0,0 +1,161 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EnrollmentRule places machines when they first enroll: it adds them to
+// groups, applies a template, and names them from a hostname pattern.
+// Rules are evaluated in priority order, lowest first. Evaluation stops at
+// the first rule that matches unless that rule has Continue set, so a rule
+// can apply its actions and leave later rules to add theirs.
+type EnrollmentRule struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Priority    int    `json:"priority"`
+	Enabled     bool   `json:"enabled"`
+
+	Match EnrollmentRuleMatch `json:"match"`
+
+	// Continue goes on to later rules after this one matches, instead of
+	// stopping at it
+	Continue bool `json:"continue"`
+
+	// GroupIDs are groups the machine is added to
+	GroupIDs []string `json:"group_ids"`
+
+	// TemplateID is a template applied to the machine, if it has no
+	// configuration yet. Of several matching rules, the first with a
+	// template applies it.
+	TemplateID string `json:"template_id,omitempty"`
+
+	// HostnamePattern names the machine, if it has no hostname yet, such
+	// as db-{seq}. {seq} is replaced by the next number of a sequence kept
+	// per pattern, starting at 1, and {seq:N} pads it to N digits.
+	// {service_tag} is replaced by the machine's service tag,
+	// {service_tag_suffix} by its last four characters (or N, with
+	// {service_tag_suffix:N}), {model_short} by its shortened model, and
+	// {group} by the name of the rule's first group. Of several matching
+	// rules, the first with a pattern names the machine.
+	HostnamePattern string `json:"hostname_pattern,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// EnrollmentRuleMatch is what a rule matches. Every condition that is set
+// must hold. A rule without conditions must set CatchAll, so that one
+// saved without conditions by mistake doesn't match every machine.
+type EnrollmentRuleMatch struct {
+	ServiceTagPrefix string `json:"service_tag_prefix,omitempty"`
+	MACOUI           string `json:"mac_oui,omitempty"`      // First three bytes of the MAC address, e.g. 00:1a:2b
+	Manufacturer     string `json:"manufacturer,omitempty"` // Equal, ignoring case
+	Model            string `json:"model,omitempty"`        // Contained in the model, ignoring case
+	CPU              string `json:"cpu,omitempty"`          // Contained in the CPU model, ignoring case
+
+	MinMemoryGB float64 `json:"min_memory_gb,omitempty"`
+	MinDisks    int     `json:"min_disks,omitempty"`
+	MaxDisks    int     `json:"max_disks,omitempty"`
+
+	CatchAll bool `json:"catch_all,omitempty"`
+}
+
+// EnrollmentRuleTest reports what the rules would do with a sample
+// enrollment, without changing anything
+type EnrollmentRuleTest struct {
+	// Matched are the rules that would apply, in the order they would
+	Matched []*EnrollmentRule `json:"matched"`
+
+	GroupIDs   []string `json:"group_ids"`
+	TemplateID string   `json:"template_id,omitempty"`
+
+	// Hostname is what the machine would be named if it enrolled now
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// Validate checks a rule and normalizes its MAC OUI
+func (r *EnrollmentRule) Validate() error {
+	if !bootProfileNamePattern.MatchString(r.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, dots, dashes, or underscores")
+	}
+
+	if err := r.Match.validate(); err != nil {
+		return err
+	}
+
+	if err := ValidateHostnamePattern(r.HostnamePattern); err != nil {
+		return fmt.Errorf("hostname_pattern: %w", err)
+	}
+	if UsesGroup(r.HostnamePattern) && len(r.GroupIDs) == 0 {
+		return fmt.Errorf("hostname_pattern can only use {group} if the rule adds groups")
+	}
+
+	if len(r.GroupIDs) == 0 && r.TemplateID == "" && r.HostnamePattern == "" {
+		return fmt.Errorf("rule must add groups, apply a template, or set a hostname pattern")
+	}
+	if r.GroupIDs == nil {
+		r.GroupIDs = []string{}
+	}
+	return nil
+}
+
+func (m *EnrollmentRuleMatch) validate() error {
+	if m.MACOUI != "" {
+		oui, err := NormalizeMAC(strings.ReplaceAll(m.MACOUI, "-", ":") + ":00:00:00")
+		if err != nil {
+			return fmt.Errorf("mac_oui must be the first three bytes of a MAC address, such as 00:1a:2b")
+		}
+		m.MACOUI = oui[:8]
+	}
+	if m.MinMemoryGB < 0 || m.MinDisks < 0 || m.MaxDisks < 0 {
+		return fmt.Errorf("min_memory_gb, min_disks, and max_disks must not be negative")
+	}
+	if m.MaxDisks > 0 && m.MaxDisks < m.MinDisks {
+		return fmt.Errorf("max_disks must not be less than min_disks")
+	}
+
+	conditions := m.ServiceTagPrefix != "" || m.MACOUI != "" || m.Manufacturer != "" || m.Model != "" ||
+		m.CPU != "" || m.MinMemoryGB > 0 || m.MinDisks > 0 || m.MaxDisks > 0
+	if conditions && m.CatchAll {
+		return fmt.Errorf("catch_all can't be combined with other conditions")
+	}
+	if !conditions && !m.CatchAll {
+		return fmt.Errorf("match needs a condition, or catch_all to match every machine")
+	}
+	return nil
+}
+
+// Matches reports whether a machine with the given identity and hardware
+// meets every condition. macAddress must be normalized.
+func (m *EnrollmentRuleMatch) Matches(serviceTag, macAddress string, hardware *HardwareInfo) bool {
+	if m.CatchAll {
+		return true
+	}
+
+	memoryGB := hardware.Memory.TotalGB
+	if memoryGB == 0 {
+		memoryGB = float64(hardware.Memory.TotalBytes) / (1 << 30)
+	}
+	disks := len(hardware.Disks)
+
+	switch {
+	case m.ServiceTagPrefix != "" && !strings.HasPrefix(serviceTag, m.ServiceTagPrefix):
+	case m.MACOUI != "" && !strings.HasPrefix(macAddress, m.MACOUI):
+	case m.Manufacturer != "" && !strings.EqualFold(hardware.Manufacturer, m.Manufacturer):
+	case m.Model != "" && !containsFold(hardware.Model, m.Model):
+	case m.CPU != "" && !containsFold(hardware.CPU.Model, m.CPU):
+	case m.MinMemoryGB > 0 && memoryGB < m.MinMemoryGB:
+	case m.MinDisks > 0 && disks < m.MinDisks:
+	case m.MaxDisks > 0 && disks > m.MaxDisks:
+	default:
+		return true
+	}
+	return false
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
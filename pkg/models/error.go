@@ -0,0 +1,20 @@
+package models
+
+// ErrorResponse is the body of every API error response
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError describes a failed request. Code is stable and meant for
+// programs; Message is for people. RequestID matches the X-Request-ID
+// response header and the server's log lines for the request.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
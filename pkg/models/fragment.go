@@ -0,0 +1,82 @@
+package models
+
+import "time"
+
+// ConfigFragment is a reusable piece of NixOS configuration, such as a base
+// system, monitoring, or GPU drivers. Machines and groups list the fragments
+// they use, and builds assemble them into one configuration.
+type ConfigFragment struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// NixOSConfig is a NixOS module, imported by the assembled
+	// configuration. {{name}} placeholders are replaced with Variables.
+	NixOSConfig string `json:"nixos_config"`
+
+	// Weight orders fragments in the assembled configuration, lowest
+	// first. Fragments with the same weight keep the order they are
+	// listed in.
+	Weight int `json:"weight"`
+
+	// Variables are placeholder defaults. The hostname, service_tag, and
+	// mac_address placeholders are always the machine's own.
+	Variables map[string]string `json:"variables,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	CreatedBy string    `json:"created_by,omitempty"`
+}
+
+// UpdateFragmentRequest changes the fields of a fragment that are given.
+// Variables are replaced when given; {} removes them.
+type UpdateFragmentRequest struct {
+	Name        string            `json:"name,omitempty"`
+	Description *string           `json:"description,omitempty"`
+	NixOSConfig string            `json:"nixos_config,omitempty"`
+	Weight      *int              `json:"weight,omitempty"`
+	Variables   map[string]string `json:"variables,omitempty"`
+}
+
+// FragmentListRequest sets the fragments a machine or group uses, by ID or
+// name, in order
+type FragmentListRequest struct {
+	Fragments []string `json:"fragments"`
+}
+
+// FragmentRef is a fragment a machine or group uses
+type FragmentRef struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+
+	// The group whose default the fragment is, if it isn't the machine's
+	// own
+	GroupID   string `json:"group_id,omitempty"`
+	GroupName string `json:"group_name,omitempty"`
+}
+
+// AssembleRequest previews a machine's assembled configuration. Fragments
+// and NixOSConfig stand in for the machine's own if given, so unsaved
+// changes can be previewed.
+type AssembleRequest struct {
+	Fragments   []string `json:"fragments,omitempty"`
+	NixOSConfig *string  `json:"nixos_config,omitempty"`
+
+	// Validate has the builder check that the result parses
+	Validate bool `json:"validate,omitempty"`
+}
+
+// AssembledConfig is the configuration a machine's builds use
+type AssembledConfig struct {
+	Config string `json:"config"`
+
+	// Assembled is false for machines without fragments, whose
+	// nixos_config is built as is
+	Assembled bool          `json:"assembled"`
+	Fragments []FragmentRef `json:"fragments"`
+
+	// Set when validation was asked for
+	Valid *bool  `json:"valid,omitempty"`
+	Error string `json:"error,omitempty"`
+}
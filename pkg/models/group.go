@@ -1,6 +1,7 @@
 package models
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -12,20 +13,79 @@ type MachineGroup struct {
 	Tags        []string  `json:"tags,omitempty" db:"tags"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+
+	// BuildLimits raises or lowers the builder's resource limits for
+	// member machines, e.g. for known-heavy configurations
+	BuildLimits *BuildLimits `json:"build_limits,omitempty" db:"build_limits"`
+
+	// BuilderLabels are labels a builder must have to build member
+	// machines, e.g. gpu for configurations that need CUDA substituters
+	BuilderLabels []string `json:"builder_labels,omitempty" db:"builder_labels"`
+
+	// RequireBuildApproval holds builds of member machines for an admin's
+	// approval unless an admin queued them
+	RequireBuildApproval bool `json:"require_build_approval" db:"require_build_approval"`
+
+	// HostnamePattern names member machines configured without a
+	// hostname, such as {group}-{seq:3}; see EnrollmentRule for the
+	// placeholders. Of several groups with a pattern, the first by name
+	// names the machine.
+	HostnamePattern string `json:"hostname_pattern,omitempty" db:"hostname_pattern"`
+
+	// Ownership is the default ownership of member machines. A machine
+	// inherits each field it doesn't set from the first group by name
+	// that sets it.
+	Ownership *Ownership `json:"ownership,omitempty" db:"owner_team"`
+}
+
+// BuildLimits caps the resources an image build may use. Zero fields leave
+// the builder's default in place.
+type BuildLimits struct {
+	TimeoutMinutes int `json:"timeout_minutes,omitempty"`
+	MemoryMB       int `json:"memory_mb,omitempty"`
+	CPUPercent     int `json:"cpu_percent,omitempty"` // 100 per core
+	DiskMB         int `json:"disk_mb,omitempty"`
 }
 
 // CreateGroupRequest represents a request to create a new group
 type CreateGroupRequest struct {
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Tags        []string `json:"tags,omitempty"`
+	Name          string       `json:"name"`
+	Description   string       `json:"description"`
+	Tags          []string     `json:"tags,omitempty"`
+	BuildLimits   *BuildLimits `json:"build_limits,omitempty"`
+	BuilderLabels []string     `json:"builder_labels,omitempty"`
+
+	RequireBuildApproval bool   `json:"require_build_approval,omitempty"`
+	HostnamePattern      string `json:"hostname_pattern,omitempty"`
+
+	Ownership *Ownership `json:"ownership,omitempty"`
 }
 
 // UpdateGroupRequest represents a request to update a group
 type UpdateGroupRequest struct {
-	Name        string   `json:"name,omitempty"`
-	Description string   `json:"description,omitempty"`
-	Tags        []string `json:"tags,omitempty"`
+	Name          string       `json:"name,omitempty"`
+	Description   string       `json:"description,omitempty"`
+	Tags          []string     `json:"tags,omitempty"`
+	BuildLimits   *BuildLimits `json:"build_limits,omitempty"`   // {} clears them
+	BuilderLabels []string     `json:"builder_labels,omitempty"` // [] clears them
+
+	RequireBuildApproval *bool   `json:"require_build_approval,omitempty"` // Only admins can turn it off
+	HostnamePattern      *string `json:"hostname_pattern,omitempty"`       // "" removes it
+
+	Ownership *Ownership `json:"ownership,omitempty"` // Replaces it; {} removes it
+}
+
+// GroupMetrics is what a group's Prometheus gauges are exported from
+type GroupMetrics struct {
+	Name             string
+	MachineIDs       []string
+	MachinesByStatus map[string]int
+
+	// BuildsFinished counts the members' builds that succeeded or failed
+	// in the window the metrics were read for, and BuildsSucceeded those
+	// that succeeded
+	BuildsFinished  int
+	BuildsSucceeded int
 }
 
 // GroupMembership represents the association between a machine and a group
@@ -39,14 +99,57 @@ type GroupMembership struct {
 type BulkOperationRequest struct {
 	MachineIDs []string               `json:"machine_ids,omitempty"`
 	GroupID    string                 `json:"group_id,omitempty"`
-	Operation  string                 `json:"operation"` // update, build, delete
+	Operation  string                 `json:"operation"` // update, build, delete, rotate_bmc
 	Data       map[string]interface{} `json:"data,omitempty"`
+
+	// DryRun reports what an update would change, machine by machine,
+	// without changing anything
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// ConfirmationToken is the token a dry run of the same update
+	// returned. It proves the update is the one that was previewed.
+	ConfirmationToken string `json:"confirmation_token,omitempty"`
 }
 
 // BulkOperationResult represents the result of a bulk operation
 type BulkOperationResult struct {
+	DryRun       bool     `json:"dry_run,omitempty"`
 	TotalCount   int      `json:"total_count"`
 	SuccessCount int      `json:"success_count"`
 	FailureCount int      `json:"failure_count"`
-	Errors       []string `json:"errors,omitempty"`
+	Errors       []string `json:"errors,omitempty"` // The failures as text, as in Results
+
+	// AwaitingApprovalCount is how many of the successful builds of a bulk
+	// build wait for an admin's approval
+	AwaitingApprovalCount int `json:"awaiting_approval_count,omitempty"`
+
+	// Results is the outcome for each machine
+	Results []BulkMachineResult `json:"results"`
+
+	// ConfirmationToken is returned by a dry run of an update, for the
+	// update that makes the changes previewed
+	ConfirmationToken string `json:"confirmation_token,omitempty"`
+}
+
+// BulkMachineResult is what a bulk operation did to one machine, or for a
+// dry run would have done. Changes lists the fields an update changed;
+// configurations are summarized by hash and line count.
+type BulkMachineResult struct {
+	MachineID string        `json:"machine_id"`
+	Success   bool          `json:"success"`
+	Changes   []FieldChange `json:"changes,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Succeed records that the operation succeeded for a machine
+func (r *BulkOperationResult) Succeed(machineID string, changes []FieldChange) {
+	r.SuccessCount++
+	r.Results = append(r.Results, BulkMachineResult{MachineID: machineID, Success: true, Changes: changes})
+}
+
+// Fail records that the operation failed for a machine
+func (r *BulkOperationResult) Fail(machineID string, err error) {
+	r.FailureCount++
+	r.Errors = append(r.Errors, fmt.Sprintf("machine %s: %v", machineID, err))
+	r.Results = append(r.Results, BulkMachineResult{MachineID: machineID, Error: err.Error()})
 }
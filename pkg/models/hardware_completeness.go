@@ -0,0 +1,131 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// HardwareFields are the hardware inventory fields builds and templates
+// depend on, by the names completeness reports and templates require them
+// by. The minimal registration environment sometimes fails to collect
+// some of them.
+var HardwareFields = []string{
+	"manufacturer",
+	"model",
+	"serial_number",
+	"cpu.model",
+	"cpu.cores",
+	"memory",
+	"memory.modules",
+	"disks",
+	"nics",
+}
+
+// IsHardwareField reports whether field is one of HardwareFields
+func IsHardwareField(field string) bool {
+	for _, f := range HardwareFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// HardwareCompleteness is how much of HardwareFields a machine's inventory
+// has. Score is the percentage present; Missing lists the rest.
+type HardwareCompleteness struct {
+	Score   int      `json:"score"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+// Complete reports whether every field is present
+func (c *HardwareCompleteness) Complete() bool {
+	return len(c.Missing) == 0
+}
+
+// Completeness reports which of HardwareFields the inventory has
+func (h *HardwareInfo) Completeness() *HardwareCompleteness {
+	present := map[string]bool{
+		"manufacturer":   h.Manufacturer != "",
+		"model":          h.Model != "",
+		"serial_number":  h.SerialNumber != "",
+		"cpu.model":      h.CPU.Model != "",
+		"cpu.cores":      h.CPU.Cores > 0,
+		"memory":         h.Memory.TotalBytes > 0 || h.Memory.TotalGB > 0,
+		"memory.modules": len(h.Memory.Modules) > 0,
+		"disks":          len(h.Disks) > 0,
+		"nics":           len(h.NICs) > 0,
+	}
+
+	completeness := &HardwareCompleteness{}
+	for _, field := range HardwareFields {
+		if !present[field] {
+			completeness.Missing = append(completeness.Missing, field)
+		}
+	}
+	completeness.Score = (len(HardwareFields) - len(completeness.Missing)) * 100 / len(HardwareFields)
+	return completeness
+}
+
+// hardwarePlaceholder matches {{hardware.<field>}} placeholders
+var hardwarePlaceholder = regexp.MustCompile(`{{(hardware\.[A-Za-z0-9_.]+)}}`)
+
+// HardwarePlaceholderNames returns the hardware placeholders config has,
+// such as hardware.disks.0.device, in the order they first appear
+func HardwarePlaceholderNames(config string) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, match := range hardwarePlaceholder.FindAllStringSubmatch(config, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// HardwarePlaceholders returns the values of an inventory's fields by their
+// placeholder names: hardware.manufacturer, hardware.cpu.model,
+// hardware.memory_gb, hardware.disk_count, and hardware.disks.0.device for
+// the first disk, for instance. Fields that are empty or zero have none,
+// so a configuration is never rendered with a blank in their place.
+func HardwarePlaceholders(h *HardwareInfo) map[string]string {
+	values := make(map[string]string)
+	add := func(name, value string) {
+		if value != "" && value != "0" {
+			values["hardware."+name] = value
+		}
+	}
+
+	add("manufacturer", h.Manufacturer)
+	add("model", h.Model)
+	add("serial_number", h.SerialNumber)
+	add("bios_version", h.BIOSVersion)
+	add("cpu.model", h.CPU.Model)
+	add("cpu.cores", strconv.Itoa(h.CPU.Cores))
+	add("cpu.threads", strconv.Itoa(h.CPU.Threads))
+	add("cpu.sockets", strconv.Itoa(h.CPU.Sockets))
+	add("cpu.architecture", h.CPU.Architecture)
+	add("memory_gb", strconv.FormatFloat(h.Memory.TotalGB, 'f', -1, 64))
+	add("disk_count", strconv.Itoa(len(h.Disks)))
+	add("nic_count", strconv.Itoa(len(h.NICs)))
+
+	for i, disk := range h.Disks {
+		prefix := fmt.Sprintf("disks.%d.", i)
+		add(prefix+"device", disk.Device)
+		add(prefix+"model", disk.Model)
+		add(prefix+"size_gb", strconv.FormatFloat(disk.SizeGB, 'f', -1, 64))
+		add(prefix+"type", disk.Type)
+		add(prefix+"serial", disk.Serial)
+		add(prefix+"wwn", disk.WWN)
+	}
+	for i, nic := range h.NICs {
+		prefix := fmt.Sprintf("nics.%d.", i)
+		add(prefix+"name", nic.Name)
+		add(prefix+"mac_address", nic.MACAddress)
+		add(prefix+"driver", nic.Driver)
+		add(prefix+"pci_address", nic.PCIAddress)
+	}
+	return values
+}
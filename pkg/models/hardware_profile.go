@@ -0,0 +1,346 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hardware compliance statuses
+const (
+	ComplianceCompliant = "compliant"
+	ComplianceFailed    = "failed"
+
+	// ComplianceUnchecked filters machines no profile applies to; it is
+	// never stored
+	ComplianceUnchecked = "unchecked"
+)
+
+// Default tolerances of a hardware profile
+const (
+	DefaultMemoryTolerancePercent   = 2.0
+	DefaultDiskSizeTolerancePercent = 5.0
+)
+
+// HardwareProfile is the hardware a kind of machine is expected to have.
+// It applies to machines in any of its groups or, for machines in none of
+// them, to machines of its manufacturer and model. Machines are checked
+// against it when they enroll and when their inventory is refreshed.
+type HardwareProfile struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Manufacturer and Model, compared ignoring case, are the machines
+	// the profile applies to outside its groups. Both or neither are set.
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+
+	// GroupIDs are groups whose machines the profile applies to, whatever
+	// their manufacturer and model
+	GroupIDs []string `json:"group_ids"`
+
+	Expected HardwareExpectation `json:"expected"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HardwareExpectation is what a profile expects. Fields left unset aren't
+// checked.
+type HardwareExpectation struct {
+	CPUModel   string `json:"cpu_model,omitempty"` // Regular expression matched against the CPU model
+	CPUSockets int    `json:"cpu_sockets,omitempty"`
+	CPUCores   int    `json:"cpu_cores,omitempty"`
+
+	// MemoryGB is the expected total memory. Firmware reserves some of it,
+	// so the total may be up to MemoryTolerancePercent away, by default 2.
+	MemoryGB               float64 `json:"memory_gb,omitempty"`
+	MemoryTolerancePercent float64 `json:"memory_tolerance_percent,omitempty"`
+
+	// Disks are the expected kinds of disk. Every disk has to be one of
+	// them.
+	Disks []DiskExpectation `json:"disks,omitempty"`
+
+	// NICs are the expected kinds of NIC. Machines may have more NICs,
+	// such as virtual ones, than are listed.
+	NICs []NICExpectation `json:"nics,omitempty"`
+
+	// GPUCount is the exact number of GPUs, if set; 0 expects none
+	GPUCount *int `json:"gpu_count,omitempty"`
+}
+
+// DiskExpectation is a kind of disk a machine is expected to have Count
+// of. Spares of those slots may be empty, such as hot-spare slots that are
+// filled when a disk fails.
+type DiskExpectation struct {
+	Count  int     `json:"count"`
+	Spares int     `json:"spares,omitempty"`
+	SizeGB float64 `json:"size_gb,omitempty"`
+	Type   string  `json:"type,omitempty"` // SSD, HDD, NVMe; compared ignoring case
+
+	// SizeGB is in the decimal gigabytes disks are sold by, so a 960 GB
+	// SSD is 960 although inventories report it as 894 GiB.
+	// SizeTolerancePercent is how far a disk's size may be from it, by
+	// default 5, since vendors round sizes differently.
+	SizeTolerancePercent float64 `json:"size_tolerance_percent,omitempty"`
+}
+
+// NICExpectation is a kind of NIC a machine is expected to have at least
+// Count of
+type NICExpectation struct {
+	Count int    `json:"count"`
+	Speed string `json:"speed,omitempty"` // 1Gbps, 10Gbps, etc.; compared ignoring case
+}
+
+// HardwareCompliance is the result of checking a machine against the
+// hardware profile that applies to it
+type HardwareCompliance struct {
+	Status      string              `json:"status"` // compliant, failed
+	ProfileID   string              `json:"profile_id"`
+	ProfileName string              `json:"profile_name"`
+	Deviations  []HardwareDeviation `json:"deviations"`
+	CheckedAt   time.Time           `json:"checked_at"`
+}
+
+// HardwareDeviation is a way a machine's hardware differs from its profile
+type HardwareDeviation struct {
+	Component string `json:"component"` // cpu, memory, disks, nics, gpus
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+// IsValidComplianceFilter reports whether status can filter machines by
+// their hardware compliance
+func IsValidComplianceFilter(status string) bool {
+	return status == ComplianceCompliant || status == ComplianceFailed || status == ComplianceUnchecked
+}
+
+// Validate checks a profile and fills in its defaults
+func (p *HardwareProfile) Validate() error {
+	if !bootProfileNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, dots, dashes, or underscores")
+	}
+
+	p.Manufacturer = strings.TrimSpace(p.Manufacturer)
+	p.Model = strings.TrimSpace(p.Model)
+	if (p.Manufacturer == "") != (p.Model == "") {
+		return fmt.Errorf("manufacturer and model must be set together")
+	}
+	if p.Manufacturer == "" && len(p.GroupIDs) == 0 {
+		return fmt.Errorf("profile must apply to a manufacturer and model, or to groups")
+	}
+	if p.GroupIDs == nil {
+		p.GroupIDs = []string{}
+	}
+
+	return p.Expected.validate()
+}
+
+func (e *HardwareExpectation) validate() error {
+	if e.CPUModel != "" {
+		if _, err := regexp.Compile(e.CPUModel); err != nil {
+			return fmt.Errorf("cpu_model is not a valid regular expression: %v", err)
+		}
+	}
+	if e.CPUSockets < 0 || e.CPUCores < 0 || e.MemoryGB < 0 || (e.GPUCount != nil && *e.GPUCount < 0) {
+		return fmt.Errorf("cpu_sockets, cpu_cores, memory_gb, and gpu_count must not be negative")
+	}
+	if e.MemoryTolerancePercent < 0 || e.MemoryTolerancePercent >= 100 {
+		return fmt.Errorf("memory_tolerance_percent must be between 0 and 100")
+	}
+	if e.MemoryGB > 0 && e.MemoryTolerancePercent == 0 {
+		e.MemoryTolerancePercent = DefaultMemoryTolerancePercent
+	}
+
+	for i := range e.Disks {
+		disk := &e.Disks[i]
+		if disk.Count < 1 {
+			return fmt.Errorf("disks[%d]: count must be at least 1", i)
+		}
+		if disk.Spares < 0 || disk.Spares > disk.Count {
+			return fmt.Errorf("disks[%d]: spares must be between 0 and count", i)
+		}
+		if disk.SizeGB < 0 {
+			return fmt.Errorf("disks[%d]: size_gb must not be negative", i)
+		}
+		if disk.SizeTolerancePercent < 0 || disk.SizeTolerancePercent >= 100 {
+			return fmt.Errorf("disks[%d]: size_tolerance_percent must be between 0 and 100", i)
+		}
+		if disk.SizeGB > 0 && disk.SizeTolerancePercent == 0 {
+			disk.SizeTolerancePercent = DefaultDiskSizeTolerancePercent
+		}
+	}
+
+	for i, nic := range e.NICs {
+		if nic.Count < 1 {
+			return fmt.Errorf("nics[%d]: count must be at least 1", i)
+		}
+	}
+
+	if e.CPUModel == "" && e.CPUSockets == 0 && e.CPUCores == 0 && e.MemoryGB == 0 &&
+		len(e.Disks) == 0 && len(e.NICs) == 0 && e.GPUCount == nil {
+		return fmt.Errorf("expected must set at least one component")
+	}
+	return nil
+}
+
+// AppliesToModel reports whether the profile applies to machines of a
+// manufacturer and model outside its groups
+func (p *HardwareProfile) AppliesToModel(hardware *HardwareInfo) bool {
+	return p.Manufacturer != "" &&
+		strings.EqualFold(p.Manufacturer, strings.TrimSpace(hardware.Manufacturer)) &&
+		strings.EqualFold(p.Model, strings.TrimSpace(hardware.Model))
+}
+
+// Check compares a machine's hardware with the profile
+func (p *HardwareProfile) Check(hardware *HardwareInfo, now time.Time) *HardwareCompliance {
+	result := &HardwareCompliance{
+		Status:      ComplianceCompliant,
+		ProfileID:   p.ID,
+		ProfileName: p.Name,
+		Deviations:  p.Expected.deviations(hardware),
+		CheckedAt:   now,
+	}
+	if len(result.Deviations) > 0 {
+		result.Status = ComplianceFailed
+	}
+	return result
+}
+
+func (e *HardwareExpectation) deviations(hardware *HardwareInfo) []HardwareDeviation {
+	deviations := []HardwareDeviation{}
+	deviate := func(component, expected, actual string) {
+		deviations = append(deviations, HardwareDeviation{Component: component, Expected: expected, Actual: actual})
+	}
+
+	if e.CPUModel != "" {
+		if pattern, err := regexp.Compile(e.CPUModel); err == nil && !pattern.MatchString(hardware.CPU.Model) {
+			deviate("cpu", "model matching "+e.CPUModel, fmt.Sprintf("%q", hardware.CPU.Model))
+		}
+	}
+	if e.CPUSockets > 0 && hardware.CPU.Sockets != e.CPUSockets {
+		deviate("cpu", fmt.Sprintf("%d sockets", e.CPUSockets), fmt.Sprintf("%d sockets", hardware.CPU.Sockets))
+	}
+	if e.CPUCores > 0 && hardware.CPU.Cores != e.CPUCores {
+		deviate("cpu", fmt.Sprintf("%d cores", e.CPUCores), fmt.Sprintf("%d cores", hardware.CPU.Cores))
+	}
+
+	if e.MemoryGB > 0 {
+		memoryGB := hardware.Memory.TotalGB
+		if memoryGB == 0 {
+			memoryGB = float64(hardware.Memory.TotalBytes) / (1 << 30)
+		}
+		if !withinPercent(memoryGB, e.MemoryGB, e.MemoryTolerancePercent) {
+			deviate("memory", fmt.Sprintf("%g GB (±%g%%)", e.MemoryGB, e.MemoryTolerancePercent), fmt.Sprintf("%.1f GB", memoryGB))
+		}
+	}
+
+	if len(e.Disks) > 0 {
+		e.diskDeviations(hardware.Disks, deviate)
+	}
+
+	for _, nic := range e.NICs {
+		found := 0
+		for _, actual := range hardware.NICs {
+			if nic.Speed == "" || strings.EqualFold(actual.Speed, nic.Speed) {
+				found++
+			}
+		}
+		if found < nic.Count {
+			deviate("nics", fmt.Sprintf("at least %d %s", nic.Count, nic.describe()), fmt.Sprintf("%d", found))
+		}
+	}
+
+	if e.GPUCount != nil && len(hardware.GPUs) != *e.GPUCount {
+		deviate("gpus", fmt.Sprintf("%d GPUs", *e.GPUCount), fmt.Sprintf("%d", len(hardware.GPUs)))
+	}
+
+	return deviations
+}
+
+// diskDeviations assigns each disk to the first expected kind it matches,
+// then compares the counts. A disk of no expected kind is a deviation.
+func (e *HardwareExpectation) diskDeviations(disks []DiskInfo, deviate func(component, expected, actual string)) {
+	found := make([]int, len(e.Disks))
+	var unexpected []string
+	for _, disk := range disks {
+		matched := false
+		for i, expected := range e.Disks {
+			if expected.matches(disk) {
+				found[i]++
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unexpected = append(unexpected, fmt.Sprintf("%s (%s, %.0f GB)", disk.Device, disk.Type, diskVendorGB(disk)))
+		}
+	}
+
+	for i, expected := range e.Disks {
+		switch {
+		case found[i] > expected.Count:
+			deviate("disks", fmt.Sprintf("%d %s", expected.Count, expected.describe()), fmt.Sprintf("%d", found[i]))
+		case found[i] < expected.Count-expected.Spares:
+			want := fmt.Sprintf("%d %s", expected.Count, expected.describe())
+			if expected.Spares > 0 {
+				want = fmt.Sprintf("%d-%d %s", expected.Count-expected.Spares, expected.Count, expected.describe())
+			}
+			deviate("disks", want, fmt.Sprintf("%d", found[i]))
+		}
+	}
+	if len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		deviate("disks", "no other disks", "unexpected "+strings.Join(unexpected, ", "))
+	}
+}
+
+func (d DiskExpectation) matches(disk DiskInfo) bool {
+	if d.Type != "" && !strings.EqualFold(disk.Type, d.Type) {
+		return false
+	}
+	if d.SizeGB > 0 {
+		return withinPercent(diskVendorGB(disk), d.SizeGB, d.SizeTolerancePercent)
+	}
+	return true
+}
+
+// diskVendorGB is a disk's size in the decimal gigabytes disks are sold by,
+// where inventories report binary ones
+func diskVendorGB(disk DiskInfo) float64 {
+	if disk.SizeBytes > 0 {
+		return float64(disk.SizeBytes) / 1e9
+	}
+	return disk.SizeGB * (1 << 30) / 1e9
+}
+
+func (d DiskExpectation) describe() string {
+	var parts []string
+	if d.SizeGB > 0 {
+		parts = append(parts, fmt.Sprintf("%g GB", d.SizeGB))
+	}
+	if d.Type != "" {
+		parts = append(parts, d.Type)
+	}
+	parts = append(parts, "disks")
+	return strings.Join(parts, " ")
+}
+
+func (n NICExpectation) describe() string {
+	if n.Speed == "" {
+		return "NICs"
+	}
+	return n.Speed + " NICs"
+}
+
+// withinPercent reports whether actual is within percent of expected
+func withinPercent(actual, expected, percent float64) bool {
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= expected*percent/100
+}
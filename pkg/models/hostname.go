@@ -0,0 +1,149 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// HostnameVars are what the placeholders of a hostname pattern are filled
+// in with
+type HostnameVars struct {
+	ServiceTag string
+	Model      string // Hardware model, shortened for {model_short}
+	Group      string // Group name
+	Seq        int64  // Number taken from the pattern's sequence
+}
+
+// hostnamePatternPlaceholder matches the placeholders of a hostname
+// pattern, with their optional width
+var hostnamePatternPlaceholder = regexp.MustCompile(`\{([a-z_]+)(?::(\d))?\}`)
+
+// hostnamePatternLiteral is what a pattern may contain besides its
+// placeholders
+var hostnamePatternLiteral = regexp.MustCompile(`^[a-zA-Z0-9.-]*$`)
+
+// hostnamePlaceholderWidths says which placeholders a pattern may use and
+// whether they take a width
+var hostnamePlaceholderWidths = map[string]bool{
+	"seq":                true,
+	"service_tag":        false,
+	"service_tag_suffix": true,
+	"model_short":        false,
+	"group":              false,
+}
+
+// defaultServiceTagSuffix is how many characters {service_tag_suffix}
+// takes from the end of the service tag
+const defaultServiceTagSuffix = 4
+
+// ValidateHostnamePattern checks that a hostname pattern only has known
+// placeholders and characters hostnames may contain
+func ValidateHostnamePattern(pattern string) error {
+	for _, parts := range hostnamePatternPlaceholder.FindAllStringSubmatch(pattern, -1) {
+		width, known := hostnamePlaceholderWidths[parts[1]]
+		if !known || (parts[2] != "" && !width) {
+			return fmt.Errorf("hostname pattern has an unknown placeholder %s", parts[0])
+		}
+	}
+
+	literal := hostnamePatternPlaceholder.ReplaceAllString(pattern, "")
+	if !hostnamePatternLiteral.MatchString(literal) {
+		return fmt.Errorf("hostname pattern may only contain letters, digits, dots, dashes, and the placeholders " +
+			"{seq}, {seq:N}, {service_tag}, {service_tag_suffix}, {service_tag_suffix:N}, {model_short}, and {group}")
+	}
+	if len(pattern) > 253 {
+		return fmt.Errorf("hostname pattern must be at most 253 characters")
+	}
+	return nil
+}
+
+// HostnameFromPattern fills in a hostname pattern. {seq} is vars.Seq, which
+// callers only take from the pattern's sequence if UsesSequence says the
+// pattern has one, padded with zeros to N digits for {seq:N}. The service
+// tag, model, and group are lowercased, with what a hostname can't contain
+// replaced by dashes.
+func HostnameFromPattern(pattern string, vars HostnameVars) string {
+	hostname := hostnamePatternPlaceholder.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		parts := hostnamePatternPlaceholder.FindStringSubmatch(placeholder)
+		width := 0
+		if parts[2] != "" {
+			width = int(parts[2][0] - '0')
+		}
+
+		switch parts[1] {
+		case "seq":
+			return fmt.Sprintf("%0*d", width, vars.Seq)
+		case "service_tag":
+			return hostnameLabel(vars.ServiceTag)
+		case "service_tag_suffix":
+			if width == 0 {
+				width = defaultServiceTagSuffix
+			}
+			tag := vars.ServiceTag
+			if len(tag) > width {
+				tag = tag[len(tag)-width:]
+			}
+			return hostnameLabel(tag)
+		case "model_short":
+			return hostnameLabel(ShortModel(vars.Model))
+		case "group":
+			return hostnameLabel(vars.Group)
+		}
+		return placeholder
+	})
+
+	// A placeholder with nothing to fill in leaves a dangling separator
+	return strings.Trim(hostname, ".-")
+}
+
+// UsesSequence reports whether a hostname pattern has a {seq} placeholder
+func UsesSequence(pattern string) bool {
+	return usesPlaceholder(pattern, "seq")
+}
+
+// UsesGroup reports whether a hostname pattern has a {group} placeholder
+func UsesGroup(pattern string) bool {
+	return usesPlaceholder(pattern, "group")
+}
+
+func usesPlaceholder(pattern, name string) bool {
+	for _, parts := range hostnamePatternPlaceholder.FindAllStringSubmatch(pattern, -1) {
+		if parts[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ShortModel shortens a hardware model to the word that identifies it,
+// the first with a digit: r740 for PowerEdge R740, dl380 for ProLiant
+// DL380 Gen10. A model without digits is shortened to its first word.
+func ShortModel(model string) string {
+	words := strings.Fields(model)
+	if len(words) == 0 {
+		return ""
+	}
+	for _, word := range words {
+		if strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+			return word
+		}
+	}
+	return words[0]
+}
+
+// hostnameLabel lowercases s and replaces what a hostname can't contain
+// with dashes
+func hostnameLabel(s string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, s)
+	return strings.Trim(label, "-")
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// IdempotencyRecord remembers the response to a request sent with an
+// Idempotency-Key header, so that a retry gets the same response instead of
+// repeating the request. Keys are scoped to the user and the endpoint.
+type IdempotencyRecord struct {
+	Key         string `json:"key" db:"key"`
+	Username    string `json:"username" db:"username"` // Empty for unauthenticated requests
+	Endpoint    string `json:"endpoint" db:"endpoint"` // Method and path, e.g. POST /api/v1/bulk
+	RequestHash string `json:"request_hash" db:"request_hash"`
+
+	// StatusCode is 0 while the first request is still being handled
+	StatusCode   int    `json:"status_code" db:"status_code"`
+	ResponseBody string `json:"response_body,omitempty" db:"response_body"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// Completed reports whether the response has been recorded
+func (r *IdempotencyRecord) Completed() bool {
+	return r.StatusCode != 0
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// ImpersonationDuration is how long an impersonation session lasts. Its
+// token can't be refreshed, so the admin has to start another session to
+// go on.
+const ImpersonationDuration = 15 * time.Minute
+
+// ImpersonationSession is an admin acting as another user, to see what the
+// user can see and do. The session's token carries the user's identity and
+// role, and the admin's as the impersonator. The session records it so it
+// can be ended before it expires.
+type ImpersonationSession struct {
+	ID             string     `json:"id"`
+	ImpersonatorID string     `json:"impersonator_id"`
+	Impersonator   string     `json:"impersonator"` // Username
+	UserID         string     `json:"user_id"`
+	Username       string     `json:"username"`
+	StartedAt      time.Time  `json:"started_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	EndedAt        *time.Time `json:"ended_at,omitempty"`
+}
+
+// Active reports whether the session was neither ended nor expired at now
+func (s *ImpersonationSession) Active(now time.Time) bool {
+	return s.EndedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// ImpersonationResponse is the token of a started impersonation session
+type ImpersonationResponse struct {
+	Token     string               `json:"token"`
+	ExpiresAt time.Time            `json:"expires_at"`
+	User      User                 `json:"user"`
+	Session   ImpersonationSession `json:"session"`
+}
+
+// CurrentUser is the authenticated user, as /auth/me returns it. While an
+// admin impersonates the user, Impersonation describes the session, for
+// clients to show a banner.
+type CurrentUser struct {
+	User
+	Impersonation *ImpersonationSession `json:"impersonation,omitempty"`
+}
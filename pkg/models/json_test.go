@@ -0,0 +1,50 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestJSONDocumentsRoundTrip checks that the JSON documents templates,
+// webhooks, groups, and events carry come back from the API's encoding as
+// they went in, and that empty ones are left out
+func TestJSONDocumentsRoundTrip(t *testing.T) {
+	populated := json.RawMessage(`{"region":"eu-west","racks":[1,2]}`)
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		decoded interface{}
+		absent  []string // keys left out of the encoding
+	}{
+		{"empty template", &MachineTemplate{}, &MachineTemplate{}, []string{"tags", "variables", "bmc_config"}},
+		{"template", &MachineTemplate{Tags: json.RawMessage(`["gpu"]`), Variables: populated}, &MachineTemplate{}, nil},
+		{"empty webhook", &Webhook{}, &Webhook{}, []string{"headers", "group_ids", "statuses", "tags", "fields", "retry"}},
+		{"webhook", &Webhook{Headers: populated, Events: []string{"machine.enrolled"}, Tags: []string{"gpu"}}, &Webhook{}, nil},
+		{"empty group", &MachineGroup{}, &MachineGroup{}, []string{"tags", "build_limits", "builder_labels", "ownership"}},
+		{"group", &MachineGroup{Tags: []string{"gpu"}, BuildLimits: &BuildLimits{MemoryMB: 8192}}, &MachineGroup{}, nil},
+		{"event", &MachineEvent{Data: populated}, &MachineEvent{}, nil},
+	}
+
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.value)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := json.Unmarshal(data, tt.decoded); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(tt.decoded, tt.value) {
+			t.Errorf("%s: decoded %+v, want %+v", tt.name, tt.decoded, tt.value)
+		}
+
+		var fields map[string]json.RawMessage
+		json.Unmarshal(data, &fields)
+		for _, key := range tt.absent {
+			if value, ok := fields[key]; ok {
+				t.Errorf("%s: encoded %s as %s, want it left out", tt.name, key, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Lint severities. Findings of error rules block builds; warnings are only
+// reported. A built-in check set to off isn't run.
+const (
+	LintSeverityError   = "error"
+	LintSeverityWarning = "warning"
+	LintSeverityOff     = "off"
+)
+
+// IsValidLintSeverity reports whether severity is a lint severity
+func IsValidLintSeverity(severity string) bool {
+	switch severity {
+	case LintSeverityError, LintSeverityWarning, LintSeverityOff:
+		return true
+	}
+	return false
+}
+
+// LintRule is a check of machine configurations defined in the lint rules
+// file. It looks either for lines matching Pattern or for settings of
+// Option, and reports every one it finds, or, if Absent, reports that it
+// found none.
+type LintRule struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	Severity    string `json:"severity"` // error or warning
+
+	// Message is reported with each finding, or the description if empty
+	Message string `json:"message,omitempty"`
+
+	// Pattern is a regular expression matched against each line of the
+	// configuration
+	Pattern string `json:"pattern,omitempty"`
+
+	// Option is an option path, such as services.xserver.enable. Settings
+	// of the option, or of options below it, are found whether they are
+	// written as one path or nested. Value, a regular expression, only
+	// finds settings whose value, as written, matches it.
+	Option string `json:"option,omitempty"`
+	Value  string `json:"value,omitempty"`
+
+	// Absent reports configurations that have nothing the rule looks for,
+	// rather than what they have
+	Absent bool `json:"absent,omitempty"`
+
+	// DeployMode limits the rule to machines deployed one way, netboot or
+	// switch
+	DeployMode string `json:"deploy_mode,omitempty"`
+}
+
+// lintRuleID is what rule IDs may look like
+var lintRuleID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Validate checks that a rule is complete and its expressions compile
+func (r *LintRule) Validate() error {
+	if !lintRuleID.MatchString(r.ID) {
+		return fmt.Errorf("id must be lowercase letters, digits, and dashes")
+	}
+	if r.Severity != LintSeverityError && r.Severity != LintSeverityWarning {
+		return fmt.Errorf("severity must be error or warning")
+	}
+	if (r.Pattern == "") == (r.Option == "") {
+		return fmt.Errorf("rule needs either a pattern or an option")
+	}
+	if r.Pattern != "" {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("pattern is not a valid regular expression: %v", err)
+		}
+		if r.Value != "" {
+			return fmt.Errorf("value only applies to option rules")
+		}
+	}
+	if r.Option != "" && strings.Contains(r.Option, " ") {
+		return fmt.Errorf("option must be an option path such as services.xserver.enable")
+	}
+	if r.Value != "" {
+		if _, err := regexp.Compile(r.Value); err != nil {
+			return fmt.Errorf("value is not a valid regular expression: %v", err)
+		}
+	}
+	if r.DeployMode != "" && r.DeployMode != DeployModeNetboot && r.DeployMode != DeployModeSwitch {
+		return fmt.Errorf("deploy_mode must be netboot or switch")
+	}
+	return nil
+}
+
+// LintRules are the rules of the lint rules file: the severities of
+// built-in checks changed from their defaults, by check ID, and rules of
+// its own
+type LintRules struct {
+	Builtins map[string]string `json:"builtins,omitempty"`
+	Rules    []LintRule        `json:"rules"`
+}
+
+// BuiltinLintRule describes a built-in check, with the severity it has
+type BuiltinLintRule struct {
+	ID              string `json:"id"`
+	Description     string `json:"description"`
+	Severity        string `json:"severity"`
+	DefaultSeverity string `json:"default_severity"`
+}
+
+// LintRuleList lists the built-in checks and the rules of the rules file
+type LintRuleList struct {
+	Builtins []BuiltinLintRule `json:"builtins"`
+	Rules    []LintRule        `json:"rules"`
+}
+
+// LintSeverityRequest changes the severity of a built-in check
+type LintSeverityRequest struct {
+	Severity string `json:"severity"`
+}
+
+// LintFinding is something a lint rule found in a configuration. Line is
+// the line it is on, counting from 1, or 0 for something missing.
+type LintFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Line     int    `json:"line,omitempty"`
+}
+
+// LintResult is the outcome of linting a machine's configuration
+type LintResult struct {
+	Findings  []LintFinding `json:"findings"`
+	Errors    int           `json:"errors"`
+	Warnings  int           `json:"warnings"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// Add records a finding
+func (r *LintResult) Add(finding LintFinding) {
+	r.Findings = append(r.Findings, finding)
+	if finding.Severity == LintSeverityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// Summary describes the errors found, for a build that they blocked
+func (r *LintResult) Summary() string {
+	var messages []string
+	for _, finding := range r.Findings {
+		if finding.Severity != LintSeverityError {
+			continue
+		}
+		message := finding.Rule + ": " + finding.Message
+		if finding.Line > 0 {
+			message = fmt.Sprintf("%s (line %d)", message, finding.Line)
+		}
+		messages = append(messages, message)
+	}
+	return fmt.Sprintf("configuration lint found %d error(s): %s", r.Errors, strings.Join(messages, "; "))
+}
@@ -1,7 +1,15 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -16,8 +24,145 @@ const (
 	StatusReady       MachineStatus = "ready"
 	StatusProvisioned MachineStatus = "provisioned"
 	StatusFailed      MachineStatus = "failed"
+
+	// StatusWiping machines boot the wipe image instead of their own image
+	// until the wipe job finishes
+	StatusWiping MachineStatus = "wiping"
+
+	// StatusDecommissioned machines have been pulled from service. They are
+	// not booted, built, or re-enrolled until an operator approves it.
+	StatusDecommissioned MachineStatus = "decommissioned"
+
+	// StatusAdopted machines were already running NixOS when they were
+	// brought under management, and have not been built since
+	StatusAdopted MachineStatus = "adopted"
+
+	// StatusTesting machines have a successful build whose boot test has to
+	// pass before they are ready
+	StatusTesting MachineStatus = "testing"
+
+	// StatusConflict machines enrolled with a MAC address or serial number
+	// that belongs to another machine. They are held, and not booted or
+	// built, until an operator resolves the conflict.
+	StatusConflict MachineStatus = "conflict"
+
+	// StatusPreregistered machines were imported from a DCIM and have not
+	// enrolled yet. The first enrollment with their service tag completes
+	// the record.
+	StatusPreregistered MachineStatus = "preregistered"
+)
+
+// Deploy modes select what a machine's builds produce and how they reach it
+const (
+	// DeployModeNetboot machines boot a kernel and initrd built for them
+	// from the iPXE server. An empty deploy mode means netboot.
+	DeployModeNetboot = "netboot"
+
+	// DeployModeSwitch machines boot from their own disk. Builds produce a
+	// system closure that is copied to the machine and switched to over SSH.
+	DeployModeSwitch = "switch"
+)
+
+// Boot modes reported by the registration image
+const (
+	BootModeBIOS     = "bios"
+	BootModeUEFI     = "uefi"
+	BootModeUEFIHTTP = "uefi-http"
+)
+
+// IsValidBootMode reports whether mode is a known boot mode
+func IsValidBootMode(mode string) bool {
+	switch mode {
+	case BootModeBIOS, BootModeUEFI, BootModeUEFIHTTP:
+		return true
+	}
+	return false
+}
+
+// Tag limits
+const (
+	MaxTagLength = 64
+	MaxTags      = 32
 )
 
+// tagPattern is the tag charset. Tags never contain quotes, so a tag is
+// matched exactly by searching a machine's JSON tag array for it in quotes.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._:/-]*$`)
+
+// NormalizeTags lowercases and trims tags, drops duplicates and empty
+// ones, and sorts them. It returns an error for tags that are too long or
+// use characters other than letters, digits, and . _ : / -
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, MaxTagLength)
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q must start with a letter or digit and contain only letters, digits, and . _ : / -", tag)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	if len(normalized) > MaxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", MaxTags)
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// HasTag reports whether tags contains tag
+func HasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeMAC returns mac in the lowercase, colon-separated form machine
+// MAC addresses are stored in
+func NormalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", fmt.Errorf("mac_address %q is not a valid MAC address", mac)
+	}
+	return hw.String(), nil
+}
+
+// placeholderSerials are serial numbers firmware reports when the vendor
+// never set one. Many machines share them, so they identify nothing.
+var placeholderSerials = map[string]bool{
+	"":                       true,
+	"0":                      true,
+	"0123456789":             true,
+	"DEFAULT STRING":         true,
+	"N/A":                    true,
+	"NONE":                   true,
+	"NOT APPLICABLE":         true,
+	"NOT SPECIFIED":          true,
+	"SYSTEM SERIAL NUMBER":   true,
+	"TO BE FILLED BY O.E.M.": true,
+}
+
+// NormalizeSerialNumber returns a hardware serial number trimmed and
+// uppercased for comparison, or "" for placeholders that identify nothing
+func NormalizeSerialNumber(serial string) string {
+	serial = strings.ToUpper(strings.TrimSpace(serial))
+	if placeholderSerials[serial] {
+		return ""
+	}
+	return serial
+}
+
 // Machine represents a bare metal machine in the system
 type Machine struct {
 	ID          string        `json:"id" db:"id"`
@@ -27,23 +172,241 @@ type Machine struct {
 	Hostname    string        `json:"hostname" db:"hostname"`
 	Description string        `json:"description" db:"description"`
 
+	// Free-form labels, normalized by NormalizeTags
+	Tags []string `json:"tags,omitempty" db:"tags"`
+
+	// Where the machine is racked
+	Location *Location `json:"location,omitempty" db:"datacenter"`
+
+	// Ownership is who is responsible for the machine, as set on the
+	// machine itself. EffectiveOwnership fills the fields it leaves empty
+	// from the machine's groups, first by name, and is what events and
+	// notifications carry.
+	Ownership          *Ownership `json:"ownership,omitempty" db:"owner_team"`
+	EffectiveOwnership *Ownership `json:"effective_ownership,omitempty" db:"-"`
+
+	// Arbitrary key/value data such as a cost center or environment, set
+	// through the metadata endpoint and validated by ValidateMetadata
+	Metadata map[string]interface{} `json:"metadata,omitempty" db:"metadata"`
+
 	// Hardware information
 	Hardware HardwareInfo `json:"hardware" db:"hardware"`
 
 	// NixOS configuration
-	NixOSConfig string `json:"nixos_config" db:"nixos_config"`
+	NixOSConfig string `json:"nixos_config,omitempty" db:"nixos_config"`
+
+	// ConfigHash is the ConfigHash of NixOSConfig, and ConfigUpdatedAt when
+	// it last changed; saves that leave the hash as it was don't count.
+	// BuiltConfigHash is the ConfigHash the last successful build was
+	// queued with.
+	ConfigHash      string     `json:"config_hash,omitempty" db:"config_hash"`
+	ConfigUpdatedAt *time.Time `json:"config_updated_at,omitempty" db:"config_updated_at"`
+	BuiltConfigHash string     `json:"built_config_hash,omitempty" db:"built_config_hash"`
+
+	// StaleBuild is set when the configuration has changed since the last
+	// successful build, so the image the machine boots doesn't have the
+	// change. It is worked out by BuildIsStale when the machine is read.
+	StaleBuild bool `json:"stale_build" db:"-"`
+
+	// TemplateID is the template the configuration was applied from. It is
+	// cleared when the configuration is edited by hand.
+	TemplateID string `json:"template_id,omitempty" db:"template_id"`
+
+	// TemplateVariables are the values given for the template's variables
+	// when it was applied, in place of their defaults
+	TemplateVariables map[string]string `json:"template_variables,omitempty" db:"template_variables"`
 
 	// Build information
 	LastBuildID   *string    `json:"last_build_id,omitempty" db:"last_build_id"`
 	LastBuildTime *time.Time `json:"last_build_time,omitempty" db:"last_build_time"`
 
+	// BuildTarget is what builds of the machine produce unless they ask
+	// for another target: netboot if empty
+	BuildTarget string `json:"build_target,omitempty" db:"build_target"`
+
 	// IPMI/BMC configuration
 	BMCInfo *BMCInfo `json:"bmc_info,omitempty" db:"bmc_info"`
 
+	// Wake-on-LAN, used to power on machines without a BMC
+	WakeOnLAN *WakeOnLAN `json:"wake_on_lan,omitempty" db:"wol_enabled"`
+
+	// BMC status from the last on-demand or scheduled poll
+	BMCFirmware    string     `json:"bmc_firmware,omitempty" db:"bmc_firmware"`
+	BMCHealth      string     `json:"bmc_health,omitempty" db:"bmc_health"` // ok, warning, critical
+	BMCUnreachable bool       `json:"bmc_unreachable" db:"bmc_unreachable"`
+	BMCCheckedAt   *time.Time `json:"bmc_checked_at,omitempty" db:"bmc_checked_at"`
+
+	// Power state from the last power poll or BMC power operation
+	PowerState          string     `json:"power_state" db:"power_state"` // on, off, unknown
+	PowerStateUpdatedAt *time.Time `json:"power_state_updated_at,omitempty" db:"power_state_updated_at"`
+
+	// Address from the most recent DHCP lease for the machine's MAC, or
+	// that the machine last enrolled or submitted metrics from, and when
+	// it was recorded
+	CurrentIP          string     `json:"current_ip,omitempty" db:"current_ip"`
+	CurrentIPUpdatedAt *time.Time `json:"current_ip_updated_at,omitempty" db:"current_ip_updated_at"`
+
+	// Firmware boot mode, used by the iPXE server to pick the boot script
+	BootMode string `json:"boot_mode,omitempty" db:"boot_mode"` // bios, uefi, uefi-http
+
+	// How builds are deployed
+	DeployMode string `json:"deploy_mode,omitempty" db:"deploy_mode"` // netboot (default), switch
+
+	// SSH target for deployments. The key is referenced by the name of a
+	// private key file in the builder's SSH keys directory, never stored.
+	SSHAddress string `json:"ssh_address,omitempty" db:"ssh_address"` // host or host:port
+	SSHUser    string `json:"ssh_user,omitempty" db:"ssh_user"`       // Default root
+	SSHKey     string `json:"ssh_key,omitempty" db:"ssh_key"`
+
+	// The user who claimed the machine with its claim code. Viewers other
+	// than the owner can't see a claimed machine.
+	OwnerUserID string     `json:"owner_user_id,omitempty" db:"owner_user_id"`
+	ClaimedAt   *time.Time `json:"claimed_at,omitempty" db:"claimed_at"`
+
+	// Metrics submitted for the machine are accepted whatever identity
+	// they report, for cases such as a chassis swap awaiting re-enrollment
+	IdentityExempt bool `json:"identity_exempt" db:"identity_exempt"`
+
+	// Virtual is set on machines created through the API, with no hardware
+	// behind them, to exercise enrollment, configuration, and builds. It
+	// is fixed when the machine is created. DryRunBuilds has the builder
+	// evaluate a virtual machine's builds without running nix-build.
+	Virtual      bool `json:"virtual" db:"is_virtual"`
+	DryRunBuilds bool `json:"dry_run_builds,omitempty" db:"dry_run_builds"`
+
+	// HardwareCompliance is the result of the last check against the
+	// hardware profile that applies to the machine, if one does
+	HardwareCompliance *HardwareCompliance `json:"hardware_compliance,omitempty" db:"hardware_compliance"`
+
+	// HardwareCompleteness is which of the critical hardware fields the
+	// machine's inventory has. It is worked out from Hardware when the
+	// machine is read.
+	HardwareCompleteness *HardwareCompleteness `json:"hardware_completeness,omitempty" db:"-"`
+
+	// HardwareRefreshRequestedAt is set while the machine is to boot the
+	// registration image, in place of its own image, so its hardware
+	// inventory is collected again. Its next enrollment clears it.
+	HardwareRefreshRequestedAt *time.Time `json:"hardware_refresh_requested_at,omitempty" db:"hardware_refresh_requested_at"`
+
+	// ConfigLint is the result of linting the machine's configuration when
+	// it was last saved or built
+	ConfigLint *LintResult `json:"config_lint,omitempty" db:"config_lint"`
+
 	// Timestamps
 	EnrolledAt time.Time  `json:"enrolled_at" db:"enrolled_at"`
 	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
 	LastSeenAt *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`
+
+	// Set when the machine is decommissioned; the record is deleted once the
+	// retention period has passed
+	DecommissionedAt *time.Time `json:"decommissioned_at,omitempty" db:"decommissioned_at"`
+
+	// Set while the machine is in the trash; it is deleted permanently
+	// once the trash retention period has passed
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+}
+
+// CanProvision reports whether the machine may be configured and built.
+// Decommissioned machines and machines being wiped may not.
+func (m *Machine) CanProvision() bool {
+	return canProvision(m.Status)
+}
+
+func canProvision(status MachineStatus) bool {
+	return status != StatusDecommissioned && status != StatusWiping && status != StatusConflict &&
+		status != StatusPreregistered
+}
+
+// BuildIsStale reports whether the machine's configuration has changed
+// since its last successful build. Machines whose last build predates
+// config hashes are never stale.
+func (m *Machine) BuildIsStale() bool {
+	return m.LastBuildID != nil && m.BuiltConfigHash != "" && m.ConfigHash != m.BuiltConfigHash
+}
+
+// ConfigHash returns the hash configurations are compared by, to tell a
+// change from a save of the same configuration. Line endings and
+// surrounding whitespace don't count; an empty configuration hashes to "".
+func ConfigHash(config string) string {
+	config = strings.TrimSpace(strings.ReplaceAll(config, "\r\n", "\n"))
+	if config == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(config))
+	return hex.EncodeToString(sum[:])
+}
+
+// BootsFromDisk reports whether the machine boots from its own disk rather
+// than being served a netboot image
+func (m *Machine) BootsFromDisk() bool {
+	return m.DeployMode == DeployModeSwitch
+}
+
+// MachineSummary is the lightweight form of a machine used by list views.
+// It leaves out the NixOS configuration, BMC credentials, and all but a few
+// hardware fields, which are extracted by the database.
+type MachineSummary struct {
+	ID          string        `json:"id"`
+	ServiceTag  string        `json:"service_tag"`
+	MACAddress  string        `json:"mac_address"`
+	Status      MachineStatus `json:"status"`
+	Hostname    string        `json:"hostname"`
+	Description string        `json:"description"`
+	Tags        []string      `json:"tags,omitempty"`
+	Location    *Location     `json:"location,omitempty"`
+
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// EffectiveOwnership is the machine's ownership with the fields it
+	// doesn't set inherited from its groups
+	EffectiveOwnership *Ownership `json:"effective_ownership,omitempty"`
+
+	Manufacturer string  `json:"manufacturer"`
+	Model        string  `json:"model"`
+	CPUModel     string  `json:"cpu_model"`
+	CPUCores     int     `json:"cpu_cores"`
+	MemoryGB     float64 `json:"memory_gb"`
+	DiskCount    int     `json:"disk_count"`
+	GPUCount     int     `json:"gpu_count"`
+	GPUModel     string  `json:"gpu_model,omitempty"` // The first GPU's
+
+	HasConfig  bool   `json:"has_config"`  // Whether a NixOS configuration is set
+	Virtual    bool   `json:"virtual"`     // Created through the API, with no hardware
+	StaleBuild bool   `json:"stale_build"` // Configuration changed since the last successful build
+	CurrentIP  string `json:"current_ip,omitempty"`
+	DeployMode string `json:"deploy_mode,omitempty"`
+
+	CurrentIPUpdatedAt *time.Time `json:"current_ip_updated_at,omitempty"`
+
+	OwnerUserID string `json:"owner_user_id,omitempty"`
+
+	// ArtifactBytes is the space the machine's images take up in the
+	// images directory
+	ArtifactBytes int64 `json:"artifact_bytes"`
+
+	BMCEnabled     bool   `json:"bmc_enabled"`
+	BMCHealth      string `json:"bmc_health,omitempty"`
+	BMCUnreachable bool   `json:"bmc_unreachable"`
+
+	PowerState          string     `json:"power_state"`
+	PowerStateUpdatedAt *time.Time `json:"power_state_updated_at,omitempty"`
+
+	LastBuildID      *string    `json:"last_build_id,omitempty"`
+	LastBuildTime    *time.Time `json:"last_build_time,omitempty"`
+	EnrolledAt       time.Time  `json:"enrolled_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	LastSeenAt       *time.Time `json:"last_seen_at,omitempty"`
+	DecommissionedAt *time.Time `json:"decommissioned_at,omitempty"`
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"`
+
+	// HardwareRefreshRequestedAt is set while the machine is to boot the
+	// registration image; the iPXE server looks machines up by summary
+	HardwareRefreshRequestedAt *time.Time `json:"hardware_refresh_requested_at,omitempty"`
+}
+
+// CanProvision reports whether the machine may be configured and built
+func (m *MachineSummary) CanProvision() bool {
+	return canProvision(m.Status)
 }
 
 // BMCInfo contains BMC/IPMI configuration and credentials
@@ -54,6 +417,96 @@ type BMCInfo struct {
 	Type      string `json:"type"`               // IPMI, Redfish, etc.
 	Port      int    `json:"port,omitempty"`
 	Enabled   bool   `json:"enabled"`
+
+	// ipmitool session options for BMCs that reject the defaults. Zero
+	// values leave ipmitool's defaults in place.
+	Interface      string `json:"interface,omitempty"`       // lan or lanplus (default)
+	CipherSuite    int    `json:"cipher_suite,omitempty"`    // lanplus cipher suite ID, e.g. 17
+	PrivilegeLevel string `json:"privilege_level,omitempty"` // CALLBACK, USER, OPERATOR, or ADMINISTRATOR
+	Retries        int    `json:"retries,omitempty"`         // Session retries (-R)
+
+	// Discovered by the registration image; Channel is also the channel
+	// whose users are listed when rotating the password
+	MACAddress string `json:"mac_address,omitempty"`
+	Channel    int    `json:"channel,omitempty"` // LAN channel, default 1
+
+	// Whether the BMC can capture the server's screen over Redfish, found
+	// the first time a screenshot is taken. Nil until then; clearing it
+	// detects it again.
+	ScreenshotSupported *bool `json:"screenshot_supported,omitempty"`
+}
+
+// Location is where a machine is racked
+type Location struct {
+	Datacenter string `json:"datacenter,omitempty"`
+	Rack       string `json:"rack,omitempty"`
+	RackUnit   int    `json:"rack_unit,omitempty"` // Lowest rack unit the machine occupies
+}
+
+// WakeOnLAN configures powering a machine on with a Wake-on-LAN magic
+// packet, for machines without a BMC
+type WakeOnLAN struct {
+	Enabled bool `json:"enabled"`
+
+	// The NIC to wake. It defaults to the MAC address the machine enrolled
+	// with.
+	MACAddress string `json:"mac_address,omitempty"`
+}
+
+// WakeOnLANMAC returns the MAC address a Wake-on-LAN packet for the machine
+// is sent to, or "" if Wake-on-LAN is not enabled
+func (m *Machine) WakeOnLANMAC() string {
+	if m.WakeOnLAN == nil || !m.WakeOnLAN.Enabled {
+		return ""
+	}
+	if m.WakeOnLAN.MACAddress != "" {
+		return m.WakeOnLAN.MACAddress
+	}
+	return m.MACAddress
+}
+
+// IPMI session options accepted in BMCInfo
+const (
+	IPMIInterfaceLAN     = "lan"
+	IPMIInterfaceLANPlus = "lanplus"
+
+	// maxCipherSuite is the highest cipher suite ID ipmitool knows
+	maxCipherSuite = 17
+
+	// maxIPMIChannel is the highest IPMI channel number
+	maxIPMIChannel = 15
+)
+
+// ValidateIPMIOptions checks the optional ipmitool session options
+func (b *BMCInfo) ValidateIPMIOptions() error {
+	switch b.Interface {
+	case "", IPMIInterfaceLAN, IPMIInterfaceLANPlus:
+	default:
+		return fmt.Errorf("interface must be lan or lanplus")
+	}
+
+	if b.CipherSuite < 0 || b.CipherSuite > maxCipherSuite {
+		return fmt.Errorf("cipher_suite must be between 0 and %d", maxCipherSuite)
+	}
+	if b.CipherSuite != 0 && b.Interface == IPMIInterfaceLAN {
+		return fmt.Errorf("cipher_suite only applies to the lanplus interface")
+	}
+
+	switch b.PrivilegeLevel {
+	case "", "CALLBACK", "USER", "OPERATOR", "ADMINISTRATOR":
+	default:
+		return fmt.Errorf("privilege_level must be CALLBACK, USER, OPERATOR, or ADMINISTRATOR")
+	}
+
+	if b.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+
+	if b.Channel < 0 || b.Channel > maxIPMIChannel {
+		return fmt.Errorf("channel must be between 0 and %d", maxIPMIChannel)
+	}
+
+	return nil
 }
 
 // Scan implements the sql.Scanner interface for BMCInfo
@@ -77,16 +530,16 @@ func (b BMCInfo) Value() (interface{}, error) {
 
 // HardwareInfo contains detailed hardware information about a machine
 type HardwareInfo struct {
-	Manufacturer string          `json:"manufacturer"`
-	Model        string          `json:"model"`
-	SerialNumber string          `json:"serial_number"`
-	BIOSVersion  string          `json:"bios_version"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	SerialNumber string `json:"serial_number"`
+	BIOSVersion  string `json:"bios_version"`
 
-	CPU     CPUInfo     `json:"cpu"`
-	Memory  MemoryInfo  `json:"memory"`
-	Disks   []DiskInfo  `json:"disks"`
-	NICs    []NICInfo   `json:"nics"`
-	GPUs    []GPUInfo   `json:"gpus,omitempty"`
+	CPU    CPUInfo    `json:"cpu"`
+	Memory MemoryInfo `json:"memory"`
+	Disks  []DiskInfo `json:"disks"`
+	NICs   []NICInfo  `json:"nics"`
+	GPUs   []GPUInfo  `json:"gpus,omitempty"`
 
 	// Raw data from dmidecode, lshw, etc.
 	RawData map[string]interface{} `json:"raw_data,omitempty"`
@@ -94,11 +547,11 @@ type HardwareInfo struct {
 
 // CPUInfo contains CPU details
 type CPUInfo struct {
-	Model       string `json:"model"`
-	Cores       int    `json:"cores"`
-	Threads     int    `json:"threads"`
-	Sockets     int    `json:"sockets"`
-	MaxFreqMHz  int    `json:"max_freq_mhz"`
+	Model        string `json:"model"`
+	Cores        int    `json:"cores"`
+	Threads      int    `json:"threads"`
+	Sockets      int    `json:"sockets"`
+	MaxFreqMHz   int    `json:"max_freq_mhz"`
 	Architecture string `json:"architecture"`
 }
 
@@ -113,7 +566,7 @@ type MemoryInfo struct {
 type MemorySlot struct {
 	Slot      string `json:"slot"`
 	SizeBytes int64  `json:"size_bytes"`
-	Type      string `json:"type"` // DDR4, DDR5, etc.
+	Type      string `json:"type"`  // DDR4, DDR5, etc.
 	Speed     int    `json:"speed"` // MHz
 }
 
@@ -139,12 +592,15 @@ type NICInfo struct {
 	LinkStatus string `json:"link_status"` // up, down
 }
 
-// GPUInfo contains GPU details
+// GPUInfo contains GPU details. UUID, VBIOS version, and memory are only
+// known when the vendor's tools, such as nvidia-smi, are available.
 type GPUInfo struct {
-	Model      string `json:"model"`
-	Vendor     string `json:"vendor"`
-	PCIAddress string `json:"pci_address"`
-	Memory     int64  `json:"memory_bytes,omitempty"`
+	Model        string `json:"model"`
+	Vendor       string `json:"vendor"`
+	PCIAddress   string `json:"pci_address"`
+	Memory       int64  `json:"memory_bytes,omitempty"`
+	UUID         string `json:"uuid,omitempty"`
+	VBIOSVersion string `json:"vbios_version,omitempty"`
 }
 
 // Scan implements the sql.Scanner interface for HardwareInfo
@@ -166,102 +622,539 @@ func (h HardwareInfo) Value() (interface{}, error) {
 	return json.Marshal(h)
 }
 
+// MergeMissing fills empty fields from another inventory source without
+// overwriting anything already present. It is used to layer BMC-collected
+// inventory under the richer data reported by the registration image.
+func (h *HardwareInfo) MergeMissing(other HardwareInfo) {
+	if h.Manufacturer == "" {
+		h.Manufacturer = other.Manufacturer
+	}
+	if h.Model == "" {
+		h.Model = other.Model
+	}
+	if h.SerialNumber == "" {
+		h.SerialNumber = other.SerialNumber
+	}
+	if h.BIOSVersion == "" {
+		h.BIOSVersion = other.BIOSVersion
+	}
+
+	if h.CPU.Model == "" {
+		h.CPU.Model = other.CPU.Model
+	}
+	if h.CPU.Sockets == 0 {
+		h.CPU.Sockets = other.CPU.Sockets
+	}
+	if h.CPU.Cores == 0 {
+		h.CPU.Cores = other.CPU.Cores
+	}
+	if h.CPU.Threads == 0 {
+		h.CPU.Threads = other.CPU.Threads
+	}
+	if h.CPU.MaxFreqMHz == 0 {
+		h.CPU.MaxFreqMHz = other.CPU.MaxFreqMHz
+	}
+	if h.CPU.Architecture == "" {
+		h.CPU.Architecture = other.CPU.Architecture
+	}
+
+	if h.Memory.TotalBytes == 0 {
+		h.Memory.TotalBytes = other.Memory.TotalBytes
+		h.Memory.TotalGB = other.Memory.TotalGB
+	}
+	if len(h.Memory.Modules) == 0 {
+		h.Memory.Modules = other.Memory.Modules
+	}
+
+	if len(h.Disks) == 0 {
+		h.Disks = other.Disks
+	}
+	if len(h.NICs) == 0 {
+		h.NICs = other.NICs
+	}
+	if len(h.GPUs) == 0 {
+		h.GPUs = other.GPUs
+	}
+}
+
 // EnrollmentRequest is the payload sent by the registration image
 type EnrollmentRequest struct {
-	ServiceTag  string       `json:"service_tag"`
-	MACAddress  string       `json:"mac_address"`
-	Hardware    HardwareInfo `json:"hardware"`
+	ServiceTag string         `json:"service_tag"`
+	MACAddress string         `json:"mac_address"`
+	Hardware   HardwareInfo   `json:"hardware"`
+	BootMode   string         `json:"boot_mode,omitempty"`
+	BMC        *EnrollmentBMC `json:"bmc,omitempty"` // Discovered in-band, optional
+}
+
+// EnrollmentBMC is the BMC LAN configuration the registration image reads
+// in-band with `ipmitool lan print`
+type EnrollmentBMC struct {
+	IPAddress  string `json:"ip_address,omitempty"`
+	MACAddress string `json:"mac_address,omitempty"`
+	Channel    int    `json:"channel,omitempty"`
+}
+
+// MergeInto fills in the parts of a machine's BMC info that are still
+// unset from what the registration image discovered. Credentials and
+// anything an operator already set are never changed. It returns the
+// merged BMC info and whether anything changed.
+func (d *EnrollmentBMC) MergeInto(info *BMCInfo) (*BMCInfo, bool) {
+	ip, err := NormalizeIP(d.IPAddress)
+	if err != nil || netip.MustParseAddr(ip).IsUnspecified() {
+		return info, false
+	}
+
+	merged := BMCInfo{Type: "IPMI"}
+	if info != nil {
+		merged = *info
+	}
+
+	changed := false
+	if merged.IPAddress == "" {
+		merged.IPAddress = ip
+		changed = true
+	}
+	if merged.MACAddress == "" && d.MACAddress != "" {
+		if mac, err := net.ParseMAC(d.MACAddress); err == nil {
+			merged.MACAddress = mac.String()
+			changed = true
+		}
+	}
+	if merged.Channel == 0 && d.Channel > 0 && d.Channel <= maxIPMIChannel {
+		merged.Channel = d.Channel
+		changed = true
+	}
+
+	if !changed {
+		return info, false
+	}
+	return &merged, true
+}
+
+// AdoptRequest brings a machine that already runs NixOS under management
+// without netbooting or reinstalling it
+type AdoptRequest struct {
+	ServiceTag  string `json:"service_tag"`
+	MACAddress  string `json:"mac_address"`
+	Hostname    string `json:"hostname"`
+	SSHAddress  string `json:"ssh_address"`            // host or host:port reachable over SSH
+	SSHUser     string `json:"ssh_user,omitempty"`     // Default root
+	SSHKey      string `json:"ssh_key,omitempty"`      // Key file name in the builder's SSH keys directory
+	NixOSConfig string `json:"nixos_config,omitempty"` // The machine's current configuration.nix
+	Description string `json:"description,omitempty"`
+}
+
+// CreateMachineRequest creates a virtual machine through the API: a machine
+// with the hardware given rather than reported by the registration image,
+// for exercising the pipeline without hardware. Virtual must be set.
+type CreateMachineRequest struct {
+	EnrollmentRequest
+	Virtual      bool     `json:"virtual"`
+	DryRunBuilds bool     `json:"dry_run_builds,omitempty"` // Evaluate builds without running nix-build
+	Hostname     string   `json:"hostname,omitempty"`
+	Description  string   `json:"description,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	NixOSConfig  string   `json:"nixos_config,omitempty"`
+}
+
+// DecommissionRequest represents a request to take a machine out of service
+type DecommissionRequest struct {
+	PowerOff bool   `json:"power_off"` // Power the machine off through its BMC
+	Reason   string `json:"reason,omitempty"`
 }
 
 // BuildRequest represents a request to build a custom NixOS image
 type BuildRequest struct {
-	ID          string    `json:"id" db:"id"`
-	MachineID   string    `json:"machine_id" db:"machine_id"`
-	Status      string    `json:"status" db:"status"` // pending, building, success, failed
-	Config      string    `json:"config" db:"config"`
-	LogOutput   string    `json:"log_output" db:"log_output"`
-	Error       string    `json:"error,omitempty" db:"error"`
-	ArtifactURL string    `json:"artifact_url,omitempty" db:"artifact_url"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID          string     `json:"id" db:"id"`
+	Type        string     `json:"type" db:"type"`             // machine, or a system image such as registration
+	MachineID   string     `json:"machine_id" db:"machine_id"` // Empty for system image builds
+	Status      string     `json:"status" db:"status"`         // awaiting_approval, pending, unschedulable, building, success, failed, cancelled, rejected, tested_failed
+	Config      string     `json:"config" db:"config"`
+	RequireTest bool       `json:"require_test,omitempty" db:"require_test"` // Machine is not ready until the build's boot test passes
+	Priority    string     `json:"priority" db:"priority"`                   // urgent, high, normal, or low
+	Target      string     `json:"target" db:"target"`                       // netboot, iso, sd-image, or kexec
+	Error       string     `json:"error,omitempty" db:"error"`
+	ArtifactURL string     `json:"artifact_url,omitempty" db:"artifact_url"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+
+	// Builder is the name of the builder that ran the build, and
+	// Environment its toolchain, recorded when the build starts
+	Builder     string            `json:"builder,omitempty" db:"builder"`
+	Environment *BuildEnvironment `json:"environment,omitempty" db:"-"`
+
+	// DurationMS is how long the builder spent on the build, and
+	// PeakMemoryBytes the most memory the build used, when the builder
+	// could measure it
+	DurationMS      int64 `json:"duration_ms,omitempty" db:"duration_ms"`
+	PeakMemoryBytes int64 `json:"peak_memory_bytes,omitempty" db:"peak_memory_bytes"`
+
+	// SystemPath is the store path of the build's system closure.
+	// ClosureDiff lists the packages that changed since the closure of
+	// ClosureDiffFrom, the machine's previous successful build, when the
+	// builder could still find it.
+	SystemPath      string `json:"system_path,omitempty" db:"system_path"`
+	ClosureDiff     string `json:"closure_diff,omitempty" db:"closure_diff"`
+	ClosureDiffFrom string `json:"closure_diff_from,omitempty" db:"closure_diff_from"`
+
+	// SigningKey is the fingerprint of the key that signed the build's
+	// kernel and initrd, if the builder signs boot artifacts
+	SigningKey string `json:"signing_key,omitempty" db:"signing_key"`
+
+	// ArtifactBytes is the size of the artifacts the build published
+	ArtifactBytes int64 `json:"artifact_bytes,omitempty" db:"artifact_bytes"`
+
+	// ConfigHash is the machine's ConfigHash when the build was queued,
+	// which the machine's BuiltConfigHash becomes if the build succeeds
+	ConfigHash string `json:"config_hash,omitempty" db:"config_hash"`
+
+	// DryRun builds, queued for virtual machines with DryRunBuilds set,
+	// are evaluated by the builder but not built, and publish no artifacts
+	DryRun bool `json:"dry_run,omitempty" db:"dry_run"`
+
+	// LeaseExpiresAt is when a building build goes back in the queue
+	// unless its builder renews the lease, and Attempts how many times the
+	// build has been claimed
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty" db:"lease_expires_at"`
+	Attempts       int        `json:"attempts,omitempty" db:"attempts"`
+
+	// RequestedBy is the user who queued the build. ReviewedBy and
+	// ReviewedAt record the admin who approved or rejected it, for builds
+	// that waited for approval.
+	RequestedBy string     `json:"requested_by,omitempty" db:"requested_by"`
+	ReviewedBy  string     `json:"reviewed_by,omitempty" db:"reviewed_by"`
+	ReviewedAt  *time.Time `json:"reviewed_at,omitempty" db:"reviewed_at"`
+
+	// BuildRequirements decide which builders may claim the build. A
+	// build no live builder can claim becomes unschedulable until one can.
+	BuildRequirements
+
+	// Lint is the result of linting the build's configuration before it
+	// was queued. A build whose lint found errors fails without being
+	// built, with the errors as its error.
+	Lint *LintResult `json:"lint,omitempty" db:"lint"`
+
+	// Warnings are problems the builder reported that didn't fail the
+	// build, such as an image built without its machine token
+	Warnings []string `json:"warnings,omitempty" db:"warnings"`
+
+	// QueuePosition is the build's place in the queue while it is pending,
+	// starting at 1 for the next build to be claimed
+	QueuePosition int `json:"queue_position,omitempty" db:"-"`
+}
+
+// Build priorities. Pending builds are claimed in order of priority, then
+// oldest first. Only admins can queue urgent builds. Priorities don't
+// preempt: running builds are never paused for an urgent one.
+const (
+	BuildPriorityUrgent = "urgent"
+	BuildPriorityHigh   = "high"
+	BuildPriorityNormal = "normal"
+	BuildPriorityLow    = "low"
+)
+
+// BuildPriorities lists the build priorities, most urgent first
+var BuildPriorities = []string{
+	BuildPriorityUrgent,
+	BuildPriorityHigh,
+	BuildPriorityNormal,
+	BuildPriorityLow,
+}
+
+// IsValidBuildPriority reports whether priority is a build priority
+func IsValidBuildPriority(priority string) bool {
+	for _, p := range BuildPriorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// Build statuses of the approval gate. A build that needs approval waits
+// in awaiting_approval, which builders don't claim, until an admin moves it
+// to pending or rejects it.
+const (
+	BuildStatusAwaitingApproval = "awaiting_approval"
+	BuildStatusRejected         = "rejected"
+)
+
+// TrustedTemplateTag marks templates whose configurations are built
+// without waiting for approval
+const TrustedTemplateTag = "trusted"
+
+// BuildReviewRequest approves or rejects a build awaiting approval. The
+// reason is recorded as the error of a rejected build.
+type BuildReviewRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// BuildMachineRequest queues a build of a machine. Target defaults to the
+// machine's build target.
+type BuildMachineRequest struct {
+	Priority string `json:"priority"`
+	Target   string `json:"target,omitempty"`
+}
+
+// BuildPriorityRequest sets the priority of a build
+type BuildPriorityRequest struct {
+	Priority string `json:"priority"`
 }
 
 // PowerOperation represents a power control operation
 type PowerOperation struct {
-	ID         string    `json:"id" db:"id"`
-	MachineID  string    `json:"machine_id" db:"machine_id"`
-	Operation  string    `json:"operation" db:"operation"` // on, off, reset, status
-	Status     string    `json:"status" db:"status"`       // pending, success, failed
-	Result     string    `json:"result,omitempty" db:"result"`
-	Error      string    `json:"error,omitempty" db:"error"`
-	InitiatedBy string   `json:"initiated_by" db:"initiated_by"` // User ID
-	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	ID          string     `json:"id" db:"id"`
+	MachineID   string     `json:"machine_id" db:"machine_id"`
+	Operation   string     `json:"operation" db:"operation"` // on, off, reset, status
+	Method      string     `json:"method" db:"method"`       // bmc, wol, or simulated
+	Status      string     `json:"status" db:"status"`       // pending, success, failed
+	Result      string     `json:"result,omitempty" db:"result"`
+	Error       string     `json:"error,omitempty" db:"error"`
+	InitiatedBy string     `json:"initiated_by" db:"initiated_by"` // User ID
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
 }
 
+// Machine power states
+const (
+	PowerStateOn      = "on"
+	PowerStateOff     = "off"
+	PowerStateUnknown = "unknown"
+)
+
+// Ways a power operation reaches a machine
+const (
+	PowerMethodBMC = "bmc"
+	PowerMethodWOL = "wol"
+
+	// PowerMethodSimulated records operations on virtual machines, which
+	// succeed without reaching anything
+	PowerMethodSimulated = "simulated"
+)
+
 // MachineMetrics represents collected metrics from a machine
 type MachineMetrics struct {
-	ID              string    `json:"id" db:"id"`
-	MachineID       string    `json:"machine_id" db:"machine_id"`
-	Timestamp       time.Time `json:"timestamp" db:"timestamp"`
-	CPUUsagePercent float64   `json:"cpu_usage_percent" db:"cpu_usage_percent"`
-	MemoryUsedBytes int64     `json:"memory_used_bytes" db:"memory_used_bytes"`
-	MemoryTotalBytes int64    `json:"memory_total_bytes" db:"memory_total_bytes"`
-	DiskUsedBytes   int64     `json:"disk_used_bytes" db:"disk_used_bytes"`
-	DiskTotalBytes  int64     `json:"disk_total_bytes" db:"disk_total_bytes"`
-	NetworkRxBytes  int64     `json:"network_rx_bytes" db:"network_rx_bytes"`
-	NetworkTxBytes  int64     `json:"network_tx_bytes" db:"network_tx_bytes"`
-	LoadAverage1    float64   `json:"load_average_1" db:"load_average_1"`
-	LoadAverage5    float64   `json:"load_average_5" db:"load_average_5"`
-	LoadAverage15   float64   `json:"load_average_15" db:"load_average_15"`
-	Temperature     *float64  `json:"temperature,omitempty" db:"temperature"`
-	PowerState      string    `json:"power_state" db:"power_state"` // on, off, unknown
-	Uptime          int64     `json:"uptime" db:"uptime"` // seconds
+	ID               string       `json:"id" db:"id"`
+	MachineID        string       `json:"machine_id" db:"machine_id"`
+	Timestamp        time.Time    `json:"timestamp" db:"timestamp"`
+	CPUUsagePercent  float64      `json:"cpu_usage_percent" db:"cpu_usage_percent"`
+	MemoryUsedBytes  int64        `json:"memory_used_bytes" db:"memory_used_bytes"`
+	MemoryTotalBytes int64        `json:"memory_total_bytes" db:"memory_total_bytes"`
+	DiskUsedBytes    int64        `json:"disk_used_bytes" db:"disk_used_bytes"`
+	DiskTotalBytes   int64        `json:"disk_total_bytes" db:"disk_total_bytes"`
+	NetworkRxBytes   int64        `json:"network_rx_bytes" db:"network_rx_bytes"`
+	NetworkTxBytes   int64        `json:"network_tx_bytes" db:"network_tx_bytes"`
+	LoadAverage1     float64      `json:"load_average_1" db:"load_average_1"`
+	LoadAverage5     float64      `json:"load_average_5" db:"load_average_5"`
+	LoadAverage15    float64      `json:"load_average_15" db:"load_average_15"`
+	Temperature      *float64     `json:"temperature,omitempty" db:"temperature"`
+	PowerState       string       `json:"power_state" db:"power_state"` // on, off, unknown
+	Uptime           int64        `json:"uptime" db:"uptime"`           // seconds
+	GPUs             []GPUMetrics `json:"gpus,omitempty" db:"gpus"`
+
+	// The identity of the host that submitted the metrics, checked against
+	// the machine record and not stored
+	ReportedServiceTag string `json:"reported_service_tag,omitempty"`
+	ReportedMAC        string `json:"reported_mac,omitempty"`
+}
+
+// IdentityExemptRequest sets whether a machine's metrics submissions skip
+// the identity check
+type IdentityExemptRequest struct {
+	IdentityExempt *bool `json:"identity_exempt"`
+}
+
+// GPUMetrics is one GPU's readings in a metrics report. GPUs are identified
+// by UUID when the agent knows it, and otherwise by index.
+type GPUMetrics struct {
+	Index       int      `json:"index"`
+	UUID        string   `json:"uuid,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"` // Celsius
 }
 
 // ImageTest represents a test result for a boot image
 type ImageTest struct {
-	ID          string    `json:"id" db:"id"`
-	ImagePath   string    `json:"image_path" db:"image_path"`
-	ImageType   string    `json:"image_type" db:"image_type"` // registration, custom
-	TestType    string    `json:"test_type" db:"test_type"`   // boot, integrity, validation
-	Status      string    `json:"status" db:"status"`         // pending, running, passed, failed
-	Result      string    `json:"result,omitempty" db:"result"`
-	Error       string    `json:"error,omitempty" db:"error"`
-	MachineID   *string   `json:"machine_id,omitempty" db:"machine_id"` // Optional: machine used for testing
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID          string     `json:"id" db:"id"`
+	ImagePath   string     `json:"image_path" db:"image_path"`
+	ImageType   string     `json:"image_type" db:"image_type"` // registration, custom
+	TestType    string     `json:"test_type" db:"test_type"`   // boot, integrity, validation
+	Status      string     `json:"status" db:"status"`         // pending, running, passed, failed
+	Result      string     `json:"result,omitempty" db:"result"`
+	Error       string     `json:"error,omitempty" db:"error"`
+	MachineID   *string    `json:"machine_id,omitempty" db:"machine_id"` // Optional: machine used for testing
+	BuildID     *string    `json:"build_id,omitempty" db:"build_id"`     // Optional: build whose image is tested
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
 }
 
 // Webhook represents a webhook endpoint for event notifications
 type Webhook struct {
+	ID         string          `json:"id" db:"id"`
+	Name       string          `json:"name" db:"name"`
+	URL        string          `json:"url" db:"url"`
+	Events     []string        `json:"events" db:"events"`           // machine.enrolled, machine.status_changed, etc.
+	Secret     string          `json:"secret,omitempty" db:"secret"` // For HMAC signature
+	Active     bool            `json:"active" db:"active"`
+	Headers    json.RawMessage `json:"headers,omitempty" db:"headers"` // Custom headers as JSON
+	Timeout    int             `json:"timeout" db:"timeout"`           // Request timeout in seconds
+	MaxRetries int             `json:"max_retries" db:"max_retries"`   // Attempts per delivery, the first included
+
+	// Retry is how failed deliveries are retried, and Retry.Events how
+	// for particular event types. Without it, the defaults apply.
+	Retry *WebhookRetryPolicy `json:"retry,omitempty" db:"retry_policy"`
+
+	// Optional scoping. A webhook with group IDs only fires for machines in
+	// one of the groups, one with statuses only for machines in one of the
+	// statuses, and one with tags only for machines with one of the tags.
+	GroupIDs []string `json:"group_ids,omitempty" db:"group_ids"`
+	Statuses []string `json:"statuses,omitempty" db:"statuses"`
+	Tags     []string `json:"tags,omitempty" db:"tags"`
+
+	// Fields limits the event data sent to these keys. machine_id is always
+	// sent.
+	Fields []string `json:"fields,omitempty" db:"fields"`
+
+	// AllowPrivateNetworks lets the URL resolve to loopback, link-local, or
+	// private addresses. Only admins may set it.
+	AllowPrivateNetworks bool `json:"allow_private_networks" db:"allow_private_networks"`
+
+	// SchemaVersion is the payload schema the webhook receives. New
+	// webhooks get the current version unless they pin another.
+	SchemaVersion string `json:"schema_version" db:"schema_version"`
+
+	// Format is how deliveries are wrapped: WebhookFormatDefault sends
+	// the payload as is, WebhookFormatCloudEvents in a CloudEvents 1.0
+	// envelope
+	Format string `json:"format" db:"format"`
+
+	// A webhook whose deliveries keep failing is deactivated once its
+	// failure streak reaches DisableAfterFailures and has lasted
+	// DisableAfterSeconds. Zero takes the server's default; a negative
+	// DisableAfterFailures never deactivates the webhook.
+	DisableAfterFailures int `json:"disable_after_failures,omitempty" db:"disable_after_failures"`
+	DisableAfterSeconds  int `json:"disable_after_seconds,omitempty" db:"disable_after_seconds"`
+
+	// ConsecutiveFailures is the failure streak since the last successful
+	// delivery, which began at FailingSince. Failures a receiver may
+	// recover from by itself count once, others more; see the webhook
+	// package. FailureLimit is the streak the webhook is deactivated at,
+	// with the server's default applied, and is absent if it never is.
+	ConsecutiveFailures int        `json:"consecutive_failures" db:"consecutive_failures"`
+	FailingSince        *time.Time `json:"failing_since,omitempty" db:"failing_since"`
+	FailureLimit        int        `json:"failure_limit,omitempty" db:"-"`
+
+	// AutoDisabledAt is when the webhook was deactivated for failing, and
+	// DisabledReason why. Both are cleared when it is reactivated.
+	AutoDisabledAt *time.Time `json:"auto_disabled_at,omitempty" db:"auto_disabled_at"`
+	DisabledReason string     `json:"disabled_reason,omitempty" db:"disabled_reason"`
+
+	LastSuccess *time.Time `json:"last_success,omitempty" db:"last_success"`
+	LastFailure *time.Time `json:"last_failure,omitempty" db:"last_failure"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+
+	// Stats summarizes recent deliveries. Only a single webhook's GET
+	// computes it.
+	Stats *WebhookDeliveryStats `json:"stats,omitempty" db:"-"`
+}
+
+// Webhook delivery formats
+const (
+	WebhookFormatDefault     = "default"
+	WebhookFormatCloudEvents = "cloudevents"
+)
+
+// IsValidWebhookFormat reports whether format is a webhook delivery format
+func IsValidWebhookFormat(format string) bool {
+	return format == WebhookFormatDefault || format == WebhookFormatCloudEvents
+}
+
+// Scoped reports whether the webhook only fires for some machines
+func (w *Webhook) Scoped() bool {
+	return len(w.GroupIDs) > 0 || len(w.Statuses) > 0 || len(w.Tags) > 0
+}
+
+// WebhookDelivery represents a webhook delivery attempt
+type WebhookDelivery struct {
+	ID          string     `json:"id" db:"id"`
+	WebhookID   string     `json:"webhook_id" db:"webhook_id"`
+	EventID     string     `json:"event_id,omitempty" db:"event_id"` // The event's ID in the machine event log
+	Event       string     `json:"event" db:"event"`
+	Payload     string     `json:"payload" db:"payload"`
+	StatusCode  int        `json:"status_code" db:"status_code"`
+	Response    string     `json:"response,omitempty" db:"response"`
+	Error       string     `json:"error,omitempty" db:"error"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	Success     bool       `json:"success" db:"success"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+
+	// MachineID is the machine the event was about. MachineHostname is its
+	// hostname when the deliveries are listed, not when the event happened.
+	MachineID       string `json:"machine_id,omitempty" db:"machine_id"`
+	MachineHostname string `json:"machine_hostname,omitempty" db:"-"`
+
+	// PayloadSize is the size of the payload sent. Payloads larger than
+	// MaxStoredWebhookPayload are cut when the delivery is recorded.
+	PayloadSize      int  `json:"payload_size" db:"payload_size"`
+	PayloadTruncated bool `json:"payload_truncated,omitempty" db:"-"`
+
+	// DurationMS is how long the last attempt took, from sending the
+	// request to reading the response. Deliveries recorded before
+	// durations were have none.
+	DurationMS *int64 `json:"duration_ms,omitempty" db:"duration_ms"`
+
+	// AttemptHistory records each attempt, in order. Deliveries recorded
+	// before it was kept have none.
+	AttemptHistory []WebhookDeliveryAttempt `json:"attempt_history,omitempty" db:"attempt_history"`
+}
+
+// MaxStoredWebhookPayload is how much of a delivery's payload is recorded
+const MaxStoredWebhookPayload = 64 << 10
+
+// WebhookDeliveryStats summarizes a webhook's recent deliveries, to show
+// its health at a glance
+type WebhookDeliveryStats struct {
+	Since        time.Time `json:"since"`
+	Deliveries   int       `json:"deliveries"`
+	Failures     int       `json:"failures"`
+	SuccessRate  float64   `json:"success_rate"`             // 0 to 1; 0 without deliveries
+	P95LatencyMS *int64    `json:"p95_latency_ms,omitempty"` // Of deliveries with durations
+}
+
+// Notification channel types
+const (
+	NotificationSlack = "slack"
+	NotificationEmail = "email"
+)
+
+// NotificationChannel is a Slack or email destination for machine events
+type NotificationChannel struct {
 	ID          string          `json:"id" db:"id"`
 	Name        string          `json:"name" db:"name"`
-	URL         string          `json:"url" db:"url"`
-	Events      []string        `json:"events" db:"events"` // machine.enrolled, machine.status_changed, etc.
-	Secret      string          `json:"secret,omitempty" db:"secret"` // For HMAC signature
+	Type        string          `json:"type" db:"type"`     // slack, email
+	Events      []string        `json:"events" db:"events"` // Same event names as webhooks, or "*"
+	Config      json.RawMessage `json:"config" db:"config"` // Type-specific settings (webhook URL, SMTP server)
 	Active      bool            `json:"active" db:"active"`
-	Headers     json.RawMessage `json:"headers,omitempty" db:"headers"` // Custom headers as JSON
-	Timeout     int             `json:"timeout" db:"timeout"` // Request timeout in seconds
-	MaxRetries  int             `json:"max_retries" db:"max_retries"`
+	RateLimit   int             `json:"rate_limit" db:"rate_limit"`   // Messages per window before events are collapsed into a digest
+	RateWindow  int             `json:"rate_window" db:"rate_window"` // Window in seconds
 	LastSuccess *time.Time      `json:"last_success,omitempty" db:"last_success"`
 	LastFailure *time.Time      `json:"last_failure,omitempty" db:"last_failure"`
 	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
 }
 
-// WebhookDelivery represents a webhook delivery attempt
-type WebhookDelivery struct {
-	ID          string    `json:"id" db:"id"`
-	WebhookID   string    `json:"webhook_id" db:"webhook_id"`
-	Event       string    `json:"event" db:"event"`
-	Payload     string    `json:"payload" db:"payload"`
-	StatusCode  int       `json:"status_code" db:"status_code"`
-	Response    string    `json:"response,omitempty" db:"response"`
-	Error       string    `json:"error,omitempty" db:"error"`
-	Attempts    int       `json:"attempts" db:"attempts"`
-	Success     bool      `json:"success" db:"success"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+// NotificationDelivery represents a notification delivery attempt
+type NotificationDelivery struct {
+	ID          string     `json:"id" db:"id"`
+	ChannelID   string     `json:"channel_id" db:"channel_id"`
+	Event       string     `json:"event" db:"event"`
+	EventCount  int        `json:"event_count" db:"event_count"` // More than one for digests
+	Payload     string     `json:"payload" db:"payload"`
+	Error       string     `json:"error,omitempty" db:"error"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	Success     bool       `json:"success" db:"success"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
 }
 
@@ -272,19 +1165,54 @@ type MachineTemplate struct {
 	Description string          `json:"description" db:"description"`
 	NixOSConfig string          `json:"nixos_config" db:"nixos_config"`
 	BMCConfig   *BMCInfo        `json:"bmc_config,omitempty" db:"bmc_config"`
-	Tags        json.RawMessage `json:"tags,omitempty" db:"tags"` // Array of tags as JSON
+	Tags        json.RawMessage `json:"tags,omitempty" db:"tags"`           // Array of tags as JSON
 	Variables   json.RawMessage `json:"variables,omitempty" db:"variables"` // Template variables as JSON
-	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
-	CreatedBy   string          `json:"created_by" db:"created_by"` // User ID
+
+	// RequiredHardware lists the HardwareFields a machine's inventory must
+	// have for the template to be applied to it
+	RequiredHardware []string `json:"required_hardware,omitempty" db:"required_hardware"`
+
+	// BuildTarget, if set, becomes the build target of machines the
+	// template is applied to
+	BuildTarget string `json:"build_target,omitempty" db:"build_target"`
+
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	CreatedBy string    `json:"created_by" db:"created_by"` // User ID
+}
+
+// HasTag reports whether the template is tagged tag. Templates whose tags
+// aren't a list of strings have none.
+func (t *MachineTemplate) HasTag(tag string) bool {
+	var tags []string
+	if t.Tags == nil || json.Unmarshal(t.Tags, &tags) != nil {
+		return false
+	}
+	return HasTag(tags, tag)
+}
+
+// ApplyTemplateRequest sets the values of a template's variables when it
+// is applied, in place of their defaults
+type ApplyTemplateRequest struct {
+	Variables map[string]string `json:"variables,omitempty"`
 }
 
 // MachineEvent represents an event that occurred for a machine
 type MachineEvent struct {
-	ID          string          `json:"id" db:"id"`
-	MachineID   string          `json:"machine_id" db:"machine_id"`
-	Event       string          `json:"event" db:"event"` // enrolled, status_changed, build_started, etc.
-	Data        json.RawMessage `json:"data" db:"data"` // Event-specific data
-	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
-	CreatedBy   *string         `json:"created_by,omitempty" db:"created_by"` // User ID if applicable
+	ID        string          `json:"id" db:"id"`
+	MachineID string          `json:"machine_id" db:"machine_id"`
+	Event     string          `json:"event" db:"event"` // enrolled, status_changed, build_started, etc.
+	Data      json.RawMessage `json:"data" db:"data"`   // Event-specific data
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+	CreatedBy *string         `json:"created_by,omitempty" db:"created_by"` // User ID if applicable
+
+	// ImpersonatedBy is the admin who caused the event while impersonating
+	// CreatedBy
+	ImpersonatedBy *string `json:"impersonated_by,omitempty" db:"impersonated_by"`
+
+	// Sequence numbers a machine's events in the order they were recorded,
+	// starting at 1. Events recorded before sequence numbers existed have
+	// none.
+	Sequence int64  `json:"sequence,omitempty" db:"sequence"`
+	DataHash string `json:"-" db:"data_hash"` // SHA-256 of Data, to find duplicates
 }
@@ -0,0 +1,153 @@
+package models
+
+import "time"
+
+// MachineDocument is a machine's desired state, as exported for and applied
+// from version control. It is keyed by service tag. Fields left out of a
+// document are left as they are by an apply; lists and maps given replace
+// the machine's, so an empty one removes them.
+type MachineDocument struct {
+	ServiceTag string `yaml:"service_tag" json:"service_tag"`
+
+	// Revision is the machine's updated_at when it was exported. A document
+	// older than its machine is a conflict, unless forced, if applying it
+	// would change the machine, since it would undo changes it doesn't
+	// know about.
+	Revision *time.Time `yaml:"revision,omitempty" json:"revision,omitempty"`
+
+	Hostname    *string                `yaml:"hostname,omitempty" json:"hostname,omitempty"`
+	Description *string                `yaml:"description,omitempty" json:"description,omitempty"`
+	Tags        []string               `yaml:"tags" json:"tags"`
+	Metadata    map[string]interface{} `yaml:"metadata" json:"metadata"`
+
+	// NixOSConfig is the machine's configuration, or the override block of
+	// its fragments. Machines whose configuration is applied from a
+	// template have Template instead.
+	NixOSConfig *string           `yaml:"nixos_config,omitempty" json:"nixos_config,omitempty"`
+	Template    *DocumentTemplate `yaml:"template,omitempty" json:"template,omitempty"`
+
+	// Fragments and Groups are names. Fragments are the machine's own, in
+	// order; its groups' fragments come with its groups.
+	Fragments []string `yaml:"fragments" json:"fragments"`
+	Groups    []string `yaml:"groups" json:"groups"`
+
+	BMC *DocumentBMC `yaml:"bmc,omitempty" json:"bmc,omitempty"`
+}
+
+// DocumentTemplate is the template a machine document's configuration is
+// applied from, with the values given for its variables
+type DocumentTemplate struct {
+	Name      string            `yaml:"name" json:"name"`
+	Variables map[string]string `yaml:"variables,omitempty" json:"variables,omitempty"`
+}
+
+// DocumentBMC is a machine document's BMC settings. The password is never
+// exported or applied; it is set through the machine, and the MAC address
+// and channel the registration image discovers are kept.
+type DocumentBMC struct {
+	IPAddress      string `yaml:"ip_address" json:"ip_address"`
+	Username       string `yaml:"username" json:"username"`
+	Type           string `yaml:"type" json:"type"`
+	Port           int    `yaml:"port,omitempty" json:"port,omitempty"`
+	Enabled        bool   `yaml:"enabled" json:"enabled"`
+	Interface      string `yaml:"interface,omitempty" json:"interface,omitempty"`
+	CipherSuite    int    `yaml:"cipher_suite,omitempty" json:"cipher_suite,omitempty"`
+	PrivilegeLevel string `yaml:"privilege_level,omitempty" json:"privilege_level,omitempty"`
+	Retries        int    `yaml:"retries,omitempty" json:"retries,omitempty"`
+}
+
+// DocumentBMCFrom returns the document form of a machine's BMC settings
+func DocumentBMCFrom(bmc *BMCInfo) *DocumentBMC {
+	if bmc == nil {
+		return nil
+	}
+	return &DocumentBMC{
+		IPAddress:      bmc.IPAddress,
+		Username:       bmc.Username,
+		Type:           bmc.Type,
+		Port:           bmc.Port,
+		Enabled:        bmc.Enabled,
+		Interface:      bmc.Interface,
+		CipherSuite:    bmc.CipherSuite,
+		PrivilegeLevel: bmc.PrivilegeLevel,
+		Retries:        bmc.Retries,
+	}
+}
+
+// IgnoredDocumentFields are machine fields the server owns. Documents may
+// have them, such as when they are copied from the machines API, but
+// applying them changes nothing.
+var IgnoredDocumentFields = []string{
+	"id", "mac_address", "status", "hardware", "enrolled_at", "updated_at",
+	"last_seen_at", "last_build_id", "last_build_time", "decommissioned_at",
+	"deleted_at",
+}
+
+// Machine apply actions, one per document in an apply report
+const (
+	MachineApplyCreated   = "created"   // A preregistered machine was created
+	MachineApplyUpdated   = "updated"   // Fields of the machine were changed
+	MachineApplyUnchanged = "unchanged" // The machine already matched
+	MachineApplyConflict  = "conflict"  // The machine changed since the document's revision
+	MachineApplyFailed    = "failed"    // The document is invalid, or applying it failed
+)
+
+// MachineApplyReport is the outcome of applying machine documents. With
+// DryRun, nothing was changed, and the items say what would have been.
+type MachineApplyReport struct {
+	DryRun bool `json:"dry_run"`
+	Force  bool `json:"force"`
+
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Conflicts int `json:"conflicts"`
+	Failed    int `json:"failed"`
+
+	Items []MachineApplyItem `json:"items"`
+}
+
+// Add records what was done with a document
+func (r *MachineApplyReport) Add(item MachineApplyItem) {
+	switch item.Action {
+	case MachineApplyCreated:
+		r.Created++
+	case MachineApplyUpdated:
+		r.Updated++
+	case MachineApplyUnchanged:
+		r.Unchanged++
+	case MachineApplyConflict:
+		r.Conflicts++
+	default:
+		r.Failed++
+	}
+	r.Items = append(r.Items, item)
+}
+
+// MachineApplyItem is what applying one document did
+type MachineApplyItem struct {
+	ServiceTag string        `json:"service_tag"`
+	MachineID  string        `json:"machine_id,omitempty"`
+	Action     string        `json:"action"`
+	Changes    []FieldChange `json:"changes,omitempty"`
+
+	// Revision is the machine's updated_at once the document was applied,
+	// or as it was if it wasn't, for the document's revision
+	Revision *time.Time `json:"revision,omitempty"`
+
+	// Ignored lists the server-owned fields the document had
+	Ignored []string `json:"ignored,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// FieldChange is a field an apply changed, from and to its values as
+// text. Configurations are shown as a unified diff instead, or where only
+// a summary is wanted, from and to their hashes and line counts, with
+// LineDelta the change in line count.
+type FieldChange struct {
+	Field     string `json:"field"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	Diff      string `json:"diff,omitempty"`
+	LineDelta *int   `json:"line_delta,omitempty"`
+}
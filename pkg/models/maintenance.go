@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// Maintenance window scopes
+const (
+	MaintenanceScopeAll     = "all"
+	MaintenanceScopeGroup   = "group"
+	MaintenanceScopeMachine = "machine"
+)
+
+// Operations gated by maintenance windows
+const (
+	MaintenanceOpPower  = "power"
+	MaintenanceOpBuild  = "build"
+	MaintenanceOpDelete = "delete"
+	MaintenanceOpDeploy = "deploy"
+)
+
+// MaintenanceWindow defines when destructive operations may run on the
+// machines in its scope. A window is either a one-off period (StartsAt to
+// EndsAt) or recurring (Schedule plus Duration, evaluated in Timezone).
+type MaintenanceWindow struct {
+	ID          string     `json:"id" db:"id"`
+	Name        string     `json:"name" db:"name"`
+	Description string     `json:"description,omitempty" db:"description"`
+	Scope       string     `json:"scope" db:"scope"`                     // all, group, machine
+	ScopeID     string     `json:"scope_id,omitempty" db:"scope_id"`     // Group or machine ID
+	Operations  []string   `json:"operations,omitempty" db:"operations"` // power, build, delete, deploy; empty means all
+	Schedule    string     `json:"schedule,omitempty" db:"schedule"`     // Cron expression: minute hour day-of-month month day-of-week
+	Duration    int        `json:"duration,omitempty" db:"duration"`     // Minutes, for recurring windows
+	StartsAt    *time.Time `json:"starts_at,omitempty" db:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at,omitempty" db:"ends_at"`
+	Timezone    string     `json:"timezone,omitempty" db:"timezone"` // IANA name, defaults to UTC
+	Enabled     bool       `json:"enabled" db:"enabled"`
+	CreatedBy   string     `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// CoversOperation reports whether the window gates the given operation
+func (w *MaintenanceWindow) CoversOperation(op string) bool {
+	if len(w.Operations) == 0 {
+		return true
+	}
+	for _, o := range w.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metadata limits
+const (
+	MaxMetadataBytes = 16 << 10
+	MaxMetadataDepth = 4
+	MaxMetadataKey   = 64
+)
+
+// metadataKeyPattern keeps metadata keys usable in {{metadata.key}}
+// placeholders and metadata.key filters, which separate keys with dots
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidMetadataKey reports whether key can be used as a metadata key
+func ValidMetadataKey(key string) bool {
+	return len(key) <= MaxMetadataKey && metadataKeyPattern.MatchString(key)
+}
+
+// ValidateMetadata checks that every key in metadata, including the keys
+// of nested objects, is an identifier, that objects and arrays are nested
+// at most MaxMetadataDepth deep, and that metadata encodes to at most
+// MaxMetadataBytes of JSON
+func ValidateMetadata(metadata map[string]interface{}) error {
+	if err := validateMetadataValue("", metadata, 1); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("metadata cannot be encoded: %w", err)
+	}
+	if len(data) > MaxMetadataBytes {
+		return fmt.Errorf("metadata is %d bytes of JSON; at most %d are allowed", len(data), MaxMetadataBytes)
+	}
+	return nil
+}
+
+func validateMetadataValue(path string, value interface{}, depth int) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if depth > MaxMetadataDepth {
+			return fmt.Errorf("metadata %s is nested more than %d levels deep", path, MaxMetadataDepth)
+		}
+		for key, child := range v {
+			if !ValidMetadataKey(key) {
+				return fmt.Errorf("metadata key %q must start with a letter or underscore, contain only letters, digits, and underscores, and be at most %d characters", key, MaxMetadataKey)
+			}
+			if err := validateMetadataValue(joinMetadataPath(path, key), child, depth+1); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if depth > MaxMetadataDepth {
+			return fmt.Errorf("metadata %s is nested more than %d levels deep", path, MaxMetadataDepth)
+		}
+		for i, child := range v {
+			if err := validateMetadataValue(fmt.Sprintf("%s[%d]", path, i), child, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MergeMetadata applies a JSON merge patch (RFC 7386) to metadata and
+// returns the result: keys in patch are set, keys set to null are removed,
+// and nested objects are merged the same way. metadata is not modified.
+func MergeMetadata(metadata, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(metadata)+len(patch))
+	for key, value := range metadata {
+		merged[key] = value
+	}
+
+	for key, value := range patch {
+		switch v := value.(type) {
+		case nil:
+			delete(merged, key)
+		case map[string]interface{}:
+			current, _ := merged[key].(map[string]interface{})
+			merged[key] = MergeMetadata(current, v)
+		default:
+			merged[key] = v
+		}
+	}
+	return merged
+}
+
+// MetadataPlaceholders returns the values of metadata's scalar fields by
+// their placeholder names: metadata.env for a top-level key, and
+// metadata.team.name for a key of a nested object. Arrays have no
+// placeholders.
+func MetadataPlaceholders(metadata map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	addMetadataPlaceholders(values, "metadata", metadata)
+	return values
+}
+
+func addMetadataPlaceholders(values map[string]string, prefix string, metadata map[string]interface{}) {
+	for key, value := range metadata {
+		name := prefix + "." + key
+		switch v := value.(type) {
+		case map[string]interface{}:
+			addMetadataPlaceholders(values, name, v)
+		case string:
+			values[name] = v
+		case float64:
+			values[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case json.Number:
+			values[name] = v.String()
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		}
+	}
+}
+
+// ParseMetadataPath splits a dotted metadata path, such as team.name, into
+// its keys. It returns nil if any key is invalid.
+func ParseMetadataPath(path string) []string {
+	keys := strings.Split(path, ".")
+	if len(keys) > MaxMetadataDepth {
+		return nil
+	}
+	for _, key := range keys {
+		if !ValidMetadataKey(key) {
+			return nil
+		}
+	}
+	return keys
+}
+
+func joinMetadataPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// MachineNote is a free-form markdown note on a machine, such as where it
+// was moved or what the vendor replaced. Notes are kept newest first as the
+// machine's history.
+type MachineNote struct {
+	ID        string     `json:"id"`
+	MachineID string     `json:"machine_id"`
+	Author    string     `json:"author"`
+	Body      string     `json:"body"` // Markdown
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// MachineNoteRequest creates or edits a note
+type MachineNoteRequest struct {
+	Body string `json:"body"`
+}
+
+// MachineAttachment is a file attached to a machine, such as a photo of its
+// rack label or a vendor invoice. The file is stored once per SHA-256, however
+// many machines it is attached to.
+type MachineAttachment struct {
+	ID          string    `json:"id"`
+	MachineID   string    `json:"machine_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	UploadedBy  string    `json:"uploaded_by"`
+	Source      string    `json:"source"` // AttachmentSourceUpload or AttachmentSourceBMCScreenshot
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Where attachments come from. BMC screenshots are kept up to a number per
+// machine, oldest removed first; uploads are kept until deleted.
+const (
+	AttachmentSourceUpload        = "upload"
+	AttachmentSourceBMCScreenshot = "bmc_screenshot"
+)
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Environments a machine can be assigned to
+const (
+	EnvironmentProd    = "prod"
+	EnvironmentStaging = "staging"
+	EnvironmentDev     = "dev"
+)
+
+// Ownership records who is responsible for a machine and how to reach them
+// when something goes wrong. Groups carry an Ownership too; a machine
+// inherits each field from its groups unless it sets the field itself.
+type Ownership struct {
+	Team         string `json:"team,omitempty"`
+	ContactEmail string `json:"contact_email,omitempty"`
+	SlackChannel string `json:"slack_channel,omitempty"`
+	Environment  string `json:"environment,omitempty"`
+}
+
+// IsZero reports whether no ownership field is set
+func (o *Ownership) IsZero() bool {
+	return o == nil || *o == Ownership{}
+}
+
+// HasOwner reports whether a team or contact email is set, the two fields
+// someone can be paged through
+func (o *Ownership) HasOwner() bool {
+	return o != nil && (o.Team != "" || o.ContactEmail != "")
+}
+
+// Normalize trims every field, prefixes the Slack channel with # when it
+// is missing, and validates the contact email and environment
+func (o *Ownership) Normalize() error {
+	o.Team = strings.TrimSpace(o.Team)
+	o.ContactEmail = strings.TrimSpace(o.ContactEmail)
+	o.SlackChannel = strings.TrimSpace(o.SlackChannel)
+	o.Environment = strings.ToLower(strings.TrimSpace(o.Environment))
+
+	if o.ContactEmail != "" {
+		addr, err := mail.ParseAddress(o.ContactEmail)
+		if err != nil || addr.Address != o.ContactEmail {
+			return fmt.Errorf("contact_email %q is not a valid email address", o.ContactEmail)
+		}
+	}
+	if o.SlackChannel != "" {
+		if !strings.HasPrefix(o.SlackChannel, "#") {
+			o.SlackChannel = "#" + o.SlackChannel
+		}
+		if len(o.SlackChannel) == 1 || strings.ContainsAny(o.SlackChannel, " \t\r\n") {
+			return fmt.Errorf("slack_channel %q is not a valid channel name", o.SlackChannel)
+		}
+	}
+	switch o.Environment {
+	case "", EnvironmentProd, EnvironmentStaging, EnvironmentDev:
+	default:
+		return fmt.Errorf("environment must be %s, %s, or %s", EnvironmentProd, EnvironmentStaging, EnvironmentDev)
+	}
+	return nil
+}
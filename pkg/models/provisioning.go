@@ -0,0 +1,280 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Provisioning hook types
+const (
+	// HookTypeWebhook has the server POST the machine to URL, as for
+	// joining monitoring or registering in DNS
+	HookTypeWebhook = "webhook-call"
+
+	// HookTypeScript is a script the machine's agent fetches from
+	// /machines/{id}/hooks/next, runs, and reports the result of
+	HookTypeScript = "script-delivered-to-machine"
+
+	// HookTypeWaitForEndpoint has the server poll URL until it answers
+	// with a 2xx status, as for waiting on a service the image starts
+	HookTypeWaitForEndpoint = "wait-for-endpoint"
+)
+
+// HookTypes lists the provisioning hook types
+var HookTypes = []string{HookTypeWebhook, HookTypeScript, HookTypeWaitForEndpoint}
+
+// Scopes of provisioning hook lists. A machine runs the hooks of its
+// template, then of its groups by name, then its own; a hook replaces an
+// earlier one of the same name in its place.
+const (
+	HookScopeTemplate = "template"
+	HookScopeGroup    = "group"
+	HookScopeMachine  = "machine"
+)
+
+// Provisioning hook limits and defaults
+const (
+	MaxProvisioningHooks     = 50
+	MaxHookRetries           = 10
+	MaxHookTimeoutSeconds    = 24 * 60 * 60
+	MaxHookRetryDelaySeconds = 60 * 60
+	MaxHookScriptBytes       = 64 << 10
+
+	DefaultHookTimeoutSeconds    = 300
+	DefaultHookRetryDelaySeconds = 30
+)
+
+// MaxHookLogBytes bounds the output kept of a hook run. Longer output
+// keeps its end, where errors usually are.
+const MaxHookLogBytes = 64 << 10
+
+// ProvisioningHook is a task run after a machine boots its custom image,
+// such as joining monitoring, registering in DNS, or a smoke test. URLs
+// may use the {{hostname}}, {{service_tag}}, {{machine_id}}, and {{ip}}
+// placeholders.
+type ProvisioningHook struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	URL    string `json:"url,omitempty"`    // webhook-call and wait-for-endpoint
+	Script string `json:"script,omitempty"` // script-delivered-to-machine
+
+	// TimeoutSeconds bounds an attempt: the request of a webhook call,
+	// the polling of an endpoint, or the agent's run of a script.
+	// DefaultHookTimeoutSeconds if 0.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+
+	// Retries is how many more attempts a failed hook gets, each
+	// RetryDelaySeconds (DefaultHookRetryDelaySeconds if 0) after the last
+	Retries           int `json:"retries,omitempty"`
+	RetryDelaySeconds int `json:"retry_delay_seconds,omitempty"`
+
+	// Optional hooks don't hold up provisioning when they fail
+	Optional bool `json:"optional,omitempty"`
+
+	// Scope is where the hook is defined, when resolved for a machine
+	Scope string `json:"scope,omitempty"`
+}
+
+// Timeout returns how long an attempt of the hook may take
+func (h *ProvisioningHook) Timeout() time.Duration {
+	if h.TimeoutSeconds == 0 {
+		return DefaultHookTimeoutSeconds * time.Second
+	}
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+// RetryDelay returns how long after a failed attempt the hook is retried
+func (h *ProvisioningHook) RetryDelay() time.Duration {
+	if h.RetryDelaySeconds == 0 {
+		return DefaultHookRetryDelaySeconds * time.Second
+	}
+	return time.Duration(h.RetryDelaySeconds) * time.Second
+}
+
+// RunsOnServer reports whether the server runs the hook itself, rather
+// than the machine's agent
+func (h *ProvisioningHook) RunsOnServer() bool {
+	return h.Type != HookTypeScript
+}
+
+// Validate checks a provisioning hook
+func (h *ProvisioningHook) Validate() error {
+	if !bootProfileNamePattern.MatchString(h.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, dots, dashes, or underscores")
+	}
+
+	switch h.Type {
+	case HookTypeWebhook, HookTypeWaitForEndpoint:
+		if h.Script != "" {
+			return fmt.Errorf("%s hooks have a url, not a script", h.Type)
+		}
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s hooks need an http or https url", h.Type)
+		}
+	case HookTypeScript:
+		if h.URL != "" {
+			return fmt.Errorf("%s hooks have a script, not a url", h.Type)
+		}
+		if strings.TrimSpace(h.Script) == "" {
+			return fmt.Errorf("%s hooks need a script", h.Type)
+		}
+		if len(h.Script) > MaxHookScriptBytes {
+			return fmt.Errorf("script must be at most %d bytes", MaxHookScriptBytes)
+		}
+	default:
+		return fmt.Errorf("type must be one of %s", strings.Join(HookTypes, ", "))
+	}
+
+	if h.TimeoutSeconds < 0 || h.TimeoutSeconds > MaxHookTimeoutSeconds {
+		return fmt.Errorf("timeout_seconds must be between 0 and %d", MaxHookTimeoutSeconds)
+	}
+	if h.Retries < 0 || h.Retries > MaxHookRetries {
+		return fmt.Errorf("retries must be between 0 and %d", MaxHookRetries)
+	}
+	if h.RetryDelaySeconds < 0 || h.RetryDelaySeconds > MaxHookRetryDelaySeconds {
+		return fmt.Errorf("retry_delay_seconds must be between 0 and %d", MaxHookRetryDelaySeconds)
+	}
+	return nil
+}
+
+// ProvisioningHookList is the ordered list of hooks of a template, group,
+// or machine
+type ProvisioningHookList struct {
+	Hooks []ProvisioningHook `json:"hooks"`
+}
+
+// Validate checks the hooks of a list, whose names must be unique
+func (l *ProvisioningHookList) Validate() error {
+	if len(l.Hooks) > MaxProvisioningHooks {
+		return fmt.Errorf("at most %d hooks can be defined", MaxProvisioningHooks)
+	}
+
+	seen := make(map[string]bool)
+	for i := range l.Hooks {
+		hook := &l.Hooks[i]
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("hooks[%d]: %w", i, err)
+		}
+		if seen[hook.Name] {
+			return fmt.Errorf("hooks[%d]: name %s is used more than once", i, hook.Name)
+		}
+		seen[hook.Name] = true
+	}
+	return nil
+}
+
+// MachineHookList is a machine's own hooks, and the hooks it runs: its
+// template's, its groups', and its own, merged by ResolveProvisioningHooks
+type MachineHookList struct {
+	Hooks    []ProvisioningHook `json:"hooks"`
+	Resolved []ProvisioningHook `json:"resolved"`
+}
+
+// ResolveProvisioningHooks merges hook lists, in the order they apply, into
+// what a machine runs: a hook replaces an earlier one of the same name, in
+// the earlier one's place. Each hook's Scope is set to the list's.
+func ResolveProvisioningHooks(scopes []string, lists [][]ProvisioningHook) []ProvisioningHook {
+	var hooks []ProvisioningHook
+	index := make(map[string]int)
+	for i, list := range lists {
+		for _, hook := range list {
+			hook.Scope = scopes[i]
+			if at, ok := index[hook.Name]; ok {
+				hooks[at] = hook
+				continue
+			}
+			index[hook.Name] = len(hooks)
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// Provisioning cycle states
+const (
+	ProvisioningRunning   = "running"
+	ProvisioningSucceeded = "succeeded" // Every required hook succeeded
+	ProvisioningFailed    = "failed"    // A required hook failed for good
+	ProvisioningCancelled = "cancelled" // A later boot started another cycle
+)
+
+// Hook run states
+const (
+	HookRunPending   = "pending" // Waiting for its turn, or for its next attempt
+	HookRunRunning   = "running"
+	HookRunSucceeded = "succeeded"
+	HookRunFailed    = "failed" // Out of attempts
+)
+
+// ProvisioningCycle runs a machine's hooks, in order, after it first boots
+// the image of a build. The machine becomes provisioned when every hook
+// that isn't optional has succeeded; a required hook running out of
+// attempts fails the cycle, which goes on once the hook is re-run and
+// succeeds.
+type ProvisioningCycle struct {
+	ID         string     `json:"id"`
+	MachineID  string     `json:"machine_id"`
+	BuildID    string     `json:"build_id"`
+	Status     string     `json:"status"` // running, succeeded, failed, cancelled
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	Runs []*HookRun `json:"runs"`
+}
+
+// HookRun is a hook's run in a provisioning cycle. Hook is the definition
+// as it was when the cycle started.
+type HookRun struct {
+	ID        string           `json:"id"`
+	CycleID   string           `json:"cycle_id"`
+	MachineID string           `json:"machine_id"`
+	Position  int              `json:"position"`
+	Hook      ProvisioningHook `json:"hook"`
+	Status    string           `json:"status"` // pending, running, succeeded, failed
+	Attempts  int              `json:"attempts"`
+
+	// NextAttemptAt holds a pending run back until its retry delay has
+	// passed, and Deadline is when a running attempt times out
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	Deadline      *time.Time `json:"deadline,omitempty"`
+
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	ExitCode *int   `json:"exit_code,omitempty"` // Of scripts
+	Log      string `json:"log,omitempty"`       // Output of the last attempt
+	Error    string `json:"error,omitempty"`     // Why the last attempt failed
+}
+
+// Done reports whether the run no longer holds up the runs after it
+func (r *HookRun) Done() bool {
+	return r.Status == HookRunSucceeded || (r.Status == HookRunFailed && r.Hook.Optional)
+}
+
+// HookAssignment is what /machines/{id}/hooks/next answers the agent: the
+// script hook to run now, if any, and whether the cycle is still running.
+// The agent polls until it isn't.
+type HookAssignment struct {
+	Run         *HookRun `json:"run,omitempty"`
+	CycleStatus string   `json:"cycle_status,omitempty"` // Empty if the machine has no cycle
+}
+
+// HookResult is what the agent reports after running a script hook
+type HookResult struct {
+	Success  bool   `json:"success"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// TruncateHookLog keeps at most MaxHookLogBytes of the end of a hook's
+// output
+func TruncateHookLog(log string) string {
+	if len(log) <= MaxHookLogBytes {
+		return log
+	}
+	return strings.ToValidUTF8(log[len(log)-MaxHookLogBytes:], "")
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota kinds: what a user's usage quotas count
+const (
+	QuotaBuilds          = "builds"
+	QuotaPowerOperations = "power_operations"
+)
+
+// QuotaKinds lists the quota kinds
+var QuotaKinds = []string{QuotaBuilds, QuotaPowerOperations}
+
+// IsValidQuotaKind reports whether kind is a quota kind
+func IsValidQuotaKind(kind string) bool {
+	return containsString(QuotaKinds, kind)
+}
+
+// QuotaWindow is the rolling window quotas count usage over
+const QuotaWindow = 24 * time.Hour
+
+// QuotaLimits are how many units of each kind a user may use per
+// QuotaWindow. A nil limit is unlimited.
+type QuotaLimits struct {
+	Builds          *int `json:"builds,omitempty"`
+	PowerOperations *int `json:"power_operations,omitempty"`
+}
+
+// Limit returns the limit of a quota kind, or nil if it is unlimited
+func (l *QuotaLimits) Limit(kind string) *int {
+	if l == nil {
+		return nil
+	}
+	switch kind {
+	case QuotaBuilds:
+		return l.Builds
+	case QuotaPowerOperations:
+		return l.PowerOperations
+	}
+	return nil
+}
+
+// Set sets the limit of a quota kind
+func (l *QuotaLimits) Set(kind string, limit int) {
+	switch kind {
+	case QuotaBuilds:
+		l.Builds = &limit
+	case QuotaPowerOperations:
+		l.PowerOperations = &limit
+	}
+}
+
+// Validate checks that no limit is negative
+func (l *QuotaLimits) Validate() error {
+	for _, kind := range QuotaKinds {
+		if limit := l.Limit(kind); limit != nil && *limit < 0 {
+			return fmt.Errorf("%s cannot be negative", kind)
+		}
+	}
+	return nil
+}
+
+// QuotaGrant temporarily raises a user's quota of one kind
+type QuotaGrant struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Kind      string    `json:"kind"`
+	Units     int       `json:"units"`
+	Reason    string    `json:"reason,omitempty"`
+	GrantedBy string    `json:"granted_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateQuotaGrantRequest grants a user extra units of a quota for a while
+type CreateQuotaGrantRequest struct {
+	Kind     string `json:"kind"`
+	Units    int    `json:"units"`
+	Duration string `json:"duration"` // Such as 24h; defaults to QuotaWindow
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Quota sources: where a user's limit of a quota kind comes from
+const (
+	QuotaSourceUser = "user" // Set on the user
+	QuotaSourceRole = "role" // Configured for the user's role
+)
+
+// QuotaUsage is a user's use of one quota kind over the last QuotaWindow.
+// Limit, Remaining, and Source are absent for unlimited quotas.
+type QuotaUsage struct {
+	Kind      string `json:"kind"`
+	Used      int    `json:"used"`
+	Limit     *int   `json:"limit,omitempty"` // Base plus active grants
+	BaseLimit *int   `json:"base_limit,omitempty"`
+	Granted   int    `json:"granted,omitempty"`
+	Remaining *int   `json:"remaining,omitempty"`
+	Source    string `json:"source,omitempty"`
+
+	// ResetsAt is when the oldest unit counted drops out of the window,
+	// freeing one up
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+// UserUsage is a user's quota usage, for admins
+type UserUsage struct {
+	UserID   string       `json:"user_id"`
+	Username string       `json:"username"`
+	Role     UserRole     `json:"role"`
+	Window   string       `json:"window"`
+	Quotas   []QuotaUsage `json:"quotas"`
+	Grants   []QuotaGrant `json:"grants"`
+
+	// Limits are the limits set on the user, which take precedence over
+	// their role's
+	Limits *QuotaLimits `json:"limits,omitempty"`
+}
+
+// ParseRoleQuotas parses the limits of one quota kind for each role, given
+// as comma-separated role=limit pairs such as "operator=100,viewer=0"
+func ParseRoleQuotas(value string) (map[UserRole]int, error) {
+	limits := map[UserRole]int{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		role, limit, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not role=limit", pair)
+		}
+		switch r := UserRole(strings.TrimSpace(role)); r {
+		case RoleAdmin, RoleOperator, RoleViewer:
+			n, err := strconv.Atoi(strings.TrimSpace(limit))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("limit of %s must be a whole number", r)
+			}
+			limits[r] = n
+		default:
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+	}
+	return limits, nil
+}
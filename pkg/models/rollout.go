@@ -0,0 +1,88 @@
+package models
+
+import "time"
+
+// Build rollout states
+const (
+	BuildRolloutRunning   = "running"
+	BuildRolloutPaused    = "paused"
+	BuildRolloutCompleted = "completed"
+	BuildRolloutAborted   = "aborted"
+)
+
+// Build rollout machine states
+const (
+	RolloutMachinePending   = "pending"
+	RolloutMachineBuilding  = "building"
+	RolloutMachineWaiting   = "waiting" // Built, waiting for the machine to reach the rollout's wait_for_status
+	RolloutMachineSucceeded = "succeeded"
+	RolloutMachineFailed    = "failed"
+	RolloutMachineSkipped   = "skipped" // Could not be built when the rollout was created
+	RolloutMachineAborted   = "aborted" // Not finished when the rollout was aborted
+)
+
+// BuildRollout rebuilds a group's machines in batches. The orchestrator in
+// the API server starts each batch's builds, waits for every machine in the
+// batch to finish, and pauses the rollout once more than MaxFailures
+// machines have failed. All progress is stored, so a restarted server picks
+// up where it left off.
+type BuildRollout struct {
+	ID      string `json:"id" db:"id"`
+	GroupID string `json:"group_id" db:"group_id"`
+	Status  string `json:"status" db:"status"` // running, paused, completed, aborted
+
+	BatchSize       int           `json:"batch_size" db:"batch_size"`
+	MaxFailures     int           `json:"max_failures" db:"max_failures"`
+	WaitForStatus   MachineStatus `json:"wait_for_status" db:"wait_for_status"`
+	WaitTimeout     int           `json:"wait_timeout_seconds" db:"wait_timeout"`
+	InterBatchDelay int           `json:"inter_batch_delay_seconds" db:"inter_batch_delay"`
+	PowerCycle      bool          `json:"power_cycle" db:"power_cycle"`
+
+	Machines     []BuildRolloutMachine `json:"machines" db:"machines"` // In rollout order
+	CurrentBatch int                   `json:"current_batch" db:"current_batch"`
+	Failures     int                   `json:"failures" db:"failures"` // Since the rollout started or was last resumed
+	PausedReason string                `json:"paused_reason,omitempty" db:"paused_reason"`
+	NextBatchAt  *time.Time            `json:"next_batch_at,omitempty" db:"next_batch_at"`
+
+	CreatedBy   string     `json:"created_by,omitempty" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+}
+
+// BuildRolloutMachine is the progress of one machine in a build rollout
+type BuildRolloutMachine struct {
+	MachineID   string     `json:"machine_id"`
+	Hostname    string     `json:"hostname,omitempty"`
+	Batch       int        `json:"batch,omitempty"`
+	Status      string     `json:"status"` // pending, building, waiting, succeeded, failed, skipped, aborted
+	BuildID     string     `json:"build_id,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	BuiltAt     *time.Time `json:"built_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// IsActive reports whether the rollout can still build machines
+func (r *BuildRollout) IsActive() bool {
+	return r.Status == BuildRolloutRunning || r.Status == BuildRolloutPaused
+}
+
+// IsDone reports whether the machine's part in the rollout is over
+func (m *BuildRolloutMachine) IsDone() bool {
+	switch m.Status {
+	case RolloutMachinePending, RolloutMachineBuilding, RolloutMachineWaiting:
+		return false
+	}
+	return true
+}
+
+// BuildRolloutRequest starts a build rollout of a group
+type BuildRolloutRequest struct {
+	BatchSize       int           `json:"batch_size,omitempty"`                // Default 1
+	MaxFailures     int           `json:"max_failures,omitempty"`              // Failures tolerated before pausing, default 0
+	WaitForStatus   MachineStatus `json:"wait_for_status,omitempty"`           // ready (default) or provisioned
+	WaitTimeout     int           `json:"wait_timeout_seconds,omitempty"`      // Default 3600
+	InterBatchDelay int           `json:"inter_batch_delay_seconds,omitempty"` // Pause between batches
+	PowerCycle      bool          `json:"power_cycle,omitempty"`               // Power cycle each machine after its build succeeds
+}
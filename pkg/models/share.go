@@ -0,0 +1,181 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Share scopes: what a share link can read
+const (
+	ShareScopeMachine   = "machine"    // Identity, status, and hardware compliance
+	ShareScopeHardware  = "hardware"   // Hardware inventory
+	ShareScopeEvents    = "events"     // Event history
+	ShareScopeBuildLogs = "build_logs" // Builds and their logs
+)
+
+// ShareScopes are all share scopes, which a share gets unless it asks for
+// fewer
+var ShareScopes = []string{ShareScopeMachine, ShareScopeHardware, ShareScopeEvents, ShareScopeBuildLogs}
+
+// Share link lifetimes
+const (
+	DefaultShareExpiry = 72 * time.Hour
+	MaxShareExpiry     = 30 * 24 * time.Hour
+)
+
+// MachineShare is a link that lets someone without an account, such as a
+// vendor supporting a hardware case, read a machine until it expires or is
+// revoked. The link carries a token signed with the server secret; the
+// share records it so it can be listed and revoked.
+type MachineShare struct {
+	ID        string   `json:"id"`
+	MachineID string   `json:"machine_id"`
+	Scopes    []string `json:"scopes"`
+
+	// BuildID restricts the build_logs scope to one build
+	BuildID string `json:"build_id,omitempty"`
+
+	Note      string     `json:"note,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy string     `json:"revoked_by,omitempty"`
+}
+
+// HasScope reports whether the share grants scope
+func (s *MachineShare) HasScope(scope string) bool {
+	for _, granted := range s.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateShareRequest creates a share link for a machine
+type CreateShareRequest struct {
+	// ExpiresIn is how long the link works, such as 72h (the default), at
+	// most 30 days
+	ExpiresIn string   `json:"expires_in,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+	BuildID   string   `json:"build_id,omitempty"`
+	Note      string   `json:"note,omitempty"`
+}
+
+// Expiry parses ExpiresIn
+func (r *CreateShareRequest) Expiry() (time.Duration, error) {
+	if r.ExpiresIn == "" {
+		return DefaultShareExpiry, nil
+	}
+	expiry, err := time.ParseDuration(r.ExpiresIn)
+	if err != nil || expiry <= 0 {
+		return 0, fmt.Errorf("expires_in must be a positive duration, such as 72h")
+	}
+	if expiry > MaxShareExpiry {
+		return 0, fmt.Errorf("expires_in must be at most %s", MaxShareExpiry)
+	}
+	return expiry, nil
+}
+
+// ValidateScopes checks the requested scopes, defaulting to all of them
+func (r *CreateShareRequest) ValidateScopes() error {
+	if len(r.Scopes) == 0 {
+		r.Scopes = append([]string(nil), ShareScopes...)
+		return nil
+	}
+	seen := make(map[string]bool, len(r.Scopes))
+	for _, scope := range r.Scopes {
+		valid := false
+		for _, known := range ShareScopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			return fmt.Errorf("unknown scope %q; scopes are machine, hardware, events, and build_logs", scope)
+		}
+		if seen[scope] {
+			return fmt.Errorf("scope %q is listed twice", scope)
+		}
+		seen[scope] = true
+	}
+	return nil
+}
+
+// CreatedShare is a new share with its token, which is only returned once
+type CreatedShare struct {
+	*MachineShare
+	Token string `json:"token"`
+
+	// Path is the share link's path on the API server
+	Path string `json:"path"`
+}
+
+// SharedMachine is what a share link shows of a machine. It is copied
+// field by field, so BMC credentials, SSH settings, the NixOS
+// configuration, and metadata never reach a share link, whatever the
+// machine record holds.
+type SharedMachine struct {
+	ID         string        `json:"id"`
+	ServiceTag string        `json:"service_tag"`
+	Hostname   string        `json:"hostname,omitempty"`
+	Status     MachineStatus `json:"status"`
+
+	// Hardware is only included if the share has the hardware scope, and
+	// then without its raw data
+	Hardware *HardwareInfo `json:"hardware,omitempty"`
+
+	HardwareCompliance *HardwareCompliance `json:"hardware_compliance,omitempty"`
+
+	EnrolledAt    time.Time  `json:"enrolled_at"`
+	LastSeenAt    *time.Time `json:"last_seen_at,omitempty"`
+	LastBuildTime *time.Time `json:"last_build_time,omitempty"`
+
+	// ExpiresAt is when the share link stops working
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewSharedMachine copies what a share may show of a machine
+func NewSharedMachine(machine *Machine, hardware bool) *SharedMachine {
+	shared := &SharedMachine{
+		ID:                 machine.ID,
+		ServiceTag:         machine.ServiceTag,
+		Hostname:           machine.Hostname,
+		Status:             machine.Status,
+		HardwareCompliance: machine.HardwareCompliance,
+		EnrolledAt:         machine.EnrolledAt,
+		LastSeenAt:         machine.LastSeenAt,
+		LastBuildTime:      machine.LastBuildTime,
+	}
+	if hardware {
+		// Raw tool output can hold anything, so it isn't shared
+		inventory := machine.Hardware
+		inventory.RawData = nil
+		shared.Hardware = &inventory
+	}
+	return shared
+}
+
+// SharedBuild is what a share link shows of a build, leaving out the
+// configuration it built
+type SharedBuild struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Builder     string     `json:"builder,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	DurationMS  int64      `json:"duration_ms,omitempty"`
+}
+
+// NewSharedBuild copies what a share may show of a build
+func NewSharedBuild(build *BuildRequest) *SharedBuild {
+	return &SharedBuild{
+		ID:          build.ID,
+		Status:      build.Status,
+		Error:       build.Error,
+		Builder:     build.Builder,
+		CreatedAt:   build.CreatedAt,
+		CompletedAt: build.CompletedAt,
+		DurationMS:  build.DurationMS,
+	}
+}
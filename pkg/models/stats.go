@@ -0,0 +1,69 @@
+package models
+
+import "time"
+
+// Stats summarizes the fleet for dashboards. Everything in it is counted in
+// the database, so it costs the same however many machines there are.
+type Stats struct {
+	// GroupID limits the machine, build, and metrics numbers to a group's
+	// machines. Webhook deliveries aren't tied to machines and are always
+	// counted for the whole fleet.
+	GroupID     string    `json:"group_id,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+
+	Machines    MachineStats `json:"machines"`
+	Builds      BuildStats   `json:"builds"`
+	Webhooks    WebhookStats `json:"webhooks"`
+	MetricsRows int64        `json:"metrics_rows"`
+}
+
+// MachineStats counts machines, leaving out those in the trash
+type MachineStats struct {
+	// Total doesn't count decommissioned machines, which ByStatus does
+	Total    int                   `json:"total"`
+	ByStatus map[MachineStatus]int `json:"by_status"`
+
+	// ByHardware is the most common manufacturer and model pairs, most
+	// common first
+	ByHardware []HardwareCount `json:"by_hardware"`
+
+	// Offline counts machines, other than decommissioned ones, that
+	// haven't been seen (or enrolled, if they never have been) since
+	// OfflineSince
+	Offline      int       `json:"offline"`
+	OfflineSince time.Time `json:"offline_since"`
+
+	// HardwareNoncompliant counts machines whose hardware failed the check
+	// against their hardware profile
+	HardwareNoncompliant int `json:"hardware_noncompliant"`
+}
+
+// HardwareCount is how many machines are of a manufacturer and model
+type HardwareCount struct {
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	Count        int    `json:"count"`
+}
+
+// BuildStats counts the builds created since Since
+type BuildStats struct {
+	Since    time.Time                   `json:"since"`
+	Total    int                         `json:"total"`
+	ByStatus map[string]BuildStatusStats `json:"by_status"`
+}
+
+// BuildStatusStats counts builds with a status. The average duration is of
+// those that recorded one, and 0 if none did.
+type BuildStatusStats struct {
+	Count                  int     `json:"count"`
+	AverageDurationSeconds float64 `json:"average_duration_seconds"`
+}
+
+// WebhookStats counts the webhook deliveries made since Since.
+// SuccessRate is the fraction that succeeded, or nil if there were none.
+type WebhookStats struct {
+	Since       time.Time `json:"since"`
+	Deliveries  int       `json:"deliveries"`
+	Succeeded   int       `json:"succeeded"`
+	SuccessRate *float64  `json:"success_rate"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// ArtifactsMachinesDir is the directory of the images directory that holds
+// each machine's images, in a directory named for its service tag
+const ArtifactsMachinesDir = "machines"
+
+// ArtifactUsage is the space a directory of the images directory takes
+// up. Each machine's images are one directory, machines/<service tag>, and
+// every other top-level directory, such as registration, is one.
+type ArtifactUsage struct {
+	Path       string    `json:"path"`
+	ServiceTag string    `json:"service_tag,omitempty"` // Set for machines' directories
+	MachineID  string    `json:"machine_id,omitempty"`  // Set if a machine has the service tag
+	Hostname   string    `json:"hostname,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// StorageUsage is the disk usage of the images directory: the space its
+// artifacts take up, by directory, and how full the filesystem it is on
+// is. The filesystem fields are left out if it can't be read.
+type StorageUsage struct {
+	ArtifactBytes       int64   `json:"artifact_bytes"`
+	FilesystemBytes     int64   `json:"filesystem_bytes,omitempty"`
+	FilesystemFreeBytes int64   `json:"filesystem_free_bytes,omitempty"`
+	UsedPercent         float64 `json:"used_percent,omitempty"`
+
+	// AlertPercent is the used percentage storage.usage_high is published
+	// at, if alerts are on, and AboveAlert whether the filesystem is there
+	AlertPercent int  `json:"alert_percent,omitempty"`
+	AboveAlert   bool `json:"above_alert"`
+
+	// Machines are machines' directories, and Other the rest, each largest
+	// first
+	Machines []ArtifactUsage `json:"machines"`
+	Other    []ArtifactUsage `json:"other"`
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultMaxSubscriptions is how many subscriptions a user may have unless
+// the server says otherwise
+const DefaultMaxSubscriptions = 50
+
+// Subscription is a user's own request to be emailed about events of one
+// machine, or of every machine in one group, at their account's email
+// address. Digest subscriptions collect the events and send them together
+// on a schedule instead of one email each.
+type Subscription struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	MachineID string    `json:"machine_id,omitempty"`
+	GroupID   string    `json:"group_id,omitempty"`
+	Events    []string  `json:"events"` // Event types, or "*" for all
+	Digest    bool      `json:"digest"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Of the subscribed user, as subscriptions matching an event are
+	// looked up
+	Email string   `json:"-"`
+	Role  UserRole `json:"-"`
+}
+
+// Matches reports whether the subscription is to events of eventType
+func (s *Subscription) Matches(eventType string) bool {
+	for _, e := range s.Events {
+		if e == eventType || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateSubscriptionRequest subscribes the requesting user to events of a
+// machine or a group
+type CreateSubscriptionRequest struct {
+	MachineID string   `json:"machine_id,omitempty"`
+	GroupID   string   `json:"group_id,omitempty"`
+	Events    []string `json:"events"`
+	Digest    bool     `json:"digest,omitempty"`
+}
+
+// Validate checks that the request names one machine or group, and event
+// types known to isKnown or "*", each once
+func (r *CreateSubscriptionRequest) Validate(isKnown func(string) bool) error {
+	if (r.MachineID == "") == (r.GroupID == "") {
+		return fmt.Errorf("exactly one of machine_id and group_id is required")
+	}
+	if len(r.Events) == 0 {
+		return fmt.Errorf("events is required")
+	}
+
+	seen := make(map[string]bool, len(r.Events))
+	for _, e := range r.Events {
+		if e != "*" && !isKnown(e) {
+			return fmt.Errorf("unknown event type %q", e)
+		}
+		if seen[e] {
+			return fmt.Errorf("event type %q is listed twice", e)
+		}
+		seen[e] = true
+	}
+	if seen["*"] && len(r.Events) > 1 {
+		return fmt.Errorf(`"*" already covers every event type`)
+	}
+	return nil
+}
+
+// SubscriptionDigestItem is an event held for a digest subscription's next
+// digest, in the form notifications are sent in
+type SubscriptionDigestItem struct {
+	ID             string
+	SubscriptionID string
+	UserID         string
+	Event          []byte
+	CreatedAt      time.Time
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Build types. A machine build builds a machine's configuration; other
+// builds build a system image, named by the type.
+const (
+	BuildTypeMachine      = "machine"
+	BuildTypeRegistration = SystemImageRegistration
+)
+
+// SystemImageRegistration is the registration image every unknown machine
+// boots to enroll. It is the only system image.
+const SystemImageRegistration = "registration"
+
+// IsSystemImage reports whether name is a system image
+func IsSystemImage(name string) bool {
+	return name == SystemImageRegistration
+}
+
+// System image statuses
+const (
+	SystemImageBuilding = "building" // Queued or being built
+	SystemImageTesting  = "testing"  // Built, waiting for its boot test
+	SystemImageReady    = "ready"    // Boot test passed; can be promoted
+	SystemImageFailed   = "failed"   // Build or boot test failed
+)
+
+// SystemImage is a version of an image the system itself serves, such as
+// the registration image, built by a builder like a machine's image. Its
+// files are under the images directory in <name>/<version>, and the
+// version being served is the current one.
+type SystemImage struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	BuildID string `json:"build_id"`
+	TestID  string `json:"test_id,omitempty"` // Boot test, once built
+
+	// Current is set on the version the iPXE server serves, promoted at
+	// PromotedAt. Versions promoted before keep their PromotedAt, so they
+	// can be rolled back to.
+	Current    bool       `json:"current"`
+	PromotedAt *time.Time `json:"promoted_at,omitempty"`
+
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Dir is the image's directory, relative to the images directory
+func (i *SystemImage) Dir() string {
+	return fmt.Sprintf("%s/%d", i.Name, i.Version)
+}
+
+// SystemImageConfig is a system image's NixOS configuration
+type SystemImageConfig struct {
+	Config string `json:"config"`
+}
@@ -15,15 +15,21 @@ const (
 
 // User represents a user in the system
 type User struct {
-	ID           string    `json:"id" db:"id"`
-	Username     string    `json:"username" db:"username"`
-	Email        string    `json:"email" db:"email"`
-	PasswordHash string    `json:"-" db:"password_hash"` // Never expose in JSON
-	Role         UserRole  `json:"role" db:"role"`
-	Active       bool      `json:"active" db:"active"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	ID           string     `json:"id" db:"id"`
+	Username     string     `json:"username" db:"username"`
+	Email        string     `json:"email" db:"email"`
+	PasswordHash string     `json:"-" db:"password_hash"` // Never expose in JSON
+	Role         UserRole   `json:"role" db:"role"`
+	Active       bool       `json:"active" db:"active"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
 	LastLoginAt  *time.Time `json:"last_login_at,omitempty" db:"last_login_at"`
+
+	// Group that machines the user claims are added to
+	DefaultGroupID string `json:"default_group_id,omitempty" db:"default_group_id"`
+
+	// Quota limits set on the user, in place of their role's
+	Quota *QuotaLimits `json:"quota,omitempty" db:"quota"`
 }
 
 // LoginRequest represents a user login request
@@ -41,10 +47,11 @@ type LoginResponse struct {
 
 // RegisterRequest represents a user registration request
 type RegisterRequest struct {
-	Username string   `json:"username"`
-	Email    string   `json:"email"`
-	Password string   `json:"password"`
-	Role     UserRole `json:"role"`
+	Username       string   `json:"username"`
+	Email          string   `json:"email"`
+	Password       string   `json:"password"`
+	Role           UserRole `json:"role"`
+	DefaultGroupID string   `json:"default_group_id,omitempty"`
 }
 
 // UpdateUserRequest represents a user update request
@@ -53,22 +60,26 @@ type UpdateUserRequest struct {
 	Password string   `json:"password,omitempty"`
 	Role     UserRole `json:"role,omitempty"`
 	Active   bool     `json:"active"`
+
+	// DefaultGroupID changes the user's default group when given; ""
+	// clears it
+	DefaultGroupID *string `json:"default_group_id,omitempty"`
 }
 
 // APIKeyRequest represents an API key generation request
 type APIKeyRequest struct {
-	Name      string    `json:"name"`
+	Name      string     `json:"name"`
 	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 // APIKey represents an API key for programmatic access
 type APIKey struct {
-	ID        string     `json:"id" db:"id"`
-	UserID    string     `json:"user_id" db:"user_id"`
-	Name      string     `json:"name" db:"name"`
-	Key       string     `json:"key" db:"key"` // Hashed in database
-	Active    bool       `json:"active" db:"active"`
-	CreatedAt time.Time  `json:"created_at" db:"created_at"`
-	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	ID         string     `json:"id" db:"id"`
+	UserID     string     `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Key        string     `json:"key" db:"key"` // Hashed in database
+	Active     bool       `json:"active" db:"active"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
 	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
 }
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Webhook retry backoff strategies
+const (
+	WebhookBackoffLinear      = "linear"
+	WebhookBackoffExponential = "exponential"
+)
+
+// Webhook retry conditions, besides HTTP status codes such as "503"
+const (
+	WebhookRetryNetwork     = "network" // The receiver couldn't be reached, or didn't answer in time
+	WebhookRetryClientError = "4xx"
+	WebhookRetryServerError = "5xx"
+)
+
+// DefaultWebhookRetryOn is what a failed delivery is retried on unless its
+// webhook says otherwise. Other 4xx responses mean the receiver rejects
+// the payload, which sending it again won't change.
+var DefaultWebhookRetryOn = []string{WebhookRetryNetwork, "408", "429", WebhookRetryServerError}
+
+// WebhookRetryPolicy is how a webhook's failed deliveries are retried.
+// Fields left unset take the webhook package's defaults.
+type WebhookRetryPolicy struct {
+	// Backoff is how the wait before each retry grows: linear waits
+	// InitialIntervalMS more each time, exponential twice as long
+	Backoff           string `json:"backoff,omitempty"`
+	InitialIntervalMS int    `json:"initial_interval_ms,omitempty"`
+	MaxIntervalMS     int    `json:"max_interval_ms,omitempty"`
+
+	// Jitter waits a random time up to the backoff instead of all of it,
+	// so receivers aren't retried by every server at once
+	Jitter *bool `json:"jitter,omitempty"`
+
+	// RetryOn lists what is retried: "network", "4xx", "5xx", or status
+	// codes. A 429 or 503 response's Retry-After is waited out, up to
+	// MaxIntervalMS.
+	RetryOn []string `json:"retry_on,omitempty"`
+
+	// Events overrides the policy for event types, such as more retries
+	// for machine.enrolled. What an override leaves unset is the
+	// webhook's.
+	Events map[string]WebhookRetryOverride `json:"events,omitempty"`
+}
+
+// WebhookRetryOverride is a webhook's retry policy for one event type.
+// MaxRetries replaces the webhook's max_retries.
+type WebhookRetryOverride struct {
+	MaxRetries int `json:"max_retries,omitempty"`
+	WebhookRetryPolicy
+}
+
+// Validate checks a retry policy, and its overrides. isEvent reports
+// whether an event type can be overridden.
+func (p *WebhookRetryPolicy) Validate(isEvent func(string) bool) error {
+	if err := p.validateSettings(); err != nil {
+		return err
+	}
+	for event, override := range p.Events {
+		if !isEvent(event) {
+			return fmt.Errorf("retry.events: unknown event type %q", event)
+		}
+		if override.MaxRetries < 0 {
+			return fmt.Errorf("retry.events.%s: max_retries cannot be negative", event)
+		}
+		if len(override.Events) > 0 {
+			return fmt.Errorf("retry.events.%s: overrides cannot have their own events", event)
+		}
+		if err := override.validateSettings(); err != nil {
+			return fmt.Errorf("retry.events.%s: %w", event, err)
+		}
+	}
+	return nil
+}
+
+// validateSettings checks a policy's fields other than its overrides
+func (p *WebhookRetryPolicy) validateSettings() error {
+	switch p.Backoff {
+	case "", WebhookBackoffLinear, WebhookBackoffExponential:
+	default:
+		return fmt.Errorf("backoff must be %s or %s", WebhookBackoffLinear, WebhookBackoffExponential)
+	}
+	if p.InitialIntervalMS < 0 || p.MaxIntervalMS < 0 {
+		return fmt.Errorf("initial_interval_ms and max_interval_ms cannot be negative")
+	}
+	if p.MaxIntervalMS > 0 && p.InitialIntervalMS > p.MaxIntervalMS {
+		return fmt.Errorf("initial_interval_ms cannot exceed max_interval_ms")
+	}
+	for _, condition := range p.RetryOn {
+		if !validRetryCondition(condition) {
+			return fmt.Errorf("retry_on must list network, 4xx, 5xx, or status codes from 400 to 599, not %q", condition)
+		}
+	}
+	return nil
+}
+
+// validRetryCondition reports whether condition is something a delivery
+// can be retried on
+func validRetryCondition(condition string) bool {
+	switch condition {
+	case WebhookRetryNetwork, WebhookRetryClientError, WebhookRetryServerError:
+		return true
+	}
+	code, err := strconv.Atoi(condition)
+	return err == nil && code >= 400 && code <= 599
+}
+
+// WebhookDeliveryAttempt is one try at a delivery
+type WebhookDeliveryAttempt struct {
+	Attempt    int       `json:"attempt"`
+	StartedAt  time.Time `json:"started_at"`
+	StatusCode int       `json:"status_code,omitempty"` // Absent if the receiver wasn't reached
+	DurationMS int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+
+	// RetryInMS is how long was waited before the next attempt, if
+	// there was one
+	RetryInMS int64 `json:"retry_in_ms,omitempty"`
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Wipe job and disk states
+const (
+	WipePending   = "pending"
+	WipeRunning   = "running"
+	WipeCompleted = "completed"
+	WipeFailed    = "failed"
+	WipeMissing   = "missing" // Disk state only: the disk disappeared
+)
+
+// Wipe methods, chosen per disk from the hardware inventory
+const (
+	WipeMethodNVMeFormat = "nvme-format" // nvme format --ses=1 (user data erase)
+	WipeMethodBlkdiscard = "blkdiscard"  // blkdiscard --secure, falling back to a full discard
+	WipeMethodShred      = "shred"       // Overwrite passes for rotational disks
+)
+
+// WipeJob tracks a disk wipe performed by the wipe image before a machine is
+// re-provisioned. Completed jobs are the audit record of which disks were
+// erased and how.
+type WipeJob struct {
+	ID          string     `json:"id" db:"id"`
+	MachineID   string     `json:"machine_id" db:"machine_id"`
+	Status      string     `json:"status" db:"status"` // pending, running, completed, failed
+	Disks       []WipeDisk `json:"disks" db:"disks"`
+	Error       string     `json:"error,omitempty" db:"error"`
+	RequestedBy string     `json:"requested_by" db:"requested_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty" db:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+}
+
+// WipeDisk is the plan and progress for one disk in a wipe job. Disks are
+// identified by serial since device names can change between boots, and by
+// device only when the inventory has no serial.
+type WipeDisk struct {
+	Device      string     `json:"device"`
+	Serial      string     `json:"serial"`
+	Model       string     `json:"model,omitempty"`
+	SizeBytes   int64      `json:"size_bytes"`
+	Method      string     `json:"method"`
+	Status      string     `json:"status"`   // pending, running, completed, failed, missing
+	Progress    int        `json:"progress"` // Percent
+	Error       string     `json:"error,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// WipeStatusUpdate is posted by the wipe image as it works through the disks
+type WipeStatusUpdate struct {
+	Status string     `json:"status,omitempty"` // running, completed, failed
+	Disks  []WipeDisk `json:"disks,omitempty"`  // Matched to the job's disks by serial
+	Error  string     `json:"error,omitempty"`
+}
+
+// IsActive reports whether the job is still waiting for or running a wipe
+func (j *WipeJob) IsActive() bool {
+	return j.Status == WipePending || j.Status == WipeRunning
+}
+
+// WipeMethodFor picks the erase method for a disk: NVMe format for NVMe
+// drives, a secure discard for other solid state drives, and overwriting
+// for rotational disks, where discard does not erase data.
+func WipeMethodFor(disk DiskInfo) string {
+	switch {
+	case strings.EqualFold(disk.Type, "NVMe") || strings.Contains(disk.Device, "nvme"):
+		return WipeMethodNVMeFormat
+	case disk.Rotational || strings.EqualFold(disk.Type, "HDD"):
+		return WipeMethodShred
+	}
+	return WipeMethodBlkdiscard
+}
@@ -0,0 +1,263 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrBlocked is wrapped by errors for URLs and addresses a policy refuses
+var ErrBlocked = errors.New("destination not allowed")
+
+// Policy says which user-supplied URLs the server may send requests to.
+// The zero value allows only https to public addresses.
+type Policy struct {
+	// AllowHTTP permits plain http URLs
+	AllowHTTP bool
+
+	// AllowPrivate permits loopback, link-local, and private network
+	// addresses, including cloud metadata endpoints
+	AllowPrivate bool
+}
+
+// Resolver looks up the addresses of a host. net.DefaultResolver is used
+// when a Guard has none.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Guard checks URLs against a policy and dials only addresses the policy
+// allows
+type Guard struct {
+	Policy   Policy
+	Resolver Resolver
+}
+
+// New returns a guard for policy using the default resolver
+func New(policy Policy) *Guard {
+	return &Guard{Policy: policy}
+}
+
+// CheckURL parses a URL and checks its scheme and the addresses its host
+// resolves to. Requests must still go through the guard's DialContext,
+// since the host may resolve differently later.
+func (g *Guard) CheckURL(ctx context.Context, raw string) (*url.URL, error) {
+	u, err := g.checkSyntax(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := g.resolve(ctx, u.Hostname()); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// checkSyntax parses a URL and checks everything about it but its addresses
+func (g *Guard) checkSyntax(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !g.Policy.AllowHTTP {
+			return nil, fmt.Errorf("%w: URL must use https", ErrBlocked)
+		}
+	default:
+		return nil, fmt.Errorf("%w: URL must use https", ErrBlocked)
+	}
+
+	if u.User != nil {
+		return nil, fmt.Errorf("%w: URL must not contain credentials", ErrBlocked)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("invalid URL: no host")
+	}
+	if strings.Contains(host, "%") {
+		// A zone picks one of the server's interfaces to reach an IPv6
+		// link-local address on
+		return nil, fmt.Errorf("%w: %s has an IPv6 zone", ErrBlocked, host)
+	}
+	if net.ParseIP(host) == nil && looksNumeric(host) {
+		return nil, fmt.Errorf("%w: %s is not a valid host name or IP address", ErrBlocked, host)
+	}
+
+	return u, nil
+}
+
+// looksNumeric reports whether a host that is not an IP address is written
+// like one, such as 2130706433, 0x7f.1, or 0177.0.0.1. Some resolvers and
+// HTTP clients read these as IPv4 addresses; none are valid host names,
+// since top-level domains are never numeric.
+func looksNumeric(host string) bool {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	last := strings.ToLower(labels[len(labels)-1])
+	if strings.HasPrefix(last, "0x") {
+		return true
+	}
+	for _, c := range last {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckIP returns an error if the policy does not allow connecting to ip
+func (g *Guard) CheckIP(ip net.IP) error {
+	ip = embeddedIPv4(ip)
+
+	switch {
+	case ip.IsUnspecified(), ip.IsMulticast(), ip.IsInterfaceLocalMulticast(),
+		ip.Equal(net.IPv4bcast), ip.To4() != nil && ip[0] == 0:
+		// 0.0.0.0/8 and :: reach the local host on most systems
+		return fmt.Errorf("%w: %s is not a unicast address", ErrBlocked, ip)
+	case g.Policy.AllowPrivate:
+		return nil
+	case ip.IsLoopback(), ip.IsLinkLocalUnicast(), ip.IsPrivate(), sharedAddressSpace.Contains(ip),
+		siteLocal.Contains(ip), nat64LocalPrefix.Contains(ip):
+		// IsPrivate covers IPv6 unique local addresses, fc00::/7, and
+		// IsLinkLocalUnicast fe80::/10
+		return fmt.Errorf("%w: %s is a private address", ErrBlocked, ip)
+	}
+	return nil
+}
+
+// embeddedIPv4 returns the IPv4 address inside IPv4-mapped, IPv4-compatible,
+// NAT64, and 6to4 IPv6 addresses, which reach the IPv4 host, or ip unchanged
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	if len(ip) != net.IPv6len {
+		return ip
+	}
+	if nat64Prefix.Contains(ip) {
+		return ip[12:]
+	}
+	if sixToFourPrefix.Contains(ip) {
+		return ip[2:6]
+	}
+	// ::a.b.c.d, but not :: or ::1
+	for _, b := range ip[:12] {
+		if b != 0 {
+			return ip
+		}
+	}
+	if ip.IsUnspecified() || ip.IsLoopback() {
+		return ip
+	}
+	return ip[12:]
+}
+
+// nat64Prefix is the well-known NAT64 prefix, RFC 6052
+var nat64Prefix = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+// nat64LocalPrefix is for local NAT64 translators, RFC 8215. Where the IPv4
+// address sits depends on how the site divides it, so it is treated as
+// private as a whole.
+var nat64LocalPrefix = &net.IPNet{IP: net.ParseIP("64:ff9b:1::"), Mask: net.CIDRMask(48, 128)}
+
+// sixToFourPrefix is the 6to4 prefix, RFC 3056, whose addresses carry an
+// IPv4 address in their second to sixth bytes
+var sixToFourPrefix = &net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+
+// siteLocal is the deprecated IPv6 site-local range, RFC 3879, which some
+// networks still route internally
+var siteLocal = &net.IPNet{IP: net.ParseIP("fec0::"), Mask: net.CIDRMask(10, 128)}
+
+// sharedAddressSpace is the carrier-grade NAT range, RFC 6598
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// resolve looks up a host and checks every address it resolves to, so that
+// a name with one public and one private address is refused
+func (g *Guard) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if err := g.CheckIP(ip); err != nil {
+			return nil, err
+		}
+		return []net.IP{ip}, nil
+	}
+
+	resolver := g.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("failed to resolve %s: no addresses", host)
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if err := g.CheckIP(addr.IP); err != nil {
+			return nil, fmt.Errorf("%s resolves to a blocked address: %w", host, err)
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// DialContext resolves and checks addr's host, then connects to one of the
+// addresses it checked rather than resolving again
+func (g *Guard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := g.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Client returns an HTTP client whose connections and redirects are checked
+// against the policy. It ignores proxy settings, which would bypass the
+// checks.
+func (g *Guard) Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           g.DialContext,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			_, err := g.checkSyntax(req.URL.String())
+			return err
+		},
+	}
+}
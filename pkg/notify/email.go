@@ -0,0 +1,227 @@
+package notify
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SMTP connection security modes
+const (
+	TLSNone     = "none"
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+)
+
+// EmailConfig configures an SMTP email channel
+type EmailConfig struct {
+	Host               string   `json:"host"`
+	Port               int      `json:"port"`
+	Username           string   `json:"username,omitempty"`
+	Password           string   `json:"password,omitempty"`
+	From               string   `json:"from"`
+	To                 []string `json:"to"`
+	TLS                string   `json:"tls,omitempty"` // none, starttls (default), tls
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+}
+
+type emailSender struct {
+	config EmailConfig
+
+	// unsubscribeURLs are the links that end the subscriptions a
+	// subscriber's email was sent for
+	unsubscribeURLs []string
+}
+
+func newEmailSender(raw json.RawMessage) (*emailSender, error) {
+	var config EmailConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("invalid email config: %w", err)
+	}
+
+	if config.Host == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email config requires host, from, and to")
+	}
+
+	if config.TLS == "" {
+		config.TLS = TLSStartTLS
+	}
+	switch config.TLS {
+	case TLSNone, TLSStartTLS, TLSImplicit:
+	default:
+		return nil, fmt.Errorf("email tls must be none, starttls, or tls")
+	}
+
+	if config.Port == 0 {
+		config.Port = 587
+		if config.TLS == TLSImplicit {
+			config.Port = 465
+		}
+	}
+
+	return &emailSender{config: config}, nil
+}
+
+// Send emails the events to every configured recipient
+func (s *emailSender) Send(events []Event) (string, error) {
+	message := s.message(events)
+
+	if err := s.sendMail([]byte(message)); err != nil {
+		return message, err
+	}
+	return message, nil
+}
+
+func (s *emailSender) sendMail(message []byte) error {
+	addr := net.JoinHostPort(s.config.Host, fmt.Sprintf("%d", s.config.Port))
+	tlsConfig := &tls.Config{
+		ServerName:         s.config.Host,
+		InsecureSkipVerify: s.config.InsecureSkipVerify,
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if s.config.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	client, err := smtp.NewClient(conn, s.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if s.config.TLS == TLSStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	if s.config.Username != "" {
+		auth := smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(s.config.From); err != nil {
+		return err
+	}
+	for _, to := range s.config.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", to, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// message renders the events as a plain text email with headers
+func (s *emailSender) message(events []Event) string {
+	subject := fmt.Sprintf("[Metal Enrollment] %s: %s", events[0].Title(), machineLabel(events[0]))
+	if len(events) > 1 {
+		subject = fmt.Sprintf("[Metal Enrollment] %d machine events", len(events))
+	}
+
+	var body strings.Builder
+	for i, ev := range events {
+		if i > 0 {
+			body.WriteString("\n----------------------------------------\n\n")
+		}
+		writeEventText(&body, ev)
+	}
+	if len(s.unsubscribeURLs) > 0 {
+		body.WriteString("\n----------------------------------------\n\n")
+		body.WriteString("You are receiving this because you subscribed to these events.\n")
+		body.WriteString("To unsubscribe, open:\n")
+		for _, url := range s.unsubscribeURLs {
+			fmt.Fprintf(&body, "%s\n", url)
+		}
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if len(s.unsubscribeURLs) == 1 {
+		fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\n", s.unsubscribeURLs[0])
+		msg.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+	return msg.String()
+}
+
+func writeEventText(b *strings.Builder, ev Event) {
+	fmt.Fprintf(b, "%s\n\n", ev.Title())
+	if ev.ServiceTag != "" {
+		fmt.Fprintf(b, "Service Tag: %s\n", ev.ServiceTag)
+	}
+	if ev.Hostname != "" {
+		fmt.Fprintf(b, "Hostname:    %s\n", ev.Hostname)
+	}
+	if ev.Status != "" {
+		fmt.Fprintf(b, "Status:      %s\n", ev.Status)
+	}
+	if ev.MachineID != "" {
+		fmt.Fprintf(b, "Machine ID:  %s\n", ev.MachineID)
+	}
+	if o := ev.Ownership; o != nil {
+		if o.Team != "" {
+			fmt.Fprintf(b, "Owner:       %s\n", o.Team)
+		}
+		if o.ContactEmail != "" {
+			fmt.Fprintf(b, "Contact:     %s\n", o.ContactEmail)
+		}
+		if o.SlackChannel != "" {
+			fmt.Fprintf(b, "Escalation:  %s\n", o.SlackChannel)
+		}
+		if o.Environment != "" {
+			fmt.Fprintf(b, "Environment: %s\n", o.Environment)
+		}
+	}
+	fmt.Fprintf(b, "Event:       %s\n", ev.Type)
+	fmt.Fprintf(b, "Time:        %s\n", ev.Timestamp.Format(time.RFC3339))
+
+	keys := make([]string, 0, len(ev.Data))
+	for key := range ev.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := formatValue(ev.Data[key])
+		if strings.Contains(value, "\n") {
+			fmt.Fprintf(b, "\n%s:\n%s\n", key, value)
+		} else {
+			fmt.Fprintf(b, "%s: %s\n", key, value)
+		}
+	}
+}
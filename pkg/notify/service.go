@@ -0,0 +1,294 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+const (
+	defaultRateLimit  = 5
+	defaultRateWindow = 60 // seconds
+	maxAttempts       = 3
+)
+
+// Event is a machine event with the machine details senders need to format it
+type Event struct {
+	Type       string                 `json:"event"`
+	MachineID  string                 `json:"machine_id"`
+	ServiceTag string                 `json:"service_tag,omitempty"`
+	Hostname   string                 `json:"hostname,omitempty"`
+	Status     string                 `json:"status,omitempty"`
+	Ownership  *models.Ownership      `json:"ownership,omitempty"` // Effective, for escalation
+	Data       map[string]interface{} `json:"data,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+// Title returns a human readable summary of the event type,
+// e.g. "Machine build started" for machine.build_started
+func (e Event) Title() string {
+	title := strings.NewReplacer(".", " ", "_", " ").Replace(e.Type)
+	if title == "" {
+		return e.Type
+	}
+	return strings.ToUpper(title[:1]) + title[1:]
+}
+
+// Sender delivers a batch of events to a channel. It returns the payload that
+// was sent so it can be recorded with the delivery.
+type Sender interface {
+	Send(events []Event) (string, error)
+}
+
+// NewSender creates the sender for a channel's type and configuration
+func NewSender(channel *models.NotificationChannel) (Sender, error) {
+	switch channel.Type {
+	case models.NotificationSlack:
+		return newSlackSender(channel.Config)
+	case models.NotificationEmail:
+		return newEmailSender(channel.Config)
+	}
+	return nil, fmt.Errorf("unsupported notification channel type: %s", channel.Type)
+}
+
+// Service fans machine events out to notification channels, and to the
+// users subscribed to them
+type Service struct {
+	db            *database.DB
+	subscriptions SubscriptionConfig
+
+	mu     sync.Mutex
+	limits map[string]*rateState
+}
+
+// rateState tracks how many messages a channel has been sent in the current
+// window and the events held back for the next digest
+type rateState struct {
+	windowStart time.Time
+	sent        int
+	pending     []Event
+	flushing    bool
+}
+
+// NewService creates a new notification service
+func NewService(db *database.DB) *Service {
+	return &Service{
+		db:     db,
+		limits: make(map[string]*rateState),
+	}
+}
+
+// HandleEvent notifies every active channel subscribed to the event, and
+// every user subscribed to it for its machine. It is registered with
+// events.Publisher.Subscribe.
+func (s *Service) HandleEvent(event events.Event) {
+	channels, err := s.db.GetNotificationChannelsByEvent(event.Type)
+	if err != nil {
+		log.Printf("Failed to get notification channels for event %s: %v", event.Type, err)
+	}
+
+	var subs []*models.Subscription
+	if event.MachineID != "" {
+		subs, err = s.db.ListSubscriptionsForEvent(event.MachineID, event.Type)
+		if err != nil {
+			log.Printf("Failed to get subscriptions for event %s: %v", event.Type, err)
+		}
+	}
+
+	if len(channels) == 0 && len(subs) == 0 {
+		return // Nobody subscribed to this event
+	}
+
+	ev := Event{
+		Type:      event.Type,
+		MachineID: event.MachineID,
+		Data:      event.Fields(),
+		Timestamp: event.Timestamp,
+	}
+	var machine *models.Machine
+	if event.MachineID != "" {
+		if machine, err = s.db.GetMachine(event.MachineID); err == nil && machine != nil {
+			ev.ServiceTag = machine.ServiceTag
+			ev.Hostname = machine.Hostname
+			ev.Status = string(machine.Status)
+			ev.Ownership = machine.EffectiveOwnership
+		}
+	}
+
+	for _, channel := range channels {
+		s.dispatch(channel, ev)
+	}
+	if len(subs) > 0 && machine != nil {
+		s.notifySubscribers(subs, ev, machine)
+	}
+}
+
+// SendTest sends a test message to a channel immediately, bypassing the rate
+// limit, and returns the recorded delivery
+func (s *Service) SendTest(channel *models.NotificationChannel) *models.NotificationDelivery {
+	return s.deliver(channel, []Event{{
+		Type:       "notification.test",
+		ServiceTag: "TEST123",
+		Hostname:   "test-machine",
+		Status:     string(models.StatusReady),
+		Data:       map[string]interface{}{"message": "Test notification from Metal Enrollment"},
+		Timestamp:  time.Now(),
+	}})
+}
+
+// dispatch sends an event right away while the channel is under its rate
+// limit. Beyond that, events are held and sent as one digest when the
+// window ends.
+func (s *Service) dispatch(channel *models.NotificationChannel, ev Event) {
+	limit := channel.RateLimit
+	if limit <= 0 {
+		limit = defaultRateLimit
+	}
+	window := time.Duration(channel.RateWindow) * time.Second
+	if window <= 0 {
+		window = defaultRateWindow * time.Second
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.limits[channel.ID]
+	if !ok {
+		state = &rateState{}
+		s.limits[channel.ID] = state
+	}
+
+	now := time.Now()
+	if now.Sub(state.windowStart) >= window && !state.flushing {
+		state.windowStart = now
+		state.sent = 0
+	}
+
+	if state.sent < limit && !state.flushing {
+		state.sent++
+		go s.deliver(channel, []Event{ev})
+		return
+	}
+
+	state.pending = append(state.pending, ev)
+	if !state.flushing {
+		state.flushing = true
+		time.AfterFunc(state.windowStart.Add(window).Sub(now), func() {
+			s.flush(channel)
+		})
+	}
+}
+
+// flush sends the held events for a channel as a digest and starts a new
+// window counting the digest as its first message
+func (s *Service) flush(channel *models.NotificationChannel) {
+	s.mu.Lock()
+	state := s.limits[channel.ID]
+	events := state.pending
+	state.pending = nil
+	state.flushing = false
+	state.windowStart = time.Now()
+	state.sent = 1
+	s.mu.Unlock()
+
+	// Pick up changes made to the channel while events were held
+	current, err := s.db.GetNotificationChannel(channel.ID)
+	if err != nil || current == nil || !current.Active {
+		return
+	}
+
+	s.deliver(current, events)
+}
+
+// deliver sends events to a channel with retries and records the delivery
+func (s *Service) deliver(channel *models.NotificationChannel, events []Event) *models.NotificationDelivery {
+	delivery := &models.NotificationDelivery{
+		ChannelID:  channel.ID,
+		Event:      events[0].Type,
+		EventCount: len(events),
+	}
+	if len(events) > 1 {
+		delivery.Event = "digest"
+	}
+
+	var lastErr error
+	sender, err := NewSender(channel)
+	if err != nil {
+		lastErr = err
+	} else {
+		for attempt := 1; attempt <= maxAttempts; attempt++ {
+			delivery.Attempts = attempt
+
+			payload, err := sender.Send(events)
+			delivery.Payload = payload
+			if err == nil {
+				delivery.Success = true
+				break
+			}
+
+			lastErr = err
+			log.Printf("Notification attempt %d/%d failed for %s: %v", attempt, maxAttempts, channel.Name, err)
+
+			// Exponential backoff
+			if attempt < maxAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+	}
+
+	now := time.Now()
+	delivery.CompletedAt = &now
+
+	if delivery.Success {
+		log.Printf("Notification delivered to %s (%d events)", channel.Name, len(events))
+	} else {
+		delivery.Error = lastErr.Error()
+		log.Printf("Notification delivery failed to %s: %v", channel.Name, lastErr)
+	}
+
+	s.db.UpdateNotificationDeliveryStatus(channel.ID, delivery.Success)
+
+	// Store delivery record
+	if err := s.db.CreateNotificationDelivery(delivery); err != nil {
+		log.Printf("Failed to store notification delivery record: %v", err)
+	}
+
+	return delivery
+}
+
+// ValidateConfig checks that a channel's configuration is usable
+func ValidateConfig(channel *models.NotificationChannel) error {
+	_, err := NewSender(channel)
+	return err
+}
+
+// truncate shortens s to at most max runes, marking the cut
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	const marker = "… (truncated)"
+	return string(runes[:max-len([]rune(marker))]) + marker
+}
+
+// formatValue renders an event data value for display
+func formatValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprintf("%g", value)
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
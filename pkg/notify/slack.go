@@ -0,0 +1,237 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Slack Block Kit limits
+const (
+	slackHeaderMax  = 150
+	slackTextMax    = 3000
+	slackFieldMax   = 2000
+	slackMaxBlocks  = 50
+	slackMaxFields  = 10
+	slackDigestShow = 10 // Events listed individually in a digest
+)
+
+// longFields are event data keys rendered as a code block rather than a
+// short field, e.g. build errors and logs
+var longFields = map[string]bool{
+	"error":      true,
+	"log":        true,
+	"log_output": true,
+	"output":     true,
+}
+
+// SlackConfig configures a Slack incoming webhook channel
+type SlackConfig struct {
+	WebhookURL string `json:"webhook_url"`
+	Channel    string `json:"channel,omitempty"`  // Overrides the webhook's default channel
+	Username   string `json:"username,omitempty"` // Overrides the webhook's default name
+}
+
+type slackSender struct {
+	config SlackConfig
+	client *http.Client
+}
+
+func newSlackSender(raw json.RawMessage) (*slackSender, error) {
+	var config SlackConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("invalid slack config: %w", err)
+	}
+	if !strings.HasPrefix(config.WebhookURL, "https://") && !strings.HasPrefix(config.WebhookURL, "http://") {
+		return nil, fmt.Errorf("slack config requires webhook_url")
+	}
+
+	return &slackSender{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Send posts the events to the Slack incoming webhook
+func (s *slackSender) Send(events []Event) (string, error) {
+	payload, err := json.Marshal(s.message(events))
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", s.config.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return string(payload), err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Metal-Enrollment-Notify/1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return string(payload), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return string(payload), fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	return string(payload), nil
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Fields   []slackText `json:"fields,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+type slackMessage struct {
+	Text     string       `json:"text"`
+	Channel  string       `json:"channel,omitempty"`
+	Username string       `json:"username,omitempty"`
+	Blocks   []slackBlock `json:"blocks"`
+}
+
+func (s *slackSender) message(events []Event) slackMessage {
+	msg := slackMessage{
+		Channel:  s.config.Channel,
+		Username: s.config.Username,
+	}
+
+	if len(events) == 1 {
+		msg.Text = fmt.Sprintf("%s: %s", events[0].Title(), machineLabel(events[0]))
+		msg.Blocks = eventBlocks(events[0])
+		return msg
+	}
+
+	msg.Text = fmt.Sprintf("%d machine events", len(events))
+	msg.Blocks = append(msg.Blocks, slackBlock{
+		Type: "header",
+		Text: &slackText{Type: "plain_text", Text: msg.Text},
+	})
+
+	shown := events
+	if len(shown) > slackDigestShow {
+		shown = shown[:slackDigestShow]
+	}
+	for _, ev := range shown {
+		line := fmt.Sprintf("*%s* – %s", ev.Title(), machineLabel(ev))
+		if errText := ev.Data["error"]; errText != nil {
+			line += "\n" + formatValue(errText)
+		}
+		msg.Blocks = append(msg.Blocks, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: truncate(line, slackTextMax)},
+		})
+	}
+	if more := len(events) - len(shown); more > 0 {
+		msg.Blocks = append(msg.Blocks, contextBlock(fmt.Sprintf("and %d more", more)))
+	}
+
+	return msg
+}
+
+// eventBlocks formats a single event: a header, the machine details as
+// fields, long values such as build errors as code blocks, and a footer
+func eventBlocks(ev Event) []slackBlock {
+	blocks := []slackBlock{{
+		Type: "header",
+		Text: &slackText{Type: "plain_text", Text: truncate(ev.Title(), slackHeaderMax)},
+	}}
+
+	var fields []slackText
+	addField := func(name, value string) {
+		if value == "" || len(fields) >= slackMaxFields {
+			return
+		}
+		fields = append(fields, slackText{
+			Type: "mrkdwn",
+			Text: truncate(fmt.Sprintf("*%s*\n%s", name, value), slackFieldMax),
+		})
+	}
+
+	addField("Service Tag", ev.ServiceTag)
+	addField("Hostname", ev.Hostname)
+	addField("Status", ev.Status)
+	if ev.Ownership != nil {
+		addField("Owner", ev.Ownership.Team)
+		addField("Contact", ev.Ownership.ContactEmail)
+		addField("Escalation", ev.Ownership.SlackChannel)
+		addField("Environment", ev.Ownership.Environment)
+	}
+
+	keys := make([]string, 0, len(ev.Data))
+	for key := range ev.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var long []string
+	for _, key := range keys {
+		if longFields[key] {
+			long = append(long, key)
+			continue
+		}
+		addField(key, formatValue(ev.Data[key]))
+	}
+
+	if len(fields) > 0 {
+		blocks = append(blocks, slackBlock{Type: "section", Fields: fields})
+	}
+
+	for _, key := range long {
+		if len(blocks) >= slackMaxBlocks-1 {
+			break
+		}
+		// Leave room for the ``` fences and the key label
+		text := truncate(formatValue(ev.Data[key]), slackTextMax-len(key)-16)
+		blocks = append(blocks, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n```%s```", key, text)},
+		})
+	}
+
+	context := []string{ev.Type}
+	if ev.MachineID != "" {
+		context = append(context, ev.MachineID)
+	}
+	context = append(context, ev.Timestamp.Format(time.RFC3339))
+	blocks = append(blocks, contextBlock(strings.Join(context, " • ")))
+
+	return blocks
+}
+
+func contextBlock(text string) slackBlock {
+	return slackBlock{
+		Type:     "context",
+		Elements: []slackText{{Type: "mrkdwn", Text: truncate(text, slackTextMax)}},
+	}
+}
+
+// machineLabel identifies the machine in one line
+func machineLabel(ev Event) string {
+	switch {
+	case ev.Hostname != "" && ev.ServiceTag != "":
+		return fmt.Sprintf("%s (%s)", ev.Hostname, ev.ServiceTag)
+	case ev.ServiceTag != "":
+		return ev.ServiceTag
+	case ev.MachineID == "":
+		// Rollout events are about a group rather than a machine
+		if groupID, ok := ev.Data["group_id"].(string); ok {
+			return "group " + groupID
+		}
+	}
+	return ev.MachineID
+}
@@ -0,0 +1,201 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// SubscriptionConfig configures the email sent for users' own
+// subscriptions
+type SubscriptionConfig struct {
+	// Channel is the name or ID of the email channel whose SMTP server and
+	// From address subscription emails are sent with. Empty uses the
+	// oldest active email channel.
+	Channel string
+
+	// UnsubscribeURL returns the link in a subscription's emails that
+	// deletes it, or nil for no link
+	UnsubscribeURL func(subscriptionID string) string
+}
+
+// SetSubscriptions configures subscription emails. It must be called
+// before any events are handled.
+func (s *Service) SetSubscriptions(config SubscriptionConfig) {
+	s.subscriptions = config
+}
+
+// SubscriptionChannel returns the email channel subscription emails are
+// sent with, or nil if there is none
+func (s *Service) SubscriptionChannel() (*models.NotificationChannel, error) {
+	channels, err := s.db.ListNotificationChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	// Channels are listed newest first
+	var found *models.NotificationChannel
+	for _, channel := range channels {
+		if channel.Type != models.NotificationEmail || !channel.Active {
+			continue
+		}
+		if s.subscriptions.Channel == "" {
+			found = channel
+		} else if channel.Name == s.subscriptions.Channel || channel.ID == s.subscriptions.Channel {
+			return channel, nil
+		}
+	}
+	return found, nil
+}
+
+// notifySubscribers emails the users subscribed to an event of a machine,
+// or holds it for their digest. A user whose subscriptions match more than
+// once gets the event once, right away if any of the matching
+// subscriptions isn't a digest. Viewers don't hear about machines claimed
+// by other users.
+func (s *Service) notifySubscribers(subs []*models.Subscription, ev Event, machine *models.Machine) {
+	chosen := make(map[string]*models.Subscription)
+	var order []string
+	for _, sub := range subs {
+		if !sub.Matches(ev.Type) || sub.Email == "" {
+			continue
+		}
+		if sub.Role == models.RoleViewer && machine.OwnerUserID != "" && machine.OwnerUserID != sub.UserID {
+			continue
+		}
+
+		current, ok := chosen[sub.UserID]
+		if !ok {
+			order = append(order, sub.UserID)
+		}
+		if !ok || (current.Digest && !sub.Digest) {
+			chosen[sub.UserID] = sub
+		}
+	}
+
+	for _, userID := range order {
+		sub := chosen[userID]
+		if !sub.Digest {
+			go func() {
+				if err := s.sendToSubscriber(sub.Email, []Event{ev}, []string{sub.ID}); err != nil {
+					log.Printf("Failed to email %s event to subscriber %s: %v", ev.Type, sub.UserID, err)
+				}
+			}()
+			continue
+		}
+
+		data, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("Failed to hold %s event for digest: %v", ev.Type, err)
+			continue
+		}
+		err = s.db.AddSubscriptionDigestItem(&models.SubscriptionDigestItem{
+			SubscriptionID: sub.ID,
+			UserID:         sub.UserID,
+			Event:          data,
+		})
+		if err != nil {
+			log.Printf("Failed to hold %s event for digest: %v", ev.Type, err)
+		}
+	}
+}
+
+// SendSubscriptionDigests emails each user the events held for their
+// digest subscriptions, in one email. Events of a user that can't be sent
+// are kept for the next digest.
+func (s *Service) SendSubscriptionDigests() {
+	items, err := s.db.ListSubscriptionDigestItems()
+	if err != nil {
+		log.Printf("Failed to list events held for digests: %v", err)
+		return
+	}
+
+	for start := 0; start < len(items); {
+		end := start
+		for end < len(items) && items[end].UserID == items[start].UserID {
+			end++
+		}
+		s.sendDigest(items[start:end])
+		start = end
+	}
+}
+
+// sendDigest emails a user the events held for their digest
+func (s *Service) sendDigest(items []*models.SubscriptionDigestItem) {
+	userID := items[0].UserID
+	through := items[len(items)-1].CreatedAt
+
+	user, err := s.db.GetUser(userID)
+	if err != nil {
+		log.Printf("Failed to get digest subscriber %s: %v", userID, err)
+		return
+	}
+	if user == nil || !user.Active || user.Email == "" {
+		if err := s.db.DeleteSubscriptionDigestItems(userID, through); err != nil {
+			log.Printf("Failed to drop digest of %s: %v", userID, err)
+		}
+		return
+	}
+
+	var events []Event
+	var subscriptionIDs []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		var ev Event
+		if err := json.Unmarshal(item.Event, &ev); err != nil {
+			log.Printf("Skipping unreadable digest event %s: %v", item.ID, err)
+			continue
+		}
+		events = append(events, ev)
+		if !seen[item.SubscriptionID] {
+			seen[item.SubscriptionID] = true
+			subscriptionIDs = append(subscriptionIDs, item.SubscriptionID)
+		}
+	}
+
+	if len(events) > 0 {
+		if err := s.sendToSubscriber(user.Email, events, subscriptionIDs); err != nil {
+			log.Printf("Failed to email digest of %d events to %s: %v", len(events), user.Username, err)
+			return
+		}
+		log.Printf("Emailed digest of %d events to %s", len(events), user.Username)
+	}
+	if err := s.db.DeleteSubscriptionDigestItems(userID, through); err != nil {
+		log.Printf("Failed to delete sent digest events of %s: %v", user.Username, err)
+	}
+}
+
+// sendToSubscriber emails events to a subscriber through the subscription
+// channel's SMTP server, with retries, and links to unsubscribe from the
+// subscriptions they came from
+func (s *Service) sendToSubscriber(email string, events []Event, subscriptionIDs []string) error {
+	channel, err := s.SubscriptionChannel()
+	if err != nil {
+		return err
+	}
+	if channel == nil {
+		return fmt.Errorf("no active email notification channel to send with")
+	}
+
+	sender, err := newEmailSender(channel.Config)
+	if err != nil {
+		return err
+	}
+	sender.config.To = []string{email}
+	if s.subscriptions.UnsubscribeURL != nil {
+		for _, id := range subscriptionIDs {
+			sender.unsubscribeURLs = append(sender.unsubscribeURLs, s.subscriptions.UnsubscribeURL(id))
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		_, err := sender.Send(events)
+		if err == nil || attempt == maxAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
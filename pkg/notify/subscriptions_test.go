@@ -0,0 +1,249 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// fakeSMTP accepts mail over plain SMTP and hands each message it
+// receives to messages
+type fakeSMTP struct {
+	listener net.Listener
+	messages chan string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{listener: listener, messages: make(chan string, 16)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case command == "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var message strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			f.messages <- message.String()
+			fmt.Fprint(conn, "250 queued\r\n")
+		case command == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 OK\r\n")
+		}
+	}
+}
+
+// next returns the next message received, or fails the test
+func (f *fakeSMTP) next(t *testing.T) string {
+	t.Helper()
+
+	select {
+	case message := <-f.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email sent")
+		return ""
+	}
+}
+
+// none fails the test if a message is received within a moment
+func (f *fakeSMTP) none(t *testing.T) {
+	t.Helper()
+
+	select {
+	case message := <-f.messages:
+		t.Fatalf("unexpected email:\n%s", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// subscriptionTest sets up a service whose subscription emails go to a
+// fakeSMTP, with a subscriber and a machine
+func subscriptionTest(t *testing.T) (*Service, *database.DB, *fakeSMTP, *models.User, *models.Machine) {
+	t.Helper()
+
+	db, err := database.New(database.Config{Driver: "sqlite3", DSN: "file:" + filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=10000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	smtpServer := newFakeSMTP(t)
+	addr := smtpServer.listener.Addr().(*net.TCPAddr)
+	config, _ := json.Marshal(EmailConfig{Host: "127.0.0.1", Port: addr.Port, From: "metal@example.com", To: []string{"ops@example.com"}, TLS: TLSNone})
+	channel := &models.NotificationChannel{Name: "email", Type: models.NotificationEmail, Events: []string{events.RolloutStarted}, Config: config, Active: true}
+	if err := db.CreateNotificationChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.CreateUser("dev", "dev@example.com", "x", models.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine, err := db.CreateMachine(models.EnrollmentRequest{ServiceTag: "SUB001", MACAddress: "02:00:00:00:00:01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := NewService(db)
+	service.SetSubscriptions(SubscriptionConfig{
+		UnsubscribeURL: func(id string) string {
+			return "https://metal.example.com/api/v1/subscriptions/" + id + "/unsubscribe?token=t"
+		},
+	})
+	return service, db, smtpServer, user, machine
+}
+
+func subscribe(t *testing.T, db *database.DB, user *models.User, machine *models.Machine, digest bool) *models.Subscription {
+	t.Helper()
+
+	sub := &models.Subscription{UserID: user.ID, MachineID: machine.ID, Events: []string{events.MachineBuildSucceeded, events.MachineBuildFailed}, Digest: digest}
+	if err := db.CreateSubscription(sub); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestSubscriptionDigest(t *testing.T) {
+	service, db, smtpServer, user, machine := subscriptionTest(t)
+	sub := subscribe(t, db, user, machine, true)
+
+	// Events are held rather than sent
+	for _, eventType := range []string{events.MachineBuildSucceeded, events.MachineBuildFailed, events.MachineEnrolled} {
+		service.HandleEvent(events.Event{Type: eventType, MachineID: machine.ID, Timestamp: time.Now()})
+	}
+	smtpServer.none(t)
+	items, err := db.ListSubscriptionDigestItems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("%d events held, want the 2 subscribed to", len(items))
+	}
+
+	// The digest sends them in one email, with the subscription's
+	// unsubscribe link, and lets them go
+	service.SendSubscriptionDigests()
+	message := smtpServer.next(t)
+	for _, want := range []string{
+		"To: dev@example.com\r\n",
+		"Subject: [Metal Enrollment] 2 machine events\r\n",
+		"Machine build succeeded",
+		"Machine build failed",
+		"List-Unsubscribe: <https://metal.example.com/api/v1/subscriptions/" + sub.ID + "/unsubscribe?token=t>\r\n",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("digest lacks %q:\n%s", want, message)
+		}
+	}
+	if items, err := db.ListSubscriptionDigestItems(); err != nil || len(items) != 0 {
+		t.Errorf("%d events still held after the digest (%v)", len(items), err)
+	}
+
+	// An empty digest sends nothing
+	service.SendSubscriptionDigests()
+	smtpServer.none(t)
+}
+
+func TestSubscriptionSentOnceRightAway(t *testing.T) {
+	service, db, smtpServer, user, machine := subscriptionTest(t)
+	subscribe(t, db, user, machine, true)
+	sub := subscribe(t, db, user, machine, false)
+
+	// A user with a digest and an immediate subscription to the same event
+	// gets it once, right away
+	service.HandleEvent(events.Event{Type: events.MachineBuildSucceeded, MachineID: machine.ID, Timestamp: time.Now()})
+	message := smtpServer.next(t)
+	if !strings.Contains(message, "To: dev@example.com\r\n") || !strings.Contains(message, sub.ID+"/unsubscribe") {
+		t.Errorf("email:\n%s", message)
+	}
+	smtpServer.none(t)
+	if items, err := db.ListSubscriptionDigestItems(); err != nil || len(items) != 0 {
+		t.Errorf("%d events held for the digest too (%v)", len(items), err)
+	}
+}
+
+func TestUnsubscribeHeaders(t *testing.T) {
+	sender := &emailSender{config: EmailConfig{From: "metal@example.com", To: []string{"dev@example.com"}}}
+	ev := Event{Type: events.MachineBuildSucceeded, ServiceTag: "SUB001"}
+
+	// Emails to channels have no unsubscribe link
+	if message := sender.message([]Event{ev}); strings.Contains(message, "List-Unsubscribe") || strings.Contains(message, "unsubscribe") {
+		t.Errorf("channel email has an unsubscribe link:\n%s", message)
+	}
+
+	// One subscription's email can be unsubscribed from in one click
+	sender.unsubscribeURLs = []string{"https://metal.example.com/u/1"}
+	message := sender.message([]Event{ev})
+	headers, body, _ := strings.Cut(message, "\r\n\r\n")
+	if !strings.Contains(headers, "List-Unsubscribe: <https://metal.example.com/u/1>\r\n") ||
+		!strings.Contains(headers, "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n") {
+		t.Errorf("headers lack one-click unsubscribe:\n%s", headers)
+	}
+	if !strings.Contains(body, "https://metal.example.com/u/1") {
+		t.Errorf("body lacks the unsubscribe link:\n%s", body)
+	}
+
+	// A digest of several subscriptions lists each link, and has no header
+	// that would unsubscribe from just one
+	sender.unsubscribeURLs = append(sender.unsubscribeURLs, "https://metal.example.com/u/2")
+	headers, body, _ = strings.Cut(sender.message([]Event{ev, ev}), "\r\n\r\n")
+	if strings.Contains(headers, "List-Unsubscribe") {
+		t.Errorf("headers of a digest of two subscriptions:\n%s", headers)
+	}
+	if !strings.Contains(body, "/u/1") || !strings.Contains(body, "/u/2") {
+		t.Errorf("body lacks the unsubscribe links:\n%s", body)
+	}
+}
@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys bounds the keys a Memory limiter tracks when none is given
+const DefaultMaxKeys = 100000
+
+// sweepInterval is how often idle buckets are dropped
+const sweepInterval = time.Minute
+
+// Memory is a token bucket limiter that keeps its buckets in memory. A bucket
+// that has refilled completely is the same as no bucket, so idle buckets are
+// dropped and memory stays proportional to the number of recently active
+// keys rather than every key ever seen.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*list.Element // Of *bucket, in recent
+	recent    *list.List               // Buckets, most recently seen first
+	maxKeys   int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	key     string
+	limit   Limit
+	tokens  float64
+	updated time.Time
+}
+
+// NewMemory returns an in-memory limiter tracking at most maxKeys keys, or
+// DefaultMaxKeys if maxKeys is 0. When every tracked key is active and a new
+// one arrives, the bucket of the key seen least recently is dropped. It has
+// had the longest to refill, so it is the likeliest to be full already, and
+// a client still making requests, such as one being limited, keeps its
+// bucket however many other keys arrive.
+func NewMemory(maxKeys int) *Memory {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	return &Memory{
+		buckets:   make(map[string]*list.Element),
+		recent:    list.New(),
+		maxKeys:   maxKeys,
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a token from key's bucket if one is left
+func (m *Memory) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.sweep(now)
+	}
+
+	var b *bucket
+	if e, ok := m.buckets[key]; ok {
+		m.recent.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		for len(m.buckets) >= m.maxKeys {
+			m.remove(m.recent.Back())
+		}
+		b = &bucket{key: key, limit: limit, tokens: float64(limit.Requests), updated: now}
+		m.buckets[key] = m.recent.PushFront(b)
+	}
+	b.refill(now)
+
+	result := Result{Limit: limit.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) / limit.rate() * float64(time.Second))
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = now.Add(time.Duration((float64(limit.Requests) - b.tokens) / limit.rate() * float64(time.Second)))
+
+	return result, nil
+}
+
+// Len returns how many keys have buckets
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buckets)
+}
+
+// sweep drops buckets that have refilled completely
+func (m *Memory) sweep(now time.Time) {
+	for e := m.recent.Front(); e != nil; {
+		next := e.Next()
+		b := e.Value.(*bucket)
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Requests) {
+			m.remove(e)
+		}
+		e = next
+	}
+	m.lastSweep = now
+}
+
+// remove drops a bucket
+func (m *Memory) remove(e *list.Element) {
+	delete(m.buckets, m.recent.Remove(e).(*bucket).key)
+}
+
+// refill adds the tokens earned since the bucket was last updated
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Requests), b.tokens+elapsed*b.limit.rate())
+		b.updated = now
+	}
+}
@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Memory's clock, moved on by the test
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestMemory(maxKeys int) (*Memory, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewMemory(maxKeys)
+	m.now = func() time.Time { return clock.now }
+	m.lastSweep = clock.now
+	return m, clock
+}
+
+func allow(t *testing.T, m *Memory, key string, limit Limit) Result {
+	t.Helper()
+
+	result, err := m.Allow(context.Background(), key, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMemoryRefill(t *testing.T) {
+	m, clock := newTestMemory(0)
+	limit := Limit{Requests: 2, Period: time.Second}
+
+	for i := 0; i < 2; i++ {
+		if !allow(t, m, "client", limit).Allowed {
+			t.Fatalf("request %d of the burst denied", i+1)
+		}
+	}
+	denied := allow(t, m, "client", limit)
+	if denied.Allowed || denied.Remaining != 0 || denied.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("over the burst: %+v, want denied with retry after 500ms", denied)
+	}
+
+	// A token comes back every half second
+	clock.advance(500 * time.Millisecond)
+	if !allow(t, m, "client", limit).Allowed {
+		t.Error("denied once a token was earned back")
+	}
+	if allow(t, m, "client", limit).Allowed {
+		t.Error("allowed a second request on one earned token")
+	}
+
+	// Idle time earns back no more than the burst
+	clock.advance(time.Hour)
+	result := allow(t, m, "client", limit)
+	if !result.Allowed || result.Remaining != 1 || !result.Reset.Equal(clock.now.Add(500*time.Millisecond)) {
+		t.Errorf("after an hour idle: %+v, want 1 remaining and reset in 500ms", result)
+	}
+}
+
+func TestMemorySweepDropsFullBuckets(t *testing.T) {
+	m, clock := newTestMemory(0)
+	limit := Limit{Requests: 10, Period: time.Minute}
+
+	allow(t, m, "idle", limit)
+	clock.advance(30 * time.Second)
+	for i := 0; i < 10; i++ {
+		allow(t, m, "busy", limit)
+	}
+
+	// By the next sweep the idle bucket is full again and the busy one
+	// still isn't
+	clock.advance(sweepInterval - 30*time.Second)
+	allow(t, m, "busy", limit)
+	if m.Len() != 1 {
+		t.Errorf("tracking %d keys after a sweep, want only the busy one", m.Len())
+	}
+}
+
+func TestMemoryEvictsLeastRecentlySeen(t *testing.T) {
+	m, clock := newTestMemory(3)
+	limit := Limit{Requests: 1, Period: time.Minute}
+
+	if !allow(t, m, "abuser", limit).Allowed {
+		t.Fatal("first request denied")
+	}
+
+	// New keys flood in while the abuser keeps trying. Each new key
+	// pushes out the one seen least recently, never the abuser's.
+	for i := 0; i < 100; i++ {
+		clock.advance(time.Millisecond)
+		allow(t, m, fmt.Sprintf("client-%d", i), limit)
+		if allow(t, m, "abuser", limit).Allowed {
+			t.Fatalf("abuser let through after %d new keys", i+1)
+		}
+		if m.Len() > 3 {
+			t.Fatalf("tracking %d keys, want at most 3", m.Len())
+		}
+	}
+
+	// The newest keys are still tracked, and the oldest were dropped,
+	// which only lets them through sooner
+	if allow(t, m, "client-99", limit).Allowed {
+		t.Error("client-99's bucket was dropped")
+	}
+	if !allow(t, m, "client-0", limit).Allowed {
+		t.Error("client-0's bucket was kept")
+	}
+
+	// A key that goes quiet while others arrive is the one dropped
+	clock.advance(time.Millisecond)
+	for _, key := range []string{"new-1", "new-2", "new-3"} {
+		allow(t, m, key, limit)
+	}
+	if !allow(t, m, "abuser", limit).Allowed {
+		t.Error("abuser's bucket kept after three newer keys")
+	}
+}
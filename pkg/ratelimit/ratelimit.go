@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Requests requests per Period. Unused requests accumulate up
+// to Requests, so a client that has been idle can burst that many at once.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit parses a limit written as <requests>/<period>, e.g. "60/1m"
+func ParseLimit(s string) (Limit, error) {
+	requests, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: want <requests>/<period>, e.g. 60/1m", s)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(requests))
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: requests must be a positive number", s)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: period must be a positive duration", s)
+	}
+
+	return Limit{Requests: n, Period: d}, nil
+}
+
+// String formats a limit the way ParseLimit reads it
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// rate is how many requests the limit allows per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Result is the outcome of counting a request against a limit
+type Result struct {
+	Allowed   bool
+	Limit     int       // Requests allowed in a burst
+	Remaining int       // Requests that could be made right now
+	Reset     time.Time // When the full burst is available again
+
+	// RetryAfter is how long until a request would be allowed, when this
+	// one was not
+	RetryAfter time.Duration
+}
+
+// Limiter counts requests by key. Each key should always be counted against
+// the same limit. Implementations are safe for concurrent use; Memory keeps
+// counts in the process, and one shared by several servers would let them
+// enforce a limit together.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
@@ -0,0 +1,81 @@
+package redfish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SetPassword changes the password of the AccountService account the client
+// logs in as
+func (c *Client) SetPassword(password string) error {
+	service, err := c.get("/redfish/v1/AccountService")
+	if err != nil {
+		return err
+	}
+
+	collection := service.link("Accounts")
+	if collection == "" {
+		return fmt.Errorf("BMC does not list Redfish accounts")
+	}
+
+	accounts, err := c.members(collection)
+	if err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		if account.str("UserName") != c.username {
+			continue
+		}
+		return c.patch(account.str("@odata.id"), account.str("@odata.etag"), map[string]interface{}{
+			"Password": password,
+		})
+	}
+
+	return fmt.Errorf("no Redfish account named %q", c.username)
+}
+
+// CheckLogin verifies the client's credentials with an authenticated request
+func (c *Client) CheckLogin() error {
+	_, err := c.get("/redfish/v1/Systems")
+	return err
+}
+
+// patch updates a Redfish resource. BMCs that version resources require
+// their ETag in If-Match.
+func (c *Client) patch(path, etag string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH", c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("redfish request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		return nil
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("redfish PATCH %s returned HTTP %d: %s", path, resp.StatusCode, strings.TrimSpace(string(detail)))
+}
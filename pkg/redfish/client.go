@@ -0,0 +1,171 @@
+package redfish
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Client talks to a BMC over the Redfish REST API
+type Client struct {
+	baseURL  string
+	username string
+	password string
+	http     *http.Client
+}
+
+// NewClient creates a new Redfish client for a BMC
+func NewClient(bmc *models.BMCInfo) (*Client, error) {
+	if bmc == nil {
+		return nil, fmt.Errorf("BMC info is required")
+	}
+
+	if !bmc.Enabled {
+		return nil, fmt.Errorf("BMC is not enabled for this machine")
+	}
+
+	if bmc.IPAddress == "" {
+		return nil, fmt.Errorf("BMC IP address is required")
+	}
+
+	// Port 623 is the IPMI default and is never a Redfish endpoint. IPv6
+	// literals are bracketed in URLs, with or without a port.
+	host := strings.TrimSuffix(strings.TrimPrefix(bmc.IPAddress, "["), "]")
+	if bmc.Port > 0 && bmc.Port != 623 {
+		host = net.JoinHostPort(host, strconv.Itoa(bmc.Port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	return &Client{
+		baseURL:  "https://" + host,
+		username: bmc.Username,
+		password: bmc.Password,
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				// BMCs almost always ship with self-signed certificates
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}, nil
+}
+
+// resource is a generic Redfish JSON document
+type resource map[string]interface{}
+
+// get fetches a Redfish resource by its @odata.id path
+func (c *Client) get(path string) (resource, error) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("redfish request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("redfish GET %s returned HTTP %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var doc resource
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode redfish response for %s: %w", path, err)
+	}
+
+	return doc, nil
+}
+
+// members fetches a collection and returns each of its member documents
+func (c *Client) members(path string) ([]resource, error) {
+	collection, err := c.get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []resource
+	for _, link := range collection.links("Members") {
+		doc, err := c.get(link)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// str returns the first non-empty string value found under the given keys
+func (r resource) str(keys ...string) string {
+	for _, key := range keys {
+		if v, ok := r[key].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// num returns the first numeric value found under the given keys
+func (r resource) num(keys ...string) float64 {
+	for _, key := range keys {
+		if v, ok := r[key].(float64); ok {
+			return v
+		}
+	}
+	return 0
+}
+
+// obj returns a nested object
+func (r resource) obj(key string) resource {
+	if v, ok := r[key].(map[string]interface{}); ok {
+		return resource(v)
+	}
+	return resource{}
+}
+
+// link returns the @odata.id of a nested navigation property
+func (r resource) link(key string) string {
+	return r.obj(key).str("@odata.id")
+}
+
+// links returns the @odata.id values of an array navigation property
+func (r resource) links(key string) []string {
+	items, ok := r[key].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var out []string
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			if id, ok := m["@odata.id"].(string); ok && id != "" {
+				out = append(out, id)
+			}
+		}
+	}
+	return out
+}
+
+// absent reports whether the resource is marked as not installed
+func (r resource) absent() bool {
+	return strings.EqualFold(r.obj("Status").str("State"), "Absent")
+}
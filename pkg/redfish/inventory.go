@@ -0,0 +1,160 @@
+package redfish
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// GetInventory walks the first ComputerSystem exposed by the BMC and maps
+// its memory, storage, and network resources into a HardwareInfo
+func (c *Client) GetInventory() (*models.HardwareInfo, error) {
+	systems, err := c.get("/redfish/v1/Systems")
+	if err != nil {
+		return nil, err
+	}
+
+	systemLinks := systems.links("Members")
+	if len(systemLinks) == 0 {
+		return nil, fmt.Errorf("BMC does not expose any systems")
+	}
+
+	system, err := c.get(systemLinks[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var memory, drives, nics []resource
+
+	if link := system.link("Memory"); link != "" {
+		if memory, err = c.members(link); err != nil {
+			return nil, fmt.Errorf("failed to read memory inventory: %w", err)
+		}
+	}
+
+	if link := system.link("Storage"); link != "" {
+		controllers, err := c.members(link)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read storage inventory: %w", err)
+		}
+		for _, controller := range controllers {
+			for _, driveLink := range controller.links("Drives") {
+				drive, err := c.get(driveLink)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read drive: %w", err)
+				}
+				drives = append(drives, drive)
+			}
+		}
+	}
+
+	if link := system.link("EthernetInterfaces"); link != "" {
+		if nics, err = c.members(link); err != nil {
+			return nil, fmt.Errorf("failed to read network inventory: %w", err)
+		}
+	}
+
+	hw := mapInventory(system, memory, drives, nics)
+	return &hw, nil
+}
+
+// mapInventory converts raw Redfish documents into a HardwareInfo. It does no
+// I/O so it can be exercised against captured BMC responses.
+func mapInventory(system resource, memory, drives, nics []resource) models.HardwareInfo {
+	profile := profileFor(system.str("Manufacturer"))
+
+	hw := models.HardwareInfo{
+		Manufacturer: system.str("Manufacturer"),
+		Model:        system.str("Model"),
+		SerialNumber: system.str(profile.serviceTag...),
+		BIOSVersion:  system.str("BiosVersion"),
+	}
+
+	processors := system.obj("ProcessorSummary")
+	hw.CPU.Model = processors.str("Model")
+	hw.CPU.Sockets = int(processors.num("Count"))
+
+	for _, dimm := range memory {
+		if dimm.absent() {
+			continue
+		}
+
+		sizeBytes := int64(dimm.num(profile.memorySize...)) * 1024 * 1024
+		if sizeBytes == 0 {
+			continue
+		}
+
+		hw.Memory.Modules = append(hw.Memory.Modules, models.MemorySlot{
+			Slot:      dimm.str(profile.memorySlot...),
+			SizeBytes: sizeBytes,
+			Type:      dimm.str(profile.memoryType...),
+			Speed:     int(dimm.num(profile.memorySpeed...)),
+		})
+		hw.Memory.TotalBytes += sizeBytes
+	}
+
+	// Fall back to the summary when the BMC hides individual DIMMs
+	if hw.Memory.TotalBytes == 0 {
+		hw.Memory.TotalBytes = int64(system.obj("MemorySummary").num("TotalSystemMemoryGiB") * 1024 * 1024 * 1024)
+	}
+	hw.Memory.TotalGB = float64(hw.Memory.TotalBytes) / (1024 * 1024 * 1024)
+
+	for _, drive := range drives {
+		if drive.absent() {
+			continue
+		}
+
+		sizeBytes := int64(drive.num("CapacityBytes"))
+		hw.Disks = append(hw.Disks, models.DiskInfo{
+			Device:     drive.str("Name", "Id"),
+			Model:      drive.str("Model"),
+			SizeBytes:  sizeBytes,
+			SizeGB:     float64(sizeBytes) / (1024 * 1024 * 1024),
+			Type:       driveType(drive),
+			Serial:     drive.str("SerialNumber"),
+			Rotational: strings.EqualFold(drive.str("MediaType"), "HDD"),
+		})
+	}
+
+	for _, nic := range nics {
+		if nic.absent() {
+			continue
+		}
+
+		info := models.NICInfo{
+			Name:       nic.str("Id", "Name"),
+			MACAddress: strings.ToLower(nic.str(profile.nicMAC...)),
+			LinkStatus: strings.ToLower(nic.str("LinkStatus")),
+		}
+		if speed := nic.num(profile.nicSpeed...); speed > 0 {
+			info.Speed = formatSpeed(int(speed))
+		}
+		hw.NICs = append(hw.NICs, info)
+	}
+
+	return hw
+}
+
+// driveType maps Redfish MediaType/Protocol onto the SSD/HDD/NVMe values the
+// registration image reports
+func driveType(drive resource) string {
+	if strings.EqualFold(drive.str("Protocol"), "NVMe") {
+		return "NVMe"
+	}
+	switch strings.ToUpper(drive.str("MediaType")) {
+	case "SSD":
+		return "SSD"
+	case "HDD":
+		return "HDD"
+	}
+	return ""
+}
+
+// formatSpeed renders a link speed in Mbps the way the registration image does
+func formatSpeed(mbps int) string {
+	if mbps >= 1000 && mbps%1000 == 0 {
+		return fmt.Sprintf("%dGbps", mbps/1000)
+	}
+	return fmt.Sprintf("%dMbps", mbps)
+}
@@ -0,0 +1,160 @@
+package redfish
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// fixtureClient serves a captured BMC's documents, a JSON object of
+// @odata.id paths to documents in testdata, to a client
+func fixtureClient(t *testing.T, name string) *Client {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs map[string]json.RawMessage
+	if err := json.Unmarshal(data, &docs); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "root" || pass != "calvin" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Client{baseURL: srv.URL, username: "root", password: "calvin", http: srv.Client()}
+}
+
+func TestGetInventoryDell(t *testing.T) {
+	hw, err := fixtureClient(t, "dell").GetInventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// iDRAC's SKU is the service tag; SerialNumber is the board's
+	if hw.SerialNumber != "7XJ2KQ3" {
+		t.Errorf("SerialNumber = %q, want the service tag 7XJ2KQ3", hw.SerialNumber)
+	}
+	if hw.Manufacturer != "Dell Inc." || hw.Model != "PowerEdge R650" || hw.BIOSVersion != "1.8.2" {
+		t.Errorf("system = %q %q %q", hw.Manufacturer, hw.Model, hw.BIOSVersion)
+	}
+	if hw.CPU.Sockets != 2 || hw.CPU.Model != "Intel(R) Xeon(R) Gold 6338 CPU @ 2.00GHz" {
+		t.Errorf("CPU = %+v", hw.CPU)
+	}
+
+	wantModules := []models.MemorySlot{
+		{Slot: "DIMM.Socket.A1", SizeBytes: 32 << 30, Type: "DDR4", Speed: 3200},
+		{Slot: "DIMM.Socket.B1", SizeBytes: 32 << 30, Type: "DDR4", Speed: 3200},
+	}
+	if !reflect.DeepEqual(hw.Memory.Modules, wantModules) {
+		t.Errorf("memory modules = %+v, want %+v (absent DIMM skipped)", hw.Memory.Modules, wantModules)
+	}
+	if hw.Memory.TotalBytes != 64<<30 || hw.Memory.TotalGB != 64 {
+		t.Errorf("memory total = %d bytes, %v GB", hw.Memory.TotalBytes, hw.Memory.TotalGB)
+	}
+
+	if len(hw.Disks) != 2 {
+		t.Fatalf("disks = %+v, want 2", hw.Disks)
+	}
+	ssd, hdd := hw.Disks[0], hw.Disks[1]
+	if ssd.Type != "SSD" || ssd.Rotational || ssd.Serial != "S5YJNE0R123456" || ssd.SizeBytes != 479559942144 {
+		t.Errorf("SSD = %+v", ssd)
+	}
+	if hdd.Type != "HDD" || !hdd.Rotational || hdd.Model != "ST2000NM0055" {
+		t.Errorf("HDD = %+v", hdd)
+	}
+
+	wantNICs := []models.NICInfo{
+		{Name: "NIC.Integrated.1-1-1", MACAddress: "b0:26:28:aa:bb:01", Speed: "25Gbps", LinkStatus: "linkup"},
+	}
+	if !reflect.DeepEqual(hw.NICs, wantNICs) {
+		t.Errorf("NICs = %+v, want %+v (permanent MAC)", hw.NICs, wantNICs)
+	}
+}
+
+func TestGetInventorySupermicro(t *testing.T) {
+	hw, err := fixtureClient(t, "supermicro").GetInventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hw.SerialNumber != "S292395X8712345" {
+		t.Errorf("SerialNumber = %q, want the system serial", hw.SerialNumber)
+	}
+
+	// Older firmware's SizeMB/SpeedMHz and Name-only locator; the empty
+	// slot is skipped
+	wantModules := []models.MemorySlot{
+		{Slot: "P1-DIMMA1", SizeBytes: 16 << 30, Type: "DRAM", Speed: 2666},
+	}
+	if !reflect.DeepEqual(hw.Memory.Modules, wantModules) {
+		t.Errorf("memory modules = %+v, want %+v", hw.Memory.Modules, wantModules)
+	}
+	if hw.Memory.TotalGB != 16 {
+		t.Errorf("memory total = %v GB, want 16", hw.Memory.TotalGB)
+	}
+
+	if len(hw.Disks) != 0 {
+		t.Errorf("disks = %+v, want none without a Storage link", hw.Disks)
+	}
+
+	wantNICs := []models.NICInfo{
+		{Name: "1", MACAddress: "0c:c4:7a:11:22:33", Speed: "1Gbps", LinkStatus: "linkup"},
+	}
+	if !reflect.DeepEqual(hw.NICs, wantNICs) {
+		t.Errorf("NICs = %+v, want %+v (current MAC, LinkSpeedMbps)", hw.NICs, wantNICs)
+	}
+}
+
+func TestMapInventoryMemorySummaryFallback(t *testing.T) {
+	system := resource{
+		"Manufacturer":  "HPE",
+		"SerialNumber":  "CZ12345678",
+		"MemorySummary": map[string]interface{}{"TotalSystemMemoryGiB": float64(128)},
+	}
+
+	hw := mapInventory(system, nil, nil, nil)
+	if hw.SerialNumber != "CZ12345678" {
+		t.Errorf("SerialNumber = %q", hw.SerialNumber)
+	}
+	if hw.Memory.TotalBytes != 128<<30 || len(hw.Memory.Modules) != 0 {
+		t.Errorf("memory = %+v, want 128 GiB from the summary", hw.Memory)
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	tests := []struct {
+		manufacturer string
+		want         vendorProfile
+	}{
+		{"Dell Inc.", vendorProfiles["dell"]},
+		{"DELL", vendorProfiles["dell"]},
+		{"Supermicro", vendorProfiles["supermicro"]},
+		{"Lenovo", genericProfile},
+		{"", genericProfile},
+	}
+	for _, tt := range tests {
+		if got := profileFor(tt.manufacturer); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("profileFor(%q) = %+v, want %+v", tt.manufacturer, got, tt.want)
+		}
+	}
+}
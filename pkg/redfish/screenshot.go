@@ -0,0 +1,184 @@
+package redfish
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ErrScreenshotUnsupported is returned by Screenshot when the BMC offers no
+// way to capture the server's screen
+var ErrScreenshotUnsupported = errors.New("BMC does not support capturing the server's screen")
+
+// maxActionResponseBytes bounds the response read for an action. It leaves
+// room for screenshots that BMCs send base64-encoded in JSON.
+const maxActionResponseBytes = 32 << 20
+
+// Screenshot is an image of the server's screen
+type Screenshot struct {
+	Data        []byte
+	ContentType string // image/png or image/jpeg
+}
+
+// Screenshot captures the server's screen. BMCs that offer it do so as an
+// action of their manager, or, on iDRAC, of the DellLCService the manager
+// links to; either may return the image itself or base64-encoded in JSON.
+// It returns ErrScreenshotUnsupported if the BMC has no such action.
+func (c *Client) Screenshot() (*Screenshot, error) {
+	managers, err := c.get("/redfish/v1/Managers")
+	if err != nil {
+		return nil, err
+	}
+
+	managerLinks := managers.links("Members")
+	if len(managerLinks) == 0 {
+		return nil, ErrScreenshotUnsupported
+	}
+
+	manager, err := c.get(managerLinks[0])
+	if err != nil {
+		return nil, err
+	}
+
+	target := screenshotAction(manager.obj("Actions"))
+	body := map[string]interface{}{}
+	if target == "" {
+		if link := manager.obj("Links").obj("Oem").obj("Dell").link("DellLCService"); link != "" {
+			service, err := c.get(link)
+			if err != nil {
+				return nil, err
+			}
+			target = screenshotAction(service.obj("Actions"))
+			body["FileType"] = "ServerScreenShot"
+		}
+	}
+	if target == "" {
+		return nil, ErrScreenshotUnsupported
+	}
+
+	data, contentType, err := c.post(target, body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeScreenshot(data, contentType)
+}
+
+// screenshotAction returns the target of the screen capture action among a
+// resource's actions, including its OEM actions
+func screenshotAction(actions resource) string {
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "Oem" {
+			if target := screenshotAction(actions.obj(name)); target != "" {
+				return target
+			}
+			continue
+		}
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "screenshot") || strings.Contains(lower, "screencapture") {
+			if target := actions.obj(name).str("target"); target != "" {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+// decodeScreenshot returns the image in a screen capture action's
+// response, which is either the image or JSON with it base64-encoded
+func decodeScreenshot(data []byte, contentType string) (*Screenshot, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" {
+		return screenshotImage(data)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode screenshot response: %w", err)
+	}
+
+	// iDRAC puts it in ServerScreenShotFile; other BMCs name the field
+	// after the screenshot or image
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lower := strings.ToLower(key)
+		if !strings.Contains(lower, "screenshot") && !strings.Contains(lower, "image") {
+			continue
+		}
+		encoded, ok := doc[key].(string)
+		if !ok || encoded == "" {
+			continue
+		}
+		image, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			// The image is never put in errors, so it can't end up in logs
+			return nil, fmt.Errorf("screenshot in %s is not valid base64", key)
+		}
+		return screenshotImage(image)
+	}
+	return nil, errors.New("screenshot response has no image")
+}
+
+// screenshotImage checks that data is a PNG or JPEG image, by its contents
+// rather than what the BMC said it was
+func screenshotImage(data []byte) (*Screenshot, error) {
+	contentType := http.DetectContentType(data)
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return nil, fmt.Errorf("screenshot is %s, not a PNG or JPEG image", contentType)
+	}
+	return &Screenshot{Data: data, ContentType: contentType}, nil
+}
+
+// post invokes a Redfish action and returns its response body and content
+// type
+func (c *Client) post(path string, body interface{}) ([]byte, string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("redfish request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("redfish POST %s returned HTTP %d: %s", path, resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxActionResponseBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read redfish response for %s: %w", path, err)
+	}
+	if len(respBody) > maxActionResponseBytes {
+		return nil, "", fmt.Errorf("redfish response for %s is larger than %d bytes", path, maxActionResponseBytes)
+	}
+
+	return respBody, resp.Header.Get("Content-Type"), nil
+}
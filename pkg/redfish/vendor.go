@@ -0,0 +1,67 @@
+package redfish
+
+import "strings"
+
+// vendorProfile describes where a BMC vendor puts properties that are not
+// consistent across Redfish implementations. Each list is tried in order and
+// the first non-empty value wins.
+type vendorProfile struct {
+	// System identity
+	serviceTag []string
+
+	// Memory modules
+	memorySlot  []string
+	memorySize  []string // MiB
+	memoryType  []string
+	memorySpeed []string // MHz
+
+	// Network interfaces
+	nicMAC   []string
+	nicSpeed []string // Mbps
+}
+
+var genericProfile = vendorProfile{
+	serviceTag:  []string{"SerialNumber", "SKU"},
+	memorySlot:  []string{"DeviceLocator", "Name", "Id"},
+	memorySize:  []string{"CapacityMiB"},
+	memoryType:  []string{"MemoryDeviceType", "MemoryType"},
+	memorySpeed: []string{"OperatingSpeedMhz"},
+	nicMAC:      []string{"PermanentMACAddress", "MACAddress"},
+	nicSpeed:    []string{"SpeedMbps"},
+}
+
+// vendorProfiles holds the known deviations from the generic profile, keyed
+// by a lowercase substring of the system Manufacturer property
+var vendorProfiles = map[string]vendorProfile{
+	// iDRAC reports the service tag in SKU; SerialNumber is the board serial
+	"dell": {
+		serviceTag:  []string{"SKU", "SerialNumber"},
+		memorySlot:  []string{"DeviceLocator", "Id"},
+		memorySize:  []string{"CapacityMiB"},
+		memoryType:  []string{"MemoryDeviceType"},
+		memorySpeed: []string{"OperatingSpeedMhz"},
+		nicMAC:      []string{"PermanentMACAddress", "MACAddress"},
+		nicSpeed:    []string{"SpeedMbps"},
+	},
+	// Older Supermicro firmware uses SizeMB/SpeedMHz and a Name-only locator
+	"supermicro": {
+		serviceTag:  []string{"SerialNumber"},
+		memorySlot:  []string{"DeviceLocator", "Name", "Id"},
+		memorySize:  []string{"CapacityMiB", "SizeMB"},
+		memoryType:  []string{"MemoryDeviceType", "MemoryType"},
+		memorySpeed: []string{"OperatingSpeedMhz", "SpeedMHz"},
+		nicMAC:      []string{"MACAddress", "PermanentMACAddress"},
+		nicSpeed:    []string{"SpeedMbps", "LinkSpeedMbps"},
+	},
+}
+
+// profileFor selects the vendor profile for a system manufacturer
+func profileFor(manufacturer string) vendorProfile {
+	m := strings.ToLower(manufacturer)
+	for key, profile := range vendorProfiles {
+		if strings.Contains(m, key) {
+			return profile
+		}
+	}
+	return genericProfile
+}
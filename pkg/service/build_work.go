@@ -0,0 +1,422 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// buildClaimPoll is how often a waiting claim looks for a queued build
+const buildClaimPoll = 2 * time.Second
+
+// ClaimBuild claims the next queued build the builder can run, waiting up
+// to wait for one to be queued, and returns it with what the builder needs
+// to run it. The builder must have registered, since claims go by the
+// architectures and labels it registered with. It returns nil, nil if no
+// build was queued in time.
+//
+// A claimed build is building under a lease of models.BuildLease, which
+// RecordBuildProgress renews. CompleteBuild records its outcome; if the
+// lease runs out first, ExpireBuildLeases puts it back in the queue.
+func (s *Service) ClaimBuild(ctx context.Context, builderName string, wait time.Duration) (*models.BuildJob, error) {
+	builder, err := s.db.GetBuilder(builderName)
+	if err != nil {
+		return nil, err
+	}
+	if builder == nil {
+		return nil, invalid("builder %s has not registered", builderName)
+	}
+
+	deadline := time.Now().Add(min(wait, models.MaxBuildClaimWait))
+	for ctx.Err() == nil {
+		build, err := s.db.ClaimPendingBuild(builder, time.Now().Add(models.BuildLease))
+		if err != nil {
+			return nil, err
+		}
+		if build != nil {
+			job, err := s.buildJob(ctx, build)
+			if err != nil || job != nil {
+				return job, err
+			}
+			// The build couldn't run and has failed; look for another
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(min(buildClaimPoll, time.Until(deadline))):
+		}
+	}
+	return nil, nil
+}
+
+// buildJob gathers what a builder needs to run a build it claimed. A build
+// of a machine or system image version that no longer exists is failed,
+// and nil returned.
+func (s *Service) buildJob(ctx context.Context, build *models.BuildRequest) (*models.BuildJob, error) {
+	job := &models.BuildJob{Build: build}
+
+	if build.Type == models.BuildTypeRegistration {
+		image, err := s.db.GetSystemImageByBuild(build.ID)
+		if err != nil {
+			return nil, err
+		}
+		if image == nil {
+			return nil, s.failClaimedBuild(ctx, build, "Failed to get system image: no version is built by this build")
+		}
+		job.SystemImage = image
+		return job, nil
+	}
+
+	machine, err := s.db.GetMachine(build.MachineID)
+	if err != nil {
+		return nil, err
+	}
+	if machine == nil {
+		return nil, s.failClaimedBuild(ctx, build, "Failed to get machine: machine not found")
+	}
+	job.Machine = machine
+
+	if job.Groups, err = s.db.GetMachineGroups(machine.ID); err != nil {
+		return nil, err
+	}
+	if job.PreviousBuild, err = s.db.GetLatestSuccessfulBuild(machine.ID); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// failClaimedBuild fails a build its builder can't run
+func (s *Service) failClaimedBuild(ctx context.Context, build *models.BuildRequest, message string) error {
+	_, err := s.CompleteBuild(ctx, build.ID, models.BuildResult{
+		Builder:     build.Builder,
+		Error:       message,
+		CompletedAt: time.Now(),
+	})
+	return err
+}
+
+// RecordBuildProgress renews a builder's lease on a build, and records the
+// toolchain and log output the builder reports. It returns a ConflictError
+// if the build is no longer building on that builder, which should stop
+// working on it.
+func (s *Service) RecordBuildProgress(ctx context.Context, id string, progress models.BuildProgress) error {
+	renewed, err := s.db.RenewBuildLease(id, progress.Builder, time.Now().Add(models.BuildLease))
+	if err != nil {
+		return err
+	}
+	if !renewed {
+		return s.notLeased(id, progress.Builder)
+	}
+
+	if progress.Environment != nil {
+		if err := s.db.SetBuildEnvironment(id, progress.Builder, *progress.Environment); err != nil {
+			return err
+		}
+	}
+	if progress.Log != "" {
+		if err := s.db.AppendBuildLog(id, progress.Log, progress.MaxLogBytes); err != nil {
+			return err
+		}
+	}
+	if progress.Stage != "" {
+		log.Printf("Build %s on %s: %s", id, progress.Builder, progress.Stage)
+	}
+	return nil
+}
+
+// notLeased describes why a build isn't building on builder
+func (s *Service) notLeased(id, builder string) error {
+	build, err := s.db.GetBuild(id)
+	if err != nil {
+		return err
+	}
+	if build == nil {
+		return ErrBuildNotFound
+	}
+	if build.Status == "building" {
+		return &ConflictError{Message: fmt.Sprintf("build is building on %s, not %s", build.Builder, builder)}
+	}
+	return &ConflictError{Message: fmt.Sprintf("build is %s, no longer building on %s", build.Status, builder)}
+}
+
+// CompleteBuild records how a build ended, as its builder reports it, and
+// moves its machine or system image version on: a machine is ready, or
+// testing if the build requires a boot test, or failed. The result is
+// recorded only while the build is building on that builder. A result that
+// was already recorded is acknowledged again, so builders can retry until
+// they hear back; otherwise it returns a ConflictError.
+func (s *Service) CompleteBuild(ctx context.Context, id string, result models.BuildResult) (*models.BuildRequest, error) {
+	build, err := s.db.GetBuild(id)
+	if err != nil {
+		return nil, err
+	}
+	if build == nil {
+		return nil, ErrBuildNotFound
+	}
+
+	status := "failed"
+	if result.Success {
+		status = "success"
+	}
+	if build.Status != "building" || build.Builder != result.Builder {
+		if build.Builder == result.Builder && build.CompletedAt != nil && sameOutcome(build.Status, status) {
+			return build, nil
+		}
+		return nil, s.notLeased(id, result.Builder)
+	}
+
+	if result.Log != "" {
+		if err := s.db.SaveBuildLog(id, result.Log, result.MaxLogBytes); err != nil {
+			log.Printf("Failed to save log of build %s: %v", id, err)
+		}
+	}
+	if result.Environment != nil {
+		if err := s.db.SetBuildEnvironment(id, result.Builder, *result.Environment); err != nil {
+			log.Printf("Failed to record environment of build %s: %v", id, err)
+		}
+		build.Environment = result.Environment
+	}
+	if result.SigningKey != nil {
+		if err := s.db.RecordBootSigningKey(result.SigningKey); err != nil {
+			return nil, err
+		}
+		build.SigningKey = result.SigningKey.Fingerprint
+	}
+
+	completedAt := result.CompletedAt
+	if completedAt.IsZero() {
+		completedAt = time.Now()
+	}
+	build.Status = status
+	build.Error = result.Error
+	build.ArtifactURL = result.ArtifactURL
+	build.ArtifactBytes = result.ArtifactBytes
+	build.CompletedAt = &completedAt
+	build.DurationMS = result.DurationMS
+	build.PeakMemoryBytes = result.PeakMemoryBytes
+	build.SystemPath = result.SystemPath
+	build.ClosureDiffFrom = result.ClosureDiffFrom
+	build.ClosureDiff = result.ClosureDiff
+	build.Warnings = result.Warnings
+
+	finished, err := s.db.FinishBuild(build)
+	if err != nil {
+		return nil, err
+	}
+	if !finished {
+		return nil, s.notLeased(id, result.Builder)
+	}
+	if result.Success && build.ArtifactURL != "" {
+		s.recordArtifactUsage(build.ArtifactURL)
+	}
+
+	switch {
+	case build.Type == models.BuildTypeRegistration:
+		s.finishSystemImageBuild(build)
+	case result.Success:
+		log.Printf("Build %s completed successfully", build.ID)
+		s.buildSucceeded(ctx, build, result.CreateBootTest)
+	default:
+		log.Printf("Build %s failed: %s", build.ID, build.Error)
+		s.buildFailed(ctx, build)
+	}
+
+	return build, nil
+}
+
+// sameOutcome reports whether a build's status is the outcome a result
+// reported. A successful build stays successful even once its boot test
+// has failed it.
+func sameOutcome(status, outcome string) bool {
+	return status == outcome || (outcome == "success" && status == "tested_failed")
+}
+
+// buildSucceeded moves a machine whose build succeeded to ready. A machine
+// whose build requires a boot test waits in testing until the server sees
+// the test pass. Builds of installers and bundles are only announced.
+func (s *Service) buildSucceeded(ctx context.Context, build *models.BuildRequest, createBootTest bool) {
+	if !build.BootsMachine() {
+		s.publish(ctx, events.Event{
+			Type:      events.MachineBuildSucceeded,
+			MachineID: build.MachineID,
+			Data: events.BuildSucceededData{
+				BuildID:     build.ID,
+				Target:      build.Target,
+				ArtifactURL: build.ArtifactURL,
+			},
+		})
+		return
+	}
+
+	machine, err := s.db.GetMachine(build.MachineID)
+	if err != nil || machine == nil {
+		log.Printf("Failed to get machine %s of build %s: %v", build.MachineID, build.ID, err)
+		return
+	}
+
+	oldStatus := machine.Status
+	machine.Status = models.StatusReady
+	if createBootTest || build.RequireTest {
+		if err := s.createBootTest(build, machine); err != nil {
+			log.Printf("Failed to create boot test for build %s: %v", build.ID, err)
+			if build.RequireTest {
+				machine.Status = models.StatusFailed
+			}
+		} else if build.RequireTest {
+			machine.Status = models.StatusTesting
+		}
+	}
+	machine.LastBuildID = &build.ID
+	machine.LastBuildTime = build.CompletedAt
+	machine.BuiltConfigHash = build.ConfigHash
+	if err := s.db.UpdateMachine(machine); err != nil {
+		log.Printf("Failed to update machine: %v", err)
+	}
+
+	var closureDiff *models.ClosureDiffSummary
+	if build.ClosureDiff != "" {
+		summary := models.SummarizeClosureDiff(build.ClosureDiff)
+		closureDiff = &summary
+	}
+	s.publish(ctx, events.Event{
+		Type:      events.MachineBuildSucceeded,
+		MachineID: machine.ID,
+		Data: events.BuildSucceededData{
+			BuildID:     build.ID,
+			Target:      build.Target,
+			ArtifactURL: build.ArtifactURL,
+			ClosureDiff: closureDiff,
+		},
+	})
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+}
+
+// createBootTest records a pending boot test of a build's image, to be run
+// and reported by whatever boots the machine
+func (s *Service) createBootTest(build *models.BuildRequest, machine *models.Machine) error {
+	test := &models.ImageTest{
+		ImagePath: build.ArtifactURL,
+		ImageType: "custom",
+		TestType:  "boot",
+		Status:    "pending",
+		MachineID: &machine.ID,
+		BuildID:   &build.ID,
+	}
+	if err := s.db.CreateImageTest(test); err != nil {
+		return err
+	}
+
+	log.Printf("Created boot test %s for build %s", test.ID, build.ID)
+	return nil
+}
+
+// buildFailed marks the machine of a failed build failed, unless the
+// build was of an installer or bundle
+func (s *Service) buildFailed(ctx context.Context, build *models.BuildRequest) {
+	s.publish(ctx, events.Event{
+		Type:      events.MachineBuildFailed,
+		MachineID: build.MachineID,
+		Data: events.BuildFailedData{
+			BuildID: build.ID,
+			Error:   build.Error,
+		},
+	})
+	if !build.BootsMachine() {
+		return
+	}
+
+	machine, err := s.db.GetMachine(build.MachineID)
+	if err != nil || machine == nil {
+		return
+	}
+	oldStatus := machine.Status
+	machine.Status = models.StatusFailed
+	if err := s.db.UpdateMachine(machine); err != nil {
+		log.Printf("Failed to update machine: %v", err)
+	}
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+}
+
+// finishSystemImageBuild moves the system image version a build built on:
+// a built version waits for a boot test, since nothing boots it until it
+// is promoted. Unlike machine builds, there is no machine to mark failed
+// or publish events about.
+func (s *Service) finishSystemImageBuild(build *models.BuildRequest) {
+	image, err := s.db.GetSystemImageByBuild(build.ID)
+	if err != nil || image == nil {
+		log.Printf("Failed to get system image of build %s: %v", build.ID, err)
+		return
+	}
+
+	if build.Status != "success" {
+		log.Printf("Build %s failed: %s", build.ID, build.Error)
+		image.Status = models.SystemImageFailed
+		image.Error = build.Error
+	} else {
+		test := &models.ImageTest{
+			ImagePath: build.ArtifactURL,
+			ImageType: image.Name,
+			TestType:  "boot",
+			Status:    "pending",
+			BuildID:   &build.ID,
+		}
+		if err := s.db.CreateImageTest(test); err != nil {
+			log.Printf("Failed to create boot test for build %s: %v", build.ID, err)
+			image.Status = models.SystemImageFailed
+			image.Error = fmt.Sprintf("Failed to create boot test: %v", err)
+		} else {
+			image.Status = models.SystemImageTesting
+			image.TestID = test.ID
+		}
+		log.Printf("Build %s of %s image version %d completed successfully", build.ID, image.Name, image.Version)
+	}
+
+	if err := s.db.UpdateSystemImageStatus(image); err != nil {
+		log.Printf("Failed to update %s image version %d: %v", image.Name, image.Version, err)
+	}
+}
+
+// ExpireBuildLeases puts builds whose builder stopped renewing their lease
+// back in the queue for another builder to claim. A build that has been
+// claimed models.MaxBuildAttempts times fails instead, so a build that
+// takes its builder down doesn't take every builder down in turn.
+func (s *Service) ExpireBuildLeases(ctx context.Context) error {
+	now := time.Now()
+	builds, err := s.db.ListExpiredBuildLeases(now)
+	if err != nil {
+		return err
+	}
+
+	for _, build := range builds {
+		if build.Attempts >= models.MaxBuildAttempts {
+			message := fmt.Sprintf("Builder %s stopped reporting on the build; gave up after %d attempts", build.Builder, build.Attempts)
+			if _, err := s.CompleteBuild(ctx, build.ID, models.BuildResult{
+				Builder:     build.Builder,
+				Error:       message,
+				CompletedAt: now,
+			}); err != nil {
+				log.Printf("Failed to fail abandoned build %s: %v", build.ID, err)
+			}
+			continue
+		}
+
+		requeued, err := s.db.RequeueBuild(build.ID, build.Builder, now)
+		if err != nil {
+			log.Printf("Failed to requeue build %s: %v", build.ID, err)
+			continue
+		}
+		if requeued {
+			log.Printf("Build %s went back in the queue: builder %s stopped renewing its lease (attempt %d of %d)",
+				build.ID, build.Builder, build.Attempts, models.MaxBuildAttempts)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// RegisterBuilder registers a builder with its capabilities and health, or
+// renews its registration as a heartbeat, and returns the builder as
+// recorded. A registration never changes whether the builder is cordoned.
+//
+// A builder whose disks have just gone low is announced with
+// builder.low_disk, and a garbage collection it reports for the first time
+// with builder.gc_completed; one that answers the builder's pending request
+// clears it.
+func (s *Service) RegisterBuilder(ctx context.Context, req models.RegisterBuilderRequest) (*models.Builder, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, invalid("name is required")
+	}
+
+	var architectures []string
+	for _, arch := range req.Architectures {
+		if arch = models.NormalizeArchitecture(arch); arch != "" {
+			architectures = append(architectures, arch)
+		}
+	}
+	if len(architectures) == 0 {
+		return nil, invalid("at least one architecture is required")
+	}
+
+	if req.MaxConcurrentBuilds < 1 {
+		req.MaxConcurrentBuilds = 1
+	}
+	now := time.Now()
+	if req.StartedAt.IsZero() {
+		req.StartedAt = now
+	}
+
+	previous, err := s.db.GetBuilder(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.RecordBuilderHeartbeat(&models.Builder{
+		Name:                req.Name,
+		Environment:         req.Environment,
+		StartedAt:           req.StartedAt,
+		LastSeenAt:          now,
+		Architectures:       architectures,
+		Labels:              req.Labels,
+		MaxConcurrentBuilds: req.MaxConcurrentBuilds,
+		Health:              req.Health,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Health != nil {
+		s.builderHealthChanged(ctx, req.Name, previous, req.Health)
+	}
+
+	return s.db.GetBuilder(req.Name)
+}
+
+// builderHealthChanged publishes what changed between a builder's previous
+// registration and the health it reports now
+func (s *Service) builderHealthChanged(ctx context.Context, name string, previous *models.Builder, health *models.BuilderHealth) {
+	var before *models.BuilderHealth
+	if previous != nil {
+		before = previous.Health
+	}
+
+	if health.LowDisk() && (before == nil || !before.LowDisk()) {
+		log.Printf("Builder %s is low on disk space", name)
+		s.publish(ctx, events.Event{
+			Type: events.BuilderLowDisk,
+			Data: events.BuilderLowDiskData{
+				Builder:       name,
+				Disks:         health.Disks,
+				NixStoreBytes: health.NixStoreBytes,
+			},
+		})
+	}
+
+	gc := health.LastGC
+	if gc == nil || (before != nil && before.LastGC != nil && before.LastGC.CompletedAt.Equal(gc.CompletedAt)) {
+		return
+	}
+
+	var requestedBy string
+	if gc.RequestID != "" && previous != nil && previous.PendingGC != nil && previous.PendingGC.ID == gc.RequestID {
+		requestedBy = previous.PendingGC.RequestedBy
+		if err := s.db.ClearBuilderGCRequest(name, gc.RequestID); err != nil {
+			log.Printf("Failed to clear garbage collection request of builder %s: %v", name, err)
+		}
+	}
+
+	log.Printf("Builder %s collected garbage: %d bytes freed", name, gc.FreedBytes)
+	s.publish(ctx, events.Event{
+		Type: events.BuilderGCCompleted,
+		Data: events.BuilderGCCompletedData{
+			Builder:       name,
+			RequestedBy:   requestedBy,
+			MaxFreedBytes: gc.MaxFreedBytes,
+			FreedBytes:    gc.FreedBytes,
+			DurationMS:    gc.CompletedAt.Sub(gc.StartedAt).Milliseconds(),
+			Error:         gc.Error,
+		},
+	})
+}
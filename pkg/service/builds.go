@@ -0,0 +1,405 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/lint"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/maintenance"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// BuildOptions are the choices made when a build is queued
+type BuildOptions struct {
+	// Priority is the build's priority, or normal priority if empty.
+	// Whether the caller may queue urgent builds is up to the caller.
+	Priority string
+
+	// Actor is who the build is attributed to, or the user authenticated
+	// in the context if empty
+	Actor string
+
+	// OverrideMaintenance builds even when a maintenance window blocks
+	// builds of the machine, recording the override in its event log
+	OverrideMaintenance bool
+
+	// Admin marks a build queued by an admin, which doesn't wait for
+	// approval. Bulk marks one queued with others, by a bulk operation or
+	// a rollout, which waits for approval whoever queued it, if approval
+	// is required.
+	Admin bool
+	Bulk  bool
+
+	// Target is what the build produces, or the machine's build target if
+	// empty
+	Target string
+}
+
+// TriggerBuild queues a build of a machine's configuration, checking that
+// the machine can be built and that no maintenance window blocks it
+func (s *Service) TriggerBuild(ctx context.Context, machineID string, opts BuildOptions) (*models.BuildRequest, error) {
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		return nil, err
+	}
+	if machine == nil {
+		return nil, ErrMachineNotFound
+	}
+
+	if !machine.CanProvision() {
+		return nil, &ConflictError{Message: fmt.Sprintf("machine is %s", machine.Status)}
+	}
+
+	if opts.Priority != "" && !models.IsValidBuildPriority(opts.Priority) {
+		return nil, invalid("priority must be urgent, high, normal, or low")
+	}
+
+	if err := s.CheckMaintenance(ctx, []string{machine.ID}, models.MaintenanceOpBuild, opts.OverrideMaintenance); err != nil {
+		return nil, err
+	}
+
+	return s.StartBuild(ctx, machine, opts)
+}
+
+// StartBuild queues a build of the machine's configuration and moves the
+// machine to building, without checking whether it may be built. The
+// build's target must be supported for the machine's architecture; builds
+// of targets other than netboot leave the machine as it is. A
+// configuration assembled from fragments is validated first, and recorded
+// on the build as assembled. The configuration is linted, with the result
+// recorded on the machine and the build; if lint finds errors, the build
+// is recorded as failed and a LintError returned.
+//
+// Builds queued by a user count against their build quota, and a
+// QuotaError is returned if it is used up.
+//
+// If the build needs approval, it waits in awaiting_approval instead and
+// the machine is left as it is until ApproveBuild queues the build.
+//
+// The machine's last build time is when its last build was queued, however
+// the build was started.
+func (s *Service) StartBuild(ctx context.Context, machine *models.Machine, opts BuildOptions) (*models.BuildRequest, error) {
+	target := buildTarget(machine, opts.Target)
+	if err := models.CheckBuildTarget(target, machine.Hardware.CPU.Architecture); err != nil {
+		return nil, invalid("%s", err.Error())
+	}
+
+	// Builds count against the quota of the user who queued them, or of
+	// the user a schedule or rollout queues them for
+	user, err := s.QuotaUser(ctx, opts.Actor)
+	if err != nil {
+		return nil, err
+	}
+	quota, err := s.CheckQuota(user, models.QuotaBuilds, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := fragments.BuildConfig(ctx, s.db, s.builder, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	requestedBy := actor(ctx, opts.Actor)
+	result := lint.Check(config, machine, s.config.LintRules.Rules())
+	if err := s.db.SetMachineConfigLint(machine.ID, result); err != nil {
+		return nil, err
+	}
+	machine.ConfigLint = result
+	if result.Errors > 0 {
+		return nil, s.failLint(ctx, machine, config, target, opts, requestedBy, result)
+	}
+
+	requirements, err := s.db.BuildRequirements(machine)
+	if err != nil {
+		return nil, err
+	}
+
+	gated, err := s.needsApproval(machine, config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dry runs produce no image to boot test
+	dryRun := machine.Virtual && machine.DryRunBuilds
+	requireTest := s.config.RequireImageTest && !dryRun
+
+	build, err := s.db.CreateBuild(machine.ID, config, models.ConfigHash(machine.NixOSConfig), target, requireTest, dryRun, opts.Priority, requirements, requestedBy, gated, result)
+	if err != nil {
+		return nil, err
+	}
+	s.UseQuota(ctx, user, quota, 1)
+
+	if gated {
+		s.publish(ctx, events.Event{
+			Type:      events.MachineBuildAwaitingApproval,
+			MachineID: machine.ID,
+			Actor:     opts.Actor,
+			Data: events.BuildAwaitingApprovalData{
+				BuildID:     build.ID,
+				Priority:    build.Priority,
+				RequestedBy: requestedBy,
+			},
+		})
+		log.Printf("Build of machine %s awaits approval: build_id=%s", machine.ID, build.ID)
+		return build, nil
+	}
+
+	s.markBuilding(ctx, machine, build, opts.Actor)
+	log.Printf("Build requested for machine %s: build_id=%s", machine.ID, build.ID)
+
+	return build, nil
+}
+
+// failLint records a build whose configuration lint found errors in as
+// failed, and returns the LintError for it. The machine is left as it is.
+func (s *Service) failLint(ctx context.Context, machine *models.Machine, config, target string, opts BuildOptions, requestedBy string, result *models.LintResult) error {
+	build, err := s.db.CreateLintFailedBuild(machine.ID, config, target, opts.Priority, requestedBy, result)
+	if err != nil {
+		return err
+	}
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineBuildFailed,
+		MachineID: machine.ID,
+		Actor:     opts.Actor,
+		Data: events.BuildFailedData{
+			BuildID: build.ID,
+			Error:   build.Error,
+		},
+	})
+	log.Printf("Build of machine %s failed lint with %d error(s): build_id=%s", machine.ID, result.Errors, build.ID)
+
+	return &LintError{Build: build, Result: result}
+}
+
+// ConfigChanged reports whether the configuration a build of machine would
+// build differs from its latest successful build's, or it has none
+func (s *Service) ConfigChanged(ctx context.Context, machine *models.Machine) (bool, error) {
+	config, err := fragments.BuildConfig(ctx, s.db, s.builder, machine)
+	if err != nil {
+		return false, err
+	}
+
+	latest, err := s.db.GetLatestSuccessfulBuild(machine.ID)
+	if err != nil {
+		return false, err
+	}
+	return latest == nil || latest.Config != config, nil
+}
+
+// buildTarget returns the target of a build of machine: requested, or
+// the machine's build target, or netboot
+func buildTarget(machine *models.Machine, requested string) string {
+	switch {
+	case requested != "":
+		return requested
+	case machine.BuildTarget != "":
+		return machine.BuildTarget
+	default:
+		return models.BuildTargetNetboot
+	}
+}
+
+// markBuilding moves a machine to building for a build that was just
+// queued. A build of an installer or bundle leaves the machine as it is,
+// since it doesn't change what the machine boots.
+func (s *Service) markBuilding(ctx context.Context, machine *models.Machine, build *models.BuildRequest, actor string) {
+	oldStatus := machine.Status
+	if build.BootsMachine() {
+		now := time.Now()
+		machine.Status = models.StatusBuilding
+		machine.LastBuildID = &build.ID
+		machine.LastBuildTime = &now
+		if err := s.db.UpdateMachine(machine); err != nil {
+			log.Printf("Failed to update machine status: %v", err)
+		}
+	}
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineBuildStarted,
+		MachineID: machine.ID,
+		Actor:     actor,
+		Data: events.BuildStartedData{
+			BuildID:  build.ID,
+			Priority: build.Priority,
+			Target:   build.Target,
+		},
+	})
+	s.publishStatusChange(ctx, machine, oldStatus, actor)
+}
+
+// needsApproval reports whether a build of machine with config waits for
+// an admin's approval. Approval is required everywhere or by one of the
+// machine's groups. Builds queued by an admin, except in bulk, go ahead,
+// as do builds of a configuration applied unchanged from a template
+// tagged trusted, with no fragments added.
+func (s *Service) needsApproval(machine *models.Machine, config string, opts BuildOptions) (bool, error) {
+	if opts.Admin && !opts.Bulk {
+		return false, nil
+	}
+
+	required := s.config.RequireBuildApproval
+	if !required {
+		groups, err := s.db.GetMachineGroups(machine.ID)
+		if err != nil {
+			return false, err
+		}
+		for _, group := range groups {
+			if group.RequireBuildApproval {
+				required = true
+				break
+			}
+		}
+	}
+	if !required {
+		return false, nil
+	}
+
+	if machine.TemplateID != "" && config == machine.NixOSConfig {
+		template, err := s.db.GetTemplate(machine.TemplateID)
+		if err != nil {
+			return false, err
+		}
+		if template != nil && template.HasTag(models.TrustedTemplateTag) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// ApproveBuild queues a build awaiting approval and moves its machine to
+// building
+func (s *Service) ApproveBuild(ctx context.Context, id string) (*models.BuildRequest, error) {
+	build, machine, err := s.awaitingBuild(id)
+	if err != nil {
+		return nil, err
+	}
+	if !machine.CanProvision() {
+		return nil, &ConflictError{Message: fmt.Sprintf("machine is %s", machine.Status)}
+	}
+
+	build, err = s.reviewBuild(ctx, build, true, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s.markBuilding(ctx, machine, build, "")
+	log.Printf("Build %s of machine %s approved by %s", build.ID, machine.ID, build.ReviewedBy)
+
+	return build, nil
+}
+
+// RejectBuild rejects a build awaiting approval, recording reason as its
+// error. Its machine is left as it is.
+func (s *Service) RejectBuild(ctx context.Context, id, reason string) (*models.BuildRequest, error) {
+	build, machine, err := s.awaitingBuild(id)
+	if err != nil {
+		return nil, err
+	}
+
+	build, err = s.reviewBuild(ctx, build, false, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Build %s of machine %s rejected by %s", build.ID, machine.ID, build.ReviewedBy)
+
+	return build, nil
+}
+
+// awaitingBuild returns a build awaiting approval and its machine
+func (s *Service) awaitingBuild(id string) (*models.BuildRequest, *models.Machine, error) {
+	build, err := s.db.GetBuild(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if build == nil {
+		return nil, nil, ErrBuildNotFound
+	}
+	if build.Status != models.BuildStatusAwaitingApproval {
+		return nil, nil, &ConflictError{Message: "build is " + build.Status + ", not awaiting approval"}
+	}
+
+	machine, err := s.db.GetMachine(build.MachineID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if machine == nil {
+		return nil, nil, ErrMachineNotFound
+	}
+
+	return build, machine, nil
+}
+
+// reviewBuild approves or rejects a build awaiting approval and publishes
+// that it was, returning the build as reviewed
+func (s *Service) reviewBuild(ctx context.Context, build *models.BuildRequest, approve bool, reason string) (*models.BuildRequest, error) {
+	reviewer := actor(ctx, "")
+	ok, err := s.db.ReviewBuild(build.ID, approve, reviewer, reason)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &ConflictError{Message: "build is no longer awaiting approval"}
+	}
+
+	reviewed, err := s.db.GetBuild(build.ID)
+	if err != nil {
+		return nil, err
+	}
+	if reviewed == nil {
+		return nil, ErrBuildNotFound
+	}
+
+	eventType := events.MachineBuildApproved
+	if !approve {
+		eventType = events.MachineBuildRejected
+	}
+	s.publish(ctx, events.Event{
+		Type:      eventType,
+		MachineID: reviewed.MachineID,
+		Data: events.BuildReviewedData{
+			BuildID:     reviewed.ID,
+			RequestedBy: reviewed.RequestedBy,
+			ReviewedBy:  reviewer,
+			Reason:      reason,
+		},
+	})
+
+	return reviewed, nil
+}
+
+// CheckMaintenance enforces maintenance windows for op on the given
+// machines, returning a MaintenanceError naming the next window when the
+// operation is blocked. With override the operation goes ahead anyway, and
+// the override is recorded in each blocked machine's event log.
+func (s *Service) CheckMaintenance(ctx context.Context, machineIDs []string, op string, override bool) error {
+	decision, blocked, err := maintenance.CheckMachines(s.db, machineIDs, op)
+	if err != nil {
+		return fmt.Errorf("failed to check maintenance windows: %w", err)
+	}
+
+	if decision.Allowed {
+		return nil
+	}
+	if !override {
+		return &MaintenanceError{Message: decision.Message(op)}
+	}
+
+	for _, id := range blocked {
+		s.publish(ctx, events.Event{
+			Type:      events.MachineMaintenanceOverride,
+			MachineID: id,
+			Data:      events.MaintenanceOverrideData{Operation: op},
+		})
+	}
+	log.Printf("Maintenance window overridden for %s on %d machine(s)", op, len(blocked))
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/web"
+)
+
+// TestLastBuildTime documents that a machine's last build time is when its
+// last build was queued, whether by the service, the API, or the
+// dashboard, until the build finishes and it becomes when the build did
+func TestLastBuildTime(t *testing.T) {
+	env := testutil.New(t)
+	svc := env.API.Service()
+	dashboard := web.NewServer(env.DB, svc, "")
+
+	triggers := []struct {
+		name    string
+		trigger func(id string) string // returns the build's ID
+	}{
+		{"service", func(id string) string {
+			build, err := svc.TriggerBuild(context.Background(), id, service.BuildOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return build.ID
+		}},
+		{"API", func(id string) string {
+			var build models.BuildRequest
+			env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/machines/"+id+"/build", nil, http.StatusCreated, &build)
+			return build.ID
+		}},
+		{"dashboard", func(id string) string {
+			rec := httptest.NewRecorder()
+			dashboard.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/machines/"+id+"/build", nil))
+			if rec.Code >= 400 {
+				t.Fatalf("dashboard build: status %d: %s", rec.Code, rec.Body)
+			}
+			machine, err := env.DB.GetMachine(id)
+			if err != nil || machine.LastBuildID == nil {
+				t.Fatalf("dashboard build: machine %+v, %v", machine, err)
+			}
+			return *machine.LastBuildID
+		}},
+	}
+
+	for i, tt := range triggers {
+		t.Run(tt.name, func(t *testing.T) {
+			machine := env.EnrollMachine(fmt.Sprintf("LASTBUILD%02d", i+1))
+			env.ConfigureMachine(machine.ID, testutil.FixtureConfig)
+			if machine.LastBuildTime != nil {
+				t.Fatalf("new machine has last build time %s", machine.LastBuildTime)
+			}
+
+			queued := time.Now().Add(-time.Second)
+			buildID := tt.trigger(machine.ID)
+			machine, err := env.DB.GetMachine(machine.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if machine.LastBuildTime == nil || machine.LastBuildTime.Before(queued) {
+				t.Errorf("last build time = %v, want when the build was queued, after %s", machine.LastBuildTime, queued)
+			}
+			if machine.LastBuildID == nil || *machine.LastBuildID != buildID {
+				t.Errorf("last build = %v, want %s", machine.LastBuildID, buildID)
+			}
+
+			// Finishing the build sets it to when the build finished
+			if _, err := env.DB.Exec("UPDATE builds SET status = 'building', builder = 'builder-1' WHERE id = ?", buildID); err != nil {
+				t.Fatal(err)
+			}
+			completed := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+			result := models.BuildResult{Builder: "builder-1", Success: true, CompletedAt: completed}
+			if _, err := svc.CompleteBuild(context.Background(), buildID, result); err != nil {
+				t.Fatal(err)
+			}
+			if machine, err = env.DB.GetMachine(machine.ID); err != nil {
+				t.Fatal(err)
+			}
+			if machine.LastBuildTime == nil || !machine.LastBuildTime.Equal(completed) {
+				t.Errorf("last build time = %v, want the build's completion at %s", machine.LastBuildTime, completed)
+			}
+
+			// and the next build moves it on again
+			queued = time.Now().Add(-time.Second)
+			tt.trigger(machine.ID)
+			if machine, err = env.DB.GetMachine(machine.ID); err != nil {
+				t.Fatal(err)
+			}
+			if machine.LastBuildTime == nil || machine.LastBuildTime.Before(queued) {
+				t.Errorf("last build time = %v after a rebuild, want after %s", machine.LastBuildTime, queued)
+			}
+		})
+	}
+}
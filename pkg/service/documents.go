@@ -0,0 +1,577 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/drift"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Document fields, as named in apply reports
+const (
+	fieldHostname    = "hostname"
+	fieldDescription = "description"
+	fieldTags        = "tags"
+	fieldMetadata    = "metadata"
+	fieldNixOSConfig = "nixos_config"
+	fieldTemplate    = "template"
+	fieldFragments   = "fragments"
+	fieldGroups      = "groups"
+	fieldBMC         = "bmc"
+)
+
+// ApplyOptions control how machine documents are applied
+type ApplyOptions struct {
+	// DryRun reports what applying would change, and changes nothing
+	DryRun bool
+
+	// Force applies documents to machines changed since their revision
+	Force bool
+
+	// Admin allows removing machines from groups that require build
+	// approval
+	Admin bool
+}
+
+// ExportMachine returns a machine's document. Its configuration is given
+// as the template it was applied from, if it was and the template still
+// exists, and as its nixos_config otherwise.
+func (s *Service) ExportMachine(machine *models.Machine) (*models.MachineDocument, error) {
+	revision := machine.UpdatedAt
+	hostname, description := machine.Hostname, machine.Description
+	doc := &models.MachineDocument{
+		ServiceTag:  machine.ServiceTag,
+		Revision:    &revision,
+		Hostname:    &hostname,
+		Description: &description,
+		Tags:        machine.Tags,
+		Metadata:    machine.Metadata,
+		BMC:         models.DocumentBMCFrom(machine.BMCInfo),
+	}
+
+	if machine.TemplateID != "" {
+		template, err := s.db.GetTemplate(machine.TemplateID)
+		if err != nil {
+			return nil, err
+		}
+		if template != nil {
+			doc.Template = &models.DocumentTemplate{Name: template.Name, Variables: machine.TemplateVariables}
+		}
+	}
+	if doc.Template == nil {
+		config := machine.NixOSConfig
+		doc.NixOSConfig = &config
+	}
+
+	fragments, err := s.db.GetMachineFragments(machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	doc.Fragments = fragmentNames(fragments)
+
+	groups, err := s.db.GetMachineGroups(machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	doc.Groups = groupNames(groups)
+
+	return doc, nil
+}
+
+// ApplyMachineDocuments reconciles machines with documents, keyed by
+// service tag, and reports what was done with each document, in order.
+// Machines that don't exist are created preregistered. A document whose
+// machine changed after its revision is a conflict and not applied,
+// unless forced. Each document is applied on its own, so one that fails
+// doesn't stop the rest.
+func (s *Service) ApplyMachineDocuments(ctx context.Context, docs []models.MachineDocument, opts ApplyOptions) *models.MachineApplyReport {
+	report := &models.MachineApplyReport{DryRun: opts.DryRun, Force: opts.Force, Items: []models.MachineApplyItem{}}
+
+	seen := make(map[string]int, len(docs))
+	for i := range docs {
+		doc := &docs[i]
+		doc.ServiceTag = strings.TrimSpace(doc.ServiceTag)
+		if first, ok := seen[doc.ServiceTag]; ok && doc.ServiceTag != "" {
+			report.Add(models.MachineApplyItem{
+				ServiceTag: doc.ServiceTag,
+				Action:     models.MachineApplyFailed,
+				Message:    fmt.Sprintf("service tag is also in document %d", first+1),
+			})
+			continue
+		}
+		seen[doc.ServiceTag] = i
+		report.Add(s.applyDocument(ctx, doc, opts))
+	}
+
+	return report
+}
+
+// desiredMachine is a validated document, with the templates, fragments,
+// and groups it names looked up. Nil fields aren't managed by it.
+type desiredMachine struct {
+	doc *models.MachineDocument
+
+	tags      []string
+	metadata  map[string]interface{}
+	template  *models.MachineTemplate
+	fragments []*models.ConfigFragment
+	groups    []*models.MachineGroup
+}
+
+// applyDocument applies one document and returns what it did
+func (s *Service) applyDocument(ctx context.Context, doc *models.MachineDocument, opts ApplyOptions) models.MachineApplyItem {
+	item := models.MachineApplyItem{ServiceTag: doc.ServiceTag}
+	fail := func(format string, args ...interface{}) models.MachineApplyItem {
+		item.Action = models.MachineApplyFailed
+		item.Message = fmt.Sprintf(format, args...)
+		return item
+	}
+
+	if doc.ServiceTag == "" {
+		return fail("service_tag is required")
+	}
+
+	want, err := s.resolveDocument(doc)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	machine, err := s.db.GetMachineByServiceTag(doc.ServiceTag)
+	if err != nil {
+		return fail("failed to look up machine: %v", err)
+	}
+
+	creating := machine == nil
+	if creating {
+		trashed, err := s.db.GetTrashedMachineByServiceTag(doc.ServiceTag)
+		if err != nil {
+			return fail("failed to look up machine: %v", err)
+		}
+		if trashed != nil {
+			item.MachineID = trashed.ID
+			return fail("machine is in the trash; restore it or delete it permanently first")
+		}
+		machine = &models.Machine{ServiceTag: doc.ServiceTag, Status: models.StatusPreregistered}
+	} else {
+		item.MachineID = machine.ID
+		item.Revision = &machine.UpdatedAt
+	}
+
+	changes, removedGroups, err := s.documentChanges(machine, creating, want)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if !opts.Admin {
+		var approval []string
+		for _, group := range removedGroups {
+			if group.RequireBuildApproval {
+				approval = append(approval, group.Name)
+			}
+		}
+		if len(approval) > 0 {
+			return fail("only admins can remove machines from groups that require build approval (%s)", strings.Join(approval, ", "))
+		}
+	}
+
+	item.Changes = changes
+	switch {
+	case creating:
+		item.Action = models.MachineApplyCreated
+	case len(changes) == 0:
+		item.Action = models.MachineApplyUnchanged
+		return item
+	case doc.Revision != nil && machine.UpdatedAt.After(*doc.Revision) && !opts.Force:
+		// A document that matches the machine is unchanged whatever its
+		// revision; one that doesn't would undo the changes made since
+		item.Action = models.MachineApplyConflict
+		item.Message = fmt.Sprintf("machine was changed at %s, after the document's revision; export it again, or apply with force to overwrite",
+			machine.UpdatedAt.Format(time.RFC3339))
+		return item
+	default:
+		item.Action = models.MachineApplyUpdated
+	}
+	if opts.DryRun {
+		return item
+	}
+
+	if creating {
+		hostname := ""
+		if doc.Hostname != nil {
+			hostname = *doc.Hostname
+		}
+		machine, err = s.db.CreatePreregisteredMachine(doc.ServiceTag, hostname, models.DCIMFields{})
+		if err != nil {
+			return fail("failed to create machine: %v", err)
+		}
+		item.MachineID = machine.ID
+	}
+
+	machine, err = s.applyChanges(ctx, machine, want, changes, removedGroups)
+	if err != nil {
+		return fail("failed to apply changes, some of which may have been made: %v", err)
+	}
+	item.Revision = &machine.UpdatedAt
+	return item
+}
+
+// resolveDocument validates a document and looks up what it names
+func (s *Service) resolveDocument(doc *models.MachineDocument) (*desiredMachine, error) {
+	want := &desiredMachine{doc: doc}
+
+	if doc.Tags != nil {
+		tags, err := models.NormalizeTags(doc.Tags)
+		if err != nil {
+			return nil, invalid("%s", err.Error())
+		}
+		want.tags = tags
+	}
+
+	if doc.Metadata != nil {
+		// Documents decode numbers as integers; stored metadata, as JSON,
+		// has them as floats
+		data, err := json.Marshal(doc.Metadata)
+		if err != nil {
+			return nil, invalid("metadata can't be encoded as JSON: %v", err)
+		}
+		var metadata map[string]interface{}
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return nil, err
+		}
+		if err := models.ValidateMetadata(metadata); err != nil {
+			return nil, invalid("%s", err.Error())
+		}
+		want.metadata = metadata
+	}
+
+	if doc.NixOSConfig != nil && doc.Template != nil {
+		return nil, invalid("nixos_config and template can't both be given; the template sets the configuration")
+	}
+	if doc.Template != nil {
+		template, err := s.db.GetTemplateByName(doc.Template.Name)
+		if err == nil && template == nil {
+			template, err = s.db.GetTemplate(doc.Template.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if template == nil {
+			return nil, invalid("template %q not found", doc.Template.Name)
+		}
+		if err := checkTemplateVariables(templateVariables(template), doc.Template.Variables); err != nil {
+			return nil, err
+		}
+		want.template = template
+	}
+
+	if doc.Fragments != nil {
+		want.fragments = []*models.ConfigFragment{}
+		seen := make(map[string]bool, len(doc.Fragments))
+		for _, entry := range doc.Fragments {
+			fragment, err := s.db.GetFragmentByName(entry)
+			if err == nil && fragment == nil {
+				fragment, err = s.db.GetFragment(entry)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if fragment == nil {
+				return nil, invalid("fragment %q not found", entry)
+			}
+			if seen[fragment.ID] {
+				return nil, invalid("fragment %q is listed twice", fragment.Name)
+			}
+			seen[fragment.ID] = true
+			want.fragments = append(want.fragments, fragment)
+		}
+	}
+
+	if doc.Groups != nil {
+		want.groups = []*models.MachineGroup{}
+		seen := make(map[string]bool, len(doc.Groups))
+		for _, entry := range doc.Groups {
+			group, err := s.db.GetGroupByName(entry)
+			if err == nil && group == nil {
+				group, err = s.db.GetGroup(entry)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if group == nil {
+				return nil, invalid("group %q not found", entry)
+			}
+			if !seen[group.ID] {
+				seen[group.ID] = true
+				want.groups = append(want.groups, group)
+			}
+		}
+	}
+
+	if doc.BMC != nil {
+		bmc := bmcFromDocument(doc.BMC, nil)
+		if err := bmc.ValidateIPMIOptions(); err != nil {
+			return nil, invalid("bmc: %s", err.Error())
+		}
+		if err := bmc.NormalizeAddress(); err != nil {
+			return nil, invalid("bmc: %s", err.Error())
+		}
+		// Compared with the machine's address as stored
+		doc.BMC.IPAddress = bmc.IPAddress
+	}
+
+	return want, nil
+}
+
+// documentChanges compares a machine with what a document wants, returning
+// the fields that differ and the groups the machine would leave
+func (s *Service) documentChanges(machine *models.Machine, creating bool, want *desiredMachine) ([]models.FieldChange, []*models.MachineGroup, error) {
+	doc := want.doc
+	var changes []models.FieldChange
+	change := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, models.FieldChange{Field: field, From: from, To: to})
+		}
+	}
+
+	if doc.Hostname != nil {
+		change(fieldHostname, machine.Hostname, *doc.Hostname)
+	}
+	if doc.Description != nil {
+		change(fieldDescription, machine.Description, *doc.Description)
+	}
+	if want.tags != nil {
+		change(fieldTags, strings.Join(machine.Tags, ", "), strings.Join(want.tags, ", "))
+	}
+	if want.metadata != nil {
+		change(fieldMetadata, metadataText(machine.Metadata), metadataText(want.metadata))
+	}
+
+	if doc.NixOSConfig != nil && *doc.NixOSConfig != machine.NixOSConfig {
+		changes = append(changes, models.FieldChange{
+			Field: fieldNixOSConfig,
+			Diff:  drift.UnifiedDiff("machine", "document", machine.NixOSConfig, *doc.NixOSConfig),
+		})
+	}
+	if want.template != nil {
+		from := ""
+		if machine.TemplateID != "" {
+			current, err := s.db.GetTemplate(machine.TemplateID)
+			if err != nil {
+				return nil, nil, err
+			}
+			name := machine.TemplateID
+			if current != nil {
+				name = current.Name
+			}
+			from = templateText(name, machine.TemplateVariables)
+		}
+		change(fieldTemplate, from, templateText(want.template.Name, doc.Template.Variables))
+	}
+
+	if want.fragments != nil {
+		var current []*models.ConfigFragment
+		if !creating {
+			var err error
+			if current, err = s.db.GetMachineFragments(machine.ID); err != nil {
+				return nil, nil, err
+			}
+		}
+		change(fieldFragments, strings.Join(fragmentNames(current), ", "), strings.Join(fragmentNames(want.fragments), ", "))
+	}
+
+	var removed []*models.MachineGroup
+	if want.groups != nil {
+		var current []*models.MachineGroup
+		if !creating {
+			var err error
+			if current, err = s.db.GetMachineGroups(machine.ID); err != nil {
+				return nil, nil, err
+			}
+		}
+		wanted := make(map[string]bool, len(want.groups))
+		for _, group := range want.groups {
+			wanted[group.ID] = true
+		}
+		for _, group := range current {
+			if !wanted[group.ID] {
+				removed = append(removed, group)
+			}
+		}
+		change(fieldGroups, strings.Join(groupNames(current), ", "), strings.Join(groupNames(want.groups), ", "))
+	}
+
+	if doc.BMC != nil {
+		change(fieldBMC, bmcText(models.DocumentBMCFrom(machine.BMCInfo)), bmcText(doc.BMC))
+	}
+
+	return changes, removed, nil
+}
+
+// applyChanges makes the changes documentChanges found. Groups and
+// fragments come first, since they name the machine, and the template
+// last, since it fills in the machine's metadata and hostname.
+func (s *Service) applyChanges(ctx context.Context, machine *models.Machine, want *desiredMachine, changes []models.FieldChange, removedGroups []*models.MachineGroup) (*models.Machine, error) {
+	changed := make(map[string]bool, len(changes))
+	for _, c := range changes {
+		changed[c.Field] = true
+	}
+	doc := want.doc
+
+	if changed[fieldGroups] {
+		for _, group := range removedGroups {
+			if err := s.db.RemoveMachineFromGroup(group.ID, machine.ID); err != nil {
+				return nil, err
+			}
+		}
+		// Adding a machine to a group it is in changes nothing
+		for _, group := range want.groups {
+			if err := s.db.AddMachineToGroup(group.ID, machine.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if changed[fieldFragments] {
+		if err := s.db.SetMachineFragments(machine.ID, fragmentIDs(want.fragments)); err != nil {
+			return nil, err
+		}
+	}
+	if changed[fieldMetadata] {
+		if _, err := s.db.UpdateMachineMetadata(machine.ID, func(map[string]interface{}) (map[string]interface{}, error) {
+			return want.metadata, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read again for the metadata
+	machine, err := s.db.GetMachine(machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	if machine == nil {
+		return nil, ErrMachineNotFound
+	}
+	oldStatus := machine.Status
+
+	if changed[fieldHostname] {
+		machine.Hostname = *doc.Hostname
+	}
+	if changed[fieldDescription] {
+		machine.Description = *doc.Description
+	}
+	if changed[fieldTags] {
+		machine.Tags = want.tags
+	}
+	if changed[fieldBMC] {
+		machine.BMCInfo = bmcFromDocument(doc.BMC, machine.BMCInfo)
+	}
+	if changed[fieldNixOSConfig] {
+		machine.NixOSConfig = *doc.NixOSConfig
+		machine.TemplateID = ""
+		machine.TemplateVariables = nil
+	}
+
+	// A configuration, or fragments to assemble one from, configures the
+	// machine, as setting them through the API does
+	configChanged := changed[fieldNixOSConfig] || changed[fieldFragments]
+	if configChanged && !changed[fieldTemplate] {
+		if machine.CanProvision() && (machine.NixOSConfig != "" || len(want.fragments) > 0) {
+			machine.Status = models.StatusConfigured
+		}
+		if err := s.AssignHostname(machine); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		return nil, err
+	}
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+
+	if changed[fieldTemplate] {
+		return s.ApplyTemplate(ctx, machine.ID, want.template.ID, doc.Template.Variables)
+	}
+	if configChanged {
+		s.LintSaved(machine)
+	}
+	return machine, nil
+}
+
+// bmcFromDocument returns the BMC settings of a document, keeping the
+// password, MAC address, and channel of current, the machine's
+func bmcFromDocument(doc *models.DocumentBMC, current *models.BMCInfo) *models.BMCInfo {
+	bmc := &models.BMCInfo{
+		IPAddress:      doc.IPAddress,
+		Username:       doc.Username,
+		Type:           doc.Type,
+		Port:           doc.Port,
+		Enabled:        doc.Enabled,
+		Interface:      doc.Interface,
+		CipherSuite:    doc.CipherSuite,
+		PrivilegeLevel: doc.PrivilegeLevel,
+		Retries:        doc.Retries,
+	}
+	if current != nil {
+		bmc.Password = current.Password
+		bmc.MACAddress = current.MACAddress
+		bmc.Channel = current.Channel
+	}
+	return bmc
+}
+
+func fragmentNames(fragments []*models.ConfigFragment) []string {
+	names := make([]string, len(fragments))
+	for i, fragment := range fragments {
+		names[i] = fragment.Name
+	}
+	return names
+}
+
+func fragmentIDs(fragments []*models.ConfigFragment) []string {
+	ids := make([]string, len(fragments))
+	for i, fragment := range fragments {
+		ids[i] = fragment.ID
+	}
+	return ids
+}
+
+// groupNames returns the names of groups, sorted, since membership has no
+// order
+func groupNames(groups []*models.MachineGroup) []string {
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = group.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// metadataText returns metadata as JSON, whose object keys are sorted, so
+// equal metadata has equal text
+func metadataText(metadata map[string]interface{}) string {
+	if len(metadata) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(metadata)
+	return string(data)
+}
+
+func templateText(name string, variables map[string]string) string {
+	if len(variables) == 0 {
+		return name
+	}
+	data, _ := json.Marshal(variables)
+	return name + " " + string(data)
+}
+
+func bmcText(bmc *models.DocumentBMC) string {
+	if bmc == nil {
+		return ""
+	}
+	data, _ := json.Marshal(bmc)
+	return string(data)
+}
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// What an enrollment did with the machine
+const (
+	// EnrollmentNew is a machine's first enrollment, including that of a
+	// machine imported from a DCIM
+	EnrollmentNew = "new"
+
+	// EnrollmentReturning is an enrollment of a machine that already had
+	// one
+	EnrollmentReturning = "returning"
+
+	// EnrollmentHeld is an enrollment held until an operator resolves its
+	// conflict with another machine
+	EnrollmentHeld = "conflict"
+)
+
+// Enrollment is the result of an enrollment
+type Enrollment struct {
+	Machine *models.Machine
+	Outcome string
+}
+
+// EnrollMachine enrolls a machine, or records that a returning machine was
+// seen. source is the address the machine enrolled from, if known.
+//
+// A new machine whose MAC address or serial number belongs to another
+// machine is held, as is any machine already held; neither is an error.
+// Decommissioned machines, and machines in the trash unless the service
+// restores them, are rejected with a ConflictError or TrashedError.
+func (s *Service) EnrollMachine(ctx context.Context, req models.EnrollmentRequest, source string) (*Enrollment, error) {
+	if req.ServiceTag == "" || req.MACAddress == "" {
+		return nil, invalid("service_tag and mac_address are required")
+	}
+
+	if req.BootMode != "" && !models.IsValidBootMode(req.BootMode) {
+		return nil, invalid("boot_mode must be bios, uefi, or uefi-http")
+	}
+
+	mac, err := models.NormalizeMAC(req.MACAddress)
+	if err != nil {
+		return nil, invalid("%s", err.Error())
+	}
+	req.MACAddress = mac
+
+	existing, err := s.db.GetMachineByServiceTag(req.ServiceTag)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing == nil {
+		trashed, err := s.db.GetTrashedMachineByServiceTag(req.ServiceTag)
+		if err != nil {
+			return nil, err
+		}
+		if trashed != nil && !s.config.RestoreTrashed {
+			log.Printf("Enrollment attempt from machine %s in the trash (service_tag: %s)", trashed.ID, trashed.ServiceTag)
+			return nil, &TrashedError{Machine: trashed}
+		}
+		if trashed != nil {
+			if err := s.RestoreMachine(ctx, trashed, "re-enrolled"); err != nil {
+				return nil, fmt.Errorf("failed to restore machine: %w", err)
+			}
+			existing = trashed
+		}
+	}
+
+	if existing != nil && existing.Status == models.StatusDecommissioned {
+		// Decommissioned machines are not brought back silently; an
+		// operator has to approve the re-enrollment first
+		log.Printf("Re-enrollment attempt from decommissioned machine %s (service_tag: %s)", existing.ID, existing.ServiceTag)
+		s.publish(ctx, events.Event{
+			Type:      events.MachineReenrollmentRequested,
+			MachineID: existing.ID,
+			Data: events.ReenrollmentData{
+				ServiceTag: req.ServiceTag,
+				MACAddress: req.MACAddress,
+			},
+		})
+		return nil, &ConflictError{Message: "machine is decommissioned; re-enrollment requires operator approval"}
+	}
+
+	if existing != nil && existing.Status == models.StatusConflict {
+		// Held enrollments stay held however often the machine retries
+		s.RecordAddress(ctx, existing, source)
+		return &Enrollment{Machine: existing, Outcome: EnrollmentHeld}, nil
+	}
+
+	if existing != nil && existing.Status == models.StatusPreregistered {
+		// A machine imported from the DCIM enrolling for the first time
+		completed, err := s.db.CompletePreregistration(existing, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enroll machine: %w", err)
+		}
+		if completed {
+			return s.enrolled(ctx, existing, source), nil
+		}
+	}
+
+	if existing != nil {
+		// Update last_seen_at, and the boot mode in case firmware
+		// settings changed since the machine first enrolled
+		now := time.Now()
+		existing.LastSeenAt = &now
+		if req.BootMode != "" {
+			existing.BootMode = req.BootMode
+		}
+		discovered := false
+		if req.BMC != nil {
+			existing.BMCInfo, discovered = req.BMC.MergeInto(existing.BMCInfo)
+		}
+		// A machine sent to the registration image for a hardware refresh
+		// reports its inventory again; what it fails to report is kept
+		refreshed := existing.HardwareRefreshRequestedAt != nil
+		if refreshed {
+			hardware := req.Hardware
+			hardware.MergeMissing(existing.Hardware)
+			existing.Hardware = hardware
+			existing.HardwareCompleteness = hardware.Completeness()
+		}
+		if err := s.db.UpdateMachine(existing); err != nil {
+			log.Printf("Failed to update last_seen_at: %v", err)
+		} else {
+			if discovered {
+				s.publishBMCDiscovered(ctx, existing)
+			}
+			if refreshed {
+				s.hardwareRefreshed(ctx, existing)
+			}
+		}
+		s.RecordAddress(ctx, existing, source)
+		return &Enrollment{Machine: existing, Outcome: EnrollmentReturning}, nil
+	}
+
+	// A new service tag with a MAC address or serial number that belongs
+	// to another machine is held until an operator resolves the conflict
+	owner, field, err := s.db.FindIdentityOwner(req.MACAddress, models.NormalizeSerialNumber(req.Hardware.SerialNumber))
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil {
+		machine, err := s.holdEnrollment(ctx, req, owner, field, source)
+		if err != nil {
+			return nil, err
+		}
+		return &Enrollment{Machine: machine, Outcome: EnrollmentHeld}, nil
+	}
+
+	machine, err := s.db.CreateMachine(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create machine: %w", err)
+	}
+
+	return s.enrolled(ctx, machine, source), nil
+}
+
+// enrolled announces a machine's first enrollment
+func (s *Service) enrolled(ctx context.Context, machine *models.Machine, source string) *Enrollment {
+	log.Printf("Enrolled new machine: %s (service_tag: %s)", machine.ID, machine.ServiceTag)
+	s.RecordAddress(ctx, machine, source)
+
+	placement, err := s.matchEnrollmentRules(machine.ServiceTag, machine.MACAddress, &machine.Hardware)
+	if err != nil {
+		log.Printf("Failed to evaluate enrollment rules for machine %s: %v", machine.ID, err)
+		placement = &enrollmentPlacement{}
+	}
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineEnrolled,
+		MachineID: machine.ID,
+		Data: events.EnrolledData{
+			ServiceTag:   machine.ServiceTag,
+			MACAddress:   machine.MACAddress,
+			Status:       machine.Status,
+			Manufacturer: machine.Hardware.Manufacturer,
+			Model:        machine.Hardware.Model,
+			CurrentIP:    machine.CurrentIP,
+			Virtual:      machine.Virtual,
+			MatchedRules: placement.ruleNames(),
+		},
+	})
+	if machine.BMCInfo != nil {
+		s.publishBMCDiscovered(ctx, machine)
+	}
+	s.placeEnrolledMachine(ctx, machine, placement)
+
+	// After placement, which may have added the machine to a group with a
+	// hardware profile
+	if _, err := s.CheckHardwareCompliance(ctx, machine); err != nil {
+		log.Printf("Failed to check hardware compliance of machine %s: %v", machine.ID, err)
+	}
+
+	return &Enrollment{Machine: machine, Outcome: EnrollmentNew}
+}
+
+// holdEnrollment creates a machine whose MAC address or serial number,
+// named by field, belongs to owner, and holds it in the conflict status.
+// Held machines are not booted or built, so a machine whose motherboard was
+// swapped can't pick up another machine's image.
+func (s *Service) holdEnrollment(ctx context.Context, req models.EnrollmentRequest, owner *models.Machine, field, source string) (*models.Machine, error) {
+	value := req.MACAddress
+	if field == models.IdentitySerialNumber {
+		value = models.NormalizeSerialNumber(req.Hardware.SerialNumber)
+	}
+
+	machine, err := s.db.HoldMachine(req, &models.MachineConflict{
+		ExistingMachineID: owner.ID,
+		Field:             field,
+		Value:             value,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create machine: %w", err)
+	}
+
+	log.Printf("Held enrollment of %s (service_tag: %s): %s %s belongs to machine %s (service_tag: %s)",
+		machine.ID, machine.ServiceTag, field, value, owner.ID, owner.ServiceTag)
+	s.RecordAddress(ctx, machine, source)
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineEnrollmentConflict,
+		MachineID: machine.ID,
+		Data: events.EnrollmentConflictData{
+			ServiceTag:         machine.ServiceTag,
+			MACAddress:         machine.MACAddress,
+			SerialNumber:       machine.Hardware.SerialNumber,
+			Field:              field,
+			Value:              value,
+			ExistingMachineID:  owner.ID,
+			ExistingServiceTag: owner.ServiceTag,
+		},
+	})
+
+	return machine, nil
+}
+
+// RestoreMachine takes a machine out of the trash and publishes
+// machine.restored. reason is set when the machine wasn't restored by an
+// operator.
+func (s *Service) RestoreMachine(ctx context.Context, machine *models.Machine, reason string) error {
+	restored, err := s.db.RestoreMachine(machine.ID)
+	if err != nil {
+		return err
+	}
+	if !restored {
+		return fmt.Errorf("machine %s is not in the trash", machine.ID)
+	}
+
+	deletedAt := machine.DeletedAt
+	machine.DeletedAt = nil
+
+	log.Printf("Restored machine %s (service_tag: %s) from the trash", machine.ID, machine.ServiceTag)
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineRestored,
+		MachineID: machine.ID,
+		Data: events.RestoredData{
+			ServiceTag: machine.ServiceTag,
+			DeletedAt:  deletedAt,
+			Reason:     reason,
+		},
+	})
+
+	return nil
+}
+
+// RecordAddress records that a machine was just seen at ip, such as when
+// it enrolled or submitted metrics, as its current address, and announces
+// when that changes. Addresses are stored normalized, so an IPv4 client
+// seen through an IPv6 socket keeps its IPv4 address. Addresses that don't
+// parse are ignored.
+func (s *Service) RecordAddress(ctx context.Context, machine *models.Machine, ip string) {
+	ip, err := models.NormalizeIP(ip)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	if err := s.db.RecordMachineAddress(machine.ID, ip, now); err != nil {
+		log.Printf("Failed to record address of machine %s: %v", machine.ID, err)
+		return
+	}
+
+	previous := machine.CurrentIP
+	machine.CurrentIP = ip
+	machine.CurrentIPUpdatedAt = &now
+	machine.LastSeenAt = &now
+
+	if previous != "" && previous != ip {
+		s.publish(ctx, events.Event{
+			Type:      events.MachineIPChanged,
+			MachineID: machine.ID,
+			Data: events.IPChangedData{
+				CurrentIP:  ip,
+				PreviousIP: previous,
+				MACAddress: machine.MACAddress,
+			},
+		})
+	}
+}
+
+// publishBMCDiscovered publishes the BMC details that enrollment filled in
+func (s *Service) publishBMCDiscovered(ctx context.Context, machine *models.Machine) {
+	s.publish(ctx, events.Event{
+		Type:      events.MachineBMCDiscovered,
+		MachineID: machine.ID,
+		Data: events.BMCDiscoveredData{
+			IPAddress:  machine.BMCInfo.IPAddress,
+			MACAddress: machine.BMCInfo.MACAddress,
+			Channel:    machine.BMCInfo.Channel,
+		},
+	})
+}
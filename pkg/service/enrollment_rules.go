@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// enrollmentPlacement is what the rules that matched a machine do with it
+type enrollmentPlacement struct {
+	rules           []*models.EnrollmentRule
+	groupIDs        []string
+	templateID      string
+	hostnamePattern string
+
+	// hostnameGroupID is the first group of the rule with the hostname
+	// pattern, for {group}
+	hostnameGroupID string
+}
+
+// ruleNames returns the names of the rules that matched
+func (p *enrollmentPlacement) ruleNames() []string {
+	var names []string
+	for _, rule := range p.rules {
+		names = append(names, rule.Name)
+	}
+	return names
+}
+
+// matchEnrollmentRules evaluates the enabled enrollment rules against a
+// machine in priority order, stopping at the first match unless it goes on
+func (s *Service) matchEnrollmentRules(serviceTag, macAddress string, hardware *models.HardwareInfo) (*enrollmentPlacement, error) {
+	rules, err := s.db.ListEnrollmentRules()
+	if err != nil {
+		return nil, err
+	}
+
+	placement := &enrollmentPlacement{groupIDs: []string{}}
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if !rule.Enabled || !rule.Match.Matches(serviceTag, macAddress, hardware) {
+			continue
+		}
+
+		placement.rules = append(placement.rules, rule)
+		for _, groupID := range rule.GroupIDs {
+			if !seen[groupID] {
+				seen[groupID] = true
+				placement.groupIDs = append(placement.groupIDs, groupID)
+			}
+		}
+		if placement.templateID == "" {
+			placement.templateID = rule.TemplateID
+		}
+		if placement.hostnamePattern == "" && rule.HostnamePattern != "" {
+			placement.hostnamePattern = rule.HostnamePattern
+			if len(rule.GroupIDs) > 0 {
+				placement.hostnameGroupID = rule.GroupIDs[0]
+			}
+		}
+
+		if !rule.Continue {
+			break
+		}
+	}
+
+	return placement, nil
+}
+
+// placeEnrolledMachine names a newly enrolled machine, adds it to groups,
+// and applies a template, as the rules that matched it say. Each step that
+// fails is logged and skipped, since the machine is enrolled either way.
+func (s *Service) placeEnrolledMachine(ctx context.Context, machine *models.Machine, placement *enrollmentPlacement) {
+	// The hostname goes first so that the template can use it
+	if placement.hostnamePattern != "" && machine.Hostname == "" {
+		vars, err := s.placementHostnameVars(placement, machine.ServiceTag, &machine.Hardware)
+		var hostname string
+		if err == nil {
+			hostname, err = s.hostnameFromPattern(placement.hostnamePattern, vars, machine.ID)
+		}
+		if err != nil {
+			log.Printf("Failed to name machine %s: %v", machine.ID, err)
+		} else {
+			machine.Hostname = hostname
+			if err := s.db.UpdateMachine(machine); err != nil {
+				log.Printf("Failed to set hostname of machine %s: %v", machine.ID, err)
+				machine.Hostname = ""
+			}
+		}
+	}
+
+	for _, groupID := range placement.groupIDs {
+		if err := s.db.AddMachineToGroup(groupID, machine.ID); err != nil {
+			log.Printf("Failed to add machine %s to group %s: %v", machine.ID, groupID, err)
+		}
+	}
+
+	if placement.templateID != "" && machine.NixOSConfig == "" && machine.TemplateID == "" {
+		applied, err := s.ApplyTemplate(ctx, machine.ID, placement.templateID, nil)
+		if err != nil {
+			log.Printf("Failed to apply template %s to machine %s: %v", placement.templateID, machine.ID, err)
+		} else {
+			*machine = *applied
+		}
+	}
+}
+
+// TestEnrollmentRules reports what the enrollment rules would do with a
+// machine enrolling with req, without changing anything. The hostname is
+// the one the machine would get if it enrolled now.
+func (s *Service) TestEnrollmentRules(req models.EnrollmentRequest) (*models.EnrollmentRuleTest, error) {
+	if req.ServiceTag == "" || req.MACAddress == "" {
+		return nil, invalid("service_tag and mac_address are required")
+	}
+	mac, err := models.NormalizeMAC(req.MACAddress)
+	if err != nil {
+		return nil, invalid("%s", err.Error())
+	}
+
+	placement, err := s.matchEnrollmentRules(req.ServiceTag, mac, &req.Hardware)
+	if err != nil {
+		return nil, err
+	}
+
+	test := &models.EnrollmentRuleTest{
+		Matched:    placement.rules,
+		GroupIDs:   placement.groupIDs,
+		TemplateID: placement.templateID,
+	}
+	if test.Matched == nil {
+		test.Matched = []*models.EnrollmentRule{}
+	}
+	if placement.hostnamePattern != "" {
+		vars, err := s.placementHostnameVars(placement, req.ServiceTag, &req.Hardware)
+		if err != nil {
+			return nil, err
+		}
+		if models.UsesSequence(placement.hostnamePattern) {
+			current, err := s.db.PeekCounter(hostnameCounter(placement.hostnamePattern, vars.Group))
+			if err != nil {
+				return nil, err
+			}
+			vars.Seq = current + 1
+		}
+		test.Hostname = models.HostnameFromPattern(placement.hostnamePattern, vars)
+	}
+
+	return test, nil
+}
+
+// placementHostnameVars returns what the hostname pattern of a placement
+// is filled in with for a machine
+func (s *Service) placementHostnameVars(placement *enrollmentPlacement, serviceTag string, hardware *models.HardwareInfo) (models.HostnameVars, error) {
+	vars := models.HostnameVars{ServiceTag: serviceTag, Model: hardware.Model}
+	if placement.hostnameGroupID != "" && models.UsesGroup(placement.hostnamePattern) {
+		group, err := s.db.GetGroup(placement.hostnameGroupID)
+		if err != nil {
+			return vars, err
+		}
+		if group != nil {
+			vars.Group = group.Name
+		}
+	}
+	return vars, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+var (
+	// ErrMachineNotFound is returned for a machine that doesn't exist or
+	// is in the trash
+	ErrMachineNotFound = errors.New("machine not found")
+
+	// ErrTemplateNotFound is returned for a template that doesn't exist
+	ErrTemplateNotFound = errors.New("template not found")
+
+	// ErrBuildNotFound is returned for a build that doesn't exist
+	ErrBuildNotFound = errors.New("build not found")
+)
+
+// InvalidError is returned when a request fails validation
+type InvalidError struct {
+	Message string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Message
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &InvalidError{Message: fmt.Sprintf(format, args...)}
+}
+
+// ConflictError is returned when a machine's state doesn't allow an
+// operation, such as building a decommissioned machine
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// TrashedError is returned when a machine enrolls with the service tag of
+// a machine in the trash, and trashed machines aren't restored
+type TrashedError struct {
+	Machine *models.Machine
+}
+
+func (e *TrashedError) Error() string {
+	return fmt.Sprintf("machine %s with service tag %s is in the trash; restore it or delete it permanently first",
+		e.Machine.ID, e.Machine.ServiceTag)
+}
+
+// LintError is returned when linting a configuration that was about to be
+// built finds errors. Build is the failed build recorded for it.
+type LintError struct {
+	Build  *models.BuildRequest
+	Result *models.LintResult
+}
+
+func (e *LintError) Error() string {
+	return fmt.Sprintf("%s; see build %s", e.Result.Summary(), e.Build.ID)
+}
+
+// MaintenanceError is returned when maintenance windows block an operation
+// that wasn't allowed to override them
+type MaintenanceError struct {
+	Message string
+}
+
+func (e *MaintenanceError) Error() string {
+	return e.Message
+}
+
+// QuotaError is returned when a user has too little of a quota left for an
+// operation. ResetsAt is when the oldest use counted leaves the window,
+// freeing some up.
+type QuotaError struct {
+	Kind     string
+	Limit    int
+	Used     int
+	Units    int
+	ResetsAt *time.Time
+}
+
+// Remaining returns how many units of the quota are left
+func (e *QuotaError) Remaining() int {
+	if e.Used >= e.Limit {
+		return 0
+	}
+	return e.Limit - e.Used
+}
+
+func (e *QuotaError) Error() string {
+	msg := fmt.Sprintf("%s quota exceeded: %d of %d used in the last %d hours", e.Kind, e.Used, e.Limit, int(models.QuotaWindow.Hours()))
+	if e.Units > 1 {
+		msg += fmt.Sprintf(", and %d are needed", e.Units)
+	}
+	if e.ResetsAt != nil {
+		msg += "; more are available at " + e.ResetsAt.UTC().Format(time.RFC3339)
+	}
+	return msg
+}
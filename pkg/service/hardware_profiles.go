@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// hardwareProfileFor returns the hardware profile that applies to a
+// machine: the first, by name, assigned to one of its groups, or else the
+// one for its manufacturer and model. It returns nil if none does.
+func (s *Service) hardwareProfileFor(machine *models.Machine, profiles []*models.HardwareProfile) (*models.HardwareProfile, error) {
+	groups, err := s.db.GetMachineGroups(machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	inGroup := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		inGroup[group.ID] = true
+	}
+
+	for _, profile := range profiles {
+		for _, groupID := range profile.GroupIDs {
+			if inGroup[groupID] {
+				return profile, nil
+			}
+		}
+	}
+	for _, profile := range profiles {
+		if profile.AppliesToModel(&machine.Hardware) {
+			return profile, nil
+		}
+	}
+	return nil, nil
+}
+
+// CheckHardwareCompliance checks a machine's hardware against the profile
+// that applies to it and records the result, or clears it if no profile
+// applies. A failed check is announced with machine.hardware_noncompliant
+// unless the last check found the same deviations.
+func (s *Service) CheckHardwareCompliance(ctx context.Context, machine *models.Machine) (*models.HardwareCompliance, error) {
+	profiles, err := s.db.ListHardwareProfiles()
+	if err != nil {
+		return nil, err
+	}
+	return s.checkHardwareCompliance(ctx, machine, profiles)
+}
+
+func (s *Service) checkHardwareCompliance(ctx context.Context, machine *models.Machine, profiles []*models.HardwareProfile) (*models.HardwareCompliance, error) {
+	profile, err := s.hardwareProfileFor(machine, profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := machine.HardwareCompliance
+	if profile == nil {
+		if previous != nil {
+			if err := s.db.SetMachineHardwareCompliance(machine.ID, nil); err != nil {
+				return nil, err
+			}
+			machine.HardwareCompliance = nil
+		}
+		return nil, nil
+	}
+
+	result := profile.Check(&machine.Hardware, time.Now())
+	if err := s.db.SetMachineHardwareCompliance(machine.ID, result); err != nil {
+		return nil, err
+	}
+	machine.HardwareCompliance = result
+
+	if result.Status == models.ComplianceFailed && (previous == nil || previous.Status != result.Status ||
+		previous.ProfileID != result.ProfileID || !reflect.DeepEqual(previous.Deviations, result.Deviations)) {
+		log.Printf("Machine %s does not match hardware profile %s: %d deviations", machine.ID, profile.Name, len(result.Deviations))
+		s.publish(ctx, events.Event{
+			Type:      events.MachineHardwareNoncompliant,
+			MachineID: machine.ID,
+			Data: events.HardwareNoncompliantData{
+				ProfileID:   profile.ID,
+				ProfileName: profile.Name,
+				Deviations:  result.Deviations,
+			},
+		})
+	}
+
+	return result, nil
+}
+
+// RecheckHardwareCompliance checks every machine other than decommissioned
+// ones again, after the hardware profiles changed. Machines that fail are
+// logged and skipped.
+func (s *Service) RecheckHardwareCompliance(ctx context.Context) {
+	profiles, err := s.db.ListHardwareProfiles()
+	if err != nil {
+		log.Printf("Failed to list hardware profiles: %v", err)
+		return
+	}
+	machines, err := s.db.ListMachines()
+	if err != nil {
+		log.Printf("Failed to list machines to check hardware compliance: %v", err)
+		return
+	}
+
+	for _, machine := range machines {
+		if machine.Status == models.StatusDecommissioned {
+			continue
+		}
+		if _, err := s.checkHardwareCompliance(ctx, machine, profiles); err != nil {
+			log.Printf("Failed to check hardware compliance of machine %s: %v", machine.ID, err)
+		}
+	}
+}
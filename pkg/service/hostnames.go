@@ -0,0 +1,88 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// maxHostnameAttempts is how many numbers of a pattern's sequence are
+// tried before giving up on naming a machine, when the names they give are
+// already taken by machines named by hand
+const maxHostnameAttempts = 100
+
+// hostnameCounter is the counter that numbers the machines named by a
+// hostname pattern. Patterns with {group} are numbered per group.
+func hostnameCounter(pattern, group string) string {
+	return "hostname:" + strings.ReplaceAll(pattern, "{group}", group)
+}
+
+// hostnameFromPattern names machineID from a hostname pattern. A pattern
+// with {seq} takes the next number of its sequence, and the next one again
+// while the name is taken, so that machines named concurrently never get
+// the same name. A pattern without {seq} that names another machine's
+// hostname fails with a HostnameTakenError.
+func (s *Service) hostnameFromPattern(pattern string, vars models.HostnameVars, machineID string) (string, error) {
+	for attempt := 0; attempt < maxHostnameAttempts; attempt++ {
+		if models.UsesSequence(pattern) {
+			seq, err := s.db.NextCounter(hostnameCounter(pattern, vars.Group))
+			if err != nil {
+				return "", err
+			}
+			vars.Seq = seq
+		}
+
+		hostname := models.HostnameFromPattern(pattern, vars)
+		if hostname == "" {
+			return "", invalid("hostname pattern %s gives an empty hostname", pattern)
+		}
+
+		err := s.db.CheckHostname(machineID, hostname)
+		if err == nil {
+			return hostname, nil
+		}
+		var taken *database.HostnameTakenError
+		if !errors.As(err, &taken) || !models.UsesSequence(pattern) {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("hostname pattern %s found no free hostname in %d tries", pattern, maxHostnameAttempts)
+}
+
+// AssignHostname names a machine without a hostname from the hostname
+// pattern of its groups, the first by name that has one. It only sets the
+// machine's Hostname, which the caller saves; a machine with a hostname,
+// or in no group with a pattern, is left as it is.
+func (s *Service) AssignHostname(machine *models.Machine) error {
+	if machine.Hostname != "" {
+		return nil
+	}
+
+	groups, err := s.db.GetMachineGroups(machine.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if group.HostnamePattern == "" {
+			continue
+		}
+
+		hostname, err := s.hostnameFromPattern(group.HostnamePattern, models.HostnameVars{
+			ServiceTag: machine.ServiceTag,
+			Model:      machine.Hardware.Model,
+			Group:      group.Name,
+		}, machine.ID)
+		if err != nil {
+			return fmt.Errorf("failed to name machine from group %s: %w", group.Name, err)
+		}
+		machine.Hostname = hostname
+		return nil
+	}
+
+	return nil
+}
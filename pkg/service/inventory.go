@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// RequestHardwareRefresh has the iPXE server send a machine to the
+// registration image on its next boot, even if it has an image of its
+// own, so its hardware inventory is collected again. The machine's next
+// enrollment records the inventory and ends the refresh.
+func (s *Service) RequestHardwareRefresh(ctx context.Context, machine *models.Machine) error {
+	switch machine.Status {
+	case models.StatusDecommissioned, models.StatusWiping, models.StatusConflict, models.StatusPreregistered:
+		return &ConflictError{Message: fmt.Sprintf("machine is %s", machine.Status)}
+	}
+
+	now := time.Now()
+	if err := s.db.SetHardwareRefreshRequested(machine.ID, &now); err != nil {
+		return err
+	}
+	machine.HardwareRefreshRequestedAt = &now
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineHardwareRefreshRequested,
+		MachineID: machine.ID,
+		Data: events.HardwareRefreshRequestedData{
+			Missing: machine.Hardware.Completeness().Missing,
+		},
+	})
+	return nil
+}
+
+// CancelHardwareRefresh lets a machine boot its own image again without
+// its inventory having been collected
+func (s *Service) CancelHardwareRefresh(machine *models.Machine) error {
+	if machine.HardwareRefreshRequestedAt == nil {
+		return nil
+	}
+	if err := s.db.SetHardwareRefreshRequested(machine.ID, nil); err != nil {
+		return err
+	}
+	machine.HardwareRefreshRequestedAt = nil
+	return nil
+}
+
+// hardwareRefreshed ends a machine's hardware refresh once its enrollment
+// has recorded the inventory the registration image collected
+func (s *Service) hardwareRefreshed(ctx context.Context, machine *models.Machine) {
+	if err := s.CancelHardwareRefresh(machine); err != nil {
+		log.Printf("Failed to end hardware refresh of machine %s: %v", machine.ID, err)
+	}
+	log.Printf("Collected hardware inventory of machine %s (completeness: %d%%)", machine.ID, machine.HardwareCompleteness.Score)
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineInventoryRefreshed,
+		MachineID: machine.ID,
+		Data: events.InventoryRefreshedData{
+			Source:       "registration",
+			Manufacturer: machine.Hardware.Manufacturer,
+			Model:        machine.Hardware.Model,
+		},
+	})
+
+	if _, err := s.CheckHardwareCompliance(ctx, machine); err != nil {
+		log.Printf("Failed to check hardware compliance of machine %s: %v", machine.ID, err)
+	}
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"log"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/lint"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// LintMachine lints the configuration a build of machine would build and
+// records the result on the machine, or clears it if the machine has no
+// configuration
+func (s *Service) LintMachine(machine *models.Machine) (*models.LintResult, error) {
+	assembled, err := fragments.MachineConfig(s.db, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *models.LintResult
+	if assembled.Config != "" {
+		result = lint.Check(assembled.Config, machine, s.config.LintRules.Rules())
+	}
+	if err := s.db.SetMachineConfigLint(machine.ID, result); err != nil {
+		return nil, err
+	}
+	machine.ConfigLint = result
+	return result, nil
+}
+
+// LintSaved lints a machine's configuration after it was saved, whether
+// by the service or by a bulk update or a change to its fragments. A save
+// isn't undone because its configuration couldn't be linted; the next
+// build lints it again.
+func (s *Service) LintSaved(machine *models.Machine) {
+	if _, err := s.LintMachine(machine); err != nil {
+		log.Printf("Failed to lint configuration of machine %s: %v", machine.ID, err)
+	}
+}
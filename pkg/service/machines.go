@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// sshHostPattern matches hostnames and IPv4 and IPv6 addresses
+var sshHostPattern = regexp.MustCompile(`^[A-Za-z0-9.:-]+$`)
+
+// sshUserPattern matches login names, and sshKeyPattern file names in the
+// builder's SSH keys directory
+var (
+	sshUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+	sshKeyPattern  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// validSSHAddress reports whether addr is a host or host:port. Builders
+// write it into deploy scripts, so nothing else is accepted.
+func validSSHAddress(addr string) bool {
+	host := addr
+	if h, port, err := net.SplitHostPort(addr); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return false
+		}
+		host = h
+	}
+	return sshHostPattern.MatchString(host)
+}
+
+// ValidateSSHTarget checks the parts of an SSH target that are set,
+// returning an InvalidError saying what is wrong with them
+func ValidateSSHTarget(address, user, key string) error {
+	switch {
+	case address != "" && !validSSHAddress(address):
+		return invalid("ssh_address must be a host or host:port")
+	case user != "" && !sshUserPattern.MatchString(user):
+		return invalid("ssh_user is not a valid user name")
+	case key != "" && !sshKeyPattern.MatchString(key):
+		return invalid("ssh_key must be the name of a key file")
+	}
+	return nil
+}
+
+// UpdateMachine applies the fields set in patch to a machine. Setting a
+// NixOS configuration marks a machine that can be provisioned configured,
+// names it from its groups' hostname pattern if it has no hostname, and
+// lints the configuration;
+// tags, Wake-on-LAN settings, and the location are replaced when given,
+// and an empty list of tags or an empty location removes them. Leaving the
+// BMC password, MAC address, or channel out keeps the stored ones.
+func (s *Service) UpdateMachine(ctx context.Context, id string, patch *models.Machine) (*models.Machine, error) {
+	machine, err := s.db.GetMachine(id)
+	if err != nil {
+		return nil, err
+	}
+	if machine == nil {
+		return nil, ErrMachineNotFound
+	}
+
+	oldStatus := machine.Status
+
+	if patch.Hostname != "" {
+		machine.Hostname = patch.Hostname
+	}
+	if patch.Description != "" {
+		machine.Description = patch.Description
+	}
+	if patch.NixOSConfig != "" {
+		machine.NixOSConfig = patch.NixOSConfig
+		machine.TemplateID = ""
+		machine.TemplateVariables = nil
+		// A decommissioned machine stays decommissioned until its
+		// re-enrollment is approved, and a wipe has to finish first
+		if machine.CanProvision() {
+			machine.Status = models.StatusConfigured
+		}
+	}
+	if patch.Tags != nil {
+		tags, err := models.NormalizeTags(patch.Tags)
+		if err != nil {
+			return nil, invalid("%s", err.Error())
+		}
+		machine.Tags = tags
+	}
+	if patch.BootMode != "" {
+		if !models.IsValidBootMode(patch.BootMode) {
+			return nil, invalid("boot_mode must be bios, uefi, or uefi-http")
+		}
+		machine.BootMode = patch.BootMode
+	}
+	if patch.BuildTarget != "" {
+		if err := models.CheckBuildTarget(patch.BuildTarget, machine.Hardware.CPU.Architecture); err != nil {
+			return nil, invalid("build_target: %s", err.Error())
+		}
+		machine.BuildTarget = patch.BuildTarget
+	}
+	if err := ValidateSSHTarget(patch.SSHAddress, patch.SSHUser, patch.SSHKey); err != nil {
+		return nil, err
+	}
+	if patch.SSHAddress != "" {
+		machine.SSHAddress = patch.SSHAddress
+	}
+	if patch.SSHUser != "" {
+		machine.SSHUser = patch.SSHUser
+	}
+	if patch.SSHKey != "" {
+		machine.SSHKey = patch.SSHKey
+	}
+	if patch.BMCInfo != nil {
+		if err := patch.BMCInfo.ValidateIPMIOptions(); err != nil {
+			return nil, invalid("%s", err.Error())
+		}
+		bmc := *patch.BMCInfo
+		if err := bmc.NormalizeAddress(); err != nil {
+			return nil, invalid("%s", err.Error())
+		}
+		if machine.BMCInfo != nil {
+			if bmc.Password == "" {
+				bmc.Password = machine.BMCInfo.Password
+			}
+			if bmc.MACAddress == "" {
+				bmc.MACAddress = machine.BMCInfo.MACAddress
+			}
+			if bmc.Channel == 0 {
+				bmc.Channel = machine.BMCInfo.Channel
+			}
+		}
+		machine.BMCInfo = &bmc
+	}
+	if patch.WakeOnLAN != nil {
+		wol := *patch.WakeOnLAN
+		if wol.MACAddress != "" {
+			mac, err := models.NormalizeMAC(wol.MACAddress)
+			if err != nil {
+				return nil, invalid("wake_on_lan.%s", err.Error())
+			}
+			wol.MACAddress = mac
+		}
+		machine.WakeOnLAN = &wol
+	}
+	if patch.Location != nil {
+		if patch.Location.RackUnit < 0 {
+			return nil, invalid("location.rack_unit must not be negative")
+		}
+		location := *patch.Location
+		machine.Location = &location
+		if location == (models.Location{}) {
+			machine.Location = nil
+		}
+	}
+	if patch.Ownership != nil {
+		ownership := *patch.Ownership
+		if err := ownership.Normalize(); err != nil {
+			return nil, invalid("ownership: %s", err.Error())
+		}
+		machine.Ownership = &ownership
+		if ownership.IsZero() {
+			machine.Ownership = nil
+		}
+	}
+
+	if patch.NixOSConfig != "" {
+		if err := s.AssignHostname(machine); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		return nil, err
+	}
+	if patch.NixOSConfig != "" {
+		s.LintSaved(machine)
+	}
+	if patch.Ownership != nil {
+		if machine.EffectiveOwnership, err = s.db.GetEffectiveOwnership(machine.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+
+	return machine, nil
+}
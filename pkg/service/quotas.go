@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// QuotaUser returns the user an operation is counted against: the user
+// named, or the user authenticated in the context if name is empty. It
+// returns nil for operations of anything but a user, such as the builder's
+// callbacks or schedules, which have no quota.
+func (s *Service) QuotaUser(ctx context.Context, name string) (*models.User, error) {
+	if name != "" {
+		return s.db.GetUserByUsername(name)
+	}
+	if claims, ok := ctx.Value(auth.ClaimsContextKey).(*auth.Claims); ok && claims.UserID != "" {
+		return s.db.GetUser(claims.UserID)
+	}
+	return nil, nil
+}
+
+// QuotaUsage returns a user's use of a quota kind over the last
+// models.QuotaWindow. The user's own limit takes precedence over their
+// role's, and active grants are added to it.
+func (s *Service) QuotaUsage(user *models.User, kind string) (*models.QuotaUsage, error) {
+	now := time.Now()
+	grants, err := s.db.ListQuotaGrants(user.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	return s.quotaUsage(user, kind, grants, now)
+}
+
+func (s *Service) quotaUsage(user *models.User, kind string, grants []models.QuotaGrant, now time.Time) (*models.QuotaUsage, error) {
+	used, oldest, err := s.db.QuotaUsed(user.ID, kind, now.Add(-models.QuotaWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &models.QuotaUsage{Kind: kind, Used: used}
+	if oldest != nil {
+		resets := oldest.Add(models.QuotaWindow)
+		usage.ResetsAt = &resets
+	}
+
+	base := user.Quota.Limit(kind)
+	usage.Source = models.QuotaSourceUser
+	if base == nil {
+		base = s.config.Quotas[user.Role].Limit(kind)
+		usage.Source = models.QuotaSourceRole
+	}
+	if base == nil {
+		usage.Source = ""
+		return usage, nil
+	}
+
+	for _, grant := range grants {
+		if grant.Kind == kind {
+			usage.Granted += grant.Units
+		}
+	}
+	limit := *base + usage.Granted
+	remaining := limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	usage.BaseLimit = base
+	usage.Limit = &limit
+	usage.Remaining = &remaining
+	return usage, nil
+}
+
+// UserUsage returns a user's use of every quota kind, and their active
+// grants
+func (s *Service) UserUsage(user *models.User) (*models.UserUsage, error) {
+	now := time.Now()
+	grants, err := s.db.ListQuotaGrants(user.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &models.UserUsage{
+		UserID:   user.ID,
+		Username: user.Username,
+		Role:     user.Role,
+		Window:   models.QuotaWindow.String(),
+		Quotas:   []models.QuotaUsage{},
+		Grants:   grants,
+		Limits:   user.Quota,
+	}
+	for _, kind := range models.QuotaKinds {
+		usage, err := s.quotaUsage(user, kind, grants, now)
+		if err != nil {
+			return nil, err
+		}
+		result.Quotas = append(result.Quotas, *usage)
+	}
+	return result, nil
+}
+
+// CheckQuota returns a QuotaError if a user has fewer than units of a
+// quota kind left. A nil user has no quota. The usage returned is passed
+// to UseQuota once the operation has been carried out.
+func (s *Service) CheckQuota(user *models.User, kind string, units int) (*models.QuotaUsage, error) {
+	if user == nil {
+		return nil, nil
+	}
+	usage, err := s.QuotaUsage(user, kind)
+	if err != nil {
+		return nil, err
+	}
+	if usage.Limit != nil && usage.Used+units > *usage.Limit {
+		return nil, &QuotaError{Kind: kind, Limit: *usage.Limit, Used: usage.Used, Units: units, ResetsAt: usage.ResetsAt}
+	}
+	return usage, nil
+}
+
+// UseQuota counts units of a quota kind against a user, whose usage
+// CheckQuota returned, publishing user.quota_warning and
+// user.quota_exhausted as their use crosses 80% and 100% of the limit.
+// Usage that can't be recorded is logged; the operation has already been
+// carried out.
+func (s *Service) UseQuota(ctx context.Context, user *models.User, usage *models.QuotaUsage, units int) {
+	if user == nil || usage == nil {
+		return
+	}
+
+	now := time.Now()
+	if err := s.db.RecordQuotaUsage(user.ID, usage.Kind, units, now); err != nil {
+		log.Printf("Failed to record %s quota usage of user %s: %v", usage.Kind, user.Username, err)
+		return
+	}
+	if usage.Limit == nil {
+		return
+	}
+
+	limit := *usage.Limit
+	before, after := usage.Used, usage.Used+units
+	resets := usage.ResetsAt
+	if resets == nil {
+		at := now.Add(models.QuotaWindow)
+		resets = &at
+	}
+
+	var eventType string
+	switch {
+	case before < limit && after >= limit:
+		eventType = events.UserQuotaExhausted
+	case before*5 < limit*4 && after*5 >= limit*4:
+		eventType = events.UserQuotaWarning
+	default:
+		return
+	}
+
+	log.Printf("User %s has used %d of %d %s in the last %s", user.Username, after, limit, usage.Kind, models.QuotaWindow)
+	s.publish(ctx, events.Event{
+		Type:  eventType,
+		Actor: user.Username,
+		Data: events.QuotaData{
+			UserID:   user.ID,
+			Username: user.Username,
+			Kind:     usage.Kind,
+			Limit:    limit,
+			Used:     after,
+			ResetsAt: resets,
+		},
+	})
+}
+
+// ConsumeQuota checks that a user has units of a quota kind left and
+// counts them against it, for operations that can't fail once started
+func (s *Service) ConsumeQuota(ctx context.Context, user *models.User, kind string, units int) error {
+	usage, err := s.CheckQuota(user, kind, units)
+	if err != nil {
+		return err
+	}
+	s.UseQuota(ctx, user, usage, units)
+	return nil
+}
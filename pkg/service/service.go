@@ -0,0 +1,151 @@
+// Package service holds the rules for enrolling, configuring, and building
+// machines, so the API, the dashboard, and other tools embedding them share
+// one implementation. Its methods validate, update the database, and
+// publish events; turning their errors into responses is up to callers.
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/builder"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/lint"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Config holds the settings that change how machines are handled
+type Config struct {
+	// RequireImageTest holds machines in testing after a build until the
+	// build's boot test passes, rather than marking them ready
+	RequireImageTest bool
+
+	// RestoreTrashed restores a machine in the trash when it enrolls,
+	// rather than rejecting the enrollment
+	RestoreTrashed bool
+
+	// RequireBuildApproval holds builds for an admin's approval unless an
+	// admin queued them, as groups with RequireBuildApproval do for their
+	// members
+	RequireBuildApproval bool
+
+	// LintRules are the rules configurations are linted with besides the
+	// built-in checks. If nil, only the built-in checks run.
+	LintRules *lint.Store
+
+	// Quotas are the usage quotas of each role, which users with limits
+	// of their own don't have. Roles not listed are unlimited.
+	Quotas map[models.UserRole]*models.QuotaLimits
+
+	// ImagesDir is where builds publish their artifacts, whose disk usage
+	// is recorded as builds finish. StorageAlertPercent is how full its
+	// filesystem gets before storage.usage_high is published; 0 publishes
+	// nothing.
+	ImagesDir           string
+	StorageAlertPercent int
+}
+
+// Service carries out machine operations. Events go through publisher,
+// so they reach whatever subscribes to it, such as webhooks.
+type Service struct {
+	db      *database.DB
+	events  *events.Publisher
+	builder *builder.Client
+	config  Config
+
+	// storageAlerted is set once storage.usage_high is published, until
+	// the filesystem of the images directory is below the alert again
+	storageMu      sync.Mutex
+	storageAlerted bool
+}
+
+// New creates a service. builder validates configurations assembled from
+// fragments, and may be nil if there is no builder.
+func New(db *database.DB, publisher *events.Publisher, builder *builder.Client, config Config) *Service {
+	return &Service{
+		db:      db,
+		events:  publisher,
+		builder: builder,
+		config:  config,
+	}
+}
+
+// publish emits an event, or holds it for later if ctx is from
+// DeferEvents. Events that cannot be recorded are logged; the change they
+// describe has already happened.
+func (s *Service) publish(ctx context.Context, event events.Event) {
+	if deferred, ok := ctx.Value(deferredEventsKey{}).(*deferredEvents); ok {
+		deferred.mu.Lock()
+		deferred.events = append(deferred.events, event)
+		deferred.mu.Unlock()
+		return
+	}
+	if err := s.events.Publish(ctx, event); err != nil {
+		log.Printf("Failed to publish event: %v", err)
+	}
+}
+
+// deferredEventsKey is the context key of the events DeferEvents holds
+type deferredEventsKey struct{}
+
+// deferredEvents are events held until a request's changes are stored
+type deferredEvents struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+// DeferEvents returns a context in which the service holds the events it
+// would publish, and a function that publishes them, in order, when called.
+// Calling it after the operation returns, even with an error, keeps event
+// recording and delivery out of the operation; they use a context that is
+// not canceled with ctx.
+func (s *Service) DeferEvents(ctx context.Context) (context.Context, func()) {
+	deferred := &deferredEvents{}
+	ctx = context.WithValue(ctx, deferredEventsKey{}, deferred)
+
+	return ctx, func() {
+		deferred.mu.Lock()
+		held := deferred.events
+		deferred.events = nil
+		deferred.mu.Unlock()
+
+		publishCtx := context.WithoutCancel(ctx)
+		for _, event := range held {
+			if err := s.events.Publish(publishCtx, event); err != nil {
+				log.Printf("Failed to publish event: %v", err)
+			}
+		}
+	}
+}
+
+// actor returns name, or the user authenticated in the context if name is
+// empty
+func actor(ctx context.Context, name string) string {
+	if name != "" {
+		return name
+	}
+	if claims, ok := ctx.Value(auth.ClaimsContextKey).(*auth.Claims); ok {
+		return claims.Username
+	}
+	return ""
+}
+
+// publishStatusChange publishes machine.status_changed when a machine's
+// status is no longer oldStatus
+func (s *Service) publishStatusChange(ctx context.Context, machine *models.Machine, oldStatus models.MachineStatus, actor string) {
+	if machine.Status == oldStatus {
+		return
+	}
+	s.publish(ctx, events.Event{
+		Type:      events.MachineStatusChanged,
+		MachineID: machine.ID,
+		Actor:     actor,
+		Data: events.StatusChangedData{
+			OldStatus: oldStatus,
+			NewStatus: machine.Status,
+		},
+	})
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fsusage"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// storageAlertMachines is how many of the largest machine directories
+// storage.usage_high lists
+const storageAlertMachines = 10
+
+// artifactDir returns the directory of the images directory an artifact
+// URL is in, as its usage is recorded: machines/<service tag> for a
+// machine's images, with the service tag, or else the top-level directory
+func artifactDir(artifactURL string) (dir, serviceTag string, ok bool) {
+	rel, ok := strings.CutPrefix(path.Clean(artifactURL), "/images/")
+	if !ok || rel == "" || strings.HasPrefix(rel, "../") {
+		return "", "", false
+	}
+
+	parts := strings.Split(rel, "/")
+	if parts[0] == models.ArtifactsMachinesDir {
+		if len(parts) < 2 {
+			return "", "", false
+		}
+		return parts[0] + "/" + parts[1], parts[1], true
+	}
+	return parts[0], "", true
+}
+
+// recordArtifactUsage measures the directory of the images directory that
+// a build published to, so the recorded usage stays current between walks
+// of the whole directory. Failures are only logged; the next walk corrects
+// them.
+func (s *Service) recordArtifactUsage(artifactURL string) {
+	if s.config.ImagesDir == "" {
+		return
+	}
+	dir, serviceTag, ok := artifactDir(artifactURL)
+	if !ok {
+		return
+	}
+
+	bytes, err := fsusage.DirBytes(filepath.Join(s.config.ImagesDir, filepath.FromSlash(dir)))
+	if err != nil {
+		log.Printf("Failed to measure %s in the images directory: %v", dir, err)
+		return
+	}
+	err = s.db.SetArtifactUsage(models.ArtifactUsage{
+		Path:       dir,
+		ServiceTag: serviceTag,
+		Bytes:      bytes,
+		UpdatedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record usage of %s: %v", dir, err)
+	}
+}
+
+// ReconcileStorage walks the whole images directory and replaces the
+// recorded usage with what it finds, correcting drift from files written
+// or removed other than by builds. It returns how many bytes the recorded
+// total was off by.
+func (s *Service) ReconcileStorage() (int64, error) {
+	if s.config.ImagesDir == "" {
+		return 0, nil
+	}
+
+	recorded, err := s.db.ListArtifactUsage()
+	if err != nil {
+		return 0, err
+	}
+	var before int64
+	for _, u := range recorded {
+		before += u.Bytes
+	}
+
+	entries, err := os.ReadDir(s.config.ImagesDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		entries = nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	usage := []models.ArtifactUsage{}
+	measure := func(dir, serviceTag string) error {
+		bytes, err := fsusage.DirBytes(filepath.Join(s.config.ImagesDir, filepath.FromSlash(dir)))
+		if err != nil {
+			return err
+		}
+		usage = append(usage, models.ArtifactUsage{Path: dir, ServiceTag: serviceTag, Bytes: bytes, UpdatedAt: now})
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.Name() != models.ArtifactsMachinesDir || !entry.IsDir() {
+			if err := measure(entry.Name(), ""); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		machineDirs, err := os.ReadDir(filepath.Join(s.config.ImagesDir, entry.Name()))
+		if err != nil {
+			return 0, err
+		}
+		for _, machineDir := range machineDirs {
+			serviceTag := ""
+			if machineDir.IsDir() {
+				serviceTag = machineDir.Name()
+			}
+			if err := measure(entry.Name()+"/"+machineDir.Name(), serviceTag); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err := s.db.ReplaceArtifactUsage(usage); err != nil {
+		return 0, err
+	}
+
+	var after int64
+	for _, u := range usage {
+		after += u.Bytes
+	}
+	return after - before, nil
+}
+
+// StorageUsage returns the disk usage of the images directory, as recorded
+// and as its filesystem reports it
+func (s *Service) StorageUsage() (*models.StorageUsage, error) {
+	recorded, err := s.db.ListArtifactUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &models.StorageUsage{
+		AlertPercent: s.config.StorageAlertPercent,
+		Machines:     []models.ArtifactUsage{},
+		Other:        []models.ArtifactUsage{},
+	}
+	for _, u := range recorded {
+		usage.ArtifactBytes += u.Bytes
+		if u.ServiceTag != "" {
+			usage.Machines = append(usage.Machines, u)
+		} else {
+			usage.Other = append(usage.Other, u)
+		}
+	}
+
+	if s.config.ImagesDir != "" {
+		if total, free, err := fsusage.Filesystem(s.config.ImagesDir); err == nil && total > 0 {
+			usage.FilesystemBytes = total
+			usage.FilesystemFreeBytes = free
+			usage.UsedPercent = float64(total-free) / float64(total) * 100
+			usage.AboveAlert = usage.AlertPercent > 0 && usage.UsedPercent >= float64(usage.AlertPercent)
+		}
+	}
+	return usage, nil
+}
+
+// CheckStorageAlert publishes storage.usage_high when the filesystem of
+// the images directory is past Config.StorageAlertPercent, once each time
+// it gets there
+func (s *Service) CheckStorageAlert(ctx context.Context) error {
+	if s.config.StorageAlertPercent <= 0 {
+		return nil
+	}
+
+	usage, err := s.StorageUsage()
+	if err != nil {
+		return err
+	}
+	if usage.FilesystemBytes == 0 {
+		return nil
+	}
+
+	s.storageMu.Lock()
+	alert := usage.AboveAlert && !s.storageAlerted
+	s.storageAlerted = usage.AboveAlert
+	s.storageMu.Unlock()
+	if !alert {
+		return nil
+	}
+
+	machines := usage.Machines
+	if len(machines) > storageAlertMachines {
+		machines = machines[:storageAlertMachines]
+	}
+	log.Printf("Images directory filesystem is %.1f%% full, past the %d%% alert", usage.UsedPercent, usage.AlertPercent)
+	s.publish(ctx, events.Event{
+		Type: events.StorageUsageHigh,
+		Data: events.StorageUsageHighData{
+			UsedPercent:         usage.UsedPercent,
+			AlertPercent:        usage.AlertPercent,
+			FilesystemBytes:     usage.FilesystemBytes,
+			FilesystemFreeBytes: usage.FilesystemFreeBytes,
+			ArtifactBytes:       usage.ArtifactBytes,
+			Machines:            machines,
+		},
+	})
+	return nil
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// ApplyTemplate sets a machine's NixOS configuration from a template and
+// marks it configured, if it can be provisioned. The template's {{variable}} placeholders take the
+// template's default values, replaced by those in vars; hostname,
+// service_tag, and mac_address come from the machine, except that a
+// hostname in vars is used when the machine has none. A machine with
+// neither is named from its groups' hostname pattern, if one has it.
+// {{metadata.<key>}} placeholders take the machine's metadata, and
+// {{hardware.<field>}} placeholders its hardware inventory. A machine
+// whose inventory lacks a field the template requires or uses is refused
+// rather than given a configuration with a blank in its place. The
+// template's BMC settings are used if the machine has none, and its build
+// target, if it has one, becomes the machine's.
+func (s *Service) ApplyTemplate(ctx context.Context, machineID, templateID string, vars map[string]string) (*models.Machine, error) {
+	machine, err := s.db.GetMachine(machineID)
+	if err != nil {
+		return nil, err
+	}
+	if machine == nil {
+		return nil, ErrMachineNotFound
+	}
+
+	template, err := s.db.GetTemplate(templateID)
+	if err != nil {
+		return nil, err
+	}
+	if template == nil {
+		return nil, ErrTemplateNotFound
+	}
+
+	variables := templateVariables(template)
+	if err := checkTemplateVariables(variables, vars); err != nil {
+		return nil, err
+	}
+	if err := checkRequiredHardware(template, machine); err != nil {
+		return nil, err
+	}
+	if template.BuildTarget != "" {
+		if err := models.CheckBuildTarget(template.BuildTarget, machine.Hardware.CPU.Architecture); err != nil {
+			return nil, invalid("template's build_target: %s", err.Error())
+		}
+	}
+
+	if vars["hostname"] == "" {
+		if err := s.AssignHostname(machine); err != nil {
+			return nil, err
+		}
+	}
+
+	config := template.NixOSConfig
+	for key, value := range variables {
+		if v, ok := vars[key]; ok {
+			value = v
+		}
+		switch key {
+		case "hostname":
+			if machine.Hostname != "" {
+				value = machine.Hostname
+			}
+		case "service_tag":
+			value = machine.ServiceTag
+		case "mac_address":
+			value = machine.MACAddress
+		}
+		config = strings.ReplaceAll(config, "{{"+key+"}}", value)
+	}
+
+	// Metadata fields fill {{metadata.<key>}} placeholders
+	for name, value := range models.MetadataPlaceholders(machine.Metadata) {
+		config = strings.ReplaceAll(config, "{{"+name+"}}", value)
+	}
+
+	// Hardware fields fill {{hardware.<field>}} placeholders
+	config, err = fillHardwarePlaceholders(config, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	oldStatus := machine.Status
+	machine.NixOSConfig = config
+	machine.TemplateID = template.ID
+	machine.TemplateVariables = vars
+	if template.BuildTarget != "" {
+		machine.BuildTarget = template.BuildTarget
+	}
+	// Like setting a configuration by hand, applying a template leaves
+	// machines that can't be provisioned in their status
+	if machine.CanProvision() {
+		machine.Status = models.StatusConfigured
+	}
+
+	if template.BMCConfig != nil && machine.BMCInfo == nil {
+		machine.BMCInfo = template.BMCConfig
+	}
+
+	if err := s.db.UpdateMachine(machine); err != nil {
+		return nil, err
+	}
+	s.LintSaved(machine)
+
+	s.publish(ctx, events.Event{
+		Type:      events.MachineTemplateApplied,
+		MachineID: machine.ID,
+		Data: events.TemplateAppliedData{
+			TemplateID:   template.ID,
+			TemplateName: template.Name,
+		},
+	})
+	s.publishStatusChange(ctx, machine, oldStatus, "")
+
+	return machine, nil
+}
+
+// templateVariables returns a template's variables with their defaults.
+// Templates whose variables aren't a map of strings are applied without
+// substituting them.
+func templateVariables(template *models.MachineTemplate) map[string]string {
+	var variables map[string]string
+	if template.Variables != nil {
+		if err := json.Unmarshal(template.Variables, &variables); err != nil {
+			return nil
+		}
+	}
+	return variables
+}
+
+// checkRequiredHardware returns an InvalidError if the machine's hardware
+// inventory lacks fields the template requires
+func checkRequiredHardware(template *models.MachineTemplate, machine *models.Machine) error {
+	completeness := machine.Hardware.Completeness()
+	var missing []string
+	for _, field := range template.RequiredHardware {
+		for _, m := range completeness.Missing {
+			if m == field {
+				missing = append(missing, field)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return invalid("template %s requires hardware the machine's inventory lacks: %s; refresh its hardware first",
+			template.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// fillHardwarePlaceholders replaces a configuration's {{hardware.<field>}}
+// placeholders with the machine's hardware inventory. It returns an
+// InvalidError naming those the inventory has no value for, such as a
+// second disk on a machine that reported one.
+func fillHardwarePlaceholders(config string, machine *models.Machine) (string, error) {
+	values := models.HardwarePlaceholders(&machine.Hardware)
+	var missing []string
+	for _, name := range models.HardwarePlaceholderNames(config) {
+		value, ok := values[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		config = strings.ReplaceAll(config, "{{"+name+"}}", value)
+	}
+	if len(missing) > 0 {
+		return "", invalid("the machine's hardware inventory has no %s; refresh its hardware first", strings.Join(missing, ", "))
+	}
+	return config, nil
+}
+
+// checkTemplateVariables returns an InvalidError if vars gives values for
+// variables a template doesn't have
+func checkTemplateVariables(variables, vars map[string]string) error {
+	var unknown []string
+	for key := range vars {
+		if _, ok := variables[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return invalid("template has no variables %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package service_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+)
+
+// hardwareConfig is a template configuration that uses the machine's first
+// disk and CPU model
+const hardwareConfig = `{ config, pkgs, ... }:
+{
+  boot.loader.grub.device = "{{hardware.disks.0.device}}";
+  environment.etc."cpu-model".text = "{{hardware.cpu.model}}";
+  system.stateVersion = "24.05";
+}
+`
+
+// TestApplyTemplateWithSparseHardware renders templates that use or
+// require hardware fields for machines whose inventory lacks some of them.
+// A machine missing a field a template needs is refused with the field
+// named and its configuration left alone, never given one with a blank.
+func TestApplyTemplateWithSparseHardware(t *testing.T) {
+	env := testutil.New(t)
+
+	var uses, requires models.MachineTemplate
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/templates", models.MachineTemplate{
+		Name:        "uses-hardware",
+		NixOSConfig: hardwareConfig,
+	}, http.StatusCreated, &uses)
+	env.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/templates", models.MachineTemplate{
+		Name:             "requires-disks",
+		NixOSConfig:      testutil.FixtureConfig,
+		RequiredHardware: []string{"disks", "nics"},
+	}, http.StatusCreated, &requires)
+
+	noDisks := func(serviceTag string) models.HardwareInfo {
+		h := testutil.FixtureHardware(serviceTag)
+		h.Disks = nil
+		return h
+	}
+	noCPU := func(serviceTag string) models.HardwareInfo {
+		h := testutil.FixtureHardware(serviceTag)
+		h.CPU = models.CPUInfo{}
+		return h
+	}
+	nothing := func(string) models.HardwareInfo { return models.HardwareInfo{} }
+
+	tests := []struct {
+		name     string
+		hardware func(serviceTag string) models.HardwareInfo
+		template *models.MachineTemplate
+		want     string // in the configuration, or the error if refused
+		refused  bool
+	}{
+		{"complete, uses", testutil.FixtureHardware, &uses, `grub.device = "/dev/nvme0n1"`, false},
+		{"complete, requires", testutil.FixtureHardware, &requires, `system.stateVersion`, false},
+		{"no disks, uses", noDisks, &uses, "has no hardware.disks.0.device", true},
+		{"no disks, requires", noDisks, &requires, "lacks: disks", true},
+		{"no CPU, uses", noCPU, &uses, "has no hardware.cpu.model", true},
+		{"no CPU, requires", noCPU, &requires, `system.stateVersion`, false},
+		{"nothing, uses", nothing, &uses, "has no hardware.disks.0.device, hardware.cpu.model", true},
+		{"nothing, requires", nothing, &requires, "lacks: disks, nics", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceTag := "SPARSE" + string(rune('A'+i))
+			machine := env.EnrollMachineWith(serviceTag, tt.hardware(serviceTag))
+			path := "/api/v1/machines/" + machine.ID + "/template/" + tt.template.ID
+
+			if !tt.refused {
+				var applied models.Machine
+				env.MustJSON(models.RoleOperator, http.MethodPost, path, nil, http.StatusOK, &applied)
+				if !strings.Contains(applied.NixOSConfig, tt.want) || strings.Contains(applied.NixOSConfig, "{{") {
+					t.Errorf("config = %s, want %s and no placeholders", applied.NixOSConfig, tt.want)
+				}
+				return
+			}
+
+			var resp models.ErrorResponse
+			env.MustJSON(models.RoleOperator, http.MethodPost, path, nil, http.StatusBadRequest, &resp)
+			if resp.Error.Code != "invalid_request" || !strings.Contains(resp.Error.Message, tt.want) {
+				t.Errorf("error = %+v, want invalid_request naming %q", resp.Error, tt.want)
+			}
+			got, err := env.DB.GetMachine(machine.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.NixOSConfig != "" || got.TemplateID != "" {
+				t.Errorf("refused template still applied: config %q, template %q", got.NixOSConfig, got.TemplateID)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// CreateVirtualMachine creates a virtual machine with the hardware given,
+// for pipelines to configure and build without hardware. It is held to the
+// enrollment rules for new machines: a service tag already in use, in or
+// out of the trash, or a MAC address or serial number that belongs to
+// another machine is rejected rather than held. The machine is announced
+// and placed as an enrolled one, then given the hostname, description,
+// tags, and configuration in the request.
+func (s *Service) CreateVirtualMachine(ctx context.Context, req models.CreateMachineRequest) (*models.Machine, error) {
+	if !req.Virtual {
+		return nil, invalid("virtual must be true; real machines are created by enrolling")
+	}
+	if req.ServiceTag == "" || req.MACAddress == "" {
+		return nil, invalid("service_tag and mac_address are required")
+	}
+	if req.BootMode != "" && !models.IsValidBootMode(req.BootMode) {
+		return nil, invalid("boot_mode must be bios, uefi, or uefi-http")
+	}
+	if _, err := models.NormalizeTags(req.Tags); err != nil {
+		return nil, invalid("%s", err.Error())
+	}
+
+	mac, err := models.NormalizeMAC(req.MACAddress)
+	if err != nil {
+		return nil, invalid("%s", err.Error())
+	}
+	req.MACAddress = mac
+
+	existing, err := s.db.GetMachineByServiceTag(req.ServiceTag)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, &ConflictError{Message: "a machine with this service tag already exists"}
+	}
+	trashed, err := s.db.GetTrashedMachineByServiceTag(req.ServiceTag)
+	if err != nil {
+		return nil, err
+	}
+	if trashed != nil {
+		return nil, &TrashedError{Machine: trashed}
+	}
+
+	serial := models.NormalizeSerialNumber(req.Hardware.SerialNumber)
+	owner, field, err := s.db.FindIdentityOwner(req.MACAddress, serial)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil {
+		value := req.MACAddress
+		if field == models.IdentitySerialNumber {
+			value = serial
+		}
+		return nil, &ConflictError{Message: fmt.Sprintf("%s %s already belongs to machine %s (service_tag: %s)", field, value, owner.ID, owner.ServiceTag)}
+	}
+
+	if err := s.db.CheckHostname("", req.Hostname); err != nil {
+		return nil, err
+	}
+
+	machine, err := s.db.CreateVirtualMachine(req.EnrollmentRequest, req.DryRunBuilds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create machine: %w", err)
+	}
+	log.Printf("Created virtual machine %s (service_tag: %s)", machine.ID, machine.ServiceTag)
+
+	s.enrolled(ctx, machine, "")
+
+	patch := &models.Machine{
+		Hostname:    req.Hostname,
+		Description: req.Description,
+		Tags:        req.Tags,
+		NixOSConfig: req.NixOSConfig,
+	}
+	if patch.Hostname == "" && patch.Description == "" && patch.Tags == nil && patch.NixOSConfig == "" {
+		return s.db.GetMachine(machine.ID)
+	}
+	return s.UpdateMachine(ctx, machine.ID, patch)
+}
+
+// PurgeVirtualMachines permanently deletes virtual machines created longer
+// than olderThan ago, and returns the deleted IDs. Real machines are never
+// deleted, whatever they are tagged or named.
+func (s *Service) PurgeVirtualMachines(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	purged, err := s.db.PurgeVirtualMachines(time.Now().Add(-olderThan))
+	for _, id := range purged {
+		log.Printf("Permanently deleted virtual machine %s", id)
+		s.publish(ctx, events.Event{
+			Type:      events.MachineDeleted,
+			MachineID: id,
+			Data: events.DeletedData{
+				Permanent: true,
+				Reason:    "virtual machine cleanup",
+			},
+		})
+	}
+	return purged, err
+}
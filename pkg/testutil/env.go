@@ -0,0 +1,234 @@
+// Package testutil runs the API server in-process for integration tests:
+// fully wired, on an in-memory database, with a user and token for each
+// role, and with fakes for the BMCs, the builder, and webhook receivers it
+// talks to.
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/api"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/auth"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/google/uuid"
+)
+
+// jwtSecret signs the tokens of every Env's users
+const jwtSecret = "testutil-secret"
+
+// Anonymous makes requests without a token
+const Anonymous models.UserRole = ""
+
+// Roles are the roles an Env has a user for
+var Roles = []models.UserRole{models.RoleAdmin, models.RoleOperator, models.RoleViewer}
+
+// Env is an API server listening on a local port, with its database and
+// fakes. It is shut down when the test that created it ends.
+type Env struct {
+	t testing.TB
+
+	Server  *httptest.Server
+	API     *api.Server
+	DB      *database.DB
+	BMC     *FakeBMC
+	Builder *FakeBuilder
+	Sleeper *FakeSleeper
+
+	// Users and Tokens hold a user, named after its role, and a bearer
+	// token for each of Roles
+	Users  map[models.UserRole]*models.User
+	Tokens map[models.UserRole]string
+
+	config api.Config
+}
+
+// New starts an Env with auth enabled and rate limits off. configure, if
+// given, adjusts the server's configuration before it is created; the
+// builder URL, JWT settings, and auth are set by then.
+func New(t testing.TB, configure ...func(*api.Config)) *Env {
+	t.Helper()
+
+	// Each Env gets its own named in-memory database, shared by the
+	// connections of its pool
+	dsn := fmt.Sprintf("file:testutil-%s?mode=memory&cache=shared&_busy_timeout=5000", uuid.New().String())
+	db, err := database.New(database.Config{Driver: "sqlite3", DSN: dsn})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	if err := db.Migrate(); err != nil {
+		db.Close()
+		t.Fatalf("migrate database: %v", err)
+	}
+
+	env := &Env{
+		t:       t,
+		DB:      db,
+		BMC:     NewFakeBMC(),
+		Builder: NewFakeBuilder(t),
+		Sleeper: &FakeSleeper{},
+		Users:   make(map[models.UserRole]*models.User),
+		Tokens:  make(map[models.UserRole]string),
+	}
+
+	config := api.Config{
+		BuilderURL:       env.Builder.URL(),
+		JWTSecret:        jwtSecret,
+		JWTExpiry:        time.Hour,
+		EnableAuth:       true,
+		WebhookAllowHTTP: true,
+		RateLimits:       api.RateLimitConfig{Disabled: true},
+	}
+	for _, fn := range configure {
+		fn(&config)
+	}
+
+	env.config = config
+	env.API = env.NewReplica()
+	env.Server = httptest.NewServer(env.API.Router)
+
+	// The server goes before the database, so no request is left using it
+	t.Cleanup(func() {
+		env.Server.Close()
+		db.Close()
+	})
+
+	env.seedUsers(config)
+	return env
+}
+
+// NewReplica creates another API server with the Env's configuration,
+// database, and fakes, as a second replica behind a load balancer would
+// be. It serves no requests unless the test serves its Router.
+func (e *Env) NewReplica() *api.Server {
+	server := api.New(e.DB, e.config)
+	server.SetIPMIRunner(e.BMC)
+	server.SetWebhookSleeper(e.Sleeper.Sleep)
+	return server
+}
+
+// seedUsers creates a user for each role and signs its token
+func (e *Env) seedUsers(config api.Config) {
+	e.t.Helper()
+
+	hash, err := auth.HashPassword("password")
+	if err != nil {
+		e.t.Fatalf("hash password: %v", err)
+	}
+
+	jwtManager := auth.NewJWTManager(config.JWTSecret, config.JWTExpiry)
+	for _, role := range Roles {
+		user, err := e.DB.CreateUser(string(role), string(role)+"@example.com", hash, role)
+		if err != nil {
+			e.t.Fatalf("create %s user: %v", role, err)
+		}
+		token, _, err := jwtManager.GenerateToken(user)
+		if err != nil {
+			e.t.Fatalf("sign %s token: %v", role, err)
+		}
+		e.Users[role] = user
+		e.Tokens[role] = token
+	}
+}
+
+// JWTManager returns a JWT manager with the Env's secret, for the tokens
+// the server hands out itself, such as those of unsubscribe links
+func (e *Env) JWTManager() *auth.JWTManager {
+	return auth.NewJWTManager(e.config.JWTSecret, e.config.JWTExpiry)
+}
+
+// URL returns the server's URL for path, such as /api/v1/machines
+func (e *Env) URL(path string) string {
+	return e.Server.URL + path
+}
+
+// Do makes a request as the user with role, or without a token for
+// Anonymous. body, unless nil, is sent as JSON. The caller closes the
+// response's body.
+func (e *Env) Do(role models.UserRole, method, path string, body interface{}) *http.Response {
+	e.t.Helper()
+
+	token := ""
+	if role != Anonymous {
+		var ok bool
+		if token, ok = e.Tokens[role]; !ok {
+			e.t.Fatalf("%s %s: no user with role %q", method, path, role)
+		}
+	}
+	return e.DoToken(token, method, path, body)
+}
+
+// DoToken makes a request like Do with token as its bearer token, such as
+// a machine's hooks token, or without one if token is empty
+func (e *Env) DoToken(token, method, path string, body interface{}) *http.Response {
+	e.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			e.t.Fatalf("%s %s: encode body: %v", method, path, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, e.URL(path), reader)
+	if err != nil {
+		e.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := e.Server.Client().Do(req)
+	if err != nil {
+		e.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
+// JSON makes a request like Do and returns the response's status. If out
+// is not nil, the body is decoded into it, whatever the status.
+func (e *Env) JSON(role models.UserRole, method, path string, body, out interface{}) int {
+	e.t.Helper()
+
+	resp := e.Do(role, method, path, body)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatalf("%s %s: read body: %v", method, path, err)
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			e.t.Fatalf("%s %s: decode %d response %q: %v", method, path, resp.StatusCode, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// MustJSON makes a request like JSON and fails the test unless the
+// response has status want
+func (e *Env) MustJSON(role models.UserRole, method, path string, body interface{}, want int, out interface{}) {
+	e.t.Helper()
+
+	var raw json.RawMessage
+	if status := e.JSON(role, method, path, body, &raw); status != want {
+		e.t.Fatalf("%s %s: got status %d, want %d: %s", method, path, status, want, raw)
+	}
+	if out != nil && len(raw) > 0 {
+		if err := json.Unmarshal(raw, out); err != nil {
+			e.t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/builder"
+)
+
+// FakeBMC stands in for ipmitool, keeping a power state for each BMC
+// address. It answers power commands, chassis bootdev, and mc info; any
+// other command fails, as does every command to an address in Unreachable.
+type FakeBMC struct {
+	mu          sync.Mutex
+	power       map[string]string
+	unreachable map[string]bool
+	calls       [][]string
+}
+
+// NewFakeBMC returns a FakeBMC whose machines are all powered off
+func NewFakeBMC() *FakeBMC {
+	return &FakeBMC{
+		power:       make(map[string]string),
+		unreachable: make(map[string]bool),
+	}
+}
+
+// SetPower sets the power state, on or off, of the BMC at address
+func (f *FakeBMC) SetPower(address, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.power[address] = state
+}
+
+// Power returns the power state of the BMC at address
+func (f *FakeBMC) Power(address string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if state, ok := f.power[address]; ok {
+		return state
+	}
+	return "off"
+}
+
+// Unreachable makes commands to the BMC at address fail, or succeed again
+func (f *FakeBMC) Unreachable(address string, unreachable bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unreachable[address] = unreachable
+}
+
+// Calls returns each command run so far as the BMC address followed by
+// the ipmitool command, such as [10.0.0.5 power on]
+func (f *FakeBMC) Calls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.calls...)
+}
+
+// Run implements command.Runner for ipmitool invocations
+func (f *FakeBMC) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	address, command := splitIPMIArgs(args)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, append([]string{address}, command...))
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	if name != "ipmitool" {
+		return "", "", fmt.Errorf("FakeBMC only runs ipmitool, not %s", name)
+	}
+	if f.unreachable[address] {
+		return "", "Error: Unable to establish IPMI v2 / RMCP+ session", fmt.Errorf("exit status 1")
+	}
+
+	state := f.power[address]
+	if state == "" {
+		state = "off"
+	}
+
+	switch strings.Join(command, " ") {
+	case "power status":
+		return "Chassis Power is " + state + "\n", "", nil
+	case "power on":
+		f.power[address] = "on"
+		return "Chassis Power Control: Up/On\n", "", nil
+	case "power off":
+		f.power[address] = "off"
+		return "Chassis Power Control: Down/Off\n", "", nil
+	case "power cycle":
+		f.power[address] = "on"
+		return "Chassis Power Control: Cycle\n", "", nil
+	case "power reset":
+		return "Chassis Power Control: Reset\n", "", nil
+	case "chassis bootdev pxe":
+		return "Set Boot Device to pxe\n", "", nil
+	case "mc info":
+		return "Device ID                 : 32\nFirmware Revision         : 2.81\nManufacturer Name         : Fake\n", "", nil
+	}
+	return "", "Invalid command", fmt.Errorf("FakeBMC does not support %q", strings.Join(command, " "))
+}
+
+// splitIPMIArgs separates the -H address from the ipmitool command that
+// follows the connection options
+func splitIPMIArgs(args []string) (string, []string) {
+	var address string
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		if args[i] == "-H" && i+1 < len(args) {
+			address = args[i+1]
+		}
+		i += 2
+	}
+	if i > len(args) {
+		i = len(args)
+	}
+	return address, args[i:]
+}
+
+// FakeBuilder is the builder service's HTTP API as the server uses it,
+// which is to validate configurations. Configurations are valid unless
+// Reject says otherwise.
+type FakeBuilder struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	validated []string
+	reject    func(config string) string
+}
+
+// NewFakeBuilder starts a FakeBuilder, stopped when the test ends
+func NewFakeBuilder(t testing.TB) *FakeBuilder {
+	f := &FakeBuilder{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// URL returns the builder's base URL
+func (f *FakeBuilder) URL() string {
+	return f.server.URL
+}
+
+// Reject sets the check configurations are validated with: it returns
+// nix's error for a configuration that doesn't parse, or "" if it does
+func (f *FakeBuilder) Reject(check func(config string) string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reject = check
+}
+
+// Validated returns the configurations validated so far, in order
+func (f *FakeBuilder) Validated() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.validated...)
+}
+
+func (f *FakeBuilder) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/validate" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req builder.ValidateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.validated = append(f.validated, req.Config)
+	reject := f.reject
+	f.mu.Unlock()
+
+	response := builder.ValidateResponse{Valid: true}
+	if reject != nil {
+		if msg := reject(req.Config); msg != "" {
+			response = builder.ValidateResponse{Error: msg}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Delivery is a request a WebhookReceiver received
+type Delivery struct {
+	Header  http.Header
+	Body    []byte
+	Payload map[string]interface{} // The body, if it is a JSON object
+}
+
+// Event returns the payload's event type
+func (d Delivery) Event() string {
+	event, _ := d.Payload["event"].(string)
+	return event
+}
+
+// WebhookReceiver records the webhook deliveries it receives. It answers
+// with the responses given to Script, in order, and then with Status, 200
+// unless set otherwise.
+type WebhookReceiver struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	status     int
+	script     []Response
+	deliveries []Delivery
+	received   chan struct{}
+}
+
+// Response is a WebhookReceiver's answer to a delivery. RetryAfter, if
+// set, is sent as the Retry-After header.
+type Response struct {
+	Status     int
+	RetryAfter string
+}
+
+// NewWebhookReceiver starts a WebhookReceiver, stopped when the test ends
+func NewWebhookReceiver(t testing.TB) *WebhookReceiver {
+	f := &WebhookReceiver{
+		status:   http.StatusOK,
+		received: make(chan struct{}, 1),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// URL returns the URL deliveries are received at
+func (f *WebhookReceiver) URL() string {
+	return f.server.URL + "/hook"
+}
+
+// Status sets the status deliveries are answered with
+func (f *WebhookReceiver) Status(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+// Script sets the responses the next deliveries are answered with, one
+// each, before falling back to Status
+func (f *WebhookReceiver) Script(responses ...Response) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append([]Response(nil), responses...)
+}
+
+// Deliveries returns the deliveries received so far, in order
+func (f *WebhookReceiver) Deliveries() []Delivery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Delivery(nil), f.deliveries...)
+}
+
+// WaitFor waits up to timeout for a delivery of an event of type event and
+// returns it, or fails the test
+func (f *WebhookReceiver) WaitFor(t testing.TB, event string, timeout time.Duration) Delivery {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		for _, delivery := range f.Deliveries() {
+			if delivery.Event() == event {
+				return delivery
+			}
+		}
+		select {
+		case <-f.received:
+		case <-deadline:
+			t.Fatalf("no %s webhook delivery within %s; got %d other deliveries", event, timeout, len(f.Deliveries()))
+			return Delivery{}
+		}
+	}
+}
+
+func (f *WebhookReceiver) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	delivery := Delivery{Header: r.Header.Clone(), Body: body}
+	json.Unmarshal(body, &delivery.Payload)
+
+	f.mu.Lock()
+	f.deliveries = append(f.deliveries, delivery)
+	response := Response{Status: f.status}
+	if len(f.script) > 0 {
+		response, f.script = f.script[0], f.script[1:]
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.received <- struct{}{}:
+	default:
+	}
+	if response.RetryAfter != "" {
+		w.Header().Set("Retry-After", response.RetryAfter)
+	}
+	w.WriteHeader(response.Status)
+}
+
+// FakeSleeper records the waits between webhook delivery attempts instead
+// of sleeping through them
+type FakeSleeper struct {
+	mu    sync.Mutex
+	waits []time.Duration
+}
+
+// Sleep records d and returns at once
+func (f *FakeSleeper) Sleep(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.waits = append(f.waits, d)
+}
+
+// Waits returns the waits recorded so far, in order
+func (f *FakeSleeper) Waits() []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Duration(nil), f.waits...)
+}
@@ -0,0 +1,144 @@
+package testutil
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// FixtureConfig is a minimal NixOS configuration that passes the built-in
+// lint checks, so machines given it can be built
+const FixtureConfig = `{ config, pkgs, ... }:
+{
+  networking.hostName = "fixture";
+  system.stateVersion = "24.05";
+}
+`
+
+// FixtureHardware returns the hardware a two-socket server reports at
+// enrollment, with serial numbers and MAC addresses derived from
+// serviceTag so that different tags never collide
+func FixtureHardware(serviceTag string) models.HardwareInfo {
+	mac := FixtureMAC(serviceTag)
+	return models.HardwareInfo{
+		Manufacturer: "Dell Inc.",
+		Model:        "PowerEdge R650",
+		SerialNumber: serviceTag,
+		BIOSVersion:  "1.10.2",
+		CPU: models.CPUInfo{
+			Model:        "Intel(R) Xeon(R) Gold 6338 CPU @ 2.00GHz",
+			Cores:        64,
+			Threads:      128,
+			Sockets:      2,
+			MaxFreqMHz:   3200,
+			Architecture: "x86_64",
+		},
+		Memory: models.MemoryInfo{
+			TotalBytes: 256 << 30,
+			TotalGB:    256,
+			Modules: []models.MemorySlot{
+				{Slot: "A1", SizeBytes: 64 << 30, Type: "DDR4", Speed: 3200},
+				{Slot: "A2", SizeBytes: 64 << 30, Type: "DDR4", Speed: 3200},
+				{Slot: "B1", SizeBytes: 64 << 30, Type: "DDR4", Speed: 3200},
+				{Slot: "B2", SizeBytes: 64 << 30, Type: "DDR4", Speed: 3200},
+			},
+		},
+		Disks: []models.DiskInfo{
+			{Device: "/dev/nvme0n1", Model: "Dell Ent NVMe P5600", SizeBytes: 1600 << 30, SizeGB: 1600, Type: "NVMe", Serial: serviceTag + "-D0"},
+			{Device: "/dev/nvme1n1", Model: "Dell Ent NVMe P5600", SizeBytes: 1600 << 30, SizeGB: 1600, Type: "NVMe", Serial: serviceTag + "-D1"},
+		},
+		NICs: []models.NICInfo{
+			{Name: "eno1", MACAddress: mac, Driver: "ice", Speed: "25Gbps", PCIAddress: "0000:31:00.0", LinkStatus: "up"},
+		},
+	}
+}
+
+// FixtureMAC returns the MAC address FixtureHardware gives serviceTag's
+// first NIC, a locally administered one
+func FixtureMAC(serviceTag string) string {
+	h := fnv.New32a()
+	h.Write([]byte(serviceTag))
+	sum := h.Sum32()
+	return fmt.Sprintf("02:00:%02x:%02x:%02x:%02x", byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+// EnrollMachine enrolls a machine with FixtureHardware through the
+// enrollment endpoint, as the registration image does, and returns it
+func (e *Env) EnrollMachine(serviceTag string) *models.Machine {
+	e.t.Helper()
+	return e.EnrollMachineWith(serviceTag, FixtureHardware(serviceTag))
+}
+
+// EnrollMachineWith enrolls a machine reporting hardware, such as an
+// inventory the registration image only partly collected, and returns it
+func (e *Env) EnrollMachineWith(serviceTag string, hardware models.HardwareInfo) *models.Machine {
+	e.t.Helper()
+
+	req := models.EnrollmentRequest{
+		ServiceTag: serviceTag,
+		MACAddress: FixtureMAC(serviceTag),
+		Hardware:   hardware,
+	}
+	var resp models.EnrollmentResponse
+	e.MustJSON(Anonymous, http.MethodPost, "/api/v1/enroll", req, http.StatusCreated, &resp)
+	if resp.Machine == nil {
+		e.t.Fatalf("enroll %s: no machine in the response", serviceTag)
+	}
+	return resp.Machine
+}
+
+// ConfigureMachine gives a machine a NixOS configuration as an operator,
+// which makes it configured and ready to build, and returns it
+func (e *Env) ConfigureMachine(id, config string) *models.Machine {
+	e.t.Helper()
+
+	var machine models.Machine
+	e.MustJSON(models.RoleOperator, http.MethodPut, "/api/v1/machines/"+id,
+		map[string]interface{}{"nixos_config": config}, http.StatusOK, &machine)
+	return &machine
+}
+
+// SetBMC gives a machine an enabled IPMI BMC at address, which the
+// Env's FakeBMC answers for
+func (e *Env) SetBMC(id, address string) {
+	e.t.Helper()
+
+	bmc := models.BMCInfo{
+		IPAddress: address,
+		Username:  "root",
+		Password:  "calvin",
+		Type:      "IPMI",
+		Enabled:   true,
+	}
+	e.MustJSON(models.RoleOperator, http.MethodPut, "/api/v1/machines/"+id,
+		map[string]interface{}{"bmc_info": bmc}, http.StatusOK, nil)
+}
+
+// CreateGroup creates a group as an operator and returns it
+func (e *Env) CreateGroup(name string) *models.MachineGroup {
+	e.t.Helper()
+
+	var group models.MachineGroup
+	e.MustJSON(models.RoleOperator, http.MethodPost, "/api/v1/groups",
+		models.CreateGroupRequest{Name: name}, http.StatusCreated, &group)
+	return &group
+}
+
+// AddWebhook subscribes receiver to events as an admin and returns the
+// webhook. It may reach the receiver on the loopback address.
+func (e *Env) AddWebhook(receiver *WebhookReceiver, events ...string) *models.Webhook {
+	e.t.Helper()
+
+	webhook := models.Webhook{
+		Name:                 "testutil",
+		URL:                  receiver.URL(),
+		Events:               events,
+		Active:               true,
+		AllowPrivateNetworks: true,
+	}
+	var created models.Webhook
+	e.MustJSON(models.RoleAdmin, http.MethodPost, "/api/v1/webhooks", webhook, http.StatusCreated, &created)
+	return &created
+}
@@ -0,0 +1,240 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// activityShown is how many of the latest events the dashboard's recent
+// activity panel shows
+const activityShown = 20
+
+// activityRefreshSeconds is how often the dashboard reloads its recent
+// activity panel
+const activityRefreshSeconds = 15
+
+// activityErrorLength bounds how much of an event's error the panel shows
+const activityErrorLength = 120
+
+// activityItem is an event as the recent activity panel shows it
+type activityItem struct {
+	Event     string
+	Badge     string // Class of the event type's badge
+	Text      string
+	MachineID string
+	Machine   string // The machine's hostname or service tag, if it still exists
+	Actor     string
+	At        time.Time
+}
+
+// recentActivity returns the latest events across the fleet, newest first
+func (s *Server) recentActivity() ([]activityItem, error) {
+	events, err := s.db.ListAllEvents(activityShown)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	items := make([]activityItem, 0, len(events))
+	for _, event := range events {
+		name, ok := names[event.MachineID]
+		if !ok {
+			if machine, err := s.db.GetMachine(event.MachineID); err != nil {
+				log.Printf("Error getting machine %s: %v", event.MachineID, err)
+			} else if machine != nil {
+				name = machine.Hostname
+				if name == "" {
+					name = machine.ServiceTag
+				}
+			}
+			names[event.MachineID] = name
+		}
+
+		item := activityItem{
+			Event:     event.Event,
+			Badge:     eventBadge(event.Event),
+			Text:      describeEvent(event.Event, event.Data),
+			MachineID: event.MachineID,
+			Machine:   name,
+			At:        event.CreatedAt,
+		}
+		if event.CreatedBy != nil {
+			item.Actor = *event.CreatedBy
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// handleActivity serves the recent activity panel alone, which the
+// dashboard polls to keep it current
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request) {
+	items, err := s.recentActivity()
+	if err != nil {
+		log.Printf("Error listing events: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.templates["activity"].ExecuteTemplate(w, "activity", items); err != nil {
+		log.Printf("Error rendering template: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// eventAcronyms are words of event types written in capitals
+var eventAcronyms = map[string]string{"ip": "IP", "bmc": "BMC"}
+
+// describeEvent renders an event as a line of text: what happened, from its
+// type, and the details of its data a person scanning the fleet's activity
+// wants. Every event type renders this way, so events added later never
+// show as raw data.
+func describeEvent(eventType string, data json.RawMessage) string {
+	text := humanizeEventType(eventType)
+
+	var fields map[string]interface{}
+	if len(data) == 0 || json.Unmarshal(data, &fields) != nil {
+		return text
+	}
+	str := func(key string) string {
+		switch v := fields[key].(type) {
+		case string:
+			return v
+		case float64:
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+
+	var details []string
+	if from, to := str("old_status"), str("new_status"); to != "" {
+		if from != "" {
+			details = append(details, from+" → "+to)
+		} else {
+			details = append(details, to)
+		}
+	}
+	if from, to := str("from"), str("to"); to != "" {
+		details = append(details, from+" → "+to)
+	}
+	if ip := str("current_ip"); ip != "" {
+		details = append(details, ip)
+	}
+	if op := str("operation"); op != "" {
+		details = append(details, op)
+	}
+	if id := str("build_id"); id != "" {
+		details = append(details, "build "+shortID(id))
+	}
+	if name := str("template_name"); name != "" {
+		details = append(details, name)
+	}
+	if user := str("username"); user != "" {
+		details = append(details, user)
+	}
+	if len(details) > 0 {
+		text += ": " + strings.Join(details, ", ")
+	}
+
+	reason := str("error")
+	if reason == "" {
+		reason = str("reason")
+	}
+	if reason != "" {
+		text += " (" + truncate(reason, activityErrorLength) + ")"
+	}
+	return text
+}
+
+// humanizeEventType turns an event type into words, such as "Build
+// succeeded" for machine.build_succeeded. Types of events about something
+// other than a machine keep what they are about, such as "Rollout started".
+func humanizeEventType(eventType string) string {
+	subject, action, ok := strings.Cut(eventType, ".")
+	if !ok {
+		action, subject = subject, ""
+	}
+	words := strings.Split(action, "_")
+	if subject != "" && subject != "machine" {
+		words = append([]string{subject}, words...)
+	}
+	for i, word := range words {
+		if acronym, ok := eventAcronyms[word]; ok {
+			words[i] = acronym
+		}
+	}
+	text := strings.Join(words, " ")
+	if text == "" {
+		return eventType
+	}
+	first, size := utf8.DecodeRuneInString(text)
+	return strings.ToUpper(string(first)) + text[size:]
+}
+
+// eventBadge returns the class of an event type's badge, by whether it
+// reports a failure, a success, or neither
+func eventBadge(eventType string) string {
+	for _, word := range []string{"failed", "rejected", "mismatch", "noncompliant", "conflict", "unschedulable", "stale"} {
+		if strings.Contains(eventType, word) {
+			return "event-error"
+		}
+	}
+	for _, word := range []string{"succeeded", "deployed", "completed", "approved", "enrolled", "resolved", "restored"} {
+		if strings.Contains(eventType, word) {
+			return "event-success"
+		}
+	}
+	return "event-info"
+}
+
+// timeAgo describes how long ago t was, such as "5m ago"
+func timeAgo(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
+
+// shortID returns the first eight characters of an ID, enough to tell
+// builds apart at a glance
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// formatBytes describes a size in bytes in binary units, such as "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// truncate shortens s to at most n runes, marking that it was cut
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
@@ -0,0 +1,147 @@
+package web
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+)
+
+// sampleEventData returns data for an event type with every field of its
+// schema filled in
+func sampleEventData(t *testing.T, fields map[string]string) json.RawMessage {
+	t.Helper()
+
+	data := make(map[string]interface{}, len(fields))
+	for name, kind := range fields {
+		kind, _, _ = strings.Cut(kind, ",")
+		switch kind {
+		case "string":
+			data[name] = "sample-" + strings.ReplaceAll(name, "_", "-")
+		case "integer":
+			data[name] = 3
+		case "boolean":
+			data[name] = true
+		case "timestamp":
+			data[name] = "2026-01-02T03:04:05Z"
+		case "array":
+			data[name] = []interface{}{"a", "b"}
+		default:
+			data[name] = map[string]interface{}{"nested": "value"}
+		}
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// TestDescribeEveryEventType renders every event type there is, with its
+// data and without, and checks each comes out as a sentence rather than
+// the type's name or raw JSON
+func TestDescribeEveryEventType(t *testing.T) {
+	schema := events.DescribeSchema()
+
+	for _, eventType := range events.Types {
+		fields, ok := schema.Events[eventType]
+		if !ok {
+			t.Errorf("%s has no schema", eventType)
+			continue
+		}
+
+		for _, data := range []json.RawMessage{nil, json.RawMessage(`{}`), sampleEventData(t, fields), json.RawMessage(`not json`)} {
+			text := describeEvent(eventType, data)
+
+			first := []rune(text)[0]
+			if !unicode.IsUpper(first) {
+				t.Errorf("%s: %q doesn't start with a capital", eventType, text)
+			}
+			if strings.Contains(text, eventType) || strings.ContainsAny(text, "_{}[]\"") {
+				t.Errorf("%s: %q shows the raw event", eventType, text)
+			}
+			if strings.Contains(text, "nested") || strings.Contains(text, "map[") {
+				t.Errorf("%s: %q shows nested data", eventType, text)
+			}
+		}
+	}
+}
+
+func TestDescribeEvent(t *testing.T) {
+	longError := strings.Repeat("x", activityErrorLength+10)
+
+	tests := []struct {
+		eventType string
+		data      string
+		want      string
+	}{
+		{events.MachineEnrolled, `{"service_tag":"ABC123"}`, "Enrolled"},
+		{events.MachineStatusChanged, `{"old_status":"configured","new_status":"ready"}`, "Status changed: configured → ready"},
+		{events.MachineStatusChanged, `{"new_status":"ready"}`, "Status changed: ready"},
+		{events.MachinePowerChanged, `{"from":"off","to":"on"}`, "Power changed: off → on"},
+		{events.MachineIPChanged, `{"old_ip":"10.0.0.1","current_ip":"10.0.0.2"}`, "IP changed: 10.0.0.2"},
+		{events.MachineBuildSucceeded, `{"build_id":"7f3a9c21-0000-4000-8000-000000000000"}`, "Build succeeded: build 7f3a9c21"},
+		{events.MachineBuildFailed, `{"build_id":"7f3a9c21","error":"nix-build exited 1"}`, "Build failed: build 7f3a9c21 (nix-build exited 1)"},
+		{events.MachineBuildFailed, `{"error":"` + longError + `"}`, "Build failed (" + longError[:activityErrorLength] + "…)"},
+		{events.MachinePowerOperation, `{"operation":"cycle","status":"completed"}`, "Power operation: cycle"},
+		{events.MachineBMCPasswordRotated, `{}`, "BMC password rotated"},
+		{events.MachineClaimed, `{"username":"alice"}`, "Claimed: alice"},
+		{events.MachineDeleted, `{"permanent":true,"reason":"trash retention expired"}`, "Deleted (trash retention expired)"},
+		{events.RolloutStarted, `{"rollout_id":"r1"}`, "Rollout started"},
+		{events.BuilderLowDisk, `{}`, "Builder low disk"},
+		{events.UserQuotaExhausted, `{"username":"bob","kind":"builds"}`, "User quota exhausted: bob"},
+		{"machine.something_new", `{"detail":"x"}`, "Something new"},
+		{"unscoped", ``, "Unscoped"},
+	}
+	for _, tt := range tests {
+		if got := describeEvent(tt.eventType, json.RawMessage(tt.data)); got != tt.want {
+			t.Errorf("describeEvent(%s, %s) = %q, want %q", tt.eventType, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestEventBadge(t *testing.T) {
+	for eventType, want := range map[string]string{
+		events.MachineBuildFailed:          "event-error",
+		events.MachineBuildRejected:        "event-error",
+		events.MachineIdentityMismatch:     "event-error",
+		events.MachineHardwareNoncompliant: "event-error",
+		events.MachineBootWithStaleConfig:  "event-error",
+		events.MachineBuildSucceeded:       "event-success",
+		events.MachineEnrolled:             "event-success",
+		events.MachineDeployed:             "event-success",
+		events.RolloutCompleted:            "event-success",
+		events.MachineStatusChanged:        "event-info",
+		events.MachinePowerOperation:       "event-info",
+	} {
+		if got := eventBadge(eventType); got != want {
+			t.Errorf("eventBadge(%s) = %s, want %s", eventType, got, want)
+		}
+	}
+}
+
+func TestTimeAgo(t *testing.T) {
+	now := time.Now()
+	for d, want := range map[time.Duration]string{
+		10 * time.Second: "just now",
+		5 * time.Minute:  "5m ago",
+		3 * time.Hour:    "3h ago",
+		50 * time.Hour:   "2d ago",
+	} {
+		if got := timeAgo(now.Add(-d)); got != want {
+			t.Errorf("timeAgo(-%s) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("héllo wörld", 5); got != "héllo…" {
+		t.Errorf("truncate = %q", got)
+	}
+	if got := truncate("short", 5); got != "short" {
+		t.Errorf("truncate = %q", got)
+	}
+}
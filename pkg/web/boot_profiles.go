@@ -0,0 +1,47 @@
+package web
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// handleBootProfiles lists the boot profiles, with a form to add one. The
+// page signs in and adds and deletes profiles through the API itself, so
+// only admins can change them.
+func (s *Server) handleBootProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := s.db.ListBootProfiles()
+	if err != nil {
+		log.Printf("Error listing boot profiles: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	groups, err := s.db.ListGroups()
+	if err != nil {
+		log.Printf("Error listing groups: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	groupNames := make(map[string]string, len(groups))
+	for _, group := range groups {
+		groupNames[group.ID] = group.Name
+	}
+
+	data := struct {
+		Profiles   []*models.BootProfile
+		Groups     []*models.MachineGroup
+		GroupNames map[string]string
+	}{
+		Profiles:   profiles,
+		Groups:     groups,
+		GroupNames: groupNames,
+	}
+
+	if err := s.templates["bootProfiles"].Execute(w, data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
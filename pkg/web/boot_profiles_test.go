@@ -0,0 +1,50 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/web"
+)
+
+// TestBootProfilesChangeOnlyThroughTheAPI checks the dashboard has no
+// unauthenticated way to add or delete boot profiles; its page goes
+// through the API, which takes an admin
+func TestBootProfilesChangeOnlyThroughTheAPI(t *testing.T) {
+	env := testutil.New(t)
+	dashboard := web.NewServer(env.DB, env.API.Service(), "")
+
+	form := url.Values{
+		"name":        {"lab-debug"},
+		"kernel_path": {"registration-debug/bzImage"},
+		"initrd_path": {"registration-debug/initrd"},
+	}
+	for _, path := range []string{"/admin/boot-profiles", "/admin/boot-profiles/some-id/delete"} {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		dashboard.Router().ServeHTTP(rec, r)
+		if rec.Code < 400 {
+			t.Errorf("POST %s: status %d, want an error", path, rec.Code)
+		}
+	}
+
+	profiles, err := env.DB.ListBootProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 0 {
+		t.Errorf("%d boot profiles added without signing in", len(profiles))
+	}
+
+	// The page itself is still served, and changes profiles through the API
+	rec := httptest.NewRecorder()
+	dashboard.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/boot-profiles", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/api/v1/boot-profiles") {
+		t.Errorf("GET /admin/boot-profiles: status %d, want the page", rec.Code)
+	}
+}
@@ -0,0 +1,15 @@
+package web
+
+import (
+	"log"
+	"net/http"
+)
+
+// handleClaim serves the page users claim machines on. The page signs in
+// and claims through the API itself, since the dashboard has no accounts.
+func (s *Server) handleClaim(w http.ResponseWriter, r *http.Request) {
+	if err := s.templates["claim"].Execute(w, nil); err != nil {
+		log.Printf("Error rendering template: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,75 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// flashCookie carries a flash message from the request that set it to the
+// page the browser is redirected to
+const flashCookie = "metal_flash"
+
+// flashMaxAge bounds how long a flash message waits for the page after a
+// redirect, so one that is never shown doesn't turn up later
+const flashMaxAge = 60
+
+// Flash message kinds, which set how the message is styled
+const (
+	flashSuccess = "success"
+	flashError   = "error"
+)
+
+// flash is a one-time message shown on the next page a browser loads, such
+// as the result of a form it posted
+type flash struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// setFlash sets the message the next page shows. It is kept in a cookie,
+// since the dashboard has no server-side sessions; the message is escaped
+// when shown, like anything else on the page.
+func setFlash(w http.ResponseWriter, kind, message string) {
+	value, err := json.Marshal(flash{Kind: kind, Message: message})
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/",
+		MaxAge:   flashMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// popFlash returns the message set for this page, if any, and clears it so
+// it is shown once
+func popFlash(w http.ResponseWriter, r *http.Request) *flash {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	value, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	var f flash
+	if err := json.Unmarshal(value, &f); err != nil || f.Message == "" {
+		return nil
+	}
+	if f.Kind != flashError {
+		f.Kind = flashSuccess
+	}
+	return &f
+}
@@ -0,0 +1,76 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// nextRequest returns a request carrying the cookies rec set, as a browser
+// following a redirect would send them
+func nextRequest(rec *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestFlashIsShownOnce(t *testing.T) {
+	set := httptest.NewRecorder()
+	setFlash(set, flashError, `Delete failed: "web-01" <is> in use`)
+
+	cookie := set.Result().Cookies()[0]
+	if cookie.Name != flashCookie || cookie.MaxAge != flashMaxAge || !cookie.HttpOnly {
+		t.Errorf("cookie = %+v", cookie)
+	}
+
+	shown := httptest.NewRecorder()
+	f := popFlash(shown, nextRequest(set))
+	if f == nil || f.Kind != flashError || f.Message != `Delete failed: "web-01" <is> in use` {
+		t.Fatalf("flash = %+v", f)
+	}
+
+	// Showing it clears it
+	cleared := shown.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != flashCookie || cleared[0].MaxAge >= 0 {
+		t.Errorf("cookies after showing = %+v, want the flash cleared", cleared)
+	}
+	if f := popFlash(httptest.NewRecorder(), nextRequest(shown)); f != nil {
+		t.Errorf("flash shown again: %+v", f)
+	}
+}
+
+func TestFlashKinds(t *testing.T) {
+	for kind, want := range map[string]string{
+		flashSuccess: flashSuccess,
+		flashError:   flashError,
+		"":           flashSuccess,
+		"warning":    flashSuccess,
+	} {
+		set := httptest.NewRecorder()
+		setFlash(set, kind, "Saved")
+		if f := popFlash(httptest.NewRecorder(), nextRequest(set)); f == nil || f.Kind != want {
+			t.Errorf("kind %q: flash = %+v, want kind %s", kind, f, want)
+		}
+	}
+}
+
+func TestNoFlash(t *testing.T) {
+	if f := popFlash(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)); f != nil {
+		t.Errorf("flash = %+v, want none", f)
+	}
+
+	for _, value := range []string{"not base64!", "bm90IGpzb24", "eyJraW5kIjoic3VjY2VzcyJ9"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: flashCookie, Value: value})
+		rec := httptest.NewRecorder()
+		if f := popFlash(rec, r); f != nil {
+			t.Errorf("cookie %q: flash = %+v, want none", value, f)
+		}
+		// A bad cookie is still cleared
+		if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+			t.Errorf("cookie %q: not cleared", value)
+		}
+	}
+}
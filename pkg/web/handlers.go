@@ -1,43 +1,107 @@
 package web
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/drift"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/fragments"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/ipxe"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/maintenance"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/service"
 	"github.com/gorilla/mux"
 )
 
+// bootPreviewTimeout bounds how long a machine page waits for the iPXE
+// server's boot script preview
+const bootPreviewTimeout = 3 * time.Second
+
+// machineDiagnosticsShown is how many of its latest diagnostic runs a
+// machine page shows
+const machineDiagnosticsShown = 5
+
 // Server represents the web server
 type Server struct {
 	db        *database.DB
+	service   *service.Service
 	router    *mux.Router
 	templates map[string]*template.Template
+	ipxe      *ipxe.Client
 }
 
-// NewServer creates a new web server
-func NewServer(db *database.DB) *Server {
+// NewServer creates a new web server. Machines are updated and built
+// through svc, the API server's service, so the dashboard follows the same
+// rules and publishes the same events. Machine pages preview their boot
+// script from the iPXE server at ipxeURL, if it is set.
+func NewServer(db *database.DB, svc *service.Service, ipxeURL string) *Server {
 	s := &Server{
-		db:     db,
-		router: mux.NewRouter(),
+		db:      db,
+		service: svc,
+		router:  mux.NewRouter(),
 		templates: map[string]*template.Template{
-			"index":   template.Must(template.New("index").Parse(indexTemplate)),
-			"machine": template.Must(template.New("machine").Parse(machineTemplate)),
+			"index":    parsePage("index", indexTemplate, flashTemplate, activityTemplate),
+			"machine":  parsePage("machine", machineTemplate, flashTemplate),
+			"group":    template.Must(template.New("group").Funcs(templateFuncs).Parse(groupTemplate)),
+			"activity": parsePage("activity", activityTemplate),
+
+			"bootProfiles": template.Must(template.New("bootProfiles").Funcs(templateFuncs).Parse(bootProfilesTemplate)),
+			"claim":        template.Must(template.New("claim").Funcs(templateFuncs).Parse(claimTemplate)),
 		},
 	}
 
+	if ipxeURL != "" {
+		s.ipxe = ipxe.NewClient(ipxeURL, "")
+	}
+
 	s.setupRoutes()
 	return s
 }
 
+var templateFuncs = template.FuncMap{
+	"tagFilterURL": tagFilterURL,
+	"timeAgo":      timeAgo,
+	"shortID":      shortID,
+	"formatBytes":  formatBytes,
+}
+
+// parsePage parses a page's template along with the shared templates it
+// uses, such as flashTemplate
+func parsePage(name, page string, shared ...string) *template.Template {
+	t := template.Must(template.New(name).Funcs(templateFuncs).Parse(page))
+	for _, text := range shared {
+		template.Must(t.Parse(text))
+	}
+	return t
+}
+
+// tagFilterURL returns the dashboard URL filtered by the current tags and
+// tag
+func tagFilterURL(current []string, tag string) string {
+	tags := append([]string{}, current...)
+	if !models.HasTag(tags, tag) {
+		tags = append(tags, tag)
+	}
+	return "/?" + url.Values{"tag": tags}.Encode()
+}
+
 func (s *Server) setupRoutes() {
 	s.router.HandleFunc("/", s.handleIndex).Methods("GET")
+	s.router.HandleFunc("/activity", s.handleActivity).Methods("GET")
 	s.router.HandleFunc("/machines/{id}", s.handleMachine).Methods("GET")
 	s.router.HandleFunc("/machines/{id}/update", s.handleUpdateMachine).Methods("POST")
 	s.router.HandleFunc("/machines/{id}/build", s.handleBuildMachine).Methods("GET")
+	s.router.HandleFunc("/groups/{id}", s.handleGroup).Methods("GET")
+	s.router.HandleFunc("/admin/boot-profiles", s.handleBootProfiles).Methods("GET")
+	s.router.HandleFunc("/claim", s.handleClaim).Methods("GET")
 }
 
 // Router returns the HTTP router
@@ -47,7 +111,21 @@ func (s *Server) Router() *mux.Router {
 
 // handleIndex shows the dashboard
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
-	machines, err := s.db.ListMachines()
+	tags, err := models.NormalizeTags(r.URL.Query()["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Virtual machines are shown only when asked for
+	includeVirtual := r.URL.Query().Get("include_virtual") == "true"
+	filter := database.MachineFilter{Tags: tags}
+	if !includeVirtual {
+		virtual := false
+		filter.Virtual = &virtual
+	}
+
+	machines, err := s.db.ListMachineSummaries(filter)
 	if err != nil {
 		log.Printf("Error listing machines: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -56,26 +134,72 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 
 	// Calculate stats
 	stats := struct {
-		TotalMachines  int
-		EnrolledCount  int
-		ReadyCount     int
-		BuildingCount  int
-		Machines       []*models.Machine
+		TotalMachines     int
+		EnrolledCount     int
+		ReadyCount        int
+		BuildingCount     int
+		NoncompliantCount int
+		Machines          []*models.MachineSummary
+		AwaitingApproval  []*models.BuildRequest
+		Maintenance       maintenance.Summary
+		TagFilter         []string
+		Flash             *flash
+		Activity          []activityItem
+		ActivityRefresh   int
+		Storage           *models.StorageUsage
 	}{
-		TotalMachines: len(machines),
-		Machines:      machines,
+		Machines:        machines,
+		TagFilter:       tags,
+		Flash:           popFlash(w, r),
+		ActivityRefresh: activityRefreshSeconds,
 	}
 
-	for _, m := range machines {
-		switch m.Status {
-		case models.StatusEnrolled:
-			stats.EnrolledCount++
-		case models.StatusReady:
-			stats.ReadyCount++
-		case models.StatusBuilding:
-			stats.BuildingCount++
-		}
+	// Recent activity across the fleet; the page still renders without it
+	if activity, err := s.recentActivity(); err != nil {
+		log.Printf("Error listing events: %v", err)
+	} else {
+		stats.Activity = activity
+	}
+
+	// Disk usage of the images directory
+	if storage, err := s.service.StorageUsage(); err != nil {
+		log.Printf("Error reading storage usage: %v", err)
+	} else if storage.FilesystemBytes > 0 || storage.ArtifactBytes > 0 {
+		stats.Storage = storage
+	}
+
+	// Maintenance window banner
+	if windows, err := s.db.ListEnabledMaintenanceWindows(); err != nil {
+		log.Printf("Error listing maintenance windows: %v", err)
+	} else if len(windows) > 0 {
+		stats.Maintenance = maintenance.Summarize(windows, time.Now().UTC())
+	}
+
+	// Builds awaiting an admin's approval
+	if builds, err := s.db.ListBuilds(database.BuildFilter{Status: models.BuildStatusAwaitingApproval}); err != nil {
+		log.Printf("Error listing builds awaiting approval: %v", err)
+	} else {
+		stats.AwaitingApproval = builds
+	}
+
+	// The counts are of the whole fleet, whatever the tag filter.
+	// Decommissioned machines are listed but not counted.
+	now := time.Now()
+	counts, err := s.db.GetStats(database.StatsFilter{
+		IncludeVirtual: includeVirtual,
+		OfflineSince:   now.Add(-24 * time.Hour),
+		Since:          now.Add(-24 * time.Hour),
+	})
+	if err != nil {
+		log.Printf("Error counting machines: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
+	stats.TotalMachines = counts.Machines.Total
+	stats.EnrolledCount = counts.Machines.ByStatus[models.StatusEnrolled]
+	stats.ReadyCount = counts.Machines.ByStatus[models.StatusReady]
+	stats.BuildingCount = counts.Machines.ByStatus[models.StatusBuilding]
+	stats.NoncompliantCount = counts.Machines.HardwareNoncompliant
 
 	if err := s.templates["index"].Execute(w, stats); err != nil {
 		log.Printf("Error rendering template: %v", err)
@@ -100,10 +224,77 @@ func (s *Server) handleMachine(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	groups, err := s.db.GetMachineGroups(id)
+	if err != nil {
+		log.Printf("Error getting machine groups: %v", err)
+	}
+
+	lastBoot, err := s.db.GetLastBootRequest(id)
+	if err != nil {
+		log.Printf("Error getting last boot request: %v", err)
+	}
+
+	notes, err := s.db.ListMachineNotes(id)
+	if err != nil {
+		log.Printf("Error getting machine notes: %v", err)
+	}
+
+	attachments, err := s.db.ListMachineAttachments(id)
+	if err != nil {
+		log.Printf("Error getting machine attachments: %v", err)
+	}
+
+	diagnostics, err := s.db.ListDiagnosticRuns(id, machineDiagnosticsShown)
+	if err != nil {
+		log.Printf("Error getting machine diagnostics: %v", err)
+	}
+
+	schedules, err := s.db.ListMachineBuildSchedules(id)
+	if err != nil {
+		log.Printf("Error getting machine build schedules: %v", err)
+	}
+
+	provisioning, err := s.db.GetLatestProvisioningCycle(id)
+	if err != nil {
+		log.Printf("Error getting machine provisioning: %v", err)
+	}
+
+	// The page still renders if the iPXE server is slow or down
+	var bootPreview *models.BootRequest
+	var bootPreviewError string
+	if s.ipxe != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), bootPreviewTimeout)
+		bootPreview, err = s.ipxe.Preview(ctx, machine.ServiceTag, nil)
+		cancel()
+		if err != nil {
+			bootPreviewError = err.Error()
+		}
+	}
+
 	data := struct {
-		Machine *models.Machine
+		Machine          *models.Machine
+		Groups           []*models.MachineGroup
+		Notes            []*models.MachineNote
+		Attachments      []*models.MachineAttachment
+		Diagnostics      []*models.DiagnosticRun
+		Schedules        []*models.BuildSchedule
+		Provisioning     *models.ProvisioningCycle
+		LastBoot         *models.BootRequest
+		BootPreview      *models.BootRequest
+		BootPreviewError string
+		Flash            *flash
 	}{
-		Machine: machine,
+		Machine:          machine,
+		Groups:           groups,
+		Notes:            notes,
+		Attachments:      attachments,
+		Diagnostics:      diagnostics,
+		Schedules:        schedules,
+		Provisioning:     provisioning,
+		LastBoot:         lastBoot,
+		BootPreview:      bootPreview,
+		BootPreviewError: bootPreviewError,
+		Flash:            popFlash(w, r),
 	}
 
 	if err := s.templates["machine"].Execute(w, data); err != nil {
@@ -112,50 +303,91 @@ func (s *Server) handleMachine(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleUpdateMachine updates machine configuration
-func (s *Server) handleUpdateMachine(w http.ResponseWriter, r *http.Request) {
+// handleGroup shows a group's members and how they differ from each other
+func (s *Server) handleGroup(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	machine, err := s.db.GetMachine(id)
+	group, err := s.db.GetGroup(id)
 	if err != nil {
-		log.Printf("Error getting machine: %v", err)
+		log.Printf("Error getting group: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if machine == nil {
+	if group == nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	// Parse form
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Invalid form data", http.StatusBadRequest)
+	opts, err := drift.ParseOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Update fields
-	hostname := r.FormValue("hostname")
-	description := r.FormValue("description")
-	nixosConfig := r.FormValue("nixos_config")
+	report, err := drift.CheckGroup(s.db, id, opts)
+	if err != nil {
+		log.Printf("Error comparing group machines: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-	if hostname != "" {
-		machine.Hostname = hostname
+	machines, err := s.db.GetGroupMachines(id)
+	if err != nil {
+		log.Printf("Error getting group machines: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
-	if description != "" {
-		machine.Description = description
+
+	byID := make(map[string]*models.Machine, len(machines))
+	for _, m := range machines {
+		byID[m.ID] = m
 	}
-	if nixosConfig != "" {
-		machine.NixOSConfig = nixosConfig
-		machine.Status = models.StatusConfigured
+
+	data := struct {
+		Group    *models.MachineGroup
+		Machines []*models.Machine
+		ByID     map[string]*models.Machine
+		Drift    *models.GroupDrift
+	}{
+		Group:    group,
+		Machines: machines,
+		ByID:     byID,
+		Drift:    report,
 	}
 
-	if err := s.db.UpdateMachine(machine); err != nil {
-		log.Printf("Error updating machine: %v", err)
+	if err := s.templates["group"].Execute(w, data); err != nil {
+		log.Printf("Error rendering template: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// handleUpdateMachine updates machine configuration
+func (s *Server) handleUpdateMachine(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	patch := &models.Machine{
+		Hostname:    r.FormValue("hostname"),
+		Description: r.FormValue("description"),
+		NixOSConfig: r.FormValue("nixos_config"),
+	}
+	// The form always has the tags field, so an empty one clears them
+	if _, ok := r.Form["tags"]; ok {
+		patch.Tags = strings.Split(r.FormValue("tags"), ",")
+	}
+
+	machine, err := s.service.UpdateMachine(r.Context(), id, patch)
+	if err != nil {
+		s.serviceError(w, r, err)
 		return
 	}
+	setFlash(w, flashSuccess, "Saved "+machineName(machine))
 
 	// Redirect back to machine page
 	http.Redirect(w, r, "/machines/"+id, http.StatusSeeOther)
@@ -163,46 +395,95 @@ func (s *Server) handleUpdateMachine(w http.ResponseWriter, r *http.Request) {
 
 // handleBuildMachine triggers a build
 func (s *Server) handleBuildMachine(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+	id := mux.Vars(r)["id"]
 
-	machine, err := s.db.GetMachine(id)
+	build, err := s.service.TriggerBuild(r.Context(), id, service.BuildOptions{})
 	if err != nil {
-		log.Printf("Error getting machine: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		// Failures the user can act on are shown on the machine page
+		status, message := describeServiceError(err)
+		if status >= http.StatusInternalServerError || status == http.StatusNotFound {
+			s.serviceError(w, r, err)
+			return
+		}
+		setFlash(w, flashError, "Build not queued: "+message)
+		http.Redirect(w, r, "/machines/"+id, http.StatusSeeOther)
 		return
 	}
 
-	if machine == nil {
-		http.NotFound(w, r)
-		return
-	}
+	log.Printf("Build triggered for machine %s: build_id=%s", id, build.ID)
 
-	if machine.NixOSConfig == "" {
-		http.Error(w, "Machine has no configuration", http.StatusBadRequest)
-		return
+	name := id
+	if machine, err := s.db.GetMachine(id); err == nil && machine != nil {
+		name = machineName(machine)
 	}
-
-	// Create build request
-	build, err := s.db.CreateBuild(machine.ID, machine.NixOSConfig)
-	if err != nil {
-		log.Printf("Error creating build: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	if build.Status == models.BuildStatusAwaitingApproval {
+		setFlash(w, flashSuccess, fmt.Sprintf("Build %s… of %s awaits an admin's approval", shortID(build.ID), name))
+	} else {
+		setFlash(w, flashSuccess, fmt.Sprintf("Build %s… queued for %s", shortID(build.ID), name))
 	}
 
-	// Update machine status
-	machine.Status = models.StatusBuilding
-	machine.LastBuildID = &build.ID
-	now := time.Now()
-	machine.LastBuildTime = &now
+	// Redirect back to machine page
+	http.Redirect(w, r, "/machines/"+id, http.StatusSeeOther)
+}
 
-	if err := s.db.UpdateMachine(machine); err != nil {
-		log.Printf("Error updating machine: %v", err)
+// serviceError responds with why a service operation failed
+func (s *Server) serviceError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := describeServiceError(err)
+	switch status {
+	case http.StatusNotFound:
+		http.NotFound(w, r)
+		return
+	case http.StatusBadGateway:
+		log.Printf("Error validating configuration: %v", err)
+	case http.StatusInternalServerError:
+		log.Printf("Error handling %s %s: %v", r.Method, r.URL.Path, err)
 	}
+	http.Error(w, message, status)
+}
 
-	log.Printf("Build triggered for machine %s: build_id=%s", machine.ID, build.ID)
+// describeServiceError returns the status and message a service error is
+// shown with
+func describeServiceError(err error) (int, string) {
+	var invalidReq *service.InvalidError
+	var conflict *service.ConflictError
+	var blocked *service.MaintenanceError
+	var invalidConfig *fragments.InvalidError
+	var builderErr *fragments.BuilderError
+	var hostnameTaken *database.HostnameTakenError
+	var lintFailed *service.LintError
+	var quota *service.QuotaError
+	switch {
+	case errors.Is(err, service.ErrMachineNotFound):
+		return http.StatusNotFound, "Machine not found"
+	case errors.As(err, &invalidReq):
+		return http.StatusBadRequest, invalidReq.Message
+	case errors.As(err, &conflict):
+		return http.StatusConflict, conflict.Message
+	case errors.As(err, &hostnameTaken):
+		return http.StatusConflict, "Hostname " + hostnameTaken.Hostname + " is already used by machine " + hostnameTaken.ServiceTag +
+			" (" + hostnameTaken.MachineID + "); choose another hostname"
+	case errors.As(err, &blocked):
+		return http.StatusLocked, blocked.Message
+	case errors.As(err, &quota):
+		return http.StatusTooManyRequests, quota.Error()
+	case errors.Is(err, fragments.ErrNoConfiguration):
+		return http.StatusBadRequest, "Machine has no configuration"
+	case errors.As(err, &invalidConfig):
+		return http.StatusUnprocessableEntity, "Assembled configuration does not parse: " + invalidConfig.Message
+	case errors.As(err, &lintFailed):
+		return http.StatusUnprocessableEntity, "Build failed: " + lintFailed.Result.Summary()
+	case errors.As(err, &builderErr):
+		return http.StatusBadGateway, "Failed to validate configuration with the builder"
+	default:
+		return http.StatusInternalServerError, "Internal server error"
+	}
+}
 
-	// Redirect back to machine page
-	http.Redirect(w, r, "/machines/"+id, http.StatusSeeOther)
+// machineName returns the name a machine is shown by in messages: its
+// hostname, or its service tag if it has none
+func machineName(machine *models.Machine) string {
+	if machine.Hostname != "" {
+		return machine.Hostname
+	}
+	return machine.ServiceTag
 }
@@ -0,0 +1,96 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/testutil"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/web"
+)
+
+// sparseHardware is what the minimal registration environment reports when
+// it fails to collect some of the inventory, by what it lacks
+var sparseHardware = []struct {
+	name     string
+	hardware func(serviceTag string) models.HardwareInfo
+	missing  []string
+}{
+	{"nothing", func(string) models.HardwareInfo { return models.HardwareInfo{} }, models.HardwareFields},
+	{"disks", func(serviceTag string) models.HardwareInfo {
+		h := testutil.FixtureHardware(serviceTag)
+		h.Disks = nil
+		return h
+	}, []string{"disks"}},
+	{"cpu and memory", func(serviceTag string) models.HardwareInfo {
+		h := testutil.FixtureHardware(serviceTag)
+		h.CPU = models.CPUInfo{}
+		h.Memory = models.MemoryInfo{}
+		return h
+	}, []string{"cpu.model", "cpu.cores", "memory", "memory.modules"}},
+}
+
+// zeroHardware matches a hardware summary with zeros for what it doesn't
+// know
+var zeroHardware = regexp.MustCompile(`\b0 (GB RAM|disk\(s\))`)
+
+// render returns a dashboard page, failing the test unless it is served
+func render(t *testing.T, dashboard *web.Server, path string) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	dashboard.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", path, rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+// TestSparseHardwareRendering renders the machine list, the machine page,
+// and a group's page for machines with parts of their inventory missing,
+// which say what is unknown rather than showing zeros
+func TestSparseHardwareRendering(t *testing.T) {
+	env := testutil.New(t)
+	dashboard := web.NewServer(env.DB, env.API.Service(), "")
+
+	for _, tt := range sparseHardware {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceTag := "SPARSE-" + strings.ReplaceAll(strings.ToUpper(tt.name), " ", "-")
+			machine := env.EnrollMachineWith(serviceTag, tt.hardware(serviceTag))
+			group := env.CreateGroup("sparse-" + strings.ReplaceAll(tt.name, " ", "-"))
+			env.MustJSON(models.RoleOperator, http.MethodPut, "/api/v1/groups/"+group.ID+"/machines/"+machine.ID, nil, http.StatusNoContent, nil)
+
+			var got models.Machine
+			env.MustJSON(models.RoleViewer, http.MethodGet, "/api/v1/machines/"+machine.ID, nil, http.StatusOK, &got)
+			if got.HardwareCompleteness == nil || strings.Join(got.HardwareCompleteness.Missing, ",") != strings.Join(tt.missing, ",") {
+				t.Errorf("hardware completeness = %+v, want %v missing", got.HardwareCompleteness, tt.missing)
+			}
+
+			for _, path := range []string{"/", "/groups/" + group.ID} {
+				page := render(t, dashboard, path)
+				if zeroHardware.MatchString(page) {
+					t.Errorf("GET %s shows zeros for hardware it doesn't know", path)
+				}
+			}
+
+			page := render(t, dashboard, "/machines/"+machine.ID)
+			if !strings.Contains(page, "Incomplete hardware inventory") {
+				t.Fatalf("machine page has no incomplete inventory banner")
+			}
+			for _, field := range tt.missing {
+				if !strings.Contains(page, field) {
+					t.Errorf("banner doesn't name %s", field)
+				}
+			}
+		})
+	}
+
+	// A machine with all of its inventory has no banner
+	machine := env.EnrollMachine("COMPLETE01")
+	if page := render(t, dashboard, "/machines/"+machine.ID); strings.Contains(page, "Incomplete hardware inventory") {
+		t.Error("complete machine's page has the incomplete inventory banner")
+	}
+}
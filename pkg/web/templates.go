@@ -20,6 +20,11 @@ const indexTemplate = `<!DOCTYPE html>
             box-shadow: 0 2px 4px rgba(0,0,0,0.1);
         }
         .header h1 { font-size: 1.5rem; }
+        .header-links {
+            margin-top: 0.5rem;
+            font-size: 0.875rem;
+        }
+        .header-links a { color: #3498db; text-decoration: none; }
         .container {
             max-width: 1400px;
             margin: 2rem auto;
@@ -49,6 +54,17 @@ const indexTemplate = `<!DOCTYPE html>
             font-weight: bold;
             color: #2c3e50;
         }
+        .stat-card .detail {
+            font-size: 0.875rem;
+            color: #666;
+            margin-top: 0.25rem;
+        }
+        .stat-card.warning {
+            border-left: 4px solid #e74c3c;
+        }
+        .stat-card.warning .value {
+            color: #e74c3c;
+        }
         .machines-table {
             background: white;
             border-radius: 8px;
@@ -98,6 +114,12 @@ const indexTemplate = `<!DOCTYPE html>
         .status-ready { background: #e8f5e9; color: #388e3c; }
         .status-provisioned { background: #f3e5f5; color: #7b1fa2; }
         .status-failed { background: #ffebee; color: #d32f2f; }
+        .status-decommissioned { background: #eceff1; color: #607d8b; }
+        .status-wiping { background: #fce4ec; color: #c2185b; }
+        .status-conflict { background: #fff8e1; color: #ff8f00; }
+        .power-on { background: #e8f5e9; color: #388e3c; }
+        .power-off { background: #eceff1; color: #607d8b; }
+        .power-unknown { background: #f5f5f5; color: #9e9e9e; }
         .btn {
             padding: 0.5rem 1rem;
             border: none;
@@ -134,14 +156,86 @@ const indexTemplate = `<!DOCTYPE html>
             font-size: 0.875rem;
             color: #666;
         }
+        .tag-chip {
+            display: inline-block;
+            padding: 0.1rem 0.5rem;
+            margin: 0.25rem 0.25rem 0 0;
+            border-radius: 10px;
+            background: #ecf0f1;
+            color: #2c3e50;
+            font-size: 0.75rem;
+            text-decoration: none;
+        }
+        .tag-chip:hover {
+            background: #bdc3c7;
+        }
+        .tag-filter {
+            margin-bottom: 1rem;
+            font-size: 0.875rem;
+        }
+        .maintenance-banner {
+            padding: 1rem 1.5rem;
+            border-radius: 8px;
+            margin-bottom: 2rem;
+            font-size: 0.875rem;
+        }
+        .maintenance-active { background: #e8f5e9; color: #2e7d32; border: 1px solid #a5d6a7; }
+        .maintenance-closed { background: #fff3e0; color: #e65100; border: 1px solid #ffcc80; }
+        .flash {
+            padding: 1rem 1.5rem;
+            border-radius: 8px;
+            margin-bottom: 2rem;
+            font-size: 0.875rem;
+        }
+        .flash-success { background: #e8f5e9; color: #2e7d32; border: 1px solid #a5d6a7; }
+        .flash-error { background: #ffebee; color: #c62828; border: 1px solid #ef9a9a; }
+        .activity-list { list-style: none; }
+        .activity-list li {
+            display: flex;
+            gap: 0.75rem;
+            align-items: baseline;
+            padding: 0.75rem 1.5rem;
+            font-size: 0.875rem;
+        }
+        .activity-list li:not(:last-child) { border-bottom: 1px solid #f0f0f0; }
+        .activity-list .activity-text { flex: 1; }
+        .activity-list time { color: #999; white-space: nowrap; }
+        .event-badge {
+            display: inline-block;
+            padding: 0.1rem 0.5rem;
+            border-radius: 10px;
+            font-size: 0.75rem;
+            font-family: monospace;
+            white-space: nowrap;
+        }
+        .event-info { background: #e3f2fd; color: #1976d2; }
+        .event-success { background: #e8f5e9; color: #388e3c; }
+        .event-error { background: #ffebee; color: #d32f2f; }
     </style>
 </head>
 <body>
     <div class="header">
         <h1>⚙️ Metal Enrollment Dashboard</h1>
+        <div class="header-links">
+            <a href="/claim">Claim Machine</a> ·
+            <a href="/admin/boot-profiles">Boot Profiles</a>
+        </div>
     </div>
 
     <div class="container">
+        {{template "flash" .Flash}}
+        {{if .Maintenance.Active}}
+        <div class="maintenance-banner maintenance-active">
+            <strong>Maintenance window open:</strong>
+            {{range $i, $p := .Maintenance.Active}}{{if $i}}, {{end}}{{$p.Window.Name}} until {{$p.End.Format "2006-01-02 15:04 MST"}}{{end}}
+        </div>
+        {{else if .Maintenance.Next}}
+        <div class="maintenance-banner maintenance-closed">
+            <strong>Outside maintenance windows:</strong>
+            builds and power operations may be locked. Next window is {{.Maintenance.Next.Window.Name}}
+            at {{.Maintenance.Next.Start.Format "2006-01-02 15:04 MST"}}.
+        </div>
+        {{end}}
         <div class="stats">
             <div class="stat-card">
                 <h3>Total Machines</h3>
@@ -159,11 +253,83 @@ const indexTemplate = `<!DOCTYPE html>
                 <h3>Building</h3>
                 <div class="value">{{.BuildingCount}}</div>
             </div>
+            {{if .NoncompliantCount}}
+            <div class="stat-card">
+                <h3>Hardware Noncompliant</h3>
+                <div class="value">{{.NoncompliantCount}}</div>
+            </div>
+            {{end}}
+            {{if .AwaitingApproval}}
+            <div class="stat-card">
+                <h3>Awaiting Approval</h3>
+                <div class="value">{{len .AwaitingApproval}}</div>
+            </div>
+            {{end}}
+            {{with .Storage}}
+            <div class="stat-card{{if .AboveAlert}} warning{{end}}">
+                <h3>Images Storage</h3>
+                {{if .FilesystemBytes}}
+                <div class="value">{{printf "%.0f" .UsedPercent}}%</div>
+                <div class="detail">{{formatBytes .FilesystemFreeBytes}} free of {{formatBytes .FilesystemBytes}}</div>
+                {{else}}
+                <div class="value">{{formatBytes .ArtifactBytes}}</div>
+                {{end}}
+                <div class="detail">{{formatBytes .ArtifactBytes}} of artifacts{{if .AboveAlert}}, past the {{.AlertPercent}}% alert{{end}}</div>
+            </div>
+            {{end}}
+        </div>
+
+        {{if .AwaitingApproval}}
+        <div class="machines-table">
+            <div class="table-header">
+                <h2>Builds Awaiting Approval</h2>
+            </div>
+            <table>
+                <thead>
+                    <tr>
+                        <th>Build</th>
+                        <th>Machine</th>
+                        <th>Priority</th>
+                        <th>Requested By</th>
+                        <th>Requested</th>
+                    </tr>
+                </thead>
+                <tbody>
+                    {{range .AwaitingApproval}}
+                    <tr>
+                        <td><code>{{.ID}}</code></td>
+                        <td><a href="/machines/{{.MachineID}}">{{.MachineID}}</a></td>
+                        <td>{{.Priority}}</td>
+                        <td>{{if .RequestedBy}}{{.RequestedBy}}{{else}}<em>Unknown</em>{{end}}</td>
+                        <td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td>
+                    </tr>
+                    {{end}}
+                </tbody>
+            </table>
+            <div class="empty-state">
+                <p>Admins approve or reject builds with <code>POST /api/v1/builds/&lt;id&gt;/approve</code> or <code>/reject</code>.</p>
+            </div>
+        </div>
+        {{end}}
+
+        <div class="machines-table" style="margin-bottom: 2rem;">
+            <div class="table-header">
+                <h2>Recent Activity</h2>
+            </div>
+            <div id="activity" data-refresh="{{.ActivityRefresh}}">
+                {{template "activity" .Activity}}
+            </div>
         </div>
 
         <div class="machines-table">
             <div class="table-header">
                 <h2>Enrolled Machines</h2>
+                {{if .TagFilter}}
+                <div class="tag-filter">
+                    Tagged {{range .TagFilter}}<span class="tag-chip">{{.}}</span>{{end}}
+                    <a href="/">Clear</a>
+                </div>
+                {{end}}
             </div>
             {{if .Machines}}
             <table>
@@ -173,6 +339,7 @@ const indexTemplate = `<!DOCTYPE html>
                         <th>Hostname</th>
                         <th>Hardware</th>
                         <th>Status</th>
+                        <th>Power</th>
                         <th>Enrolled</th>
                         <th>Actions</th>
                     </tr>
@@ -181,17 +348,21 @@ const indexTemplate = `<!DOCTYPE html>
                     {{range .Machines}}
                     <tr>
                         <td><strong>{{.ServiceTag}}</strong></td>
-                        <td>{{if .Hostname}}{{.Hostname}}{{else}}<em>Not set</em>{{end}}</td>
+                        <td>
+                            {{if .Hostname}}{{.Hostname}}{{else}}<em>Not set</em>{{end}}{{if .CurrentIP}}<br><small{{with .CurrentIPUpdatedAt}} title="as of {{.Format "2006-01-02 15:04"}}"{{end}}>{{.CurrentIP}}</small>{{end}}
+                            {{if .Tags}}<br>{{range .Tags}}<a href="{{tagFilterURL $.TagFilter .}}" class="tag-chip">{{.}}</a>{{end}}{{end}}
+                        </td>
                         <td class="hardware-summary">
-                            {{.Hardware.CPU.Model}}<br>
-                            <small>{{.Hardware.Memory.TotalGB}} GB RAM • {{len .Hardware.Disks}} disk(s)</small>
+                            {{if .CPUModel}}{{.CPUModel}}{{else}}<em>CPU unknown</em>{{end}}<br>
+                            <small>{{if .MemoryGB}}{{.MemoryGB}} GB RAM{{else}}RAM unknown{{end}} • {{if .DiskCount}}{{.DiskCount}} disk(s){{else}}disks unknown{{end}}</small>
                         </td>
-                        <td><span class="status-badge status-{{.Status}}">{{.Status}}</span></td>
+                        <td><span class="status-badge status-{{.Status}}">{{.Status}}</span>{{if .StaleBuild}}<br><small title="The configuration changed since the last build">stale build</small>{{end}}</td>
+                        <td><span class="status-badge power-{{.PowerState}}"{{with .PowerStateUpdatedAt}} title="as of {{.Format "2006-01-02 15:04"}}"{{end}}>{{.PowerState}}</span></td>
                         <td>{{.EnrolledAt.Format "2006-01-02"}}</td>
                         <td>
                             <div class="actions">
                                 <a href="/machines/{{.ID}}" class="btn btn-secondary">View</a>
-                                {{if .NixOSConfig}}
+                                {{if and .HasConfig .CanProvision}}
                                 <a href="/machines/{{.ID}}/build" class="btn btn-primary">Build</a>
                                 {{end}}
                             </div>
@@ -207,6 +378,20 @@ const indexTemplate = `<!DOCTYPE html>
             {{end}}
         </div>
     </div>
+    <script>
+        // Keep the recent activity panel current without reloading the page
+        (function() {
+            var panel = document.getElementById('activity');
+            var seconds = parseInt(panel.dataset.refresh, 10);
+            setInterval(function() {
+                if (document.hidden) return;
+                fetch('/activity', {cache: 'no-store'})
+                    .then(function(resp) { return resp.ok ? resp.text() : null; })
+                    .then(function(html) { if (html !== null) panel.innerHTML = html; })
+                    .catch(function() {});
+            }, seconds * 1000);
+        })();
+    </script>
 </body>
 </html>`
 
@@ -348,6 +533,78 @@ const machineTemplate = `<!DOCTYPE html>
         .status-configured { background: #fff3e0; color: #f57c00; }
         .status-building { background: #fce4ec; color: #c2185b; }
         .status-ready { background: #e8f5e9; color: #388e3c; }
+        .status-decommissioned { background: #eceff1; color: #607d8b; }
+        .status-wiping { background: #fce4ec; color: #c2185b; }
+        .status-conflict { background: #fff8e1; color: #ff8f00; }
+        .tag-chip {
+            display: inline-block;
+            padding: 0.1rem 0.5rem;
+            margin: 0.25rem 0.25rem 0 0;
+            border-radius: 10px;
+            background: #ecf0f1;
+            color: #2c3e50;
+            font-size: 0.75rem;
+            text-decoration: none;
+        }
+        .tag-chip:hover {
+            background: #bdc3c7;
+        }
+        .boot-script {
+            margin-top: 1rem;
+            padding: 1rem;
+            background: #f8f9fa;
+            border-radius: 4px;
+            font-family: 'Monaco', 'Menlo', 'Ubuntu Mono', monospace;
+            font-size: 0.8rem;
+            white-space: pre-wrap;
+            overflow-x: auto;
+        }
+        .boot-error { color: #c0392b; }
+        .note {
+            padding: 1rem 0;
+            border-bottom: 1px solid #eee;
+        }
+        .note:last-child { border-bottom: none; }
+        .note-meta {
+            font-size: 0.75rem;
+            color: #7f8c8d;
+            margin-bottom: 0.5rem;
+        }
+        .note-body { white-space: pre-wrap; }
+        .lint-findings {
+            list-style: none;
+            margin-bottom: 1.5rem;
+        }
+        .lint-findings li {
+            padding: 0.5rem 0.75rem;
+            margin-bottom: 0.5rem;
+            border-left: 4px solid;
+            border-radius: 4px;
+            font-size: 0.875rem;
+        }
+        .lint-error { background: #fdecea; border-color: #c0392b; }
+        .lint-warning { background: #fff8e1; border-color: #ff8f00; }
+        .lint-meta {
+            font-size: 0.75rem;
+            color: #7f8c8d;
+        }
+        .hardware-banner {
+            padding: 1rem 1.5rem;
+            border-radius: 8px;
+            margin-bottom: 2rem;
+            font-size: 0.875rem;
+            background: #fff3e0;
+            color: #e65100;
+            border: 1px solid #ffcc80;
+        }
+        .flash {
+            padding: 1rem 1.5rem;
+            border-radius: 8px;
+            margin-bottom: 2rem;
+            font-size: 0.875rem;
+        }
+        .flash-success { background: #e8f5e9; color: #2e7d32; border: 1px solid #a5d6a7; }
+        .flash-error { background: #ffebee; color: #c62828; border: 1px solid #ef9a9a; }
     </style>
 </head>
 <body>
@@ -359,6 +616,59 @@ const machineTemplate = `<!DOCTYPE html>
     </div>
 
     <div class="container">
+        {{template "flash" .Flash}}
+        {{if ne .Machine.Status "preregistered"}}{{with .Machine.HardwareCompleteness}}{{if not .Complete}}
+        <div class="hardware-banner">
+            <strong>Incomplete hardware inventory ({{.Score}}%):</strong>
+            the machine didn't report {{range $i, $f := .Missing}}{{if $i}}, {{end}}{{$f}}{{end}}.
+            Templates that require or use these fields can't be applied to it.
+            {{with $.Machine.HardwareRefreshRequestedAt}}A hardware refresh was requested at {{.Format "2006-01-02 15:04"}}; the machine boots the registration image to collect its inventory again.{{else}}Refresh its hardware to boot it into the registration image and collect its inventory again.{{end}}
+        </div>
+        {{end}}{{end}}{{end}}
+        {{if .Machine.StaleBuild}}
+        <div class="hardware-banner">
+            <strong>Configuration changed since the last build:</strong>
+            the configuration was changed{{with .Machine.ConfigUpdatedAt}} at {{.Format "2006-01-02 15:04"}}{{end}}, after build <code>{{.Machine.LastBuildID}}</code> was queued, so the image the machine boots doesn't have the change.
+            Rebuild the machine to apply it.
+        </div>
+        {{end}}
+        {{if and (ne .Machine.Status "decommissioned") (not .Machine.EffectiveOwnership.HasOwner)}}
+        <div class="hardware-banner">
+            <strong>No owner:</strong>
+            neither the machine nor its groups name an owner team or contact email, so nobody is escalated to when it fails.
+        </div>
+        {{end}}
+        {{with .Machine.EffectiveOwnership}}
+        <div class="card">
+            <div class="card-header">
+                <h2>Ownership</h2>
+                {{with .Environment}}<span class="status-badge">{{.}}</span>{{end}}
+            </div>
+            <div class="card-body">
+                <div class="info-grid">
+                    {{if .Team}}
+                    <div class="info-item">
+                        <label>Owner Team</label>
+                        <div class="value">{{.Team}}</div>
+                    </div>
+                    {{end}}
+                    {{if .ContactEmail}}
+                    <div class="info-item">
+                        <label>Contact</label>
+                        <div class="value"><a href="mailto:{{.ContactEmail}}">{{.ContactEmail}}</a></div>
+                    </div>
+                    {{end}}
+                    {{if .SlackChannel}}
+                    <div class="info-item">
+                        <label>Escalation Channel</label>
+                        <div class="value">{{.SlackChannel}}</div>
+                    </div>
+                    {{end}}
+                </div>
+                <small>Fields the machine doesn't set are inherited from its groups.</small>
+            </div>
+        </div>
+        {{end}}
         <div class="card">
             <div class="card-header">
                 <h2>Machine Information</h2>
@@ -374,6 +684,12 @@ const machineTemplate = `<!DOCTYPE html>
                         <label>MAC Address</label>
                         <div class="value">{{.Machine.MACAddress}}</div>
                     </div>
+                    {{if .Machine.CurrentIP}}
+                    <div class="info-item">
+                        <label>Current IP</label>
+                        <div class="value">{{.Machine.CurrentIP}}{{with .Machine.CurrentIPUpdatedAt}} <small>as of {{.Format "2006-01-02 15:04"}}</small>{{end}}</div>
+                    </div>
+                    {{end}}
                     <div class="info-item">
                         <label>Enrolled At</label>
                         <div class="value">{{.Machine.EnrolledAt.Format "2006-01-02 15:04"}}</div>
@@ -384,7 +700,157 @@ const machineTemplate = `<!DOCTYPE html>
                         <div class="value">{{.Machine.LastSeenAt.Format "2006-01-02 15:04"}}</div>
                     </div>
                     {{end}}
+                    <div class="info-item">
+                        <label>Power</label>
+                        <div class="value">{{.Machine.PowerState}}{{with .Machine.PowerStateUpdatedAt}} <small>as of {{.Format "2006-01-02 15:04"}}</small>{{end}}</div>
+                    </div>
+                    {{if .Machine.Tags}}
+                    <div class="info-item">
+                        <label>Tags</label>
+                        <div class="value">{{range .Machine.Tags}}<a href="{{tagFilterURL nil .}}" class="tag-chip">{{.}}</a>{{end}}</div>
+                    </div>
+                    {{end}}
+                    {{if .Groups}}
+                    <div class="info-item">
+                        <label>Groups</label>
+                        <div class="value">{{range .Groups}}<a href="/groups/{{.ID}}" class="tag-chip">{{.Name}}</a>{{end}}</div>
+                    </div>
+                    {{end}}
+                    {{with .Machine.Location}}
+                    <div class="info-item">
+                        <label>Location</label>
+                        <div class="value">{{.Datacenter}}{{if .Rack}} rack {{.Rack}}{{end}}{{if .RackUnit}} U{{.RackUnit}}{{end}}</div>
+                    </div>
+                    {{end}}
+                </div>
+            </div>
+        </div>
+
+        {{if or .Notes .Attachments}}
+        <div class="card">
+            <div class="card-header">
+                <h2>Notes</h2>
+            </div>
+            <div class="card-body">
+                {{range .Notes}}
+                <div class="note">
+                    <div class="note-meta">{{if .Author}}{{.Author}}, {{end}}{{.CreatedAt.Format "2006-01-02 15:04"}}{{if .UpdatedAt}} (edited {{.UpdatedAt.Format "2006-01-02 15:04"}}){{end}}</div>
+                    <div class="note-body">{{.Body}}</div>
+                </div>
+                {{end}}
+                {{if .Attachments}}
+                <h3 style="margin: 2rem 0 1rem;">Attachments</h3>
+                <ul class="hardware-list">
+                    {{range .Attachments}}
+                    <li>
+                        <strong>{{.Filename}}</strong>
+                        <small>{{.ContentType}} • {{.Size}} bytes • {{if .UploadedBy}}{{.UploadedBy}}, {{end}}{{.CreatedAt.Format "2006-01-02 15:04"}}</small>
+                    </li>
+                    {{end}}
+                </ul>
+                {{end}}
+            </div>
+        </div>
+        {{end}}
+
+        {{if .Diagnostics}}
+        <div class="card">
+            <div class="card-header">
+                <h2>Diagnostics</h2>
+            </div>
+            <div class="card-body">
+                <ul class="hardware-list">
+                    {{range .Diagnostics}}
+                    <li>
+                        <strong>{{.ProfileName}}</strong>: {{.Status}}{{with .Results}} ({{if .Passed}}passed{{else}}failed{{end}}){{end}}
+                        <small>{{.CreatedAt.Format "2006-01-02 15:04"}}{{if .RequestedBy}} by {{.RequestedBy}}{{end}}{{if .CompletedAt}}, ended {{.CompletedAt.Format "2006-01-02 15:04"}}{{else}}, until {{.EndsAt.Format "2006-01-02 15:04"}}{{end}}</small>
+                        {{with .Results}}{{if .Memtest}}<br><small>memtest: {{.Memtest}}</small>{{end}}{{if .Stress}}<br><small>stress: {{.Stress}}</small>{{end}}{{end}}
+                    </li>
+                    {{end}}
+                </ul>
+            </div>
+        </div>
+        {{end}}
+
+        {{with .Provisioning}}
+        <div class="card">
+            <div class="card-header">
+                <h2>Provisioning</h2>
+            </div>
+            <div class="card-body">
+                <p>Build <code>{{.BuildID}}</code>: {{.Status}} <small>started {{.StartedAt.Format "2006-01-02 15:04"}}{{if .FinishedAt}}, ended {{.FinishedAt.Format "2006-01-02 15:04"}}{{end}}</small></p>
+                <ul class="hardware-list">
+                    {{range .Runs}}
+                    <li>
+                        <strong>{{.Hook.Name}}</strong> ({{.Hook.Type}}{{if .Hook.Optional}}, optional{{end}}): {{.Status}}
+                        <small>{{.Attempts}} attempts, {{.Hook.Retries}} retries{{with .ExitCode}}, exit code {{.}}{{end}}{{with .Error}}: {{.}}{{end}}</small>
+                        {{if .Log}}<pre class="boot-script">{{.Log}}</pre>{{end}}
+                    </li>
+                    {{end}}
+                </ul>
+            </div>
+        </div>
+        {{end}}
+
+        {{if .Schedules}}
+        <div class="card">
+            <div class="card-header">
+                <h2>Build Schedules</h2>
+            </div>
+            <div class="card-body">
+                <ul class="hardware-list">
+                    {{range .Schedules}}
+                    <li>
+                        <strong>{{if eq .Scope "group"}}Group schedule{{else}}Machine schedule{{end}}</strong>: <code>{{.Cron}}</code> ({{.Timezone}}), {{.Mode}}{{if .SkipUnchanged}}, skips unchanged{{end}}
+                        <small>{{if not .Enabled}}disabled{{else if .NextRunAt}}next build {{.NextRunAt.Format "2006-01-02 15:04 MST"}}{{else}}no further runs{{end}}{{if .LastRunAt}}, last ran {{.LastRunAt.Format "2006-01-02 15:04 MST"}}{{end}}</small>
+                    </li>
+                    {{end}}
+                </ul>
+            </div>
+        </div>
+        {{end}}
+
+        <div class="card">
+            <div class="card-header">
+                <h2>Network Boot</h2>
+            </div>
+            <div class="card-body">
+                <h3 style="margin-bottom: 1rem;">Last Boot Request</h3>
+                {{if .LastBoot}}
+                <div class="info-grid">
+                    <div class="info-item">
+                        <label>Requested At</label>
+                        <div class="value">{{.LastBoot.RequestedAt.Format "2006-01-02 15:04:05"}}</div>
+                    </div>
+                    <div class="info-item">
+                        <label>Client IP</label>
+                        <div class="value">{{.LastBoot.ClientIP}}</div>
+                    </div>
+                    <div class="info-item">
+                        <label>Served</label>
+                        <div class="value">{{.LastBoot.Decision}} ({{.LastBoot.Flavor}}, {{.LastBoot.Arch}})</div>
+                    </div>
+                    {{if .LastBoot.ArtifactsVersion}}
+                    <div class="info-item">
+                        <label>Build</label>
+                        <div class="value">{{.LastBoot.ArtifactsVersion}}</div>
+                    </div>
+                    {{end}}
                 </div>
+                <p style="margin-top: 1rem;"><small>{{.LastBoot.Reason}}</small></p>
+                {{else}}
+                <p><small>No network boot recorded.</small></p>
+                {{end}}
+
+                {{if .BootPreview}}
+                <h3 style="margin: 2rem 0 1rem;">Boot Script Now</h3>
+                <p><strong>{{.BootPreview.Decision}}</strong>: {{.BootPreview.Reason}}</p>
+                {{if .BootPreview.Script}}<pre class="boot-script">{{.BootPreview.Script}}</pre>{{end}}
+                {{if .BootPreview.Redirect}}<p style="margin-top: 1rem;"><small>Redirects to {{.BootPreview.Redirect}}</small></p>{{end}}
+                {{else if .BootPreviewError}}
+                <h3 style="margin: 2rem 0 1rem;">Boot Script Now</h3>
+                <p class="boot-error">{{.BootPreviewError}}</p>
+                {{end}}
             </div>
         </div>
 
@@ -449,6 +915,18 @@ const machineTemplate = `<!DOCTYPE html>
                 <h2>Configuration</h2>
             </div>
             <div class="card-body">
+                {{with .Machine.ConfigLint}}
+                {{if .Findings}}
+                <ul class="lint-findings">
+                    {{range .Findings}}
+                    <li class="lint-{{.Severity}}">
+                        <strong>{{.Severity}}</strong> {{.Message}}
+                        <div class="lint-meta">{{.Rule}}{{if .Line}} • line {{.Line}}{{end}}</div>
+                    </li>
+                    {{end}}
+                </ul>
+                {{end}}
+                {{end}}
                 <form method="POST" action="/machines/{{.Machine.ID}}/update">
                     <div class="form-group">
                         <label for="hostname">Hostname</label>
@@ -460,6 +938,11 @@ const machineTemplate = `<!DOCTYPE html>
                         <input type="text" id="description" name="description" value="{{.Machine.Description}}" placeholder="Production web server">
                     </div>
 
+                    <div class="form-group">
+                        <label for="tags">Tags</label>
+                        <input type="text" id="tags" name="tags" value="{{range $i, $t := .Machine.Tags}}{{if $i}}, {{end}}{{$t}}{{end}}" placeholder="gpu, dc1-row3">
+                    </div>
+
                     <div class="form-group">
                         <label for="nixos_config">NixOS Configuration</label>
                         <textarea id="nixos_config" name="nixos_config" placeholder="# Enter NixOS configuration here...">{{.Machine.NixOSConfig}}</textarea>
@@ -472,3 +955,785 @@ const machineTemplate = `<!DOCTYPE html>
     </div>
 </body>
 </html>`
+
+const groupTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Group.Name}} - Metal Enrollment</title>
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif;
+            background: #f5f5f5;
+            color: #333;
+        }
+        .header {
+            background: #2c3e50;
+            color: white;
+            padding: 1.5rem 2rem;
+            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+        }
+        .header h1 { font-size: 1.5rem; }
+        .breadcrumb {
+            margin-top: 0.5rem;
+            font-size: 0.875rem;
+        }
+        .breadcrumb a { color: #3498db; text-decoration: none; }
+        .container {
+            max-width: 1200px;
+            margin: 2rem auto;
+            padding: 0 2rem;
+        }
+        .card {
+            background: white;
+            border-radius: 8px;
+            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+            margin-bottom: 1.5rem;
+            overflow: hidden;
+        }
+        .card-header {
+            padding: 1.5rem;
+            border-bottom: 1px solid #e0e0e0;
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+        }
+        .card-header h2 { font-size: 1.25rem; }
+        .card-body {
+            padding: 1.5rem;
+        }
+        .summary {
+            margin-bottom: 1rem;
+            font-size: 0.875rem;
+            color: #666;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+        th, td {
+            padding: 0.75rem 1rem;
+            text-align: left;
+            font-size: 0.875rem;
+            vertical-align: top;
+        }
+        th {
+            background: #f8f9fa;
+            font-weight: 600;
+            color: #666;
+            text-transform: uppercase;
+            letter-spacing: 0.5px;
+            font-size: 0.75rem;
+        }
+        tr:not(:last-child) td {
+            border-bottom: 1px solid #f0f0f0;
+        }
+        td a { color: #2c3e50; }
+        code {
+            font-family: 'Monaco', 'Menlo', 'Ubuntu Mono', monospace;
+            font-size: 0.8rem;
+        }
+        .expected { color: #388e3c; }
+        .actual { color: #d32f2f; }
+        .no-drift { color: #388e3c; font-weight: 600; }
+        .status-badge {
+            display: inline-block;
+            padding: 0.25rem 0.75rem;
+            border-radius: 12px;
+            font-size: 0.75rem;
+            font-weight: 600;
+            text-transform: uppercase;
+        }
+        .status-enrolled { background: #e3f2fd; color: #1976d2; }
+        .status-configured { background: #fff3e0; color: #f57c00; }
+        .status-building { background: #fce4ec; color: #c2185b; }
+        .status-ready { background: #e8f5e9; color: #388e3c; }
+        .status-provisioned { background: #f3e5f5; color: #7b1fa2; }
+        .status-failed { background: #ffebee; color: #d32f2f; }
+        .status-decommissioned { background: #eceff1; color: #607d8b; }
+        .status-wiping { background: #fce4ec; color: #c2185b; }
+        .status-conflict { background: #fff8e1; color: #ff8f00; }
+    </style>
+</head>
+<body>
+    <div class="header">
+        <h1>{{.Group.Name}}</h1>
+        <div class="breadcrumb">
+            <a href="/">← Back to Dashboard</a>
+        </div>
+    </div>
+
+    <div class="container">
+        <div class="card">
+            <div class="card-header">
+                <h2>Drift</h2>
+            </div>
+            <div class="card-body">
+                {{if not .Drift.MachineCount}}
+                <p class="summary">This group has no machines.</p>
+                {{else}}
+                <p class="summary">
+                    {{.Drift.MachineCount}} machine(s) in {{len .Drift.Clusters}} configuration cluster(s).
+                    {{if .Drift.Outliers}}{{len .Drift.Outliers}} machine(s) differ from the rest of the group.{{else}}<span class="no-drift">No drift.</span>{{end}}
+                </p>
+
+                <table>
+                    <thead>
+                        <tr>
+                            <th>Configuration</th>
+                            <th>Machines</th>
+                        </tr>
+                    </thead>
+                    <tbody>
+                        {{range .Drift.Clusters}}
+                        <tr>
+                            <td>{{if .Fingerprint}}<code>{{.Fingerprint}}</code>{{else}}<em>No configuration</em>{{end}}</td>
+                            <td>{{range $i, $id := .MachineIDs}}{{if $i}}, {{end}}{{with index $.ByID $id}}<a href="/machines/{{.ID}}">{{.ServiceTag}}</a>{{end}}{{end}}</td>
+                        </tr>
+                        {{end}}
+                    </tbody>
+                </table>
+                {{end}}
+            </div>
+        </div>
+
+        {{if .Drift.Outliers}}
+        <div class="card">
+            <div class="card-header">
+                <h2>Outliers</h2>
+            </div>
+            <div class="card-body">
+                <table>
+                    <thead>
+                        <tr>
+                            <th>Machine</th>
+                            <th>Field</th>
+                            <th>Most Machines</th>
+                            <th>This Machine</th>
+                        </tr>
+                    </thead>
+                    <tbody>
+                        {{range .Drift.Outliers}}
+                        {{$outlier := .}}
+                        {{range $i, $d := .Differences}}
+                        <tr>
+                            <td>{{if not $i}}<a href="/machines/{{$outlier.MachineID}}">{{$outlier.ServiceTag}}</a>{{if $outlier.Hostname}}<br><small>{{$outlier.Hostname}}</small>{{end}}{{end}}</td>
+                            <td><code>{{$d.Field}}</code></td>
+                            <td class="expected">{{$d.Expected}}</td>
+                            <td class="actual">{{$d.Actual}}</td>
+                        </tr>
+                        {{end}}
+                        {{end}}
+                    </tbody>
+                </table>
+            </div>
+        </div>
+        {{end}}
+
+        <div class="card">
+            <div class="card-header">
+                <h2>Machines</h2>
+            </div>
+            <div class="card-body">
+                <table>
+                    <thead>
+                        <tr>
+                            <th>Service Tag</th>
+                            <th>Hostname</th>
+                            <th>Hardware</th>
+                            <th>Status</th>
+                        </tr>
+                    </thead>
+                    <tbody>
+                        {{range .Machines}}
+                        <tr>
+                            <td><a href="/machines/{{.ID}}"><strong>{{.ServiceTag}}</strong></a></td>
+                            <td>{{if .Hostname}}{{.Hostname}}{{else}}<em>Not set</em>{{end}}</td>
+                            <td>{{if .Hardware.CPU.Model}}{{.Hardware.CPU.Model}}{{else}}<em>CPU unknown</em>{{end}}<br><small>{{if .Hardware.Memory.TotalGB}}{{printf "%.0f" .Hardware.Memory.TotalGB}} GB RAM{{else}}RAM unknown{{end}} • {{if .Hardware.Disks}}{{len .Hardware.Disks}} disk(s){{else}}disks unknown{{end}}</small></td>
+                            <td><span class="status-badge status-{{.Status}}">{{.Status}}</span></td>
+                        </tr>
+                        {{end}}
+                    </tbody>
+                </table>
+            </div>
+        </div>
+    </div>
+</body>
+</html>`
+
+// bootProfilesTemplate lists the boot profiles. It signs in to add and
+// delete them through the API, which lets only admins change them.
+const bootProfilesTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Boot Profiles - Metal Enrollment</title>
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif;
+            background: #f5f5f5;
+            color: #333;
+        }
+        .header {
+            background: #2c3e50;
+            color: white;
+            padding: 1.5rem 2rem;
+            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+        }
+        .header h1 { font-size: 1.5rem; }
+        .breadcrumb {
+            margin-top: 0.5rem;
+            font-size: 0.875rem;
+        }
+        .breadcrumb a { color: #3498db; text-decoration: none; }
+        .container {
+            max-width: 1200px;
+            margin: 2rem auto;
+            padding: 0 2rem;
+        }
+        .card {
+            background: white;
+            border-radius: 8px;
+            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+            margin-bottom: 1.5rem;
+            overflow: hidden;
+        }
+        .card-header {
+            padding: 1.5rem;
+            border-bottom: 1px solid #e0e0e0;
+        }
+        .card-header h2 { font-size: 1.25rem; }
+        .card-body {
+            padding: 1.5rem;
+        }
+        .summary {
+            margin-bottom: 1rem;
+            font-size: 0.875rem;
+            color: #666;
+        }
+        table {
+            width: 100%;
+            border-collapse: collapse;
+        }
+        th, td {
+            padding: 0.75rem 1rem;
+            text-align: left;
+            font-size: 0.875rem;
+            vertical-align: top;
+        }
+        th {
+            background: #f8f9fa;
+            font-weight: 600;
+            color: #666;
+            text-transform: uppercase;
+            letter-spacing: 0.5px;
+            font-size: 0.75rem;
+        }
+        tr:not(:last-child) td {
+            border-bottom: 1px solid #f0f0f0;
+        }
+        td a { color: #2c3e50; }
+        code {
+            font-family: 'Monaco', 'Menlo', 'Ubuntu Mono', monospace;
+            font-size: 0.8rem;
+        }
+        .form-group {
+            margin-bottom: 1.5rem;
+        }
+        .form-group label {
+            display: block;
+            margin-bottom: 0.5rem;
+            font-weight: 600;
+            font-size: 0.875rem;
+            color: #555;
+        }
+        .form-group input[type=text], .form-group input[type=password] {
+            width: 100%;
+            padding: 0.75rem;
+            border: 1px solid #ddd;
+            border-radius: 4px;
+            font-family: inherit;
+            font-size: 0.875rem;
+        }
+        .form-group .checkbox {
+            display: inline-block;
+            margin-right: 1rem;
+            font-weight: normal;
+        }
+        .btn {
+            padding: 0.5rem 1rem;
+            border: none;
+            border-radius: 4px;
+            cursor: pointer;
+            font-size: 0.875rem;
+            font-weight: 600;
+        }
+        .btn-primary {
+            background: #2c3e50;
+            color: white;
+        }
+        .btn-primary:hover {
+            background: #34495e;
+        }
+        .btn-danger {
+            background: #ffebee;
+            color: #d32f2f;
+        }
+        .btn-danger:hover {
+            background: #ffcdd2;
+        }
+        .result {
+            display: none;
+            padding: 1rem 1.5rem;
+            border-radius: 8px;
+            margin-bottom: 2rem;
+            font-size: 0.875rem;
+        }
+        .result-success { background: #e8f5e9; color: #2e7d32; border: 1px solid #a5d6a7; }
+        .result-error { background: #ffebee; color: #c62828; border: 1px solid #ef9a9a; }
+    </style>
+</head>
+<body>
+    <div class="header">
+        <h1>Boot Profiles</h1>
+        <div class="breadcrumb">
+            <a href="/">← Back to Dashboard</a>
+        </div>
+    </div>
+
+    <div class="container">
+        <div id="result" class="result" role="status"></div>
+        <div class="card">
+            <div class="card-header">
+                <h2>Sign In</h2>
+            </div>
+            <div class="card-body">
+                <p class="summary" id="signed-in">Adding and deleting profiles takes an admin account.</p>
+                <form id="sign-in-form">
+                    <div class="form-group">
+                        <label for="username">Username</label>
+                        <input type="text" id="username" name="username" autocomplete="username" required>
+                    </div>
+                    <div class="form-group">
+                        <label for="password">Password</label>
+                        <input type="password" id="password" name="password" autocomplete="current-password" required>
+                    </div>
+                    <button type="submit" class="btn btn-primary">Sign In</button>
+                </form>
+            </div>
+        </div>
+
+        <div class="card">
+            <div class="card-header">
+                <h2>Profiles</h2>
+            </div>
+            <div class="card-body">
+                <p class="summary">
+                    The iPXE server serves a profile's kernel and initrd in place of the built-in registration image:
+                    to members of its groups, to boot URLs with <code>?profile=&lt;name&gt;</code>, and to clients in its subnets, in that order.
+                </p>
+                {{if .Profiles}}
+                <table>
+                    <thead>
+                        <tr>
+                            <th>Name</th>
+                            <th>Kernel / Initrd</th>
+                            <th>Extra Arguments</th>
+                            <th>Subnets</th>
+                            <th>Groups</th>
+                            <th></th>
+                        </tr>
+                    </thead>
+                    <tbody>
+                        {{range .Profiles}}
+                        <tr>
+                            <td><strong>{{.Name}}</strong>{{if .Description}}<br><small>{{.Description}}</small>{{end}}</td>
+                            <td><code>{{.KernelPath}}</code><br><code>{{.InitrdPath}}</code>{{if .EnrollmentURL}}<br><small>Enrolls at {{.EnrollmentURL}}</small>{{end}}</td>
+                            <td>{{if .ExtraCmdline}}<code>{{.ExtraCmdline}}</code>{{else}}<em>None</em>{{end}}</td>
+                            <td>{{range .Subnets}}<code>{{.}}</code><br>{{else}}<em>None</em>{{end}}</td>
+                            <td>{{range .GroupIDs}}<a href="/groups/{{.}}">{{index $.GroupNames .}}</a><br>{{else}}<em>None</em>{{end}}</td>
+                            <td>
+                                <form class="delete-form" data-id="{{.ID}}" data-name="{{.Name}}">
+                                    <button type="submit" class="btn btn-danger">Delete</button>
+                                </form>
+                            </td>
+                        </tr>
+                        {{end}}
+                    </tbody>
+                </table>
+                {{else}}
+                <p class="summary">No boot profiles. Every registration boot gets the built-in image.</p>
+                {{end}}
+            </div>
+        </div>
+
+        <div class="card">
+            <div class="card-header">
+                <h2>Add Profile</h2>
+            </div>
+            <div class="card-body">
+                <form id="profile-form">
+                    <div class="form-group">
+                        <label for="name">Name</label>
+                        <input type="text" id="name" name="name" placeholder="lab-debug" required>
+                    </div>
+                    <div class="form-group">
+                        <label for="description">Description</label>
+                        <input type="text" id="description" name="description" placeholder="Registration image with debugging tools">
+                    </div>
+                    <div class="form-group">
+                        <label for="kernel_path">Kernel (relative to /images, or a URL; {arch} is the client's architecture)</label>
+                        <input type="text" id="kernel_path" name="kernel_path" placeholder="registration-debug/bzImage" required>
+                    </div>
+                    <div class="form-group">
+                        <label for="initrd_path">Initrd</label>
+                        <input type="text" id="initrd_path" name="initrd_path" placeholder="registration-debug/initrd" required>
+                    </div>
+                    <div class="form-group">
+                        <label for="extra_cmdline">Extra kernel arguments</label>
+                        <input type="text" id="extra_cmdline" name="extra_cmdline" placeholder="debug systemd.log_level=debug">
+                    </div>
+                    <div class="form-group">
+                        <label for="enrollment_url">Enrollment URL override</label>
+                        <input type="text" id="enrollment_url" name="enrollment_url" placeholder="http://lab-enrollment.local:8080/api/v1/enroll">
+                    </div>
+                    <div class="form-group">
+                        <label for="subnets">Subnets (comma-separated CIDRs)</label>
+                        <input type="text" id="subnets" name="subnets" placeholder="10.20.0.0/24, 10.21.0.0/16">
+                    </div>
+                    {{if .Groups}}
+                    <div class="form-group">
+                        <label>Groups</label>
+                        {{range .Groups}}
+                        <label class="checkbox"><input type="checkbox" name="group_ids" value="{{.ID}}"> {{.Name}}</label>
+                        {{end}}
+                    </div>
+                    {{end}}
+                    <button type="submit" class="btn btn-primary">Add Profile</button>
+                </form>
+            </div>
+        </div>
+    </div>
+
+    <script>
+        // The token lasts as long as the tab, so the page can reload to show
+        // a change without signing in again
+        const tokenKey = 'metal-boot-profiles-token';
+        const resultKey = 'metal-boot-profiles-result';
+
+        function showResult(ok, message) {
+            const result = document.getElementById('result');
+            result.className = 'result ' + (ok ? 'result-success' : 'result-error');
+            result.textContent = message;
+            result.style.display = 'block';
+        }
+
+        // reloadWith reloads the page to show a change, then message
+        function reloadWith(message) {
+            sessionStorage.setItem(resultKey, message);
+            window.location.reload();
+        }
+
+        async function request(method, url, body) {
+            const headers = {};
+            const token = sessionStorage.getItem(tokenKey);
+            if (token) {
+                headers['Authorization'] = 'Bearer ' + token;
+            }
+            if (body !== undefined) {
+                headers['Content-Type'] = 'application/json';
+            }
+            const response = await fetch(url, { method: method, headers: headers, body: body === undefined ? undefined : JSON.stringify(body) });
+            const data = await response.json().catch(() => ({}));
+            if (response.status === 401) {
+                sessionStorage.removeItem(tokenKey);
+            }
+            if (!response.ok) {
+                throw new Error((data.error && data.error.message) || response.statusText);
+            }
+            return data;
+        }
+
+        function showSignedIn() {
+            const username = sessionStorage.getItem(tokenKey + '-user');
+            if (sessionStorage.getItem(tokenKey) && username) {
+                document.getElementById('signed-in').textContent = 'Signed in as ' + username + '.';
+            }
+        }
+
+        document.getElementById('sign-in-form').addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const form = e.target;
+            try {
+                const login = await request('POST', '/api/v1/login', {
+                    username: form.username.value,
+                    password: form.password.value
+                });
+                sessionStorage.setItem(tokenKey, login.token);
+                sessionStorage.setItem(tokenKey + '-user', form.username.value);
+                showSignedIn();
+                showResult(true, 'Signed in as ' + form.username.value + '.');
+            } catch (err) {
+                showResult(false, 'Could not sign in: ' + err.message);
+            }
+            form.password.value = '';
+        });
+
+        document.getElementById('profile-form').addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const form = e.target;
+            const profile = {
+                // elements, since form.name can mean the form's own name
+                name: form.elements['name'].value.trim(),
+                description: form.description.value,
+                kernel_path: form.kernel_path.value.trim(),
+                initrd_path: form.initrd_path.value.trim(),
+                extra_cmdline: form.extra_cmdline.value.trim(),
+                enrollment_url: form.enrollment_url.value.trim(),
+                subnets: form.subnets.value.split(',').map((s) => s.trim()).filter((s) => s !== ''),
+                group_ids: Array.from(form.querySelectorAll('input[name=group_ids]:checked')).map((c) => c.value)
+            };
+            try {
+                await request('POST', '/api/v1/boot-profiles', profile);
+                reloadWith('Added boot profile ' + profile.name);
+            } catch (err) {
+                showResult(false, 'Could not add the boot profile: ' + err.message);
+            }
+        });
+
+        document.querySelectorAll('.delete-form').forEach((form) => {
+            form.addEventListener('submit', async (e) => {
+                e.preventDefault();
+                const name = form.dataset.name;
+                if (!confirm('Delete boot profile ' + name + '?')) {
+                    return;
+                }
+                try {
+                    await request('DELETE', '/api/v1/boot-profiles/' + encodeURIComponent(form.dataset.id));
+                    reloadWith('Deleted boot profile ' + name);
+                } catch (err) {
+                    showResult(false, 'Could not delete the boot profile: ' + err.message);
+                }
+            });
+        });
+
+        showSignedIn();
+        const message = sessionStorage.getItem(resultKey);
+        if (message) {
+            sessionStorage.removeItem(resultKey);
+            showResult(true, message);
+        }
+    </script>
+</body>
+</html>`
+
+// claimTemplate signs in and claims a machine through the API, so claims
+// are authenticated, rate limited, and audited like any other API request
+const claimTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Claim Machine - Metal Enrollment</title>
+    <style>
+        * { margin: 0; padding: 0; box-sizing: border-box; }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif;
+            background: #f5f5f5;
+            color: #333;
+        }
+        .header {
+            background: #2c3e50;
+            color: white;
+            padding: 1.5rem 2rem;
+            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+        }
+        .header h1 { font-size: 1.5rem; }
+        .breadcrumb {
+            margin-top: 0.5rem;
+            font-size: 0.875rem;
+        }
+        .breadcrumb a { color: #3498db; text-decoration: none; }
+        .container {
+            max-width: 600px;
+            margin: 2rem auto;
+            padding: 0 2rem;
+        }
+        .card {
+            background: white;
+            border-radius: 8px;
+            box-shadow: 0 2px 4px rgba(0,0,0,0.1);
+            margin-bottom: 1.5rem;
+            overflow: hidden;
+        }
+        .card-header {
+            padding: 1.5rem;
+            border-bottom: 1px solid #e0e0e0;
+        }
+        .card-header h2 { font-size: 1.25rem; }
+        .card-body {
+            padding: 1.5rem;
+        }
+        .summary {
+            margin-bottom: 1rem;
+            font-size: 0.875rem;
+            color: #666;
+        }
+        .form-group {
+            margin-bottom: 1.5rem;
+        }
+        .form-group label {
+            display: block;
+            margin-bottom: 0.5rem;
+            font-weight: 600;
+            font-size: 0.875rem;
+            color: #555;
+        }
+        .form-group input {
+            width: 100%;
+            padding: 0.75rem;
+            border: 1px solid #ddd;
+            border-radius: 4px;
+            font-family: inherit;
+            font-size: 0.875rem;
+        }
+        .form-group input#code {
+            font-family: 'Monaco', 'Menlo', 'Ubuntu Mono', monospace;
+            font-size: 1.25rem;
+            letter-spacing: 2px;
+            text-transform: uppercase;
+        }
+        .btn {
+            padding: 0.5rem 1rem;
+            border: none;
+            border-radius: 4px;
+            cursor: pointer;
+            font-size: 0.875rem;
+            font-weight: 600;
+        }
+        .btn-primary {
+            background: #2c3e50;
+            color: white;
+        }
+        .btn-primary:hover {
+            background: #34495e;
+        }
+        .result {
+            display: none;
+            margin-top: 1rem;
+            padding: 1rem;
+            border-radius: 4px;
+            font-size: 0.875rem;
+        }
+        .result-success { background: #e8f5e9; color: #2e7d32; }
+        .result-error { background: #ffebee; color: #d32f2f; }
+    </style>
+</head>
+<body>
+    <div class="header">
+        <h1>Claim Machine</h1>
+        <div class="breadcrumb">
+            <a href="/">← Back to Dashboard</a>
+        </div>
+    </div>
+
+    <div class="container">
+        <div class="card">
+            <div class="card-header">
+                <h2>Enter Claim Code</h2>
+            </div>
+            <div class="card-body">
+                <p class="summary">
+                    A machine shows its claim code on the console after it enrolls.
+                    Claiming it makes it yours and adds it to your default group.
+                    Each code works once.
+                </p>
+                <form id="claim-form">
+                    <div class="form-group">
+                        <label for="code">Claim code</label>
+                        <input type="text" id="code" name="code" placeholder="XXXXX-XXXXX" autocomplete="off" required>
+                    </div>
+                    <div class="form-group">
+                        <label for="username">Username</label>
+                        <input type="text" id="username" name="username" autocomplete="username" required>
+                    </div>
+                    <div class="form-group">
+                        <label for="password">Password</label>
+                        <input type="password" id="password" name="password" autocomplete="current-password" required>
+                    </div>
+                    <button type="submit" class="btn btn-primary">Claim</button>
+                </form>
+                <div id="result" class="result"></div>
+            </div>
+        </div>
+    </div>
+
+    <script>
+        function showResult(ok, message) {
+            const result = document.getElementById('result');
+            result.className = 'result ' + (ok ? 'result-success' : 'result-error');
+            result.textContent = message;
+            result.style.display = 'block';
+        }
+
+        async function postJSON(url, body, token) {
+            const headers = { 'Content-Type': 'application/json' };
+            if (token) {
+                headers['Authorization'] = 'Bearer ' + token;
+            }
+            const response = await fetch(url, { method: 'POST', headers: headers, body: JSON.stringify(body) });
+            const data = await response.json().catch(() => ({}));
+            if (!response.ok) {
+                throw new Error((data.error && data.error.message) || response.statusText);
+            }
+            return data;
+        }
+
+        document.getElementById('claim-form').addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const form = e.target;
+            try {
+                const login = await postJSON('/api/v1/login', {
+                    username: form.username.value,
+                    password: form.password.value
+                });
+                const machine = await postJSON('/api/v1/machines/claim', { code: form.code.value }, login.token);
+                showResult(true, 'Claimed ' + (machine.hostname || machine.service_tag) + '.');
+                form.code.value = '';
+            } catch (err) {
+                showResult(false, 'Could not claim the machine: ' + err.message);
+            }
+            form.password.value = '';
+        });
+    </script>
+</body>
+</html>
+`
+
+// flashTemplate shows a page's flash message, if it has one
+const flashTemplate = `{{define "flash"}}{{with .}}<div class="flash flash-{{.Kind}}" role="status">{{.Message}}</div>{{end}}{{end}}`
+
+// activityTemplate lists the dashboard's recent activity. The dashboard
+// polls /activity for it alone.
+const activityTemplate = `{{define "activity"}}{{if .}}
+<ul class="activity-list">
+    {{range .}}
+    <li>
+        <span class="event-badge {{.Badge}}" title="{{.Event}}">{{.Event}}</span>
+        <span class="activity-text">
+            {{if .Machine}}<a href="/machines/{{.MachineID}}">{{.Machine}}</a>{{else}}<code>{{shortID .MachineID}}</code>{{end}}:
+            {{.Text}}{{with .Actor}} <small>by {{.}}</small>{{end}}
+        </span>
+        <time datetime="{{.At.UTC.Format "2006-01-02T15:04:05Z07:00"}}" title="{{.At.Format "2006-01-02 15:04:05 MST"}}">{{timeAgo .At}}</time>
+    </li>
+    {{end}}
+</ul>
+{{else}}
+<div class="empty-state">
+    <p>Nothing has happened yet.</p>
+</div>
+{{end}}{{end}}`
@@ -0,0 +1,266 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// update rewrites golden files with what the code produces now, for
+// changes to payloads that are meant
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+
+	db, err := database.New(database.Config{Driver: "sqlite3", DSN: "file:" + filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=10000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// receiver is a webhook endpoint that keeps the deliveries it gets
+type receiver struct {
+	server     *httptest.Server
+	deliveries chan *http.Request
+	bodies     chan []byte
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+
+	r := &receiver{deliveries: make(chan *http.Request, 10), bodies: make(chan []byte, 10)}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.deliveries <- req
+		r.bodies <- body
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// next returns the next delivery and its body
+func (r *receiver) next(t *testing.T) (*http.Request, []byte) {
+	t.Helper()
+
+	select {
+	case req := <-r.deliveries:
+		return req, <-r.bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+		return nil, nil
+	}
+}
+
+// goldenWebhook creates a webhook in format for every event, delivering
+// to r
+func goldenWebhook(t *testing.T, db *database.DB, r *receiver, format string) *models.Webhook {
+	t.Helper()
+
+	webhook := &models.Webhook{
+		Name:                 "golden",
+		URL:                  r.server.URL,
+		Events:               []string{events.MachineStatusChanged, events.RolloutStarted},
+		Secret:               "golden-secret",
+		Active:               true,
+		AllowPrivateNetworks: true,
+		SchemaVersion:        events.SchemaVersion,
+		Format:               format,
+	}
+	if err := db.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+// delivered is a delivery as its receiver got it
+type delivered struct {
+	header     http.Header
+	body       []byte
+	normalized []byte // body, as normalizeBody leaves it
+}
+
+// deliver publishes an event to a webhook in format and returns what its
+// receiver got. newEvent makes the event given a configured machine.
+func deliver(t *testing.T, format string, newEvent func(machine *models.Machine) events.Event) delivered {
+	t.Helper()
+
+	db := newTestDB(t)
+	r := newReceiver(t)
+	goldenWebhook(t, db, r, format)
+
+	machine, err := db.CreateMachine(models.EnrollmentRequest{ServiceTag: "GOLDEN01", MACAddress: "52:54:00:00:00:01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.Hostname = "golden-01"
+	machine.Status = models.StatusConfigured
+	if err := db.UpdateMachine(machine); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := events.NewPublisher(db)
+	publisher.Subscribe(NewService(db).HandleEvent)
+	if err := publisher.Publish(context.Background(), newEvent(machine)); err != nil {
+		t.Fatal(err)
+	}
+
+	req, body := r.next(t)
+	return delivered{header: req.Header, body: body, normalized: normalizeBody(t, body, machine.ID)}
+}
+
+// statusChange is a machine's status change from enrolled to configured
+func statusChange(machine *models.Machine) events.Event {
+	return events.Event{
+		Type:      events.MachineStatusChanged,
+		MachineID: machine.ID,
+		Data:      events.StatusChangedData{OldStatus: models.StatusEnrolled, NewStatus: models.StatusConfigured},
+	}
+}
+
+// rolloutStart is the start of a rollout, which is about no one machine
+func rolloutStart(*models.Machine) events.Event {
+	return events.Event{
+		Type: events.RolloutStarted,
+		Data: events.RolloutData{RolloutID: "rollout-1", GroupID: "group-1", Status: "active", Machines: map[string]int{"pending": 4}},
+	}
+}
+
+// normalizeBody indents a delivered body, with the values that differ from
+// run to run replaced by their names
+func normalizeBody(t *testing.T, body []byte, machineID string) []byte {
+	t.Helper()
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("payload %s: %v", body, err)
+	}
+	normalizePayload(payload, machineID)
+	normalized, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(normalized, '\n')
+}
+
+// normalizePayload replaces the event's ID, its time, and the machine's and
+// webhook's IDs wherever they appear, including in an envelope's data
+func normalizePayload(payload map[string]interface{}, machineID string) {
+	for key, value := range payload {
+		switch v := value.(type) {
+		case string:
+			switch {
+			case key == "id":
+				payload[key] = "{event id}"
+			case key == "timestamp" || key == "time":
+				payload[key] = "{time}"
+			case key == "webhook_id":
+				payload[key] = "{webhook id}"
+			case v == machineID && machineID != "":
+				payload[key] = "{machine id}"
+			}
+		case map[string]interface{}:
+			normalizePayload(v, machineID)
+			if key == "machine" {
+				v["id"] = "{machine id}"
+			}
+		}
+	}
+}
+
+// checkGolden compares got with testdata/name, or rewrites the file with
+// -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed; if that's meant, run go test -update\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// TestPayloadMatchesGoldenFile checks the envelope every delivery of schema
+// version 1 has; the data of each event type is checked against golden
+// files in pkg/events
+func TestPayloadMatchesGoldenFile(t *testing.T) {
+	checkGolden(t, "payload_v1.golden", deliver(t, models.WebhookFormatDefault, statusChange).normalized)
+}
+
+// TestCloudEventsMatchGoldenFiles checks the CloudEvents envelope around
+// the version 1 payload, for an event about a machine, which is its
+// subject, for one about none, and for a test delivery
+func TestCloudEventsMatchGoldenFiles(t *testing.T) {
+	tests := []struct {
+		golden   string
+		newEvent func(machine *models.Machine) events.Event
+	}{
+		{"cloudevents_status_changed.golden", statusChange},
+		{"cloudevents_rollout_started.golden", rolloutStart},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			got := deliver(t, models.WebhookFormatCloudEvents, tt.newEvent)
+			if ct := got.header.Get("Content-Type"); ct != "application/cloudevents+json" {
+				t.Errorf("Content-Type = %q, want application/cloudevents+json", ct)
+			}
+			checkSignature(t, got)
+			checkGolden(t, tt.golden, got.normalized)
+		})
+	}
+
+	t.Run("cloudevents_test.golden", func(t *testing.T) {
+		db := newTestDB(t)
+		r := newReceiver(t)
+		webhook := goldenWebhook(t, db, r, models.WebhookFormatCloudEvents)
+		if _, err := NewService(db).Test(webhook); err != nil {
+			t.Fatal(err)
+		}
+
+		req, body := r.next(t)
+		got := delivered{header: req.Header, body: body, normalized: normalizeBody(t, body, "")}
+		checkSignature(t, got)
+		checkGolden(t, "cloudevents_test.golden", got.normalized)
+	})
+}
+
+// checkSignature checks that a delivery is signed over the body as sent,
+// envelope and all
+func checkSignature(t *testing.T, got delivered) {
+	t.Helper()
+
+	mac := hmac.New(sha256.New, []byte("golden-secret"))
+	mac.Write(got.body)
+	if want := hex.EncodeToString(mac.Sum(nil)); got.header.Get("X-Webhook-Signature") != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got.header.Get("X-Webhook-Signature"), want)
+	}
+}
@@ -0,0 +1,159 @@
+package webhook
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// Unless a webhook's retry policy says otherwise, deliveries are tried
+// DefaultMaxRetries times, waiting DefaultRetryInterval longer before each
+// retry, up to DefaultMaxRetryInterval
+const (
+	DefaultMaxRetries       = 3
+	DefaultRetryInterval    = time.Second
+	DefaultMaxRetryInterval = time.Minute
+)
+
+// retryPolicy is how a delivery is retried: its webhook's retry policy for
+// the event type, with the defaults applied
+type retryPolicy struct {
+	attempts int
+	backoff  string
+	initial  time.Duration
+	max      time.Duration
+	jitter   bool
+	retryOn  []string
+}
+
+// resolveRetryPolicy returns how a webhook's deliveries of an event type
+// are retried. An override for the event type takes precedence over the
+// webhook's policy, which takes precedence over the defaults.
+func resolveRetryPolicy(webhook *models.Webhook, eventType string) retryPolicy {
+	p := retryPolicy{
+		attempts: webhook.MaxRetries,
+		backoff:  models.WebhookBackoffLinear,
+		initial:  DefaultRetryInterval,
+		max:      DefaultMaxRetryInterval,
+		retryOn:  models.DefaultWebhookRetryOn,
+	}
+	if p.attempts <= 0 {
+		p.attempts = DefaultMaxRetries
+	}
+
+	if webhook.Retry != nil {
+		p.apply(webhook.Retry)
+		if override, ok := webhook.Retry.Events[eventType]; ok {
+			if override.MaxRetries > 0 {
+				p.attempts = override.MaxRetries
+			}
+			p.apply(&override.WebhookRetryPolicy)
+		}
+	}
+
+	if p.max < p.initial {
+		p.max = p.initial
+	}
+	return p
+}
+
+// apply replaces the settings a retry policy sets
+func (p *retryPolicy) apply(settings *models.WebhookRetryPolicy) {
+	if settings.Backoff != "" {
+		p.backoff = settings.Backoff
+	}
+	if settings.InitialIntervalMS > 0 {
+		p.initial = time.Duration(settings.InitialIntervalMS) * time.Millisecond
+	}
+	if settings.MaxIntervalMS > 0 {
+		p.max = time.Duration(settings.MaxIntervalMS) * time.Millisecond
+	}
+	if settings.Jitter != nil {
+		p.jitter = *settings.Jitter
+	}
+	if len(settings.RetryOn) > 0 {
+		p.retryOn = settings.RetryOn
+	}
+}
+
+// retryable reports whether an attempt is retried that was answered with
+// statusCode, or that didn't reach the receiver if statusCode is 0
+func (p retryPolicy) retryable(statusCode int) bool {
+	for _, condition := range p.retryOn {
+		switch condition {
+		case models.WebhookRetryNetwork:
+			if statusCode == 0 {
+				return true
+			}
+		case models.WebhookRetryClientError:
+			if statusCode >= 400 && statusCode < 500 {
+				return true
+			}
+		case models.WebhookRetryServerError:
+			if statusCode >= 500 && statusCode < 600 {
+				return true
+			}
+		default:
+			if statusCode != 0 && condition == strconv.Itoa(statusCode) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wait returns how long to wait after a failed attempt, the first being
+// 1, before the next. A Retry-After the receiver asked for is waited out
+// if it is longer, up to the policy's longest wait.
+func (p retryPolicy) wait(attempt int, retryAfter time.Duration) time.Duration {
+	d := p.initial
+	switch p.backoff {
+	case models.WebhookBackoffExponential:
+		for i := 1; i < attempt && d < p.max; i++ {
+			d *= 2
+		}
+	default:
+		d *= time.Duration(attempt)
+	}
+	if d > p.max {
+		d = p.max
+	}
+
+	if p.jitter && d > 0 {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+
+	if retryAfter > d {
+		d = retryAfter
+		if d > p.max {
+			d = p.max
+		}
+	}
+	return d
+}
+
+// retryAfter returns how long a 429 or 503 response asks to be left
+// alone, in seconds or until an HTTP date, or 0 if it doesn't
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
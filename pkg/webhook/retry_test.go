@@ -0,0 +1,326 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+)
+
+// response is a scripted receiver's answer to one attempt
+type response struct {
+	status     int
+	retryAfter string
+}
+
+// scriptedReceiver answers attempts with its script, in order, and then
+// with 200
+type scriptedReceiver struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	script   []response
+	attempts int
+}
+
+func newScriptedReceiver(t *testing.T, script ...response) *scriptedReceiver {
+	t.Helper()
+
+	r := &scriptedReceiver{script: script}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.attempts++
+		answer := response{status: http.StatusOK}
+		if len(r.script) > 0 {
+			answer, r.script = r.script[0], r.script[1:]
+		}
+		r.mu.Unlock()
+
+		if answer.retryAfter != "" {
+			w.Header().Set("Retry-After", answer.retryAfter)
+		}
+		w.WriteHeader(answer.status)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// received returns how many attempts reached the receiver
+func (r *scriptedReceiver) received() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts
+}
+
+// recordingSleeper records the waits between attempts instead of sleeping
+type recordingSleeper struct {
+	waits []time.Duration
+}
+
+func (s *recordingSleeper) sleep(d time.Duration) {
+	s.waits = append(s.waits, d)
+}
+
+// retryWebhook creates a webhook delivering to url with retry as its
+// policy
+func retryWebhook(t *testing.T, db *database.DB, url string, maxRetries int, retry *models.WebhookRetryPolicy) *models.Webhook {
+	t.Helper()
+
+	webhook := &models.Webhook{
+		Name:                 "retries",
+		URL:                  url,
+		Events:               []string{events.MachineEnrolled, events.MachineStatusChanged},
+		Active:               true,
+		AllowPrivateNetworks: true,
+		MaxRetries:           maxRetries,
+		Retry:                retry,
+	}
+	if err := db.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func repeat(status, n int) []response {
+	script := make([]response, n)
+	for i := range script {
+		script[i] = response{status: status}
+	}
+	return script
+}
+
+// TestRetries delivers to receivers that answer each attempt as scripted,
+// checking how many attempts are made, how long is waited between them,
+// and the attempt history the delivery is recorded with
+func TestRetries(t *testing.T) {
+	jitter := true
+	tests := []struct {
+		name       string
+		script     []response
+		maxRetries int
+		retry      *models.WebhookRetryPolicy
+		event      string
+		attempts   int
+		waits      []time.Duration
+		success    bool
+	}{
+		{
+			name:     "server errors, then success",
+			script:   repeat(http.StatusInternalServerError, 2),
+			attempts: 3,
+			waits:    []time.Duration{time.Second, 2 * time.Second},
+			success:  true,
+		},
+		{
+			name:     "server errors throughout",
+			script:   repeat(http.StatusServiceUnavailable, 5),
+			attempts: DefaultMaxRetries,
+			waits:    []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:     "rejected payload isn't retried",
+			script:   repeat(http.StatusBadRequest, 3),
+			attempts: 1,
+		},
+		{
+			name:     "408 is retried",
+			script:   repeat(http.StatusRequestTimeout, 1),
+			attempts: 2,
+			waits:    []time.Duration{time.Second},
+			success:  true,
+		},
+		{
+			name:     "Retry-After is waited out",
+			script:   []response{{status: http.StatusTooManyRequests, retryAfter: "7"}, {status: http.StatusServiceUnavailable, retryAfter: "1"}},
+			attempts: 3,
+			waits:    []time.Duration{7 * time.Second, 2 * time.Second},
+			success:  true,
+		},
+		{
+			name:     "Retry-After is capped at the longest wait",
+			script:   []response{{status: http.StatusTooManyRequests, retryAfter: "3600"}},
+			attempts: 2,
+			waits:    []time.Duration{DefaultMaxRetryInterval},
+			success:  true,
+		},
+		{
+			name:       "exponential backoff up to its longest wait",
+			script:     repeat(http.StatusBadGateway, 4),
+			maxRetries: 5,
+			retry:      &models.WebhookRetryPolicy{Backoff: models.WebhookBackoffExponential, InitialIntervalMS: 100, MaxIntervalMS: 300},
+			attempts:   5,
+			waits:      []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond},
+			success:    true,
+		},
+		{
+			name:     "retrying on a listed status only",
+			script:   []response{{status: http.StatusConflict}, {status: http.StatusInternalServerError}},
+			retry:    &models.WebhookRetryPolicy{RetryOn: []string{"409"}},
+			attempts: 2,
+			waits:    []time.Duration{time.Second},
+		},
+		{
+			name:   "an event type's override",
+			script: repeat(http.StatusInternalServerError, 4),
+			retry: &models.WebhookRetryPolicy{Events: map[string]models.WebhookRetryOverride{
+				events.MachineEnrolled: {MaxRetries: 5, WebhookRetryPolicy: models.WebhookRetryPolicy{InitialIntervalMS: 10}},
+			}},
+			event:    events.MachineEnrolled,
+			attempts: 5,
+			waits:    []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 40 * time.Millisecond},
+			success:  true,
+		},
+		{
+			name:   "another event type's override doesn't apply",
+			script: repeat(http.StatusInternalServerError, 4),
+			retry: &models.WebhookRetryPolicy{Events: map[string]models.WebhookRetryOverride{
+				events.MachineEnrolled: {MaxRetries: 5},
+			}},
+			attempts: DefaultMaxRetries,
+			waits:    []time.Duration{time.Second, 2 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			receiver := newScriptedReceiver(t, tt.script...)
+			webhook := retryWebhook(t, db, receiver.server.URL, tt.maxRetries, tt.retry)
+			sleeper := &recordingSleeper{}
+			s := NewService(db)
+			s.SetSleeper(sleeper.sleep)
+
+			event := events.Event{ID: "event-1", Type: events.MachineStatusChanged}
+			if tt.event != "" {
+				event.Type = tt.event
+			}
+			delivery := s.sendWebhook(webhook, event, []byte(`{}`))
+
+			if delivery.Success != tt.success || delivery.Attempts != tt.attempts || receiver.received() != tt.attempts {
+				t.Errorf("success %v after %d attempts, %d received; want success %v after %d",
+					delivery.Success, delivery.Attempts, receiver.received(), tt.success, tt.attempts)
+			}
+			if !equalWaits(sleeper.waits, tt.waits) {
+				t.Errorf("waits = %v, want %v", sleeper.waits, tt.waits)
+			}
+			checkHistory(t, db, webhook, tt.script, tt.attempts, sleeper.waits)
+		})
+	}
+
+	t.Run("jitter", func(t *testing.T) {
+		db := newTestDB(t)
+		receiver := newScriptedReceiver(t, repeat(http.StatusInternalServerError, 4)...)
+		policy := &models.WebhookRetryPolicy{Backoff: models.WebhookBackoffExponential, InitialIntervalMS: 1000, MaxIntervalMS: 4000, Jitter: &jitter}
+		webhook := retryWebhook(t, db, receiver.server.URL, 5, policy)
+		sleeper := &recordingSleeper{}
+		s := NewService(db)
+		s.SetSleeper(sleeper.sleep)
+
+		if delivery := s.sendWebhook(webhook, events.Event{Type: events.MachineStatusChanged}, []byte(`{}`)); !delivery.Success {
+			t.Fatalf("delivery failed: %+v", delivery)
+		}
+		// Each wait is at most the backoff it replaces
+		bounds := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+		if len(sleeper.waits) != len(bounds) {
+			t.Fatalf("waits = %v, want %d", sleeper.waits, len(bounds))
+		}
+		for i, wait := range sleeper.waits {
+			if wait < 0 || wait > bounds[i] {
+				t.Errorf("wait %d = %s, want between 0 and %s", i+1, wait, bounds[i])
+			}
+		}
+	})
+
+	t.Run("unreachable receiver", func(t *testing.T) {
+		db := newTestDB(t)
+		receiver := newScriptedReceiver(t)
+		url := receiver.server.URL
+		receiver.server.Close()
+		webhook := retryWebhook(t, db, url, 0, nil)
+		sleeper := &recordingSleeper{}
+		s := NewService(db)
+		s.SetSleeper(sleeper.sleep)
+
+		delivery := s.sendWebhook(webhook, events.Event{Type: events.MachineStatusChanged}, []byte(`{}`))
+		if delivery.Success || delivery.Attempts != DefaultMaxRetries || len(sleeper.waits) != DefaultMaxRetries-1 {
+			t.Errorf("delivery %+v with waits %v, want %d failed attempts", delivery, sleeper.waits, DefaultMaxRetries)
+		}
+		for _, attempt := range delivery.AttemptHistory {
+			if attempt.StatusCode != 0 || attempt.Error == "" {
+				t.Errorf("attempt %+v, want a network error", attempt)
+			}
+		}
+	})
+}
+
+func equalWaits(got, want []time.Duration) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHistory checks the stored delivery's attempts have the scripted
+// statuses, and the waits after them
+func checkHistory(t *testing.T, db *database.DB, webhook *models.Webhook, script []response, attempts int, waits []time.Duration) {
+	t.Helper()
+
+	deliveries, err := db.ListWebhookDeliveries(database.WebhookDeliveryFilter{WebhookID: webhook.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries stored, want 1", len(deliveries))
+	}
+	history := deliveries[0].AttemptHistory
+	if len(history) != attempts {
+		t.Fatalf("history has %d attempts, want %d", len(history), attempts)
+	}
+	for i, attempt := range history {
+		want := http.StatusOK
+		if i < len(script) {
+			want = script[i].status
+		}
+		var retryIn int64
+		if i < len(waits) {
+			retryIn = waits[i].Milliseconds()
+		}
+		if attempt.Attempt != i+1 || attempt.StatusCode != want || attempt.RetryInMS != retryIn {
+			t.Errorf("attempt %d = %+v, want status %d and retry in %dms", i+1, attempt, want, retryIn)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		status int
+		value  string
+		want   time.Duration
+	}{
+		{http.StatusTooManyRequests, "30", 30 * time.Second},
+		{http.StatusServiceUnavailable, now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{http.StatusServiceUnavailable, now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{http.StatusTooManyRequests, "-5", 0},
+		{http.StatusTooManyRequests, "soon", 0},
+		{http.StatusTooManyRequests, "", 0},
+		{http.StatusInternalServerError, "30", 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		resp.Header.Set("Retry-After", tt.value)
+		if got := retryAfter(resp, now); got != tt.want {
+			t.Errorf("%d with Retry-After %q: got %s, want %s", tt.status, tt.value, got, tt.want)
+		}
+	}
+}
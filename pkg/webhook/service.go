@@ -2,6 +2,7 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -10,18 +11,59 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/database"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/events"
 	"github.com/3whiskeywhiskey/metal-enrollment/pkg/models"
+	"github.com/3whiskeywhiskey/metal-enrollment/pkg/netguard"
+	"github.com/google/uuid"
+)
+
+// maxResponseBytes is how much of a response body is stored with a delivery
+const maxResponseBytes = 4 << 10
+
+// DefaultSource is the source of CloudEvents deliveries when the server's
+// URL isn't known
+const DefaultSource = "metal-enrollment"
+
+// cloudEventTypePrefix is put before event types to make CloudEvents types
+const cloudEventTypePrefix = "com.metal-enrollment."
+
+// TestEvent is the event type of test deliveries
+const TestEvent = "webhook.test"
+
+// Unless SetAutoDisable or the webhook says otherwise, a webhook is
+// deactivated once its failure streak reaches DefaultDisableAfterFailures
+// and has lasted DefaultDisableAfter
+const (
+	DefaultDisableAfterFailures = 10
+	DefaultDisableAfter         = time.Hour
 )
 
 // Service handles webhook notifications
 type Service struct {
-	db     *database.DB
-	client *http.Client
+	db         *database.DB
+	client     *http.Client
+	source     string
+	onDelivery []DeliveryHandler
+
+	// publisher receives webhook.auto_disabled events, if set
+	publisher *events.Publisher
+
+	disableAfterFailures int
+	disableAfter         time.Duration
+
+	// sleep waits between a delivery's attempts
+	sleep func(time.Duration)
 }
 
+// DeliveryHandler is called after each delivery finishes, successfully or
+// after its last retry
+type DeliveryHandler func(webhook *models.Webhook, delivery *models.WebhookDelivery)
+
 // NewService creates a new webhook service
 func NewService(db *database.DB) *Service {
 	return &Service{
@@ -29,137 +71,424 @@ func NewService(db *database.DB) *Service {
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		source:               DefaultSource,
+		disableAfterFailures: DefaultDisableAfterFailures,
+		disableAfter:         DefaultDisableAfter,
+		sleep:                time.Sleep,
 	}
 }
 
-// EventPayload represents the payload sent to webhook endpoints
+// SetSource sets the source of CloudEvents deliveries, the server's URL.
+// It must be called before any events are triggered.
+func (s *Service) SetSource(source string) {
+	if source != "" {
+		s.source = source
+	}
+}
+
+// SetPublisher sets where webhook.auto_disabled events are published. It
+// must be called before any events are triggered.
+func (s *Service) SetPublisher(publisher *events.Publisher) {
+	s.publisher = publisher
+}
+
+// SetAutoDisable sets the failure streak webhooks are deactivated at, and
+// how long it must have lasted, for webhooks that don't set their own.
+// Zero failures leaves those webhooks active however long they fail. It
+// must be called before any events are triggered.
+func (s *Service) SetAutoDisable(failures int, after time.Duration) {
+	s.disableAfterFailures = failures
+	s.disableAfter = after
+}
+
+// SetSleeper replaces how the service waits between a delivery's
+// attempts, so tests can record the waits instead of sitting through them.
+// It must be called before any events are triggered.
+func (s *Service) SetSleeper(sleep func(time.Duration)) {
+	s.sleep = sleep
+}
+
+// FailureLimit returns the failure streak a webhook is deactivated at, and
+// how long the streak must have lasted, with the service's defaults
+// applied. failures is zero if the webhook is never deactivated.
+func (s *Service) FailureLimit(webhook *models.Webhook) (failures int, after time.Duration) {
+	failures = webhook.DisableAfterFailures
+	if failures == 0 {
+		failures = s.disableAfterFailures
+	}
+	if failures < 0 {
+		failures = 0
+	}
+
+	after = time.Duration(webhook.DisableAfterSeconds) * time.Second
+	if after == 0 {
+		after = s.disableAfter
+	}
+	return failures, after
+}
+
+// OnDelivery registers a handler for finished deliveries. Handlers must be
+// registered before any events are triggered.
+func (s *Service) OnDelivery(handler DeliveryHandler) {
+	s.onDelivery = append(s.onDelivery, handler)
+}
+
+// EventPayload represents the payload sent to webhook endpoints, in the
+// schema version the webhook is pinned to
 type EventPayload struct {
-	Event     string      `json:"event"`
-	Timestamp time.Time   `json:"timestamp"`
-	Data      interface{} `json:"data"`
+	Schema    string                  `json:"schema"`
+	ID        string                  `json:"id"`                 // Same as the event's ID in the machine event log
+	Sequence  int64                   `json:"sequence,omitempty"` // The event's number among the machine's events
+	Event     string                  `json:"event"`
+	Timestamp time.Time               `json:"timestamp"`
+	Machine   *events.MachineSnapshot `json:"machine,omitempty"` // Absent for events about no single machine
+	Data      interface{}             `json:"data"`
 }
 
-// TriggerEvent sends webhook notifications for a machine event
-func (s *Service) TriggerEvent(eventType string, data interface{}) error {
-	webhooks, err := s.db.GetWebhooksByEvent(eventType)
+// CloudEvent is the CloudEvents 1.0 envelope webhooks with the cloudevents
+// format receive, in structured mode. Data is the payload other webhooks
+// receive.
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"` // The machine's ID, for machine events
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// HandleEvent sends webhook notifications for a published event. Machine
+// events are sent with a snapshot of the machine and with machine_id added
+// to their data, and reach webhooks scoped by the machine's groups, status,
+// and tags. Events about no single machine, such as rollout events, only
+// reach unscoped webhooks. It is registered with events.Publisher.Subscribe.
+func (s *Service) HandleEvent(event events.Event) {
+	webhooks, err := s.db.GetWebhooksByEvent(event.Type)
 	if err != nil {
-		log.Printf("Failed to get webhooks for event %s: %v", eventType, err)
-		return err
+		log.Printf("Failed to get webhooks for event %s: %v", event.Type, err)
+		return
 	}
 
 	if len(webhooks) == 0 {
-		return nil // No webhooks configured for this event
+		return // No webhooks configured for this event
 	}
 
-	payload := EventPayload{
-		Event:     eventType,
-		Timestamp: time.Now(),
-		Data:      data,
+	var machine *models.Machine
+	if event.MachineID != "" {
+		machine, err = s.db.GetMachine(event.MachineID)
+		if err != nil {
+			log.Printf("Failed to get machine %s for webhooks: %v", event.MachineID, err)
+			return
+		}
 	}
 
-	payloadJSON, err := json.Marshal(payload)
+	scope, err := s.loadScope(machine, webhooks)
 	if err != nil {
-		return err
+		log.Printf("Failed to resolve webhook scope for machine %s: %v", event.MachineID, err)
+		return
+	}
+
+	var snapshot *events.MachineSnapshot
+	data := map[string]interface{}{}
+	if event.MachineID != "" {
+		snapshot = events.NewMachineSnapshot(event.MachineID, machine)
+		data["machine_id"] = event.MachineID
+	}
+	if machine != nil && len(machine.Metadata) > 0 {
+		data["machine_metadata"] = machine.Metadata
+	}
+	for k, v := range event.Fields() {
+		data[k] = v
+	}
+
+	// Send to every webhook at once, but finish before returning so that
+	// the machine's next event is not sent ahead of this one
+	var wg sync.WaitGroup
+	for _, webhook := range webhooks {
+		if !scope.matches(webhook) {
+			continue
+		}
+
+		payloadJSON, err := s.encodePayload(webhook, event, snapshot, selectFields(data, webhook.Fields))
+		if err != nil {
+			log.Printf("Failed to marshal webhook payload for event %s: %v", event.Type, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(webhook *models.Webhook) {
+			defer wg.Done()
+			s.sendWebhook(webhook, event, payloadJSON)
+		}(webhook)
 	}
+	wg.Wait()
+}
+
+// eventScope is what webhook scoping is evaluated against: the machine's
+// current status, groups, and tags
+type eventScope struct {
+	found  bool
+	status string
+	groups map[string]bool
+	tags   []string
+}
 
-	// Send webhooks asynchronously
+// loadScope looks up the machine's groups if any of the webhooks are
+// scoped. machine is nil for events without a machine and for machines
+// that have since been deleted.
+func (s *Service) loadScope(machine *models.Machine, webhooks []*models.Webhook) (*eventScope, error) {
+	scope := &eventScope{groups: map[string]bool{}}
+
+	scoped := false
 	for _, webhook := range webhooks {
-		go s.sendWebhook(webhook, payloadJSON)
+		scoped = scoped || webhook.Scoped()
+	}
+	if !scoped || machine == nil {
+		return scope, nil
+	}
+	scope.found = true
+	scope.status = string(machine.Status)
+	scope.tags = machine.Tags
+
+	groups, err := s.db.GetMachineGroups(machine.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		scope.groups[group.ID] = true
 	}
 
-	return nil
+	return scope, nil
 }
 
-func (s *Service) sendWebhook(webhook *models.Webhook, payload []byte) {
-	delivery := &models.WebhookDelivery{
-		WebhookID: webhook.ID,
-		Event:     webhook.Events[0], // First event
-		Payload:   string(payload),
-		Attempts:  0,
-		Success:   false,
+// matches reports whether a webhook fires for the event's machine
+func (e *eventScope) matches(webhook *models.Webhook) bool {
+	if !webhook.Scoped() {
+		return true
+	}
+	if !e.found {
+		return false
 	}
 
-	maxRetries := webhook.MaxRetries
-	if maxRetries == 0 {
-		maxRetries = 3
+	if len(webhook.GroupIDs) > 0 {
+		inGroup := false
+		for _, id := range webhook.GroupIDs {
+			inGroup = inGroup || e.groups[id]
+		}
+		if !inGroup {
+			return false
+		}
 	}
 
+	if len(webhook.Tags) > 0 {
+		tagged := false
+		for _, tag := range webhook.Tags {
+			tagged = tagged || models.HasTag(e.tags, tag)
+		}
+		if !tagged {
+			return false
+		}
+	}
+
+	if len(webhook.Statuses) > 0 {
+		for _, status := range webhook.Statuses {
+			if status == e.status {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// encodePayload encodes an event in the schema version the webhook is
+// pinned to, and in its format. Webhooks saved before versions existed
+// receive version 1.
+func (s *Service) encodePayload(webhook *models.Webhook, event events.Event, machine *events.MachineSnapshot, data map[string]interface{}) ([]byte, error) {
+	schema := webhook.SchemaVersion
+	if schema == "" {
+		schema = "1"
+	}
+
+	var payload []byte
+	var err error
+	switch schema {
+	case "1":
+		payload, err = json.Marshal(EventPayload{
+			Schema:    schema,
+			ID:        event.ID,
+			Sequence:  event.Sequence,
+			Event:     event.Type,
+			Timestamp: event.Timestamp,
+			Machine:   machine,
+			Data:      data,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported schema version %q", schema)
+	}
+	if err != nil || webhook.Format != models.WebhookFormatCloudEvents {
+		return payload, err
+	}
+
+	return json.Marshal(CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              event.ID,
+		Source:          s.source,
+		Type:            cloudEventTypePrefix + event.Type,
+		Subject:         event.MachineID,
+		Time:            event.Timestamp,
+		DataContentType: "application/json",
+		Data:            payload,
+	})
+}
+
+// contentType is the Content-Type of a webhook's deliveries
+func contentType(webhook *models.Webhook) string {
+	if webhook.Format == models.WebhookFormatCloudEvents {
+		return "application/cloudevents+json"
+	}
+	return "application/json"
+}
+
+// Test sends a webhook.test event to a webhook, once and whether or not it
+// is active or subscribed to it, so its receiver can be checked end to
+// end. The delivery is recorded like any other.
+func (s *Service) Test(webhook *models.Webhook) (*models.WebhookDelivery, error) {
+	event := events.Event{
+		Type:      TestEvent,
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
+	}
+	payload, err := s.encodePayload(webhook, event, nil, map[string]interface{}{
+		"webhook_id": webhook.ID,
+		"message":    "This is a test delivery from metal-enrollment",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	once := *webhook
+	once.MaxRetries = 1
+	once.Retry = nil
+	return s.sendWebhook(&once, event, payload), nil
+}
+
+// selectFields returns the listed keys of data, and machine_id. Without a
+// list, all of data is sent.
+func selectFields(data map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return data
+	}
+
+	selected := map[string]interface{}{}
+	if id, ok := data["machine_id"]; ok {
+		selected["machine_id"] = id
+	}
+	for _, field := range fields {
+		if v, ok := data[field]; ok {
+			selected[field] = v
+		}
+	}
+	return selected
+}
+
+// sendWebhook delivers a payload, retrying as the webhook allows, and
+// records the delivery
+func (s *Service) sendWebhook(webhook *models.Webhook, event events.Event, payload []byte) *models.WebhookDelivery {
+	delivery := &models.WebhookDelivery{
+		WebhookID:   webhook.ID,
+		EventID:     event.ID,
+		Event:       event.Type,
+		MachineID:   event.MachineID,
+		Payload:     string(payload),
+		PayloadSize: len(payload),
+		Attempts:    0,
+		Success:     false,
+	}
+
+	policy := resolveRetryPolicy(webhook, event.Type)
+
 	timeout := time.Duration(webhook.Timeout) * time.Second
 	if timeout == 0 {
 		timeout = 30 * time.Second
 	}
 
-	client := &http.Client{
-		Timeout: timeout,
-	}
+	// The URL was checked when the webhook was saved, but its host may
+	// resolve elsewhere now, so every connection is checked again. The
+	// scheme was checked then too, against settings the builder lacks.
+	client := netguard.New(netguard.Policy{
+		AllowHTTP:    true,
+		AllowPrivate: webhook.AllowPrivateNetworks,
+	}).Client(timeout)
+	defer client.CloseIdleConnections()
 
 	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
+	for attempt := 1; attempt <= policy.attempts; attempt++ {
 		delivery.Attempts = attempt
+		record := models.WebhookDeliveryAttempt{Attempt: attempt, StartedAt: time.Now()}
 
-		req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+		req, err := s.newRequest(webhook, payload)
 		if err != nil {
+			// A request that can't be built won't be on the next attempt
 			lastErr = err
-			continue
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", "Metal-Enrollment-Webhook/1.0")
-
-		// Add custom headers
-		if webhook.Headers != nil {
-			var headers map[string]string
-			if err := json.Unmarshal(webhook.Headers, &headers); err == nil {
-				for key, value := range headers {
-					req.Header.Set(key, value)
-				}
-			}
-		}
-
-		// Add HMAC signature if secret is configured
-		if webhook.Secret != "" {
-			signature := s.generateSignature(payload, webhook.Secret)
-			req.Header.Set("X-Webhook-Signature", signature)
+			record.Error = err.Error()
+			delivery.AttemptHistory = append(delivery.AttemptHistory, record)
+			break
 		}
 
+		var wait time.Duration
 		resp, err := client.Do(req)
+		recordDuration(delivery, record.StartedAt)
+		record.DurationMS = *delivery.DurationMS
 		if err != nil {
 			lastErr = err
-			log.Printf("Webhook delivery attempt %d/%d failed for %s: %v", attempt, maxRetries, webhook.Name, err)
-
-			// Exponential backoff
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
-			}
-			continue
-		}
+			record.Error = err.Error()
+			delivery.StatusCode = 0
+			delivery.Response = ""
+			log.Printf("Webhook delivery attempt %d/%d failed for %s: %v", attempt, policy.attempts, webhook.Name, err)
+		} else {
+			// Read response, keeping only the start of it
+			responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+			resp.Body.Close()
 
-		// Read response
-		responseBody, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
+			delivery.StatusCode = resp.StatusCode
+			delivery.Response = string(responseBody)
+			record.StatusCode = resp.StatusCode
 
-		delivery.StatusCode = resp.StatusCode
-		delivery.Response = string(responseBody)
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				delivery.Success = true
+				now := time.Now()
+				delivery.CompletedAt = &now
+				delivery.AttemptHistory = append(delivery.AttemptHistory, record)
 
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			delivery.Success = true
-			now := time.Now()
-			delivery.CompletedAt = &now
+				// Update webhook last success
+				s.db.UpdateWebhookDeliveryStatus(webhook.ID, true)
 
-			// Update webhook last success
-			s.db.UpdateWebhookDeliveryStatus(webhook.ID, true)
+				log.Printf("Webhook delivered successfully to %s (attempt %d/%d)", webhook.Name, attempt, policy.attempts)
+				break
+			}
 
-			log.Printf("Webhook delivered successfully to %s (attempt %d/%d)", webhook.Name, attempt, maxRetries)
-			break
-		} else {
 			lastErr = fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(responseBody))
-			log.Printf("Webhook delivery attempt %d/%d returned HTTP %d for %s", attempt, maxRetries, resp.StatusCode, webhook.Name)
+			wait = retryAfter(resp, time.Now())
+			log.Printf("Webhook delivery attempt %d/%d returned HTTP %d for %s", attempt, policy.attempts, resp.StatusCode, webhook.Name)
+		}
 
-			// Exponential backoff
-			if attempt < maxRetries {
-				time.Sleep(time.Duration(attempt) * time.Second)
+		retry := attempt < policy.attempts && policy.retryable(record.StatusCode)
+		if retry {
+			wait = policy.wait(attempt, wait)
+			record.RetryInMS = wait.Milliseconds()
+		}
+		delivery.AttemptHistory = append(delivery.AttemptHistory, record)
+		if !retry {
+			if attempt < policy.attempts {
+				log.Printf("Not retrying webhook delivery to %s: its retry policy doesn't cover the failure", webhook.Name)
 			}
+			break
 		}
+		s.sleep(wait)
 	}
 
 	if !delivery.Success {
@@ -171,12 +500,140 @@ func (s *Service) sendWebhook(webhook *models.Webhook, payload []byte) {
 		s.db.UpdateWebhookDeliveryStatus(webhook.ID, false)
 
 		log.Printf("Webhook delivery failed after %d attempts to %s: %v", delivery.Attempts, webhook.Name, lastErr)
+
+		// Test deliveries check a receiver without counting against it
+		if event.Type != TestEvent {
+			s.addFailure(webhook, delivery)
+		}
 	}
 
-	// Store delivery record
+	// Store delivery record, with as much of the payload as is kept
+	if len(delivery.Payload) > models.MaxStoredWebhookPayload {
+		delivery.Payload = strings.ToValidUTF8(delivery.Payload[:models.MaxStoredWebhookPayload], "")
+		delivery.PayloadTruncated = true
+	}
 	if err := s.db.CreateWebhookDelivery(delivery); err != nil {
 		log.Printf("Failed to store webhook delivery record: %v", err)
 	}
+
+	for _, handler := range s.onDelivery {
+		handler(webhook, delivery)
+	}
+
+	return delivery
+}
+
+// newRequest builds a delivery's request, with the webhook's headers and
+// signature
+func (s *Service) newRequest(webhook *models.Webhook, payload []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType(webhook))
+	req.Header.Set("User-Agent", "Metal-Enrollment-Webhook/1.0")
+
+	// Add custom headers
+	if webhook.Headers != nil {
+		var headers map[string]string
+		if err := json.Unmarshal(webhook.Headers, &headers); err == nil {
+			for key, value := range headers {
+				req.Header.Set(key, value)
+			}
+		}
+	}
+
+	// Add HMAC signature if secret is configured
+	if webhook.Secret != "" {
+		signature := s.generateSignature(payload, webhook.Secret)
+		req.Header.Set("X-Webhook-Signature", signature)
+	}
+	return req, nil
+}
+
+// failureWeight is how much a failed delivery adds to its webhook's failure
+// streak, by the status of the last response. A receiver that was
+// unreachable, or answered with a 5xx, 408, or 429, may recover by itself,
+// and counts once; one refusing deliveries with another 4xx needs fixing,
+// and counts twice. gone is set for 410 Gone, which deactivates the webhook
+// at once.
+func failureWeight(statusCode int) (weight int, gone bool) {
+	switch {
+	case statusCode == http.StatusGone:
+		return 1, true
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests:
+		return 1, false
+	case statusCode >= 400 && statusCode < 500:
+		return 2, false
+	default:
+		return 1, false
+	}
+}
+
+// addFailure adds a failed delivery to its webhook's failure streak, and
+// deactivates the webhook if the streak has gone on long enough or the
+// receiver is gone
+func (s *Service) addFailure(webhook *models.Webhook, delivery *models.WebhookDelivery) {
+	weight, gone := failureWeight(delivery.StatusCode)
+	current, err := s.db.AddWebhookFailures(webhook.ID, weight)
+	if err != nil {
+		log.Printf("Failed to record failure of webhook %s: %v", webhook.Name, err)
+		return
+	}
+	if current == nil || !current.Active || current.FailingSince == nil {
+		return
+	}
+
+	failures, after := s.FailureLimit(current)
+	var reason string
+	switch {
+	case failures == 0:
+		return
+	case gone:
+		reason = "the receiver responded 410 Gone"
+	case current.ConsecutiveFailures >= failures && time.Since(*current.FailingSince) >= after:
+		reason = fmt.Sprintf("failure streak of %d since %s", current.ConsecutiveFailures,
+			current.FailingSince.UTC().Format(time.RFC3339))
+	default:
+		return
+	}
+
+	disabled, err := s.db.AutoDisableWebhook(current.ID, reason)
+	if err != nil {
+		log.Printf("Failed to deactivate webhook %s: %v", current.Name, err)
+		return
+	}
+	if !disabled {
+		return // Deactivated by another delivery, or by hand
+	}
+	log.Printf("Deactivated webhook %s: %s", current.Name, reason)
+
+	if s.publisher == nil {
+		return
+	}
+	err = s.publisher.Publish(context.Background(), events.Event{
+		Type: events.WebhookAutoDisabled,
+		Data: events.WebhookAutoDisabledData{
+			WebhookID:           current.ID,
+			Name:                current.Name,
+			ConsecutiveFailures: current.ConsecutiveFailures,
+			FailingSince:        *current.FailingSince,
+			StatusCode:          delivery.StatusCode,
+			Error:               delivery.Error,
+			Reason:              reason,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to publish deactivation of webhook %s: %v", current.Name, err)
+	}
+}
+
+// recordDuration sets a delivery's duration to that of the attempt started
+// at started
+func recordDuration(delivery *models.WebhookDelivery, started time.Time) {
+	ms := time.Since(started).Milliseconds()
+	delivery.DurationMS = &ms
 }
 
 func (s *Service) generateSignature(payload []byte, secret string) string {
@@ -0,0 +1,62 @@
+package wol
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// DefaultBroadcastAddr is the limited broadcast address on the discard port,
+// where NICs listen for magic packets
+const DefaultBroadcastAddr = "255.255.255.255:9"
+
+// MagicPacket returns the Wake-on-LAN magic packet for the NIC with the MAC
+// address mac: six 0xFF bytes followed by the address sixteen times
+func MagicPacket(mac string) ([]byte, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAC address %q: %w", mac, err)
+	}
+	if len(hw) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q: Wake-on-LAN needs a 48-bit address", mac)
+	}
+
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, hw...)
+	}
+	return packet, nil
+}
+
+// Send broadcasts a magic packet for the NIC with the MAC address mac to
+// broadcastAddr, a host:port such as DefaultBroadcastAddr or a subnet's
+// directed broadcast address. The sender has to be on the NIC's segment,
+// or on a network that forwards directed broadcasts to it.
+func Send(mac, broadcastAddr string) error {
+	packet, err := MagicPacket(mac)
+	if err != nil {
+		return err
+	}
+
+	if broadcastAddr == "" {
+		broadcastAddr = DefaultBroadcastAddr
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", broadcastAddr)
+	if err != nil {
+		return fmt.Errorf("invalid broadcast address %q: %w", broadcastAddr, err)
+	}
+
+	// The Go runtime enables SO_BROADCAST on UDP sockets, so the
+	// connection can send to broadcast addresses
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return fmt.Errorf("failed to open socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(packet); err != nil {
+		return fmt.Errorf("failed to send magic packet: %w", err)
+	}
+	return nil
+}